@@ -19,13 +19,28 @@
 package commandv2
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/megaease/easegress/v2/cmd/client/general"
 	"github.com/megaease/easegress/v2/cmd/client/resources"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/consumers"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/corpus"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/usagestore"
 	"github.com/megaease/easegress/v2/pkg/util/codectool"
 	"github.com/spf13/cobra"
 )
@@ -37,6 +52,39 @@ func AICmd() *cobra.Command {
 		{Desc: "Disable AI (Delete the AIGatewayController)", Command: "egctl disable"},
 		{Desc: "Get AI statistics", Command: "egctl ai stat"},
 		{Desc: "Check AI health of providers", Command: "egctl ai check"},
+		{Desc: "Flush connections of a provider", Command: "egctl ai flush <provider>"},
+		{Desc: "List the effective specs of providers with templates merged", Command: "egctl ai providers -o yaml"},
+		{Desc: "List the TTFT SLO states and demotions of providers", Command: "egctl ai providers slo"},
+		{Desc: "Pin the weight of a provider in provider groups", Command: "egctl ai providers pin <provider> --weight-factor 0.5"},
+		{Desc: "List middlewares and their states", Command: "egctl ai middlewares"},
+		{Desc: "Disable a middleware at runtime", Command: "egctl ai middlewares disable <middleware>"},
+		{Desc: "Enable a middleware at runtime", Command: "egctl ai middlewares enable <middleware>"},
+		{Desc: "Probe the lookup of a middleware with a sample prompt", Command: "egctl ai middlewares probe <middleware> <prompt>"},
+		{Desc: "Purge the caches of a middleware on all members", Command: "egctl ai middlewares purge <middleware>"},
+		{Desc: "Quarantine the documents with invalid vectors of a middleware", Command: "egctl ai middlewares scrub <middleware>"},
+		{Desc: "Move the collections of a middleware created before the scope is set under the scope", Command: "egctl ai middlewares migrate-scope <middleware>"},
+		{Desc: "Check whether the documents of a middleware are all indexed", Command: "egctl ai middlewares integrity <middleware> --start"},
+		{Desc: "Move the documents of a sharded middleware to the shards owning them", Command: "egctl ai middlewares rebalance <middleware> --start"},
+		{Desc: "Chunk and ingest documents into the collection of a retrieval middleware", Command: "egctl ai middlewares ingest <middleware> <file>..."},
+		{Desc: "Get the agreement of the cache hits of a middleware with fresh generations", Command: "egctl ai middlewares evaluation <middleware>"},
+		{Desc: "Count the cache entries of a middleware by schema version", Command: "egctl ai middlewares schema-versions <middleware>"},
+		{Desc: "Estimate the cost and duration of re-embedding the documents of a middleware", Command: "egctl ai middlewares reembed <middleware> --dry-run"},
+		{Desc: "Import the request logs on the gateway into the cache of a middleware", Command: "egctl ai middlewares import <middleware> --start --path <file>"},
+		{Desc: "Evaluate feature flags for a consumer", Command: "egctl ai flags <consumer>"},
+		{Desc: "Get AI usage of the last 7 days by consumer and model", Command: "egctl ai usage --group-by consumer,model"},
+		{Desc: "List endpoints served by AI Gateway", Command: "egctl ai endpoints"},
+		{Desc: "Trace the routing and policy decisions of a request without sending it", Command: "egctl ai simulate <provider> --consumer <consumer> --model gpt-4o"},
+		{Desc: "Show the request sent to the provider after the middlewares without sending it", Command: "egctl ai dry-run <provider> --body-file <file>"},
+		{Desc: "List the progress of deleting documents of dropped indexes", Command: "egctl ai drains"},
+		{Desc: "List the write queues of vector collections", Command: "egctl ai write-queues"},
+		{Desc: "Get the fill levels of the strata of the sampled corpus", Command: "egctl ai corpus"},
+		{Desc: "List the spec changes of the latest reloads", Command: "egctl ai reloads"},
+		{Desc: "List the metrics of AI Gateway with their labels", Command: "egctl ai metrics"},
+		{Desc: "Pause the vector writes for 10 minutes", Command: "egctl ai write-queues set-rate --rate 0 --duration 10m"},
+		{Desc: "Rotate the API key of a provider after verifying it", Command: "egctl ai providers credentials rotate <provider> --api-key-file <file>"},
+		{Desc: "List the consumers and the prefixes of their keys", Command: "egctl ai consumers"},
+		{Desc: "Create a consumer, its key is only shown once", Command: "egctl ai consumers create <consumer> --group <group>"},
+		{Desc: "Revoke the key of a consumer", Command: "egctl ai consumers revoke <consumer>"},
 	}
 
 	cmd := &cobra.Command{
@@ -52,6 +100,21 @@ func AICmd() *cobra.Command {
 		disableCmd(),
 		statCmd(),
 		checkCmd(),
+		flushCmd(),
+		providersCmd(),
+		middlewaresCmd(),
+		flagsCmd(),
+		usageCmd(),
+		endpointsCmd(),
+		simulateCmd(),
+		dryRunCmd(),
+		drainsCmd(),
+		janitorsCmd(),
+		writeQueuesCmd(),
+		corpusCmd(),
+		reloadsCmd(),
+		metricsCmd(),
+		consumersCmd(),
 		editCmd(),
 	)
 
@@ -209,6 +272,1514 @@ func checkCmd() *cobra.Command {
 	}
 }
 
+func flushCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "flush",
+		Short:   "Flush connections of an AI Gateway provider",
+		Example: createExample("Flush connections of provider openai.", "egctl ai flush openai"),
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			_, err := general.HandleRequest(http.MethodPost, fmt.Sprintf(general.AIProviderFlushURL, args[0]), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			fmt.Printf("Connections of provider %s flushed successfully.\n", args[0])
+		},
+	}
+}
+
+func providersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "providers",
+		Short: "List the effective specs of AI Gateway providers, secrets are shown as hashes",
+		Example: createMultiExample([]general.Example{
+			{Desc: "List the providers and the templates they extend.", Command: "egctl ai providers"},
+			{Desc: "Show the full effective specs of the providers.", Command: "egctl ai providers -o yaml"},
+		}),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIProviderSpecsURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.ProviderSpecsResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"NAME", "PROVIDER-TYPE", "EXTENDS", "BASE-URL"},
+			}
+			for _, p := range resp.Providers {
+				field := func(name string) string {
+					s, _ := p[name].(string)
+					return s
+				}
+				table = append(table, []string{field("name"), field("providerType"), field("extends"), field("baseURL")})
+			}
+			general.PrintTable(table)
+		},
+	}
+	cmd.AddCommand(providerSLOCmd(), pinProviderCmd(), unpinProviderCmd(), credentialsCmd())
+	return cmd
+}
+
+func providerSLOCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "slo",
+		Short: "List the TTFT SLO states of providers, including demotions and pins",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIProviderSLOURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printProviderSLO(body)
+		},
+	}
+}
+
+func pinProviderCmd() *cobra.Command {
+	var weightFactor float64
+	cmd := &cobra.Command{
+		Use:   "pin",
+		Short: "Pin the weight factor of a provider in provider groups, overriding the SLO demotions",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Keep the full weight of provider openai regardless of its TTFT.", Command: "egctl ai providers pin openai"},
+			{Desc: "Move most traffic away from provider openai.", Command: "egctl ai providers pin openai --weight-factor 0.1"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			req := &aigatewaycontroller.PinRequest{WeightFactor: &weightFactor}
+			body, err := general.HandleRequest(http.MethodPost, fmt.Sprintf(general.AIProviderPinURL, args[0]), codectool.MustMarshalJSON(req))
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printProviderSLO(body)
+		},
+	}
+	cmd.Flags().Float64Var(&weightFactor, "weight-factor", 1, "Factor of the weight of the provider, in [0, 1]")
+	return cmd
+}
+
+func unpinProviderCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "unpin",
+		Short:   "Unpin a provider, so the SLO demotions apply again",
+		Example: createExample("Unpin provider openai.", "egctl ai providers unpin openai"),
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodDelete, fmt.Sprintf(general.AIProviderPinURL, args[0]), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printProviderSLO(body)
+		},
+	}
+}
+
+func credentialsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "credentials",
+		Short: "List the API keys of a provider by fingerprint, with their requests and errors",
+		Example: createMultiExample([]general.Example{
+			{Desc: "List the API keys of provider openai.", Command: "egctl ai providers credentials openai"},
+			{Desc: "Send 10% of requests with a new API key for 30 minutes before retiring the old one.", Command: "egctl ai providers credentials rotate openai --api-key-file key.txt --mode staged --percentage 10 --soak 30m"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, fmt.Sprintf(general.AIProviderKeysURL, args[0]), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printCredentials(body)
+		},
+	}
+	cmd.AddCommand(rotateCredentialCmd(), abortCredentialRotationCmd())
+	return cmd
+}
+
+func rotateCredentialCmd() *cobra.Command {
+	var apiKey, apiKeyFile string
+	rotation := &providers.CredentialRotation{}
+	cmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Verify a new API key of a provider by a canary request, and rotate to it if it succeeds",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Replace the API keys of provider openai by the key in key.txt.", Command: "egctl ai providers credentials rotate openai --api-key-file key.txt"},
+			{Desc: "Add a new API key to the ones in use.", Command: "egctl ai providers credentials rotate openai --api-key-file key.txt --mode join"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if apiKeyFile != "" {
+				data, err := os.ReadFile(apiKeyFile)
+				if err != nil {
+					general.ExitWithError(err)
+				}
+				apiKey = strings.TrimSpace(string(data))
+			}
+			if apiKey == "" {
+				general.ExitWithErrorf("--api-key or --api-key-file is required")
+			}
+			rotation.APIKey = apiKey
+			body, err := general.HandleRequest(http.MethodPost, fmt.Sprintf(general.AIProviderKeysURL, args[0]), codectool.MustMarshalJSON(rotation))
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printCredentials(body)
+		},
+	}
+	cmd.Flags().StringVar(&apiKey, "api-key", "", "The new API key, prefer --api-key-file to keep it out of the shell history")
+	cmd.Flags().StringVar(&apiKeyFile, "api-key-file", "", "File containing the new API key")
+	cmd.Flags().StringVar(&rotation.Mode, "mode", providers.CredentialModeReplace, "Mode of the rotation, replace, join or staged")
+	cmd.Flags().IntVar(&rotation.Percentage, "percentage", 0, "Percentage of requests sent with the new API key during the soak of a staged rotation")
+	cmd.Flags().StringVar(&rotation.Soak, "soak", "", "How long a staged rotation lasts before the old API keys are retired, default 10m")
+	return cmd
+}
+
+func abortCredentialRotationCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "abort",
+		Short:   "Remove the new API key of the staged rotation of a provider, the API keys in use are kept",
+		Example: createExample("Abort the staged rotation of provider openai.", "egctl ai providers credentials abort openai"),
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodDelete, fmt.Sprintf(general.AIProviderStagedURL, args[0]), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printCredentials(body)
+		},
+	}
+}
+
+func printCredentials(body []byte) {
+	if !general.CmdGlobalFlags.DefaultFormat() {
+		general.PrintBody(body)
+		return
+	}
+
+	var status providers.CredentialStatus
+	err := codectool.UnmarshalJSON(body, &status)
+	if err != nil {
+		general.ExitWithError(err)
+	}
+
+	table := [][]string{
+		{"FINGERPRINT", "STATE", "PERCENTAGE", "SOAK-ENDS-AT", "ADDED-AT", "REQUESTS", "ERRORS"},
+	}
+	for _, c := range status.Credentials {
+		percentage := ""
+		if c.Percentage > 0 {
+			percentage = strconv.Itoa(c.Percentage) + "%"
+		}
+		table = append(table, []string{
+			c.Fingerprint, c.State, percentage, c.SoakEndsAt, c.AddedAt,
+			strconv.FormatInt(c.Requests, 10), strconv.FormatInt(c.Errors, 10),
+		})
+	}
+	general.PrintTable(table)
+}
+
+func printProviderSLO(body []byte) {
+	if !general.CmdGlobalFlags.DefaultFormat() {
+		general.PrintBody(body)
+		return
+	}
+
+	var resp aigatewaycontroller.ProviderSLOResponse
+	err := codectool.UnmarshalJSON(body, &resp)
+	if err != nil {
+		general.ExitWithError(err)
+	}
+
+	table := [][]string{
+		{"PROVIDER", "TARGET", "PERCENTILE", "SAMPLES", "WEIGHT-FACTOR", "DEMOTED-AT", "PINNED-BY"},
+	}
+	for _, p := range resp.Providers {
+		table = append(table, []string{
+			p.Provider, p.Target, p.Percentile, strconv.Itoa(p.Samples),
+			strconv.FormatFloat(p.WeightFactor, 'g', 3, 64), p.DemotedAt, p.PinnedBy,
+		})
+	}
+	general.PrintTable(table)
+}
+
+func middlewaresCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "middlewares",
+		Short: "List AI Gateway middlewares and their states",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIMiddlewaresURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.MiddlewaresResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"NAME", "KIND", "ENABLED", "UPDATED-BY", "UPDATED-AT"},
+			}
+			for _, m := range resp.Middlewares {
+				enabled := "NO"
+				if m.Enabled {
+					enabled = "YES"
+				}
+				table = append(table, []string{m.Name, m.Kind, enabled, m.UpdatedBy, m.UpdatedAt})
+			}
+			general.PrintTable(table)
+		},
+	}
+
+	toggleCmd := func(action string) *cobra.Command {
+		return &cobra.Command{
+			Use:     action,
+			Short:   fmt.Sprintf("%s an AI Gateway middleware at runtime", strings.ToUpper(action[:1])+action[1:]),
+			Example: createExample(fmt.Sprintf("%s middleware topic-guard.", strings.ToUpper(action[:1])+action[1:]), fmt.Sprintf("egctl ai middlewares %s topic-guard", action)),
+			Args:    cobra.ExactArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				_, err := general.HandleRequest(http.MethodPost, fmt.Sprintf(general.AIMiddlewareURL, args[0], action), nil)
+				if err != nil {
+					general.ExitWithError(err)
+				}
+				fmt.Printf("Middleware %s %sd successfully.\n", args[0], action)
+			},
+		}
+	}
+	cmd.AddCommand(toggleCmd("enable"), toggleCmd("disable"), probeCmd(), purgeCmd(), scrubCmd(), migrateScopeCmd(), integrityCmd(), rebalanceCmd(), ingestCmd(), evaluationCmd(), schemaVersionsCmd(), reembedCmd(), importCmd())
+	return cmd
+}
+
+func probeCmd() *cobra.Command {
+	probeReq := &aigatewaycontroller.ProbeRequest{}
+	cmd := &cobra.Command{
+		Use:     "probe",
+		Short:   "Probe the lookup of an AI Gateway middleware with a sample prompt",
+		Example: createExample("Show the top 10 cache candidates of a prompt.", "egctl ai middlewares probe semantic-cache 'What is Easegress?' --top-k 10"),
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			probeReq.Prompt = args[1]
+			body, err := general.HandleRequest(http.MethodPost, fmt.Sprintf(general.AIMiddlewareProbeURL, args[0]), codectool.MustMarshalJSON(probeReq))
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			general.PrintBody(body)
+		},
+	}
+	cmd.Flags().IntVar(&probeReq.TopK, "top-k", 0, "Number of candidates to return, default 5")
+	cmd.Flags().BoolVar(&probeReq.Stream, "stream", false, "Probe as a streaming request")
+	cmd.Flags().StringVar(&probeReq.Model, "model", "", "Model of the sample request")
+	return cmd
+}
+
+func purgeCmd() *cobra.Command {
+	var fallback bool
+	cmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Purge the caches of an AI Gateway middleware",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Purge the caches of middleware semantic-cache.", Command: "egctl ai middlewares purge semantic-cache"},
+			{Desc: "Drop the fallback of middleware semantic-cache once it is re-embedded.", Command: "egctl ai middlewares purge semantic-cache --fallback"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			u := fmt.Sprintf(general.AIMiddlewareURL, args[0], "purge")
+			if fallback {
+				u += "?fallback=true"
+			}
+			body, err := general.HandleRequest(http.MethodPost, u, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			general.PrintBody(body)
+		},
+	}
+	cmd.Flags().BoolVar(&fallback, "fallback", false, "Only drop the fallback of the cache")
+	return cmd
+}
+
+func scrubCmd() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "scrub",
+		Short: "Quarantine the documents with invalid vectors in the collections of an AI Gateway middleware",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Quarantine the documents with invalid vectors of middleware semantic-cache.", Command: "egctl ai middlewares scrub semantic-cache"},
+			{Desc: "Report the documents with invalid vectors without moving them.", Command: "egctl ai middlewares scrub semantic-cache --dry-run"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			u := fmt.Sprintf(general.AIMiddlewareURL, args[0], "scrub")
+			if dryRun {
+				u += "?dryRun=true"
+			}
+			body, err := general.HandleRequest(http.MethodPost, u, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			general.PrintBody(body)
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only report the documents with invalid vectors")
+	return cmd
+}
+
+func migrateScopeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "migrate-scope",
+		Short:   "Move the collections of an AI Gateway middleware created before the scope of the controller is set under the scope",
+		Example: createExample("Move the collections of middleware semantic-cache under the scope.", "egctl ai middlewares migrate-scope semantic-cache"),
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodPost, fmt.Sprintf(general.AIMiddlewareURL, args[0], "scopemigration"), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			general.PrintBody(body)
+		},
+	}
+}
+
+func integrityCmd() *cobra.Command {
+	var start, repair bool
+	cmd := &cobra.Command{
+		Use:   "integrity",
+		Short: "Check whether the documents in the collections of an AI Gateway middleware are all indexed",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Get the progress or the results of the last checks of middleware semantic-cache.", Command: "egctl ai middlewares integrity semantic-cache"},
+			{Desc: "Start checking the collections of middleware semantic-cache.", Command: "egctl ai middlewares integrity semantic-cache --start"},
+			{Desc: "Start checking and touch the documents to be indexed again if discrepancies are found.", Command: "egctl ai middlewares integrity semantic-cache --start --repair"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if repair && !start {
+				general.ExitWithErrorf("--repair must be used with --start")
+			}
+			u := fmt.Sprintf(general.AIMiddlewareURL, args[0], "integrity")
+			method := http.MethodGet
+			if start {
+				method = http.MethodPost
+				if repair {
+					u += "?repair=true"
+				}
+			}
+			body, err := general.HandleRequest(method, u, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var result middlewares.IntegrityResult
+			err = codectool.UnmarshalJSON(body, &result)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			table := [][]string{{"COLLECTION", "STATUS", "SCANNED", "INDEXED", "MISSING", "SAMPLED", "UNSEARCHABLE", "TOUCHED", "STARTED-AT"}}
+			for _, r := range result.Reports {
+				table = append(table, []string{
+					r.Collection, r.Status, fmt.Sprint(r.ScannedKeys), fmt.Sprint(r.IndexedDocs), fmt.Sprint(r.Missing),
+					fmt.Sprint(r.Sampled), fmt.Sprint(len(r.Unsearchable)), fmt.Sprint(r.Touched), r.StartedAt,
+				})
+			}
+			general.PrintTable(table)
+		},
+	}
+	cmd.Flags().BoolVar(&start, "start", false, "Start checking instead of getting the results of the last checks")
+	cmd.Flags().BoolVar(&repair, "repair", false, "Touch the documents to be indexed again if discrepancies are found")
+	return cmd
+}
+
+func rebalanceCmd() *cobra.Command {
+	var start bool
+	cmd := &cobra.Command{
+		Use:   "rebalance",
+		Short: "Move the documents in the sharded collections of an AI Gateway middleware to the shards owning them",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Get the progress or the results of the last rebalances of middleware semantic-cache.", Command: "egctl ai middlewares rebalance semantic-cache"},
+			{Desc: "Start rebalancing the collections of middleware semantic-cache after shards are added or removed.", Command: "egctl ai middlewares rebalance semantic-cache --start"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			method := http.MethodGet
+			if start {
+				method = http.MethodPost
+			}
+			body, err := general.HandleRequest(method, fmt.Sprintf(general.AIMiddlewareURL, args[0], "rebalance"), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var result middlewares.RebalanceResult
+			err = codectool.UnmarshalJSON(body, &result)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			table := [][]string{{"COLLECTION", "STATUS", "SCANNED", "MOVED", "CONFLICTS", "STARTED-AT", "ERROR"}}
+			for _, r := range result.Reports {
+				table = append(table, []string{
+					r.Collection, r.Status, fmt.Sprint(r.ScannedKeys), fmt.Sprint(r.Moved), fmt.Sprint(r.Conflicts), r.StartedAt, r.Error,
+				})
+			}
+			general.PrintTable(table)
+		},
+	}
+	cmd.Flags().BoolVar(&start, "start", false, "Start rebalancing instead of getting the results of the last rebalances")
+	return cmd
+}
+
+func schemaVersionsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema-versions",
+		Short: "Count the entries in the collections of an AI Gateway middleware by schema version",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Count the entries of middleware semantic-cache by schema version.", Command: "egctl ai middlewares schema-versions semantic-cache"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, fmt.Sprintf(general.AIMiddlewareURL, args[0], "schemaversions"), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var result middlewares.SchemaVersionResult
+			err = codectool.UnmarshalJSON(body, &result)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			fmt.Printf("Current schema version: %d\n", result.Current)
+			table := [][]string{{"COLLECTION", "VERSION", "ENTRIES", "ERROR"}}
+			for _, r := range result.Reports {
+				versions := slices.Sorted(maps.Keys(r.Versions))
+				if len(versions) == 0 {
+					table = append(table, []string{r.Collection, "-", "0", r.Error})
+				}
+				for _, version := range versions {
+					table = append(table, []string{r.Collection, fmt.Sprint(version), fmt.Sprint(r.Versions[version]), r.Error})
+				}
+			}
+			general.PrintTable(table)
+		},
+	}
+	return cmd
+}
+
+func reembedCmd() *cobra.Command {
+	var dryRun, start, abort bool
+	req := &middlewares.ReembedRequest{}
+	cmd := &cobra.Command{
+		Use:   "reembed",
+		Short: "Re-embed the documents of an AI Gateway middleware with its current embedding model",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Get the progress of the re-embedding of middleware retrieval.", Command: "egctl ai middlewares reembed retrieval"},
+			{Desc: "Estimate the documents, tokens, cost and duration without embedding anything.", Command: "egctl ai middlewares reembed retrieval --dry-run --requests-per-second 50"},
+			{Desc: "Start re-embedding with a daily spend cap of 20 USD.", Command: "egctl ai middlewares reembed retrieval --start --requests-per-second 50 --daily-spend-cap 20"},
+			{Desc: "Abort the running re-embedding, starting it again resumes from where it stops.", Command: "egctl ai middlewares reembed retrieval --abort"},
+			{Desc: "Copy the fallback of middleware semantic-cache into the primary cache with the current embedding model.", Command: "egctl ai middlewares reembed semantic-cache --start"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if dryRun && start || dryRun && abort || start && abort {
+				general.ExitWithErrorf("only one of --dry-run, --start and --abort can be used")
+			}
+			u := fmt.Sprintf(general.AIMiddlewareURL, args[0], "reembed")
+			method, reqBody := http.MethodGet, []byte(nil)
+			switch {
+			case dryRun:
+				method, reqBody = http.MethodPost, codectool.MustMarshalJSON(req)
+				u += "?dryRun=true"
+			case start:
+				method, reqBody = http.MethodPost, codectool.MustMarshalJSON(req)
+			case abort:
+				method = http.MethodDelete
+			}
+			body, err := general.HandleRequest(method, u, reqBody)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			if dryRun {
+				var plan middlewares.ReembedPlan
+				if err := codectool.UnmarshalJSON(body, &plan); err != nil {
+					general.ExitWithError(err)
+				}
+				printReembedPlan(&plan)
+				return
+			}
+			var status middlewares.ReembedStatus
+			if err := codectool.UnmarshalJSON(body, &status); err != nil {
+				general.ExitWithError(err)
+			}
+			printReembedPlan(status.Plan)
+			table := [][]string{
+				{"STATUS", "SCANNED", "REEMBEDDED", "SKIPPED", "TOKENS", "SPENT", "SPENT-TODAY", "STARTED-AT", "PAUSED-UNTIL", "FINISHED-AT", "ERROR"},
+				{
+					status.Status, fmt.Sprint(status.Scanned), fmt.Sprint(status.Reembedded), fmt.Sprint(status.Skipped),
+					fmt.Sprint(status.Tokens), fmt.Sprintf("%.4f", status.Spent), fmt.Sprintf("%.4f", status.SpentToday),
+					status.StartedAt, status.PausedUntil, status.FinishedAt, status.Error,
+				},
+			}
+			general.PrintTable(table)
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only estimate the re-embedding")
+	cmd.Flags().BoolVar(&start, "start", false, "Start re-embedding in the background")
+	cmd.Flags().BoolVar(&abort, "abort", false, "Abort the running re-embedding")
+	cmd.Flags().Float64Var(&req.RequestsPerSecond, "requests-per-second", 0, "Embedding requests per second, default is 10")
+	cmd.Flags().Int64Var(&req.TokensPerMinute, "tokens-per-minute", 0, "Tokens embedded per minute, default is no limit")
+	cmd.Flags().Float64Var(&req.DailySpendCap, "daily-spend-cap", 0, "Spend of a UTC day in USD, default is no limit")
+	cmd.Flags().Float64Var(&req.PricePerMillion, "price-per-million", 0, "Price of the embedding model in USD per million tokens, default is the pricing of the usage store")
+	cmd.Flags().IntVar(&req.BatchSize, "batch-size", 0, "Documents scanned and written at a time, default is 100")
+	cmd.Flags().IntVar(&req.SampleSize, "sample-size", 0, "Documents sampled to estimate the tokens, default is 1000")
+	return cmd
+}
+
+func importCmd() *cobra.Command {
+	var start, abort bool
+	req := &middlewares.CacheImportRequest{}
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import OpenAI chat completion logs into the cache of an AI Gateway semantic cache middleware",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Get the progress of the import into middleware semantic-cache.", Command: "egctl ai middlewares import semantic-cache"},
+			{Desc: "Import the records of gpt-4o in June 2024 from a file on the gateway, the entries expire in 7 days.", Command: "egctl ai middlewares import semantic-cache --start --path /var/log/openai/requests.jsonl --models gpt-4o --since 2024-06-01T00:00:00Z --until 2024-07-01T00:00:00Z --ttl 168h"},
+			{Desc: "Abort the running import, importing the same file again resumes from where it stops.", Command: "egctl ai middlewares import semantic-cache --abort"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if start && abort {
+				general.ExitWithErrorf("only one of --start and --abort can be used")
+			}
+			u := fmt.Sprintf(general.AIMiddlewareURL, args[0], "import")
+			method, reqBody := http.MethodGet, []byte(nil)
+			switch {
+			case start:
+				if req.Path == "" {
+					general.ExitWithErrorf("--path is required to start importing")
+				}
+				method, reqBody = http.MethodPost, codectool.MustMarshalJSON(req)
+			case abort:
+				method = http.MethodDelete
+			}
+			body, err := general.HandleRequest(method, u, reqBody)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var status middlewares.CacheImportStatus
+			if err := codectool.UnmarshalJSON(body, &status); err != nil {
+				general.ExitWithError(err)
+			}
+			path := ""
+			if status.Request != nil {
+				path = status.Request.Path
+			}
+			table := [][]string{
+				{"PATH", "STATUS", "LINE", "IMPORTED", "SKIPPED", "FAILED", "TOKENS", "STARTED-AT", "FINISHED-AT", "ERROR"},
+				{
+					path, status.Status, fmt.Sprint(status.Line), fmt.Sprint(status.Imported), fmt.Sprint(status.Skipped),
+					fmt.Sprint(status.Failed), fmt.Sprint(status.Tokens), status.StartedAt, status.FinishedAt, status.Error,
+				},
+			}
+			general.PrintTable(table)
+
+			if len(status.SkipReasons)+len(status.FailReasons) > 0 {
+				table = [][]string{{"RESULT", "REASON", "RECORDS"}}
+				for _, reason := range slices.Sorted(maps.Keys(status.SkipReasons)) {
+					table = append(table, []string{"skipped", reason, fmt.Sprint(status.SkipReasons[reason])})
+				}
+				for _, reason := range slices.Sorted(maps.Keys(status.FailReasons)) {
+					table = append(table, []string{"failed", reason, fmt.Sprint(status.FailReasons[reason])})
+				}
+				fmt.Println()
+				general.PrintTable(table)
+			}
+			if len(status.Errors) > 0 {
+				table = [][]string{{"LINE", "REASON", "ERROR"}}
+				for _, e := range status.Errors {
+					table = append(table, []string{fmt.Sprint(e.Line), e.Reason, e.Error})
+				}
+				fmt.Println()
+				general.PrintTable(table)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&start, "start", false, "Start importing in the background")
+	cmd.Flags().BoolVar(&abort, "abort", false, "Abort the running import")
+	cmd.Flags().StringVar(&req.Path, "path", "", "Path of the JSONL file of request and response pairs on the gateway")
+	cmd.Flags().StringSliceVar(&req.Models, "models", nil, "Import the records of the models only, default is all models")
+	cmd.Flags().StringVar(&req.Since, "since", "", "Import the records since the time in RFC3339")
+	cmd.Flags().StringVar(&req.Until, "until", "", "Import the records before the time in RFC3339")
+	cmd.Flags().IntVar(&req.MinResponseLength, "min-response-length", 0, "Skip the records whose response content has fewer characters")
+	cmd.Flags().Float64Var(&req.RequestsPerSecond, "requests-per-second", 0, "Embedding requests per second, default is 10")
+	cmd.Flags().Int64Var(&req.TokensPerMinute, "tokens-per-minute", 0, "Tokens embedded per minute, default is no limit")
+	cmd.Flags().StringVar(&req.TTL, "ttl", "", "Time to live of the imported entries, default is the TTL of the vector database")
+	cmd.Flags().StringVar(&req.Source, "source", "", "Provenance marker of the imported entries, default is import")
+	return cmd
+}
+
+func printReembedPlan(plan *middlewares.ReembedPlan) {
+	if plan == nil {
+		return
+	}
+	table := [][]string{
+		{"COLLECTION", "MODEL", "EMBEDDING-VERSION", "DOCUMENTS", "PENDING", "SAMPLED", "ESTIMATED-TOKENS", "ESTIMATED-COST", "ESTIMATED-DURATION"},
+		{
+			plan.Collection, plan.Model, plan.EmbeddingVersion, fmt.Sprint(plan.Documents), fmt.Sprint(plan.Pending),
+			fmt.Sprint(plan.Sampled), fmt.Sprint(plan.EstimatedTokens), fmt.Sprintf("%.4f", plan.EstimatedCost), plan.EstimatedDuration,
+		},
+	}
+	general.PrintTable(table)
+}
+
+func ingestCmd() *cobra.Command {
+	var format, docURL, title, chunker string
+	var chunkTokens, overlapTokens int
+	var acl []string
+	cmd := &cobra.Command{
+		Use:   "ingest",
+		Short: "Chunk, embed and ingest documents into the collection of an AI Gateway retrieval middleware",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Ingest the documents into middleware retrieval, the formats are detected by the file extensions.", Command: "egctl ai middlewares ingest retrieval guide.md faq.html notes.txt"},
+			{Desc: "Ingest a document with its URL and title.", Command: "egctl ai middlewares ingest retrieval guide.md --url https://example.com/guide --title Guide"},
+			{Desc: "Ingest a document with chunks of 128 tokens overlapping 16 tokens.", Command: "egctl ai middlewares ingest retrieval guide.txt --chunker fixed --chunk-tokens 128 --overlap-tokens 16"},
+			{Desc: "Ingest documents retrieved only for the consumers in groups hr or finance.", Command: "egctl ai middlewares ingest retrieval payroll.md --acl hr,finance"},
+		}),
+		Args: cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			files := args[1:]
+			if (docURL != "" || title != "") && len(files) > 1 {
+				general.ExitWithErrorf("--url and --title can only be used with one file")
+			}
+
+			req := &middlewares.IngestRequest{}
+			for _, file := range files {
+				content, err := os.ReadFile(file)
+				if err != nil {
+					general.ExitWithError(err)
+				}
+				doc := &middlewares.IngestDocument{Content: string(content), Format: format, URL: docURL, Title: title, ACL: acl}
+				if doc.Format == "" {
+					doc.Format = documentFormat(file)
+				}
+				if doc.URL == "" {
+					doc.URL = file
+				}
+				req.Documents = append(req.Documents, doc)
+			}
+			if chunker != "" || chunkTokens != 0 || overlapTokens != 0 {
+				req.Chunker = &middlewares.RetrievalChunkerSpec{Mode: chunker, ChunkTokens: chunkTokens, OverlapTokens: overlapTokens}
+			}
+
+			reader, err := general.HandleReqWithStreamResp(http.MethodPost, fmt.Sprintf(general.AIMiddlewareURL, args[0], "documents"), codectool.MustMarshalJSON(req))
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			defer reader.Close()
+
+			failed := false
+			r := bufio.NewReader(reader)
+			for {
+				line, err := r.ReadBytes('\n')
+				if err != nil {
+					if err != io.EOF {
+						general.ExitWithError(err)
+					}
+					break
+				}
+				if !general.CmdGlobalFlags.DefaultFormat() {
+					fmt.Print(string(line))
+					continue
+				}
+
+				event := &middlewares.IngestEvent{}
+				if err := codectool.UnmarshalJSON(line, event); err != nil {
+					general.ExitWithError(err)
+				}
+				switch event.Status {
+				case middlewares.IngestStatusEmbedding:
+					fmt.Printf("%s: embedded %d/%d chunks\n", event.URL, event.Embedded, event.Chunks)
+				case middlewares.IngestStatusIngested:
+					fmt.Printf("%s: ingested %d chunks, parent hash %s\n", event.URL, event.Chunks, event.ParentHash)
+				case middlewares.IngestStatusFailed:
+					fmt.Printf("%s: failed: %s\n", event.URL, event.Error)
+				case middlewares.IngestStatusDone:
+					fmt.Printf("done: %d documents, %d failed, %d chunks ingested\n", event.Documents, event.Failed, event.Chunks)
+					failed = event.Failed > 0
+				}
+			}
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "", "Format of the documents: text, markdown or html, detected by the file extensions by default")
+	cmd.Flags().StringVar(&docURL, "url", "", "URL of the document, defaults to the file path")
+	cmd.Flags().StringVar(&title, "title", "", "Title of the document, defaults to the title of the HTML document")
+	cmd.Flags().StringVar(&chunker, "chunker", "", "Chunker overriding the one of the middleware: fixed or structure")
+	cmd.Flags().IntVar(&chunkTokens, "chunk-tokens", 0, "Maximum tokens of a chunk")
+	cmd.Flags().IntVar(&overlapTokens, "overlap-tokens", 0, "Tokens overlapping between the adjacent chunks of the fixed chunker")
+	cmd.Flags().StringSliceVar(&acl, "acl", nil, "Groups of the consumers having access to the documents, requires the acl of the middleware")
+	return cmd
+}
+
+// documentFormat returns the format of the document by its file extension.
+func documentFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".html", ".htm":
+		return middlewares.DocumentFormatHTML
+	case ".md", ".markdown":
+		return middlewares.DocumentFormatMarkdown
+	default:
+		return middlewares.DocumentFormatText
+	}
+}
+
+func evaluationCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "evaluation",
+		Short:   "Get the agreement of the cache hits of an AI Gateway middleware with fresh generations",
+		Example: createExample("Get the evaluation report of middleware semantic-cache.", "egctl ai middlewares evaluation semantic-cache"),
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, fmt.Sprintf(general.AIMiddlewareURL, args[0], "evaluation"), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var report middlewares.EvaluationReport
+			err = codectool.UnmarshalJSON(body, &report)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			row := func(scope string, stats middlewares.EvaluationStats) []string {
+				return []string{scope, fmt.Sprint(stats.Evaluated), fmt.Sprint(stats.Agreed), fmt.Sprintf("%.4f", stats.MeanScore)}
+			}
+			table := [][]string{
+				{"SCOPE", "EVALUATED", "AGREED", "MEAN-SCORE"},
+				row("all", report.EvaluationStats),
+			}
+			for _, m := range report.Models {
+				table = append(table, row("model="+m.Model, m.EvaluationStats))
+			}
+			for _, b := range report.Buckets {
+				table = append(table, row(fmt.Sprintf("score=[%g,%g)", b.From, b.To), b.EvaluationStats))
+			}
+			general.PrintTable(table)
+			fmt.Printf("\nFailed: %d, Skipped: %d\n", report.Failed, report.Skipped)
+		},
+	}
+}
+
+func flagsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "flags",
+		Short:   "Evaluate AI Gateway feature flags for a consumer",
+		Example: createExample("Evaluate feature flags for consumer alice.", "egctl ai flags alice"),
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIFeatureFlagsURL+"?consumer="+url.QueryEscape(args[0]), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.FeatureFlagsResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"NAME", "ENABLED", "REASON"},
+			}
+			for _, f := range resp.Flags {
+				enabled := "NO"
+				if f.Enabled {
+					enabled = "YES"
+				}
+				table = append(table, []string{f.Name, enabled, f.Reason})
+			}
+			general.PrintTable(table)
+		},
+	}
+}
+
+func usageCmd() *cobra.Command {
+	var (
+		days        int
+		bucketWidth string
+		groupBy     string
+		models      string
+		consumers   string
+	)
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Get AI Gateway usage aggregated by the usage store",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Get daily usage of the last 7 days.", Command: "egctl ai usage"},
+			{Desc: "Get hourly usage of gpt-4o of the last day by consumer.", Command: "egctl ai usage --days 1 --bucket-width 1h --models gpt-4o --group-by consumer"},
+		}),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			query := url.Values{}
+			query.Set("start_time", fmt.Sprint(time.Now().Add(-time.Duration(days)*24*time.Hour).Unix()))
+			query.Set("bucket_width", bucketWidth)
+			query.Set("limit", "1000")
+			for name, value := range map[string]string{"group_by": groupBy, "models": models, "consumers": consumers} {
+				if value != "" {
+					query.Set(name, value)
+				}
+			}
+			body, err := general.HandleRequest(http.MethodGet, general.AIUsageURL+"?"+query.Encode(), nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var page usagestore.Page
+			err = codectool.UnmarshalJSON(body, &page)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"START", "CONSUMER", "PROVIDER", "MODEL", "REQUESTS", "FAILED", "INPUT TOKENS", "OUTPUT TOKENS", "COST"},
+			}
+			for _, b := range page.Data {
+				start := time.Unix(b.StartTime, 0).UTC().Format(time.RFC3339)
+				for _, r := range b.Results {
+					table = append(table, []string{
+						start, r.Consumer, r.Provider, r.Model,
+						fmt.Sprint(r.NumModelRequests), fmt.Sprint(r.NumFailedRequests),
+						fmt.Sprint(r.InputTokens), fmt.Sprint(r.OutputTokens),
+						fmt.Sprintf("%.4f", r.Cost),
+					})
+				}
+			}
+			general.PrintTable(table)
+		},
+	}
+	cmd.Flags().IntVar(&days, "days", 7, "Number of days of the usage")
+	cmd.Flags().StringVar(&bucketWidth, "bucket-width", "1d", "Width of the buckets, 1d or a duration dividing a day")
+	cmd.Flags().StringVar(&groupBy, "group-by", "", "Comma separated dimensions to group by: consumer, provider and model")
+	cmd.Flags().StringVar(&models, "models", "", "Comma separated models to filter")
+	cmd.Flags().StringVar(&consumers, "consumers", "", "Comma separated consumers to filter")
+	return cmd
+}
+
+func endpointsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "endpoints",
+		Short: "List AI Gateway endpoints and whether they are exposed",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIEndpointsURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.EndpointsResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"PATH", "METHOD", "EXPOSED"},
+			}
+			for _, e := range resp.Endpoints {
+				exposed := "NO"
+				if e.Exposed {
+					exposed = "YES"
+				}
+				table = append(table, []string{e.Path, e.Method, exposed})
+			}
+			general.PrintTable(table)
+		},
+	}
+}
+
+func simulateCmd() *cobra.Command {
+	req := &aigatewaycontroller.SimulateRequest{}
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Trace the routing and policy decisions of a request without sending it",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Simulate a chat request of a consumer to a provider group.", Command: "egctl ai simulate gpt --consumer alice --model gpt-4o --prompt-tokens 2000"},
+			{Desc: "Simulate a request through the middlewares of a proxy.", Command: "egctl ai simulate openai --middlewares policy,semantic-cache --header X-Feature-Flags=new-prompt=on"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			req.Provider = args[0]
+			body, err := general.HandleRequest(http.MethodPost, general.AISimulateURL, codectool.MustMarshalJSON(req))
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.SimulateResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"STEP", "DECISION", "RULES", "RUNTIME STATE", "DETAIL"},
+			}
+			for _, s := range resp.Steps {
+				state := make([]string, 0, len(s.RuntimeState))
+				for k, v := range s.RuntimeState {
+					state = append(state, k+"="+v)
+				}
+				slices.Sort(state)
+				table = append(table, []string{s.Step, s.Decision, strings.Join(s.Rules, ","), strings.Join(state, ","), s.Detail})
+			}
+			general.PrintTable(table)
+			fmt.Printf("\nOutcome: %s", resp.Outcome)
+			if resp.Provider != "" {
+				fmt.Printf(", provider: %s", resp.Provider)
+			}
+			fmt.Println()
+		},
+	}
+	cmd.Flags().StringSliceVar(&req.Middlewares, "middlewares", nil, "Middlewares of the AIGatewayProxy filter, in order")
+	cmd.Flags().StringVar(&req.Path, "path", "", "Endpoint of the request, default /v1/chat/completions")
+	cmd.Flags().StringVar(&req.Consumer, "consumer", "", "Consumer sending the request")
+	cmd.Flags().StringVar(&req.Model, "model", "", "Model of the request")
+	cmd.Flags().BoolVar(&req.Stream, "stream", false, "Simulate a streaming request")
+	cmd.Flags().StringToStringVar(&req.Headers, "header", nil, "Headers of the request in key=value format")
+	cmd.Flags().IntVar(&req.PromptTokens, "prompt-tokens", 0, "Approximate number of tokens of the prompt")
+	return cmd
+}
+
+func dryRunCmd() *cobra.Command {
+	req := &aigatewaycontroller.DryRunRequest{}
+	var bodyFile string
+	cmd := &cobra.Command{
+		Use:   "dry-run",
+		Short: "Run a request through the middlewares and show the request sent to the provider without sending it",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Show the request to provider openai after the retrieval and the prompt middlewares.", Command: "egctl ai dry-run openai --middlewares retrieval,prompt --body-file request.json"},
+			{Desc: "Show the request of a consumer to a provider group in JSON.", Command: "egctl ai dry-run gpt --consumer alice --body-file request.json -o json"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			req.Provider = args[0]
+			if bodyFile != "" {
+				data, err := os.ReadFile(bodyFile)
+				if err != nil {
+					general.ExitWithError(err)
+				}
+				if err := codectool.UnmarshalJSON(data, &req.Body); err != nil {
+					general.ExitWithErrorf("invalid body in %s: %v", bodyFile, err)
+				}
+			}
+			body, err := general.HandleRequest(http.MethodPost, general.AIDryRunURL, codectool.MustMarshalJSON(req))
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.DryRunResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"STEP", "DECISION", "RULES", "DETAIL"},
+			}
+			for _, s := range resp.Steps {
+				table = append(table, []string{s.Step, s.Decision, strings.Join(s.Rules, ","), s.Detail})
+			}
+			general.PrintTable(table)
+			fmt.Printf("\nOutcome: %s", resp.Outcome)
+			if resp.Provider != "" {
+				fmt.Printf(", provider: %s", resp.Provider)
+			}
+			fmt.Println()
+			if resp.Trace != nil && resp.Trace.Tags != "" {
+				fmt.Printf("Tags: %s\n", resp.Trace.Tags)
+			}
+			if r := resp.Request; r != nil {
+				fmt.Printf("\n%s %s\n", r.Method, r.URL)
+				keys := make([]string, 0, len(r.Headers))
+				for k := range r.Headers {
+					keys = append(keys, k)
+				}
+				slices.Sort(keys)
+				for _, k := range keys {
+					fmt.Printf("%s: %s\n", k, strings.Join(r.Headers[k], ", "))
+				}
+				if r.Body != nil {
+					fmt.Printf("\n%s\n", codectool.MustMarshalJSON(r.Body))
+				}
+			}
+		},
+	}
+	cmd.Flags().StringSliceVar(&req.Middlewares, "middlewares", nil, "Middlewares of the AIGatewayProxy filter, in order")
+	cmd.Flags().StringVar(&req.Path, "path", "", "Endpoint of the request, default /v1/chat/completions")
+	cmd.Flags().StringVar(&req.Consumer, "consumer", "", "Consumer sending the request")
+	cmd.Flags().StringToStringVar(&req.Headers, "header", nil, "Headers of the request in key=value format")
+	cmd.Flags().StringVar(&bodyFile, "body-file", "", "File containing the JSON body of the request")
+	return cmd
+}
+
+func drainsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "drains",
+		Short: "List the progress of deleting documents of dropped vector indexes",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIDrainsURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.DrainsResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"INDEX", "STATUS", "DELETED", "RATE", "STARTED", "FINISHED", "ERROR"},
+			}
+			for _, d := range resp.Drains {
+				table = append(table, []string{
+					d.Index, d.Status, strconv.FormatInt(d.Deleted, 10), strconv.Itoa(d.DeletionsPerSecond),
+					d.StartedAt, d.FinishedAt, d.Error,
+				})
+			}
+			general.PrintTable(table)
+		},
+	}
+}
+
+func janitorsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "janitors",
+		Short: "List the sweeps of orphaned keys of vector indexes",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIJanitorsURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.JanitorsResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"INDEX", "POLICY", "LEADER", "SWEEPS", "SCANNED", "NO-TTL", "NO-FIELDS", "EXPIRED", "REPAIRED", "DELETED", "LAST-SWEPT", "ERROR"},
+			}
+			for _, j := range resp.Janitors {
+				table = append(table, []string{
+					j.Index, j.Policy, strconv.FormatBool(j.Leader), strconv.FormatInt(j.Sweeps, 10),
+					strconv.FormatInt(j.Scanned, 10), strconv.FormatInt(j.MissingTTL, 10), strconv.FormatInt(j.MissingFields, 10),
+					strconv.FormatInt(j.Expired, 10), strconv.FormatInt(j.Repaired, 10), strconv.FormatInt(j.Deleted, 10),
+					j.LastSweptAt, j.Error,
+				})
+			}
+			general.PrintTable(table)
+		},
+	}
+}
+
+func writeQueuesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "write-queues",
+		Short: "List the write queues of vector collections",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIWriteQueuesURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printWriteQueues(body)
+		},
+	}
+	cmd.AddCommand(setWriteRateCmd())
+	return cmd
+}
+
+func setWriteRateCmd() *cobra.Command {
+	req := &aigatewaycontroller.WriteRateRequest{}
+	cmd := &cobra.Command{
+		Use:   "set-rate",
+		Short: "Adjust the write rate of vector collections temporarily",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Pause the writes of all collections for 10 minutes.", Command: "egctl ai write-queues set-rate --rate 0 --duration 10m"},
+			{Desc: "Limit the writes of a collection to 5 per second for an hour.", Command: "egctl ai write-queues set-rate --collection semantic_cache_chat --rate 5 --duration 1h"},
+		}),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodPost, general.AIWriteRateURL, codectool.MustMarshalJSON(req))
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printWriteQueues(body)
+		},
+	}
+	cmd.Flags().StringVar(&req.Collection, "collection", "", "Collection to adjust, default is all collections")
+	cmd.Flags().Float64Var(&req.Rate, "rate", 0, "Documents written per second, 0 pauses the writes")
+	cmd.Flags().IntVar(&req.Burst, "burst", 0, "Maximum number of documents written at once, default is the rate rounded up")
+	cmd.Flags().StringVar(&req.Duration, "duration", "", "How long the rate applies, the rate in the spec is restored after it")
+	cmd.MarkFlagRequired("duration")
+	return cmd
+}
+
+func printWriteQueues(body []byte) {
+	if !general.CmdGlobalFlags.DefaultFormat() {
+		general.PrintBody(body)
+		return
+	}
+
+	var resp aigatewaycontroller.WriteQueuesResponse
+	err := codectool.UnmarshalJSON(body, &resp)
+	if err != nil {
+		general.ExitWithError(err)
+	}
+
+	table := [][]string{
+		{"COLLECTION", "RATE", "BURST", "OVERFLOW", "DEPTH", "WRITTEN", "FAILED", "DROPPED", "OVERRIDE UNTIL"},
+	}
+	for _, q := range resp.WriteQueues {
+		table = append(table, []string{
+			q.Collection, strconv.FormatFloat(q.Rate, 'g', -1, 64), strconv.Itoa(q.Burst), q.Overflow,
+			fmt.Sprintf("%d/%d", q.Depth, q.QueueSize), strconv.FormatInt(q.Written, 10),
+			strconv.FormatInt(q.Failed, 10), strconv.FormatInt(q.Dropped, 10), q.OverrideUntil,
+		})
+	}
+	general.PrintTable(table)
+}
+
+func corpusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "corpus",
+		Short: "Get the fill levels of the strata of the sampled corpus in the current window",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AICorpusURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var status corpus.Status
+			err = codectool.UnmarshalJSON(body, &status)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			fmt.Printf("Window: %s - %s\n", status.WindowStart, status.WindowEnd)
+			if status.LastFile != "" {
+				fmt.Printf("Last file: %s\n", status.LastFile)
+			}
+			if status.LastError != "" {
+				fmt.Printf("Last error: %s\n", status.LastError)
+			}
+			if status.Overflowed > 0 {
+				fmt.Printf("Requests of overflowed strata: %d\n", status.Overflowed)
+			}
+			table := [][]string{
+				{"MODEL", "CONSUMER", "SAMPLED", "TARGET", "SEEN"},
+			}
+			for _, s := range status.Strata {
+				table = append(table, []string{
+					s.Model, s.Consumer, strconv.Itoa(s.Sampled), strconv.Itoa(s.Target), strconv.FormatInt(s.Seen, 10),
+				})
+			}
+			general.PrintTable(table)
+		},
+	}
+}
+
+func reloadsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "reloads",
+		Short: "List the spec changes of the latest reloads and the components recreated",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIReloadsURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp aigatewaycontroller.ReloadsResponse
+			err = codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"TIME", "CHANGES", "RECREATED", "KEPT"},
+			}
+			for _, r := range resp.Reloads {
+				var changes, recreated, kept []string
+				for _, c := range r.Changes {
+					changes = append(changes, c.Path+" "+c.Type)
+				}
+				for _, c := range r.Components {
+					switch c.Action {
+					case "kept":
+						kept = append(kept, c.Name)
+					case "recreated":
+						recreated = append(recreated, c.Name)
+					default:
+						recreated = append(recreated, c.Name+"("+c.Action+")")
+					}
+				}
+				table = append(table, []string{
+					r.Time.Format(time.RFC3339), strings.Join(changes, ","),
+					strings.Join(recreated, ","), strings.Join(kept, ","),
+				})
+			}
+			general.PrintTable(table)
+		},
+	}
+}
+
+// consumerAdminToken is the admin token of the consumer commands.
+var consumerAdminToken string
+
+func metricsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "metrics",
+		Short: "List the metrics of AI Gateway with their labels and help texts",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := general.HandleRequest(http.MethodGet, general.AIMetricsManifestURL, nil)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var manifest metricshub.Manifest
+			err = codectool.UnmarshalJSON(body, &manifest)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+
+			table := [][]string{
+				{"NAME", "TYPE", "UNIT", "LABELS", "EXEMPLARS", "HELP"},
+			}
+			for _, m := range manifest.Metrics {
+				labels := strings.Join(m.Labels, ",")
+				if m.CustomLabels {
+					labels += ",<custom>"
+				}
+				exemplars := "NO"
+				if m.Exemplars {
+					exemplars = "YES"
+				}
+				table = append(table, []string{m.Name, m.Type, m.Unit, labels, exemplars, m.Help})
+			}
+			general.PrintTable(table)
+		},
+	}
+}
+
+func consumerRequest(method string, path string, body []byte) []byte {
+	header := http.Header{}
+	if consumerAdminToken != "" {
+		header.Set(consumers.AdminTokenHeader, consumerAdminToken)
+	}
+	resp, err := general.HandleRequestWithHeader(method, path, body, header)
+	if err != nil {
+		general.ExitWithError(err)
+	}
+	return resp
+}
+
+func printConsumers(list []*consumers.Consumer) {
+	table := [][]string{
+		{"NAME", "KEY", "GROUP", "REGION", "EXPIRES-AT", "SKIP-MIDDLEWARES", "CREATED-BY", "CREATED-AT"},
+	}
+	for _, c := range list {
+		table = append(table, []string{c.Name, c.KeyPrefix + "...", c.Group, c.Region, c.ExpiresAt, strings.Join(c.SkipMiddlewares, ","), c.CreatedBy, c.CreatedAt})
+	}
+	general.PrintTable(table)
+}
+
+func consumersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "consumers",
+		Short: "List the consumers of AI Gateway and the prefixes of their keys",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			body := consumerRequest(http.MethodGet, general.AIConsumersURL, nil)
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp consumers.ListResponse
+			err := codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printConsumers(resp.Consumers)
+		},
+	}
+	cmd.PersistentFlags().StringVar(&consumerAdminToken, "admin-token", "", "Admin token of the consumer API if admin tokens are configured")
+	cmd.AddCommand(createConsumerCmd(), updateConsumerCmd(), revokeConsumerCmd())
+	return cmd
+}
+
+func createConsumerCmd() *cobra.Command {
+	req := &consumers.CreateRequest{}
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create a consumer with a generated key, the key is only shown once",
+		Example: createMultiExample([]general.Example{
+			{Desc: "Create a consumer in group analysts.", Command: "egctl ai consumers create alice --group analysts"},
+			{Desc: "Create a consumer whose key expires at the end of 2026.", Command: "egctl ai consumers create bob --expires-at 2026-12-31T23:59:59Z"},
+			{Desc: "Create a consumer whose requests are kept in region eu.", Command: "egctl ai consumers create carol --region eu"},
+			{Desc: "Create a consumer skipping the semantic cache.", Command: "egctl ai consumers create dave --skip-middlewares semantic-cache"},
+		}),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			req.Name = args[0]
+			body := consumerRequest(http.MethodPost, general.AIConsumersURL, codectool.MustMarshalJSON(req))
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var resp consumers.CreateResponse
+			err := codectool.UnmarshalJSON(body, &resp)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			fmt.Printf("Consumer %s created, save the key, it is not shown again:\n%s\n", resp.Consumer.Name, resp.Key)
+		},
+	}
+	cmd.Flags().StringVar(&req.Group, "group", "", "Consumer group of the consumer policies")
+	cmd.Flags().StringVar(&req.Region, "region", "", "Region the requests of the consumer are kept in, default is any region")
+	cmd.Flags().StringVar(&req.ExpiresAt, "expires-at", "", "Expiration time of the key in RFC3339 format, default is never")
+	cmd.Flags().StringSliceVar(&req.SkipMiddlewares, "skip-middlewares", nil, "Skippable middlewares skipped by the requests of the consumer")
+	return cmd
+}
+
+func updateConsumerCmd() *cobra.Command {
+	req := &consumers.UpdateRequest{}
+	cmd := &cobra.Command{
+		Use:     "update",
+		Short:   "Replace the group, the region, the expiration and the skipped middlewares of a consumer",
+		Example: createExample("Move a consumer to group others and remove its expiration.", "egctl ai consumers update alice --group others"),
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body := consumerRequest(http.MethodPut, fmt.Sprintf(general.AIConsumerURL, args[0]), codectool.MustMarshalJSON(req))
+			if !general.CmdGlobalFlags.DefaultFormat() {
+				general.PrintBody(body)
+				return
+			}
+
+			var c consumers.Consumer
+			err := codectool.UnmarshalJSON(body, &c)
+			if err != nil {
+				general.ExitWithError(err)
+			}
+			printConsumers([]*consumers.Consumer{&c})
+		},
+	}
+	cmd.Flags().StringVar(&req.Group, "group", "", "Consumer group of the consumer policies")
+	cmd.Flags().StringVar(&req.Region, "region", "", "Region the requests of the consumer are kept in, default is any region")
+	cmd.Flags().StringVar(&req.ExpiresAt, "expires-at", "", "Expiration time of the key in RFC3339 format, default is never")
+	cmd.Flags().StringSliceVar(&req.SkipMiddlewares, "skip-middlewares", nil, "Skippable middlewares skipped by the requests of the consumer")
+	return cmd
+}
+
+func revokeConsumerCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "revoke",
+		Short:   "Revoke the key of a consumer and delete the consumer",
+		Example: createExample("Revoke the key of consumer alice.", "egctl ai consumers revoke alice"),
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			consumerRequest(http.MethodDelete, fmt.Sprintf(general.AIConsumerURL, args[0]), nil)
+			fmt.Printf("Consumer %s revoked successfully.\n", args[0])
+		},
+	}
+}
+
 func editCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "edit",
@@ -141,7 +141,7 @@ func HandleReqWithStreamResp(httpMethod string, path string, yamlBody []byte) (i
 	if err != nil {
 		return nil, err
 	}
-	resp, err := doRequest(httpMethod, url, jsonBody, client)
+	resp, err := doRequest(httpMethod, url, jsonBody, nil, client)
 	if err != nil {
 		return nil, err
 	}
@@ -155,7 +155,7 @@ func HandleReqWithStreamResp(httpMethod string, path string, yamlBody []byte) (i
 
 		// https://github.com/golang/go/blob/release-branch.go1.21/src/net/http/server.go#L1892-L1899
 		if strings.Contains(string(body), "Client sent an HTTP request to an HTTPS server") {
-			resp, err = doRequest(httpMethod, HTTPSProtocol+strings.TrimPrefix(url, HTTPProtocol), jsonBody, client)
+			resp, err = doRequest(httpMethod, HTTPSProtocol+strings.TrimPrefix(url, HTTPProtocol), jsonBody, nil, client)
 			if err != nil {
 				return nil, err
 			}
@@ -184,6 +184,11 @@ func HandleReqWithStreamResp(httpMethod string, path string, yamlBody []byte) (i
 
 // HandleRequest used in cmd/client/resources. It will return the response body in yaml or json format.
 func HandleRequest(httpMethod string, path string, yamlBody []byte) (body []byte, err error) {
+	return HandleRequestWithHeader(httpMethod, path, yamlBody, nil)
+}
+
+// HandleRequestWithHeader is HandleRequest with extra request headers.
+func HandleRequestWithHeader(httpMethod string, path string, yamlBody []byte, header http.Header) (body []byte, err error) {
 	var jsonBody []byte
 	if yamlBody != nil {
 		var err error
@@ -201,7 +206,7 @@ func HandleRequest(httpMethod string, path string, yamlBody []byte) (body []byte
 	if err != nil {
 		return nil, err
 	}
-	resp, body, err := doRequestWithBody(httpMethod, url, jsonBody, client)
+	resp, body, err := doRequestWithBody(httpMethod, url, jsonBody, header, client)
 	if err != nil {
 		return nil, err
 	}
@@ -209,7 +214,7 @@ func HandleRequest(httpMethod string, path string, yamlBody []byte) (body []byte
 	msg := string(body)
 	// https://github.com/golang/go/blob/release-branch.go1.21/src/net/http/server.go#L1892-L1899
 	if strings.HasPrefix(url, HTTPProtocol) && resp.StatusCode == http.StatusBadRequest && strings.Contains(msg, "Client sent an HTTP request to an HTTPS server") {
-		resp, body, err = doRequestWithBody(httpMethod, HTTPSProtocol+strings.TrimPrefix(url, HTTPProtocol), jsonBody, client)
+		resp, body, err = doRequestWithBody(httpMethod, HTTPSProtocol+strings.TrimPrefix(url, HTTPProtocol), jsonBody, header, client)
 		if err != nil {
 			return nil, err
 		}
@@ -226,7 +231,7 @@ func HandleRequest(httpMethod string, path string, yamlBody []byte) (body []byte
 	return body, nil
 }
 
-func doRequest(httpMethod string, url string, jsonBody []byte, client *http.Client) (*http.Response, error) {
+func doRequest(httpMethod string, url string, jsonBody []byte, header http.Header, client *http.Client) (*http.Response, error) {
 	config, err := GetCurrentConfig()
 	if err != nil {
 		return nil, err
@@ -238,6 +243,9 @@ func doRequest(httpMethod string, url string, jsonBody []byte, client *http.Clie
 	if err != nil {
 		return nil, err
 	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -245,8 +253,8 @@ func doRequest(httpMethod string, url string, jsonBody []byte, client *http.Clie
 	return resp, nil
 }
 
-func doRequestWithBody(httpMethod string, url string, jsonBody []byte, client *http.Client) (*http.Response, []byte, error) {
-	resp, err := doRequest(httpMethod, url, jsonBody, client)
+func doRequestWithBody(httpMethod string, url string, jsonBody []byte, header http.Header, client *http.Client) (*http.Response, []byte, error) {
+	resp, err := doRequest(httpMethod, url, jsonBody, header, client)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -77,6 +77,29 @@ const (
 
 	AISProviderstatusURL = APIURL + "/ai-gateway/providers/status"
 	AIStatURL            = APIURL + "/ai-gateway/stat"
+	AIProviderFlushURL   = APIURL + "/ai-gateway/providers/%s/flush"
+	AIProviderSpecsURL   = APIURL + "/ai-gateway/providers/specs"
+	AIProviderSLOURL     = APIURL + "/ai-gateway/providers/slo"
+	AIProviderPinURL     = APIURL + "/ai-gateway/providers/%s/pin"
+	AIProviderKeysURL    = APIURL + "/ai-gateway/providers/%s/credentials"
+	AIProviderStagedURL  = APIURL + "/ai-gateway/providers/%s/credentials/staged"
+	AIMiddlewaresURL     = APIURL + "/ai-gateway/middlewares"
+	AIMiddlewareURL      = APIURL + "/ai-gateway/middlewares/%s/%s"
+	AIMiddlewareProbeURL = APIURL + "/ai-gateway/middlewares/%s/probe"
+	AIFeatureFlagsURL    = APIURL + "/ai-gateway/featureflags"
+	AIUsageURL           = APIURL + "/ai-gateway/usage"
+	AIEndpointsURL       = APIURL + "/ai-gateway/endpoints"
+	AISimulateURL        = APIURL + "/ai-gateway/simulate"
+	AIDryRunURL          = APIURL + "/ai-gateway/dryrun"
+	AIDrainsURL          = APIURL + "/ai-gateway/vectordb/drains"
+	AIJanitorsURL        = APIURL + "/ai-gateway/vectordb/janitors"
+	AIWriteQueuesURL     = APIURL + "/ai-gateway/vectordb/writequeues"
+	AIWriteRateURL       = APIURL + "/ai-gateway/vectordb/writequeues/rate"
+	AICorpusURL          = APIURL + "/ai-gateway/corpus"
+	AIReloadsURL         = APIURL + "/ai-gateway/reloads"
+	AIMetricsManifestURL = APIURL + "/ai-gateway/metrics/manifest"
+	AIConsumersURL       = APIURL + "/ai-gateway/consumers"
+	AIConsumerURL        = APIURL + "/ai-gateway/consumers/%s"
 
 	// HTTPProtocol is prefix for HTTP protocol
 	HTTPProtocol = "http://"
@@ -18,6 +18,7 @@
 package api
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -26,12 +27,19 @@ const (
 	PrometheusMetricsPrefix = "/metrics"
 )
 
+// prometheusHandler is promhttp.Handler with OpenMetrics enabled, so the
+// exemplars of metrics are exposed to the scrapers negotiating it.
+var prometheusHandler = promhttp.InstrumentMetricHandler(
+	prometheus.DefaultRegisterer,
+	promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+)
+
 func (s *Server) prometheusMetricsAPIEntries() []*Entry {
 	return []*Entry{
 		{
 			Path:    PrometheusMetricsPrefix,
 			Method:  "GET",
-			Handler: promhttp.Handler().ServeHTTP,
+			Handler: prometheusHandler.ServeHTTP,
 		},
 	}
 }
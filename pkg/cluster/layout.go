@@ -45,8 +45,11 @@ const (
 	customDataKindPrefix      = "/custom-data-kinds/"
 	customDataPrefix          = "/custom-data/"
 
-	aiGatewayStatusFormat = "/aigateway/stats/%s" // + memberName
-	aiGatewayStatusPrefix = "/aigateway/stats/"
+	aiGatewayStatusFormat   = "/aigateway/stats/%s" // + memberName
+	aiGatewayStatusPrefix   = "/aigateway/stats/"
+	aiGatewayUsageFormat    = "/aigateway/usage/%s/" // + memberName
+	aiGatewayUsagePrefix    = "/aigateway/usage/"
+	aiGatewayConsumerPrefix = "/aigateway/consumers/"
 
 	// the cluster name of this eg group will be registered under this path in etcd
 	// any new member(primary or secondary ) will be rejected if it is configured a different cluster name
@@ -168,3 +171,20 @@ func (l *Layout) AIGatewayStatsKey() string {
 func (l *Layout) AIGatewayStatsPrefix() string {
 	return aiGatewayStatusPrefix
 }
+
+// AIGatewayUsagePrefix returns the prefix of AI gateway usage buckets of
+// all members.
+func (l *Layout) AIGatewayUsagePrefix() string {
+	return aiGatewayUsagePrefix
+}
+
+// AIGatewayMemberUsagePrefix returns the prefix of AI gateway usage buckets
+// of own member.
+func (l *Layout) AIGatewayMemberUsagePrefix() string {
+	return fmt.Sprintf(aiGatewayUsageFormat, l.memberName)
+}
+
+// AIGatewayConsumerPrefix returns the prefix of AI gateway consumers.
+func (l *Layout) AIGatewayConsumerPrefix() string {
+	return aiGatewayConsumerPrefix
+}
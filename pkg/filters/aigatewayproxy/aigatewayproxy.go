@@ -66,6 +66,17 @@ type (
 	}
 )
 
+// Validate validates the spec. The order of the middlewares is checked
+// against the controller if it exists, it is checked again when the
+// requests are handled.
+func (s *Spec) Validate() error {
+	handler, err := aigatewaycontroller.GetGlobalAIGatewayHandler()
+	if err != nil {
+		return nil
+	}
+	return handler.ValidateMiddlewares(s.Middlewares)
+}
+
 // Name returns the name of the AIGatewayProxy filter instance.
 func (p *AIGatewayProxy) Name() string {
 	return p.spec.Name()
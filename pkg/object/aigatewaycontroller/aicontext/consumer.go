@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aicontext
+
+import (
+	"slices"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+// consumerDataKey is the key of the consumer in the data of the context.
+const consumerDataKey = "AI_GATEWAY_CONSUMER"
+
+// Consumer is the consumer of a request authenticated by the consumer keys
+// of AIGatewayController.
+type Consumer struct {
+	// ID is the name of the consumer, it is empty if the request has no
+	// valid key and the keys are not required.
+	ID     string
+	Group  string
+	Region string
+	// SkipMiddlewares are the middlewares skipped by the requests of the
+	// consumer.
+	SkipMiddlewares []string
+}
+
+// Skips reports whether the consumer skips the middleware, a nil consumer
+// skips nothing.
+func (c *Consumer) Skips(middleware string) bool {
+	return c != nil && slices.Contains(c.SkipMiddlewares, middleware)
+}
+
+// SetConsumer sets the consumer authenticated by AIGatewayController to
+// the context, the AI contexts created from it carry the consumer.
+func SetConsumer(ctx *context.Context, consumer *Consumer) {
+	ctx.SetData(consumerDataKey, consumer)
+}
+
+// ConsumerOf returns the consumer of the context set by SetConsumer, it
+// is nil if the consumers are not managed by AIGatewayController.
+func ConsumerOf(ctx *context.Context) *Consumer {
+	consumer, _ := ctx.GetData(consumerDataKey).(*Consumer)
+	return consumer
+}
+
+// ConsumerID returns the ID of the consumer of the request in the context.
+// If the consumers are managed by AIGatewayController, it is the ID of the
+// authenticated consumer and the header is ignored, so clients can't
+// claim to be another consumer. Otherwise, it is the value of the header,
+// which is usually set by the authentication filters.
+func ConsumerID(ctx *context.Context, header string) string {
+	if consumer := ConsumerOf(ctx); consumer != nil {
+		return consumer.ID
+	}
+	if header == "" {
+		return ""
+	}
+	return ctx.GetInputRequest().(*httpprot.Request).HTTPHeader().Get(header)
+}
+
+// ConsumerID returns the ID of the consumer of the request, see the
+// function ConsumerID.
+func (c *Context) ConsumerID(header string) string {
+	if c.Consumer != nil {
+		return c.Consumer.ID
+	}
+	if header == "" {
+		return ""
+	}
+	return c.Req.HTTPHeader().Get(header)
+}
+
+// ConsumerGroup returns the group of the consumer of the request like
+// ConsumerID.
+func (c *Context) ConsumerGroup(header string) string {
+	if c.Consumer != nil {
+		return c.Consumer.Group
+	}
+	if header == "" {
+		return ""
+	}
+	return c.Req.HTTPHeader().Get(header)
+}
@@ -18,15 +18,19 @@
 package aicontext
 
 import (
+	stdcontext "context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/megaease/easegress/v2/pkg/context"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/sessionstate"
 	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
 )
 
@@ -44,8 +48,15 @@ const (
 	ResponseTypeModels ResponseType = "/v1/models"
 	// ResponseTypeImageGenerations is used for image generation requests.
 	ResponseTypeImageGenerations ResponseType = "/v1/images/generations"
+	// ResponseTypeModerations is used for moderation requests.
+	ResponseTypeModerations ResponseType = "/v1/moderations"
 )
 
+// RequestTimeoutHeader carries the time the client waits for the
+// response, in milliseconds or as a duration like 800ms. The deadline of
+// the request is the time it is received plus the timeout.
+const RequestTimeoutHeader = "X-Request-Timeout"
+
 type ResultError string
 
 const (
@@ -79,10 +90,125 @@ type (
 		BaseURL      string            `json:"baseURL"`
 		APIKey       string            `json:"apiKey"`
 		Headers      map[string]string `json:"headers,omitempty"`
+
+		// Extends is the provider template the provider is based on, the
+		// fields of the provider are set in Overrides then.
+		Extends string `json:"extends,omitempty"`
+		// Overrides are deep-merged into the fields of the template, and a
+		// null deletes the field of the template.
+		Overrides map[string]any `json:"overrides,omitempty"`
+
 		// Optional parameters for specific providers, such as Azure.
 		Endpoint     string `json:"endpoint,omitempty"`     // It is used for Azure OpenAI.
 		DeploymentID string `json:"deploymentID,omitempty"` // It is used for Azure OpenAI.
 		APIVersion   string `json:"apiVersion,omitempty"`   // It is used for Azure OpenAI.
+
+		// BaseURLs are the additional base URLs of the provider. Requests are
+		// balanced among BaseURL and BaseURLs in round-robin, and fail over
+		// to other base URLs if one is unhealthy.
+		BaseURLs            []string `json:"baseURLs,omitempty"`
+		HealthCheckInterval string   `json:"healthCheckInterval,omitempty" jsonschema:"format=duration"`
+
+		HTTPClient       *HTTPClientSpec       `json:"httpClient,omitempty"`
+		MaxResponseBytes *MaxResponseBytesSpec `json:"maxResponseBytes,omitempty"`
+		// Signing authenticates the requests to the provider, the requests
+		// carry the APIKey as a bearer token if it is not set.
+		Signing *SigningSpec `json:"signing,omitempty"`
+		// OutputScrub removes the special tokens leaked by models from the
+		// responses, the first rule matching the model applies.
+		OutputScrub []*OutputScrubSpec `json:"outputScrub,omitempty"`
+		// Completions is how the legacy completions requests are served,
+		// native proxies them as is, chat translates them to chat
+		// completions. It defaults by the provider type.
+		Completions string `json:"completions,omitempty" jsonschema:"enum=,enum=native,enum=chat"`
+		// Required makes the readiness of the controller wait for the
+		// provider to pass its health check at startup.
+		Required bool `json:"required,omitempty"`
+		// Region is the data residency region the provider is hosted in,
+		// consumers pinned to a region are only served by its providers.
+		Region string `json:"region,omitempty"`
+		// SynthesizeStreaming serves the streaming requests to a provider
+		// which can not stream by its non-streaming responses, which are
+		// chunked into synthetic streams.
+		SynthesizeStreaming *SynthesizeStreamingSpec `json:"synthesizeStreaming,omitempty"`
+	}
+
+	// HTTPClientSpec defines the connection pool of the HTTP client used to access a provider.
+	HTTPClientSpec struct {
+		MaxIdleConns        int    `json:"maxIdleConns,omitempty"`
+		MaxIdleConnsPerHost int    `json:"maxIdleConnsPerHost,omitempty"`
+		MaxConnsPerHost     int    `json:"maxConnsPerHost,omitempty"`
+		IdleConnTimeout     string `json:"idleConnTimeout,omitempty" jsonschema:"format=duration"`
+		// Protocol forces the HTTP protocol used to access the provider, it
+		// can be http1 or http2. HTTP/2 is only available over TLS, and
+		// by default it is negotiated with the provider.
+		Protocol string `json:"protocol,omitempty" jsonschema:"enum=,enum=http1,enum=http2"`
+		// DNSRefreshInterval is the interval to resolve the hosts of the
+		// provider again, connections are flushed if the addresses change.
+		DNSRefreshInterval string `json:"dnsRefreshInterval,omitempty" jsonschema:"format=duration"`
+	}
+
+	// MaxResponseBytesSpec limits the size of responses from a provider, 0 means no limit.
+	MaxResponseBytesSpec struct {
+		// Body limits the body size of a non-streaming response.
+		Body int64 `json:"body,omitempty"`
+		// Stream limits the cumulative size of a streaming response.
+		Stream int64 `json:"stream,omitempty"`
+	}
+
+	// OutputScrubSpec defines the tokens and patterns removed from the
+	// content of responses.
+	OutputScrubSpec struct {
+		// Models are the models the rule applies to, path.Match patterns
+		// are supported, and the rule applies to all models if it is empty.
+		Models   []string `json:"models,omitempty"`
+		Tokens   []string `json:"tokens,omitempty"`
+		Patterns []string `json:"patterns,omitempty"`
+		// Replacement replaces the tokens and the matches of the patterns,
+		// they are removed if it is empty.
+		Replacement string `json:"replacement,omitempty"`
+		// ThinkBlocks is how <think>...</think> blocks are handled, keep
+		// them, strip them, or move their content to reasoning_content.
+		ThinkBlocks string `json:"thinkBlocks,omitempty" jsonschema:"enum=,enum=keep,enum=strip,enum=reasoning"`
+		// MaxPatternLength is the maximum length in bytes of the matches of
+		// the patterns, streaming content is held back by it to match the
+		// patterns split across chunks.
+		MaxPatternLength int `json:"maxPatternLength,omitempty"`
+	}
+
+	// SynthesizeStreamingSpec defines how the content of a non-streaming
+	// response is chunked into a synthetic stream.
+	SynthesizeStreamingSpec struct {
+		// Chunking splits the content by word or by sentence, it defaults
+		// to word.
+		Chunking string `json:"chunking,omitempty" jsonschema:"enum=,enum=word,enum=sentence"`
+		// Interval is the pause between the chunks, the chunks are sent
+		// without pauses if it is empty.
+		Interval string `json:"interval,omitempty" jsonschema:"format=duration"`
+	}
+
+	// SigningSpec defines how the requests to a provider are signed.
+	SigningSpec struct {
+		// Type is the signing scheme, the built-in ones are bearer,
+		// apiKey, hmac and sigv4.
+		Type string `json:"type" jsonschema:"required"`
+		// Header is the header of the APIKey for apiKey, or the header
+		// of the signature for hmac.
+		Header string `json:"header,omitempty"`
+
+		// Secret is the shared secret of hmac.
+		Secret string `json:"secret,omitempty"`
+		// StringToSign is the Go template of the string signed by hmac.
+		StringToSign string `json:"stringToSign,omitempty"`
+		// TimestampHeader is the header of the signing time of hmac.
+		TimestampHeader string `json:"timestampHeader,omitempty"`
+
+		// Region, Service and the credential are used by sigv4.
+		Region          string `json:"region,omitempty"`
+		Service         string `json:"service,omitempty"`
+		AccessKeyID     string `json:"accessKeyID,omitempty"`
+		SecretAccessKey string `json:"secretAccessKey,omitempty"`
+		SessionToken    string `json:"sessionToken,omitempty"`
 	}
 
 	Context struct {
@@ -95,14 +221,54 @@ type (
 		ReqInfo   *protocol.GeneralRequest
 		OpenAIReq map[string]any
 		RespType  ResponseType
+		// Flags is the feature flags resolved for the consumer of the
+		// request, see FlagEnabled.
+		Flags map[string]bool
+		// Consumer is the consumer authenticated by AIGatewayController,
+		// it is nil if the consumers are not managed by the controller.
+		// Use ConsumerID to identify the consumer of the request.
+		Consumer *Consumer
+		// ConsumerRegion is the data residency region of the consumer of
+		// the request, the request is not pinned to a region if it is empty.
+		ConsumerRegion string
+		// Session is the state of the conversation of the request kept
+		// across requests, it is nil if the session state is not
+		// configured or the request has no session ID.
+		Session *sessionstate.Session
 
 		// ParseMetricFn is a function that parses the response body to a metric.
 		// If it is sent, it will be called to parse the response body to a metric.
 		// Otherwise, default ParseMetricFn will be used.
 		ParseMetricFn func(fc *FinishContext) *metricshub.Metric
 
-		resp      *Response
-		callBacks []func(fc *FinishContext)
+		// Detached is set if the streaming response is buffered for
+		// resumption. The request to the provider is not canceled when the
+		// client goes away then, and the body of its response is left in
+		// UpstreamBody to be closed by the buffer.
+		Detached     bool
+		UpstreamBody io.Closer
+		// DryRun is set if the request is returned to the developer
+		// instead of being sent to the provider, middlewares must not
+		// write to their stores then.
+		DryRun bool
+
+		resp             *Response
+		callBacks        []func(fc *FinishContext)
+		responseHandlers []func(ctx *Context)
+		deliverers       []func(resp *Response)
+		piiVault         *PIIVault
+		citations        []*Citation
+		repairs          []*ConversationRepair
+		packedChunks     []*PackedChunk
+		images           []*ImageOptimization
+		variables        map[string]any
+		budgetDecisions  []*BudgetDecision
+		checkFailures    []*ResponseCheckFailure
+		embeddings       map[string][]float32
+		deadline         time.Time
+		// reqCtx overrides the context of Req for the requests to the
+		// provider, see Fork.
+		reqCtx stdcontext.Context
 
 		stop   bool
 		result string
@@ -122,16 +288,94 @@ type (
 		BodyBytes []byte
 	}
 
+	// Citation is a source document injected into the request.
+	Citation struct {
+		// ID is the ID of the document.
+		ID string `json:"id,omitempty"`
+		// Source is the URL or the name of the source of the document.
+		Source string `json:"source,omitempty"`
+		Title  string `json:"title,omitempty"`
+	}
+
+	// ConversationRepair is a change made to the messages of the request
+	// to make the conversation valid for the provider.
+	ConversationRepair struct {
+		// Rule is the violated rule.
+		Rule string `json:"rule"`
+		// Action is merge, reorder or synthesize.
+		Action string `json:"action"`
+		// Index is the index of the repaired message in the original
+		// request.
+		Index  int    `json:"index"`
+		Detail string `json:"detail,omitempty"`
+	}
+
+	// PackedChunk is the decision of packing a retrieved chunk into the
+	// context window of the request.
+	PackedChunk struct {
+		ID     string  `json:"id,omitempty"`
+		Source string  `json:"source,omitempty"`
+		Score  float64 `json:"score"`
+		// Tokens is the estimated tokens of the chunk, and PackedTokens is
+		// the tokens injected, which is less if the chunk is truncated.
+		Tokens       int    `json:"tokens"`
+		PackedTokens int    `json:"packedTokens"`
+		Decision     string `json:"decision"`
+		Reason       string `json:"reason,omitempty"`
+	}
+
+	// ImageOptimization is the processing of an inline image of the
+	// request before it is sent to the provider.
+	ImageOptimization struct {
+		// Message and Part are the indexes of the image in the messages
+		// of the request and in the content of the message.
+		Message int `json:"message"`
+		Part    int `json:"part"`
+		// Action is resized, reencoded, stripped or passthrough.
+		Action         string `json:"action"`
+		OriginalFormat string `json:"originalFormat"`
+		Format         string `json:"format"`
+		OriginalBytes  int    `json:"originalBytes"`
+		Bytes          int    `json:"bytes"`
+		OriginalWidth  int    `json:"originalWidth,omitempty"`
+		OriginalHeight int    `json:"originalHeight,omitempty"`
+		Width          int    `json:"width,omitempty"`
+		Height         int    `json:"height,omitempty"`
+	}
+
+	// BudgetDecision is the decision of a middleware on the remaining time
+	// budget of the request, like skipping the work which would make the
+	// request miss its deadline.
+	BudgetDecision struct {
+		Middleware string `json:"middleware"`
+		Decision   string `json:"decision"`
+		// Remaining is the budget left when the middleware runs, and
+		// Estimated is the estimated cost of its work.
+		Remaining time.Duration `json:"remaining"`
+		Estimated time.Duration `json:"estimated"`
+	}
+
+	// ResponseCheckFailure is a failed quality check of the response sent
+	// to the user.
+	ResponseCheckFailure struct {
+		Check string `json:"check"`
+		// Action is the action taken on the failure.
+		Action string `json:"action"`
+		Detail string `json:"detail,omitempty"`
+	}
+
 	FinishContext struct {
 		StatusCode int
 		Header     http.Header
-		// RespBody is the final response body that sent to the user.
+		// RespBody is the final response body that sent to the user,
+		// before the transforms added by OnDeliver.
 		RespBody []byte
 		Duration int64
 	}
 )
 
 func New(ctx *context.Context, provider *ProviderSpec) (*Context, error) {
+	received := time.Now()
 	req := ctx.GetInputRequest().(*httpprot.Request)
 	// request body
 	body, err := io.ReadAll(req.GetPayload())
@@ -147,6 +391,8 @@ func New(ctx *context.Context, provider *ProviderSpec) (*Context, error) {
 		respType = ResponseTypeCompletions
 	} else if strings.HasSuffix(path, string(ResponseTypeModels)) {
 		respType = ResponseTypeModels
+	} else if strings.HasSuffix(path, string(ResponseTypeModerations)) {
+		respType = ResponseTypeModerations
 	} else {
 		return nil, fmt.Errorf("unsupported request path: %s", path)
 	}
@@ -155,6 +401,7 @@ func New(ctx *context.Context, provider *ProviderSpec) (*Context, error) {
 		c := &Context{
 			Ctx:       ctx,
 			Provider:  provider,
+			Consumer:  ConsumerOf(ctx),
 			Req:       req,
 			ReqBody:   body,
 			OpenAIReq: map[string]any{},
@@ -171,6 +418,22 @@ func New(ctx *context.Context, provider *ProviderSpec) (*Context, error) {
 		return nil, err
 	}
 
+	// the model of moderation requests is optional.
+	if respType == ResponseTypeModerations {
+		model, _ := openAIReq["model"].(string)
+		c := &Context{
+			Ctx:       ctx,
+			Provider:  provider,
+			Consumer:  ConsumerOf(ctx),
+			Req:       req,
+			ReqBody:   body,
+			OpenAIReq: openAIReq,
+			ReqInfo:   &protocol.GeneralRequest{Model: model},
+			RespType:  respType,
+		}
+		return c, nil
+	}
+
 	model, stream, streamOptions, err := func() (model string, stream bool, options protocol.StreamOptions, err error) {
 		defer func() {
 			var ok bool
@@ -201,6 +464,7 @@ func New(ctx *context.Context, provider *ProviderSpec) (*Context, error) {
 	c := &Context{
 		Ctx:       ctx,
 		Provider:  provider,
+		Consumer:  ConsumerOf(ctx),
 		Req:       req,
 		ReqBody:   body,
 		OpenAIReq: openAIReq,
@@ -211,9 +475,97 @@ func New(ctx *context.Context, provider *ProviderSpec) (*Context, error) {
 		},
 		RespType: respType,
 	}
+	if timeout, err := ParseRequestTimeout(req.HTTPHeader().Get(RequestTimeoutHeader)); err == nil && timeout > 0 {
+		c.deadline = received.Add(timeout)
+	}
 	return c, nil
 }
 
+// ParseRequestTimeout parses the value of RequestTimeoutHeader, it returns
+// 0 if the value is empty.
+func ParseRequestTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// SetDeadline sets the time the client gives up the request.
+func (c *Context) SetDeadline(deadline time.Time) {
+	c.deadline = deadline
+}
+
+// Deadline returns the deadline of the request, which is the earlier one
+// of the deadline set by the client and the deadline of the context of the
+// request. It returns false if the request has no deadline.
+func (c *Context) Deadline() (time.Time, bool) {
+	deadline := c.deadline
+	if c.Req != nil {
+		if d, ok := c.Req.Std().Context().Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// RemainingBudget returns the time left before the deadline of the
+// request, it returns false if the request has no deadline.
+func (c *Context) RemainingBudget(now time.Time) (time.Duration, bool) {
+	deadline, ok := c.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return deadline.Sub(now), true
+}
+
+// AddBudgetDecisions records the decisions of middlewares on the remaining
+// time budget of the request.
+func (c *Context) AddBudgetDecisions(decisions ...*BudgetDecision) {
+	c.budgetDecisions = append(c.budgetDecisions, decisions...)
+}
+
+// BudgetDecisions returns the decisions of middlewares on the remaining
+// time budget of the request.
+func (c *Context) BudgetDecisions() []*BudgetDecision {
+	return c.budgetDecisions
+}
+
+// SetResponseCheckFailures records the failed quality checks of the
+// response sent to the user, the response is not cached then.
+func (c *Context) SetResponseCheckFailures(failures []*ResponseCheckFailure) {
+	c.checkFailures = failures
+}
+
+// ResponseCheckFailures returns the failed quality checks of the response
+// sent to the user.
+func (c *Context) ResponseCheckFailures() []*ResponseCheckFailure {
+	return c.checkFailures
+}
+
+// Embedding returns the embedding of the text by the model memoized in the
+// request, and whether it is memoized, otherwise the text is embedded by
+// embed and memoized, so the middlewares embedding the same text share one
+// embedding call. The text is matched with its whitespaces collapsed, and
+// failures are not memoized. The embedding must not be modified.
+func (c *Context) Embedding(model, text string, embed func(text string) ([]float32, error)) ([]float32, bool, error) {
+	key := model + "\x00" + strings.Join(strings.Fields(text), " ")
+	if embedding, ok := c.embeddings[key]; ok {
+		return embedding, true, nil
+	}
+	embedding, err := embed(text)
+	if err != nil {
+		return nil, false, err
+	}
+	if c.embeddings == nil {
+		c.embeddings = map[string][]float32{}
+	}
+	c.embeddings[key] = embedding
+	return embedding, false, nil
+}
+
 // GetResponse returns the response of the context.
 func (c *Context) GetResponse() *Response {
 	return c.resp
@@ -232,6 +584,159 @@ func (c *Context) AddCallBack(cb func(fc *FinishContext)) {
 	c.callBacks = append(c.callBacks, cb)
 }
 
+// OnResponse adds a handler to the context.
+// The handler will be called after the provider sets the response and
+// before the response is sent to the user, so it can inspect or replace
+// the response.
+func (c *Context) OnResponse(handler func(ctx *Context)) {
+	c.responseHandlers = append(c.responseHandlers, handler)
+}
+
+// ResponseHandlers returns all response handlers registered in the context.
+func (c *Context) ResponseHandlers() []func(ctx *Context) {
+	return c.responseHandlers
+}
+
+// OnDeliver adds a transform of the response sent to the user. The
+// transforms run after the response handlers, including the requests
+// stopped by middlewares, and the callbacks see the response before them,
+// so the transforms must not change what is cached or recorded.
+func (c *Context) OnDeliver(transform func(resp *Response)) {
+	c.deliverers = append(c.deliverers, transform)
+}
+
+// Deliverers returns all delivery transforms registered in the context.
+func (c *Context) Deliverers() []func(resp *Response) {
+	return c.deliverers
+}
+
+// FlagEnabled checks whether the feature flag is enabled for the request,
+// unknown flags are disabled.
+func (c *Context) FlagEnabled(name string) bool {
+	return c.Flags[name]
+}
+
+// Resident checks whether the request or its data may go to the region,
+// which is the region of a provider, collection or sink. A request pinned
+// to a region never goes to others, including the unlabeled ones.
+func (c *Context) Resident(region string) bool {
+	return Resident(c.ConsumerRegion, region)
+}
+
+// Resident checks whether the data of a consumer pinned to consumerRegion
+// may go to the region, any region is allowed if consumerRegion is empty.
+func Resident(consumerRegion, region string) bool {
+	return consumerRegion == "" || consumerRegion == region
+}
+
+// SetVariable sets a named value derived from the request, e.g. by
+// expression hooks, for the later middlewares. The value is a string or a
+// float64.
+func (c *Context) SetVariable(name string, value any) {
+	if c.variables == nil {
+		c.variables = map[string]any{}
+	}
+	c.variables[name] = value
+}
+
+// Variable returns the value of the variable set by SetVariable.
+func (c *Context) Variable(name string) (any, bool) {
+	v, ok := c.variables[name]
+	return v, ok
+}
+
+// Variables returns the variables of the request.
+func (c *Context) Variables() map[string]any {
+	return c.variables
+}
+
+// AddCitations records the source documents injected into the request.
+func (c *Context) AddCitations(citations ...*Citation) {
+	c.citations = append(c.citations, citations...)
+}
+
+// Citations returns the source documents injected into the request.
+func (c *Context) Citations() []*Citation {
+	return c.citations
+}
+
+// AddConversationRepairs records the repairs made to the messages of the
+// request.
+func (c *Context) AddConversationRepairs(repairs ...*ConversationRepair) {
+	c.repairs = append(c.repairs, repairs...)
+}
+
+// ConversationRepairs returns the repairs made to the messages of the
+// request.
+func (c *Context) ConversationRepairs() []*ConversationRepair {
+	return c.repairs
+}
+
+// AddPackedChunks records the decisions of packing retrieved chunks into
+// the request.
+func (c *Context) AddPackedChunks(chunks ...*PackedChunk) {
+	c.packedChunks = append(c.packedChunks, chunks...)
+}
+
+// PackedChunks returns the decisions of packing retrieved chunks into the
+// request.
+func (c *Context) PackedChunks() []*PackedChunk {
+	return c.packedChunks
+}
+
+// AddImageOptimizations records the processing of the inline images of
+// the request.
+func (c *Context) AddImageOptimizations(images ...*ImageOptimization) {
+	c.images = append(c.images, images...)
+}
+
+// ImageOptimizations returns the processing of the inline images of the
+// request.
+func (c *Context) ImageOptimizations() []*ImageOptimization {
+	return c.images
+}
+
+// RequestContext returns the context of the requests to the provider, it
+// is the context of the original request unless the context is forked.
+func (c *Context) RequestContext() stdcontext.Context {
+	if c.reqCtx != nil {
+		return c.reqCtx
+	}
+	return c.Req.Context()
+}
+
+// Fork returns a copy of the context for a concurrent call to the
+// provider, e.g. a hedged request. The copy shares the request with the
+// context, but it has its own provider, request context, response,
+// callbacks and result, and it has no response handlers. The request of
+// the copy must not be modified.
+func (c *Context) Fork(reqCtx stdcontext.Context, provider *ProviderSpec) *Context {
+	f := *c
+	f.Provider = provider
+	f.reqCtx = reqCtx
+	f.ParseMetricFn = nil
+	f.UpstreamBody = nil
+	f.resp = nil
+	f.callBacks = nil
+	f.responseHandlers = nil
+	f.stop = false
+	f.result = ""
+	return &f
+}
+
+// Join adopts the call to the provider made by the forked context, its
+// provider, response, callbacks and result replace the ones of the
+// context.
+func (c *Context) Join(f *Context) {
+	c.Provider = f.Provider
+	c.ParseMetricFn = f.ParseMetricFn
+	c.UpstreamBody = f.UpstreamBody
+	c.resp = f.resp
+	c.callBacks = append(c.callBacks, f.callBacks...)
+	c.stop = f.stop
+	c.result = f.result
+}
+
 // CallBacks returns all callback functions registered in the context.
 func (c *Context) Callbacks() []func(fc *FinishContext) {
 	return c.callBacks
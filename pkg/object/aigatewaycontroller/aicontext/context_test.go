@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/megaease/easegress/v2/pkg/context"
 	"github.com/megaease/easegress/v2/pkg/logger"
@@ -118,3 +119,91 @@ func TestContext(t *testing.T) {
 	}
 
 }
+
+func TestDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	newContext := func(timeout string) *Context {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt"}`)))
+		assert.Nil(err)
+		if timeout != "" {
+			req.Header.Set(RequestTimeoutHeader, timeout)
+		}
+		setRequest(t, ctx, "deadline", req)
+		aiCtx, err := New(ctx, &ProviderSpec{Name: "openai", ProviderType: "openai"})
+		assert.Nil(err)
+		return aiCtx
+	}
+
+	aiCtx := newContext("")
+	_, ok := aiCtx.RemainingBudget(time.Now())
+	assert.False(ok)
+
+	for _, timeout := range []string{"800", "800ms"} {
+		aiCtx = newContext(timeout)
+		remaining, ok := aiCtx.RemainingBudget(time.Now())
+		assert.True(ok)
+		assert.True(remaining > 700*time.Millisecond && remaining <= 800*time.Millisecond, remaining)
+	}
+
+	// invalid timeouts are ignored.
+	aiCtx = newContext("soon")
+	_, ok = aiCtx.Deadline()
+	assert.False(ok)
+
+	now := time.Now()
+	aiCtx.SetDeadline(now.Add(time.Second))
+	remaining, ok := aiCtx.RemainingBudget(now)
+	assert.True(ok)
+	assert.Equal(time.Second, remaining)
+
+	timeout, err := ParseRequestTimeout("1.5s")
+	assert.NoError(err)
+	assert.Equal(1500*time.Millisecond, timeout)
+}
+
+func TestConsumerID(t *testing.T) {
+	assert := assert.New(t)
+
+	newContext := func() *context.Context {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt-4o"}`)))
+		assert.Nil(err)
+		req.Header.Set("X-Consumer", "spoofed")
+		req.Header.Set("X-Group", "admins")
+		setRequest(t, ctx, "consumer", req)
+		return ctx
+	}
+	spec := &ProviderSpec{Name: "openai", ProviderType: "openai"}
+
+	// the headers identify the consumer if the consumers are not managed.
+	ctx := newContext()
+	assert.Nil(ConsumerOf(ctx))
+	assert.Equal("spoofed", ConsumerID(ctx, "X-Consumer"))
+	assert.Equal("", ConsumerID(ctx, ""))
+	aiCtx, err := New(ctx, spec)
+	assert.Nil(err)
+	assert.Nil(aiCtx.Consumer)
+	assert.Equal("spoofed", aiCtx.ConsumerID("X-Consumer"))
+	assert.Equal("admins", aiCtx.ConsumerGroup("X-Group"))
+
+	// the headers are ignored once the consumers are managed, even if the
+	// request is anonymous.
+	ctx = newContext()
+	SetConsumer(ctx, &Consumer{})
+	assert.Equal("", ConsumerID(ctx, "X-Consumer"))
+	aiCtx, err = New(ctx, spec)
+	assert.Nil(err)
+	assert.Equal("", aiCtx.ConsumerID("X-Consumer"))
+	assert.Equal("", aiCtx.ConsumerGroup("X-Group"))
+
+	ctx = newContext()
+	SetConsumer(ctx, &Consumer{ID: "alice", Group: "analysts", Region: "eu"})
+	assert.Equal("alice", ConsumerID(ctx, "X-Consumer"))
+	aiCtx, err = New(ctx, spec)
+	assert.Nil(err)
+	assert.Equal("alice", aiCtx.ConsumerID("X-Consumer"))
+	assert.Equal("analysts", aiCtx.ConsumerGroup("X-Group"))
+	assert.Equal(&Consumer{ID: "alice", Group: "analysts", Region: "eu"}, aiCtx.Consumer)
+}
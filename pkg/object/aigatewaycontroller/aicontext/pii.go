@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aicontext
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// PIIVault maps the PII values of a request to the placeholders replacing
+// them, so the placeholders in the response can be restored. It is only
+// held by the context of the request, and the values it holds are zeroed
+// once the response is sent. The copies of the values in the bodies of
+// the request and the response are not held by the vault, they are left
+// to the garbage collector.
+type PIIVault struct {
+	lock sync.Mutex
+	// key is the random key of the MACs of the values, so the values
+	// are not kept as the keys of placeholders, and can't be guessed by
+	// their hashes.
+	key []byte
+	// values are kept as bytes, so they can be zeroed by Wipe.
+	values map[string][]byte
+	// placeholders maps the MACs of the values to their placeholders.
+	placeholders map[[sha256.Size]byte]string
+	counts       map[string]int
+}
+
+// PIIVault returns the PII vault of the request, it is created on the
+// first call.
+func (c *Context) PIIVault() *PIIVault {
+	if c.piiVault == nil {
+		c.piiVault = newPIIVault()
+	}
+	return c.piiVault
+}
+
+func newPIIVault() *PIIVault {
+	key := make([]byte, sha256.Size)
+	// never fails, see the doc of crypto/rand.Read.
+	rand.Read(key)
+	return &PIIVault{
+		key:          key,
+		values:       map[string][]byte{},
+		placeholders: map[[sha256.Size]byte]string{},
+		counts:       map[string]int{},
+	}
+}
+
+// mac returns the MAC of the value, it must be called with the lock held.
+func (v *PIIVault) mac(value string) [sha256.Size]byte {
+	h := hmac.New(sha256.New, v.key)
+	h.Write([]byte(value))
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Tokenize returns the placeholder of the value, like [EMAIL_1]. The same
+// value always gets the same placeholder in a request, and the values of
+// a kind are numbered in the order they are seen.
+func (v *PIIVault) Tokenize(kind, value string) string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	mac := v.mac(value)
+	if placeholder, ok := v.placeholders[mac]; ok {
+		return placeholder
+	}
+	v.counts[kind]++
+	placeholder := fmt.Sprintf("[%s_%d]", kind, v.counts[kind])
+	v.placeholders[mac] = placeholder
+	v.values[placeholder] = []byte(value)
+	return placeholder
+}
+
+// Len returns the number of the values in the vault.
+func (v *PIIVault) Len() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return len(v.values)
+}
+
+// Placeholders returns the placeholders in the vault.
+func (v *PIIVault) Placeholders() []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	placeholders := make([]string, 0, len(v.values))
+	for placeholder := range v.values {
+		placeholders = append(placeholders, placeholder)
+	}
+	return placeholders
+}
+
+// Restore replaces the placeholders in the text with their values, the
+// escape function, e.g. for JSON strings, is applied to the values if it
+// is not nil. The returned text is not held by the vault, so it is not
+// zeroed by Wipe.
+func (v *PIIVault) Restore(text string, escape func(string) string) string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.values) == 0 || !strings.Contains(text, "[") {
+		return text
+	}
+	oldnew := make([]string, 0, 2*len(v.values))
+	for placeholder, value := range v.values {
+		value := string(value)
+		if escape != nil {
+			value = escape(value)
+		}
+		oldnew = append(oldnew, placeholder, value)
+	}
+	return strings.NewReplacer(oldnew...).Replace(text)
+}
+
+// Wipe zeroes the values and the key of the vault, and empties it.
+func (v *PIIVault) Wipe() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for placeholder, value := range v.values {
+		clear(value)
+		delete(v.values, placeholder)
+	}
+	clear(v.key)
+	clear(v.placeholders)
+	clear(v.counts)
+}
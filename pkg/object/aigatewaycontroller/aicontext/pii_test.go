@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aicontext
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPIIVault(t *testing.T) {
+	assert := assert.New(t)
+
+	v := newPIIVault()
+	assert.Equal("[EMAIL_1]", v.Tokenize("EMAIL", "alice@example.com"))
+	assert.Equal("[PHONE_1]", v.Tokenize("PHONE", "+1 555 0100"))
+	assert.Equal("[EMAIL_2]", v.Tokenize("EMAIL", "bob@example.com"))
+	// the same value always gets the same placeholder.
+	assert.Equal("[EMAIL_1]", v.Tokenize("EMAIL", "alice@example.com"))
+	assert.Equal(3, v.Len())
+	placeholders := v.Placeholders()
+	sort.Strings(placeholders)
+	assert.Equal([]string{"[EMAIL_1]", "[EMAIL_2]", "[PHONE_1]"}, placeholders)
+
+	assert.Equal("mail alice@example.com or bob@example.com", v.Restore("mail [EMAIL_1] or [EMAIL_2]", nil))
+	assert.Equal(`"+1 555 0100"`, v.Restore("[PHONE_1]", strconv.Quote))
+	assert.Equal("no placeholders", v.Restore("no placeholders", nil))
+	assert.Equal("[EMAIL_9]", v.Restore("[EMAIL_9]", nil))
+
+	// the values are not kept as the keys of placeholders, and the MACs
+	// differ between vaults.
+	for mac := range v.placeholders {
+		assert.NotContains(string(mac[:]), "example.com")
+	}
+	other := newPIIVault()
+	other.Tokenize("EMAIL", "alice@example.com")
+	for mac := range other.placeholders {
+		_, ok := v.placeholders[mac]
+		assert.False(ok)
+	}
+
+	// the values and the key are zeroed by wipes.
+	values := [][]byte{}
+	for _, value := range v.values {
+		values = append(values, value)
+	}
+	key := v.key
+	v.Wipe()
+	for _, value := range values {
+		assert.Equal(make([]byte, len(value)), value)
+	}
+	assert.Equal(make([]byte, len(key)), key)
+	assert.Zero(v.Len())
+	assert.Empty(v.placeholders)
+	assert.Equal("[EMAIL_1]", v.Restore("[EMAIL_1]", nil))
+}
@@ -20,24 +20,36 @@ package aigatewaycontroller
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"maps"
 	"net/http"
+	"reflect"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/megaease/easegress/v2/pkg/api"
 	"github.com/megaease/easegress/v2/pkg/common"
 	"github.com/megaease/easegress/v2/pkg/context"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/consumers"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/corpus"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/moderation"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/sessionstate"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/streamresume"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/usagesink"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/usagestore"
 	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
 	"github.com/megaease/easegress/v2/pkg/supervisor"
 	"github.com/megaease/easegress/v2/pkg/util/codectool"
@@ -96,6 +108,7 @@ type (
 	// AIGatewayHandler is used to handle AI traffic.
 	AIGatewayHandler interface {
 		Handle(ctx *context.Context, providerName string, middlewares []string) string
+		ValidateMiddlewares(names []string) error
 	}
 
 	// AIGatewayController is the controller for AI Gateway.
@@ -104,15 +117,107 @@ type (
 		superSpec *supervisor.Spec
 		spec      *Spec
 
-		providers   map[string]providers.Provider
-		middlewares map[string]middlewares.Middleware
-		metricshub  *metricshub.MetricsHub
+		// providerSets points to the providers in use, see providerSet.
+		providerSets *atomic.Pointer[providerSet]
+		middlewares  map[string]middlewares.Middleware
+		metricshub   *metricshub.MetricsHub
+		// metricLabeler computes the custom labels of the request
+		// metrics, it is nil if there are no custom labels.
+		metricLabeler *metricLabeler
+		usageSink     usagesink.Sink
+		usageStore    *usagestore.Store
+		consumers     *consumers.Registry
+		flags         *featureFlags
+		endpoints     *endpoints
+		rateLimiter   *rateLimiter
+		latencySLO    *latencySLO
+		residency     *residency
+		// responseValidator checks the quality of the responses, it is
+		// nil if no response validators are configured.
+		responseValidator *middlewares.ResponseValidator
+		moderator         *moderation.Moderator
+		corpus            *corpus.Sampler
+		streams           *streamresume.Store
+		sessions          *sessionstate.Store
+		// specDiffs keeps the spec diffs of the latest reloads.
+		specDiffs *specDiffHistory
+		// readiness gates the AI traffic until the dependencies are
+		// reachable, it is nil if readiness is not configured.
+		readiness *readiness
+
+		middlewareStates     atomic.Pointer[middlewareStates]
+		middlewareStatesLock sync.Mutex
 	}
 
 	// Spec describes AIGatewayController.
 	Spec struct {
-		Providers   []*aicontext.ProviderSpec     `json:"providers,omitempty"`
-		Middlewares []*middlewares.MiddlewareSpec `json:"middlewares,omitempty"`
+		Providers []*aicontext.ProviderSpec `json:"providers,omitempty"`
+		// ProviderTemplates are the base provider definitions extended by
+		// the providers.
+		ProviderTemplates []*ProviderTemplateSpec       `json:"providerTemplates,omitempty"`
+		Middlewares       []*middlewares.MiddlewareSpec `json:"middlewares,omitempty"`
+		// Scope is composed into the names of the collections and the key
+		// prefixes of the vector databases of the middlewares, so the
+		// controllers of environments never see the data of each other.
+		Scope string `json:"scope,omitempty"`
+		// SharedBackend tells the vector databases are shared with the
+		// controllers of other environments, Scope is required then.
+		SharedBackend bool `json:"sharedBackend,omitempty"`
+		// ProviderGroups balance the requests among providers by weight.
+		ProviderGroups []*ProviderGroupSpec `json:"providerGroups,omitempty"`
+		// LatencySLO demotes the providers breaching their TTFT targets
+		// in the provider groups.
+		LatencySLO *LatencySLOSpec `json:"latencySLO,omitempty"`
+		// ResponseValidators check the quality of the responses of the
+		// models before they are sent to the user and cached.
+		ResponseValidators []*middlewares.ResponseValidatorSpec `json:"responseValidators,omitempty"`
+		UsageSink          *usagesink.Spec                      `json:"usageSink,omitempty"`
+		// UsageStore aggregates the usage for reports by consumer, model
+		// and day.
+		UsageStore *usagestore.Spec `json:"usageStore,omitempty"`
+		// Consumers authenticates the requests with the consumer keys
+		// managed by the admin API.
+		Consumers *consumers.Spec `json:"consumers,omitempty"`
+		// ConsumerIDHeader is the request header carrying the consumer ID
+		// of the rate limit, the feature flags, the usage and the corpus.
+		// The consumers set it to the consumer name, and it defaults to
+		// X-Consumer-Id then. Otherwise it is usually set by the
+		// authentication filters, and there is no consumer if it is empty.
+		ConsumerIDHeader string `json:"consumerIDHeader,omitempty"`
+		// FeatureFlags are resolved per consumer for gradual rollouts of
+		// middleware behaviors.
+		FeatureFlags *FeatureFlagsSpec `json:"featureFlags,omitempty"`
+		// Endpoints controls the endpoints served, all supported endpoints
+		// are served if it is nil.
+		Endpoints *EndpointsSpec `json:"endpoints,omitempty"`
+		// RateLimit limits the requests and tokens of consumers.
+		RateLimit *RateLimitSpec `json:"rateLimit,omitempty"`
+		// RateLimitHeaders is the policy of the x-ratelimit-* response
+		// headers, passthrough keeps the ones of providers, synthesized
+		// computes them from RateLimit, and off removes them.
+		RateLimitHeaders string `json:"rateLimitHeaders,omitempty" jsonschema:"enum=,enum=passthrough,enum=synthesized,enum=off"`
+		// Moderation is the backend serving the moderations endpoint, it
+		// is shared by the ModerationGuard middlewares. The requests are
+		// proxied to the providers supporting moderations if it is nil.
+		Moderation *moderation.Spec `json:"moderation,omitempty"`
+		// Corpus samples the requests into a corpus for offline
+		// evaluation, stratified by model and consumer.
+		Corpus *corpus.Spec `json:"corpus,omitempty"`
+		// StreamResumption buffers the streaming responses, so clients
+		// losing a stream can resume it.
+		StreamResumption *streamresume.Spec `json:"streamResumption,omitempty"`
+		// SessionState keeps the metadata of the conversations across
+		// requests for the middlewares.
+		SessionState *sessionstate.Spec `json:"sessionState,omitempty"`
+		// MetricLabels are the custom labels of the request metrics, from
+		// request headers or JWT claims.
+		MetricLabels []*MetricLabelSpec `json:"metricLabels,omitempty"`
+		// Readiness rejects the AI traffic at startup until the vector
+		// databases and the required providers are reachable.
+		Readiness *ReadinessSpec `json:"readiness,omitempty"`
+		// Residency handles the requests of the consumers pinned to a
+		// region addressing providers out of the region.
+		Residency *ResidencySpec `json:"residency,omitempty"`
 	}
 
 	Status struct{}
@@ -120,8 +225,12 @@ type (
 
 // Validate validates the spec of AIGatewayController.
 func (spec *Spec) Validate() error {
+	effective, err := resolveProviders(spec)
+	if err != nil {
+		return err
+	}
 	nameSet := make(map[string]struct{})
-	for _, p := range spec.Providers {
+	for _, p := range effective {
 		if p.Name == "" {
 			return fmt.Errorf("provider name cannot be empty")
 		}
@@ -136,12 +245,72 @@ func (spec *Spec) Validate() error {
 		if err := providers.ValidateSpec(p); err != nil {
 			return err
 		}
+		if err := middlewares.ValidateOutputScrubSpecs(p.OutputScrub); err != nil {
+			return fmt.Errorf("provider %s has invalid output scrub: %w", p.Name, err)
+		}
+	}
+	if err := validateProviderGroups(spec.ProviderGroups, effective); err != nil {
+		return err
+	}
+	if err := validateLatencySLOSpec(spec.LatencySLO, effective); err != nil {
+		return fmt.Errorf("invalid latency SLO: %w", err)
+	}
+	if err := validateResponseValidators(spec.ResponseValidators, effective, spec.ProviderGroups); err != nil {
+		return err
+	}
+	if err := validateResidencySpec(spec.Residency, effective, spec.ProviderGroups); err != nil {
+		return fmt.Errorf("invalid residency: %w", err)
+	}
+	if err := validateMetricLabels(spec.MetricLabels); err != nil {
+		return err
+	}
+	if err := validateScope(spec.Scope, spec.SharedBackend); err != nil {
+		return err
 	}
 	for _, m := range spec.Middlewares {
 		err := middlewares.ValidateSpec(m)
 		if err != nil {
 			return fmt.Errorf("middleware %s has invalid spec: %w", m.Name, err)
 		}
+		if middlewares.RequiresModerator(m) && spec.Moderation == nil {
+			return fmt.Errorf("middleware %s requires the moderation backend", m.Name)
+		}
+	}
+	if err := moderation.ValidateSpec(spec.Moderation); err != nil {
+		return fmt.Errorf("invalid moderation: %w", err)
+	}
+	if err := validateFeatureFlagsSpec(spec.FeatureFlags, spec.consumerIDHeader()); err != nil {
+		return err
+	}
+	if err := validateEndpointsSpec(spec.Endpoints); err != nil {
+		return err
+	}
+	if err := validateRateLimitSpec(spec.RateLimit, spec.RateLimitHeaders); err != nil {
+		return fmt.Errorf("invalid rate limit: %w", err)
+	}
+	if err := usagesink.ValidateSpec(spec.UsageSink); err != nil {
+		return fmt.Errorf("invalid usage sink: %w", err)
+	}
+	if err := usagestore.ValidateSpec(spec.UsageStore); err != nil {
+		return fmt.Errorf("invalid usage store: %w", err)
+	}
+	if err := consumers.ValidateSpec(spec.Consumers); err != nil {
+		return fmt.Errorf("invalid consumers: %w", err)
+	}
+	if err := validateSkippableMiddlewares(spec.Consumers, spec.Middlewares); err != nil {
+		return fmt.Errorf("invalid consumers: %w", err)
+	}
+	if err := corpus.ValidateSpec(spec.Corpus); err != nil {
+		return fmt.Errorf("invalid corpus: %w", err)
+	}
+	if err := streamresume.ValidateSpec(spec.StreamResumption); err != nil {
+		return fmt.Errorf("invalid stream resumption: %w", err)
+	}
+	if err := sessionstate.ValidateSpec(spec.SessionState); err != nil {
+		return fmt.Errorf("invalid session state: %w", err)
+	}
+	if err := validateReadinessSpec(spec.Readiness); err != nil {
+		return fmt.Errorf("invalid readiness: %w", err)
 	}
 
 	return nil
@@ -184,34 +353,173 @@ func (agc *AIGatewayController) Inherit(superSpec *supervisor.Spec, previousGene
 }
 
 func (agc *AIGatewayController) reload(prev *AIGatewayController) {
-	agc.providers = make(map[string]providers.Provider)
-	for _, s := range agc.spec.Providers {
-		provider := providers.NewProvider(s)
-		agc.providers[s.Name] = provider
+	// diff is nil for the first generation, nothing is recorded then.
+	var diff *SpecDiff
+	if prev != nil {
+		agc.specDiffs = prev.specDiffs
+		diff = diffSpecs(prev.spec, agc.spec)
+	} else {
+		agc.specDiffs = &specDiffHistory{}
 	}
+
+	diff.component("providers", agc.reloadProviders(prev))
+	if agc.spec.Moderation != nil {
+		agc.moderator = moderation.New(agc.spec.Moderation)
+	}
+	diff.component("moderator", componentAction(prev != nil && prev.moderator != nil, agc.moderator != nil))
+	agc.middlewares = make(map[string]middlewares.Middleware)
 	for _, m := range agc.spec.Middlewares {
-		middleware := middlewares.NewMiddleware(m)
+		middleware := middlewares.NewMiddleware(middlewares.ScopeSpec(m, agc.spec.Scope))
+		if setter, ok := middleware.(middlewares.ModeratorSetter); ok {
+			setter.SetModerator(agc.moderator)
+		}
+		if setter, ok := middleware.(middlewares.GeneratorSetter); ok {
+			setter.SetGenerator(agc)
+		}
 		agc.middlewares[m.Name] = middleware
 	}
+	if prev != nil {
+		for _, m := range agc.spec.Middlewares {
+			diff.component("middleware/"+m.Name, componentAction(prev.middlewares[m.Name] != nil, true))
+		}
+		for _, m := range prev.spec.Middlewares {
+			if agc.middlewares[m.Name] == nil {
+				diff.component("middleware/"+m.Name, componentClosed)
+			}
+		}
+		prev.closeMiddlewares()
+	}
+	agc.initMiddlewareStates(prev)
+	agc.flags = newFeatureFlags(agc.spec.FeatureFlags)
+	agc.endpoints = newEndpoints(agc.spec.Endpoints)
+	agc.residency = newResidency(agc.spec.Residency)
+	diff.component("featureFlags", componentRecreated)
+	diff.component("endpoints", componentRecreated)
+	diff.component("residency", componentRecreated)
+	diff.component("rateLimiter", agc.reloadRateLimiter(prev))
+	diff.component("latencySLO", agc.reloadLatencySLO(prev))
+	diff.component("responseValidators", agc.reloadResponseValidator(prev))
+
+	if prev != nil {
+		prev.closeUsageSink()
+	}
+	if agc.spec.UsageSink != nil {
+		sink, err := usagesink.New(agc.superSpec.Name(), agc.spec.UsageSink)
+		if err != nil {
+			logger.Errorf("failed to create usage sink: %v", err)
+		} else {
+			agc.usageSink = sink
+		}
+	}
+	diff.component("usageSink", componentAction(prev != nil && prev.usageSink != nil, agc.usageSink != nil))
+
+	diff.component("usageStore", agc.reloadUsageStore(prev))
+	diff.component("consumers", agc.reloadConsumers(prev))
+
+	// the samples of the previous generation are written, so a new
+	// window starts with the new spec.
+	if prev != nil && prev.corpus != nil {
+		prev.corpus.Close()
+	}
+	if agc.spec.Corpus != nil {
+		agc.corpus = corpus.New(agc.spec.Corpus, agc.super.Options().Name)
+	}
+	diff.component("corpus", componentAction(prev != nil && prev.corpus != nil, agc.corpus != nil))
+	diff.component("streamResumption", agc.reloadStreams(prev))
+	diff.component("sessionState", agc.reloadSessions(prev))
 
 	if prev != nil && prev.metricshub != nil {
 		agc.metricshub = prev.metricshub
+		diff.component("metricsHub", componentKept)
 		logger.Infof("AIGatewayController reusing MetricsHub from previous generation")
 	} else {
 		agc.metricshub = metricshub.New(agc.superSpec)
+		diff.component("metricsHub", componentCreated)
 		logger.Infof("AIGatewayController created new MetricsHub for AIGatewayController")
 	}
+	agc.metricLabeler = newMetricLabeler(agc.spec.MetricLabels)
+	agc.metricshub.SetCustomLabels(agc.metricLabeler.names())
+	diff.component("readiness", agc.reloadReadiness(prev))
+	if diff != nil {
+		agc.specDiffs.add(diff)
+		logger.Infof("AIGatewayController %s reloaded: %s", agc.superSpec.Name(), diff)
+	}
 	globalAGC.Store(agc)
 
 	agc.registerAPIs()
 }
 
+// reloadUsageStore reuses the usage store of the previous generation, so
+// the usage of in-flight requests is not lost. The store is recreated if
+// its journal or Redis changes.
+func (agc *AIGatewayController) reloadUsageStore(prev *AIGatewayController) string {
+	var store *usagestore.Store
+	if prev != nil {
+		store = prev.usageStore
+	}
+	if agc.spec.UsageStore == nil {
+		if store != nil {
+			store.Close()
+			return componentClosed
+		}
+		return ""
+	}
+	recreated := false
+	if store != nil && (!reflect.DeepEqual(prev.spec.UsageStore.Journal, agc.spec.UsageStore.Journal) ||
+		!reflect.DeepEqual(prev.spec.UsageStore.Redis, agc.spec.UsageStore.Redis)) {
+		store.Close()
+		store = nil
+		recreated = true
+	}
+	if store != nil {
+		store.SetSpec(agc.spec.UsageStore)
+		agc.usageStore = store
+		return componentKept
+	}
+	cluster := agc.super.Cluster()
+	store, err := usagestore.New(agc.spec.UsageStore, cluster,
+		cluster.Layout().AIGatewayUsagePrefix(), cluster.Layout().AIGatewayMemberUsagePrefix())
+	if err != nil {
+		logger.Errorf("failed to create usage store: %v", err)
+		return componentFailed
+	}
+	agc.usageStore = store
+	if recreated {
+		return componentRecreated
+	}
+	return componentCreated
+}
+
+// reloadRateLimiter reuses the rate limiter of the previous generation, so
+// the usage in the current windows is kept.
+func (agc *AIGatewayController) reloadRateLimiter(prev *AIGatewayController) string {
+	if agc.spec.RateLimit == nil {
+		if prev != nil && prev.rateLimiter != nil {
+			return componentClosed
+		}
+		return ""
+	}
+	if prev != nil && prev.rateLimiter != nil {
+		prev.rateLimiter.setSpec(agc.spec.RateLimit)
+		agc.rateLimiter = prev.rateLimiter
+		return componentKept
+	}
+	agc.rateLimiter = newRateLimiter(agc.spec.RateLimit)
+	return componentCreated
+}
+
 // Status returns the status of AIGatewayController.
 func (agc *AIGatewayController) Status() *supervisor.Status {
 	stats := agc.metricshub.GetStats()
 
 	status := make(map[string]interface{})
 	status["providerStats"] = stats
+	if demotions := agc.latencySLO.demotions(); len(demotions) > 0 {
+		status["providerDemotions"] = demotions
+	}
+	if agc.readiness != nil {
+		status["readiness"] = agc.readiness.status()
+	}
 	return &supervisor.Status{ObjectStatus: status}
 }
 
@@ -224,25 +532,220 @@ func (agc *AIGatewayController) InheritClose() {
 // Close closes AIGatewayController.
 func (agc *AIGatewayController) Close() {
 	logger.Infof("closing AIGatewayController")
+	agc.readiness.close()
+	agc.closeProviders()
+	agc.closeMiddlewares()
+	agc.closeUsageSink()
+	if agc.usageStore != nil {
+		agc.usageStore.Close()
+	}
+	if agc.consumers != nil {
+		agc.consumers.Close()
+	}
+	if agc.corpus != nil {
+		agc.corpus.Close()
+	}
+	if agc.streams != nil {
+		agc.streams.Close()
+	}
+	if agc.sessions != nil {
+		agc.sessions.Close()
+	}
 	agc.metricshub.Close()
 	agc.unregisterAPIs()
 	globalAGC.CompareAndSwap(agc, (*AIGatewayController)(nil))
 }
 
+func (agc *AIGatewayController) closeMiddlewares() {
+	for _, m := range agc.middlewares {
+		if closer, ok := m.(middlewares.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+func (agc *AIGatewayController) closeUsageSink() {
+	if agc.usageSink != nil {
+		agc.usageSink.Close()
+	}
+}
+
+// sendUsageEvent sends the usage of the request to the usage sink.
+func (agc *AIGatewayController) sendUsageEvent(ctx *context.Context, aiCtx *aicontext.Context, metric *metricshub.Metric) {
+	if agc.usageSink == nil || metric == nil {
+		return
+	}
+	if !aiCtx.Resident(agc.spec.UsageSink.Region) {
+		agc.residency.record(aiCtx.ConsumerRegion, residencyStageUsageSink, "skipped")
+		return
+	}
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	requestID := req.HTTPHeader().Get("X-Request-Id")
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	event := &usagesink.Event{
+		RequestID: requestID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Flags:     aiCtx.Flags,
+		Metric:    *metric,
+	}
+	event.ConsumerID = aiCtx.ConsumerID(agc.spec.consumerIDHeader())
+	agc.usageSink.Send(event)
+}
+
+// labelMetric sets the values of the custom labels and the trace ID of
+// the metric.
+func (agc *AIGatewayController) labelMetric(ctx *context.Context, metric *metricshub.Metric) {
+	if metric == nil {
+		return
+	}
+	metric.TraceID = traceID(ctx)
+	if agc.metricLabeler == nil {
+		return
+	}
+	metric.CustomLabels = agc.metricLabeler.values(ctx.GetInputRequest().(*httpprot.Request))
+}
+
+// traceID returns the trace ID of the request, it is empty if tracing is
+// not enabled or the request is not sampled.
+func traceID(ctx *context.Context) string {
+	span := ctx.Span()
+	if span == nil || span.IsNoop() {
+		return ""
+	}
+	sc := span.SpanContext()
+	if !sc.IsValid() || !sc.IsSampled() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// sampleCorpus offers the finished request to the corpus sampler.
+func (agc *AIGatewayController) sampleCorpus(ctx *context.Context, aiCtx *aicontext.Context, fc *aicontext.FinishContext) {
+	if agc.corpus == nil {
+		return
+	}
+	if !aiCtx.Resident(agc.spec.Corpus.Region) {
+		agc.residency.record(aiCtx.ConsumerRegion, residencyStageCorpus, "skipped")
+		return
+	}
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	requestID := req.HTTPHeader().Get("X-Request-Id")
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	agc.corpus.Offer(&corpus.Request{
+		RequestID:  requestID,
+		Model:      aiCtx.ReqInfo.Model,
+		Consumer:   aiCtx.ConsumerID(agc.spec.consumerIDHeader()),
+		Provider:   aiCtx.Provider.Name,
+		Endpoint:   string(aiCtx.RespType),
+		StatusCode: fc.StatusCode,
+		Body:       aiCtx.ReqBody,
+		Response: func() []byte {
+			return fc.RespBody
+		},
+	})
+}
+
+// updateUsageStore aggregates the usage of the request to the usage store.
+func (agc *AIGatewayController) updateUsageStore(aiCtx *aicontext.Context, metric *metricshub.Metric) {
+	if agc.usageStore == nil || metric == nil {
+		return
+	}
+	consumer := aiCtx.ConsumerID(agc.spec.consumerIDHeader())
+	agc.usageStore.Update(aiCtx.Req.HTTPHeader().Get("X-Request-Id"), consumer, metric, time.Now())
+}
+
 func (agc *AIGatewayController) Handle(ctx *context.Context, providerName string, middlewares []string) string {
-	if _, ok := agc.providers[providerName]; !ok || providerName == "" {
+	if !agc.checkReadiness(ctx) {
+		return string(aicontext.ResultServerError)
+	}
+	// the middlewares of the controller may be changed after the filter
+	// is validated.
+	if err := agc.ValidateMiddlewares(middlewares); err != nil {
+		agc.setErrResponse(ctx, err)
+		return string(aicontext.ResultInternalError)
+	}
+	if !agc.endpoints.check(ctx) {
+		return string(aicontext.ResultClientError)
+	}
+	if !agc.authenticateConsumer(ctx) {
+		return string(aicontext.ResultClientError)
+	}
+	if result, ok := agc.resumeStream(ctx); ok {
+		return result
+	}
+	if !agc.checkRateLimit(ctx) {
+		return string(aicontext.ResultClientError)
+	}
+
+	set := agc.acquireProviders()
+	if set == nil {
+		agc.setErrResponse(ctx, fmt.Errorf("AIGatewayController is closed"))
+		return string(aicontext.ResultInternalError)
+	}
+	// the response body is read from the provider after Handle returns, so
+	// the providers are released after the finish actions of the request.
+	defer ctx.OnFinish(set.release)
+
+	region := agc.consumerRegion(ctx)
+	provider, err := agc.residentProvider(set, providerName, region, residencyStageRouting)
+	if errors.Is(err, errNotResident) {
+		setEndpointErrResponse(ctx, http.StatusForbidden, errCodeResidencyViolation,
+			fmt.Sprintf("The request can not be served in region %s of the consumer.", region))
+		ctx.AddTag(err.Error())
+		return string(aicontext.ResultClientError)
+	}
+	if err != nil {
 		agc.setErrResponse(ctx, fmt.Errorf("provider %s not found", providerName))
 		return string(aicontext.ResultProviderError)
 	}
+	group := agc.hedgedGroup(providerName)
+	if resolved := provider.Name(); resolved != providerName {
+		ctx.AddTag(fmt.Sprintf("providerGroup: %s, provider: %s", providerName, resolved))
+		providerName = resolved
+	}
 
-	aiCtx, err := aicontext.New(ctx, agc.providers[providerName].Spec())
+	aiCtx, err := aicontext.New(ctx, provider.Spec())
 	if err != nil {
 		agc.setErrResponse(ctx, fmt.Errorf("failed to create AI context: %w", err))
 		return string(aicontext.ResultInternalError)
 	}
+	if !agc.checkCapability(ctx, aiCtx) {
+		return string(aicontext.ResultClientError)
+	}
+	agc.detachStream(aiCtx)
+	agc.attachSession(aiCtx)
+
+	aiCtx.ConsumerRegion = region
+	aiCtx.Flags = agc.flags.resolve(aiCtx, agc.spec.consumerIDHeader())
+	if len(aiCtx.Flags) > 0 {
+		ctx.AddTag("featureFlags: " + formatFeatureFlags(aiCtx.Flags))
+	}
+
+	// the output is scrubbed before the response handlers of middlewares,
+	// so they see the clean content, and the semantic cache stores it. The
+	// scrubber is the one of the provider serving the response, which may
+	// be another member of a hedged group.
+	if len(set.scrubbers) > 0 {
+		aiCtx.OnResponse(func(aiCtx *aicontext.Context) {
+			if scrubber := set.scrubbers[aiCtx.Provider.Name]; scrubber != nil {
+				scrubber.Handle(aiCtx)
+			}
+		})
+	}
 
 	start := time.Now().UnixMilli()
+	states := agc.getMiddlewareStates()
 	for _, middlewareName := range middlewares {
+		if state, ok := states[middlewareName]; ok && !state.Enabled {
+			continue
+		}
+		if aiCtx.Consumer.Skips(middlewareName) {
+			continue
+		}
 		if middleware, ok := agc.middlewares[middlewareName]; ok {
 			middleware.Handle(aiCtx)
 			if aiCtx.IsStopped() {
@@ -251,11 +754,40 @@ func (agc *AIGatewayController) Handle(ctx *context.Context, providerName string
 			}
 		}
 	}
-	provider := agc.providers[providerName]
-	provider.Handle(aiCtx)
+	if aiCtx.RespType == aicontext.ResponseTypeModerations && agc.moderator != nil {
+		agc.moderate(aiCtx)
+	} else {
+		providerStart := time.Now()
+		if group != nil {
+			provider, providerStart = agc.handleHedged(aiCtx, set, group, provider)
+		} else {
+			provider.Handle(aiCtx)
+		}
+		agc.trackFirstToken(aiCtx, providerStart)
+		// the response of the provider is checked before the response
+		// handlers, which run once on the response passed to the user.
+		agc.validateResponse(aiCtx, set, provider)
+	}
+	for _, handler := range aiCtx.ResponseHandlers() {
+		handler(aiCtx)
+	}
 	return agc.processResult(ctx, aiCtx, start)
 }
 
+// eofHookReader calls onEOF once the reader is read to the end.
+type eofHookReader struct {
+	reader io.Reader
+	onEOF  func()
+}
+
+func (r *eofHookReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		r.onEOF()
+	}
+	return n, err
+}
+
 func GetGlobalAIGatewayHandler() (AIGatewayHandler, error) {
 	value := globalAGC.Load()
 	if value == nil {
@@ -269,6 +801,18 @@ func GetGlobalAIGatewayHandler() (AIGatewayHandler, error) {
 	return agc, nil
 }
 
+// ValidateMiddlewares checks the middlewares run in the order are safe,
+// the middlewares not found are ignored like Handle.
+func (agc *AIGatewayController) ValidateMiddlewares(names []string) error {
+	specs := make([]*middlewares.MiddlewareSpec, 0, len(names))
+	for _, name := range names {
+		if m, ok := agc.middlewares[name]; ok {
+			specs = append(specs, m.Spec())
+		}
+	}
+	return middlewares.ValidateOrder(specs)
+}
+
 func (agc *AIGatewayController) setErrResponse(ctx *context.Context, err error) {
 	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
 	if resp == nil {
@@ -295,36 +839,99 @@ func (agc *AIGatewayController) processResult(ctx *context.Context, aiCtx *aicon
 		return string(aicontext.ResultInternalError)
 	}
 
-	// set ai response to easegress response
-	egResp.SetStatusCode(aiResp.StatusCode)
-	if aiResp.ContentLength > 0 {
-		egResp.ContentLength = aiResp.ContentLength
-	}
-	maps.Copy(egResp.HTTPHeader(), aiResp.Header)
-
+	// the usage of the request is computed once from the whole response
+	// body, and aggregated to the usage store before the response is
+	// finished, so the journal of the usage store has it even if the
+	// member crashes right after the user gets the response.
 	var getRespBody func() []byte
+	usage := sync.OnceValues(func() (*aicontext.FinishContext, *metricshub.Metric) {
+		fc := &aicontext.FinishContext{
+			StatusCode: aiResp.StatusCode,
+			Header:     aiResp.Header,
+			RespBody:   getRespBody(),
+			Duration:   endTime - startTime,
+		}
+		if aiCtx.ParseMetricFn != nil {
+			metric := aiCtx.ParseMetricFn(fc)
+			agc.labelMetric(ctx, metric)
+			return fc, metric
+		}
+		metric := &metricshub.Metric{
+			Success:      aiResp.StatusCode == http.StatusOK,
+			Provider:     aiCtx.Provider.Name,
+			Duration:     fc.Duration,
+			Model:        aiCtx.ReqInfo.Model,
+			BaseURL:      aiCtx.Provider.BaseURL,
+			ResponseType: string(aiCtx.RespType),
+			ProviderType: aiCtx.Provider.ProviderType,
+		}
+		if aiResp.StatusCode != http.StatusOK {
+			metric.Error = metricshub.MetricInternalError
+		}
+		agc.labelMetric(ctx, metric)
+		return fc, metric
+	})
+	storeUsage := sync.OnceFunc(func() {
+		_, metric := usage()
+		agc.updateUsageStore(aiCtx, metric)
+	})
+
+	// the callbacks see the body before the delivery transforms, which
+	// change only the response sent to the user.
+	delivered := *aiResp
 	if aiResp.BodyBytes != nil {
-		egResp.SetPayload(aiResp.BodyBytes)
 		getRespBody = func() []byte {
 			return aiResp.BodyBytes
 		}
 	} else if aiResp.BodyReader != nil {
+		// the usage is stored once the body is read to the end, before
+		// its last bytes are sent to the user.
 		var buf bytes.Buffer
-		tee := io.TeeReader(aiResp.BodyReader, &buf)
-		egResp.SetPayload(tee)
+		delivered.BodyReader = &eofHookReader{
+			reader: io.TeeReader(aiResp.BodyReader, &buf),
+			onEOF:  storeUsage,
+		}
 		getRespBody = func() []byte {
 			return buf.Bytes()
 		}
+	} else {
+		getRespBody = func() []byte {
+			return nil
+		}
+	}
+	if deliverers := aiCtx.Deliverers(); len(deliverers) > 0 {
+		delivered.Header = aiResp.Header.Clone()
+		for _, deliver := range deliverers {
+			deliver(&delivered)
+		}
+	}
+
+	// set ai response to easegress response
+	egResp.SetStatusCode(delivered.StatusCode)
+	if delivered.ContentLength > 0 {
+		egResp.ContentLength = delivered.ContentLength
+	}
+	maps.Copy(egResp.HTTPHeader(), delivered.Header)
+	agc.applyRateLimitHeaders(ctx, egResp.HTTPHeader())
+	if delivered.BodyBytes != nil {
+		egResp.SetPayload(delivered.BodyBytes)
+	} else if delivered.BodyReader != nil {
+		egResp.SetPayload(agc.recordStream(aiCtx, egResp, delivered.BodyReader))
+	}
+	// the upstream of a detached request is closed here unless it is
+	// taken by the stream buffer.
+	if upstream := aiCtx.UpstreamBody; upstream != nil {
+		aiCtx.AddCallBack(func(*aicontext.FinishContext) {
+			upstream.Close()
+		})
+	}
+	if aiResp.BodyReader == nil {
+		storeUsage()
 	}
 	ctx.SetOutputResponse(egResp)
 
 	ctx.OnFinish(func() {
-		fc := &aicontext.FinishContext{
-			StatusCode: aiResp.StatusCode,
-			Header:     aiResp.Header,
-			RespBody:   getRespBody(),
-			Duration:   endTime - startTime,
-		}
+		fc, metric := usage()
 		for _, cb := range aiCtx.Callbacks() {
 			func() {
 				defer func() {
@@ -336,24 +943,13 @@ func (agc *AIGatewayController) processResult(ctx *context.Context, aiCtx *aicon
 				cb(fc)
 			}()
 		}
-		if aiCtx.ParseMetricFn != nil {
-			metric := aiCtx.ParseMetricFn(fc)
-			agc.metricshub.Update(metric)
-			return
-		}
-		metric := metricshub.Metric{
-			Success:      aiResp.StatusCode == http.StatusOK,
-			Provider:     aiCtx.Provider.Name,
-			Duration:     fc.Duration,
-			Model:        aiCtx.ReqInfo.Model,
-			BaseURL:      aiCtx.Provider.BaseURL,
-			ResponseType: string(aiCtx.RespType),
-			ProviderType: aiCtx.Provider.ProviderType,
-		}
-		if aiResp.StatusCode != http.StatusOK {
-			metric.Error = metricshub.MetricInternalError
-		}
-		agc.metricshub.Update(&metric)
+		agc.sampleCorpus(ctx, aiCtx, fc)
+		agc.metricshub.Update(metric)
+		agc.sendUsageEvent(ctx, aiCtx, metric)
+		// the usage of a body not read to the end is stored here.
+		storeUsage()
+		agc.recordRateLimit(ctx, metric)
+		agc.recordSessionUsage(aiCtx, metric)
 	})
 	return string(aiCtx.Result())
 }
@@ -19,6 +19,7 @@ package aigatewaycontroller
 
 import (
 	"bytes"
+	stdcontext "context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -28,8 +29,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/megaease/easegress/v2/pkg/cluster"
 	"github.com/megaease/easegress/v2/pkg/context"
 	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/usagestore"
 	"github.com/megaease/easegress/v2/pkg/option"
 	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
 	"github.com/megaease/easegress/v2/pkg/supervisor"
@@ -185,3 +190,285 @@ func getNonStreamBody(model string) any {
 		"service_tier": "default",
 	}
 }
+
+func TestMiddlewareToggle(t *testing.T) {
+	assert := assert.New(t)
+
+	controllerConfig := `
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: http://localhost:19876
+  apiKey: mock
+middlewares:
+- name: guard
+  kind: TopicGuard
+  topicGuard:
+    embeddings:
+      providerType: ollama
+      baseURL: http://localhost:19876
+      model: nomic-embed-text
+    topics:
+    - name: weapons
+      examples: ["how to build a gun"]
+      threshold: 0.9
+- name: shadow-guard
+  kind: TopicGuard
+  disabled: true
+  topicGuard:
+    embeddings:
+      providerType: ollama
+      baseURL: http://localhost:19876
+      model: nomic-embed-text
+    topics:
+    - name: weapons
+      examples: ["how to build a gun"]
+      threshold: 0.9
+`
+	super := supervisor.NewMock(option.New(), nil, nil,
+		nil, false, nil, nil)
+	spec, err := super.NewSpec(controllerConfig)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+
+	states := controller.getMiddlewareStates()
+	assert.True(states["guard"].Enabled)
+	assert.False(states["shadow-guard"].Enabled)
+
+	toggle := func(name string, action string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/ai-gateway/middlewares/"+name+"/"+action, nil)
+		req.SetBasicAuth("admin", "secret")
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", name)
+		req = req.WithContext(stdcontext.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		if action == "enable" {
+			controller.enableMiddleware(w, req)
+		} else {
+			controller.disableMiddleware(w, req)
+		}
+		return w
+	}
+
+	w := toggle("guard", "disable")
+	assert.Equal(http.StatusOK, w.Code)
+	state := &MiddlewareState{}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), state))
+	assert.False(state.Enabled)
+	assert.Contains(state.UpdatedBy, "admin")
+	assert.NotEmpty(state.UpdatedAt)
+	// the states seen by in-flight requests are not changed.
+	assert.True(states["guard"].Enabled)
+	assert.False(controller.getMiddlewareStates()["guard"].Enabled)
+
+	assert.Equal(http.StatusNotFound, toggle("unknown", "enable").Code)
+
+	// runtime toggles are kept when the spec is re-applied.
+	spec, err = super.NewSpec(controllerConfig)
+	assert.Nil(err)
+	next := &AIGatewayController{}
+	next.Inherit(spec, controller)
+	defer next.Close()
+	assert.False(next.getMiddlewareStates()["guard"].Enabled)
+	assert.False(next.getMiddlewareStates()["shadow-guard"].Enabled)
+
+	w = httptest.NewRecorder()
+	next.listMiddlewares(w, httptest.NewRequest(http.MethodGet, "/ai-gateway/middlewares", nil))
+	resp := &MiddlewaresResponse{}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), resp))
+	assert.Len(resp.Middlewares, 2)
+	assert.Equal("guard", resp.Middlewares[0].Name)
+
+	probe := func(name string, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/ai-gateway/middlewares/"+name+"/probe", bytes.NewReader([]byte(body)))
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", name)
+		req = req.WithContext(stdcontext.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		next.probeMiddleware(w, req)
+		return w.Code
+	}
+	assert.Equal(http.StatusNotFound, probe("unknown", `{"prompt": "hello"}`))
+	// TopicGuard does not support probing.
+	assert.Equal(http.StatusBadRequest, probe("guard", `{"prompt": "hello"}`))
+
+	purge := func(name string) int {
+		req := httptest.NewRequest(http.MethodPost, "/ai-gateway/middlewares/"+name+"/purge", nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", name)
+		req = req.WithContext(stdcontext.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		next.purgeMiddleware(w, req)
+		return w.Code
+	}
+	assert.Equal(http.StatusNotFound, purge("unknown"))
+	// TopicGuard has no caches to purge.
+	assert.Equal(http.StatusBadRequest, purge("guard"))
+
+	aiCtx, err := newProbeContext(httptest.NewRequest(http.MethodPost, "/", nil), &ProbeRequest{Prompt: "hello", Stream: true})
+	assert.Nil(err)
+	assert.Equal("probe", aiCtx.ReqInfo.Model)
+	assert.True(aiCtx.ReqInfo.Stream)
+}
+
+func TestPIITokenizerDelivery(t *testing.T) {
+	assert := assert.New(t)
+
+	// the provider echoes the prompt, which has the placeholders.
+	var upstream []byte
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream, _ = io.ReadAll(r.Body)
+		req := struct {
+			Model    string `json:"model"`
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}{}
+		json.Unmarshal(upstream, &req)
+		body := getNonStreamBody(req.Model).(map[string]any)
+		body["choices"].([]any)[0].(map[string]any)["message"].(map[string]any)["content"] = "Echo: " + req.Messages[0].Content
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer mockServer.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+middlewares:
+- name: pii
+  kind: PIITokenizer
+`, mockServer.URL)
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	ctx := context.New(nil)
+	body := `{"model": "gpt", "messages": [{"role": "user", "content": "Mail alice@example.com"}]}`
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+	assert.Nil(err)
+	setRequest(t, ctx, "pii", req)
+	controller.Handle(ctx, "openai", []string{"pii"})
+	resp := ctx.GetResponse("pii").(*httpprot.Response)
+	data, err := io.ReadAll(resp.GetPayload())
+	assert.Nil(err)
+	ctx.Finish()
+
+	assert.Contains(string(upstream), "Mail [EMAIL_1]")
+	assert.NotContains(string(upstream), "alice@example.com")
+	assert.Contains(string(data), "Echo: Mail alice@example.com")
+	assert.NotContains(string(data), "[EMAIL_1]")
+
+	// a semantic cache before the tokenizer is rejected, the request is
+	// not sent to the provider.
+	controller.middlewares["cache"] = &specMiddleware{spec: &middlewares.MiddlewareSpec{Name: "cache", Kind: "SemanticCache"}}
+	assert.NoError(controller.ValidateMiddlewares([]string{"pii", "cache", "missing"}))
+	assert.ErrorContains(controller.ValidateMiddlewares([]string{"cache", "pii"}), "runs before PII tokenizer")
+	upstream = nil
+	ctx = context.New(nil)
+	req, err = http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+	assert.Nil(err)
+	setRequest(t, ctx, "pii", req)
+	controller.Handle(ctx, "openai", []string{"cache", "pii"})
+	assert.Equal(http.StatusInternalServerError, ctx.GetResponse("pii").(*httpprot.Response).StatusCode())
+	assert.Nil(upstream)
+	ctx.Finish()
+}
+
+// specMiddleware is a middleware only having a spec.
+type specMiddleware struct {
+	middlewares.Middleware
+	spec *middlewares.MiddlewareSpec
+}
+
+func (m *specMiddleware) Spec() *middlewares.MiddlewareSpec {
+	return m.spec
+}
+
+func TestUsageStoredBeforeFinish(t *testing.T) {
+	assert := assert.New(t)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(rateLimitedHandler))
+	defer mockServer.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+usageStore:
+  journal:
+    dir: %s
+`, mockServer.URL, t.TempDir())
+	cls := newMapCluster()
+	cls.MockedLayout = func() *cluster.Layout {
+		return &cluster.Layout{}
+	}
+	super := supervisor.NewMock(option.New(), cls, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	requests := func() int64 {
+		now := time.Now().Unix()
+		page, err := controller.usageStore.Query(&usagestore.Query{
+			StartTime: now - 3600, EndTime: now + 3600, BucketWidth: time.Hour, Limit: 10,
+		})
+		assert.Nil(err)
+		n := int64(0)
+		for _, b := range page.Data {
+			for _, r := range b.Results {
+				n += r.NumModelRequests
+			}
+		}
+		return n
+	}
+	send := func(stream bool) *httpprot.Response {
+		ctx := context.New(nil)
+		data := fmt.Sprintf(`{"model": "gpt", "stream": %v}`, stream)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(data)))
+		assert.Nil(err)
+		setRequest(t, ctx, "usage", req)
+		controller.Handle(ctx, "openai", nil)
+		resp := ctx.GetResponse("usage").(*httpprot.Response)
+		t.Cleanup(ctx.Finish)
+		return resp
+	}
+
+	// the usage is stored once the response is read to the end, before
+	// the request is finished.
+	for i, stream := range []bool{false, true} {
+		resp := send(stream)
+		assert.Equal(int64(i), requests())
+		_, err = io.ReadAll(resp.GetPayload())
+		assert.Nil(err)
+		assert.Equal(int64(i+1), requests())
+	}
+
+	// the usage of a response not read to the end is stored when the request
+	// is finished, and every usage is stored once.
+	ctx := context.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt", "stream": true}`)))
+	assert.Nil(err)
+	setRequest(t, ctx, "usage", req)
+	controller.Handle(ctx, "openai", nil)
+	assert.Equal(int64(2), requests())
+	ctx.Finish()
+	assert.Equal(int64(3), requests())
+}
@@ -18,10 +18,26 @@
 package aigatewaycontroller
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/megaease/easegress/v2/pkg/api"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/consumers"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/usagestore"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
 	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
@@ -42,17 +58,145 @@ type (
 		Error        string `json:"error,omitempty"`
 	}
 
+	// ProviderSpecsResponse lists the effective specs of the providers in
+	// use, the templates are merged and the secrets are replaced by their
+	// hashes.
+	ProviderSpecsResponse struct {
+		Providers []map[string]any `json:"providers"`
+	}
+
 	StatsResponse struct {
 		Stats []*metricshub.MetricStats `json:"stats"`
 	}
+
+	MiddlewaresResponse struct {
+		Middlewares []*MiddlewareState `json:"middlewares"`
+	}
+
+	// FeatureFlagsResponse is the evaluation of feature flags for a consumer.
+	FeatureFlagsResponse struct {
+		Consumer string                   `json:"consumer"`
+		Flags    []*FeatureFlagEvaluation `json:"flags"`
+	}
+
+	// EndpointsResponse lists the supported endpoints and whether they
+	// are exposed.
+	EndpointsResponse struct {
+		Endpoints []*EndpointState `json:"endpoints"`
+	}
+
+	// DrainsResponse lists the drains of the dropped indexes started by
+	// this member.
+	DrainsResponse struct {
+		Drains []*redisvector.DrainStatus `json:"drains"`
+	}
+
+	// JanitorsResponse lists the janitors of the indexes started by this
+	// member.
+	JanitorsResponse struct {
+		Janitors []*redisvector.JanitorStats `json:"janitors"`
+	}
+
+	// WriteQueuesResponse lists the write queues of the collections on
+	// this member.
+	WriteQueuesResponse struct {
+		WriteQueues []*vectordb.WriteQueueStatus `json:"writeQueues"`
+	}
+
+	// ProviderSLOResponse lists the latency SLO states of the providers
+	// on this member.
+	ProviderSLOResponse struct {
+		Providers []*ProviderSLOStatus `json:"providers"`
+	}
+
+	// PinRequest pins the weight factor of a provider in the provider
+	// groups, overriding the latency SLO automation.
+	PinRequest struct {
+		// WeightFactor is in [0, 1], default 1 keeps the full weight.
+		WeightFactor *float64 `json:"weightFactor,omitempty"`
+	}
+
+	// ReloadsResponse lists the spec diffs of the latest reloads, the
+	// latest first.
+	ReloadsResponse struct {
+		Reloads []*SpecDiff `json:"reloads"`
+	}
+
+	// WriteRateRequest adjusts the write rate of collections temporarily.
+	WriteRateRequest struct {
+		// Collection is the collection to adjust, empty means all.
+		Collection string  `json:"collection,omitempty"`
+		Rate       float64 `json:"rate"`
+		Burst      int     `json:"burst,omitempty"`
+		Duration   string  `json:"duration"`
+	}
+
+	// ProbeRequest is a sample request to probe a middleware.
+	ProbeRequest struct {
+		Prompt string `json:"prompt"`
+		Model  string `json:"model,omitempty"`
+		Stream bool   `json:"stream,omitempty"`
+		TopK   int    `json:"topK,omitempty"`
+	}
 )
 
+// maxProbeTopK is the maximum number of candidates of a probe.
+const maxProbeTopK = 100
+
 func (agc *AIGatewayController) registerAPIs() {
 	group := &api.Group{
 		Group: APIGroupName,
 		Entries: []*api.Entry{
 			{Path: APIPrefix + "/providers/status", Method: "GET", Handler: agc.checkProvidersStatus},
+			{Path: APIPrefix + "/providers/{name}/flush", Method: "POST", Handler: agc.flushProvider},
+			{Path: APIPrefix + "/providers/specs", Method: "GET", Handler: agc.listProviderSpecs},
+			{Path: APIPrefix + "/providers/slo", Method: "GET", Handler: agc.listProviderSLO},
+			{Path: APIPrefix + "/providers/{name}/pin", Method: "POST", Handler: agc.pinProvider},
+			{Path: APIPrefix + "/providers/{name}/pin", Method: "DELETE", Handler: agc.unpinProvider},
+			{Path: APIPrefix + "/providers/{name}/credentials", Method: "GET", Handler: agc.getProviderCredentials},
+			{Path: APIPrefix + "/providers/{name}/credentials", Method: "POST", Handler: agc.rotateProviderCredential},
+			{Path: APIPrefix + "/providers/{name}/credentials/staged", Method: "DELETE", Handler: agc.abortProviderCredentialRotation},
+			{Path: APIPrefix + "/middlewares", Method: "GET", Handler: agc.listMiddlewares},
+			{Path: APIPrefix + "/middlewares/{name}/enable", Method: "POST", Handler: agc.enableMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/disable", Method: "POST", Handler: agc.disableMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/probe", Method: "POST", Handler: agc.probeMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/feedback", Method: "POST", Handler: agc.feedbackMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/threshold", Method: "GET", Handler: agc.getMiddlewareThreshold},
+			{Path: APIPrefix + "/middlewares/{name}/threshold/revert", Method: "POST", Handler: agc.revertMiddlewareThreshold},
+			{Path: APIPrefix + "/middlewares/{name}/evaluation", Method: "GET", Handler: agc.getMiddlewareEvaluation},
+			{Path: APIPrefix + "/middlewares/{name}/purge", Method: "POST", Handler: agc.purgeMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/scrub", Method: "POST", Handler: agc.scrubMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/scopemigration", Method: "POST", Handler: agc.migrateMiddlewareScope},
+			{Path: APIPrefix + "/middlewares/{name}/integrity", Method: "GET", Handler: agc.getMiddlewareIntegrity},
+			{Path: APIPrefix + "/middlewares/{name}/integrity", Method: "POST", Handler: agc.checkMiddlewareIntegrity},
+			{Path: APIPrefix + "/middlewares/{name}/rebalance", Method: "GET", Handler: agc.getMiddlewareRebalance},
+			{Path: APIPrefix + "/middlewares/{name}/rebalance", Method: "POST", Handler: agc.rebalanceMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/documents", Method: "POST", Handler: agc.ingestMiddlewareDocuments},
+			{Path: APIPrefix + "/middlewares/{name}/schemaversions", Method: "GET", Handler: agc.getMiddlewareSchemaVersions},
+			{Path: APIPrefix + "/middlewares/{name}/reembed", Method: "GET", Handler: agc.getMiddlewareReembed},
+			{Path: APIPrefix + "/middlewares/{name}/reembed", Method: "POST", Handler: agc.reembedMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/reembed", Method: "DELETE", Handler: agc.abortMiddlewareReembed},
+			{Path: APIPrefix + "/middlewares/{name}/import", Method: "GET", Handler: agc.getMiddlewareImport},
+			{Path: APIPrefix + "/middlewares/{name}/import", Method: "POST", Handler: agc.importMiddleware},
+			{Path: APIPrefix + "/middlewares/{name}/import", Method: "DELETE", Handler: agc.abortMiddlewareImport},
+			{Path: APIPrefix + "/vectordb/drains", Method: "GET", Handler: agc.listDrains},
+			{Path: APIPrefix + "/vectordb/janitors", Method: "GET", Handler: agc.listJanitors},
+			{Path: APIPrefix + "/vectordb/writequeues", Method: "GET", Handler: agc.listWriteQueues},
+			{Path: APIPrefix + "/vectordb/writequeues/rate", Method: "POST", Handler: agc.setWriteRate},
+			{Path: APIPrefix + "/featureflags", Method: "GET", Handler: agc.evaluateFeatureFlags},
+			{Path: APIPrefix + "/endpoints", Method: "GET", Handler: agc.listEndpoints},
+			{Path: APIPrefix + "/simulate", Method: "POST", Handler: agc.simulateRequest},
+			{Path: APIPrefix + "/dryrun", Method: "POST", Handler: agc.dryRunRequest},
 			{Path: APIPrefix + "/stat", Method: "GET", Handler: agc.stat},
+			{Path: APIPrefix + "/usage", Method: "GET", Handler: agc.queryUsage},
+			{Path: APIPrefix + "/corpus", Method: "GET", Handler: agc.getCorpus},
+			{Path: APIPrefix + "/reloads", Method: "GET", Handler: agc.listReloads},
+			{Path: APIPrefix + "/metrics/manifest", Method: "GET", Handler: agc.getMetricsManifest},
+			{Path: APIPrefix + "/consumers", Method: "GET", Handler: agc.listConsumers},
+			{Path: APIPrefix + "/consumers", Method: "POST", Handler: agc.createConsumer},
+			{Path: APIPrefix + "/consumers/{name}", Method: "GET", Handler: agc.getConsumer},
+			{Path: APIPrefix + "/consumers/{name}", Method: "PUT", Handler: agc.updateConsumer},
+			{Path: APIPrefix + "/consumers/{name}", Method: "DELETE", Handler: agc.revokeConsumer},
 		},
 	}
 
@@ -65,7 +209,13 @@ func (agc *AIGatewayController) unregisterAPIs() {
 
 func (agc *AIGatewayController) checkProvidersStatus(w http.ResponseWriter, r *http.Request) {
 	resp := HealthCheckResponse{}
-	for _, provider := range agc.providers {
+	set := agc.acquireProviders()
+	if set == nil {
+		api.HandleAPIError(w, r, http.StatusServiceUnavailable, fmt.Errorf("AIGatewayController is closed"))
+		return
+	}
+	defer set.release()
+	for _, provider := range set.providers {
 		result := HealthCheckResult{
 			Name:         provider.Name(),
 			ProviderType: provider.Type(),
@@ -84,6 +234,952 @@ func (agc *AIGatewayController) checkProvidersStatus(w http.ResponseWriter, r *h
 	w.Write(codectool.MustMarshalJSON(resp))
 }
 
+func (agc *AIGatewayController) flushProvider(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	set := agc.acquireProviders()
+	if set == nil {
+		api.HandleAPIError(w, r, http.StatusServiceUnavailable, fmt.Errorf("AIGatewayController is closed"))
+		return
+	}
+	defer set.release()
+	provider, ok := set.providers[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("provider %s not found", name))
+		return
+	}
+	provider.FlushConnections()
+}
+
+func (agc *AIGatewayController) listProviderSLO(w http.ResponseWriter, r *http.Request) {
+	if agc.latencySLO == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, ErrLatencySLODisabled)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(ProviderSLOResponse{Providers: agc.latencySLO.statuses()}))
+}
+
+func (agc *AIGatewayController) pinProvider(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if agc.latencySLO == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, ErrLatencySLODisabled)
+		return
+	}
+	req := &PinRequest{}
+	if err := codectool.DecodeJSON(r.Body, req); err != nil && err != io.EOF {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid pin request: %w", err))
+		return
+	}
+	factor := 1.0
+	if req.WeightFactor != nil {
+		factor = *req.WeightFactor
+	}
+	if factor < 0 || factor > 1 {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("weightFactor must be in [0, 1]"))
+		return
+	}
+	set := agc.acquireProviders()
+	if set == nil {
+		api.HandleAPIError(w, r, http.StatusServiceUnavailable, fmt.Errorf("AIGatewayController is closed"))
+		return
+	}
+	_, ok := set.providers[name]
+	set.release()
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("provider %s not found", name))
+		return
+	}
+	agc.latencySLO.setPin(name, factor, apiOperator(r))
+	w.Write(codectool.MustMarshalJSON(ProviderSLOResponse{Providers: agc.latencySLO.statuses()}))
+}
+
+func (agc *AIGatewayController) unpinProvider(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if agc.latencySLO == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, ErrLatencySLODisabled)
+		return
+	}
+	if !agc.latencySLO.unpin(name, apiOperator(r)) {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("provider %s is not pinned", name))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(ProviderSLOResponse{Providers: agc.latencySLO.statuses()}))
+}
+
+// credentialRotator returns the provider of the request as a credential
+// rotator with the provider set acquired, the caller must release the set.
+// It writes the error response and returns nil if it fails.
+func (agc *AIGatewayController) credentialRotator(w http.ResponseWriter, r *http.Request) (providers.CredentialRotator, *providerSet) {
+	name := chi.URLParam(r, "name")
+	set := agc.acquireProviders()
+	if set == nil {
+		api.HandleAPIError(w, r, http.StatusServiceUnavailable, fmt.Errorf("AIGatewayController is closed"))
+		return nil, nil
+	}
+	provider, ok := set.providers[name]
+	if !ok {
+		set.release()
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("provider %s not found", name))
+		return nil, nil
+	}
+	rotator, ok := provider.(providers.CredentialRotator)
+	if !ok || rotator.CredentialStatus() == nil {
+		set.release()
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("provider %s: %w", name, providers.ErrCredentialRotationUnsupported))
+		return nil, nil
+	}
+	return rotator, set
+}
+
+func (agc *AIGatewayController) getProviderCredentials(w http.ResponseWriter, r *http.Request) {
+	rotator, set := agc.credentialRotator(w, r)
+	if rotator == nil {
+		return
+	}
+	defer set.release()
+	w.Write(codectool.MustMarshalJSON(rotator.CredentialStatus()))
+}
+
+// rotateProviderCredential verifies the new API key of the provider by a
+// canary request, and rotates to it only if the request succeeds.
+func (agc *AIGatewayController) rotateProviderCredential(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	rotation := &providers.CredentialRotation{}
+	if err := codectool.DecodeJSON(r.Body, rotation); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid credential rotation: %w", err))
+		return
+	}
+	if err := providers.ValidateCredentialRotation(rotation); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid credential rotation: %w", err))
+		return
+	}
+
+	rotator, set := agc.credentialRotator(w, r)
+	if rotator == nil {
+		return
+	}
+	defer set.release()
+	status, err := rotator.RotateCredential(r.Context(), rotation)
+	if err != nil {
+		code := http.StatusInternalServerError
+		var verifyErr *providers.CredentialVerificationError
+		switch {
+		case errors.As(err, &verifyErr):
+			code = http.StatusUnprocessableEntity
+		case errors.Is(err, providers.ErrCredentialRotationInProgress), errors.Is(err, providers.ErrCredentialInUse):
+			code = http.StatusConflict
+		}
+		api.HandleAPIError(w, r, code, fmt.Errorf("failed to rotate credential of provider %s: %w", name, err))
+		return
+	}
+	mode := rotation.Mode
+	if mode == "" {
+		mode = providers.CredentialModeReplace
+	}
+	logger.Infof("credential of provider %s rotated by %s, mode: %s", name, apiOperator(r), mode)
+	w.Write(codectool.MustMarshalJSON(status))
+}
+
+// abortProviderCredentialRotation removes the new API key of the staged
+// rotation of the provider.
+func (agc *AIGatewayController) abortProviderCredentialRotation(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	rotator, set := agc.credentialRotator(w, r)
+	if rotator == nil {
+		return
+	}
+	defer set.release()
+	status, err := rotator.AbortCredentialRotation()
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("provider %s: %w", name, err))
+		return
+	}
+	logger.Infof("staged credential rotation of provider %s aborted by %s", name, apiOperator(r))
+	w.Write(codectool.MustMarshalJSON(status))
+}
+
+func (agc *AIGatewayController) listProviderSpecs(w http.ResponseWriter, r *http.Request) {
+	set := agc.acquireProviders()
+	if set == nil {
+		api.HandleAPIError(w, r, http.StatusServiceUnavailable, fmt.Errorf("AIGatewayController is closed"))
+		return
+	}
+	defer set.release()
+
+	resp := ProviderSpecsResponse{Providers: []map[string]any{}}
+	for _, spec := range set.specs {
+		fields := map[string]any{}
+		codectool.MustUnmarshal(codectool.MustMarshalJSON(spec), &fields)
+		resp.Providers = append(resp.Providers, redactSecrets(fields, "").(map[string]any))
+	}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+func (agc *AIGatewayController) listMiddlewares(w http.ResponseWriter, r *http.Request) {
+	states := agc.getMiddlewareStates()
+	resp := MiddlewaresResponse{Middlewares: []*MiddlewareState{}}
+	for _, m := range agc.spec.Middlewares {
+		if state, ok := states[m.Name]; ok {
+			resp.Middlewares = append(resp.Middlewares, state)
+		}
+	}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+func (agc *AIGatewayController) enableMiddleware(w http.ResponseWriter, r *http.Request) {
+	agc.toggleMiddleware(w, r, true)
+}
+
+func (agc *AIGatewayController) disableMiddleware(w http.ResponseWriter, r *http.Request) {
+	agc.toggleMiddleware(w, r, false)
+}
+
+func (agc *AIGatewayController) toggleMiddleware(w http.ResponseWriter, r *http.Request, enabled bool) {
+	name := chi.URLParam(r, "name")
+	state, err := agc.setMiddlewareEnabled(name, enabled, apiOperator(r))
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(state))
+}
+
+// evaluateFeatureFlags reports the feature flags evaluated for the consumer
+// in the query, it does not count in the metrics.
+func (agc *AIGatewayController) evaluateFeatureFlags(w http.ResponseWriter, r *http.Request) {
+	consumer := r.URL.Query().Get("consumer")
+	resp := FeatureFlagsResponse{Consumer: consumer, Flags: []*FeatureFlagEvaluation{}}
+	if agc.flags != nil {
+		resp.Flags = agc.flags.evaluate(consumer, nil)
+	}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+func (agc *AIGatewayController) listEndpoints(w http.ResponseWriter, r *http.Request) {
+	resp := EndpointsResponse{Endpoints: agc.endpoints.states()}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+// simulateRequest traces a hypothetical request through the routing and
+// the policies without sending it to the provider.
+func (agc *AIGatewayController) simulateRequest(w http.ResponseWriter, r *http.Request) {
+	req := &SimulateRequest{}
+	if err := codectool.DecodeJSON(r.Body, req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid simulate request: %w", err))
+		return
+	}
+	if err := validateSimulateRequest(req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid simulate request: %w", err))
+		return
+	}
+	resp, err := agc.simulate(req, time.Now())
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+// dryRunRequest runs a request through the middlewares, and returns the
+// request to the provider without sending it.
+func (agc *AIGatewayController) dryRunRequest(w http.ResponseWriter, r *http.Request) {
+	req := &DryRunRequest{}
+	if err := codectool.DecodeJSON(r.Body, req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid dry run request: %w", err))
+		return
+	}
+	if err := validateDryRunRequest(req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid dry run request: %w", err))
+		return
+	}
+	resp, err := agc.dryRun(req, time.Now())
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+func (agc *AIGatewayController) listReloads(w http.ResponseWriter, r *http.Request) {
+	resp := ReloadsResponse{Reloads: agc.specDiffs.list()}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+// getMetricsManifest lists the metrics of AIGatewayController with their
+// labels and help texts for dashboard tooling.
+func (agc *AIGatewayController) getMetricsManifest(w http.ResponseWriter, r *http.Request) {
+	w.Write(codectool.MustMarshalJSON(metricshub.GetManifest()))
+}
+
+func (agc *AIGatewayController) probeMiddleware(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return
+	}
+	prober, ok := middleware.(middlewares.Prober)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support probing", name, middleware.Kind()))
+		return
+	}
+
+	probeReq := &ProbeRequest{}
+	if err := codectool.DecodeJSON(r.Body, probeReq); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid probe request: %w", err))
+		return
+	}
+	if probeReq.Prompt == "" {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("prompt of probe request is empty"))
+		return
+	}
+	if probeReq.TopK < 0 || probeReq.TopK > maxProbeTopK {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("topK of probe request must be in [0, %d]", maxProbeTopK))
+		return
+	}
+
+	aiCtx, err := newProbeContext(r, probeReq)
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	result, err := prober.Probe(aiCtx, &middlewares.ProbeOptions{TopK: probeReq.TopK})
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to probe middleware %s: %w", name, err))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(result))
+}
+
+func (agc *AIGatewayController) feedbackMiddleware(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return
+	}
+	receiver, ok := middleware.(middlewares.FeedbackReceiver)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not accept feedback", name, middleware.Kind()))
+		return
+	}
+
+	feedback := &middlewares.Feedback{}
+	if err := codectool.DecodeJSON(r.Body, feedback); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid feedback: %w", err))
+		return
+	}
+	if err := receiver.Feedback(feedback); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, middlewares.ErrFeedbackRequestNotFound) {
+			status = http.StatusNotFound
+		}
+		api.HandleAPIError(w, r, status, err)
+	}
+}
+
+// thresholdTuner returns the middleware tuning its threshold, or writes
+// the error and returns nil.
+func (agc *AIGatewayController) thresholdTuner(w http.ResponseWriter, r *http.Request) middlewares.ThresholdTuner {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return nil
+	}
+	tuner, ok := middleware.(middlewares.ThresholdTuner)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not tune threshold", name, middleware.Kind()))
+		return nil
+	}
+	return tuner
+}
+
+func (agc *AIGatewayController) getMiddlewareThreshold(w http.ResponseWriter, r *http.Request) {
+	tuner := agc.thresholdTuner(w, r)
+	if tuner == nil {
+		return
+	}
+	stats, err := tuner.ThresholdStats()
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(stats))
+}
+
+func (agc *AIGatewayController) revertMiddlewareThreshold(w http.ResponseWriter, r *http.Request) {
+	tuner := agc.thresholdTuner(w, r)
+	if tuner == nil {
+		return
+	}
+	stats, err := tuner.RevertThreshold(apiOperator(r))
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(stats))
+}
+
+func (agc *AIGatewayController) getMiddlewareEvaluation(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return
+	}
+	evaluator, ok := middleware.(middlewares.Evaluator)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not evaluate responses", name, middleware.Kind()))
+		return
+	}
+	report, err := evaluator.EvaluationReport()
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(report))
+}
+
+// getMiddlewareSchemaVersions counts the entries of the collections of
+// the middleware by their schema versions.
+func (agc *AIGatewayController) getMiddlewareSchemaVersions(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return
+	}
+	reporter, ok := middleware.(middlewares.SchemaVersionReporter)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not have schema versions", name, middleware.Kind()))
+		return
+	}
+	result, err := reporter.SchemaVersions(r.Context())
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to get schema versions of middleware %s: %w", name, err))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(result))
+}
+
+func (agc *AIGatewayController) purgeMiddleware(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return
+	}
+	if r.URL.Query().Get("fallback") == "true" {
+		agc.purgeMiddlewareFallback(w, r, middleware)
+		return
+	}
+	purger, ok := middleware.(middlewares.Purger)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support purging", name, middleware.Kind()))
+		return
+	}
+
+	result, err := purger.Purge(r.Context())
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to purge middleware %s: %w", name, err))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(result))
+}
+
+// purgeMiddlewareFallback drops the fallback of the middleware only, it is
+// rejected while the fallback is being re-embedded.
+func (agc *AIGatewayController) purgeMiddlewareFallback(w http.ResponseWriter, r *http.Request, middleware middlewares.Middleware) {
+	name := middleware.Name()
+	purger, ok := middleware.(middlewares.FallbackPurger)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support purging the fallback", name, middleware.Kind()))
+		return
+	}
+
+	result, err := purger.PurgeFallback(r.Context())
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, middlewares.ErrNoFallback):
+			code = http.StatusBadRequest
+		case errors.Is(err, middlewares.ErrReembedRunning):
+			code = http.StatusConflict
+		}
+		api.HandleAPIError(w, r, code, fmt.Errorf("failed to purge the fallback of middleware %s: %w", name, err))
+		return
+	}
+	logger.Infof("fallback of middleware %s purged by %s", name, apiOperator(r))
+	w.Write(codectool.MustMarshalJSON(result))
+}
+
+// scrubMiddleware quarantines the documents with invalid vectors in the
+// collections of the middleware, they are only reported if dryRun is true.
+func (agc *AIGatewayController) scrubMiddleware(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return
+	}
+	scrubber, ok := middleware.(middlewares.VectorScrubber)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support scrubbing", name, middleware.Kind()))
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	result, err := scrubber.ScrubVectors(r.Context(), dryRun)
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to scrub middleware %s: %w", name, err))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(result))
+}
+
+// migrateMiddlewareScope moves the collections of the middleware created
+// before the scope is set under the scope.
+func (agc *AIGatewayController) migrateMiddlewareScope(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return
+	}
+	if agc.spec.Scope == "" {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("scope of the controller is not set"))
+		return
+	}
+	migrator, ok := middleware.(middlewares.ScopeMigrator)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support scope migration", name, middleware.Kind()))
+		return
+	}
+
+	result, err := migrator.MigrateToScope(r.Context())
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to migrate middleware %s to scope %s: %w", name, agc.spec.Scope, err))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(result))
+}
+
+// integrityChecker returns the middleware of the request as an integrity
+// checker, it writes the error response if it fails.
+func (agc *AIGatewayController) integrityChecker(w http.ResponseWriter, r *http.Request) middlewares.IntegrityChecker {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return nil
+	}
+	checker, ok := middleware.(middlewares.IntegrityChecker)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support integrity checks", name, middleware.Kind()))
+		return nil
+	}
+	return checker
+}
+
+// getMiddlewareIntegrity returns the progress or the results of the last
+// integrity checks of the collections of the middleware.
+func (agc *AIGatewayController) getMiddlewareIntegrity(w http.ResponseWriter, r *http.Request) {
+	checker := agc.integrityChecker(w, r)
+	if checker == nil {
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(checker.IntegrityReports()))
+}
+
+// checkMiddlewareIntegrity starts checking whether the documents of the
+// collections of the middleware are all indexed, and optionally repairs
+// them. The checks run in the background, their progress is returned by
+// getMiddlewareIntegrity.
+func (agc *AIGatewayController) checkMiddlewareIntegrity(w http.ResponseWriter, r *http.Request) {
+	checker := agc.integrityChecker(w, r)
+	if checker == nil {
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	repair := r.URL.Query().Get("repair") == "true"
+	result, err := checker.StartIntegrityCheck(repair)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, redisvector.ErrIntegrityCheckRunning) {
+			status = http.StatusConflict
+		}
+		api.HandleAPIError(w, r, status, fmt.Errorf("failed to check integrity of middleware %s: %w", name, err))
+		return
+	}
+	logger.Infof("integrity check of middleware %s started by %s, repair: %v", name, apiOperator(r), repair)
+	w.Write(codectool.MustMarshalJSON(result))
+}
+
+// rebalancer returns the middleware of the request as a rebalancer, it
+// writes the error response if it fails.
+func (agc *AIGatewayController) rebalancer(w http.ResponseWriter, r *http.Request) middlewares.Rebalancer {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return nil
+	}
+	rebalancer, ok := middleware.(middlewares.Rebalancer)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support rebalancing", name, middleware.Kind()))
+		return nil
+	}
+	return rebalancer
+}
+
+// getMiddlewareRebalance returns the progress or the results of the last
+// rebalances of the collections of the middleware.
+func (agc *AIGatewayController) getMiddlewareRebalance(w http.ResponseWriter, r *http.Request) {
+	rebalancer := agc.rebalancer(w, r)
+	if rebalancer == nil {
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(rebalancer.RebalanceReports()))
+}
+
+// rebalanceMiddleware starts moving the documents of the sharded
+// collections of the middleware to the shards owning them, after shards
+// are added or removed. The rebalances run in the background, their
+// progress is returned by getMiddlewareRebalance.
+func (agc *AIGatewayController) rebalanceMiddleware(w http.ResponseWriter, r *http.Request) {
+	rebalancer := agc.rebalancer(w, r)
+	if rebalancer == nil {
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	result, err := rebalancer.StartRebalance()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, redisvector.ErrRebalanceRunning) {
+			status = http.StatusConflict
+		}
+		api.HandleAPIError(w, r, status, fmt.Errorf("failed to rebalance middleware %s: %w", name, err))
+		return
+	}
+	logger.Infof("rebalance of middleware %s started by %s", name, apiOperator(r))
+	w.Write(codectool.MustMarshalJSON(result))
+}
+
+// ingestMiddlewareDocuments chunks the raw documents of the request,
+// embeds and ingests the chunks into the collection of the middleware.
+// The progress is streamed as newline delimited JSON events.
+func (agc *AIGatewayController) ingestMiddlewareDocuments(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return
+	}
+	ingester, ok := middleware.(middlewares.DocumentIngester)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support ingesting documents", name, middleware.Kind()))
+		return
+	}
+
+	req := &middlewares.IngestRequest{}
+	if err := codectool.DecodeJSON(r.Body, req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid ingest request: %w", err))
+		return
+	}
+	if len(req.Documents) == 0 {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("no documents to ingest"))
+		return
+	}
+
+	logger.Infof("%d documents ingested into middleware %s by %s", len(req.Documents), name, apiOperator(r))
+	flusher, _ := w.(http.Flusher)
+	started := false
+	progress := func(event *middlewares.IngestEvent) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+		w.Write(append(codectool.MustMarshalJSON(event), '\n'))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := ingester.IngestDocuments(r.Context(), req, progress); err != nil {
+		if !started {
+			api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("failed to ingest documents into middleware %s: %w", name, err))
+			return
+		}
+		logger.Errorf("failed to ingest documents into middleware %s: %v", name, err)
+	}
+}
+
+// reembedder returns the middleware of the request as a reembedder, it
+// writes the error response if it fails.
+func (agc *AIGatewayController) reembedder(w http.ResponseWriter, r *http.Request) middlewares.Reembedder {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return nil
+	}
+	reembedder, ok := middleware.(middlewares.Reembedder)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support re-embedding", name, middleware.Kind()))
+		return nil
+	}
+	return reembedder
+}
+
+// getMiddlewareReembed returns the progress of the running re-embedding
+// of the middleware, or the status of the last one.
+func (agc *AIGatewayController) getMiddlewareReembed(w http.ResponseWriter, r *http.Request) {
+	reembedder := agc.reembedder(w, r)
+	if reembedder == nil {
+		return
+	}
+	status := reembedder.ReembedStatus()
+	if status == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s is never re-embedded", chi.URLParam(r, "name")))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(status))
+}
+
+// reembedMiddleware returns the plan of re-embedding the documents of the
+// middleware if dryRun is true, otherwise it starts the re-embedding in
+// the background. The price of the embedding model is looked up in the
+// pricing of the usage store if the request has none.
+func (agc *AIGatewayController) reembedMiddleware(w http.ResponseWriter, r *http.Request) {
+	reembedder := agc.reembedder(w, r)
+	if reembedder == nil {
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	req := &middlewares.ReembedRequest{}
+	if r.ContentLength != 0 {
+		if err := codectool.DecodeJSON(r.Body, req); err != nil {
+			api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid re-embed request: %w", err))
+			return
+		}
+	}
+	if req.PricePerMillion == 0 && agc.usageStore != nil {
+		if price := agc.usageStore.Price("", reembedder.EmbeddingModel()); price != nil {
+			req.PricePerMillion = price.InputPerMillion
+		}
+	}
+
+	if r.URL.Query().Get("dryRun") == "true" {
+		plan, err := reembedder.PlanReembed(r.Context(), req)
+		if err != nil {
+			api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("failed to plan re-embedding of middleware %s: %w", name, err))
+			return
+		}
+		w.Write(codectool.MustMarshalJSON(plan))
+		return
+	}
+
+	status, err := reembedder.StartReembed(r.Context(), req)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, middlewares.ErrReembedRunning) {
+			code = http.StatusConflict
+		}
+		api.HandleAPIError(w, r, code, fmt.Errorf("failed to re-embed middleware %s: %w", name, err))
+		return
+	}
+	logger.Infof("re-embedding of middleware %s started by %s", name, apiOperator(r))
+	w.Write(codectool.MustMarshalJSON(status))
+}
+
+// abortMiddlewareReembed stops the running re-embedding of the middleware,
+// a re-embedding started later resumes from where it stops.
+func (agc *AIGatewayController) abortMiddlewareReembed(w http.ResponseWriter, r *http.Request) {
+	reembedder := agc.reembedder(w, r)
+	if reembedder == nil {
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	status, err := reembedder.AbortReembed()
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, middlewares.ErrReembedNotRunning) {
+			code = http.StatusConflict
+		}
+		api.HandleAPIError(w, r, code, fmt.Errorf("failed to abort re-embedding of middleware %s: %w", name, err))
+		return
+	}
+	logger.Infof("re-embedding of middleware %s aborted by %s", name, apiOperator(r))
+	w.Write(codectool.MustMarshalJSON(status))
+}
+
+// cacheImporter returns the middleware of the request as a cache importer,
+// it writes the error response if it fails.
+func (agc *AIGatewayController) cacheImporter(w http.ResponseWriter, r *http.Request) middlewares.CacheImporter {
+	name := chi.URLParam(r, "name")
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s not found", name))
+		return nil
+	}
+	importer, ok := middleware.(middlewares.CacheImporter)
+	if !ok {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("middleware %s of kind %s does not support importing", name, middleware.Kind()))
+		return nil
+	}
+	return importer
+}
+
+// getMiddlewareImport returns the progress of the running cache import of
+// the middleware, or the report of the last one.
+func (agc *AIGatewayController) getMiddlewareImport(w http.ResponseWriter, r *http.Request) {
+	importer := agc.cacheImporter(w, r)
+	if importer == nil {
+		return
+	}
+	status := importer.CacheImportStatus()
+	if status == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("middleware %s is never imported into", chi.URLParam(r, "name")))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(status))
+}
+
+// importMiddleware starts importing the records of a log file into the
+// cache of the middleware in the background.
+func (agc *AIGatewayController) importMiddleware(w http.ResponseWriter, r *http.Request) {
+	importer := agc.cacheImporter(w, r)
+	if importer == nil {
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	req := &middlewares.CacheImportRequest{}
+	if err := codectool.DecodeJSON(r.Body, req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid import request: %w", err))
+		return
+	}
+	status, err := importer.StartCacheImport(req)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, middlewares.ErrCacheImportRunning) {
+			code = http.StatusConflict
+		}
+		api.HandleAPIError(w, r, code, fmt.Errorf("failed to import into middleware %s: %w", name, err))
+		return
+	}
+	logger.Infof("cache import of middleware %s started by %s", name, apiOperator(r))
+	w.Write(codectool.MustMarshalJSON(status))
+}
+
+// abortMiddlewareImport stops the running cache import of the middleware,
+// an import of the same file started later resumes from where it stops.
+func (agc *AIGatewayController) abortMiddlewareImport(w http.ResponseWriter, r *http.Request) {
+	importer := agc.cacheImporter(w, r)
+	if importer == nil {
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	status, err := importer.AbortCacheImport()
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, middlewares.ErrCacheImportNotRunning) {
+			code = http.StatusConflict
+		}
+		api.HandleAPIError(w, r, code, fmt.Errorf("failed to abort cache import of middleware %s: %w", name, err))
+		return
+	}
+	logger.Infof("cache import of middleware %s aborted by %s", name, apiOperator(r))
+	w.Write(codectool.MustMarshalJSON(status))
+}
+
+func (agc *AIGatewayController) listDrains(w http.ResponseWriter, r *http.Request) {
+	resp := DrainsResponse{Drains: redisvector.DrainStatuses(agc.spec.Scope)}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+func (agc *AIGatewayController) listJanitors(w http.ResponseWriter, r *http.Request) {
+	resp := JanitorsResponse{Janitors: redisvector.GetJanitorStats(agc.spec.Scope)}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+func (agc *AIGatewayController) listWriteQueues(w http.ResponseWriter, r *http.Request) {
+	resp := WriteQueuesResponse{WriteQueues: vectordb.WriteQueueStatuses(agc.spec.Scope)}
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+func (agc *AIGatewayController) setWriteRate(w http.ResponseWriter, r *http.Request) {
+	req := &WriteRateRequest{}
+	if err := codectool.DecodeJSON(r.Body, req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid write rate request: %w", err))
+		return
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid duration %q: %w", req.Duration, err))
+		return
+	}
+	statuses, err := vectordb.SetWriteRate(agc.spec.Scope, req.Collection, req.Rate, req.Burst, duration)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, vectordb.ErrWriteQueueNotFound) {
+			status = http.StatusNotFound
+		}
+		api.HandleAPIError(w, r, status, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(WriteQueuesResponse{WriteQueues: statuses}))
+}
+
+// newProbeContext creates the AI context of a chat completions request
+// with the prompt of the probe request as the user message.
+func newProbeContext(r *http.Request, probeReq *ProbeRequest) (*aicontext.Context, error) {
+	model := probeReq.Model
+	if model == "" {
+		model = "probe"
+	}
+	body, err := codectool.MarshalJSON(map[string]any{
+		"model":    model,
+		"stream":   probeReq.Stream,
+		"messages": []map[string]any{{"role": "user", "content": probeReq.Prompt}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// probes bypass the query limit of vector databases, so they work
+	// when the backends are saturated.
+	stdReq, err := http.NewRequestWithContext(vectordb.WithoutQueryLimit(r.Context()), http.MethodPost, "http://localhost/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req, err := httpprot.NewRequest(stdReq)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.FetchPayload(0); err != nil {
+		return nil, err
+	}
+
+	ctx := context.New(nil)
+	ctx.SetRequest(context.DefaultNamespace, req)
+	ctx.UseNamespace(context.DefaultNamespace)
+	return aicontext.New(ctx, nil)
+}
+
+// apiOperator returns who sends the admin API request, it is the basic
+// auth user if there is one, or the remote address.
+func apiOperator(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return fmt.Sprintf("%s(%s)", user, r.RemoteAddr)
+	}
+	return r.RemoteAddr
+}
+
 func (agc *AIGatewayController) stat(w http.ResponseWriter, r *http.Request) {
 	stats := agc.metricshub.GetStats()
 	resp := StatsResponse{
@@ -91,3 +1187,145 @@ func (agc *AIGatewayController) stat(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(codectool.MustMarshalJSON(resp))
 }
+
+// queryUsage returns the usage aggregated by the usage store, the query
+// parameters and the response follow the OpenAI usage API.
+func (agc *AIGatewayController) queryUsage(w http.ResponseWriter, r *http.Request) {
+	if agc.usageStore == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("usage store is not configured"))
+		return
+	}
+	query, err := usagestore.ParseQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	page, err := agc.usageStore.Query(query)
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(page))
+}
+
+func (agc *AIGatewayController) getCorpus(w http.ResponseWriter, r *http.Request) {
+	if agc.corpus == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("corpus is not configured"))
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(agc.corpus.Status()))
+}
+
+// authorizeConsumers checks the admin token of the request allows the
+// scope, it returns the operator of the request for the audit logs.
+func (agc *AIGatewayController) authorizeConsumers(w http.ResponseWriter, r *http.Request, scope string) (*consumers.Registry, string, bool) {
+	registry := agc.consumers
+	if registry == nil {
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("consumers are not configured"))
+		return nil, "", false
+	}
+	name, err := registry.Authorize(r.Header.Get(consumers.AdminTokenHeader), scope)
+	if err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, consumers.ErrForbidden) {
+			status = http.StatusForbidden
+			logger.Warnf("admin token %s of %s is not allowed to %s AI gateway consumers", name, apiOperator(r), scope)
+		}
+		api.HandleAPIError(w, r, status, err)
+		return nil, "", false
+	}
+	operator := apiOperator(r)
+	if name != "" {
+		operator = fmt.Sprintf("token %s(%s)", name, r.RemoteAddr)
+	}
+	return registry, operator, true
+}
+
+// handleConsumerError writes the error of a consumer operation.
+func handleConsumerError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, consumers.ErrConsumerNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, consumers.ErrConsumerExists):
+		status = http.StatusConflict
+	case errors.Is(err, consumers.ErrInvalidConsumer):
+		status = http.StatusBadRequest
+	}
+	api.HandleAPIError(w, r, status, err)
+}
+
+func (agc *AIGatewayController) listConsumers(w http.ResponseWriter, r *http.Request) {
+	registry, _, ok := agc.authorizeConsumers(w, r, consumers.ScopeRead)
+	if !ok {
+		return
+	}
+	list, err := registry.List()
+	if err != nil {
+		handleConsumerError(w, r, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(consumers.ListResponse{Consumers: list}))
+}
+
+func (agc *AIGatewayController) getConsumer(w http.ResponseWriter, r *http.Request) {
+	registry, _, ok := agc.authorizeConsumers(w, r, consumers.ScopeRead)
+	if !ok {
+		return
+	}
+	consumer, err := registry.Get(chi.URLParam(r, "name"))
+	if err != nil {
+		handleConsumerError(w, r, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(consumer))
+}
+
+// createConsumer creates a consumer, the generated key is only returned
+// in the response.
+func (agc *AIGatewayController) createConsumer(w http.ResponseWriter, r *http.Request) {
+	registry, operator, ok := agc.authorizeConsumers(w, r, consumers.ScopeWrite)
+	if !ok {
+		return
+	}
+	req := &consumers.CreateRequest{}
+	if err := codectool.DecodeJSON(r.Body, req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid consumer request: %w", err))
+		return
+	}
+	resp, err := registry.Create(req, operator, time.Now())
+	if err != nil {
+		handleConsumerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(codectool.MustMarshalJSON(resp))
+}
+
+func (agc *AIGatewayController) updateConsumer(w http.ResponseWriter, r *http.Request) {
+	registry, operator, ok := agc.authorizeConsumers(w, r, consumers.ScopeWrite)
+	if !ok {
+		return
+	}
+	req := &consumers.UpdateRequest{}
+	if err := codectool.DecodeJSON(r.Body, req); err != nil {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid consumer request: %w", err))
+		return
+	}
+	consumer, err := registry.Update(chi.URLParam(r, "name"), req, operator, time.Now())
+	if err != nil {
+		handleConsumerError(w, r, err)
+		return
+	}
+	w.Write(codectool.MustMarshalJSON(consumer))
+}
+
+func (agc *AIGatewayController) revokeConsumer(w http.ResponseWriter, r *http.Request) {
+	registry, operator, ok := agc.authorizeConsumers(w, r, consumers.ScopeWrite)
+	if !ok {
+		return
+	}
+	if err := registry.Revoke(chi.URLParam(r, "name"), operator); err != nil {
+		handleConsumerError(w, r, err)
+	}
+}
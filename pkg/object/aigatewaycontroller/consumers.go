@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/consumers"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+const (
+	// consumersPullInterval is the interval of pulling all consumers in
+	// case of missed watch events.
+	consumersPullInterval = time.Minute
+
+	errCodeInvalidAPIKey = "invalid_api_key"
+)
+
+// consumerIDHeader returns the request header carrying the consumer ID,
+// it defaults to the header set by the consumer registry if the
+// consumers are managed by the controller.
+func (spec *Spec) consumerIDHeader() string {
+	if spec.ConsumerIDHeader != "" || spec.Consumers == nil {
+		return spec.ConsumerIDHeader
+	}
+	return consumers.DefaultConsumerIDHeader
+}
+
+// consumerID returns the ID of the consumer of the request, it is empty
+// if the consumer is unknown.
+func (agc *AIGatewayController) consumerID(ctx *context.Context) string {
+	return aicontext.ConsumerID(ctx, agc.spec.consumerIDHeader())
+}
+
+// validateSkippableMiddlewares checks the skippable middlewares of the
+// consumers are configured and skippable.
+func validateSkippableMiddlewares(spec *consumers.Spec, specs []*middlewares.MiddlewareSpec) error {
+	if spec == nil {
+		return nil
+	}
+	for _, name := range spec.SkippableMiddlewares {
+		i := slices.IndexFunc(specs, func(m *middlewares.MiddlewareSpec) bool { return m.Name == name })
+		if i < 0 {
+			return fmt.Errorf("skippable middleware %s not found", name)
+		}
+		if !middlewares.Skippable(specs[i]) {
+			return fmt.Errorf("middleware %s of kind %s is not skippable", name, specs[i].Kind)
+		}
+	}
+	return nil
+}
+
+// reloadConsumers reuses the consumer registry of the previous
+// generation, so the consumers are not reloaded from the cluster.
+func (agc *AIGatewayController) reloadConsumers(prev *AIGatewayController) string {
+	var registry *consumers.Registry
+	if prev != nil {
+		registry = prev.consumers
+	}
+	if agc.spec.Consumers == nil {
+		if registry != nil {
+			registry.Close()
+			return componentClosed
+		}
+		return ""
+	}
+	if registry != nil {
+		registry.SetSpec(agc.spec.Consumers)
+		agc.consumers = registry
+		return componentKept
+	}
+
+	cluster := agc.super.Cluster()
+	syncer, err := cluster.Syncer(consumersPullInterval)
+	if err != nil {
+		// the consumers are still loaded, but changes of other members
+		// are not synced.
+		logger.Errorf("failed to create syncer of AI gateway consumers: %v", err)
+		syncer = nil
+	}
+	agc.consumers = consumers.New(agc.spec.Consumers, cluster, cluster.Layout().AIGatewayConsumerPrefix(), syncer)
+	return componentCreated
+}
+
+// authenticateConsumer checks the key of the request and sets its consumer
+// to the context, which identifies the consumer for all components of the
+// controller. The name, the group and the region of the consumer are also
+// set to the request headers, the ones sent by the client are removed.
+func (agc *AIGatewayController) authenticateConsumer(ctx *context.Context) bool {
+	registry := agc.consumers
+	if registry == nil {
+		return true
+	}
+	header := ctx.GetInputRequest().(*httpprot.Request).HTTPHeader()
+	header.Del(agc.spec.consumerIDHeader())
+	header.Del(registry.GroupHeader())
+	header.Del(registry.RegionHeader())
+	aicontext.SetConsumer(ctx, &aicontext.Consumer{})
+
+	consumer, err := registry.Authenticate(header.Get(registry.KeyHeader()), time.Now())
+	if err == nil {
+		agc.setConsumer(ctx, registry, consumer)
+		return true
+	}
+	if !registry.Required() {
+		return true
+	}
+
+	message := "Incorrect API key provided."
+	switch {
+	case errors.Is(err, consumers.ErrKeyMissing):
+		message = fmt.Sprintf("You didn't provide an API key in the %s header.", registry.KeyHeader())
+	case errors.Is(err, consumers.ErrKeyExpired):
+		message = "The API key provided is expired."
+	}
+	setEndpointErrResponse(ctx, http.StatusUnauthorized, errCodeInvalidAPIKey, message)
+	return false
+}
+
+// setConsumer sets the consumer to the context and the request headers.
+func (agc *AIGatewayController) setConsumer(ctx *context.Context, registry *consumers.Registry, consumer *consumers.Consumer) {
+	aicontext.SetConsumer(ctx, &aicontext.Consumer{
+		ID:              consumer.Name,
+		Group:           consumer.Group,
+		Region:          consumer.Region,
+		SkipMiddlewares: registry.SkippedMiddlewares(consumer),
+	})
+	header := ctx.GetInputRequest().(*httpprot.Request).HTTPHeader()
+	header.Set(agc.spec.consumerIDHeader(), consumer.Name)
+	if consumer.Group != "" {
+		header.Set(registry.GroupHeader(), consumer.Group)
+	}
+	if consumer.Region != "" {
+		header.Set(registry.RegionHeader(), consumer.Region)
+	}
+}
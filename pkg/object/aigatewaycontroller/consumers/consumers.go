@@ -0,0 +1,598 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package consumers manages the API keys of the consumers of AI gateway.
+// The consumers are saved to the cluster, so they are shared by all members
+// and take effect without reloading AIGatewayController.
+package consumers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/common"
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+const (
+	// ScopeRead allows listing the consumers.
+	ScopeRead = "read"
+	// ScopeWrite allows creating, updating and revoking the consumers as
+	// well as listing them.
+	ScopeWrite = "write"
+
+	// AdminTokenHeader is the header of the admin API requests carrying
+	// the admin token.
+	AdminTokenHeader = "X-AI-Gateway-Admin-Token"
+
+	// KeyPrefix is the prefix of the generated keys.
+	KeyPrefix = "sk-eg-"
+
+	// DefaultConsumerIDHeader is the request header set to the consumer
+	// name if the consumer ID header of the controller is empty.
+	DefaultConsumerIDHeader = "X-Consumer-Id"
+
+	defaultKeyHeader    = "Authorization"
+	defaultGroupHeader  = "X-Consumer-Group"
+	defaultRegionHeader = "X-Consumer-Region"
+
+	keyBytes = 24
+	// displayedKeyLength is the length of the key prefix displayed to
+	// identify a key.
+	displayedKeyLength = len(KeyPrefix) + 6
+)
+
+var (
+	// ErrKeyMissing means the request has no key.
+	ErrKeyMissing = errors.New("API key is missing")
+	// ErrInvalidKey means the key of the request is not a valid key.
+	ErrInvalidKey = errors.New("API key is invalid")
+	// ErrKeyExpired means the key of the request is expired.
+	ErrKeyExpired = errors.New("API key is expired")
+
+	// ErrInvalidConsumer means the consumer request is invalid.
+	ErrInvalidConsumer = errors.New("invalid consumer")
+	// ErrConsumerNotFound means the consumer does not exist.
+	ErrConsumerNotFound = errors.New("consumer not found")
+	// ErrConsumerExists means the consumer to create exists.
+	ErrConsumerExists = errors.New("consumer already exists")
+
+	// ErrUnauthorized means the admin token is missing or invalid.
+	ErrUnauthorized = errors.New("admin token is missing or invalid")
+	// ErrForbidden means the scope of the admin token does not allow the
+	// operation.
+	ErrForbidden = errors.New("admin token is not allowed to do the operation")
+)
+
+type (
+	// Spec describes the consumer keys of AIGatewayController. The key of
+	// a request is checked against the consumers, and the name and the
+	// group of its consumer are set to the request headers, which are
+	// read by the consumer policies, the rate limit and the usage reports.
+	Spec struct {
+		// KeyHeader is the request header carrying the key, a "Bearer "
+		// prefix of it is trimmed.
+		KeyHeader string `json:"keyHeader,omitempty"`
+		// GroupHeader is the request header set to the group of the
+		// consumer, the value sent by clients is always removed. The name
+		// is set to the consumer ID header of the controller.
+		GroupHeader string `json:"groupHeader,omitempty"`
+		// RegionHeader is the request header set to the data residency
+		// region of the consumer, the value sent by clients is always
+		// removed.
+		RegionHeader string `json:"regionHeader,omitempty"`
+		// Required rejects the requests without a valid key, otherwise
+		// they are served without a consumer.
+		Required bool `json:"required,omitempty"`
+		// SkippableMiddlewares are the names of the middlewares the
+		// consumers may skip. The authentication and the rate limit are
+		// never skippable, nor are the ConsumerPolicy middlewares.
+		SkippableMiddlewares []string `json:"skippableMiddlewares,omitempty"`
+		// AdminTokens limit the admin API of consumers to the holders of
+		// the tokens, the admin API is only protected by the basic auth
+		// of Easegress if it is empty.
+		AdminTokens []*AdminTokenSpec `json:"adminTokens,omitempty"`
+	}
+
+	// AdminTokenSpec is a token of the admin API of consumers.
+	AdminTokenSpec struct {
+		// Name identifies the holder of the token in the audit logs.
+		Name  string `json:"name" jsonschema:"required"`
+		Token string `json:"token" jsonschema:"required"`
+		Scope string `json:"scope" jsonschema:"required,enum=read,enum=write"`
+	}
+
+	// Consumer is a consumer and its key, only the hash of the key is
+	// saved, the key itself is only returned when the consumer is created.
+	Consumer struct {
+		Name string `json:"name"`
+		// KeyPrefix is the beginning of the key to identify it.
+		KeyPrefix string `json:"keyPrefix"`
+		KeyHash   string `json:"keyHash"`
+		// Group is the consumer group of the consumer policies.
+		Group string `json:"group,omitempty"`
+		// Region pins the requests and the stored data of the consumer to
+		// the providers, collections and sinks of the region.
+		Region string `json:"region,omitempty"`
+		// ExpiresAt is in RFC3339 format, the key never expires if empty.
+		ExpiresAt string `json:"expiresAt,omitempty"`
+		// SkipMiddlewares are the middlewares skipped by the requests of
+		// the consumer, they must be skippable.
+		SkipMiddlewares []string `json:"skipMiddlewares,omitempty"`
+		CreatedBy       string   `json:"createdBy"`
+		CreatedAt       string   `json:"createdAt"`
+		UpdatedBy       string   `json:"updatedBy,omitempty"`
+		UpdatedAt       string   `json:"updatedAt,omitempty"`
+	}
+
+	// CreateRequest creates a consumer with a generated key.
+	CreateRequest struct {
+		Name            string   `json:"name"`
+		Group           string   `json:"group,omitempty"`
+		Region          string   `json:"region,omitempty"`
+		ExpiresAt       string   `json:"expiresAt,omitempty"`
+		SkipMiddlewares []string `json:"skipMiddlewares,omitempty"`
+	}
+
+	// CreateResponse is the created consumer, it is the only chance to
+	// get the key.
+	CreateResponse struct {
+		Consumer *Consumer `json:"consumer"`
+		Key      string    `json:"key"`
+	}
+
+	// UpdateRequest replaces the group, the region, the expiration and the
+	// skipped middlewares of a consumer.
+	UpdateRequest struct {
+		Group           string   `json:"group,omitempty"`
+		Region          string   `json:"region,omitempty"`
+		ExpiresAt       string   `json:"expiresAt,omitempty"`
+		SkipMiddlewares []string `json:"skipMiddlewares,omitempty"`
+	}
+
+	// ListResponse lists the consumers by name.
+	ListResponse struct {
+		Consumers []*Consumer `json:"consumers"`
+	}
+
+	// Backend saves the consumers, it is implemented by the cluster.
+	Backend interface {
+		Get(key string) (*string, error)
+		Put(key, value string) error
+		GetPrefix(prefix string) (map[string]string, error)
+		Delete(key string) error
+	}
+
+	// Syncer sends the consumers saved under a prefix whenever they
+	// change, it is implemented by the syncer of the cluster.
+	Syncer interface {
+		SyncPrefix(prefix string) (<-chan map[string]string, error)
+		Close()
+	}
+
+	// Registry authenticates the keys of requests against the consumers
+	// synced from the backend, and manages the consumers.
+	Registry struct {
+		backend Backend
+		prefix  string
+		syncer  Syncer
+
+		spec atomic.Pointer[Spec]
+		// keys maps the key hashes to the consumers, it is replaced as a
+		// whole on changes.
+		keys atomic.Pointer[map[string]*Consumer]
+		// lock serializes the changes of consumers on this member.
+		lock sync.Mutex
+
+		done      chan struct{}
+		closeOnce sync.Once
+		wg        sync.WaitGroup
+	}
+)
+
+// ValidateSpec validates the consumers spec.
+func ValidateSpec(spec *Spec) error {
+	if spec == nil {
+		return nil
+	}
+	names := map[string]struct{}{}
+	for _, t := range spec.AdminTokens {
+		if t.Name == "" {
+			return fmt.Errorf("name of admin token cannot be empty")
+		}
+		if _, ok := names[t.Name]; ok {
+			return fmt.Errorf("duplicated admin token %s", t.Name)
+		}
+		names[t.Name] = struct{}{}
+		if t.Token == "" {
+			return fmt.Errorf("token of admin token %s cannot be empty", t.Name)
+		}
+		if t.Scope != ScopeRead && t.Scope != ScopeWrite {
+			return fmt.Errorf("invalid scope %q of admin token %s", t.Scope, t.Name)
+		}
+	}
+	for i, name := range spec.SkippableMiddlewares {
+		if name == "" {
+			return fmt.Errorf("empty name of skippable middleware")
+		}
+		if slices.Contains(spec.SkippableMiddlewares[:i], name) {
+			return fmt.Errorf("duplicated skippable middleware %s", name)
+		}
+	}
+	return nil
+}
+
+// New creates a registry of the consumers saved under prefix, it keeps
+// syncing the consumers if syncer is not nil and closes it on Close.
+func New(spec *Spec, backend Backend, prefix string, syncer Syncer) *Registry {
+	r := &Registry{
+		backend: backend,
+		prefix:  prefix,
+		syncer:  syncer,
+		done:    make(chan struct{}),
+	}
+	r.SetSpec(spec)
+	r.keys.Store(&map[string]*Consumer{})
+
+	if data, err := backend.GetPrefix(prefix); err != nil {
+		logger.Errorf("failed to load AI gateway consumers: %v", err)
+	} else {
+		r.setConsumers(data)
+	}
+
+	if syncer != nil {
+		ch, err := syncer.SyncPrefix(prefix)
+		if err != nil {
+			logger.Errorf("failed to sync AI gateway consumers: %v", err)
+		} else {
+			r.wg.Add(1)
+			go r.sync(ch)
+		}
+	}
+	return r
+}
+
+// SetSpec updates the spec, the consumers are kept.
+func (r *Registry) SetSpec(spec *Spec) {
+	r.spec.Store(spec)
+}
+
+// KeyHeader returns the request header carrying the key.
+func (r *Registry) KeyHeader() string {
+	if h := r.spec.Load().KeyHeader; h != "" {
+		return h
+	}
+	return defaultKeyHeader
+}
+
+// GroupHeader returns the request header set to the consumer group.
+func (r *Registry) GroupHeader() string {
+	if h := r.spec.Load().GroupHeader; h != "" {
+		return h
+	}
+	return defaultGroupHeader
+}
+
+// RegionHeader returns the request header set to the consumer region.
+func (r *Registry) RegionHeader() string {
+	if h := r.spec.Load().RegionHeader; h != "" {
+		return h
+	}
+	return defaultRegionHeader
+}
+
+// Required reports whether the requests without a valid key are rejected.
+func (r *Registry) Required() bool {
+	return r.spec.Load().Required
+}
+
+// SkippedMiddlewares returns the middlewares skipped by the consumer, which
+// are still skippable. A middleware removed from the skippable ones is
+// not skipped anymore, even if the consumer still has it.
+func (r *Registry) SkippedMiddlewares(c *Consumer) []string {
+	skippable := r.spec.Load().SkippableMiddlewares
+	var skipped []string
+	for _, name := range c.SkipMiddlewares {
+		if slices.Contains(skippable, name) {
+			skipped = append(skipped, name)
+		}
+	}
+	return skipped
+}
+
+// validateSkipMiddlewares checks the middlewares to skip are skippable.
+func (r *Registry) validateSkipMiddlewares(names []string) error {
+	skippable := r.spec.Load().SkippableMiddlewares
+	for _, name := range names {
+		if !slices.Contains(skippable, name) {
+			return fmt.Errorf("%w: middleware %q is not skippable", ErrInvalidConsumer, name)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) sync(ch <-chan map[string]string) {
+	defer r.wg.Done()
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				return
+			}
+			r.setConsumers(data)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// setConsumers replaces the consumers with the ones in data.
+func (r *Registry) setConsumers(data map[string]string) {
+	keys := make(map[string]*Consumer, len(data))
+	for key, value := range data {
+		c := &Consumer{}
+		if err := json.Unmarshal([]byte(value), c); err != nil {
+			logger.Errorf("failed to unmarshal AI gateway consumer %s: %v", key, err)
+			continue
+		}
+		keys[c.KeyHash] = c
+	}
+	r.keys.Store(&keys)
+}
+
+// updateKeys applies a change of this member before it is synced back.
+// old and c are the consumer before and after the change, nil means not
+// existing.
+func (r *Registry) updateKeys(old, c *Consumer) {
+	keys := make(map[string]*Consumer)
+	for hash, consumer := range *r.keys.Load() {
+		keys[hash] = consumer
+	}
+	if old != nil {
+		delete(keys, old.KeyHash)
+	}
+	if c != nil {
+		keys[c.KeyHash] = c
+	}
+	r.keys.Store(&keys)
+}
+
+// Close stops syncing the consumers.
+func (r *Registry) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		if r.syncer != nil {
+			r.syncer.Close()
+		}
+		r.wg.Wait()
+	})
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the consumer of the key at now.
+func (r *Registry) Authenticate(key string, now time.Time) (*Consumer, error) {
+	key = strings.TrimSpace(strings.TrimPrefix(key, "Bearer "))
+	if key == "" {
+		return nil, ErrKeyMissing
+	}
+	c, ok := (*r.keys.Load())[hashKey(key)]
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	if c.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, c.ExpiresAt)
+		if err != nil || !now.Before(expiresAt) {
+			return nil, ErrKeyExpired
+		}
+	}
+	return c, nil
+}
+
+// Authorize checks the admin token allows the scope, it returns the name
+// of the token, which is empty if there is no admin token in the spec.
+func (r *Registry) Authorize(token, scope string) (string, error) {
+	tokens := r.spec.Load().AdminTokens
+	if len(tokens) == 0 {
+		return "", nil
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) != 1 {
+			continue
+		}
+		if scope == ScopeWrite && t.Scope != ScopeWrite {
+			return t.Name, ErrForbidden
+		}
+		return t.Name, nil
+	}
+	return "", ErrUnauthorized
+}
+
+func (r *Registry) consumerKey(name string) string {
+	return r.prefix + name
+}
+
+func validateExpiresAt(expiresAt string, now time.Time) error {
+	if expiresAt == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return fmt.Errorf("%w: expiresAt %q is not in RFC3339 format", ErrInvalidConsumer, expiresAt)
+	}
+	if !t.After(now) {
+		return fmt.Errorf("%w: expiresAt %s is not in the future", ErrInvalidConsumer, expiresAt)
+	}
+	return nil
+}
+
+func (r *Registry) load(name string) (*Consumer, error) {
+	value, err := r.backend.Get(r.consumerKey(name))
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, ErrConsumerNotFound
+	}
+	c := &Consumer{}
+	if err := json.Unmarshal([]byte(*value), c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal consumer %s: %w", name, err)
+	}
+	return c, nil
+}
+
+func (r *Registry) save(c *Consumer) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return r.backend.Put(r.consumerKey(c.Name), string(data))
+}
+
+// List lists the consumers by name.
+func (r *Registry) List() ([]*Consumer, error) {
+	data, err := r.backend.GetPrefix(r.prefix)
+	if err != nil {
+		return nil, err
+	}
+	consumers := make([]*Consumer, 0, len(data))
+	for key, value := range data {
+		c := &Consumer{}
+		if err := json.Unmarshal([]byte(value), c); err != nil {
+			logger.Errorf("failed to unmarshal AI gateway consumer %s: %v", key, err)
+			continue
+		}
+		consumers = append(consumers, c)
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].Name < consumers[j].Name })
+	return consumers, nil
+}
+
+// Get returns the consumer of the name.
+func (r *Registry) Get(name string) (*Consumer, error) {
+	return r.load(name)
+}
+
+// Create creates a consumer with a generated key.
+func (r *Registry) Create(req *CreateRequest, operator string, now time.Time) (*CreateResponse, error) {
+	if err := common.ValidateName(req.Name); err != nil {
+		return nil, fmt.Errorf("%w: invalid name %q", ErrInvalidConsumer, req.Name)
+	}
+	if err := validateExpiresAt(req.ExpiresAt, now); err != nil {
+		return nil, err
+	}
+	if err := r.validateSkipMiddlewares(req.SkipMiddlewares); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, err := r.load(req.Name); err == nil {
+		return nil, ErrConsumerExists
+	} else if !errors.Is(err, ErrConsumerNotFound) {
+		return nil, err
+	}
+
+	buf := make([]byte, keyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	key := KeyPrefix + hex.EncodeToString(buf)
+	c := &Consumer{
+		Name:            req.Name,
+		KeyPrefix:       key[:displayedKeyLength],
+		KeyHash:         hashKey(key),
+		Group:           req.Group,
+		Region:          req.Region,
+		ExpiresAt:       req.ExpiresAt,
+		SkipMiddlewares: req.SkipMiddlewares,
+		CreatedBy:       operator,
+		CreatedAt:       now.Format(time.RFC3339),
+	}
+	if err := r.save(c); err != nil {
+		return nil, err
+	}
+	r.updateKeys(nil, c)
+
+	logger.Infof("AI gateway consumer %s is created by %s with key %s, group %q, region %q, expiresAt %q, skipMiddlewares %q",
+		c.Name, operator, c.KeyPrefix, c.Group, c.Region, c.ExpiresAt, c.SkipMiddlewares)
+	return &CreateResponse{Consumer: c, Key: key}, nil
+}
+
+// Update replaces the group, the region, the expiration and the skipped
+// middlewares of the consumer.
+func (r *Registry) Update(name string, req *UpdateRequest, operator string, now time.Time) (*Consumer, error) {
+	if err := validateExpiresAt(req.ExpiresAt, now); err != nil {
+		return nil, err
+	}
+	if err := r.validateSkipMiddlewares(req.SkipMiddlewares); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	old, err := r.load(name)
+	if err != nil {
+		return nil, err
+	}
+	c := *old
+	c.Group, c.Region, c.ExpiresAt = req.Group, req.Region, req.ExpiresAt
+	c.SkipMiddlewares = req.SkipMiddlewares
+	c.UpdatedBy, c.UpdatedAt = operator, now.Format(time.RFC3339)
+	if err := r.save(&c); err != nil {
+		return nil, err
+	}
+	r.updateKeys(old, &c)
+
+	logger.Infof("AI gateway consumer %s is updated by %s, group %q, region %q, expiresAt %q, skipMiddlewares %q",
+		name, operator, c.Group, c.Region, c.ExpiresAt, c.SkipMiddlewares)
+	return &c, nil
+}
+
+// Revoke deletes the consumer, its key is rejected immediately.
+func (r *Registry) Revoke(name string, operator string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	old, err := r.load(name)
+	if err != nil {
+		return err
+	}
+	if err := r.backend.Delete(r.consumerKey(name)); err != nil {
+		return err
+	}
+	r.updateKeys(old, nil)
+
+	logger.Infof("AI gateway consumer %s with key %s is revoked by %s", name, old.KeyPrefix, operator)
+	return nil
+}
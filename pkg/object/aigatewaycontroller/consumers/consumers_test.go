@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consumers
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	m.Run()
+}
+
+type memBackend struct {
+	lock sync.Mutex
+	data map[string]string
+	fail bool
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{data: map[string]string{}}
+}
+
+func (b *memBackend) Get(key string) (*string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.fail {
+		return nil, errors.New("backend is down")
+	}
+	value, ok := b.data[key]
+	if !ok {
+		return nil, nil
+	}
+	return &value, nil
+}
+
+func (b *memBackend) Put(key, value string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.fail {
+		return errors.New("backend is down")
+	}
+	b.data[key] = value
+	return nil
+}
+
+func (b *memBackend) GetPrefix(prefix string) (map[string]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	result := map[string]string{}
+	for k, v := range b.data {
+		if strings.HasPrefix(k, prefix) {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+func (b *memBackend) Delete(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.data, key)
+	return nil
+}
+
+// chanSyncer sends the data of the backend whenever notified.
+type chanSyncer struct {
+	ch chan map[string]string
+}
+
+func (s *chanSyncer) SyncPrefix(prefix string) (<-chan map[string]string, error) {
+	return s.ch, nil
+}
+
+func (s *chanSyncer) Close() {}
+
+func TestValidateSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateSpec(nil))
+	assert.NoError(ValidateSpec(&Spec{AdminTokens: []*AdminTokenSpec{
+		{Name: "ops", Token: "t1", Scope: ScopeRead},
+		{Name: "admin", Token: "t2", Scope: ScopeWrite},
+	}}))
+	assert.Error(ValidateSpec(&Spec{AdminTokens: []*AdminTokenSpec{{Token: "t1", Scope: ScopeRead}}}))
+	assert.Error(ValidateSpec(&Spec{AdminTokens: []*AdminTokenSpec{{Name: "ops", Scope: ScopeRead}}}))
+	assert.Error(ValidateSpec(&Spec{AdminTokens: []*AdminTokenSpec{{Name: "ops", Token: "t1", Scope: "admin"}}}))
+	assert.Error(ValidateSpec(&Spec{AdminTokens: []*AdminTokenSpec{
+		{Name: "ops", Token: "t1", Scope: ScopeRead},
+		{Name: "ops", Token: "t2", Scope: ScopeWrite},
+	}}))
+	assert.NoError(ValidateSpec(&Spec{SkippableMiddlewares: []string{"cache", "guard"}}))
+	assert.Error(ValidateSpec(&Spec{SkippableMiddlewares: []string{""}}))
+	assert.Error(ValidateSpec(&Spec{SkippableMiddlewares: []string{"cache", "cache"}}))
+}
+
+func TestRegistrySkippedMiddlewares(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := New(&Spec{SkippableMiddlewares: []string{"cache", "guard"}}, newMemBackend(), "/consumers/", nil)
+	defer registry.Close()
+	now := time.Now()
+
+	// only the skippable middlewares can be skipped.
+	_, err := registry.Create(&CreateRequest{Name: "alice", SkipMiddlewares: []string{"policy"}}, "admin", now)
+	assert.ErrorIs(err, ErrInvalidConsumer)
+	resp, err := registry.Create(&CreateRequest{Name: "alice", SkipMiddlewares: []string{"cache", "guard"}}, "admin", now)
+	assert.NoError(err)
+	assert.Equal([]string{"cache", "guard"}, registry.SkippedMiddlewares(resp.Consumer))
+	_, err = registry.Update("alice", &UpdateRequest{SkipMiddlewares: []string{"policy"}}, "ops", now)
+	assert.ErrorIs(err, ErrInvalidConsumer)
+	c, err := registry.Update("alice", &UpdateRequest{SkipMiddlewares: []string{"guard"}}, "ops", now)
+	assert.NoError(err)
+	assert.Equal([]string{"guard"}, c.SkipMiddlewares)
+
+	// the middlewares not skippable anymore are not skipped.
+	c, err = registry.Update("alice", &UpdateRequest{SkipMiddlewares: []string{"cache", "guard"}}, "ops", now)
+	assert.NoError(err)
+	registry.SetSpec(&Spec{SkippableMiddlewares: []string{"guard"}})
+	assert.Equal([]string{"guard"}, registry.SkippedMiddlewares(c))
+	registry.SetSpec(&Spec{})
+	assert.Empty(registry.SkippedMiddlewares(c))
+}
+
+func TestRegistryLifecycle(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newMemBackend()
+	registry := New(&Spec{}, backend, "/consumers/", nil)
+	defer registry.Close()
+	now := time.Now()
+
+	resp, err := registry.Create(&CreateRequest{Name: "alice", Group: "analysts", Region: "eu"}, "admin", now)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(resp.Key, KeyPrefix))
+	assert.Equal(resp.Key[:displayedKeyLength], resp.Consumer.KeyPrefix)
+	assert.NotContains(backend.data["/consumers/alice"], resp.Key)
+	assert.Equal("admin", resp.Consumer.CreatedBy)
+
+	_, err = registry.Create(&CreateRequest{Name: "alice"}, "admin", now)
+	assert.ErrorIs(err, ErrConsumerExists)
+	_, err = registry.Create(&CreateRequest{Name: "bad name"}, "admin", now)
+	assert.ErrorIs(err, ErrInvalidConsumer)
+	_, err = registry.Create(&CreateRequest{Name: "bob", ExpiresAt: now.Add(-time.Hour).Format(time.RFC3339)}, "admin", now)
+	assert.ErrorIs(err, ErrInvalidConsumer)
+
+	c, err := registry.Authenticate("Bearer "+resp.Key, now)
+	assert.NoError(err)
+	assert.Equal("alice", c.Name)
+	assert.Equal("analysts", c.Group)
+	assert.Equal("eu", c.Region)
+	_, err = registry.Authenticate("", now)
+	assert.ErrorIs(err, ErrKeyMissing)
+	_, err = registry.Authenticate(KeyPrefix+"unknown", now)
+	assert.ErrorIs(err, ErrInvalidKey)
+
+	// the expiration takes effect immediately.
+	expiresAt := now.Add(time.Hour).Format(time.RFC3339)
+	c, err = registry.Update("alice", &UpdateRequest{Group: "others", ExpiresAt: expiresAt}, "ops", now)
+	assert.NoError(err)
+	assert.Equal("others", c.Group)
+	assert.Equal("ops", c.UpdatedBy)
+	c, err = registry.Authenticate(resp.Key, now)
+	assert.NoError(err)
+	assert.Equal("others", c.Group)
+	assert.Empty(c.Region)
+	_, err = registry.Authenticate(resp.Key, now.Add(2*time.Hour))
+	assert.ErrorIs(err, ErrKeyExpired)
+	_, err = registry.Update("bob", &UpdateRequest{}, "ops", now)
+	assert.ErrorIs(err, ErrConsumerNotFound)
+
+	_, err = registry.Create(&CreateRequest{Name: "bob"}, "admin", now)
+	assert.NoError(err)
+	list, err := registry.List()
+	assert.NoError(err)
+	assert.Len(list, 2)
+	assert.Equal("alice", list[0].Name)
+	assert.NotEmpty(list[0].KeyHash)
+
+	assert.NoError(registry.Revoke("alice", "admin"))
+	_, err = registry.Authenticate(resp.Key, now)
+	assert.ErrorIs(err, ErrInvalidKey)
+	assert.ErrorIs(registry.Revoke("alice", "admin"), ErrConsumerNotFound)
+	_, err = registry.Get("alice")
+	assert.ErrorIs(err, ErrConsumerNotFound)
+
+	// nothing changes if the backend fails.
+	backend.fail = true
+	_, err = registry.Create(&CreateRequest{Name: "carol"}, "admin", now)
+	assert.Error(err)
+	list, _ = registry.List()
+	assert.Len(list, 1)
+}
+
+func TestRegistrySync(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newMemBackend()
+	other := New(&Spec{}, backend, "/consumers/", nil)
+	defer other.Close()
+	resp, err := other.Create(&CreateRequest{Name: "alice"}, "admin", time.Now())
+	assert.NoError(err)
+
+	// the consumers are loaded on creation.
+	syncer := &chanSyncer{ch: make(chan map[string]string)}
+	registry := New(&Spec{KeyHeader: "X-Api-Key", Required: true}, backend, "/consumers/", syncer)
+	defer registry.Close()
+	_, err = registry.Authenticate(resp.Key, time.Now())
+	assert.NoError(err)
+	assert.Equal("X-Api-Key", registry.KeyHeader())
+	assert.Equal(defaultGroupHeader, registry.GroupHeader())
+	assert.True(registry.Required())
+
+	// the consumer revoked by another member.
+	assert.NoError(other.Revoke("alice", "admin"))
+	data, _ := backend.GetPrefix("/consumers/")
+	syncer.ch <- data
+	syncer.ch <- data
+	_, err = registry.Authenticate(resp.Key, time.Now())
+	assert.ErrorIs(err, ErrInvalidKey)
+}
+
+func TestRegistryAuthorize(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := New(&Spec{}, newMemBackend(), "/consumers/", nil)
+	defer registry.Close()
+	name, err := registry.Authorize("", ScopeWrite)
+	assert.NoError(err)
+	assert.Empty(name)
+
+	registry.SetSpec(&Spec{AdminTokens: []*AdminTokenSpec{
+		{Name: "ops", Token: "read-token", Scope: ScopeRead},
+		{Name: "admin", Token: "write-token", Scope: ScopeWrite},
+	}})
+	name, err = registry.Authorize("read-token", ScopeRead)
+	assert.NoError(err)
+	assert.Equal("ops", name)
+	_, err = registry.Authorize("read-token", ScopeWrite)
+	assert.ErrorIs(err, ErrForbidden)
+	name, err = registry.Authorize("write-token", ScopeWrite)
+	assert.NoError(err)
+	assert.Equal("admin", name)
+	_, err = registry.Authorize("", ScopeRead)
+	assert.ErrorIs(err, ErrUnauthorized)
+	_, err = registry.Authorize("unknown", ScopeRead)
+	assert.ErrorIs(err, ErrUnauthorized)
+}
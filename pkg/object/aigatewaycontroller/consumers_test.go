@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/consumers"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func newMapCluster() *clustertest.MockedCluster {
+	var lock sync.Mutex
+	data := map[string]string{}
+	cls := clustertest.NewMockedCluster()
+	cls.MockedGet = func(key string) (*string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if value, ok := data[key]; ok {
+			return &value, nil
+		}
+		return nil, nil
+	}
+	cls.MockedPut = func(key, value string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		data[key] = value
+		return nil
+	}
+	cls.MockedGetPrefix = func(prefix string) (map[string]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		result := map[string]string{}
+		for k, v := range data {
+			if strings.HasPrefix(k, prefix) {
+				result[k] = v
+			}
+		}
+		return result, nil
+	}
+	cls.MockedDelete = func(key string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		delete(data, key)
+		return nil
+	}
+	return cls
+}
+
+func TestConsumers(t *testing.T) {
+	assert := assert.New(t)
+
+	var consumerID, group string
+	var identity *aicontext.Consumer
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer mockServer.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+consumers:
+  required: true
+  adminTokens:
+  - name: ops
+    token: read-token
+    scope: read
+  - name: admin
+    token: write-token
+    scope: write
+`, mockServer.URL)
+	super := supervisor.NewMock(option.New(), newMapCluster(), nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	call := func(handler http.HandlerFunc, method, name, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/ai-gateway/consumers/"+name, bytes.NewReader([]byte(body)))
+		req.Header.Set(consumers.AdminTokenHeader, token)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", name)
+		req = req.WithContext(stdcontext.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	send := func(key string) *httpprot.Response {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt"}`)))
+		assert.Nil(err)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		req.Header.Set("X-Consumer-Id", "spoofed")
+		setRequest(t, ctx, "consumers", req)
+		controller.Handle(ctx, "openai", nil)
+		header := ctx.GetInputRequest().(*httpprot.Request).HTTPHeader()
+		consumerID, group = header.Get("X-Consumer-Id"), header.Get("X-Consumer-Group")
+		identity = aicontext.ConsumerOf(ctx)
+		resp := ctx.GetResponse("consumers").(*httpprot.Response)
+		ctx.Finish()
+		return resp
+	}
+
+	// the read-only token cannot mint keys.
+	body := `{"name": "alice", "group": "analysts"}`
+	assert.Equal(http.StatusUnauthorized, call(controller.createConsumer, http.MethodPost, "", "", body).Code)
+	assert.Equal(http.StatusForbidden, call(controller.createConsumer, http.MethodPost, "", "read-token", body).Code)
+	w := call(controller.createConsumer, http.MethodPost, "", "write-token", body)
+	assert.Equal(http.StatusCreated, w.Code)
+	created := &consumers.CreateResponse{}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), created))
+	assert.Contains(created.Consumer.CreatedBy, "admin")
+	assert.Equal(http.StatusConflict, call(controller.createConsumer, http.MethodPost, "", "write-token", body).Code)
+	assert.Equal(http.StatusBadRequest, call(controller.createConsumer, http.MethodPost, "", "write-token", `{"name": "bob", "expiresAt": "tomorrow"}`).Code)
+
+	w = call(controller.listConsumers, http.MethodGet, "", "read-token", "")
+	assert.Equal(http.StatusOK, w.Code)
+	list := &consumers.ListResponse{}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), list))
+	assert.Len(list.Consumers, 1)
+	assert.Equal(created.Consumer.KeyHash, list.Consumers[0].KeyHash)
+	assert.NotContains(w.Body.String(), created.Key)
+
+	// the requests are authenticated by the key.
+	resp := send(created.Key)
+	assert.Equal(http.StatusOK, resp.StatusCode())
+	assert.Equal("alice", consumerID)
+	assert.Equal("analysts", group)
+	assert.Equal(&aicontext.Consumer{ID: "alice", Group: "analysts"}, identity)
+	resp = send("")
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode())
+	assert.Empty(consumerID)
+	assert.Equal(&aicontext.Consumer{}, identity)
+
+	w = call(controller.updateConsumer, http.MethodPut, "alice", "write-token", `{"group": "others"}`)
+	assert.Equal(http.StatusOK, w.Code)
+	send(created.Key)
+	assert.Equal("others", group)
+	assert.Equal(http.StatusNotFound, call(controller.getConsumer, http.MethodGet, "bob", "read-token", "").Code)
+
+	assert.Equal(http.StatusForbidden, call(controller.revokeConsumer, http.MethodDelete, "alice", "read-token", "").Code)
+	assert.Equal(http.StatusOK, call(controller.revokeConsumer, http.MethodDelete, "alice", "write-token", "").Code)
+	resp = send(created.Key)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode())
+	assert.Equal(http.StatusNotFound, call(controller.revokeConsumer, http.MethodDelete, "alice", "write-token", "").Code)
+}
+
+func TestConsumerSkipMiddlewares(t *testing.T) {
+	assert := assert.New(t)
+
+	var tier string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tier = r.Header.Get("X-Tier")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","object":"chat.completion","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer mockServer.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+consumers:
+  required: true
+  skippableMiddlewares: [tier]
+middlewares:
+- name: tier
+  kind: ExpressionHook
+  expressionHook:
+    outputs:
+    - name: tier
+      expression: '"gold"'
+      header: X-Tier
+- name: policy
+  kind: ConsumerPolicy
+  consumerPolicy:
+    groups:
+    - name: analysts
+`, mockServer.URL)
+	super := supervisor.NewMock(option.New(), newMapCluster(), nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	registry := controller.consumers
+	now := time.Now()
+	alice, err := registry.Create(&consumers.CreateRequest{Name: "alice", SkipMiddlewares: []string{"tier"}}, "admin", now)
+	assert.Nil(err)
+	bob, err := registry.Create(&consumers.CreateRequest{Name: "bob"}, "admin", now)
+	assert.Nil(err)
+	_, err = registry.Create(&consumers.CreateRequest{Name: "carol", SkipMiddlewares: []string{"policy"}}, "admin", now)
+	assert.ErrorIs(err, consumers.ErrInvalidConsumer)
+
+	send := func(key string) {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt"}`)))
+		assert.Nil(err)
+		req.Header.Set("Authorization", "Bearer "+key)
+		setRequest(t, ctx, "consumers", req)
+		tier = ""
+		controller.Handle(ctx, "openai", []string{"tier", "policy"})
+		assert.Equal(http.StatusOK, ctx.GetResponse("consumers").(*httpprot.Response).StatusCode())
+		ctx.Finish()
+	}
+
+	// the middleware skipped by the consumer is not run for its requests.
+	send(alice.Key)
+	assert.Empty(tier)
+	send(bob.Key)
+	assert.Equal("gold", tier)
+
+	// the middleware is run again once it is not skippable.
+	registry.SetSpec(&consumers.Spec{Required: true})
+	send(alice.Key)
+	assert.Equal("gold", tier)
+
+	// the skippable middlewares must be configured, and the consumer
+	// policies are never skippable.
+	validate := func(skippable ...string) error {
+		spec := &Spec{
+			Middlewares: controller.spec.Middlewares,
+			Consumers:   &consumers.Spec{SkippableMiddlewares: skippable},
+		}
+		return spec.Validate()
+	}
+	assert.NoError(validate("tier"))
+	assert.ErrorContains(validate("missing"), "not found")
+	assert.ErrorContains(validate("policy"), "not skippable")
+	assert.ErrorContains(validate("tier", "tier"), "duplicated")
+}
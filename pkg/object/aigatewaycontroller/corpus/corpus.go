@@ -0,0 +1,455 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package corpus samples AI requests into a replayable corpus for offline
+// evaluation. The requests are stratified by model and consumer, so the
+// corpus is not dominated by the top consumers.
+package corpus
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+const (
+	defaultWindow          = 24 * time.Hour
+	minWindow              = time.Minute
+	defaultMaxStrata       = 1000
+	defaultMaxRequestBytes = 1 << 20
+)
+
+type (
+	// Spec describes the corpus sampler of AIGatewayController.
+	Spec struct {
+		// Window is the period of a corpus file, the samples of a window
+		// are written when it ends.
+		Window string `json:"window,omitempty" jsonschema:"format=duration"`
+		// Seed is mixed into the hash of request IDs, changing it selects
+		// a different corpus from the same traffic.
+		Seed string `json:"seed,omitempty"`
+		// Strata are the target counts of strata, the first one matching
+		// the model and consumer of a request is used.
+		Strata []*StratumSpec `json:"strata,omitempty"`
+		// DefaultTarget is the target count of strata not matching any of
+		// Strata, 0 means they are not sampled.
+		DefaultTarget int `json:"defaultTarget,omitempty"`
+		// MaxStrata is the maximum number of strata of a window, requests
+		// of new strata beyond it are not sampled.
+		MaxStrata int `json:"maxStrata,omitempty"`
+		// MaxRequestBytes is the maximum size of a sampled request body,
+		// larger requests are not sampled.
+		MaxRequestBytes int `json:"maxRequestBytes,omitempty"`
+		// IncludeResponses stores the responses with the requests.
+		IncludeResponses bool `json:"includeResponses,omitempty"`
+		// Redaction redacts PII in the stored requests and responses.
+		Redaction *RedactionSpec `json:"redaction,omitempty"`
+		File      *FileSpec      `json:"file" jsonschema:"required"`
+		// Upload uploads the corpus files to object storage.
+		Upload *UploadSpec `json:"upload,omitempty"`
+		// Region is the data residency region of the corpus, the requests
+		// of consumers pinned to other regions are not sampled.
+		Region string `json:"region,omitempty"`
+	}
+
+	// StratumSpec is the target count of the strata matching it. Each
+	// distinct pair of model and consumer is a stratum.
+	StratumSpec struct {
+		// Model is a glob pattern of the model name, empty matches all.
+		Model string `json:"model,omitempty"`
+		// Consumer is a glob pattern of the consumer, empty matches all.
+		Consumer string `json:"consumer,omitempty"`
+		// Target is the number of requests sampled in a window, 0 means
+		// the strata are not sampled.
+		Target int `json:"target"`
+	}
+
+	// Request is a finished request offered to the sampler.
+	Request struct {
+		RequestID string
+		Model     string
+		Consumer  string
+		Provider  string
+		// Endpoint is the path of the request, e.g. /v1/chat/completions.
+		Endpoint   string
+		StatusCode int
+		Body       []byte
+		// Response returns the response body, it is only called if the
+		// request is sampled and responses are included.
+		Response func() []byte
+	}
+
+	// Record is a sampled request in the corpus file.
+	Record struct {
+		RequestID  string `json:"requestID"`
+		Timestamp  string `json:"timestamp"`
+		Model      string `json:"model"`
+		Consumer   string `json:"consumer,omitempty"`
+		Provider   string `json:"provider"`
+		Endpoint   string `json:"endpoint"`
+		StatusCode int    `json:"statusCode"`
+		Request    any    `json:"request"`
+		Response   any    `json:"response,omitempty"`
+	}
+
+	// Status is the fill level of the strata of the current window.
+	Status struct {
+		WindowStart string `json:"windowStart"`
+		WindowEnd   string `json:"windowEnd"`
+		// Overflowed is the number of requests not sampled since their
+		// strata exceed MaxStrata.
+		Overflowed int64            `json:"overflowed"`
+		Strata     []*StratumStatus `json:"strata"`
+		// LastFile is the last corpus file written.
+		LastFile  string `json:"lastFile,omitempty"`
+		LastError string `json:"lastError,omitempty"`
+	}
+
+	// StratumStatus is the fill level of a stratum.
+	StratumStatus struct {
+		Model    string `json:"model"`
+		Consumer string `json:"consumer,omitempty"`
+		Target   int    `json:"target"`
+		Sampled  int    `json:"sampled"`
+		// Seen is the number of requests of the stratum in the window.
+		Seen int64 `json:"seen"`
+	}
+
+	// Sampler samples the requests of each window. In each stratum, the
+	// requests with the smallest hashes of their IDs are kept, which is
+	// a uniform sample of the stratum and is deterministic per request ID.
+	Sampler struct {
+		spec   *Spec
+		window time.Duration
+		writer *writer
+
+		lock        sync.Mutex
+		windowStart time.Time
+		strata      map[stratumKey]*stratum
+		overflowed  int64
+		lastFile    string
+		lastError   string
+
+		flushLock sync.Mutex
+		done      chan struct{}
+		wg        sync.WaitGroup
+	}
+
+	stratumKey struct {
+		model    string
+		consumer string
+	}
+
+	stratum struct {
+		target  int
+		seen    int64
+		samples sampleHeap
+	}
+
+	sample struct {
+		hash      uint64
+		timestamp time.Time
+		req       *Request
+		response  []byte
+	}
+
+	// sampleHeap is a max heap of the hashes, the root is evicted first.
+	sampleHeap []*sample
+)
+
+func (h sampleHeap) Len() int           { return len(h) }
+func (h sampleHeap) Less(i, j int) bool { return h[i].hash > h[j].hash }
+func (h sampleHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x any)        { *h = append(*h, x.(*sample)) }
+func (h *sampleHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+// ValidateSpec validates the corpus spec.
+func ValidateSpec(spec *Spec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.Window != "" {
+		window, err := time.ParseDuration(spec.Window)
+		if err != nil {
+			return fmt.Errorf("invalid window: %w", err)
+		}
+		if window < minWindow {
+			return fmt.Errorf("window must be at least %s", minWindow)
+		}
+	}
+	for _, s := range spec.Strata {
+		if _, err := path.Match(s.Model, ""); err != nil {
+			return fmt.Errorf("invalid model pattern %s: %w", s.Model, err)
+		}
+		if _, err := path.Match(s.Consumer, ""); err != nil {
+			return fmt.Errorf("invalid consumer pattern %s: %w", s.Consumer, err)
+		}
+		if s.Target < 0 {
+			return fmt.Errorf("target of strata cannot be negative")
+		}
+	}
+	if spec.DefaultTarget < 0 {
+		return fmt.Errorf("defaultTarget cannot be negative")
+	}
+	if spec.MaxStrata < 0 {
+		return fmt.Errorf("maxStrata cannot be negative")
+	}
+	if spec.MaxRequestBytes < 0 {
+		return fmt.Errorf("maxRequestBytes cannot be negative")
+	}
+	if err := validateRedactionSpec(spec.Redaction); err != nil {
+		return fmt.Errorf("invalid redaction: %w", err)
+	}
+	if spec.File == nil {
+		return fmt.Errorf("file is required")
+	}
+	if err := validateFileSpec(spec.File); err != nil {
+		return fmt.Errorf("invalid file: %w", err)
+	}
+	if err := validateUploadSpec(spec.Upload); err != nil {
+		return fmt.Errorf("invalid upload: %w", err)
+	}
+	return nil
+}
+
+// New creates the sampler of the spec, member distinguishes the corpus
+// files of the members of the cluster.
+func New(spec *Spec, member string) *Sampler {
+	window := defaultWindow
+	if spec.Window != "" {
+		window, _ = time.ParseDuration(spec.Window)
+	}
+	s := &Sampler{
+		spec:   spec,
+		window: window,
+		writer: newWriter(spec, member),
+		strata: make(map[stratumKey]*stratum),
+		done:   make(chan struct{}),
+	}
+	s.windowStart = time.Now().Truncate(window)
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Hash returns the sampling hash of the request ID.
+func (s *Sampler) Hash(requestID string) uint64 {
+	sum := sha256.Sum256([]byte(s.spec.Seed + "\x00" + requestID))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func (s *Sampler) target(key stratumKey) int {
+	for _, st := range s.spec.Strata {
+		if ok, _ := path.Match(st.Model, key.model); !ok && st.Model != "" {
+			continue
+		}
+		if ok, _ := path.Match(st.Consumer, key.consumer); !ok && st.Consumer != "" {
+			continue
+		}
+		return st.Target
+	}
+	return s.spec.DefaultTarget
+}
+
+func (s *Sampler) maxStrata() int {
+	if s.spec.MaxStrata > 0 {
+		return s.spec.MaxStrata
+	}
+	return defaultMaxStrata
+}
+
+func (s *Sampler) maxRequestBytes() int {
+	if s.spec.MaxRequestBytes > 0 {
+		return s.spec.MaxRequestBytes
+	}
+	return defaultMaxRequestBytes
+}
+
+// Offer offers a finished request to the sampler, it returns whether the
+// request is sampled for now, it may be evicted by later requests. The
+// request is only kept in memory, it is redacted and written when the
+// window ends, so Offer adds little latency.
+func (s *Sampler) Offer(req *Request) bool {
+	if len(req.Body) > s.maxRequestBytes() {
+		return false
+	}
+	hash := s.Hash(req.RequestID)
+	key := stratumKey{model: req.Model, consumer: req.Consumer}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := s.strata[key]
+	if st == nil {
+		if len(s.strata) >= s.maxStrata() {
+			s.overflowed++
+			return false
+		}
+		st = &stratum{target: s.target(key)}
+		s.strata[key] = st
+	}
+	st.seen++
+	if st.target == 0 {
+		return false
+	}
+	if len(st.samples) >= st.target {
+		if hash >= st.samples[0].hash {
+			return false
+		}
+		heap.Pop(&st.samples)
+	}
+
+	smp := &sample{hash: hash, timestamp: time.Now(), req: req}
+	// the request body may be reused after the request finishes.
+	req.Body = append([]byte(nil), req.Body...)
+	if s.spec.IncludeResponses && req.Response != nil {
+		smp.response = append([]byte(nil), req.Response()...)
+	}
+	req.Response = nil
+	heap.Push(&st.samples, smp)
+	return true
+}
+
+func (s *Sampler) run() {
+	defer s.wg.Done()
+	for {
+		s.lock.Lock()
+		end := s.windowStart.Add(s.window)
+		s.lock.Unlock()
+
+		timer := time.NewTimer(time.Until(end))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.flush(time.Now())
+		}
+	}
+}
+
+// flush writes the samples of the current window and starts a new one.
+func (s *Sampler) flush(now time.Time) {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.lock.Lock()
+	start, strata := s.windowStart, s.strata
+	s.windowStart = now.Truncate(s.window)
+	s.strata = make(map[stratumKey]*stratum)
+	s.overflowed = 0
+	s.lock.Unlock()
+
+	var samples []*sample
+	for _, st := range strata {
+		samples = append(samples, st.samples...)
+	}
+	if len(samples) == 0 {
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].timestamp.Before(samples[j].timestamp)
+	})
+
+	file, err := s.writer.write(start, now, s.records(samples))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		logger.Errorf("failed to write corpus of window %s: %v", start.UTC().Format(time.RFC3339), err)
+		s.lastError = err.Error()
+		return
+	}
+	logger.Infof("wrote %d samples to corpus file %s", len(samples), file)
+	s.lastFile, s.lastError = file, ""
+}
+
+// records redacts the samples into records.
+func (s *Sampler) records(samples []*sample) []*Record {
+	redactor := newRedactor(s.spec.Redaction)
+	records := make([]*Record, 0, len(samples))
+	for _, smp := range samples {
+		req := smp.req
+		record := &Record{
+			RequestID:  req.RequestID,
+			Timestamp:  smp.timestamp.UTC().Format(time.RFC3339Nano),
+			Model:      req.Model,
+			Consumer:   req.Consumer,
+			Provider:   req.Provider,
+			Endpoint:   req.Endpoint,
+			StatusCode: req.StatusCode,
+			Request:    redactor.redactBody(req.Body),
+		}
+		if smp.response != nil {
+			record.Response = redactor.redactBody(smp.response)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Status returns the fill level of the strata of the current window.
+func (s *Sampler) Status() *Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := &Status{
+		WindowStart: s.windowStart.UTC().Format(time.RFC3339),
+		WindowEnd:   s.windowStart.Add(s.window).UTC().Format(time.RFC3339),
+		Overflowed:  s.overflowed,
+		Strata:      make([]*StratumStatus, 0, len(s.strata)),
+		LastFile:    s.lastFile,
+		LastError:   s.lastError,
+	}
+	for key, st := range s.strata {
+		status.Strata = append(status.Strata, &StratumStatus{
+			Model:    key.model,
+			Consumer: key.consumer,
+			Target:   st.target,
+			Sampled:  len(st.samples),
+			Seen:     st.seen,
+		})
+	}
+	sort.Slice(status.Strata, func(i, j int) bool {
+		a, b := status.Strata[i], status.Strata[j]
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Consumer < b.Consumer
+	})
+	return status
+}
+
+// Close stops the sampler, the samples of the current window are written.
+func (s *Sampler) Close() {
+	close(s.done)
+	s.wg.Wait()
+	s.flush(time.Now())
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package corpus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	os.Exit(m.Run())
+}
+
+func newRequest(id, model, consumer string) *Request {
+	return &Request{
+		RequestID:  id,
+		Model:      model,
+		Consumer:   consumer,
+		Provider:   "openai",
+		Endpoint:   "/v1/chat/completions",
+		StatusCode: http.StatusOK,
+		Body:       []byte(`{"model":"` + model + `","messages":[{"role":"user","content":"mail me at bob@example.com"}]}`),
+		Response: func() []byte {
+			return []byte(`{"choices":[{"message":{"content":"call 555-123-4567"}}]}`)
+		},
+	}
+}
+
+func sampledIDs(s *Sampler) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ids []string
+	for _, st := range s.strata {
+		for _, smp := range st.samples {
+			ids = append(ids, smp.req.RequestID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func readRecords(t *testing.T, file string) []*Record {
+	f, err := os.Open(file)
+	assert.NoError(t, err)
+	defer f.Close()
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := &Record{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestValidateSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	file := &FileSpec{Dir: t.TempDir()}
+	assert.NoError(ValidateSpec(nil))
+	assert.NoError(ValidateSpec(&Spec{File: file, DefaultTarget: 10}))
+	assert.Error(ValidateSpec(&Spec{}))
+	assert.Error(ValidateSpec(&Spec{File: &FileSpec{}}))
+	assert.Error(ValidateSpec(&Spec{File: file, Window: "1s"}))
+	assert.Error(ValidateSpec(&Spec{File: file, Strata: []*StratumSpec{{Model: "[", Target: 1}}}))
+	assert.Error(ValidateSpec(&Spec{File: file, Strata: []*StratumSpec{{Target: -1}}}))
+	assert.Error(ValidateSpec(&Spec{File: file, Redaction: &RedactionSpec{Builtins: []string{"ssn"}}}))
+	assert.Error(ValidateSpec(&Spec{File: file, Redaction: &RedactionSpec{Patterns: []*RedactionPattern{{Name: "key", Regex: "("}}}}))
+	assert.Error(ValidateSpec(&Spec{File: file, Upload: &UploadSpec{URL: "ftp://example.com"}}))
+}
+
+func TestSamplerStrata(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{
+		DefaultTarget: 2,
+		Strata: []*StratumSpec{
+			{Model: "gpt-4*", Consumer: "tester", Target: 0},
+			{Model: "gpt-4*", Target: 5},
+		},
+		MaxStrata:       3,
+		MaxRequestBytes: 1024,
+		File:            &FileSpec{Dir: t.TempDir()},
+	}
+	s := New(spec, "member")
+	defer s.Close()
+
+	// the top consumer does not take over the corpus.
+	for i := 0; i < 100; i++ {
+		s.Offer(newRequest(fmt.Sprintf("top-%d", i), "llama", "top"))
+	}
+	for i := 0; i < 3; i++ {
+		s.Offer(newRequest(fmt.Sprintf("small-%d", i), "llama", "small"))
+	}
+	for i := 0; i < 10; i++ {
+		s.Offer(newRequest(fmt.Sprintf("gpt-%d", i), "gpt-4o", "top"))
+	}
+	// not sampled by the rule, and overflowed.
+	assert.False(s.Offer(newRequest("tester", "gpt-4o", "tester")))
+	assert.False(s.Offer(newRequest("other", "llama", "other")))
+	large := newRequest("large", "llama", "small")
+	large.Body = make([]byte, 2048)
+	assert.False(s.Offer(large))
+
+	status := s.Status()
+	assert.EqualValues(2, status.Overflowed)
+	assert.Len(status.Strata, 3)
+	assert.Equal(&StratumStatus{Model: "gpt-4o", Consumer: "top", Target: 5, Sampled: 5, Seen: 10}, status.Strata[0])
+	assert.Equal(&StratumStatus{Model: "llama", Consumer: "small", Target: 2, Sampled: 2, Seen: 3}, status.Strata[1])
+	assert.Equal(&StratumStatus{Model: "llama", Consumer: "top", Target: 2, Sampled: 2, Seen: 100}, status.Strata[2])
+}
+
+func TestSamplerDeterministic(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{DefaultTarget: 5, File: &FileSpec{Dir: t.TempDir()}}
+	a, b := New(spec, ""), New(spec, "")
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 50; i++ {
+		a.Offer(newRequest(fmt.Sprintf("req-%d", i), "llama", "top"))
+	}
+	for i := 49; i >= 0; i-- {
+		b.Offer(newRequest(fmt.Sprintf("req-%d", i), "llama", "top"))
+	}
+	// the sample depends on the request IDs only, not on the order.
+	assert.Len(sampledIDs(a), 5)
+	assert.Equal(sampledIDs(a), sampledIDs(b))
+
+	// a different seed selects a different corpus.
+	c := New(&Spec{DefaultTarget: 5, Seed: "another", File: spec.File}, "")
+	defer c.Close()
+	for i := 0; i < 50; i++ {
+		c.Offer(newRequest(fmt.Sprintf("req-%d", i), "llama", "top"))
+	}
+	assert.NotEqual(sampledIDs(a), sampledIDs(c))
+}
+
+func TestSamplerFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	var uploaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(http.MethodPut, r.Method)
+		assert.Equal("secret", r.Header.Get("Authorization"))
+		body, _ := io.ReadAll(r.Body)
+		assert.NotEmpty(body)
+		uploaded = append(uploaded, r.URL.Path)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	spec := &Spec{
+		DefaultTarget: 10,
+		File:          &FileSpec{Dir: dir, MaxFiles: 2},
+		Upload:        &UploadSpec{URL: server.URL + "/bucket/", Headers: map[string]string{"Authorization": "secret"}},
+	}
+	s := New(spec, "member")
+	defer s.Close()
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 2; j++ {
+			s.Offer(newRequest(fmt.Sprintf("req-%d-%d", i, j), "llama", "top"))
+		}
+		s.flush(now.Add(time.Duration(i+1) * 24 * time.Hour))
+	}
+	// nothing is written for an empty window.
+	s.flush(now.Add(96 * time.Hour))
+
+	status := s.Status()
+	assert.Empty(status.LastError)
+	assert.True(strings.HasPrefix(filepath.Base(status.LastFile), "corpus-member-"))
+	assert.Empty(status.Strata)
+	assert.Len(uploaded, 3)
+	assert.Equal("/bucket/"+filepath.Base(status.LastFile), uploaded[2])
+
+	// the oldest file is removed.
+	entries, err := os.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(entries, 2)
+
+	records := readRecords(t, status.LastFile)
+	assert.Len(records, 2)
+	assert.Equal("llama", records[0].Model)
+	assert.Equal("top", records[0].Consumer)
+	assert.Contains(records[0].RequestID, "req-2-")
+	// the responses are excluded by default, and PII is redacted.
+	assert.Nil(records[0].Response)
+	data, _ := json.Marshal(records[0].Request)
+	assert.Contains(string(data), "mail me at [EMAIL]")
+
+	// the responses are included.
+	spec = &Spec{DefaultTarget: 10, IncludeResponses: true, File: &FileSpec{Dir: t.TempDir()}}
+	s2 := New(spec, "")
+	s2.Offer(newRequest("req", "llama", "top"))
+	s2.Close()
+	records = readRecords(t, s2.Status().LastFile)
+	assert.Len(records, 1)
+	data, _ = json.Marshal(records[0].Response)
+	assert.Contains(string(data), "call [PHONE]")
+
+	// the upload failure is reported, the file is still kept.
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	s.Offer(newRequest("req", "llama", "top"))
+	s.flush(now.Add(120 * time.Hour))
+	assert.Contains(s.Status().LastError, "status 403")
+}
+
+func TestRedactor(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newRedactor(nil)
+	assert.Equal("[EMAIL], [PHONE], [PHONE], [CREDIT_CARD], [IP_ADDRESS]",
+		r.redactText("a.b@example.com, (555) 123-4567, +1 555.123.4567, 4111 1111 1111 1111, 10.0.0.1"))
+	// numbers of JSON bodies are kept.
+	assert.Equal(map[string]any{"created": 5551234567.0, "content": "[PHONE]"},
+		r.redactBody([]byte(`{"created": 5551234567, "content": "5551234567"}`)))
+
+	stream := "data: {\"content\":\"bob@example.com\"}\n\ndata: [DONE]\n"
+	assert.Equal("data: {\"content\":\"[EMAIL]\"}\n\ndata: [DONE]\n", r.redactBody([]byte(stream)))
+
+	r = newRedactor(&RedactionSpec{
+		Builtins: []string{PIIEmail},
+		Patterns: []*RedactionPattern{{Name: "apiKey", Regex: `sk-[A-Za-z0-9]+`}},
+	})
+	assert.Equal("[EMAIL] [APIKEY] 10.0.0.1", r.redactText("bob@example.com sk-abc123 10.0.0.1"))
+
+	r = newRedactor(&RedactionSpec{DisableBuiltins: true})
+	assert.Equal("bob@example.com", r.redactText("bob@example.com"))
+}
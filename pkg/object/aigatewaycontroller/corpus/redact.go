@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package corpus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Built-in PII patterns.
+const (
+	PIIEmail      = "email"
+	PIICreditCard = "creditCard"
+	PIIPhone      = "phone"
+	PIIIPAddress  = "ipAddress"
+)
+
+type (
+	// RedactionSpec describes the redaction of PII in the corpus. The
+	// built-in patterns are applied unless they are disabled.
+	RedactionSpec struct {
+		// Builtins are the built-in patterns applied, empty means all:
+		// email, creditCard, phone and ipAddress.
+		Builtins []string `json:"builtins,omitempty"`
+		// DisableBuiltins disables the built-in patterns.
+		DisableBuiltins bool `json:"disableBuiltins,omitempty"`
+		// Patterns are the custom patterns, applied after the built-in ones.
+		Patterns []*RedactionPattern `json:"patterns,omitempty"`
+	}
+
+	// RedactionPattern replaces the matches of a regular expression.
+	RedactionPattern struct {
+		Name  string `json:"name" jsonschema:"required"`
+		Regex string `json:"regex" jsonschema:"required"`
+		// Replacement replaces the matches, default is [<NAME>].
+		Replacement string `json:"replacement,omitempty"`
+	}
+
+	redactor struct {
+		rules []*redactionRule
+	}
+
+	redactionRule struct {
+		re          *regexp.Regexp
+		replacement string
+	}
+)
+
+// builtinPatterns are applied in order, credit cards before phones, since
+// the numbers of credit cards contain phone-like numbers.
+var builtinPatterns = []*struct {
+	name        string
+	re          *regexp.Regexp
+	replacement string
+}{
+	{PIIEmail, regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[EMAIL]"},
+	{PIICreditCard, regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), "[CREDIT_CARD]"},
+	{PIIPhone, regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{3}\)|\b\d{3})[ .-]?\d{3}[ .-]?\d{4}\b`), "[PHONE]"},
+	{PIIIPAddress, regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`), "[IP_ADDRESS]"},
+}
+
+// PIIPattern is a built-in PII pattern.
+type PIIPattern struct {
+	Name string
+	// Kind is the kind of the PII in upper case, like EMAIL.
+	Kind   string
+	Regexp *regexp.Regexp
+}
+
+// BuiltinPIIPatterns returns the built-in PII patterns in the order they
+// are applied.
+func BuiltinPIIPatterns() []*PIIPattern {
+	patterns := make([]*PIIPattern, 0, len(builtinPatterns))
+	for _, p := range builtinPatterns {
+		patterns = append(patterns, &PIIPattern{
+			Name:   p.name,
+			Kind:   strings.Trim(p.replacement, "[]"),
+			Regexp: p.re,
+		})
+	}
+	return patterns
+}
+
+func validateRedactionSpec(spec *RedactionSpec) error {
+	if spec == nil {
+		return nil
+	}
+	for _, name := range spec.Builtins {
+		found := false
+		for _, p := range builtinPatterns {
+			if p.name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown built-in pattern %s", name)
+		}
+	}
+	for _, p := range spec.Patterns {
+		if p.Name == "" {
+			return fmt.Errorf("pattern name cannot be empty")
+		}
+		if _, err := regexp.Compile(p.Regex); err != nil {
+			return fmt.Errorf("invalid regex of pattern %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func newRedactor(spec *RedactionSpec) *redactor {
+	if spec == nil {
+		spec = &RedactionSpec{}
+	}
+	r := &redactor{}
+	if !spec.DisableBuiltins {
+		for _, p := range builtinPatterns {
+			if len(spec.Builtins) == 0 || contains(spec.Builtins, p.name) {
+				r.rules = append(r.rules, &redactionRule{re: p.re, replacement: p.replacement})
+			}
+		}
+	}
+	for _, p := range spec.Patterns {
+		replacement := p.Replacement
+		if replacement == "" {
+			replacement = "[" + strings.ToUpper(p.Name) + "]"
+		}
+		r.rules = append(r.rules, &redactionRule{re: regexp.MustCompile(p.Regex), replacement: replacement})
+	}
+	return r
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redactor) redactText(text string) string {
+	for _, rule := range r.rules {
+		text = rule.re.ReplaceAllLiteralString(text, rule.replacement)
+	}
+	return text
+}
+
+// redactValue redacts the strings in a decoded JSON value, the keys and
+// numbers are kept.
+func (r *redactor) redactValue(v any) any {
+	switch v := v.(type) {
+	case string:
+		return r.redactText(v)
+	case []any:
+		for i := range v {
+			v[i] = r.redactValue(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = r.redactValue(v[k])
+		}
+	}
+	return v
+}
+
+// redactBody redacts a request or response body. A JSON body is returned
+// as the decoded value, other bodies, e.g. event streams, are returned as
+// strings with the JSON data of events redacted.
+func (r *redactor) redactBody(body []byte) any {
+	var v any
+	if err := json.Unmarshal(body, &v); err == nil {
+		return r.redactValue(v)
+	}
+
+	lines := bytes.Split(body, []byte("\n"))
+	for i, line := range lines {
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if ok {
+			var event any
+			if err := json.Unmarshal(data, &event); err == nil {
+				redacted, _ := json.Marshal(r.redactValue(event))
+				lines[i] = append([]byte("data: "), redacted...)
+				continue
+			}
+		}
+		lines[i] = []byte(r.redactText(string(line)))
+	}
+	return string(bytes.Join(lines, []byte("\n")))
+}
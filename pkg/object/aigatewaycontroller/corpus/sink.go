@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package corpus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxFiles      = 10
+	defaultUploadTimeout = time.Minute
+	fileTimeFormat       = "20060102T150405Z"
+)
+
+type (
+	// FileSpec describes the local corpus files, a file is written for
+	// each window.
+	FileSpec struct {
+		Dir string `json:"dir" jsonschema:"required"`
+		// MaxFiles is the number of corpus files kept, the oldest ones are
+		// removed, default is 10.
+		MaxFiles int `json:"maxFiles,omitempty"`
+	}
+
+	// UploadSpec uploads the corpus files to object storage by HTTP PUT,
+	// e.g. to an S3 compatible bucket or a presigned URL prefix.
+	UploadSpec struct {
+		// URL is the prefix of the object URLs, the file name is appended.
+		URL     string            `json:"url" jsonschema:"required"`
+		Headers map[string]string `json:"headers,omitempty"`
+		Timeout string            `json:"timeout,omitempty" jsonschema:"format=duration"`
+	}
+
+	// writer writes the records of windows to files and uploads them.
+	writer struct {
+		file   *FileSpec
+		upload *UploadSpec
+		prefix string
+		client *http.Client
+	}
+)
+
+func validateFileSpec(spec *FileSpec) error {
+	if spec.Dir == "" {
+		return fmt.Errorf("dir is required")
+	}
+	if spec.MaxFiles < 0 {
+		return fmt.Errorf("maxFiles cannot be negative")
+	}
+	return nil
+}
+
+func validateUploadSpec(spec *UploadSpec) error {
+	if spec == nil {
+		return nil
+	}
+	u, err := url.Parse(spec.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must be http or https")
+	}
+	if spec.Timeout != "" {
+		if _, err := time.ParseDuration(spec.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	return nil
+}
+
+func newWriter(spec *Spec, member string) *writer {
+	w := &writer{
+		file:   spec.File,
+		upload: spec.Upload,
+		prefix: "corpus-",
+	}
+	if member != "" {
+		w.prefix += member + "-"
+	}
+	if spec.Upload != nil {
+		timeout := defaultUploadTimeout
+		if spec.Upload.Timeout != "" {
+			timeout, _ = time.ParseDuration(spec.Upload.Timeout)
+		}
+		w.client = &http.Client{Timeout: timeout}
+	}
+	return w
+}
+
+// write writes the records of the window to a new file, removes the
+// oldest files and uploads the file, it returns the file path.
+func (w *writer) write(start, end time.Time, records []*Record) (string, error) {
+	if err := os.MkdirAll(w.file.Dir, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s%s-%s.jsonl", w.prefix, start.UTC().Format(fileTimeFormat), end.UTC().Format(fileTimeFormat))
+	file := filepath.Join(w.file.Dir, name)
+
+	// write to a temporary file first, so readers never see partial files.
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	buf := bufio.NewWriter(f)
+	encoder := json.NewEncoder(buf)
+	for _, record := range records {
+		if err = encoder.Encode(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	w.rotate()
+	if w.upload != nil {
+		if err := w.put(name, file); err != nil {
+			return file, fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+	}
+	return file, nil
+}
+
+// rotate removes the oldest corpus files of the member beyond MaxFiles.
+func (w *writer) rotate() {
+	maxFiles := w.file.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultMaxFiles
+	}
+	entries, err := os.ReadDir(w.file.Dir)
+	if err != nil {
+		return
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, w.prefix) && strings.HasSuffix(name, ".jsonl") {
+			files = append(files, name)
+		}
+	}
+	if len(files) <= maxFiles {
+		return
+	}
+	// the names start with the window time, so they sort by time.
+	sort.Strings(files)
+	for _, name := range files[:len(files)-maxFiles] {
+		os.Remove(filepath.Join(w.file.Dir, name))
+	}
+}
+
+func (w *writer) put(name, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	target := strings.TrimSuffix(w.upload.URL, "/") + "/" + url.PathEscape(name)
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range w.upload.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// dryRunSecretHeaders are the headers carrying credentials, their values
+// are redacted in the requests of dry runs.
+var dryRunSecretHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Api-Key",
+	"X-Api-Key",
+	"X-Goog-Api-Key",
+	"X-Amz-Security-Token",
+}
+
+type (
+	// DryRunRequest is a request to run through the middlewares of the
+	// controller, it is not sent to the provider.
+	DryRunRequest struct {
+		// Provider is the provider or the provider group of the
+		// AIGatewayProxy filter, and Middlewares are its middlewares.
+		Provider    string   `json:"provider"`
+		Middlewares []string `json:"middlewares,omitempty"`
+		// Path is the endpoint of the request, default
+		// /v1/chat/completions.
+		Path string `json:"path,omitempty"`
+		// Consumer is the name of the consumer sending the request, it is
+		// looked up in the consumer keys instead of authenticating a key.
+		Consumer string            `json:"consumer,omitempty"`
+		Headers  map[string]string `json:"headers,omitempty"`
+		// Body is the body of the request in the OpenAI API.
+		Body map[string]any `json:"body,omitempty"`
+	}
+
+	// DryRunResponse is the request which would be sent to the provider,
+	// and the decisions made on it.
+	DryRunResponse struct {
+		SimulateResponse
+
+		// Request is the request to the provider, it is nil if the
+		// request is rejected.
+		Request *DryRunUpstreamRequest `json:"request,omitempty"`
+		Trace   *DryRunTrace           `json:"trace,omitempty"`
+	}
+
+	// DryRunUpstreamRequest is the request to the provider, the values
+	// of the headers carrying credentials are replaced by their hashes.
+	DryRunUpstreamRequest struct {
+		Method  string      `json:"method"`
+		URL     string      `json:"url"`
+		Headers http.Header `json:"headers,omitempty"`
+		// Body is the decoded JSON body, or the body as is if it is not
+		// JSON.
+		Body any `json:"body,omitempty"`
+	}
+
+	// DryRunTrace is the decisions recorded in the AI context by the
+	// middlewares.
+	DryRunTrace struct {
+		Tags                string                          `json:"tags,omitempty"`
+		Flags               map[string]bool                 `json:"flags,omitempty"`
+		Variables           map[string]any                  `json:"variables,omitempty"`
+		Citations           []*aicontext.Citation           `json:"citations,omitempty"`
+		ConversationRepairs []*aicontext.ConversationRepair `json:"conversationRepairs,omitempty"`
+		PackedChunks        []*aicontext.PackedChunk        `json:"packedChunks,omitempty"`
+		ImageOptimizations  []*aicontext.ImageOptimization  `json:"imageOptimizations,omitempty"`
+		BudgetDecisions     []*aicontext.BudgetDecision     `json:"budgetDecisions,omitempty"`
+	}
+)
+
+// validateDryRunRequest validates the request and sets the defaults.
+func validateDryRunRequest(req *DryRunRequest) error {
+	if req.Provider == "" {
+		return fmt.Errorf("provider is required")
+	}
+	if req.Path == "" {
+		req.Path = string(aicontext.ResponseTypeChatCompletions)
+	}
+	return nil
+}
+
+// dryRun runs the request through the middlewares like Handle, and
+// returns the request which would be sent to the provider. The checks of
+// the gateway before the middlewares are simulated, so nothing is counted
+// by the rate limit or the metrics, and the middlewares skip writing to
+// their stores. A streaming request is returned like a non-streaming one,
+// as the provider is not called.
+func (agc *AIGatewayController) dryRun(req *DryRunRequest, now time.Time) (*DryRunResponse, error) {
+	if err := validateDryRunRequest(req); err != nil {
+		return nil, err
+	}
+	if err := agc.ValidateMiddlewares(req.Middlewares); err != nil {
+		return nil, err
+	}
+	method := http.MethodPost
+	if ep := findSupportedEndpoint(req.Path); ep != nil {
+		method = ep.method
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = codectool.MarshalJSON(req.Body); err != nil {
+			return nil, fmt.Errorf("invalid body: %w", err)
+		}
+	}
+	ctx, egReq, err := newSyntheticRequest(method, req.Path, req.Headers, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dry run request: %w", err)
+	}
+	resp := &DryRunResponse{
+		SimulateResponse: SimulateResponse{Outcome: SimulationProxied, Steps: []*middlewares.SimulationStep{}},
+	}
+	s := &simulation{resp: &resp.SimulateResponse, ctx: ctx, req: egReq}
+
+	if !s.add("readiness", agc.simulateReadiness()) ||
+		!s.add("endpoint", agc.simulateEndpoint(req.Path)) ||
+		!s.add("authentication", agc.simulateAuthentication(ctx, req.Consumer, now)) ||
+		!s.add("rateLimit", agc.simulateRateLimit(ctx, 0, now)) {
+		return resp, nil
+	}
+
+	set := agc.acquireProviders()
+	if set == nil {
+		return nil, fmt.Errorf("AIGatewayController is closed")
+	}
+	defer set.release()
+
+	providerName, step := agc.simulateRouting(req.Provider)
+	provider, ok := set.providers[providerName]
+	if !ok || providerName == "" {
+		step.Decision = middlewares.SimulationReject
+		step.Detail = fmt.Sprintf("provider %s not found", providerName)
+	}
+	if !s.add("routing", step) {
+		return resp, nil
+	}
+	resp.Provider = providerName
+
+	aiCtx, err := aicontext.New(ctx, provider.Spec())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AI context: %w", err)
+	}
+	aiCtx.DryRun = true
+	aiCtx.ConsumerRegion = agc.consumerRegion(ctx)
+	if !s.add("capability", agc.simulateCapability(aiCtx)) {
+		return resp, nil
+	}
+	s.add("featureFlags", agc.simulateFeatureFlags(aiCtx))
+	defer func() {
+		resp.Trace = newDryRunTrace(aiCtx)
+	}()
+
+	states := agc.getMiddlewareStates()
+	for _, name := range req.Middlewares {
+		if !s.add("middleware/"+name, agc.dryRunMiddleware(aiCtx, name, states[name])) {
+			return resp, nil
+		}
+	}
+
+	if aiCtx.RespType == aicontext.ResponseTypeModerations && agc.moderator != nil {
+		s.add("moderation", &middlewares.SimulationStep{
+			Decision: middlewares.SimulationSkip,
+			Rules:    []string{"moderation"},
+			Detail:   "the request is served by the moderation backend instead of the provider",
+		})
+		resp.Provider = ""
+		return resp, nil
+	}
+
+	upstream, upstreamBody, err := provider.PrepareRequest(aiCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request to provider %s: %w", providerName, err)
+	}
+	resp.Request = &DryRunUpstreamRequest{
+		Method:  upstream.Method,
+		URL:     upstream.URL.String(),
+		Headers: agc.redactDryRunHeaders(upstream.Header, provider.Spec()),
+	}
+	if len(upstreamBody) > 0 {
+		var decoded any
+		if codectool.UnmarshalJSON(upstreamBody, &decoded) == nil {
+			resp.Request.Body = decoded
+		} else {
+			resp.Request.Body = string(upstreamBody)
+		}
+	}
+	return resp, nil
+}
+
+// dryRunMiddleware runs the middleware, and reports the request stopped
+// by it as rejected.
+func (agc *AIGatewayController) dryRunMiddleware(aiCtx *aicontext.Context, name string, state *MiddlewareState) *middlewares.SimulationStep {
+	rules := []string{fmt.Sprintf("middlewares[%s]", name)}
+	if state != nil && !state.Enabled {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationSkip, Rules: rules, Detail: "middleware is disabled"}
+	}
+	if aiCtx.Consumer.Skips(name) {
+		return &middlewares.SimulationStep{
+			Decision: middlewares.SimulationSkip,
+			Rules:    []string{"consumers.skippableMiddlewares"},
+			Detail:   fmt.Sprintf("middleware is skipped by consumer %q", aiCtx.Consumer.ID),
+		}
+	}
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationSkip, Detail: fmt.Sprintf("middleware %s not found", name)}
+	}
+	middleware.Handle(aiCtx)
+	if !aiCtx.IsStopped() {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationPass, Rules: rules}
+	}
+	step := &middlewares.SimulationStep{
+		Decision: middlewares.SimulationReject,
+		Rules:    rules,
+		Detail:   fmt.Sprintf("the request is stopped by %s", middleware.Kind()),
+	}
+	if r := aiCtx.GetResponse(); r != nil {
+		step.Detail += fmt.Sprintf(" with status %d", r.StatusCode)
+		if len(r.BodyBytes) > 0 {
+			step.Detail += ": " + string(r.BodyBytes)
+		}
+	}
+	return step
+}
+
+// redactDryRunHeaders replaces the values of the headers carrying the
+// credentials of the provider or the consumer with their hashes.
+func (agc *AIGatewayController) redactDryRunHeaders(header http.Header, spec *aicontext.ProviderSpec) http.Header {
+	secrets := append([]string{}, dryRunSecretHeaders...)
+	for k := range spec.Headers {
+		secrets = append(secrets, k)
+	}
+	if spec.Signing != nil && spec.Signing.Header != "" {
+		secrets = append(secrets, spec.Signing.Header)
+	}
+	if agc.consumers != nil {
+		secrets = append(secrets, agc.consumers.KeyHeader())
+	}
+	redacted := header.Clone()
+	for _, k := range secrets {
+		values := redacted[http.CanonicalHeaderKey(k)]
+		for i, v := range values {
+			values[i] = hashSecret(v)
+		}
+	}
+	return redacted
+}
+
+func newDryRunTrace(aiCtx *aicontext.Context) *DryRunTrace {
+	return &DryRunTrace{
+		Tags:                aiCtx.Ctx.Tags(),
+		Flags:               aiCtx.Flags,
+		Variables:           aiCtx.Variables(),
+		Citations:           aiCtx.Citations(),
+		ConversationRepairs: aiCtx.ConversationRepairs(),
+		PackedChunks:        aiCtx.PackedChunks(),
+		ImageOptimizations:  aiCtx.ImageOptimizations(),
+		BudgetDecisions:     aiCtx.BudgetDecisions(),
+	}
+}
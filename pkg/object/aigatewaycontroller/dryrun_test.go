@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: primary
+  providerType: openai
+  baseURL: %[1]s
+  apiKey: secret
+  headers:
+    X-Org: org-1
+- name: batch
+  providerType: openai
+  baseURL: %[1]s
+  apiKey: secret
+  synthesizeStreaming: {}
+consumerIDHeader: X-Consumer
+rateLimit:
+  requestsPerMinute: 1
+middlewares:
+- name: tier
+  kind: ExpressionHook
+  expressionHook:
+    outputs:
+    - name: tier
+      expression: 'headers["x-consumer"] == "alice" ? "gold" : "silver"'
+      header: X-Tier
+`, server.URL)
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	stepOf := func(resp *DryRunResponse, name string) *middlewares.SimulationStep {
+		for _, step := range resp.Steps {
+			if step.Step == name {
+				return step
+			}
+		}
+		return nil
+	}
+	newRequest := func(provider string) *DryRunRequest {
+		return &DryRunRequest{
+			Provider:    provider,
+			Middlewares: []string{"tier", "missing"},
+			Headers:     map[string]string{"X-Consumer": "alice"},
+			Body: map[string]any{
+				"model":    "gpt-4o",
+				"stream":   true,
+				"messages": []any{map[string]any{"role": "user", "content": "hello"}},
+			},
+		}
+	}
+
+	// the request to the provider carries the changes of the middlewares,
+	// and its credentials are redacted.
+	resp, err := controller.dryRun(newRequest("primary"), time.Now())
+	assert.Nil(err)
+	assert.Equal(SimulationProxied, resp.Outcome)
+	assert.Equal("primary", resp.Provider)
+	assert.Equal(middlewares.SimulationPass, stepOf(resp, "middleware/tier").Decision)
+	assert.Equal(middlewares.SimulationSkip, stepOf(resp, "middleware/missing").Decision)
+	assert.Equal(http.MethodPost, resp.Request.Method)
+	assert.Equal(server.URL+"/v1/chat/completions", resp.Request.URL)
+	assert.Equal(hashSecret("Bearer secret"), resp.Request.Headers.Get("Authorization"))
+	assert.Equal(hashSecret("org-1"), resp.Request.Headers.Get("X-Org"))
+	assert.Equal("gold", resp.Request.Headers.Get("X-Tier"))
+	body := resp.Request.Body.(map[string]any)
+	assert.Equal("gpt-4o", body["model"])
+	assert.Equal(true, body["stream"])
+	assert.Equal("gold", resp.Trace.Variables["tier"])
+
+	// the streaming requests are sent as non-streaming ones to the
+	// provider synthesizing streams.
+	resp, err = controller.dryRun(newRequest("batch"), time.Now())
+	assert.Nil(err)
+	assert.NotContains(resp.Request.Body, "stream")
+
+	// the dry runs are not counted by the rate limit.
+	assert.Equal("1", stepOf(resp, "rateLimit").RuntimeState["remainingRequests"])
+	assert.Zero(calls.Load())
+
+	resp, err = controller.dryRun(newRequest("missing"), time.Now())
+	assert.Nil(err)
+	assert.Equal(SimulationRejected, resp.Outcome)
+	assert.Nil(resp.Request)
+
+	assert.Error(validateDryRunRequest(&DryRunRequest{}))
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	errCodeUnsupportedEndpoint  = "unsupported_endpoint"
+	errCodeMethodNotAllowed     = "method_not_allowed"
+	errCodeUnsupportedParameter = "unsupported_parameter"
+
+	// unsupportedPathSegments is the number of path segments kept in the
+	// metric label, the rest usually contains IDs like /v1/assistants/{id}.
+	unsupportedPathSegments = 2
+)
+
+type (
+	// EndpointsSpec controls the endpoints served by AIGatewayController,
+	// the requests to other endpoints get OpenAI format errors.
+	EndpointsSpec struct {
+		// Expose lists the endpoints served, all supported endpoints are
+		// served if it is empty.
+		Expose []string `json:"expose,omitempty"`
+		// Reject lists the endpoints rejected even if they are exposed.
+		Reject []string `json:"reject,omitempty"`
+	}
+
+	// EndpointState is the state of a supported endpoint.
+	EndpointState struct {
+		Path    string `json:"path"`
+		Method  string `json:"method"`
+		Exposed bool   `json:"exposed"`
+	}
+
+	supportedEndpoint struct {
+		respType aicontext.ResponseType
+		method   string
+	}
+
+	// endpoints decides whether a request is served.
+	endpoints struct {
+		exposed map[aicontext.ResponseType]bool
+		hits    *prometheus.CounterVec
+	}
+)
+
+// supportedEndpoints are the endpoints handled by the AI context. The
+// order matters, as the request path is matched by suffix.
+var supportedEndpoints = []supportedEndpoint{
+	{aicontext.ResponseTypeChatCompletions, http.MethodPost},
+	{aicontext.ResponseTypeCompletions, http.MethodPost},
+	{aicontext.ResponseTypeModels, http.MethodGet},
+	{aicontext.ResponseTypeModerations, http.MethodPost},
+}
+
+func findSupportedEndpoint(path string) *supportedEndpoint {
+	for i := range supportedEndpoints {
+		if strings.HasSuffix(path, string(supportedEndpoints[i].respType)) {
+			return &supportedEndpoints[i]
+		}
+	}
+	return nil
+}
+
+func validateEndpointsSpec(spec *EndpointsSpec) error {
+	if spec == nil {
+		return nil
+	}
+	for _, path := range append(slices.Clone(spec.Expose), spec.Reject...) {
+		if ep := findSupportedEndpoint(path); ep == nil || string(ep.respType) != path {
+			return fmt.Errorf("endpoint %s is not supported", path)
+		}
+	}
+	return nil
+}
+
+func newEndpoints(spec *EndpointsSpec) *endpoints {
+	e := &endpoints{
+		exposed: map[aicontext.ResponseType]bool{},
+		hits:    metricshub.UnsupportedEndpointRequests.NewCounter(),
+	}
+	for _, ep := range supportedEndpoints {
+		path := string(ep.respType)
+		exposed := true
+		if spec != nil {
+			exposed = len(spec.Expose) == 0 || slices.Contains(spec.Expose, path)
+			exposed = exposed && !slices.Contains(spec.Reject, path)
+		}
+		e.exposed[ep.respType] = exposed
+	}
+	return e
+}
+
+// states returns the states of all supported endpoints.
+func (e *endpoints) states() []*EndpointState {
+	states := make([]*EndpointState, 0, len(supportedEndpoints))
+	for _, ep := range supportedEndpoints {
+		states = append(states, &EndpointState{
+			Path:    string(ep.respType),
+			Method:  ep.method,
+			Exposed: e.exposed[ep.respType],
+		})
+	}
+	return states
+}
+
+// metricPath returns the leading segments of the path.
+func metricPath(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", unsupportedPathSegments+1)
+	if len(segments) > unsupportedPathSegments {
+		segments = segments[:unsupportedPathSegments]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// check checks the request is to a served endpoint, otherwise it sets
+// an OpenAI format error response and returns false.
+func (e *endpoints) check(ctx *context.Context) bool {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	path, method := req.URL().Path, req.Method()
+
+	ep := findSupportedEndpoint(path)
+	if ep != nil && e.exposed[ep.respType] {
+		if method == ep.method {
+			return true
+		}
+		message := fmt.Sprintf("Method %s is not allowed for endpoint %s, use %s instead.", method, path, ep.method)
+		setEndpointErrResponse(ctx, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, message)
+		return false
+	}
+
+	if e.hits != nil {
+		e.hits.WithLabelValues(metricPath(path)).Inc()
+	}
+	message := fmt.Sprintf("Unsupported endpoint: %s %s is not supported by the AI gateway.", method, path)
+	setEndpointErrResponse(ctx, http.StatusNotFound, errCodeUnsupportedEndpoint, message)
+	return false
+}
+
+func setEndpointErrResponse(ctx *context.Context, statusCode int, code string, message string) {
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil {
+		resp, _ = httpprot.NewResponse(nil)
+	}
+	resp.SetStatusCode(statusCode)
+	resp.HTTPHeader().Set("Content-Type", "application/json")
+	data, _ := codectool.MarshalJSON(protocol.NewInvalidRequestError(code, message))
+	resp.SetPayload(data)
+	ctx.SetOutputResponse(resp)
+}
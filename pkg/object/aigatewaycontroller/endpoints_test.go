@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+func TestValidateEndpointsSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateEndpointsSpec(nil))
+	assert.NoError(validateEndpointsSpec(&EndpointsSpec{
+		Expose: []string{"/v1/chat/completions", "/v1/models"},
+		Reject: []string{"/v1/completions"},
+	}))
+	assert.Error(validateEndpointsSpec(&EndpointsSpec{Expose: []string{"/v1/assistants"}}))
+	assert.Error(validateEndpointsSpec(&EndpointsSpec{Reject: []string{"/openai/v1/models"}}))
+}
+
+func TestEndpointsCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	check := func(e *endpoints, method string, path string) (bool, int, *protocol.ErrorResponse) {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(method, "http://127.0.0.1:8080"+path, nil)
+		assert.Nil(err)
+		setRequest(t, ctx, "endpoints", req)
+		if e.check(ctx) {
+			return true, 0, nil
+		}
+		resp := ctx.GetResponse("endpoints").(*httpprot.Response)
+		assert.Equal("application/json", resp.HTTPHeader().Get("Content-Type"))
+		errResp := &protocol.ErrorResponse{}
+		assert.Nil(json.Unmarshal(resp.RawPayload(), errResp))
+		return false, resp.StatusCode(), errResp
+	}
+
+	all := newEndpoints(nil)
+	ok, _, _ := check(all, http.MethodPost, "/v1/chat/completions")
+	assert.True(ok)
+	ok, _, _ = check(all, http.MethodGet, "/openai/v1/models")
+	assert.True(ok)
+
+	ok, code, errResp := check(all, http.MethodPost, "/v1/assistants")
+	assert.False(ok)
+	assert.Equal(http.StatusNotFound, code)
+	assert.Equal("invalid_request_error", errResp.Error.Type)
+	assert.Equal(errCodeUnsupportedEndpoint, *errResp.Error.Code)
+	assert.Contains(errResp.Error.Message, "POST /v1/assistants")
+
+	ok, code, errResp = check(all, http.MethodGet, "/v1/chat/completions")
+	assert.False(ok)
+	assert.Equal(http.StatusMethodNotAllowed, code)
+	assert.Equal(errCodeMethodNotAllowed, *errResp.Error.Code)
+
+	limited := newEndpoints(&EndpointsSpec{
+		Expose: []string{"/v1/chat/completions", "/v1/models"},
+		Reject: []string{"/v1/models"},
+	})
+	ok, _, _ = check(limited, http.MethodPost, "/v1/chat/completions")
+	assert.True(ok)
+	for _, path := range []string{"/v1/models", "/v1/completions"} {
+		method := http.MethodPost
+		if path == "/v1/models" {
+			method = http.MethodGet
+		}
+		ok, code, errResp = check(limited, method, path)
+		assert.False(ok)
+		assert.Equal(http.StatusNotFound, code)
+		assert.Contains(errResp.Error.Message, path)
+	}
+
+	states := limited.states()
+	assert.Len(states, 4)
+	assert.Equal(&EndpointState{Path: "/v1/chat/completions", Method: http.MethodPost, Exposed: true}, states[0])
+	assert.False(states[1].Exposed)
+	assert.False(states[2].Exposed)
+	assert.Equal(&EndpointState{Path: "/v1/moderations", Method: http.MethodPost, Exposed: false}, states[3])
+
+	assert.Equal("/v1/assistants", metricPath("/v1/assistants/asst_abc/files"))
+	assert.Equal("/v1/fine_tuning", metricPath("/v1/fine_tuning"))
+	assert.Equal("/v1", metricPath("/v1"))
+}
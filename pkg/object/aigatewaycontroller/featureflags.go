@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/common"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+const (
+	// featureFlagBuckets is the number of buckets consumers are hashed
+	// into, so the rollout percentage has a precision of 0.01%.
+	featureFlagBuckets = 10000
+
+	featureFlagReasonOverride   = "override"
+	featureFlagReasonConsumer   = "consumer"
+	featureFlagReasonPercentage = "percentage"
+	featureFlagReasonDefault    = "default"
+)
+
+type (
+	// FeatureFlagsSpec defines the feature flags of the controller, they
+	// are resolved per consumer and are readable by middlewares from the
+	// AI context.
+	FeatureFlagsSpec struct {
+		// OverrideHeader is the request header to override flags for
+		// testing, in the format of "flag1=on,flag2=off". Overriding is
+		// disabled if it is empty.
+		OverrideHeader string             `json:"overrideHeader,omitempty"`
+		Flags          []*FeatureFlagSpec `json:"flags" jsonschema:"required"`
+	}
+
+	// FeatureFlagSpec is a feature flag. It is enabled for the consumers
+	// in Consumers, and a stable Percentage of the other consumers.
+	FeatureFlagSpec struct {
+		Name       string   `json:"name" jsonschema:"required"`
+		Percentage float64  `json:"percentage,omitempty"`
+		Consumers  []string `json:"consumers,omitempty"`
+	}
+
+	// FeatureFlagEvaluation is the evaluation result of a flag.
+	FeatureFlagEvaluation struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+		Reason  string `json:"reason"`
+	}
+
+	// featureFlags evaluates the feature flags of a spec.
+	featureFlags struct {
+		spec        *FeatureFlagsSpec
+		consumers   []map[string]struct{}
+		evaluations *prometheus.CounterVec
+	}
+)
+
+func validateFeatureFlagsSpec(spec *FeatureFlagsSpec, consumerIDHeader string) error {
+	if spec == nil {
+		return nil
+	}
+	if consumerIDHeader == "" {
+		return fmt.Errorf("feature flags require consumerIDHeader or consumers")
+	}
+	names := map[string]struct{}{}
+	for _, flag := range spec.Flags {
+		if common.ValidateName(flag.Name) != nil {
+			return fmt.Errorf("invalid feature flag name: %s", flag.Name)
+		}
+		if _, ok := names[flag.Name]; ok {
+			return fmt.Errorf("duplicate feature flag name: %s", flag.Name)
+		}
+		names[flag.Name] = struct{}{}
+		if flag.Percentage < 0 || flag.Percentage > 100 {
+			return fmt.Errorf("percentage of feature flag %s must be in [0, 100]", flag.Name)
+		}
+	}
+	return nil
+}
+
+func newFeatureFlags(spec *FeatureFlagsSpec) *featureFlags {
+	if spec == nil {
+		return nil
+	}
+	ff := &featureFlags{
+		spec:        spec,
+		evaluations: metricshub.FeatureFlagEvaluations.NewCounter(),
+	}
+	for _, flag := range spec.Flags {
+		consumers := map[string]struct{}{}
+		for _, consumer := range flag.Consumers {
+			consumers[consumer] = struct{}{}
+		}
+		ff.consumers = append(ff.consumers, consumers)
+	}
+	return ff
+}
+
+// parseFeatureFlagOverrides parses the overrides in the format of
+// "flag1=on,flag2=off", invalid items are ignored.
+func parseFeatureFlagOverrides(value string) map[string]bool {
+	overrides := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		name, v, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "on":
+			overrides[strings.TrimSpace(name)] = true
+		case "off":
+			overrides[strings.TrimSpace(name)] = false
+		default:
+			if enabled, err := strconv.ParseBool(v); err == nil {
+				overrides[strings.TrimSpace(name)] = enabled
+			}
+		}
+	}
+	return overrides
+}
+
+// featureFlagBucket returns the stable bucket of the consumer for the
+// flag, the flag name is hashed too, so different flags are rolled out
+// to different consumers.
+func featureFlagBucket(flag, consumer string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(flag))
+	h.Write([]byte{0})
+	h.Write([]byte(consumer))
+	return h.Sum32() % featureFlagBuckets
+}
+
+// evaluate evaluates all flags for the consumer.
+func (ff *featureFlags) evaluate(consumer string, overrides map[string]bool) []*FeatureFlagEvaluation {
+	evaluations := make([]*FeatureFlagEvaluation, 0, len(ff.spec.Flags))
+	for i, flag := range ff.spec.Flags {
+		evaluation := &FeatureFlagEvaluation{Name: flag.Name, Reason: featureFlagReasonDefault}
+		if enabled, ok := overrides[flag.Name]; ok {
+			evaluation.Enabled, evaluation.Reason = enabled, featureFlagReasonOverride
+		} else if _, ok := ff.consumers[i][consumer]; ok {
+			evaluation.Enabled, evaluation.Reason = true, featureFlagReasonConsumer
+		} else if float64(featureFlagBucket(flag.Name, consumer)) < flag.Percentage*featureFlagBuckets/100 {
+			evaluation.Enabled, evaluation.Reason = true, featureFlagReasonPercentage
+		}
+		evaluations = append(evaluations, evaluation)
+	}
+	return evaluations
+}
+
+// resolve evaluates the flags of the request, and records them in the
+// metrics. It returns nil if there is no feature flag.
+func (ff *featureFlags) resolve(aiCtx *aicontext.Context, consumerIDHeader string) map[string]bool {
+	if ff == nil || len(ff.spec.Flags) == 0 {
+		return nil
+	}
+	var overrides map[string]bool
+	if ff.spec.OverrideHeader != "" {
+		overrides = parseFeatureFlagOverrides(aiCtx.Req.HTTPHeader().Get(ff.spec.OverrideHeader))
+	}
+	flags := map[string]bool{}
+	for _, evaluation := range ff.evaluate(aiCtx.ConsumerID(consumerIDHeader), overrides) {
+		flags[evaluation.Name] = evaluation.Enabled
+		if ff.evaluations != nil {
+			ff.evaluations.With(prometheus.Labels{
+				"flag":    evaluation.Name,
+				"enabled": strconv.FormatBool(evaluation.Enabled),
+			}).Inc()
+		}
+	}
+	return flags
+}
+
+// formatFeatureFlags formats the flags as "flag1=on,flag2=off" sorted by
+// name, it is used to correlate requests in logs.
+func formatFeatureFlags(flags map[string]bool) string {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]string, 0, len(names))
+	for _, name := range names {
+		if flags[name] {
+			items = append(items, name+"=on")
+		} else {
+			items = append(items, name+"=off")
+		}
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/consumers"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &FeatureFlagsSpec{
+		OverrideHeader: "X-Feature-Flags",
+		Flags: []*FeatureFlagSpec{
+			{Name: "new-cache-key", Percentage: 10},
+			{Name: "new-guardrail", Consumers: []string{"alice"}},
+			{Name: "all", Percentage: 100},
+		},
+	}
+	assert.NoError(validateFeatureFlagsSpec(spec, "X-Consumer"))
+	assert.Error(validateFeatureFlagsSpec(spec, ""))
+	// the consumer ID header defaults to the one of the consumer keys.
+	assert.Empty((&Spec{}).consumerIDHeader())
+	assert.Equal("X-Consumer", (&Spec{ConsumerIDHeader: "X-Consumer", Consumers: &consumers.Spec{}}).consumerIDHeader())
+	assert.Equal(consumers.DefaultConsumerIDHeader, (&Spec{Consumers: &consumers.Spec{}}).consumerIDHeader())
+	assert.Error(validateFeatureFlagsSpec(&FeatureFlagsSpec{
+		Flags: []*FeatureFlagSpec{{Name: "a", Percentage: 101}},
+	}, "X-Consumer"))
+	assert.Error(validateFeatureFlagsSpec(&FeatureFlagsSpec{
+		Flags: []*FeatureFlagSpec{{Name: "a"}, {Name: "a"}},
+	}, "X-Consumer"))
+
+	ff := newFeatureFlags(spec)
+
+	// the percentage rollout is stable and close to the percentage.
+	enabled := 0
+	for i := 0; i < 10000; i++ {
+		consumer := fmt.Sprintf("consumer-%d", i)
+		evaluations := ff.evaluate(consumer, nil)
+		assert.Equal(evaluations, ff.evaluate(consumer, nil))
+		if evaluations[0].Enabled {
+			assert.Equal(featureFlagReasonPercentage, evaluations[0].Reason)
+			enabled++
+		}
+		assert.False(evaluations[1].Enabled)
+		assert.True(evaluations[2].Enabled)
+	}
+	assert.InDelta(1000, enabled, 150)
+
+	evaluations := ff.evaluate("alice", nil)
+	assert.True(evaluations[1].Enabled)
+	assert.Equal(featureFlagReasonConsumer, evaluations[1].Reason)
+
+	// overrides win.
+	evaluations = ff.evaluate("alice", parseFeatureFlagOverrides("new-guardrail=off, new-cache-key=on,invalid"))
+	assert.False(evaluations[1].Enabled)
+	assert.Equal(featureFlagReasonOverride, evaluations[1].Reason)
+	assert.True(evaluations[0].Enabled)
+	assert.Equal(featureFlagReasonOverride, evaluations[0].Reason)
+
+	req, err := httpprot.NewRequest(httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+	assert.NoError(err)
+	req.HTTPHeader().Set("X-Consumer", "alice")
+	req.HTTPHeader().Set("X-Feature-Flags", "all=false")
+	aiCtx := &aicontext.Context{Req: req}
+	flags := ff.resolve(aiCtx, "X-Consumer")
+	assert.True(flags["new-guardrail"])
+	assert.False(flags["all"])
+	assert.Equal("all=off,new-cache-key=on,new-guardrail=on", formatFeatureFlags(map[string]bool{
+		"new-guardrail": true, "all": false, "new-cache-key": true,
+	}))
+
+	// overriding is disabled without the override header.
+	spec.OverrideHeader = ""
+	flags = ff.resolve(aiCtx, "X-Consumer")
+	assert.True(flags["all"])
+
+	// the authenticated consumer takes precedence over the header.
+	aiCtx.Consumer = &aicontext.Consumer{ID: "bob"}
+	flags = ff.resolve(aiCtx, "X-Consumer")
+	assert.False(flags["new-guardrail"])
+
+	var nilFlags *featureFlags
+	assert.Nil(nilFlags.resolve(aiCtx, "X-Consumer"))
+
+	agc := &AIGatewayController{flags: ff}
+	w := httptest.NewRecorder()
+	agc.evaluateFeatureFlags(w, httptest.NewRequest(http.MethodGet, "/ai-gateway/featureflags?consumer=alice", nil))
+	resp := &FeatureFlagsResponse{}
+	assert.NoError(codectool.UnmarshalJSON(w.Body.Bytes(), resp))
+	assert.Equal("alice", resp.Consumer)
+	assert.Len(resp.Flags, 3)
+	assert.True(resp.Flags[1].Enabled)
+}
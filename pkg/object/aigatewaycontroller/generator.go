@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+var _ middlewares.Generator = (*AIGatewayController)(nil)
+
+// Generate sends the request body to the provider and returns the body of
+// its response. The request skips the middlewares, the rate limits, the
+// usage accounting and the metrics, so it never affects the clients, but
+// the output of the provider is scrubbed as the one sent to the clients.
+func (agc *AIGatewayController) Generate(ctx stdcontext.Context, providerName string, respType aicontext.ResponseType, body []byte) ([]byte, error) {
+	set := agc.acquireProviders()
+	if set == nil {
+		return nil, fmt.Errorf("AIGatewayController is closed")
+	}
+	defer set.release()
+
+	provider, ok := set.providers[providerName]
+	if !ok {
+		return nil, fmt.Errorf("provider %s not found", providerName)
+	}
+
+	stdReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost"+string(respType), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	stdReq.Header.Set("Content-Type", "application/json")
+	req, err := httpprot.NewRequest(stdReq)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.FetchPayload(0); err != nil {
+		return nil, err
+	}
+	egCtx := context.New(nil)
+	egCtx.SetRequest(context.DefaultNamespace, req)
+	egCtx.UseNamespace(context.DefaultNamespace)
+	aiCtx, err := aicontext.New(egCtx, provider.Spec())
+	if err != nil {
+		return nil, err
+	}
+	if scrubber := set.scrubbers[providerName]; scrubber != nil {
+		aiCtx.OnResponse(scrubber.Handle)
+	}
+
+	start := time.Now()
+	provider.Handle(aiCtx)
+	for _, handler := range aiCtx.ResponseHandlers() {
+		handler(aiCtx)
+	}
+	resp := aiCtx.GetResponse()
+	if resp == nil {
+		return nil, fmt.Errorf("no response found in AI context")
+	}
+	respBody := resp.BodyBytes
+	if respBody == nil && resp.BodyReader != nil {
+		respBody, err = io.ReadAll(resp.BodyReader)
+	}
+	// the callbacks of the provider release the response.
+	fc := &aicontext.FinishContext{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		RespBody:   respBody,
+		Duration:   time.Since(start).Milliseconds(),
+	}
+	for _, cb := range aiCtx.Callbacks() {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Errorf("failed to execute finish action: %v, stack trace: \n%s\n", err, debug.Stack())
+				}
+			}()
+			cb(fc)
+		}()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("provider %s responds %d: %s", providerName, resp.StatusCode, respBody)
+	}
+	return respBody, nil
+}
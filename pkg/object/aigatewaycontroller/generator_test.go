@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func TestGenerate(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(chatCompletionsHandler))
+	defer server.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	config := `
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+- name: failing
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+`
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(fmt.Sprintf(config, server.URL, failing.URL))
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	body := []byte(`{"model": "gpt-4o", "stream": false, "messages": [{"role": "user", "content": "hello"}]}`)
+	resp, err := controller.Generate(stdcontext.Background(), "openai", aicontext.ResponseTypeChatCompletions, body)
+	assert.NoError(err)
+	assert.Contains(string(resp), "Hello! How can I assist you today?")
+	// the generation is not counted in the metrics of the controller.
+	assert.Empty(controller.metricshub.GetStats())
+
+	_, err = controller.Generate(stdcontext.Background(), "failing", aicontext.ResponseTypeChatCompletions, body)
+	assert.ErrorContains(err, "503")
+	_, err = controller.Generate(stdcontext.Background(), "unknown", aicontext.ResponseTypeChatCompletions, body)
+	assert.Error(err)
+}
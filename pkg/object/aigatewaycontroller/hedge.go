@@ -0,0 +1,349 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+)
+
+const (
+	hedgeToolsExclude = "exclude"
+	hedgeToolsAllow   = "allow"
+
+	hedgeDecisionHedged   = "hedged"
+	hedgeDecisionInTime   = "inTime"
+	hedgeDecisionExcluded = "excluded"
+	hedgeDecisionNoMember = "noMember"
+
+	// hedgeRequestIDSuffix is appended to the request ID of the usage of
+	// a canceled attempt, so the usage store counts it apart from the
+	// usage of the response.
+	hedgeRequestIDSuffix = "#hedge"
+	// hedgeFirstTokenBytes is the size of the first read of a streaming
+	// response, which tells the first token arrives.
+	hedgeFirstTokenBytes = 4096
+)
+
+// ProviderGroupHedgeSpec sends a request to a second member of the group
+// if the first member has not produced the first token within Delay, and
+// the response arriving first is used. The other call is canceled, and
+// its prompt tokens are counted as wasted, see hedgeRace.
+type ProviderGroupHedgeSpec struct {
+	// Delay is the time waited for the first token of the first member,
+	// the request is sent to both members at once if it is 0.
+	Delay string `json:"delay" jsonschema:"required,format=duration"`
+	// Tools is how the requests declaring tools are handled. The tool
+	// calls of both responses may be executed by the user if they race,
+	// so the requests with tools are not hedged by default.
+	Tools string `json:"tools,omitempty" jsonschema:"enum=,enum=exclude,enum=allow"`
+	// IdempotentTools are the tools without side effects, the requests
+	// declaring only these tools are hedged even if Tools is exclude.
+	IdempotentTools []string `json:"idempotentTools,omitempty"`
+}
+
+var (
+	hedgeDecisions    = sync.OnceValue(metricshub.ProviderGroupHedges.NewCounter)
+	hedgeWinners      = sync.OnceValue(metricshub.ProviderGroupHedgeWinners.NewCounter)
+	hedgeWastedTokens = sync.OnceValue(metricshub.ProviderGroupHedgeWastedTokens.NewCounter)
+	hedgeWastedCost   = sync.OnceValue(metricshub.ProviderGroupHedgeWastedCost.NewCounter)
+)
+
+// getTools returns how the requests declaring tools are handled.
+func (h *ProviderGroupHedgeSpec) getTools() string {
+	if h.Tools == "" {
+		return hedgeToolsExclude
+	}
+	return h.Tools
+}
+
+// getDelay returns the delay of the second call, the spec is validated.
+func (h *ProviderGroupHedgeSpec) getDelay() time.Duration {
+	d, _ := time.ParseDuration(h.Delay)
+	return d
+}
+
+func validateHedge(g *ProviderGroupSpec) error {
+	h := g.Hedge
+	if len(g.Members) < 2 {
+		return fmt.Errorf("hedging requires at least 2 members")
+	}
+	d, err := time.ParseDuration(h.Delay)
+	if err != nil {
+		return fmt.Errorf("invalid hedge delay %q: %w", h.Delay, err)
+	}
+	if d < 0 {
+		return fmt.Errorf("hedge delay cannot be negative")
+	}
+	switch h.Tools {
+	case "", hedgeToolsExclude, hedgeToolsAllow:
+	default:
+		return fmt.Errorf("invalid hedge tools %q, must be exclude or allow", h.Tools)
+	}
+	return nil
+}
+
+// hedgedGroup returns the group of the name if it is hedged.
+func (agc *AIGatewayController) hedgedGroup(name string) *ProviderGroupSpec {
+	for _, g := range agc.spec.ProviderGroups {
+		if g.Name == name && g.Hedge != nil {
+			return g
+		}
+	}
+	return nil
+}
+
+// hedgeExclusion returns why the request must not be hedged, it is empty
+// if the request can be hedged. Only completions are hedged, since the
+// other endpoints are cheap or have side effects, and the streams buffered
+// for resumption keep their single call to the provider.
+func hedgeExclusion(ctx *aicontext.Context, spec *ProviderGroupHedgeSpec) string {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions && ctx.RespType != aicontext.ResponseTypeCompletions {
+		return "endpoint " + string(ctx.RespType)
+	}
+	if ctx.Detached {
+		return "resumable stream"
+	}
+	if spec.getTools() == hedgeToolsAllow {
+		return ""
+	}
+	for _, tool := range requestTools(ctx) {
+		if !slices.Contains(spec.IdempotentTools, tool) {
+			return "tool " + tool
+		}
+	}
+	return ""
+}
+
+// requestTools returns the names of the tools declared by the request, the
+// type is used as the name of the built-in tools which are not functions.
+func requestTools(ctx *aicontext.Context) []string {
+	var names []string
+	tools, _ := ctx.OpenAIReq["tools"].([]any)
+	for _, item := range tools {
+		tool, _ := item.(map[string]any)
+		function, _ := tool["function"].(map[string]any)
+		name, _ := function["name"].(string)
+		if name == "" {
+			name, _ = tool["type"].(string)
+		}
+		names = append(names, name)
+	}
+	// functions is the deprecated version of tools.
+	functions, _ := ctx.OpenAIReq["functions"].([]any)
+	for _, item := range functions {
+		function, _ := item.(map[string]any)
+		name, _ := function["name"].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+// hedgeAttempt is a call to a member of a hedged group.
+type hedgeAttempt struct {
+	index    int
+	provider providers.Provider
+	ctx      *aicontext.Context
+	cancel   stdcontext.CancelFunc
+	start    time.Time
+	done     chan struct{}
+}
+
+// run calls the provider, it returns after the first token of a
+// streaming response is read, or a response is received otherwise.
+func (a *hedgeAttempt) run() {
+	defer close(a.done)
+	a.provider.Handle(a.ctx)
+	if !a.ctx.IsStopped() && a.ctx.ReqInfo.Stream {
+		readFirstToken(a.ctx.GetResponse())
+	}
+}
+
+// readFirstToken reads the first bytes of the body of the response, and
+// puts them back to the body.
+func readFirstToken(resp *aicontext.Response) {
+	if resp == nil || resp.BodyReader == nil {
+		return
+	}
+	buf := make([]byte, hedgeFirstTokenBytes)
+	n, err := 0, error(nil)
+	for n == 0 && err == nil {
+		n, err = resp.BodyReader.Read(buf)
+	}
+	resp.BodyReader = io.MultiReader(bytes.NewReader(buf[:n]), resp.BodyReader)
+}
+
+// discard cancels the call, and releases its response once it returns.
+func (a *hedgeAttempt) discard() {
+	a.cancel()
+	go func() {
+		<-a.done
+		fc := &aicontext.FinishContext{}
+		for _, cb := range a.ctx.Callbacks() {
+			cb(fc)
+		}
+	}()
+}
+
+// handleHedged calls the first member of the hedged group, and the second
+// one picked by weight if the request can be hedged, see hedgeRace. It
+// returns the provider serving the response and the start of its call.
+func (agc *AIGatewayController) handleHedged(aiCtx *aicontext.Context, set *providerSet, g *ProviderGroupSpec, provider providers.Provider) (providers.Provider, time.Time) {
+	start := time.Now()
+	if reason := hedgeExclusion(aiCtx, g.Hedge); reason != "" {
+		hedgeDecisions().WithLabelValues(g.Name, hedgeDecisionExcluded).Inc()
+		aiCtx.Ctx.AddTag(fmt.Sprintf("providerGroup: %s, hedging excluded by %s", g.Name, reason))
+		provider.Handle(aiCtx)
+		return provider, start
+	}
+	// the second member is kept in the region of the consumer.
+	second := agc.pickGroupMember(g, func(name string) bool {
+		return name != provider.Name() && aiCtx.Resident(set.region(name))
+	})
+	if second == "" {
+		hedgeDecisions().WithLabelValues(g.Name, hedgeDecisionNoMember).Inc()
+		provider.Handle(aiCtx)
+		return provider, start
+	}
+	return agc.hedgeRace(aiCtx, g, provider, set.providers[second])
+}
+
+// hedgeRace calls the first provider, and the second one as well if the
+// first one has not produced the first token within the delay. The first
+// successful response wins, and the other call is canceled. The response
+// of the first provider is used if both fail. The estimated prompt tokens
+// of the canceled call are counted as wasted, and in the usage of its
+// provider.
+func (agc *AIGatewayController) hedgeRace(aiCtx *aicontext.Context, g *ProviderGroupSpec, first, second providers.Provider) (providers.Provider, time.Time) {
+	base := aiCtx.RequestContext()
+	finished := make(chan *hedgeAttempt, 2)
+	var attempts []*hedgeAttempt
+	launch := func(p providers.Provider) {
+		reqCtx, cancel := stdcontext.WithCancel(base)
+		a := &hedgeAttempt{
+			index:    len(attempts),
+			provider: p,
+			ctx:      aiCtx.Fork(reqCtx, p.Spec()),
+			cancel:   cancel,
+			start:    time.Now(),
+			done:     make(chan struct{}),
+		}
+		attempts = append(attempts, a)
+		go func() {
+			a.run()
+			finished <- a
+		}()
+	}
+
+	launch(first)
+	var delay <-chan time.Time
+	if d := g.Hedge.getDelay(); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		delay = timer.C
+	} else {
+		launch(second)
+	}
+
+	var winner *hedgeAttempt
+	done := map[*hedgeAttempt]bool{}
+	for winner == nil && len(done) < len(attempts) {
+		select {
+		case <-delay:
+			delay = nil
+			launch(second)
+		case a := <-finished:
+			done[a] = true
+			if !a.ctx.IsStopped() {
+				winner = a
+			}
+		}
+	}
+	if winner == nil {
+		winner = attempts[0]
+	}
+
+	if len(attempts) == 1 {
+		hedgeDecisions().WithLabelValues(g.Name, hedgeDecisionInTime).Inc()
+	} else {
+		hedgeDecisions().WithLabelValues(g.Name, hedgeDecisionHedged).Inc()
+		attempt := "first"
+		if winner.index > 0 {
+			attempt = "second"
+		}
+		hedgeWinners().WithLabelValues(g.Name, winner.provider.Name(), attempt).Inc()
+		aiCtx.Ctx.AddTag(fmt.Sprintf("providerGroup: %s, hedged to provider: %s, winner: %s", g.Name, second.Name(), winner.provider.Name()))
+	}
+	for _, a := range attempts {
+		if a == winner {
+			continue
+		}
+		// a failed call is not charged by the provider.
+		if !done[a] || !a.ctx.IsStopped() {
+			agc.recordHedgeWaste(aiCtx, g, a)
+		}
+		a.discard()
+	}
+
+	aiCtx.Join(winner.ctx)
+	// the request to the winner lasts until the response is sent.
+	aiCtx.AddCallBack(func(*aicontext.FinishContext) {
+		winner.cancel()
+	})
+	return winner.provider, winner.start
+}
+
+// recordHedgeWaste counts the estimated prompt tokens of the canceled call
+// as wasted, and adds them to the usage of its provider with the suffixed
+// request ID.
+func (agc *AIGatewayController) recordHedgeWaste(aiCtx *aicontext.Context, g *ProviderGroupSpec, a *hedgeAttempt) {
+	spec := a.provider.Spec()
+	tokens := int64(len(aiCtx.ReqBody) / simulatedCharsPerToken)
+	hedgeWastedTokens().WithLabelValues(g.Name, spec.Name).Add(float64(tokens))
+	if agc.usageStore == nil {
+		return
+	}
+	if price := agc.usageStore.Price(spec.Name, aiCtx.ReqInfo.Model); price != nil {
+		hedgeWastedCost().WithLabelValues(g.Name, spec.Name).Add(float64(tokens) * price.InputPerMillion / 1e6)
+	}
+
+	header := aiCtx.Req.HTTPHeader()
+	requestID := header.Get("X-Request-Id")
+	if requestID != "" {
+		requestID += hedgeRequestIDSuffix
+	}
+	consumer := aiCtx.ConsumerID(agc.spec.consumerIDHeader())
+	agc.usageStore.Update(requestID, consumer, &metricshub.Metric{
+		Provider:     spec.Name,
+		ProviderType: spec.ProviderType,
+		Model:        aiCtx.ReqInfo.Model,
+		BaseURL:      spec.BaseURL,
+		ResponseType: string(aiCtx.RespType),
+		Success:      true,
+		InputTokens:  tokens,
+	}, time.Now())
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func TestValidateHedge(t *testing.T) {
+	assert := assert.New(t)
+	providers := []*aicontext.ProviderSpec{{Name: "a"}, {Name: "b"}}
+	members := []*ProviderGroupMemberSpec{{Provider: "a"}, {Provider: "b"}}
+
+	for _, c := range []struct {
+		members []*ProviderGroupMemberSpec
+		hedge   *ProviderGroupHedgeSpec
+		err     bool
+	}{
+		{members, &ProviderGroupHedgeSpec{Delay: "200ms"}, false},
+		{members, &ProviderGroupHedgeSpec{Delay: "0s", Tools: hedgeToolsAllow}, false},
+		{members[:1], &ProviderGroupHedgeSpec{Delay: "200ms"}, true},
+		{members, &ProviderGroupHedgeSpec{}, true},
+		{members, &ProviderGroupHedgeSpec{Delay: "-1s"}, true},
+		{members, &ProviderGroupHedgeSpec{Delay: "1s", Tools: "retry"}, true},
+	} {
+		groups := []*ProviderGroupSpec{{Name: "chat", Members: c.members, Hedge: c.hedge}}
+		err := validateProviderGroups(groups, providers)
+		assert.Equal(c.err, err != nil, "%+v: %v", c.hedge, err)
+	}
+}
+
+func TestHedgeExclusion(t *testing.T) {
+	assert := assert.New(t)
+	newCtx := func(body map[string]any) *aicontext.Context {
+		return &aicontext.Context{RespType: aicontext.ResponseTypeChatCompletions, OpenAIReq: body}
+	}
+	search := map[string]any{"type": "function", "function": map[string]any{"name": "search"}}
+	send := map[string]any{"type": "function", "function": map[string]any{"name": "send_email"}}
+	spec := &ProviderGroupHedgeSpec{Delay: "1s", IdempotentTools: []string{"search"}}
+
+	assert.Empty(hedgeExclusion(newCtx(map[string]any{}), spec))
+	assert.Empty(hedgeExclusion(newCtx(map[string]any{"tools": []any{search}}), spec))
+	assert.Equal("tool send_email", hedgeExclusion(newCtx(map[string]any{"tools": []any{search, send}}), spec))
+	assert.Equal("tool web_search", hedgeExclusion(newCtx(map[string]any{"tools": []any{map[string]any{"type": "web_search"}}}), spec))
+	assert.Equal("tool lookup", hedgeExclusion(newCtx(map[string]any{"functions": []any{map[string]any{"name": "lookup"}}}), spec))
+
+	spec.Tools = hedgeToolsAllow
+	assert.Empty(hedgeExclusion(newCtx(map[string]any{"tools": []any{send}}), spec))
+
+	ctx := newCtx(map[string]any{})
+	ctx.RespType = aicontext.ResponseTypeEmbeddings
+	assert.Equal("endpoint /v1/embeddings", hedgeExclusion(ctx, spec))
+	ctx = newCtx(map[string]any{})
+	ctx.Detached = true
+	assert.Equal("resumable stream", hedgeExclusion(ctx, spec))
+}
+
+func TestHedgedProviderGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	// the slow provider holds the requests until they are canceled, the
+	// body is read, so the server watches the connection.
+	var slowHits, slowCanceled, fastHits atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		select {
+		case <-r.Context().Done():
+			slowCanceled.Add(1)
+		case <-time.After(5 * time.Second):
+			rateLimitedHandler(w, r)
+		}
+	}))
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHits.Add(1)
+		rateLimitedHandler(w, r)
+	}))
+	defer slow.Close()
+	defer fast.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: slow
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+- name: fast
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+providerGroups:
+- name: chat
+  members:
+  - provider: slow
+  - provider: fast
+  hedge:
+    delay: 50ms
+latencySLO:
+  ttft: 10s
+`, slow.URL, fast.URL)
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+	// the slow provider is always called first.
+	controller.latencySLO.setPin("fast", 0, "test")
+
+	send := func(body string) *httpprot.Response {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+		assert.Nil(err)
+		setRequest(t, ctx, "hedge", req)
+		start := time.Now()
+		controller.Handle(ctx, "chat", nil)
+		resp := ctx.GetResponse("hedge").(*httpprot.Response)
+		_, err = io.ReadAll(resp.GetPayload())
+		assert.Nil(err)
+		assert.Less(time.Since(start), 2*time.Second)
+		ctx.Finish()
+		return resp
+	}
+
+	wasted := testutil.ToFloat64(hedgeWastedTokens().WithLabelValues("chat", "slow"))
+	for _, body := range []string{`{"model": "gpt"}`, `{"model": "gpt", "stream": true}`} {
+		resp := send(body)
+		assert.Equal(http.StatusOK, resp.StatusCode())
+	}
+	assert.Equal(int64(2), slowHits.Load())
+	assert.Equal(int64(2), fastHits.Load())
+	assert.Eventually(func() bool { return slowCanceled.Load() == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(2.0, testutil.ToFloat64(hedgeWinners().WithLabelValues("chat", "fast", "second")))
+	assert.Greater(testutil.ToFloat64(hedgeWastedTokens().WithLabelValues("chat", "slow")), wasted)
+
+	// the requests with tools having side effects are not hedged.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx := context.New(nil)
+		body := `{"model": "gpt", "tools": [{"type": "function", "function": {"name": "send_email"}}]}`
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+		assert.Nil(err)
+		setRequest(t, ctx, "hedge", req)
+		controller.Handle(ctx, "chat", nil)
+		ctx.Finish()
+	}()
+	assert.Eventually(func() bool { return slowHits.Load() == 3 }, time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(int64(2), fastHits.Load())
+	slow.CloseClientConnections()
+	<-done
+}
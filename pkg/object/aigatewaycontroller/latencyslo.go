@@ -0,0 +1,451 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+)
+
+const (
+	defaultSLOTTFT            = 1500 * time.Millisecond
+	defaultSLOWindow          = time.Minute
+	defaultSLOPercentile      = 95
+	defaultSLOMinSamples      = 20
+	defaultSLOBreachWindows   = 3
+	defaultSLORecoveryWindows = 3
+	defaultSLORecoveryRatio   = 0.8
+	defaultSLODemotionFactor  = 0.5
+	defaultSLOMinWeightFactor = 0.1
+
+	// maxSLOSamples bounds the samples of a provider in a window.
+	maxSLOSamples = 10000
+)
+
+type (
+	// LatencySLOSpec tracks the time to first token (TTFT) of providers in
+	// windows, and demotes the providers breaching their targets in the
+	// provider groups. A provider is demoted by multiplying its weight
+	// factor by DemotionFactor when the TTFT percentile exceeds its target
+	// in BreachWindows consecutive windows, down to MinWeightFactor, and
+	// promoted back step by step when the percentile stays below the
+	// target times RecoveryRatio in RecoveryWindows consecutive windows.
+	LatencySLOSpec struct {
+		// TTFT is the default target of providers, default 1.5s.
+		TTFT    string                  `json:"ttft,omitempty" jsonschema:"format=duration"`
+		Targets []*LatencySLOTargetSpec `json:"targets,omitempty"`
+		// Percentile of the TTFT compared with the target, default 95.
+		Percentile float64 `json:"percentile,omitempty"`
+		Window     string  `json:"window,omitempty" jsonschema:"format=duration"`
+		// MinSamples is the number of samples a window needs to be
+		// evaluated, the windows with fewer samples are ignored.
+		MinSamples      int     `json:"minSamples,omitempty"`
+		BreachWindows   int     `json:"breachWindows,omitempty"`
+		RecoveryWindows int     `json:"recoveryWindows,omitempty"`
+		RecoveryRatio   float64 `json:"recoveryRatio,omitempty"`
+		DemotionFactor  float64 `json:"demotionFactor,omitempty"`
+		MinWeightFactor float64 `json:"minWeightFactor,omitempty"`
+	}
+
+	// LatencySLOTargetSpec is the TTFT target of a provider.
+	LatencySLOTargetSpec struct {
+		Provider string `json:"provider" jsonschema:"required"`
+		TTFT     string `json:"ttft" jsonschema:"required,format=duration"`
+	}
+
+	// ProviderSLOStatus is the latency SLO state of a provider.
+	ProviderSLOStatus struct {
+		Provider string `json:"provider"`
+		Target   string `json:"target"`
+		// Percentile is the TTFT percentile of the last evaluated window.
+		Percentile   string  `json:"percentile,omitempty"`
+		Samples      int     `json:"samples"`
+		WeightFactor float64 `json:"weightFactor"`
+		Demoted      bool    `json:"demoted"`
+		DemotedAt    string  `json:"demotedAt,omitempty"`
+		// BreachWindows and RecoveryWindows are the consecutive windows
+		// breaching the target and recovering from it.
+		BreachWindows   int    `json:"breachWindows"`
+		RecoveryWindows int    `json:"recoveryWindows"`
+		Pinned          bool   `json:"pinned"`
+		PinnedBy        string `json:"pinnedBy,omitempty"`
+		PinnedAt        string `json:"pinnedAt,omitempty"`
+	}
+
+	// latencySLO tracks the TTFT of providers, the state is kept across
+	// generations and in the memory of each member.
+	latencySLO struct {
+		lock      sync.Mutex
+		spec      *LatencySLOSpec
+		now       func() time.Time
+		providers map[string]*providerSLO
+	}
+
+	providerSLO struct {
+		windowStart time.Time
+		samples     []time.Duration
+		percentile  time.Duration
+		breaches    int
+		recoveries  int
+		factor      float64
+		demotedAt   time.Time
+
+		// pin overrides the factor set by the automation.
+		pin      *float64
+		pinnedBy string
+		pinnedAt time.Time
+	}
+
+	// firstTokenReader calls onFirst when the first bytes of the response
+	// body are read.
+	firstTokenReader struct {
+		io.Reader
+		once    sync.Once
+		onFirst func()
+	}
+)
+
+// ErrLatencySLODisabled means the latency SLO is not configured.
+var ErrLatencySLODisabled = errors.New("latency SLO is not configured")
+
+func validateLatencySLOSpec(spec *LatencySLOSpec, providers []*aicontext.ProviderSpec) error {
+	if spec == nil {
+		return nil
+	}
+	for _, d := range []string{spec.TTFT, spec.Window} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+			return fmt.Errorf("invalid duration %s", d)
+		}
+	}
+	for _, t := range spec.Targets {
+		if !slices.ContainsFunc(providers, func(p *aicontext.ProviderSpec) bool { return p.Name == t.Provider }) {
+			return fmt.Errorf("provider %s of target not found", t.Provider)
+		}
+		if v, err := time.ParseDuration(t.TTFT); err != nil || v <= 0 {
+			return fmt.Errorf("invalid ttft %s of provider %s", t.TTFT, t.Provider)
+		}
+	}
+	if spec.Percentile < 0 || spec.Percentile > 100 {
+		return fmt.Errorf("percentile must be in (0, 100]")
+	}
+	if spec.MinSamples < 0 || spec.BreachWindows < 0 || spec.RecoveryWindows < 0 {
+		return fmt.Errorf("minSamples, breachWindows and recoveryWindows cannot be negative")
+	}
+	if spec.RecoveryRatio < 0 || spec.RecoveryRatio > 1 {
+		return fmt.Errorf("recoveryRatio must be in (0, 1]")
+	}
+	if spec.DemotionFactor < 0 || spec.DemotionFactor >= 1 {
+		return fmt.Errorf("demotionFactor must be in (0, 1)")
+	}
+	if spec.MinWeightFactor < 0 || spec.MinWeightFactor > 1 {
+		return fmt.Errorf("minWeightFactor must be in [0, 1]")
+	}
+	return nil
+}
+
+func parseDurationOr(s string, d time.Duration) time.Duration {
+	if v, err := time.ParseDuration(s); err == nil {
+		return v
+	}
+	return d
+}
+
+func positiveOr[T int | float64](v, d T) T {
+	if v > 0 {
+		return v
+	}
+	return d
+}
+
+// target returns the TTFT target of the provider.
+func (spec *LatencySLOSpec) target(provider string) time.Duration {
+	for _, t := range spec.Targets {
+		if t.Provider == provider {
+			return parseDurationOr(t.TTFT, defaultSLOTTFT)
+		}
+	}
+	return parseDurationOr(spec.TTFT, defaultSLOTTFT)
+}
+
+func newLatencySLO(spec *LatencySLOSpec) *latencySLO {
+	return &latencySLO{
+		spec:      spec,
+		now:       time.Now,
+		providers: map[string]*providerSLO{},
+	}
+}
+
+func (l *latencySLO) setSpec(spec *LatencySLOSpec) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.spec = spec
+}
+
+// getProvider returns the state of the provider, it must be called with
+// the lock held.
+func (l *latencySLO) getProvider(name string) *providerSLO {
+	p := l.providers[name]
+	if p == nil {
+		p = &providerSLO{windowStart: l.now(), factor: 1}
+		l.providers[name] = p
+	}
+	return p
+}
+
+// observe records the TTFT of a request to the provider, the window of
+// the provider is evaluated when it ends.
+func (l *latencySLO) observe(provider string, ttft time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	p := l.getProvider(provider)
+	now := l.now()
+	if now.Sub(p.windowStart) >= parseDurationOr(l.spec.Window, defaultSLOWindow) {
+		l.evaluate(provider, p)
+		p.samples = p.samples[:0]
+		p.windowStart = now
+	}
+	if len(p.samples) < maxSLOSamples {
+		p.samples = append(p.samples, ttft)
+	}
+}
+
+// evaluate updates the streaks and the weight factor of the provider by
+// the samples of the ended window, it must be called with the lock held.
+func (l *latencySLO) evaluate(name string, p *providerSLO) {
+	spec := l.spec
+	if len(p.samples) < positiveOr(spec.MinSamples, defaultSLOMinSamples) {
+		return
+	}
+	sort.Slice(p.samples, func(i, j int) bool { return p.samples[i] < p.samples[j] })
+	percentile := positiveOr(spec.Percentile, defaultSLOPercentile)
+	index := int(math.Ceil(percentile/100*float64(len(p.samples)))) - 1
+	p.percentile = p.samples[max(index, 0)]
+
+	target := spec.target(name)
+	recovery := time.Duration(float64(target) * positiveOr(spec.RecoveryRatio, defaultSLORecoveryRatio))
+	switch {
+	case p.percentile > target:
+		p.breaches++
+		p.recoveries = 0
+	case p.percentile <= recovery:
+		p.recoveries++
+		p.breaches = 0
+	default:
+		// between the recovery threshold and the target, the provider
+		// neither breaches nor recovers.
+		p.breaches = 0
+		p.recoveries = 0
+	}
+
+	demotion := positiveOr(spec.DemotionFactor, defaultSLODemotionFactor)
+	floor := positiveOr(spec.MinWeightFactor, defaultSLOMinWeightFactor)
+	if p.breaches >= positiveOr(spec.BreachWindows, defaultSLOBreachWindows) && p.factor > floor {
+		if p.factor == 1 {
+			p.demotedAt = l.now()
+		}
+		p.factor = max(p.factor*demotion, floor)
+		p.breaches = 0
+		logger.Warnf("provider %s demoted to weight factor %.3f: p%g TTFT %s exceeds SLO %s",
+			name, p.factor, percentile, p.percentile, target)
+	}
+	if p.recoveries >= positiveOr(spec.RecoveryWindows, defaultSLORecoveryWindows) && p.factor < 1 {
+		p.factor = min(p.factor/demotion, 1)
+		p.recoveries = 0
+		if p.factor == 1 {
+			p.demotedAt = time.Time{}
+			logger.Infof("provider %s recovered: p%g TTFT %s meets SLO %s", name, percentile, p.percentile, target)
+		} else {
+			logger.Infof("provider %s promoted to weight factor %.3f: p%g TTFT %s meets SLO %s",
+				name, p.factor, percentile, p.percentile, target)
+		}
+	}
+}
+
+// weightFactor returns the factor of the weight of the provider in the
+// provider groups, the pin of the provider overrides the automation.
+func (l *latencySLO) weightFactor(provider string) float64 {
+	if l == nil {
+		return 1
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	p := l.providers[provider]
+	if p == nil {
+		return 1
+	}
+	if p.pin != nil {
+		return *p.pin
+	}
+	return p.factor
+}
+
+// setPin pins the weight factor of the provider, the automation keeps
+// tracking the provider, but its factor does not apply until unpinned.
+func (l *latencySLO) setPin(provider string, factor float64, operator string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	p := l.getProvider(provider)
+	p.pin = &factor
+	p.pinnedBy = operator
+	p.pinnedAt = l.now()
+	logger.Infof("provider %s pinned to weight factor %.3f by %s", provider, factor, operator)
+}
+
+// unpin removes the pin of the provider, it returns false if the provider
+// is not pinned.
+func (l *latencySLO) unpin(provider, operator string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	p := l.providers[provider]
+	if p == nil || p.pin == nil {
+		return false
+	}
+	p.pin = nil
+	p.pinnedBy = ""
+	p.pinnedAt = time.Time{}
+	logger.Infof("provider %s unpinned by %s, weight factor %.3f applies", provider, operator, p.factor)
+	return true
+}
+
+// statuses returns the states of the tracked providers sorted by name.
+func (l *latencySLO) statuses() []*ProviderSLOStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	statuses := make([]*ProviderSLOStatus, 0, len(l.providers))
+	for name, p := range l.providers {
+		s := &ProviderSLOStatus{
+			Provider:        name,
+			Target:          l.spec.target(name).String(),
+			Samples:         len(p.samples),
+			WeightFactor:    p.factor,
+			Demoted:         p.factor < 1,
+			BreachWindows:   p.breaches,
+			RecoveryWindows: p.recoveries,
+			Pinned:          p.pin != nil,
+			PinnedBy:        p.pinnedBy,
+		}
+		if p.percentile > 0 {
+			s.Percentile = p.percentile.String()
+		}
+		if !p.demotedAt.IsZero() {
+			s.DemotedAt = p.demotedAt.Format(time.RFC3339)
+		}
+		if p.pin != nil {
+			s.WeightFactor = *p.pin
+			s.PinnedAt = p.pinnedAt.Format(time.RFC3339)
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Provider < statuses[j].Provider })
+	return statuses
+}
+
+// demotions returns the states of the providers demoted or pinned.
+func (l *latencySLO) demotions() []*ProviderSLOStatus {
+	if l == nil {
+		return nil
+	}
+	var demotions []*ProviderSLOStatus
+	for _, s := range l.statuses() {
+		if s.Demoted || s.Pinned {
+			demotions = append(demotions, s)
+		}
+	}
+	return demotions
+}
+
+func (r *firstTokenReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.once.Do(r.onFirst)
+	}
+	return n, err
+}
+
+// Close closes the underlying reader if it is a closer.
+func (r *firstTokenReader) Close() error {
+	if closer, ok := r.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// firstTokenSeconds is the histogram of the TTFT of providers.
+var firstTokenSeconds = sync.OnceValue(metricshub.ProviderFirstTokenSeconds.NewHistogram)
+
+// trackFirstToken records the TTFT of the successful response of the
+// provider. The TTFT of a streaming response is when its first bytes are
+// read, and the one of other responses is when they are received. The
+// TTFT of a synthetic stream is the latency of the whole response, so it
+// is labeled apart and never observed by the latency SLO.
+func (agc *AIGatewayController) trackFirstToken(aiCtx *aicontext.Context, start time.Time) {
+	resp := aiCtx.GetResponse()
+	if resp == nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return
+	}
+	slo := agc.latencySLO
+	provider := aiCtx.Provider.Name
+	synthetic := resp.Header.Get(providers.SyntheticStreamHeader) != ""
+	observe := func() {
+		ttft := time.Since(start)
+		firstTokenSeconds().WithLabelValues(provider, strconv.FormatBool(synthetic)).Observe(ttft.Seconds())
+		if slo != nil && !synthetic {
+			slo.observe(provider, ttft)
+		}
+	}
+	if resp.BodyReader == nil {
+		observe()
+		return
+	}
+	resp.BodyReader = &firstTokenReader{Reader: resp.BodyReader, onFirst: observe}
+}
+
+// reloadLatencySLO reuses the latency SLO of the previous generation, so
+// the demotions and pins are kept.
+func (agc *AIGatewayController) reloadLatencySLO(prev *AIGatewayController) string {
+	if agc.spec.LatencySLO == nil {
+		if prev != nil && prev.latencySLO != nil {
+			return componentClosed
+		}
+		return ""
+	}
+	if prev != nil && prev.latencySLO != nil {
+		prev.latencySLO.setSpec(agc.spec.LatencySLO)
+		agc.latencySLO = prev.latencySLO
+		return componentKept
+	}
+	agc.latencySLO = newLatencySLO(agc.spec.LatencySLO)
+	return componentCreated
+}
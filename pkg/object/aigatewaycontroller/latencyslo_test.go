@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func TestValidateLatencySLO(t *testing.T) {
+	assert := assert.New(t)
+
+	providers := []*aicontext.ProviderSpec{{Name: "openai"}, {Name: "deepseek"}}
+	assert.NoError(validateLatencySLOSpec(nil, providers))
+	assert.NoError(validateLatencySLOSpec(&LatencySLOSpec{
+		TTFT:    "1s",
+		Targets: []*LatencySLOTargetSpec{{Provider: "openai", TTFT: "2s"}},
+	}, providers))
+	assert.Error(validateLatencySLOSpec(&LatencySLOSpec{TTFT: "soon"}, providers))
+	assert.Error(validateLatencySLOSpec(&LatencySLOSpec{Targets: []*LatencySLOTargetSpec{{Provider: "mistral", TTFT: "1s"}}}, providers))
+	assert.Error(validateLatencySLOSpec(&LatencySLOSpec{Percentile: 101}, providers))
+	assert.Error(validateLatencySLOSpec(&LatencySLOSpec{DemotionFactor: 1}, providers))
+	assert.Error(validateLatencySLOSpec(&LatencySLOSpec{RecoveryRatio: 1.5}, providers))
+
+	assert.NoError(validateProviderGroups([]*ProviderGroupSpec{
+		{Name: "chat", Members: []*ProviderGroupMemberSpec{{Provider: "openai", Weight: 3}, {Provider: "deepseek"}}},
+	}, providers))
+	assert.Error(validateProviderGroups([]*ProviderGroupSpec{{Name: "openai", Members: []*ProviderGroupMemberSpec{{Provider: "deepseek"}}}}, providers))
+	assert.Error(validateProviderGroups([]*ProviderGroupSpec{{Name: "chat"}}, providers))
+	assert.Error(validateProviderGroups([]*ProviderGroupSpec{{Name: "chat", Members: []*ProviderGroupMemberSpec{{Provider: "mistral"}}}}, providers))
+	assert.Error(validateProviderGroups([]*ProviderGroupSpec{{Name: "chat", Members: []*ProviderGroupMemberSpec{{Provider: "openai", Weight: -1}}}}, providers))
+}
+
+func TestLatencySLODemotion(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	slo := newLatencySLO(&LatencySLOSpec{
+		TTFT:            "1s",
+		MinSamples:      4,
+		BreachWindows:   2,
+		RecoveryWindows: 2,
+		MinWeightFactor: 0.2,
+	})
+	slo.now = func() time.Time { return now }
+
+	// window feeds a window of samples, the previous window is evaluated
+	// by the first sample.
+	window := func(ttft time.Duration, n int) {
+		now = now.Add(time.Minute)
+		for i := 0; i < n; i++ {
+			slo.observe("openai", ttft)
+		}
+	}
+
+	window(2*time.Second, 4)
+	window(2*time.Second, 4)
+	assert.Equal(1.0, slo.weightFactor("openai"))
+	// the second breaching window is evaluated.
+	window(2*time.Second, 4)
+	assert.Equal(0.5, slo.weightFactor("openai"))
+	window(2*time.Second, 4)
+	window(2*time.Second, 4)
+	assert.Equal(0.25, slo.weightFactor("openai"))
+	window(2*time.Second, 4)
+	window(2*time.Second, 4)
+	assert.Equal(0.2, slo.weightFactor("openai"), "the factor stops at the floor")
+
+	// windows with too few samples are ignored.
+	window(100*time.Millisecond, 1)
+	window(100*time.Millisecond, 1)
+	window(100*time.Millisecond, 1)
+	assert.Equal(0.2, slo.weightFactor("openai"))
+
+	// windows between the recovery threshold and the target reset the
+	// streaks.
+	window(100*time.Millisecond, 4)
+	window(900*time.Millisecond, 4)
+	window(100*time.Millisecond, 4)
+	window(100*time.Millisecond, 4)
+	assert.Equal(0.2, slo.weightFactor("openai"))
+	window(100*time.Millisecond, 4)
+	assert.Equal(0.4, slo.weightFactor("openai"))
+
+	status := slo.demotions()
+	assert.Len(status, 1)
+	assert.True(status[0].Demoted)
+	assert.Equal("100ms", status[0].Percentile)
+	assert.NotEmpty(status[0].DemotedAt)
+
+	window(100*time.Millisecond, 4)
+	window(100*time.Millisecond, 4)
+	assert.Equal(0.8, slo.weightFactor("openai"))
+	window(100*time.Millisecond, 4)
+	window(100*time.Millisecond, 4)
+	assert.Equal(1.0, slo.weightFactor("openai"))
+	assert.Empty(slo.demotions())
+
+	// pins override the automation.
+	slo.setPin("openai", 0, "admin")
+	assert.Equal(0.0, slo.weightFactor("openai"))
+	assert.Len(slo.demotions(), 1)
+	assert.True(slo.unpin("openai", "admin"))
+	assert.False(slo.unpin("openai", "admin"))
+	assert.Equal(1.0, slo.weightFactor("openai"))
+}
+
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestFirstTokenReader(t *testing.T) {
+	assert := assert.New(t)
+
+	body := &closeCounter{Reader: strings.NewReader("data: {}")}
+	calls := 0
+	reader := &firstTokenReader{Reader: body, onFirst: func() { calls++ }}
+	data, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal("data: {}", string(data))
+	assert.Equal(1, calls)
+	assert.NoError(reader.Close())
+	assert.Equal(1, body.closed)
+}
+
+func TestTrackFirstTokenSynthetic(t *testing.T) {
+	assert := assert.New(t)
+	agc := &AIGatewayController{latencySLO: newLatencySLO(&LatencySLOSpec{TTFT: "1s"})}
+	track := func(header http.Header) {
+		aiCtx := &aicontext.Context{Provider: &aicontext.ProviderSpec{Name: "openai"}}
+		aiCtx.SetResponse(&aicontext.Response{StatusCode: http.StatusOK, Header: header, BodyReader: strings.NewReader("data: [DONE]\n\n")})
+		agc.trackFirstToken(aiCtx, time.Now())
+		_, err := io.ReadAll(aiCtx.GetResponse().BodyReader)
+		assert.NoError(err)
+	}
+
+	// synthetic streams are not observed by the latency SLO.
+	track(http.Header{providers.SyntheticStreamHeader: []string{"true"}})
+	assert.Nil(agc.latencySLO.providers["openai"])
+	track(http.Header{})
+	assert.Len(agc.latencySLO.providers["openai"].samples, 1)
+}
+
+func TestProviderGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	var openaiHits, deepseekHits atomic.Int64
+	counting := func(hits *atomic.Int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			rateLimitedHandler(w, r)
+		}))
+	}
+	openai, deepseek := counting(&openaiHits), counting(&deepseekHits)
+	defer openai.Close()
+	defer deepseek.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+- name: deepseek
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+providerGroups:
+- name: chat
+  members:
+  - provider: openai
+  - provider: deepseek
+latencySLO:
+  ttft: 1s
+`, openai.URL, deepseek.URL)
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			ctx := context.New(nil)
+			req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt"}`)))
+			assert.Nil(err)
+			setRequest(t, ctx, "group", req)
+			controller.Handle(ctx, "chat", nil)
+			resp := ctx.GetResponse("group").(*httpprot.Response)
+			assert.Equal(http.StatusOK, resp.StatusCode())
+			_, err = io.ReadAll(resp.GetPayload())
+			assert.Nil(err)
+			ctx.Finish()
+		}
+	}
+	pin := func(method, name, body string) int {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", name)
+		r := httptest.NewRequest(method, "/providers/"+name+"/pin", strings.NewReader(body))
+		r = r.WithContext(stdcontext.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		if method == http.MethodDelete {
+			controller.unpinProvider(w, r)
+		} else {
+			controller.pinProvider(w, r)
+		}
+		return w.Code
+	}
+
+	send(40)
+	assert.Greater(openaiHits.Load(), int64(0))
+	assert.Greater(deepseekHits.Load(), int64(0))
+	statuses := controller.latencySLO.statuses()
+	assert.Len(statuses, 2)
+
+	// a provider pinned to 0 gets no requests.
+	assert.Equal(http.StatusOK, pin(http.MethodPost, "openai", `{"weightFactor": 0}`))
+	openaiHits.Store(0)
+	send(20)
+	assert.Equal(int64(0), openaiHits.Load())
+	assert.Len(controller.Status().ObjectStatus.(map[string]interface{})["providerDemotions"], 1)
+
+	// the largest member serves all requests if all are pinned to 0.
+	assert.Equal(http.StatusOK, pin(http.MethodPost, "deepseek", `{"weightFactor": 0}`))
+	openaiHits.Store(0)
+	send(5)
+	assert.Equal(int64(5), openaiHits.Load())
+
+	assert.Equal(http.StatusOK, pin(http.MethodDelete, "openai", ""))
+	assert.Equal(http.StatusOK, pin(http.MethodDelete, "deepseek", ""))
+	assert.Equal(http.StatusNotFound, pin(http.MethodDelete, "deepseek", ""))
+	assert.Equal(http.StatusOK, pin(http.MethodPost, "deepseek", ""))
+	assert.Equal(1.0, controller.latencySLO.weightFactor("deepseek"))
+	assert.Equal(http.StatusBadRequest, pin(http.MethodPost, "deepseek", `{"weightFactor": 2}`))
+	assert.Equal(http.StatusNotFound, pin(http.MethodPost, "mistral", ""))
+}
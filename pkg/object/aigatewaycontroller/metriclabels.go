@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/prometheushelper"
+)
+
+const (
+	// MaxMetricLabels is the maximum number of the custom metric labels.
+	MaxMetricLabels = 4
+	// MaxMetricLabelValues is the maximum number of the allowed values of
+	// a custom metric label.
+	MaxMetricLabelValues = 50
+	// MaxMetricLabelSeries is the maximum number of the combinations of
+	// the custom metric label values, including MetricLabelOther and
+	// MetricLabelNone, so a provider and model has at most this number of
+	// series of a request metric.
+	MaxMetricLabelSeries = 1000
+
+	// MetricLabelOther is the value of a custom label whose value is not
+	// allowed.
+	MetricLabelOther = "other"
+	// MetricLabelNone is the value of a custom label whose source is
+	// absent in the request.
+	MetricLabelNone = "none"
+)
+
+type (
+	// MetricLabelSpec defines a custom label of the request metrics,
+	// whose value is from a request header or a JWT claim. Values not in
+	// the allowlist are reported as MetricLabelOther, so the number of
+	// the series is bounded.
+	MetricLabelSpec struct {
+		Name   string `json:"name" jsonschema:"required"`
+		Header string `json:"header,omitempty"`
+		// Claim is a claim of the bearer JWT in the Authorization header.
+		// The token is not verified here, verify it by a filter before
+		// the controller if needed.
+		Claim string `json:"claim,omitempty"`
+		// Pattern validates the values before they are checked against
+		// the allowlist.
+		Pattern string   `json:"pattern,omitempty"`
+		Values  []string `json:"values" jsonschema:"required"`
+	}
+
+	// metricLabeler computes the values of the custom metric labels of
+	// requests.
+	metricLabeler struct {
+		labels []*metricLabel
+	}
+
+	metricLabel struct {
+		spec    *MetricLabelSpec
+		pattern *regexp.Regexp
+		allowed map[string]struct{}
+	}
+)
+
+func validateMetricLabels(specs []*MetricLabelSpec) error {
+	if len(specs) > MaxMetricLabels {
+		return fmt.Errorf("at most %d metric labels are allowed", MaxMetricLabels)
+	}
+	reserved := metricshub.ReservedLabels()
+	names := map[string]struct{}{}
+	series := 1
+	for _, spec := range specs {
+		if !prometheushelper.ValidateLabelName(spec.Name) || strings.HasPrefix(spec.Name, "__") {
+			return fmt.Errorf("invalid metric label name %q", spec.Name)
+		}
+		if slices.Contains(reserved, spec.Name) {
+			return fmt.Errorf("metric label name %s is reserved", spec.Name)
+		}
+		if _, ok := names[spec.Name]; ok {
+			return fmt.Errorf("duplicate metric label %s", spec.Name)
+		}
+		names[spec.Name] = struct{}{}
+
+		if (spec.Header == "") == (spec.Claim == "") {
+			return fmt.Errorf("metric label %s must have exactly one of header and claim", spec.Name)
+		}
+		var pattern *regexp.Regexp
+		if spec.Pattern != "" {
+			var err error
+			if pattern, err = regexp.Compile(spec.Pattern); err != nil {
+				return fmt.Errorf("metric label %s has invalid pattern: %w", spec.Name, err)
+			}
+		}
+		if len(spec.Values) == 0 {
+			return fmt.Errorf("metric label %s must have allowed values", spec.Name)
+		}
+		if len(spec.Values) > MaxMetricLabelValues {
+			return fmt.Errorf("metric label %s has more than %d allowed values", spec.Name, MaxMetricLabelValues)
+		}
+		for _, v := range spec.Values {
+			if v == "" || v == MetricLabelOther || v == MetricLabelNone {
+				return fmt.Errorf("metric label %s has invalid allowed value %q", spec.Name, v)
+			}
+			if pattern != nil && !pattern.MatchString(v) {
+				return fmt.Errorf("allowed value %q of metric label %s does not match the pattern", v, spec.Name)
+			}
+		}
+		series *= len(spec.Values) + 2
+		if series > MaxMetricLabelSeries {
+			return fmt.Errorf("metric labels have more than %d combinations of values", MaxMetricLabelSeries)
+		}
+	}
+	return nil
+}
+
+// newMetricLabeler creates a labeler of the validated specs, it returns
+// nil if there are no labels.
+func newMetricLabeler(specs []*MetricLabelSpec) *metricLabeler {
+	if len(specs) == 0 {
+		return nil
+	}
+	l := &metricLabeler{}
+	for _, spec := range specs {
+		label := &metricLabel{spec: spec, allowed: map[string]struct{}{}}
+		if spec.Pattern != "" {
+			label.pattern = regexp.MustCompile(spec.Pattern)
+		}
+		for _, v := range spec.Values {
+			label.allowed[v] = struct{}{}
+		}
+		l.labels = append(l.labels, label)
+	}
+	return l
+}
+
+// names returns the names of the labels, it is nil-safe.
+func (l *metricLabeler) names() []string {
+	if l == nil {
+		return nil
+	}
+	names := make([]string, 0, len(l.labels))
+	for _, label := range l.labels {
+		names = append(names, label.spec.Name)
+	}
+	return names
+}
+
+// values returns the values of the labels of the request, every value is
+// an allowed one, MetricLabelOther or MetricLabelNone.
+func (l *metricLabeler) values(req *httpprot.Request) []string {
+	if l == nil {
+		return nil
+	}
+	var claims jwt.MapClaims
+	values := make([]string, 0, len(l.labels))
+	for _, label := range l.labels {
+		var value string
+		if label.spec.Header != "" {
+			value = req.HTTPHeader().Get(label.spec.Header)
+		} else {
+			if claims == nil {
+				claims = bearerClaims(req)
+			}
+			if v, ok := claims[label.spec.Claim]; ok && v != nil {
+				value = fmt.Sprint(v)
+			}
+		}
+		values = append(values, label.value(value))
+	}
+	return values
+}
+
+func (label *metricLabel) value(v string) string {
+	if v == "" {
+		return MetricLabelNone
+	}
+	if label.pattern != nil && !label.pattern.MatchString(v) {
+		return MetricLabelOther
+	}
+	if _, ok := label.allowed[v]; !ok {
+		return MetricLabelOther
+	}
+	return v
+}
+
+// bearerClaims returns the claims of the bearer JWT of the request without
+// verifying it, it returns empty claims if there is no valid token.
+func bearerClaims(req *httpprot.Request) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	auth := req.HTTPHeader().Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return claims
+	}
+	if _, _, err := jwt.NewParser().ParseUnverified(strings.TrimSpace(token), claims); err != nil {
+		return jwt.MapClaims{}
+	}
+	return claims
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func TestValidateMetricLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	label := func(name string, values ...string) *MetricLabelSpec {
+		return &MetricLabelSpec{Name: name, Header: "X-" + name, Values: values}
+	}
+	manyValues := func(n int) []string {
+		values := make([]string, n)
+		for i := range values {
+			values[i] = "v" + strconv.Itoa(i)
+		}
+		return values
+	}
+
+	assert.NoError(validateMetricLabels(nil))
+	assert.NoError(validateMetricLabels([]*MetricLabelSpec{
+		label("app", "search", "chat"),
+		{Name: "team", Claim: "team", Pattern: "^[a-z]+$", Values: []string{"infra"}},
+	}))
+
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("a", "x"), label("b", "x"), label("c", "x"), label("d", "x"), label("e", "x")}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("app-name", "x")}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("__app", "x")}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("model", "x")}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("error", "x")}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("app", "x"), label("app", "y")}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{{Name: "app", Values: []string{"x"}}}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{{Name: "app", Header: "X-App", Claim: "app", Values: []string{"x"}}}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{{Name: "app", Header: "X-App", Pattern: "(", Values: []string{"x"}}}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{{Name: "app", Header: "X-App", Pattern: "^[a-z]+$", Values: []string{"X1"}}}))
+
+	// the allowlist is required and bounded.
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("app")}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("app", manyValues(MaxMetricLabelValues+1)...)}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("app", "x", MetricLabelOther)}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("app", "x", MetricLabelNone)}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("app", "x", "")}))
+
+	// the combinations of the values are bounded.
+	assert.NoError(validateMetricLabels([]*MetricLabelSpec{label("a", manyValues(8)...), label("b", manyValues(8)...), label("c", manyValues(8)...)}))
+	assert.Error(validateMetricLabels([]*MetricLabelSpec{label("a", manyValues(9)...), label("b", manyValues(9)...), label("c", manyValues(9)...)}))
+}
+
+func TestMetricLabelerValues(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newMetricLabeler(nil))
+	assert.Nil((*metricLabeler)(nil).names())
+
+	l := newMetricLabeler([]*MetricLabelSpec{
+		{Name: "app", Header: "X-App", Values: []string{"search", "chat"}},
+		{Name: "env", Header: "X-Env", Pattern: "^[a-z]+$", Values: []string{"prod", "staging"}},
+		{Name: "team", Claim: "team", Values: []string{"infra"}},
+	})
+	assert.Equal([]string{"app", "env", "team"}, l.names())
+
+	token := func(claims jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		assert.NoError(err)
+		return "Bearer " + s
+	}
+	values := func(headers map[string]string) []string {
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1/v1/chat/completions", nil)
+		assert.NoError(err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		httpreq, err := httpprot.NewRequest(req)
+		assert.NoError(err)
+		return l.values(httpreq)
+	}
+
+	assert.Equal([]string{"search", "prod", "infra"}, values(map[string]string{
+		"X-App": "search", "X-Env": "prod", "Authorization": token(jwt.MapClaims{"team": "infra"}),
+	}))
+	assert.Equal([]string{MetricLabelNone, MetricLabelNone, MetricLabelNone}, values(nil))
+	assert.Equal([]string{MetricLabelOther, MetricLabelOther, MetricLabelOther}, values(map[string]string{
+		"X-App": "unknown", "X-Env": "dev", "Authorization": token(jwt.MapClaims{"team": "payments"}),
+	}))
+	// values not matching the pattern are other, even if allowed
+	// case-insensitively.
+	assert.Equal(MetricLabelOther, values(map[string]string{"X-Env": "PROD"})[1])
+	// non-string claims and malformed tokens.
+	assert.Equal(MetricLabelOther, values(map[string]string{"Authorization": token(jwt.MapClaims{"team": 42})})[2])
+	assert.Equal(MetricLabelNone, values(map[string]string{"Authorization": "Bearer not-a-token"})[2])
+	assert.Equal(MetricLabelNone, values(map[string]string{"Authorization": "Basic dXNlcjpwYXNz"})[2])
+}
+
+func TestMetricLabelsCardinality(t *testing.T) {
+	assert := assert.New(t)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(chatCompletionsHandler))
+	defer mockServer.Close()
+
+	controllerConfig := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+metricLabels:
+- name: app
+  header: X-App
+  values: [search, chat]
+`, mockServer.URL)
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(controllerConfig)
+	assert.Nil(err)
+	controller := AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	send := func(app string) {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt", "stream": false}`)))
+		assert.Nil(err)
+		if app != "" {
+			req.Header.Set("X-App", app)
+		}
+		setRequest(t, ctx, "metriclabels", req)
+		assert.Equal("", controller.Handle(ctx, "openai", nil))
+		ctx.Finish()
+	}
+	send("search")
+	send("")
+	// every unknown value falls into other, so there is no explosion.
+	for i := 0; i < 100; i++ {
+		send("app-" + strconv.Itoa(i))
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.Nil(err)
+	counts := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "ai_gateway_total_request" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "app" {
+					counts[label.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	assert.Equal(map[string]float64{"search": 1, MetricLabelNone: 1, MetricLabelOther: 100}, counts)
+}
@@ -21,11 +21,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"maps"
+	"strconv"
 	"time"
 
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/supervisor"
-	"github.com/megaease/easegress/v2/pkg/util/prometheushelper"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -42,6 +42,8 @@ const (
 	MetricProviderError    MetricError = "providerError"
 	MetricMiddlewareError  MetricError = "middlewareError"
 	MetricMarshalError     MetricError = "marshalError"
+	// MetricResponseTooLargeError means the response of the provider exceeds maxResponseBytes.
+	MetricResponseTooLargeError MetricError = "responseTooLarge"
 )
 
 type (
@@ -57,6 +59,21 @@ type (
 		BaseURL      string      `json:"baseURL"`
 		ResponseType string      `json:"responseType"`
 		Error        MetricError `json:"error"`
+
+		// Connection information of the request to the provider,
+		// the fields below are valid only if ConnectionTraced is true.
+		ConnectionTraced     bool  `json:"connectionTraced"`
+		ConnectionReused     bool  `json:"connectionReused"`
+		DNSDuration          int64 `json:"dnsDuration"`          // in milliseconds
+		TLSHandshakeDuration int64 `json:"tlsHandshakeDuration"` // in milliseconds
+		OpenConnections      int64 `json:"openConnections"`
+
+		// CustomLabels are the values of the custom labels of the request
+		// metrics, in the order of the names set by SetCustomLabels.
+		CustomLabels []string `json:"-"`
+		// TraceID is the trace ID of the request, it is attached to the
+		// latency and token metrics as the exemplar if not empty.
+		TraceID string `json:"-"`
 	}
 
 	metricEvent struct {
@@ -66,13 +83,14 @@ type (
 
 	// MetricsHub manages collection, aggregation, and exposure of all metrics.
 	MetricsHub struct {
-		totalRequest    *prometheus.CounterVec
-		successRequest  *prometheus.CounterVec
-		failedRequest   *prometheus.CounterVec
-		requestDuration prometheus.ObserverVec
-
 		promptTokens     *prometheus.CounterVec
 		completionTokens *prometheus.CounterVec
+		requestTokens    prometheus.ObserverVec
+
+		connections          *prometheus.CounterVec
+		openConnections      *prometheus.GaugeVec
+		dnsDuration          prometheus.ObserverVec
+		tlsHandshakeDuration prometheus.ObserverVec
 
 		spec *supervisor.Spec
 		// stats is lock-free, please access it through run goroutine only.
@@ -97,13 +115,17 @@ type (
 		SuccessRequestDuration int64 `json:"successRequestDuration"`
 		PromptTokens           int64 `json:"promptTokens"`
 		CompletionTokens       int64 `json:"completionTokens"`
+		NewConnections         int64 `json:"newConnections"`
+		ReusedConnections      int64 `json:"reusedConnections"`
+		ResponseTooLarge       int64 `json:"responseTooLarge"`
 	}
 
 	// MetricStats combines MetricLabel and MetricDetails, and includes average request duration.
 	MetricStats struct {
 		MetricLabel            `json:",inline"`
 		MetricDetails          `json:",inline"`
-		RequestAverageDuration int64 `json:"requestAverageDuration"`
+		RequestAverageDuration int64   `json:"requestAverageDuration"`
+		RequestsPerConnection  float64 `json:"requestsPerConnection"`
 	}
 
 	// MetricSnapshot captures a full snapshot of all metrics at a specific timestamp.
@@ -121,51 +143,20 @@ func New(spec *supervisor.Spec) *MetricsHub {
 		"clusterRole":  spec.Super().Options().ClusterRole,
 		"instanceName": spec.Super().Options().Name,
 	}
-	labels := []string{
-		// common labels
-		"kind", "clusterName", "clusterRole", "instanceName",
-		// metric labels
-		"provider", "providerType", "baseUrl", "model", "respType",
-	}
 	hub := &MetricsHub{
-		totalRequest: prometheushelper.NewCounter(
-			"ai_gateway_total_request",
-			"Total number of requests received by AIGatewayController",
-			labels,
-		).MustCurryWith(commonLabels),
-		successRequest: prometheushelper.NewCounter(
-			"ai_gateway_success_request",
-			"Total number of successful requests processed by AIGatewayController",
-			labels,
-		).MustCurryWith(commonLabels),
-		failedRequest: prometheushelper.NewCounter(
-			"ai_gateway_failed_request",
-			"Total number of failed requests processed by AIGatewayController",
-			append(labels, "error"),
-		).MustCurryWith(commonLabels),
-		requestDuration: prometheushelper.NewHistogram(
-			prometheus.HistogramOpts{
-				Name:    "ai_gateway_requests_duration",
-				Help:    "Request processing duration histogram of a provider by AIGatewayController",
-				Buckets: prometheushelper.DefaultDurationBuckets(),
-			},
-			labels,
-		).MustCurryWith(commonLabels),
-		promptTokens: prometheushelper.NewCounter(
-			"ai_gateway_prompt_tokens",
-			"Total number of prompt tokens processed by AIGatewayController",
-			labels,
-		).MustCurryWith(commonLabels),
-		completionTokens: prometheushelper.NewCounter(
-			"ai_gateway_completion_tokens",
-			"Total number of completion tokens processed by AIGatewayController",
-			labels,
-		).MustCurryWith(commonLabels),
+		promptTokens:         PromptTokens.NewCounter().MustCurryWith(commonLabels),
+		completionTokens:     CompletionTokens.NewCounter().MustCurryWith(commonLabels),
+		requestTokens:        RequestTokens.NewHistogram().MustCurryWith(commonLabels),
+		connections:          ProviderConnections.NewCounter().MustCurryWith(commonLabels),
+		openConnections:      ProviderOpenConnections.NewGauge().MustCurryWith(commonLabels),
+		dnsDuration:          ProviderDNSDuration.NewHistogram().MustCurryWith(commonLabels),
+		tlsHandshakeDuration: ProviderTLSHandshakeDuration.NewHistogram().MustCurryWith(commonLabels),
 
 		spec:    spec,
 		stats:   make(map[MetricLabel]*MetricDetails),
 		eventCh: make(chan *metricEvent, 10000),
 	}
+	initRequestMetrics(commonLabels)
 	logger.Infof("MetricsHub initialized for AIGatewayController")
 	go hub.run()
 	return hub
@@ -214,8 +205,18 @@ func (m *MetricsHub) updateStats(metric *Metric) {
 	}
 
 	details.TotalRequests++
+	if metric.ConnectionTraced {
+		if metric.ConnectionReused {
+			details.ReusedConnections++
+		} else {
+			details.NewConnections++
+		}
+	}
 	if !metric.Success {
 		details.FailedRequests++
+		if metric.Error == MetricResponseTooLargeError {
+			details.ResponseTooLarge++
+		}
 		return
 	}
 
@@ -225,6 +226,14 @@ func (m *MetricsHub) updateStats(metric *Metric) {
 	details.CompletionTokens += metric.OutputTokens
 }
 
+// requestsPerConnection returns the average number of requests served by a new connection.
+func (d *MetricDetails) requestsPerConnection() float64 {
+	if d.NewConnections == 0 {
+		return 0
+	}
+	return float64(d.NewConnections+d.ReusedConnections) / float64(d.NewConnections)
+}
+
 func (m *MetricsHub) currentStats() []*MetricStats {
 	stats := make([]*MetricStats, 0, len(m.stats))
 	for label, details := range m.stats {
@@ -236,6 +245,7 @@ func (m *MetricsHub) currentStats() []*MetricStats {
 			MetricLabel:            label,
 			MetricDetails:          *details,
 			RequestAverageDuration: avgDuration,
+			RequestsPerConnection:  details.requestsPerConnection(),
 		})
 	}
 	return stats
@@ -308,19 +318,56 @@ func (m *MetricsHub) Update(metric *Metric) {
 		"model":        metric.Model,
 		"respType":     metric.ResponseType,
 	}
+	rm := requestMetricsCollector.current.Load()
+	requestLabels := maps.Clone(labels)
+	for i, name := range rm.customLabels {
+		// the values are empty if the metric is labeled before the
+		// custom labels change.
+		value := ""
+		if len(metric.CustomLabels) == len(rm.customLabels) {
+			value = metric.CustomLabels[i]
+		}
+		requestLabels[name] = value
+	}
 
-	m.totalRequest.With(labels).Inc()
+	rm.totalRequest.With(requestLabels).Inc()
+	if metric.ConnectionTraced {
+		m.updateConnection(metric)
+	}
 	if !metric.Success {
-		newLabels := maps.Clone(labels)
+		newLabels := maps.Clone(requestLabels)
 		newLabels["error"] = string(metric.Error)
-		m.failedRequest.With(newLabels).Inc()
+		rm.failedRequest.With(newLabels).Inc()
 		return
 	}
 
-	m.successRequest.With(labels).Inc()
-	m.requestDuration.With(labels).Observe(float64(metric.Duration))
-	m.promptTokens.With(labels).Add(float64(metric.InputTokens))
-	m.completionTokens.With(labels).Add(float64(metric.OutputTokens))
+	rm.successRequest.With(requestLabels).Inc()
+	observe(rm.requestDuration.With(requestLabels), float64(metric.Duration), metric.TraceID)
+	add(m.promptTokens.With(labels), float64(metric.InputTokens), metric.TraceID)
+	add(m.completionTokens.With(labels), float64(metric.OutputTokens), metric.TraceID)
+	for tokenType, tokens := range map[string]int64{"prompt": metric.InputTokens, "completion": metric.OutputTokens} {
+		tokenLabels := maps.Clone(labels)
+		tokenLabels["type"] = tokenType
+		observe(m.requestTokens.With(tokenLabels), float64(tokens), metric.TraceID)
+	}
+}
+
+func (m *MetricsHub) updateConnection(metric *Metric) {
+	labels := prometheus.Labels{
+		"provider":     metric.Provider,
+		"providerType": metric.ProviderType,
+		"baseUrl":      metric.BaseURL,
+	}
+	m.openConnections.With(labels).Set(float64(metric.OpenConnections))
+
+	connLabels := maps.Clone(labels)
+	connLabels["reused"] = strconv.FormatBool(metric.ConnectionReused)
+	m.connections.With(connLabels).Inc()
+	if metric.ConnectionReused {
+		return
+	}
+	m.dnsDuration.With(labels).Observe(float64(metric.DNSDuration))
+	m.tlsHandshakeDuration.With(labels).Observe(float64(metric.TLSHandshakeDuration))
 }
 
 // GetStats returns the current stats of AI gateway metrics.
@@ -384,6 +431,9 @@ func (m *MetricsHub) GetAllStats() ([]MetricStats, error) {
 			details.SuccessRequestDuration += stat.SuccessRequestDuration
 			details.PromptTokens += stat.PromptTokens
 			details.CompletionTokens += stat.CompletionTokens
+			details.NewConnections += stat.NewConnections
+			details.ReusedConnections += stat.ReusedConnections
+			details.ResponseTooLarge += stat.ResponseTooLarge
 		}
 	}
 	if len(allMetricMap) == 0 {
@@ -399,6 +449,7 @@ func (m *MetricsHub) GetAllStats() ([]MetricStats, error) {
 			MetricLabel:            label,
 			MetricDetails:          *details,
 			RequestAverageDuration: avgDuration,
+			RequestsPerConnection:  details.requestsPerConnection(),
 		})
 	}
 	return res, nil
@@ -0,0 +1,599 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metricshub
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/megaease/easegress/v2/pkg/util/prometheushelper"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The types of metrics.
+const (
+	MetricTypeCounter   = "counter"
+	MetricTypeGauge     = "gauge"
+	MetricTypeHistogram = "histogram"
+)
+
+// ExemplarTraceIDLabel is the label of the trace ID in the exemplars.
+const ExemplarTraceIDLabel = "trace_id"
+
+type (
+	// Definition defines a metric of AIGatewayController. All metrics are
+	// defined in this file, so their names, labels and help texts follow
+	// the same scheme and are listed by the manifest.
+	Definition struct {
+		Name   string   `json:"name"`
+		Type   string   `json:"type"`
+		Help   string   `json:"help"`
+		Unit   string   `json:"unit,omitempty"`
+		Labels []string `json:"labels"`
+		// Buckets are the upper bounds of the buckets of histograms.
+		Buckets []float64 `json:"buckets,omitempty"`
+		// Exemplars means the samples carry the trace IDs of requests
+		// as exemplars when tracing is enabled.
+		Exemplars bool `json:"exemplars,omitempty"`
+		// CustomLabels means the custom labels of metricLabels are
+		// appended to Labels.
+		CustomLabels bool `json:"customLabels,omitempty"`
+	}
+
+	// Manifest lists all metrics of AIGatewayController.
+	Manifest struct {
+		Metrics []*Definition `json:"metrics"`
+	}
+)
+
+var (
+	// validMetricName is the naming scheme of metrics: ai_gateway_, the
+	// subject and the measure in lower snake case.
+	validMetricName = regexp.MustCompile(`^ai_gateway(_[a-z0-9]+)+$`)
+	// validLabelName is the naming scheme of labels: lower camel case.
+	validLabelName = regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`)
+
+	definitionsLock sync.Mutex
+	definitions     = map[string]*Definition{}
+)
+
+// commonLabels are the labels of the metrics of the hub, which are curried
+// with the options of the member.
+var commonLabels = []string{"kind", "clusterName", "clusterRole", "instanceName"}
+
+func withCommonLabels(labels ...string) []string {
+	return append(slices.Clone(commonLabels), labels...)
+}
+
+// Request metrics.
+var (
+	TotalRequests = define(&Definition{
+		Name:         "ai_gateway_total_request",
+		Type:         MetricTypeCounter,
+		Help:         "Total number of requests received by AIGatewayController",
+		Labels:       requestLabels(),
+		CustomLabels: true,
+	})
+	SuccessRequests = define(&Definition{
+		Name:         "ai_gateway_success_request",
+		Type:         MetricTypeCounter,
+		Help:         "Total number of successful requests processed by AIGatewayController",
+		Labels:       requestLabels(),
+		CustomLabels: true,
+	})
+	FailedRequests = define(&Definition{
+		Name:         "ai_gateway_failed_request",
+		Type:         MetricTypeCounter,
+		Help:         "Total number of failed requests processed by AIGatewayController",
+		Labels:       append(requestLabels(), "error"),
+		CustomLabels: true,
+	})
+	RequestDuration = define(&Definition{
+		Name:         "ai_gateway_requests_duration",
+		Type:         MetricTypeHistogram,
+		Help:         "Request processing duration histogram of a provider by AIGatewayController",
+		Unit:         "milliseconds",
+		Labels:       requestLabels(),
+		Buckets:      prometheushelper.DefaultDurationBuckets(),
+		Exemplars:    true,
+		CustomLabels: true,
+	})
+	PromptTokens = define(&Definition{
+		Name:      "ai_gateway_prompt_tokens",
+		Type:      MetricTypeCounter,
+		Help:      "Total number of prompt tokens processed by AIGatewayController",
+		Unit:      "tokens",
+		Labels:    requestLabels(),
+		Exemplars: true,
+	})
+	CompletionTokens = define(&Definition{
+		Name:      "ai_gateway_completion_tokens",
+		Type:      MetricTypeCounter,
+		Help:      "Total number of completion tokens processed by AIGatewayController",
+		Unit:      "tokens",
+		Labels:    requestLabels(),
+		Exemplars: true,
+	})
+	RequestTokens = define(&Definition{
+		Name:      "ai_gateway_request_tokens",
+		Type:      MetricTypeHistogram,
+		Help:      "Tokens histogram of requests by type, prompt or completion, processed by AIGatewayController",
+		Unit:      "tokens",
+		Labels:    append(requestLabels(), "type"),
+		Buckets:   prometheus.ExponentialBuckets(16, 4, 8),
+		Exemplars: true,
+	})
+)
+
+// Provider connection metrics.
+var (
+	ProviderConnections = define(&Definition{
+		Name:   "ai_gateway_provider_connections",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of connections used to access providers by AIGatewayController",
+		Labels: withCommonLabels("provider", "providerType", "baseUrl", "reused"),
+	})
+	ProviderOpenConnections = define(&Definition{
+		Name:   "ai_gateway_provider_open_connections",
+		Type:   MetricTypeGauge,
+		Help:   "Number of connections currently opened to providers by AIGatewayController",
+		Labels: withCommonLabels("provider", "providerType", "baseUrl"),
+	})
+	ProviderDNSDuration = define(&Definition{
+		Name:    "ai_gateway_provider_dns_duration",
+		Type:    MetricTypeHistogram,
+		Help:    "DNS resolution duration histogram of a provider by AIGatewayController",
+		Unit:    "milliseconds",
+		Labels:  withCommonLabels("provider", "providerType", "baseUrl"),
+		Buckets: connDurationBuckets,
+	})
+	ProviderTLSHandshakeDuration = define(&Definition{
+		Name:    "ai_gateway_provider_tls_handshake_duration",
+		Type:    MetricTypeHistogram,
+		Help:    "TLS handshake duration histogram of a provider by AIGatewayController",
+		Unit:    "milliseconds",
+		Labels:  withCommonLabels("provider", "providerType", "baseUrl"),
+		Buckets: connDurationBuckets,
+	})
+	ProviderFailovers = define(&Definition{
+		Name:   "ai_gateway_provider_failovers",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of endpoint failovers of providers by AIGatewayController",
+		Labels: []string{"provider", "baseUrl"},
+	})
+	ProviderFirstTokenSeconds = define(&Definition{
+		Name:    "ai_gateway_provider_first_token_seconds",
+		Type:    MetricTypeHistogram,
+		Help:    "Time to the first token of the successful responses of providers, synthetic streams are labeled apart",
+		Unit:    "seconds",
+		Labels:  []string{"provider", "synthetic"},
+		Buckets: prometheus.DefBuckets,
+	})
+	ProviderCredentialRequests = define(&Definition{
+		Name:   "ai_gateway_provider_credential_requests",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of requests to providers by API key and result",
+		Labels: []string{"provider", "credential", "result"},
+	})
+)
+
+var connDurationBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2000}
+
+// Controller metrics.
+var (
+	RateLimitedRequests = define(&Definition{
+		Name:   "ai_gateway_rate_limited_requests",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of requests rejected by the rate limit of AIGatewayController",
+		Labels: []string{"type"},
+	})
+	UnsupportedEndpointRequests = define(&Definition{
+		Name:   "ai_gateway_unsupported_endpoint_requests",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of requests to endpoints not served by AIGatewayController",
+		Labels: []string{"path"},
+	})
+	FeatureFlagEvaluations = define(&Definition{
+		Name:   "ai_gateway_feature_flag_evaluations",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of feature flag evaluations of AIGatewayController",
+		Labels: []string{"flag", "enabled"},
+	})
+	ResidencyEnforcements = define(&Definition{
+		Name:   "ai_gateway_residency_enforcements",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of requests kept in the regions of their consumers by data residency",
+		Labels: []string{"region", "stage", "action"},
+	})
+	ProviderGroupHedges = define(&Definition{
+		Name:   "ai_gateway_provider_group_hedges",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of requests to hedged provider groups by hedging decision",
+		Labels: []string{"group", "decision"},
+	})
+	ProviderGroupHedgeWinners = define(&Definition{
+		Name:   "ai_gateway_provider_group_hedge_winners",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of hedged requests by the provider and the attempt serving the response",
+		Labels: []string{"group", "provider", "attempt"},
+	})
+	ProviderGroupHedgeWastedTokens = define(&Definition{
+		Name:   "ai_gateway_provider_group_hedge_wasted_tokens",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of estimated prompt tokens of the canceled attempts of hedged requests",
+		Labels: []string{"group", "provider"},
+	})
+	ProviderGroupHedgeWastedCost = define(&Definition{
+		Name:   "ai_gateway_provider_group_hedge_wasted_cost",
+		Type:   MetricTypeCounter,
+		Help:   "Total estimated cost in USD of the canceled attempts of hedged requests",
+		Unit:   "USD",
+		Labels: []string{"group", "provider"},
+	})
+	ResponseValidatorTriggers = define(&Definition{
+		Name:   "ai_gateway_response_validator_triggers",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of failed quality checks of the responses of models",
+		Labels: []string{"model", "check", "action"},
+	})
+	OutputScrubHits = define(&Definition{
+		Name:   "ai_gateway_output_scrub_hits",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of tokens, patterns and think blocks scrubbed from the responses of providers",
+		Labels: []string{"provider", "pattern"},
+	})
+	UsageCost = define(&Definition{
+		Name:   "ai_gateway_usage_cost",
+		Type:   MetricTypeCounter,
+		Help:   "Total cost in USD of requests processed by AIGatewayController",
+		Unit:   "USD",
+		Labels: []string{"provider", "model"},
+	})
+	UsageSinkEvents = define(&Definition{
+		Name:   "ai_gateway_usage_sink_events",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of usage events by result of the usage sinks of AIGatewayController",
+		Labels: []string{"sink", "result"},
+	})
+)
+
+// Middleware metrics.
+var (
+	ModerationInputs = define(&Definition{
+		Name:   "ai_gateway_moderation_inputs",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of inputs moderated by AIGatewayController",
+		Labels: []string{"backend", "cached", "flagged"},
+	})
+	ModerationErrors = define(&Definition{
+		Name:   "ai_gateway_moderation_errors",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of failed moderations of AIGatewayController",
+		Labels: []string{"backend"},
+	})
+	ModerationGuardHits = define(&Definition{
+		Name:   "ai_gateway_moderation_guard_hits",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of requests flagged by ModerationGuard middlewares",
+		Labels: []string{"middleware", "category", "action"},
+	})
+	TopicGuardHits = define(&Definition{
+		Name:   "ai_gateway_topic_guard_hits",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of requests hitting topics of TopicGuard middlewares",
+		Labels: []string{"middleware", "topic", "action"},
+	})
+	ToolPolicyViolations = define(&Definition{
+		Name:   "ai_gateway_tool_policy_violations",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of tools blocked by the tool policy of ConsumerPolicy middlewares",
+		Labels: []string{"middleware", "group", "direction", "action"},
+	})
+	EmbeddingDedupHits = define(&Definition{
+		Name:   "ai_gateway_embedding_dedup_hits",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of query embeddings of middlewares reused within a request",
+		Labels: []string{"middleware", "model"},
+	})
+	RetrievalBudgetDecisions = define(&Definition{
+		Name:   "ai_gateway_retrieval_budget_decisions",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of the retrieval decisions on the budgets of requests",
+		Labels: []string{"middleware", "decision"},
+	})
+	CacheInvalidationEvents = define(&Definition{
+		Name:   "ai_gateway_cache_invalidation_events",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of cache invalidation events of middlewares by AIGatewayController",
+		Labels: []string{"middleware", "event"},
+	})
+	SemanticCacheThreshold = define(&Definition{
+		Name:   "ai_gateway_semantic_cache_threshold",
+		Type:   MetricTypeGauge,
+		Help:   "Similarity threshold of semantic cache middlewares",
+		Labels: []string{"middleware"},
+	})
+	SemanticCacheAgreement = define(&Definition{
+		Name:    "ai_gateway_semantic_cache_agreement",
+		Type:    MetricTypeHistogram,
+		Help:    "Agreement scores of the cache hits with fresh generations",
+		Labels:  []string{"middleware", "model", "scoreBucket"},
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	})
+	SemanticCacheEvaluations = define(&Definition{
+		Name:   "ai_gateway_semantic_cache_evaluations",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of the evaluations of cache hits",
+		Labels: []string{"middleware", "result"},
+	})
+	SemanticCacheTamperedEntries = define(&Definition{
+		Name:   "ai_gateway_semantic_cache_tampered_entries",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of the cache entries failing the signature verification",
+		Labels: []string{"middleware", "reason"},
+	})
+	SemanticCacheOffloads = define(&Definition{
+		Name:   "ai_gateway_semantic_cache_offloads",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of the cache entries offloaded to cold storage",
+		Labels: []string{"middleware", "result"},
+	})
+	SemanticCacheRehydrations = define(&Definition{
+		Name:   "ai_gateway_semantic_cache_rehydrations",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of the cache entries moved back from cold storage",
+		Labels: []string{"middleware", "result"},
+	})
+	SemanticCacheColdFetchSeconds = define(&Definition{
+		Name:    "ai_gateway_semantic_cache_cold_fetch_seconds",
+		Type:    MetricTypeHistogram,
+		Help:    "Latency of fetching the cache entries from cold storage",
+		Unit:    "seconds",
+		Labels:  []string{"middleware", "result"},
+		Buckets: prometheus.DefBuckets,
+	})
+	SemanticCacheClockSkewSeconds = define(&Definition{
+		Name:   "ai_gateway_semantic_cache_clock_skew_seconds",
+		Type:   MetricTypeGauge,
+		Help:   "Difference of the local clock from the clock of the vector database of semantic caches",
+		Unit:   "seconds",
+		Labels: []string{"middleware"},
+	})
+	SemanticCacheStaleServed = define(&Definition{
+		Name:   "ai_gateway_semantic_cache_stale_served",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of the cache hits served from the local tier while the vector database is degraded",
+		Labels: []string{"middleware"},
+	})
+	SemanticCacheStalenessSeconds = define(&Definition{
+		Name:    "ai_gateway_semantic_cache_staleness_seconds",
+		Type:    MetricTypeHistogram,
+		Help:    "Time since the stale cache hits are validated against the vector database",
+		Unit:    "seconds",
+		Labels:  []string{"middleware"},
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	SemanticCacheLocalLookups = define(&Definition{
+		Name:   "ai_gateway_semantic_cache_local_lookups",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of the lookups of the local tier of the semantic cache by the eviction policy, the hit rate of a policy is its hits of all lookups",
+		Labels: []string{"middleware", "policy", "result"},
+	})
+)
+
+// Vector database metrics.
+var (
+	VectorDBWriteQueueDepth = define(&Definition{
+		Name:   "ai_gateway_vectordb_write_queue_depth",
+		Type:   MetricTypeGauge,
+		Help:   "Number of pending document writes of collections",
+		Labels: []string{"collection"},
+	})
+	VectorDBQueuedWrites = define(&Definition{
+		Name:   "ai_gateway_vectordb_queued_writes",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of queued document writes of collections by result",
+		Labels: []string{"collection", "result"},
+	})
+	VectorDBQueriesInFlight = define(&Definition{
+		Name:   "ai_gateway_vectordb_queries_in_flight",
+		Type:   MetricTypeGauge,
+		Help:   "Number of in-flight similarity searches of backends by priority",
+		Labels: []string{"backend", "priority"},
+	})
+	VectorDBQueryWaitSeconds = define(&Definition{
+		Name:    "ai_gateway_vectordb_query_wait_seconds",
+		Type:    MetricTypeHistogram,
+		Help:    "Time similarity searches wait for a slot of backends by priority",
+		Unit:    "seconds",
+		Labels:  []string{"backend", "priority"},
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	})
+	VectorDBShedQueries = define(&Definition{
+		Name:   "ai_gateway_vectordb_shed_queries",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of similarity searches shed by backends by priority",
+		Labels: []string{"backend", "priority"},
+	})
+	VectorDBRescoringSeconds = define(&Definition{
+		Name:    "ai_gateway_vectordb_rescoring_seconds",
+		Type:    MetricTypeHistogram,
+		Help:    "Time re-scoring the candidates of similarity searches by function",
+		Unit:    "seconds",
+		Labels:  []string{"function"},
+		Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1},
+	})
+	VectorDBRescoringFailures = define(&Definition{
+		Name:   "ai_gateway_vectordb_rescoring_failures",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of the candidates failed to re-score by function",
+		Labels: []string{"function"},
+	})
+	VectorDBOperations = define(&Definition{
+		Name:   "ai_gateway_vectordb_operations",
+		Type:   MetricTypeCounter,
+		Help:   "Total number of operations of vector database clients by type and outcome",
+		Labels: []string{"backend", "operation", "outcome"},
+	})
+	VectorDBOperationSeconds = define(&Definition{
+		Name:    "ai_gateway_vectordb_operation_seconds",
+		Type:    MetricTypeHistogram,
+		Help:    "Latency of operations of vector database clients by type",
+		Unit:    "seconds",
+		Labels:  []string{"backend", "operation"},
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+	VectorDBBatchSize = define(&Definition{
+		Name:    "ai_gateway_vectordb_batch_size",
+		Type:    MetricTypeHistogram,
+		Help:    "Number of documents written or deleted by operations of vector database clients",
+		Unit:    "documents",
+		Labels:  []string{"backend", "operation"},
+		Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	})
+	VectorDBResults = define(&Definition{
+		Name:    "ai_gateway_vectordb_results",
+		Type:    MetricTypeHistogram,
+		Help:    "Number of documents returned by the searches of vector database clients",
+		Unit:    "documents",
+		Labels:  []string{"backend"},
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100},
+	})
+)
+
+// define adds the metric to the manifest, it panics if the metric breaks
+// the naming scheme or is defined twice, so the mistakes are found by any
+// test of the package.
+func define(d *Definition) *Definition {
+	if err := validateDefinition(d); err != nil {
+		panic(err)
+	}
+
+	definitionsLock.Lock()
+	defer definitionsLock.Unlock()
+	if _, ok := definitions[d.Name]; ok {
+		panic(fmt.Errorf("metric %s is defined twice", d.Name))
+	}
+	definitions[d.Name] = d
+	return d
+}
+
+func validateDefinition(d *Definition) error {
+	if !validMetricName.MatchString(d.Name) {
+		return fmt.Errorf("metric name %s breaks the naming scheme", d.Name)
+	}
+	if strings.TrimSpace(d.Help) == "" {
+		return fmt.Errorf("metric %s has no help", d.Name)
+	}
+	switch d.Type {
+	case MetricTypeCounter, MetricTypeGauge:
+		if len(d.Buckets) != 0 {
+			return fmt.Errorf("metric %s is not a histogram but has buckets", d.Name)
+		}
+	case MetricTypeHistogram:
+		if len(d.Buckets) == 0 {
+			return fmt.Errorf("histogram %s has no buckets", d.Name)
+		}
+	default:
+		return fmt.Errorf("metric %s has invalid type %s", d.Name, d.Type)
+	}
+	if d.Exemplars && d.Type == MetricTypeGauge {
+		return fmt.Errorf("gauge %s can not have exemplars", d.Name)
+	}
+	for i, label := range d.Labels {
+		if !validLabelName.MatchString(label) {
+			return fmt.Errorf("label %s of metric %s breaks the naming scheme", label, d.Name)
+		}
+		if slices.Contains(d.Labels[:i], label) {
+			return fmt.Errorf("label %s of metric %s is duplicated", label, d.Name)
+		}
+	}
+	return nil
+}
+
+// GetManifest returns all metrics sorted by name.
+func GetManifest() *Manifest {
+	definitionsLock.Lock()
+	defer definitionsLock.Unlock()
+
+	metrics := make([]*Definition, 0, len(definitions))
+	for _, d := range definitions {
+		metrics = append(metrics, d)
+	}
+	slices.SortFunc(metrics, func(a, b *Definition) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return &Manifest{Metrics: metrics}
+}
+
+// NewCounter creates the counter of the definition, or returns the one
+// created already.
+func (d *Definition) NewCounter() *prometheus.CounterVec {
+	return prometheushelper.NewCounter(d.Name, d.Help, d.Labels)
+}
+
+// NewGauge creates the gauge of the definition, or returns the one
+// created already.
+func (d *Definition) NewGauge() *prometheus.GaugeVec {
+	return prometheushelper.NewGauge(d.Name, d.Help, d.Labels)
+}
+
+// NewHistogram creates the histogram of the definition, or returns the one
+// created already.
+func (d *Definition) NewHistogram() *prometheus.HistogramVec {
+	return prometheushelper.NewHistogram(d.histogramOpts(), d.Labels)
+}
+
+func (d *Definition) counterOpts() prometheus.CounterOpts {
+	return prometheus.CounterOpts{Name: d.Name, Help: d.Help}
+}
+
+func (d *Definition) histogramOpts() prometheus.HistogramOpts {
+	return prometheus.HistogramOpts{Name: d.Name, Help: d.Help, Buckets: d.Buckets}
+}
+
+// exemplar returns the exemplar labels of the trace ID, it is nil if the
+// request is not traced.
+func exemplar(traceID string) prometheus.Labels {
+	if traceID == "" {
+		return nil
+	}
+	return prometheus.Labels{ExemplarTraceIDLabel: traceID}
+}
+
+// observe observes the value with the trace ID as the exemplar if there is.
+func observe(observer prometheus.Observer, value float64, traceID string) {
+	if e, ok := observer.(prometheus.ExemplarObserver); ok && traceID != "" {
+		e.ObserveWithExemplar(value, exemplar(traceID))
+		return
+	}
+	observer.Observe(value)
+}
+
+// add adds the value to the counter with the trace ID as the exemplar if
+// there is.
+func add(counter prometheus.Counter, value float64, traceID string) {
+	if e, ok := counter.(prometheus.ExemplarAdder); ok && traceID != "" {
+		e.AddWithExemplar(value, exemplar(traceID))
+		return
+	}
+	counter.Add(value)
+}
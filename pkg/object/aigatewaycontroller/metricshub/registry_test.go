@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metricshub_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+func newTestHub(t *testing.T) *metricshub.MetricsHub {
+	mockCluster := clustertest.NewMockedCluster()
+	mockCluster.MockedLayout = func() *cluster.Layout {
+		return &cluster.Layout{}
+	}
+	mockCluster.MockedPut = func(key string, value string) error {
+		return nil
+	}
+	super := supervisor.NewMock(option.New(), mockCluster, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: http://localhost:19876
+  apiKey: mock
+`)
+	assert.Nil(t, err)
+	return metricshub.New(spec)
+}
+
+func TestManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	hub := newTestHub(t)
+	defer hub.Close()
+	hub.Update(&metricshub.Metric{
+		Success:      true,
+		Duration:     100,
+		Provider:     "openai",
+		ProviderType: "openai",
+		InputTokens:  10,
+		OutputTokens: 5,
+		Model:        "manifest",
+	})
+
+	manifest := metricshub.GetManifest()
+	assert.True(slices.IsSortedFunc(manifest.Metrics, func(a, b *metricshub.Definition) int {
+		return strings.Compare(a.Name, b.Name)
+	}))
+	definitions := map[string]*metricshub.Definition{}
+	for _, d := range manifest.Metrics {
+		definitions[d.Name] = d
+	}
+	assert.Contains(definitions, "ai_gateway_residency_enforcements")
+
+	// every metric exposed is in the manifest with the same type and labels.
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(err)
+	exposed := 0
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "ai_gateway_") {
+			continue
+		}
+		exposed++
+		d, ok := definitions[family.GetName()]
+		if !assert.True(ok, "metric %s is not in the manifest", family.GetName()) {
+			continue
+		}
+		assert.Equal(d.Type, strings.ToLower(family.GetType().String()), d.Name)
+		labels := []string{}
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			labels = append(labels, label.GetName())
+		}
+		expected := slices.Clone(d.Labels)
+		slices.Sort(expected)
+		assert.Equal(expected, labels, d.Name)
+	}
+	assert.NotZero(exposed)
+}
+
+func TestExemplars(t *testing.T) {
+	assert := assert.New(t)
+
+	hub := newTestHub(t)
+	defer hub.Close()
+	hub.Update(&metricshub.Metric{
+		Success:      true,
+		Duration:     120,
+		Provider:     "openai",
+		ProviderType: "openai",
+		InputTokens:  100,
+		OutputTokens: 20,
+		Model:        "exemplars",
+		TraceID:      "4bf92f3577b34da6a3ce929d0e0e4736",
+	})
+	// the requests not traced carry no exemplars.
+	hub.Update(&metricshub.Metric{
+		Success:      true,
+		Duration:     120,
+		Provider:     "openai",
+		ProviderType: "openai",
+		Model:        "untraced",
+	})
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(err)
+	exemplars := func(name, model string) []*dto.Exemplar {
+		result := []*dto.Exemplar{}
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				if !slices.ContainsFunc(m.GetLabel(), func(l *dto.LabelPair) bool {
+					return l.GetName() == "model" && l.GetValue() == model
+				}) {
+					continue
+				}
+				if e := m.GetCounter().GetExemplar(); e != nil {
+					result = append(result, e)
+				}
+				for _, b := range m.GetHistogram().GetBucket() {
+					if e := b.GetExemplar(); e != nil {
+						result = append(result, e)
+					}
+				}
+			}
+		}
+		return result
+	}
+
+	for _, d := range []*metricshub.Definition{
+		metricshub.RequestDuration, metricshub.PromptTokens,
+		metricshub.CompletionTokens, metricshub.RequestTokens,
+	} {
+		assert.True(d.Exemplars)
+		list := exemplars(d.Name, "exemplars")
+		if !assert.NotEmpty(list, d.Name) {
+			continue
+		}
+		for _, e := range list {
+			assert.Equal(metricshub.ExemplarTraceIDLabel, e.GetLabel()[0].GetName())
+			assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", e.GetLabel()[0].GetValue())
+		}
+		assert.Empty(exemplars(d.Name, "untraced"), d.Name)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metricshub
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// requestCollector collects the request metrics, which carry the
+	// custom labels besides the metric labels. A registry never accepts a
+	// metric with different label names once it is registered, so the
+	// collector is unchecked, and the metrics are replaced when the custom
+	// labels change.
+	requestCollector struct {
+		lock    sync.Mutex
+		current atomic.Pointer[requestMetrics]
+	}
+
+	// requestMetrics are the request counters and duration histogram of
+	// a set of custom labels.
+	requestMetrics struct {
+		commonLabels prometheus.Labels
+		customLabels []string
+
+		totalRequestVec    *prometheus.CounterVec
+		successRequestVec  *prometheus.CounterVec
+		failedRequestVec   *prometheus.CounterVec
+		requestDurationVec *prometheus.HistogramVec
+
+		// the metrics curried with the common labels.
+		totalRequest    *prometheus.CounterVec
+		successRequest  *prometheus.CounterVec
+		failedRequest   *prometheus.CounterVec
+		requestDuration prometheus.ObserverVec
+	}
+)
+
+var (
+	requestMetricsOnce      sync.Once
+	requestMetricsCollector = &requestCollector{}
+)
+
+// requestLabels returns the labels of the request metrics, the custom
+// labels are appended to them.
+func requestLabels() []string {
+	return []string{
+		// common labels
+		"kind", "clusterName", "clusterRole", "instanceName",
+		// metric labels
+		"provider", "providerType", "baseUrl", "model", "respType",
+	}
+}
+
+// ReservedLabels returns the labels which can not be used as custom
+// labels.
+func ReservedLabels() []string {
+	return append(requestLabels(), "error")
+}
+
+// initRequestMetrics registers the request metrics without custom labels,
+// they are shared by all hubs like the other metrics.
+func initRequestMetrics(commonLabels prometheus.Labels) {
+	requestMetricsOnce.Do(func() {
+		requestMetricsCollector.current.Store(newRequestMetrics(commonLabels, nil))
+		prometheus.MustRegister(requestMetricsCollector)
+	})
+}
+
+func newRequestMetrics(commonLabels prometheus.Labels, customLabels []string) *requestMetrics {
+	labels := append(requestLabels(), customLabels...)
+	rm := &requestMetrics{
+		commonLabels:       commonLabels,
+		customLabels:       customLabels,
+		totalRequestVec:    prometheus.NewCounterVec(TotalRequests.counterOpts(), labels),
+		successRequestVec:  prometheus.NewCounterVec(SuccessRequests.counterOpts(), labels),
+		failedRequestVec:   prometheus.NewCounterVec(FailedRequests.counterOpts(), append(slices.Clone(labels), "error")),
+		requestDurationVec: prometheus.NewHistogramVec(RequestDuration.histogramOpts(), labels),
+	}
+	rm.totalRequest = rm.totalRequestVec.MustCurryWith(commonLabels)
+	rm.successRequest = rm.successRequestVec.MustCurryWith(commonLabels)
+	rm.failedRequest = rm.failedRequestVec.MustCurryWith(commonLabels)
+	rm.requestDuration = rm.requestDurationVec.MustCurryWith(commonLabels)
+	return rm
+}
+
+// Describe describes nothing, so the collector is unchecked.
+func (c *requestCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect collects the current request metrics.
+func (c *requestCollector) Collect(ch chan<- prometheus.Metric) {
+	rm := c.current.Load()
+	if rm == nil {
+		return
+	}
+	rm.totalRequestVec.Collect(ch)
+	rm.successRequestVec.Collect(ch)
+	rm.failedRequestVec.Collect(ch)
+	rm.requestDurationVec.Collect(ch)
+}
+
+// SetCustomLabels sets the names of the custom labels of the request
+// metrics. The metrics are replaced if the names change, so their series
+// with the previous labels are dropped.
+func (m *MetricsHub) SetCustomLabels(names []string) {
+	c := requestMetricsCollector
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	current := c.current.Load()
+	if slices.Equal(current.customLabels, names) {
+		return
+	}
+	c.current.Store(newRequestMetrics(current.commonLabels, slices.Clone(names)))
+	logger.Infof("AIGatewayController MetricsHub custom labels set to %v", names)
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	citationFormatAnnotations = "annotations"
+	citationFormatMarkdown    = "markdown"
+
+	citationDefaultMaxCitations = 5
+)
+
+type (
+	// CitationSpec defines how the citations of the injected documents are
+	// appended to the response.
+	CitationSpec struct {
+		// Format is annotations or markdown, annotations appends OpenAI-style
+		// url_citation annotations to the message, markdown appends a
+		// footer listing the sources to the content.
+		Format       string `json:"format,omitempty" jsonschema:"enum=,enum=annotations,enum=markdown"`
+		MaxCitations int    `json:"maxCitations,omitempty"`
+		// ConsumerFormats overrides the format of the consumers, which
+		// are the consumers authenticated by AIGatewayController, or
+		// the consumers in ConsumerHeader if the consumers are not
+		// managed by the controller.
+		ConsumerHeader  string            `json:"consumerHeader,omitempty"`
+		ConsumerFormats map[string]string `json:"consumerFormats,omitempty"`
+	}
+)
+
+func validateCitationFormat(format string) error {
+	switch format {
+	case "", citationFormatAnnotations, citationFormatMarkdown:
+		return nil
+	default:
+		return fmt.Errorf("invalid citation format %s", format)
+	}
+}
+
+func validateCitationSpec(spec *CitationSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if err := validateCitationFormat(spec.Format); err != nil {
+		return err
+	}
+	if spec.MaxCitations < 0 {
+		return fmt.Errorf("maxCitations must not be negative")
+	}
+	for consumer, format := range spec.ConsumerFormats {
+		if err := validateCitationFormat(format); err != nil {
+			return fmt.Errorf("consumer %s: %w", consumer, err)
+		}
+	}
+	return nil
+}
+
+// getFormat returns the citation format of the consumer of the request.
+func (spec *CitationSpec) getFormat(ctx *aicontext.Context) string {
+	if format := spec.ConsumerFormats[ctx.ConsumerID(spec.ConsumerHeader)]; format != "" {
+		return format
+	}
+	if spec.Format == "" {
+		return citationFormatAnnotations
+	}
+	return spec.Format
+}
+
+// getCitations returns the deduplicated citations of the context.
+func (spec *CitationSpec) getCitations(ctx *aicontext.Context) []*aicontext.Citation {
+	maxCitations := spec.MaxCitations
+	if maxCitations == 0 {
+		maxCitations = citationDefaultMaxCitations
+	}
+	seen := map[string]struct{}{}
+	var citations []*aicontext.Citation
+	for _, citation := range ctx.Citations() {
+		key := citation.Source
+		if key == "" {
+			key = citation.ID
+		}
+		if key == "" {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		citations = append(citations, citation)
+		if len(citations) == maxCitations {
+			break
+		}
+	}
+	return citations
+}
+
+func citationURL(citation *aicontext.Citation) string {
+	if citation.Source != "" {
+		return citation.Source
+	}
+	return citation.ID
+}
+
+func citationAnnotations(citations []*aicontext.Citation) []any {
+	annotations := make([]any, 0, len(citations))
+	for _, citation := range citations {
+		urlCitation := map[string]any{"url": citationURL(citation)}
+		if citation.Title != "" {
+			urlCitation["title"] = citation.Title
+		}
+		annotations = append(annotations, map[string]any{
+			"type":         "url_citation",
+			"url_citation": urlCitation,
+		})
+	}
+	return annotations
+}
+
+func citationFooter(citations []*aicontext.Citation) string {
+	var sb strings.Builder
+	sb.WriteString("\n\nSources:")
+	for i, citation := range citations {
+		sb.WriteString("\n" + strconv.Itoa(i+1) + ". ")
+		if citation.Title != "" {
+			sb.WriteString("[" + citation.Title + "](" + citationURL(citation) + ")")
+		} else {
+			sb.WriteString(citationURL(citation))
+		}
+	}
+	return sb.String()
+}
+
+// appendCitations appends the citations to the response, to the messages
+// of a non-streaming response, or as a final chunk of a streaming response.
+func appendCitations(ctx *aicontext.Context, spec *CitationSpec) {
+	resp := ctx.GetResponse()
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+	citations := spec.getCitations(ctx)
+	if len(citations) == 0 {
+		return
+	}
+	format := spec.getFormat(ctx)
+
+	if ctx.ReqInfo.Stream {
+		if resp.BodyReader != nil {
+			resp.BodyReader = newCitationStreamReader(resp.BodyReader, format, citations)
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+		return
+	}
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		logger.Errorf("failed to read response for citations: %v", err)
+		return
+	}
+	completion := map[string]any{}
+	if err := codectool.UnmarshalJSON(body, &completion); err != nil {
+		logger.Errorf("failed to unmarshal response for citations: %v", err)
+		return
+	}
+	choices, _ := completion["choices"].([]any)
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]any)
+		message, _ := choice["message"].(map[string]any)
+		if message == nil {
+			continue
+		}
+		if format == citationFormatMarkdown {
+			content, _ := message["content"].(string)
+			message["content"] = content + citationFooter(citations)
+		} else {
+			annotations, _ := message["annotations"].([]any)
+			message["annotations"] = append(annotations, citationAnnotations(citations)...)
+		}
+	}
+	data, err := codectool.MarshalJSON(completion)
+	if err != nil {
+		logger.Errorf("failed to marshal response for citations: %v", err)
+		return
+	}
+	setResponseBody(resp, data)
+}
+
+// citationStream appends the citations as the final chunk of a stream,
+// before the [DONE] event.
+type citationStream struct {
+	format    string
+	citations []*aicontext.Citation
+	// last is the last chunk, the final chunk copies its id and model.
+	last     map[string]any
+	appended bool
+}
+
+func newCitationStreamReader(body io.Reader, format string, citations []*aicontext.Citation) *sseEventReader {
+	s := &citationStream{format: format, citations: citations}
+	return newSSEEventReader(body, s.processEvent, s.finish)
+}
+
+func (s *citationStream) processEvent(event []byte, out *bytes.Buffer) bool {
+	if isSSEDoneEvent(event) {
+		s.finish(out)
+		out.Write(event)
+		return true
+	}
+	if data, ok := sseEventData(event); ok {
+		chunk := map[string]any{}
+		if err := codectool.UnmarshalJSON(data, &chunk); err == nil {
+			s.last = chunk
+		}
+	}
+	out.Write(event)
+	return true
+}
+
+// finish writes the citations chunk.
+func (s *citationStream) finish(out *bytes.Buffer) {
+	if s.appended {
+		return
+	}
+	s.appended = true
+
+	delta := map[string]any{}
+	if s.format == citationFormatMarkdown {
+		delta["content"] = citationFooter(s.citations)
+	} else {
+		delta["annotations"] = citationAnnotations(s.citations)
+	}
+	chunk := map[string]any{
+		"object": "chat.completion.chunk",
+		"choices": []any{
+			map[string]any{"index": 0, "delta": delta, "finish_reason": nil},
+		},
+	}
+	for _, key := range []string{"id", "created", "model", "system_fingerprint"} {
+		if v, ok := s.last[key]; ok {
+			chunk[key] = v
+		}
+	}
+	data, err := codectool.MarshalJSON(chunk)
+	if err != nil {
+		logger.Errorf("failed to marshal citations chunk: %v", err)
+		return
+	}
+	writeSSEEvent(out, data)
+}
@@ -0,0 +1,615 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	toolPolicyActionReject  = "reject"
+	toolPolicyActionReplace = "replace"
+
+	toolPolicyDirectionRequest  = "request"
+	toolPolicyDirectionResponse = "response"
+)
+
+type (
+	// ConsumerPolicySpec defines the policies of consumer groups. The
+	// consumer of a request is the one authenticated by the consumer keys
+	// of AIGatewayController, whose group takes precedence over the
+	// consumers of the groups. If the consumers are not managed by the
+	// controller, the consumer and its group are identified by request
+	// headers, which are usually set by the authentication filters.
+	ConsumerPolicySpec struct {
+		ConsumerHeader string `json:"consumerHeader,omitempty"`
+		GroupHeader    string `json:"groupHeader,omitempty"`
+		// DefaultGroup is the group of the consumers not in any group,
+		// no policy is applied to them if it is empty.
+		DefaultGroup string           `json:"defaultGroup,omitempty"`
+		Groups       []*ConsumerGroup `json:"groups" jsonschema:"required"`
+	}
+
+	// ConsumerGroup is a group of consumers sharing the same policy.
+	ConsumerGroup struct {
+		Name       string          `json:"name" jsonschema:"required"`
+		Consumers  []string        `json:"consumers,omitempty"`
+		ToolPolicy *ToolPolicySpec `json:"toolPolicy,omitempty"`
+	}
+
+	// ToolPolicySpec limits the tools a consumer group can use. Allow and
+	// Deny are tool names or glob patterns like "execute_*", a tool is
+	// allowed if it matches no deny pattern, and it matches an allow pattern
+	// or Allow is empty.
+	ToolPolicySpec struct {
+		Allow []string `json:"allow,omitempty"`
+		Deny  []string `json:"deny,omitempty"`
+		// OnViolation is the action on violations, reject rejects the
+		// request or the response, replace removes the blocked tools from
+		// the request and replaces the blocked tool calls of the response
+		// with a policy violation message.
+		OnViolation string `json:"onViolation,omitempty" jsonschema:"enum=,enum=reject,enum=replace"`
+	}
+
+	consumerPolicyMiddleware struct {
+		spec       *MiddlewareSpec
+		groups     map[string]*ConsumerGroup
+		consumers  map[string]*ConsumerGroup
+		violations *prometheus.CounterVec
+	}
+
+	// toolPolicyViolation is a tool blocked by the tool policy.
+	toolPolicyViolation struct {
+		tool      string
+		direction string
+	}
+)
+
+func init() {
+	middlewareTypeRegistry[consumerPolicyMiddlewareKind] = reflect.TypeOf(consumerPolicyMiddleware{})
+}
+
+var (
+	_ Middleware = (*consumerPolicyMiddleware)(nil)
+	_ Simulator  = (*consumerPolicyMiddleware)(nil)
+)
+
+// Skippable returns whether consumers may skip the middleware. The
+// policies of consumers are never skippable, or consumers could lift them
+// by themselves, nor are the PII tokenizers, or the PII would reach the
+// providers and the semantic caches. The authentication and the rate limit
+// are not middlewares, so they are never skippable either.
+func Skippable(spec *MiddlewareSpec) bool {
+	return spec.Kind != consumerPolicyMiddlewareKind && spec.Kind != piiTokenizerMiddlewareKind
+}
+
+func (m *consumerPolicyMiddleware) init(spec *MiddlewareSpec) {
+	m.spec = spec
+	m.groups = map[string]*ConsumerGroup{}
+	m.consumers = map[string]*ConsumerGroup{}
+	for _, group := range spec.ConsumerPolicy.Groups {
+		m.groups[group.Name] = group
+		for _, consumer := range group.Consumers {
+			m.consumers[consumer] = group
+		}
+	}
+	m.violations = metricshub.ToolPolicyViolations.NewCounter()
+}
+
+func (m *consumerPolicyMiddleware) validate(spec *MiddlewareSpec) error {
+	policy := spec.ConsumerPolicy
+	if policy == nil {
+		return fmt.Errorf("consumerPolicy middleware %s must have a consumerPolicy spec", spec.Name)
+	}
+	if len(policy.Groups) == 0 {
+		return fmt.Errorf("consumerPolicy middleware %s must have at least one group", spec.Name)
+	}
+	groups := map[string]struct{}{}
+	consumers := map[string]struct{}{}
+	for _, group := range policy.Groups {
+		if group.Name == "" {
+			return fmt.Errorf("consumerPolicy middleware %s has a group without name", spec.Name)
+		}
+		if _, ok := groups[group.Name]; ok {
+			return fmt.Errorf("consumerPolicy middleware %s has duplicated group %s", spec.Name, group.Name)
+		}
+		groups[group.Name] = struct{}{}
+		for _, consumer := range group.Consumers {
+			if _, ok := consumers[consumer]; ok {
+				return fmt.Errorf("consumer %s of consumerPolicy middleware %s is in more than one group", consumer, spec.Name)
+			}
+			consumers[consumer] = struct{}{}
+		}
+		if err := validateToolPolicy(group.ToolPolicy); err != nil {
+			return fmt.Errorf("group %s of consumerPolicy middleware %s has invalid tool policy: %w", group.Name, spec.Name, err)
+		}
+	}
+	if policy.DefaultGroup != "" {
+		if _, ok := groups[policy.DefaultGroup]; !ok {
+			return fmt.Errorf("default group %s of consumerPolicy middleware %s not found", policy.DefaultGroup, spec.Name)
+		}
+	}
+	return nil
+}
+
+func validateToolPolicy(spec *ToolPolicySpec) error {
+	if spec == nil {
+		return nil
+	}
+	for _, pattern := range append(append([]string{}, spec.Allow...), spec.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid tool pattern %s: %w", pattern, err)
+		}
+	}
+	switch spec.OnViolation {
+	case "", toolPolicyActionReject, toolPolicyActionReplace:
+	default:
+		return fmt.Errorf("invalid onViolation %s", spec.OnViolation)
+	}
+	return nil
+}
+
+func (m *consumerPolicyMiddleware) Name() string {
+	return m.spec.Name
+}
+
+func (m *consumerPolicyMiddleware) Kind() string {
+	return consumerPolicyMiddlewareKind
+}
+
+func (m *consumerPolicyMiddleware) Spec() *MiddlewareSpec {
+	return m.spec
+}
+
+// getGroup returns the group of the consumer of the request.
+func (m *consumerPolicyMiddleware) getGroup(ctx *aicontext.Context) (string, *ConsumerGroup) {
+	consumer := ctx.ConsumerID(m.spec.ConsumerPolicy.ConsumerHeader)
+	if group, ok := m.groups[ctx.ConsumerGroup(m.spec.ConsumerPolicy.GroupHeader)]; ok {
+		return consumer, group
+	}
+	if group, ok := m.consumers[consumer]; ok {
+		return consumer, group
+	}
+	return consumer, m.groups[m.spec.ConsumerPolicy.DefaultGroup]
+}
+
+// allowed checks whether the tool is allowed by the policy.
+func (spec *ToolPolicySpec) allowed(tool string) bool {
+	for _, pattern := range spec.Deny {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return false
+		}
+	}
+	if len(spec.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range spec.Allow {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (spec *ToolPolicySpec) action() string {
+	if spec.OnViolation == "" {
+		return toolPolicyActionReject
+	}
+	return spec.OnViolation
+}
+
+func (m *consumerPolicyMiddleware) Handle(ctx *aicontext.Context) {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions {
+		return
+	}
+	consumer, group := m.getGroup(ctx)
+	if group == nil || group.ToolPolicy == nil {
+		return
+	}
+
+	policy := group.ToolPolicy
+	report := func(v *toolPolicyViolation) {
+		m.report(ctx, consumer, group, v)
+	}
+	if !m.checkRequestTools(ctx, policy, report) {
+		return
+	}
+	ctx.OnResponse(func(ctx *aicontext.Context) {
+		checkResponseToolCalls(ctx, policy, report)
+	})
+}
+
+// Simulate reports the group of the consumer and its tool policy, the
+// request is rejected by the policy only for its tools, which are not
+// known by simulations.
+func (m *consumerPolicyMiddleware) Simulate(ctx *aicontext.Context) *SimulationStep {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions {
+		return &SimulationStep{Decision: SimulationSkip, Detail: "only chat completions are checked"}
+	}
+	consumer, group := m.getGroup(ctx)
+	if group == nil {
+		return &SimulationStep{Decision: SimulationSkip, Detail: fmt.Sprintf("consumer %q is in no group", consumer)}
+	}
+	step := &SimulationStep{
+		Decision: SimulationPass,
+		Rules:    []string{fmt.Sprintf("middlewares[%s].consumerPolicy.groups[%s]", m.spec.Name, group.Name)},
+	}
+	if group.ToolPolicy == nil {
+		step.Detail = fmt.Sprintf("consumer %q is in group %s without tool policy", consumer, group.Name)
+		return step
+	}
+	step.Detail = fmt.Sprintf("consumer %q is in group %s, the tools of the request and the tool calls of the response violating its tool policy are handled by %s",
+		consumer, group.Name, group.ToolPolicy.action())
+	return step
+}
+
+// report records the violation to the metrics, the access log and the log.
+func (m *consumerPolicyMiddleware) report(ctx *aicontext.Context, consumer string, group *ConsumerGroup, v *toolPolicyViolation) {
+	action := group.ToolPolicy.action()
+	if m.violations != nil {
+		m.violations.With(prometheus.Labels{
+			"middleware": m.spec.Name,
+			"group":      group.Name,
+			"direction":  v.direction,
+			"action":     action,
+		}).Inc()
+	}
+	ctx.Ctx.AddTag(fmt.Sprintf("consumerPolicy %s: tool %s blocked in %s, action %s", m.spec.Name, v.tool, v.direction, action))
+	logger.Warnf("tool policy violation: middleware %s, consumer %q, group %s, tool %q, direction %s, action %s",
+		m.spec.Name, consumer, group.Name, v.tool, v.direction, action)
+}
+
+// checkRequestTools checks the tools declared by the request, it returns
+// false if the request is rejected.
+func (m *consumerPolicyMiddleware) checkRequestTools(ctx *aicontext.Context, policy *ToolPolicySpec, report func(*toolPolicyViolation)) bool {
+	var blocked []string
+	filter := func(key string, getName func(item map[string]any) string) {
+		items, ok := ctx.OpenAIReq[key].([]any)
+		if !ok {
+			return
+		}
+		kept := make([]any, 0, len(items))
+		for _, item := range items {
+			tool, _ := item.(map[string]any)
+			name := getName(tool)
+			if policy.allowed(name) {
+				kept = append(kept, item)
+				continue
+			}
+			blocked = append(blocked, name)
+			report(&toolPolicyViolation{tool: name, direction: toolPolicyDirectionRequest})
+		}
+		if len(kept) == 0 {
+			delete(ctx.OpenAIReq, key)
+		} else {
+			ctx.OpenAIReq[key] = kept
+		}
+	}
+	filter("tools", func(tool map[string]any) string {
+		function, _ := tool["function"].(map[string]any)
+		name, _ := function["name"].(string)
+		return name
+	})
+	// functions is the deprecated version of tools.
+	filter("functions", func(function map[string]any) string {
+		name, _ := function["name"].(string)
+		return name
+	})
+	if len(blocked) == 0 {
+		return true
+	}
+
+	if policy.action() == toolPolicyActionReject {
+		setToolPolicyErrResponse(ctx, fmt.Sprintf("request is rejected, tool %s is not allowed", blocked[0]))
+		return false
+	}
+
+	// the blocked tools are removed, so the choices referring to them are
+	// removed too.
+	if _, ok := ctx.OpenAIReq["tools"]; !ok {
+		delete(ctx.OpenAIReq, "tool_choice")
+		delete(ctx.OpenAIReq, "parallel_tool_calls")
+	} else if choice, ok := ctx.OpenAIReq["tool_choice"].(map[string]any); ok {
+		function, _ := choice["function"].(map[string]any)
+		if name, _ := function["name"].(string); !policy.allowed(name) {
+			delete(ctx.OpenAIReq, "tool_choice")
+		}
+	}
+	if _, ok := ctx.OpenAIReq["functions"]; !ok {
+		delete(ctx.OpenAIReq, "function_call")
+	}
+	body, err := codectool.MarshalJSON(ctx.OpenAIReq)
+	if err != nil {
+		logger.Errorf("failed to marshal request of consumerPolicy middleware %s: %v", m.spec.Name, err)
+		setToolPolicyErrResponse(ctx, "request is rejected, it uses tools not allowed")
+		return false
+	}
+	ctx.ReqBody = body
+	return true
+}
+
+func setToolPolicyErrResponse(ctx *aicontext.Context, msg string) {
+	errMsg := protocol.NewError(http.StatusForbidden, msg)
+	data, _ := codectool.MarshalJSON(errMsg)
+	ctx.SetResponse(&aicontext.Response{
+		StatusCode:    http.StatusForbidden,
+		ContentLength: int64(len(data)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		BodyBytes:     data,
+	})
+	ctx.Stop(aicontext.ResultMiddlewareError)
+}
+
+func toolPolicyViolationMessage(tool string) string {
+	return fmt.Sprintf("[tool call %s is blocked by policy]", tool)
+}
+
+// checkResponseToolCalls checks the tool calls returned by the model.
+func checkResponseToolCalls(ctx *aicontext.Context, policy *ToolPolicySpec, report func(*toolPolicyViolation)) {
+	resp := ctx.GetResponse()
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if ctx.ReqInfo.Stream {
+		if resp.BodyReader != nil {
+			resp.BodyReader = newToolPolicyStreamReader(resp.BodyReader, policy, report)
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+		return
+	}
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		logger.Errorf("failed to read response for tool policy: %v", err)
+		setToolPolicyErrResponse(ctx, "failed to check tool calls of the response")
+		return
+	}
+
+	completion := map[string]any{}
+	if err := codectool.UnmarshalJSON(body, &completion); err != nil {
+		logger.Errorf("failed to unmarshal response for tool policy: %v", err)
+		return
+	}
+	choices, _ := completion["choices"].([]any)
+	var blocked []string
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]any)
+		message, _ := choice["message"].(map[string]any)
+		if message == nil {
+			continue
+		}
+		names := filterToolCalls(message, policy)
+		for _, name := range names {
+			report(&toolPolicyViolation{tool: name, direction: toolPolicyDirectionResponse})
+		}
+		if len(names) > 0 && message["tool_calls"] == nil && message["function_call"] == nil {
+			choice["finish_reason"] = "stop"
+		}
+		blocked = append(blocked, names...)
+	}
+	if len(blocked) == 0 {
+		return
+	}
+
+	if policy.action() == toolPolicyActionReject {
+		setToolPolicyErrResponse(ctx, fmt.Sprintf("response is rejected, tool %s is not allowed", blocked[0]))
+		return
+	}
+	data, err := codectool.MarshalJSON(completion)
+	if err != nil {
+		logger.Errorf("failed to marshal response for tool policy: %v", err)
+		setToolPolicyErrResponse(ctx, "failed to check tool calls of the response")
+		return
+	}
+	setResponseBody(resp, data)
+}
+
+// filterToolCalls removes the blocked tool calls from the message, and
+// appends the violation messages to the content. It returns the names of
+// the blocked tools.
+func filterToolCalls(message map[string]any, policy *ToolPolicySpec) []string {
+	var blocked []string
+	if calls, ok := message["tool_calls"].([]any); ok {
+		kept := make([]any, 0, len(calls))
+		for _, call := range calls {
+			c, _ := call.(map[string]any)
+			function, _ := c["function"].(map[string]any)
+			name, _ := function["name"].(string)
+			if policy.allowed(name) {
+				kept = append(kept, call)
+				continue
+			}
+			blocked = append(blocked, name)
+		}
+		if len(kept) == 0 {
+			delete(message, "tool_calls")
+		} else {
+			message["tool_calls"] = kept
+		}
+	}
+	// function_call is the deprecated version of tool_calls.
+	if call, ok := message["function_call"].(map[string]any); ok {
+		name, _ := call["name"].(string)
+		if !policy.allowed(name) {
+			blocked = append(blocked, name)
+			delete(message, "function_call")
+		}
+	}
+
+	if len(blocked) > 0 {
+		content, _ := message["content"].(string)
+		for _, name := range blocked {
+			if content != "" {
+				content += "\n"
+			}
+			content += toolPolicyViolationMessage(name)
+		}
+		message["content"] = content
+	}
+	return blocked
+}
+
+// toolPolicyStream checks the tool calls in a streaming response. The
+// name of a tool call only comes with its first delta, so it remembers the
+// blocked tool calls by their indexes, and removes all their deltas.
+type toolPolicyStream struct {
+	policy *ToolPolicySpec
+	report func(*toolPolicyViolation)
+
+	// blocked is the blocked tool calls by choice and tool call index.
+	blocked map[string]bool
+	// allowed is the choices having allowed tool calls.
+	allowed map[float64]bool
+}
+
+func newToolPolicyStreamReader(body io.Reader, policy *ToolPolicySpec, report func(*toolPolicyViolation)) io.Reader {
+	s := &toolPolicyStream{
+		policy:  policy,
+		report:  report,
+		blocked: map[string]bool{},
+		allowed: map[float64]bool{},
+	}
+	return newSSEEventReader(body, s.processEvent, nil)
+}
+
+func (r *toolPolicyStream) processEvent(event []byte, out *bytes.Buffer) bool {
+	data, ok := sseEventData(event)
+	if !ok {
+		out.Write(event)
+		return true
+	}
+	chunk := map[string]any{}
+	if err := codectool.UnmarshalJSON(data, &chunk); err != nil {
+		out.Write(event)
+		return true
+	}
+
+	modified := false
+	choices, _ := chunk["choices"].([]any)
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]any)
+		delta, _ := choice["delta"].(map[string]any)
+		choiceIndex, _ := choice["index"].(float64)
+		if delta != nil {
+			blocked, changed := r.filterDelta(choiceIndex, delta)
+			modified = modified || changed
+			for _, name := range blocked {
+				r.report(&toolPolicyViolation{tool: name, direction: toolPolicyDirectionResponse})
+				if r.policy.action() == toolPolicyActionReject {
+					// end the stream with an error event.
+					errMsg := protocol.NewError(http.StatusForbidden, fmt.Sprintf("response is rejected, tool %s is not allowed", name))
+					data, _ := codectool.MarshalJSON(errMsg)
+					writeSSEEvent(out, data)
+					return false
+				}
+			}
+		}
+		// all tool calls of the choice are blocked.
+		if reason, _ := choice["finish_reason"].(string); (reason == "tool_calls" || reason == "function_call") && !r.allowed[choiceIndex] {
+			choice["finish_reason"] = "stop"
+			modified = true
+		}
+	}
+	if !modified {
+		out.Write(event)
+		return true
+	}
+	data, err := codectool.MarshalJSON(chunk)
+	if err != nil {
+		out.Write(event)
+		return true
+	}
+	writeSSEEvent(out, data)
+	return true
+}
+
+// filterDelta removes the deltas of blocked tool calls, it returns the
+// newly blocked tools and whether the delta is changed.
+func (r *toolPolicyStream) filterDelta(choiceIndex float64, delta map[string]any) ([]string, bool) {
+	var blocked []string
+	changed := false
+	if calls, ok := delta["tool_calls"].([]any); ok {
+		kept := make([]any, 0, len(calls))
+		for _, call := range calls {
+			c, _ := call.(map[string]any)
+			index, _ := c["index"].(float64)
+			key := strconv.FormatFloat(choiceIndex, 'f', -1, 64) + "/" + strconv.FormatFloat(index, 'f', -1, 64)
+			function, _ := c["function"].(map[string]any)
+			if name, ok := function["name"].(string); ok && name != "" {
+				if !r.policy.allowed(name) {
+					r.blocked[key] = true
+					blocked = append(blocked, name)
+				} else {
+					r.allowed[choiceIndex] = true
+				}
+			}
+			if r.blocked[key] {
+				continue
+			}
+			kept = append(kept, call)
+		}
+		if len(kept) != len(calls) {
+			changed = true
+			if len(kept) == 0 {
+				delete(delta, "tool_calls")
+			} else {
+				delta["tool_calls"] = kept
+			}
+		}
+	}
+	if call, ok := delta["function_call"].(map[string]any); ok {
+		key := strconv.FormatFloat(choiceIndex, 'f', -1, 64) + "/function_call"
+		if name, ok := call["name"].(string); ok && name != "" {
+			if !r.policy.allowed(name) {
+				r.blocked[key] = true
+				blocked = append(blocked, name)
+			} else {
+				r.allowed[choiceIndex] = true
+			}
+		}
+		if r.blocked[key] {
+			delete(delta, "function_call")
+			changed = true
+		}
+	}
+
+	if len(blocked) > 0 {
+		messages := make([]string, 0, len(blocked))
+		for _, name := range blocked {
+			messages = append(messages, toolPolicyViolationMessage(name))
+		}
+		content, _ := delta["content"].(string)
+		delta["content"] = content + strings.Join(messages, "\n")
+	}
+	return blocked, changed
+}
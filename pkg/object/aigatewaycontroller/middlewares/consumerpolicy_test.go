@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func newConsumerPolicyMiddleware(t *testing.T, onViolation string) *consumerPolicyMiddleware {
+	spec := &MiddlewareSpec{
+		Name: "test-consumer-policy",
+		Kind: consumerPolicyMiddlewareKind,
+		ConsumerPolicy: &ConsumerPolicySpec{
+			ConsumerHeader: "X-Consumer",
+			DefaultGroup:   "others",
+			Groups: []*ConsumerGroup{
+				{
+					Name:      "analysts",
+					Consumers: []string{"alice"},
+					ToolPolicy: &ToolPolicySpec{
+						Allow:       []string{"execute_sql", "get_*"},
+						OnViolation: onViolation,
+					},
+				},
+				{
+					Name: "others",
+					ToolPolicy: &ToolPolicySpec{
+						Deny:        []string{"execute_*"},
+						OnViolation: onViolation,
+					},
+				},
+			},
+		},
+	}
+	assert.Nil(t, ValidateSpec(spec))
+	m := &consumerPolicyMiddleware{}
+	m.init(spec)
+	return m
+}
+
+func newToolPolicyContext(t *testing.T, consumer string, stream bool, tools ...string) *aicontext.Context {
+	toolDefs := []map[string]any{}
+	for _, tool := range tools {
+		toolDefs = append(toolDefs, map[string]any{
+			"type":     "function",
+			"function": map[string]any{"name": tool},
+		})
+	}
+	data := map[string]any{
+		"model":    "gpt-4.1",
+		"stream":   stream,
+		"messages": []map[string]any{{"role": "user", "content": "hello"}},
+		"tools":    toolDefs,
+	}
+	jsonData, err := json.Marshal(data)
+	assert.Nil(t, err)
+
+	ctx := context.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+	assert.Nil(t, err)
+	req.Header.Set("X-Consumer", consumer)
+	setRequest(t, ctx, "consumer.policy", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+	assert.Nil(t, err)
+	return aiCtx
+}
+
+func setToolPolicyResponse(aiCtx *aicontext.Context, body string) {
+	aiCtx.SetResponse(&aicontext.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: int64(len(body)),
+		Header:        http.Header{"Content-Length": []string{"100"}},
+		BodyReader:    io.NopCloser(strings.NewReader(body)),
+	})
+	for _, handler := range aiCtx.ResponseHandlers() {
+		handler(aiCtx)
+	}
+}
+
+func TestConsumerPolicyValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test",
+		Kind: consumerPolicyMiddlewareKind,
+		ConsumerPolicy: &ConsumerPolicySpec{
+			ConsumerHeader: "X-Consumer",
+			Groups:         []*ConsumerGroup{{Name: "a", ToolPolicy: &ToolPolicySpec{Deny: []string{"[a-"}}}},
+		},
+	}
+	assert.Error(ValidateSpec(spec))
+	spec.ConsumerPolicy.Groups[0].ToolPolicy = &ToolPolicySpec{OnViolation: "drop"}
+	assert.Error(ValidateSpec(spec))
+	spec.ConsumerPolicy.Groups[0].ToolPolicy = &ToolPolicySpec{Deny: []string{"execute_*"}}
+	assert.NoError(ValidateSpec(spec))
+	spec.ConsumerPolicy.DefaultGroup = "b"
+	assert.Error(ValidateSpec(spec))
+	spec.ConsumerPolicy.DefaultGroup = ""
+	spec.ConsumerPolicy.Groups = append(spec.ConsumerPolicy.Groups, &ConsumerGroup{Name: "a"})
+	assert.Error(ValidateSpec(spec))
+
+	policy := &ToolPolicySpec{Allow: []string{"get_*"}, Deny: []string{"get_secret"}}
+	assert.True(policy.allowed("get_weather"))
+	assert.False(policy.allowed("get_secret"))
+	assert.False(policy.allowed("execute_sql"))
+}
+
+func TestConsumerPolicyRequestTools(t *testing.T) {
+	assert := assert.New(t)
+
+	{
+		// reject
+		m := newConsumerPolicyMiddleware(t, "")
+		aiCtx := newToolPolicyContext(t, "bob", false, "get_weather", "execute_sql")
+		m.Handle(aiCtx)
+		assert.True(aiCtx.IsStopped())
+		assert.Equal(http.StatusForbidden, aiCtx.GetResponse().StatusCode)
+		assert.Contains(string(aiCtx.GetResponse().BodyBytes), "execute_sql")
+
+		// alice is allowed to use execute_sql
+		aiCtx = newToolPolicyContext(t, "alice", false, "get_weather", "execute_sql")
+		m.Handle(aiCtx)
+		assert.False(aiCtx.IsStopped())
+	}
+
+	{
+		// the consumer authenticated by the controller is used instead of
+		// the header sent by the client.
+		m := newConsumerPolicyMiddleware(t, "")
+		aiCtx := newToolPolicyContext(t, "alice", false, "execute_sql")
+		aiCtx.Consumer = &aicontext.Consumer{ID: "bob"}
+		m.Handle(aiCtx)
+		assert.True(aiCtx.IsStopped())
+
+		// and so is its group.
+		aiCtx = newToolPolicyContext(t, "bob", false, "execute_sql")
+		aiCtx.Consumer = &aicontext.Consumer{ID: "bob", Group: "analysts"}
+		m.Handle(aiCtx)
+		assert.False(aiCtx.IsStopped())
+	}
+
+	{
+		// replace
+		m := newConsumerPolicyMiddleware(t, toolPolicyActionReplace)
+		aiCtx := newToolPolicyContext(t, "bob", false, "get_weather", "execute_sql")
+		m.Handle(aiCtx)
+		assert.False(aiCtx.IsStopped())
+		assert.NotContains(string(aiCtx.ReqBody), "execute_sql")
+		assert.Contains(string(aiCtx.ReqBody), "get_weather")
+
+		aiCtx = newToolPolicyContext(t, "bob", false, "execute_sql")
+		m.Handle(aiCtx)
+		assert.False(aiCtx.IsStopped())
+		assert.NotContains(string(aiCtx.ReqBody), "tools")
+	}
+}
+
+func TestConsumerPolicyResponseToolCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":null,` +
+		`"tool_calls":[{"id":"call_1","type":"function","function":{"name":"execute_sql","arguments":"{}"}}]}}]}`
+
+	{
+		m := newConsumerPolicyMiddleware(t, "")
+		aiCtx := newToolPolicyContext(t, "bob", false, "get_weather")
+		m.Handle(aiCtx)
+		setToolPolicyResponse(aiCtx, body)
+		assert.True(aiCtx.IsStopped())
+		assert.Equal(http.StatusForbidden, aiCtx.GetResponse().StatusCode)
+	}
+
+	{
+		m := newConsumerPolicyMiddleware(t, toolPolicyActionReplace)
+		aiCtx := newToolPolicyContext(t, "bob", false, "get_weather")
+		m.Handle(aiCtx)
+		setToolPolicyResponse(aiCtx, body)
+		assert.False(aiCtx.IsStopped())
+		resp := aiCtx.GetResponse()
+		assert.Empty(resp.Header.Get("Content-Length"))
+		assert.Equal(int64(len(resp.BodyBytes)), resp.ContentLength)
+
+		completion := map[string]any{}
+		assert.Nil(json.Unmarshal(resp.BodyBytes, &completion))
+		choice := completion["choices"].([]any)[0].(map[string]any)
+		assert.Equal("stop", choice["finish_reason"])
+		message := choice["message"].(map[string]any)
+		assert.Nil(message["tool_calls"])
+		assert.Equal(toolPolicyViolationMessage("execute_sql"), message["content"])
+	}
+
+	{
+		// allowed tool calls are not changed
+		m := newConsumerPolicyMiddleware(t, "")
+		aiCtx := newToolPolicyContext(t, "alice", false, "execute_sql")
+		m.Handle(aiCtx)
+		setToolPolicyResponse(aiCtx, body)
+		assert.False(aiCtx.IsStopped())
+		assert.Equal(body, string(aiCtx.GetResponse().BodyBytes))
+	}
+}
+
+func TestConsumerPolicyStreamToolCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	events := []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"execute_sql","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"function":{"arguments":"{\"q\":\"drop table\"}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+	}
+	var stream strings.Builder
+	for _, event := range events {
+		stream.WriteString("data: " + event + "\n\n")
+	}
+	stream.WriteString("data: [DONE]\n\n")
+
+	read := func(onViolation string) string {
+		m := newConsumerPolicyMiddleware(t, onViolation)
+		aiCtx := newToolPolicyContext(t, "bob", true, "get_weather")
+		m.Handle(aiCtx)
+		setToolPolicyResponse(aiCtx, stream.String())
+		resp := aiCtx.GetResponse()
+		assert.Equal(int64(-1), resp.ContentLength)
+		data, err := io.ReadAll(resp.BodyReader)
+		assert.Nil(err)
+		return string(data)
+	}
+
+	{
+		data := read(toolPolicyActionReplace)
+		assert.Contains(data, "get_weather")
+		assert.NotContains(data, "execute_sql\"")
+		assert.NotContains(data, "drop table")
+		assert.Contains(data, "is blocked by policy")
+		assert.Contains(data, `"finish_reason":"tool_calls"`)
+		assert.True(strings.HasSuffix(data, "data: [DONE]\n\n"))
+	}
+
+	{
+		data := read("")
+		assert.Contains(data, "get_weather")
+		assert.NotContains(data, "drop table")
+		assert.Contains(data, "response is rejected, tool execute_sql is not allowed")
+		assert.NotContains(data, "[DONE]")
+	}
+}
+
+func TestConsumerPolicyGroupHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newConsumerPolicyMiddleware(t, toolPolicyActionReject)
+	m.spec.ConsumerPolicy.GroupHeader = "X-Consumer-Group"
+
+	// the group in the header takes precedence over the spec.
+	aiCtx := newToolPolicyContext(t, "bob", false, "execute_sql")
+	aiCtx.Req.HTTPHeader().Set("X-Consumer-Group", "analysts")
+	_, group := m.getGroup(aiCtx)
+	assert.Equal("analysts", group.Name)
+
+	// unknown groups are ignored.
+	aiCtx.Req.HTTPHeader().Set("X-Consumer-Group", "admins")
+	_, group = m.getGroup(aiCtx)
+	assert.Equal("others", group.Name)
+
+	aiCtx = newToolPolicyContext(t, "alice", false, "execute_sql")
+	_, group = m.getGroup(aiCtx)
+	assert.Equal("analysts", group.Name)
+}
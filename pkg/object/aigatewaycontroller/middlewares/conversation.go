@@ -0,0 +1,451 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	conversationModeReject = "reject"
+	conversationModeRepair = "repair"
+
+	// rules of the conversation.
+	conversationRuleRole        = "role"
+	conversationRuleToolResult  = "toolResult"
+	conversationRuleToolCalls   = "toolCalls"
+	conversationRuleSystemFirst = "systemFirst"
+	conversationRuleFirstTurn   = "firstTurn"
+	conversationRuleAlternation = "alternation"
+
+	// actions of the repairs.
+	conversationActionReorder    = "reorder"
+	conversationActionSynthesize = "synthesize"
+	conversationActionMerge      = "merge"
+)
+
+// conversationStrictProviders are the provider types whose models require
+// the system messages to come first, and the conversation to start with a
+// user message and alternate between user and assistant messages.
+var conversationStrictProviders = map[string]bool{
+	"anthropic": true,
+	"bedrock":   true,
+	"cohere":    true,
+	"gemini":    true,
+}
+
+type (
+	// ConversationValidatorSpec defines the conversation validator
+	// middleware, it checks the roles of the messages against the rules of
+	// the provider, and rejects or repairs the invalid conversations.
+	ConversationValidatorSpec struct {
+		// Mode is reject or repair, reject is the default.
+		Mode string `json:"mode,omitempty" jsonschema:"enum=,enum=reject,enum=repair"`
+	}
+
+	conversationValidatorMiddleware struct {
+		spec *MiddlewareSpec
+		mode string
+	}
+
+	// conversationViolation is a message breaking a rule, index is the
+	// index of the message in the request.
+	conversationViolation struct {
+		index      int
+		rule       string
+		message    string
+		repairable bool
+	}
+
+	// conversationMessage is a message being repaired, index is the index
+	// of the message in the request.
+	conversationMessage struct {
+		index int
+		msg   map[string]any
+	}
+)
+
+func init() {
+	middlewareTypeRegistry[conversationValidatorMiddlewareKind] = reflect.TypeOf(conversationValidatorMiddleware{})
+}
+
+var _ Middleware = (*conversationValidatorMiddleware)(nil)
+
+func (m *conversationValidatorMiddleware) init(spec *MiddlewareSpec) {
+	m.spec = spec
+	m.mode = conversationModeReject
+	if spec.ConversationValidator != nil && spec.ConversationValidator.Mode != "" {
+		m.mode = spec.ConversationValidator.Mode
+	}
+}
+
+func (m *conversationValidatorMiddleware) validate(spec *MiddlewareSpec) error {
+	if spec.ConversationValidator == nil {
+		return nil
+	}
+	switch spec.ConversationValidator.Mode {
+	case "", conversationModeReject, conversationModeRepair:
+		return nil
+	default:
+		return fmt.Errorf("conversationValidator middleware %s has invalid mode %s", spec.Name, spec.ConversationValidator.Mode)
+	}
+}
+
+func (m *conversationValidatorMiddleware) Name() string {
+	return m.spec.Name
+}
+
+func (m *conversationValidatorMiddleware) Kind() string {
+	return conversationValidatorMiddlewareKind
+}
+
+func (m *conversationValidatorMiddleware) Spec() *MiddlewareSpec {
+	return m.spec
+}
+
+func (m *conversationValidatorMiddleware) Handle(ctx *aicontext.Context) {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions {
+		return
+	}
+	messages, ok := ctx.OpenAIReq["messages"].([]any)
+	if !ok {
+		return
+	}
+
+	strict := ctx.Provider != nil && conversationStrictProviders[ctx.Provider.ProviderType]
+	violations := checkConversation(messages, strict)
+	if len(violations) == 0 {
+		return
+	}
+	if m.mode == conversationModeReject {
+		m.reject(ctx, violations[0])
+		return
+	}
+	for _, v := range violations {
+		if !v.repairable {
+			m.reject(ctx, v)
+			return
+		}
+	}
+
+	repaired, repairs := repairConversation(messages, strict)
+	// the repairs always fix the violations, this is only a safeguard.
+	if remaining := checkConversation(repaired, strict); len(remaining) > 0 {
+		logger.Errorf("conversationValidator middleware %s failed to repair messages: %s", m.spec.Name, remaining[0].message)
+		m.reject(ctx, violations[0])
+		return
+	}
+	ctx.OpenAIReq["messages"] = repaired
+	body, err := codectool.MarshalJSON(ctx.OpenAIReq)
+	if err != nil {
+		ctx.OpenAIReq["messages"] = messages
+		logger.Errorf("failed to marshal request of conversationValidator middleware %s: %v", m.spec.Name, err)
+		return
+	}
+	ctx.ReqBody = body
+	ctx.AddConversationRepairs(repairs...)
+	for _, r := range repairs {
+		logger.Debugf("conversationValidator middleware %s: %s message %d for rule %s, %s", m.spec.Name, r.Action, r.Index, r.Rule, r.Detail)
+	}
+	ctx.Ctx.AddTag(fmt.Sprintf("conversationValidator %s: %d repairs", m.spec.Name, len(repairs)))
+}
+
+func (m *conversationValidatorMiddleware) reject(ctx *aicontext.Context, v *conversationViolation) {
+	msg := fmt.Sprintf("invalid conversation, messages[%d]: %s", v.index, v.message)
+	ctx.Ctx.AddTag(fmt.Sprintf("conversationValidator %s: rule %s broken by message %d", m.spec.Name, v.rule, v.index))
+
+	errMsg := protocol.NewError(http.StatusBadRequest, msg)
+	data, _ := codectool.MarshalJSON(errMsg)
+	ctx.SetResponse(&aicontext.Response{
+		StatusCode:    http.StatusBadRequest,
+		ContentLength: int64(len(data)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		BodyBytes:     data,
+	})
+	ctx.Stop(aicontext.ResultClientError)
+}
+
+func isSystemRole(role string) bool {
+	return role == "system" || role == "developer"
+}
+
+func isConversationRole(role string) bool {
+	switch role {
+	case "system", "developer", "user", "assistant", "tool", "function":
+		return true
+	}
+	return false
+}
+
+func messageRole(msg map[string]any) string {
+	role, _ := msg["role"].(string)
+	return role
+}
+
+// toolCallIDs returns the IDs of the tool calls of an assistant message.
+func toolCallIDs(msg map[string]any) []string {
+	calls, _ := msg["tool_calls"].([]any)
+	ids := make([]string, 0, len(calls))
+	for _, call := range calls {
+		call, _ := call.(map[string]any)
+		id, _ := call["id"].(string)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// checkConversation returns the violations of the messages sorted by
+// index. The rules of all providers are:
+//   - every message is an object with a known role.
+//   - a tool message answers a tool call of the preceding assistant
+//     message, it is not repairable.
+//   - the tool calls of an assistant message are all answered by the tool
+//     messages following it, empty results are synthesized to repair it.
+//
+// And strict providers have the additional rules:
+//   - system messages come before the other messages, they are moved to
+//     the front to repair it.
+//   - the first message after the system messages is a user message, it is
+//     not repairable.
+//   - user and assistant messages alternate, consecutive messages of the
+//     same role are merged to repair it.
+func checkConversation(messages []any, strict bool) []*conversationViolation {
+	var (
+		violations []*conversationViolation
+		// pending are the unanswered tool calls of the assistant message
+		// at callIndex.
+		pending   []string
+		callIndex int
+		// prevRole is the role of the previous non-system message.
+		prevRole string
+	)
+	add := func(index int, rule string, repairable bool, format string, args ...any) {
+		violations = append(violations, &conversationViolation{
+			index:      index,
+			rule:       rule,
+			message:    fmt.Sprintf(format, args...),
+			repairable: repairable,
+		})
+	}
+	flush := func() {
+		if len(pending) > 0 {
+			add(callIndex, conversationRuleToolCalls, true, "tool calls %s have no results", strings.Join(pending, ", "))
+			pending = nil
+		}
+	}
+
+	for i, item := range messages {
+		msg, ok := item.(map[string]any)
+		if !ok {
+			add(i, conversationRuleRole, false, "message must be an object")
+			continue
+		}
+		role := messageRole(msg)
+		if !isConversationRole(role) {
+			add(i, conversationRuleRole, false, "unknown role %q", role)
+			continue
+		}
+
+		if role == "tool" {
+			id, _ := msg["tool_call_id"].(string)
+			if j := slices.Index(pending, id); j >= 0 {
+				pending = slices.Delete(pending, j, j+1)
+			} else {
+				add(i, conversationRuleToolResult, false, "tool message %q answers no tool call of the preceding assistant message", id)
+			}
+		} else {
+			flush()
+		}
+
+		if isSystemRole(role) {
+			if strict && prevRole != "" {
+				add(i, conversationRuleSystemFirst, true, "%s message must come before the other messages", role)
+			}
+			continue
+		}
+		if strict {
+			if prevRole == "" && role != "user" {
+				add(i, conversationRuleFirstTurn, false, "the conversation must start with a user message, got %s", role)
+			} else if role == prevRole && (role == "user" || role == "assistant") {
+				add(i, conversationRuleAlternation, true, "consecutive %s messages", role)
+			}
+		}
+		if role == "assistant" {
+			pending, callIndex = toolCallIDs(msg), i
+		}
+		prevRole = role
+	}
+	flush()
+
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].index < violations[j].index
+	})
+	return violations
+}
+
+// repairConversation repairs the messages, it must be called only if all
+// the violations are repairable. The messages of the request are not
+// changed, merged messages are copied.
+func repairConversation(messages []any, strict bool) ([]any, []*aicontext.ConversationRepair) {
+	var repairs []*aicontext.ConversationRepair
+	items := make([]*conversationMessage, 0, len(messages))
+	for i, msg := range messages {
+		items = append(items, &conversationMessage{index: i, msg: msg.(map[string]any)})
+	}
+
+	if strict {
+		var systems, others []*conversationMessage
+		for _, item := range items {
+			if !isSystemRole(messageRole(item.msg)) {
+				others = append(others, item)
+				continue
+			}
+			if len(others) > 0 {
+				repairs = append(repairs, &aicontext.ConversationRepair{
+					Rule:   conversationRuleSystemFirst,
+					Action: conversationActionReorder,
+					Index:  item.index,
+					Detail: "moved to the front",
+				})
+			}
+			systems = append(systems, item)
+		}
+		items = append(systems, others...)
+	}
+
+	synthesized := make([]*conversationMessage, 0, len(items))
+	for i := 0; i < len(items); {
+		item := items[i]
+		synthesized = append(synthesized, item)
+		i++
+		if messageRole(item.msg) != "assistant" {
+			continue
+		}
+		answered := map[string]bool{}
+		for ; i < len(items) && messageRole(items[i].msg) == "tool"; i++ {
+			id, _ := items[i].msg["tool_call_id"].(string)
+			answered[id] = true
+			synthesized = append(synthesized, items[i])
+		}
+		for _, id := range toolCallIDs(item.msg) {
+			if answered[id] {
+				continue
+			}
+			synthesized = append(synthesized, &conversationMessage{
+				index: item.index,
+				msg:   map[string]any{"role": "tool", "tool_call_id": id, "content": ""},
+			})
+			repairs = append(repairs, &aicontext.ConversationRepair{
+				Rule:   conversationRuleToolCalls,
+				Action: conversationActionSynthesize,
+				Index:  item.index,
+				Detail: fmt.Sprintf("empty result of tool call %s", id),
+			})
+		}
+	}
+	items = synthesized
+
+	if strict {
+		merged := make([]*conversationMessage, 0, len(items))
+		for _, item := range items {
+			role := messageRole(item.msg)
+			if n := len(merged); n > 0 && (role == "user" || role == "assistant") && messageRole(merged[n-1].msg) == role {
+				prev := merged[n-1]
+				merged[n-1] = &conversationMessage{index: prev.index, msg: mergeConversationMessages(prev.msg, item.msg)}
+				repairs = append(repairs, &aicontext.ConversationRepair{
+					Rule:   conversationRuleAlternation,
+					Action: conversationActionMerge,
+					Index:  item.index,
+					Detail: fmt.Sprintf("merged into message %d", prev.index),
+				})
+				continue
+			}
+			merged = append(merged, item)
+		}
+		items = merged
+	}
+
+	result := make([]any, 0, len(items))
+	for _, item := range items {
+		result = append(result, item.msg)
+	}
+	return result, repairs
+}
+
+// mergeConversationMessages returns a message with the contents of a and b,
+// the other fields of b, like the tool calls, are kept if a has not them.
+func mergeConversationMessages(a, b map[string]any) map[string]any {
+	msg := maps.Clone(a)
+	for k, v := range b {
+		if _, ok := msg[k]; !ok || isEmptyContent(msg[k]) {
+			msg[k] = v
+		}
+	}
+	msg["content"] = mergeConversationContent(a["content"], b["content"])
+	return msg
+}
+
+// mergeConversationContent joins two text contents with a blank line, or
+// concatenates the parts if any of them is a list of parts.
+func mergeConversationContent(a, b any) any {
+	if isEmptyContent(a) {
+		return b
+	}
+	if isEmptyContent(b) {
+		return a
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return as + "\n\n" + bs
+	}
+	return append(contentParts(a), contentParts(b)...)
+}
+
+func contentParts(content any) []any {
+	switch v := content.(type) {
+	case []any:
+		return slices.Clone(v)
+	case string:
+		return []any{map[string]any{"type": "text", "text": v}}
+	}
+	return nil
+}
+
+func isEmptyContent(content any) bool {
+	switch v := content.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
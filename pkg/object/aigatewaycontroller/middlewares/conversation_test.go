@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func newConversationContext(t *testing.T, providerType string, messages string) *aicontext.Context {
+	body := `{"model": "gpt-4.1", "messages": ` + messages + `}`
+	ctx := egContext.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+	assert.Nil(t, err)
+	setRequest(t, ctx, "conversation", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: providerType, ProviderType: providerType})
+	assert.Nil(t, err)
+	return aiCtx
+}
+
+func newConversationValidator(mode string) *conversationValidatorMiddleware {
+	m := &conversationValidatorMiddleware{}
+	m.init(&MiddlewareSpec{
+		Name:                  "validator",
+		Kind:                  conversationValidatorMiddlewareKind,
+		ConversationValidator: &ConversationValidatorSpec{Mode: mode},
+	})
+	return m
+}
+
+func TestConversationValidatorValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{Name: "validator", Kind: conversationValidatorMiddlewareKind}
+	assert.Nil(ValidateSpec(spec))
+	spec.ConversationValidator = &ConversationValidatorSpec{Mode: "repair"}
+	assert.Nil(ValidateSpec(spec))
+	spec.ConversationValidator.Mode = "fix"
+	assert.Error(ValidateSpec(spec))
+
+	assert.Equal(conversationModeReject, newConversationValidator("").mode)
+}
+
+func TestCheckConversation(t *testing.T) {
+	assert := assert.New(t)
+
+	check := func(strict bool, messages string) []*conversationViolation {
+		var msgs []any
+		assert.Nil(json.Unmarshal([]byte(messages), &msgs))
+		return checkConversation(msgs, strict)
+	}
+
+	valid := `[
+		{"role": "system", "content": "be nice"},
+		{"role": "user", "content": "weather?"},
+		{"role": "assistant", "content": null, "tool_calls": [{"id": "a"}, {"id": "b"}]},
+		{"role": "tool", "tool_call_id": "b", "content": "sunny"},
+		{"role": "tool", "tool_call_id": "a", "content": "warm"},
+		{"role": "assistant", "content": "sunny and warm"},
+		{"role": "user", "content": "thanks"}
+	]`
+	assert.Empty(check(false, valid))
+	assert.Empty(check(true, valid))
+
+	// consecutive messages and late system messages are allowed by openai.
+	relaxed := `[
+		{"role": "assistant", "content": "hi"},
+		{"role": "user", "content": "a"},
+		{"role": "user", "content": "b"},
+		{"role": "system", "content": "be nice"}
+	]`
+	assert.Empty(check(false, relaxed))
+	violations := check(true, relaxed)
+	assert.Len(violations, 3)
+	assert.Equal(0, violations[0].index)
+	assert.Equal(conversationRuleFirstTurn, violations[0].rule)
+	assert.False(violations[0].repairable)
+	assert.Equal(2, violations[1].index)
+	assert.Equal(conversationRuleAlternation, violations[1].rule)
+	assert.Equal(3, violations[2].index)
+	assert.Equal(conversationRuleSystemFirst, violations[2].rule)
+
+	violations = check(false, `[
+		{"role": "user", "content": "weather?"},
+		{"role": "assistant", "tool_calls": [{"id": "a"}, {"id": "b"}]},
+		{"role": "tool", "tool_call_id": "a", "content": "sunny"},
+		{"role": "user", "content": "hurry"},
+		{"role": "tool", "tool_call_id": "b", "content": "warm"},
+		{"role": "robot", "content": "beep"},
+		"hello"
+	]`)
+	assert.Len(violations, 4)
+	assert.Equal(1, violations[0].index)
+	assert.Equal(conversationRuleToolCalls, violations[0].rule)
+	assert.Equal("tool calls b have no results", violations[0].message)
+	assert.True(violations[0].repairable)
+	assert.Equal(4, violations[1].index)
+	assert.Equal(conversationRuleToolResult, violations[1].rule)
+	assert.False(violations[1].repairable)
+	assert.Equal(`unknown role "robot"`, violations[2].message)
+	assert.Equal(6, violations[3].index)
+}
+
+func TestConversationValidatorReject(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newConversationValidator("")
+	aiCtx := newConversationContext(t, "anthropic", `[
+		{"role": "user", "content": "a"},
+		{"role": "user", "content": "b"}
+	]`)
+	m.Handle(aiCtx)
+	assert.True(aiCtx.IsStopped())
+	assert.Equal(http.StatusBadRequest, aiCtx.GetResponse().StatusCode)
+	assert.Contains(string(aiCtx.GetResponse().BodyBytes), "messages[1]: consecutive user messages")
+
+	// the same conversation is valid for openai.
+	aiCtx = newConversationContext(t, "openai", `[
+		{"role": "user", "content": "a"},
+		{"role": "user", "content": "b"}
+	]`)
+	m.Handle(aiCtx)
+	assert.False(aiCtx.IsStopped())
+
+	// unrepairable violations are rejected in repair mode.
+	m = newConversationValidator("repair")
+	aiCtx = newConversationContext(t, "openai", `[
+		{"role": "user", "content": "a"},
+		{"role": "tool", "tool_call_id": "x", "content": "b"}
+	]`)
+	m.Handle(aiCtx)
+	assert.True(aiCtx.IsStopped())
+	assert.Contains(string(aiCtx.GetResponse().BodyBytes), `messages[1]: tool message \"x\" answers no tool call`)
+}
+
+func TestConversationValidatorRepair(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newConversationValidator("repair")
+	messages := `[
+		{"role": "user", "content": "a"},
+		{"role": "system", "content": "be nice"},
+		{"role": "user", "content": [{"type": "text", "text": "b"}]},
+		{"role": "assistant", "content": "let me check"},
+		{"role": "assistant", "content": null, "tool_calls": [{"id": "x"}, {"id": "y"}]},
+		{"role": "tool", "tool_call_id": "y", "content": "c"},
+		{"role": "user", "content": "d"}
+	]`
+	aiCtx := newConversationContext(t, "bedrock", messages)
+	m.Handle(aiCtx)
+	assert.False(aiCtx.IsStopped())
+
+	req := map[string]any{}
+	assert.Nil(json.Unmarshal(aiCtx.ReqBody, &req))
+	expected := []any{
+		map[string]any{"role": "system", "content": "be nice"},
+		map[string]any{"role": "user", "content": []any{
+			map[string]any{"type": "text", "text": "a"},
+			map[string]any{"type": "text", "text": "b"},
+		}},
+		map[string]any{"role": "assistant", "content": "let me check", "tool_calls": []any{
+			map[string]any{"id": "x"}, map[string]any{"id": "y"},
+		}},
+		map[string]any{"role": "tool", "tool_call_id": "y", "content": "c"},
+		map[string]any{"role": "tool", "tool_call_id": "x", "content": ""},
+		map[string]any{"role": "user", "content": "d"},
+	}
+	assert.Equal(expected, req["messages"])
+	assert.Equal(expected, aiCtx.OpenAIReq["messages"])
+
+	repairs := aiCtx.ConversationRepairs()
+	assert.Len(repairs, 4)
+	assert.Equal(&aicontext.ConversationRepair{
+		Rule: conversationRuleSystemFirst, Action: conversationActionReorder, Index: 1, Detail: "moved to the front",
+	}, repairs[0])
+	assert.Equal(&aicontext.ConversationRepair{
+		Rule: conversationRuleToolCalls, Action: conversationActionSynthesize, Index: 4, Detail: "empty result of tool call x",
+	}, repairs[1])
+	assert.Equal(&aicontext.ConversationRepair{
+		Rule: conversationRuleAlternation, Action: conversationActionMerge, Index: 2, Detail: "merged into message 0",
+	}, repairs[2])
+	assert.Equal(4, repairs[3].Index)
+
+	// openai only needs the tool results.
+	aiCtx = newConversationContext(t, "openai", messages)
+	m.Handle(aiCtx)
+	assert.Nil(json.Unmarshal(aiCtx.ReqBody, &req))
+	assert.Len(req["messages"], 8)
+	assert.Len(aiCtx.ConversationRepairs(), 1)
+
+	// valid conversations are not changed.
+	aiCtx = newConversationContext(t, "gemini", `[{"role": "user", "content": "a"}]`)
+	body := aiCtx.ReqBody
+	m.Handle(aiCtx)
+	assert.Equal(body, aiCtx.ReqBody)
+	assert.Empty(aiCtx.ConversationRepairs())
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var (
+	_ DependencyChecker = (*semanticCacheMiddleware)(nil)
+	_ DependencyChecker = (*retrievalMiddleware)(nil)
+)
+
+// pingVectorDB checks whether the vector database is reachable, vector
+// databases which can not be pinged are considered reachable.
+func pingVectorDB(ctx context.Context, db vecdbtypes.VectorDB) error {
+	pinger, ok := db.(vecdbtypes.Pinger)
+	if !ok {
+		return nil
+	}
+	return pinger.Ping(ctx)
+}
+
+// CheckDependencies checks whether the vector database of the cache is
+// reachable, the cache works if either the primary or the fallback vector
+// database is reachable.
+func (m *semanticCacheMiddleware) CheckDependencies(ctx context.Context) error {
+	err := pingVectorDB(ctx, m.vectorHandler.vectorDB)
+	if err == nil || m.fallbackVectorHandler == nil {
+		return err
+	}
+	if pingVectorDB(ctx, m.fallbackVectorHandler.vectorDB) == nil {
+		return nil
+	}
+	return err
+}
+
+// DependenciesReady resumes the drains failed for unreachable vector
+// databases.
+func (m *semanticCacheMiddleware) DependenciesReady() {
+	handlers := []*semanticCacheVectorHandler{m.vectorHandler}
+	if m.fallbackVectorHandler != nil {
+		handlers = append(handlers, m.fallbackVectorHandler)
+	}
+	for _, h := range handlers {
+		if h.drainFailed.CompareAndSwap(true, false) {
+			m.resumeDrain(h)
+		}
+	}
+}
+
+// CheckDependencies checks whether the vector database of the retrieval
+// middleware is reachable.
+func (m *retrievalMiddleware) CheckDependencies(ctx context.Context) error {
+	return pingVectorDB(ctx, m.vectorDB)
+}
+
+// DependenciesReady does nothing, the vector handlers of the retrieval
+// middleware are created on demand.
+func (m *retrievalMiddleware) DependenciesReady() {}
@@ -27,6 +27,7 @@ import (
 
 type EmbeddingSpec = embedtypes.EmbeddingSpec
 type EmbeddingHandler = embedtypes.EmbeddingHandler
+type BatchEmbeddingHandler = embedtypes.BatchEmbeddingHandler
 
 // registryMap maps embedding provider types to their respective handler constructors.
 var registryMap = map[string]func(*EmbeddingSpec) EmbeddingHandler{
@@ -55,5 +56,8 @@ func ValidateSpec(spec *EmbeddingSpec) error {
 	if spec.Model == "" {
 		return fmt.Errorf("model is required for embedding provider")
 	}
+	if spec.MaxResponseBytes < 0 {
+		return fmt.Errorf("maxResponseBytes must be greater than or equal to 0")
+	}
 	return nil
 }
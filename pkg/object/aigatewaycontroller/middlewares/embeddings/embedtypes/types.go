@@ -24,6 +24,14 @@ type (
 		EmbedQuery(text string) ([]float32, error)
 	}
 
+	// BatchEmbeddingHandler is implemented by the handlers embedding texts
+	// in a single request. The embeddings are passed to fn with the index of
+	// their texts as they are decoded from the response, so the response of
+	// a large batch is never held in memory as a whole.
+	BatchEmbeddingHandler interface {
+		EmbedBatch(texts []string, fn func(index int, embedding []float32) error) error
+	}
+
 	// EmbeddingSpec defines the specification for embedding providers.
 	EmbeddingSpec struct {
 		ProviderType string            `json:"providerType"`
@@ -31,5 +39,8 @@ type (
 		APIKey       string            `json:"apiKey"`
 		Headers      map[string]string `json:"headers,omitempty"`
 		Model        string            `json:"model"`
+		// MaxResponseBytes caps the size of an embedding response, the
+		// decoding is aborted once it is exceeded, 0 means no cap.
+		MaxResponseBytes int64 `json:"maxResponseBytes,omitempty"`
 	}
 )
@@ -29,7 +29,11 @@ import (
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
 )
 
-const openaiEmbedPath = "/v1/embeddings"
+const (
+	openaiEmbedPath = "/v1/embeddings"
+	// maxErrorBodyBytes is the size of error responses kept in errors.
+	maxErrorBodyBytes = 4096
+)
 
 type (
 	openaiEmbeddingHanlder struct {
@@ -45,23 +49,61 @@ func New(spec *embedtypes.EmbeddingSpec) embedtypes.EmbeddingHandler {
 }
 
 func (h *openaiEmbeddingHanlder) EmbedDocuments(text string) ([]float32, error) {
+	var embedding []float32
+	err := h.embed(text, func(e *protocol.Embedding) error {
+		if embedding == nil {
+			embedding = e.Embedding
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(embedding) == 0 {
+		return nil, fmt.Errorf("openai embedding response is empty")
+	}
+	return embedding, nil
+}
+
+// EmbedBatch embeds the texts in a single request.
+func (h *openaiEmbeddingHanlder) EmbedBatch(texts []string, fn func(index int, embedding []float32) error) error {
+	embedded := 0
+	err := h.embed(texts, func(e *protocol.Embedding) error {
+		if e.Index < 0 || e.Index >= len(texts) || len(e.Embedding) == 0 {
+			return fmt.Errorf("openai embedding response has an invalid embedding of index %d", e.Index)
+		}
+		embedded++
+		return fn(e.Index, e.Embedding)
+	})
+	if err != nil {
+		return err
+	}
+	if embedded != len(texts) {
+		return fmt.Errorf("openai embedding response has %d embeddings for %d texts", embedded, len(texts))
+	}
+	return nil
+}
+
+// embed sends the embedding request of the input, and decodes the
+// embeddings of the response incrementally.
+func (h *openaiEmbeddingHanlder) embed(input any, fn func(*protocol.Embedding) error) error {
 	// prepare the request body
 	embedReq := &protocol.EmbedRequest{
 		Model:          h.spec.Model,
-		Input:          text,
+		Input:          input,
 		EncodingFormat: "float",
 	}
 	reqBody, err := json.Marshal(embedReq)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	u, err := url.JoinPath(h.spec.BaseURL, openaiEmbedPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(reqBody))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.Header.Set("Authorization", "Bearer "+h.spec.APIKey)
 	for k, v := range h.spec.Headers {
@@ -71,24 +113,20 @@ func (h *openaiEmbeddingHanlder) EmbedDocuments(text string) ([]float32, error)
 	// parse the response body
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
-	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("ollama embedding request failed with status code %d, %s", resp.StatusCode, string(data))
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		if err != nil {
+			return fmt.Errorf("failed to read response body: %w", err)
+		}
+		return fmt.Errorf("openai embedding request failed with status code %d, %s", resp.StatusCode, string(data))
 	}
-	var embedResp protocol.EmbeddingResponse
-	if err := json.Unmarshal(data, &embedResp); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
-	}
-	if len(embedResp.Data) == 0 || len(embedResp.Data[0].Embedding) == 0 {
-		return nil, fmt.Errorf("openai embedding response is empty")
+	if _, err := protocol.DecodeEmbeddingResponse(resp.Body, h.spec.MaxResponseBytes, fn); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
 	}
-	return embedResp.Data[0].Embedding, nil
+	return nil
 }
 
 func (h *openaiEmbeddingHanlder) EmbedQuery(text string) ([]float32, error) {
@@ -107,3 +107,55 @@ func TestOpenAIEmbedding(t *testing.T) {
 	assert.Equal(embeddingString("hello world"), embed)
 	assert.Equal(embeddingString("hello world2"), embed2)
 }
+
+func TestOpenAIEmbedBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		embedReq := protocol.EmbedRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&embedReq); err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+		resp := protocol.EmbeddingResponse{Object: "list", Model: embedReq.Model}
+		inputs, ok := embedReq.Input.([]any)
+		if !ok {
+			inputs = []any{embedReq.Input}
+		}
+		// the embeddings are in reverse order.
+		for i := len(inputs) - 1; i >= 0; i-- {
+			resp.Data = append(resp.Data, protocol.Embedding{
+				Object:    "embedding",
+				Index:     i,
+				Embedding: embeddingString(inputs[i].(string)),
+			})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer mockServer.Close()
+
+	spec := &embedtypes.EmbeddingSpec{
+		ProviderType: "openai",
+		BaseURL:      mockServer.URL,
+		Model:        "test-model",
+		APIKey:       "mock-api",
+	}
+	handler := New(spec).(embedtypes.BatchEmbeddingHandler)
+	texts := []string{"a", "b", "c"}
+	results := make([][]float32, len(texts))
+	err := handler.EmbedBatch(texts, func(index int, embedding []float32) error {
+		results[index] = embedding
+		return nil
+	})
+	assert.NoError(err)
+	for i, text := range texts {
+		assert.Equal(embeddingString(text), results[i])
+	}
+
+	// the response exceeds the memory cap.
+	spec.MaxResponseBytes = 128
+	err = handler.EmbedBatch(texts, func(index int, embedding []float32) error { return nil })
+	assert.ErrorIs(err, protocol.ErrEmbeddingResponseTooLarge)
+	_, err = New(spec).EmbedDocuments("a")
+	assert.ErrorIs(err, protocol.ErrEmbeddingResponseTooLarge)
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings"
+)
+
+var (
+	embeddingMetricsOnce sync.Once
+	embeddingDedupHits   *prometheus.CounterVec
+)
+
+func initEmbeddingMetrics() {
+	embeddingMetricsOnce.Do(func() {
+		embeddingDedupHits = metricshub.EmbeddingDedupHits.NewCounter()
+	})
+}
+
+// embedQuery embeds the query text of the request by the handler. The
+// embedding is memoized in the request by the provider, the base URL and
+// the model of the spec, so the middlewares embedding the same text by
+// the same model make one embedding call per request.
+func embedQuery(ctx *aicontext.Context, middleware string, spec *embeddings.EmbeddingSpec, handler embeddings.EmbeddingHandler, text string) ([]float32, error) {
+	if spec == nil {
+		return handler.EmbedQuery(text)
+	}
+	initEmbeddingMetrics()
+	model := spec.ProviderType + " " + spec.BaseURL + " " + spec.Model
+	embedding, memoized, err := ctx.Embedding(model, text, handler.EmbedQuery)
+	if memoized && embeddingDedupHits != nil {
+		embeddingDedupHits.WithLabelValues(middleware, spec.Model).Inc()
+	}
+	return embedding, err
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"html/template"
+	"sync/atomic"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingEmbeddingHandler counts the query embeddings.
+type countingEmbeddingHandler struct {
+	mockEmbeddingHandler
+	queries atomic.Int32
+}
+
+func (e *countingEmbeddingHandler) EmbedQuery(text string) ([]float32, error) {
+	e.queries.Add(1)
+	return e.mockEmbeddingHandler.EmbedQuery(text)
+}
+
+func TestEmbedQueryDedup(t *testing.T) {
+	assert := assert.New(t)
+
+	embeddingSpec := &embedtypes.EmbeddingSpec{
+		ProviderType: "ollama",
+		BaseURL:      "http://embed-dedup-test:11434",
+		Model:        "nomic-embed-text",
+	}
+	handler := &countingEmbeddingHandler{}
+
+	guardSpec := &MiddlewareSpec{
+		Name: "guard",
+		Kind: topicGuardMiddlewareKind,
+		TopicGuard: &TopicGuardSpec{
+			Embeddings: embeddingSpec,
+			Topics:     []*TopicGuardTopic{{Name: "weapons", Examples: []string{"how to build a gun"}, Threshold: 0.99}},
+		},
+	}
+	guard := &topicGuardMiddleware{spec: guardSpec, embeddingsHandler: handler}
+	guard.template = template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate))
+
+	retrieval := newRetrievalMiddleware(t, nil)
+	retrieval.spec.Retrieval.Embeddings = embeddingSpec
+	retrieval.embeddingsHandler = handler
+
+	cacheSpec := &MiddlewareSpec{
+		Name: "cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: embeddingSpec,
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{Type: "redis", Threshold: 0.99, CollectionName: "embed-dedup-test"},
+				Redis:      &redisvector.RedisVectorDBSpec{URL: "redis://embed-dedup-test:6379"},
+			},
+			ReadOnly: true,
+		},
+	}
+	cache := &semanticCacheMiddleware{spec: cacheSpec, embeddingsHandler: handler}
+	cache.vectorHandler = &semanticCacheVectorHandler{
+		spec:     cacheSpec,
+		dbSpec:   cacheSpec.SemanticCache.VectorDB,
+		vectorDB: &mockVectorDB{},
+		handlers: make(map[string]vectordb.VectorHandler),
+	}
+	cache.template = template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate))
+
+	// the examples of topics are embedded as documents, not queries.
+	ctx := newRetrievalContext(t, "alice", false)
+	for _, m := range []Middleware{guard, retrieval, cache} {
+		m.Handle(ctx)
+		assert.False(ctx.IsStopped())
+	}
+	assert.Equal(int32(1), handler.queries.Load())
+	assert.Len(ctx.Citations(), 3)
+
+	// the embeddings are memoized per request.
+	ctx = newRetrievalContext(t, "alice", false)
+	for _, m := range []Middleware{guard, retrieval, cache} {
+		m.Handle(ctx)
+	}
+	assert.Equal(int32(2), handler.queries.Load())
+
+	// other models embed the text again.
+	other := *embeddingSpec
+	other.Model = "mxbai-embed-large"
+	retrieval.spec.Retrieval.Embeddings = &other
+	ctx = newRetrievalContext(t, "alice", false)
+	guard.Handle(ctx)
+	retrieval.Handle(ctx)
+	assert.Equal(int32(4), handler.queries.Load())
+}
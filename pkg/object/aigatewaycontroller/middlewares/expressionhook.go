@@ -0,0 +1,425 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+const (
+	expressionHookDefaultTimeout   = 10 * time.Millisecond
+	expressionHookDefaultCostLimit = 10000
+	// expressionHookMaxLength bounds the length of expressions.
+	expressionHookMaxLength = 4096
+	// expressionHookMaxOutputLength bounds the length of string outputs.
+	expressionHookMaxOutputLength = 1024
+	// expressionHookInterruptFrequency is the number of iterations of
+	// comprehensions between the checks of the timeout.
+	expressionHookInterruptFrequency = 100
+
+	expressionOutputString = "string"
+	expressionOutputNumber = "number"
+)
+
+var expressionOutputNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type (
+	// ExpressionHookSpec defines the expression hook middleware, it
+	// evaluates CEL expressions against the request, and sets their
+	// results as the variables of the request for the later middlewares.
+	ExpressionHookSpec struct {
+		// Outputs are evaluated in order, an output can refer to the
+		// outputs before it by vars.
+		Outputs []*ExpressionOutputSpec `json:"outputs" jsonschema:"required"`
+		// Timeout is the maximum time of evaluating an expression, default
+		// 10ms.
+		Timeout string `json:"timeout,omitempty" jsonschema:"format=duration"`
+		// CostLimit is the maximum runtime cost of evaluating an
+		// expression, which bounds the work and the memory of it, default
+		// 10000.
+		CostLimit uint64 `json:"costLimit,omitempty"`
+	}
+
+	// ExpressionOutputSpec is a named output of an expression hook.
+	ExpressionOutputSpec struct {
+		Name       string `json:"name" jsonschema:"required"`
+		Expression string `json:"expression" jsonschema:"required"`
+		// Type is string (default) or number.
+		Type string `json:"type,omitempty" jsonschema:"enum=,enum=string,enum=number"`
+		// Header is the request header set to the output if any.
+		Header string `json:"header,omitempty"`
+	}
+
+	expressionHookMiddleware struct {
+		spec    *MiddlewareSpec
+		timeout time.Duration
+		outputs []*expressionOutput
+	}
+
+	expressionOutput struct {
+		spec    *ExpressionOutputSpec
+		program cel.Program
+	}
+)
+
+func init() {
+	middlewareTypeRegistry[expressionHookMiddlewareKind] = reflect.TypeOf(expressionHookMiddleware{})
+}
+
+var (
+	_ Middleware = (*expressionHookMiddleware)(nil)
+	_ Simulator  = (*expressionHookMiddleware)(nil)
+)
+
+// newExpressionEnv returns the environment of the expressions, the
+// variables are:
+//
+//   - model, path, method: strings of the request.
+//   - headers: the request headers with lowercase names.
+//   - body: the JSON body of the request.
+//   - promptChars: the number of characters of the text of the messages or
+//     the prompt.
+//   - provider: the name of the provider.
+//   - flags: the feature flags of the request.
+//   - vars: the variables set before.
+//
+// The string extensions and jwtClaims are available as well.
+func newExpressionEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("model", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("method", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("body", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("promptChars", cel.IntType),
+		cel.Variable("provider", cel.StringType),
+		cel.Variable("flags", cel.MapType(cel.StringType, cel.BoolType)),
+		cel.Variable("vars", cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings(),
+		cel.Function("jwtClaims",
+			cel.Overload("jwtClaims_string", []*cel.Type{cel.StringType}, cel.MapType(cel.StringType, cel.DynType),
+				cel.UnaryBinding(jwtClaims))),
+		cel.ParserExpressionSizeLimit(expressionHookMaxLength),
+	)
+}
+
+// jwtClaims returns the claims of a JWT, which may have the Bearer prefix.
+// The signature is NOT verified, so the claims are only trustworthy if
+// the token is verified before, e.g. by the consumer authentication.
+func jwtClaims(v ref.Val) ref.Val {
+	token, ok := v.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(v)
+	}
+	claims, err := decodeJWTClaims(string(token))
+	if err != nil {
+		return types.NewErr("jwtClaims: %v", err)
+	}
+	return types.DefaultTypeAdapter.NativeToValue(claims)
+}
+
+// decodeJWTClaims decodes the claims of a JWT without verifying it, the
+// token may have the Bearer prefix.
+func decodeJWTClaims(token string) (map[string]any, error) {
+	s := strings.TrimSpace(token)
+	if len(s) > 7 && strings.EqualFold(s[:7], "bearer ") {
+		s = strings.TrimSpace(s[7:])
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed payload: %v", err)
+	}
+	claims := map[string]any{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	return claims, nil
+}
+
+// compileExpressionOutput compiles the expression of the output, and
+// checks its type matches the output.
+func compileExpressionOutput(env *cel.Env, spec *ExpressionOutputSpec, costLimit uint64) (cel.Program, error) {
+	ast, issues := env.Compile(spec.Expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	outputType := ast.OutputType()
+	switch {
+	case outputType.IsExactType(cel.DynType):
+		// checked when evaluated.
+	case spec.Type == expressionOutputNumber:
+		if !outputType.IsExactType(cel.IntType) && !outputType.IsExactType(cel.UintType) && !outputType.IsExactType(cel.DoubleType) {
+			return nil, fmt.Errorf("expression returns %s, not a number", outputType)
+		}
+	default:
+		if !outputType.IsExactType(cel.StringType) {
+			return nil, fmt.Errorf("expression returns %s, not a string", outputType)
+		}
+	}
+	return env.Program(ast,
+		cel.CostLimit(costLimit),
+		cel.InterruptCheckFrequency(expressionHookInterruptFrequency),
+	)
+}
+
+func (m *expressionHookMiddleware) init(spec *MiddlewareSpec) {
+	m.spec = spec
+	m.timeout = expressionHookDefaultTimeout
+	s := spec.ExpressionHook
+	if s == nil {
+		return
+	}
+	if d, err := time.ParseDuration(s.Timeout); err == nil && d > 0 {
+		m.timeout = d
+	}
+	costLimit := s.CostLimit
+	if costLimit == 0 {
+		costLimit = expressionHookDefaultCostLimit
+	}
+	env, err := newExpressionEnv()
+	if err != nil {
+		logger.Errorf("failed to create expression environment of middleware %s: %v", spec.Name, err)
+		return
+	}
+	for _, output := range s.Outputs {
+		// the expressions are validated, they never fail here.
+		program, err := compileExpressionOutput(env, output, costLimit)
+		if err != nil {
+			logger.Errorf("failed to compile output %s of middleware %s: %v", output.Name, spec.Name, err)
+			continue
+		}
+		m.outputs = append(m.outputs, &expressionOutput{spec: output, program: program})
+	}
+}
+
+func (m *expressionHookMiddleware) validate(spec *MiddlewareSpec) error {
+	s := spec.ExpressionHook
+	if s == nil {
+		return fmt.Errorf("expressionHook middleware %s has no spec", spec.Name)
+	}
+	if len(s.Outputs) == 0 {
+		return fmt.Errorf("expressionHook middleware %s has no outputs", spec.Name)
+	}
+	if s.Timeout != "" {
+		if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("expressionHook middleware %s has invalid timeout %s", spec.Name, s.Timeout)
+		}
+	}
+	env, err := newExpressionEnv()
+	if err != nil {
+		return fmt.Errorf("expressionHook middleware %s: %v", spec.Name, err)
+	}
+	names := map[string]bool{}
+	for _, output := range s.Outputs {
+		if !expressionOutputNameRegexp.MatchString(output.Name) {
+			return fmt.Errorf("expressionHook middleware %s has invalid output name %q", spec.Name, output.Name)
+		}
+		if names[output.Name] {
+			return fmt.Errorf("expressionHook middleware %s has duplicate output %s", spec.Name, output.Name)
+		}
+		names[output.Name] = true
+		if output.Type != "" && output.Type != expressionOutputString && output.Type != expressionOutputNumber {
+			return fmt.Errorf("expressionHook middleware %s output %s has invalid type %s", spec.Name, output.Name, output.Type)
+		}
+		if _, err := compileExpressionOutput(env, output, expressionHookDefaultCostLimit); err != nil {
+			return fmt.Errorf("expressionHook middleware %s output %s: %v", spec.Name, output.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *expressionHookMiddleware) Name() string {
+	return m.spec.Name
+}
+
+func (m *expressionHookMiddleware) Kind() string {
+	return expressionHookMiddlewareKind
+}
+
+func (m *expressionHookMiddleware) Spec() *MiddlewareSpec {
+	return m.spec
+}
+
+// Handle evaluates the outputs and sets them as the variables of the
+// request, an output failed to evaluate is left unset.
+func (m *expressionHookMiddleware) Handle(ctx *aicontext.Context) {
+	if len(m.outputs) == 0 {
+		return
+	}
+	activation := expressionActivation(ctx)
+	vars := activation["vars"].(map[string]any)
+	for _, output := range m.outputs {
+		value, err := m.evaluate(output, activation)
+		if err != nil {
+			logger.Debugf("middleware %s failed to evaluate output %s: %v", m.spec.Name, output.spec.Name, err)
+			continue
+		}
+		ctx.SetVariable(output.spec.Name, value)
+		vars[output.spec.Name] = value
+		if output.spec.Header != "" {
+			ctx.Req.HTTPHeader().Set(output.spec.Header, formatExpressionValue(value))
+		}
+	}
+}
+
+// Simulate evaluates the outputs like Handle, and reports their values.
+func (m *expressionHookMiddleware) Simulate(ctx *aicontext.Context) *SimulationStep {
+	if len(m.outputs) == 0 {
+		return &SimulationStep{Decision: SimulationSkip, Detail: "no outputs"}
+	}
+	m.Handle(ctx)
+	step := &SimulationStep{Decision: SimulationPass}
+	values := make([]string, 0, len(m.outputs))
+	for _, output := range m.outputs {
+		value, ok := ctx.Variable(output.spec.Name)
+		if !ok {
+			values = append(values, output.spec.Name+" failed")
+			continue
+		}
+		step.Rules = append(step.Rules, fmt.Sprintf("middlewares[%s].expressionHook.outputs[%s]", m.spec.Name, output.spec.Name))
+		values = append(values, output.spec.Name+"="+formatExpressionValue(value))
+	}
+	step.Detail = strings.Join(values, ", ")
+	return step
+}
+
+// evaluate evaluates the output within the timeout, and converts the
+// result to a string or a float64 by the type of the output.
+func (m *expressionHookMiddleware) evaluate(output *expressionOutput, activation map[string]any) (any, error) {
+	evalCtx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	result, _, err := output.program.ContextEval(evalCtx, activation)
+	if err != nil {
+		return nil, err
+	}
+
+	if output.spec.Type == expressionOutputNumber {
+		switch v := result.(type) {
+		case types.Int:
+			return float64(v), nil
+		case types.Uint:
+			return float64(v), nil
+		case types.Double:
+			return float64(v), nil
+		}
+		return nil, fmt.Errorf("expression returns %s, not a number", result.Type().TypeName())
+	}
+	s, ok := result.(types.String)
+	if !ok {
+		return nil, fmt.Errorf("expression returns %s, not a string", result.Type().TypeName())
+	}
+	if len(s) > expressionHookMaxOutputLength {
+		return nil, fmt.Errorf("expression returns a string of %d bytes, exceeding %d bytes", len(s), expressionHookMaxOutputLength)
+	}
+	return string(s), nil
+}
+
+func formatExpressionValue(value any) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// expressionActivation returns the variables of the expressions for the
+// request.
+func expressionActivation(ctx *aicontext.Context) map[string]any {
+	headers := map[string]string{}
+	for name, values := range ctx.Req.HTTPHeader() {
+		if len(values) > 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	body := ctx.OpenAIReq
+	if body == nil {
+		body = map[string]any{}
+	}
+	flags := ctx.Flags
+	if flags == nil {
+		flags = map[string]bool{}
+	}
+	vars := map[string]any{}
+	for name, value := range ctx.Variables() {
+		vars[name] = value
+	}
+	var model string
+	if ctx.ReqInfo != nil {
+		model = ctx.ReqInfo.Model
+	}
+	var provider string
+	if ctx.Provider != nil {
+		provider = ctx.Provider.Name
+	}
+	return map[string]any{
+		"model":       model,
+		"path":        ctx.Req.Path(),
+		"method":      ctx.Req.Method(),
+		"headers":     headers,
+		"body":        body,
+		"promptChars": promptChars(body),
+		"provider":    provider,
+		"flags":       flags,
+		"vars":        vars,
+	}
+}
+
+// promptChars returns the number of characters of the text content of the
+// messages, or the prompt of completions requests.
+func promptChars(body map[string]any) int64 {
+	var n int
+	if prompt, ok := body["prompt"].(string); ok {
+		n += utf8.RuneCountInString(prompt)
+	}
+	messages, _ := body["messages"].([]any)
+	for _, message := range messages {
+		m, _ := message.(map[string]any)
+		switch content := m["content"].(type) {
+		case string:
+			n += utf8.RuneCountInString(content)
+		case []any:
+			for _, part := range content {
+				p, _ := part.(map[string]any)
+				if text, ok := p["text"].(string); ok {
+					n += utf8.RuneCountInString(text)
+				}
+			}
+		}
+	}
+	return int64(n)
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+func newExpressionHook(t *testing.T, spec *ExpressionHookSpec) *expressionHookMiddleware {
+	mwSpec := &MiddlewareSpec{Name: "hook", Kind: expressionHookMiddlewareKind, ExpressionHook: spec}
+	assert.NoError(t, ValidateSpec(mwSpec))
+	return NewMiddleware(mwSpec).(*expressionHookMiddleware)
+}
+
+func newExpressionContext(t *testing.T, header http.Header, body map[string]any) *aicontext.Context {
+	data, _ := json.Marshal(body)
+	ctx := egContext.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(data))
+	assert.Nil(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	setRequest(t, ctx, "hook", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+	assert.Nil(t, err)
+	return aiCtx
+}
+
+func testJWT(claims map[string]any) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func TestExpressionHookValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	validate := func(spec *ExpressionHookSpec) error {
+		return ValidateSpec(&MiddlewareSpec{Name: "hook", Kind: expressionHookMiddlewareKind, ExpressionHook: spec})
+	}
+	output := func(name, expression, typ string) *ExpressionHookSpec {
+		return &ExpressionHookSpec{Outputs: []*ExpressionOutputSpec{{Name: name, Expression: expression, Type: typ}}}
+	}
+
+	assert.Error(validate(nil))
+	assert.Error(validate(&ExpressionHookSpec{}))
+	assert.NoError(validate(output("tier", `model.startsWith("gpt-4") ? "premium" : "standard"`, "")))
+	assert.NoError(validate(output("chars", `promptChars * 2`, "number")))
+	// the types of dynamic values are checked when evaluated.
+	assert.NoError(validate(output("user", `body.user`, "")))
+
+	// syntax errors, unknown variables and mismatched types are rejected
+	// before the middleware is created.
+	assert.Error(validate(output("tier", `model.startsWith(`, "")))
+	assert.Error(validate(output("tier", `tenant == "a"`, "")))
+	assert.Error(validate(output("tier", `promptChars`, "")))
+	assert.Error(validate(output("tier", `model`, "number")))
+	assert.Error(validate(output("tier", `model`, "bool")))
+	assert.Error(validate(output("tier-name", `model`, "")))
+	assert.Error(validate(output("tier", `"`+strings.Repeat("a", expressionHookMaxLength)+`"`, "")))
+
+	spec := output("tier", `model`, "")
+	spec.Outputs = append(spec.Outputs, spec.Outputs[0])
+	assert.Error(validate(spec))
+	spec = output("tier", `model`, "")
+	spec.Timeout = "soon"
+	assert.Error(validate(spec))
+}
+
+// TestExpressionHookTenant extracts the tenant from a JWT claim, and sets
+// it as a header for the consumer headers of other middlewares.
+func TestExpressionHookTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newExpressionHook(t, &ExpressionHookSpec{
+		Outputs: []*ExpressionOutputSpec{
+			{
+				Name:       "tenant",
+				Expression: `"authorization" in headers ? string(jwtClaims(headers["authorization"]).tenant) : "anonymous"`,
+				Header:     "X-Tenant",
+			},
+			// outputs refer to the ones before them.
+			{Name: "cacheKey", Expression: `vars.tenant + ":" + model`},
+		},
+	})
+
+	body := map[string]any{"model": "gpt-4o", "messages": []any{map[string]any{"role": "user", "content": "hi"}}}
+	ctx := newExpressionContext(t, http.Header{"Authorization": {"Bearer " + testJWT(map[string]any{"tenant": "acme", "sub": "u1"})}}, body)
+	m.Handle(ctx)
+	assert.False(ctx.IsStopped())
+	tenant, ok := ctx.Variable("tenant")
+	assert.True(ok)
+	assert.Equal("acme", tenant)
+	assert.Equal("acme", ctx.Req.HTTPHeader().Get("X-Tenant"))
+	key, _ := ctx.Variable("cacheKey")
+	assert.Equal("acme:gpt-4o", key)
+
+	ctx = newExpressionContext(t, nil, body)
+	m.Handle(ctx)
+	tenant, _ = ctx.Variable("tenant")
+	assert.Equal("anonymous", tenant)
+
+	// a malformed token fails the output, it is left unset, and the
+	// outputs depending on it fail as well.
+	ctx = newExpressionContext(t, http.Header{"Authorization": {"Bearer garbage"}}, body)
+	m.Handle(ctx)
+	assert.False(ctx.IsStopped())
+	_, ok = ctx.Variable("tenant")
+	assert.False(ok)
+	_, ok = ctx.Variable("cacheKey")
+	assert.False(ok)
+	assert.Empty(ctx.Req.HTTPHeader().Get("X-Tenant"))
+}
+
+// TestExpressionHookModelTier derives the tier of the model from the
+// length of the messages.
+func TestExpressionHookModelTier(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newExpressionHook(t, &ExpressionHookSpec{
+		Outputs: []*ExpressionOutputSpec{
+			{Name: "promptLength", Expression: `promptChars`, Type: "number"},
+			{Name: "tier", Expression: `promptChars > 1000 ? "large" : promptChars > 100 ? "medium" : "small"`, Header: "X-Model-Tier"},
+		},
+	})
+
+	for _, tc := range []struct {
+		chars int
+		tier  string
+	}{{10, "small"}, {500, "medium"}, {5000, "large"}} {
+		body := map[string]any{
+			"model": "gpt-4o",
+			"messages": []any{
+				map[string]any{"role": "system", "content": strings.Repeat("s", tc.chars/2)},
+				map[string]any{"role": "user", "content": []any{
+					map[string]any{"type": "text", "text": strings.Repeat("u", tc.chars-tc.chars/2)},
+					map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/a.png"}},
+				}},
+			},
+		}
+		ctx := newExpressionContext(t, nil, body)
+		m.Handle(ctx)
+		length, _ := ctx.Variable("promptLength")
+		assert.Equal(float64(tc.chars), length)
+		tier, _ := ctx.Variable("tier")
+		assert.Equal(tc.tier, tier)
+		assert.Equal(tc.tier, ctx.Req.HTTPHeader().Get("X-Model-Tier"))
+	}
+
+	ctx := newExpressionContext(t, nil, map[string]any{
+		"model":    "gpt-4o",
+		"messages": []any{map[string]any{"role": "user", "content": strings.Repeat("u", 500)}},
+	})
+	step := m.Simulate(ctx)
+	assert.Equal(SimulationPass, step.Decision)
+	assert.Equal([]string{"middlewares[hook].expressionHook.outputs[promptLength]", "middlewares[hook].expressionHook.outputs[tier]"}, step.Rules)
+	assert.Equal("promptLength=500, tier=medium", step.Detail)
+	assert.Equal("medium", ctx.Req.HTTPHeader().Get("X-Model-Tier"))
+}
+
+func TestExpressionHookLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	messages := make([]any, 500)
+	for i := range messages {
+		messages[i] = map[string]any{"role": "user", "content": "hi"}
+	}
+	body := map[string]any{"model": "gpt-4o", "messages": messages}
+	expression := `body.messages.all(m, m.role == "user") ? "users" : "mixed"`
+
+	// the cost limit stops expressions doing too much work.
+	m := newExpressionHook(t, &ExpressionHookSpec{
+		Outputs:   []*ExpressionOutputSpec{{Name: "roles", Expression: expression}},
+		CostLimit: 100,
+	})
+	ctx := newExpressionContext(t, nil, body)
+	m.Handle(ctx)
+	_, ok := ctx.Variable("roles")
+	assert.False(ok)
+
+	// so does the timeout.
+	m = newExpressionHook(t, &ExpressionHookSpec{
+		Outputs: []*ExpressionOutputSpec{{Name: "roles", Expression: expression}},
+		Timeout: "1ns",
+	})
+	m.Handle(ctx)
+	_, ok = ctx.Variable("roles")
+	assert.False(ok)
+
+	m = newExpressionHook(t, &ExpressionHookSpec{
+		Outputs: []*ExpressionOutputSpec{{Name: "roles", Expression: expression}},
+		Timeout: "1s",
+	})
+	m.Handle(ctx)
+	roles, _ := ctx.Variable("roles")
+	assert.Equal("users", roles)
+
+	// dynamic values of wrong types and long strings are rejected.
+	m = newExpressionHook(t, &ExpressionHookSpec{
+		Outputs: []*ExpressionOutputSpec{
+			{Name: "stream", Expression: `body.stream`},
+			{Name: "long", Expression: `string(body.user)`},
+		},
+	})
+	ctx = newExpressionContext(t, nil, map[string]any{"model": "gpt-4o", "stream": true, "user": strings.Repeat("u", 2000), "messages": []any{}})
+	m.Handle(ctx)
+	assert.Empty(ctx.Variables())
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	errInvalidJPEG = errors.New("invalid JPEG image")
+	errInvalidPNG  = errors.New("invalid PNG image")
+	errInvalidWebP = errors.New("invalid WebP image")
+	errInvalidGIF  = errors.New("invalid GIF image")
+
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// pngMetadataChunks are the PNG chunks carrying metadata.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// walkJPEG calls fn with the marker and the payload of the segments of the
+// JPEG image before the image data, and returns the image without the
+// segments fn returns false for.
+func walkJPEG(data []byte, fn func(marker byte, payload []byte) bool) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errInvalidJPEG
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xFF {
+			return nil, errInvalidJPEG
+		}
+		// skip the fill bytes.
+		for i+1 < len(data) && data[i+1] == 0xFF {
+			i++
+		}
+		if i+1 >= len(data) {
+			return nil, errInvalidJPEG
+		}
+		marker := data[i+1]
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD9) {
+			out = append(out, data[i:i+2]...)
+			i += 2
+			if marker == 0xD9 {
+				return out, nil
+			}
+			continue
+		}
+		if i+4 > len(data) {
+			return nil, errInvalidJPEG
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, errInvalidJPEG
+		}
+		// the image data follows the start of scan, it is kept as is.
+		if marker == 0xDA {
+			return append(out, data[i:]...), nil
+		}
+		if fn(marker, data[i+4:i+2+length]) {
+			out = append(out, data[i:i+2+length]...)
+		}
+		i += 2 + length
+	}
+	return nil, errInvalidJPEG
+}
+
+// stripJPEGMetadata removes the EXIF, XMP, IPTC and vendor segments and
+// the comments of the JPEG image. The JFIF, ICC profile and Adobe segments
+// are kept, since they affect how the image is rendered.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	return walkJPEG(data, func(marker byte, payload []byte) bool {
+		switch {
+		case marker == 0xFE:
+			return false
+		case marker >= 0xE0 && marker <= 0xEF:
+			return marker == 0xE0 || marker == 0xE2 || marker == 0xEE
+		default:
+			return true
+		}
+	})
+}
+
+// jpegOrientation returns the EXIF orientation of the JPEG image, it is 1
+// if the image has no orientation.
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	walkJPEG(data, func(marker byte, payload []byte) bool {
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			orientation = exifOrientation(payload[6:])
+		}
+		return true
+	})
+	return orientation
+}
+
+// exifOrientation returns the orientation tag in the first IFD of the
+// TIFF structure of EXIF.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for k := 0; k < entries; k++ {
+		entry := offset + 2 + k*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+		if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+			return v
+		}
+		break
+	}
+	return 1
+}
+
+// walkPNG returns the PNG image without the chunks fn returns false for.
+func walkPNG(data []byte, fn func(chunk string) bool) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errInvalidPNG
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, errInvalidPNG
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) || end < i {
+			return nil, errInvalidPNG
+		}
+		chunk := string(data[i+4 : i+8])
+		if fn(chunk) {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+		if chunk == "IEND" {
+			return out, nil
+		}
+	}
+	return nil, errInvalidPNG
+}
+
+// stripPNGMetadata removes the EXIF, text and time chunks of the PNG image.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	return walkPNG(data, func(chunk string) bool {
+		return !pngMetadataChunks[chunk]
+	})
+}
+
+// walkWebP returns the WebP image without the chunks fn returns false
+// for, fn may modify the payload of the chunks in place.
+func walkWebP(data []byte, fn func(chunk string, payload []byte) bool) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errInvalidWebP
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errInvalidWebP
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if end > len(data) || end < i {
+			return nil, errInvalidWebP
+		}
+		chunk := data[i:end]
+		if fn(string(chunk[:4]), chunk[8:8+size]) {
+			out = append(out, chunk...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks of the WebP image.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	data = bytes.Clone(data)
+	return walkWebP(data, func(chunk string, payload []byte) bool {
+		switch chunk {
+		case "EXIF", "XMP ":
+			return false
+		case "VP8X":
+			if len(payload) > 0 {
+				// clear the EXIF and XMP flags.
+				payload[0] &^= 0x08 | 0x04
+			}
+		}
+		return true
+	})
+}
+
+// gifFrames returns the number of frames of the GIF image.
+func gifFrames(data []byte) (int, error) {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF")) {
+		return 0, errInvalidGIF
+	}
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	skipSubBlocks := func() error {
+		for {
+			if i >= len(data) {
+				return errInvalidGIF
+			}
+			size := int(data[i])
+			i += 1 + size
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+	frames := 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21:
+			i += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x2C:
+			if i+10 > len(data) {
+				return 0, errInvalidGIF
+			}
+			frames++
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			// the minimum code size of LZW.
+			i++
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x3B:
+			return frames, nil
+		default:
+			return 0, errInvalidGIF
+		}
+	}
+	return frames, nil
+}
+
+// isAnimatedImage returns whether the image of the format is animated.
+func isAnimatedImage(format string, data []byte) bool {
+	switch format {
+	case "gif":
+		frames, err := gifFrames(data)
+		return err == nil && frames > 1
+	case "png":
+		animated := false
+		walkPNG(data, func(chunk string) bool {
+			animated = animated || chunk == "acTL"
+			return true
+		})
+		return animated
+	case "webp":
+		animated := false
+		walkWebP(data, func(chunk string, payload []byte) bool {
+			if chunk == "VP8X" && len(payload) > 0 {
+				animated = payload[0]&0x02 != 0
+			}
+			return true
+		})
+		return animated
+	}
+	return false
+}
+
+// orientImage transforms the image by its EXIF orientation, so it is
+// displayed correctly without the orientation.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
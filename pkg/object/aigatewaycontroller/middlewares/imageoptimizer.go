@@ -0,0 +1,419 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	imageOptimizerDefaultMaxDimension = 2048
+	imageOptimizerDefaultQuality      = 85
+	// imageOptimizerMaxPixels bounds the pixels of the images decoded, so
+	// a small image can not exhaust the memory.
+	imageOptimizerMaxPixels = 64 << 20
+
+	// actions of the image optimizations.
+	imageActionResized     = "resized"
+	imageActionReencoded   = "reencoded"
+	imageActionStripped    = "stripped"
+	imageActionPassthrough = "passthrough"
+
+	imageFormatUnknown = "unknown"
+)
+
+type (
+	// ImageOptimizerSpec defines the image optimizer middleware, it
+	// downscales and re-encodes the inline base64 images of chat
+	// completions requests before they are sent to the provider, and
+	// strips their metadata. Animated images are forwarded untouched.
+	ImageOptimizerSpec struct {
+		// MaxDimension is the maximum width and height of images, larger
+		// images are downscaled keeping the aspect ratio, default 2048.
+		MaxDimension int `json:"maxDimension,omitempty"`
+		// Quality is the JPEG quality of the re-encoded images, default 85.
+		Quality int `json:"quality,omitempty"`
+		// MaxImageBytes is the maximum size of a processed image, and
+		// MaxRequestBytes is the maximum total size of the processed images
+		// of a request, requests exceeding them are rejected. 0 means no
+		// limit.
+		MaxImageBytes   int `json:"maxImageBytes,omitempty"`
+		MaxRequestBytes int `json:"maxRequestBytes,omitempty"`
+		// The images of SkipConsumers are forwarded untouched, they are
+		// the consumers authenticated by AIGatewayController, or the
+		// consumers in ConsumerHeader if the consumers are not managed
+		// by the controller.
+		ConsumerHeader string   `json:"consumerHeader,omitempty"`
+		SkipConsumers  []string `json:"skipConsumers,omitempty"`
+	}
+
+	imageOptimizerMiddleware struct {
+		spec          *MiddlewareSpec
+		maxDimension  int
+		quality       int
+		skipConsumers map[string]bool
+	}
+
+	// inlineImage is an inline image in the content of a message.
+	inlineImage struct {
+		message int
+		part    int
+		content map[string]any
+		data    []byte
+	}
+)
+
+func init() {
+	middlewareTypeRegistry[imageOptimizerMiddlewareKind] = reflect.TypeOf(imageOptimizerMiddleware{})
+}
+
+var _ Middleware = (*imageOptimizerMiddleware)(nil)
+
+func (m *imageOptimizerMiddleware) init(spec *MiddlewareSpec) {
+	m.spec = spec
+	m.maxDimension = imageOptimizerDefaultMaxDimension
+	m.quality = imageOptimizerDefaultQuality
+	m.skipConsumers = map[string]bool{}
+	if spec.ImageOptimizer == nil {
+		return
+	}
+	if spec.ImageOptimizer.MaxDimension > 0 {
+		m.maxDimension = spec.ImageOptimizer.MaxDimension
+	}
+	if spec.ImageOptimizer.Quality > 0 {
+		m.quality = spec.ImageOptimizer.Quality
+	}
+	for _, consumer := range spec.ImageOptimizer.SkipConsumers {
+		m.skipConsumers[consumer] = true
+	}
+}
+
+func (m *imageOptimizerMiddleware) validate(spec *MiddlewareSpec) error {
+	s := spec.ImageOptimizer
+	if s == nil {
+		return nil
+	}
+	if s.MaxDimension < 0 {
+		return fmt.Errorf("imageOptimizer middleware %s has negative maxDimension", spec.Name)
+	}
+	if s.Quality < 0 || s.Quality > 100 {
+		return fmt.Errorf("imageOptimizer middleware %s has invalid quality %d, it must be in [1, 100]", spec.Name, s.Quality)
+	}
+	if s.MaxImageBytes < 0 || s.MaxRequestBytes < 0 {
+		return fmt.Errorf("imageOptimizer middleware %s has negative size limits", spec.Name)
+	}
+	return nil
+}
+
+func (m *imageOptimizerMiddleware) Name() string {
+	return m.spec.Name
+}
+
+func (m *imageOptimizerMiddleware) Kind() string {
+	return imageOptimizerMiddlewareKind
+}
+
+func (m *imageOptimizerMiddleware) Spec() *MiddlewareSpec {
+	return m.spec
+}
+
+func (m *imageOptimizerMiddleware) limits() (maxImageBytes, maxRequestBytes int) {
+	if s := m.spec.ImageOptimizer; s != nil {
+		return s.MaxImageBytes, s.MaxRequestBytes
+	}
+	return 0, 0
+}
+
+// skipped returns whether the consumer of the request skips the
+// optimization.
+func (m *imageOptimizerMiddleware) skipped(ctx *aicontext.Context) bool {
+	if len(m.skipConsumers) == 0 {
+		return false
+	}
+	return m.skipConsumers[ctx.ConsumerID(m.spec.ImageOptimizer.ConsumerHeader)]
+}
+
+func (m *imageOptimizerMiddleware) Handle(ctx *aicontext.Context) {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions || m.skipped(ctx) {
+		return
+	}
+	messages, ok := ctx.OpenAIReq["messages"].([]any)
+	if !ok {
+		return
+	}
+	images := findInlineImages(messages)
+	if len(images) == 0 {
+		return
+	}
+
+	maxImageBytes, maxRequestBytes := m.limits()
+	optimizations := make([]*aicontext.ImageOptimization, 0, len(images))
+	urls := make([]string, len(images))
+	originalTotal, total := 0, 0
+	for i, img := range images {
+		data, optimization, err := m.optimizeImage(img.data)
+		if err != nil {
+			m.reject(ctx, "invalid_image", fmt.Sprintf("invalid image in messages[%d].content[%d]: %v", img.message, img.part, err))
+			return
+		}
+		optimization.Message, optimization.Part = img.message, img.part
+		if maxImageBytes > 0 && len(data) > maxImageBytes {
+			m.reject(ctx, "image_too_large", fmt.Sprintf("image in messages[%d].content[%d] is %d bytes after optimization, exceeding the limit of %d bytes",
+				img.message, img.part, len(data), maxImageBytes))
+			return
+		}
+		originalTotal += optimization.OriginalBytes
+		total += len(data)
+		if maxRequestBytes > 0 && total > maxRequestBytes {
+			m.reject(ctx, "image_too_large", fmt.Sprintf("images of the request exceed the limit of %d bytes after optimization", maxRequestBytes))
+			return
+		}
+		if optimization.Action != imageActionPassthrough {
+			urls[i] = "data:image/" + optimization.Format + ";base64," + base64.StdEncoding.EncodeToString(data)
+		}
+		optimizations = append(optimizations, optimization)
+	}
+
+	// the request is modified after all images are processed, so it is
+	// untouched if any of them is rejected.
+	originals := make([]any, len(images))
+	for i, img := range images {
+		originals[i] = img.content["image_url"]
+		if urls[i] != "" {
+			setImageURL(img.content, urls[i])
+		}
+	}
+	body, err := codectool.MarshalJSON(ctx.OpenAIReq)
+	if err != nil {
+		for i, img := range images {
+			img.content["image_url"] = originals[i]
+		}
+		logger.Errorf("failed to marshal request of imageOptimizer middleware %s: %v", m.spec.Name, err)
+		return
+	}
+	ctx.ReqBody = body
+	ctx.AddImageOptimizations(optimizations...)
+	ctx.Ctx.AddTag(fmt.Sprintf("imageOptimizer %s: %d images, %d -> %d bytes", m.spec.Name, len(images), originalTotal, total))
+}
+
+// optimizeImage processes the image, it returns the processed image and
+// how it is processed.
+func (m *imageOptimizerMiddleware) optimizeImage(data []byte) ([]byte, *aicontext.ImageOptimization, error) {
+	optimization := &aicontext.ImageOptimization{OriginalBytes: len(data)}
+	passthrough := func(format string) ([]byte, *aicontext.ImageOptimization, error) {
+		optimization.Action = imageActionPassthrough
+		optimization.OriginalFormat, optimization.Format = format, format
+		optimization.Width, optimization.Height = optimization.OriginalWidth, optimization.OriginalHeight
+		optimization.Bytes = len(data)
+		return data, optimization, nil
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// the provider decides whether the images not recognized are valid.
+		return passthrough(imageFormatUnknown)
+	}
+	optimization.OriginalWidth, optimization.OriginalHeight = config.Width, config.Height
+	if config.Width*config.Height > imageOptimizerMaxPixels {
+		return nil, nil, fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+	if isAnimatedImage(format, data) {
+		return passthrough(format)
+	}
+
+	orientation := 1
+	stripped := data
+	switch format {
+	case "jpeg":
+		orientation = jpegOrientation(data)
+		stripped, err = stripJPEGMetadata(data)
+	case "png":
+		stripped, err = stripPNGMetadata(data)
+	case "webp":
+		stripped, err = stripWebPMetadata(data)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxImageBytes, _ := m.limits()
+	resize := max(config.Width, config.Height) > m.maxDimension
+	if !resize && orientation == 1 && (maxImageBytes == 0 || len(stripped) <= maxImageBytes) {
+		optimization.Action = imageActionStripped
+		optimization.OriginalFormat, optimization.Format = format, format
+		optimization.Width, optimization.Height = config.Width, config.Height
+		optimization.Bytes = len(stripped)
+		return stripped, optimization, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode %s image: %w", format, err)
+	}
+	img = orientImage(downscaleImage(img, m.maxDimension), orientation)
+	encoded, encodedFormat, err := encodeImage(img, m.quality)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	action := imageActionReencoded
+	if resize {
+		action = imageActionResized
+	} else if orientation == 1 && len(encoded) >= len(stripped) {
+		// re-encoding does not make the image smaller.
+		encoded, encodedFormat, action = stripped, format, imageActionStripped
+	}
+	optimization.Action = action
+	optimization.OriginalFormat, optimization.Format = format, encodedFormat
+	optimization.Width, optimization.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	if action == imageActionStripped {
+		optimization.Width, optimization.Height = config.Width, config.Height
+	}
+	optimization.Bytes = len(encoded)
+	return encoded, optimization, nil
+}
+
+func (m *imageOptimizerMiddleware) reject(ctx *aicontext.Context, code, msg string) {
+	ctx.Ctx.AddTag(fmt.Sprintf("imageOptimizer %s: %s", m.spec.Name, msg))
+
+	errMsg := protocol.NewInvalidRequestError(code, msg)
+	data, _ := codectool.MarshalJSON(errMsg)
+	ctx.SetResponse(&aicontext.Response{
+		StatusCode:    http.StatusBadRequest,
+		ContentLength: int64(len(data)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		BodyBytes:     data,
+	})
+	ctx.Stop(aicontext.ResultClientError)
+}
+
+// findInlineImages returns the inline base64 images in the content of the
+// messages, images referenced by URLs are not included.
+func findInlineImages(messages []any) []*inlineImage {
+	images := []*inlineImage{}
+	for i, msg := range messages {
+		message, ok := msg.(map[string]any)
+		if !ok {
+			continue
+		}
+		parts, ok := message["content"].([]any)
+		if !ok {
+			continue
+		}
+		for j, p := range parts {
+			part, ok := p.(map[string]any)
+			if !ok || part["type"] != "image_url" {
+				continue
+			}
+			data, ok := parseImageDataURL(getImageURL(part))
+			if !ok {
+				continue
+			}
+			images = append(images, &inlineImage{message: i, part: j, content: part, data: data})
+		}
+	}
+	return images
+}
+
+// getImageURL returns the URL of the image content, image_url is an
+// object with the URL, or the URL itself in some clients.
+func getImageURL(part map[string]any) string {
+	switch v := part["image_url"].(type) {
+	case string:
+		return v
+	case map[string]any:
+		url, _ := v["url"].(string)
+		return url
+	}
+	return ""
+}
+
+func setImageURL(part map[string]any, url string) {
+	if v, ok := part["image_url"].(map[string]any); ok {
+		updated := make(map[string]any, len(v))
+		for k, val := range v {
+			updated[k] = val
+		}
+		updated["url"] = url
+		part["image_url"] = updated
+		return
+	}
+	part["image_url"] = url
+}
+
+// parseImageDataURL returns the data of the base64 data URL of an image.
+func parseImageDataURL(url string) ([]byte, bool) {
+	if !strings.HasPrefix(url, "data:image/") {
+		return nil, false
+	}
+	meta, encoded, ok := strings.Cut(url[len("data:"):], ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		data, err = base64.RawStdEncoding.DecodeString(encoded)
+	}
+	return data, err == nil
+}
+
+// downscaleImage scales the image down to fit in maxDimension, keeping
+// the aspect ratio.
+func downscaleImage(img image.Image, maxDimension int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if max(w, h) <= maxDimension {
+		return img
+	}
+	if w >= h {
+		w, h = maxDimension, max(h*maxDimension/w, 1)
+	} else {
+		w, h = max(w*maxDimension/h, 1), maxDimension
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// encodeImage encodes opaque images as JPEG, and others as PNG to keep
+// their transparency.
+func encodeImage(img image.Image, quality int) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		err := png.Encode(buf, img)
+		return buf.Bytes(), "png", err
+	}
+	err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	return buf.Bytes(), "jpeg", err
+}
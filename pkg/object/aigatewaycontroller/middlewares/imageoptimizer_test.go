@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+func newImageOptimizer(spec *ImageOptimizerSpec) *imageOptimizerMiddleware {
+	m := &imageOptimizerMiddleware{}
+	m.init(&MiddlewareSpec{Name: "images", Kind: imageOptimizerMiddlewareKind, ImageOptimizer: spec})
+	return m
+}
+
+func newImageContext(t *testing.T, consumer string, urls ...string) *aicontext.Context {
+	content := []any{map[string]any{"type": "text", "text": "what is it?"}}
+	for _, url := range urls {
+		content = append(content, map[string]any{"type": "image_url", "image_url": map[string]any{"url": url, "detail": "high"}})
+	}
+	body, _ := json.Marshal(map[string]any{
+		"model":    "gpt-4.1",
+		"messages": []any{map[string]any{"role": "user", "content": content}},
+	})
+	ctx := egContext.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set("X-Consumer", consumer)
+	setRequest(t, ctx, "images", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+	assert.Nil(t, err)
+	return aiCtx
+}
+
+func dataURL(format string, data []byte) string {
+	return "data:image/" + format + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// requestImages returns the images in the body of the request.
+func requestImages(t *testing.T, ctx *aicontext.Context) [][]byte {
+	req := map[string]any{}
+	assert.Nil(t, json.Unmarshal(ctx.ReqBody, &req))
+	images := [][]byte{}
+	for _, part := range req["messages"].([]any)[0].(map[string]any)["content"].([]any) {
+		p := part.(map[string]any)
+		if p["type"] != "image_url" {
+			continue
+		}
+		assert.Equal(t, "high", p["image_url"].(map[string]any)["detail"])
+		data, ok := parseImageDataURL(getImageURL(p))
+		if !ok {
+			continue
+		}
+		images = append(images, data)
+	}
+	return images
+}
+
+func gradientImage(w, h int, alpha bool) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := uint8(255)
+			if alpha && x < w/2 {
+				a = 0
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: a})
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}))
+	return buf.Bytes()
+}
+
+// withEXIF inserts an EXIF segment with the orientation and a GPS marker
+// into the JPEG image.
+func withEXIF(data []byte, orientation int) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00")
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry, 0x0112)
+	binary.LittleEndian.PutUint16(entry[2:], 3)
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint16(entry[8:], uint16(orientation))
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, []byte("GPS 37.7749N 122.4194W")...)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestImageOptimizerValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{Name: "images", Kind: imageOptimizerMiddlewareKind}
+	assert.Nil(ValidateSpec(spec))
+	spec.ImageOptimizer = &ImageOptimizerSpec{MaxDimension: 1024, Quality: 80, MaxImageBytes: 1 << 20, ConsumerHeader: "X-Consumer", SkipConsumers: []string{"alice"}}
+	assert.Nil(ValidateSpec(spec))
+	for _, invalid := range []*ImageOptimizerSpec{
+		{MaxDimension: -1},
+		{Quality: 101},
+		{MaxRequestBytes: -1},
+	} {
+		spec.ImageOptimizer = invalid
+		assert.Error(ValidateSpec(spec))
+	}
+
+	m := newImageOptimizer(nil)
+	assert.Equal(imageOptimizerDefaultMaxDimension, m.maxDimension)
+	assert.Equal(imageOptimizerDefaultQuality, m.quality)
+}
+
+func TestImageMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	original := encodeJPEG(t, gradientImage(16, 8, false))
+	data := withEXIF(original, 6)
+	assert.Equal(6, jpegOrientation(data))
+	assert.Equal(1, jpegOrientation(original))
+	stripped, err := stripJPEGMetadata(data)
+	assert.Nil(err)
+	assert.Equal(original, stripped)
+	_, err = stripJPEGMetadata([]byte("not a jpeg"))
+	assert.Error(err)
+
+	// png with a text chunk.
+	buf := &bytes.Buffer{}
+	assert.Nil(png.Encode(buf, gradientImage(4, 4, false)))
+	pngData := buf.Bytes()
+	text := []byte("tEXtComment\x00secret")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	withText := append(append(append([]byte{}, pngData[:33]...), chunk...), pngData[33:]...)
+	stripped, err = stripPNGMetadata(withText)
+	assert.Nil(err)
+	assert.Equal(pngData, stripped)
+
+	// webp with EXIF and XMP chunks.
+	riffChunk := func(fourcc string, payload []byte) []byte {
+		c := append([]byte(fourcc), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+		c = append(c, payload...)
+		if len(payload)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	webp := func(chunks ...[]byte) []byte {
+		body := []byte("WEBP")
+		for _, c := range chunks {
+			body = append(body, c...)
+		}
+		return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+	}
+	vp8 := riffChunk("VP8 ", []byte("frame"))
+	data = webp(riffChunk("VP8X", []byte{0x0C, 0, 0, 0, 0, 0, 0, 0, 0, 0}), vp8, riffChunk("EXIF", []byte("gps")), riffChunk("XMP ", []byte("<x/>")))
+	stripped, err = stripWebPMetadata(data)
+	assert.Nil(err)
+	assert.Equal(webp(riffChunk("VP8X", []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), vp8), stripped)
+	assert.False(isAnimatedImage("webp", data))
+	assert.True(isAnimatedImage("webp", webp(riffChunk("VP8X", []byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0}))))
+
+	// orientation 6 rotates the image 90 degrees clockwise.
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 255})
+	img.SetNRGBA(1, 0, color.NRGBA{G: 255, A: 255})
+	rotated := orientImage(img, 6)
+	assert.Equal(image.Rect(0, 0, 1, 2), rotated.Bounds())
+	assert.Equal(color.NRGBA{R: 255, A: 255}, rotated.At(0, 0))
+	assert.Equal(color.NRGBA{G: 255, A: 255}, rotated.At(0, 1))
+	rotated = orientImage(img, 8)
+	assert.Equal(color.NRGBA{G: 255, A: 255}, rotated.At(0, 0))
+}
+
+func TestImageOptimizerHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	large := withEXIF(encodeJPEG(t, gradientImage(3000, 1000, false)), 6)
+	small := withEXIF(encodeJPEG(t, gradientImage(100, 50, false)), 1)
+	buf := &bytes.Buffer{}
+	assert.Nil(png.Encode(buf, gradientImage(400, 200, true)))
+	transparent := buf.Bytes()
+	buf = &bytes.Buffer{}
+	palette := color.Palette{color.Black, color.White}
+	frames := []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 8, 8), palette), image.NewPaletted(image.Rect(0, 0, 8, 8), palette)}
+	assert.Nil(gif.EncodeAll(buf, &gif.GIF{Image: frames, Delay: []int{10, 10}}))
+	animated := buf.Bytes()
+
+	m := newImageOptimizer(&ImageOptimizerSpec{MaxDimension: 256, ConsumerHeader: "X-Consumer", SkipConsumers: []string{"raw"}})
+	ctx := newImageContext(t, "bob", dataURL("jpeg", large), dataURL("jpeg", small), dataURL("png", transparent),
+		dataURL("gif", animated), "https://example.com/cat.png")
+	m.Handle(ctx)
+	assert.False(ctx.IsStopped())
+
+	images := requestImages(t, ctx)
+	assert.Len(images, 4)
+	for _, data := range images[:3] {
+		assert.NotContains(string(data), "Exif")
+		assert.NotContains(string(data), "GPS")
+	}
+	// rotated by the orientation after downscaled.
+	config, format, err := image.DecodeConfig(bytes.NewReader(images[0]))
+	assert.Nil(err)
+	assert.Equal("jpeg", format)
+	assert.Equal(85, config.Width)
+	assert.Equal(256, config.Height)
+	config, _, err = image.DecodeConfig(bytes.NewReader(images[1]))
+	assert.Nil(err)
+	assert.Equal(100, config.Width)
+	config, format, err = image.DecodeConfig(bytes.NewReader(images[2]))
+	assert.Nil(err)
+	assert.Equal("png", format)
+	assert.Equal(256, config.Width)
+	assert.Equal(128, config.Height)
+	assert.Equal(animated, images[3])
+
+	optimizations := ctx.ImageOptimizations()
+	assert.Len(optimizations, 4)
+	assert.Equal(imageActionResized, optimizations[0].Action)
+	assert.Equal(len(large), optimizations[0].OriginalBytes)
+	assert.Equal(len(images[0]), optimizations[0].Bytes)
+	assert.Equal(3000, optimizations[0].OriginalWidth)
+	assert.Equal(imageActionStripped, optimizations[1].Action)
+	assert.Equal(2, optimizations[1].Part)
+	assert.Equal(imageActionResized, optimizations[2].Action)
+	assert.Equal(imageActionPassthrough, optimizations[3].Action)
+	assert.Equal("gif", optimizations[3].Format)
+
+	// skipped consumers.
+	ctx = newImageContext(t, "raw", dataURL("jpeg", large))
+	m.Handle(ctx)
+	assert.Empty(ctx.ImageOptimizations())
+	assert.Contains(string(ctx.ReqBody), base64.StdEncoding.EncodeToString(large))
+
+	// orientation without resizing.
+	ctx = newImageContext(t, "bob", dataURL("jpeg", withEXIF(encodeJPEG(t, gradientImage(100, 50, false)), 6)))
+	m.Handle(ctx)
+	config, _, err = image.DecodeConfig(bytes.NewReader(requestImages(t, ctx)[0]))
+	assert.Nil(err)
+	assert.Equal(50, config.Width)
+	assert.Equal(100, config.Height)
+	assert.Equal(imageActionReencoded, ctx.ImageOptimizations()[0].Action)
+}
+
+func TestImageOptimizerLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	small := encodeJPEG(t, gradientImage(100, 50, false))
+	ctx := newImageContext(t, "bob", dataURL("jpeg", small))
+	body := ctx.ReqBody
+	newImageOptimizer(&ImageOptimizerSpec{MaxImageBytes: 100}).Handle(ctx)
+	assert.True(ctx.IsStopped())
+	assert.Equal(http.StatusBadRequest, ctx.GetResponse().StatusCode)
+	assert.Contains(string(ctx.GetResponse().BodyBytes), "image_too_large")
+	assert.Equal(body, ctx.ReqBody)
+
+	ctx = newImageContext(t, "bob", dataURL("jpeg", small), dataURL("jpeg", small))
+	newImageOptimizer(&ImageOptimizerSpec{MaxRequestBytes: len(small) + 100}).Handle(ctx)
+	assert.True(ctx.IsStopped())
+	assert.Contains(string(ctx.GetResponse().BodyBytes), "images of the request exceed")
+
+	large := encodeJPEG(t, gradientImage(3000, 1000, false))
+	ctx = newImageContext(t, "bob", dataURL("jpeg", large[:len(large)/2]))
+	newImageOptimizer(nil).Handle(ctx)
+	assert.True(ctx.IsStopped())
+	assert.Contains(string(ctx.GetResponse().BodyBytes), "invalid_image")
+}
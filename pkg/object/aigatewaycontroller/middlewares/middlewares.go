@@ -18,18 +18,33 @@
 package middlewares
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/moderation"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
 type (
 	// MiddlewareSpec defines the specification for middleware in the AI Gateway Controller.
 	MiddlewareSpec struct {
-		Name          string             `json:"name" jsonschema:"required"`
-		Kind          string             `json:"kind" jsonschema:"required"`
-		SemanticCache *SemanticCacheSpec `json:"semanticCache,omitempty"`
+		Name string `json:"name" jsonschema:"required"`
+		Kind string `json:"kind" jsonschema:"required"`
+		// Disabled is the initial state of the middleware, it can be
+		// toggled at runtime through the admin API.
+		Disabled              bool                       `json:"disabled,omitempty"`
+		SemanticCache         *SemanticCacheSpec         `json:"semanticCache,omitempty"`
+		TopicGuard            *TopicGuardSpec            `json:"topicGuard,omitempty"`
+		ConsumerPolicy        *ConsumerPolicySpec        `json:"consumerPolicy,omitempty"`
+		Retrieval             *RetrievalSpec             `json:"retrieval,omitempty"`
+		ConversationValidator *ConversationValidatorSpec `json:"conversationValidator,omitempty"`
+		ModerationGuard       *ModerationGuardSpec       `json:"moderationGuard,omitempty"`
+		ImageOptimizer        *ImageOptimizerSpec        `json:"imageOptimizer,omitempty"`
+		ExpressionHook        *ExpressionHookSpec        `json:"expressionHook,omitempty"`
+		PIITokenizer          *PIITokenizerSpec          `json:"piiTokenizer,omitempty"`
 	}
 
 	// Middleware defines the interface for middleware in the AI Gateway Controller.
@@ -42,6 +57,238 @@ type (
 		init(spec *MiddlewareSpec)
 		validate(spec *MiddlewareSpec) error
 	}
+
+	// Prober is implemented by middlewares which can be probed. A probe
+	// runs the same lookup as Handle, but it never changes the response or
+	// any stored data, and it returns how the lookup gets its result.
+	Prober interface {
+		Probe(ctx *aicontext.Context, options *ProbeOptions) (any, error)
+	}
+
+	// ProbeOptions is the options of probing a middleware.
+	ProbeOptions struct {
+		// TopK is the number of candidates to return.
+		TopK int
+	}
+
+	// Simulator is implemented by middlewares whose decision on a request
+	// is derived from the spec and the request alone. A simulation never
+	// calls providers or vector databases, it may change the headers and
+	// the variables of the request like Handle, so the later middlewares
+	// see them.
+	Simulator interface {
+		Simulate(ctx *aicontext.Context) *SimulationStep
+	}
+
+	// SimulationStep is a decision made on a simulated request.
+	SimulationStep struct {
+		Step string `json:"step"`
+		// Decision is pass, reject, skip, select or unknown.
+		Decision string `json:"decision"`
+		// Rules are the IDs of the rules of the spec matched by the step,
+		// like providerGroups[gpt].members[openai].
+		Rules  []string `json:"rules,omitempty"`
+		Detail string   `json:"detail,omitempty"`
+		// RuntimeState is the runtime state the decision depends on, with
+		// the current values used by the simulation.
+		RuntimeState map[string]string `json:"runtimeState,omitempty"`
+	}
+
+	// FeedbackReceiver is implemented by middlewares which accept feedback
+	// on the responses they served.
+	FeedbackReceiver interface {
+		Feedback(feedback *Feedback) error
+	}
+
+	// Feedback tells whether the response served to a request is correct.
+	Feedback struct {
+		RequestID string `json:"requestID"`
+		Correct   bool   `json:"correct"`
+	}
+
+	// ThresholdTuner is implemented by middlewares which tune their
+	// similarity threshold from feedback.
+	ThresholdTuner interface {
+		ThresholdStats() (*ThresholdStats, error)
+		// RevertThreshold reverts the threshold to the one in the spec and
+		// pauses automatic adjustments.
+		RevertThreshold(operator string) (*ThresholdStats, error)
+	}
+
+	// Purger is implemented by middlewares which can purge their caches.
+	Purger interface {
+		Purge(ctx context.Context) (*PurgeResult, error)
+	}
+
+	// FallbackPurger is implemented by middlewares which can purge the
+	// previous generation of their caches only, once it is re-embedded.
+	FallbackPurger interface {
+		PurgeFallback(ctx context.Context) (*PurgeResult, error)
+	}
+
+	// PurgeResult is the result of purging the caches of a middleware.
+	PurgeResult struct {
+		// Collections are the purged collections.
+		Collections []string `json:"collections"`
+		// Sequence is the number of the invalidation broadcast to other
+		// members, it is 0 if the purge is not broadcast.
+		Sequence int64 `json:"sequence,omitempty"`
+	}
+
+	// VectorScrubber is implemented by middlewares which can scan their
+	// collections for invalid vectors and quarantine them.
+	VectorScrubber interface {
+		ScrubVectors(ctx context.Context, dryRun bool) (*ScrubResult, error)
+	}
+
+	// ScrubResult is the result of scrubbing the collections of a middleware.
+	ScrubResult struct {
+		Reports []*vectordb.ScrubReport `json:"reports"`
+	}
+
+	// DocumentIngester is implemented by middlewares which can chunk raw
+	// documents and ingest the chunks into their collections, the progress
+	// is reported by events.
+	DocumentIngester interface {
+		IngestDocuments(ctx context.Context, req *IngestRequest, progress func(*IngestEvent)) error
+	}
+
+	// Reembedder is implemented by middlewares which can embed the
+	// documents of their collections again with the current embedding
+	// model in a background job.
+	Reembedder interface {
+		// EmbeddingModel returns the model the documents are embedded
+		// with.
+		EmbeddingModel() string
+		// PlanReembed estimates the documents, tokens, cost and duration
+		// of re-embedding without embedding anything.
+		PlanReembed(ctx context.Context, req *ReembedRequest) (*ReembedPlan, error)
+		// StartReembed plans and starts re-embedding in the background.
+		StartReembed(ctx context.Context, req *ReembedRequest) (*ReembedStatus, error)
+		// ReembedStatus returns the progress of the running job, or the
+		// status of the last one, it is nil if none is started.
+		ReembedStatus() *ReembedStatus
+		// AbortReembed stops the running job.
+		AbortReembed() (*ReembedStatus, error)
+	}
+
+	// CacheImporter is implemented by middlewares which can import the
+	// request and response pairs of logs as cache entries in a
+	// background job.
+	CacheImporter interface {
+		// StartCacheImport starts importing the records of the file in
+		// the background.
+		StartCacheImport(req *CacheImportRequest) (*CacheImportStatus, error)
+		// CacheImportStatus returns the progress of the running job, or
+		// the report of the last one, it is nil if none is started.
+		CacheImportStatus() *CacheImportStatus
+		// AbortCacheImport stops the running job.
+		AbortCacheImport() (*CacheImportStatus, error)
+	}
+
+	// IntegrityChecker is implemented by middlewares which can check
+	// whether the documents of their collections are all indexed.
+	IntegrityChecker interface {
+		StartIntegrityCheck(repair bool) (*IntegrityResult, error)
+		IntegrityReports() *IntegrityResult
+	}
+
+	// IntegrityResult is the result of the integrity checks of the
+	// collections of a middleware.
+	IntegrityResult struct {
+		Reports []*vectordb.IntegrityReport `json:"reports"`
+	}
+
+	// Rebalancer is implemented by middlewares which can move the
+	// documents of their sharded collections to the shards owning them.
+	Rebalancer interface {
+		StartRebalance() (*RebalanceResult, error)
+		RebalanceReports() *RebalanceResult
+	}
+
+	// RebalanceResult is the result of the rebalances of the collections
+	// of a middleware.
+	RebalanceResult struct {
+		Reports []*vectordb.RebalanceReport `json:"reports"`
+	}
+
+	// ScopeMigrator is implemented by middlewares which can move their
+	// collections created without the scope of the controller under it.
+	ScopeMigrator interface {
+		MigrateToScope(ctx context.Context) (*ScopeMigrationResult, error)
+	}
+
+	// ScopeMigrationResult is the result of moving the collections of a
+	// middleware under the scope.
+	ScopeMigrationResult struct {
+		Reports []*vectordb.ScopeMigrationReport `json:"reports"`
+	}
+
+	// SchemaVersionReporter is implemented by middlewares which can report
+	// the schema versions of the entries in their collections.
+	SchemaVersionReporter interface {
+		SchemaVersions(ctx context.Context) (*SchemaVersionResult, error)
+	}
+
+	// SchemaVersionResult is the schema versions of the entries in the
+	// collections of a middleware.
+	SchemaVersionResult struct {
+		// Current is the schema version of the entries written by this
+		// gateway.
+		Current int                    `json:"current"`
+		Reports []*SchemaVersionReport `json:"reports"`
+	}
+
+	// SchemaVersionReport is the numbers of entries of a collection by
+	// schema version.
+	SchemaVersionReport struct {
+		Collection string        `json:"collection"`
+		Versions   map[int]int64 `json:"versions"`
+		Error      string        `json:"error,omitempty"`
+	}
+
+	// ModeratorSetter is implemented by middlewares which moderate content
+	// with the moderation backend of the controller, so the moderations
+	// endpoint and the middlewares share the backend and its cache.
+	ModeratorSetter interface {
+		SetModerator(moderator *moderation.Moderator)
+	}
+
+	// GeneratorSetter is implemented by middlewares which generate fresh
+	// responses from the providers of the controller in background.
+	GeneratorSetter interface {
+		SetGenerator(generator Generator)
+	}
+
+	// Generator generates a response from a provider without going through
+	// the middlewares, the rate limits or the usage accounting, so the
+	// generation never affects the clients.
+	Generator interface {
+		Generate(ctx context.Context, provider string, respType aicontext.ResponseType, body []byte) ([]byte, error)
+	}
+
+	// Evaluator is implemented by middlewares which evaluate the responses
+	// they served.
+	Evaluator interface {
+		EvaluationReport() (*EvaluationReport, error)
+	}
+
+	// DependencyChecker is implemented by middlewares which depend on
+	// external services, the controller waits for the services to be
+	// reachable before it is ready.
+	DependencyChecker interface {
+		CheckDependencies(ctx context.Context) error
+		// DependenciesReady is called once the dependencies pass the
+		// check, the initializations failed for unreachable dependencies
+		// are retried then.
+		DependenciesReady()
+	}
+
+	// Closer is implemented by middlewares which have resources to release
+	// when they are replaced or the controller is closed.
+	Closer interface {
+		Close()
+	}
 )
 
 var (
@@ -49,7 +296,29 @@ var (
 )
 
 const (
-	semanticCacheMiddlewareKind = "SemanticCache"
+	semanticCacheMiddlewareKind         = "SemanticCache"
+	topicGuardMiddlewareKind            = "TopicGuard"
+	consumerPolicyMiddlewareKind        = "ConsumerPolicy"
+	retrievalMiddlewareKind             = "Retrieval"
+	conversationValidatorMiddlewareKind = "ConversationValidator"
+	moderationGuardMiddlewareKind       = "ModerationGuard"
+	imageOptimizerMiddlewareKind        = "ImageOptimizer"
+	expressionHookMiddlewareKind        = "ExpressionHook"
+	piiTokenizerMiddlewareKind          = "PIITokenizer"
+)
+
+const (
+	// SimulationPass means the request goes on.
+	SimulationPass = "pass"
+	// SimulationReject means the request is rejected.
+	SimulationReject = "reject"
+	// SimulationSkip means the step does not apply to the request.
+	SimulationSkip = "skip"
+	// SimulationSelect means a provider is selected for the request.
+	SimulationSelect = "select"
+	// SimulationUnknown means the decision depends on calls to providers
+	// or vector databases, which are not made by simulations.
+	SimulationUnknown = "unknown"
 )
 
 func NewMiddleware(spec *MiddlewareSpec) Middleware {
@@ -61,6 +330,32 @@ func NewMiddleware(spec *MiddlewareSpec) Middleware {
 	return nil
 }
 
+// ScopeSpec returns the copy of the spec whose vector databases are in the
+// scope, the spec itself is returned if the scope is empty.
+func ScopeSpec(spec *MiddlewareSpec, scope string) *MiddlewareSpec {
+	if scope == "" {
+		return spec
+	}
+	scoped := &MiddlewareSpec{}
+	codectool.MustUnmarshalJSON(codectool.MustMarshalJSON(spec), scoped)
+	var dbSpecs []*vectordb.Spec
+	if c := scoped.SemanticCache; c != nil {
+		dbSpecs = append(dbSpecs, c.VectorDB)
+		if c.Fallback != nil {
+			dbSpecs = append(dbSpecs, c.Fallback.VectorDB)
+		}
+	}
+	if scoped.Retrieval != nil {
+		dbSpecs = append(dbSpecs, scoped.Retrieval.VectorDB)
+	}
+	for _, dbSpec := range dbSpecs {
+		if dbSpec != nil {
+			vectordb.ScopeSpec(dbSpec, scope)
+		}
+	}
+	return scoped
+}
+
 func ValidateSpec(spec *MiddlewareSpec) error {
 	if spec == nil {
 		return fmt.Errorf("middleware spec cannot be nil")
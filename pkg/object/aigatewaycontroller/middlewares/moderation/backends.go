@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+)
+
+const (
+	openaiModerationPath = "/v1/moderations"
+	classifierPath       = "/predict"
+	judgeChatPath        = "/v1/chat/completions"
+
+	judgePrompt = `You are a content moderator. Score how likely the user message belongs to each of the categories: %s.
+Reply with a JSON object only, its keys are the categories and its values are the scores between 0 and 1.`
+)
+
+type (
+	// openaiBackend calls the moderations API of OpenAI.
+	openaiBackend struct {
+		spec *Spec
+	}
+
+	// classifierBackend calls a text classification service compatible
+	// with the /predict API of Hugging Face text-embeddings-inference.
+	classifierBackend struct {
+		spec *Spec
+	}
+
+	// classifierLabel is a label predicted by the classifier.
+	classifierLabel struct {
+		Label string  `json:"label"`
+		Score float64 `json:"score"`
+	}
+
+	// judgeBackend asks an LLM to score the categories of each input.
+	judgeBackend struct {
+		spec *Spec
+	}
+)
+
+// post sends the request to the path of the backend, and decodes the
+// response to out.
+func post(ctx context.Context, spec *Spec, path string, body any, out any) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u, err := url.JoinPath(spec.BaseURL, path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if spec.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+spec.APIKey)
+	}
+	for k, v := range spec.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s moderation request failed with status code %d, %s", spec.Type, resp.StatusCode, string(data))
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
+
+func (b *openaiBackend) moderate(ctx context.Context, inputs []string) ([]*protocol.ModerationResult, error) {
+	req := &protocol.ModerationRequest{Input: inputs, Model: b.spec.Model}
+	resp := &protocol.ModerationResponse{}
+	if err := post(ctx, b.spec, openaiModerationPath, req, resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+func (b *classifierBackend) moderate(ctx context.Context, inputs []string) ([]*protocol.ModerationResult, error) {
+	req := map[string]any{"inputs": inputs}
+	var resp [][]*classifierLabel
+	if err := post(ctx, b.spec, classifierPath, req, &resp); err != nil {
+		return nil, err
+	}
+
+	results := make([]*protocol.ModerationResult, 0, len(resp))
+	for _, labels := range resp {
+		scores := map[string]float64{}
+		for _, label := range labels {
+			category, ok := b.spec.Labels[label.Label]
+			if !ok {
+				category = label.Label
+			}
+			if !isCategory(category) {
+				continue
+			}
+			// several labels may be mapped to the same category.
+			if score, ok := scores[category]; !ok || label.Score > score {
+				scores[category] = label.Score
+			}
+		}
+		results = append(results, newResult(scores, threshold(b.spec)))
+	}
+	return results, nil
+}
+
+func (b *judgeBackend) categories() []string {
+	if len(b.spec.Categories) > 0 {
+		return b.spec.Categories
+	}
+	return Categories
+}
+
+func (b *judgeBackend) moderate(ctx context.Context, inputs []string) ([]*protocol.ModerationResult, error) {
+	categories := b.categories()
+	results := make([]*protocol.ModerationResult, 0, len(inputs))
+	for _, input := range inputs {
+		req := map[string]any{
+			"model":       b.spec.Model,
+			"temperature": 0,
+			"stream":      false,
+			"messages": []map[string]any{
+				{"role": "system", "content": fmt.Sprintf(judgePrompt, strings.Join(categories, ", "))},
+				{"role": "user", "content": input},
+			},
+			"response_format": map[string]any{"type": "json_object"},
+		}
+		resp := &struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}{}
+		if err := post(ctx, b.spec, judgeChatPath, req, resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Choices) == 0 {
+			return nil, fmt.Errorf("judge moderation response has no choices")
+		}
+
+		content := strings.TrimSpace(resp.Choices[0].Message.Content)
+		content = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(content, "```json"), "```"), "```")
+		judged := map[string]float64{}
+		if err := json.Unmarshal([]byte(content), &judged); err != nil {
+			return nil, fmt.Errorf("failed to parse judge scores %q: %w", content, err)
+		}
+		scores := map[string]float64{}
+		for _, category := range categories {
+			if score, ok := judged[category]; ok {
+				scores[category] = min(max(score, 0), 1)
+			}
+		}
+		results = append(results, newResult(scores, threshold(b.spec)))
+	}
+	return results, nil
+}
+
+func isCategory(category string) bool {
+	return slices.Contains(Categories, category)
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package moderation provides the moderation backends shared by the
+// moderations endpoint and the ModerationGuard middleware.
+package moderation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+)
+
+// Backend types.
+const (
+	TypeOpenAI     = "openai"
+	TypeClassifier = "classifier"
+	TypeJudge      = "judge"
+)
+
+const (
+	defaultThreshold = 0.5
+	defaultCacheTTL  = 10 * time.Minute
+	defaultCacheSize = 10000
+)
+
+// Categories are the moderation categories of OpenAI, the results of all
+// backends have them, and the ones not supported by a backend are null.
+var Categories = []string{
+	"harassment",
+	"harassment/threatening",
+	"hate",
+	"hate/threatening",
+	"illicit",
+	"illicit/violent",
+	"self-harm",
+	"self-harm/instructions",
+	"self-harm/intent",
+	"sexual",
+	"sexual/minors",
+	"violence",
+	"violence/graphic",
+}
+
+type (
+	// Spec defines the moderation backend.
+	Spec struct {
+		// Type is openai for the moderations API of OpenAI, classifier for
+		// a local text classification service, or judge for an LLM
+		// scoring the categories.
+		Type    string            `json:"type" jsonschema:"required,enum=openai,enum=classifier,enum=judge"`
+		BaseURL string            `json:"baseURL" jsonschema:"required"`
+		APIKey  string            `json:"apiKey,omitempty"`
+		Headers map[string]string `json:"headers,omitempty"`
+		// Model is the moderation model of openai, or the chat model of
+		// judge.
+		Model string `json:"model,omitempty"`
+		// Threshold is the score flagging a category by classifier and
+		// judge, default is 0.5.
+		Threshold float64 `json:"threshold,omitempty"`
+		// Labels maps the labels of classifier to categories, the labels
+		// not in it are used as categories.
+		Labels map[string]string `json:"labels,omitempty"`
+		// Categories are the categories scored by judge, default is all.
+		Categories []string `json:"categories,omitempty"`
+		// CacheTTL is how long the results are cached by the hash of the
+		// inputs, default is 10m, 0s disables the cache.
+		CacheTTL  string `json:"cacheTTL,omitempty" jsonschema:"format=duration"`
+		CacheSize int    `json:"cacheSize,omitempty"`
+	}
+
+	// backend moderates inputs, the results are in the order of inputs.
+	backend interface {
+		moderate(ctx context.Context, inputs []string) ([]*protocol.ModerationResult, error)
+	}
+
+	// Moderator moderates inputs with the backend, and caches the results.
+	Moderator struct {
+		spec      *Spec
+		backend   backend
+		cache     *cache.Cache
+		cacheSize int
+
+		inputs *prometheus.CounterVec
+		errors *prometheus.CounterVec
+	}
+)
+
+// ValidateSpec validates the spec of the moderation backend.
+func ValidateSpec(spec *Spec) error {
+	if spec == nil {
+		return nil
+	}
+	switch spec.Type {
+	case TypeOpenAI, TypeClassifier:
+	case TypeJudge:
+		if spec.Model == "" {
+			return fmt.Errorf("model is required for judge moderation backend")
+		}
+	default:
+		return fmt.Errorf("unknown moderation backend type: %s", spec.Type)
+	}
+	if spec.BaseURL == "" {
+		return fmt.Errorf("baseURL is required for moderation backend")
+	}
+	if spec.Threshold < 0 || spec.Threshold > 1 {
+		return fmt.Errorf("threshold of moderation backend must be in [0, 1]")
+	}
+	for label, category := range spec.Labels {
+		if !isCategory(category) {
+			return fmt.Errorf("label %s is mapped to unknown category %s", label, category)
+		}
+	}
+	for _, category := range spec.Categories {
+		if !isCategory(category) {
+			return fmt.Errorf("unknown category %s", category)
+		}
+	}
+	if spec.CacheTTL != "" {
+		ttl, err := time.ParseDuration(spec.CacheTTL)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid cacheTTL %s", spec.CacheTTL)
+		}
+	}
+	if spec.CacheSize < 0 {
+		return fmt.Errorf("cacheSize of moderation backend cannot be negative")
+	}
+	return nil
+}
+
+// New creates a moderator, the spec must be validated.
+func New(spec *Spec) *Moderator {
+	m := &Moderator{
+		spec:      spec,
+		cacheSize: defaultCacheSize,
+		inputs:    metricshub.ModerationInputs.NewCounter(),
+		errors:    metricshub.ModerationErrors.NewCounter(),
+	}
+	switch spec.Type {
+	case TypeOpenAI:
+		m.backend = &openaiBackend{spec: spec}
+	case TypeClassifier:
+		m.backend = &classifierBackend{spec: spec}
+	case TypeJudge:
+		m.backend = &judgeBackend{spec: spec}
+	}
+
+	ttl := defaultCacheTTL
+	if spec.CacheTTL != "" {
+		ttl, _ = time.ParseDuration(spec.CacheTTL)
+	}
+	if spec.CacheSize > 0 {
+		m.cacheSize = spec.CacheSize
+	}
+	if ttl > 0 {
+		m.cache = cache.New(ttl, max(ttl, time.Minute))
+	}
+	return m
+}
+
+// Model returns the model reported in the moderation responses.
+func (m *Moderator) Model() string {
+	if m.spec.Model != "" {
+		return m.spec.Model
+	}
+	return m.spec.Type
+}
+
+func cacheKey(input string) string {
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])
+}
+
+// Moderate returns the results of the inputs in order, the cached results
+// are reused, and only the others are sent to the backend.
+func (m *Moderator) Moderate(ctx context.Context, inputs []string) ([]*protocol.ModerationResult, error) {
+	results := make([]*protocol.ModerationResult, len(inputs))
+	var missed []string
+	var missedIndexes []int
+	for i, input := range inputs {
+		if m.cache != nil {
+			if v, ok := m.cache.Get(cacheKey(input)); ok {
+				results[i] = v.(*protocol.ModerationResult)
+				m.count(true, results[i])
+				continue
+			}
+		}
+		missed = append(missed, input)
+		missedIndexes = append(missedIndexes, i)
+	}
+	if len(missed) == 0 {
+		return results, nil
+	}
+
+	moderated, err := m.backend.moderate(ctx, missed)
+	if err == nil && len(moderated) != len(missed) {
+		err = fmt.Errorf("moderation backend returns %d results for %d inputs", len(moderated), len(missed))
+	}
+	if err != nil {
+		if m.errors != nil {
+			m.errors.With(prometheus.Labels{"backend": m.spec.Type}).Inc()
+		}
+		return nil, err
+	}
+	for i, result := range moderated {
+		fillCategories(result)
+		results[missedIndexes[i]] = result
+		m.count(false, result)
+		if m.cache != nil && m.cache.ItemCount() < m.cacheSize {
+			m.cache.SetDefault(cacheKey(missed[i]), result)
+		}
+	}
+	return results, nil
+}
+
+func (m *Moderator) count(cached bool, result *protocol.ModerationResult) {
+	if m.inputs == nil {
+		return
+	}
+	m.inputs.With(prometheus.Labels{
+		"backend": m.spec.Type,
+		"cached":  strconv.FormatBool(cached),
+		"flagged": strconv.FormatBool(result.Flagged),
+	}).Inc()
+}
+
+// FlaggedCategories returns the flagged categories of the result in the
+// order of Categories.
+func FlaggedCategories(result *protocol.ModerationResult) []string {
+	var flagged []string
+	for _, category := range Categories {
+		if v := result.Categories[category]; v != nil && *v {
+			flagged = append(flagged, category)
+		}
+	}
+	return flagged
+}
+
+// newResult returns the result of the scores, a category is flagged if
+// its score reaches the threshold.
+func newResult(scores map[string]float64, threshold float64) *protocol.ModerationResult {
+	result := &protocol.ModerationResult{
+		Categories:     map[string]*bool{},
+		CategoryScores: map[string]*float64{},
+	}
+	for category, score := range scores {
+		flagged := score >= threshold
+		result.Categories[category] = &flagged
+		result.CategoryScores[category] = &score
+		result.Flagged = result.Flagged || flagged
+	}
+	return result
+}
+
+// fillCategories sets the categories missing in the result to null, so
+// the results of all backends have the same fields.
+func fillCategories(result *protocol.ModerationResult) {
+	if result.Categories == nil {
+		result.Categories = map[string]*bool{}
+	}
+	if result.CategoryScores == nil {
+		result.CategoryScores = map[string]*float64{}
+	}
+	for _, category := range Categories {
+		if _, ok := result.Categories[category]; !ok {
+			result.Categories[category] = nil
+		}
+		if _, ok := result.CategoryScores[category]; !ok {
+			result.CategoryScores[category] = nil
+		}
+	}
+}
+
+func threshold(spec *Spec) float64 {
+	if spec.Threshold > 0 {
+		return spec.Threshold
+	}
+	return defaultThreshold
+}
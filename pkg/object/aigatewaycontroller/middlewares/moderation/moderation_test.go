@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	m.Run()
+}
+
+func TestValidateSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(ValidateSpec(nil))
+	assert.Nil(ValidateSpec(&Spec{Type: TypeOpenAI, BaseURL: "http://localhost"}))
+	assert.Nil(ValidateSpec(&Spec{Type: TypeJudge, BaseURL: "http://localhost", Model: "gpt-4.1", Categories: []string{"hate"}}))
+
+	for _, spec := range []*Spec{
+		{Type: "unknown", BaseURL: "http://localhost"},
+		{Type: TypeOpenAI},
+		{Type: TypeJudge, BaseURL: "http://localhost"},
+		{Type: TypeClassifier, BaseURL: "http://localhost", Threshold: 1.5},
+		{Type: TypeClassifier, BaseURL: "http://localhost", Labels: map[string]string{"toxic": "rude"}},
+		{Type: TypeJudge, BaseURL: "http://localhost", Model: "gpt-4.1", Categories: []string{"rude"}},
+		{Type: TypeOpenAI, BaseURL: "http://localhost", CacheTTL: "forever"},
+		{Type: TypeOpenAI, BaseURL: "http://localhost", CacheSize: -1},
+	} {
+		assert.NotNil(ValidateSpec(spec), "%+v", spec)
+	}
+}
+
+func TestOpenAIBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(openaiModerationPath, r.URL.Path)
+		assert.Equal("Bearer key", r.Header.Get("Authorization"))
+		body, _ := io.ReadAll(r.Body)
+		req := map[string]any{}
+		assert.Nil(json.Unmarshal(body, &req))
+		assert.Equal("omni-moderation-latest", req["model"])
+
+		var results []map[string]any
+		for _, input := range req["input"].([]any) {
+			flagged := input == "I will hurt you"
+			results = append(results, map[string]any{
+				"flagged":         flagged,
+				"categories":      map[string]any{"violence": flagged},
+				"category_scores": map[string]any{"violence": map[bool]float64{true: 0.9, false: 0.01}[flagged]},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": "modr-1", "model": "omni-moderation-latest", "results": results})
+	}))
+	defer server.Close()
+
+	m := New(&Spec{Type: TypeOpenAI, BaseURL: server.URL, APIKey: "key", Model: "omni-moderation-latest"})
+	results, err := m.Moderate(context.Background(), []string{"hello", "I will hurt you"})
+	assert.Nil(err)
+	assert.Len(results, 2)
+	assert.False(results[0].Flagged)
+	assert.True(results[1].Flagged)
+	assert.Equal([]string{"violence"}, FlaggedCategories(results[1]))
+	// the categories not returned by the backend are null.
+	assert.Contains(results[1].Categories, "hate")
+	assert.Nil(results[1].Categories["hate"])
+	assert.Nil(results[1].CategoryScores["hate"])
+	data, err := json.Marshal(results[1])
+	assert.Nil(err)
+	assert.Contains(string(data), `"hate":null`)
+
+	// the cached results are reused, only the new inputs are moderated.
+	results, err = m.Moderate(context.Background(), []string{"I will hurt you", "bye"})
+	assert.Nil(err)
+	assert.True(results[0].Flagged)
+	assert.False(results[1].Flagged)
+	assert.Equal(2, calls)
+	_, err = m.Moderate(context.Background(), []string{"hello", "bye"})
+	assert.Nil(err)
+	assert.Equal(2, calls)
+
+	// the cache is disabled.
+	m = New(&Spec{Type: TypeOpenAI, BaseURL: server.URL, APIKey: "key", Model: "omni-moderation-latest", CacheTTL: "0s"})
+	m.Moderate(context.Background(), []string{"hello"})
+	m.Moderate(context.Background(), []string{"hello"})
+	assert.Equal(4, calls)
+}
+
+func TestClassifierBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(classifierPath, r.URL.Path)
+		w.Write([]byte(`[
+			[{"label": "toxic", "score": 0.3}, {"label": "insult", "score": 0.8}, {"label": "neutral", "score": 0.1}],
+			[{"label": "hate", "score": 0.2}]
+		]`))
+	}))
+	defer server.Close()
+
+	m := New(&Spec{
+		Type:    TypeClassifier,
+		BaseURL: server.URL,
+		Labels:  map[string]string{"toxic": "harassment", "insult": "harassment"},
+	})
+	results, err := m.Moderate(context.Background(), []string{"you idiot", "hmm"})
+	assert.Nil(err)
+	assert.True(results[0].Flagged)
+	assert.Equal(0.8, *results[0].CategoryScores["harassment"])
+	assert.Nil(results[0].CategoryScores["hate"])
+	assert.False(results[1].Flagged)
+	assert.False(*results[1].Categories["hate"])
+	assert.Nil(results[1].Categories["harassment"])
+	assert.Equal("classifier", m.Model())
+
+	// the number of results must match the inputs.
+	_, err = m.Moderate(context.Background(), []string{"a", "b", "c"})
+	assert.Error(err)
+}
+
+func TestJudgeBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(judgeChatPath, r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		req := map[string]any{}
+		assert.Nil(json.Unmarshal(body, &req))
+		assert.Equal("gpt-4.1-mini", req["model"])
+		assert.Contains(req["messages"].([]any)[0].(map[string]any)["content"], "hate, violence")
+
+		content := "```json\n{\"hate\": 0.05, \"violence\": 1.2, \"sexual\": 0.9}\n```"
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []any{map[string]any{"message": map[string]any{"role": "assistant", "content": content}}},
+		})
+	}))
+	defer server.Close()
+
+	m := New(&Spec{
+		Type:       TypeJudge,
+		BaseURL:    server.URL,
+		Model:      "gpt-4.1-mini",
+		Threshold:  0.7,
+		Categories: []string{"hate", "violence"},
+	})
+	results, err := m.Moderate(context.Background(), []string{"some text"})
+	assert.Nil(err)
+	assert.True(results[0].Flagged)
+	assert.Equal(1.0, *results[0].CategoryScores["violence"])
+	assert.False(*results[0].Categories["hate"])
+	// the categories not judged are null.
+	assert.Nil(results[0].Categories["sexual"])
+}
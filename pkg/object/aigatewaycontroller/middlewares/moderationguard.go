@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/moderation"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// ModerationGuardSpec blocks the requests flagged by the moderation
+	// backend of the controller.
+	ModerationGuardSpec struct {
+		// Categories are the categories blocking requests, requests flagged
+		// in any category are blocked if it is empty.
+		Categories      []string `json:"categories,omitempty"`
+		ContentTemplate string   `json:"contentTemplate,omitempty"`
+		// Shadow annotates the flagged requests without blocking them.
+		Shadow bool `json:"shadow,omitempty"`
+	}
+
+	moderationGuardMiddleware struct {
+		spec      *MiddlewareSpec
+		template  *template.Template
+		moderator *moderation.Moderator
+		hits      *prometheus.CounterVec
+	}
+)
+
+func init() {
+	middlewareTypeRegistry[moderationGuardMiddlewareKind] = reflect.TypeOf(moderationGuardMiddleware{})
+}
+
+var (
+	_ Middleware      = (*moderationGuardMiddleware)(nil)
+	_ ModeratorSetter = (*moderationGuardMiddleware)(nil)
+)
+
+// RequiresModerator returns whether the middleware needs the moderation
+// backend of the controller.
+func RequiresModerator(spec *MiddlewareSpec) bool {
+	return spec.Kind == moderationGuardMiddlewareKind
+}
+
+func (m *moderationGuardMiddleware) init(spec *MiddlewareSpec) {
+	m.spec = spec
+	templateText := spec.ModerationGuard.ContentTemplate
+	if templateText == "" {
+		templateText = semanticCacheDefaultContentTemplate
+	}
+	m.template = template.Must(template.New("").Parse(templateText))
+	m.hits = metricshub.ModerationGuardHits.NewCounter()
+}
+
+func (m *moderationGuardMiddleware) validate(spec *MiddlewareSpec) error {
+	if spec.ModerationGuard == nil {
+		return fmt.Errorf("moderationGuard middleware %s must have a moderationGuard spec", spec.Name)
+	}
+	for _, category := range spec.ModerationGuard.Categories {
+		if !slices.Contains(moderation.Categories, category) {
+			return fmt.Errorf("moderationGuard middleware %s has unknown category %s", spec.Name, category)
+		}
+	}
+	if spec.ModerationGuard.ContentTemplate != "" {
+		if _, err := template.New("").Parse(spec.ModerationGuard.ContentTemplate); err != nil {
+			return fmt.Errorf("moderationGuard middleware %s has invalid content template: %w", spec.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *moderationGuardMiddleware) Name() string {
+	return m.spec.Name
+}
+
+func (m *moderationGuardMiddleware) Kind() string {
+	return moderationGuardMiddlewareKind
+}
+
+func (m *moderationGuardMiddleware) Spec() *MiddlewareSpec {
+	return m.spec
+}
+
+// SetModerator sets the moderation backend of the controller.
+func (m *moderationGuardMiddleware) SetModerator(moderator *moderation.Moderator) {
+	m.moderator = moderator
+}
+
+func (m *moderationGuardMiddleware) Handle(ctx *aicontext.Context) {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions && ctx.RespType != aicontext.ResponseTypeCompletions {
+		return
+	}
+	if m.moderator == nil {
+		logger.Errorf("moderationGuard middleware %s has no moderation backend", m.spec.Name)
+		return
+	}
+
+	var content bytes.Buffer
+	if err := m.template.Execute(&content, ctx.OpenAIReq); err != nil {
+		logger.Errorf("failed to execute template for moderation guard: %v", err)
+		return
+	}
+	if content.Len() == 0 {
+		return
+	}
+	results, err := m.moderator.Moderate(ctx.Req.Context(), []string{content.String()})
+	if err != nil {
+		logger.Errorf("failed to moderate content for moderationGuard middleware %s: %v", m.spec.Name, err)
+		return
+	}
+
+	action := topicGuardActionBlock
+	if m.spec.ModerationGuard.Shadow {
+		action = topicGuardActionAnnotate
+	}
+	var flagged []string
+	for _, category := range moderation.FlaggedCategories(results[0]) {
+		if len(m.spec.ModerationGuard.Categories) > 0 && !slices.Contains(m.spec.ModerationGuard.Categories, category) {
+			continue
+		}
+		flagged = append(flagged, category)
+		if m.hits != nil {
+			m.hits.With(prometheus.Labels{
+				"middleware": m.spec.Name,
+				"category":   category,
+				"action":     action,
+			}).Inc()
+		}
+	}
+	if len(flagged) == 0 {
+		return
+	}
+	ctx.Ctx.AddTag(fmt.Sprintf("moderationGuard %s: categories %s, action %s",
+		m.spec.Name, strings.Join(flagged, ","), action))
+	if action != topicGuardActionBlock {
+		return
+	}
+
+	errMsg := protocol.NewError(http.StatusBadRequest, fmt.Sprintf("request is rejected, it is flagged for %s by moderation", strings.Join(flagged, ", ")))
+	data, _ := codectool.MarshalJSON(errMsg)
+	ctx.SetResponse(&aicontext.Response{
+		StatusCode:    http.StatusBadRequest,
+		ContentLength: int64(len(data)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		BodyBytes:     data,
+	})
+	ctx.Stop(aicontext.ResultMiddlewareError)
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/moderation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModerationGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[[{"label": "harassment", "score": 0.9}, {"label": "hate", "score": 0.6}]]`))
+	}))
+	defer server.Close()
+	moderator := moderation.New(&moderation.Spec{Type: moderation.TypeClassifier, BaseURL: server.URL, CacheTTL: "0s"})
+
+	newGuard := func(spec *ModerationGuardSpec) *moderationGuardMiddleware {
+		middlewareSpec := &MiddlewareSpec{Name: "guard", Kind: moderationGuardMiddlewareKind, ModerationGuard: spec}
+		assert.Nil(ValidateSpec(middlewareSpec))
+		m := NewMiddleware(middlewareSpec).(*moderationGuardMiddleware)
+		m.SetModerator(moderator)
+		return m
+	}
+
+	assert.NotNil(ValidateSpec(&MiddlewareSpec{Name: "guard", Kind: moderationGuardMiddlewareKind}))
+	assert.NotNil(ValidateSpec(&MiddlewareSpec{
+		Name: "guard", Kind: moderationGuardMiddlewareKind,
+		ModerationGuard: &ModerationGuardSpec{Categories: []string{"rude"}},
+	}))
+	assert.True(RequiresModerator(&MiddlewareSpec{Kind: moderationGuardMiddlewareKind}))
+
+	messages := `[{"role": "user", "content": "you idiot"}]`
+
+	// flagged in any category.
+	aiCtx := newConversationContext(t, "openai", messages)
+	newGuard(&ModerationGuardSpec{}).Handle(aiCtx)
+	assert.True(aiCtx.IsStopped())
+	assert.Equal(http.StatusBadRequest, aiCtx.GetResponse().StatusCode)
+	assert.Contains(string(aiCtx.GetResponse().BodyBytes), "harassment, hate")
+
+	// the flagged categories are not blocking.
+	aiCtx = newConversationContext(t, "openai", messages)
+	newGuard(&ModerationGuardSpec{Categories: []string{"violence"}}).Handle(aiCtx)
+	assert.False(aiCtx.IsStopped())
+
+	// shadow mode annotates only.
+	aiCtx = newConversationContext(t, "openai", messages)
+	newGuard(&ModerationGuardSpec{Categories: []string{"hate"}, Shadow: true}).Handle(aiCtx)
+	assert.False(aiCtx.IsStopped())
+
+	// no moderation backend.
+	aiCtx = newConversationContext(t, "openai", messages)
+	guard := newGuard(&ModerationGuardSpec{})
+	guard.SetModerator(nil)
+	guard.Handle(aiCtx)
+	assert.False(aiCtx.IsStopped())
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package objectstore provides a minimal client of S3 compatible object
+// stores, used to keep the payloads moved out of the vector databases.
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/util/signer"
+)
+
+const (
+	defaultRegion  = "us-east-1"
+	defaultTimeout = 5 * time.Second
+
+	service             = "s3"
+	contentSHA256Header = "X-Amz-Content-Sha256"
+	securityTokenHeader = "X-Amz-Security-Token"
+)
+
+// ErrNotFound means the object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+var sigV4Literal = &signer.Literal{
+	ScopeSuffix:      "aws4_request",
+	AlgorithmName:    "X-Amz-Algorithm",
+	AlgorithmValue:   "AWS4-HMAC-SHA256",
+	SignedHeaders:    "X-Amz-SignedHeaders",
+	Signature:        "X-Amz-Signature",
+	Date:             "X-Amz-Date",
+	Expires:          "X-Amz-Expires",
+	Credential:       "X-Amz-Credential",
+	ContentSHA256:    contentSHA256Header,
+	SigningKeyPrefix: "AWS4",
+}
+
+type (
+	// Spec defines the object store, the objects are addressed in path
+	// style, that is <endpoint>/<bucket>/<prefix><key>.
+	Spec struct {
+		Endpoint string `json:"endpoint" jsonschema:"required"`
+		Bucket   string `json:"bucket" jsonschema:"required"`
+		// Region is the region of the bucket, it defaults to us-east-1.
+		Region string `json:"region,omitempty"`
+		// Prefix is prepended to the keys of the objects.
+		Prefix          string `json:"prefix,omitempty"`
+		AccessKeyID     string `json:"accessKeyID,omitempty"`
+		SecretAccessKey string `json:"secretAccessKey,omitempty"`
+		SessionToken    string `json:"sessionToken,omitempty"`
+		// Timeout is the timeout of each request, it defaults to 5s.
+		Timeout string `json:"timeout,omitempty" jsonschema:"format=duration"`
+	}
+
+	// Store reads and writes the objects of a bucket.
+	Store struct {
+		spec    *Spec
+		signer  *signer.Signer
+		client  *http.Client
+		timeout time.Duration
+	}
+)
+
+// ValidateSpec validates the spec of the object store.
+func ValidateSpec(spec *Spec) error {
+	if spec.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	u, err := url.Parse(spec.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", spec.Endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid endpoint %q, the scheme must be http or https", spec.Endpoint)
+	}
+	if spec.Bucket == "" {
+		return fmt.Errorf("bucket is required")
+	}
+	if (spec.AccessKeyID == "") != (spec.SecretAccessKey == "") {
+		return fmt.Errorf("accessKeyID and secretAccessKey must be set together")
+	}
+	if spec.Timeout != "" {
+		d, err := time.ParseDuration(spec.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q: %w", spec.Timeout, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("timeout must be positive")
+		}
+	}
+	return nil
+}
+
+// New creates the object store, the spec must be valid. The requests are
+// signed with AWS Signature Version 4 if the credential is set.
+func New(spec *Spec) *Store {
+	s := &Store{
+		spec:    spec,
+		client:  &http.Client{},
+		timeout: defaultTimeout,
+	}
+	if spec.Timeout != "" {
+		s.timeout, _ = time.ParseDuration(spec.Timeout)
+	}
+	if spec.AccessKeyID != "" {
+		s.signer = signer.New().SetLiteral(sigV4Literal).SetCredential(spec.AccessKeyID, spec.SecretAccessKey)
+	}
+	return s
+}
+
+func (s *Store) region() string {
+	if s.spec.Region == "" {
+		return defaultRegion
+	}
+	return s.spec.Region
+}
+
+// Put writes the object.
+func (s *Store) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get reads the object, it returns ErrNotFound if the object does not
+// exist.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// Delete deletes the object, deleting an object which does not exist
+// succeeds.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends the request of the object, the body of the response must be
+// closed by the caller if there is no error.
+func (s *Store) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	u, err := url.JoinPath(s.spec.Endpoint, s.spec.Bucket, s.spec.Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if body == nil {
+		req.Body, req.ContentLength = nil, 0
+	}
+	if err := s.sign(req, body); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if resp.StatusCode/100 != 2 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%s object %s failed with status code %d, %s", strings.ToLower(method), key, resp.StatusCode, string(data))
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (s *Store) sign(req *http.Request, body []byte) error {
+	if s.signer == nil {
+		return nil
+	}
+	// the body hash is passed in the header, which is required by S3, so
+	// the signer never reads the body.
+	hash := sha256.Sum256(body)
+	req.Header.Set(contentSHA256Header, hex.EncodeToString(hash[:]))
+	if s.spec.SessionToken != "" {
+		req.Header.Set(securityTokenHeader, s.spec.SessionToken)
+	}
+	return s.signer.NewSigningContext(time.Now(), s.region(), service).Sign(req, nil)
+}
+
+// cancelBody cancels the context of the request when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
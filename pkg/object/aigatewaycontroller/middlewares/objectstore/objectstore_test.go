@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error(ValidateSpec(&Spec{Bucket: "b"}))
+	assert.Error(ValidateSpec(&Spec{Endpoint: "ftp://x", Bucket: "b"}))
+	assert.Error(ValidateSpec(&Spec{Endpoint: "http://x"}))
+	assert.Error(ValidateSpec(&Spec{Endpoint: "http://x", Bucket: "b", AccessKeyID: "id"}))
+	assert.Error(ValidateSpec(&Spec{Endpoint: "http://x", Bucket: "b", Timeout: "abc"}))
+	assert.Error(ValidateSpec(&Spec{Endpoint: "http://x", Bucket: "b", Timeout: "-1s"}))
+	assert.NoError(ValidateSpec(&Spec{Endpoint: "http://x", Bucket: "b", AccessKeyID: "id", SecretAccessKey: "secret", Timeout: "1s"}))
+}
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=id/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get(contentSHA256Header) == "" || r.Header.Get(securityTokenHeader) != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = data
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case http.MethodDelete:
+			if _, ok := objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	store := New(&Spec{
+		Endpoint:        server.URL,
+		Bucket:          "cache",
+		Region:          "eu-west-1",
+		Prefix:          "cold/",
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+	})
+	ctx := context.Background()
+
+	assert.NoError(store.Put(ctx, "index/1", []byte("hello")))
+	assert.Contains(objects, "/cache/cold/index/1")
+
+	data, err := store.Get(ctx, "index/1")
+	assert.NoError(err)
+	assert.Equal("hello", string(data))
+
+	assert.NoError(store.Delete(ctx, "index/1"))
+	_, err = store.Get(ctx, "index/1")
+	assert.True(errors.Is(err, ErrNotFound))
+	assert.NoError(store.Delete(ctx, "index/1"))
+
+	// requests without the credential are rejected.
+	store = New(&Spec{Endpoint: server.URL, Bucket: "cache"})
+	err = store.Put(ctx, "index/1", []byte("hello"))
+	assert.Error(err)
+	assert.False(errors.Is(err, ErrNotFound))
+	assert.Contains(err.Error(), "403")
+}
@@ -0,0 +1,474 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	thinkBlocksKeep      = "keep"
+	thinkBlocksStrip     = "strip"
+	thinkBlocksReasoning = "reasoning"
+
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+
+	// reasoningContentField is the field of messages and deltas carrying
+	// the reasoning, like DeepSeek.
+	reasoningContentField = "reasoning_content"
+
+	outputScrubDefaultMaxPatternLength = 64
+)
+
+type (
+	// OutputScrubber removes the tokens leaked by models from the responses
+	// of a provider. It runs before the other response handlers, so the
+	// responses sent to users and cached are both scrubbed.
+	OutputScrubber struct {
+		provider string
+		rules    []*outputScrubRule
+		hits     *prometheus.CounterVec
+	}
+
+	outputScrubRule struct {
+		spec     *aicontext.OutputScrubSpec
+		patterns []*regexp.Regexp
+	}
+
+	// textScrubber scrubs the content of a choice. The streaming content
+	// which may be the beginning of a tag, a token or a match of a pattern
+	// is held back until the following content arrives.
+	textScrubber struct {
+		rule *outputScrubRule
+		hit  func(pattern string, n int)
+
+		inThink      bool
+		thinkPending string
+		pending      string
+	}
+)
+
+// ValidateOutputScrubSpecs validates the output scrub rules of a provider.
+func ValidateOutputScrubSpecs(specs []*aicontext.OutputScrubSpec) error {
+	for i, spec := range specs {
+		if _, err := newOutputScrubRule(spec); err != nil {
+			return fmt.Errorf("outputScrub[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func newOutputScrubRule(spec *aicontext.OutputScrubSpec) (*outputScrubRule, error) {
+	switch spec.ThinkBlocks {
+	case "", thinkBlocksKeep, thinkBlocksStrip, thinkBlocksReasoning:
+	default:
+		return nil, fmt.Errorf("invalid thinkBlocks %s", spec.ThinkBlocks)
+	}
+	if len(spec.Tokens) == 0 && len(spec.Patterns) == 0 && !scrubsThink(spec) {
+		return nil, fmt.Errorf("no tokens, patterns or think blocks to scrub")
+	}
+	if spec.MaxPatternLength < 0 {
+		return nil, fmt.Errorf("maxPatternLength must not be negative")
+	}
+	for _, model := range spec.Models {
+		if _, err := path.Match(model, ""); err != nil {
+			return nil, fmt.Errorf("invalid model pattern %s: %w", model, err)
+		}
+	}
+	for _, token := range spec.Tokens {
+		if token == "" {
+			return nil, fmt.Errorf("empty token")
+		}
+		if strings.Contains(spec.Replacement, token) {
+			return nil, fmt.Errorf("replacement contains token %s", token)
+		}
+	}
+	rule := &outputScrubRule{spec: spec}
+	for _, pattern := range spec.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("pattern %s matches empty string", pattern)
+		}
+		if re.MatchString(spec.Replacement) {
+			return nil, fmt.Errorf("replacement matches pattern %s", pattern)
+		}
+		rule.patterns = append(rule.patterns, re)
+	}
+	return rule, nil
+}
+
+func scrubsThink(spec *aicontext.OutputScrubSpec) bool {
+	return spec.ThinkBlocks == thinkBlocksStrip || spec.ThinkBlocks == thinkBlocksReasoning
+}
+
+func (r *outputScrubRule) matches(model string) bool {
+	if len(r.spec.Models) == 0 {
+		return true
+	}
+	for _, pattern := range r.spec.Models {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NewOutputScrubber creates the output scrubber of a provider.
+func NewOutputScrubber(provider string, specs []*aicontext.OutputScrubSpec) (*OutputScrubber, error) {
+	s := &OutputScrubber{provider: provider}
+	for i, spec := range specs {
+		rule, err := newOutputScrubRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("outputScrub[%d]: %w", i, err)
+		}
+		s.rules = append(s.rules, rule)
+	}
+	s.hits = metricshub.OutputScrubHits.NewCounter()
+	return s, nil
+}
+
+func (s *OutputScrubber) hit(pattern string, n int) {
+	if s.hits != nil {
+		s.hits.With(prometheus.Labels{"provider": s.provider, "pattern": pattern}).Add(float64(n))
+	}
+}
+
+// Handle scrubs the response, it is registered as a response handler.
+func (s *OutputScrubber) Handle(ctx *aicontext.Context) {
+	resp := ctx.GetResponse()
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions && ctx.RespType != aicontext.ResponseTypeCompletions {
+		return
+	}
+	var rule *outputScrubRule
+	for _, r := range s.rules {
+		if r.matches(ctx.ReqInfo.Model) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return
+	}
+
+	if ctx.ReqInfo.Stream {
+		if resp.BodyReader != nil {
+			resp.BodyReader = newOutputScrubStreamReader(resp.BodyReader, rule, s.hit)
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+		return
+	}
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		logger.Errorf("failed to read response for output scrub: %v", err)
+		return
+	}
+	completion := map[string]any{}
+	if err := codectool.UnmarshalJSON(body, &completion); err != nil {
+		logger.Errorf("failed to unmarshal response for output scrub: %v", err)
+		return
+	}
+	changed := false
+	choices, _ := completion["choices"].([]any)
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]any)
+		if choice == nil {
+			continue
+		}
+		sc := &textScrubber{rule: rule, hit: s.hit}
+		if message, ok := choice["message"].(map[string]any); ok {
+			changed = sc.scrubFields(message, "content", true) || changed
+		} else {
+			changed = sc.scrubFields(choice, "text", true) || changed
+		}
+	}
+	if !changed {
+		return
+	}
+	data, err := codectool.MarshalJSON(completion)
+	if err != nil {
+		logger.Errorf("failed to marshal response for output scrub: %v", err)
+		return
+	}
+	setResponseBody(resp, data)
+}
+
+// scrubFields scrubs the text of the field of the message or delta, and
+// appends the reasoning moved out of it to reasoning_content. It returns
+// whether the fields are changed.
+func (s *textScrubber) scrubFields(m map[string]any, field string, final bool) bool {
+	text, ok := m[field].(string)
+	if !ok && !final {
+		return false
+	}
+	content, reasoning := s.write(text, final)
+	changed := false
+	if content != text && (ok || content != "") {
+		m[field] = content
+		changed = true
+	}
+	if reasoning != "" {
+		existing, _ := m[reasoningContentField].(string)
+		m[reasoningContentField] = existing + reasoning
+		changed = true
+	}
+	return changed
+}
+
+func (r *outputScrubRule) maxPatternLength() int {
+	if r.spec.MaxPatternLength > 0 {
+		return r.spec.MaxPatternLength
+	}
+	return outputScrubDefaultMaxPatternLength
+}
+
+// write scrubs the text, and returns the content and the reasoning ready
+// to send, final flushes the text held back.
+func (s *textScrubber) write(text string, final bool) (content string, reasoning string) {
+	content, reasoning = s.splitThink(text, final)
+	return s.scrub(content, final), reasoning
+}
+
+// splitThink splits the content of think blocks out of the text, the
+// content is dropped unless it is moved to reasoning_content.
+func (s *textScrubber) splitThink(text string, final bool) (content string, reasoning string) {
+	if !scrubsThink(s.rule.spec) {
+		return text, ""
+	}
+	var contentBuf, reasoningBuf strings.Builder
+	emit := func(text string) {
+		if !s.inThink {
+			contentBuf.WriteString(text)
+		} else if s.rule.spec.ThinkBlocks == thinkBlocksReasoning {
+			reasoningBuf.WriteString(text)
+		}
+	}
+
+	buf := s.thinkPending + text
+	s.thinkPending = ""
+	for {
+		tag := thinkOpenTag
+		if s.inThink {
+			tag = thinkCloseTag
+		}
+		if i := strings.Index(buf, tag); i >= 0 {
+			emit(buf[:i])
+			buf = buf[i+len(tag):]
+			if !s.inThink {
+				s.hit(thinkOpenTag, 1)
+			}
+			s.inThink = !s.inThink
+			continue
+		}
+		keep := 0
+		if !final {
+			keep = partialSuffixLen(buf, tag)
+		}
+		emit(buf[:len(buf)-keep])
+		s.thinkPending = buf[len(buf)-keep:]
+		return contentBuf.String(), reasoningBuf.String()
+	}
+}
+
+// scrub replaces the tokens and the matches of the patterns in the text.
+func (s *textScrubber) scrub(text string, final bool) string {
+	spec := s.rule.spec
+	buf := s.pending + text
+	s.pending = ""
+	for _, token := range spec.Tokens {
+		if n := strings.Count(buf, token); n > 0 {
+			buf = strings.ReplaceAll(buf, token, spec.Replacement)
+			s.hit(token, n)
+		}
+	}
+	for i, re := range s.rule.patterns {
+		n := 0
+		buf = re.ReplaceAllStringFunc(buf, func(string) string {
+			n++
+			return spec.Replacement
+		})
+		if n > 0 {
+			s.hit(spec.Patterns[i], n)
+		}
+	}
+	if final {
+		return buf
+	}
+
+	keep := 0
+	for _, token := range spec.Tokens {
+		keep = max(keep, partialSuffixLen(buf, token))
+	}
+	if len(s.rule.patterns) > 0 {
+		keep = max(keep, min(len(buf), s.rule.maxPatternLength()))
+	}
+	// never split a multi-byte character.
+	for keep > 0 && keep < len(buf) && !utf8.RuneStart(buf[len(buf)-keep]) {
+		keep++
+	}
+	s.pending = buf[len(buf)-keep:]
+	return buf[:len(buf)-keep]
+}
+
+// partialSuffixLen returns the length of the longest suffix of s which is
+// a proper prefix of token.
+func partialSuffixLen(s string, token string) int {
+	for n := min(len(s), len(token)-1); n > 0; n-- {
+		if strings.HasSuffix(s, token[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// outputScrubStream scrubs the choices of a streaming response chunk by
+// chunk, the content held back is sent in the chunk finishing the choice,
+// or in a final chunk before the [DONE] event.
+type outputScrubStream struct {
+	rule      *outputScrubRule
+	hit       func(pattern string, n int)
+	scrubbers map[int]*textScrubber
+	// last is the last chunk, the final chunk copies its id and model.
+	last     map[string]any
+	finished bool
+}
+
+func newOutputScrubStreamReader(body io.Reader, rule *outputScrubRule, hit func(pattern string, n int)) *sseEventReader {
+	s := &outputScrubStream{rule: rule, hit: hit, scrubbers: map[int]*textScrubber{}}
+	return newSSEEventReader(body, s.processEvent, s.finish)
+}
+
+func (s *outputScrubStream) processEvent(event []byte, out *bytes.Buffer) bool {
+	if isSSEDoneEvent(event) {
+		s.finish(out)
+		out.Write(event)
+		return true
+	}
+	data, ok := sseEventData(event)
+	if !ok {
+		out.Write(event)
+		return true
+	}
+	chunk := map[string]any{}
+	if err := codectool.UnmarshalJSON(data, &chunk); err != nil {
+		out.Write(event)
+		return true
+	}
+	s.last = chunk
+
+	changed := false
+	choices, _ := chunk["choices"].([]any)
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]any)
+		if choice == nil {
+			continue
+		}
+		index, _ := choice["index"].(float64)
+		sc := s.scrubbers[int(index)]
+		if sc == nil {
+			sc = &textScrubber{rule: s.rule, hit: s.hit}
+			s.scrubbers[int(index)] = sc
+		}
+		final := choice["finish_reason"] != nil
+		if delta, ok := choice["delta"].(map[string]any); ok {
+			changed = sc.scrubFields(delta, "content", final) || changed
+		} else {
+			changed = sc.scrubFields(choice, "text", final) || changed
+		}
+		if final {
+			delete(s.scrubbers, int(index))
+		}
+	}
+	if !changed {
+		out.Write(event)
+		return true
+	}
+	data, err := codectool.MarshalJSON(chunk)
+	if err != nil {
+		logger.Errorf("failed to marshal chunk for output scrub: %v", err)
+		out.Write(event)
+		return true
+	}
+	writeSSEEvent(out, data)
+	return true
+}
+
+// finish sends the content held back of the choices not finished.
+func (s *outputScrubStream) finish(out *bytes.Buffer) {
+	if s.finished {
+		return
+	}
+	s.finished = true
+
+	indexes := make([]int, 0, len(s.scrubbers))
+	for index := range s.scrubbers {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	var choices []any
+	for _, index := range indexes {
+		choice := map[string]any{"index": index, "finish_reason": nil}
+		fields, field := map[string]any{}, "content"
+		if s.last["object"] == "text_completion" {
+			fields, field = choice, "text"
+		} else {
+			choice["delta"] = fields
+		}
+		if s.scrubbers[index].scrubFields(fields, field, true) {
+			choices = append(choices, choice)
+		}
+	}
+	if len(choices) == 0 {
+		return
+	}
+
+	chunk := map[string]any{"choices": choices}
+	for _, key := range []string{"id", "object", "created", "model", "system_fingerprint"} {
+		if v, ok := s.last[key]; ok {
+			chunk[key] = v
+		}
+	}
+	data, err := codectool.MarshalJSON(chunk)
+	if err != nil {
+		logger.Errorf("failed to marshal final chunk for output scrub: %v", err)
+		return
+	}
+	writeSSEEvent(out, data)
+}
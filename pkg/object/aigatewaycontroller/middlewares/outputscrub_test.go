@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func newScrubContext(t *testing.T, model string, stream bool) *aicontext.Context {
+	body := fmt.Sprintf(`{"model": %q, "stream": %t, "messages": [{"role": "user", "content": "hi"}]}`, model, stream)
+	ctx := egContext.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+	assert.Nil(t, err)
+	setRequest(t, ctx, "scrub", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "local", ProviderType: "ollama"})
+	assert.Nil(t, err)
+	return aiCtx
+}
+
+func TestValidateOutputScrubSpecs(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(ValidateOutputScrubSpecs(nil))
+	assert.Nil(ValidateOutputScrubSpecs([]*aicontext.OutputScrubSpec{
+		{Models: []string{"qwen*"}, Tokens: []string{"<|im_end|>"}, Patterns: []string{`<\|[a-z_]+\|>`}},
+		{ThinkBlocks: "reasoning"},
+	}))
+
+	for _, spec := range []*aicontext.OutputScrubSpec{
+		{},
+		{ThinkBlocks: "keep"},
+		{ThinkBlocks: "move"},
+		{Tokens: []string{""}},
+		{Patterns: []string{"("}},
+		{Patterns: []string{"a*"}},
+		{Models: []string{"["}, Tokens: []string{"x"}},
+		{Tokens: []string{"x"}, Replacement: "xx"},
+		{Patterns: []string{"[0-9]+"}, Replacement: "0"},
+		{Tokens: []string{"x"}, MaxPatternLength: -1},
+	} {
+		assert.NotNil(ValidateOutputScrubSpecs([]*aicontext.OutputScrubSpec{spec}), "%+v", spec)
+	}
+}
+
+func TestTextScrubber(t *testing.T) {
+	assert := assert.New(t)
+
+	hits := map[string]int{}
+	newScrubber := func(spec *aicontext.OutputScrubSpec) *textScrubber {
+		rule, err := newOutputScrubRule(spec)
+		assert.Nil(err)
+		return &textScrubber{rule: rule, hit: func(pattern string, n int) { hits[pattern] += n }}
+	}
+	write := func(s *textScrubber, chunks ...string) (string, string) {
+		var content, reasoning string
+		for i, chunk := range chunks {
+			c, r := s.write(chunk, i == len(chunks)-1)
+			content += c
+			reasoning += r
+		}
+		return content, reasoning
+	}
+
+	// tokens split across chunks are removed, and the content not being a
+	// token is sent without delay.
+	s := newScrubber(&aicontext.OutputScrubSpec{Tokens: []string{"<|im_end|>"}})
+	content, _ := s.write("Hello<|im_", false)
+	assert.Equal("Hello", content)
+	content, _ = s.write("end|> world <", false)
+	assert.Equal(" world ", content)
+	content, _ = s.write("b>", false)
+	assert.Equal("<b>", content)
+	assert.Equal(1, hits["<|im_end|>"])
+
+	// patterns split across chunks are removed, multi-byte characters are
+	// never split.
+	s = newScrubber(&aicontext.OutputScrubSpec{Patterns: []string{`<\|[a-z_]+\|>`}, Replacement: " ", MaxPatternLength: 16})
+	content, _ = write(s, "你好<|", "eot", "_id|>世界<|end|>")
+	assert.Equal("你好 世界 ", content)
+	assert.Equal(2, hits[`<\|[a-z_]+\|>`])
+
+	// think blocks are moved to reasoning, or stripped.
+	spec := &aicontext.OutputScrubSpec{ThinkBlocks: "reasoning", Tokens: []string{"<|im_end|>"}}
+	content, reasoning := write(newScrubber(spec), "<thi", "nk>let me", " think</th", "ink>The answer<|im_end|>")
+	assert.Equal("The answer", content)
+	assert.Equal("let me think", reasoning)
+	assert.Equal(1, hits["<think>"])
+
+	spec.ThinkBlocks = "strip"
+	content, reasoning = write(newScrubber(spec), "A<think>x</think>B<think>y")
+	assert.Equal("AB", content)
+	assert.Empty(reasoning)
+
+	// the partial tokens are sent at the end.
+	content, _ = write(newScrubber(spec), "price <|im_")
+	assert.Equal("price <|im_", content)
+}
+
+func TestOutputScrubberHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	scrubber, err := NewOutputScrubber("local", []*aicontext.OutputScrubSpec{
+		{Models: []string{"gpt-*"}, Tokens: []string{"[GPT]"}},
+		{Models: []string{"qwen*"}, Tokens: []string{"<|im_end|>"}, ThinkBlocks: "reasoning"},
+	})
+	assert.Nil(err)
+
+	{
+		aiCtx := newScrubContext(t, "qwen3", false)
+		aiCtx.OnResponse(scrubber.Handle)
+		setToolPolicyResponse(aiCtx, `{"choices": [{"index": 0, "message": {"role": "assistant", "content": "<think>plan</think>Hello<|im_end|>"}}]}`)
+		resp := aiCtx.GetResponse()
+		completion := map[string]any{}
+		assert.Nil(json.Unmarshal(resp.BodyBytes, &completion))
+		message := completion["choices"].([]any)[0].(map[string]any)["message"].(map[string]any)
+		assert.Equal("Hello", message["content"])
+		assert.Equal("plan", message["reasoning_content"])
+		assert.Equal(int64(len(resp.BodyBytes)), resp.ContentLength)
+	}
+
+	{
+		// no rule matches the model.
+		body := `{"choices": [{"index": 0, "message": {"content": "<|im_end|>"}}]}`
+		aiCtx := newScrubContext(t, "llama3", false)
+		aiCtx.OnResponse(scrubber.Handle)
+		setToolPolicyResponse(aiCtx, body)
+		data, err := io.ReadAll(aiCtx.GetResponse().BodyReader)
+		assert.Nil(err)
+		assert.Equal(body, string(data))
+	}
+
+	stream := `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen3","choices":[{"index":0,"delta":{"role":"assistant","content":"<thi"}}]}` + "\n\n" +
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen3","choices":[{"index":0,"delta":{"content":"nk>plan</think>Hi"}}]}` + "\n\n" +
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen3","choices":[{"index":0,"delta":{"content":" there<|im"}}]}` + "\n\n" +
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen3","choices":[{"index":0,"delta":{"content":"_end|> <|"}}]}` + "\n\n"
+
+	handle := func(stream string) []map[string]any {
+		aiCtx := newScrubContext(t, "qwen3", true)
+		aiCtx.OnResponse(scrubber.Handle)
+		setToolPolicyResponse(aiCtx, stream)
+		resp := aiCtx.GetResponse()
+		assert.Equal(int64(-1), resp.ContentLength)
+		data, err := io.ReadAll(resp.BodyReader)
+		assert.Nil(err)
+		var chunks []map[string]any
+		for _, event := range strings.Split(strings.TrimSuffix(string(data), "\n\n"), "\n\n") {
+			if event == "data: [DONE]" {
+				chunks = append(chunks, nil)
+				continue
+			}
+			chunk := map[string]any{}
+			assert.Nil(json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk))
+			chunks = append(chunks, chunk)
+		}
+		return chunks
+	}
+	collect := func(chunks []map[string]any) (string, string) {
+		var content, reasoning string
+		for _, chunk := range chunks {
+			if chunk == nil {
+				continue
+			}
+			delta := chunk["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)
+			c, _ := delta["content"].(string)
+			r, _ := delta["reasoning_content"].(string)
+			content += c
+			reasoning += r
+		}
+		return content, reasoning
+	}
+
+	{
+		// the content held back is sent with the finish reason.
+		chunks := handle(stream + `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen3","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}` + "\n\n" + "data: [DONE]\n\n")
+		assert.Len(chunks, 6)
+		content, reasoning := collect(chunks)
+		assert.Equal("Hi there <|", content)
+		assert.Equal("plan", reasoning)
+		assert.Nil(chunks[5])
+	}
+
+	{
+		// the content held back is sent in a final chunk before [DONE].
+		chunks := handle(stream + "data: [DONE]\n\n")
+		assert.Len(chunks, 6)
+		content, _ := collect(chunks)
+		assert.Equal("Hi there <|", content)
+		assert.Equal("chatcmpl-1", chunks[4]["id"])
+		assert.Nil(chunks[5])
+	}
+}
@@ -0,0 +1,511 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/corpus"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// piiKindRegexp is the names of the custom patterns, which are the kinds
+// in their placeholders.
+var piiKindRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+type (
+	// PIITokenizerSpec defines the PII tokenizer middleware, it replaces
+	// the PII in the prompts of chat completions and completions requests
+	// with placeholders like [EMAIL_1] before they are sent to the
+	// provider, and restores the placeholders in the response sent to the
+	// user. The values are only kept in memory while the request is
+	// served. The built-in patterns are applied unless they are disabled.
+	PIITokenizerSpec struct {
+		// Builtins are the built-in patterns applied, empty means all:
+		// email, creditCard, phone and ipAddress.
+		Builtins []string `json:"builtins,omitempty"`
+		// DisableBuiltins disables the built-in patterns.
+		DisableBuiltins bool `json:"disableBuiltins,omitempty"`
+		// Patterns are the custom patterns, applied after the built-in
+		// ones. The name in upper case is the kind in the placeholders.
+		Patterns []*PIITokenizerPattern `json:"patterns,omitempty"`
+	}
+
+	// PIITokenizerPattern tokenizes the matches of a regular expression.
+	PIITokenizerPattern struct {
+		Name  string `json:"name" jsonschema:"required"`
+		Regex string `json:"regex" jsonschema:"required"`
+	}
+
+	piiTokenizerMiddleware struct {
+		spec     *MiddlewareSpec
+		patterns []*piiPattern
+	}
+
+	piiPattern struct {
+		kind string
+		re   *regexp.Regexp
+	}
+)
+
+func init() {
+	middlewareTypeRegistry[piiTokenizerMiddlewareKind] = reflect.TypeOf(piiTokenizerMiddleware{})
+}
+
+var _ Middleware = (*piiTokenizerMiddleware)(nil)
+
+// ValidateOrder checks the middlewares run in the order are safe. A
+// semantic cache before a PII tokenizer would store and serve the PII of
+// requests, so the order is rejected.
+func ValidateOrder(specs []*MiddlewareSpec) error {
+	var cache *MiddlewareSpec
+	for _, spec := range specs {
+		switch spec.Kind {
+		case semanticCacheMiddlewareKind:
+			if cache == nil {
+				cache = spec
+			}
+		case piiTokenizerMiddlewareKind:
+			if cache != nil {
+				return fmt.Errorf("semantic cache %s runs before PII tokenizer %s", cache.Name, spec.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *piiTokenizerMiddleware) init(spec *MiddlewareSpec) {
+	m.spec = spec
+	s := spec.PIITokenizer
+	if s == nil {
+		s = &PIITokenizerSpec{}
+	}
+	if !s.DisableBuiltins {
+		for _, p := range corpus.BuiltinPIIPatterns() {
+			if len(s.Builtins) == 0 || slices.Contains(s.Builtins, p.Name) {
+				m.patterns = append(m.patterns, &piiPattern{kind: p.Kind, re: p.Regexp})
+			}
+		}
+	}
+	for _, p := range s.Patterns {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			logger.Errorf("piiTokenizer middleware %s has invalid regex of pattern %s: %v", spec.Name, p.Name, err)
+			continue
+		}
+		m.patterns = append(m.patterns, &piiPattern{kind: strings.ToUpper(p.Name), re: re})
+	}
+}
+
+func (m *piiTokenizerMiddleware) validate(spec *MiddlewareSpec) error {
+	s := spec.PIITokenizer
+	if s == nil {
+		return nil
+	}
+	builtins := corpus.BuiltinPIIPatterns()
+	for _, name := range s.Builtins {
+		if !slices.ContainsFunc(builtins, func(p *corpus.PIIPattern) bool { return p.Name == name }) {
+			return fmt.Errorf("piiTokenizer middleware %s has unknown built-in pattern %s", spec.Name, name)
+		}
+	}
+	for _, p := range s.Patterns {
+		if !piiKindRegexp.MatchString(p.Name) {
+			return fmt.Errorf("piiTokenizer middleware %s has invalid pattern name %q, it must be letters, digits and underscores", spec.Name, p.Name)
+		}
+		if _, err := regexp.Compile(p.Regex); err != nil {
+			return fmt.Errorf("piiTokenizer middleware %s has invalid regex of pattern %s: %w", spec.Name, p.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *piiTokenizerMiddleware) Name() string {
+	return m.spec.Name
+}
+
+func (m *piiTokenizerMiddleware) Kind() string {
+	return piiTokenizerMiddlewareKind
+}
+
+func (m *piiTokenizerMiddleware) Spec() *MiddlewareSpec {
+	return m.spec
+}
+
+func (m *piiTokenizerMiddleware) Handle(ctx *aicontext.Context) {
+	if len(m.patterns) == 0 {
+		return
+	}
+	vault := ctx.PIIVault()
+	// the response is restored once, even if the request is tokenized by
+	// more than one middleware.
+	registered := vault.Len() > 0
+	n := 0
+	tokenize := func(text string) string {
+		for _, p := range m.patterns {
+			text = p.re.ReplaceAllStringFunc(text, func(value string) string {
+				n++
+				return vault.Tokenize(p.kind, value)
+			})
+		}
+		return text
+	}
+
+	switch ctx.RespType {
+	case aicontext.ResponseTypeChatCompletions:
+		messages, _ := ctx.OpenAIReq["messages"].([]any)
+		tokenizeMessages(messages, tokenize)
+	case aicontext.ResponseTypeCompletions:
+		switch prompt := ctx.OpenAIReq["prompt"].(type) {
+		case string:
+			ctx.OpenAIReq["prompt"] = tokenize(prompt)
+		case []any:
+			for i, p := range prompt {
+				if p, ok := p.(string); ok {
+					prompt[i] = tokenize(p)
+				}
+			}
+		}
+	default:
+		return
+	}
+	if n == 0 {
+		return
+	}
+
+	body, err := codectool.MarshalJSON(ctx.OpenAIReq)
+	if err != nil {
+		// the PII is never sent to the provider untokenized.
+		logger.Errorf("failed to marshal request of piiTokenizer middleware %s: %v", m.spec.Name, err)
+		vault.Wipe()
+		m.reject(ctx)
+		return
+	}
+	ctx.ReqBody = body
+	ctx.Ctx.AddTag(fmt.Sprintf("piiTokenizer %s: %d values tokenized", m.spec.Name, n))
+	if registered {
+		return
+	}
+	ctx.OnDeliver(func(resp *aicontext.Response) {
+		restorePII(ctx, resp)
+	})
+	// the stream of a detached request is read after the request is
+	// finished, its vault is wiped when the stream ends.
+	ctx.AddCallBack(func(*aicontext.FinishContext) {
+		if !ctx.Detached {
+			vault.Wipe()
+		}
+	})
+}
+
+func (m *piiTokenizerMiddleware) reject(ctx *aicontext.Context) {
+	errMsg := protocol.NewError(http.StatusInternalServerError, "failed to tokenize PII of the request")
+	data, _ := codectool.MarshalJSON(errMsg)
+	ctx.SetResponse(&aicontext.Response{
+		StatusCode:    http.StatusInternalServerError,
+		ContentLength: int64(len(data)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		BodyBytes:     data,
+	})
+	ctx.Stop(aicontext.ResultMiddlewareError)
+}
+
+// tokenizeMessages tokenizes the text content and the tool call arguments
+// of the messages.
+func tokenizeMessages(messages []any, tokenize func(string) string) {
+	for _, msg := range messages {
+		msg, _ := msg.(map[string]any)
+		if msg == nil {
+			continue
+		}
+		switch content := msg["content"].(type) {
+		case string:
+			msg["content"] = tokenize(content)
+		case []any:
+			for _, part := range content {
+				if part, ok := part.(map[string]any); ok {
+					if text, ok := part["text"].(string); ok {
+						part["text"] = tokenize(text)
+					}
+				}
+			}
+		}
+		toolCalls, _ := msg["tool_calls"].([]any)
+		for _, call := range toolCalls {
+			call, _ := call.(map[string]any)
+			function, _ := call["function"].(map[string]any)
+			if arguments, ok := function["arguments"].(string); ok {
+				function["arguments"] = tokenize(arguments)
+			}
+		}
+	}
+}
+
+// restorePII restores the placeholders in the response sent to the user.
+// The events of a successful stream are restored one by one, other bodies
+// are restored as a whole.
+func restorePII(ctx *aicontext.Context, resp *aicontext.Response) {
+	vault := ctx.PIIVault()
+	if ctx.ReqInfo.Stream && resp.StatusCode == http.StatusOK {
+		// the streams served from caches are in BodyBytes.
+		if resp.BodyBytes != nil {
+			resp.BodyReader = bytes.NewReader(resp.BodyBytes)
+			resp.BodyBytes = nil
+		}
+		if resp.BodyReader != nil {
+			resp.BodyReader = newPIIRestoreStreamReader(resp.BodyReader, vault)
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+		return
+	}
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		logger.Errorf("failed to read response for PII restoration: %v", err)
+		return
+	}
+	var escape func(string) string
+	if json.Valid(body) {
+		escape = escapeJSONString
+	}
+	restored := vault.Restore(string(body), escape)
+	if restored != string(body) {
+		setResponseBody(resp, []byte(restored))
+	}
+}
+
+// escapeJSONString escapes the value to be put in a JSON string.
+func escapeJSONString(value string) string {
+	data, _ := json.Marshal(value)
+	return string(data[1 : len(data)-1])
+}
+
+// piiStreamKey is a text restored across the chunks of a stream, tool is
+// the index of the tool call whose arguments are the text, or -1 for the
+// content.
+type piiStreamKey struct {
+	choice int
+	tool   int
+}
+
+// piiRestoreStream restores the placeholders in the choices of a streaming
+// response chunk by chunk. The text which may be the beginning of a
+// placeholder is held back, and it is sent in the chunk finishing the
+// choice, or in a final chunk before the [DONE] event.
+type piiRestoreStream struct {
+	vault        *aicontext.PIIVault
+	placeholders []string
+	pending      map[piiStreamKey]string
+	// last is the last chunk, the final chunk copies its id and model.
+	last     map[string]any
+	finished bool
+}
+
+func newPIIRestoreStreamReader(body io.Reader, vault *aicontext.PIIVault) *sseEventReader {
+	s := &piiRestoreStream{
+		vault:        vault,
+		placeholders: vault.Placeholders(),
+		pending:      map[piiStreamKey]string{},
+	}
+	return newSSEEventReader(body, s.processEvent, s.finish)
+}
+
+// restore restores the placeholders in the text, final flushes the text
+// held back.
+func (s *piiRestoreStream) restore(key piiStreamKey, text string, final bool) string {
+	buf := s.pending[key] + text
+	delete(s.pending, key)
+	keep := 0
+	if !final {
+		for _, placeholder := range s.placeholders {
+			keep = max(keep, partialSuffixLen(buf, placeholder))
+		}
+	}
+	if keep > 0 {
+		s.pending[key] = buf[len(buf)-keep:]
+	}
+	return s.vault.Restore(buf[:len(buf)-keep], nil)
+}
+
+// restoreField restores the text of the field, it returns whether the
+// field is changed.
+func (s *piiRestoreStream) restoreField(m map[string]any, field string, key piiStreamKey, final bool) bool {
+	text, ok := m[field].(string)
+	if !ok && (!final || s.pending[key] == "") {
+		return false
+	}
+	restored := s.restore(key, text, final)
+	if restored == text {
+		return false
+	}
+	m[field] = restored
+	return true
+}
+
+// restoreChoice restores the content and the tool call arguments of the
+// choice, it returns whether the choice is changed.
+func (s *piiRestoreStream) restoreChoice(choice map[string]any, index int, final bool) bool {
+	key := piiStreamKey{choice: index, tool: -1}
+	delta, ok := choice["delta"].(map[string]any)
+	if !ok {
+		return s.restoreField(choice, "text", key, final)
+	}
+	changed := s.restoreField(delta, "content", key, final)
+
+	toolCalls, _ := delta["tool_calls"].([]any)
+	seen := map[int]bool{}
+	for _, call := range toolCalls {
+		call, _ := call.(map[string]any)
+		function, _ := call["function"].(map[string]any)
+		if function == nil {
+			continue
+		}
+		tool, _ := call["index"].(float64)
+		seen[int(tool)] = true
+		key := piiStreamKey{choice: index, tool: int(tool)}
+		changed = s.restoreField(function, "arguments", key, final) || changed
+	}
+	if !final {
+		return changed
+	}
+	// the arguments held back of the tool calls not in the chunk.
+	for _, tool := range s.pendingTools(index) {
+		if seen[tool] {
+			continue
+		}
+		key := piiStreamKey{choice: index, tool: tool}
+		toolCalls = append(toolCalls, map[string]any{
+			"index":    tool,
+			"function": map[string]any{"arguments": s.restore(key, "", true)},
+		})
+		delta["tool_calls"] = toolCalls
+		changed = true
+	}
+	return changed
+}
+
+// pendingTools returns the sorted indexes of the tool calls of the choice
+// with arguments held back.
+func (s *piiRestoreStream) pendingTools(choice int) []int {
+	var tools []int
+	for key := range s.pending {
+		if key.choice == choice && key.tool >= 0 {
+			tools = append(tools, key.tool)
+		}
+	}
+	sort.Ints(tools)
+	return tools
+}
+
+func (s *piiRestoreStream) processEvent(event []byte, out *bytes.Buffer) bool {
+	if isSSEDoneEvent(event) {
+		s.finish(out)
+		out.Write(event)
+		return true
+	}
+	data, ok := sseEventData(event)
+	if !ok {
+		out.Write(event)
+		return true
+	}
+	chunk := map[string]any{}
+	if err := codectool.UnmarshalJSON(data, &chunk); err != nil {
+		out.Write(event)
+		return true
+	}
+	s.last = chunk
+
+	changed := false
+	choices, _ := chunk["choices"].([]any)
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]any)
+		if choice == nil {
+			continue
+		}
+		index, _ := choice["index"].(float64)
+		final := choice["finish_reason"] != nil
+		changed = s.restoreChoice(choice, int(index), final) || changed
+	}
+	if !changed {
+		out.Write(event)
+		return true
+	}
+	data, err := codectool.MarshalJSON(chunk)
+	if err != nil {
+		logger.Errorf("failed to marshal chunk for PII restoration: %v", err)
+		out.Write(event)
+		return true
+	}
+	writeSSEEvent(out, data)
+	return true
+}
+
+// finish sends the text held back of the choices not finished, and wipes
+// the vault, since the stream ends.
+func (s *piiRestoreStream) finish(out *bytes.Buffer) {
+	if s.finished {
+		return
+	}
+	s.finished = true
+	defer s.vault.Wipe()
+
+	indexes := []int{}
+	for key := range s.pending {
+		if !slices.Contains(indexes, key.choice) {
+			indexes = append(indexes, key.choice)
+		}
+	}
+	sort.Ints(indexes)
+	var choices []any
+	for _, index := range indexes {
+		choice := map[string]any{"index": index, "finish_reason": nil}
+		if s.last["object"] != "text_completion" {
+			choice["delta"] = map[string]any{}
+		}
+		s.restoreChoice(choice, index, true)
+		choices = append(choices, choice)
+	}
+	if len(choices) == 0 {
+		return
+	}
+
+	chunk := map[string]any{"choices": choices}
+	for _, key := range []string{"id", "object", "created", "model", "system_fingerprint"} {
+		if v, ok := s.last[key]; ok {
+			chunk[key] = v
+		}
+	}
+	data, err := codectool.MarshalJSON(chunk)
+	if err != nil {
+		logger.Errorf("failed to marshal final chunk for PII restoration: %v", err)
+		return
+	}
+	writeSSEEvent(out, data)
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+func newPIIContext(t *testing.T, body string) *aicontext.Context {
+	ctx := egContext.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+	assert.Nil(t, err)
+	setRequest(t, ctx, "pii", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+	assert.Nil(t, err)
+	return aiCtx
+}
+
+// deliverPII returns the response sent to the user.
+func deliverPII(aiCtx *aicontext.Context, resp *aicontext.Response) string {
+	for _, deliver := range aiCtx.Deliverers() {
+		deliver(resp)
+	}
+	if resp.BodyReader != nil {
+		data, _ := io.ReadAll(resp.BodyReader)
+		return string(data)
+	}
+	return string(resp.BodyBytes)
+}
+
+func TestPIITokenizerValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		spec *PIITokenizerSpec
+		err  bool
+	}{
+		{nil, false},
+		{&PIITokenizerSpec{Builtins: []string{"email", "phone"}}, false},
+		{&PIITokenizerSpec{Patterns: []*PIITokenizerPattern{{Name: "employeeID", Regex: `E\d{6}`}}}, false},
+		{&PIITokenizerSpec{Builtins: []string{"ssn"}}, true},
+		{&PIITokenizerSpec{Patterns: []*PIITokenizerPattern{{Name: "employee id", Regex: `E\d{6}`}}}, true},
+		{&PIITokenizerSpec{Patterns: []*PIITokenizerPattern{{Name: "employeeID", Regex: `(`}}}, true},
+	} {
+		spec := &MiddlewareSpec{Name: "pii", Kind: piiTokenizerMiddlewareKind, PIITokenizer: c.spec}
+		err := ValidateSpec(spec)
+		assert.Equal(c.err, err != nil, "%+v: %v", c.spec, err)
+	}
+}
+
+func TestPIITokenizerOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := &MiddlewareSpec{Name: "cache", Kind: semanticCacheMiddlewareKind}
+	pii := &MiddlewareSpec{Name: "pii", Kind: piiTokenizerMiddlewareKind}
+	guard := &MiddlewareSpec{Name: "guard", Kind: topicGuardMiddlewareKind}
+	assert.NoError(ValidateOrder(nil))
+	assert.NoError(ValidateOrder([]*MiddlewareSpec{pii, guard, cache}))
+	assert.NoError(ValidateOrder([]*MiddlewareSpec{cache, guard}))
+	assert.ErrorContains(ValidateOrder([]*MiddlewareSpec{guard, cache, pii}), "semantic cache cache runs before PII tokenizer pii")
+	assert.Error(ValidateOrder([]*MiddlewareSpec{pii, cache, pii}))
+
+	// the tokenizers are never skipped by consumers.
+	assert.False(Skippable(pii))
+	assert.True(Skippable(cache))
+}
+
+func TestPIITokenizerHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMiddleware(&MiddlewareSpec{
+		Name: "pii",
+		Kind: piiTokenizerMiddlewareKind,
+		PIITokenizer: &PIITokenizerSpec{
+			Patterns: []*PIITokenizerPattern{{Name: "employeeID", Regex: `\bE\d{6}\b`}},
+		},
+	})
+	body := `{"model": "gpt", "messages": [
+		{"role": "user", "content": "Mail alice@example.com or call 555-123-4567, I am E123456."},
+		{"role": "assistant", "tool_calls": [{"id": "1", "type": "function", "function": {"name": "send", "arguments": "{\"to\": \"alice@example.com\"}"}}]},
+		{"role": "user", "content": [{"type": "text", "text": "Also cc bob@example.com."}]}
+	]}`
+	aiCtx := newPIIContext(t, body)
+	m.Handle(aiCtx)
+	assert.False(aiCtx.IsStopped())
+
+	req := map[string]any{}
+	assert.Nil(json.Unmarshal(aiCtx.ReqBody, &req))
+	messages := req["messages"].([]any)
+	assert.Equal("Mail [EMAIL_1] or call [PHONE_1], I am [EMPLOYEEID_1].", messages[0].(map[string]any)["content"])
+	arguments := messages[1].(map[string]any)["tool_calls"].([]any)[0].(map[string]any)["function"].(map[string]any)["arguments"]
+	assert.Equal(`{"to": "[EMAIL_1]"}`, arguments)
+	assert.NotContains(string(aiCtx.ReqBody), "alice@example.com")
+	assert.Equal(4, aiCtx.PIIVault().Len())
+
+	// the placeholders of a non-streaming response are restored, the
+	// values are escaped in JSON.
+	vault := aiCtx.PIIVault()
+	vault.Tokenize("NAME", `"Bob" <bob>`)
+	resp := &aicontext.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		BodyBytes:  []byte(`{"choices": [{"index": 0, "message": {"content": "Mailed [EMAIL_1] for [NAME_1], [EMAIL_9] is unknown."}}]}`),
+	}
+	delivered := deliverPII(aiCtx, resp)
+	completion := map[string]any{}
+	assert.Nil(json.Unmarshal([]byte(delivered), &completion))
+	message := completion["choices"].([]any)[0].(map[string]any)["message"].(map[string]any)
+	assert.Equal(`Mailed alice@example.com for "Bob" <bob>, [EMAIL_9] is unknown.`, message["content"])
+	assert.Equal(int64(len(delivered)), resp.ContentLength)
+
+	// the vault is wiped once the request is finished.
+	for _, cb := range aiCtx.Callbacks() {
+		cb(&aicontext.FinishContext{})
+	}
+	assert.Equal(0, vault.Len())
+	assert.Equal("[EMAIL_1]", vault.Restore("[EMAIL_1]", nil))
+
+	// the requests without PII are untouched.
+	body = `{"model": "gpt", "messages": [{"role": "user", "content": "hello"}]}`
+	aiCtx = newPIIContext(t, body)
+	m.Handle(aiCtx)
+	assert.Equal(body, string(aiCtx.ReqBody))
+	assert.Empty(aiCtx.Deliverers())
+}
+
+func TestPIIRestoreStream(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMiddleware(&MiddlewareSpec{Name: "pii", Kind: piiTokenizerMiddlewareKind})
+	handle := func(stream string) []map[string]any {
+		aiCtx := newPIIContext(t, `{"model": "gpt", "stream": true, "messages": [{"role": "user", "content": "I am alice@example.com, call 555-123-4567"}]}`)
+		m.Handle(aiCtx)
+		assert.Equal(2, aiCtx.PIIVault().Len())
+		resp := &aicontext.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Length": []string{"1"}},
+			BodyReader: strings.NewReader(stream),
+		}
+		data := deliverPII(aiCtx, resp)
+		assert.Equal(int64(-1), resp.ContentLength)
+		// the vault is wiped once the stream ends.
+		assert.Equal(0, aiCtx.PIIVault().Len())
+
+		var chunks []map[string]any
+		for _, event := range strings.Split(strings.TrimSuffix(data, "\n\n"), "\n\n") {
+			if event == "data: [DONE]" {
+				chunks = append(chunks, nil)
+				continue
+			}
+			chunk := map[string]any{}
+			assert.Nil(json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk))
+			chunks = append(chunks, chunk)
+		}
+		return chunks
+	}
+	collect := func(chunks []map[string]any) (string, string) {
+		var content, arguments string
+		for _, chunk := range chunks {
+			if chunk == nil {
+				continue
+			}
+			delta := chunk["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)
+			c, _ := delta["content"].(string)
+			content += c
+			toolCalls, _ := delta["tool_calls"].([]any)
+			for _, call := range toolCalls {
+				a, _ := call.(map[string]any)["function"].(map[string]any)["arguments"].(string)
+				arguments += a
+			}
+		}
+		return content, arguments
+	}
+
+	stream := `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"role":"assistant","content":"Hi [EM"}}]}` + "\n\n" +
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"AIL_1], calling [PHONE_"}}]}` + "\n\n" +
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"1] [x] ["}}]}` + "\n\n" +
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"name":"call","arguments":"{\"to\": \"[PH"}}]}}]}` + "\n\n" +
+		`data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"ONE_1]\"}"}}]}}]}` + "\n\n"
+
+	{
+		// placeholders split across chunks are restored, and the text held
+		// back is sent with the finish reason.
+		chunks := handle(stream + `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}` + "\n\n" + "data: [DONE]\n\n")
+		assert.Len(chunks, 7)
+		assert.Equal("Hi ", chunks[0]["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)["content"])
+		content, arguments := collect(chunks)
+		assert.Equal("Hi alice@example.com, calling 555-123-4567 [x] [", content)
+		assert.Equal(`{"to": "555-123-4567"}`, arguments)
+		assert.Nil(chunks[6])
+	}
+
+	{
+		// the text held back is sent in a final chunk before [DONE].
+		chunks := handle(stream + `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"bye [EMAI"}}]}` + "\n\n" + "data: [DONE]\n\n")
+		assert.Len(chunks, 8)
+		content, _ := collect(chunks)
+		assert.Equal("Hi alice@example.com, calling 555-123-4567 [x] [bye [EMAI", content)
+		assert.Equal("chatcmpl-1", chunks[6]["id"])
+		assert.Nil(chunks[7])
+	}
+}
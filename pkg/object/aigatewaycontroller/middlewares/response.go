@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+// readResponseBody reads the body of a non-streaming response into
+// BodyBytes, so it can be inspected and replaced.
+func readResponseBody(resp *aicontext.Response) ([]byte, error) {
+	if resp.BodyReader == nil {
+		return resp.BodyBytes, nil
+	}
+	body, err := io.ReadAll(resp.BodyReader)
+	if closer, ok := resp.BodyReader.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.BodyReader = nil
+	resp.BodyBytes = body
+	return body, nil
+}
+
+// setResponseBody replaces the body of a non-streaming response.
+func setResponseBody(resp *aicontext.Response, body []byte) {
+	resp.BodyBytes = body
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+}
+
+// sseEventReader transforms a streaming response event by event.
+type sseEventReader struct {
+	body io.Reader
+	// process writes the transformed event to out, it returns false to
+	// end the stream.
+	process func(event []byte, out *bytes.Buffer) bool
+	// finish is called when the upstream stream ends, it is not called
+	// if the stream is ended by process.
+	finish func(out *bytes.Buffer)
+
+	buf  []byte
+	in   []byte
+	out  bytes.Buffer
+	done bool
+}
+
+func newSSEEventReader(body io.Reader, process func([]byte, *bytes.Buffer) bool, finish func(*bytes.Buffer)) *sseEventReader {
+	return &sseEventReader{
+		body:    body,
+		process: process,
+		finish:  finish,
+		buf:     make([]byte, 4096),
+	}
+}
+
+func (r *sseEventReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && !r.done {
+		n, err := r.body.Read(r.buf)
+		r.in = append(r.in, r.buf[:n]...)
+		for !r.done {
+			i := bytes.Index(r.in, []byte("\n\n"))
+			if i < 0 {
+				break
+			}
+			event := r.in[:i+2]
+			r.in = r.in[i+2:]
+			if !r.process(event, &r.out) {
+				r.end()
+			}
+		}
+		if err != nil && !r.done {
+			r.out.Write(r.in)
+			if r.finish != nil {
+				r.finish(&r.out)
+			}
+			r.done = true
+		}
+	}
+	if r.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.out.Read(p)
+}
+
+// end ends the stream and closes the upstream body.
+func (r *sseEventReader) end() {
+	r.done = true
+	r.in = nil
+	if closer, ok := r.body.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Close closes the upstream body.
+func (r *sseEventReader) Close() error {
+	if closer, ok := r.body.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// sseEventData returns the data of an event, ok is false if the event has
+// no data or it is the end of the stream.
+func sseEventData(event []byte) (data []byte, ok bool) {
+	data, ok = bytes.CutPrefix(bytes.TrimSpace(event), []byte("data:"))
+	data = bytes.TrimSpace(data)
+	if !ok || bytes.Equal(data, []byte("[DONE]")) {
+		return nil, false
+	}
+	return data, true
+}
+
+// isSSEDoneEvent checks whether the event is the end of the stream.
+func isSSEDoneEvent(event []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(event), []byte("data: [DONE]"))
+}
+
+// isCompleteStream checks whether a streaming response body ends with the
+// [DONE] event, a stream cut off before it is incomplete.
+func isCompleteStream(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	i := bytes.LastIndex(body, []byte("\n\n"))
+	return isSSEDoneEvent(body[i+1:])
+}
+
+func writeSSEEvent(out *bytes.Buffer, data []byte) {
+	out.WriteString("data: ")
+	out.Write(data)
+	out.WriteString("\n\n")
+}
@@ -0,0 +1,457 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// ResponseCheckNonEmpty fails the responses without content or tool
+	// calls.
+	ResponseCheckNonEmpty = "nonEmpty"
+	// ResponseCheckRepetition fails the responses repeating the same
+	// n-grams of words, like a model stuck in a loop.
+	ResponseCheckRepetition = "repetition"
+	// ResponseCheckLength fails the responses whose completion tokens are
+	// out of the range relative to the max tokens of the request.
+	ResponseCheckLength = "length"
+	// ResponseCheckUTF8 fails the responses with invalid UTF-8.
+	ResponseCheckUTF8 = "utf8"
+
+	// ResponseActionRetry sends the request to the same provider again.
+	ResponseActionRetry = "retry"
+	// ResponseActionFallback sends the request to the fallback provider.
+	ResponseActionFallback = "fallback"
+	// ResponseActionWarn passes the response with the warning header.
+	ResponseActionWarn = "warn"
+	// responseActionNone is recorded for streaming responses, which are
+	// sent to the user before they are checked.
+	responseActionNone = "none"
+
+	// ResponseCheckWarningHeader carries the failed checks of a response
+	// passed to the user.
+	ResponseCheckWarningHeader = "X-Response-Check-Warning"
+
+	defaultResponseCheckNGram            = 3
+	defaultResponseCheckMaxRepeatedRatio = 0.5
+	defaultResponseValidatorMaxRetries   = 1
+
+	// minRepetitionNGrams is the n-grams a response needs for the
+	// repetition check, short responses repeat words naturally.
+	minRepetitionNGrams = 10
+)
+
+type (
+	// ResponseValidatorSpec is the quality checks of the responses of the
+	// models. The checks run on the responses of the providers before the
+	// response handlers, and the action of the first failed check applies.
+	ResponseValidatorSpec struct {
+		// Models are the models the validator applies to, path.Match
+		// patterns are supported, and it applies to all models if it is
+		// empty. The first validator matching the model applies.
+		Models []string             `json:"models,omitempty"`
+		Checks []*ResponseCheckSpec `json:"checks" jsonschema:"required"`
+		// MaxRetries is the times the retry action sends the request
+		// again, default 1.
+		MaxRetries int `json:"maxRetries,omitempty"`
+		// Fallback is the provider or provider group the fallback action
+		// sends the request to.
+		Fallback string `json:"fallback,omitempty"`
+	}
+
+	// ResponseCheckSpec is a quality check of the responses.
+	ResponseCheckSpec struct {
+		Type string `json:"type" jsonschema:"required,enum=nonEmpty,enum=repetition,enum=length,enum=utf8"`
+		// Action is taken if the check fails, default warn. The response
+		// is passed with the warning header if the retries or the fallback
+		// fail the checks too.
+		Action string `json:"action,omitempty" jsonschema:"enum=,enum=retry,enum=fallback,enum=warn"`
+
+		// NGram is the words of the n-grams of the repetition check,
+		// default 3.
+		NGram int `json:"nGram,omitempty"`
+		// MaxRepeatedRatio is the ratio of the repeated n-grams to all
+		// n-grams allowed by the repetition check, default 0.5.
+		MaxRepeatedRatio float64 `json:"maxRepeatedRatio,omitempty"`
+
+		// MinLengthRatio and MaxLengthRatio are the range of the
+		// completion tokens relative to the max tokens of the request,
+		// the length check is skipped if the request has no max tokens.
+		MinLengthRatio float64 `json:"minLengthRatio,omitempty"`
+		MaxLengthRatio float64 `json:"maxLengthRatio,omitempty"`
+	}
+
+	// ResponseValidator checks the quality of the responses, and counts
+	// the failed checks by model.
+	ResponseValidator struct {
+		specs    []*ResponseValidatorSpec
+		triggers *prometheus.CounterVec
+	}
+
+	// responseOutput is the output of the first choice of a response.
+	responseOutput struct {
+		content          string
+		toolCalls        bool
+		completionTokens int
+	}
+
+	// responseCheckReader checks a streaming response when it ends.
+	responseCheckReader struct {
+		io.Reader
+		buf   bytes.Buffer
+		done  bool
+		check func(body []byte)
+	}
+)
+
+// ValidateResponseValidatorSpecs validates the specs of response
+// validators.
+func ValidateResponseValidatorSpecs(specs []*ResponseValidatorSpec) error {
+	for i, spec := range specs {
+		if len(spec.Checks) == 0 {
+			return fmt.Errorf("responseValidators[%d]: checks cannot be empty", i)
+		}
+		for _, pattern := range spec.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("responseValidators[%d]: invalid model pattern %s", i, pattern)
+			}
+		}
+		if spec.MaxRetries < 0 {
+			return fmt.Errorf("responseValidators[%d]: maxRetries cannot be negative", i)
+		}
+		for j, check := range spec.Checks {
+			if err := validateResponseCheckSpec(check); err != nil {
+				return fmt.Errorf("responseValidators[%d].checks[%d]: %w", i, j, err)
+			}
+			if check.Action == ResponseActionFallback && spec.Fallback == "" {
+				return fmt.Errorf("responseValidators[%d].checks[%d]: fallback action requires fallback", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+func validateResponseCheckSpec(spec *ResponseCheckSpec) error {
+	switch spec.Action {
+	case "", ResponseActionRetry, ResponseActionFallback, ResponseActionWarn:
+	default:
+		return fmt.Errorf("invalid action %s", spec.Action)
+	}
+	switch spec.Type {
+	case ResponseCheckNonEmpty, ResponseCheckUTF8:
+	case ResponseCheckRepetition:
+		if spec.NGram < 0 {
+			return fmt.Errorf("nGram cannot be negative")
+		}
+		if spec.MaxRepeatedRatio < 0 || spec.MaxRepeatedRatio >= 1 {
+			return fmt.Errorf("maxRepeatedRatio must be in (0, 1)")
+		}
+	case ResponseCheckLength:
+		if spec.MinLengthRatio < 0 || spec.MaxLengthRatio < 0 {
+			return fmt.Errorf("minLengthRatio and maxLengthRatio cannot be negative")
+		}
+		if spec.MinLengthRatio == 0 && spec.MaxLengthRatio == 0 {
+			return fmt.Errorf("minLengthRatio or maxLengthRatio is required")
+		}
+		if spec.MaxLengthRatio > 0 && spec.MinLengthRatio > spec.MaxLengthRatio {
+			return fmt.Errorf("minLengthRatio cannot be greater than maxLengthRatio")
+		}
+	default:
+		return fmt.Errorf("invalid check type %s", spec.Type)
+	}
+	return nil
+}
+
+// GetMaxRetries returns the times the retry action sends the request
+// again.
+func (spec *ResponseValidatorSpec) GetMaxRetries() int {
+	if spec.MaxRetries > 0 {
+		return spec.MaxRetries
+	}
+	return defaultResponseValidatorMaxRetries
+}
+
+func (spec *ResponseValidatorSpec) matches(model string) bool {
+	if len(spec.Models) == 0 {
+		return true
+	}
+	for _, pattern := range spec.Models {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAction returns the action on the failures of the check.
+func (spec *ResponseCheckSpec) GetAction() string {
+	if spec.Action == "" {
+		return ResponseActionWarn
+	}
+	return spec.Action
+}
+
+// NewResponseValidator creates the response validator.
+func NewResponseValidator(specs []*ResponseValidatorSpec) *ResponseValidator {
+	return &ResponseValidator{
+		specs:    specs,
+		triggers: metricshub.ResponseValidatorTriggers.NewCounter(),
+	}
+}
+
+// Validator returns the validator of the model, it returns nil if no
+// validator matches the model.
+func (v *ResponseValidator) Validator(model string) *ResponseValidatorSpec {
+	for _, spec := range v.specs {
+		if spec.matches(model) {
+			return spec
+		}
+	}
+	return nil
+}
+
+// Trigger counts the failed checks of a response of the model.
+func (v *ResponseValidator) Trigger(model string, failures []*aicontext.ResponseCheckFailure) {
+	if v.triggers == nil {
+		return
+	}
+	for _, f := range failures {
+		v.triggers.With(prometheus.Labels{"model": model, "check": f.Check, "action": f.Action}).Inc()
+	}
+}
+
+// Check checks the non-streaming response of the context. It returns the
+// failed checks, the action of the first one applies.
+func (v *ResponseValidator) Check(ctx *aicontext.Context, spec *ResponseValidatorSpec) []*aicontext.ResponseCheckFailure {
+	resp := ctx.GetResponse()
+	if !checksResponse(ctx) {
+		return nil
+	}
+	body, err := readResponseBody(resp)
+	if err != nil {
+		logger.Errorf("failed to read response for response validator: %v", err)
+		return nil
+	}
+	output, ok := parseResponseOutput(body)
+	if !ok {
+		return nil
+	}
+	return runResponseChecks(spec, ctx, body, output)
+}
+
+// WatchStream checks the streaming response of the context when it ends.
+// The response is sent to the user then, so the failed checks are only
+// recorded in the context and counted.
+func (v *ResponseValidator) WatchStream(ctx *aicontext.Context, spec *ResponseValidatorSpec) {
+	resp := ctx.GetResponse()
+	if !checksResponse(ctx) || resp.BodyReader == nil {
+		return
+	}
+	resp.BodyReader = &responseCheckReader{
+		Reader: resp.BodyReader,
+		check: func(body []byte) {
+			output, ok := parseResponseOutput(body)
+			if !ok {
+				return
+			}
+			failures := runResponseChecks(spec, ctx, body, output)
+			for _, f := range failures {
+				f.Action = responseActionNone
+			}
+			if len(failures) > 0 {
+				ctx.SetResponseCheckFailures(failures)
+				v.Trigger(ctx.ReqInfo.Model, failures)
+			}
+		},
+	}
+}
+
+func checksResponse(ctx *aicontext.Context) bool {
+	resp := ctx.GetResponse()
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	return ctx.RespType == aicontext.ResponseTypeChatCompletions || ctx.RespType == aicontext.ResponseTypeCompletions
+}
+
+func (r *responseCheckReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.buf.Write(p[:n])
+	if err == io.EOF && !r.done {
+		r.done = true
+		r.check(r.buf.Bytes())
+	}
+	return n, err
+}
+
+// Close closes the upstream body.
+func (r *responseCheckReader) Close() error {
+	if closer, ok := r.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func runResponseChecks(spec *ResponseValidatorSpec, ctx *aicontext.Context, body []byte, output *responseOutput) []*aicontext.ResponseCheckFailure {
+	var failures []*aicontext.ResponseCheckFailure
+	for _, check := range spec.Checks {
+		detail, failed := runResponseCheck(check, ctx, body, output)
+		if failed {
+			failures = append(failures, &aicontext.ResponseCheckFailure{
+				Check:  check.Type,
+				Action: check.GetAction(),
+				Detail: detail,
+			})
+		}
+	}
+	return failures
+}
+
+func runResponseCheck(spec *ResponseCheckSpec, ctx *aicontext.Context, body []byte, output *responseOutput) (string, bool) {
+	switch spec.Type {
+	case ResponseCheckNonEmpty:
+		if strings.TrimSpace(output.content) == "" && !output.toolCalls {
+			return "empty content", true
+		}
+	case ResponseCheckRepetition:
+		n, maxRatio := spec.NGram, spec.MaxRepeatedRatio
+		if n == 0 {
+			n = defaultResponseCheckNGram
+		}
+		if maxRatio == 0 {
+			maxRatio = defaultResponseCheckMaxRepeatedRatio
+		}
+		ratio := repeatedNGramRatio(output.content, n)
+		if ratio > maxRatio {
+			return fmt.Sprintf("repeated n-gram ratio %.2f exceeds %.2f", ratio, maxRatio), true
+		}
+	case ResponseCheckLength:
+		maxTokens := requestMaxTokens(ctx.OpenAIReq)
+		if maxTokens <= 0 {
+			return "", false
+		}
+		tokens := output.completionTokens
+		if tokens <= 0 {
+			tokens = estimateTokens(output.content)
+		}
+		ratio := float64(tokens) / float64(maxTokens)
+		if ratio < spec.MinLengthRatio || (spec.MaxLengthRatio > 0 && ratio > spec.MaxLengthRatio) {
+			return fmt.Sprintf("%d tokens of max tokens %d", tokens, maxTokens), true
+		}
+	case ResponseCheckUTF8:
+		if !utf8.Valid(body) || strings.ContainsRune(output.content, utf8.RuneError) {
+			return "invalid UTF-8", true
+		}
+	}
+	return "", false
+}
+
+// requestMaxTokens returns the max tokens of the request, it returns 0 if
+// the request has no max tokens.
+func requestMaxTokens(req map[string]any) int {
+	for _, field := range []string{"max_completion_tokens", "max_tokens"} {
+		if v, ok := req[field].(float64); ok && v > 0 {
+			return int(v)
+		}
+	}
+	return 0
+}
+
+// repeatedNGramRatio returns the ratio of the repeated word n-grams to all
+// n-grams of the text, it is 0 if the text is too short.
+func repeatedNGramRatio(text string, n int) float64 {
+	words := strings.Fields(text)
+	total := len(words) - n + 1
+	if total < minRepetitionNGrams {
+		return 0
+	}
+	seen := make(map[string]struct{}, total)
+	for i := 0; i < total; i++ {
+		seen[strings.Join(words[i:i+n], " ")] = struct{}{}
+	}
+	return float64(total-len(seen)) / float64(total)
+}
+
+// parseResponseOutput parses the output of the first choice of a chat
+// completions or completions response, which is streaming or not.
+func parseResponseOutput(body []byte) (*responseOutput, bool) {
+	type message struct {
+		Content   string            `json:"content"`
+		ToolCalls []json.RawMessage `json:"tool_calls"`
+	}
+	type response struct {
+		Choices []struct {
+			Index   int     `json:"index"`
+			Text    string  `json:"text"`
+			Message message `json:"message"`
+			Delta   message `json:"delta"`
+		} `json:"choices"`
+		Usage *struct {
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+
+	output := &responseOutput{}
+	add := func(resp *response) {
+		for _, c := range resp.Choices {
+			if c.Index != 0 {
+				continue
+			}
+			output.content += c.Text + c.Message.Content + c.Delta.Content
+			output.toolCalls = output.toolCalls || len(c.Message.ToolCalls) > 0 || len(c.Delta.ToolCalls) > 0
+		}
+		if resp.Usage != nil {
+			output.completionTokens = resp.Usage.CompletionTokens
+		}
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("data:")) {
+		var resp response
+		if err := json.Unmarshal(trimmed, &resp); err != nil || len(resp.Choices) == 0 {
+			return nil, false
+		}
+		add(&resp)
+		return output, true
+	}
+	for _, event := range bytes.Split(trimmed, []byte("\n\n")) {
+		data, ok := sseEventData(event)
+		if !ok {
+			continue
+		}
+		var resp response
+		if err := json.Unmarshal(data, &resp); err != nil {
+			continue
+		}
+		add(&resp)
+	}
+	return output, true
+}
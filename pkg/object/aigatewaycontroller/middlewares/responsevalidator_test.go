@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func newValidatorContext(t *testing.T, body string) *aicontext.Context {
+	ctx := egContext.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+	assert.Nil(t, err)
+	setRequest(t, ctx, "validator", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+	assert.Nil(t, err)
+	return aiCtx
+}
+
+func TestValidateResponseValidatorSpecs(t *testing.T) {
+	assert := assert.New(t)
+
+	valid := []*ResponseValidatorSpec{{
+		Models: []string{"gpt-*"},
+		Checks: []*ResponseCheckSpec{
+			{Type: ResponseCheckNonEmpty, Action: ResponseActionRetry},
+			{Type: ResponseCheckRepetition, NGram: 4, MaxRepeatedRatio: 0.3},
+			{Type: ResponseCheckLength, MinLengthRatio: 0.1},
+			{Type: ResponseCheckUTF8, Action: ResponseActionFallback},
+		},
+		Fallback: "backup",
+	}}
+	assert.Nil(ValidateResponseValidatorSpecs(valid))
+
+	invalid := []*ResponseValidatorSpec{
+		{},
+		{Checks: []*ResponseCheckSpec{{Type: "unknown"}}},
+		{Checks: []*ResponseCheckSpec{{Type: ResponseCheckNonEmpty, Action: "drop"}}},
+		{Checks: []*ResponseCheckSpec{{Type: ResponseCheckNonEmpty, Action: ResponseActionFallback}}},
+		{Checks: []*ResponseCheckSpec{{Type: ResponseCheckRepetition, MaxRepeatedRatio: 1}}},
+		{Checks: []*ResponseCheckSpec{{Type: ResponseCheckLength}}},
+		{Checks: []*ResponseCheckSpec{{Type: ResponseCheckLength, MinLengthRatio: 0.5, MaxLengthRatio: 0.2}}},
+		{Models: []string{"["}, Checks: []*ResponseCheckSpec{{Type: ResponseCheckNonEmpty}}},
+		{MaxRetries: -1, Checks: []*ResponseCheckSpec{{Type: ResponseCheckNonEmpty}}},
+	}
+	for i, spec := range invalid {
+		assert.NotNil(ValidateResponseValidatorSpecs([]*ResponseValidatorSpec{spec}), "case %d", i)
+	}
+}
+
+func TestResponseValidatorCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	v := NewResponseValidator([]*ResponseValidatorSpec{
+		{Models: []string{"gpt-*"}, Checks: []*ResponseCheckSpec{
+			{Type: ResponseCheckNonEmpty, Action: ResponseActionRetry},
+			{Type: ResponseCheckRepetition},
+			{Type: ResponseCheckLength, MinLengthRatio: 0.5},
+			{Type: ResponseCheckUTF8},
+		}},
+	})
+	assert.Nil(v.Validator("llama3"))
+	spec := v.Validator("gpt-4o")
+	assert.NotNil(spec)
+
+	check := func(request string, response string) []string {
+		aiCtx := newValidatorContext(t, request)
+		setToolPolicyResponse(aiCtx, response)
+		var checks []string
+		for _, f := range v.Check(aiCtx, spec) {
+			checks = append(checks, f.Check+"/"+f.Action)
+		}
+		// the body is kept for the response handlers.
+		assert.NotNil(aiCtx.GetResponse().BodyBytes)
+		return checks
+	}
+	request := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`
+	completion := func(content string) string {
+		return fmt.Sprintf(`{"choices": [{"index": 0, "message": {"role": "assistant", "content": %q}}]}`, content)
+	}
+
+	assert.Empty(check(request, completion("Hello! How can I help you?")))
+	assert.Equal([]string{"nonEmpty/retry"}, check(request, completion("  ")))
+	// tool calls without content are not empty.
+	assert.Empty(check(request, `{"choices": [{"index": 0, "message": {"role": "assistant", "content": null, "tool_calls": [{"id": "call_1"}]}}]}`))
+	assert.Equal([]string{"repetition/warn"}, check(request, completion(strings.Repeat("I am sorry. ", 20))))
+	assert.Equal([]string{"utf8/warn"}, check(request, completion("broken � output")))
+
+	limited := `{"model": "gpt-4o", "max_tokens": 100, "messages": [{"role": "user", "content": "hi"}]}`
+	assert.Equal([]string{"length/warn"}, check(limited, `{"choices": [{"index": 0, "message": {"content": "Short."}}], "usage": {"completion_tokens": 2}}`))
+	assert.Empty(check(limited, `{"choices": [{"index": 0, "message": {"content": "Long enough."}}], "usage": {"completion_tokens": 80}}`))
+
+	// the errors of providers are not checked.
+	aiCtx := newValidatorContext(t, request)
+	setToolPolicyResponse(aiCtx, completion(""))
+	aiCtx.GetResponse().StatusCode = http.StatusTooManyRequests
+	assert.Empty(v.Check(aiCtx, spec))
+}
+
+func TestResponseValidatorWatchStream(t *testing.T) {
+	assert := assert.New(t)
+
+	v := NewResponseValidator([]*ResponseValidatorSpec{
+		{Checks: []*ResponseCheckSpec{{Type: ResponseCheckNonEmpty, Action: ResponseActionRetry}}},
+	})
+	watch := func(stream string) *aicontext.Context {
+		aiCtx := newValidatorContext(t, `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`)
+		setToolPolicyResponse(aiCtx, stream)
+		v.WatchStream(aiCtx, v.Validator("gpt-4o"))
+		data, err := io.ReadAll(aiCtx.GetResponse().BodyReader)
+		assert.Nil(err)
+		assert.Equal(stream, string(data))
+		return aiCtx
+	}
+
+	aiCtx := watch(`data: {"choices":[{"index":0,"delta":{"content":"Hel"}}]}` + "\n\n" +
+		`data: {"choices":[{"index":0,"delta":{"content":"lo"}}]}` + "\n\n" + "data: [DONE]\n\n")
+	assert.Empty(aiCtx.ResponseCheckFailures())
+
+	aiCtx = watch(`data: {"choices":[{"index":0,"delta":{"content":""}}]}` + "\n\n" + "data: [DONE]\n\n")
+	failures := aiCtx.ResponseCheckFailures()
+	assert.Len(failures, 1)
+	// the stream is sent before it is checked, no action is taken.
+	assert.Equal("none", failures[0].Action)
+}
@@ -0,0 +1,491 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/pgvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	retrievalDefaultTopK         = 3
+	retrievalDefaultSystemPrompt = "Use the following context to answer the question."
+
+	// fields of the documents in the retrieval collection.
+	retrievalEmbeddingField = "embedding"
+	retrievalContentField   = "content"
+	retrievalIDField        = "doc_id"
+	retrievalSourceField    = "source"
+	retrievalTitleField     = "title"
+)
+
+type (
+	// RetrievalSpec defines the retrieval augmented generation middleware,
+	// it searches the documents similar to the prompt in the collection,
+	// and injects them into the request as a system message.
+	RetrievalSpec struct {
+		Embeddings      *embeddings.EmbeddingSpec `json:"embeddings" jsonschema:"required"`
+		VectorDB        *vectordb.Spec            `json:"vectorDB" jsonschema:"required"`
+		ContentTemplate string                    `json:"contentTemplate,omitempty"`
+		TopK            int                       `json:"topK,omitempty"`
+		// SystemPrompt is put before the injected documents.
+		SystemPrompt string        `json:"systemPrompt,omitempty"`
+		Citations    *CitationSpec `json:"citations,omitempty"`
+		// Packing packs the topK documents into a token budget, instead of
+		// injecting all of them.
+		Packing *RetrievalPackingSpec `json:"packing,omitempty"`
+		// Chunker splits the documents ingested by the admin API into
+		// chunks.
+		Chunker *RetrievalChunkerSpec `json:"chunker,omitempty"`
+		// Deadline skips or reduces the retrieval of the requests which
+		// would miss their deadlines.
+		Deadline *RetrievalDeadlineSpec `json:"deadline,omitempty"`
+		// ACL limits the documents retrieved for a consumer to the ones
+		// its groups have access to.
+		ACL *RetrievalACLSpec `json:"acl,omitempty"`
+		// FilterHeader is the request header carrying the tag filters of
+		// the documents chosen by the client, see parseRetrievalFilters.
+		FilterHeader string `json:"filterHeader,omitempty"`
+	}
+
+	// RetrievalProbeResult explains the documents injected into a request.
+	RetrievalProbeResult struct {
+		Content           string `json:"content"`
+		EmbeddingDuration string `json:"embeddingDuration"`
+		SearchDuration    string `json:"searchDuration"`
+		// MaxTokens is the budget of packing, it is 0 if packing is not
+		// enabled and all documents are injected.
+		MaxTokens    int                      `json:"maxTokens,omitempty"`
+		PackedTokens int                      `json:"packedTokens"`
+		Chunks       []*aicontext.PackedChunk `json:"chunks"`
+	}
+
+	retrievalMiddleware struct {
+		spec              *MiddlewareSpec
+		embeddingsHandler embeddings.EmbeddingHandler
+		vectorDB          vectordb.VectorDB
+		template          *template.Template
+
+		handlerLock sync.Mutex
+		handler     vectordb.VectorHandler
+		deadline    *retrievalDeadline
+
+		reembeds reembedJobs
+
+		stopIntegrityChecks []func()
+	}
+)
+
+func init() {
+	middlewareTypeRegistry[retrievalMiddlewareKind] = reflect.TypeOf(retrievalMiddleware{})
+}
+
+var _ Middleware = (*retrievalMiddleware)(nil)
+
+func (m *retrievalMiddleware) init(spec *MiddlewareSpec) {
+	m.spec = spec
+	m.embeddingsHandler = embeddings.New(spec.Retrieval.Embeddings)
+	m.vectorDB = vectordb.New(spec.Retrieval.VectorDB)
+	m.stopIntegrityChecks = scheduleIntegrityChecks(m.integrityCollections())
+	if deadline := spec.Retrieval.Deadline; deadline != nil {
+		m.deadline = newRetrievalDeadline(spec.Name, deadline)
+	}
+	templateText := spec.Retrieval.ContentTemplate
+	if templateText == "" {
+		templateText = semanticCacheDefaultContentTemplate
+	}
+	m.template = template.Must(template.New("").Parse(templateText))
+}
+
+func (m *retrievalMiddleware) validate(spec *MiddlewareSpec) error {
+	if spec.Retrieval == nil {
+		return fmt.Errorf("retrieval middleware %s must have a retrieval spec", spec.Name)
+	}
+	if err := embeddings.ValidateSpec(spec.Retrieval.Embeddings); err != nil {
+		return fmt.Errorf("retrieval middleware %s has invalid embeddings spec: %w", spec.Name, err)
+	}
+	if spec.Retrieval.VectorDB == nil {
+		return fmt.Errorf("retrieval middleware %s must have a vectorDB spec", spec.Name)
+	}
+	if err := vectordb.ValidateSpec(spec.Retrieval.VectorDB); err != nil {
+		return fmt.Errorf("retrieval middleware %s has invalid vectorDB spec: %w", spec.Name, err)
+	}
+	if spec.Retrieval.ContentTemplate != "" {
+		if _, err := template.New("").Parse(spec.Retrieval.ContentTemplate); err != nil {
+			return fmt.Errorf("retrieval middleware %s has invalid content template: %w", spec.Name, err)
+		}
+	}
+	if spec.Retrieval.TopK < 0 {
+		return fmt.Errorf("topK of retrieval middleware %s must not be negative", spec.Name)
+	}
+	if err := validateCitationSpec(spec.Retrieval.Citations); err != nil {
+		return fmt.Errorf("retrieval middleware %s has invalid citations spec: %w", spec.Name, err)
+	}
+	if err := validateRetrievalPackingSpec(spec.Retrieval.Packing); err != nil {
+		return fmt.Errorf("retrieval middleware %s has invalid packing spec: %w", spec.Name, err)
+	}
+	if err := validateRetrievalChunkerSpec(spec.Retrieval.Chunker); err != nil {
+		return fmt.Errorf("retrieval middleware %s has invalid chunker spec: %w", spec.Name, err)
+	}
+	if err := validateRetrievalDeadlineSpec(spec.Retrieval.Deadline, retrievalTopK(spec.Retrieval)); err != nil {
+		return fmt.Errorf("retrieval middleware %s has invalid deadline spec: %w", spec.Name, err)
+	}
+	if err := validateRetrievalACLSpec(spec.Retrieval.ACL); err != nil {
+		return fmt.Errorf("retrieval middleware %s has invalid acl spec: %w", spec.Name, err)
+	}
+	return nil
+}
+
+func (m *retrievalMiddleware) Name() string {
+	return m.spec.Name
+}
+
+func (m *retrievalMiddleware) Kind() string {
+	return retrievalMiddlewareKind
+}
+
+func (m *retrievalMiddleware) Spec() *MiddlewareSpec {
+	return m.spec
+}
+
+func (m *retrievalMiddleware) getContent(ctx *aicontext.Context) (string, error) {
+	var result bytes.Buffer
+	if err := m.template.Execute(&result, ctx.OpenAIReq); err != nil {
+		return "", fmt.Errorf("failed to execute template for retrieval: %w", err)
+	}
+	return result.String(), nil
+}
+
+// getHandler returns the handler of the collection, the collection is
+// created if it does not exist.
+func (m *retrievalMiddleware) getHandler(dim int) (vectordb.VectorHandler, error) {
+	m.handlerLock.Lock()
+	defer m.handlerLock.Unlock()
+
+	if m.handler != nil {
+		return m.handler, nil
+	}
+	dbSpec := m.spec.Retrieval.VectorDB
+	handler, err := m.vectorDB.CreateSchema(context.Background(), func(o *vecdbtypes.Options) {
+		o.DBName = dbSpec.CollectionName
+		o.Schema = retrievalSchema(m.spec.Retrieval, dim)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create collection, %v", err)
+	}
+	handler = vectordb.NewLimitedHandler(dbSpec, handler, vecdbtypes.QueryPriorityMedium)
+	handler = vectordb.NewRescoredHandler(dbSpec, handler)
+	handler = vectordb.NewAliasedHandler(dbSpec, handler)
+	m.handler = handler
+	return handler, nil
+}
+
+func retrievalSchema(spec *RetrievalSpec, dim int) vecdbtypes.Schema {
+	dbSpec := spec.VectorDB
+	if dbSpec.Type == vectordb.TypePostgres {
+		schema := &pgvector.TableSchema{
+			TableName: dbSpec.CollectionName,
+			Columns: []pgvector.Column{
+				{Name: retrievalEmbeddingField, DataType: fmt.Sprintf("vector(%d)", dim)},
+				{Name: retrievalContentField, DataType: "text"},
+				{Name: retrievalIDField, DataType: "text"},
+				{Name: retrievalSourceField, DataType: "text"},
+				{Name: retrievalTitleField, DataType: "text"},
+				{Name: retrievalParentHashField, DataType: "text"},
+				{Name: retrievalChunkIndexField, DataType: "integer"},
+			},
+		}
+		if dbSpec.EmbeddingVersion != "" {
+			schema.Columns = append(schema.Columns, pgvector.Column{Name: vectordb.EmbeddingVersionField, DataType: "text"})
+		}
+		if spec.ACL != nil {
+			schema.Columns = append(schema.Columns, pgvector.Column{Name: spec.ACL.getField(), DataType: "text[]"})
+		}
+		return schema
+	}
+	schema := &redisvector.IndexSchema{
+		Vectors: []redisvector.Vector{{Name: retrievalEmbeddingField, Dim: dim}},
+		Texts: []redisvector.Text{
+			{Name: retrievalContentField},
+			{Name: retrievalIDField},
+			{Name: retrievalSourceField},
+			{Name: retrievalTitleField},
+		},
+		Tags:     []redisvector.Tag{{Name: retrievalParentHashField}},
+		Numerics: []redisvector.Numeric{{Name: retrievalChunkIndexField}},
+	}
+	if dbSpec.EmbeddingVersion != "" {
+		schema.Tags = append(schema.Tags, redisvector.Tag{Name: vectordb.EmbeddingVersionField})
+	}
+	if spec.ACL != nil {
+		schema.Tags = append(schema.Tags, redisvector.Tag{Name: spec.ACL.getField()})
+	}
+	return schema
+}
+
+func retrievalTopK(spec *RetrievalSpec) int {
+	if spec.TopK == 0 {
+		return retrievalDefaultTopK
+	}
+	return spec.TopK
+}
+
+// search returns the topK documents similar to the embedding.
+func (m *retrievalMiddleware) search(ctx *aicontext.Context, embedding []float32) ([]map[string]any, error) {
+	return m.searchTopK(ctx, embedding, retrievalTopK(m.spec.Retrieval))
+}
+
+// searchTopK returns the documents similar to the embedding, up to topK.
+// The documents are explained if packing is enabled, so they have scores.
+// The filters of the client narrow the documents, and the ACL of the
+// consumer is a mandatory filter no other option overrides.
+func (m *retrievalMiddleware) searchTopK(ctx *aicontext.Context, embedding []float32, topK int) ([]map[string]any, error) {
+	spec := m.spec.Retrieval
+	options := append(getSearchOptions(spec.VectorDB, embedding), vecdbtypes.WithLimit(topK))
+	if spec.Packing != nil {
+		options = append(options, vecdbtypes.WithExplain())
+	}
+	if spec.FilterHeader != "" {
+		if value := ctx.Req.HTTPHeader().Get(spec.FilterHeader); value != "" {
+			filters, err := parseRetrievalFilters(value, spec.ACL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter header: %w", err)
+			}
+			options = append(options, vecdbtypes.WithTagFilters(filters...))
+		}
+	}
+	if spec.ACL != nil {
+		filter := spec.ACL.filter(spec.ACL.groups(ctx))
+		if filter == nil {
+			ctx.Ctx.AddTag(fmt.Sprintf("retrieval %s: no documents accessible to the consumer", m.spec.Name))
+			return nil, nil
+		}
+		options = append(options, vecdbtypes.WithMandatoryTagFilters(filter))
+	}
+
+	handler, err := m.getHandler(len(embedding))
+	if err != nil {
+		return nil, err
+	}
+	docs, err := handler.SimilaritySearch(ctx.Req.Std().Context(), options...)
+	if err != nil {
+		switch {
+		case errors.Is(err, vecdbtypes.ErrNotFound):
+			return nil, nil
+		case errors.Is(err, vecdbtypes.ErrUnavailable), errors.Is(err, vecdbtypes.ErrTimeout):
+			// the request goes on without documents if the backend is
+			// saturated or failing over.
+			if err != vectordb.ErrQueryShed {
+				logger.Warnf("retrieval degraded to no documents: %v", err)
+			}
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(docs) > topK {
+		docs = docs[:topK]
+	}
+	return docs, nil
+}
+
+func (m *retrievalMiddleware) Handle(ctx *aicontext.Context) {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions {
+		return
+	}
+	if !ctx.Resident(m.spec.Retrieval.VectorDB.Region) {
+		ctx.Ctx.AddTag(fmt.Sprintf("retrieval %s: skipped out of region %s", m.spec.Name, ctx.ConsumerRegion))
+		return
+	}
+
+	content, err := m.getContent(ctx)
+	if err != nil {
+		logger.Errorf("failed to get content for retrieval: %v", err)
+		return
+	}
+	if content == "" {
+		return
+	}
+	topK := retrievalTopK(m.spec.Retrieval)
+	if m.deadline != nil {
+		switch m.deadline.decide(ctx, time.Now()) {
+		case RetrievalBudgetSkipped:
+			return
+		case RetrievalBudgetReduced:
+			topK = m.deadline.spec.ReducedTopK
+		}
+	}
+	start := time.Now()
+	embedding, err := embedQuery(ctx, m.spec.Name, m.spec.Retrieval.Embeddings, m.embeddingsHandler, content)
+	if err != nil {
+		logger.Errorf("failed to embed content for retrieval: %v", err)
+		return
+	}
+	docs, err := m.searchTopK(ctx, embedding, topK)
+	if err != nil {
+		logger.Errorf("failed to search documents for retrieval: %v", err)
+		return
+	}
+	if m.deadline != nil {
+		m.deadline.record(time.Since(start))
+	}
+	if packing := m.spec.Retrieval.Packing; packing != nil {
+		var chunks []*aicontext.PackedChunk
+		docs, chunks = packing.pack(docs)
+		ctx.AddPackedChunks(chunks...)
+	}
+	if len(docs) == 0 {
+		return
+	}
+	if err := m.inject(ctx, docs); err != nil {
+		logger.Errorf("failed to inject documents for retrieval: %v", err)
+		return
+	}
+
+	if spec := m.spec.Retrieval.Citations; spec != nil {
+		ctx.OnResponse(func(ctx *aicontext.Context) {
+			appendCitations(ctx, spec)
+		})
+	}
+}
+
+var _ Prober = (*retrievalMiddleware)(nil)
+
+// Probe explains the documents injected into the request. It takes the
+// same code path as Handle, but never changes the request.
+func (m *retrievalMiddleware) Probe(ctx *aicontext.Context, options *ProbeOptions) (any, error) {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions {
+		return nil, fmt.Errorf("retrieval does not support %s requests", ctx.RespType)
+	}
+	content, err := m.getContent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &RetrievalProbeResult{Content: content, Chunks: []*aicontext.PackedChunk{}}
+	if content == "" {
+		return result, nil
+	}
+
+	start := time.Now()
+	embedding, err := m.embeddingsHandler.EmbedQuery(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed content: %w", err)
+	}
+	result.EmbeddingDuration = time.Since(start).String()
+
+	start = time.Now()
+	docs, err := m.search(ctx, embedding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search documents: %w", err)
+	}
+	result.SearchDuration = time.Since(start).String()
+
+	if packing := m.spec.Retrieval.Packing; packing != nil {
+		result.MaxTokens = packing.MaxTokens
+		_, result.Chunks = packing.pack(docs)
+	} else {
+		for _, doc := range docs {
+			tokens := estimateTokens(retrievalDocField(doc, retrievalContentField))
+			result.Chunks = append(result.Chunks, &aicontext.PackedChunk{
+				ID:           retrievalDocField(doc, retrievalIDField),
+				Source:       retrievalDocField(doc, retrievalSourceField),
+				Tokens:       tokens,
+				PackedTokens: tokens,
+				Decision:     PackingSelected,
+			})
+		}
+	}
+	for _, chunk := range result.Chunks {
+		result.PackedTokens += chunk.PackedTokens
+	}
+	return result, nil
+}
+
+// inject puts the documents into the request as a system message, and
+// records them in the context for citations.
+func (m *retrievalMiddleware) inject(ctx *aicontext.Context, docs []map[string]any) error {
+	messages, ok := ctx.OpenAIReq["messages"].([]any)
+	if !ok {
+		return fmt.Errorf("no messages in request")
+	}
+
+	prompt := m.spec.Retrieval.SystemPrompt
+	if prompt == "" {
+		prompt = retrievalDefaultSystemPrompt
+	}
+	var sb strings.Builder
+	sb.WriteString(prompt)
+	citations := make([]*aicontext.Citation, 0, len(docs))
+	for i, doc := range docs {
+		citation := &aicontext.Citation{
+			ID:     retrievalDocField(doc, retrievalIDField),
+			Source: retrievalDocField(doc, retrievalSourceField),
+			Title:  retrievalDocField(doc, retrievalTitleField),
+		}
+		citations = append(citations, citation)
+
+		sb.WriteString("\n\n[" + strconv.Itoa(i+1) + "]")
+		if citation.Title != "" {
+			sb.WriteString(" " + citation.Title)
+		}
+		if citation.Source != "" {
+			sb.WriteString(" (" + citation.Source + ")")
+		}
+		sb.WriteString("\n" + retrievalDocField(doc, retrievalContentField))
+	}
+
+	message := map[string]any{"role": "system", "content": sb.String()}
+	ctx.OpenAIReq["messages"] = append([]any{message}, messages...)
+	body, err := codectool.MarshalJSON(ctx.OpenAIReq)
+	if err != nil {
+		ctx.OpenAIReq["messages"] = messages
+		return err
+	}
+	ctx.ReqBody = body
+	ctx.AddCitations(citations...)
+	return nil
+}
+
+func retrievalDocField(doc map[string]any, field string) string {
+	switch v := doc[field].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/stretchr/testify/assert"
+)
+
+// retrievalVectorDB returns the documents in order, up to the limit.
+type retrievalVectorDB struct {
+	docs []map[string]any
+	err  error
+}
+
+func (db *retrievalVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	return db, nil
+}
+
+func (db *retrievalVectorDB) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	db.docs = append(db.docs, docs...)
+	return nil, nil
+}
+
+func (db *retrievalVectorDB) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	opts := &vecdbtypes.HandlerSearchOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	if db.err != nil {
+		return nil, db.err
+	}
+	filters := append(slices.Clone(opts.TagFilters), opts.MandatoryTagFilters...)
+	var docs []map[string]any
+	for _, doc := range db.docs {
+		if matchTagFilters(doc, filters) {
+			docs = append(docs, doc)
+		}
+	}
+	if len(docs) == 0 {
+		return nil, vecdbtypes.ErrSimilaritySearchNotFound
+	}
+	if opts.Limit > 0 && len(docs) > opts.Limit {
+		return docs[:opts.Limit], nil
+	}
+	return docs, nil
+}
+
+// matchTagFilters matches the document like Redis, the tags of a field are
+// separated by commas.
+func matchTagFilters(doc map[string]any, filters []*vecdbtypes.TagFilter) bool {
+	for _, filter := range filters {
+		var tags []string
+		switch v := doc[filter.Field].(type) {
+		case string:
+			tags = strings.Split(v, ",")
+		case []string:
+			tags = v
+		}
+		matched := slices.ContainsFunc(tags, func(tag string) bool {
+			return slices.Contains(filter.Tags, tag)
+		})
+		if matched == filter.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+func newRetrievalMiddleware(t *testing.T, citations *CitationSpec) *retrievalMiddleware {
+	spec := &MiddlewareSpec{
+		Name: "test-retrieval",
+		Kind: retrievalMiddlewareKind,
+		Retrieval: &RetrievalSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "ollama",
+				BaseURL:      "http://retrieval-test:11434",
+				Model:        "nomic-embed-text",
+			},
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{
+					Type:           vectordb.TypeRedis,
+					Threshold:      0.5,
+					CollectionName: "docs",
+				},
+				Redis: &redisvector.RedisVectorDBSpec{URL: "redis://retrieval-test:6379"},
+			},
+			TopK:      3,
+			Citations: citations,
+		},
+	}
+	assert.Nil(t, ValidateSpec(spec))
+
+	m := &retrievalMiddleware{}
+	m.spec = spec
+	m.embeddingsHandler = &mockEmbeddingHandler{}
+	m.template = template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate))
+	m.vectorDB = &retrievalVectorDB{
+		docs: []map[string]any{
+			{"doc_id": "1", "source": "https://docs.example.com/a", "title": "Doc A", "content": "content of a"},
+			{"doc_id": "2", "source": "https://docs.example.com/a", "title": "Doc A", "content": "another chunk of a"},
+			{"doc_id": "3", "source": "https://docs.example.com/b", "content": "content of b"},
+			{"doc_id": "4", "source": "https://docs.example.com/c", "content": "content of c"},
+		},
+	}
+	return m
+}
+
+func newRetrievalContext(t *testing.T, consumer string, stream bool) *aicontext.Context {
+	data := map[string]any{
+		"model":    "gpt-4.1",
+		"stream":   stream,
+		"messages": []map[string]any{{"role": "user", "content": "what is a?"}},
+	}
+	jsonData, err := json.Marshal(data)
+	assert.Nil(t, err)
+
+	ctx := egContext.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+	assert.Nil(t, err)
+	req.Header.Set("X-Consumer", consumer)
+	setRequest(t, ctx, "retrieval", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+	assert.Nil(t, err)
+	return aiCtx
+}
+
+func TestRetrievalInject(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newRetrievalMiddleware(t, nil)
+	aiCtx := newRetrievalContext(t, "", false)
+	m.Handle(aiCtx)
+	assert.False(aiCtx.IsStopped())
+	assert.Empty(aiCtx.ResponseHandlers())
+
+	req := map[string]any{}
+	assert.Nil(json.Unmarshal(aiCtx.ReqBody, &req))
+	messages := req["messages"].([]any)
+	assert.Len(messages, 2)
+	system := messages[0].(map[string]any)
+	assert.Equal("system", system["role"])
+	content := system["content"].(string)
+	assert.Contains(content, "[1] Doc A (https://docs.example.com/a)\ncontent of a")
+	assert.Contains(content, "[3] (https://docs.example.com/b)\ncontent of b")
+	assert.NotContains(content, "content of c")
+
+	assert.Len(aiCtx.Citations(), 3)
+	assert.Equal("1", aiCtx.Citations()[0].ID)
+}
+
+func TestRetrievalSearchErrorKinds(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newRetrievalMiddleware(t, nil)
+	db := m.vectorDB.(*retrievalVectorDB)
+	embedding := []float32{1, 0}
+
+	// the request goes on without documents if the backend is not
+	// available, or the collection is not found.
+	for _, kind := range []error{vecdbtypes.ErrUnavailable, vecdbtypes.ErrTimeout, vecdbtypes.ErrNotFound} {
+		db.err = vecdbtypes.NewError(kind, errors.New("backend error"))
+		docs, err := m.search(newRetrievalContext(t, "", false), embedding)
+		assert.NoError(err)
+		assert.Empty(docs)
+	}
+	db.err = vectordb.ErrQueryShed
+	_, err := m.search(newRetrievalContext(t, "", false), embedding)
+	assert.NoError(err)
+
+	for _, kind := range []error{vecdbtypes.ErrDimensionMismatch, vecdbtypes.ErrInvalidFilter} {
+		db.err = vecdbtypes.NewError(kind, errors.New("backend error"))
+		_, err := m.search(newRetrievalContext(t, "", false), embedding)
+		assert.ErrorIs(err, kind)
+	}
+}
+
+func TestRetrievalCitations(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &CitationSpec{
+		MaxCitations:    5,
+		ConsumerHeader:  "X-Consumer",
+		ConsumerFormats: map[string]string{"alice": citationFormatMarkdown},
+	}
+	body := `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"finish_reason":"stop",` +
+		`"message":{"role":"assistant","content":"a is a letter."}}]}`
+
+	handle := func(consumer string) map[string]any {
+		m := newRetrievalMiddleware(t, spec)
+		aiCtx := newRetrievalContext(t, consumer, false)
+		m.Handle(aiCtx)
+		setToolPolicyResponse(aiCtx, body)
+		resp := aiCtx.GetResponse()
+		assert.Equal(int64(len(resp.BodyBytes)), resp.ContentLength)
+		completion := map[string]any{}
+		assert.Nil(json.Unmarshal(resp.BodyBytes, &completion))
+		return completion["choices"].([]any)[0].(map[string]any)["message"].(map[string]any)
+	}
+
+	{
+		message := handle("bob")
+		assert.Equal("a is a letter.", message["content"])
+		annotations := message["annotations"].([]any)
+		// the documents of the same source are deduplicated.
+		assert.Len(annotations, 2)
+		annotation := annotations[0].(map[string]any)
+		assert.Equal("url_citation", annotation["type"])
+		assert.Equal("https://docs.example.com/a", annotation["url_citation"].(map[string]any)["url"])
+		assert.Equal("Doc A", annotation["url_citation"].(map[string]any)["title"])
+	}
+
+	{
+		message := handle("alice")
+		assert.Nil(message["annotations"])
+		assert.Equal("a is a letter.\n\nSources:\n1. [Doc A](https://docs.example.com/a)\n2. https://docs.example.com/b", message["content"])
+	}
+
+	{
+		spec.MaxCitations = 1
+		message := handle("alice")
+		assert.Equal("a is a letter.\n\nSources:\n1. [Doc A](https://docs.example.com/a)", message["content"])
+		spec.MaxCitations = 5
+	}
+}
+
+func TestRetrievalStreamCitations(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &CitationSpec{
+		ConsumerHeader:  "X-Consumer",
+		ConsumerFormats: map[string]string{"alice": citationFormatMarkdown},
+	}
+	stream := `data: {"id":"chatcmpl-1","model":"gpt-4.1","choices":[{"index":0,"delta":{"role":"assistant","content":"a is"}}]}` + "\n\n" +
+		`data: {"id":"chatcmpl-1","model":"gpt-4.1","choices":[{"index":0,"delta":{"content":" a letter."},"finish_reason":"stop"}]}` + "\n\n" +
+		"data: [DONE]\n\n"
+
+	handle := func(consumer string, stream string) []string {
+		m := newRetrievalMiddleware(t, spec)
+		aiCtx := newRetrievalContext(t, consumer, true)
+		m.Handle(aiCtx)
+		setToolPolicyResponse(aiCtx, stream)
+		resp := aiCtx.GetResponse()
+		assert.Equal(int64(-1), resp.ContentLength)
+		data, err := io.ReadAll(resp.BodyReader)
+		assert.Nil(err)
+		return strings.Split(strings.TrimSuffix(string(data), "\n\n"), "\n\n")
+	}
+
+	{
+		events := handle("bob", stream)
+		assert.Len(events, 4)
+		assert.Equal("data: [DONE]", events[3])
+		chunk := map[string]any{}
+		assert.Nil(json.Unmarshal([]byte(strings.TrimPrefix(events[2], "data: ")), &chunk))
+		assert.Equal("chatcmpl-1", chunk["id"])
+		assert.Equal("gpt-4.1", chunk["model"])
+		delta := chunk["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)
+		assert.Len(delta["annotations"].([]any), 2)
+	}
+
+	{
+		events := handle("alice", stream)
+		assert.Len(events, 4)
+		chunk := map[string]any{}
+		assert.Nil(json.Unmarshal([]byte(strings.TrimPrefix(events[2], "data: ")), &chunk))
+		delta := chunk["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)
+		assert.Equal("\n\nSources:\n1. [Doc A](https://docs.example.com/a)\n2. https://docs.example.com/b", delta["content"])
+	}
+
+	{
+		// the citations are appended at the end if there is no [DONE] event.
+		events := handle("bob", strings.TrimSuffix(stream, "data: [DONE]\n\n"))
+		assert.Len(events, 3)
+		assert.Contains(events[2], "url_citation")
+	}
+}
+
+func TestRetrievalDialect(t *testing.T) {
+	assert := assert.New(t)
+
+	// the searches of thresholds below 1 are range queries, which are
+	// rejected by Redis with dialect 1.
+	spec := newRetrievalMiddleware(t, nil).spec
+	spec.Retrieval.VectorDB.Redis.Dialect = 1
+	assert.ErrorContains(ValidateSpec(spec), "VECTOR_RANGE")
+	spec.Retrieval.VectorDB.Threshold = 1
+	assert.NoError(ValidateSpec(spec))
+	spec.Retrieval.VectorDB.Redis.Dialect = 2
+	spec.Retrieval.VectorDB.Threshold = 0.5
+	assert.NoError(ValidateSpec(spec))
+}
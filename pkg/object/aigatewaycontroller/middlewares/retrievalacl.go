@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// RetrievalACLAllow and RetrievalACLDeny are the default policies of
+	// the documents without ACLs.
+	RetrievalACLAllow = "allow"
+	RetrievalACLDeny  = "deny"
+
+	retrievalDefaultACLField = "acl"
+	retrievalDefaultACLClaim = "groups"
+	// retrievalPublicACL is the ACL written with the documents ingested
+	// without one, it is never a group of consumers.
+	retrievalPublicACL = "__public__"
+)
+
+// RetrievalACLSpec limits the documents retrieved for a consumer to the
+// ones whose ACL has any of its groups.
+type RetrievalACLSpec struct {
+	// Field is the field of the ACL of the documents, default acl.
+	Field string `json:"field,omitempty"`
+	// GroupHeaders are the request headers carrying the groups of the
+	// consumer separated by commas, like the group header set by the
+	// consumers of the controller, which removes the values from clients.
+	GroupHeaders []string `json:"groupHeaders,omitempty"`
+	// JWTHeader is the request header carrying a JWT verified before the
+	// AI gateway, and JWTClaim is its claim of the groups of the consumer,
+	// default groups.
+	JWTHeader string `json:"jwtHeader,omitempty"`
+	JWTClaim  string `json:"jwtClaim,omitempty"`
+	// DefaultPolicy is whether the documents without ACLs are retrieved
+	// for all consumers, allow or deny, default deny.
+	DefaultPolicy string `json:"defaultPolicy,omitempty" jsonschema:"enum=,enum=allow,enum=deny"`
+}
+
+func validateRetrievalACLSpec(spec *RetrievalACLSpec) error {
+	if spec == nil {
+		return nil
+	}
+	switch spec.getField() {
+	case retrievalEmbeddingField, retrievalContentField, retrievalIDField, retrievalSourceField,
+		retrievalTitleField, retrievalParentHashField, retrievalChunkIndexField, vectordb.EmbeddingVersionField, "id":
+		return fmt.Errorf("field %s is a reserved field of the documents", spec.Field)
+	}
+	if len(spec.GroupHeaders) == 0 && spec.JWTHeader == "" {
+		return fmt.Errorf("groupHeaders or jwtHeader is required")
+	}
+	if slices.Contains(spec.GroupHeaders, "") {
+		return fmt.Errorf("groupHeaders cannot be empty")
+	}
+	switch spec.DefaultPolicy {
+	case "", RetrievalACLAllow, RetrievalACLDeny:
+	default:
+		return fmt.Errorf("invalid defaultPolicy %s", spec.DefaultPolicy)
+	}
+	return nil
+}
+
+func (spec *RetrievalACLSpec) getField() string {
+	if spec.Field != "" {
+		return spec.Field
+	}
+	return retrievalDefaultACLField
+}
+
+func (spec *RetrievalACLSpec) getJWTClaim() string {
+	if spec.JWTClaim != "" {
+		return spec.JWTClaim
+	}
+	return retrievalDefaultACLClaim
+}
+
+// groups returns the groups of the consumer of the request, from the
+// group headers and the JWT claim. A malformed JWT has no groups.
+func (spec *RetrievalACLSpec) groups(ctx *aicontext.Context) []string {
+	header := ctx.Req.HTTPHeader()
+	var groups []string
+	for _, name := range spec.GroupHeaders {
+		for _, value := range header.Values(name) {
+			groups = append(groups, strings.Split(value, ",")...)
+		}
+	}
+	if token := header.Get(spec.JWTHeader); spec.JWTHeader != "" && token != "" {
+		claims, _ := decodeJWTClaims(token)
+		switch v := claims[spec.getJWTClaim()].(type) {
+		case string:
+			groups = append(groups, strings.Split(v, ",")...)
+		case []any:
+			for _, group := range v {
+				if s, ok := group.(string); ok {
+					groups = append(groups, s)
+				}
+			}
+		}
+	}
+
+	result := make([]string, 0, len(groups))
+	for _, group := range groups {
+		group = strings.TrimSpace(group)
+		if group != "" && group != retrievalPublicACL {
+			result = append(result, group)
+		}
+	}
+	slices.Sort(result)
+	return slices.Compact(result)
+}
+
+// filter returns the filter of the documents the groups have access to,
+// it is nil if they have access to none.
+func (spec *RetrievalACLSpec) filter(groups []string) *vecdbtypes.TagFilter {
+	tags := slices.Clone(groups)
+	if spec.DefaultPolicy == RetrievalACLAllow {
+		tags = append(tags, retrievalPublicACL)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return &vecdbtypes.TagFilter{Field: spec.getField(), Tags: tags, Array: true}
+}
+
+// documentACL returns the ACL field written with an ingested document.
+func (spec *RetrievalACLSpec) documentACL(dbType string, acl []string) (any, error) {
+	for _, group := range acl {
+		switch {
+		case strings.TrimSpace(group) == "":
+			return nil, fmt.Errorf("groups of ACL cannot be empty")
+		case strings.Contains(group, ","):
+			return nil, fmt.Errorf("group %s of ACL cannot contain commas", group)
+		case group == retrievalPublicACL:
+			return nil, fmt.Errorf("group %s of ACL is reserved", group)
+		}
+	}
+	if len(acl) == 0 {
+		acl = []string{retrievalPublicACL}
+	}
+	if dbType == vectordb.TypePostgres {
+		return acl, nil
+	}
+	// the tags of Redis are separated by commas.
+	return strings.Join(acl, ","), nil
+}
+
+// parseRetrievalFilters parses the filters of the filter header, like
+// source=wiki,faq;lang!=de, which are the documents whose field has any
+// of the tags, or none of them with !=. They never filter on the ACL
+// field, so they only narrow the documents the consumer has access to.
+func parseRetrievalFilters(value string, acl *RetrievalACLSpec) ([]*vecdbtypes.TagFilter, error) {
+	var filters []*vecdbtypes.TagFilter
+	for _, clause := range strings.Split(value, ";") {
+		if strings.TrimSpace(clause) == "" {
+			continue
+		}
+		field, tags, ok := strings.Cut(clause, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %q", clause)
+		}
+		filter := &vecdbtypes.TagFilter{Field: strings.TrimSpace(field)}
+		if strings.HasSuffix(filter.Field, "!") {
+			filter.Field, filter.Negate = strings.TrimSpace(strings.TrimSuffix(filter.Field, "!")), true
+		}
+		if acl != nil && filter.Field == acl.getField() {
+			return nil, fmt.Errorf("filter on the ACL field %s is not allowed", filter.Field)
+		}
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				filter.Tags = append(filter.Tags, tag)
+			}
+		}
+		filters = append(filters, filter)
+	}
+	if err := vecdbtypes.ValidateTagFilters(filters); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
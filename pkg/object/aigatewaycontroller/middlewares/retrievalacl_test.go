@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func newACLRetrievalMiddleware(t *testing.T, policy string) *retrievalMiddleware {
+	m := newRetrievalMiddleware(t, nil)
+	m.spec.Retrieval.ACL = &RetrievalACLSpec{
+		GroupHeaders:  []string{"X-Consumer-Group"},
+		JWTHeader:     "Authorization",
+		DefaultPolicy: policy,
+	}
+	m.spec.Retrieval.FilterHeader = "X-Retrieval-Filter"
+	assert.Nil(t, ValidateSpec(m.spec))
+	m.vectorDB = &retrievalVectorDB{
+		docs: []map[string]any{
+			{"doc_id": "hr", "source": "handbook", "content": "salaries", "acl": "hr"},
+			{"doc_id": "finance", "source": "handbook", "content": "budgets", "acl": "finance"},
+			{"doc_id": "public", "source": "handbook", "content": "holidays", "acl": retrievalPublicACL},
+			{"doc_id": "shared", "source": "wiki", "content": "offices", "acl": "finance,hr"},
+			// ingested before the ACL was enabled.
+			{"doc_id": "legacy", "source": "wiki", "content": "history"},
+		},
+	}
+	return m
+}
+
+// retrieveACL returns the IDs of the documents retrieved for a request with
+// the headers.
+func retrieveACL(t *testing.T, m *retrievalMiddleware, headers map[string]string) ([]string, error) {
+	ctx := newRetrievalContext(t, "", false)
+	for k, v := range headers {
+		ctx.Req.HTTPHeader().Set(k, v)
+	}
+	docs, err := m.searchTopK(ctx, []float32{0.1}, 10)
+	var ids []string
+	for _, doc := range docs {
+		ids = append(ids, retrievalDocField(doc, retrievalIDField))
+	}
+	return ids, err
+}
+
+func newTestJWT(payload string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return "Bearer " + encode([]byte(`{"alg":"HS256"}`)) + "." + encode([]byte(payload)) + ".signature"
+}
+
+func TestValidateRetrievalACLSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateRetrievalACLSpec(nil))
+	assert.NoError(validateRetrievalACLSpec(&RetrievalACLSpec{GroupHeaders: []string{"X-Consumer-Group"}}))
+	assert.NoError(validateRetrievalACLSpec(&RetrievalACLSpec{JWTHeader: "Authorization", DefaultPolicy: RetrievalACLAllow}))
+	assert.Error(validateRetrievalACLSpec(&RetrievalACLSpec{}))
+	assert.Error(validateRetrievalACLSpec(&RetrievalACLSpec{GroupHeaders: []string{""}}))
+	assert.Error(validateRetrievalACLSpec(&RetrievalACLSpec{JWTHeader: "Authorization", DefaultPolicy: "maybe"}))
+	assert.Error(validateRetrievalACLSpec(&RetrievalACLSpec{JWTHeader: "Authorization", Field: retrievalSourceField}))
+}
+
+func TestRetrievalACL(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newACLRetrievalMiddleware(t, "")
+	ids, err := retrieveACL(t, m, map[string]string{"X-Consumer-Group": "hr"})
+	assert.NoError(err)
+	assert.Equal([]string{"hr", "shared"}, ids)
+
+	ids, err = retrieveACL(t, m, map[string]string{"Authorization": newTestJWT(`{"sub":"bob","groups":["finance"]}`)})
+	assert.NoError(err)
+	assert.Equal([]string{"finance", "shared"}, ids)
+
+	// the groups of both sources are combined.
+	ids, err = retrieveACL(t, m, map[string]string{
+		"X-Consumer-Group": "hr",
+		"Authorization":    newTestJWT(`{"groups":"finance"}`),
+	})
+	assert.NoError(err)
+	assert.Equal([]string{"hr", "finance", "shared"}, ids)
+
+	// a consumer without groups retrieves nothing by default, and the
+	// documents without ACLs are denied.
+	for _, headers := range []map[string]string{
+		{},
+		{"Authorization": "Bearer malformed"},
+		{"Authorization": newTestJWT(`{"groups":[1,2]}`)},
+		{"X-Consumer-Group": " , "},
+		{"X-Consumer-Group": retrievalPublicACL},
+	} {
+		ids, err = retrieveACL(t, m, headers)
+		assert.NoError(err)
+		assert.Empty(ids, headers)
+	}
+
+	m = newACLRetrievalMiddleware(t, RetrievalACLAllow)
+	ids, err = retrieveACL(t, m, nil)
+	assert.NoError(err)
+	assert.Equal([]string{"public"}, ids)
+	ids, err = retrieveACL(t, m, map[string]string{"X-Consumer-Group": "hr"})
+	assert.NoError(err)
+	assert.Equal([]string{"hr", "public", "shared"}, ids)
+}
+
+func TestRetrievalACLFilters(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newACLRetrievalMiddleware(t, "")
+	ids, err := retrieveACL(t, m, map[string]string{"X-Consumer-Group": "hr", "X-Retrieval-Filter": "source=wiki"})
+	assert.NoError(err)
+	assert.Equal([]string{"shared"}, ids)
+	ids, err = retrieveACL(t, m, map[string]string{"X-Consumer-Group": "hr", "X-Retrieval-Filter": "source!=wiki"})
+	assert.NoError(err)
+	assert.Equal([]string{"hr"}, ids)
+
+	// no filter of the client widens the documents of the consumer, they
+	// are either rejected or narrow the documents.
+	allowed := []string{"hr", "shared"}
+	for _, filter := range []string{
+		"acl=finance",
+		"acl!=hr",
+		" acl =finance",
+		"acl!=nobody;source=handbook",
+		"ACL=finance",
+		"doc_id=finance",
+		"doc_id=finance,hr,legacy,public",
+		"source!=nobody",
+		"source=handbook,wiki;source!=x",
+		"source=x} | @acl:{finance",
+		"source=wiki;acl=finance",
+		"=finance",
+		"source",
+		"source=",
+		";;",
+	} {
+		ids, err := retrieveACL(t, m, map[string]string{"X-Consumer-Group": "hr", "X-Retrieval-Filter": filter})
+		if err != nil {
+			assert.Empty(ids, filter)
+			continue
+		}
+		for _, id := range ids {
+			assert.True(slices.Contains(allowed, id), "filter %q retrieved %s", filter, id)
+		}
+	}
+	_, err = retrieveACL(t, m, map[string]string{"X-Consumer-Group": "hr", "X-Retrieval-Filter": "acl=finance"})
+	assert.Error(err)
+
+	// the handle injects nothing if the filter is invalid.
+	ctx := newRetrievalContext(t, "", false)
+	ctx.Req.HTTPHeader().Set("X-Consumer-Group", "hr")
+	ctx.Req.HTTPHeader().Set("X-Retrieval-Filter", "acl=finance")
+	m.Handle(ctx)
+	assert.Empty(ctx.Citations())
+}
+
+func TestRetrievalACLIngest(t *testing.T) {
+	assert := assert.New(t)
+
+	acl := &RetrievalACLSpec{GroupHeaders: []string{"X-Consumer-Group"}}
+	value, err := acl.documentACL(vectordb.TypeRedis, []string{"hr", "finance"})
+	assert.NoError(err)
+	assert.Equal("hr,finance", value)
+	value, err = acl.documentACL(vectordb.TypePostgres, []string{"hr", "finance"})
+	assert.NoError(err)
+	assert.Equal([]string{"hr", "finance"}, value)
+	value, err = acl.documentACL(vectordb.TypeRedis, nil)
+	assert.NoError(err)
+	assert.Equal(retrievalPublicACL, value)
+	for _, groups := range [][]string{{""}, {"hr,finance"}, {retrievalPublicACL}} {
+		_, err = acl.documentACL(vectordb.TypeRedis, groups)
+		assert.Error(err, groups)
+	}
+
+	m := newRetrievalMiddleware(t, nil)
+	db := &ingestVectorDB{}
+	m.vectorDB = db
+	req := &IngestRequest{Documents: []*IngestDocument{{Content: "salaries", ACL: []string{"hr"}}}}
+	var events []*IngestEvent
+	err = m.IngestDocuments(context.Background(), req, func(e *IngestEvent) { events = append(events, e) })
+	assert.NoError(err)
+	// documents with ACLs are not ingested if the ACL is not enabled, so
+	// they are never visible to all consumers.
+	assert.Equal(IngestStatusFailed, events[0].Status)
+	assert.Empty(db.docs)
+
+	m.spec.Retrieval.ACL = acl
+	req.Documents = append(req.Documents, &IngestDocument{Content: "holidays"})
+	err = m.IngestDocuments(context.Background(), req, func(*IngestEvent) {})
+	assert.NoError(err)
+	assert.Len(db.docs, 2)
+	assert.Equal("hr", db.docs[0][retrievalDefaultACLField])
+	assert.Equal(retrievalPublicACL, db.docs[1][retrievalDefaultACLField])
+}
+
+// keywordEmbeddingHandler embeds the texts by the keywords they contain,
+// so the texts of different keywords are orthogonal.
+type keywordEmbeddingHandler struct{}
+
+func (e *keywordEmbeddingHandler) EmbedDocuments(text string) ([]float32, error) {
+	embedding := make([]float32, 3)
+	for i, keyword := range []string{"salaries", "budgets", "offices"} {
+		if strings.Contains(text, keyword) {
+			embedding[i] = 1
+		}
+	}
+	return embedding, nil
+}
+
+func (e *keywordEmbeddingHandler) EmbedQuery(text string) ([]float32, error) {
+	return e.EmbedDocuments(text)
+}
+
+func TestRetrievalACLThresholdRedis(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	redisC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "redis:latest",
+			ExposedPorts: []string{"6379/tcp"},
+			WaitingFor:   wait.ForLog("Ready to accept connections"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Redis container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, redisC)
+	endpoint, err := redisC.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to get Redis container endpoint: %v", err)
+	}
+
+	m := newACLRetrievalMiddleware(t, "")
+	spec := m.spec.Retrieval
+	spec.VectorDB.Threshold = 0.9
+	spec.VectorDB.Redis.URL = "redis://" + endpoint
+	assert.Nil(ValidateSpec(m.spec))
+	m.vectorDB = vectordb.New(spec.VectorDB)
+	m.embeddingsHandler = &keywordEmbeddingHandler{}
+
+	req := &IngestRequest{Documents: []*IngestDocument{
+		{Content: "salaries of hr", ACL: []string{"hr"}},
+		{Content: "salaries of finance", ACL: []string{"finance"}},
+		{Content: "offices of hr", ACL: []string{"hr"}},
+	}}
+	var events []*IngestEvent
+	assert.NoError(m.IngestDocuments(ctx, req, func(e *IngestEvent) { events = append(events, e) }))
+	assert.Equal(IngestStatusDone, events[len(events)-1].Status)
+	assert.Zero(events[len(events)-1].Failed)
+
+	// the range query of the threshold is narrowed by the ACL of the
+	// consumer, only the similar documents accessible to it are found.
+	search := func(group string) []string {
+		aiCtx := newRetrievalContext(t, "", false)
+		aiCtx.Req.HTTPHeader().Set("X-Consumer-Group", group)
+		docs, err := m.searchTopK(aiCtx, []float32{1, 0, 0}, 10)
+		assert.NoError(err)
+		var contents []string
+		for _, doc := range docs {
+			contents = append(contents, retrievalDocField(doc, retrievalContentField))
+		}
+		return contents
+	}
+	assert.Equal([]string{"salaries of hr"}, search("hr"))
+	assert.Equal([]string{"salaries of finance"}, search("finance"))
+	assert.Empty(search("sales"))
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+// The decisions of retrieval on the remaining budget of a request.
+const (
+	RetrievalBudgetFull    = "full"
+	RetrievalBudgetReduced = "reduced"
+	RetrievalBudgetSkipped = "skipped"
+)
+
+const (
+	defaultRetrievalDeadlinePercentile = 90
+	defaultRetrievalDeadlineSamples    = 100
+	defaultRetrievalDeadlineMinSamples = 10
+)
+
+type (
+	// RetrievalDeadlineSpec makes the retrieval aware of the deadlines of
+	// requests. The cost of the retrieval, that is embedding the prompt
+	// and searching the documents, is estimated by a percentile of its
+	// recent latencies. The retrieval is skipped if the remaining budget
+	// of a request minus the cost is less than MinBudget, so the provider
+	// still has time to answer.
+	RetrievalDeadlineSpec struct {
+		// MinBudget is the least budget left for the provider after the
+		// retrieval.
+		MinBudget string `json:"minBudget" jsonschema:"required,format=duration"`
+		// Percentile of the recent latencies estimating the cost, default
+		// 90.
+		Percentile float64 `json:"percentile,omitempty"`
+		// Samples is the number of the recent latencies kept, default 100.
+		Samples int `json:"samples,omitempty"`
+		// MinSamples is the number of latencies needed to estimate the
+		// cost, the cost is 0 before that, default 10.
+		MinSamples int `json:"minSamples,omitempty"`
+		// ReducedTopK is the number of documents injected if the budget
+		// covers the cost but not MinBudget, a shorter prompt is answered
+		// faster. The retrieval is skipped then if it is 0.
+		ReducedTopK int `json:"reducedTopK,omitempty"`
+	}
+
+	// retrievalDeadline decides the retrieval of requests by their
+	// remaining budgets.
+	retrievalDeadline struct {
+		name      string
+		spec      *RetrievalDeadlineSpec
+		minBudget time.Duration
+
+		lock      sync.Mutex
+		latencies []time.Duration
+		next      int
+
+		decisions *prometheus.CounterVec
+	}
+)
+
+func validateRetrievalDeadlineSpec(spec *RetrievalDeadlineSpec, topK int) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.MinBudget == "" {
+		return fmt.Errorf("minBudget is required")
+	}
+	if d, err := time.ParseDuration(spec.MinBudget); err != nil || d < 0 {
+		return fmt.Errorf("invalid minBudget %s", spec.MinBudget)
+	}
+	if spec.Percentile < 0 || spec.Percentile > 100 {
+		return fmt.Errorf("percentile must be in (0, 100]")
+	}
+	if spec.Samples < 0 || spec.MinSamples < 0 {
+		return fmt.Errorf("samples and minSamples must not be negative")
+	}
+	if spec.Samples > 0 && spec.MinSamples > spec.Samples {
+		return fmt.Errorf("minSamples must not be greater than samples")
+	}
+	if spec.ReducedTopK < 0 || spec.ReducedTopK >= topK {
+		return fmt.Errorf("reducedTopK must be in [0, %d)", topK)
+	}
+	return nil
+}
+
+func newRetrievalDeadline(name string, spec *RetrievalDeadlineSpec) *retrievalDeadline {
+	s := *spec
+	if s.Percentile == 0 {
+		s.Percentile = defaultRetrievalDeadlinePercentile
+	}
+	if s.Samples == 0 {
+		s.Samples = defaultRetrievalDeadlineSamples
+	}
+	if s.MinSamples == 0 {
+		s.MinSamples = min(defaultRetrievalDeadlineMinSamples, s.Samples)
+	}
+	d := &retrievalDeadline{
+		name:      name,
+		spec:      &s,
+		latencies: make([]time.Duration, 0, s.Samples),
+		decisions: metricshub.RetrievalBudgetDecisions.NewCounter(),
+	}
+	d.minBudget, _ = time.ParseDuration(s.MinBudget)
+	return d
+}
+
+// record records the latency of a retrieval, the oldest one is replaced
+// if there are enough latencies.
+func (d *retrievalDeadline) record(latency time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.latencies) < d.spec.Samples {
+		d.latencies = append(d.latencies, latency)
+		return
+	}
+	d.latencies[d.next] = latency
+	d.next = (d.next + 1) % d.spec.Samples
+}
+
+// estimate returns the estimated cost of a retrieval, it is 0 if there
+// are not enough latencies.
+func (d *retrievalDeadline) estimate() time.Duration {
+	d.lock.Lock()
+	latencies := slices.Clone(d.latencies)
+	d.lock.Unlock()
+	if len(latencies) < d.spec.MinSamples {
+		return 0
+	}
+	slices.Sort(latencies)
+	index := int(math.Ceil(d.spec.Percentile/100*float64(len(latencies)))) - 1
+	return latencies[max(index, 0)]
+}
+
+// decide returns the decision of the retrieval of the request, the
+// decision is recorded in the context if the request has a deadline,
+// otherwise the retrieval is always full.
+func (d *retrievalDeadline) decide(ctx *aicontext.Context, now time.Time) string {
+	remaining, ok := ctx.RemainingBudget(now)
+	if !ok {
+		return RetrievalBudgetFull
+	}
+	cost := d.estimate()
+	decision := RetrievalBudgetFull
+	switch {
+	case remaining-cost >= d.minBudget:
+	case d.spec.ReducedTopK > 0 && remaining > cost:
+		decision = RetrievalBudgetReduced
+	default:
+		decision = RetrievalBudgetSkipped
+	}
+	ctx.AddBudgetDecisions(&aicontext.BudgetDecision{
+		Middleware: d.name,
+		Decision:   decision,
+		Remaining:  remaining,
+		Estimated:  cost,
+	})
+	d.decisions.WithLabelValues(d.name, decision).Inc()
+	return decision
+}
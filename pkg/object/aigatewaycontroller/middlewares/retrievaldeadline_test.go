@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+func TestValidateRetrievalDeadlineSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateRetrievalDeadlineSpec(nil, 3))
+	assert.NoError(validateRetrievalDeadlineSpec(&RetrievalDeadlineSpec{MinBudget: "500ms", ReducedTopK: 1}, 3))
+	assert.Error(validateRetrievalDeadlineSpec(&RetrievalDeadlineSpec{}, 3))
+	assert.Error(validateRetrievalDeadlineSpec(&RetrievalDeadlineSpec{MinBudget: "soon"}, 3))
+	assert.Error(validateRetrievalDeadlineSpec(&RetrievalDeadlineSpec{MinBudget: "1s", Percentile: 101}, 3))
+	assert.Error(validateRetrievalDeadlineSpec(&RetrievalDeadlineSpec{MinBudget: "1s", Samples: 5, MinSamples: 10}, 3))
+	assert.Error(validateRetrievalDeadlineSpec(&RetrievalDeadlineSpec{MinBudget: "1s", ReducedTopK: 3}, 3))
+}
+
+func TestRetrievalDeadlineEstimate(t *testing.T) {
+	assert := assert.New(t)
+
+	d := newRetrievalDeadline("test", &RetrievalDeadlineSpec{MinBudget: "1s", Samples: 10, MinSamples: 5, Percentile: 90})
+	for i := 1; i <= 4; i++ {
+		d.record(time.Duration(i) * time.Millisecond)
+	}
+	// not enough latencies.
+	assert.Zero(d.estimate())
+
+	for i := 5; i <= 10; i++ {
+		d.record(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(9*time.Millisecond, d.estimate())
+
+	// the oldest latencies are replaced.
+	for i := 0; i < 10; i++ {
+		d.record(100 * time.Millisecond)
+	}
+	assert.Equal(100*time.Millisecond, d.estimate())
+}
+
+func TestRetrievalDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newRetrievalMiddleware(t, nil)
+	m.spec.Retrieval.Deadline = &RetrievalDeadlineSpec{MinBudget: "500ms", ReducedTopK: 1}
+	assert.Nil(ValidateSpec(m.spec))
+	m.deadline = newRetrievalDeadline(m.spec.Name, m.spec.Retrieval.Deadline)
+	for i := 0; i < 20; i++ {
+		m.deadline.record(100 * time.Millisecond)
+	}
+
+	handle := func(budget time.Duration) *aicontext.Context {
+		aiCtx := newRetrievalContext(t, "", false)
+		if budget != 0 {
+			aiCtx.SetDeadline(time.Now().Add(budget))
+		}
+		m.Handle(aiCtx)
+		return aiCtx
+	}
+
+	// requests without deadlines are always retrieved.
+	aiCtx := handle(0)
+	assert.Len(aiCtx.Citations(), 3)
+	assert.Empty(aiCtx.BudgetDecisions())
+
+	aiCtx = handle(2 * time.Second)
+	assert.Len(aiCtx.Citations(), 3)
+	assert.Len(aiCtx.BudgetDecisions(), 1)
+	decision := aiCtx.BudgetDecisions()[0]
+	assert.Equal(RetrievalBudgetFull, decision.Decision)
+	assert.Equal("test-retrieval", decision.Middleware)
+	assert.Equal(100*time.Millisecond, decision.Estimated)
+
+	// the budget covers the retrieval but not the minimum budget.
+	aiCtx = handle(300 * time.Millisecond)
+	assert.Len(aiCtx.Citations(), 1)
+	assert.Equal(RetrievalBudgetReduced, aiCtx.BudgetDecisions()[0].Decision)
+
+	// the budget does not even cover the retrieval.
+	aiCtx = handle(50 * time.Millisecond)
+	assert.Empty(aiCtx.Citations())
+	assert.Equal(RetrievalBudgetSkipped, aiCtx.BudgetDecisions()[0].Decision)
+	assert.NotContains(string(aiCtx.ReqBody), retrievalDefaultSystemPrompt)
+
+	// the deadline has passed.
+	aiCtx = handle(-time.Second)
+	assert.Empty(aiCtx.Citations())
+
+	// the retrieval is skipped instead of reduced without reducedTopK.
+	m.deadline.spec.ReducedTopK = 0
+	aiCtx = handle(300 * time.Millisecond)
+	assert.Empty(aiCtx.Citations())
+	assert.Equal(RetrievalBudgetSkipped, aiCtx.BudgetDecisions()[0].Decision)
+}
@@ -0,0 +1,545 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/html"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// ChunkerFixed splits documents into chunks of a fixed number of
+	// tokens, the adjacent chunks overlap.
+	ChunkerFixed = "fixed"
+	// ChunkerStructure splits documents by headings and paragraphs, the
+	// paragraphs of a section are merged into chunks within the tokens.
+	ChunkerStructure = "structure"
+
+	// DocumentFormatText, DocumentFormatMarkdown and DocumentFormatHTML
+	// are the formats of the ingested documents, the tags of HTML
+	// documents are stripped.
+	DocumentFormatText     = "text"
+	DocumentFormatMarkdown = "markdown"
+	DocumentFormatHTML     = "html"
+
+	// IngestStatusEmbedding, IngestStatusIngested and IngestStatusFailed
+	// are the statuses of the documents in the ingestion progress, and
+	// IngestStatusDone is the status of the last event of an ingestion.
+	IngestStatusEmbedding = "embedding"
+	IngestStatusIngested  = "ingested"
+	IngestStatusFailed    = "failed"
+	IngestStatusDone      = "done"
+
+	retrievalDefaultChunkTokens   = 256
+	retrievalDefaultOverlapTokens = 32
+	// ingestProgressInterval is the number of the embedded chunks of a
+	// document between two progress events.
+	ingestProgressInterval = 10
+	// ingestEmbedBatchSize is the number of chunks embedded in a request
+	// by the handlers supporting batches.
+	ingestEmbedBatchSize = 256
+	// ingestReplaceAttempts is the attempts to replace the chunks of a
+	// document if the vector database is unavailable or times out.
+	ingestReplaceAttempts = 3
+	ingestReplaceBackoff  = 500 * time.Millisecond
+
+	// fields of the ingested chunks in the retrieval collection.
+	retrievalParentHashField = "parent_hash"
+	retrievalChunkIndexField = "chunk_index"
+)
+
+type (
+	// RetrievalChunkerSpec defines how the ingested documents are split
+	// into chunks.
+	RetrievalChunkerSpec struct {
+		Mode          string `json:"mode,omitempty" jsonschema:"enum=,enum=fixed,enum=structure"`
+		ChunkTokens   int    `json:"chunkTokens,omitempty"`
+		OverlapTokens int    `json:"overlapTokens,omitempty"`
+	}
+
+	// IngestRequest is the request to ingest documents into the
+	// collection of a retrieval middleware.
+	IngestRequest struct {
+		Documents []*IngestDocument `json:"documents"`
+		// Chunker overrides the chunker of the middleware.
+		Chunker *RetrievalChunkerSpec `json:"chunker,omitempty"`
+	}
+
+	// IngestDocument is a raw document to ingest.
+	IngestDocument struct {
+		Content string `json:"content"`
+		Format  string `json:"format,omitempty"`
+		URL     string `json:"url,omitempty"`
+		Title   string `json:"title,omitempty"`
+		// ACL is the groups of consumers having access to the document,
+		// the document is governed by the default policy of the ACL spec
+		// if it is empty.
+		ACL []string `json:"acl,omitempty"`
+	}
+
+	// IngestEvent is an event of the ingestion progress.
+	IngestEvent struct {
+		Status string `json:"status"`
+		// Document is the index of the document in the request.
+		Document   int    `json:"document"`
+		URL        string `json:"url,omitempty"`
+		ParentHash string `json:"parentHash,omitempty"`
+		Chunks     int    `json:"chunks"`
+		Embedded   int    `json:"embedded,omitempty"`
+		Error      string `json:"error,omitempty"`
+
+		// the fields below are set in the event of IngestStatusDone.
+		Documents int `json:"documents,omitempty"`
+		Failed    int `json:"failed,omitempty"`
+	}
+
+	// chunkUnit is a word or a CJK character with its trailing spaces.
+	chunkUnit struct {
+		text   string
+		tokens int
+	}
+)
+
+var _ DocumentIngester = (*retrievalMiddleware)(nil)
+
+func validateRetrievalChunkerSpec(spec *RetrievalChunkerSpec) error {
+	if spec == nil {
+		return nil
+	}
+	switch spec.Mode {
+	case "", ChunkerFixed, ChunkerStructure:
+	default:
+		return fmt.Errorf("invalid chunker mode %s", spec.Mode)
+	}
+	if spec.ChunkTokens < 0 || spec.OverlapTokens < 0 {
+		return fmt.Errorf("chunkTokens and overlapTokens must not be negative")
+	}
+	if spec.OverlapTokens >= spec.getChunkTokens() {
+		return fmt.Errorf("overlapTokens must be less than chunkTokens")
+	}
+	return nil
+}
+
+func (spec *RetrievalChunkerSpec) getChunkTokens() int {
+	if spec.ChunkTokens > 0 {
+		return spec.ChunkTokens
+	}
+	return retrievalDefaultChunkTokens
+}
+
+func (spec *RetrievalChunkerSpec) getOverlapTokens() int {
+	if spec.OverlapTokens > 0 {
+		return spec.OverlapTokens
+	}
+	return min(retrievalDefaultOverlapTokens, spec.getChunkTokens()/4)
+}
+
+// chunk splits the text into chunks.
+func (spec *RetrievalChunkerSpec) chunk(text string) []string {
+	if spec.Mode == ChunkerFixed {
+		return chunkFixed(text, spec.getChunkTokens(), spec.getOverlapTokens())
+	}
+	return chunkStructure(text, spec.getChunkTokens())
+}
+
+// splitChunkUnits splits the text into units, concatenating them gets the
+// text.
+func splitChunkUnits(text string) []*chunkUnit {
+	var units []*chunkUnit
+	start, inSpace := 0, false
+	cut := func(i int) {
+		if i > start {
+			units = append(units, &chunkUnit{text: text[start:i], tokens: estimateTokens(text[start:i])})
+		}
+		start, inSpace = i, false
+	}
+	for i, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			inSpace = true
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			cut(i)
+			// the character is a unit with its trailing spaces.
+			inSpace = true
+		case inSpace:
+			cut(i)
+		}
+	}
+	cut(len(text))
+	return units
+}
+
+// chunkFixed splits the text into chunks of chunkTokens, every chunk
+// begins with the last overlapTokens of the previous one.
+func chunkFixed(text string, chunkTokens, overlapTokens int) []string {
+	units := splitChunkUnits(text)
+	var chunks []string
+	for start := 0; start < len(units); {
+		end, tokens := start, 0
+		for end < len(units) && (end == start || tokens+units[end].tokens <= chunkTokens) {
+			tokens += units[end].tokens
+			end++
+		}
+		var sb strings.Builder
+		for _, u := range units[start:end] {
+			sb.WriteString(u.text)
+		}
+		if chunk := strings.TrimSpace(sb.String()); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		if end == len(units) {
+			break
+		}
+
+		// the next chunk starts overlapTokens before the end, and moves
+		// forward at least one unit.
+		next, overlap := end, 0
+		for next > start+1 && overlap+units[next-1].tokens <= overlapTokens {
+			next--
+			overlap += units[next].tokens
+		}
+		start = next
+	}
+	return chunks
+}
+
+// chunkStructure splits the text by markdown headings into sections, and
+// merges the paragraphs of every section into chunks within chunkTokens.
+// Every chunk begins with the heading of its section, and a paragraph
+// longer than chunkTokens is split by chunkFixed.
+func chunkStructure(text string, chunkTokens int) []string {
+	var (
+		chunks     []string
+		heading    string
+		paragraphs []string
+	)
+	flushSection := func() {
+		headingTokens := estimateTokens(heading)
+		budget := max(chunkTokens-headingTokens, chunkTokens/2)
+		var current []string
+		tokens := 0
+		emit := func() {
+			if len(current) == 0 {
+				return
+			}
+			body := strings.Join(current, "\n\n")
+			if heading != "" {
+				body = heading + "\n\n" + body
+			}
+			chunks = append(chunks, body)
+			current, tokens = nil, 0
+		}
+		for _, p := range paragraphs {
+			n := estimateTokens(p)
+			if n > budget {
+				emit()
+				for _, piece := range chunkFixed(p, budget, 0) {
+					current = []string{piece}
+					emit()
+				}
+				continue
+			}
+			if tokens+n > budget {
+				emit()
+			}
+			current = append(current, p)
+			tokens += n
+		}
+		emit()
+		paragraphs = nil
+	}
+
+	var paragraph []string
+	flushParagraph := func() {
+		if p := strings.TrimSpace(strings.Join(paragraph, "\n")); p != "" {
+			paragraphs = append(paragraphs, p)
+		}
+		paragraph = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case isMarkdownHeading(trimmed):
+			flushParagraph()
+			flushSection()
+			heading = trimmed
+		case trimmed == "":
+			flushParagraph()
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+	flushParagraph()
+	flushSection()
+	return chunks
+}
+
+// isMarkdownHeading returns whether the line is an ATX heading like
+// "## Title".
+func isMarkdownHeading(line string) bool {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	return level >= 1 && level <= 6 && level < len(line) && line[level] == ' '
+}
+
+// htmlToText strips the tags of the HTML document, the headings are
+// converted to markdown headings, so the structure chunker splits by
+// them. It returns the text and the title of the document.
+func htmlToText(doc string) (string, string) {
+	var (
+		sb      strings.Builder
+		title   strings.Builder
+		skip    int
+		inTitle bool
+	)
+	z := html.NewTokenizer(strings.NewReader(doc))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return strings.TrimSpace(collapseBlankLines(sb.String())), strings.TrimSpace(title.String())
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			switch tag {
+			case "script", "style", "noscript", "template":
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				sb.WriteString("\n\n")
+				if tt == html.StartTagToken {
+					sb.WriteString(strings.Repeat("#", int(tag[1]-'0')) + " ")
+				}
+			case "p", "div", "section", "article", "ul", "ol", "table", "blockquote", "pre":
+				sb.WriteString("\n\n")
+			case "br", "li", "tr":
+				if tt != html.EndTagToken {
+					sb.WriteString("\n")
+				}
+			}
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := html.UnescapeString(string(z.Text()))
+			if inTitle {
+				title.WriteString(text)
+				continue
+			}
+			// spaces inside a line are collapsed like browsers.
+			sb.WriteString(strings.Join(strings.Fields(text), " "))
+			if strings.TrimRightFunc(text, unicode.IsSpace) != text {
+				sb.WriteString(" ")
+			}
+		}
+	}
+}
+
+// collapseBlankLines trims the lines and keeps at most one blank line
+// between them.
+func collapseBlankLines(text string) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// documentHash returns the hash of the content of a document, the chunks
+// of a document are replaced when a document of the same hash is
+// ingested.
+func documentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// IngestDocuments chunks the documents, embeds the chunks and replaces
+// the previous chunks of the documents in the collection. A document
+// failing is reported in its event, and the others go on.
+func (m *retrievalMiddleware) IngestDocuments(ctx context.Context, req *IngestRequest, progress func(*IngestEvent)) error {
+	chunker := req.Chunker
+	if chunker == nil {
+		chunker = m.spec.Retrieval.Chunker
+	}
+	if chunker == nil {
+		chunker = &RetrievalChunkerSpec{}
+	}
+	if err := validateRetrievalChunkerSpec(chunker); err != nil {
+		return fmt.Errorf("invalid chunker: %w", err)
+	}
+	for i, doc := range req.Documents {
+		switch doc.Format {
+		case "", DocumentFormatText, DocumentFormatMarkdown, DocumentFormatHTML:
+		default:
+			return fmt.Errorf("document %d has invalid format %s", i, doc.Format)
+		}
+	}
+
+	done := &IngestEvent{Status: IngestStatusDone, Document: -1, Documents: len(req.Documents)}
+	for i, doc := range req.Documents {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		event := &IngestEvent{Document: i, URL: doc.URL, ParentHash: documentHash(doc.Content)}
+		err := m.ingestDocument(ctx, doc, chunker, event, progress)
+		if err != nil {
+			event.Status, event.Error = IngestStatusFailed, err.Error()
+			done.Failed++
+		} else {
+			event.Status = IngestStatusIngested
+			done.Chunks += event.Chunks
+		}
+		progress(event)
+	}
+	progress(done)
+	return nil
+}
+
+func (m *retrievalMiddleware) ingestDocument(ctx context.Context, doc *IngestDocument, chunker *RetrievalChunkerSpec, event *IngestEvent, progress func(*IngestEvent)) error {
+	text, title := doc.Content, doc.Title
+	if doc.Format == DocumentFormatHTML {
+		var htmlTitle string
+		text, htmlTitle = htmlToText(doc.Content)
+		if title == "" {
+			title = htmlTitle
+		}
+	}
+	var acl any
+	if spec := m.spec.Retrieval.ACL; spec != nil {
+		var err error
+		if acl, err = spec.documentACL(m.spec.Retrieval.VectorDB.Type, doc.ACL); err != nil {
+			return err
+		}
+	} else if len(doc.ACL) > 0 {
+		return fmt.Errorf("document has ACL, but ACL is not enabled")
+	}
+	chunks := chunker.chunk(text)
+	if len(chunks) == 0 {
+		return fmt.Errorf("document has no content")
+	}
+	event.Chunks = len(chunks)
+
+	docs := make([]map[string]any, len(chunks))
+	embedded := 0
+	// addChunk writes the embedding into the document of the chunk, the
+	// embeddings of a batch are passed as they are decoded.
+	addChunk := func(i int, embedding []float32) error {
+		if docs[i] != nil {
+			return fmt.Errorf("chunk %d is embedded twice", i)
+		}
+		chunkID := fmt.Sprintf("%s:%d", event.ParentHash, i)
+		docs[i] = map[string]any{
+			// the IDs are UUIDs derived from the chunks, which are valid
+			// primary keys of PostgreSQL.
+			"id":                     uuid.NewSHA1(uuid.NameSpaceOID, []byte(chunkID)).String(),
+			retrievalEmbeddingField:  embedding,
+			retrievalContentField:    chunks[i],
+			retrievalIDField:         chunkID,
+			retrievalSourceField:     doc.URL,
+			retrievalTitleField:      title,
+			retrievalParentHashField: event.ParentHash,
+			retrievalChunkIndexField: i,
+		}
+		if version := m.spec.Retrieval.VectorDB.EmbeddingVersion; version != "" {
+			docs[i][vectordb.EmbeddingVersionField] = version
+		}
+		if acl != nil {
+			docs[i][m.spec.Retrieval.ACL.getField()] = acl
+		}
+		embedded++
+		if embedded%ingestProgressInterval == 0 && embedded < len(chunks) {
+			progress(&IngestEvent{
+				Status: IngestStatusEmbedding, Document: event.Document, URL: event.URL,
+				ParentHash: event.ParentHash, Chunks: len(chunks), Embedded: embedded,
+			})
+		}
+		return nil
+	}
+
+	if batcher, ok := m.embeddingsHandler.(embeddings.BatchEmbeddingHandler); ok {
+		for start := 0; start < len(chunks); start += ingestEmbedBatchSize {
+			end := min(start+ingestEmbedBatchSize, len(chunks))
+			err := batcher.EmbedBatch(chunks[start:end], func(i int, embedding []float32) error {
+				return addChunk(start+i, embedding)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to embed chunks %d-%d: %w", start, end-1, err)
+			}
+		}
+	} else {
+		for i, chunk := range chunks {
+			embedding, err := m.embeddingsHandler.EmbedDocuments(chunk)
+			if err != nil {
+				return fmt.Errorf("failed to embed chunk %d: %w", i, err)
+			}
+			addChunk(i, embedding)
+		}
+	}
+
+	handler, err := m.getHandler(len(docs[0][retrievalEmbeddingField].([]float32)))
+	if err != nil {
+		return err
+	}
+	replacer, ok := handler.(vecdbtypes.DocumentReplacer)
+	if !ok {
+		return vectordb.ErrReplaceNotSupported
+	}
+	// the replacement is atomic, so it is safe to run it again.
+	for attempt := 1; ; attempt++ {
+		_, err = replacer.ReplaceDocuments(ctx, retrievalParentHashField, event.ParentHash, docs)
+		transient := errors.Is(err, vecdbtypes.ErrUnavailable) || errors.Is(err, vecdbtypes.ErrTimeout)
+		if !transient || attempt == ingestReplaceAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * ingestReplaceBackoff):
+		}
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/stretchr/testify/assert"
+)
+
+// ingestVectorDB replaces the documents of a group.
+type ingestVectorDB struct {
+	retrievalVectorDB
+}
+
+func (db *ingestVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	return db, nil
+}
+
+func (db *ingestVectorDB) ReplaceDocuments(ctx context.Context, field, group string, docs []map[string]any) ([]string, error) {
+	kept := []map[string]any{}
+	for _, doc := range db.docs {
+		if doc[field] != group {
+			kept = append(kept, doc)
+		}
+	}
+	db.docs = append(kept, docs...)
+	return nil, nil
+}
+
+func TestValidateRetrievalChunkerSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateRetrievalChunkerSpec(nil))
+	assert.NoError(validateRetrievalChunkerSpec(&RetrievalChunkerSpec{Mode: ChunkerFixed, ChunkTokens: 100, OverlapTokens: 10}))
+	assert.Error(validateRetrievalChunkerSpec(&RetrievalChunkerSpec{Mode: "sentence"}))
+	assert.Error(validateRetrievalChunkerSpec(&RetrievalChunkerSpec{ChunkTokens: -1}))
+	assert.Error(validateRetrievalChunkerSpec(&RetrievalChunkerSpec{ChunkTokens: 10, OverlapTokens: 10}))
+}
+
+func TestChunkFixed(t *testing.T) {
+	assert := assert.New(t)
+
+	text := "a b c d e f g h i j"
+	chunks := chunkFixed(text, 4, 1)
+	assert.Equal([]string{"a b c d", "d e f g", "g h i j"}, chunks)
+	chunks = chunkFixed(text, 4, 0)
+	assert.Equal([]string{"a b c d", "e f g h", "i j"}, chunks)
+
+	assert.Equal([]string{text}, chunkFixed(text, 100, 10))
+	assert.Empty(chunkFixed("  \n ", 10, 2))
+
+	// CJK characters are a token each.
+	assert.Equal([]string{"你好世", "世界"}, chunkFixed("你好世界", 3, 1))
+}
+
+func TestChunkStructure(t *testing.T) {
+	assert := assert.New(t)
+
+	text := `# Install
+
+Download the binary.
+
+Run it.
+
+## Configure
+` + strings.Repeat("word ", 30)
+
+	chunks := chunkStructure(text, 12)
+	assert.Equal("# Install\n\nDownload the binary.\n\nRun it.", chunks[0])
+	assert.Greater(len(chunks), 2)
+	for _, chunk := range chunks[1:] {
+		assert.True(strings.HasPrefix(chunk, "## Configure\n\nword"), chunk)
+		assert.LessOrEqual(estimateTokens(chunk), 12)
+	}
+
+	// the paragraphs are merged within the tokens.
+	chunks = chunkStructure("a b\n\nc d\n\ne f", 4)
+	assert.Equal([]string{"a b\n\nc d", "e f"}, chunks)
+}
+
+func TestHTMLToText(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `<html><head><title>Guide &amp; FAQ</title><style>p { color: red; }</style></head>
+<body><h1>Install</h1><p>Download   the <b>binary</b>.</p><script>alert(1)</script>
+<h2>Usage</h2><ul><li>run</li><li>stop</li></ul></body></html>`
+	text, title := htmlToText(doc)
+	assert.Equal("Guide & FAQ", title)
+	assert.Equal("# Install\n\nDownload the binary.\n\n## Usage\n\nrun\nstop", text)
+}
+
+func TestRetrievalIngestDocuments(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newRetrievalMiddleware(t, nil)
+	db := &ingestVectorDB{}
+	m.vectorDB = db
+
+	req := &IngestRequest{
+		Documents: []*IngestDocument{
+			{Content: "<title>Guide</title><h1>Install</h1><p>Download it.</p><h1>Run</h1><p>Run it.</p>", Format: DocumentFormatHTML, URL: "https://docs.example.com/guide"},
+			{Content: "   "},
+			{Content: "# Notes\n\nSome notes.", Format: DocumentFormatMarkdown, URL: "notes.md", Title: "Notes"},
+		},
+	}
+	var events []*IngestEvent
+	err := m.IngestDocuments(context.Background(), req, func(e *IngestEvent) { events = append(events, e) })
+	assert.NoError(err)
+	assert.Len(events, 4)
+	assert.Equal(IngestStatusIngested, events[0].Status)
+	assert.Equal(2, events[0].Chunks)
+	assert.Equal(IngestStatusFailed, events[1].Status)
+	assert.Equal(IngestStatusIngested, events[2].Status)
+	assert.Equal(&IngestEvent{Status: IngestStatusDone, Document: -1, Chunks: 3, Documents: 3, Failed: 1}, events[3])
+
+	assert.Len(db.docs, 3)
+	assert.Equal("Guide", db.docs[0][retrievalTitleField])
+	assert.Equal("# Install\n\nDownload it.", db.docs[0][retrievalContentField])
+	assert.Equal(1, db.docs[1][retrievalChunkIndexField])
+	assert.Equal(events[0].ParentHash, db.docs[1][retrievalParentHashField])
+	assert.Equal(events[0].ParentHash+":1", db.docs[1][retrievalIDField])
+
+	// ingesting the same document again replaces its chunks.
+	err = m.IngestDocuments(context.Background(), &IngestRequest{Documents: req.Documents[:1]}, func(*IngestEvent) {})
+	assert.NoError(err)
+	assert.Len(db.docs, 3)
+
+	// invalid formats fail the request before ingesting.
+	err = m.IngestDocuments(context.Background(), &IngestRequest{Documents: []*IngestDocument{{Content: "a", Format: "pdf"}}}, func(*IngestEvent) {})
+	assert.Error(err)
+}
+
+// batchEmbeddingHandler embeds batches in reverse order, like responses
+// whose embeddings are not ordered by index.
+type batchEmbeddingHandler struct {
+	mockEmbeddingHandler
+	batches int
+}
+
+func (h *batchEmbeddingHandler) EmbedBatch(texts []string, fn func(index int, embedding []float32) error) error {
+	h.batches++
+	for i := len(texts) - 1; i >= 0; i-- {
+		if err := fn(i, embeddingString(texts[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRetrievalIngestBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newRetrievalMiddleware(t, nil)
+	db := &ingestVectorDB{}
+	m.vectorDB = db
+	handler := &batchEmbeddingHandler{}
+	m.embeddingsHandler = handler
+
+	// a chunk of a word each, they are embedded in two batches.
+	words := make([]string, ingestEmbedBatchSize+2)
+	for i := range words {
+		words[i] = "w" + strconv.Itoa(i)
+	}
+	req := &IngestRequest{
+		Documents: []*IngestDocument{{Content: strings.Join(words, " ")}},
+		Chunker:   &RetrievalChunkerSpec{Mode: ChunkerFixed, ChunkTokens: 1},
+	}
+	var events []*IngestEvent
+	err := m.IngestDocuments(context.Background(), req, func(e *IngestEvent) { events = append(events, e) })
+	assert.NoError(err)
+	assert.Equal(2, handler.batches)
+	assert.Equal(IngestStatusIngested, events[len(events)-2].Status)
+	assert.Equal(len(words), events[len(events)-2].Chunks)
+
+	assert.Len(db.docs, len(words))
+	for i, doc := range db.docs {
+		assert.Equal(i, doc[retrievalChunkIndexField])
+		assert.Equal(embeddingString(doc[retrievalContentField].(string)), doc[retrievalEmbeddingField])
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// The decisions of packing a chunk.
+const (
+	PackingSelected  = "selected"
+	PackingTruncated = "truncated"
+	PackingSkipped   = "skipped"
+)
+
+// The reasons of skipping a chunk.
+const (
+	packingReasonThreshold   = "belowThreshold"
+	packingReasonSourceLimit = "sourceLimit"
+	packingReasonBudget      = "budget"
+)
+
+type (
+	// RetrievalPackingSpec defines how the retrieved chunks are packed into
+	// a token budget. The chunks are selected greedily by score per token
+	// until the budget is filled.
+	RetrievalPackingSpec struct {
+		// MaxTokens is the budget of the content of the injected chunks.
+		MaxTokens int `json:"maxTokens" jsonschema:"required"`
+		// MaxChunksPerSource is the max number of chunks of a source
+		// document, 0 means no limit.
+		MaxChunksPerSource int `json:"maxChunksPerSource,omitempty"`
+		// SplitSentences truncates a chunk beyond the remaining budget at a
+		// sentence boundary, instead of skipping it.
+		SplitSentences bool `json:"splitSentences,omitempty"`
+	}
+
+	// packingCandidate is a retrieved chunk to pack.
+	packingCandidate struct {
+		doc     map[string]any
+		content string
+		chunk   *aicontext.PackedChunk
+	}
+)
+
+func validateRetrievalPackingSpec(spec *RetrievalPackingSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.MaxTokens <= 0 {
+		return fmt.Errorf("maxTokens must be positive")
+	}
+	if spec.MaxChunksPerSource < 0 {
+		return fmt.Errorf("maxChunksPerSource must not be negative")
+	}
+	return nil
+}
+
+// pack selects the chunks to inject within the budget. It returns the
+// selected chunks in the order of the search, the content of truncated
+// chunks is replaced, and the decisions of all chunks.
+func (spec *RetrievalPackingSpec) pack(docs []map[string]any) ([]map[string]any, []*aicontext.PackedChunk) {
+	candidates := make([]*packingCandidate, 0, len(docs))
+	chunks := make([]*aicontext.PackedChunk, 0, len(docs))
+	for _, doc := range docs {
+		c := &packingCandidate{
+			doc:     doc,
+			content: retrievalDocField(doc, retrievalContentField),
+			chunk: &aicontext.PackedChunk{
+				ID:     retrievalDocField(doc, retrievalIDField),
+				Source: retrievalDocField(doc, retrievalSourceField),
+			},
+		}
+		c.chunk.Score, _ = doc[vecdbtypes.ExplainScoreField].(float64)
+		c.chunk.Tokens = estimateTokens(c.content)
+		chunks = append(chunks, c.chunk)
+		if passed, ok := doc[vecdbtypes.ExplainPassedField].(bool); ok && !passed {
+			c.chunk.Decision, c.chunk.Reason = PackingSkipped, packingReasonThreshold
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+
+	order := make([]*packingCandidate, len(candidates))
+	copy(order, candidates)
+	sort.SliceStable(order, func(i, j int) bool {
+		return order[i].density() > order[j].density()
+	})
+
+	remaining := spec.MaxTokens
+	sources := map[string]int{}
+	for _, c := range order {
+		source := c.chunk.Source
+		if source == "" {
+			source = c.chunk.ID
+		}
+		if spec.MaxChunksPerSource > 0 && source != "" && sources[source] >= spec.MaxChunksPerSource {
+			c.chunk.Decision, c.chunk.Reason = PackingSkipped, packingReasonSourceLimit
+			continue
+		}
+		switch {
+		case c.chunk.Tokens <= remaining:
+			c.chunk.Decision, c.chunk.PackedTokens = PackingSelected, c.chunk.Tokens
+		case spec.SplitSentences:
+			c.content, c.chunk.PackedTokens = truncateSentences(c.content, remaining)
+			if c.chunk.PackedTokens == 0 {
+				c.chunk.Decision, c.chunk.Reason = PackingSkipped, packingReasonBudget
+				continue
+			}
+			c.chunk.Decision = PackingTruncated
+		default:
+			c.chunk.Decision, c.chunk.Reason = PackingSkipped, packingReasonBudget
+			continue
+		}
+		remaining -= c.chunk.PackedTokens
+		sources[source]++
+	}
+
+	selected := make([]map[string]any, 0, len(candidates))
+	for _, c := range candidates {
+		switch c.chunk.Decision {
+		case PackingSelected:
+			selected = append(selected, c.doc)
+		case PackingTruncated:
+			doc := make(map[string]any, len(c.doc))
+			for k, v := range c.doc {
+				doc[k] = v
+			}
+			doc[retrievalContentField] = c.content
+			selected = append(selected, doc)
+		}
+	}
+	return selected, chunks
+}
+
+// density is the score per token of the candidate.
+func (c *packingCandidate) density() float64 {
+	return c.chunk.Score / float64(max(c.chunk.Tokens, 1))
+}
+
+// estimateTokens estimates the tokens of the text, a token is about four
+// characters of a word, and a CJK character is a token.
+func estimateTokens(text string) int {
+	tokens, word := 0, 0
+	flush := func() {
+		tokens += (word + 3) / 4
+		word = 0
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			tokens++
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			flush()
+			tokens++
+		default:
+			word++
+		}
+	}
+	flush()
+	return tokens
+}
+
+// splitSentences splits the text after the sentence terminators and the
+// blank lines, the whitespaces after a sentence are kept with it.
+func splitSentences(text string) []string {
+	var sentences []string
+	start, ended := 0, false
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if r == '\n' && i > start && text[i-1] == '\n' {
+				ended = true
+			}
+			continue
+		}
+		if ended {
+			sentences = append(sentences, text[start:i])
+			start, ended = i, false
+		}
+		switch r {
+		case '。', '！', '？':
+			ended = true
+		case '.', '!', '?':
+			// a terminator in a word like 3.14 does not end a sentence.
+			next, _ := utf8.DecodeRuneInString(text[i+1:])
+			ended = unicode.IsSpace(next)
+		}
+	}
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+	return sentences
+}
+
+// truncateSentences returns the leading sentences of the text within the
+// tokens, and their tokens.
+func truncateSentences(text string, maxTokens int) (string, int) {
+	var sb strings.Builder
+	tokens := 0
+	for _, sentence := range splitSentences(text) {
+		n := estimateTokens(sentence)
+		if tokens+n > maxTokens {
+			break
+		}
+		sb.WriteString(sentence)
+		tokens += n
+	}
+	return strings.TrimSpace(sb.String()), tokens
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, estimateTokens(""))
+	assert.Equal(1, estimateTokens("the"))
+	assert.Equal(5, estimateTokens("Easegress proxies"))
+	assert.Equal(6, estimateTokens("hello, world."))
+	assert.Equal(4, estimateTokens("你好世界"))
+}
+
+func TestSplitSentences(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"First one. ", "Pi is 3.14! ", "Really?"}, splitSentences("First one. Pi is 3.14! Really?"))
+	assert.Equal([]string{"Title\n\n", "Body"}, splitSentences("Title\n\nBody"))
+	assert.Equal([]string{"你好。", "世界"}, splitSentences("你好。世界"))
+	assert.Nil(splitSentences(""))
+
+	text, tokens := truncateSentences("One two. Three four five six. Seven.", 5)
+	assert.Equal("One two.", text)
+	assert.Equal(3, tokens)
+	text, tokens = truncateSentences("Lengthy first sentence here.", 2)
+	assert.Equal("", text)
+	assert.Equal(0, tokens)
+}
+
+func TestRetrievalPacking(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateRetrievalPackingSpec(nil))
+	assert.NoError(validateRetrievalPackingSpec(&RetrievalPackingSpec{MaxTokens: 100}))
+	assert.Error(validateRetrievalPackingSpec(&RetrievalPackingSpec{}))
+	assert.Error(validateRetrievalPackingSpec(&RetrievalPackingSpec{MaxTokens: 100, MaxChunksPerSource: -1}))
+
+	long := strings.Repeat("word ", 20) + "end. " + strings.Repeat("more ", 20)
+	docs := []map[string]any{
+		{"doc_id": "long", "source": "a", "content": long, "_score": 0.95, "_passed": true},
+		{"doc_id": "a2", "source": "a", "content": "short answer of a", "_score": 0.9, "_passed": true},
+		{"doc_id": "a3", "source": "a", "content": "another of a", "_score": 0.85, "_passed": true},
+		{"doc_id": "b", "source": "b", "content": "answer of b here", "_score": 0.8, "_passed": true},
+		{"doc_id": "low", "source": "c", "content": "low", "_score": 0.3, "_passed": false},
+	}
+
+	spec := &RetrievalPackingSpec{MaxTokens: 15, MaxChunksPerSource: 2}
+	selected, chunks := spec.pack(docs)
+	decisions := map[string]*aicontext.PackedChunk{}
+	for _, chunk := range chunks {
+		decisions[chunk.ID] = chunk
+	}
+	assert.Len(chunks, 5)
+	// a3 and b are the densest chunks, a2 fills the budget, and long is
+	// beyond the limit of source a.
+	assert.Equal(PackingSelected, decisions["a3"].Decision)
+	assert.Equal(PackingSelected, decisions["a2"].Decision)
+	assert.Equal(PackingSelected, decisions["b"].Decision)
+	assert.Equal(PackingSkipped, decisions["long"].Decision)
+	assert.Equal(packingReasonSourceLimit, decisions["long"].Reason)
+	assert.Equal(PackingSkipped, decisions["low"].Decision)
+	assert.Equal(packingReasonThreshold, decisions["low"].Reason)
+	assert.Len(selected, 3)
+	// the selected chunks are in the order of the search.
+	assert.Equal("a2", selected[0]["doc_id"])
+	assert.Equal("b", selected[2]["doc_id"])
+
+	spec = &RetrievalPackingSpec{MaxTokens: 40}
+	_, chunks = spec.pack(docs)
+	assert.Equal(PackingSkipped, chunks[0].Decision)
+	assert.Equal(packingReasonBudget, chunks[0].Reason)
+
+	spec.SplitSentences = true
+	selected, chunks = spec.pack(docs)
+	assert.Equal(PackingTruncated, chunks[0].Decision)
+	assert.Equal(22, chunks[0].PackedTokens)
+	assert.Equal(strings.Repeat("word ", 20)+"end.", selected[0]["content"])
+	// the document of the search is not changed.
+	assert.Equal(long, docs[0]["content"])
+	total := 0
+	for _, chunk := range chunks {
+		total += chunk.PackedTokens
+	}
+	assert.LessOrEqual(total, spec.MaxTokens)
+}
+
+func TestRetrievalPackingHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newRetrievalMiddleware(t, &CitationSpec{})
+	m.spec.Retrieval.Packing = &RetrievalPackingSpec{MaxTokens: 8, MaxChunksPerSource: 1}
+	assert.NoError(ValidateSpec(m.spec))
+	for i, doc := range m.vectorDB.(*retrievalVectorDB).docs {
+		doc["_score"] = 0.9 - float64(i)*0.1
+		doc["_passed"] = true
+	}
+
+	aiCtx := newRetrievalContext(t, "", false)
+	m.Handle(aiCtx)
+	req := map[string]any{}
+	assert.Nil(json.Unmarshal(aiCtx.ReqBody, &req))
+	content := req["messages"].([]any)[0].(map[string]any)["content"].(string)
+	assert.Contains(content, "content of a")
+	assert.NotContains(content, "another chunk of a")
+	assert.Contains(content, "content of b")
+
+	chunks := aiCtx.PackedChunks()
+	assert.Len(chunks, 3)
+	assert.Equal(PackingSkipped, chunks[1].Decision)
+	assert.Equal(packingReasonSourceLimit, chunks[1].Reason)
+	// only the injected chunks are cited.
+	assert.Len(aiCtx.Citations(), 2)
+
+	result, err := m.Probe(newRetrievalContext(t, "", false), nil)
+	assert.NoError(err)
+	probe := result.(*RetrievalProbeResult)
+	assert.Equal("what is a?", probe.Content)
+	assert.Equal(8, probe.MaxTokens)
+	assert.Equal(8, probe.PackedTokens)
+	assert.Len(probe.Chunks, 3)
+
+	m.spec.Retrieval.Packing = nil
+	result, err = m.Probe(newRetrievalContext(t, "", false), nil)
+	assert.NoError(err)
+	probe = result.(*RetrievalProbeResult)
+	assert.Len(probe.Chunks, 3)
+	assert.Equal(PackingSelected, probe.Chunks[2].Decision)
+}
@@ -0,0 +1,553 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// ReembedStatusRunning, ReembedStatusPaused, ReembedStatusCompleted,
+	// ReembedStatusAborted and ReembedStatusFailed are the statuses of
+	// re-embedding jobs, a job is paused when the daily spend cap is
+	// reached.
+	ReembedStatusRunning   = "running"
+	ReembedStatusPaused    = "paused"
+	ReembedStatusCompleted = "completed"
+	ReembedStatusAborted   = "aborted"
+	ReembedStatusFailed    = "failed"
+
+	reembedDefaultRequestsPerSecond = 10
+	reembedDefaultBatchSize         = 100
+	reembedDefaultSampleSize        = 1000
+)
+
+var (
+	// ErrReembedRunning means a re-embedding job of the middleware is
+	// running.
+	ErrReembedRunning = errors.New("re-embedding is running")
+	// ErrReembedNotRunning means no re-embedding job of the middleware is
+	// running.
+	ErrReembedNotRunning = errors.New("re-embedding is not running")
+)
+
+type (
+	// ReembedRequest is the request to re-embed the documents of a
+	// middleware, the limits apply to the embedding requests.
+	ReembedRequest struct {
+		// RequestsPerSecond caps the embedding requests, 10 by default.
+		RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+		// TokensPerMinute caps the estimated tokens embedded, there is no
+		// cap if it is 0.
+		TokensPerMinute int64 `json:"tokensPerMinute,omitempty"`
+		// DailySpendCap caps the estimated spend of a UTC day in USD, the
+		// job is paused until the next day once it is reached. There is
+		// no cap if it is 0.
+		DailySpendCap float64 `json:"dailySpendCap,omitempty"`
+		// PricePerMillion is the price of the embedding model in USD per
+		// million tokens, it is looked up in the pricing of the usage
+		// store if it is 0.
+		PricePerMillion float64 `json:"pricePerMillion,omitempty"`
+		// BatchSize is the number of documents scanned and written at a
+		// time, 100 by default.
+		BatchSize int `json:"batchSize,omitempty"`
+		// SampleSize is the number of documents sampled to estimate the
+		// tokens, 1000 by default.
+		SampleSize int `json:"sampleSize,omitempty"`
+	}
+
+	// ReembedPlan is the estimation of re-embedding the documents of a
+	// collection. The tokens are estimated from the documents sampled
+	// at the beginning of the scan.
+	ReembedPlan struct {
+		Collection       string `json:"collection"`
+		Model            string `json:"model"`
+		EmbeddingVersion string `json:"embeddingVersion"`
+		// Documents is the number of documents in the collection, and
+		// Pending is the ones not embedded in the embedding version.
+		Documents         int64           `json:"documents"`
+		Pending           int64           `json:"pending"`
+		Sampled           int             `json:"sampled"`
+		EstimatedTokens   int64           `json:"estimatedTokens"`
+		EstimatedCost     float64         `json:"estimatedCost"`
+		EstimatedDuration string          `json:"estimatedDuration"`
+		Request           *ReembedRequest `json:"request"`
+	}
+
+	// ReembedStatus is the progress of a re-embedding job.
+	ReembedStatus struct {
+		Status string       `json:"status"`
+		Plan   *ReembedPlan `json:"plan"`
+		// Cursor is where the scan is, an aborted or failed job is
+		// resumed from it.
+		Cursor     string `json:"cursor,omitempty"`
+		Scanned    int64  `json:"scanned"`
+		Reembedded int64  `json:"reembedded"`
+		Skipped    int64  `json:"skipped"`
+		// Tokens, Spent and SpentToday are estimated by the tokenizer and
+		// the price of the plan.
+		Tokens      int64   `json:"tokens"`
+		Spent       float64 `json:"spent"`
+		SpentToday  float64 `json:"spentToday"`
+		StartedAt   string  `json:"startedAt"`
+		PausedUntil string  `json:"pausedUntil,omitempty"`
+		FinishedAt  string  `json:"finishedAt,omitempty"`
+		Error       string  `json:"error,omitempty"`
+	}
+
+	// reembedJobs holds the last re-embedding job of a middleware, only
+	// one job of a middleware runs at a time.
+	reembedJobs struct {
+		lock sync.Mutex
+		job  *reembedJob
+	}
+
+	// reembedJob re-embeds the documents of a collection in the
+	// background.
+	reembedJob struct {
+		cancel context.CancelFunc
+		done   chan struct{}
+
+		lock   sync.Mutex
+		status ReembedStatus
+		// day is the UTC day of SpentToday.
+		day string
+		// paceStarted, paceRequests and paceTokens pace the embedding
+		// requests since the job is started or resumed from a pause.
+		paceStarted  time.Time
+		paceRequests int64
+		paceTokens   int64
+	}
+)
+
+var _ Reembedder = (*retrievalMiddleware)(nil)
+
+func validateReembedRequest(req *ReembedRequest) error {
+	if req.RequestsPerSecond < 0 || req.TokensPerMinute < 0 {
+		return fmt.Errorf("requestsPerSecond and tokensPerMinute must not be negative")
+	}
+	if req.DailySpendCap < 0 || req.PricePerMillion < 0 {
+		return fmt.Errorf("dailySpendCap and pricePerMillion must not be negative")
+	}
+	if req.BatchSize < 0 || req.SampleSize < 0 {
+		return fmt.Errorf("batchSize and sampleSize must not be negative")
+	}
+	return nil
+}
+
+func (req *ReembedRequest) getRequestsPerSecond() float64 {
+	if req.RequestsPerSecond == 0 {
+		return reembedDefaultRequestsPerSecond
+	}
+	return req.RequestsPerSecond
+}
+
+func (req *ReembedRequest) getBatchSize() int {
+	if req.BatchSize == 0 {
+		return reembedDefaultBatchSize
+	}
+	return req.BatchSize
+}
+
+func (req *ReembedRequest) getSampleSize() int {
+	if req.SampleSize == 0 {
+		return reembedDefaultSampleSize
+	}
+	return req.SampleSize
+}
+
+// cost returns the estimated cost of embedding the tokens.
+func (req *ReembedRequest) cost(tokens int64) float64 {
+	return float64(tokens) * req.PricePerMillion / 1e6
+}
+
+// projectDuration returns how long re-embedding the documents of the plan
+// takes under the limits of the request.
+func (req *ReembedRequest) projectDuration(plan *ReembedPlan) time.Duration {
+	d := time.Duration(float64(plan.Pending) / req.getRequestsPerSecond() * float64(time.Second))
+	if req.TokensPerMinute > 0 {
+		d = max(d, time.Duration(float64(plan.EstimatedTokens)/float64(req.TokensPerMinute)*float64(time.Minute)))
+	}
+	// the spend of the last day is not a whole day.
+	if req.DailySpendCap > 0 && plan.EstimatedCost > req.DailySpendCap {
+		days := math.Ceil(plan.EstimatedCost/req.DailySpendCap) - 1
+		d = max(d, time.Duration(days)*24*time.Hour)
+	}
+	return d.Round(time.Second)
+}
+
+// EmbeddingModel returns the model of the embeddings of the middleware.
+func (m *retrievalMiddleware) EmbeddingModel() string {
+	return m.spec.Retrieval.Embeddings.Model
+}
+
+// reembedScanner returns the scanner of the collection, the documents
+// are re-embedded into the embedding version of the collection, so the
+// ones re-embedded are skipped when the job is resumed.
+func (m *retrievalMiddleware) reembedScanner() (vecdbtypes.DocumentScanner, error) {
+	dbSpec := m.spec.Retrieval.VectorDB
+	if dbSpec.EmbeddingVersion == "" {
+		return nil, fmt.Errorf("re-embedding requires the embeddingVersion of the vectorDB")
+	}
+	scanner, ok := m.vectorDB.(vecdbtypes.DocumentScanner)
+	if !ok {
+		return nil, fmt.Errorf("vectorDB %s: %w", dbSpec.Type, vectordb.ErrScanNotSupported)
+	}
+	return scanner, nil
+}
+
+// PlanReembed counts the documents not embedded in the embedding version
+// of the collection, and estimates their tokens from a sample of them.
+func (m *retrievalMiddleware) PlanReembed(ctx context.Context, req *ReembedRequest) (*ReembedPlan, error) {
+	if err := validateReembedRequest(req); err != nil {
+		return nil, err
+	}
+	scanner, err := m.reembedScanner()
+	if err != nil {
+		return nil, err
+	}
+	dbSpec := m.spec.Retrieval.VectorDB
+	counter, ok := m.vectorDB.(vecdbtypes.FieldCounter)
+	if !ok {
+		return nil, fmt.Errorf("vectorDB %s does not support counting documents", dbSpec.Type)
+	}
+	counts, err := counter.CountByField(ctx, dbSpec.CollectionName, vectordb.EmbeddingVersionField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count documents: %w", err)
+	}
+
+	plan := &ReembedPlan{
+		Collection:       dbSpec.CollectionName,
+		Model:            m.EmbeddingModel(),
+		EmbeddingVersion: dbSpec.EmbeddingVersion,
+		Request:          req,
+	}
+	for version, n := range counts {
+		plan.Documents += n
+		if version != dbSpec.EmbeddingVersion {
+			plan.Pending += n
+		}
+	}
+
+	if plan.Pending > 0 {
+		var tokens int64
+		errSampled := errors.New("documents sampled")
+		fields := []string{retrievalContentField, vectordb.EmbeddingVersionField}
+		err := scanner.ScanDocuments(ctx, dbSpec.CollectionName, "", req.getBatchSize(), fields, func(docs []map[string]any, next string) error {
+			for _, doc := range docs {
+				if doc[vectordb.EmbeddingVersionField] == dbSpec.EmbeddingVersion {
+					continue
+				}
+				content, _ := doc[retrievalContentField].(string)
+				tokens += int64(estimateTokens(content))
+				plan.Sampled++
+				if plan.Sampled >= req.getSampleSize() {
+					return errSampled
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errSampled) {
+			return nil, fmt.Errorf("failed to sample documents: %w", err)
+		}
+		if plan.Sampled > 0 {
+			plan.EstimatedTokens = int64(math.Round(float64(tokens) / float64(plan.Sampled) * float64(plan.Pending)))
+		}
+	}
+	plan.EstimatedCost = req.cost(plan.EstimatedTokens)
+	plan.EstimatedDuration = req.projectDuration(plan).String()
+	return plan, nil
+}
+
+// StartReembed plans and starts re-embedding the documents. A job started
+// after an aborted or failed one of the same embedding version resumes
+// from its cursor, and the spend of the day is carried over.
+func (m *retrievalMiddleware) StartReembed(ctx context.Context, req *ReembedRequest) (*ReembedStatus, error) {
+	plan, err := m.PlanReembed(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return m.reembeds.start(m.spec.Name, plan, m.reembedDocuments)
+}
+
+// ReembedStatus returns the status of the last job.
+func (m *retrievalMiddleware) ReembedStatus() *ReembedStatus {
+	return m.reembeds.status()
+}
+
+// AbortReembed stops the running job and waits for it.
+func (m *retrievalMiddleware) AbortReembed() (*ReembedStatus, error) {
+	return m.reembeds.abort()
+}
+
+// reembedDocuments scans the documents from the cursor of the job, and
+// re-embeds the ones not embedded in the embedding version batch by
+// batch. The cursor is moved after a batch is written, so an interrupted
+// job is resumed from the batch.
+func (m *retrievalMiddleware) reembedDocuments(ctx context.Context, job *reembedJob) error {
+	scanner, err := m.reembedScanner()
+	if err != nil {
+		return err
+	}
+	status := job.getStatus()
+	plan, req := status.Plan, status.Plan.Request
+	fields := []string{retrievalContentField, vectordb.EmbeddingVersionField}
+	return scanner.ScanDocuments(ctx, plan.Collection, status.Cursor, req.getBatchSize(), fields, func(docs []map[string]any, next string) error {
+		job.update(func(s *ReembedStatus) { s.Scanned += int64(len(docs)) })
+
+		var err error
+		updates := make([]map[string]any, 0, len(docs))
+		for _, doc := range docs {
+			content, _ := doc[retrievalContentField].(string)
+			if doc[vectordb.EmbeddingVersionField] == plan.EmbeddingVersion || content == "" {
+				job.update(func(s *ReembedStatus) { s.Skipped++ })
+				continue
+			}
+			tokens := int64(estimateTokens(content))
+			cost := req.cost(tokens)
+			if err = job.waitBudget(ctx, cost); err != nil {
+				break
+			}
+			if err = job.pace(ctx, tokens); err != nil {
+				break
+			}
+			var embedding []float32
+			embedding, err = m.embeddingsHandler.EmbedDocuments(content)
+			if err != nil {
+				err = fmt.Errorf("failed to embed document %v: %w", doc["id"], err)
+				break
+			}
+			job.update(func(s *ReembedStatus) {
+				s.Tokens += tokens
+				s.Spent += cost
+				s.SpentToday += cost
+			})
+			updates = append(updates, map[string]any{
+				"id":                           doc["id"],
+				retrievalEmbeddingField:        embedding,
+				vectordb.EmbeddingVersionField: plan.EmbeddingVersion,
+			})
+		}
+
+		// the embedded documents are written even if the job is aborted,
+		// since they are paid for.
+		if len(updates) > 0 {
+			if werr := m.writeReembedded(context.WithoutCancel(ctx), updates); werr != nil {
+				return errors.Join(err, werr)
+			}
+			job.update(func(s *ReembedStatus) { s.Reembedded += int64(len(updates)) })
+		}
+		if err != nil {
+			return err
+		}
+		job.update(func(s *ReembedStatus) { s.Cursor = next })
+		return nil
+	})
+}
+
+// writeReembedded overwrites the embeddings and the embedding versions of
+// the documents, the other fields are kept.
+func (m *retrievalMiddleware) writeReembedded(ctx context.Context, docs []map[string]any) error {
+	handler, err := m.getHandler(len(docs[0][retrievalEmbeddingField].([]float32)))
+	if err != nil {
+		return err
+	}
+	if _, err := handler.InsertDocuments(ctx, docs); err != nil {
+		return fmt.Errorf("failed to write re-embedded documents: %w", err)
+	}
+	return nil
+}
+
+// start starts the job of the plan in the background, run re-embeds the
+// documents from the cursor of the job. A job started after an aborted or
+// failed one of the same collection and embedding version resumes from
+// its cursor, and the spend of the day is carried over.
+func (j *reembedJobs) start(middleware string, plan *ReembedPlan, run func(ctx context.Context, job *reembedJob) error) (*ReembedStatus, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	job := &reembedJob{done: make(chan struct{})}
+	if prev := j.job; prev != nil {
+		status := prev.getStatus()
+		switch status.Status {
+		case ReembedStatusRunning, ReembedStatusPaused:
+			return nil, ErrReembedRunning
+		case ReembedStatusAborted, ReembedStatusFailed:
+			if status.Plan.Collection == plan.Collection && status.Plan.EmbeddingVersion == plan.EmbeddingVersion {
+				job.status.Cursor = status.Cursor
+			}
+		}
+		today := time.Now().UTC().Format(time.DateOnly)
+		job.day, job.status.SpentToday = today, prev.spentOn(today)
+	}
+	job.status.Status = ReembedStatusRunning
+	job.status.Plan = plan
+	job.status.StartedAt = time.Now().Format(time.RFC3339)
+	job.paceStarted = time.Now()
+
+	var jobCtx context.Context
+	jobCtx, job.cancel = context.WithCancel(context.Background())
+	j.job = job
+	logger.Infof("re-embedding of middleware %s started: %d of %d documents, estimated %d tokens, cost %.2f, duration %s",
+		middleware, plan.Pending, plan.Documents, plan.EstimatedTokens, plan.EstimatedCost, plan.EstimatedDuration)
+	go job.run(jobCtx, middleware, run)
+	return job.getStatus(), nil
+}
+
+// status returns the status of the last job, it is nil if none is
+// started.
+func (j *reembedJobs) status() *ReembedStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.job == nil {
+		return nil
+	}
+	return j.job.getStatus()
+}
+
+// running returns whether a job is running or paused.
+func (j *reembedJobs) running() bool {
+	status := j.status()
+	return status != nil && (status.Status == ReembedStatusRunning || status.Status == ReembedStatusPaused)
+}
+
+// abort stops the running job and waits for it.
+func (j *reembedJobs) abort() (*ReembedStatus, error) {
+	j.lock.Lock()
+	job := j.job
+	j.lock.Unlock()
+	if job == nil {
+		return nil, ErrReembedNotRunning
+	}
+	select {
+	case <-job.done:
+		return nil, ErrReembedNotRunning
+	default:
+	}
+	job.cancel()
+	<-job.done
+	return job.getStatus(), nil
+}
+
+func (j *reembedJob) run(ctx context.Context, middleware string, run func(ctx context.Context, job *reembedJob) error) {
+	defer close(j.done)
+	err := run(ctx, j)
+	status := j.update(func(s *ReembedStatus) {
+		s.FinishedAt = time.Now().Format(time.RFC3339)
+		s.PausedUntil = ""
+		switch {
+		case err == nil:
+			s.Status = ReembedStatusCompleted
+		case errors.Is(err, context.Canceled):
+			s.Status = ReembedStatusAborted
+		default:
+			s.Status, s.Error = ReembedStatusFailed, err.Error()
+		}
+	})
+	logger.Infof("re-embedding of middleware %s %s: %d documents re-embedded, %d skipped, spent %.2f",
+		middleware, status.Status, status.Reembedded, status.Skipped, status.Spent)
+}
+
+func (j *reembedJob) update(fn func(s *ReembedStatus)) *ReembedStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	fn(&j.status)
+	status := j.status
+	return &status
+}
+
+func (j *reembedJob) getStatus() *ReembedStatus {
+	return j.update(func(s *ReembedStatus) {})
+}
+
+// spentOn returns the spend of the UTC day.
+func (j *reembedJob) spentOn(day string) float64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.day != day {
+		return 0
+	}
+	return j.status.SpentToday
+}
+
+// waitBudget waits until the cost is within the daily spend cap. A
+// document costing more than the cap is embedded if nothing is spent on
+// the day, or it would never be.
+func (j *reembedJob) waitBudget(ctx context.Context, cost float64) error {
+	spendCap := j.getStatus().Plan.Request.DailySpendCap
+	if spendCap <= 0 {
+		return nil
+	}
+	for {
+		now := time.Now().UTC()
+		j.lock.Lock()
+		if day := now.Format(time.DateOnly); j.day != day {
+			j.day, j.status.SpentToday = day, 0
+		}
+		if j.status.SpentToday == 0 || j.status.SpentToday+cost <= spendCap {
+			j.status.Status, j.status.PausedUntil = ReembedStatusRunning, ""
+			j.lock.Unlock()
+			return nil
+		}
+		next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		j.status.Status, j.status.PausedUntil = ReembedStatusPaused, next.Format(time.RFC3339)
+		j.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+		j.lock.Lock()
+		j.paceStarted, j.paceRequests, j.paceTokens = time.Now(), 0, 0
+		j.lock.Unlock()
+	}
+}
+
+// pace sleeps to keep the embedding requests and their tokens under the
+// caps of the request.
+func (j *reembedJob) pace(ctx context.Context, tokens int64) error {
+	j.lock.Lock()
+	req := j.status.Plan.Request
+	expected := time.Duration(float64(j.paceRequests) / req.getRequestsPerSecond() * float64(time.Second))
+	if req.TokensPerMinute > 0 {
+		expected = max(expected, time.Duration(float64(j.paceTokens)/float64(req.TokensPerMinute)*float64(time.Minute)))
+	}
+	wait := expected - time.Since(j.paceStarted)
+	j.paceRequests++
+	j.paceTokens += tokens
+	j.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
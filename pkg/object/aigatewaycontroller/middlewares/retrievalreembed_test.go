@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// reembedVectorDB scans the documents in order, and inserting a document
+// updates the fields of the one with the same ID.
+type reembedVectorDB struct {
+	lock sync.Mutex
+	docs []map[string]any
+}
+
+func (db *reembedVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	return db, nil
+}
+
+func (db *reembedVectorDB) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, doc := range docs {
+		for _, d := range db.docs {
+			if d["id"] == doc["id"] {
+				maps.Copy(d, doc)
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (db *reembedVectorDB) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	return nil, vecdbtypes.ErrSimilaritySearchNotFound
+}
+
+func (db *reembedVectorDB) CountByField(ctx context.Context, name, field string) (map[string]int64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	counts := map[string]int64{}
+	for _, doc := range db.docs {
+		v, _ := doc[field].(string)
+		counts[v]++
+	}
+	return counts, nil
+}
+
+func (db *reembedVectorDB) ScanDocuments(ctx context.Context, name, cursor string, count int, fields []string,
+	fn func(docs []map[string]any, next string) error,
+) error {
+	start := 0
+	if cursor != "" {
+		start, _ = strconv.Atoi(cursor)
+	}
+	for start < len(db.docs) {
+		db.lock.Lock()
+		end := min(start+count, len(db.docs))
+		page := make([]map[string]any, 0, end-start)
+		for _, doc := range db.docs[start:end] {
+			d := map[string]any{"id": doc["id"]}
+			for _, field := range fields {
+				if v, ok := doc[field]; ok {
+					d[field] = v
+				}
+			}
+			page = append(page, d)
+		}
+		db.lock.Unlock()
+
+		next := ""
+		if end < len(db.docs) {
+			next = strconv.Itoa(end)
+		}
+		if err := fn(page, next); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+func newReembedMiddleware(t *testing.T) (*retrievalMiddleware, *reembedVectorDB) {
+	m := newRetrievalMiddleware(t, nil)
+	m.spec.Retrieval.VectorDB.EmbeddingVersion = "v2"
+	db := &reembedVectorDB{}
+	for i := 0; i < 5; i++ {
+		doc := map[string]any{"id": fmt.Sprint(i), retrievalContentField: "one two six ten"}
+		// the first two documents are embedded in the current version.
+		if i < 2 {
+			doc[vectordb.EmbeddingVersionField] = "v2"
+		} else if i == 2 {
+			doc[vectordb.EmbeddingVersionField] = "v1"
+		}
+		db.docs = append(db.docs, doc)
+	}
+	m.vectorDB = db
+	return m, db
+}
+
+func waitReembed(t *testing.T, m Reembedder, statuses ...string) *ReembedStatus {
+	var status *ReembedStatus
+	assert.Eventually(t, func() bool {
+		status = m.ReembedStatus()
+		for _, s := range statuses {
+			if status.Status == s {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	return status
+}
+
+func TestRetrievalPlanReembed(t *testing.T) {
+	assert := assert.New(t)
+
+	m, _ := newReembedMiddleware(t)
+	plan, err := m.PlanReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 1, PricePerMillion: 1000})
+	assert.NoError(err)
+	assert.Equal("docs", plan.Collection)
+	assert.Equal("nomic-embed-text", plan.Model)
+	assert.Equal(int64(5), plan.Documents)
+	assert.Equal(int64(3), plan.Pending)
+	assert.Equal(3, plan.Sampled)
+	assert.Equal(int64(12), plan.EstimatedTokens)
+	assert.InDelta(0.012, plan.EstimatedCost, 1e-9)
+	assert.Equal("3s", plan.EstimatedDuration)
+
+	// the tokens are estimated from the sampled documents.
+	plan, err = m.PlanReembed(context.Background(), &ReembedRequest{SampleSize: 1, BatchSize: 1})
+	assert.NoError(err)
+	assert.Equal(1, plan.Sampled)
+	assert.Equal(int64(12), plan.EstimatedTokens)
+
+	_, err = m.PlanReembed(context.Background(), &ReembedRequest{DailySpendCap: -1})
+	assert.Error(err)
+	m.spec.Retrieval.VectorDB.EmbeddingVersion = ""
+	_, err = m.PlanReembed(context.Background(), &ReembedRequest{})
+	assert.Error(err)
+}
+
+func TestReembedProjectDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	plan := &ReembedPlan{Pending: 100, EstimatedTokens: 60000, EstimatedCost: 25}
+	assert.Equal(10*time.Second, (&ReembedRequest{}).projectDuration(plan))
+	assert.Equal(time.Minute, (&ReembedRequest{TokensPerMinute: 60000}).projectDuration(plan))
+	// the last day of the spend is not a whole day.
+	assert.Equal(48*time.Hour, (&ReembedRequest{DailySpendCap: 10}).projectDuration(plan))
+}
+
+func TestRetrievalReembed(t *testing.T) {
+	assert := assert.New(t)
+
+	m, db := newReembedMiddleware(t)
+	assert.Nil(m.ReembedStatus())
+	_, err := m.AbortReembed()
+	assert.ErrorIs(err, ErrReembedNotRunning)
+
+	status, err := m.StartReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 1000, PricePerMillion: 1000, BatchSize: 2})
+	assert.NoError(err)
+	assert.Equal(int64(3), status.Plan.Pending)
+	status = waitReembed(t, m, ReembedStatusCompleted)
+	assert.Equal(int64(5), status.Scanned)
+	assert.Equal(int64(3), status.Reembedded)
+	assert.Equal(int64(2), status.Skipped)
+	assert.Equal(int64(12), status.Tokens)
+	assert.InDelta(0.012, status.Spent, 1e-9)
+	assert.NotEmpty(status.FinishedAt)
+	for _, doc := range db.docs {
+		assert.Equal("v2", doc[vectordb.EmbeddingVersionField])
+	}
+	assert.Equal(embeddingString("one two six ten"), db.docs[4][retrievalEmbeddingField])
+	// the other fields are kept.
+	assert.Equal("one two six ten", db.docs[4][retrievalContentField])
+
+	// nothing is left to re-embed.
+	status, err = m.StartReembed(context.Background(), &ReembedRequest{})
+	assert.NoError(err)
+	assert.Equal(int64(0), status.Plan.Pending)
+	status = waitReembed(t, m, ReembedStatusCompleted)
+	assert.Equal(int64(0), status.Reembedded)
+}
+
+func TestRetrievalAbortReembed(t *testing.T) {
+	assert := assert.New(t)
+
+	// the second document waits for a second.
+	m, db := newReembedMiddleware(t)
+	_, err := m.StartReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 1, BatchSize: 1})
+	assert.NoError(err)
+	assert.Eventually(func() bool { return m.ReembedStatus().Reembedded == 1 }, 5*time.Second, 10*time.Millisecond)
+	_, err = m.StartReembed(context.Background(), &ReembedRequest{})
+	assert.ErrorIs(err, ErrReembedRunning)
+
+	status, err := m.AbortReembed()
+	assert.NoError(err)
+	assert.Equal(ReembedStatusAborted, status.Status)
+	assert.Equal(int64(1), status.Reembedded)
+	assert.Equal("3", status.Cursor)
+	assert.Equal("v2", db.docs[2][vectordb.EmbeddingVersionField])
+	assert.Nil(db.docs[3][vectordb.EmbeddingVersionField])
+
+	// the job is resumed from the cursor of the aborted one.
+	status, err = m.StartReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 1000})
+	assert.NoError(err)
+	assert.Equal("3", status.Cursor)
+	status = waitReembed(t, m, ReembedStatusCompleted)
+	assert.Equal(int64(2), status.Scanned)
+	assert.Equal(int64(2), status.Reembedded)
+}
+
+func TestRetrievalReembedDailySpendCap(t *testing.T) {
+	assert := assert.New(t)
+
+	// a document costs 0.004, the cap allows two of them.
+	m, db := newReembedMiddleware(t)
+	_, err := m.StartReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 1000, PricePerMillion: 1000, DailySpendCap: 0.009})
+	assert.NoError(err)
+	status := waitReembed(t, m, ReembedStatusPaused)
+	assert.NotEmpty(status.PausedUntil)
+	assert.InDelta(0.008, status.SpentToday, 1e-9)
+	assert.Equal(int64(0), status.Reembedded)
+
+	// the embedded documents are written on abort.
+	status, err = m.AbortReembed()
+	assert.NoError(err)
+	assert.Equal(ReembedStatusAborted, status.Status)
+	assert.Equal(int64(2), status.Reembedded)
+	assert.Equal("", status.Cursor)
+	assert.Equal("v2", db.docs[3][vectordb.EmbeddingVersionField])
+
+	// the spend of the day is carried over.
+	_, err = m.StartReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 1000, PricePerMillion: 1000, DailySpendCap: 0.009})
+	assert.NoError(err)
+	status = waitReembed(t, m, ReembedStatusPaused)
+	assert.Equal(int64(0), status.Reembedded)
+	m.Close()
+	assert.Equal(ReembedStatusAborted, m.ReembedStatus().Status)
+}
@@ -21,12 +21,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"net/http"
 	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
 
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
@@ -37,6 +41,13 @@ import (
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
 )
 
+const (
+	// semanticCacheRequestIDHeader carries the ID of the request to send
+	// feedback on a cache hit.
+	semanticCacheRequestIDHeader = "X-Request-Id"
+	semanticCacheScoreHeader     = "X-Semantic-Cache-Score"
+)
+
 const semanticCacheDefaultContentTemplate = `{{ $last := "" }}{{ range .messages}}{{ $last = .content }}{{ end }}{{ $last }}`
 
 type (
@@ -45,6 +56,40 @@ type (
 		VectorDB        *vectordb.Spec            `json:"vectorDB" jsonschema:"required"`
 		ReadOnly        bool                      `json:"readOnly" jsonschema:"default=false"`
 		ContentTemplate string                    `json:"contentTemplate,omitempty"`
+		// Fallback is the previous generation of the cache. It is only read
+		// when the primary cache returns too few hits, which allows the
+		// primary collection to be re-embedded gradually with a new
+		// embedding model.
+		Fallback *SemanticCacheFallbackSpec `json:"fallback,omitempty"`
+		// ThresholdTuning tunes the threshold of the primary cache from
+		// the feedback on its hits.
+		ThresholdTuning *SemanticCacheTuningSpec `json:"thresholdTuning,omitempty"`
+		// Invalidation broadcasts purges of the cache to all members.
+		Invalidation *SemanticCacheInvalidationSpec `json:"invalidation,omitempty"`
+		// Evaluation compares sampled cache hits with fresh generations.
+		Evaluation *SemanticCacheEvaluationSpec `json:"evaluation,omitempty"`
+		// StaleEntries is the policy of the entries too old to be migrated
+		// to the current schema version, they are ignored or deleted when
+		// they are read.
+		StaleEntries string `json:"staleEntries,omitempty" jsonschema:"enum=,enum=ignore,enum=delete"`
+		// ColdStorage offloads the entries not hit for long to an object
+		// store.
+		ColdStorage *SemanticCacheColdStorageSpec `json:"coldStorage,omitempty"`
+		// Signing signs the entries, and the entries failing the
+		// verification are deleted when they are hit.
+		Signing *SemanticCacheSigningSpec `json:"signing,omitempty"`
+		// StaleReads serves the hits from a local tier while the vector
+		// database is degraded.
+		StaleReads *SemanticCacheStaleReadsSpec `json:"staleReads,omitempty"`
+	}
+
+	// SemanticCacheFallbackSpec describes the previous generation of a semantic cache.
+	SemanticCacheFallbackSpec struct {
+		Embeddings *embeddings.EmbeddingSpec `json:"embeddings" jsonschema:"required"`
+		VectorDB   *vectordb.Spec            `json:"vectorDB" jsonschema:"required"`
+		// MinResults is the number of hits of the primary cache below
+		// which the fallback is read, 1 by default.
+		MinResults int `json:"minResults,omitempty"`
 	}
 
 	semanticCacheMiddleware struct {
@@ -52,6 +97,24 @@ type (
 		embeddingsHandler embeddings.EmbeddingHandler
 		vectorHandler     *semanticCacheVectorHandler
 		template          *template.Template
+
+		fallbackEmbeddingsHandler embeddings.EmbeddingHandler
+		fallbackVectorHandler     *semanticCacheVectorHandler
+
+		tuner     *thresholdTuner
+		bus       *invalidationBus
+		evaluator *cacheEvaluator
+
+		coldStorage *coldStorage
+		signer      *entrySigner
+		staleReads  *staleReads
+
+		cacheImportLock sync.Mutex
+		cacheImport     *cacheImportJob
+
+		reembeds reembedJobs
+
+		stopIntegrityChecks []func()
 	}
 )
 
@@ -70,6 +133,35 @@ func (m *semanticCacheMiddleware) init(spec *MiddlewareSpec) {
 		vectorDB: vectordb.New(spec.SemanticCache.VectorDB),
 		handlers: make(map[string]vectordb.VectorHandler),
 	}
+	if fallback := spec.SemanticCache.Fallback; fallback != nil {
+		m.fallbackEmbeddingsHandler = embeddings.New(fallback.Embeddings)
+		m.fallbackVectorHandler = &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   fallback.VectorDB,
+			vectorDB: vectordb.New(fallback.VectorDB),
+			handlers: make(map[string]vectordb.VectorHandler),
+		}
+	}
+	m.resumeDrains()
+	m.stopIntegrityChecks = scheduleIntegrityChecks(m.integrityCollections())
+	if tuning := spec.SemanticCache.ThresholdTuning; tuning != nil {
+		m.tuner = newThresholdTuner(spec.Name, tuning, spec.SemanticCache.VectorDB.Threshold)
+	}
+	if invalidation := spec.SemanticCache.Invalidation; invalidation != nil {
+		m.initInvalidation(invalidation)
+	}
+	if evaluation := spec.SemanticCache.Evaluation; evaluation != nil {
+		m.initEvaluation(evaluation)
+	}
+	if coldStorage := spec.SemanticCache.ColdStorage; coldStorage != nil {
+		m.initColdStorage(coldStorage)
+	}
+	if signing := spec.SemanticCache.Signing; signing != nil {
+		m.signer = newEntrySigner(spec.Name, signing)
+	}
+	if staleReads := spec.SemanticCache.StaleReads; staleReads != nil {
+		m.initStaleReads(staleReads)
+	}
 	templateText := spec.SemanticCache.ContentTemplate
 	if templateText == "" {
 		templateText = semanticCacheDefaultContentTemplate
@@ -77,6 +169,34 @@ func (m *semanticCacheMiddleware) init(spec *MiddlewareSpec) {
 	m.template = template.Must(template.New("").Parse(templateText))
 }
 
+// resumeDrains resumes deleting the documents of the purged collections,
+// which are interrupted by restarts.
+func (m *semanticCacheMiddleware) resumeDrains() {
+	handlers := []*semanticCacheVectorHandler{m.vectorHandler}
+	if m.fallbackVectorHandler != nil {
+		handlers = append(handlers, m.fallbackVectorHandler)
+	}
+	for _, h := range handlers {
+		m.resumeDrain(h)
+	}
+}
+
+// resumeDrain resumes the drains of the vector database in background, the
+// handler is marked if it fails, so it is resumed again when the vector
+// database is reachable.
+func (m *semanticCacheMiddleware) resumeDrain(h *semanticCacheVectorHandler) {
+	resumer, ok := h.vectorDB.(vecdbtypes.DrainResumer)
+	if !ok || h.dbSpec.Redis == nil || h.dbSpec.Redis.Drain == nil {
+		return
+	}
+	go func() {
+		if err := resumer.ResumeDrains(context.Background()); err != nil {
+			h.drainFailed.Store(true)
+			logger.Errorf("failed to resume drains of semantic cache %s: %v", m.spec.Name, err)
+		}
+	}()
+}
+
 func (m *semanticCacheMiddleware) validate(spec *MiddlewareSpec) error {
 	if spec.SemanticCache == nil {
 		return fmt.Errorf("semanticCache middleware %s must have a semanticCache spec", spec.Name)
@@ -93,6 +213,72 @@ func (m *semanticCacheMiddleware) validate(spec *MiddlewareSpec) error {
 	if err := vectordb.ValidateSpec(spec.SemanticCache.VectorDB); err != nil {
 		return fmt.Errorf("semanticCache middleware %s has invalid vectorDB spec: %w", spec.Name, err)
 	}
+	if fallback := spec.SemanticCache.Fallback; fallback != nil {
+		if fallback.Embeddings == nil || fallback.VectorDB == nil {
+			return fmt.Errorf("semanticCache middleware %s must have embeddings and vectorDB spec in fallback", spec.Name)
+		}
+		if err := embeddings.ValidateSpec(fallback.Embeddings); err != nil {
+			return fmt.Errorf("semanticCache middleware %s has invalid fallback embeddings spec: %w", spec.Name, err)
+		}
+		if err := vectordb.ValidateSpec(fallback.VectorDB); err != nil {
+			return fmt.Errorf("semanticCache middleware %s has invalid fallback vectorDB spec: %w", spec.Name, err)
+		}
+		if fallback.MinResults < 0 {
+			return fmt.Errorf("semanticCache middleware %s has negative minResults in fallback", spec.Name)
+		}
+		if fallback.VectorDB.Type == spec.SemanticCache.VectorDB.Type &&
+			fallback.VectorDB.CollectionName == spec.SemanticCache.VectorDB.CollectionName {
+			return fmt.Errorf("semanticCache middleware %s must use a different collection for fallback", spec.Name)
+		}
+	}
+	if err := validateSemanticCacheTuningSpec(spec.SemanticCache.ThresholdTuning, spec.SemanticCache.VectorDB.Threshold); err != nil {
+		return fmt.Errorf("semanticCache middleware %s has invalid thresholdTuning spec: %w", spec.Name, err)
+	}
+	if invalidation := spec.SemanticCache.Invalidation; invalidation != nil {
+		if spec.SemanticCache.VectorDB.Type != vectordb.TypeRedis {
+			return fmt.Errorf("semanticCache middleware %s must use redis vectorDB for invalidation", spec.Name)
+		}
+		if err := validateSemanticCacheInvalidationSpec(invalidation); err != nil {
+			return fmt.Errorf("semanticCache middleware %s has invalid invalidation spec: %w", spec.Name, err)
+		}
+	}
+	if err := validateSemanticCacheEvaluationSpec(spec.SemanticCache.Evaluation); err != nil {
+		return fmt.Errorf("semanticCache middleware %s has invalid evaluation spec: %w", spec.Name, err)
+	}
+	if err := validateStaleEntries(spec.SemanticCache.StaleEntries); err != nil {
+		return fmt.Errorf("semanticCache middleware %s: %w", spec.Name, err)
+	}
+	if coldStorage := spec.SemanticCache.ColdStorage; coldStorage != nil {
+		vectorDB := spec.SemanticCache.VectorDB
+		if vectorDB.Type != vectordb.TypeRedis {
+			return fmt.Errorf("semanticCache middleware %s must use redis vectorDB for coldStorage", spec.Name)
+		}
+		if vectorDB.PayloadStore != nil {
+			return fmt.Errorf("semanticCache middleware %s can not use payloadStore with coldStorage", spec.Name)
+		}
+		if vectorDB.Redis != nil && vectorDB.Redis.IndexType == string(redisvector.IndexTypeJSON) {
+			return fmt.Errorf("semanticCache middleware %s can not use JSON index type with coldStorage", spec.Name)
+		}
+		if err := validateSemanticCacheColdStorageSpec(coldStorage); err != nil {
+			return fmt.Errorf("semanticCache middleware %s has invalid coldStorage spec: %w", spec.Name, err)
+		}
+	}
+	if signing := spec.SemanticCache.Signing; signing != nil {
+		if spec.SemanticCache.VectorDB.Type != vectordb.TypeRedis {
+			return fmt.Errorf("semanticCache middleware %s must use redis vectorDB for signing", spec.Name)
+		}
+		if fallback := spec.SemanticCache.Fallback; fallback != nil && fallback.VectorDB.Type != vectordb.TypeRedis {
+			return fmt.Errorf("semanticCache middleware %s must use redis vectorDB in fallback for signing", spec.Name)
+		}
+		if err := validateSemanticCacheSigningSpec(signing); err != nil {
+			return fmt.Errorf("semanticCache middleware %s has invalid signing spec: %w", spec.Name, err)
+		}
+	}
+	if staleReads := spec.SemanticCache.StaleReads; staleReads != nil {
+		if err := validateSemanticCacheStaleReadsSpec(staleReads); err != nil {
+			return fmt.Errorf("semanticCache middleware %s has invalid staleReads spec: %w", spec.Name, err)
+		}
+	}
 	return nil
 }
 
@@ -109,8 +295,14 @@ func (m *semanticCacheMiddleware) Spec() *MiddlewareSpec {
 }
 
 func (m *semanticCacheMiddleware) getContext(ctx *aicontext.Context) (string, error) {
+	return m.renderContent(ctx.OpenAIReq)
+}
+
+// renderContent renders the content of the request to embed by the
+// content template.
+func (m *semanticCacheMiddleware) renderContent(req map[string]any) (string, error) {
 	var result bytes.Buffer
-	if err := m.template.Execute(&result, ctx.OpenAIReq); err != nil {
+	if err := m.template.Execute(&result, req); err != nil {
 		return "", fmt.Errorf("failed to execute template for semantic cache: %w", err)
 	}
 	if result.Len() == 0 {
@@ -119,7 +311,7 @@ func (m *semanticCacheMiddleware) getContext(ctx *aicontext.Context) (string, er
 	return result.String(), nil
 }
 
-func (m *semanticCacheMiddleware) addInsertCacheCallback(ctx *aicontext.Context, embedding []float32) {
+func (m *semanticCacheMiddleware) addInsertCacheCallback(ctx *aicontext.Context, prompt string, embedding []float32) {
 	if m.spec.SemanticCache.ReadOnly {
 		return
 	}
@@ -128,6 +320,16 @@ func (m *semanticCacheMiddleware) addInsertCacheCallback(ctx *aicontext.Context,
 		if fc.StatusCode != 200 {
 			return
 		}
+		// only complete responses are cached, a stream is cut off if the
+		// client goes away, even if the rest of it is buffered for
+		// resumption.
+		if ctx.ReqInfo.Stream && !isCompleteStream(fc.RespBody) {
+			return
+		}
+		// the responses failing the quality checks are not cached.
+		if len(ctx.ResponseCheckFailures()) > 0 {
+			return
+		}
 		handler, err := m.vectorHandler.GetHandler(ctx, embedding)
 		if err != nil {
 			logger.Errorf("failed to get vector handler for semantic cache: %v", err)
@@ -140,44 +342,106 @@ func (m *semanticCacheMiddleware) addInsertCacheCallback(ctx *aicontext.Context,
 			return
 		}
 		cache := map[string]any{
-			"embedding": embedding,
-			"data":      string(fc.RespBody),
-			"header":    string(header),
-			"status":    fc.StatusCode,
+			"embedding":                    embedding,
+			"data":                         string(fc.RespBody),
+			"header":                       string(header),
+			"status":                       fc.StatusCode,
+			semanticCacheGenerationMsField: fc.Duration,
+		}
+		// the generation cost is used by the eviction of the local tier.
+		if output, ok := parseResponseOutput(fc.RespBody); ok {
+			cache[semanticCacheGenerationTokensField] = output.completionTokens
 		}
-		handler.InsertDocuments(ctx.Req.Std().Context(), []map[string]any{cache})
+		m.insertCache(ctx, handler, prompt, cache)
 	})
 }
 
-func (m *semanticCacheMiddleware) writeRespWithCache(ctx *aicontext.Context, cache map[string]any) {
-	defer func() {
-		if r := recover(); r != nil {
-			if err, ok := r.(error); ok {
-				logger.Errorf("panic in writeRespWithCache: %v", err)
-			} else {
-				logger.Errorf("panic in writeRespWithCache: %v", r)
-			}
+func (m *semanticCacheMiddleware) insertCache(ctx *aicontext.Context, handler vectordb.VectorHandler, prompt string, cache map[string]any) {
+	err := m.storeCache(ctx.Req.Std().Context(), handler, prompt, cache)
+	switch {
+	case err == nil:
+	case errors.Is(err, vecdbtypes.ErrNotFound):
+		logger.Warnf("failed to insert semantic cache, collection not found: %v", err)
+	case errors.Is(err, vecdbtypes.ErrQuotaExceeded):
+		logger.Warnf("semantic cache not stored, vector database quota exceeded: %v", err)
+	default:
+		logger.Errorf("failed to insert semantic cache: %v", err)
+	}
+}
+
+// storeCache signs and inserts the cache entry. The ID of the entry is
+// kept if it is set.
+func (m *semanticCacheMiddleware) storeCache(ctx context.Context, handler vectordb.VectorHandler, prompt string, cache map[string]any, options ...vecdbtypes.HandlerInsertOption) error {
+	if m.signer != nil {
+		if err := m.signer.sign(cache, prompt); err != nil {
+			return fmt.Errorf("failed to sign semantic cache: %w", err)
 		}
-	}()
+	}
+	if version := m.spec.SemanticCache.VectorDB.EmbeddingVersion; version != "" {
+		cache[vectordb.EmbeddingVersionField] = version
+	}
+	cache[semanticCacheSchemaVersionField] = semanticCacheSchemaVersion
+	cache[semanticCachePromptField] = prompt
+	tierer, tiered := handler.(vecdbtypes.DocumentTierer)
+	if _, ok := cache["id"]; !ok && m.coldStorage != nil && tiered {
+		// the ID is set explicitly, since inserts may be queued, and the
+		// entry is tracked from now on, so it is offloaded if never hit.
+		cache["id"] = uuid.NewString()
+	}
+	_, err := handler.InsertDocuments(ctx, []map[string]any{cache}, options...)
+	switch {
+	case err == nil:
+		if m.coldStorage != nil && tiered {
+			m.touchEntries(tierer, []string{cache["id"].(string)}, time.Time{})
+		}
+	case errors.Is(err, vecdbtypes.ErrNotFound):
+		// the collection is dropped by others, it is created again
+		// before the next use.
+		m.vectorHandler.invalidate()
+	}
+	return err
+}
 
-	data := cache["data"].(string)
-	headerStr := cache["header"].(string)
-	status := cache["status"].(int)
+// migrateCache copies a cache hit from the fallback collection into the primary
+// collection, so the primary collection is re-embedded gradually by real traffic.
+// The copy keeps the ID of the hit on Redis, so it is overwritten by
+// re-embedding.
+func (m *semanticCacheMiddleware) migrateCache(ctx *aicontext.Context, prompt string, embedding []float32, id any, entry *semanticCacheEntry) {
+	if m.spec.SemanticCache.ReadOnly {
+		return
+	}
 
-	h := http.Header{}
-	if err := json.Unmarshal([]byte(headerStr), &h); err != nil {
-		logger.Errorf("failed to unmarshal response header: %v", err)
+	handler, err := m.vectorHandler.GetHandler(ctx, embedding)
+	if err != nil {
+		logger.Errorf("failed to get vector handler for semantic cache: %v", err)
 		return
 	}
+	header, err := json.Marshal(entry.Header)
+	if err != nil {
+		logger.Errorf("failed to marshal response header: %v", err)
+		return
+	}
+	doc := map[string]any{
+		"embedding": embedding,
+		"data":      entry.Data,
+		"header":    string(header),
+		"status":    entry.Status,
+	}
+	if id != nil && m.spec.SemanticCache.VectorDB.Type == vectordb.TypeRedis {
+		doc["id"] = id
+	}
+	m.insertCache(ctx, handler, prompt, doc)
+}
 
+func (m *semanticCacheMiddleware) writeRespWithCache(ctx *aicontext.Context, entry *semanticCacheEntry) {
 	resp := &aicontext.Response{
-		StatusCode: status,
-		Header:     h,
+		StatusCode: entry.Status,
+		Header:     entry.Header,
 	}
 	if ctx.ReqInfo.Stream {
-		resp.BodyReader = bytes.NewReader([]byte(data))
+		resp.BodyReader = bytes.NewReader([]byte(entry.Data))
 	} else {
-		resp.BodyBytes = []byte(data)
+		resp.BodyBytes = []byte(entry.Data)
 		resp.ContentLength = int64(len(resp.BodyBytes))
 	}
 	ctx.SetResponse(resp)
@@ -188,57 +452,314 @@ func (m *semanticCacheMiddleware) Handle(ctx *aicontext.Context) {
 	if ctx.RespType != aicontext.ResponseTypeChatCompletions && ctx.RespType != aicontext.ResponseTypeCompletions {
 		return
 	}
+	// the cache is neither read nor written out of the consumer's region.
+	if !ctx.Resident(m.spec.SemanticCache.VectorDB.Region) {
+		ctx.Ctx.AddTag(fmt.Sprintf("semanticCache %s: skipped out of region %s", m.spec.Name, ctx.ConsumerRegion))
+		return
+	}
+	// the cache is neither read nor written by dry runs, reads of the
+	// cache are recorded by the tuning and the stale reads.
+	if ctx.DryRun {
+		ctx.Ctx.AddTag(fmt.Sprintf("semanticCache %s: skipped in dry run", m.spec.Name))
+		return
+	}
 
 	context, err := m.getContext(ctx)
 	if err != nil {
 		logger.Errorf("failed to get context for semantic cache: %v", err)
 		return
 	}
-	embedding, err := m.embeddingsHandler.EmbedQuery(context)
-	if err != nil {
-		logger.Errorf("failed to embed context for semantic cache: %v", err)
+	if m.staleReads != nil && m.serveStale(ctx, context) {
 		return
 	}
-	handler, err := m.vectorHandler.GetHandler(ctx, embedding)
+	embedding, err := embedQuery(ctx, m.spec.Name, m.spec.SemanticCache.Embeddings, m.embeddingsHandler, context)
 	if err != nil {
-		logger.Errorf("failed to get vector handler for semantic cache: %v", err)
+		logger.Errorf("failed to embed context for semantic cache: %v", err)
 		return
 	}
-	cache, err := handler.SimilaritySearch(
-		ctx.Req.Std().Context(),
-		m.getSearchOptions(ctx, embedding)...,
+	var (
+		cache map[string]any
+		score float64
 	)
-	if err != nil {
-		if err == vectordb.ErrSimilaritySearchNotFound {
-			m.addInsertCacheCallback(ctx, embedding)
+	// the scores of hits are needed by both the tuning and the evaluation.
+	scored := m.tuner != nil || m.evaluator != nil
+	switch {
+	case scored:
+		cache, score, err = m.searchTuned(ctx, embedding)
+	case m.readsFallback(ctx):
+		var fallbackEmbedding []float32
+		cache, fallbackEmbedding, err = m.searchDualRead(ctx, context, embedding)
+		if err == nil && cache[vectordb.DualReadFallbackField] == true {
+			m.serveFallback(ctx, context, embedding, fallbackEmbedding, cache)
 			return
 		}
+	default:
+		cache, err = m.search(ctx, m.vectorHandler, embedding)
+	}
+	if err != nil {
 		logger.Errorf("failed to search similarity in vector database: %v", err)
 		return
 	}
+	// an entry which can not be decoded is a miss, so it is replaced by
+	// an entry of the current schema version.
+	if cache != nil && m.coldStorage != nil {
+		cache = m.thaw(ctx, embedding, cache)
+	}
+	var entry *semanticCacheEntry
+	if cache != nil {
+		entry = m.decodeEntry(ctx, m.vectorHandler, embedding, cache)
+	}
+	if entry != nil && m.staleReads != nil {
+		m.rememberHit(ctx, context, cache, entry, embedding)
+	}
+	if entry != nil && scored {
+		m.writeRespWithCache(ctx, entry)
+		if m.tuner != nil {
+			m.recordHit(ctx, score)
+		}
+		if m.evaluator != nil {
+			m.evaluateHit(ctx, context, cache, score)
+		}
+		return
+	}
+	// the tuned hits are scored by the primary cache only, so the
+	// fallback is read only if it misses.
+	if entry == nil && scored && m.readsFallback(ctx) {
+		var id any
+		entry, id = m.searchFallback(ctx, context)
+		if entry != nil {
+			m.migrateCache(ctx, context, embedding, id, entry)
+		}
+	}
+	if entry == nil {
+		m.addInsertCacheCallback(ctx, context, embedding)
+		return
+	}
+	m.writeRespWithCache(ctx, entry)
+}
+
+// search returns the best matched cache of the given vector handler, or nil if not found.
+func (m *semanticCacheMiddleware) search(ctx *aicontext.Context, vectorHandler *semanticCacheVectorHandler, embedding []float32) (map[string]any, error) {
+	cache, err := m.query(ctx, vectorHandler, embedding)
+	if err != nil {
+		return nil, err
+	}
 	if len(cache) == 0 {
-		m.addInsertCacheCallback(ctx, embedding)
+		return nil, nil
+	}
+	return cache[0], nil
+}
+
+// query searches the caches similar to the embedding, the options are
+// appended to the options of production lookups.
+func (m *semanticCacheMiddleware) query(ctx *aicontext.Context, vectorHandler *semanticCacheVectorHandler, embedding []float32, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	handler, err := vectorHandler.GetHandler(ctx, embedding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vector handler: %w", err)
+	}
+	return m.queryHandler(ctx, vectorHandler, handler, append(getSearchOptions(vectorHandler.dbSpec, embedding), options...)...)
+}
+
+// queryHandler searches the caches by the handler of the vector handler.
+// The failures of the fallback collection of a dual read are logged, and
+// the hits of the primary collection are returned.
+func (m *semanticCacheMiddleware) queryHandler(ctx *aicontext.Context, vectorHandler *semanticCacheVectorHandler, handler vectordb.VectorHandler, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	start := time.Now()
+	cache, err := handler.SimilaritySearch(ctx.Req.Std().Context(), options...)
+	var fallbackErr *vectordb.FallbackError
+	if errors.As(err, &fallbackErr) {
+		if err := m.searchError(m.fallbackVectorHandler, fallbackErr.Err); err != nil {
+			logger.Errorf("failed to search similarity in fallback vector database: %v", err)
+		}
+		err = nil
+	}
+	if m.staleReads != nil && vectorHandler == m.vectorHandler {
+		m.staleReads.observe(time.Since(start), err)
+	}
+	if err != nil {
+		return nil, m.searchError(vectorHandler, err)
+	}
+	return cache, nil
+}
+
+// searchError returns nil if the failed search goes on as a miss.
+func (m *semanticCacheMiddleware) searchError(vectorHandler *semanticCacheVectorHandler, err error) error {
+	switch {
+	case errors.Is(err, vecdbtypes.ErrNotFound):
+		// the collection may be dropped by others, it is created
+		// again before the next use.
+		if err != vectordb.ErrSimilaritySearchNotFound {
+			vectorHandler.invalidate()
+		}
+		return nil
+	case errors.Is(err, vecdbtypes.ErrUnavailable), errors.Is(err, vecdbtypes.ErrTimeout):
+		// the backend is saturated or failing over, the request goes
+		// on as a miss.
+		if err != vectordb.ErrQueryShed {
+			logger.Warnf("semantic cache lookup degraded to a miss: %v", err)
+		}
+		return nil
+	}
+	return err
+}
+
+// searchTuned returns the best matched cache of the primary cache and its
+// score, the cache is nil if the score is below the tuned threshold, or the
+// threshold of the spec if the tuning is not enabled.
+func (m *semanticCacheMiddleware) searchTuned(ctx *aicontext.Context, embedding []float32) (map[string]any, float64, error) {
+	docs, err := m.query(ctx, m.vectorHandler, embedding, vecdbtypes.WithExplain(), vecdbtypes.WithLimit(1))
+	if err != nil || len(docs) == 0 {
+		return nil, 0, err
+	}
+	score, _ := docs[0][vecdbtypes.ExplainScoreField].(float64)
+	threshold := m.spec.SemanticCache.VectorDB.Threshold
+	if m.tuner != nil {
+		threshold = m.tuner.currentThreshold()
+	}
+	if score < threshold {
+		return nil, score, nil
+	}
+	return docs[0], score, nil
+}
+
+// recordHit records the cache hit served to the request for feedback. The
+// request ID and the score are returned in the response headers, so clients
+// can send feedback on the hit.
+func (m *semanticCacheMiddleware) recordHit(ctx *aicontext.Context, score float64) {
+	resp := ctx.GetResponse()
+	if resp == nil {
 		return
 	}
-	m.writeRespWithCache(ctx, cache[0])
+	requestID := ctx.Req.HTTPHeader().Get(semanticCacheRequestIDHeader)
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	m.tuner.recordHit(requestID, score, time.Now())
+	resp.Header.Set(semanticCacheRequestIDHeader, requestID)
+	resp.Header.Set(semanticCacheScoreHeader, strconv.FormatFloat(score, 'f', 4, 64))
+}
+
+var (
+	_ FeedbackReceiver = (*semanticCacheMiddleware)(nil)
+	_ ThresholdTuner   = (*semanticCacheMiddleware)(nil)
+)
+
+// Feedback records whether a cache hit served by the middleware is correct.
+func (m *semanticCacheMiddleware) Feedback(feedback *Feedback) error {
+	if m.tuner == nil {
+		return ErrTuningDisabled
+	}
+	if feedback.RequestID == "" {
+		return fmt.Errorf("requestID of feedback is empty")
+	}
+	return m.tuner.feedback(feedback, time.Now())
+}
+
+// ThresholdStats returns the feedback statistics and the threshold.
+func (m *semanticCacheMiddleware) ThresholdStats() (*ThresholdStats, error) {
+	if m.tuner == nil {
+		return nil, ErrTuningDisabled
+	}
+	return m.tuner.stats(time.Now()), nil
+}
+
+// RevertThreshold reverts the threshold to the one in the spec.
+func (m *semanticCacheMiddleware) RevertThreshold(operator string) (*ThresholdStats, error) {
+	if m.tuner == nil {
+		return nil, ErrTuningDisabled
+	}
+	m.tuner.revert(operator, time.Now())
+	return m.tuner.stats(time.Now()), nil
+}
+
+// readsFallback returns whether the fallback of the cache is read for
+// the request.
+func (m *semanticCacheMiddleware) readsFallback(ctx *aicontext.Context) bool {
+	return m.fallbackVectorHandler != nil && ctx.Resident(m.spec.SemanticCache.Fallback.VectorDB.Region)
+}
+
+// searchDualRead returns the best hit of the primary cache, or of the
+// fallback if the primary cache returns fewer than minResults hits, with
+// the query embedded by the model of the fallback. The hits of the
+// fallback have vectordb.DualReadFallbackField set.
+func (m *semanticCacheMiddleware) searchDualRead(ctx *aicontext.Context, prompt string, embedding []float32) (map[string]any, []float32, error) {
+	primary, err := m.vectorHandler.GetHandler(ctx, embedding)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get vector handler: %w", err)
+	}
+	fallback := m.spec.SemanticCache.Fallback
+	var fallbackEmbedding []float32
+	handler := vectordb.NewDualReadHandler(primary, fallback.MinResults, func(context.Context) (vectordb.VectorHandler, []vecdbtypes.HandlerSearchOption, error) {
+		var err error
+		fallbackEmbedding, err = embedQuery(ctx, m.spec.Name, fallback.Embeddings, m.fallbackEmbeddingsHandler, prompt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to embed context: %w", err)
+		}
+		handler, err := m.fallbackVectorHandler.GetHandler(ctx, fallbackEmbedding)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get vector handler: %w", err)
+		}
+		return handler, getSearchOptions(fallback.VectorDB, fallbackEmbedding), nil
+	})
+
+	options := getSearchOptions(m.vectorHandler.dbSpec, embedding)
+	if fallback.MinResults > 1 {
+		options = append(options, vecdbtypes.WithLimit(fallback.MinResults))
+	}
+	docs, err := m.queryHandler(ctx, m.vectorHandler, handler, options...)
+	if err != nil || len(docs) == 0 {
+		return nil, nil, err
+	}
+	return docs[0], fallbackEmbedding, nil
 }
 
-func (m *semanticCacheMiddleware) getSearchOptions(ctx *aicontext.Context, embedding []float32) []vecdbtypes.HandlerSearchOption {
-	switch m.spec.SemanticCache.VectorDB.Type {
+// serveFallback serves the hit of the fallback, and copies it into the
+// primary cache. The request goes on as a miss if the hit can not be
+// decoded.
+func (m *semanticCacheMiddleware) serveFallback(ctx *aicontext.Context, prompt string, embedding, fallbackEmbedding []float32, cache map[string]any) {
+	entry := m.decodeEntry(ctx, m.fallbackVectorHandler, fallbackEmbedding, cache)
+	if entry == nil {
+		m.addInsertCacheCallback(ctx, prompt, embedding)
+		return
+	}
+	m.migrateCache(ctx, prompt, embedding, cache["id"], entry)
+	m.writeRespWithCache(ctx, entry)
+}
+
+// searchFallback returns the hit of the fallback and its ID.
+func (m *semanticCacheMiddleware) searchFallback(ctx *aicontext.Context, context string) (*semanticCacheEntry, any) {
+	embedding, err := embedQuery(ctx, m.spec.Name, m.spec.SemanticCache.Fallback.Embeddings, m.fallbackEmbeddingsHandler, context)
+	if err != nil {
+		logger.Errorf("failed to embed context for fallback semantic cache: %v", err)
+		return nil, nil
+	}
+	cache, err := m.search(ctx, m.fallbackVectorHandler, embedding)
+	if err != nil {
+		logger.Errorf("failed to search similarity in fallback vector database: %v", err)
+		return nil, nil
+	}
+	if cache == nil {
+		return nil, nil
+	}
+	return m.decodeEntry(ctx, m.fallbackVectorHandler, embedding, cache), cache["id"]
+}
+
+func getSearchOptions(dbSpec *vectordb.Spec, embedding []float32) []vecdbtypes.HandlerSearchOption {
+	switch dbSpec.Type {
 	case vectordb.TypePostgres:
 		return []vecdbtypes.HandlerSearchOption{
 			vecdbtypes.WithPostgresVectorFilterKey("embedding"),
 			vecdbtypes.WithPostgresVectorFilterValues(embedding),
-			vecdbtypes.WithScoreThreshold(float32(m.spec.SemanticCache.VectorDB.Threshold)),
+			vecdbtypes.WithScoreThreshold(float32(dbSpec.Threshold)),
 		}
 	case vectordb.TypeRedis:
 		return []vecdbtypes.HandlerSearchOption{
 			vecdbtypes.WithRedisVectorFilterKey("embedding"),
 			vecdbtypes.WithRedisVectorFilterValues(embedding),
-			vecdbtypes.WithScoreThreshold(float32(m.spec.SemanticCache.VectorDB.Threshold)),
+			vecdbtypes.WithScoreThreshold(float32(dbSpec.Threshold)),
 		}
 	default:
-		panic(fmt.Sprintf("unsupported vector db type: %s", m.spec.SemanticCache.VectorDB.Type))
+		panic(fmt.Sprintf("unsupported vector db type: %s", dbSpec.Type))
 	}
 }
 
@@ -249,9 +770,25 @@ type (
 		vectorDB    vectordb.VectorDB
 		handlerLock sync.RWMutex
 		handlers    map[string]vectordb.VectorHandler
+		// verified is when the collections of handlers are verified to
+		// exist. Handlers not verified in localTTL are verified again
+		// before use, 0 means they are verified only once.
+		verified map[string]time.Time
+		localTTL time.Duration
+		// drainFailed is whether resuming the drains failed.
+		drainFailed atomic.Bool
 	}
 )
 
+// getStructuralKey returns the index or table name of the request, the
+// caches of requests with different structures are stored separately.
+func (h *semanticCacheVectorHandler) getStructuralKey(ctx *aicontext.Context) string {
+	if h.dbSpec.Type == vectordb.TypePostgres {
+		return h.getPostgresTableName(ctx)
+	}
+	return h.getRedisDBName(ctx)
+}
+
 func (h *semanticCacheVectorHandler) getHandlerKey(ctx *aicontext.Context) string {
 	return string(ctx.RespType) + strconv.FormatBool(ctx.ReqInfo.Stream)
 }
@@ -260,7 +797,7 @@ func (h *semanticCacheVectorHandler) GetHandler(ctx *aicontext.Context, embeddin
 	key := h.getHandlerKey(ctx)
 
 	h.handlerLock.RLock()
-	if handler, exists := h.handlers[key]; exists {
+	if handler, exists := h.handlers[key]; exists && h.isFresh(key) {
 		h.handlerLock.RUnlock()
 		return handler, nil
 	}
@@ -269,18 +806,69 @@ func (h *semanticCacheVectorHandler) GetHandler(ctx *aicontext.Context, embeddin
 	h.handlerLock.Lock()
 	defer h.handlerLock.Unlock()
 	// re-check to avoid in race condition re-create the handler
-	if handler, exists := h.handlers[key]; exists {
+	handler, exists := h.handlers[key]
+	if exists && h.isFresh(key) {
 		return handler, nil
 	}
 
-	handler, err := h.vectorDB.CreateSchema(context.Background(), h.createOptions(ctx, embedding))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create index, %v", err)
+	if exists {
+		// the collection may be dropped by others, create it again.
+		if ensurer, ok := handler.(vecdbtypes.SchemaEnsurer); ok {
+			if err := ensurer.EnsureSchema(context.Background()); err != nil {
+				return nil, fmt.Errorf("failed to ensure index, %v", err)
+			}
+		}
+	} else {
+		var err error
+		handler, err = h.vectorDB.CreateSchema(context.Background(), h.createOptions(ctx, embedding))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create index, %v", err)
+		}
+		handler = vectordb.NewLimitedHandler(h.dbSpec, handler, vecdbtypes.QueryPriorityHigh)
+		handler = vectordb.NewRescoredHandler(h.dbSpec, handler)
+		handler = vectordb.NewAliasedHandler(h.dbSpec, handler)
+		if h.dbSpec.WriteLimit != nil {
+			handler = vectordb.NewQueuedHandler(h.getStructuralKey(ctx), handler, h.dbSpec.WriteLimit)
+		}
+		h.handlers[key] = handler
+	}
+	if h.verified == nil {
+		h.verified = make(map[string]time.Time)
 	}
-	h.handlers[key] = handler
+	h.verified[key] = time.Now()
 	return handler, nil
 }
 
+// close releases the write queues of the handlers, and stops their
+// background jobs.
+func (h *semanticCacheVectorHandler) close() {
+	h.handlerLock.Lock()
+	defer h.handlerLock.Unlock()
+	for _, handler := range h.handlers {
+		if closer, ok := handler.(vecdbtypes.HandlerCloser); ok {
+			closer.Close()
+		}
+	}
+}
+
+// isFresh returns whether the collection of the handler needs no
+// verification, it must be called with the lock held.
+func (h *semanticCacheVectorHandler) isFresh(key string) bool {
+	verified, ok := h.verified[key]
+	if !ok {
+		return false
+	}
+	return h.localTTL == 0 || time.Since(verified) < h.localTTL
+}
+
+// invalidate makes the collections of all handlers verified again before
+// use, since they may be dropped.
+func (h *semanticCacheVectorHandler) invalidate() {
+	h.handlerLock.Lock()
+	defer h.handlerLock.Unlock()
+	h.verified = nil
+}
+
 func (h *semanticCacheVectorHandler) createOptions(ctx *aicontext.Context, embedding []float32) vecdbtypes.Option {
 	switch h.dbSpec.Type {
 	case vectordb.TypePostgres:
@@ -301,27 +889,39 @@ func (h *semanticCacheVectorHandler) createRedisOptions(ctx *aicontext.Context,
 }
 
 func (h *semanticCacheVectorHandler) getRedisDBName(ctx *aicontext.Context) string {
-	spec := h.spec.SemanticCache.VectorDB
-	dbName := spec.CollectionName
-	switch ctx.RespType {
+	return getRedisDBName(h.dbSpec.CollectionName, ctx.RespType, ctx.ReqInfo.Stream)
+}
+
+// getRedisDBNames returns the names of all indexes of the collection.
+func getRedisDBNames(collection string) []string {
+	var names []string
+	for _, respType := range []aicontext.ResponseType{aicontext.ResponseTypeChatCompletions, aicontext.ResponseTypeCompletions} {
+		names = append(names, getRedisDBName(collection, respType, false), getRedisDBName(collection, respType, true))
+	}
+	return names
+}
+
+func getRedisDBName(collection string, respType aicontext.ResponseType, stream bool) string {
+	dbName := collection
+	switch respType {
 	case aicontext.ResponseTypeChatCompletions:
 		dbName += "_chat"
 	case aicontext.ResponseTypeCompletions:
 		dbName += "_completion"
 	default:
 		// should not reach here, check code in semanticCacheMiddleware
-		panic(fmt.Sprintf("unsupported response type: %s", ctx.RespType))
+		panic(fmt.Sprintf("unsupported response type: %s", respType))
 	}
-	if ctx.ReqInfo.Stream {
+	if stream {
 		dbName += "_stream"
 	} else {
 		dbName += "_non_stream"
 	}
-	return dbName
+	return dbName + semanticCacheMatchSuffix()
 }
 
 func (h *semanticCacheVectorHandler) createRedisSchema(dim int) vecdbtypes.Schema {
-	return &redisvector.IndexSchema{
+	schema := &redisvector.IndexSchema{
 		Vectors: []redisvector.Vector{
 			{
 				Name: "embedding",
@@ -340,8 +940,22 @@ func (h *semanticCacheVectorHandler) createRedisSchema(dim int) vecdbtypes.Schem
 			{
 				Name: "status",
 			},
+			{
+				Name: semanticCacheSchemaVersionField,
+			},
 		},
+		// the generation cost is not indexed, so it is added to the
+		// existing indexes.
+		Stored: []string{semanticCacheGenerationMsField, semanticCacheGenerationTokensField},
 	}
+	if h.dbSpec.EmbeddingVersion != "" {
+		schema.Tags = append(schema.Tags, redisvector.Tag{Name: vectordb.EmbeddingVersionField})
+	}
+	// only the entries of the primary cache are offloaded.
+	if h.spec.SemanticCache.ColdStorage != nil && h.dbSpec == h.spec.SemanticCache.VectorDB {
+		schema.Tags = append(schema.Tags, redisvector.Tag{Name: semanticCacheColdKeyField})
+	}
+	return schema
 }
 
 func (h *semanticCacheVectorHandler) createPostgresOptions(ctx *aicontext.Context, embedding []float32) vecdbtypes.Option {
@@ -352,32 +966,58 @@ func (h *semanticCacheVectorHandler) createPostgresOptions(ctx *aicontext.Contex
 }
 
 func (h *semanticCacheVectorHandler) getPostgresTableName(ctx *aicontext.Context) string {
+	return getPostgresTableName(h.dbSpec.Scope, ctx.RespType, ctx.ReqInfo.Stream)
+}
+
+// getPostgresTableNames returns the names of all tables of the cache in the
+// scope.
+func getPostgresTableNames(scope string) []string {
+	var names []string
+	for _, respType := range []aicontext.ResponseType{aicontext.ResponseTypeChatCompletions, aicontext.ResponseTypeCompletions} {
+		names = append(names, getPostgresTableName(scope, respType, false), getPostgresTableName(scope, respType, true))
+	}
+	return names
+}
+
+// getPostgresTableName returns the name of the table of the cache in the
+// scope, the tables are not named by the collection, so the scope is
+// composed here.
+func getPostgresTableName(scope string, respType aicontext.ResponseType, stream bool) string {
 	tableName := "semantic_cache"
-	switch ctx.RespType {
+	switch respType {
 	case aicontext.ResponseTypeChatCompletions:
 		tableName += "_chat"
 	case aicontext.ResponseTypeCompletions:
 		tableName += "_completion"
 	default:
 		// should not reach here, check code in semanticCacheMiddleware
-		panic(fmt.Sprintf("unsupported response type: %s", ctx.RespType))
+		panic(fmt.Sprintf("unsupported response type: %s", respType))
 	}
-	if ctx.ReqInfo.Stream {
+	if stream {
 		tableName += "_stream"
 	} else {
 		tableName += "_non_stream"
 	}
-	return tableName
+	return vecdbtypes.ScopedName(scope, tableName+semanticCacheMatchSuffix())
 }
 
 func (h *semanticCacheVectorHandler) createPostgresSchema(ctx *aicontext.Context, embedding []float32) vecdbtypes.Schema {
-	return &pgvector.TableSchema{
+	schema := &pgvector.TableSchema{
 		TableName: h.getPostgresTableName(ctx),
 		Columns: []pgvector.Column{
 			{Name: "embedding", DataType: fmt.Sprintf("vector(%d)", len(embedding))},
 			{Name: "data", DataType: "text"},
 			{Name: "header", DataType: "text"},
 			{Name: "status", DataType: "int"},
+			{Name: semanticCacheSchemaVersionField, DataType: "int"},
+			{Name: semanticCacheSourceField, DataType: "text"},
+			{Name: semanticCacheGenerationMsField, DataType: "bigint"},
+			{Name: semanticCacheGenerationTokensField, DataType: "int"},
+			{Name: semanticCachePromptField, DataType: "text"},
 		},
 	}
+	if h.dbSpec.EmbeddingVersion != "" {
+		schema.Columns = append(schema.Columns, pgvector.Column{Name: vectordb.EmbeddingVersionField, DataType: "text"})
+	}
+	return schema
 }
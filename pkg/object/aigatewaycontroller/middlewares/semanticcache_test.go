@@ -142,6 +142,171 @@ func TestSemanticCache(t *testing.T) {
 	}
 }
 
+func TestSemanticCacheIncompleteStream(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{
+					Type:           "redis",
+					Threshold:      0.99,
+					CollectionName: "redis-test",
+				},
+				Redis: &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+			},
+			ContentTemplate: semanticCacheDefaultContentTemplate,
+		},
+	}
+	db := &mockVectorDB{}
+	cache := &semanticCacheMiddleware{}
+	cache.spec = spec
+	cache.embeddingsHandler = &mockEmbeddingHandler{}
+	cache.vectorHandler = &semanticCacheVectorHandler{
+		spec:     spec,
+		dbSpec:   spec.SemanticCache.VectorDB,
+		vectorDB: db,
+		handlers: make(map[string]vectordb.VectorHandler),
+	}
+	cache.template = template.Must(template.New("").Parse(spec.SemanticCache.ContentTemplate))
+
+	jsonData := []byte(`{"model":"gpt-4.1","stream":true,"messages":[{"role":"user","content":"Hello!"}]}`)
+	providerSpec := &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"}
+	chunk := `data: {"choices":[{"index":0,"delta":{"content":"Hi"}}]}` + "\n\n"
+
+	for _, body := range []string{chunk, chunk + "data: [DONE]\n\n"} {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		setRequest(t, ctx, "stream", req)
+		aiCtx, err := aicontext.New(ctx, providerSpec)
+		assert.Nil(err)
+		cache.Handle(aiCtx)
+		assert.False(aiCtx.IsStopped())
+		for _, cb := range aiCtx.Callbacks() {
+			cb(&aicontext.FinishContext{StatusCode: http.StatusOK, RespBody: []byte(body)})
+		}
+	}
+
+	// the stream cut off is not cached.
+	assert.Len(db.data, 1)
+	assert.Contains(db.data[0]["data"], "[DONE]")
+}
+
+func TestSemanticCacheFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	newVectorDBSpec := func(collection, version string) *vectordb.Spec {
+		return &vectordb.Spec{
+			CommonSpec: vecdbtypes.CommonSpec{
+				Type:             "redis",
+				Threshold:        0.99,
+				CollectionName:   collection,
+				EmbeddingVersion: version,
+			},
+			Redis: &redisvector.RedisVectorDBSpec{
+				URL: "redis://localhost:6379",
+			},
+		}
+	}
+	embeddingSpec := &embedtypes.EmbeddingSpec{
+		ProviderType: "openai",
+		BaseURL:      "http://localhost:8080",
+		Model:        "text-embedding-3-small",
+		APIKey:       "test-api-key",
+	}
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: embeddingSpec,
+			VectorDB:   newVectorDBSpec("cache-v2", "v2"),
+			Fallback: &SemanticCacheFallbackSpec{
+				Embeddings: embeddingSpec,
+				VectorDB:   newVectorDBSpec("cache-v1", "v1"),
+			},
+		},
+	}
+	assert.Nil(ValidateSpec(spec))
+
+	primaryDB := &mockVectorDB{}
+	fallbackDB := &mockVectorDB{
+		data: []map[string]any{
+			{
+				"embedding":         embeddingString("Hello!"),
+				"data":              "cached",
+				"header":            "{}",
+				"status":            http.StatusOK,
+				"embedding_version": "v1",
+			},
+		},
+	}
+	cache := &semanticCacheMiddleware{
+		spec:              spec,
+		embeddingsHandler: &mockEmbeddingHandler{},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: primaryDB,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template:                  template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+		fallbackEmbeddingsHandler: &mockEmbeddingHandler{},
+		fallbackVectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.Fallback.VectorDB,
+			vectorDB: fallbackDB,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+	}
+
+	jsonData, err := json.Marshal(map[string]any{
+		"model":    "gpt-4.1",
+		"messages": []map[string]any{{"role": "user", "content": "Hello!"}},
+	})
+	assert.Nil(err)
+	providerSpec := &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"}
+
+	// primary misses, fallback hits and the hit is migrated into primary.
+	ctx := context.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+	assert.Nil(err)
+	setRequest(t, ctx, "fallback", req)
+	aiCtx, err := aicontext.New(ctx, providerSpec)
+	assert.Nil(err)
+	cache.Handle(aiCtx)
+	assert.True(aiCtx.IsStopped())
+	assert.Equal("cached", string(aiCtx.GetResponse().BodyBytes))
+
+	assert.Len(primaryDB.data, 1)
+	assert.Equal("v2", primaryDB.data[0][vectordb.EmbeddingVersionField])
+	assert.Equal("cached", primaryDB.data[0]["data"])
+
+	// the fallback is read too with minResults, but the hit of the primary
+	// is served and nothing is migrated again.
+	spec.SemanticCache.Fallback.MinResults = 2
+	ctx = context.New(nil)
+	req, err = http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+	assert.Nil(err)
+	setRequest(t, ctx, "dualread", req)
+	aiCtx, err = aicontext.New(ctx, providerSpec)
+	assert.Nil(err)
+	cache.Handle(aiCtx)
+	assert.True(aiCtx.IsStopped())
+	assert.Equal("cached", string(aiCtx.GetResponse().BodyBytes))
+	assert.Len(primaryDB.data, 1)
+
+	spec.SemanticCache.Fallback.MinResults = -1
+	assert.NotNil(ValidateSpec(spec))
+	spec.SemanticCache.Fallback.MinResults = 0
+
+	// same collection for primary and fallback is invalid.
+	spec.SemanticCache.Fallback.VectorDB = newVectorDBSpec("cache-v2", "v1")
+	assert.NotNil(ValidateSpec(spec))
+}
+
 func getNonStreamBody(model string) any {
 	return map[string]any{
 		"id":      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
@@ -0,0 +1,440 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/objectstore"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// semanticCacheColdKeyField is the key of the object holding the data
+	// and the header of an offloaded entry, it is empty for the entries
+	// stored in the vector database.
+	semanticCacheColdKeyField = "cold_key"
+
+	defaultColdStorageOffloadInterval   = 10 * time.Minute
+	defaultColdStorageOffloadsPerSecond = 50
+	defaultColdStorageBatchSize         = 100
+	defaultColdStorageFetchTimeout      = 2 * time.Second
+	defaultColdStorageMaxClockSkew      = 5 * time.Second
+
+	// coldStorageUpdateTimeout is the timeout of updating an entry in the
+	// vector database.
+	coldStorageUpdateTimeout = 5 * time.Second
+)
+
+type (
+	// SemanticCacheColdStorageSpec describes offloading the entries not
+	// hit for long to an S3 compatible object store. The vectors of the
+	// offloaded entries are kept in the vector database, so they are
+	// still matched, and their data and headers are fetched from the
+	// object store on hits.
+	SemanticCacheColdStorageSpec struct {
+		ObjectStore *objectstore.Spec `json:"objectStore" jsonschema:"required"`
+		// IdleAfter is how long an entry is not hit before it is offloaded.
+		IdleAfter string `json:"idleAfter" jsonschema:"required,format=duration"`
+		// Rehydrate moves the offloaded entries back to the vector
+		// database when they are hit.
+		Rehydrate bool `json:"rehydrate,omitempty"`
+		// OffloadInterval is the interval of looking for idle entries, it
+		// defaults to 10m.
+		OffloadInterval string `json:"offloadInterval,omitempty" jsonschema:"format=duration"`
+		// OffloadsPerSecond limits the rate of offloading, it defaults to
+		// 50.
+		OffloadsPerSecond int `json:"offloadsPerSecond,omitempty"`
+		// BatchSize is the max number of idle entries claimed at a time,
+		// it defaults to 100.
+		BatchSize int `json:"batchSize,omitempty"`
+		// FetchTimeout is the timeout of fetching an offloaded entry on a
+		// hit, the hit is a miss if the fetch fails, it defaults to 2s.
+		FetchTimeout string `json:"fetchTimeout,omitempty" jsonschema:"format=duration"`
+		// MaxClockSkew is the max skew tolerated between the clocks
+		// recording the hits, the entries are offloaded after idle for
+		// IdleAfter plus it, and a warning is logged if the local clock
+		// is skewed more from the vector database, it defaults to 5s.
+		MaxClockSkew string `json:"maxClockSkew,omitempty" jsonschema:"format=duration"`
+	}
+
+	// coldStorage offloads the idle entries of a semantic cache, and
+	// fetches them back on hits.
+	coldStorage struct {
+		name         string
+		spec         *SemanticCacheColdStorageSpec
+		store        *objectstore.Store
+		idleAfter    time.Duration
+		interval     time.Duration
+		fetchTimeout time.Duration
+		maxClockSkew time.Duration
+		done         chan struct{}
+		closeOnce    sync.Once
+		skewWarning  sync.Once
+
+		offloads     *prometheus.CounterVec
+		rehydrations *prometheus.CounterVec
+		fetchSeconds *prometheus.HistogramVec
+		clockSkew    *prometheus.GaugeVec
+	}
+
+	// coldEntry is the object of an offloaded entry.
+	coldEntry struct {
+		Data   string `json:"data"`
+		Header string `json:"header"`
+	}
+)
+
+func validateSemanticCacheColdStorageSpec(spec *SemanticCacheColdStorageSpec) error {
+	if spec.ObjectStore == nil {
+		return fmt.Errorf("objectStore is required")
+	}
+	if err := objectstore.ValidateSpec(spec.ObjectStore); err != nil {
+		return fmt.Errorf("invalid objectStore: %w", err)
+	}
+	if spec.IdleAfter == "" {
+		return fmt.Errorf("idleAfter is required")
+	}
+	for name, value := range map[string]string{
+		"idleAfter":       spec.IdleAfter,
+		"offloadInterval": spec.OffloadInterval,
+		"fetchTimeout":    spec.FetchTimeout,
+	} {
+		if value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(value); err != nil || v <= 0 {
+			return fmt.Errorf("invalid %s %s", name, value)
+		}
+	}
+	if spec.MaxClockSkew != "" {
+		if v, err := time.ParseDuration(spec.MaxClockSkew); err != nil || v < 0 {
+			return fmt.Errorf("invalid maxClockSkew %s", spec.MaxClockSkew)
+		}
+	}
+	if spec.OffloadsPerSecond < 0 {
+		return fmt.Errorf("offloadsPerSecond must not be negative")
+	}
+	if spec.BatchSize < 0 {
+		return fmt.Errorf("batchSize must not be negative")
+	}
+	return nil
+}
+
+func newColdStorage(name string, spec *SemanticCacheColdStorageSpec) *coldStorage {
+	s := *spec
+	if s.OffloadsPerSecond == 0 {
+		s.OffloadsPerSecond = defaultColdStorageOffloadsPerSecond
+	}
+	if s.BatchSize == 0 {
+		s.BatchSize = defaultColdStorageBatchSize
+	}
+	c := &coldStorage{
+		name:         name,
+		spec:         &s,
+		store:        objectstore.New(s.ObjectStore),
+		interval:     defaultColdStorageOffloadInterval,
+		fetchTimeout: defaultColdStorageFetchTimeout,
+		maxClockSkew: defaultColdStorageMaxClockSkew,
+		done:         make(chan struct{}),
+		offloads:     metricshub.SemanticCacheOffloads.NewCounter(),
+		rehydrations: metricshub.SemanticCacheRehydrations.NewCounter(),
+		fetchSeconds: metricshub.SemanticCacheColdFetchSeconds.NewHistogram(),
+		clockSkew:    metricshub.SemanticCacheClockSkewSeconds.NewGauge(),
+	}
+	c.idleAfter, _ = time.ParseDuration(s.IdleAfter)
+	if d, err := time.ParseDuration(s.OffloadInterval); err == nil {
+		c.interval = d
+	}
+	if d, err := time.ParseDuration(s.FetchTimeout); err == nil {
+		c.fetchTimeout = d
+	}
+	if d, err := time.ParseDuration(s.MaxClockSkew); err == nil {
+		c.maxClockSkew = d
+	}
+	return c
+}
+
+func (c *coldStorage) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "success"
+}
+
+// initColdStorage starts offloading the idle entries in background, the
+// entries are only offloaded by the members writing the cache.
+func (m *semanticCacheMiddleware) initColdStorage(spec *SemanticCacheColdStorageSpec) {
+	m.coldStorage = newColdStorage(m.spec.Name, spec)
+	if !m.spec.SemanticCache.ReadOnly {
+		go m.runOffloads()
+	}
+}
+
+// tierers returns the handlers of the cache which can tier the entries,
+// the entries are only offloaded from the indexes used since started.
+func (h *semanticCacheVectorHandler) tierers() []vecdbtypes.DocumentTierer {
+	h.handlerLock.RLock()
+	defer h.handlerLock.RUnlock()
+	var tierers []vecdbtypes.DocumentTierer
+	for _, handler := range h.handlers {
+		if tierer, ok := handler.(vecdbtypes.DocumentTierer); ok {
+			tierers = append(tierers, tierer)
+		}
+	}
+	return tierers
+}
+
+func (m *semanticCacheMiddleware) runOffloads() {
+	c := m.coldStorage
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			for _, tierer := range m.vectorHandler.tierers() {
+				m.offloadIdle(tierer)
+			}
+		}
+	}
+}
+
+// offloadIdle offloads the idle entries of the handler, at the limited rate.
+func (m *semanticCacheMiddleware) offloadIdle(tierer vecdbtypes.DocumentTierer) {
+	c := m.coldStorage
+	pace := time.NewTicker(time.Second / time.Duration(c.spec.OffloadsPerSecond))
+	defer pace.Stop()
+	for {
+		now, err := m.databaseNow(tierer)
+		if err != nil {
+			// the local clock may be skewed, so no entry is claimed.
+			logger.Errorf("semantic cache %s failed to get time of vector database: %v", m.spec.Name, err)
+			return
+		}
+		since := now.Add(-c.idleAfter - c.maxClockSkew)
+		ctx, cancel := context.WithTimeout(context.Background(), coldStorageUpdateTimeout)
+		ids, err := tierer.ClaimIdleDocuments(ctx, since, c.spec.BatchSize)
+		cancel()
+		if err != nil {
+			logger.Errorf("semantic cache %s failed to claim idle entries: %v", m.spec.Name, err)
+			return
+		}
+		for i, id := range ids {
+			select {
+			case <-c.done:
+				// give up the claimed entries, so they are offloaded
+				// after restarts.
+				m.touchEntries(tierer, ids[i:], since.Add(-time.Millisecond))
+				return
+			case <-pace.C:
+			}
+			err := m.offloadEntry(tierer, id)
+			c.offloads.WithLabelValues(m.spec.Name, resultLabel(err)).Inc()
+			if err != nil {
+				logger.Warnf("semantic cache %s failed to offload entry %s: %v", m.spec.Name, id, err)
+				// still idle, so it is offloaded again next time.
+				m.touchEntries(tierer, []string{id}, since.Add(-time.Millisecond))
+			}
+		}
+		if len(ids) < c.spec.BatchSize {
+			return
+		}
+	}
+}
+
+// databaseNow returns the current time of the vector database of the
+// tierer, which is the only clock deciding whether entries are idle. The
+// skew of the local clock is exported, and warned once if it exceeds the
+// max clock skew.
+func (m *semanticCacheMiddleware) databaseNow(tierer vecdbtypes.DocumentTierer) (time.Time, error) {
+	c := m.coldStorage
+	ctx, cancel := context.WithTimeout(context.Background(), coldStorageUpdateTimeout)
+	defer cancel()
+	start := time.Now()
+	now, err := tierer.Now(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the time of the database is read about halfway of the round trip.
+	skew := start.Add(time.Since(start) / 2).Sub(now)
+	c.clockSkew.WithLabelValues(m.spec.Name).Set(skew.Seconds())
+	if skew.Abs() > c.maxClockSkew {
+		c.skewWarning.Do(func() {
+			logger.Warnf("semantic cache %s: local clock is skewed %v from the vector database, more than the max clock skew %v",
+				m.spec.Name, skew, c.maxClockSkew)
+		})
+	}
+	return now, nil
+}
+
+// offloadEntry moves the data and the header of the entry to the object
+// store, the entries already offloaded or deleted are skipped.
+func (m *semanticCacheMiddleware) offloadEntry(tierer vecdbtypes.DocumentTierer, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), coldStorageUpdateTimeout)
+	defer cancel()
+
+	fields, err := tierer.GetDocumentFields(ctx, id, []string{"data", "header", semanticCacheColdKeyField})
+	if errors.Is(err, vecdbtypes.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fields[semanticCacheColdKeyField] != "" {
+		return nil
+	}
+
+	data, err := json.Marshal(&coldEntry{Data: fields["data"], Header: fields["header"]})
+	if err != nil {
+		return err
+	}
+	// the claimed IDs are the keys of the entries, which are unique in
+	// the vector database.
+	key := id
+	if err := m.coldStorage.store.Put(ctx, key, data); err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+	err = tierer.SetDocumentFields(ctx, id, map[string]string{
+		"data":                    "",
+		"header":                  "",
+		semanticCacheColdKeyField: key,
+	})
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, vecdbtypes.ErrNotFound) {
+		err = nil
+	}
+	// the entry is kept or deleted, the object is not needed.
+	if delErr := m.coldStorage.store.Delete(ctx, key); delErr != nil {
+		logger.Warnf("semantic cache %s failed to delete object %s: %v", m.spec.Name, key, delErr)
+	}
+	return err
+}
+
+// touchEntries records the hits of the entries at the time, which is the
+// time of the vector database if it is zero.
+func (m *semanticCacheMiddleware) touchEntries(tierer vecdbtypes.DocumentTierer, ids []string, at time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), coldStorageUpdateTimeout)
+	defer cancel()
+	if err := tierer.TouchDocuments(ctx, ids, at); err != nil {
+		logger.Warnf("semantic cache %s failed to record hits of entries: %v", m.spec.Name, err)
+	}
+}
+
+// touchEntryAfter records the hit of the entry after the request.
+func (m *semanticCacheMiddleware) touchEntryAfter(ctx *aicontext.Context, handler vectordb.VectorHandler, id string) {
+	tierer, ok := handler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return
+	}
+	ctx.AddCallBack(func(*aicontext.FinishContext) {
+		m.touchEntries(tierer, []string{id}, time.Time{})
+	})
+}
+
+// thaw returns the cache hit with its data and header fetched from the
+// object store if it is offloaded, the hit is rehydrated after the request
+// if enabled. It returns nil if the fetch fails, so the request goes on as
+// a miss.
+func (m *semanticCacheMiddleware) thaw(ctx *aicontext.Context, embedding []float32, cache map[string]any) map[string]any {
+	id := fmt.Sprint(cache["id"])
+	handler, err := m.vectorHandler.GetHandler(ctx, embedding)
+	if err != nil {
+		logger.Errorf("failed to get vector handler for semantic cache: %v", err)
+		return cache
+	}
+	m.touchEntryAfter(ctx, handler, id)
+
+	key, _ := cache[semanticCacheColdKeyField].(string)
+	if key == "" {
+		return cache
+	}
+	c := m.coldStorage
+	fetchCtx, cancel := context.WithTimeout(ctx.Req.Std().Context(), c.fetchTimeout)
+	defer cancel()
+	start := time.Now()
+	entry, err := c.fetch(fetchCtx, key)
+	c.fetchSeconds.WithLabelValues(m.spec.Name, resultLabel(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		logger.Warnf("semantic cache %s degraded to a miss, failed to fetch entry %s from cold storage: %v", m.spec.Name, id, err)
+		return nil
+	}
+
+	cache = maps.Clone(cache)
+	cache["data"] = entry.Data
+	cache["header"] = entry.Header
+	if c.spec.Rehydrate && !m.spec.SemanticCache.ReadOnly {
+		if tierer, ok := handler.(vecdbtypes.DocumentTierer); ok {
+			ctx.AddCallBack(func(*aicontext.FinishContext) {
+				err := m.rehydrate(tierer, id, key, entry)
+				c.rehydrations.WithLabelValues(m.spec.Name, resultLabel(err)).Inc()
+				if err != nil {
+					logger.Warnf("semantic cache %s failed to rehydrate entry %s: %v", m.spec.Name, id, err)
+				}
+			})
+		}
+	}
+	return cache
+}
+
+func (c *coldStorage) fetch(ctx context.Context, key string) (*coldEntry, error) {
+	data, err := c.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	entry := &coldEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("invalid object %s: %w", key, err)
+	}
+	return entry, nil
+}
+
+// rehydrate moves the data and the header of the entry back to the vector
+// database, and deletes the object.
+func (m *semanticCacheMiddleware) rehydrate(tierer vecdbtypes.DocumentTierer, id, key string, entry *coldEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), coldStorageUpdateTimeout)
+	defer cancel()
+	err := tierer.SetDocumentFields(ctx, id, map[string]string{
+		"data":                    entry.Data,
+		"header":                  entry.Header,
+		semanticCacheColdKeyField: "",
+	})
+	if err != nil && !errors.Is(err, vecdbtypes.ErrNotFound) {
+		return err
+	}
+	return m.coldStorage.store.Delete(ctx, key)
+}
@@ -0,0 +1,361 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/objectstore"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// tieringVectorDB is a mockVectorDB which tracks the hits of documents and
+// updates their fields by the id field, its clock is skewed by skew from
+// the local clock.
+type tieringVectorDB struct {
+	mockVectorDB
+	lock sync.Mutex
+	hits map[string]time.Time
+	skew time.Duration
+}
+
+func (db *tieringVectorDB) CreateSchema(ctx stdcontext.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	return db, nil
+}
+
+func (db *tieringVectorDB) find(id string) map[string]any {
+	for _, doc := range db.data {
+		if doc["id"] == id {
+			return doc
+		}
+	}
+	return nil
+}
+
+func (db *tieringVectorDB) Now(ctx stdcontext.Context) (time.Time, error) {
+	return time.Now().Add(db.skew), nil
+}
+
+func (db *tieringVectorDB) TouchDocuments(ctx stdcontext.Context, ids []string, at time.Time) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if at.IsZero() {
+		at = time.Now().Add(db.skew)
+	}
+	for _, id := range ids {
+		db.hits[id] = at
+	}
+	return nil
+}
+
+func (db *tieringVectorDB) ClaimIdleDocuments(ctx stdcontext.Context, since time.Time, limit int) ([]string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	var ids []string
+	for id, at := range db.hits {
+		if at.Before(since) && len(ids) < limit {
+			ids = append(ids, id)
+			delete(db.hits, id)
+		}
+	}
+	return ids, nil
+}
+
+func (db *tieringVectorDB) GetDocumentFields(ctx stdcontext.Context, id string, fields []string) (map[string]string, error) {
+	doc := db.find(id)
+	if doc == nil {
+		return nil, vecdbtypes.NewError(vecdbtypes.ErrNotFound, fmt.Errorf("document %s not found", id))
+	}
+	result := map[string]string{}
+	for _, field := range fields {
+		if v, ok := doc[field]; ok {
+			result[field] = fmt.Sprint(v)
+		}
+	}
+	return result, nil
+}
+
+func (db *tieringVectorDB) SetDocumentFields(ctx stdcontext.Context, id string, fields map[string]string) error {
+	doc := db.find(id)
+	if doc == nil {
+		return vecdbtypes.NewError(vecdbtypes.ErrNotFound, fmt.Errorf("document %s not found", id))
+	}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	return nil
+}
+
+func TestSemanticCacheColdStorageValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	newSpec := func(coldStorage *SemanticCacheColdStorageSpec) *MiddlewareSpec {
+		return &MiddlewareSpec{
+			Name: "test-semantic-cache",
+			Kind: semanticCacheMiddlewareKind,
+			SemanticCache: &SemanticCacheSpec{
+				Embeddings: &embedtypes.EmbeddingSpec{
+					ProviderType: "openai",
+					BaseURL:      "http://localhost:8080",
+					Model:        "text-embedding-3-small",
+					APIKey:       "test-api-key",
+				},
+				VectorDB: &vectordb.Spec{
+					CommonSpec: vecdbtypes.CommonSpec{Type: "redis", Threshold: 0.99, CollectionName: "cache"},
+					Redis:      &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+				},
+				ColdStorage: coldStorage,
+			},
+		}
+	}
+	store := &objectstore.Spec{Endpoint: "http://localhost:9000", Bucket: "cache"}
+
+	assert.NoError(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store, IdleAfter: "24h"})))
+	assert.Error(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{IdleAfter: "24h"})))
+	assert.Error(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store})))
+	assert.Error(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store, IdleAfter: "0s"})))
+	assert.Error(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store, IdleAfter: "24h", FetchTimeout: "x"})))
+	assert.Error(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store, IdleAfter: "24h", BatchSize: -1})))
+	assert.NoError(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store, IdleAfter: "24h", MaxClockSkew: "0s"})))
+	assert.Error(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store, IdleAfter: "24h", MaxClockSkew: "-1s"})))
+	assert.Error(ValidateSpec(newSpec(&SemanticCacheColdStorageSpec{ObjectStore: &objectstore.Spec{Bucket: "cache"}, IdleAfter: "24h"})))
+
+	spec := newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store, IdleAfter: "24h"})
+	spec.SemanticCache.VectorDB.PayloadStore = &vecdbtypes.PayloadStoreSpec{}
+	assert.Error(ValidateSpec(spec))
+
+	spec = newSpec(&SemanticCacheColdStorageSpec{ObjectStore: store, IdleAfter: "24h"})
+	spec.SemanticCache.VectorDB.Redis.IndexType = "JSON"
+	assert.Error(ValidateSpec(spec))
+}
+
+func TestSemanticCacheColdStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		lock    sync.Mutex
+		objects = map[string][]byte{}
+		down    bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{Type: "redis", Threshold: 0.99, CollectionName: "cache"},
+				Redis:      &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+			},
+			ColdStorage: &SemanticCacheColdStorageSpec{
+				ObjectStore:       &objectstore.Spec{Endpoint: server.URL, Bucket: "cache"},
+				IdleAfter:         "1h",
+				Rehydrate:         true,
+				OffloadsPerSecond: 1000,
+			},
+		},
+	}
+	db := &tieringVectorDB{hits: map[string]time.Time{}}
+	cache := &semanticCacheMiddleware{
+		spec:              spec,
+		embeddingsHandler: &mockEmbeddingHandler{},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template:    template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+		coldStorage: newColdStorage(spec.Name, spec.SemanticCache.ColdStorage),
+	}
+	defer cache.Close()
+
+	jsonData := []byte(`{"model":"gpt-4.1","messages":[{"role":"user","content":"Hello!"}]}`)
+	handle := func() *aicontext.Context {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		setRequest(t, ctx, "cold", req)
+		aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+		assert.Nil(err)
+		cache.Handle(aiCtx)
+		for _, cb := range aiCtx.Callbacks() {
+			cb(&aicontext.FinishContext{StatusCode: http.StatusOK, RespBody: []byte("fresh")})
+		}
+		return aiCtx
+	}
+	offload := func() {
+		for _, tierer := range cache.vectorHandler.tierers() {
+			cache.offloadIdle(tierer)
+		}
+	}
+
+	// the inserted entry is tracked with an explicit ID.
+	aiCtx := handle()
+	assert.False(aiCtx.IsStopped())
+	assert.Len(db.data, 1)
+	id, _ := db.data[0]["id"].(string)
+	assert.NotEmpty(id)
+	assert.Contains(db.hits, id)
+
+	// the entries hit recently are kept.
+	offload()
+	assert.Empty(objects)
+	assert.Equal("fresh", db.data[0]["data"])
+
+	// the idle entries are offloaded, but their vectors are kept.
+	db.hits[id] = time.Now().Add(-2 * time.Hour)
+	offload()
+	assert.Len(objects, 1)
+	assert.Contains(objects, "/cache/"+id)
+	assert.Equal("", db.data[0]["data"])
+	assert.Equal(id, db.data[0][semanticCacheColdKeyField])
+	assert.NotContains(db.hits, id)
+	assert.NotNil(db.data[0]["embedding"])
+
+	// an outage of the object store degrades the hits to misses.
+	down = true
+	aiCtx = handle()
+	assert.False(aiCtx.IsStopped())
+	assert.Len(db.data, 2)
+	db.data = db.data[:1]
+	down = false
+
+	// the offloaded entries are fetched on hits and rehydrated.
+	aiCtx = handle()
+	assert.True(aiCtx.IsStopped())
+	assert.Equal("fresh", string(aiCtx.GetResponse().BodyBytes))
+	assert.Equal("fresh", db.data[0]["data"])
+	assert.Equal("", db.data[0][semanticCacheColdKeyField])
+	assert.Empty(objects)
+	assert.Contains(db.hits, id)
+
+	// the entries failed to offload are offloaded again next time.
+	db.hits[id] = time.Now().Add(-2 * time.Hour)
+	down = true
+	offload()
+	assert.Equal("fresh", db.data[0]["data"])
+	assert.Contains(db.hits, id)
+	down = false
+	offload()
+	assert.Equal("", db.data[0]["data"])
+	assert.Len(objects, 1)
+}
+
+func TestSemanticCacheColdStorageClockSkew(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		lock    sync.Mutex
+		objects = map[string][]byte{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Method == http.MethodPut {
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		}
+	}))
+	defer server.Close()
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache-skew",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			ColdStorage: &SemanticCacheColdStorageSpec{
+				ObjectStore:       &objectstore.Spec{Endpoint: server.URL, Bucket: "cache"},
+				IdleAfter:         "1h",
+				OffloadsPerSecond: 1000,
+				MaxClockSkew:      "1m",
+			},
+		},
+	}
+	cache := &semanticCacheMiddleware{
+		spec:        spec,
+		coldStorage: newColdStorage(spec.Name, spec.SemanticCache.ColdStorage),
+	}
+	defer cache.coldStorage.close()
+
+	// the clock of the local member is 2h ahead of the database, which is
+	// longer than idleAfter.
+	db := &tieringVectorDB{hits: map[string]time.Time{}, skew: -2 * time.Hour}
+	db.data = []map[string]any{{"id": "fresh", "data": "a"}, {"id": "edge", "data": "b"}, {"id": "idle", "data": "c"}}
+	skew := testutil.ToFloat64(cache.coldStorage.clockSkew.WithLabelValues(spec.Name))
+	assert.Zero(skew)
+
+	// the hits are recorded by the clock of the database, so the entries
+	// hit just now are not idle for the skewed member.
+	cache.touchEntries(db, []string{"fresh"}, time.Time{})
+	// the entries idle for less than idleAfter plus the max clock skew are
+	// kept, so the skew between the clocks of the database is tolerated.
+	now, _ := db.Now(stdcontext.Background())
+	db.hits["edge"] = now.Add(-time.Hour - 30*time.Second)
+	db.hits["idle"] = now.Add(-time.Hour - 2*time.Minute)
+
+	for i := 0; i < 3; i++ {
+		cache.offloadIdle(db)
+		assert.Contains(db.hits, "fresh")
+		assert.Contains(db.hits, "edge")
+		assert.NotContains(db.hits, "idle")
+	}
+	assert.Equal("a", db.data[0]["data"])
+	assert.Equal("b", db.data[1]["data"])
+	assert.Equal("", db.data[2]["data"])
+	assert.Len(objects, 1)
+
+	skew = testutil.ToFloat64(cache.coldStorage.clockSkew.WithLabelValues(spec.Name))
+	assert.InDelta((2 * time.Hour).Seconds(), skew, 1)
+}
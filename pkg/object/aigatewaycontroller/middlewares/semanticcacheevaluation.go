@@ -0,0 +1,597 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+// Methods comparing the cached responses with the fresh generations.
+const (
+	EvaluationMethodEmbedding = "embedding"
+	EvaluationMethodJudge     = "judge"
+)
+
+const (
+	defaultEvaluationAgreement      = 0.8
+	defaultEvaluationBucketWidth    = 0.05
+	defaultEvaluationMaxConcurrency = 4
+	defaultEvaluationTimeout        = time.Minute
+
+	evaluationJudgePath   = "/v1/chat/completions"
+	evaluationJudgePrompt = `You compare two answers to the same request. Score how equivalent they are in meaning and correctness, 1 means the answers are interchangeable and 0 means they disagree completely.
+Reply with a JSON object only, like {"score": 0.9}.`
+)
+
+// ErrEvaluationDisabled means the evaluation of the middleware is not
+// enabled.
+var ErrEvaluationDisabled = errors.New("evaluation is not enabled")
+
+type (
+	// SemanticCacheEvaluationSpec describes evaluating the cache hits by
+	// comparing them with fresh generations of the provider in background.
+	SemanticCacheEvaluationSpec struct {
+		// SampleRate is the ratio of the cache hits evaluated.
+		SampleRate float64 `json:"sampleRate" jsonschema:"required"`
+		// Method compares the responses, embedding compares their
+		// embeddings by the embeddings of the cache, judge asks an LLM.
+		Method string                  `json:"method" jsonschema:"required,enum=embedding,enum=judge"`
+		Judge  *SemanticCacheJudgeSpec `json:"judge,omitempty"`
+		// Agreement is the lowest score of agreeing responses, the results
+		// are fed to the threshold tuning as feedback if it is enabled.
+		Agreement float64 `json:"agreement,omitempty"`
+		// BucketWidth is the width of the similarity score buckets of the
+		// cache hits in the report.
+		BucketWidth float64 `json:"bucketWidth,omitempty"`
+		// MaxConcurrency is the max number of evaluations in progress, the
+		// sampled hits are skipped beyond it.
+		MaxConcurrency int    `json:"maxConcurrency,omitempty"`
+		Timeout        string `json:"timeout,omitempty" jsonschema:"format=duration"`
+	}
+
+	// SemanticCacheJudgeSpec is the OpenAI compatible chat API judging
+	// the agreement of responses.
+	SemanticCacheJudgeSpec struct {
+		BaseURL string `json:"baseURL" jsonschema:"required"`
+		APIKey  string `json:"apiKey,omitempty"`
+		Model   string `json:"model" jsonschema:"required"`
+	}
+
+	// EvaluationReport is the agreement of the evaluated cache hits with
+	// the fresh generations.
+	EvaluationReport struct {
+		SampleRate float64 `json:"sampleRate"`
+		Method     string  `json:"method"`
+		Agreement  float64 `json:"agreement"`
+		EvaluationStats
+		// Failed are the evaluations failed to generate or compare, and
+		// Skipped are the sampled hits beyond the max concurrency.
+		Failed  int64                   `json:"failed"`
+		Skipped int64                   `json:"skipped"`
+		Models  []*ModelEvaluationStats `json:"models"`
+		Buckets []*ScoreEvaluationStats `json:"buckets"`
+	}
+
+	// EvaluationStats is the statistics of evaluated cache hits.
+	EvaluationStats struct {
+		Evaluated int64 `json:"evaluated"`
+		Agreed    int64 `json:"agreed"`
+		// MeanScore is the mean agreement score.
+		MeanScore float64 `json:"meanScore"`
+	}
+
+	// ModelEvaluationStats is the statistics of the hits of a model.
+	ModelEvaluationStats struct {
+		Model string `json:"model"`
+		EvaluationStats
+	}
+
+	// ScoreEvaluationStats is the statistics of the hits with similarity
+	// scores in [From, To).
+	ScoreEvaluationStats struct {
+		From float64 `json:"from"`
+		To   float64 `json:"to"`
+		EvaluationStats
+	}
+
+	evaluationCounter struct {
+		evaluated int64
+		agreed    int64
+		scoreSum  float64
+	}
+
+	// evaluationTask is a cache hit to evaluate.
+	evaluationTask struct {
+		requestID string
+		provider  string
+		model     string
+		respType  aicontext.ResponseType
+		// body is the request without streaming.
+		body   []byte
+		prompt string
+		cached string
+		score  float64
+	}
+
+	// cacheEvaluator compares the cache hits with fresh generations. It is
+	// reset when the middleware is re-created.
+	cacheEvaluator struct {
+		name    string
+		spec    *SemanticCacheEvaluationSpec
+		timeout time.Duration
+		slots   chan struct{}
+		// compare returns the agreement score of two responses.
+		compare func(ctx context.Context, prompt string, a string, b string) (float64, error)
+		// feedback is called with the results of the hits, it is nil if
+		// the threshold tuning is not enabled.
+		feedback func(requestID string, agreed bool)
+
+		generatorLock sync.RWMutex
+		generator     Generator
+
+		lock    sync.Mutex
+		total   evaluationCounter
+		failed  int64
+		skipped int64
+		models  map[string]*evaluationCounter
+		buckets []evaluationCounter
+
+		scores  *prometheus.HistogramVec
+		results *prometheus.CounterVec
+	}
+)
+
+func validateSemanticCacheEvaluationSpec(spec *SemanticCacheEvaluationSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.SampleRate <= 0 || spec.SampleRate > 1 {
+		return fmt.Errorf("sampleRate must be in (0, 1]")
+	}
+	switch spec.Method {
+	case EvaluationMethodEmbedding:
+	case EvaluationMethodJudge:
+		if spec.Judge == nil || spec.Judge.BaseURL == "" || spec.Judge.Model == "" {
+			return fmt.Errorf("judge with baseURL and model is required by the judge method")
+		}
+	default:
+		return fmt.Errorf("unknown method %s", spec.Method)
+	}
+	if spec.Agreement < 0 || spec.Agreement > 1 {
+		return fmt.Errorf("agreement must be in [0, 1]")
+	}
+	if spec.BucketWidth < 0 || spec.BucketWidth > 0.5 {
+		return fmt.Errorf("bucketWidth must be in (0, 0.5]")
+	}
+	if spec.MaxConcurrency < 0 {
+		return fmt.Errorf("maxConcurrency cannot be negative")
+	}
+	if spec.Timeout != "" {
+		if v, err := time.ParseDuration(spec.Timeout); err != nil || v <= 0 {
+			return fmt.Errorf("invalid timeout %s", spec.Timeout)
+		}
+	}
+	return nil
+}
+
+func newCacheEvaluator(name string, spec *SemanticCacheEvaluationSpec) *cacheEvaluator {
+	s := *spec
+	if s.Agreement == 0 {
+		s.Agreement = defaultEvaluationAgreement
+	}
+	if s.BucketWidth == 0 {
+		s.BucketWidth = defaultEvaluationBucketWidth
+	}
+	if s.MaxConcurrency == 0 {
+		s.MaxConcurrency = defaultEvaluationMaxConcurrency
+	}
+	e := &cacheEvaluator{
+		name:    name,
+		spec:    &s,
+		timeout: defaultEvaluationTimeout,
+		slots:   make(chan struct{}, s.MaxConcurrency),
+		models:  map[string]*evaluationCounter{},
+		buckets: make([]evaluationCounter, int(math.Ceil(1/s.BucketWidth))),
+		scores:  metricshub.SemanticCacheAgreement.NewHistogram(),
+		results: metricshub.SemanticCacheEvaluations.NewCounter(),
+	}
+	if d, err := time.ParseDuration(s.Timeout); err == nil {
+		e.timeout = d
+	}
+	if s.Method == EvaluationMethodJudge {
+		e.compare = func(ctx context.Context, prompt string, a string, b string) (float64, error) {
+			return judgeAgreement(ctx, s.Judge, prompt, a, b)
+		}
+	}
+	return e
+}
+
+func (e *cacheEvaluator) setGenerator(generator Generator) {
+	e.generatorLock.Lock()
+	defer e.generatorLock.Unlock()
+	e.generator = generator
+}
+
+func (e *cacheEvaluator) getGenerator() Generator {
+	e.generatorLock.RLock()
+	defer e.generatorLock.RUnlock()
+	return e.generator
+}
+
+// sample decides whether a cache hit is evaluated.
+func (e *cacheEvaluator) sample() bool {
+	return rand.Float64() < e.spec.SampleRate
+}
+
+// submit evaluates the task in background, it is skipped if there are too
+// many evaluations in progress.
+func (e *cacheEvaluator) submit(task *evaluationTask) {
+	select {
+	case e.slots <- struct{}{}:
+	default:
+		e.lock.Lock()
+		e.skipped++
+		e.lock.Unlock()
+		e.results.WithLabelValues(e.name, "skipped").Inc()
+		return
+	}
+	go func() {
+		defer func() { <-e.slots }()
+		e.evaluate(task)
+	}()
+}
+
+// evaluate generates a fresh response of the task and compares it with
+// the cached one.
+func (e *cacheEvaluator) evaluate(task *evaluationTask) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	score, err := func() (float64, error) {
+		generator := e.getGenerator()
+		if generator == nil {
+			return 0, fmt.Errorf("no generator")
+		}
+		fresh, err := generator.Generate(ctx, task.provider, task.respType, task.body)
+		if err != nil {
+			return 0, fmt.Errorf("failed to generate: %w", err)
+		}
+		score, err := e.compare(ctx, task.prompt, task.cached, responseText(fresh))
+		if err != nil {
+			return 0, fmt.Errorf("failed to compare: %w", err)
+		}
+		return min(max(score, 0), 1), nil
+	}()
+	if err != nil {
+		logger.Errorf("failed to evaluate cache hit of semantic cache %s: %v", e.name, err)
+		e.lock.Lock()
+		e.failed++
+		e.lock.Unlock()
+		e.results.WithLabelValues(e.name, "failed").Inc()
+		return
+	}
+	e.record(task, score)
+}
+
+func (e *cacheEvaluator) bucketIndex(score float64) int {
+	i := int(score / e.spec.BucketWidth)
+	return max(0, min(i, len(e.buckets)-1))
+}
+
+func (c *evaluationCounter) add(score float64, agreed bool) {
+	c.evaluated++
+	c.scoreSum += score
+	if agreed {
+		c.agreed++
+	}
+}
+
+func (c *evaluationCounter) stats() EvaluationStats {
+	stats := EvaluationStats{Evaluated: c.evaluated, Agreed: c.agreed}
+	if c.evaluated > 0 {
+		stats.MeanScore = c.scoreSum / float64(c.evaluated)
+	}
+	return stats
+}
+
+// record records the agreement score of a cache hit.
+func (e *cacheEvaluator) record(task *evaluationTask, score float64) {
+	agreed := score >= e.spec.Agreement
+	i := e.bucketIndex(task.score)
+
+	e.lock.Lock()
+	e.total.add(score, agreed)
+	counter := e.models[task.model]
+	if counter == nil {
+		counter = &evaluationCounter{}
+		e.models[task.model] = counter
+	}
+	counter.add(score, agreed)
+	e.buckets[i].add(score, agreed)
+	e.lock.Unlock()
+
+	bucket := strconv.FormatFloat(roundThreshold(float64(i)*e.spec.BucketWidth), 'f', -1, 64)
+	e.scores.WithLabelValues(e.name, task.model, bucket).Observe(score)
+	result := "disagreed"
+	if agreed {
+		result = "agreed"
+	}
+	e.results.WithLabelValues(e.name, result).Inc()
+	if e.feedback != nil && task.requestID != "" {
+		e.feedback(task.requestID, agreed)
+	}
+}
+
+func (e *cacheEvaluator) report() *EvaluationReport {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	report := &EvaluationReport{
+		SampleRate:      e.spec.SampleRate,
+		Method:          e.spec.Method,
+		Agreement:       e.spec.Agreement,
+		EvaluationStats: e.total.stats(),
+		Failed:          e.failed,
+		Skipped:         e.skipped,
+		Models:          []*ModelEvaluationStats{},
+		Buckets:         []*ScoreEvaluationStats{},
+	}
+	for model, c := range e.models {
+		report.Models = append(report.Models, &ModelEvaluationStats{Model: model, EvaluationStats: c.stats()})
+	}
+	sort.Slice(report.Models, func(i, j int) bool {
+		return report.Models[i].Model < report.Models[j].Model
+	})
+	for i := range e.buckets {
+		if e.buckets[i].evaluated == 0 {
+			continue
+		}
+		report.Buckets = append(report.Buckets, &ScoreEvaluationStats{
+			From:            roundThreshold(float64(i) * e.spec.BucketWidth),
+			To:              roundThreshold(math.Min(1, float64(i+1)*e.spec.BucketWidth)),
+			EvaluationStats: e.buckets[i].stats(),
+		})
+	}
+	return report
+}
+
+// embeddingAgreement returns the cosine similarity of the embeddings of
+// the responses.
+func embeddingAgreement(embed func(text string) ([]float32, error), a string, b string) (float64, error) {
+	va, err := embed(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := embed(b)
+	if err != nil {
+		return 0, err
+	}
+	if len(va) != len(vb) {
+		return 0, fmt.Errorf("dimensions of embeddings mismatch: %d and %d", len(va), len(vb))
+	}
+	var dot, na, nb float64
+	for i := range va {
+		dot += float64(va[i]) * float64(vb[i])
+		na += float64(va[i]) * float64(va[i])
+		nb += float64(vb[i]) * float64(vb[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0, nil
+	}
+	return dot / math.Sqrt(na*nb), nil
+}
+
+// judgeAgreement asks the judge to score the agreement of the responses.
+func judgeAgreement(ctx context.Context, spec *SemanticCacheJudgeSpec, prompt string, a string, b string) (float64, error) {
+	reqBody, err := json.Marshal(map[string]any{
+		"model":       spec.Model,
+		"temperature": 0,
+		"stream":      false,
+		"messages": []map[string]any{
+			{"role": "system", "content": evaluationJudgePrompt},
+			{"role": "user", "content": fmt.Sprintf("Request:\n%s\n\nAnswer A:\n%s\n\nAnswer B:\n%s", prompt, a, b)},
+		},
+		"response_format": map[string]any{"type": "json_object"},
+	})
+	if err != nil {
+		return 0, err
+	}
+	u, err := url.JoinPath(spec.BaseURL, evaluationJudgePath)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(reqBody))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if spec.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+spec.APIKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("judge responds %d: %s", resp.StatusCode, body)
+	}
+
+	var chat struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &chat); err != nil {
+		return 0, err
+	}
+	if len(chat.Choices) == 0 {
+		return 0, fmt.Errorf("judge response has no choices")
+	}
+	content := strings.TrimSpace(chat.Choices[0].Message.Content)
+	content = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(content, "```json"), "```"), "```")
+	var judged struct {
+		Score *float64 `json:"score"`
+	}
+	if err := json.Unmarshal([]byte(content), &judged); err != nil || judged.Score == nil {
+		return 0, fmt.Errorf("failed to parse judge score %q", content)
+	}
+	return *judged.Score, nil
+}
+
+// responseText returns the text of the first choice of a chat completions
+// or completions response, which is streaming or not.
+func responseText(body []byte) string {
+	type choice struct {
+		Index   int    `json:"index"`
+		Text    string `json:"text"`
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	}
+	type response struct {
+		Choices []choice `json:"choices"`
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("data:")) {
+		var resp response
+		if err := json.Unmarshal(trimmed, &resp); err != nil || len(resp.Choices) == 0 {
+			return ""
+		}
+		return resp.Choices[0].Message.Content + resp.Choices[0].Text
+	}
+
+	var sb strings.Builder
+	for _, event := range bytes.Split(trimmed, []byte("\n\n")) {
+		data, ok := sseEventData(event)
+		if !ok {
+			continue
+		}
+		var resp response
+		if err := json.Unmarshal(data, &resp); err != nil {
+			continue
+		}
+		for _, c := range resp.Choices {
+			if c.Index == 0 {
+				sb.WriteString(c.Delta.Content)
+				sb.WriteString(c.Text)
+			}
+		}
+	}
+	return sb.String()
+}
+
+func (m *semanticCacheMiddleware) initEvaluation(spec *SemanticCacheEvaluationSpec) {
+	e := newCacheEvaluator(m.spec.Name, spec)
+	if e.compare == nil {
+		e.compare = func(_ context.Context, _ string, a string, b string) (float64, error) {
+			return embeddingAgreement(m.embeddingsHandler.EmbedDocuments, a, b)
+		}
+	}
+	if m.tuner != nil {
+		// the results are the feedback of the hits, the feedback from
+		// clients on the evaluated hits is rejected as a duplicate then.
+		e.feedback = func(requestID string, agreed bool) {
+			m.tuner.feedback(&Feedback{RequestID: requestID, Correct: agreed}, time.Now())
+		}
+	}
+	m.evaluator = e
+}
+
+// evaluateHit samples the cache hit served to the request, and evaluates
+// it in background. The response and the request are not changed.
+func (m *semanticCacheMiddleware) evaluateHit(ctx *aicontext.Context, prompt string, cache map[string]any, score float64) {
+	if ctx.Provider == nil || !m.evaluator.sample() {
+		return
+	}
+	data, _ := cache["data"].(string)
+	req := make(map[string]any, len(ctx.OpenAIReq))
+	for k, v := range ctx.OpenAIReq {
+		req[k] = v
+	}
+	req["stream"] = false
+	delete(req, "stream_options")
+	body, err := json.Marshal(req)
+	if err != nil {
+		logger.Errorf("failed to marshal request to evaluate semantic cache %s: %v", m.spec.Name, err)
+		return
+	}
+	task := &evaluationTask{
+		provider: ctx.Provider.Name,
+		respType: ctx.RespType,
+		body:     body,
+		prompt:   prompt,
+		cached:   responseText([]byte(data)),
+		score:    score,
+	}
+	task.model, _ = ctx.OpenAIReq["model"].(string)
+	if resp := ctx.GetResponse(); resp != nil {
+		task.requestID = resp.Header.Get(semanticCacheRequestIDHeader)
+	}
+	m.evaluator.submit(task)
+}
+
+var (
+	_ GeneratorSetter = (*semanticCacheMiddleware)(nil)
+	_ Evaluator       = (*semanticCacheMiddleware)(nil)
+)
+
+// SetGenerator sets the generator of the fresh responses of evaluations.
+func (m *semanticCacheMiddleware) SetGenerator(generator Generator) {
+	if m.evaluator != nil {
+		m.evaluator.setGenerator(generator)
+	}
+}
+
+// EvaluationReport returns the agreement of the evaluated cache hits.
+func (m *semanticCacheMiddleware) EvaluationReport() (*EvaluationReport, error) {
+	if m.evaluator == nil {
+		return nil, ErrEvaluationDisabled
+	}
+	return m.evaluator.report(), nil
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// mockGenerator returns the response of the model in the request.
+type mockGenerator struct {
+	lock      sync.Mutex
+	responses map[string]string
+	requests  []map[string]any
+}
+
+func (g *mockGenerator) Generate(_ context.Context, provider string, respType aicontext.ResponseType, body []byte) ([]byte, error) {
+	req := map[string]any{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	req["provider"] = provider
+	req["respType"] = string(respType)
+	g.lock.Lock()
+	g.requests = append(g.requests, req)
+	g.lock.Unlock()
+	content, ok := g.responses[req["model"].(string)]
+	if !ok {
+		return nil, fmt.Errorf("unknown model")
+	}
+	return json.Marshal(map[string]any{
+		"choices": []map[string]any{{"message": map[string]any{"role": "assistant", "content": content}}},
+	})
+}
+
+func TestValidateSemanticCacheEvaluationSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateSemanticCacheEvaluationSpec(nil))
+	assert.NoError(validateSemanticCacheEvaluationSpec(&SemanticCacheEvaluationSpec{SampleRate: 0.01, Method: EvaluationMethodEmbedding}))
+	assert.NoError(validateSemanticCacheEvaluationSpec(&SemanticCacheEvaluationSpec{
+		SampleRate: 1, Method: EvaluationMethodJudge,
+		Judge: &SemanticCacheJudgeSpec{BaseURL: "http://localhost:8080", Model: "gpt-4o-mini"},
+	}))
+	assert.Error(validateSemanticCacheEvaluationSpec(&SemanticCacheEvaluationSpec{Method: EvaluationMethodEmbedding}))
+	assert.Error(validateSemanticCacheEvaluationSpec(&SemanticCacheEvaluationSpec{SampleRate: 1.5, Method: EvaluationMethodEmbedding}))
+	assert.Error(validateSemanticCacheEvaluationSpec(&SemanticCacheEvaluationSpec{SampleRate: 0.1, Method: "exact"}))
+	assert.Error(validateSemanticCacheEvaluationSpec(&SemanticCacheEvaluationSpec{SampleRate: 0.1, Method: EvaluationMethodJudge}))
+	assert.Error(validateSemanticCacheEvaluationSpec(&SemanticCacheEvaluationSpec{SampleRate: 0.1, Method: EvaluationMethodEmbedding, Timeout: "1x"}))
+	assert.Error(validateSemanticCacheEvaluationSpec(&SemanticCacheEvaluationSpec{SampleRate: 0.1, Method: EvaluationMethodEmbedding, BucketWidth: 0.8}))
+}
+
+func TestResponseText(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("hello", responseText([]byte(`{"choices":[{"message":{"role":"assistant","content":"hello"}}]}`)))
+	assert.Equal("hello", responseText([]byte(`{"choices":[{"text":"hello"}]}`)))
+	stream := "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\"}}]}\n\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hel\"}}]}\n\n" +
+		"data: {\"choices\":[{\"index\":1,\"delta\":{\"content\":\"other\"}}]}\n\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo\"}}]}\n\n" +
+		"data: [DONE]\n\n"
+	assert.Equal("hello", responseText([]byte(stream)))
+	assert.Equal("", responseText([]byte("not json")))
+}
+
+func TestCacheEvaluatorReport(t *testing.T) {
+	assert := assert.New(t)
+
+	var feedback []string
+	e := newCacheEvaluator("cache", &SemanticCacheEvaluationSpec{SampleRate: 1, Method: EvaluationMethodEmbedding, BucketWidth: 0.1})
+	e.feedback = func(requestID string, agreed bool) {
+		feedback = append(feedback, fmt.Sprintf("%s:%v", requestID, agreed))
+	}
+	e.record(&evaluationTask{requestID: "1", model: "gpt-4o", score: 0.95}, 0.9)
+	e.record(&evaluationTask{requestID: "2", model: "gpt-4o", score: 0.91}, 0.5)
+	e.record(&evaluationTask{model: "gpt-4.1", score: 0.85}, 1)
+
+	report := e.report()
+	assert.Equal(int64(3), report.Evaluated)
+	assert.Equal(int64(2), report.Agreed)
+	assert.InDelta(0.8, report.MeanScore, 1e-9)
+	assert.Equal([]string{"1:true", "2:false"}, feedback)
+
+	assert.Len(report.Models, 2)
+	assert.Equal("gpt-4.1", report.Models[0].Model)
+	assert.Equal(int64(1), report.Models[0].Agreed)
+	assert.Equal("gpt-4o", report.Models[1].Model)
+	assert.InDelta(0.7, report.Models[1].MeanScore, 1e-9)
+
+	assert.Len(report.Buckets, 2)
+	assert.Equal(0.8, report.Buckets[0].From)
+	assert.Equal(0.9, report.Buckets[0].To)
+	assert.Equal(int64(1), report.Buckets[0].Evaluated)
+	assert.Equal(0.9, report.Buckets[1].From)
+	assert.Equal(1.0, report.Buckets[1].To)
+	assert.Equal(int64(2), report.Buckets[1].Evaluated)
+
+	// sampled hits are skipped when all slots are taken.
+	for i := 0; i < cap(e.slots); i++ {
+		e.slots <- struct{}{}
+	}
+	e.submit(&evaluationTask{})
+	assert.Equal(int64(1), e.report().Skipped)
+}
+
+func TestJudgeAgreement(t *testing.T) {
+	assert := assert.New(t)
+
+	var judged map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/chat/completions", r.URL.Path)
+		assert.Equal("Bearer key", r.Header.Get("Authorization"))
+		json.NewDecoder(r.Body).Decode(&judged)
+		w.Write([]byte(`{"choices":[{"message":{"content":"` + "```json\\n{\\\"score\\\": 0.75}\\n```" + `"}}]}`))
+	}))
+	defer server.Close()
+
+	spec := &SemanticCacheJudgeSpec{BaseURL: server.URL, APIKey: "key", Model: "judge"}
+	score, err := judgeAgreement(context.Background(), spec, "question", "answer a", "answer b")
+	assert.NoError(err)
+	assert.Equal(0.75, score)
+	assert.Equal("judge", judged["model"])
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"they agree"}}]}`))
+	}))
+	defer failing.Close()
+	_, err = judgeAgreement(context.Background(), &SemanticCacheJudgeSpec{BaseURL: failing.URL, Model: "judge"}, "q", "a", "b")
+	assert.Error(err)
+}
+
+func TestSemanticCacheEvaluation(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache-evaluation",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "openai",
+				BaseURL:      "http://localhost:8080",
+				Model:        "text-embedding-3-small",
+				APIKey:       "test-api-key",
+			},
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{
+					Type:           "redis",
+					Threshold:      0.99,
+					CollectionName: "redis-test",
+				},
+				Redis: &redisvector.RedisVectorDBSpec{
+					URL: "redis://localhost:6379",
+				},
+			},
+			ThresholdTuning: &SemanticCacheTuningSpec{},
+			Evaluation:      &SemanticCacheEvaluationSpec{SampleRate: 1, Method: EvaluationMethodEmbedding},
+		},
+	}
+	assert.NoError(ValidateSpec(spec))
+
+	cached := `{"choices":[{"message":{"role":"assistant","content":"Easegress is a gateway"}}]}`
+	db := &explainVectorDB{
+		data: []map[string]any{
+			{"id": "near", "embedding": []float32{1, 0.1, 0}, "data": cached, "header": "{}", "status": 200},
+		},
+	}
+	cache := &semanticCacheMiddleware{
+		spec: spec,
+		embeddingsHandler: &topicEmbeddingHandler{vectors: map[string][]float32{
+			"hello":                  {1, 0, 0},
+			"Easegress is a gateway": {0, 1, 0},
+			"Easegress is a proxy":   {0, 1, 0.1},
+			"Easegress is a fruit":   {0, 0, 1},
+		}},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template: template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+		tuner:    newThresholdTuner(spec.Name, spec.SemanticCache.ThresholdTuning, 0.99),
+	}
+	cache.initEvaluation(spec.SemanticCache.Evaluation)
+	generator := &mockGenerator{responses: map[string]string{
+		"gpt-4o":  "Easegress is a proxy",
+		"gpt-4.1": "Easegress is a fruit",
+	}}
+	cache.SetGenerator(generator)
+
+	handle := func(requestID string, model string) *aicontext.Context {
+		data := map[string]any{
+			"model":          model,
+			"stream":         true,
+			"stream_options": map[string]any{"include_usage": true},
+			"messages":       []map[string]any{{"role": "user", "content": "hello"}},
+		}
+		jsonData, err := json.Marshal(data)
+		assert.Nil(err)
+		ctx := egContext.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		req.Header.Set("X-Request-Id", requestID)
+		setRequest(t, ctx, "evaluation", req)
+		aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai"})
+		assert.Nil(err)
+		cache.Handle(aiCtx)
+		return aiCtx
+	}
+
+	// the client gets the cached response, the evaluation runs in background.
+	aiCtx := handle("req-1", "gpt-4o")
+	assert.True(aiCtx.IsStopped())
+	body, err := io.ReadAll(aiCtx.GetResponse().BodyReader)
+	assert.NoError(err)
+	assert.Equal(cached, string(body))
+	handle("req-2", "gpt-4.1")
+	handle("req-3", "unknown")
+
+	assert.Eventually(func() bool {
+		report, err := cache.EvaluationReport()
+		return err == nil && report.Evaluated+report.Failed == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	report, err := cache.EvaluationReport()
+	assert.NoError(err)
+	assert.Equal(int64(2), report.Evaluated)
+	assert.Equal(int64(1), report.Agreed)
+	assert.Equal(int64(1), report.Failed)
+	assert.Len(report.Models, 2)
+	assert.Len(report.Buckets, 1)
+	assert.Equal(0.95, report.Buckets[0].From)
+
+	generator.lock.Lock()
+	for _, req := range generator.requests {
+		assert.Equal(false, req["stream"])
+		assert.NotContains(req, "stream_options")
+		assert.Equal("openai", req["provider"])
+		assert.Equal("/v1/chat/completions", req["respType"])
+	}
+	generator.lock.Unlock()
+
+	// the results are fed to the threshold tuning.
+	stats, err := cache.ThresholdStats()
+	assert.NoError(err)
+	assert.Equal(int64(2), stats.TotalFeedback)
+	assert.ErrorIs(cache.Feedback(&Feedback{RequestID: "req-1", Correct: true}), ErrFeedbackRequestNotFound)
+	assert.NoError(cache.Feedback(&Feedback{RequestID: "req-3", Correct: true}))
+
+	_, err = (&semanticCacheMiddleware{}).EvaluationReport()
+	assert.ErrorIs(err, ErrEvaluationDisabled)
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"container/heap"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// EvictionPolicyGDSF evicts the local entries of the least
+	// frequency × generation cost / size first, aged by the priorities of
+	// the entries evicted, see gdsfTier.
+	EvictionPolicyGDSF = "gdsf"
+	// EvictionPolicyLRU evicts the least recently used local entries first.
+	EvictionPolicyLRU = "lru"
+
+	// semanticCacheGenerationMsField and semanticCacheGenerationTokensField
+	// record the latency and the completion tokens of generating a cache
+	// entry, which are the generation cost of the entry.
+	semanticCacheGenerationMsField     = "generation_ms"
+	semanticCacheGenerationTokensField = "generation_tokens"
+)
+
+type (
+	// localTier is the local tier of the semantic cache, which keeps the
+	// entries by their keys and evicts them by its policy.
+	localTier interface {
+		// Add adds or replaces the entry of the key, it is a use of the
+		// entry if the key exists.
+		Add(key string, local *localEntry)
+		// Get returns the entry of the key, which is a use of the entry.
+		Get(key string) (*localEntry, bool)
+		// Peek returns the entry of the key without using it.
+		Peek(key string) (*localEntry, bool)
+		Remove(key string)
+		Purge()
+		Len() int
+	}
+
+	lruTier struct {
+		entries *lru.Cache
+	}
+
+	// gdsfTier evicts entries by Greedy-Dual-Size-Frequency, the priority
+	// of an entry is clock + frequency × cost / size, where the clock is
+	// the priority of the last entry evicted. So an expensive entry is
+	// kept longer than a cheap one used as often, and the entries not used
+	// for long are aged out, since the clock catches up with them.
+	gdsfTier struct {
+		lock       sync.Mutex
+		maxEntries int
+		clock      float64
+		items      map[string]*gdsfItem
+		heap       gdsfHeap
+	}
+
+	gdsfItem struct {
+		key       string
+		local     *localEntry
+		frequency float64
+		priority  float64
+		index     int
+	}
+
+	gdsfHeap []*gdsfItem
+)
+
+func newLocalTier(policy string, maxEntries int) localTier {
+	if policy == EvictionPolicyLRU {
+		entries, _ := lru.New(maxEntries)
+		return &lruTier{entries: entries}
+	}
+	return &gdsfTier{maxEntries: maxEntries, items: map[string]*gdsfItem{}}
+}
+
+// generationCost returns the generation cost of the cache entry, which
+// is its latency in milliseconds plus its completion tokens, so a slow or
+// long completion is expensive to generate again. It is 1 if the entry
+// has no cost recorded, like the entries written by old versions.
+func generationCost(doc map[string]any) float64 {
+	cost := 0.0
+	for _, field := range []string{semanticCacheGenerationMsField, semanticCacheGenerationTokensField} {
+		if v, err := vecdbtypes.ToFloat64(doc[field]); err == nil && v > 0 {
+			cost += v
+		}
+	}
+	return max(cost, 1)
+}
+
+func (t *lruTier) Add(key string, local *localEntry) {
+	t.entries.Add(key, local)
+}
+
+func (t *lruTier) Get(key string) (*localEntry, bool) {
+	v, ok := t.entries.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*localEntry), true
+}
+
+func (t *lruTier) Peek(key string) (*localEntry, bool) {
+	v, ok := t.entries.Peek(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*localEntry), true
+}
+
+func (t *lruTier) Remove(key string) {
+	t.entries.Remove(key)
+}
+
+func (t *lruTier) Purge() {
+	t.entries.Purge()
+}
+
+func (t *lruTier) Len() int {
+	return t.entries.Len()
+}
+
+// value returns frequency × cost / size of the item.
+func (item *gdsfItem) value() float64 {
+	return item.frequency * item.local.cost / float64(max(item.local.size, 1))
+}
+
+func (t *gdsfTier) Add(key string, local *localEntry) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if item, ok := t.items[key]; ok {
+		item.local = local
+		t.use(item)
+		return
+	}
+	item := &gdsfItem{key: key, local: local, frequency: 1}
+	item.priority = t.clock + item.value()
+	t.items[key] = item
+	heap.Push(&t.heap, item)
+	for len(t.items) > t.maxEntries {
+		evicted := heap.Pop(&t.heap).(*gdsfItem)
+		delete(t.items, evicted.key)
+		t.clock = evicted.priority
+	}
+}
+
+func (t *gdsfTier) Get(key string) (*localEntry, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	item, ok := t.items[key]
+	if !ok {
+		return nil, false
+	}
+	t.use(item)
+	return item.local, true
+}
+
+// use counts a use of the item, and lifts its priority above the clock.
+func (t *gdsfTier) use(item *gdsfItem) {
+	item.frequency++
+	item.priority = t.clock + item.value()
+	heap.Fix(&t.heap, item.index)
+}
+
+func (t *gdsfTier) Peek(key string) (*localEntry, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	item, ok := t.items[key]
+	if !ok {
+		return nil, false
+	}
+	return item.local, true
+}
+
+func (t *gdsfTier) Remove(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if item, ok := t.items[key]; ok {
+		heap.Remove(&t.heap, item.index)
+		delete(t.items, key)
+	}
+}
+
+func (t *gdsfTier) Purge() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.items = map[string]*gdsfItem{}
+	t.heap = nil
+	t.clock = 0
+}
+
+func (t *gdsfTier) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.items)
+}
+
+func (h gdsfHeap) Len() int           { return len(h) }
+func (h gdsfHeap) Less(i, j int) bool { return h[i].priority < h[j].priority }
+
+func (h gdsfHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *gdsfHeap) Push(x any) {
+	item := x.(*gdsfItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *gdsfHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// cacheTraceMaxEntries is the size of the local tier replaying the trace.
+const cacheTraceMaxEntries = 50
+
+// traceRequest is a request of the recorded key trace, with the
+// generation cost and the size of its entry.
+type traceRequest struct {
+	key    string
+	cost   float64
+	size   int
+	tokens int
+}
+
+// loadCacheTrace loads the key trace recorded from a skewed workload, the
+// popularity of the keys is heavy-tailed, a fifth of the entries are long
+// completions, and some keys are seen once only.
+func loadCacheTrace(tb testing.TB) []traceRequest {
+	f, err := os.Open("testdata/semanticcache_trace.txt")
+	if err != nil {
+		tb.Fatalf("failed to open trace: %v", err)
+	}
+	defer f.Close()
+
+	var trace []traceRequest
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r traceRequest
+		var ms int
+		if _, err := fmt.Sscan(line, &r.key, &ms, &r.tokens, &r.size); err != nil {
+			tb.Fatalf("invalid trace line %q: %v", line, err)
+		}
+		r.cost = generationCost(map[string]any{
+			semanticCacheGenerationMsField:     ms,
+			semanticCacheGenerationTokensField: r.tokens,
+		})
+		trace = append(trace, r)
+	}
+	return trace
+}
+
+// replayCacheTrace replays the trace against a local tier of the policy,
+// and returns the hit rate and the ratio of the generation cost saved by
+// the hits.
+func replayCacheTrace(trace []traceRequest, policy string, maxEntries int) (hitRate, savedRate float64) {
+	tier := newLocalTier(policy, maxEntries)
+	hits, saved, total := 0, 0.0, 0.0
+	for _, r := range trace {
+		total += r.cost
+		if _, ok := tier.Get(r.key); ok {
+			hits++
+			saved += r.cost
+			continue
+		}
+		tier.Add(r.key, &localEntry{id: r.key, cost: r.cost, size: r.size})
+	}
+	return float64(hits) / float64(len(trace)), saved / total
+}
+
+func TestGenerationCost(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(30500.0, generationCost(map[string]any{semanticCacheGenerationMsField: "30000", semanticCacheGenerationTokensField: 500}))
+	assert.Equal(1.0, generationCost(map[string]any{}))
+	assert.Equal(1.0, generationCost(map[string]any{semanticCacheGenerationMsField: "x"}))
+}
+
+func TestGDSFTier(t *testing.T) {
+	assert := assert.New(t)
+
+	tier := newLocalTier(EvictionPolicyGDSF, 2)
+	tier.Add("expensive", &localEntry{id: "expensive", cost: 30000, size: 1000})
+	tier.Add("cheap", &localEntry{id: "cheap", cost: 50, size: 1000})
+	// the cheap entry is evicted first, though it is used more recently.
+	tier.Add("other", &localEntry{id: "other", cost: 500, size: 1000})
+	_, ok := tier.Peek("cheap")
+	assert.False(ok)
+	_, ok = tier.Peek("expensive")
+	assert.True(ok)
+	assert.Equal(2, tier.Len())
+
+	// the entries used more often are kept longer.
+	for i := 0; i < 100; i++ {
+		_, ok = tier.Get("other")
+		assert.True(ok)
+	}
+	tier.Add("new", &localEntry{id: "new", cost: 40000, size: 1000})
+	_, ok = tier.Peek("expensive")
+	assert.False(ok)
+	_, ok = tier.Peek("other")
+	assert.True(ok)
+
+	// an entry cheaper than all others is evicted at once.
+	tier.Add("cheap", &localEntry{id: "cheap", cost: 1, size: 1000})
+	_, ok = tier.Peek("cheap")
+	assert.False(ok)
+
+	// the entries not used are aged out by the clock, so an expensive
+	// entry is not kept forever.
+	tier = newLocalTier(EvictionPolicyGDSF, 2)
+	tier.Add("expensive", &localEntry{id: "expensive", cost: 300, size: 1})
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("k%d", i)
+		tier.Add(key, &localEntry{id: key, cost: 1, size: 1})
+		tier.Get(key)
+		tier.Get(key)
+	}
+	_, ok = tier.Peek("expensive")
+	assert.False(ok)
+
+	// the entries are replaced by the new values.
+	tier = newLocalTier(EvictionPolicyGDSF, 2)
+	tier.Add("a", &localEntry{id: "a", cost: 1, size: 1})
+	local := &localEntry{id: "a2", cost: 1, size: 1}
+	tier.Add("a", local)
+	got, ok := tier.Get("a")
+	assert.True(ok)
+	assert.Same(local, got)
+	tier.Add("b", &localEntry{id: "b", cost: 1, size: 1})
+	assert.Equal(2, tier.Len())
+
+	tier.Remove("a")
+	assert.Equal(1, tier.Len())
+	tier.Purge()
+	assert.Zero(tier.Len())
+	tier.Add("a", &localEntry{id: "a", cost: 1, size: 1})
+	assert.Equal(1, tier.Len())
+}
+
+func TestStaleReadsEvictionPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateSemanticCacheStaleReadsSpec(&SemanticCacheStaleReadsSpec{EvictionPolicy: EvictionPolicyLRU}))
+	assert.Error(validateSemanticCacheStaleReadsSpec(&SemanticCacheStaleReadsSpec{EvictionPolicy: "lfu"}))
+
+	lookups := func(s *staleReads, result string) float64 {
+		return testutil.ToFloat64(s.lookups.WithLabelValues(s.name, s.policy, result))
+	}
+	for _, policy := range []string{EvictionPolicyGDSF, EvictionPolicyLRU} {
+		s := newStaleReads("test-stale-eviction", &SemanticCacheStaleReadsSpec{MaxEntries: 1, EvictionPolicy: policy})
+		s.remember("a", "a", &semanticCacheEntry{Data: "a"}, nil, 1)
+		local, _ := s.lookup("a")
+		assert.NotNil(local)
+		s.remember("b", "b", &semanticCacheEntry{Data: "b"}, nil, 1)
+		assert.Equal(1, s.entries.Len())
+		local, _ = s.lookup("missing")
+		assert.Nil(local)
+		assert.Equal(1.0, lookups(s, "hit"), policy)
+		assert.Equal(1.0, lookups(s, "miss"), policy)
+	}
+	s := newStaleReads("test-stale-eviction-default", &SemanticCacheStaleReadsSpec{})
+	assert.Equal(EvictionPolicyGDSF, s.policy)
+}
+
+// TestCacheTraceReplay checks the cost-aware eviction saves more
+// generation cost than LRU for the recorded workload, without losing
+// hits.
+func TestCacheTraceReplay(t *testing.T) {
+	trace := loadCacheTrace(t)
+	lruHits, lruSaved := replayCacheTrace(trace, EvictionPolicyLRU, cacheTraceMaxEntries)
+	gdsfHits, gdsfSaved := replayCacheTrace(trace, EvictionPolicyGDSF, cacheTraceMaxEntries)
+	t.Logf("lru: hit rate %.3f, saved %.3f; gdsf: hit rate %.3f, saved %.3f", lruHits, lruSaved, gdsfHits, gdsfSaved)
+	assert.Greater(t, gdsfHits, lruHits)
+	assert.Greater(t, gdsfSaved, lruSaved)
+}
+
+// BenchmarkCacheTraceReplay replays the recorded trace by each policy, and
+// reports the hit rate and the ratio of the generation cost saved.
+func BenchmarkCacheTraceReplay(b *testing.B) {
+	trace := loadCacheTrace(b)
+	for _, policy := range []string{EvictionPolicyLRU, EvictionPolicyGDSF} {
+		b.Run(policy, func(b *testing.B) {
+			var hitRate, savedRate float64
+			for i := 0; i < b.N; i++ {
+				hitRate, savedRate = replayCacheTrace(trace, policy, cacheTraceMaxEntries)
+			}
+			b.ReportMetric(hitRate, "hit-rate")
+			b.ReportMetric(savedRate, "saved-cost-rate")
+		})
+	}
+}
@@ -0,0 +1,617 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+)
+
+const (
+	// CacheImportStatusRunning, CacheImportStatusCompleted,
+	// CacheImportStatusAborted and CacheImportStatusFailed are the
+	// statuses of cache import jobs.
+	CacheImportStatusRunning   = "running"
+	CacheImportStatusCompleted = "completed"
+	CacheImportStatusAborted   = "aborted"
+	CacheImportStatusFailed    = "failed"
+
+	// The reasons of the records not imported, the records of the first
+	// ones are failed since they are invalid, and the others are skipped.
+	CacheImportReasonInvalidRecord   = "invalidRecord"
+	CacheImportReasonInvalidRequest  = "invalidRequest"
+	CacheImportReasonInvalidResponse = "invalidResponse"
+	CacheImportReasonModel           = "model"
+	CacheImportReasonNoTimestamp     = "noTimestamp"
+	CacheImportReasonOutOfRange      = "outOfRange"
+	CacheImportReasonShortResponse   = "shortResponse"
+	CacheImportReasonTruncated       = "truncated"
+	CacheImportReasonDuplicate       = "duplicate"
+
+	// semanticCacheSourceField records where a cache entry comes from, it
+	// is empty for the entries cached from the responses.
+	semanticCacheSourceField = "source"
+
+	cacheImportDefaultSource            = "import"
+	cacheImportDefaultRequestsPerSecond = 10
+	// cacheImportIDPrefix prefixes the IDs of the imported entries, which
+	// are the hashes of their prompts.
+	cacheImportIDPrefix = "import-"
+	// cacheImportMaxErrors is the number of the latest failed records kept
+	// in the report.
+	cacheImportMaxErrors = 100
+)
+
+var (
+	// ErrCacheImportRunning means a cache import job of the middleware is
+	// running.
+	ErrCacheImportRunning = errors.New("cache import is running")
+	// ErrCacheImportNotRunning means no cache import job of the middleware
+	// is running.
+	ErrCacheImportNotRunning = errors.New("cache import is not running")
+)
+
+type (
+	// CacheImportRequest is the request to import the request and
+	// response pairs of a log file into the semantic cache. The file is
+	// read by the gateway, every line of it is a JSON object with the
+	// request and response of an OpenAI chat completion, and optionally
+	// the timestamp of the request in RFC3339.
+	CacheImportRequest struct {
+		// Path is the path of the file on the gateway.
+		Path string `json:"path"`
+		// Models imports the records of the models only, the records of
+		// all models are imported if it is empty.
+		Models []string `json:"models,omitempty"`
+		// Since and Until import the records in the time range only, in
+		// RFC3339. The time of a record is its timestamp, or the created
+		// time of its response.
+		Since string `json:"since,omitempty"`
+		Until string `json:"until,omitempty"`
+		// MinResponseLength skips the records whose response content has
+		// fewer characters.
+		MinResponseLength int `json:"minResponseLength,omitempty"`
+		// RequestsPerSecond caps the embedding requests, 10 by default.
+		RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+		// TokensPerMinute caps the estimated tokens embedded, there is no
+		// cap if it is 0.
+		TokensPerMinute int64 `json:"tokensPerMinute,omitempty"`
+		// TTL is the time to live of the imported entries, the TTL of the
+		// vector database is used if it is empty. It is only supported by
+		// Redis.
+		TTL string `json:"ttl,omitempty"`
+		// Source marks the imported entries, it is import by default.
+		Source string `json:"source,omitempty"`
+	}
+
+	// CacheImportStatus is the progress of a cache import job, and the
+	// report of it when it is finished.
+	CacheImportStatus struct {
+		Status  string              `json:"status"`
+		Request *CacheImportRequest `json:"request"`
+		// Line is the number of lines read, an aborted or failed job of
+		// the same file is resumed from it.
+		Line     int64 `json:"line"`
+		Imported int64 `json:"imported"`
+		Skipped  int64 `json:"skipped"`
+		Failed   int64 `json:"failed"`
+		// SkipReasons and FailReasons count the records not imported by
+		// their reasons.
+		SkipReasons map[string]int64 `json:"skipReasons,omitempty"`
+		FailReasons map[string]int64 `json:"failReasons,omitempty"`
+		// Errors are the latest failed records.
+		Errors []*CacheImportError `json:"errors,omitempty"`
+		// Tokens is the estimated tokens embedded.
+		Tokens     int64  `json:"tokens"`
+		StartedAt  string `json:"startedAt"`
+		FinishedAt string `json:"finishedAt,omitempty"`
+		Error      string `json:"error,omitempty"`
+	}
+
+	// CacheImportError is a record failed to import.
+	CacheImportError struct {
+		Line   int64  `json:"line"`
+		Reason string `json:"reason"`
+		Error  string `json:"error"`
+	}
+
+	// cacheImportJob imports the records of a file in the background.
+	cacheImportJob struct {
+		cancel context.CancelFunc
+		done   chan struct{}
+
+		lock   sync.Mutex
+		status CacheImportStatus
+		// seen is the IDs of the records of the job, so the records of
+		// the same prompt are embedded once.
+		seen map[string]struct{}
+		// paceStarted, paceRequests and paceTokens pace the embedding
+		// requests since the job is started.
+		paceStarted  time.Time
+		paceRequests int64
+		paceTokens   int64
+	}
+
+	// cacheImportRecord is a line of the file to import.
+	cacheImportRecord struct {
+		Request   map[string]any `json:"request"`
+		Response  map[string]any `json:"response"`
+		Timestamp string         `json:"timestamp,omitempty"`
+	}
+
+	// cacheImportEntry is a record validated and normalized to import.
+	cacheImportEntry struct {
+		id     string
+		prompt string
+		data   string
+	}
+
+	// cacheImportRejection is why a record is not imported, it is skipped
+	// if it is filtered out, or failed if it is invalid.
+	cacheImportRejection struct {
+		skipped bool
+		reason  string
+		err     error
+	}
+)
+
+var _ CacheImporter = (*semanticCacheMiddleware)(nil)
+
+func (m *semanticCacheMiddleware) validateCacheImportRequest(req *CacheImportRequest) error {
+	if req.Path == "" {
+		return fmt.Errorf("path of cache import is empty")
+	}
+	var since, until time.Time
+	var err error
+	if req.Since != "" {
+		if since, err = time.Parse(time.RFC3339, req.Since); err != nil {
+			return fmt.Errorf("invalid since %s: %w", req.Since, err)
+		}
+	}
+	if req.Until != "" {
+		if until, err = time.Parse(time.RFC3339, req.Until); err != nil {
+			return fmt.Errorf("invalid until %s: %w", req.Until, err)
+		}
+	}
+	if !since.IsZero() && !until.IsZero() && !since.Before(until) {
+		return fmt.Errorf("since %s must be before until %s", req.Since, req.Until)
+	}
+	if req.MinResponseLength < 0 {
+		return fmt.Errorf("minResponseLength must not be negative")
+	}
+	if req.RequestsPerSecond < 0 || req.TokensPerMinute < 0 {
+		return fmt.Errorf("requestsPerSecond and tokensPerMinute must not be negative")
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid ttl %s, must be a positive duration", req.TTL)
+		}
+		if m.spec.SemanticCache.VectorDB.Type != vectordb.TypeRedis {
+			return fmt.Errorf("ttl of imported entries is not supported by vectorDB %s", m.spec.SemanticCache.VectorDB.Type)
+		}
+	}
+	info, err := os.Stat(req.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", req.Path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", req.Path)
+	}
+	return nil
+}
+
+func (req *CacheImportRequest) getRequestsPerSecond() float64 {
+	if req.RequestsPerSecond == 0 {
+		return cacheImportDefaultRequestsPerSecond
+	}
+	return req.RequestsPerSecond
+}
+
+func (req *CacheImportRequest) getSource() string {
+	if req.Source == "" {
+		return cacheImportDefaultSource
+	}
+	return req.Source
+}
+
+// insertOptions returns the options of inserting the entries, they are
+// never overwritten, so the entries imported before are skipped.
+func (req *CacheImportRequest) insertOptions() []vecdbtypes.HandlerInsertOption {
+	options := []vecdbtypes.HandlerInsertOption{vecdbtypes.WithRedisWriteMode(string(redisvector.WriteModeCreateOnly))}
+	if req.TTL != "" {
+		ttl, _ := time.ParseDuration(req.TTL)
+		options = append(options, vecdbtypes.WithTTL(ttl))
+	}
+	return options
+}
+
+// StartCacheImport starts importing the records of the file. A job started
+// after an aborted or failed one of the same file resumes from its line.
+func (m *semanticCacheMiddleware) StartCacheImport(req *CacheImportRequest) (*CacheImportStatus, error) {
+	if m.spec.SemanticCache.ReadOnly {
+		return nil, fmt.Errorf("semantic cache %s is read only", m.spec.Name)
+	}
+	if err := m.validateCacheImportRequest(req); err != nil {
+		return nil, err
+	}
+
+	m.cacheImportLock.Lock()
+	defer m.cacheImportLock.Unlock()
+	job := &cacheImportJob{done: make(chan struct{}), seen: make(map[string]struct{})}
+	if prev := m.cacheImport; prev != nil {
+		status := prev.getStatus()
+		switch status.Status {
+		case CacheImportStatusRunning:
+			return nil, ErrCacheImportRunning
+		case CacheImportStatusAborted, CacheImportStatusFailed:
+			if status.Request.Path == req.Path {
+				job.status.Line = status.Line
+			}
+		}
+	}
+	job.status.Status = CacheImportStatusRunning
+	job.status.Request = req
+	job.status.StartedAt = time.Now().Format(time.RFC3339)
+	job.paceStarted = time.Now()
+
+	var jobCtx context.Context
+	jobCtx, job.cancel = context.WithCancel(context.Background())
+	m.cacheImport = job
+	logger.Infof("cache import of middleware %s started: %s from line %d", m.spec.Name, req.Path, job.status.Line)
+	go m.runCacheImport(jobCtx, job)
+	return job.getStatus(), nil
+}
+
+// CacheImportStatus returns the status of the last job.
+func (m *semanticCacheMiddleware) CacheImportStatus() *CacheImportStatus {
+	m.cacheImportLock.Lock()
+	defer m.cacheImportLock.Unlock()
+	if m.cacheImport == nil {
+		return nil
+	}
+	return m.cacheImport.getStatus()
+}
+
+// AbortCacheImport stops the running job and waits for it.
+func (m *semanticCacheMiddleware) AbortCacheImport() (*CacheImportStatus, error) {
+	m.cacheImportLock.Lock()
+	job := m.cacheImport
+	m.cacheImportLock.Unlock()
+	if job == nil {
+		return nil, ErrCacheImportNotRunning
+	}
+	select {
+	case <-job.done:
+		return nil, ErrCacheImportNotRunning
+	default:
+	}
+	job.cancel()
+	<-job.done
+	return job.getStatus(), nil
+}
+
+func (m *semanticCacheMiddleware) runCacheImport(ctx context.Context, job *cacheImportJob) {
+	defer close(job.done)
+	err := m.importRecords(ctx, job)
+	status := job.update(func(s *CacheImportStatus) {
+		s.FinishedAt = time.Now().Format(time.RFC3339)
+		switch {
+		case err == nil:
+			s.Status = CacheImportStatusCompleted
+		case errors.Is(err, context.Canceled):
+			s.Status = CacheImportStatusAborted
+		default:
+			s.Status, s.Error = CacheImportStatusFailed, err.Error()
+		}
+	})
+	logger.Infof("cache import of middleware %s %s: %d records imported, %d skipped, %d failed",
+		m.spec.Name, status.Status, status.Imported, status.Skipped, status.Failed)
+}
+
+// importRecords imports the records of the file from the line of the job.
+// The line is moved after a record is imported or rejected, so the job
+// fails at the record if the embeddings or the vector database fail, and
+// it is resumed from the record.
+func (m *semanticCacheMiddleware) importRecords(ctx context.Context, job *cacheImportJob) error {
+	status := job.getStatus()
+	req := status.Request
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := int64(1); ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read line %d: %w", line, err)
+		}
+		if line > status.Line && len(strings.TrimSpace(string(data))) > 0 {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if importErr := m.importRecord(ctx, job, line, data); importErr != nil {
+				return importErr
+			}
+			job.update(func(s *CacheImportStatus) { s.Line = line })
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// importRecord imports the record of the line, the rejections of the
+// record are recorded in the status, and the error is returned if the
+// record can not be imported now.
+func (m *semanticCacheMiddleware) importRecord(ctx context.Context, job *cacheImportJob, line int64, data []byte) error {
+	req := job.getStatus().Request
+	entry, rejection := m.prepareImport(req, data)
+	if rejection == nil && !job.markSeen(entry.id) {
+		rejection = &cacheImportRejection{skipped: true, reason: CacheImportReasonDuplicate}
+	}
+	if rejection != nil {
+		job.reject(line, rejection)
+		return nil
+	}
+
+	tokens := int64(estimateTokens(entry.prompt))
+	if err := job.pace(ctx, tokens); err != nil {
+		return err
+	}
+	embedding, err := m.embeddingsHandler.EmbedQuery(entry.prompt)
+	if err != nil {
+		return fmt.Errorf("failed to embed the prompt of line %d: %w", line, err)
+	}
+	job.update(func(s *CacheImportStatus) { s.Tokens += tokens })
+
+	importCtx := &aicontext.Context{RespType: aicontext.ResponseTypeChatCompletions, ReqInfo: &protocol.GeneralRequest{}}
+	handler, err := m.vectorHandler.GetHandler(importCtx, embedding)
+	if err != nil {
+		return fmt.Errorf("failed to get vector handler: %w", err)
+	}
+	// the entries are written without the write queue, so the failures
+	// are reported.
+	if queued, ok := handler.(*vectordb.QueuedHandler); ok {
+		handler = queued.VectorHandler
+	}
+	cache := map[string]any{
+		"id":                     entry.id,
+		"embedding":              embedding,
+		"data":                   entry.data,
+		"header":                 `{"Content-Type":["application/json"]}`,
+		"status":                 200,
+		semanticCacheSourceField: req.getSource(),
+	}
+	// the embedded entries are written even if the job is aborted, since
+	// they are paid for.
+	err = m.storeCache(context.WithoutCancel(ctx), handler, entry.prompt, cache, req.insertOptions()...)
+	switch {
+	case err == nil:
+		job.update(func(s *CacheImportStatus) { s.Imported++ })
+	case errors.Is(err, vecdbtypes.ErrDocumentExists):
+		job.reject(line, &cacheImportRejection{skipped: true, reason: CacheImportReasonDuplicate})
+	default:
+		return fmt.Errorf("failed to insert the entry of line %d: %w", line, err)
+	}
+	return nil
+}
+
+// prepareImport validates the record and normalizes it to an entry. The
+// prompt is rendered by the content template, and the ID of the entry is
+// the hash of the prompt, so the records of the same prompt are imported
+// once.
+func (m *semanticCacheMiddleware) prepareImport(req *CacheImportRequest, data []byte) (*cacheImportEntry, *cacheImportRejection) {
+	fail := func(reason string, err error) *cacheImportRejection {
+		return &cacheImportRejection{reason: reason, err: err}
+	}
+	skip := func(reason string) *cacheImportRejection {
+		return &cacheImportRejection{skipped: true, reason: reason}
+	}
+
+	record := &cacheImportRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fail(CacheImportReasonInvalidRecord, err)
+	}
+	if record.Request == nil || record.Response == nil {
+		return nil, fail(CacheImportReasonInvalidRecord, fmt.Errorf("record has no request or response"))
+	}
+	messages, _ := record.Request["messages"].([]any)
+	if len(messages) == 0 {
+		return nil, fail(CacheImportReasonInvalidRequest, fmt.Errorf("request has no messages"))
+	}
+	if object, ok := record.Response["object"]; ok && object != "chat.completion" {
+		return nil, fail(CacheImportReasonInvalidResponse, fmt.Errorf("response is %v, not a chat completion", object))
+	}
+	content, finishReason, err := chatCompletionContent(record.Response)
+	if err != nil {
+		return nil, fail(CacheImportReasonInvalidResponse, err)
+	}
+
+	if len(req.Models) > 0 {
+		model, _ := record.Request["model"].(string)
+		if model == "" {
+			model, _ = record.Response["model"].(string)
+		}
+		if !slices.Contains(req.Models, model) {
+			return nil, skip(CacheImportReasonModel)
+		}
+	}
+	if req.Since != "" || req.Until != "" {
+		at, ok := record.time()
+		if !ok {
+			return nil, skip(CacheImportReasonNoTimestamp)
+		}
+		since, _ := time.Parse(time.RFC3339, req.Since)
+		until, _ := time.Parse(time.RFC3339, req.Until)
+		if (req.Since != "" && at.Before(since)) || (req.Until != "" && !at.Before(until)) {
+			return nil, skip(CacheImportReasonOutOfRange)
+		}
+	}
+	if finishReason == "length" {
+		return nil, skip(CacheImportReasonTruncated)
+	}
+	if utf8.RuneCountInString(content) < req.MinResponseLength {
+		return nil, skip(CacheImportReasonShortResponse)
+	}
+
+	// the entries are cached as non-streaming responses.
+	delete(record.Request, "stream")
+	prompt, err := m.renderContent(record.Request)
+	if err != nil {
+		return nil, fail(CacheImportReasonInvalidRequest, err)
+	}
+	body, err := json.Marshal(record.Response)
+	if err != nil {
+		return nil, fail(CacheImportReasonInvalidResponse, err)
+	}
+	hash := sha256.Sum256([]byte(prompt))
+	return &cacheImportEntry{
+		id:     cacheImportIDPrefix + hex.EncodeToString(hash[:16]),
+		prompt: prompt,
+		data:   string(body),
+	}, nil
+}
+
+// chatCompletionContent returns the content and the finish reason of the
+// first choice of the chat completion.
+func chatCompletionContent(resp map[string]any) (string, string, error) {
+	choices, _ := resp["choices"].([]any)
+	if len(choices) == 0 {
+		return "", "", fmt.Errorf("response has no choices")
+	}
+	choice, _ := choices[0].(map[string]any)
+	message, _ := choice["message"].(map[string]any)
+	content, _ := message["content"].(string)
+	if strings.TrimSpace(content) == "" {
+		return "", "", fmt.Errorf("response has no content")
+	}
+	finishReason, _ := choice["finish_reason"].(string)
+	return content, finishReason, nil
+}
+
+// time returns the time of the record, which is its timestamp, or the
+// created time of its response.
+func (r *cacheImportRecord) time() (time.Time, bool) {
+	if r.Timestamp != "" {
+		at, err := time.Parse(time.RFC3339, r.Timestamp)
+		return at, err == nil
+	}
+	created, err := vecdbtypes.ToFloat64(r.Response["created"])
+	if err != nil || created <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(created), 0), true
+}
+
+func (j *cacheImportJob) update(fn func(s *CacheImportStatus)) *CacheImportStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	fn(&j.status)
+	status := j.status
+	status.SkipReasons = maps.Clone(status.SkipReasons)
+	status.FailReasons = maps.Clone(status.FailReasons)
+	status.Errors = slices.Clone(status.Errors)
+	return &status
+}
+
+func (j *cacheImportJob) getStatus() *CacheImportStatus {
+	return j.update(func(s *CacheImportStatus) {})
+}
+
+// markSeen returns false if the ID is seen by the job.
+func (j *cacheImportJob) markSeen(id string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, ok := j.seen[id]; ok {
+		return false
+	}
+	j.seen[id] = struct{}{}
+	return true
+}
+
+// reject counts the record not imported by its reason, the latest failed
+// records are kept with their errors.
+func (j *cacheImportJob) reject(line int64, rejection *cacheImportRejection) {
+	j.update(func(s *CacheImportStatus) {
+		if rejection.skipped {
+			s.Skipped++
+			if s.SkipReasons == nil {
+				s.SkipReasons = make(map[string]int64)
+			}
+			s.SkipReasons[rejection.reason]++
+			return
+		}
+		s.Failed++
+		if s.FailReasons == nil {
+			s.FailReasons = make(map[string]int64)
+		}
+		s.FailReasons[rejection.reason]++
+		if len(s.Errors) == cacheImportMaxErrors {
+			s.Errors = s.Errors[1:]
+		}
+		s.Errors = append(s.Errors, &CacheImportError{Line: line, Reason: rejection.reason, Error: rejection.err.Error()})
+	})
+}
+
+// pace sleeps to keep the embedding requests and their tokens under the
+// caps of the request.
+func (j *cacheImportJob) pace(ctx context.Context, tokens int64) error {
+	j.lock.Lock()
+	req := j.status.Request
+	expected := time.Duration(float64(j.paceRequests) / req.getRequestsPerSecond() * float64(time.Second))
+	if req.TokensPerMinute > 0 {
+		expected = max(expected, time.Duration(float64(j.paceTokens)/float64(req.TokensPerMinute)*float64(time.Minute)))
+	}
+	wait := expected - time.Since(j.paceStarted)
+	j.paceRequests++
+	j.paceTokens += tokens
+	j.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
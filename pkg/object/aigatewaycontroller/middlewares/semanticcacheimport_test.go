@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// importVectorDB never overwrites documents in the create only write
+// mode, and fails the inserts while err is set.
+type importVectorDB struct {
+	lock    sync.Mutex
+	docs    map[string]map[string]any
+	options []*vecdbtypes.HandlerInsertOptions
+	err     error
+}
+
+func (db *importVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	return db, nil
+}
+
+func (db *importVectorDB) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.err != nil {
+		return nil, db.err
+	}
+	opts := &vecdbtypes.HandlerInsertOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	db.options = append(db.options, opts)
+	for _, doc := range docs {
+		id := doc["id"].(string)
+		if _, ok := db.docs[id]; ok && opts.RedisWriteMode == string(redisvector.WriteModeCreateOnly) {
+			return nil, vecdbtypes.NewError(vecdbtypes.ErrDocumentExists, redisvector.NewErrDocumentExists(id))
+		}
+		db.docs[id] = doc
+	}
+	return nil, nil
+}
+
+func (db *importVectorDB) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	return nil, vecdbtypes.ErrSimilaritySearchNotFound
+}
+
+func (db *importVectorDB) setErr(err error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.err = err
+}
+
+func newImportMiddleware(t *testing.T) (*semanticCacheMiddleware, *importVectorDB) {
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "openai",
+				BaseURL:      "http://localhost:8080",
+				Model:        "text-embedding-3-small",
+				APIKey:       "test-api-key",
+			},
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{
+					Type:           "redis",
+					Threshold:      0.99,
+					CollectionName: "cache",
+				},
+				Redis: &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+			},
+		},
+	}
+	assert.Nil(t, ValidateSpec(spec))
+
+	db := &importVectorDB{docs: make(map[string]map[string]any)}
+	m := &semanticCacheMiddleware{
+		spec:              spec,
+		embeddingsHandler: &mockEmbeddingHandler{},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template: template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+	}
+	return m, db
+}
+
+func importRecordLine(t *testing.T, model, prompt, content, finishReason, timestamp string) string {
+	record := map[string]any{
+		"request": map[string]any{
+			"model":    model,
+			"stream":   true,
+			"messages": []map[string]any{{"role": "user", "content": prompt}},
+		},
+		"response": map[string]any{
+			"object":  "chat.completion",
+			"model":   model,
+			"created": 1717200000,
+			"choices": []map[string]any{{
+				"index":         0,
+				"message":       map[string]any{"role": "assistant", "content": content},
+				"finish_reason": finishReason,
+			}},
+		},
+	}
+	if timestamp != "" {
+		record["timestamp"] = timestamp
+	}
+	data, err := json.Marshal(record)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func writeImportFile(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	assert.Nil(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644))
+	return path
+}
+
+func waitCacheImport(t *testing.T, m *semanticCacheMiddleware, statuses ...string) *CacheImportStatus {
+	var status *CacheImportStatus
+	assert.Eventually(t, func() bool {
+		status = m.CacheImportStatus()
+		for _, s := range statuses {
+			if status.Status == s {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	return status
+}
+
+func TestSemanticCacheImport(t *testing.T) {
+	assert := assert.New(t)
+	m, db := newImportMiddleware(t)
+
+	path := writeImportFile(t,
+		importRecordLine(t, "gpt-4o", "What is Easegress?", "A cloud native traffic orchestration system.", "stop", "2024-06-01T00:00:00Z"),
+		// the same prompt is imported once.
+		importRecordLine(t, "gpt-4o", "What is Easegress?", "A traffic orchestration system.", "stop", "2024-06-01T00:00:00Z"),
+		`{"request": `,
+		importRecordLine(t, "gpt-3.5-turbo", "What is Go?", "A programming language.", "stop", "2024-06-01T00:00:00Z"),
+		importRecordLine(t, "gpt-4o", "What is Redis?", "An in-memory data store.", "stop", "2023-01-01T00:00:00Z"),
+		importRecordLine(t, "gpt-4o", "What is 1+1?", "2", "stop", "2024-06-01T00:00:00Z"),
+		importRecordLine(t, "gpt-4o", "Tell me a story.", "Once upon a time", "length", "2024-06-01T00:00:00Z"),
+		"",
+		`{"request": {"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}, "response": {"choices": []}}`,
+		// the time of the record is the created time of its response.
+		importRecordLine(t, "gpt-4o", "What is Kubernetes?", "A container orchestration system.", "stop", ""),
+	)
+
+	// the requests are validated.
+	for _, req := range []*CacheImportRequest{
+		{},
+		{Path: path, Since: "yesterday"},
+		{Path: path, Since: "2024-06-02T00:00:00Z", Until: "2024-06-01T00:00:00Z"},
+		{Path: path, MinResponseLength: -1},
+		{Path: path, TTL: "forever"},
+		{Path: filepath.Join(t.TempDir(), "missing.jsonl")},
+	} {
+		_, err := m.StartCacheImport(req)
+		assert.Error(err)
+	}
+	assert.Nil(m.CacheImportStatus())
+
+	req := &CacheImportRequest{
+		Path:              path,
+		Models:            []string{"gpt-4o"},
+		Since:             "2024-01-01T00:00:00Z",
+		Until:             "2025-01-01T00:00:00Z",
+		MinResponseLength: 5,
+		RequestsPerSecond: 1000,
+		TTL:               "24h",
+		Source:            "openai-logs",
+	}
+	_, err := m.StartCacheImport(req)
+	assert.NoError(err)
+	status := waitCacheImport(t, m, CacheImportStatusCompleted)
+	assert.Equal(int64(10), status.Line)
+	assert.Equal(int64(2), status.Imported)
+	assert.Equal(int64(5), status.Skipped)
+	assert.Equal(int64(2), status.Failed)
+	assert.Equal(map[string]int64{
+		CacheImportReasonDuplicate:     1,
+		CacheImportReasonModel:         1,
+		CacheImportReasonOutOfRange:    1,
+		CacheImportReasonShortResponse: 1,
+		CacheImportReasonTruncated:     1,
+	}, status.SkipReasons)
+	assert.Equal(map[string]int64{CacheImportReasonInvalidRecord: 1, CacheImportReasonInvalidResponse: 1}, status.FailReasons)
+	assert.Len(status.Errors, 2)
+	assert.Equal(int64(3), status.Errors[0].Line)
+	assert.Equal(int64(9), status.Errors[1].Line)
+	assert.Positive(status.Tokens)
+
+	// the entries are marked, and expire by the TTL.
+	assert.Len(db.docs, 2)
+	for id, doc := range db.docs {
+		assert.True(strings.HasPrefix(id, cacheImportIDPrefix))
+		assert.Equal("openai-logs", doc[semanticCacheSourceField])
+		assert.Equal(semanticCacheSchemaVersion, doc[semanticCacheSchemaVersionField])
+		entry, err := decodeSemanticCacheEntry(doc)
+		assert.NoError(err)
+		assert.Equal(200, entry.Status)
+		assert.Equal("application/json", entry.Header.Get("Content-Type"))
+		assert.Contains(entry.Data, `"object":"chat.completion"`)
+	}
+	for _, opts := range db.options {
+		assert.Equal(24*time.Hour, opts.TTL)
+	}
+
+	// the entries imported before are skipped.
+	_, err = m.StartCacheImport(req)
+	assert.NoError(err)
+	status = waitCacheImport(t, m, CacheImportStatusCompleted)
+	assert.Equal(int64(0), status.Imported)
+	assert.Equal(int64(3), status.SkipReasons[CacheImportReasonDuplicate])
+	assert.Len(db.docs, 2)
+
+	// the TTL is only supported by Redis.
+	m.spec.SemanticCache.VectorDB.Type = vectordb.TypePostgres
+	_, err = m.StartCacheImport(req)
+	assert.Error(err)
+}
+
+func TestSemanticCacheImportResume(t *testing.T) {
+	assert := assert.New(t)
+	m, db := newImportMiddleware(t)
+
+	path := writeImportFile(t,
+		importRecordLine(t, "gpt-4o", "What is Easegress?", "A traffic orchestration system.", "stop", ""),
+		importRecordLine(t, "gpt-4o", "What is Go?", "A programming language.", "stop", ""),
+		importRecordLine(t, "gpt-4o", "What is Redis?", "An in-memory data store.", "stop", ""),
+	)
+	db.setErr(vecdbtypes.NewError(vecdbtypes.ErrUnavailable, errors.New("connection refused")))
+	req := &CacheImportRequest{Path: path, RequestsPerSecond: 1000}
+	_, err := m.StartCacheImport(req)
+	assert.NoError(err)
+	status := waitCacheImport(t, m, CacheImportStatusFailed)
+	assert.Equal(int64(0), status.Line)
+	assert.Contains(status.Error, "line 1")
+
+	// the job is resumed from the failed record.
+	db.setErr(nil)
+	_, err = m.StartCacheImport(req)
+	assert.NoError(err)
+	status = waitCacheImport(t, m, CacheImportStatusCompleted)
+	assert.Equal(int64(3), status.Line)
+	assert.Equal(int64(3), status.Imported)
+
+	// an aborted job is resumed from where it stops.
+	_, err = m.AbortCacheImport()
+	assert.ErrorIs(err, ErrCacheImportNotRunning)
+	path = writeImportFile(t,
+		importRecordLine(t, "gpt-4o", "What is Kubernetes?", "A container orchestration system.", "stop", ""),
+		importRecordLine(t, "gpt-4o", "What is etcd?", "A distributed key-value store.", "stop", ""),
+	)
+	req = &CacheImportRequest{Path: path, RequestsPerSecond: 0.5}
+	_, err = m.StartCacheImport(req)
+	assert.NoError(err)
+	_, err = m.StartCacheImport(req)
+	assert.ErrorIs(err, ErrCacheImportRunning)
+	waitCacheImport(t, m, CacheImportStatusRunning)
+	assert.Eventually(func() bool { return m.CacheImportStatus().Line == 1 }, 5*time.Second, 10*time.Millisecond)
+	status, err = m.AbortCacheImport()
+	assert.NoError(err)
+	assert.Equal(CacheImportStatusAborted, status.Status)
+	assert.Equal(int64(1), status.Imported)
+
+	req.RequestsPerSecond = 1000
+	_, err = m.StartCacheImport(req)
+	assert.NoError(err)
+	status = waitCacheImport(t, m, CacheImportStatusCompleted)
+	assert.Equal(int64(2), status.Line)
+	assert.Equal(int64(1), status.Imported)
+	assert.Len(db.docs, 5)
+}
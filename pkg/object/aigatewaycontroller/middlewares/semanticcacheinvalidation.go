@@ -0,0 +1,376 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	invalidationChannelPrefix   = "easegress:semantic-cache:"
+	defaultInvalidationLocalTTL = 5 * time.Minute
+	// invalidationCheckInterval is the interval to compare the sequence of
+	// the channel with the received messages, to catch up missed messages.
+	invalidationCheckInterval = 10 * time.Second
+	invalidationRetryInterval = 5 * time.Second
+
+	invalidationKindPurge = "purge"
+
+	invalidationEventPublished = "published"
+	invalidationEventReceived  = "received"
+	invalidationEventMissed    = "missed"
+	invalidationEventError     = "error"
+)
+
+type (
+	// SemanticCacheInvalidationSpec broadcasts the invalidations of a
+	// semantic cache to all members through the Redis of its vector
+	// database, so members clear their local state of the cache.
+	SemanticCacheInvalidationSpec struct {
+		// Channel is the Redis pub/sub channel, default is
+		// "easegress:semantic-cache:" followed by the collection name.
+		Channel string `json:"channel,omitempty"`
+		// LocalTTL is how long the local state of the cache is used before
+		// it is verified again, so a lost invalidation only lasts LocalTTL.
+		LocalTTL string `json:"localTTL,omitempty" jsonschema:"format=duration"`
+	}
+
+	// invalidationMessage is broadcast when a cache is invalidated.
+	invalidationMessage struct {
+		Kind        string   `json:"kind"`
+		Collections []string `json:"collections,omitempty"`
+	}
+
+	// invalidationTransport delivers numbered messages among members, it
+	// is implemented by redisvector.PubSub.
+	invalidationTransport interface {
+		Publish(ctx context.Context, message string) (int64, error)
+		Sequence(ctx context.Context) (int64, error)
+		Subscribe(ctx context.Context, fn func(seq int64, message string)) error
+		Close()
+	}
+
+	// invalidationBus receives the invalidations of other members. The
+	// messages are numbered, the local state is invalidated as a whole if
+	// any message is missed, which is found by the gaps of the received
+	// numbers, or by comparing with the sequence of the channel after the
+	// bus is disconnected.
+	invalidationBus struct {
+		name       string
+		transport  invalidationTransport
+		invalidate func(msg *invalidationMessage)
+
+		lock    sync.Mutex
+		synced  bool
+		lastSeq int64
+
+		events *prometheus.CounterVec
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+)
+
+func validateSemanticCacheInvalidationSpec(spec *SemanticCacheInvalidationSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.LocalTTL != "" {
+		ttl, err := time.ParseDuration(spec.LocalTTL)
+		if err != nil {
+			return fmt.Errorf("invalid localTTL: %w", err)
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("localTTL must be greater than 0")
+		}
+	}
+	return nil
+}
+
+func (spec *SemanticCacheInvalidationSpec) localTTL() time.Duration {
+	if spec.LocalTTL == "" {
+		return defaultInvalidationLocalTTL
+	}
+	ttl, _ := time.ParseDuration(spec.LocalTTL)
+	return ttl
+}
+
+func (spec *SemanticCacheInvalidationSpec) channel(collection string) string {
+	if spec.Channel != "" {
+		return spec.Channel
+	}
+	return invalidationChannelPrefix + collection
+}
+
+func newRedisInvalidationBus(name string, spec *SemanticCacheInvalidationSpec, redisSpec *redisvector.RedisVectorDBSpec,
+	collection string, invalidate func(msg *invalidationMessage),
+) (*invalidationBus, error) {
+	pubsub, err := redisvector.NewPubSub(redisSpec, spec.channel(collection))
+	if err != nil {
+		return nil, err
+	}
+	bus := newInvalidationBus(name, pubsub, invalidate)
+	bus.start()
+	return bus, nil
+}
+
+func newInvalidationBus(name string, transport invalidationTransport, invalidate func(msg *invalidationMessage)) *invalidationBus {
+	return &invalidationBus{
+		name:       name,
+		transport:  transport,
+		invalidate: invalidate,
+		events:     metricshub.CacheInvalidationEvents.NewCounter(),
+		done:       make(chan struct{}),
+	}
+}
+
+func (b *invalidationBus) count(event string) {
+	if b.events != nil {
+		b.events.WithLabelValues(b.name, event).Inc()
+	}
+}
+
+func (b *invalidationBus) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go b.run(ctx)
+}
+
+func (b *invalidationBus) run(ctx context.Context) {
+	defer close(b.done)
+
+	go func() {
+		ticker := time.NewTicker(invalidationCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				b.catchUp(ctx)
+			}
+		}
+	}()
+
+	for {
+		// messages published while the bus is disconnected are found by
+		// the sequence of the channel.
+		b.catchUp(ctx)
+		err := b.transport.Subscribe(ctx, b.receive)
+		if ctx.Err() != nil {
+			return
+		}
+		b.count(invalidationEventError)
+		logger.Errorf("invalidation bus of middleware %s is disconnected: %v", b.name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(invalidationRetryInterval):
+		}
+	}
+}
+
+// catchUp invalidates the local state if any message is published but not
+// received. The first call only records the sequence, since the local state
+// is built after that.
+func (b *invalidationBus) catchUp(ctx context.Context) {
+	seq, err := b.transport.Sequence(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			b.count(invalidationEventError)
+			logger.Errorf("failed to get invalidation sequence of middleware %s: %v", b.name, err)
+		}
+		return
+	}
+
+	b.lock.Lock()
+	missed := b.synced && seq > b.lastSeq
+	if !b.synced || seq > b.lastSeq {
+		b.synced, b.lastSeq = true, seq
+	}
+	b.lock.Unlock()
+
+	if missed {
+		b.count(invalidationEventMissed)
+		logger.Warnf("middleware %s missed invalidations before %d, invalidate all local state", b.name, seq)
+		b.invalidate(nil)
+	}
+}
+
+func (b *invalidationBus) receive(seq int64, message string) {
+	b.count(invalidationEventReceived)
+
+	b.lock.Lock()
+	missed := b.synced && seq > b.lastSeq+1
+	if !b.synced || seq > b.lastSeq {
+		b.synced, b.lastSeq = true, seq
+	}
+	b.lock.Unlock()
+
+	if missed {
+		b.count(invalidationEventMissed)
+	}
+	msg := &invalidationMessage{}
+	if err := json.Unmarshal([]byte(message), msg); err != nil {
+		b.count(invalidationEventError)
+		logger.Errorf("invalid invalidation message %d of middleware %s: %v", seq, b.name, err)
+		msg = nil
+	}
+	// every invalidation clears all local state, so the missed ones are
+	// covered by this one.
+	b.invalidate(msg)
+}
+
+// publish broadcasts the message to all members, including this one.
+func (b *invalidationBus) publish(ctx context.Context, msg *invalidationMessage) (int64, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := b.transport.Publish(ctx, string(data))
+	if err != nil {
+		b.count(invalidationEventError)
+		return 0, err
+	}
+	b.count(invalidationEventPublished)
+	return seq, nil
+}
+
+func (b *invalidationBus) close() {
+	if b.cancel != nil {
+		b.cancel()
+		<-b.done
+	}
+	b.transport.Close()
+}
+
+var (
+	_ Purger = (*semanticCacheMiddleware)(nil)
+	_ Closer = (*semanticCacheMiddleware)(nil)
+)
+
+func (m *semanticCacheMiddleware) initInvalidation(spec *SemanticCacheInvalidationSpec) {
+	ttl := spec.localTTL()
+	m.vectorHandler.localTTL = ttl
+	if m.fallbackVectorHandler != nil {
+		m.fallbackVectorHandler.localTTL = ttl
+	}
+
+	dbSpec := m.spec.SemanticCache.VectorDB
+	bus, err := newRedisInvalidationBus(m.spec.Name, spec, dbSpec.Redis, dbSpec.CollectionName, m.onInvalidate)
+	if err != nil {
+		// the local state still expires in localTTL.
+		logger.Errorf("failed to create invalidation bus of semantic cache %s: %v", m.spec.Name, err)
+		return
+	}
+	m.bus = bus
+}
+
+// onInvalidate clears the local state of the cache, msg is nil if the
+// invalidations are missed.
+func (m *semanticCacheMiddleware) onInvalidate(msg *invalidationMessage) {
+	if msg != nil {
+		logger.Infof("semantic cache %s is invalidated by %s of %v", m.spec.Name, msg.Kind, msg.Collections)
+	}
+	m.vectorHandler.invalidate()
+	if m.fallbackVectorHandler != nil {
+		m.fallbackVectorHandler.invalidate()
+	}
+	if m.staleReads != nil {
+		m.staleReads.purge()
+	}
+}
+
+// Purge drops the collections of the cache, including the fallback, and
+// broadcasts the purge to other members if invalidation is enabled.
+func (m *semanticCacheMiddleware) Purge(ctx context.Context) (*PurgeResult, error) {
+	handlers := []*semanticCacheVectorHandler{m.vectorHandler}
+	if m.fallbackVectorHandler != nil {
+		handlers = append(handlers, m.fallbackVectorHandler)
+	}
+	return m.purge(ctx, handlers)
+}
+
+// purge drops the collections of the handlers, and broadcasts the purge.
+func (m *semanticCacheMiddleware) purge(ctx context.Context, handlers []*semanticCacheVectorHandler) (*PurgeResult, error) {
+	result := &PurgeResult{}
+	for _, h := range handlers {
+		dropper, ok := h.vectorDB.(vecdbtypes.CollectionDropper)
+		if !ok || h.dbSpec.Type != vectordb.TypeRedis {
+			return result, fmt.Errorf("vectorDB %s of semantic cache %s does not support purge", h.dbSpec.Type, m.spec.Name)
+		}
+		for _, name := range getRedisDBNames(h.dbSpec.CollectionName) {
+			if err := dropper.DropCollection(ctx, name); err != nil {
+				return result, err
+			}
+			result.Collections = append(result.Collections, name)
+		}
+		h.invalidate()
+	}
+	if m.staleReads != nil {
+		m.staleReads.purge()
+	}
+
+	if m.bus == nil {
+		return result, nil
+	}
+	seq, err := m.bus.publish(ctx, &invalidationMessage{Kind: invalidationKindPurge, Collections: result.Collections})
+	if err != nil {
+		return result, fmt.Errorf("purged but failed to notify other members, they are invalidated in %s: %w",
+			m.vectorHandler.localTTL, err)
+	}
+	result.Sequence = seq
+	return result, nil
+}
+
+// Close stops the invalidation bus, the scheduled integrity checks, the
+// offloading, the revalidations and the re-embedding, and releases the
+// write queues.
+func (m *semanticCacheMiddleware) Close() {
+	// the running cache import is resumed when it is started again, and
+	// the re-embedding starts over, overwriting the entries copied.
+	m.AbortCacheImport()
+	m.AbortReembed()
+	if m.bus != nil {
+		m.bus.close()
+	}
+	if m.coldStorage != nil {
+		m.coldStorage.close()
+	}
+	if m.staleReads != nil {
+		m.staleReads.close()
+	}
+	for _, stop := range m.stopIntegrityChecks {
+		stop()
+	}
+	m.vectorHandler.close()
+	if m.fallbackVectorHandler != nil {
+		m.fallbackVectorHandler.close()
+	}
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/pgvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+)
+
+// fakeTransport is a channel shared by members in memory.
+type fakeTransport struct {
+	lock     sync.Mutex
+	seq      int64
+	messages chan string
+	closed   bool
+}
+
+func (tr *fakeTransport) Publish(ctx context.Context, message string) (int64, error) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.seq++
+	return tr.seq, nil
+}
+
+func (tr *fakeTransport) Sequence(ctx context.Context) (int64, error) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	return tr.seq, nil
+}
+
+func (tr *fakeTransport) Subscribe(ctx context.Context, fn func(seq int64, message string)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message := <-tr.messages:
+			tr.lock.Lock()
+			tr.seq++
+			seq := tr.seq
+			tr.lock.Unlock()
+			fn(seq, message)
+		}
+	}
+}
+
+func (tr *fakeTransport) Close() {
+	tr.closed = true
+}
+
+// droppableVectorDB records the dropped collections and the verifications
+// of the collections of its handlers.
+type droppableVectorDB struct {
+	created int
+	ensured int
+	dropped []string
+}
+
+type ensurableVectorHandler struct {
+	*explainVectorDB
+	db *droppableVectorDB
+}
+
+func (db *droppableVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	db.created++
+	return &ensurableVectorHandler{explainVectorDB: &explainVectorDB{}, db: db}, nil
+}
+
+func (db *droppableVectorDB) DropCollection(ctx context.Context, name string) error {
+	db.dropped = append(db.dropped, name)
+	return nil
+}
+
+func (h *ensurableVectorHandler) EnsureSchema(ctx context.Context) error {
+	h.db.ensured++
+	return nil
+}
+
+func TestValidateSemanticCacheInvalidationSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateSemanticCacheInvalidationSpec(nil))
+	assert.NoError(validateSemanticCacheInvalidationSpec(&SemanticCacheInvalidationSpec{LocalTTL: "1m"}))
+	assert.Error(validateSemanticCacheInvalidationSpec(&SemanticCacheInvalidationSpec{LocalTTL: "1x"}))
+	assert.Error(validateSemanticCacheInvalidationSpec(&SemanticCacheInvalidationSpec{LocalTTL: "-1m"}))
+
+	spec := &SemanticCacheInvalidationSpec{}
+	assert.Equal(defaultInvalidationLocalTTL, spec.localTTL())
+	assert.Equal("easegress:semantic-cache:movie", spec.channel("movie"))
+
+	// invalidation is broadcast through Redis only.
+	middlewareSpec := &MiddlewareSpec{
+		Name: "cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "openai",
+				BaseURL:      "http://localhost:8080",
+				Model:        "text-embedding-3-small",
+				APIKey:       "test-api-key",
+			},
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{Type: "postgres", Threshold: 0.9, CollectionName: "movie"},
+				Postgres:   &pgvector.PostgresVectorDBSpec{ConnectionURL: "postgres://localhost:5432/db"},
+			},
+			Invalidation: &SemanticCacheInvalidationSpec{},
+		},
+	}
+	assert.Error(ValidateSpec(middlewareSpec))
+	middlewareSpec.SemanticCache.VectorDB = &vectordb.Spec{
+		CommonSpec: vecdbtypes.CommonSpec{Type: "redis", Threshold: 0.9, CollectionName: "movie"},
+		Redis:      &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+	}
+	assert.NoError(ValidateSpec(middlewareSpec))
+}
+
+func TestInvalidationBus(t *testing.T) {
+	assert := assert.New(t)
+
+	var invalidations []*invalidationMessage
+	transport := &fakeTransport{}
+	bus := newInvalidationBus("cache", transport, func(msg *invalidationMessage) {
+		invalidations = append(invalidations, msg)
+	})
+	ctx := context.Background()
+
+	// the first catch up only records the sequence.
+	transport.seq = 3
+	bus.catchUp(ctx)
+	assert.Empty(invalidations)
+	assert.Equal(int64(3), bus.lastSeq)
+
+	bus.receive(4, `{"kind":"purge","collections":["movie_chat_stream"]}`)
+	assert.Len(invalidations, 1)
+	assert.Equal(invalidationKindPurge, invalidations[0].Kind)
+	assert.Equal([]string{"movie_chat_stream"}, invalidations[0].Collections)
+
+	// message 5 is missed, the local state is invalidated by message 6.
+	bus.receive(6, `{"kind":"purge"}`)
+	assert.Len(invalidations, 2)
+	assert.Equal(int64(6), bus.lastSeq)
+
+	// malformed messages invalidate all local state.
+	bus.receive(7, `purge`)
+	assert.Len(invalidations, 3)
+	assert.Nil(invalidations[2])
+
+	// messages published while disconnected are caught up.
+	bus.catchUp(ctx)
+	assert.Len(invalidations, 3)
+	transport.seq = 9
+	bus.catchUp(ctx)
+	assert.Len(invalidations, 4)
+	assert.Nil(invalidations[3])
+	assert.Equal(int64(9), bus.lastSeq)
+
+	seq, err := bus.publish(ctx, &invalidationMessage{Kind: invalidationKindPurge})
+	assert.NoError(err)
+	assert.Equal(int64(10), seq)
+
+	bus.close()
+	assert.True(transport.closed)
+}
+
+func TestInvalidationBusRun(t *testing.T) {
+	assert := assert.New(t)
+
+	received := make(chan *invalidationMessage, 1)
+	transport := &fakeTransport{messages: make(chan string)}
+	bus := newInvalidationBus("cache", transport, func(msg *invalidationMessage) {
+		received <- msg
+	})
+	bus.start()
+
+	transport.messages <- `{"kind":"purge"}`
+	select {
+	case msg := <-received:
+		assert.Equal(invalidationKindPurge, msg.Kind)
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalidation is not received")
+	}
+	bus.close()
+	assert.True(transport.closed)
+}
+
+func TestSemanticCachePurge(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{Type: "redis", Threshold: 0.9, CollectionName: "movie"},
+				Redis:      &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+			},
+		},
+	}
+	db := &droppableVectorDB{}
+	cache := &semanticCacheMiddleware{
+		spec: spec,
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+			localTTL: time.Hour,
+		},
+	}
+	aiCtx := &aicontext.Context{
+		RespType: aicontext.ResponseTypeChatCompletions,
+		ReqInfo:  &protocol.GeneralRequest{},
+	}
+
+	getHandler := func() {
+		_, err := cache.vectorHandler.GetHandler(aiCtx, []float32{1, 0})
+		assert.NoError(err)
+	}
+	getHandler()
+	getHandler()
+	assert.Equal(1, db.created)
+	assert.Zero(db.ensured)
+
+	// the handler is verified again after it expires.
+	cache.vectorHandler.verified[cache.vectorHandler.getHandlerKey(aiCtx)] = time.Now().Add(-2 * time.Hour)
+	getHandler()
+	assert.Equal(1, db.created)
+	assert.Equal(1, db.ensured)
+
+	// purged without the bus.
+	result, err := cache.Purge(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"movie_chat_non_stream", "movie_chat_stream", "movie_completion_non_stream", "movie_completion_stream"}, result.Collections)
+	assert.Equal(result.Collections, db.dropped)
+	assert.Zero(result.Sequence)
+	getHandler()
+	assert.Equal(2, db.ensured)
+
+	// purges are broadcast, and invalidations of others are applied.
+	transport := &fakeTransport{}
+	cache.bus = newInvalidationBus("cache", transport, cache.onInvalidate)
+	result, err = cache.Purge(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(1), result.Sequence)
+
+	getHandler()
+	assert.Equal(3, db.ensured)
+	cache.bus.receive(2, fmt.Sprintf(`{"kind":%q}`, invalidationKindPurge))
+	getHandler()
+	assert.Equal(4, db.ensured)
+	assert.Equal(1, db.created)
+
+	cache.Close()
+	assert.True(transport.closed)
+
+	// postgres does not support purge.
+	cache.vectorHandler.dbSpec = &vectordb.Spec{CommonSpec: vecdbtypes.CommonSpec{Type: "postgres"}}
+	cache.vectorHandler.vectorDB = &explainVectorDB{}
+	_, err = cache.Purge(context.Background())
+	assert.Error(err)
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// semanticCacheDefaultProbeTopK is the default number of candidates of a probe.
+const semanticCacheDefaultProbeTopK = 5
+
+type (
+	// SemanticCacheProbeResult explains the cache lookup of a request.
+	SemanticCacheProbeResult struct {
+		// StructuralKey is the index or table searched for the request.
+		StructuralKey string  `json:"structuralKey"`
+		Content       string  `json:"content"`
+		Threshold     float64 `json:"threshold"`
+		// Hit tells whether the lookup returns a cache.
+		Hit               bool                           `json:"hit"`
+		EmbeddingDuration string                         `json:"embeddingDuration"`
+		SearchDuration    string                         `json:"searchDuration"`
+		Candidates        []*SemanticCacheProbeCandidate `json:"candidates"`
+		// Fallback is the lookup of the fallback cache, which is only
+		// searched if the primary cache misses.
+		Fallback *SemanticCacheProbeResult `json:"fallback,omitempty"`
+	}
+
+	// SemanticCacheProbeCandidate is a cache similar to the request.
+	SemanticCacheProbeCandidate struct {
+		ID       string         `json:"id"`
+		Distance float64        `json:"distance"`
+		Score    float64        `json:"score"`
+		Passed   bool           `json:"passed"`
+		Metadata map[string]any `json:"metadata,omitempty"`
+	}
+)
+
+var _ Prober = (*semanticCacheMiddleware)(nil)
+
+// Probe explains the cache lookup of the request. It takes the same code
+// path as Handle, but never writes the response or inserts caches.
+func (m *semanticCacheMiddleware) Probe(ctx *aicontext.Context, options *ProbeOptions) (any, error) {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions && ctx.RespType != aicontext.ResponseTypeCompletions {
+		return nil, fmt.Errorf("semantic cache does not support %s requests", ctx.RespType)
+	}
+
+	topK := semanticCacheDefaultProbeTopK
+	if options != nil && options.TopK > 0 {
+		topK = options.TopK
+	}
+
+	content, err := m.getContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.probe(ctx, m.embeddingsHandler, m.vectorHandler, content, topK)
+	if err != nil {
+		return nil, err
+	}
+	if m.tuner != nil {
+		// the primary cache is searched with the tuned threshold.
+		result.Threshold = m.tuner.currentThreshold()
+		for _, candidate := range result.Candidates {
+			candidate.Passed = candidate.Score >= result.Threshold
+		}
+		result.Hit = len(result.Candidates) > 0 && result.Candidates[0].Passed
+	}
+	if !result.Hit && m.fallbackVectorHandler != nil {
+		result.Fallback, err = m.probe(ctx, m.fallbackEmbeddingsHandler, m.fallbackVectorHandler, content, topK)
+		if err != nil {
+			return nil, fmt.Errorf("failed to probe fallback cache: %w", err)
+		}
+	}
+	return result, nil
+}
+
+func (m *semanticCacheMiddleware) probe(ctx *aicontext.Context, embeddingsHandler embeddings.EmbeddingHandler,
+	vectorHandler *semanticCacheVectorHandler, content string, topK int,
+) (*SemanticCacheProbeResult, error) {
+	result := &SemanticCacheProbeResult{
+		StructuralKey: vectorHandler.getStructuralKey(ctx),
+		Content:       content,
+		Threshold:     vectorHandler.dbSpec.Threshold,
+		Candidates:    []*SemanticCacheProbeCandidate{},
+	}
+
+	start := time.Now()
+	embedding, err := embeddingsHandler.EmbedQuery(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed content: %w", err)
+	}
+	result.EmbeddingDuration = time.Since(start).String()
+
+	start = time.Now()
+	docs, err := m.query(ctx, vectorHandler, embedding, vecdbtypes.WithExplain(), vecdbtypes.WithLimit(topK))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search similarity in vector database: %w", err)
+	}
+	result.SearchDuration = time.Since(start).String()
+
+	for _, doc := range docs {
+		candidate := &SemanticCacheProbeCandidate{
+			ID:       fmt.Sprintf("%v", doc["id"]),
+			Metadata: map[string]any{},
+		}
+		candidate.Distance, _ = doc[vecdbtypes.ExplainDistanceField].(float64)
+		candidate.Score, _ = doc[vecdbtypes.ExplainScoreField].(float64)
+		candidate.Passed, _ = doc[vecdbtypes.ExplainPassedField].(bool)
+		for k, v := range doc {
+			switch k {
+			case "id", "embedding", vecdbtypes.ExplainDistanceField, vecdbtypes.ExplainScoreField, vecdbtypes.ExplainPassedField:
+			default:
+				candidate.Metadata[k] = v
+			}
+		}
+		result.Candidates = append(result.Candidates, candidate)
+	}
+	// the candidates are sorted by distance, and Handle takes the first
+	// one that passes the threshold.
+	result.Hit = len(result.Candidates) > 0 && result.Candidates[0].Passed
+	return result, nil
+}
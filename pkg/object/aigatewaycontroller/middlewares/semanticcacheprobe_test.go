@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"testing"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/stretchr/testify/assert"
+)
+
+// explainVectorDB searches documents by cosine distance, and supports explain.
+type explainVectorDB struct {
+	data     []map[string]any
+	inserted int
+}
+
+func (db *explainVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	return db, nil
+}
+
+func (db *explainVectorDB) InsertDocuments(ctx context.Context, doc []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	db.inserted += len(doc)
+	return nil, nil
+}
+
+func (db *explainVectorDB) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	opts := &vecdbtypes.HandlerSearchOptions{Limit: 1}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	var docs []map[string]any
+	for _, d := range db.data {
+		doc := map[string]any{}
+		for k, v := range d {
+			doc[k] = v
+		}
+		distance := 1 - float64(cosineSimilarity(doc["embedding"].([]float32), opts.RedisVectorFilterValues))
+		if !opts.Explain && 1-distance < float64(opts.ScoreThreshold) {
+			continue
+		}
+		vecdbtypes.ExplainDocument(doc, distance, 1-distance, opts.ScoreThreshold)
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i][vecdbtypes.ExplainDistanceField].(float64) < docs[j][vecdbtypes.ExplainDistanceField].(float64)
+	})
+	if len(docs) > opts.Limit {
+		docs = docs[:opts.Limit]
+	}
+	return docs, nil
+}
+
+func cosineSimilarity(a, b []float32) float32 {
+	var dot, na, nb float32
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	return dot / float32(math.Sqrt(float64(na))*math.Sqrt(float64(nb)))
+}
+
+func TestSemanticCacheProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "openai",
+				BaseURL:      "http://localhost:8080",
+				Model:        "text-embedding-3-small",
+				APIKey:       "test-api-key",
+			},
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{
+					Type:           "redis",
+					Threshold:      0.999,
+					CollectionName: "redis-test",
+				},
+				Redis: &redisvector.RedisVectorDBSpec{
+					URL: "redis://localhost:6379",
+				},
+			},
+		},
+	}
+
+	db := &explainVectorDB{
+		data: []map[string]any{
+			{"id": "near", "embedding": []float32{1, 0.1, 0}, "data": "near", "status": 200},
+			{"id": "exact", "embedding": []float32{1, 0, 0}, "data": "exact", "status": 200},
+			{"id": "far", "embedding": []float32{0, 1, 0}, "data": "far", "status": 200},
+		},
+	}
+	cache := &semanticCacheMiddleware{
+		spec: spec,
+		embeddingsHandler: &topicEmbeddingHandler{vectors: map[string][]float32{
+			"hello": {1, 0, 0},
+			"bye":   {1, 0.2, 0},
+		}},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template: template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+	}
+
+	probe := func(content string, topK int) *SemanticCacheProbeResult {
+		data := map[string]any{
+			"model":    "gpt-4.1",
+			"messages": []map[string]any{{"role": "user", "content": content}},
+		}
+		jsonData, err := json.Marshal(data)
+		assert.Nil(err)
+		ctx := egContext.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		setRequest(t, ctx, "probe", req)
+		aiCtx, err := aicontext.New(ctx, nil)
+		assert.Nil(err)
+
+		result, err := cache.Probe(aiCtx, &ProbeOptions{TopK: topK})
+		assert.Nil(err)
+		// probes never write responses or register callbacks to insert caches.
+		assert.False(aiCtx.IsStopped())
+		assert.Empty(aiCtx.Callbacks())
+		return result.(*SemanticCacheProbeResult)
+	}
+
+	result := probe("hello", 2)
+	assert.True(result.Hit)
+	assert.Equal("redis-test_chat_non_stream", result.StructuralKey)
+	assert.Equal("hello", result.Content)
+	assert.Len(result.Candidates, 2)
+	assert.Equal("exact", result.Candidates[0].ID)
+	assert.True(result.Candidates[0].Passed)
+	assert.InDelta(1.0, result.Candidates[0].Score, 1e-6)
+	assert.Equal("near", result.Candidates[1].ID)
+	assert.False(result.Candidates[1].Passed)
+	assert.Greater(result.Candidates[1].Distance, 0.0)
+	assert.Equal("near", result.Candidates[1].Metadata["data"])
+	assert.NotContains(result.Candidates[1].Metadata, "embedding")
+	assert.NotEmpty(result.EmbeddingDuration)
+	assert.NotEmpty(result.SearchDuration)
+
+	// near-misses are returned.
+	result = probe("bye", 5)
+	assert.False(result.Hit)
+	assert.Len(result.Candidates, 3)
+	assert.Equal(0, db.inserted)
+}
@@ -0,0 +1,366 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+)
+
+const (
+	// semanticCachePromptField is the content of the request the entry is
+	// cached for, it is embedded again when the entry is migrated from
+	// the fallback by re-embedding.
+	semanticCachePromptField = "prompt"
+)
+
+// ErrNoFallback means the semantic cache has no fallback.
+var ErrNoFallback = errors.New("semantic cache has no fallback")
+
+type (
+	// semanticCacheIndex is an index of a semantic cache on Redis, the
+	// entries of the requests of every response type and streaming are
+	// stored in their own index.
+	semanticCacheIndex struct {
+		name     string
+		respType aicontext.ResponseType
+		stream   bool
+	}
+)
+
+var (
+	_ Reembedder     = (*semanticCacheMiddleware)(nil)
+	_ FallbackPurger = (*semanticCacheMiddleware)(nil)
+)
+
+// semanticCacheReembedFields are the fields of the entries of the fallback
+// copied into the primary cache.
+var semanticCacheReembedFields = []string{
+	semanticCachePromptField, "data", "header", "status",
+	semanticCacheSchemaVersionField, semanticCacheSourceField,
+	semanticCacheGenerationMsField, semanticCacheGenerationTokensField,
+	semanticCachePromptHashField, semanticCacheKeyIDField, semanticCacheSignatureField,
+}
+
+// getSemanticCacheIndexes returns the indexes of the collection in the
+// order they are re-embedded, it is the order of getRedisDBNames.
+func getSemanticCacheIndexes(collection string) []*semanticCacheIndex {
+	var indexes []*semanticCacheIndex
+	for _, respType := range []aicontext.ResponseType{aicontext.ResponseTypeChatCompletions, aicontext.ResponseTypeCompletions} {
+		for _, stream := range []bool{false, true} {
+			indexes = append(indexes, &semanticCacheIndex{
+				name:     getRedisDBName(collection, respType, stream),
+				respType: respType,
+				stream:   stream,
+			})
+		}
+	}
+	return indexes
+}
+
+// parseSemanticCacheReembedCursor parses the cursor of a re-embedding job
+// of a semantic cache into the index being scanned and its scan cursor.
+func parseSemanticCacheReembedCursor(indexes []*semanticCacheIndex, cursor string) (int, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	i := strings.LastIndex(cursor, "|")
+	if i < 0 {
+		return 0, "", fmt.Errorf("invalid cursor %s", cursor)
+	}
+	for j, index := range indexes {
+		if index.name == cursor[:i] {
+			return j, cursor[i+1:], nil
+		}
+	}
+	return 0, "", fmt.Errorf("index of cursor %s not found", cursor)
+}
+
+// EmbeddingModel returns the model of the embeddings of the primary cache.
+func (m *semanticCacheMiddleware) EmbeddingModel() string {
+	return m.spec.SemanticCache.Embeddings.Model
+}
+
+// reembedScanner returns the scanner of the fallback, the entries of the
+// fallback are re-embedded by the model of the primary cache and copied
+// into it.
+func (m *semanticCacheMiddleware) reembedScanner() (vecdbtypes.DocumentScanner, error) {
+	if m.fallbackVectorHandler == nil {
+		return nil, fmt.Errorf("re-embedding requires the fallback of the semantic cache: %w", ErrNoFallback)
+	}
+	dbSpec := m.fallbackVectorHandler.dbSpec
+	scanner, ok := m.fallbackVectorHandler.vectorDB.(vecdbtypes.DocumentScanner)
+	if !ok || dbSpec.Type != vectordb.TypeRedis {
+		return nil, fmt.Errorf("vectorDB %s: %w", dbSpec.Type, vectordb.ErrScanNotSupported)
+	}
+	return scanner, nil
+}
+
+// PlanReembed counts the entries of the fallback, and estimates their
+// tokens from the prompts of a sample of them.
+func (m *semanticCacheMiddleware) PlanReembed(ctx context.Context, req *ReembedRequest) (*ReembedPlan, error) {
+	if err := validateReembedRequest(req); err != nil {
+		return nil, err
+	}
+	scanner, err := m.reembedScanner()
+	if err != nil {
+		return nil, err
+	}
+	dbSpec := m.fallbackVectorHandler.dbSpec
+	counter, ok := m.fallbackVectorHandler.vectorDB.(vecdbtypes.FieldCounter)
+	if !ok {
+		return nil, fmt.Errorf("vectorDB %s does not support counting documents", dbSpec.Type)
+	}
+
+	plan := &ReembedPlan{
+		Collection:       dbSpec.CollectionName,
+		Model:            m.EmbeddingModel(),
+		EmbeddingVersion: m.spec.SemanticCache.VectorDB.EmbeddingVersion,
+		Request:          req,
+	}
+	indexes := getSemanticCacheIndexes(dbSpec.CollectionName)
+	for _, index := range indexes {
+		counts, err := counter.CountByField(ctx, index.name, semanticCacheSchemaVersionField)
+		if errors.Is(err, vecdbtypes.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to count entries: %w", err)
+		}
+		for _, n := range counts {
+			plan.Documents += n
+		}
+	}
+	// all entries of the fallback are copied into the primary cache.
+	plan.Pending = plan.Documents
+
+	var tokens int64
+	errSampled := errors.New("entries sampled")
+	for _, index := range indexes {
+		if plan.Pending == 0 {
+			break
+		}
+		fields := []string{semanticCachePromptField}
+		err := scanner.ScanDocuments(ctx, index.name, "", req.getBatchSize(), fields, func(docs []map[string]any, next string) error {
+			for _, doc := range docs {
+				prompt, _ := doc[semanticCachePromptField].(string)
+				tokens += int64(estimateTokens(prompt))
+				plan.Sampled++
+				if plan.Sampled >= req.getSampleSize() {
+					return errSampled
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errSampled) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to sample entries: %w", err)
+		}
+	}
+	if plan.Sampled > 0 {
+		plan.EstimatedTokens = int64(math.Round(float64(tokens) / float64(plan.Sampled) * float64(plan.Pending)))
+	}
+	plan.EstimatedCost = req.cost(plan.EstimatedTokens)
+	plan.EstimatedDuration = req.projectDuration(plan).String()
+	return plan, nil
+}
+
+// StartReembed plans and starts copying the entries of the fallback into
+// the primary cache with their prompts embedded by the model of the
+// primary cache. A job started after an aborted or failed one resumes
+// from its cursor.
+func (m *semanticCacheMiddleware) StartReembed(ctx context.Context, req *ReembedRequest) (*ReembedStatus, error) {
+	if m.spec.SemanticCache.ReadOnly {
+		return nil, fmt.Errorf("semantic cache %s is read-only", m.spec.Name)
+	}
+	plan, err := m.PlanReembed(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return m.reembeds.start(m.spec.Name, plan, m.reembedEntries)
+}
+
+// ReembedStatus returns the status of the last job.
+func (m *semanticCacheMiddleware) ReembedStatus() *ReembedStatus {
+	return m.reembeds.status()
+}
+
+// AbortReembed stops the running job and waits for it.
+func (m *semanticCacheMiddleware) AbortReembed() (*ReembedStatus, error) {
+	return m.reembeds.abort()
+}
+
+// reembedEntries scans the indexes of the fallback from the cursor of the
+// job, and copies the entries into the indexes of the same requests in the
+// primary cache batch by batch. The entries keep their IDs on Redis, so
+// the ones copied again after resuming overwrite the copies. The entries
+// without prompts, which are written before prompts are stored, and the
+// ones failing the verification or the migration of their schema versions
+// are skipped, they are still migrated when they are hit.
+func (m *semanticCacheMiddleware) reembedEntries(ctx context.Context, job *reembedJob) error {
+	scanner, err := m.reembedScanner()
+	if err != nil {
+		return err
+	}
+	status := job.getStatus()
+	plan, req := status.Plan, status.Plan.Request
+	indexes := getSemanticCacheIndexes(plan.Collection)
+	start, cursor, err := parseSemanticCacheReembedCursor(indexes, status.Cursor)
+	if err != nil {
+		return err
+	}
+
+	for i := start; i < len(indexes); i++ {
+		index := indexes[i]
+		err := scanner.ScanDocuments(ctx, index.name, cursor, req.getBatchSize(), semanticCacheReembedFields, func(docs []map[string]any, next string) error {
+			job.update(func(s *ReembedStatus) { s.Scanned += int64(len(docs)) })
+			if err := m.reembedBatch(ctx, job, index, docs); err != nil {
+				return err
+			}
+			switch {
+			case next != "":
+				next = index.name + "|" + next
+			case i+1 < len(indexes):
+				next = indexes[i+1].name + "|"
+			}
+			job.update(func(s *ReembedStatus) { s.Cursor = next })
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		cursor = ""
+	}
+	job.update(func(s *ReembedStatus) { s.Cursor = "" })
+	return nil
+}
+
+// reembedBatch embeds the prompts of the entries of the fallback index,
+// and writes them into the primary cache.
+func (m *semanticCacheMiddleware) reembedBatch(ctx context.Context, job *reembedJob, index *semanticCacheIndex, docs []map[string]any) error {
+	req := job.getStatus().Plan.Request
+	structure := &aicontext.Context{RespType: index.respType, ReqInfo: &protocol.GeneralRequest{Stream: index.stream}}
+	for _, doc := range docs {
+		prompt, _ := doc[semanticCachePromptField].(string)
+		cache, err := m.reembedEntry(doc)
+		if prompt == "" || err != nil {
+			if err != nil {
+				logger.Warnf("semantic cache %s skips re-embedding entry %v: %v", m.spec.Name, doc["id"], err)
+			}
+			job.update(func(s *ReembedStatus) { s.Skipped++ })
+			continue
+		}
+
+		tokens := int64(estimateTokens(prompt))
+		cost := req.cost(tokens)
+		if err := job.waitBudget(ctx, cost); err != nil {
+			return err
+		}
+		if err := job.pace(ctx, tokens); err != nil {
+			return err
+		}
+		embedding, err := m.embeddingsHandler.EmbedQuery(prompt)
+		if err != nil {
+			return fmt.Errorf("failed to embed entry %v: %w", doc["id"], err)
+		}
+		job.update(func(s *ReembedStatus) {
+			s.Tokens += tokens
+			s.Spent += cost
+			s.SpentToday += cost
+		})
+
+		handler, err := m.vectorHandler.GetHandler(structure, embedding)
+		if err != nil {
+			return fmt.Errorf("failed to get vector handler: %w", err)
+		}
+		// the entries are written without the write queue, so the
+		// failures are reported.
+		if queued, ok := handler.(*vectordb.QueuedHandler); ok {
+			handler = queued.VectorHandler
+		}
+		cache["embedding"] = embedding
+		// the embedded entry is written even if the job is aborted, since
+		// it is paid for.
+		if err := m.storeCache(context.WithoutCancel(ctx), handler, prompt, cache); err != nil {
+			return fmt.Errorf("failed to write entry %v: %w", doc["id"], err)
+		}
+		job.update(func(s *ReembedStatus) { s.Reembedded++ })
+	}
+	return nil
+}
+
+// reembedEntry verifies the entry of the fallback, and returns it migrated
+// to the current schema version without the embedding. The entry keeps its
+// ID on Redis, the ID is generated by PostgreSQL otherwise.
+func (m *semanticCacheMiddleware) reembedEntry(doc map[string]any) (map[string]any, error) {
+	if m.signer != nil {
+		if err := m.signer.verify(doc); err != nil {
+			return nil, err
+		}
+	}
+	entry, err := decodeSemanticCacheEntry(doc)
+	if err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(entry.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response header: %w", err)
+	}
+	cache := map[string]any{
+		"data":   entry.Data,
+		"header": string(header),
+		"status": entry.Status,
+	}
+	if m.spec.SemanticCache.VectorDB.Type == vectordb.TypeRedis {
+		cache["id"] = doc["id"]
+	}
+	if source, _ := doc[semanticCacheSourceField].(string); source != "" {
+		cache[semanticCacheSourceField] = source
+	}
+	for _, field := range []string{semanticCacheGenerationMsField, semanticCacheGenerationTokensField} {
+		if value, err := vecdbtypes.ToFloat64(doc[field]); err == nil {
+			cache[field] = int64(value)
+		}
+	}
+	return cache, nil
+}
+
+// PurgeFallback drops the collections of the fallback once its entries
+// are re-embedded into the primary cache, and broadcasts the purge to
+// other members if invalidation is enabled.
+func (m *semanticCacheMiddleware) PurgeFallback(ctx context.Context) (*PurgeResult, error) {
+	if m.fallbackVectorHandler == nil {
+		return nil, ErrNoFallback
+	}
+	if m.reembeds.running() {
+		return nil, ErrReembedRunning
+	}
+	return m.purge(ctx, []*semanticCacheVectorHandler{m.fallbackVectorHandler})
+}
@@ -0,0 +1,490 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+)
+
+func skipDockerTest() bool {
+	// For windows and mac, the github action runner does not support docker for now.
+	skipDocker := os.Getenv("EASEGRESS_TEST_SKIP_DOCKER")
+	return skipDocker == "true"
+}
+
+// indexedVectorDB keeps the documents of every index in the order they are
+// inserted, inserting a document replaces the one of the same ID, and the
+// searches only match the same embedding.
+type indexedVectorDB struct {
+	lock    sync.Mutex
+	indexes map[string][]map[string]any
+	dropped []string
+}
+
+type indexedVectorHandler struct {
+	db    *indexedVectorDB
+	index string
+}
+
+func newIndexedVectorDB() *indexedVectorDB {
+	return &indexedVectorDB{indexes: map[string][]map[string]any{}}
+}
+
+func (db *indexedVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	o := &vecdbtypes.Options{}
+	for _, opt := range options {
+		opt(o)
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.indexes[o.DBName]; !ok {
+		db.indexes[o.DBName] = nil
+	}
+	return &indexedVectorHandler{db: db, index: o.DBName}, nil
+}
+
+func (db *indexedVectorDB) docs(index string) []map[string]any {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return slices.Clone(db.indexes[index])
+}
+
+func (db *indexedVectorDB) CountByField(ctx context.Context, name, field string) (map[string]int64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	docs, ok := db.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("index %s: %w", name, vecdbtypes.ErrNotFound)
+	}
+	counts := map[string]int64{}
+	for _, doc := range docs {
+		counts[fmt.Sprint(doc[field])]++
+	}
+	return counts, nil
+}
+
+func (db *indexedVectorDB) ScanDocuments(ctx context.Context, name, cursor string, count int, fields []string,
+	fn func(docs []map[string]any, next string) error,
+) error {
+	start := 0
+	if cursor != "" {
+		start, _ = strconv.Atoi(cursor)
+	}
+	for {
+		docs := db.docs(name)
+		if start >= len(docs) {
+			return nil
+		}
+		end := min(start+count, len(docs))
+		page := make([]map[string]any, 0, end-start)
+		for _, doc := range docs[start:end] {
+			d := map[string]any{"id": doc["id"]}
+			for _, field := range fields {
+				if v, ok := doc[field]; ok {
+					d[field] = fmt.Sprint(v)
+				}
+			}
+			page = append(page, d)
+		}
+		next := ""
+		if end < len(docs) {
+			next = strconv.Itoa(end)
+		}
+		if err := fn(page, next); err != nil {
+			return err
+		}
+		start = end
+	}
+}
+
+func (db *indexedVectorDB) DropCollection(ctx context.Context, name string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.indexes, name)
+	db.dropped = append(db.dropped, name)
+	return nil
+}
+
+func (h *indexedVectorHandler) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	h.db.lock.Lock()
+	defer h.db.lock.Unlock()
+	var ids []string
+	for _, doc := range docs {
+		if _, ok := doc["id"]; !ok {
+			doc["id"] = uuid.NewString()
+		}
+		index := h.db.indexes[h.index]
+		i := slices.IndexFunc(index, func(d map[string]any) bool { return d["id"] == doc["id"] })
+		if i < 0 {
+			h.db.indexes[h.index] = append(index, doc)
+		} else {
+			index[i] = doc
+		}
+		ids = append(ids, fmt.Sprint(doc["id"]))
+	}
+	return ids, nil
+}
+
+func (h *indexedVectorHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	opts := &vecdbtypes.HandlerSearchOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	for _, doc := range h.db.docs(h.index) {
+		if slices.Equal(doc["embedding"].([]float32), opts.RedisVectorFilterValues) {
+			return []map[string]any{doc}, nil
+		}
+	}
+	return nil, vecdbtypes.ErrSimilaritySearchNotFound
+}
+
+// prefixEmbeddingHandler embeds the texts with a prefix, like a different
+// embedding model.
+type prefixEmbeddingHandler struct {
+	prefix string
+}
+
+func (e *prefixEmbeddingHandler) EmbedDocuments(text string) ([]float32, error) {
+	return embeddingString(e.prefix + text), nil
+}
+
+func (e *prefixEmbeddingHandler) EmbedQuery(text string) ([]float32, error) {
+	return embeddingString(e.prefix + text), nil
+}
+
+func newReembedCacheSpec(fallback bool) *MiddlewareSpec {
+	newVectorDBSpec := func(collection, version string) *vectordb.Spec {
+		return &vectordb.Spec{
+			CommonSpec: vecdbtypes.CommonSpec{
+				Type:             "redis",
+				Threshold:        0.99,
+				CollectionName:   collection,
+				EmbeddingVersion: version,
+			},
+			Redis: &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+		}
+	}
+	newEmbeddingSpec := func(model string) *embedtypes.EmbeddingSpec {
+		return &embedtypes.EmbeddingSpec{ProviderType: "openai", BaseURL: "http://localhost:8080", Model: model, APIKey: "test-api-key"}
+	}
+	spec := &MiddlewareSpec{
+		Name: "reembed-cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: newEmbeddingSpec("text-embedding-3-large"),
+			VectorDB:   newVectorDBSpec("cache_v2", "v2"),
+		},
+	}
+	if fallback {
+		spec.SemanticCache.Fallback = &SemanticCacheFallbackSpec{
+			Embeddings: newEmbeddingSpec("text-embedding-3-small"),
+			VectorDB:   newVectorDBSpec("cache_v1", "v1"),
+		}
+	}
+	return spec
+}
+
+func newReembedCache(spec *MiddlewareSpec, primary, fallback vectordb.VectorDB) *semanticCacheMiddleware {
+	m := &semanticCacheMiddleware{
+		spec:              spec,
+		embeddingsHandler: &prefixEmbeddingHandler{prefix: "v2:"},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: primary,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template: template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+	}
+	if spec.SemanticCache.Fallback != nil {
+		m.fallbackEmbeddingsHandler = &prefixEmbeddingHandler{prefix: "v1:"}
+		m.fallbackVectorHandler = &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.Fallback.VectorDB,
+			vectorDB: fallback,
+			handlers: make(map[string]vectordb.VectorHandler),
+		}
+	}
+	return m
+}
+
+// seedFallback writes the entries of the prompts into the collection of
+// the fallback like the previous generation of the cache, the entry of an
+// empty prompt is written like the ones before prompts are stored.
+func seedFallback(t *testing.T, spec *MiddlewareSpec, fallbackDB vectordb.VectorDB, prompts map[bool][]string) {
+	oldSpec := *spec.SemanticCache
+	oldSpec.VectorDB, oldSpec.Fallback = spec.SemanticCache.Fallback.VectorDB, nil
+	old := newReembedCache(&MiddlewareSpec{Name: spec.Name, Kind: spec.Kind, SemanticCache: &oldSpec}, fallbackDB, nil)
+	old.embeddingsHandler = &prefixEmbeddingHandler{prefix: "v1:"}
+
+	for stream, prompts := range prompts {
+		structure := &aicontext.Context{RespType: aicontext.ResponseTypeChatCompletions, ReqInfo: &protocol.GeneralRequest{Stream: stream}}
+		for _, prompt := range prompts {
+			embedding, _ := old.embeddingsHandler.EmbedQuery(prompt)
+			handler, err := old.vectorHandler.GetHandler(structure, embedding)
+			assert.Nil(t, err)
+			cache := map[string]any{
+				"embedding":                    embedding,
+				"data":                         "answer of " + prompt,
+				"header":                       `{"Content-Type":["application/json"]}`,
+				"status":                       http.StatusOK,
+				semanticCacheGenerationMsField: 1200,
+			}
+			if prompt == "" {
+				_, err = handler.InsertDocuments(context.Background(), []map[string]any{cache})
+			} else {
+				err = old.storeCache(context.Background(), handler, prompt, cache)
+			}
+			assert.Nil(t, err)
+		}
+	}
+}
+
+// handleCached sends the prompt to the cache, and returns the cached
+// response, it is empty if the cache misses.
+func handleCached(t *testing.T, m *semanticCacheMiddleware, prompt string) string {
+	body, err := json.Marshal(map[string]any{
+		"model":    "gpt-4.1",
+		"messages": []map[string]any{{"role": "user", "content": prompt}},
+	})
+	assert.Nil(t, err)
+	ctx := egContext.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(body))
+	assert.Nil(t, err)
+	setRequest(t, ctx, "reembed", req)
+	aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+	assert.Nil(t, err)
+	m.Handle(aiCtx)
+	if !aiCtx.IsStopped() {
+		return ""
+	}
+	return string(aiCtx.GetResponse().BodyBytes)
+}
+
+func TestSemanticCacheReembed(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := newReembedCacheSpec(true)
+	assert.Nil(ValidateSpec(spec))
+	primaryDB, fallbackDB := newIndexedVectorDB(), newIndexedVectorDB()
+	seedFallback(t, spec, fallbackDB, map[bool][]string{
+		false: {"one two", "three four", ""},
+		true:  {"five six"},
+	})
+	m := newReembedCache(spec, primaryDB, fallbackDB)
+
+	plan, err := m.PlanReembed(context.Background(), &ReembedRequest{PricePerMillion: 1000})
+	assert.Nil(err)
+	assert.Equal("cache_v1", plan.Collection)
+	assert.Equal("text-embedding-3-large", plan.Model)
+	assert.Equal("v2", plan.EmbeddingVersion)
+	assert.Equal(int64(4), plan.Documents)
+	assert.Equal(int64(4), plan.Pending)
+	assert.Equal(4, plan.Sampled)
+
+	// the entries of the fallback are served by dual reads before they
+	// are re-embedded.
+	assert.Equal("answer of three four", handleCached(t, m, "three four"))
+
+	status, err := m.StartReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 1000, PricePerMillion: 1000, BatchSize: 1})
+	assert.Nil(err)
+	assert.Equal(ReembedStatusRunning, status.Status)
+	status = waitReembed(t, m, ReembedStatusCompleted)
+	assert.Equal(int64(4), status.Scanned)
+	assert.Equal(int64(3), status.Reembedded)
+	// the entry without prompt is skipped.
+	assert.Equal(int64(1), status.Skipped)
+	assert.Empty(status.Cursor)
+	assert.Positive(status.Spent)
+
+	// the entries are copied into the indexes of the same requests with
+	// their IDs, the one migrated by the dual read is overwritten.
+	nonStream := primaryDB.docs(getRedisDBName("cache_v2", aicontext.ResponseTypeChatCompletions, false))
+	assert.Len(nonStream, 2)
+	fallbackDocs := fallbackDB.docs(getRedisDBName("cache_v1", aicontext.ResponseTypeChatCompletions, false))
+	for _, doc := range nonStream {
+		if doc["id"] == fallbackDocs[0]["id"] {
+			assert.Equal("one two", doc[semanticCachePromptField])
+			assert.Equal(embeddingString("v2:one two"), doc["embedding"])
+			assert.Equal("answer of one two", doc["data"])
+			assert.Equal("v2", doc[vectordb.EmbeddingVersionField])
+			assert.Equal(int64(1200), doc[semanticCacheGenerationMsField])
+		}
+	}
+	stream := primaryDB.docs(getRedisDBName("cache_v2", aicontext.ResponseTypeChatCompletions, true))
+	assert.Len(stream, 1)
+	assert.Equal("five six", stream[0][semanticCachePromptField])
+
+	// the fallback is dropped once it is re-embedded, and the entries are
+	// served by the primary cache.
+	result, err := m.PurgeFallback(context.Background())
+	assert.Nil(err)
+	assert.Equal(getRedisDBNames("cache_v1"), result.Collections)
+	assert.Equal(getRedisDBNames("cache_v1"), fallbackDB.dropped)
+	assert.Empty(primaryDB.dropped)
+	assert.Equal("answer of one two", handleCached(t, m, "one two"))
+
+	plan, err = m.PlanReembed(context.Background(), &ReembedRequest{})
+	assert.Nil(err)
+	assert.Equal(int64(0), plan.Documents)
+}
+
+func TestSemanticCacheAbortReembed(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := newReembedCacheSpec(true)
+	primaryDB, fallbackDB := newIndexedVectorDB(), newIndexedVectorDB()
+	seedFallback(t, spec, fallbackDB, map[bool][]string{false: {"a", "b", "c"}, true: {"d", "e"}})
+	m := newReembedCache(spec, primaryDB, fallbackDB)
+
+	_, err := m.AbortReembed()
+	assert.ErrorIs(err, ErrReembedNotRunning)
+	_, err = m.StartReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 10, BatchSize: 1})
+	assert.Nil(err)
+	assert.Eventually(func() bool { return m.ReembedStatus().Reembedded >= 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// the fallback is not dropped while it is being re-embedded.
+	_, err = m.PurgeFallback(context.Background())
+	assert.ErrorIs(err, ErrReembedRunning)
+	assert.Empty(fallbackDB.dropped)
+
+	status, err := m.AbortReembed()
+	assert.Nil(err)
+	assert.Equal(ReembedStatusAborted, status.Status)
+	assert.NotEmpty(status.Cursor)
+	aborted := status.Scanned
+
+	// the job resumes from the cursor of the aborted one.
+	_, err = m.StartReembed(context.Background(), &ReembedRequest{RequestsPerSecond: 1000, BatchSize: 1})
+	assert.Nil(err)
+	status = waitReembed(t, m, ReembedStatusCompleted)
+	assert.Less(status.Scanned, int64(5))
+	assert.GreaterOrEqual(aborted+status.Scanned, int64(5))
+	count := 0
+	for _, name := range getRedisDBNames("cache_v2") {
+		count += len(primaryDB.docs(name))
+	}
+	assert.Equal(5, count)
+}
+
+func TestSemanticCacheReembedWithoutFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newReembedCache(newReembedCacheSpec(false), newIndexedVectorDB(), nil)
+	_, err := m.PlanReembed(context.Background(), &ReembedRequest{})
+	assert.ErrorIs(err, ErrNoFallback)
+	_, err = m.StartReembed(context.Background(), &ReembedRequest{})
+	assert.ErrorIs(err, ErrNoFallback)
+	_, err = m.PurgeFallback(context.Background())
+	assert.ErrorIs(err, ErrNoFallback)
+	assert.Nil(m.ReembedStatus())
+
+	spec := newReembedCacheSpec(true)
+	spec.SemanticCache.ReadOnly = true
+	m = newReembedCache(spec, newIndexedVectorDB(), newIndexedVectorDB())
+	_, err = m.StartReembed(context.Background(), &ReembedRequest{})
+	assert.NotNil(err)
+}
+
+func TestSemanticCacheReembedRedis(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	req := testcontainers.ContainerRequest{
+		Image:        "redis:latest",
+		ExposedPorts: []string{"6379/tcp"},
+		WaitingFor:   wait.ForLog("Ready to accept connections"),
+	}
+	redisC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Redis container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, redisC)
+	endpoint, err := redisC.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to get Redis container endpoint: %v", err)
+	}
+
+	spec := newReembedCacheSpec(true)
+	spec.SemanticCache.VectorDB.Redis.URL = "redis://" + endpoint
+	spec.SemanticCache.Fallback.VectorDB.Redis.URL = "redis://" + endpoint
+	assert.Nil(ValidateSpec(spec))
+	seedFallback(t, spec, vectordb.New(spec.SemanticCache.Fallback.VectorDB), map[bool][]string{
+		false: {"one two", "three four", ""},
+		true:  {"five six"},
+	})
+	m := NewMiddleware(spec).(*semanticCacheMiddleware)
+	defer m.Close()
+	m.embeddingsHandler = &prefixEmbeddingHandler{prefix: "v2:"}
+	m.fallbackEmbeddingsHandler = &prefixEmbeddingHandler{prefix: "v1:"}
+
+	// the entries of the fallback are served by dual reads before they
+	// are re-embedded.
+	assert.Equal("answer of three four", handleCached(t, m, "three four"))
+
+	plan, err := m.PlanReembed(ctx, &ReembedRequest{})
+	assert.Nil(err)
+	assert.Equal(int64(4), plan.Pending)
+	_, err = m.StartReembed(ctx, &ReembedRequest{RequestsPerSecond: 1000, BatchSize: 1})
+	assert.Nil(err)
+	status := waitReembed(t, m, ReembedStatusCompleted, ReembedStatusFailed)
+	assert.Equal(ReembedStatusCompleted, status.Status, status.Error)
+	assert.Equal(int64(3), status.Reembedded)
+	assert.Equal(int64(1), status.Skipped)
+
+	// the fallback is dropped, and the entries are served by the primary
+	// cache.
+	result, err := m.PurgeFallback(ctx)
+	assert.Nil(err)
+	assert.Equal(getRedisDBNames("cache_v1"), result.Collections)
+	plan, err = m.PlanReembed(ctx, &ReembedRequest{})
+	assert.Nil(err)
+	assert.Equal(int64(0), plan.Documents)
+	assert.Equal("answer of one two", handleCached(t, m, "one two"))
+	assert.Equal("answer of three four", handleCached(t, m, "three four"))
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// semanticCacheSchemaVersionField records the schema version of a
+	// cache entry.
+	semanticCacheSchemaVersionField = "schema_version"
+	// semanticCacheSchemaVersion is the schema version of the entries
+	// written by this version of the gateway.
+	semanticCacheSchemaVersion = 2
+
+	staleEntriesIgnore = "ignore"
+	staleEntriesDelete = "delete"
+
+	staleEntryDeleteTimeout = 5 * time.Second
+)
+
+var (
+	// errSchemaTooNew means the entry is written by a newer version of the
+	// gateway, which is the case during rolling upgrades.
+	errSchemaTooNew = errors.New("schema version of cache entry is too new")
+	// errSchemaTooOld means the entry can not be migrated to the current
+	// schema version.
+	errSchemaTooOld = errors.New("schema version of cache entry is too old")
+)
+
+type (
+	// semanticCacheSchema describes a schema version of cache entries.
+	semanticCacheSchema struct {
+		// matchVersion is the version of how requests are matched to the
+		// entries, like the normalization of the content. It is a part of
+		// the index or table names, so entries matched differently are
+		// stored separately and never hit.
+		matchVersion int
+		// migrate upgrades an entry of the version to the next version, it
+		// is nil for the current version.
+		migrate func(doc map[string]any) error
+	}
+
+	// semanticCacheEntry is a cache entry decoded to the current schema.
+	semanticCacheEntry struct {
+		SchemaVersion int
+		Data          string
+		Header        http.Header
+		Status        int
+	}
+)
+
+// semanticCacheSchemas are the schema versions which can be decoded, an
+// entry of a version not listed here is too old, unless it is newer than
+// semanticCacheSchemaVersion.
+var semanticCacheSchemas = map[int]*semanticCacheSchema{
+	// version 1 is the entries written before schema versions, they have
+	// no schema version field.
+	1: {matchVersion: 1, migrate: migrateSemanticCacheEntryV1},
+	2: {matchVersion: 1},
+}
+
+// migrateSemanticCacheEntryV1 migrates an entry of version 1 to version 2,
+// entries of version 1 may be written without headers.
+func migrateSemanticCacheEntryV1(doc map[string]any) error {
+	if header, _ := doc["header"].(string); header == "" {
+		doc["header"] = "{}"
+	}
+	doc[semanticCacheSchemaVersionField] = 2
+	return nil
+}
+
+// semanticCacheMatchSuffix returns the suffix of the index or table names
+// for the match version of the current schema, it is empty for the first
+// match version, so the names of existing caches are kept.
+func semanticCacheMatchSuffix() string {
+	version := semanticCacheSchemas[semanticCacheSchemaVersion].matchVersion
+	if version <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("_m%d", version)
+}
+
+func validateStaleEntries(policy string) error {
+	switch policy {
+	case "", staleEntriesIgnore, staleEntriesDelete:
+		return nil
+	default:
+		return fmt.Errorf("invalid staleEntries %s, must be %s or %s", policy, staleEntriesIgnore, staleEntriesDelete)
+	}
+}
+
+// entrySchemaVersion returns the schema version of the entry.
+func entrySchemaVersion(doc map[string]any) (int, error) {
+	value, ok := doc[semanticCacheSchemaVersionField]
+	if !ok || value == nil || value == "" {
+		return 1, nil
+	}
+	version, err := vecdbtypes.ToFloat64(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %v: %w", value, err)
+	}
+	return int(version), nil
+}
+
+// decodeSemanticCacheEntry decodes the entry, migrating it to the current
+// schema version. The document is not modified.
+func decodeSemanticCacheEntry(doc map[string]any) (*semanticCacheEntry, error) {
+	version, err := entrySchemaVersion(doc)
+	if err != nil {
+		return nil, err
+	}
+	if version > semanticCacheSchemaVersion {
+		return nil, fmt.Errorf("%w: %d", errSchemaTooNew, version)
+	}
+	current := semanticCacheSchemas[semanticCacheSchemaVersion]
+	schema, ok := semanticCacheSchemas[version]
+	if !ok || schema.matchVersion != current.matchVersion {
+		return nil, fmt.Errorf("%w: %d", errSchemaTooOld, version)
+	}
+
+	doc = maps.Clone(doc)
+	for ; version < semanticCacheSchemaVersion; version++ {
+		if err := semanticCacheSchemas[version].migrate(doc); err != nil {
+			return nil, fmt.Errorf("failed to migrate cache entry from version %d: %w", version, err)
+		}
+	}
+
+	data, dataOK := doc["data"].(string)
+	header, headerOK := doc["header"].(string)
+	if !dataOK || !headerOK {
+		return nil, fmt.Errorf("cache entry has no data or header")
+	}
+	entry := &semanticCacheEntry{SchemaVersion: version, Data: data, Header: http.Header{}}
+	if err := json.Unmarshal([]byte(header), &entry.Header); err != nil {
+		return nil, fmt.Errorf("invalid header of cache entry: %w", err)
+	}
+	status, err := vecdbtypes.ToFloat64(doc["status"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid status of cache entry: %w", err)
+	}
+	entry.Status = int(status)
+	return entry, nil
+}
+
+// decodeEntry decodes the entry found in the vector handler, it returns nil
+// if the entry can not be decoded, so the request goes on as a miss. The
+// entries too old to migrate are deleted after the request if the policy
+// is delete, the newer ones are kept for the members of newer versions.
+// The entries failing the signature verification are always deleted.
+func (m *semanticCacheMiddleware) decodeEntry(ctx *aicontext.Context, vectorHandler *semanticCacheVectorHandler, embedding []float32, doc map[string]any) *semanticCacheEntry {
+	if m.signer != nil {
+		if err := m.signer.verify(doc); err != nil {
+			m.signer.countTampered(err)
+			logger.Warnf("semantic cache %s skips tampered entry %v: %v", m.spec.Name, doc["id"], err)
+			if id, ok := doc["id"]; ok {
+				ctx.AddCallBack(func(*aicontext.FinishContext) {
+					m.deleteEntry(ctx, vectorHandler, embedding, fmt.Sprint(id))
+				})
+			}
+			return nil
+		}
+	}
+	entry, err := decodeSemanticCacheEntry(doc)
+	if err == nil {
+		return entry
+	}
+	if errors.Is(err, errSchemaTooNew) {
+		logger.Debugf("semantic cache %s skips entry %v: %v", m.spec.Name, doc["id"], err)
+		return nil
+	}
+	logger.Warnf("semantic cache %s skips entry %v: %v", m.spec.Name, doc["id"], err)
+	if !errors.Is(err, errSchemaTooOld) || m.spec.SemanticCache.StaleEntries != staleEntriesDelete || m.spec.SemanticCache.ReadOnly {
+		return nil
+	}
+	id, ok := doc["id"]
+	if !ok {
+		return nil
+	}
+	ctx.AddCallBack(func(*aicontext.FinishContext) {
+		m.deleteEntry(ctx, vectorHandler, embedding, fmt.Sprint(id))
+	})
+	return nil
+}
+
+func (m *semanticCacheMiddleware) deleteEntry(ctx *aicontext.Context, vectorHandler *semanticCacheVectorHandler, embedding []float32, id string) {
+	handler, err := vectorHandler.GetHandler(ctx, embedding)
+	if err != nil {
+		logger.Errorf("failed to get vector handler for semantic cache: %v", err)
+		return
+	}
+	deleter, ok := handler.(vecdbtypes.DocumentDeleter)
+	if !ok {
+		logger.Warnf("semantic cache %s can not delete entry %s: %v", m.spec.Name, id, vectordb.ErrDeleteNotSupported)
+		return
+	}
+	deleteCtx, cancel := context.WithTimeout(context.Background(), staleEntryDeleteTimeout)
+	defer cancel()
+	if _, err := deleter.DeleteDocuments(deleteCtx, []string{id}); err != nil {
+		logger.Warnf("semantic cache %s failed to delete entry %s: %v", m.spec.Name, id, err)
+		return
+	}
+	logger.Infof("semantic cache %s deleted entry %s", m.spec.Name, id)
+}
+
+var _ SchemaVersionReporter = (*semanticCacheMiddleware)(nil)
+
+// SchemaVersions counts the entries of the collections of the cache,
+// including the fallback, by their schema versions.
+func (m *semanticCacheMiddleware) SchemaVersions(ctx context.Context) (*SchemaVersionResult, error) {
+	result := &SchemaVersionResult{Current: semanticCacheSchemaVersion}
+	handlers := []*semanticCacheVectorHandler{m.vectorHandler}
+	if m.fallbackVectorHandler != nil {
+		handlers = append(handlers, m.fallbackVectorHandler)
+	}
+	for _, h := range handlers {
+		counter, ok := h.vectorDB.(vecdbtypes.FieldCounter)
+		if !ok {
+			return nil, fmt.Errorf("vectorDB %s of semantic cache %s does not support counting entries", h.dbSpec.Type, m.spec.Name)
+		}
+		names := getPostgresTableNames(h.dbSpec.Scope)
+		if h.dbSpec.Type == vectordb.TypeRedis {
+			names = getRedisDBNames(h.dbSpec.CollectionName)
+		}
+		for _, name := range names {
+			report := &SchemaVersionReport{Collection: name, Versions: map[int]int64{}}
+			counts, err := counter.CountByField(ctx, name, semanticCacheSchemaVersionField)
+			if errors.Is(err, vecdbtypes.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				report.Error = err.Error()
+			}
+			for value, count := range counts {
+				// the entries without schema version are version 1, and
+				// the invalid ones are counted as version 0.
+				version := 1
+				if value != "" {
+					version, err = strconv.Atoi(value)
+					if err != nil {
+						version = 0
+					}
+				}
+				report.Versions[version] += count
+			}
+			result.Reports = append(result.Reports, report)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/stretchr/testify/assert"
+)
+
+// deletableVectorDB is a mockVectorDB which can delete documents and count
+// them by fields.
+type deletableVectorDB struct {
+	mockVectorDB
+	deleted []string
+}
+
+func (db *deletableVectorDB) CreateSchema(ctx stdcontext.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	return db, nil
+}
+
+func (db *deletableVectorDB) DeleteDocuments(ctx stdcontext.Context, ids []string) (int64, error) {
+	db.deleted = append(db.deleted, ids...)
+	return int64(len(ids)), nil
+}
+
+func (db *deletableVectorDB) CountByField(ctx stdcontext.Context, name, field string) (map[string]int64, error) {
+	if name != "cache_chat_non_stream" {
+		return nil, vecdbtypes.NewError(vecdbtypes.ErrNotFound, errors.New("no such index"))
+	}
+	counts := map[string]int64{}
+	for _, doc := range db.data {
+		value, _ := doc[field].(string)
+		counts[value]++
+	}
+	return counts, nil
+}
+
+func TestDecodeSemanticCacheEntry(t *testing.T) {
+	assert := assert.New(t)
+
+	// entries written before schema versions, with the values returned
+	// by Redis as strings.
+	doc := map[string]any{"data": "cached", "header": "", "status": "200"}
+	entry, err := decodeSemanticCacheEntry(doc)
+	assert.NoError(err)
+	assert.Equal(&semanticCacheEntry{SchemaVersion: semanticCacheSchemaVersion, Data: "cached", Header: http.Header{}, Status: 200}, entry)
+	// the document is not modified.
+	assert.NotContains(doc, semanticCacheSchemaVersionField)
+
+	entry, err = decodeSemanticCacheEntry(map[string]any{
+		"data": "cached", "header": `{"Content-Type":["application/json"]}`, "status": int32(200), semanticCacheSchemaVersionField: "2",
+	})
+	assert.NoError(err)
+	assert.Equal("application/json", entry.Header.Get("Content-Type"))
+
+	_, err = decodeSemanticCacheEntry(map[string]any{"data": "cached", "header": "{}", "status": 200, semanticCacheSchemaVersionField: 3})
+	assert.ErrorIs(err, errSchemaTooNew)
+	_, err = decodeSemanticCacheEntry(map[string]any{"data": "cached", "header": "{}", "status": 200, semanticCacheSchemaVersionField: "0"})
+	assert.ErrorIs(err, errSchemaTooOld)
+	_, err = decodeSemanticCacheEntry(map[string]any{"data": "cached", "header": "{}", "status": 200, semanticCacheSchemaVersionField: "x"})
+	assert.Error(err)
+	_, err = decodeSemanticCacheEntry(map[string]any{"data": "cached", "header": "{", "status": 200})
+	assert.Error(err)
+	_, err = decodeSemanticCacheEntry(map[string]any{"header": "{}", "status": 200})
+	assert.Error(err)
+
+	assert.NoError(validateStaleEntries(""))
+	assert.NoError(validateStaleEntries(staleEntriesDelete))
+	assert.Error(validateStaleEntries("drop"))
+}
+
+func TestSemanticCacheSchemaVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "openai",
+				BaseURL:      "http://localhost:8080",
+				Model:        "text-embedding-3-small",
+				APIKey:       "test-api-key",
+			},
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{
+					Type:           "redis",
+					Threshold:      0.99,
+					CollectionName: "cache",
+				},
+				Redis: &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+			},
+			StaleEntries: staleEntriesDelete,
+		},
+	}
+	assert.Nil(ValidateSpec(spec))
+
+	db := &deletableVectorDB{}
+	cache := &semanticCacheMiddleware{
+		spec:              spec,
+		embeddingsHandler: &mockEmbeddingHandler{},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template: template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+	}
+
+	jsonData, err := json.Marshal(map[string]any{
+		"model":    "gpt-4.1",
+		"messages": []map[string]any{{"role": "user", "content": "Hello!"}},
+	})
+	assert.Nil(err)
+	handle := func() *aicontext.Context {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		setRequest(t, ctx, "schema", req)
+		aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+		assert.Nil(err)
+		cache.Handle(aiCtx)
+		for _, cb := range aiCtx.Callbacks() {
+			cb(&aicontext.FinishContext{StatusCode: http.StatusOK, RespBody: []byte("fresh")})
+		}
+		return aiCtx
+	}
+	newDoc := func(version string) map[string]any {
+		return map[string]any{
+			"id":                            version,
+			"embedding":                     embeddingString("Hello!"),
+			"data":                          "cached",
+			"header":                        "{}",
+			"status":                        "200",
+			semanticCacheSchemaVersionField: version,
+		}
+	}
+
+	// the entries of newer versions are misses, but they are kept for
+	// the members of newer versions.
+	db.data = []map[string]any{newDoc("3")}
+	aiCtx := handle()
+	assert.False(aiCtx.IsStopped())
+	assert.Empty(db.deleted)
+	assert.Len(db.data, 2)
+	assert.Equal(semanticCacheSchemaVersion, db.data[1][semanticCacheSchemaVersionField])
+
+	// the entries too old to migrate are deleted by the policy.
+	db.data = []map[string]any{newDoc("0")}
+	aiCtx = handle()
+	assert.False(aiCtx.IsStopped())
+	assert.Equal([]string{"0"}, db.deleted)
+
+	// the entries of older versions are migrated and hit.
+	db.data = []map[string]any{newDoc("")}
+	aiCtx = handle()
+	assert.True(aiCtx.IsStopped())
+	assert.Equal("cached", string(aiCtx.GetResponse().BodyBytes))
+
+	db.data = []map[string]any{newDoc(""), newDoc("2"), newDoc("2"), newDoc("3"), newDoc("x")}
+	result, err := cache.SchemaVersions(stdcontext.Background())
+	assert.NoError(err)
+	assert.Equal(semanticCacheSchemaVersion, result.Current)
+	assert.Len(result.Reports, 1)
+	assert.Equal("cache_chat_non_stream", result.Reports[0].Collection)
+	assert.Equal(map[int]int64{0: 1, 1: 1, 2: 2, 3: 1}, result.Reports[0].Versions)
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// semanticCachePromptHashField is the SHA256 of the normalized content
+	// of the request the entry is cached for.
+	semanticCachePromptHashField = "prompt_hash"
+	// semanticCacheKeyIDField is the ID of the key signing the entry.
+	semanticCacheKeyIDField = "key_id"
+	// semanticCacheSignatureField is the HMAC-SHA256 of the entry.
+	semanticCacheSignatureField = "signature"
+
+	// minSigningKeyLength is the min length of the signing keys in bytes.
+	minSigningKeyLength = 16
+)
+
+var (
+	errEntryUnsigned         = errors.New("cache entry is not signed")
+	errEntryKeyUnknown       = errors.New("cache entry is signed by an unknown key")
+	errEntrySignatureInvalid = errors.New("signature of cache entry does not match")
+)
+
+type (
+	// SemanticCacheSigningSpec describes signing the cache entries with
+	// HMAC-SHA256 when they are written, and verifying them when they are
+	// hit, so the entries modified in the vector database are not served.
+	SemanticCacheSigningSpec struct {
+		// KeyID is the ID of the key signing new entries, it is stored
+		// with the entries to find the key verifying them.
+		KeyID string `json:"keyID" jsonschema:"required"`
+		Key   string `json:"key" jsonschema:"required"`
+		// AcceptedKeys are the previous keys by their IDs, the entries
+		// signed by them are still served during key rotation.
+		AcceptedKeys map[string]string `json:"acceptedKeys,omitempty"`
+	}
+
+	// entrySigner signs and verifies the cache entries.
+	entrySigner struct {
+		name     string
+		keyID    string
+		keys     map[string][]byte
+		tampered *prometheus.CounterVec
+	}
+)
+
+func validateSemanticCacheSigningSpec(spec *SemanticCacheSigningSpec) error {
+	if spec.KeyID == "" {
+		return fmt.Errorf("keyID is required")
+	}
+	if len(spec.Key) < minSigningKeyLength {
+		return fmt.Errorf("key must be at least %d bytes", minSigningKeyLength)
+	}
+	for id, key := range spec.AcceptedKeys {
+		if id == "" {
+			return fmt.Errorf("ID of accepted keys must not be empty")
+		}
+		if len(key) < minSigningKeyLength {
+			return fmt.Errorf("accepted key %s must be at least %d bytes", id, minSigningKeyLength)
+		}
+		if id == spec.KeyID && key != spec.Key {
+			return fmt.Errorf("accepted key %s conflicts with the current key", id)
+		}
+	}
+	return nil
+}
+
+func newEntrySigner(name string, spec *SemanticCacheSigningSpec) *entrySigner {
+	s := &entrySigner{
+		name:     name,
+		keyID:    spec.KeyID,
+		keys:     map[string][]byte{spec.KeyID: []byte(spec.Key)},
+		tampered: metricshub.SemanticCacheTamperedEntries.NewCounter(),
+	}
+	for id, key := range spec.AcceptedKeys {
+		if id != spec.KeyID {
+			s.keys[id] = []byte(key)
+		}
+	}
+	return s
+}
+
+// promptHash returns the canonical hash of the content of a request, the
+// whitespaces of the content are normalized.
+func promptHash(content string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(content), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// entryMAC returns the signature of the entry in hex, which covers the key
+// ID, the prompt hash, and the status, header and data of the response.
+func entryMAC(key []byte, keyID string, doc map[string]any) (string, error) {
+	hash, _ := doc[semanticCachePromptHashField].(string)
+	header, _ := doc["header"].(string)
+	data, _ := doc["data"].(string)
+	status, err := vecdbtypes.ToFloat64(doc["status"])
+	if err != nil {
+		return "", fmt.Errorf("invalid status of cache entry: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	for _, field := range []string{keyID, hash, strconv.Itoa(int(status)), header} {
+		mac.Write([]byte(field))
+		mac.Write([]byte{'\n'})
+	}
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// sign signs the entry by the current key, the entry must have the data,
+// header and status of the response.
+func (s *entrySigner) sign(doc map[string]any, prompt string) error {
+	doc[semanticCachePromptHashField] = promptHash(prompt)
+	signature, err := entryMAC(s.keys[s.keyID], s.keyID, doc)
+	if err != nil {
+		return err
+	}
+	doc[semanticCacheKeyIDField] = s.keyID
+	doc[semanticCacheSignatureField] = signature
+	return nil
+}
+
+// verify verifies the signature of the entry, the entries not signed are
+// rejected, so a signature can not be bypassed by removing it.
+func (s *entrySigner) verify(doc map[string]any) error {
+	keyID, _ := doc[semanticCacheKeyIDField].(string)
+	signature, _ := doc[semanticCacheSignatureField].(string)
+	if keyID == "" || signature == "" {
+		return errEntryUnsigned
+	}
+	key, ok := s.keys[keyID]
+	if !ok {
+		return fmt.Errorf("%w: %s", errEntryKeyUnknown, keyID)
+	}
+	expected, err := entryMAC(key, keyID, doc)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errEntrySignatureInvalid, err)
+	}
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errEntrySignatureInvalid
+	}
+	return nil
+}
+
+// countTampered counts the entry failing the verification by the reason.
+func (s *entrySigner) countTampered(err error) {
+	reason := "mismatch"
+	switch {
+	case errors.Is(err, errEntryUnsigned):
+		reason = "unsigned"
+	case errors.Is(err, errEntryKeyUnknown):
+		reason = "unknownKey"
+	}
+	s.tampered.WithLabelValues(s.name, reason).Inc()
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"maps"
+	"net/http"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntrySigner(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error(validateSemanticCacheSigningSpec(&SemanticCacheSigningSpec{Key: "0123456789abcdef"}))
+	assert.Error(validateSemanticCacheSigningSpec(&SemanticCacheSigningSpec{KeyID: "k1", Key: "short"}))
+	assert.Error(validateSemanticCacheSigningSpec(&SemanticCacheSigningSpec{
+		KeyID: "k1", Key: "0123456789abcdef", AcceptedKeys: map[string]string{"k0": "short"},
+	}))
+	assert.Error(validateSemanticCacheSigningSpec(&SemanticCacheSigningSpec{
+		KeyID: "k1", Key: "0123456789abcdef", AcceptedKeys: map[string]string{"k1": "fedcba9876543210"},
+	}))
+	assert.NoError(validateSemanticCacheSigningSpec(&SemanticCacheSigningSpec{
+		KeyID: "k1", Key: "0123456789abcdef", AcceptedKeys: map[string]string{"k0": "fedcba9876543210"},
+	}))
+
+	old := newEntrySigner("signer", &SemanticCacheSigningSpec{KeyID: "k0", Key: "fedcba9876543210"})
+	signer := newEntrySigner("signer", &SemanticCacheSigningSpec{
+		KeyID: "k1", Key: "0123456789abcdef", AcceptedKeys: map[string]string{"k0": "fedcba9876543210"},
+	})
+
+	doc := map[string]any{"data": "cached", "header": "{}", "status": 200}
+	assert.NoError(signer.sign(doc, " Hello,\n world! "))
+	assert.Equal(promptHash("Hello, world!"), doc[semanticCachePromptHashField])
+	assert.Equal("k1", doc[semanticCacheKeyIDField])
+	// the values are returned by Redis as strings.
+	read := maps.Clone(doc)
+	read["status"] = "200"
+	assert.NoError(signer.verify(read))
+
+	for field, value := range map[string]any{
+		"data":                       "tampered",
+		"header":                     `{"X-Tampered":["1"]}`,
+		"status":                     "500",
+		semanticCachePromptHashField: promptHash("other"),
+		semanticCacheSignatureField:  "00",
+	} {
+		tampered := maps.Clone(doc)
+		tampered[field] = value
+		assert.ErrorIs(signer.verify(tampered), errEntrySignatureInvalid, field)
+	}
+
+	// the entries signed by the accepted keys are verified during rotation.
+	doc = map[string]any{"data": "cached", "header": "{}", "status": 200}
+	assert.NoError(old.sign(doc, "Hello!"))
+	assert.NoError(signer.verify(doc))
+	rotated := newEntrySigner("signer", &SemanticCacheSigningSpec{KeyID: "k1", Key: "0123456789abcdef"})
+	assert.ErrorIs(rotated.verify(doc), errEntryKeyUnknown)
+	// the key ID can not be changed to another accepted key.
+	doc[semanticCacheKeyIDField] = "k1"
+	assert.ErrorIs(signer.verify(doc), errEntrySignatureInvalid)
+
+	delete(doc, semanticCacheSignatureField)
+	assert.ErrorIs(signer.verify(doc), errEntryUnsigned)
+}
+
+func TestSemanticCacheSigning(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache-signing",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "openai",
+				BaseURL:      "http://localhost:8080",
+				Model:        "text-embedding-3-small",
+				APIKey:       "test-api-key",
+			},
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{
+					Type:           "redis",
+					Threshold:      0.99,
+					CollectionName: "cache",
+				},
+				Redis: &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+			},
+			Signing: &SemanticCacheSigningSpec{KeyID: "k1", Key: "0123456789abcdef"},
+		},
+	}
+	assert.Nil(ValidateSpec(spec))
+
+	db := &deletableVectorDB{}
+	cache := &semanticCacheMiddleware{
+		spec:              spec,
+		embeddingsHandler: &mockEmbeddingHandler{},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template: template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+		signer:   newEntrySigner(spec.Name, spec.SemanticCache.Signing),
+	}
+
+	jsonData, err := json.Marshal(map[string]any{
+		"model":    "gpt-4.1",
+		"messages": []map[string]any{{"role": "user", "content": "Hello!"}},
+	})
+	assert.Nil(err)
+	handle := func() *aicontext.Context {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		setRequest(t, ctx, "signing", req)
+		aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+		assert.Nil(err)
+		cache.Handle(aiCtx)
+		for _, cb := range aiCtx.Callbacks() {
+			cb(&aicontext.FinishContext{StatusCode: http.StatusOK, RespBody: []byte("fresh")})
+		}
+		return aiCtx
+	}
+	tampered := func(reason string) float64 {
+		return testutil.ToFloat64(cache.signer.tampered.WithLabelValues(spec.Name, reason))
+	}
+
+	// the entries are signed when they are written, and hit if verified.
+	aiCtx := handle()
+	assert.False(aiCtx.IsStopped())
+	assert.Len(db.data, 1)
+	assert.Equal(promptHash("Hello!"), db.data[0][semanticCachePromptHashField])
+	assert.Equal("k1", db.data[0][semanticCacheKeyIDField])
+	db.data[0]["id"] = "signed"
+	aiCtx = handle()
+	assert.True(aiCtx.IsStopped())
+	assert.Equal("fresh", string(aiCtx.GetResponse().BodyBytes))
+	assert.Empty(db.deleted)
+
+	// the modified entries are misses, and deleted after the request.
+	db.data[0]["data"] = "tampered"
+	aiCtx = handle()
+	assert.False(aiCtx.IsStopped())
+	assert.Equal([]string{"signed"}, db.deleted)
+	assert.Equal(float64(1), tampered("mismatch"))
+	// a new entry is written for the miss.
+	assert.Len(db.data, 2)
+
+	// the entries without signature are rejected.
+	db.data = []map[string]any{{"id": "unsigned", "embedding": embeddingString("Hello!"), "data": "cached", "header": "{}", "status": "200"}}
+	aiCtx = handle()
+	assert.False(aiCtx.IsStopped())
+	assert.Equal([]string{"signed", "unsigned"}, db.deleted)
+	assert.Equal(float64(1), tampered("unsigned"))
+
+	spec.SemanticCache.VectorDB.Type = "postgres"
+	assert.Error(ValidateSpec(spec))
+}
@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	defaultStaleReadsMaxEntries       = 1000
+	defaultStaleReadsMaxStaleness     = time.Minute
+	defaultStaleReadsLatencyThreshold = 200 * time.Millisecond
+	defaultStaleReadsFailureCooldown  = 10 * time.Second
+
+	// staleReadsLatencyWeight is the weight of the latest lookup in the
+	// moving average of the lookup latency.
+	staleReadsLatencyWeight = 0.2
+	// staleReadsQueueSize is the max number of the revalidations waiting
+	// in the queue, the others are dropped.
+	staleReadsQueueSize = 64
+	// staleReadsRevalidateTimeout is the timeout of a revalidation.
+	staleReadsRevalidateTimeout = 5 * time.Second
+)
+
+type (
+	// SemanticCacheStaleReadsSpec describes serving the hits of the
+	// semantic cache from a local tier while the vector database is
+	// degraded. The local tier memoizes the latest hits by their exact
+	// content, and they are served if they are validated against the
+	// vector database in MaxStaleness.
+	SemanticCacheStaleReadsSpec struct {
+		// MaxStaleness is the max time since an entry of the local tier
+		// is validated for it to be served, it defaults to 1m.
+		MaxStaleness string `json:"maxStaleness,omitempty" jsonschema:"format=duration"`
+		// MaxEntries is the max number of entries of the local tier, the
+		// ones evicted are chosen by EvictionPolicy, it defaults to 1000.
+		MaxEntries int `json:"maxEntries,omitempty"`
+		// EvictionPolicy is how the entries are evicted, gdsf evicts the
+		// entries of the least hits × generation cost / size first, and
+		// lru evicts the least recently used ones first. It defaults to
+		// gdsf.
+		EvictionPolicy string `json:"evictionPolicy,omitempty" jsonschema:"enum=,enum=gdsf,enum=lru"`
+		// LatencyThreshold is the moving average of the lookup latency
+		// above which the vector database is degraded, it defaults to
+		// 200ms.
+		LatencyThreshold string `json:"latencyThreshold,omitempty" jsonschema:"format=duration"`
+		// FailureCooldown is how long the vector database is degraded
+		// after a lookup fails for unavailability or timeout, it defaults
+		// to 10s.
+		FailureCooldown string `json:"failureCooldown,omitempty" jsonschema:"format=duration"`
+		// StrictFlag is the feature flag of the strict consumers, which
+		// are never served stale entries.
+		StrictFlag string `json:"strictFlag,omitempty"`
+	}
+
+	// staleReads is the local tier of a semantic cache, and tracks whether
+	// its vector database is degraded.
+	staleReads struct {
+		name             string
+		spec             *SemanticCacheStaleReadsSpec
+		entries          localTier
+		policy           string
+		maxStaleness     time.Duration
+		latencyThreshold time.Duration
+		failureCooldown  time.Duration
+		now              func() time.Time
+
+		lock       sync.Mutex
+		latency    time.Duration
+		failedAt   time.Time
+		revalidate map[string]struct{}
+
+		queue     chan *staleRevalidation
+		done      chan struct{}
+		closeOnce sync.Once
+
+		served    *prometheus.CounterVec
+		staleness *prometheus.HistogramVec
+		lookups   *prometheus.CounterVec
+	}
+
+	// localEntry is an entry of the local tier, the generation cost and
+	// the size are used by the eviction policy.
+	localEntry struct {
+		id          string
+		entry       *semanticCacheEntry
+		embedding   []float32
+		validatedAt time.Time
+		cost        float64
+		size        int
+	}
+
+	// staleRevalidation validates a local entry against the vector
+	// database.
+	staleRevalidation struct {
+		key   string
+		ctx   *aicontext.Context
+		local *localEntry
+	}
+)
+
+func validateSemanticCacheStaleReadsSpec(spec *SemanticCacheStaleReadsSpec) error {
+	for name, value := range map[string]string{
+		"maxStaleness":     spec.MaxStaleness,
+		"latencyThreshold": spec.LatencyThreshold,
+		"failureCooldown":  spec.FailureCooldown,
+	} {
+		if value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(value); err != nil || v <= 0 {
+			return fmt.Errorf("invalid %s %s", name, value)
+		}
+	}
+	if spec.MaxEntries < 0 {
+		return fmt.Errorf("maxEntries must not be negative")
+	}
+	switch spec.EvictionPolicy {
+	case "", EvictionPolicyGDSF, EvictionPolicyLRU:
+	default:
+		return fmt.Errorf("invalid evictionPolicy %s", spec.EvictionPolicy)
+	}
+	return nil
+}
+
+func newStaleReads(name string, spec *SemanticCacheStaleReadsSpec) *staleReads {
+	maxEntries := spec.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = defaultStaleReadsMaxEntries
+	}
+	policy := spec.EvictionPolicy
+	if policy == "" {
+		policy = EvictionPolicyGDSF
+	}
+	s := &staleReads{
+		name:             name,
+		spec:             spec,
+		entries:          newLocalTier(policy, maxEntries),
+		policy:           policy,
+		maxStaleness:     defaultStaleReadsMaxStaleness,
+		latencyThreshold: defaultStaleReadsLatencyThreshold,
+		failureCooldown:  defaultStaleReadsFailureCooldown,
+		now:              time.Now,
+		revalidate:       map[string]struct{}{},
+		queue:            make(chan *staleRevalidation, staleReadsQueueSize),
+		done:             make(chan struct{}),
+		served:           metricshub.SemanticCacheStaleServed.NewCounter(),
+		staleness:        metricshub.SemanticCacheStalenessSeconds.NewHistogram(),
+		lookups:          metricshub.SemanticCacheLocalLookups.NewCounter(),
+	}
+	if d, err := time.ParseDuration(spec.MaxStaleness); err == nil {
+		s.maxStaleness = d
+	}
+	if d, err := time.ParseDuration(spec.LatencyThreshold); err == nil {
+		s.latencyThreshold = d
+	}
+	if d, err := time.ParseDuration(spec.FailureCooldown); err == nil {
+		s.failureCooldown = d
+	}
+	return s
+}
+
+func (s *staleReads) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// observe records the latency and the error of a lookup in the vector
+// database.
+func (s *staleReads) observe(latency time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if errors.Is(err, vecdbtypes.ErrUnavailable) || errors.Is(err, vecdbtypes.ErrTimeout) {
+		s.failedAt = s.now()
+	}
+	if s.latency == 0 {
+		s.latency = latency
+		return
+	}
+	s.latency = time.Duration(staleReadsLatencyWeight*float64(latency) + (1-staleReadsLatencyWeight)*float64(s.latency))
+}
+
+// degraded returns whether the vector database is degraded, that is, the
+// moving average of its latency exceeds the threshold, or a lookup failed
+// in the cooldown.
+func (s *staleReads) degraded() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.latency > s.latencyThreshold {
+		return true
+	}
+	return !s.failedAt.IsZero() && s.now().Sub(s.failedAt) < s.failureCooldown
+}
+
+// remember memoizes the entry validated against the vector database, the
+// cost is the generation cost of the entry.
+func (s *staleReads) remember(key, id string, entry *semanticCacheEntry, embedding []float32, cost float64) {
+	if id == "" {
+		return
+	}
+	s.entries.Add(key, &localEntry{
+		id:          id,
+		entry:       entry,
+		embedding:   embedding,
+		validatedAt: s.now(),
+		cost:        cost,
+		size:        len(entry.Data),
+	})
+}
+
+// lookup returns the local entry of the key if it is not older than the
+// staleness bound.
+func (s *staleReads) lookup(key string) (*localEntry, time.Duration) {
+	local, ok := s.entries.Get(key)
+	if !ok {
+		s.lookups.WithLabelValues(s.name, s.policy, "miss").Inc()
+		return nil, 0
+	}
+	staleness := s.now().Sub(local.validatedAt)
+	if staleness > s.maxStaleness {
+		s.lookups.WithLabelValues(s.name, s.policy, "miss").Inc()
+		return nil, 0
+	}
+	s.lookups.WithLabelValues(s.name, s.policy, "hit").Inc()
+	return local, staleness
+}
+
+// enqueue queues the revalidation of the local entry, unless it is
+// queued already or the queue is full.
+func (s *staleReads) enqueue(r *staleRevalidation) {
+	s.lock.Lock()
+	if _, ok := s.revalidate[r.key]; ok {
+		s.lock.Unlock()
+		return
+	}
+	s.revalidate[r.key] = struct{}{}
+	s.lock.Unlock()
+
+	select {
+	case s.queue <- r:
+	default:
+		s.dequeue(r.key)
+	}
+}
+
+func (s *staleReads) dequeue(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.revalidate, key)
+}
+
+// purge removes all entries of the local tier.
+func (s *staleReads) purge() {
+	s.entries.Purge()
+}
+
+// documentID returns the ID of the document, it is empty if the document
+// has no ID.
+func documentID(doc map[string]any) string {
+	id, ok := doc["id"]
+	if !ok || id == nil {
+		return ""
+	}
+	return fmt.Sprint(id)
+}
+
+// staleReadsKey returns the key of the local tier, the entries are
+// separated by the response types, like the collections.
+func (h *semanticCacheVectorHandler) staleReadsKey(ctx *aicontext.Context, content string) string {
+	return h.getHandlerKey(ctx) + "\x00" + content
+}
+
+// initStaleReads starts revalidating the local entries in background.
+func (m *semanticCacheMiddleware) initStaleReads(spec *SemanticCacheStaleReadsSpec) {
+	m.staleReads = newStaleReads(m.spec.Name, spec)
+	go m.runRevalidations()
+}
+
+// serveStale serves the request from the local tier if the vector
+// database is degraded, and queues the revalidation of the served entry.
+// It returns false if the request is not served.
+func (m *semanticCacheMiddleware) serveStale(ctx *aicontext.Context, content string) bool {
+	s := m.staleReads
+	if s.spec.StrictFlag != "" && ctx.FlagEnabled(s.spec.StrictFlag) {
+		return false
+	}
+	if !s.degraded() {
+		return false
+	}
+	key := m.vectorHandler.staleReadsKey(ctx, content)
+	local, staleness := s.lookup(key)
+	if local == nil {
+		return false
+	}
+	s.served.WithLabelValues(m.spec.Name).Inc()
+	s.staleness.WithLabelValues(m.spec.Name).Observe(staleness.Seconds())
+	ctx.Ctx.AddTag(fmt.Sprintf("semanticCache %s: served stale entry %s validated %v ago", m.spec.Name, local.id, staleness.Truncate(time.Millisecond)))
+
+	entry := *local.entry
+	entry.Header = entry.Header.Clone()
+	m.writeRespWithCache(ctx, &entry)
+	s.enqueue(&staleRevalidation{key: key, ctx: ctx, local: local})
+	return true
+}
+
+// rememberHit memoizes the hit of the primary cache in the local tier.
+func (m *semanticCacheMiddleware) rememberHit(ctx *aicontext.Context, content string, cache map[string]any, entry *semanticCacheEntry, embedding []float32) {
+	m.staleReads.remember(m.vectorHandler.staleReadsKey(ctx, content), documentID(cache), entry, embedding, generationCost(cache))
+}
+
+func (m *semanticCacheMiddleware) runRevalidations() {
+	s := m.staleReads
+	for {
+		select {
+		case <-s.done:
+			return
+		case r := <-s.queue:
+			m.revalidateEntry(r)
+			s.dequeue(r.key)
+		}
+	}
+}
+
+// revalidateEntry searches the vector database by the embedding of the
+// local entry, the entry is validated if it is still the best match, or
+// removed otherwise. The entry is kept if the lookup fails.
+func (m *semanticCacheMiddleware) revalidateEntry(r *staleRevalidation) {
+	s := m.staleReads
+	handler, err := m.vectorHandler.GetHandler(r.ctx, r.local.embedding)
+	if err != nil {
+		logger.Warnf("semantic cache %s failed to get vector handler to revalidate entry %s: %v", m.spec.Name, r.local.id, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), staleReadsRevalidateTimeout)
+	defer cancel()
+	start := time.Now()
+	docs, err := handler.SimilaritySearch(ctx, append(getSearchOptions(m.vectorHandler.dbSpec, r.local.embedding), vecdbtypes.WithLimit(1))...)
+	s.observe(time.Since(start), err)
+	if err != nil && !errors.Is(err, vecdbtypes.ErrNotFound) {
+		logger.Warnf("semantic cache %s failed to revalidate entry %s: %v", m.spec.Name, r.local.id, err)
+		return
+	}
+	// the entry is kept as is if it is replaced meanwhile.
+	if local, ok := s.entries.Peek(r.key); !ok || local != r.local {
+		return
+	}
+	if len(docs) > 0 && documentID(docs[0]) == r.local.id {
+		s.remember(r.key, r.local.id, r.local.entry, r.local.embedding, r.local.cost)
+		return
+	}
+	s.entries.Remove(r.key)
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	stdcontext "context"
+	"errors"
+	"html/template"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// degradedVectorDB is a mockVectorDB whose searches fail with err, and
+// counts the searches.
+type degradedVectorDB struct {
+	mockVectorDB
+	err      error
+	searches int
+}
+
+func (db *degradedVectorDB) CreateSchema(ctx stdcontext.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	return db, nil
+}
+
+func (db *degradedVectorDB) SimilaritySearch(ctx stdcontext.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	db.searches++
+	if db.err != nil {
+		return nil, db.err
+	}
+	return db.mockVectorDB.SimilaritySearch(ctx, options...)
+}
+
+func TestSemanticCacheStaleReadsValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(validateSemanticCacheStaleReadsSpec(&SemanticCacheStaleReadsSpec{}))
+	assert.NoError(validateSemanticCacheStaleReadsSpec(&SemanticCacheStaleReadsSpec{MaxStaleness: "5m", MaxEntries: 10, StrictFlag: "strict"}))
+	assert.Error(validateSemanticCacheStaleReadsSpec(&SemanticCacheStaleReadsSpec{MaxStaleness: "0s"}))
+	assert.Error(validateSemanticCacheStaleReadsSpec(&SemanticCacheStaleReadsSpec{LatencyThreshold: "x"}))
+	assert.Error(validateSemanticCacheStaleReadsSpec(&SemanticCacheStaleReadsSpec{FailureCooldown: "-1s"}))
+	assert.Error(validateSemanticCacheStaleReadsSpec(&SemanticCacheStaleReadsSpec{MaxEntries: -1}))
+}
+
+func TestStaleReadsDegraded(t *testing.T) {
+	assert := assert.New(t)
+	s := newStaleReads("test-stale-degraded", &SemanticCacheStaleReadsSpec{LatencyThreshold: "100ms", FailureCooldown: "10s"})
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	assert.False(s.degraded())
+	s.observe(50*time.Millisecond, nil)
+	assert.False(s.degraded())
+
+	// the moving average follows the latency gradually.
+	s.observe(500*time.Millisecond, nil)
+	assert.True(s.degraded())
+	for i := 0; i < 20; i++ {
+		s.observe(10*time.Millisecond, nil)
+	}
+	assert.False(s.degraded())
+
+	// failures degrade the database until the cooldown ends.
+	s.observe(10*time.Millisecond, vecdbtypes.NewError(vecdbtypes.ErrTimeout, errors.New("timeout")))
+	assert.True(s.degraded())
+	now = now.Add(11 * time.Second)
+	assert.False(s.degraded())
+	s.observe(10*time.Millisecond, vecdbtypes.ErrSimilaritySearchNotFound)
+	assert.False(s.degraded())
+}
+
+func TestSemanticCacheStaleReads(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache-stale",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{Type: "redis", Threshold: 0.99, CollectionName: "cache"},
+				Redis:      &redisvector.RedisVectorDBSpec{URL: "redis://localhost:6379"},
+			},
+			StaleReads: &SemanticCacheStaleReadsSpec{MaxStaleness: "1m", FailureCooldown: "1h", StrictFlag: "strict"},
+		},
+	}
+	db := &degradedVectorDB{}
+	cache := &semanticCacheMiddleware{
+		spec:              spec,
+		embeddingsHandler: &mockEmbeddingHandler{},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template:   template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+		staleReads: newStaleReads(spec.Name, spec.SemanticCache.StaleReads),
+	}
+	defer cache.Close()
+	now := time.Now()
+	cache.staleReads.now = func() time.Time { return now }
+
+	jsonData := []byte(`{"model":"gpt-4.1","messages":[{"role":"user","content":"Hello!"}]}`)
+	handle := func(flags map[string]bool) *aicontext.Context {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		setRequest(t, ctx, "stale", req)
+		aiCtx, err := aicontext.New(ctx, &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai"})
+		assert.Nil(err)
+		aiCtx.Flags = flags
+		cache.Handle(aiCtx)
+		return aiCtx
+	}
+	served := func() float64 {
+		return testutil.ToFloat64(cache.staleReads.served.WithLabelValues(spec.Name))
+	}
+
+	// the miss is stored, and the hit is memoized in the local tier.
+	aiCtx := handle(nil)
+	assert.False(aiCtx.IsStopped())
+	for _, cb := range aiCtx.Callbacks() {
+		cb(&aicontext.FinishContext{StatusCode: http.StatusOK, RespBody: []byte("cached"), Duration: 1500})
+	}
+	assert.Len(db.data, 1)
+	assert.Equal(int64(1500), db.data[0][semanticCacheGenerationMsField])
+	db.data[0]["id"] = "entry-1"
+	aiCtx = handle(nil)
+	assert.True(aiCtx.IsStopped())
+	assert.Equal(1, cache.staleReads.entries.Len())
+	local, _ := cache.staleReads.entries.Peek(cache.vectorHandler.staleReadsKey(aiCtx, "Hello!"))
+	assert.Equal(1500.0, local.cost)
+
+	// the failed lookup degrades to a miss, and the database is degraded.
+	db.err = vecdbtypes.NewError(vecdbtypes.ErrUnavailable, errors.New("connection refused"))
+	aiCtx = handle(nil)
+	assert.False(aiCtx.IsStopped())
+	assert.True(cache.staleReads.degraded())
+
+	// the hits are served from the local tier without lookups, and
+	// revalidated in background.
+	searches := db.searches
+	now = now.Add(30 * time.Second)
+	aiCtx = handle(nil)
+	assert.True(aiCtx.IsStopped())
+	assert.Equal("cached", string(aiCtx.GetResponse().BodyBytes))
+	assert.Equal(searches, db.searches)
+	assert.Equal(1.0, served())
+	assert.Len(cache.staleReads.queue, 1)
+
+	// the revalidation is queued once.
+	handle(nil)
+	assert.Equal(2.0, served())
+	assert.Len(cache.staleReads.queue, 1)
+
+	// strict consumers are never served stale entries.
+	aiCtx = handle(map[string]bool{"strict": true})
+	assert.False(aiCtx.IsStopped())
+	assert.Equal(2.0, served())
+
+	revalidate := func() {
+		r := <-cache.staleReads.queue
+		cache.revalidateEntry(r)
+		cache.staleReads.dequeue(r.key)
+	}
+
+	// the entry is kept if the revalidation fails.
+	revalidate()
+	assert.Equal(1, cache.staleReads.entries.Len())
+
+	// the entries older than the staleness bound are not served.
+	now = now.Add(time.Minute)
+	aiCtx = handle(map[string]bool{"strict": false})
+	assert.False(aiCtx.IsStopped())
+	assert.Equal(2.0, served())
+
+	// the entry still matched by the database is validated again.
+	db.err = nil
+	now = now.Add(-time.Minute)
+	handle(nil)
+	assert.Equal(3.0, served())
+	now = now.Add(time.Minute)
+	revalidate()
+	local, staleness := cache.staleReads.lookup(cache.vectorHandler.staleReadsKey(aiCtx, "Hello!"))
+	assert.NotNil(local)
+	assert.Zero(staleness)
+
+	// the entry no longer matched by the database is removed.
+	handle(nil)
+	assert.Equal(4.0, served())
+	db.data = nil
+	revalidate()
+	assert.Zero(cache.staleReads.entries.Len())
+
+	// purges clear the local tier.
+	cache.staleReads.remember("key", "entry-2", &semanticCacheEntry{}, nil, 1)
+	cache.onInvalidate(nil)
+	assert.Zero(cache.staleReads.entries.Len())
+}
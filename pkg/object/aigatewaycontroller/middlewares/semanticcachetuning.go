@@ -0,0 +1,423 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+const (
+	defaultTuningFeedbackTTL     = time.Hour
+	defaultTuningMaxPending      = 100000
+	defaultTuningBucketWidth     = 0.01
+	defaultTuningTargetPrecision = 0.95
+	defaultTuningMinSamples      = 50
+	defaultTuningHysteresis      = 0.02
+	defaultTuningStep            = 0.01
+	defaultTuningAdjustInterval  = 5 * time.Minute
+
+	// maxThresholdAdjustments is the number of adjustments kept in history.
+	maxThresholdAdjustments = 100
+)
+
+var (
+	// ErrTuningDisabled means the threshold tuning of the middleware is
+	// not enabled.
+	ErrTuningDisabled = errors.New("threshold tuning is not enabled")
+	// ErrFeedbackRequestNotFound means the request of a feedback is not a
+	// cache hit, or its feedback window has passed.
+	ErrFeedbackRequestNotFound = errors.New("no cache hit of the request is waiting for feedback")
+)
+
+type (
+	// SemanticCacheTuningSpec describes tuning the similarity threshold of
+	// a semantic cache from the feedback on its hits.
+	SemanticCacheTuningSpec struct {
+		// FeedbackTTL is how long a hit accepts feedback.
+		FeedbackTTL string `json:"feedbackTTL,omitempty" jsonschema:"format=duration"`
+		// MaxPending is the maximum number of hits waiting for feedback,
+		// the oldest ones are dropped when it is exceeded.
+		MaxPending int `json:"maxPending,omitempty"`
+		// BucketWidth is the width of the score buckets of the statistics.
+		BucketWidth float64 `json:"bucketWidth,omitempty"`
+		// TargetPrecision is the expected ratio of correct hits.
+		TargetPrecision float64 `json:"targetPrecision,omitempty"`
+		// MinSamples is the minimum number of feedback to recommend a threshold.
+		MinSamples int `json:"minSamples,omitempty"`
+
+		// AutoAdjust adjusts the threshold to the recommended one within
+		// [MinThreshold, MaxThreshold].
+		AutoAdjust   bool    `json:"autoAdjust,omitempty"`
+		MinThreshold float64 `json:"minThreshold,omitempty"`
+		MaxThreshold float64 `json:"maxThreshold,omitempty"`
+		// Hysteresis is the precision margin around TargetPrecision within
+		// which the threshold is not adjusted.
+		Hysteresis float64 `json:"hysteresis,omitempty"`
+		// Step is the amount the threshold is changed at a time, it is
+		// raised to the recommended one directly if that is higher.
+		Step float64 `json:"step,omitempty"`
+		// AdjustInterval is the minimum interval between adjustments.
+		AdjustInterval string `json:"adjustInterval,omitempty" jsonschema:"format=duration"`
+	}
+
+	// ThresholdStats is the statistics of the feedback and the threshold.
+	ThresholdStats struct {
+		SpecThreshold    float64 `json:"specThreshold"`
+		Threshold        float64 `json:"threshold"`
+		AutoAdjust       bool    `json:"autoAdjust"`
+		AutoAdjustPaused bool    `json:"autoAdjustPaused"`
+		// Recommended is the lowest threshold meeting the target precision,
+		// it is nil if there is not enough feedback.
+		Recommended   *float64               `json:"recommended"`
+		Pending       int                    `json:"pending"`
+		TotalFeedback int64                  `json:"totalFeedback"`
+		Buckets       []*ScoreBucketStats    `json:"buckets"`
+		Adjustments   []*ThresholdAdjustment `json:"adjustments"`
+	}
+
+	// ScoreBucketStats is the feedback of hits with scores in [From, To).
+	ScoreBucketStats struct {
+		From      float64 `json:"from"`
+		To        float64 `json:"to"`
+		Feedback  int64   `json:"feedback"`
+		Correct   int64   `json:"correct"`
+		Precision float64 `json:"precision"`
+	}
+
+	// ThresholdAdjustment is a change of the threshold.
+	ThresholdAdjustment struct {
+		Time   string  `json:"time"`
+		From   float64 `json:"from"`
+		To     float64 `json:"to"`
+		Reason string  `json:"reason"`
+	}
+
+	pendingHit struct {
+		requestID string
+		score     float64
+		expireAt  time.Time
+	}
+
+	scoreBucket struct {
+		feedback int64
+		correct  int64
+	}
+
+	// thresholdTuner collects the feedback on cache hits and tunes the
+	// threshold. It is reset when the middleware is re-created.
+	thresholdTuner struct {
+		name           string
+		spec           *SemanticCacheTuningSpec
+		specThreshold  float64
+		ttl            time.Duration
+		adjustInterval time.Duration
+
+		lock       sync.Mutex
+		threshold  float64
+		paused     bool
+		lastAdjust time.Time
+		// pending is ordered by expiration, and index maps request IDs
+		// to the hits in it.
+		pending     []*pendingHit
+		index       map[string]*pendingHit
+		buckets     []scoreBucket
+		total       int64
+		adjustments []*ThresholdAdjustment
+
+		gauge *prometheus.GaugeVec
+	}
+)
+
+func validateSemanticCacheTuningSpec(spec *SemanticCacheTuningSpec, threshold float64) error {
+	if spec == nil {
+		return nil
+	}
+	for name, d := range map[string]string{"feedbackTTL": spec.FeedbackTTL, "adjustInterval": spec.AdjustInterval} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+			return fmt.Errorf("invalid %s %s", name, d)
+		}
+	}
+	if spec.MaxPending < 0 || spec.MinSamples < 0 {
+		return fmt.Errorf("maxPending and minSamples cannot be negative")
+	}
+	if spec.BucketWidth < 0 || spec.BucketWidth > 0.5 {
+		return fmt.Errorf("bucketWidth must be in (0, 0.5]")
+	}
+	if spec.TargetPrecision < 0 || spec.TargetPrecision > 1 {
+		return fmt.Errorf("targetPrecision must be in (0, 1]")
+	}
+	if spec.Hysteresis < 0 || spec.Step < 0 {
+		return fmt.Errorf("hysteresis and step cannot be negative")
+	}
+	if !spec.AutoAdjust {
+		return nil
+	}
+	if spec.MinThreshold <= 0 || spec.MaxThreshold > 1 || spec.MinThreshold > spec.MaxThreshold {
+		return fmt.Errorf("minThreshold and maxThreshold must be in (0, 1] and minThreshold must not exceed maxThreshold")
+	}
+	if threshold < spec.MinThreshold || threshold > spec.MaxThreshold {
+		return fmt.Errorf("threshold %v of vectorDB must be in [minThreshold, maxThreshold]", threshold)
+	}
+	return nil
+}
+
+func newThresholdTuner(name string, spec *SemanticCacheTuningSpec, threshold float64) *thresholdTuner {
+	s := *spec
+	if s.MaxPending == 0 {
+		s.MaxPending = defaultTuningMaxPending
+	}
+	if s.BucketWidth == 0 {
+		s.BucketWidth = defaultTuningBucketWidth
+	}
+	if s.TargetPrecision == 0 {
+		s.TargetPrecision = defaultTuningTargetPrecision
+	}
+	if s.MinSamples == 0 {
+		s.MinSamples = defaultTuningMinSamples
+	}
+	if s.Hysteresis == 0 {
+		s.Hysteresis = defaultTuningHysteresis
+	}
+	if s.Step == 0 {
+		s.Step = defaultTuningStep
+	}
+	t := &thresholdTuner{
+		name:           name,
+		spec:           &s,
+		specThreshold:  threshold,
+		ttl:            defaultTuningFeedbackTTL,
+		adjustInterval: defaultTuningAdjustInterval,
+		threshold:      threshold,
+		index:          map[string]*pendingHit{},
+		buckets:        make([]scoreBucket, int(math.Ceil(1/s.BucketWidth))),
+		gauge:          metricshub.SemanticCacheThreshold.NewGauge(),
+	}
+	if d, err := time.ParseDuration(s.FeedbackTTL); err == nil {
+		t.ttl = d
+	}
+	if d, err := time.ParseDuration(s.AdjustInterval); err == nil {
+		t.adjustInterval = d
+	}
+	t.setGauge()
+	return t
+}
+
+func (t *thresholdTuner) setGauge() {
+	if t.gauge != nil {
+		t.gauge.WithLabelValues(t.name).Set(t.threshold)
+	}
+}
+
+// currentThreshold returns the threshold to serve cache hits.
+func (t *thresholdTuner) currentThreshold() float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.threshold
+}
+
+func (t *thresholdTuner) expire(now time.Time) {
+	n := 0
+	for n < len(t.pending) && (t.pending[n].expireAt.Before(now) || len(t.pending)-n > t.spec.MaxPending) {
+		if t.index[t.pending[n].requestID] == t.pending[n] {
+			delete(t.index, t.pending[n].requestID)
+		}
+		n++
+	}
+	t.pending = t.pending[n:]
+}
+
+// recordHit records a cache hit served to the request to wait for feedback.
+func (t *thresholdTuner) recordHit(requestID string, score float64, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hit := &pendingHit{requestID: requestID, score: score, expireAt: now.Add(t.ttl)}
+	t.pending = append(t.pending, hit)
+	t.index[requestID] = hit
+	t.expire(now)
+}
+
+func (t *thresholdTuner) bucketIndex(score float64) int {
+	i := int(score / t.spec.BucketWidth)
+	return max(0, min(i, len(t.buckets)-1))
+}
+
+// feedback records the feedback of a cache hit, and adjusts the threshold
+// if it is enabled.
+func (t *thresholdTuner) feedback(feedback *Feedback, now time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.expire(now)
+	hit, ok := t.index[feedback.RequestID]
+	if !ok {
+		return ErrFeedbackRequestNotFound
+	}
+	// feedback is accepted only once per hit.
+	delete(t.index, feedback.RequestID)
+
+	b := &t.buckets[t.bucketIndex(hit.score)]
+	b.feedback++
+	if feedback.Correct {
+		b.correct++
+	}
+	t.total++
+
+	if t.spec.AutoAdjust && !t.paused && now.Sub(t.lastAdjust) >= t.adjustInterval {
+		t.autoAdjust(now)
+	}
+	return nil
+}
+
+// precisionAbove returns the feedback and precision of hits with scores
+// not lower than the start of the bucket of the threshold.
+func (t *thresholdTuner) precisionAbove(threshold float64) (int64, float64) {
+	var feedback, correct int64
+	for i := t.bucketIndex(threshold); i < len(t.buckets); i++ {
+		feedback += t.buckets[i].feedback
+		correct += t.buckets[i].correct
+	}
+	if feedback == 0 {
+		return 0, 0
+	}
+	return feedback, float64(correct) / float64(feedback)
+}
+
+// recommend returns the lowest bucket start at which the hits meet the
+// target precision with enough feedback.
+func (t *thresholdTuner) recommend() (float64, bool) {
+	var feedback, correct int64
+	recommended, ok := 0.0, false
+	for i := len(t.buckets) - 1; i >= 0; i-- {
+		feedback += t.buckets[i].feedback
+		correct += t.buckets[i].correct
+		if t.buckets[i].feedback == 0 || feedback < int64(t.spec.MinSamples) {
+			continue
+		}
+		if float64(correct)/float64(feedback) >= t.spec.TargetPrecision {
+			recommended, ok = roundThreshold(float64(i)*t.spec.BucketWidth), true
+		}
+	}
+	return recommended, ok
+}
+
+// roundThreshold removes the floating point noise of bucket boundaries.
+func roundThreshold(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
+
+func (t *thresholdTuner) autoAdjust(now time.Time) {
+	feedback, precision := t.precisionAbove(t.threshold)
+	if feedback < int64(t.spec.MinSamples) {
+		return
+	}
+
+	target, reason := t.threshold, ""
+	switch {
+	case precision < t.spec.TargetPrecision-t.spec.Hysteresis:
+		target = t.threshold + t.spec.Step
+		if recommended, ok := t.recommend(); ok && recommended > target {
+			target = recommended
+		}
+		reason = fmt.Sprintf("precision %.4f of %d feedback is below target %.4f", precision, feedback, t.spec.TargetPrecision)
+	case precision > t.spec.TargetPrecision+t.spec.Hysteresis:
+		target = t.threshold - t.spec.Step
+		reason = fmt.Sprintf("precision %.4f of %d feedback is above target %.4f", precision, feedback, t.spec.TargetPrecision)
+	}
+	target = roundThreshold(math.Max(t.spec.MinThreshold, math.Min(t.spec.MaxThreshold, target)))
+	if target == t.threshold {
+		return
+	}
+	t.lastAdjust = now
+	t.adjust(target, reason, now)
+}
+
+// adjust changes the threshold, all adjustments are logged and kept in
+// history.
+func (t *thresholdTuner) adjust(threshold float64, reason string, now time.Time) {
+	adjustment := &ThresholdAdjustment{
+		Time:   now.Format(time.RFC3339),
+		From:   t.threshold,
+		To:     threshold,
+		Reason: reason,
+	}
+	t.adjustments = append(t.adjustments, adjustment)
+	if len(t.adjustments) > maxThresholdAdjustments {
+		t.adjustments = t.adjustments[len(t.adjustments)-maxThresholdAdjustments:]
+	}
+	logger.Infof("threshold of semantic cache %s is adjusted from %v to %v: %s", t.name, adjustment.From, adjustment.To, reason)
+	t.threshold = threshold
+	t.setGauge()
+}
+
+// revert reverts the threshold to the one in the spec, and pauses the
+// automatic adjustments until the middleware is re-created.
+func (t *thresholdTuner) revert(operator string, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.paused = true
+	if t.threshold != t.specThreshold {
+		t.adjust(t.specThreshold, "reverted by "+operator, now)
+	}
+}
+
+func (t *thresholdTuner) stats(now time.Time) *ThresholdStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.expire(now)
+	stats := &ThresholdStats{
+		SpecThreshold:    t.specThreshold,
+		Threshold:        t.threshold,
+		AutoAdjust:       t.spec.AutoAdjust,
+		AutoAdjustPaused: t.paused,
+		Pending:          len(t.index),
+		TotalFeedback:    t.total,
+		Buckets:          []*ScoreBucketStats{},
+		Adjustments:      append([]*ThresholdAdjustment{}, t.adjustments...),
+	}
+	if recommended, ok := t.recommend(); ok {
+		stats.Recommended = &recommended
+	}
+	for i, b := range t.buckets {
+		if b.feedback == 0 {
+			continue
+		}
+		stats.Buckets = append(stats.Buckets, &ScoreBucketStats{
+			From:      roundThreshold(float64(i) * t.spec.BucketWidth),
+			To:        roundThreshold(math.Min(1, float64(i+1)*t.spec.BucketWidth)),
+			Feedback:  b.feedback,
+			Correct:   b.correct,
+			Precision: float64(b.correct) / float64(b.feedback),
+		})
+	}
+	return stats
+}
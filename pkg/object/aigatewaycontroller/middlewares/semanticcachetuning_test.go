@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	egContext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestValidateSemanticCacheTuningSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateSemanticCacheTuningSpec(nil, 0.9))
+	assert.NoError(validateSemanticCacheTuningSpec(&SemanticCacheTuningSpec{}, 0.9))
+	assert.NoError(validateSemanticCacheTuningSpec(&SemanticCacheTuningSpec{
+		AutoAdjust: true, MinThreshold: 0.85, MaxThreshold: 0.98,
+	}, 0.9))
+	assert.Error(validateSemanticCacheTuningSpec(&SemanticCacheTuningSpec{FeedbackTTL: "1x"}, 0.9))
+	assert.Error(validateSemanticCacheTuningSpec(&SemanticCacheTuningSpec{TargetPrecision: 1.5}, 0.9))
+	assert.Error(validateSemanticCacheTuningSpec(&SemanticCacheTuningSpec{BucketWidth: 0.8}, 0.9))
+	assert.Error(validateSemanticCacheTuningSpec(&SemanticCacheTuningSpec{AutoAdjust: true}, 0.9))
+	assert.Error(validateSemanticCacheTuningSpec(&SemanticCacheTuningSpec{
+		AutoAdjust: true, MinThreshold: 0.92, MaxThreshold: 0.98,
+	}, 0.9))
+}
+
+func TestThresholdTunerFeedback(t *testing.T) {
+	assert := assert.New(t)
+
+	tuner := newThresholdTuner("cache", &SemanticCacheTuningSpec{FeedbackTTL: "1m", MaxPending: 2}, 0.9)
+	now := time.Now()
+
+	tuner.recordHit("r1", 0.95, now)
+	assert.NoError(tuner.feedback(&Feedback{RequestID: "r1", Correct: true}, now))
+	// feedback is accepted once.
+	assert.ErrorIs(tuner.feedback(&Feedback{RequestID: "r1"}, now), ErrFeedbackRequestNotFound)
+	assert.ErrorIs(tuner.feedback(&Feedback{RequestID: "unknown"}, now), ErrFeedbackRequestNotFound)
+
+	// expired.
+	tuner.recordHit("r2", 0.95, now)
+	assert.ErrorIs(tuner.feedback(&Feedback{RequestID: "r2"}, now.Add(2*time.Minute)), ErrFeedbackRequestNotFound)
+
+	// the oldest hits are dropped when there are too many.
+	tuner.recordHit("r3", 0.91, now)
+	tuner.recordHit("r4", 0.92, now)
+	tuner.recordHit("r5", 0.93, now)
+	assert.ErrorIs(tuner.feedback(&Feedback{RequestID: "r3"}, now), ErrFeedbackRequestNotFound)
+	assert.NoError(tuner.feedback(&Feedback{RequestID: "r4", Correct: false}, now))
+
+	stats := tuner.stats(now)
+	assert.Equal(int64(2), stats.TotalFeedback)
+	assert.Equal(1, stats.Pending)
+	assert.Nil(stats.Recommended)
+	assert.Len(stats.Buckets, 2)
+	assert.Equal(0.92, stats.Buckets[0].From)
+	assert.Equal(0.93, stats.Buckets[0].To)
+	assert.Equal(0.0, stats.Buckets[0].Precision)
+	assert.Equal(0.95, stats.Buckets[1].From)
+	assert.Equal(1.0, stats.Buckets[1].Precision)
+}
+
+// sendFeedback sends feedback of n hits with the score, and the first
+// correct ones are correct.
+func sendFeedback(tuner *thresholdTuner, score float64, n int, correct int, now time.Time) {
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%v-%d-%d", score, i, now.UnixNano())
+		tuner.recordHit(id, score, now)
+		tuner.feedback(&Feedback{RequestID: id, Correct: i < correct}, now)
+	}
+}
+
+func TestThresholdTunerRecommend(t *testing.T) {
+	assert := assert.New(t)
+
+	tuner := newThresholdTuner("cache", &SemanticCacheTuningSpec{MinSamples: 10, TargetPrecision: 0.9}, 0.8)
+	now := time.Now()
+	sendFeedback(tuner, 0.97, 10, 10, now)
+	sendFeedback(tuner, 0.9, 10, 9, now)
+	sendFeedback(tuner, 0.85, 10, 5, now)
+
+	// precision above 0.9 is 19/20, above 0.85 is 24/30.
+	stats := tuner.stats(now)
+	assert.Equal(0.9, *stats.Recommended)
+	// nothing is adjusted without autoAdjust.
+	assert.Equal(0.8, stats.Threshold)
+	assert.Empty(stats.Adjustments)
+}
+
+func TestThresholdTunerAutoAdjust(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &SemanticCacheTuningSpec{
+		MinSamples:      10,
+		TargetPrecision: 0.9,
+		Hysteresis:      0.05,
+		Step:            0.02,
+		AutoAdjust:      true,
+		MinThreshold:    0.8,
+		MaxThreshold:    0.95,
+		AdjustInterval:  "1m",
+	}
+	loaded := time.Now()
+	now := loaded.Add(time.Minute)
+	// newTuner returns a tuner with the feedback loaded within the
+	// adjustment interval, so the evaluation is triggered by later feedback.
+	newTuner := func(threshold float64, load func(*thresholdTuner)) *thresholdTuner {
+		tuner := newThresholdTuner("cache", spec, threshold)
+		tuner.lastAdjust = loaded
+		load(tuner)
+		assert.Equal(threshold, tuner.currentThreshold())
+		return tuner
+	}
+
+	// the precision is too low, the threshold is raised to the recommended.
+	tuner := newTuner(0.85, func(tuner *thresholdTuner) {
+		sendFeedback(tuner, 0.93, 10, 10, loaded)
+		sendFeedback(tuner, 0.86, 20, 10, loaded)
+	})
+	sendFeedback(tuner, 0.86, 1, 0, now)
+	stats := tuner.stats(now)
+	assert.Equal(0.93, stats.Threshold)
+	assert.Len(stats.Adjustments, 1)
+	assert.Equal(0.85, stats.Adjustments[0].From)
+	assert.Contains(stats.Adjustments[0].Reason, "below target")
+
+	// not adjusted again within the interval.
+	sendFeedback(tuner, 0.99, 50, 50, now)
+	assert.Equal(0.93, tuner.currentThreshold())
+
+	// the precision is high, the threshold is lowered by a step.
+	sendFeedback(tuner, 0.99, 1, 1, now.Add(time.Minute))
+	assert.Equal(0.91, tuner.currentThreshold())
+
+	// within hysteresis, kept.
+	tuner = newTuner(0.85, func(tuner *thresholdTuner) {
+		sendFeedback(tuner, 0.9, 19, 17, loaded)
+	})
+	sendFeedback(tuner, 0.9, 1, 1, now)
+	assert.Equal(0.85, tuner.currentThreshold())
+
+	// bounded.
+	tuner = newTuner(0.8, func(tuner *thresholdTuner) {
+		sendFeedback(tuner, 0.99, 20, 20, loaded)
+	})
+	sendFeedback(tuner, 0.99, 1, 1, now)
+	assert.Equal(0.8, tuner.currentThreshold())
+	assert.Empty(tuner.stats(now).Adjustments)
+
+	// reverted and paused.
+	tuner = newTuner(0.85, func(tuner *thresholdTuner) {
+		sendFeedback(tuner, 0.99, 20, 20, loaded)
+	})
+	sendFeedback(tuner, 0.99, 1, 1, now)
+	assert.Equal(0.83, tuner.currentThreshold())
+	tuner.revert("admin", now)
+	stats = tuner.stats(now)
+	assert.Equal(0.85, stats.Threshold)
+	assert.True(stats.AutoAdjustPaused)
+	assert.Equal("reverted by admin", stats.Adjustments[1].Reason)
+	sendFeedback(tuner, 0.99, 20, 20, now.Add(time.Hour))
+	assert.Equal(0.85, tuner.currentThreshold())
+}
+
+func TestSemanticCacheTuning(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test-semantic-cache",
+		Kind: semanticCacheMiddlewareKind,
+		SemanticCache: &SemanticCacheSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "openai",
+				BaseURL:      "http://localhost:8080",
+				Model:        "text-embedding-3-small",
+				APIKey:       "test-api-key",
+			},
+			VectorDB: &vectordb.Spec{
+				CommonSpec: vecdbtypes.CommonSpec{
+					Type:           "redis",
+					Threshold:      0.999,
+					CollectionName: "redis-test",
+				},
+				Redis: &redisvector.RedisVectorDBSpec{
+					URL: "redis://localhost:6379",
+				},
+			},
+			ThresholdTuning: &SemanticCacheTuningSpec{},
+		},
+	}
+	assert.NoError(ValidateSpec(spec))
+
+	db := &explainVectorDB{
+		data: []map[string]any{
+			{"id": "near", "embedding": []float32{1, 0.1, 0}, "data": "near", "header": "{}", "status": 200},
+		},
+	}
+	cache := &semanticCacheMiddleware{
+		spec: spec,
+		embeddingsHandler: &topicEmbeddingHandler{vectors: map[string][]float32{
+			"hello": {1, 0, 0},
+		}},
+		vectorHandler: &semanticCacheVectorHandler{
+			spec:     spec,
+			dbSpec:   spec.SemanticCache.VectorDB,
+			vectorDB: db,
+			handlers: make(map[string]vectordb.VectorHandler),
+		},
+		template: template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate)),
+		tuner:    newThresholdTuner(spec.Name, spec.SemanticCache.ThresholdTuning, 0.999),
+	}
+
+	handle := func(requestID string) *aicontext.Context {
+		data := map[string]any{
+			"model":    "gpt-4.1",
+			"messages": []map[string]any{{"role": "user", "content": "hello"}},
+		}
+		jsonData, err := json.Marshal(data)
+		assert.Nil(err)
+		ctx := egContext.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		if requestID != "" {
+			req.Header.Set("X-Request-Id", requestID)
+		}
+		setRequest(t, ctx, "tuning", req)
+		aiCtx, err := aicontext.New(ctx, nil)
+		assert.Nil(err)
+		cache.Handle(aiCtx)
+		return aiCtx
+	}
+
+	// the score of near is about 0.995, below the threshold.
+	aiCtx := handle("req-1")
+	assert.False(aiCtx.IsStopped())
+	assert.Equal(1, len(aiCtx.Callbacks()))
+
+	cache.tuner.threshold = 0.99
+	aiCtx = handle("req-2")
+	assert.True(aiCtx.IsStopped())
+	resp := aiCtx.GetResponse()
+	assert.Equal("req-2", resp.Header.Get("X-Request-Id"))
+	assert.Equal("0.9950", resp.Header.Get("X-Semantic-Cache-Score"))
+
+	aiCtx = handle("")
+	requestID := aiCtx.GetResponse().Header.Get("X-Request-Id")
+	assert.NotEmpty(requestID)
+
+	assert.NoError(cache.Feedback(&Feedback{RequestID: "req-2", Correct: true}))
+	assert.NoError(cache.Feedback(&Feedback{RequestID: requestID, Correct: false}))
+	assert.ErrorIs(cache.Feedback(&Feedback{RequestID: "req-1"}), ErrFeedbackRequestNotFound)
+	assert.Error(cache.Feedback(&Feedback{}))
+
+	stats, err := cache.ThresholdStats()
+	assert.NoError(err)
+	assert.Equal(int64(2), stats.TotalFeedback)
+	assert.Equal(0.99, stats.Threshold)
+
+	stats, err = cache.RevertThreshold("admin")
+	assert.NoError(err)
+	assert.Equal(0.999, stats.Threshold)
+	assert.Len(stats.Adjustments, 1)
+
+	// the probe uses the tuned threshold too.
+	cache.tuner.threshold = 0.99
+	data, _ := json.Marshal(map[string]any{"model": "gpt-4.1", "messages": []map[string]any{{"role": "user", "content": "hello"}}})
+	ctx := egContext.New(nil)
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(data))
+	setRequest(t, ctx, "probe", req)
+	probeCtx, _ := aicontext.New(ctx, nil)
+	result, err := cache.Probe(probeCtx, nil)
+	assert.NoError(err)
+	assert.True(result.(*SemanticCacheProbeResult).Hit)
+
+	_, err = (&semanticCacheMiddleware{}).ThresholdStats()
+	assert.ErrorIs(err, ErrTuningDisabled)
+}
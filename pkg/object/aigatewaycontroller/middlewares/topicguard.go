@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	topicGuardActionBlock    = "block"
+	topicGuardActionAnnotate = "annotate"
+)
+
+type (
+	// TopicGuardSpec defines banned topics by example texts. A prompt is
+	// considered to be on a topic if the cosine similarity between its
+	// embedding and the centroid of the topic examples reaches the threshold.
+	TopicGuardSpec struct {
+		Embeddings      *embeddings.EmbeddingSpec `json:"embeddings" jsonschema:"required"`
+		ContentTemplate string                    `json:"contentTemplate,omitempty"`
+		// Shadow annotates the requests hitting topics without blocking them,
+		// it is used to verify the topics before enabling blocking.
+		Shadow bool               `json:"shadow,omitempty"`
+		Topics []*TopicGuardTopic `json:"topics" jsonschema:"required"`
+	}
+
+	// TopicGuardTopic is a banned topic of the topic guard.
+	TopicGuardTopic struct {
+		Name      string   `json:"name" jsonschema:"required"`
+		Examples  []string `json:"examples" jsonschema:"required"`
+		Threshold float64  `json:"threshold" jsonschema:"required"`
+		Action    string   `json:"action,omitempty" jsonschema:"enum=,enum=block,enum=annotate"`
+	}
+
+	topicGuardMiddleware struct {
+		spec              *MiddlewareSpec
+		embeddingsHandler embeddings.EmbeddingHandler
+		template          *template.Template
+		hits              *prometheus.CounterVec
+
+		lock      sync.Mutex
+		centroids [][]float32
+	}
+
+	// topicGuardHit is a topic hit by a prompt.
+	topicGuardHit struct {
+		topic      *TopicGuardTopic
+		similarity float64
+		action     string
+	}
+)
+
+// topicEmbeddingCache caches the embeddings of topic examples, so the
+// examples are not embedded again when the controller is reloaded.
+var topicEmbeddingCache sync.Map
+
+func init() {
+	middlewareTypeRegistry[topicGuardMiddlewareKind] = reflect.TypeOf(topicGuardMiddleware{})
+}
+
+var _ Middleware = (*topicGuardMiddleware)(nil)
+
+func (m *topicGuardMiddleware) init(spec *MiddlewareSpec) {
+	m.spec = spec
+	m.embeddingsHandler = embeddings.New(spec.TopicGuard.Embeddings)
+	templateText := spec.TopicGuard.ContentTemplate
+	if templateText == "" {
+		templateText = semanticCacheDefaultContentTemplate
+	}
+	m.template = template.Must(template.New("").Parse(templateText))
+	m.hits = metricshub.TopicGuardHits.NewCounter()
+
+	// embed the examples at startup, the centroids are loaded again
+	// when handling requests if it fails.
+	go func() {
+		if _, err := m.getCentroids(); err != nil {
+			logger.Errorf("failed to load topics of topicGuard middleware %s: %v", spec.Name, err)
+		}
+	}()
+}
+
+func (m *topicGuardMiddleware) validate(spec *MiddlewareSpec) error {
+	if spec.TopicGuard == nil {
+		return fmt.Errorf("topicGuard middleware %s must have a topicGuard spec", spec.Name)
+	}
+	if err := embeddings.ValidateSpec(spec.TopicGuard.Embeddings); err != nil {
+		return fmt.Errorf("topicGuard middleware %s has invalid embeddings spec: %w", spec.Name, err)
+	}
+	if spec.TopicGuard.ContentTemplate != "" {
+		if _, err := template.New("").Parse(spec.TopicGuard.ContentTemplate); err != nil {
+			return fmt.Errorf("topicGuard middleware %s has invalid content template: %w", spec.Name, err)
+		}
+	}
+	if len(spec.TopicGuard.Topics) == 0 {
+		return fmt.Errorf("topicGuard middleware %s must have at least one topic", spec.Name)
+	}
+	names := map[string]struct{}{}
+	for _, topic := range spec.TopicGuard.Topics {
+		if topic.Name == "" {
+			return fmt.Errorf("topicGuard middleware %s has a topic without name", spec.Name)
+		}
+		if _, ok := names[topic.Name]; ok {
+			return fmt.Errorf("topicGuard middleware %s has duplicated topic %s", spec.Name, topic.Name)
+		}
+		names[topic.Name] = struct{}{}
+		if len(topic.Examples) == 0 {
+			return fmt.Errorf("topic %s of topicGuard middleware %s must have at least one example", topic.Name, spec.Name)
+		}
+		if topic.Threshold <= 0 || topic.Threshold > 1 {
+			return fmt.Errorf("threshold of topic %s of topicGuard middleware %s must be in (0, 1]", topic.Name, spec.Name)
+		}
+		switch topic.Action {
+		case "", topicGuardActionBlock, topicGuardActionAnnotate:
+		default:
+			return fmt.Errorf("topic %s of topicGuard middleware %s has invalid action %s", topic.Name, spec.Name, topic.Action)
+		}
+	}
+	return nil
+}
+
+func (m *topicGuardMiddleware) Name() string {
+	return m.spec.Name
+}
+
+func (m *topicGuardMiddleware) Kind() string {
+	return topicGuardMiddlewareKind
+}
+
+func (m *topicGuardMiddleware) Spec() *MiddlewareSpec {
+	return m.spec
+}
+
+// getCentroids returns the centroids of the topics, it embeds the topic
+// examples if the centroids are not loaded yet.
+func (m *topicGuardMiddleware) getCentroids() ([][]float32, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.centroids != nil {
+		return m.centroids, nil
+	}
+
+	spec := m.spec.TopicGuard
+	centroids := make([][]float32, 0, len(spec.Topics))
+	for _, topic := range spec.Topics {
+		vectors := make([][]float32, 0, len(topic.Examples))
+		for _, example := range topic.Examples {
+			key := spec.Embeddings.ProviderType + "|" + spec.Embeddings.BaseURL + "|" + spec.Embeddings.Model + "|" + example
+			if v, ok := topicEmbeddingCache.Load(key); ok {
+				vectors = append(vectors, v.([]float32))
+				continue
+			}
+			vector, err := m.embeddingsHandler.EmbedDocuments(example)
+			if err != nil {
+				return nil, fmt.Errorf("failed to embed examples of topic %s: %w", topic.Name, err)
+			}
+			topicEmbeddingCache.Store(key, vector)
+			vectors = append(vectors, vector)
+		}
+		centroid, err := topicCentroid(vectors)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute centroid of topic %s: %w", topic.Name, err)
+		}
+		centroids = append(centroids, centroid)
+	}
+	m.centroids = centroids
+	return centroids, nil
+}
+
+// topicCentroid returns the normalized mean of the normalized vectors.
+func topicCentroid(vectors [][]float32) ([]float32, error) {
+	dim := len(vectors[0])
+	centroid := make([]float32, dim)
+	for _, vector := range vectors {
+		if len(vector) != dim {
+			return nil, fmt.Errorf("embeddings have different dimensions %d and %d", dim, len(vector))
+		}
+		norm := vectorNorm(vector)
+		if norm == 0 {
+			continue
+		}
+		for i, v := range vector {
+			centroid[i] += float32(float64(v) / norm)
+		}
+	}
+	norm := vectorNorm(centroid)
+	if norm == 0 {
+		return nil, fmt.Errorf("centroid is a zero vector")
+	}
+	for i := range centroid {
+		centroid[i] = float32(float64(centroid[i]) / norm)
+	}
+	return centroid, nil
+}
+
+func vectorNorm(vector []float32) float64 {
+	sum := 0.0
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+	return math.Sqrt(sum)
+}
+
+// match compares the embedding against all topic centroids, and returns the hit topics.
+func (m *topicGuardMiddleware) match(embedding []float32, centroids [][]float32) []*topicGuardHit {
+	norm := vectorNorm(embedding)
+	if norm == 0 {
+		return nil
+	}
+
+	var hits []*topicGuardHit
+	for i, centroid := range centroids {
+		if len(centroid) != len(embedding) {
+			continue
+		}
+		dot := 0.0
+		for j, v := range embedding {
+			dot += float64(v) * float64(centroid[j])
+		}
+		// centroids are normalized already.
+		similarity := dot / norm
+		topic := m.spec.TopicGuard.Topics[i]
+		if similarity < topic.Threshold {
+			continue
+		}
+		action := topic.Action
+		if action == "" {
+			action = topicGuardActionBlock
+		}
+		if m.spec.TopicGuard.Shadow {
+			action = topicGuardActionAnnotate
+		}
+		hits = append(hits, &topicGuardHit{topic: topic, similarity: similarity, action: action})
+	}
+	return hits
+}
+
+func (m *topicGuardMiddleware) getContent(ctx *aicontext.Context) (string, error) {
+	var result bytes.Buffer
+	if err := m.template.Execute(&result, ctx.OpenAIReq); err != nil {
+		return "", fmt.Errorf("failed to execute template for topic guard: %w", err)
+	}
+	return result.String(), nil
+}
+
+func (m *topicGuardMiddleware) Handle(ctx *aicontext.Context) {
+	if ctx.RespType != aicontext.ResponseTypeChatCompletions && ctx.RespType != aicontext.ResponseTypeCompletions {
+		return
+	}
+
+	content, err := m.getContent(ctx)
+	if err != nil {
+		logger.Errorf("failed to get content for topic guard: %v", err)
+		return
+	}
+	if content == "" {
+		return
+	}
+	centroids, err := m.getCentroids()
+	if err != nil {
+		logger.Errorf("failed to load topics of topicGuard middleware %s: %v", m.spec.Name, err)
+		return
+	}
+	embedding, err := embedQuery(ctx, m.spec.Name, m.spec.TopicGuard.Embeddings, m.embeddingsHandler, content)
+	if err != nil {
+		logger.Errorf("failed to embed content for topic guard: %v", err)
+		return
+	}
+
+	var blocked *topicGuardHit
+	for _, hit := range m.match(embedding, centroids) {
+		if m.hits != nil {
+			m.hits.With(prometheus.Labels{
+				"middleware": m.spec.Name,
+				"topic":      hit.topic.Name,
+				"action":     hit.action,
+			}).Inc()
+		}
+		ctx.Ctx.AddTag(fmt.Sprintf("topicGuard %s: topic %s, similarity %.4f, action %s",
+			m.spec.Name, hit.topic.Name, hit.similarity, hit.action))
+		if hit.action == topicGuardActionBlock && (blocked == nil || hit.similarity > blocked.similarity) {
+			blocked = hit
+		}
+	}
+	if blocked == nil {
+		return
+	}
+
+	errMsg := protocol.NewError(http.StatusBadRequest, fmt.Sprintf("request is rejected, it is about the banned topic %s", blocked.topic.Name))
+	data, _ := codectool.MarshalJSON(errMsg)
+	ctx.SetResponse(&aicontext.Response{
+		StatusCode:    http.StatusBadRequest,
+		ContentLength: int64(len(data)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		BodyBytes:     data,
+	})
+	ctx.Stop(aicontext.ResultMiddlewareError)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/embeddings/embedtypes"
+	"github.com/stretchr/testify/assert"
+)
+
+// topicEmbeddingHandler embeds texts with the predefined vectors.
+type topicEmbeddingHandler struct {
+	vectors map[string][]float32
+}
+
+func (e *topicEmbeddingHandler) EmbedDocuments(text string) ([]float32, error) {
+	return e.EmbedQuery(text)
+}
+
+func (e *topicEmbeddingHandler) EmbedQuery(text string) ([]float32, error) {
+	if v, ok := e.vectors[text]; ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown text %s", text)
+}
+
+func TestTopicGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &MiddlewareSpec{
+		Name: "test-topic-guard",
+		Kind: topicGuardMiddlewareKind,
+		TopicGuard: &TopicGuardSpec{
+			Embeddings: &embedtypes.EmbeddingSpec{
+				ProviderType: "ollama",
+				BaseURL:      "http://topic-guard-test:11434",
+				Model:        "nomic-embed-text",
+			},
+			Topics: []*TopicGuardTopic{
+				{
+					Name:      "weapons",
+					Examples:  []string{"how to build a gun", "how to make explosives"},
+					Threshold: 0.9,
+				},
+				{
+					Name:      "gambling",
+					Examples:  []string{"best online casino"},
+					Threshold: 0.9,
+					Action:    topicGuardActionAnnotate,
+				},
+			},
+		},
+	}
+	assert.Nil(ValidateSpec(spec))
+
+	guard := &topicGuardMiddleware{}
+	guard.spec = spec
+	guard.embeddingsHandler = &topicEmbeddingHandler{
+		vectors: map[string][]float32{
+			"how to build a gun":     {1, 0.1, 0},
+			"how to make explosives": {1, -0.1, 0},
+			"best online casino":     {0, 0, 1},
+			"assemble a rifle":       {0.9, 0, 0.1},
+			"poker tips":             {0.1, 0, 1},
+			"hello":                  {0, 1, 0},
+		},
+	}
+	guard.template = template.Must(template.New("").Parse(semanticCacheDefaultContentTemplate))
+
+	providerSpec := &aicontext.ProviderSpec{
+		Name:         "openai",
+		ProviderType: "openai",
+		APIKey:       "test-api-key",
+	}
+	handle := func(content string) *aicontext.Context {
+		data := map[string]any{
+			"model": "gpt-4.1",
+			"messages": []map[string]any{
+				{"role": "user", "content": content},
+			},
+		}
+		jsonData, err := json.Marshal(data)
+		assert.Nil(err)
+
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader(jsonData))
+		assert.Nil(err)
+		setRequest(t, ctx, "topic.guard", req)
+		aiCtx, err := aicontext.New(ctx, providerSpec)
+		assert.Nil(err)
+		guard.Handle(aiCtx)
+		return aiCtx
+	}
+
+	{
+		// blocked by weapons topic
+		aiCtx := handle("assemble a rifle")
+		assert.True(aiCtx.IsStopped())
+		assert.Equal(aicontext.ResultMiddlewareError, aiCtx.Result())
+		resp := aiCtx.GetResponse()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(string(resp.BodyBytes), "weapons")
+		assert.Contains(aiCtx.Ctx.Tags(), "topic weapons")
+	}
+
+	{
+		// annotated by gambling topic
+		aiCtx := handle("poker tips")
+		assert.False(aiCtx.IsStopped())
+		assert.Contains(aiCtx.Ctx.Tags(), "topic gambling")
+		assert.Contains(aiCtx.Ctx.Tags(), "action annotate")
+	}
+
+	{
+		// no topic
+		aiCtx := handle("hello")
+		assert.False(aiCtx.IsStopped())
+		assert.Empty(aiCtx.Ctx.Tags())
+	}
+
+	{
+		// shadow mode
+		spec.TopicGuard.Shadow = true
+		aiCtx := handle("assemble a rifle")
+		assert.False(aiCtx.IsStopped())
+		assert.Contains(aiCtx.Ctx.Tags(), "topic weapons")
+		assert.Contains(aiCtx.Ctx.Tags(), "action annotate")
+		spec.TopicGuard.Shadow = false
+	}
+
+	{
+		// invalid specs
+		spec.TopicGuard.Topics[0].Threshold = 1.5
+		assert.NotNil(ValidateSpec(spec))
+		spec.TopicGuard.Topics[0].Threshold = 0.9
+		spec.TopicGuard.Topics[1].Action = "drop"
+		assert.NotNil(ValidateSpec(spec))
+		spec.TopicGuard.Topics[1].Action = topicGuardActionAnnotate
+		spec.TopicGuard.Topics[1].Name = "weapons"
+		assert.NotNil(ValidateSpec(spec))
+	}
+}
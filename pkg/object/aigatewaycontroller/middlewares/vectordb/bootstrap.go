@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// DefaultInferSampleSize is the default number of the first inserted
+// documents the schema is inferred from.
+const DefaultInferSampleSize = 10
+
+type (
+	// InferOptions are the options to infer the schema of a collection.
+	InferOptions struct {
+		// SampleSize is the number of the first inserted documents the
+		// schema is inferred from in bootstrap mode.
+		SampleSize int
+		// Strict rejects the documents conflicting with the schema,
+		// otherwise they are coerced, see InferredSchema.Conform.
+		Strict bool
+	}
+
+	// inferringHandler is the handler of a collection whose schema is
+	// inferred. Before the schema is inferred, it is in bootstrap mode, the
+	// inserted documents are kept as samples, and searches find nothing.
+	inferringHandler struct {
+		db      VectorDB
+		spec    *Spec
+		options *InferOptions
+
+		lock    sync.Mutex
+		samples []*sampleBatch
+		count   int
+		schema  *InferredSchema
+		handler VectorHandler
+	}
+
+	sampleBatch struct {
+		docs    []map[string]any
+		options []vecdbtypes.HandlerInsertOption
+	}
+)
+
+var _ VectorHandler = (*inferringHandler)(nil)
+
+// CreateSchemaFromSamples infers the schema of the collection from the
+// sample documents, and creates the collection with it. The schema is
+// persisted if the vector database supports it, and the persisted one is
+// used if there is one, so restarts never infer a different schema.
+func CreateSchemaFromSamples(ctx context.Context, db VectorDB, spec *Spec, samples []map[string]any, strict bool) (VectorHandler, error) {
+	schema, err := loadSchema(ctx, db, spec.CollectionName)
+	if err != nil {
+		return nil, err
+	}
+	if schema == nil {
+		if schema, err = inferSchema(ctx, db, spec.CollectionName, samples); err != nil {
+			return nil, err
+		}
+	}
+	h := &inferringHandler{db: db, spec: spec, options: &InferOptions{Strict: strict}}
+	if err := h.create(ctx, schema); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// NewInferringHandler returns the handler of the collection whose schema
+// is inferred from the first inserted documents. The collection is created
+// directly if its schema is persisted.
+func NewInferringHandler(ctx context.Context, db VectorDB, spec *Spec, options *InferOptions) (VectorHandler, error) {
+	if options == nil {
+		options = &InferOptions{}
+	}
+	if options.SampleSize <= 0 {
+		options = &InferOptions{SampleSize: DefaultInferSampleSize, Strict: options.Strict}
+	}
+	h := &inferringHandler{db: db, spec: spec, options: options}
+	schema, err := loadSchema(ctx, db, spec.CollectionName)
+	if err != nil {
+		return nil, err
+	}
+	if schema != nil {
+		if err := h.create(ctx, schema); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// loadSchema returns the persisted schema, or nil if there is none.
+func loadSchema(ctx context.Context, db VectorDB, name string) (*InferredSchema, error) {
+	store, ok := db.(vecdbtypes.SchemaStore)
+	if !ok {
+		return nil, nil
+	}
+	data, err := store.LoadSchema(ctx, name)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	schema := &InferredSchema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("invalid persisted schema of collection %s: %w", name, err)
+	}
+	return schema, nil
+}
+
+// inferSchema infers the schema from the samples and persists it, the
+// schema persisted by others first wins.
+func inferSchema(ctx context.Context, db VectorDB, name string, samples []map[string]any) (*InferredSchema, error) {
+	schema, err := InferSchema(samples)
+	if err != nil {
+		return nil, fmt.Errorf("failed to infer schema of collection %s: %w", name, err)
+	}
+	store, ok := db.(vecdbtypes.SchemaStore)
+	if !ok {
+		logger.Warnf("inferred schema of collection %s is not persisted, the vector database does not support it: %s", name, schema)
+		return schema, nil
+	}
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	saved, err := store.SaveSchema(ctx, name, data)
+	if err != nil {
+		return nil, err
+	}
+	persisted := &InferredSchema{}
+	if err := json.Unmarshal(saved, persisted); err != nil {
+		return nil, fmt.Errorf("invalid persisted schema of collection %s: %w", name, err)
+	}
+	logger.Infof("inferred schema of collection %s: %s, persisted: %s", name, schema, persisted)
+	return persisted, nil
+}
+
+// create creates the collection with the schema, the caller must hold the
+// lock if the handler is in use.
+func (h *inferringHandler) create(ctx context.Context, schema *InferredSchema) error {
+	handler, err := h.db.CreateSchema(ctx, func(o *vecdbtypes.Options) {
+		o.DBName = h.spec.CollectionName
+		o.Schema = schema.ToSchema(h.spec)
+	})
+	if err != nil {
+		return err
+	}
+	h.schema, h.handler = schema, handler
+	return nil
+}
+
+// conform conforms the documents to the schema.
+func (h *inferringHandler) conform(schema *InferredSchema, docs []map[string]any) ([]map[string]any, error) {
+	result := make([]map[string]any, 0, len(docs))
+	for _, doc := range docs {
+		d, err := schema.Conform(doc, h.options.Strict)
+		if err != nil {
+			return nil, fmt.Errorf("document conflicts with the schema of collection %s: %w", h.spec.CollectionName, err)
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+func (h *inferringHandler) insert(ctx context.Context, schema *InferredSchema, handler VectorHandler, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	docs, err := h.conform(schema, docs)
+	if err != nil {
+		return nil, err
+	}
+	return handler.InsertDocuments(ctx, docs, options...)
+}
+
+// InsertDocuments inserts the documents. In bootstrap mode, the documents
+// are kept until there are enough samples, then the schema is inferred
+// and all kept documents are inserted, so only the IDs of the documents of
+// the last call are returned.
+func (h *inferringHandler) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	h.lock.Lock()
+	if h.handler != nil {
+		schema, handler := h.schema, h.handler
+		h.lock.Unlock()
+		return h.insert(ctx, schema, handler, docs, options...)
+	}
+	defer h.lock.Unlock()
+
+	h.samples = append(h.samples, &sampleBatch{docs: docs, options: options})
+	h.count += len(docs)
+	if h.count < h.options.SampleSize {
+		return nil, nil
+	}
+
+	samples := make([]map[string]any, 0, h.count)
+	for _, batch := range h.samples {
+		samples = append(samples, batch.docs...)
+	}
+	schema, err := loadSchema(ctx, h.db, h.spec.CollectionName)
+	if err == nil && schema == nil {
+		schema, err = inferSchema(ctx, h.db, h.spec.CollectionName, samples)
+	}
+	if err == nil {
+		err = h.create(ctx, schema)
+	}
+	if err != nil {
+		// drop the current documents, so a bad batch does not block later ones.
+		h.samples = h.samples[:len(h.samples)-1]
+		h.count -= len(docs)
+		return nil, err
+	}
+
+	kept, current := h.samples[:len(h.samples)-1], h.samples[len(h.samples)-1]
+	h.samples, h.count = nil, 0
+	for _, batch := range kept {
+		if _, err := h.insert(ctx, h.schema, h.handler, batch.docs, batch.options...); err != nil {
+			logger.Errorf("failed to insert documents of collection %s kept in bootstrap mode: %v", h.spec.CollectionName, err)
+		}
+	}
+	return h.insert(ctx, h.schema, h.handler, current.docs, current.options...)
+}
+
+// SimilaritySearch searches the collection, nothing is found in bootstrap
+// mode.
+func (h *inferringHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	h.lock.Lock()
+	handler := h.handler
+	h.lock.Unlock()
+	if handler == nil {
+		return nil, ErrSimilaritySearchNotFound
+	}
+	return handler.SimilaritySearch(ctx, options...)
+}
+
+// Close closes the handler of the collection, if the schema is inferred.
+func (h *inferringHandler) Close() {
+	h.lock.Lock()
+	handler := h.handler
+	h.lock.Unlock()
+	if closer, ok := handler.(vecdbtypes.HandlerCloser); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// DualReadFallbackField is set to true in the documents found in the
+// fallback collection by a DualReadHandler.
+const DualReadFallbackField = "_fallback"
+
+type (
+	// DualReadHandler reads a collection being re-embedded by a new
+	// embedding model. Similarity searches go to the collection of the new
+	// model first, and the collection of the previous model is searched
+	// too if the first one returns fewer than minResults documents. The
+	// documents of the fallback collection follow the ones of the primary
+	// collection. Writes only go to the primary collection.
+	DualReadHandler struct {
+		VectorHandler
+		minResults int
+		fallback   DualReadFallback
+	}
+
+	// DualReadFallback returns the handler of the fallback collection and
+	// the options searching it. It is only called when the fallback
+	// collection is searched, so the query is embedded by the previous
+	// model only if needed.
+	DualReadFallback func(ctx context.Context) (VectorHandler, []vecdbtypes.HandlerSearchOption, error)
+
+	// FallbackError is the error of searching the fallback collection of a
+	// DualReadHandler, it is returned with the documents of the primary
+	// collection.
+	FallbackError struct {
+		Err error
+	}
+)
+
+var _ VectorHandler = (*DualReadHandler)(nil)
+
+func (e *FallbackError) Error() string {
+	return "fallback collection: " + e.Err.Error()
+}
+
+func (e *FallbackError) Unwrap() error {
+	return e.Err
+}
+
+// NewDualReadHandler returns the handler reading the fallback collection
+// after the primary one, minResults is 1 if it is not positive, so the
+// fallback collection is only searched if the primary one misses.
+func NewDualReadHandler(primary VectorHandler, minResults int, fallback DualReadFallback) *DualReadHandler {
+	return &DualReadHandler{
+		VectorHandler: primary,
+		minResults:    max(minResults, 1),
+		fallback:      fallback,
+	}
+}
+
+// SimilaritySearch searches the primary collection, and the fallback
+// collection if the primary one returns too few documents. It returns
+// ErrSimilaritySearchNotFound if neither returns a document.
+func (h *DualReadHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	docs, err := h.VectorHandler.SimilaritySearch(ctx, options...)
+	if err != nil && !errors.Is(err, ErrSimilaritySearchNotFound) {
+		return nil, err
+	}
+	if len(docs) >= h.minResults {
+		return docs, nil
+	}
+
+	handler, fallbackOptions, err := h.fallback(ctx)
+	if err == nil {
+		var fallbackDocs []map[string]any
+		fallbackDocs, err = handler.SimilaritySearch(ctx, fallbackOptions...)
+		for _, doc := range fallbackDocs {
+			doc[DualReadFallbackField] = true
+		}
+		docs = append(docs, fallbackDocs...)
+	}
+	if err != nil && !errors.Is(err, ErrSimilaritySearchNotFound) {
+		return docs, &FallbackError{Err: err}
+	}
+	if len(docs) == 0 {
+		return nil, ErrSimilaritySearchNotFound
+	}
+	return docs, nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// resultHandler returns its documents to the similarity searches, or
+// ErrSimilaritySearchNotFound if there are none.
+type resultHandler struct {
+	docs     []string
+	err      error
+	searches int
+	written  int
+}
+
+func (h *resultHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	h.searches++
+	if h.err != nil {
+		return nil, h.err
+	}
+	if len(h.docs) == 0 {
+		return nil, ErrSimilaritySearchNotFound
+	}
+	docs := make([]map[string]any, 0, len(h.docs))
+	for _, id := range h.docs {
+		docs = append(docs, map[string]any{"id": id})
+	}
+	return docs, nil
+}
+
+func (h *resultHandler) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	h.written += len(docs)
+	return nil, nil
+}
+
+func TestDualReadHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := &resultHandler{docs: []string{"p1"}}
+	fallback := &resultHandler{docs: []string{"f1", "f2"}}
+	resolved := 0
+	newHandler := func(minResults int) *DualReadHandler {
+		return NewDualReadHandler(primary, minResults, func(ctx context.Context) (VectorHandler, []vecdbtypes.HandlerSearchOption, error) {
+			resolved++
+			return fallback, nil, nil
+		})
+	}
+	ids := func(docs []map[string]any) []string {
+		var ids []string
+		for _, doc := range docs {
+			if doc[DualReadFallbackField] == true {
+				ids = append(ids, "fallback:"+doc["id"].(string))
+			} else {
+				ids = append(ids, doc["id"].(string))
+			}
+		}
+		return ids
+	}
+
+	// the fallback is not resolved if the primary returns enough.
+	docs, err := newHandler(0).SimilaritySearch(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"p1"}, ids(docs))
+	assert.Equal(0, resolved)
+
+	// the documents of the fallback follow the ones of the primary.
+	docs, err = newHandler(2).SimilaritySearch(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"p1", "fallback:f1", "fallback:f2"}, ids(docs))
+	assert.Equal(1, resolved)
+
+	primary.docs = nil
+	docs, err = newHandler(1).SimilaritySearch(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"fallback:f1", "fallback:f2"}, ids(docs))
+
+	fallback.docs = nil
+	_, err = newHandler(1).SimilaritySearch(context.Background())
+	assert.Equal(ErrSimilaritySearchNotFound, err)
+
+	// the failures of the fallback are returned with the documents of the
+	// primary.
+	primary.docs = []string{"p1"}
+	failure := errors.New("timeout")
+	fallback.err = failure
+	docs, err = newHandler(2).SimilaritySearch(context.Background())
+	var fallbackErr *FallbackError
+	assert.ErrorAs(err, &fallbackErr)
+	assert.ErrorIs(err, failure)
+	assert.Equal([]string{"p1"}, ids(docs))
+
+	// the failures of the primary are returned without the fallback.
+	fallbackSearches := fallback.searches
+	primary.err = errors.New("failed")
+	_, err = newHandler(2).SimilaritySearch(context.Background())
+	assert.EqualError(err, "failed")
+	assert.Equal(fallbackSearches, fallback.searches)
+
+	// writes only go to the primary.
+	_, err = newHandler(1).InsertDocuments(context.Background(), []map[string]any{{"id": "p2"}})
+	assert.NoError(err)
+	assert.Equal(1, primary.written)
+	assert.Equal(0, fallback.written)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+type (
+	FilterAliasSpec = vecdbtypes.FilterAliasSpec
+
+	// AliasedHandler expands the tag filters of the similarity searches
+	// and deletions of a handler by the filter aliases of its collection.
+	AliasedHandler struct {
+		wrappedHandler
+		aliases *atomic.Pointer[vecdbtypes.FilterAliases]
+	}
+)
+
+var (
+	filterAliasesLock sync.Mutex
+	// filterAliases are the filter aliases of the collections, the handlers
+	// of all middlewares using a collection share its aliases, and the
+	// spec of the latest handler applies, so the aliases are reloaded
+	// without creating the collection again.
+	filterAliases = map[string]*atomic.Pointer[vecdbtypes.FilterAliases]{}
+)
+
+var (
+	_ vecdbtypes.SchemaEnsurer = (*AliasedHandler)(nil)
+	_ vecdbtypes.FilterDeleter = (*AliasedHandler)(nil)
+)
+
+// NewAliasedHandler returns the handler expanding the tag filters by the
+// filter aliases of the collection of the spec. The aliases of the spec
+// replace the ones of the collection even if they are nil, but the handler
+// is returned as is then.
+func NewAliasedHandler(spec *Spec, handler VectorHandler) VectorHandler {
+	key := queryBackend(spec) + "/" + spec.CollectionName
+	filterAliasesLock.Lock()
+	aliases := filterAliases[key]
+	if aliases == nil {
+		aliases = &atomic.Pointer[vecdbtypes.FilterAliases]{}
+		filterAliases[key] = aliases
+	}
+	filterAliasesLock.Unlock()
+
+	aliases.Store(vecdbtypes.NewFilterAliases(spec.FilterAliases))
+	if spec.FilterAliases == nil {
+		return handler
+	}
+	return &AliasedHandler{wrappedHandler: wrappedHandler{handler}, aliases: aliases}
+}
+
+// SimilaritySearch searches with the tag filters expanded, the expansions
+// are added to the results if the search is explained.
+func (h *AliasedHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	aliases := h.aliases.Load()
+	if aliases == nil {
+		return h.VectorHandler.SimilaritySearch(ctx, options...)
+	}
+	opts := &vecdbtypes.HandlerSearchOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	tagFilters, expansions := aliases.ExpandTagFilters(opts.TagFilters)
+	queryFilters, redisExpansions := aliases.ExpandRedisQueryFilters(opts.RedisQueryFilters)
+	expansions = append(expansions, redisExpansions...)
+	if len(expansions) == 0 {
+		return h.VectorHandler.SimilaritySearch(ctx, options...)
+	}
+
+	options = append(options, vecdbtypes.WithTagFilters(tagFilters...), vecdbtypes.WithRedisQueryFilters(queryFilters...))
+	docs, err := h.VectorHandler.SimilaritySearch(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Explain {
+		for _, doc := range docs {
+			doc[vecdbtypes.ExplainFilterExpansionsField] = expansions
+		}
+	}
+	return docs, nil
+}
+
+// DeleteByFilter deletes the documents matching the expanded filters, so
+// the documents of all the aliases of the tags are deleted.
+func (h *AliasedHandler) DeleteByFilter(ctx context.Context, filters ...*vecdbtypes.TagFilter) (int64, error) {
+	if aliases := h.aliases.Load(); aliases != nil {
+		filters, _ = aliases.ExpandTagFilters(filters)
+	}
+	return h.wrappedHandler.DeleteByFilter(ctx, filters...)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// filterDeletingHandler records the filters of the last deletion.
+type filterDeletingHandler struct {
+	candidateHandler
+	filters []*vecdbtypes.TagFilter
+}
+
+func (h *filterDeletingHandler) DeleteByFilter(ctx context.Context, filters ...*vecdbtypes.TagFilter) (int64, error) {
+	h.filters = filters
+	return int64(len(filters)), nil
+}
+
+func filterAliasTestSpec(collection string, aliases *FilterAliasSpec) *Spec {
+	spec := &Spec{}
+	spec.Type = TypeRedis
+	spec.CollectionName = collection
+	spec.FilterAliases = aliases
+	return spec
+}
+
+func TestAliasedHandlerPassthrough(t *testing.T) {
+	handler := &countingHandler{}
+	assert.Same(t, handler, NewAliasedHandler(filterAliasTestSpec("passthrough", nil), handler))
+}
+
+func TestAliasedHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	aliases := &FilterAliasSpec{Aliases: map[string][][]string{"model": {{"gpt4", "gpt-4", "gpt-4-0613"}}}}
+	inner := &filterDeletingHandler{candidateHandler: candidateHandler{candidates: []map[string]any{{"id": "a"}}}}
+	handler := NewAliasedHandler(filterAliasTestSpec("aliased", aliases), inner)
+
+	// the tag filters and the structured filters of Redis are expanded.
+	filter := &vecdbtypes.TagFilter{Field: "model", Tags: []string{"gpt-4"}}
+	docs, err := handler.SimilaritySearch(context.Background(), vecdbtypes.WithTagFilters(filter),
+		vecdbtypes.WithRedisQueryFilters(&vecdbtypes.RedisQueryFilter{Field: "model", Tags: []string{"gpt4"}}))
+	assert.NoError(err)
+	assert.Equal([]string{"gpt-4", "gpt4", "gpt-4-0613"}, inner.options.TagFilters[0].Tags)
+	assert.Equal([]string{"gpt4", "gpt-4", "gpt-4-0613"}, inner.options.RedisQueryFilters[0].Tags)
+	assert.Equal([]string{"gpt-4"}, filter.Tags)
+	assert.NotContains(docs[0], vecdbtypes.ExplainFilterExpansionsField)
+
+	// the expansions are in the results of explained searches.
+	docs, err = handler.SimilaritySearch(context.Background(), vecdbtypes.WithTagFilters(filter), vecdbtypes.WithExplain())
+	assert.NoError(err)
+	assert.Equal([]*vecdbtypes.FilterExpansion{{Field: "model", Tags: []string{"gpt-4"}, Expanded: []string{"gpt-4", "gpt4", "gpt-4-0613"}}},
+		docs[0][vecdbtypes.ExplainFilterExpansionsField])
+
+	// the deletions are expanded too.
+	_, err = handler.(vecdbtypes.FilterDeleter).DeleteByFilter(context.Background(), filter)
+	assert.NoError(err)
+	assert.Equal([]string{"gpt-4", "gpt4", "gpt-4-0613"}, inner.filters[0].Tags)
+
+	// the aliases of the latest spec apply to the handlers created before.
+	other := NewAliasedHandler(filterAliasTestSpec("aliased", &FilterAliasSpec{
+		Aliases: map[string][][]string{"model": {{"gpt-4", "gpt-4-turbo"}}},
+	}), &countingHandler{})
+	assert.NotSame(handler, other)
+	_, err = handler.SimilaritySearch(context.Background(), vecdbtypes.WithTagFilters(filter))
+	assert.NoError(err)
+	assert.Equal([]string{"gpt-4", "gpt-4-turbo"}, inner.options.TagFilters[0].Tags)
+
+	NewAliasedHandler(filterAliasTestSpec("aliased", nil), &countingHandler{})
+	_, err = handler.SimilaritySearch(context.Background(), vecdbtypes.WithTagFilters(filter))
+	assert.NoError(err)
+	assert.Equal([]string{"gpt-4"}, inner.options.TagFilters[0].Tags)
+
+	// handlers not deleting by filters are reported.
+	handler = NewAliasedHandler(filterAliasTestSpec("unsupported", aliases), &countingHandler{})
+	_, err = handler.(vecdbtypes.FilterDeleter).DeleteByFilter(context.Background(), filter)
+	assert.ErrorIs(err, vecdbtypes.ErrDeleteNotSupported)
+}
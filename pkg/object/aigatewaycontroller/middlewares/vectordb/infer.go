@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/pgvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// The types of inferred fields.
+const (
+	// FieldTypeTag is for short strings without spaces and booleans, like
+	// IDs and enums, they are matched exactly.
+	FieldTypeTag = "tag"
+	// FieldTypeText is for free text.
+	FieldTypeText = "text"
+	// FieldTypeNumeric is for numbers, they support range filters.
+	FieldTypeNumeric = "numeric"
+	// FieldTypeVector is for embeddings.
+	FieldTypeVector = "vector"
+
+	// maxTagLength is the maximum length of strings inferred as tags.
+	maxTagLength = 64
+)
+
+type (
+	// InferredSchema is the schema inferred from sample documents, it is
+	// converted to the schema of the vector database.
+	InferredSchema struct {
+		Fields []*InferredField `json:"fields"`
+	}
+
+	// InferredField is a field of the inferred schema.
+	InferredField struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+		// Dim is the dimension of vector fields.
+		Dim int `json:"dim,omitempty"`
+	}
+)
+
+// InferSchema proposes the field types and vector dimensions from the
+// sample documents. The fields of conflicting scalar types are widened to
+// text, and vector fields with other types or dimensions are errors.
+func InferSchema(docs []map[string]any) (*InferredSchema, error) {
+	fields := map[string]*InferredField{}
+	for _, doc := range docs {
+		for name, value := range doc {
+			if value == nil {
+				continue
+			}
+			typ, dim := inferType(value)
+			field, ok := fields[name]
+			if !ok {
+				fields[name] = &InferredField{Name: name, Type: typ, Dim: dim}
+				continue
+			}
+			if err := field.merge(typ, dim); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields in sample documents")
+	}
+
+	schema := &InferredSchema{}
+	for _, field := range fields {
+		schema.Fields = append(schema.Fields, field)
+	}
+	sort.Slice(schema.Fields, func(i, j int) bool {
+		return schema.Fields[i].Name < schema.Fields[j].Name
+	})
+	return schema, nil
+}
+
+func inferType(value any) (string, int) {
+	switch v := value.(type) {
+	case bool:
+		return FieldTypeTag, 0
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number:
+		return FieldTypeNumeric, 0
+	case string:
+		if len(v) <= maxTagLength && !strings.ContainsAny(v, " \t\r\n") {
+			return FieldTypeTag, 0
+		}
+		return FieldTypeText, 0
+	case []float32:
+		return FieldTypeVector, len(v)
+	case []float64:
+		return FieldTypeVector, len(v)
+	case []any:
+		for _, e := range v {
+			if t, _ := inferType(e); t != FieldTypeNumeric {
+				return FieldTypeText, 0
+			}
+		}
+		return FieldTypeVector, len(v)
+	default:
+		return FieldTypeText, 0
+	}
+}
+
+func (f *InferredField) merge(typ string, dim int) error {
+	if f.Type == FieldTypeVector || typ == FieldTypeVector {
+		if f.Type != typ {
+			return fmt.Errorf("field %s has both vector and scalar values", f.Name)
+		}
+		if f.Dim != dim {
+			return fmt.Errorf("vector field %s has dimensions %d and %d", f.Name, f.Dim, dim)
+		}
+		return nil
+	}
+	if f.Type != typ {
+		f.Type = FieldTypeText
+	}
+	return nil
+}
+
+// Field returns the field of the name, or nil if it is not in the schema.
+func (s *InferredSchema) Field(name string) *InferredField {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// String returns the schema in the format of name:type, for logging.
+func (s *InferredSchema) String() string {
+	fields := make([]string, 0, len(s.Fields))
+	for _, field := range s.Fields {
+		if field.Type == FieldTypeVector {
+			fields = append(fields, fmt.Sprintf("%s:%s(%d)", field.Name, field.Type, field.Dim))
+		} else {
+			fields = append(fields, field.Name+":"+field.Type)
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+// ToSchema converts the inferred schema to the schema of the vector
+// database of the spec.
+func (s *InferredSchema) ToSchema(spec *Spec) vecdbtypes.Schema {
+	if spec.Type == TypePostgres {
+		table := &pgvector.TableSchema{TableName: spec.CollectionName}
+		for _, field := range s.Fields {
+			dataType := "text"
+			switch field.Type {
+			case FieldTypeNumeric:
+				dataType = "double precision"
+			case FieldTypeVector:
+				dataType = fmt.Sprintf("vector(%d)", field.Dim)
+			}
+			table.Columns = append(table.Columns, pgvector.Column{Name: field.Name, DataType: dataType, IsNullable: true})
+		}
+		return table
+	}
+
+	index := &redisvector.IndexSchema{}
+	for _, field := range s.Fields {
+		switch field.Type {
+		case FieldTypeTag:
+			index.Tags = append(index.Tags, redisvector.Tag{Name: field.Name})
+		case FieldTypeNumeric:
+			index.Numerics = append(index.Numerics, redisvector.Numeric{Name: field.Name})
+		case FieldTypeVector:
+			index.Vectors = append(index.Vectors, redisvector.Vector{Name: field.Name, Dim: field.Dim})
+		default:
+			index.Texts = append(index.Texts, redisvector.Text{Name: field.Name})
+		}
+	}
+	return index
+}
+
+// Conform checks the document against the schema. In strict mode, the
+// values of conflicting types and unknown fields are rejected, otherwise
+// the values are coerced to the field types, and the values which cannot
+// be coerced are dropped. Vectors of other dimensions are always rejected.
+func (s *InferredSchema) Conform(doc map[string]any, strict bool) (map[string]any, error) {
+	result := make(map[string]any, len(doc))
+	for name, value := range doc {
+		field := s.Field(name)
+		if field == nil {
+			if strict {
+				return nil, fmt.Errorf("field %s is not in the schema", name)
+			}
+			result[name] = value
+			continue
+		}
+		if value == nil {
+			result[name] = value
+			continue
+		}
+
+		typ, dim := inferType(value)
+		if field.Type == FieldTypeVector {
+			if typ != FieldTypeVector || dim != field.Dim {
+				return nil, fmt.Errorf("field %s must be a vector of dimension %d", name, field.Dim)
+			}
+			result[name] = value
+			continue
+		}
+		if typ == field.Type || (field.Type == FieldTypeText && typ == FieldTypeTag) {
+			result[name] = value
+			continue
+		}
+		if strict {
+			return nil, fmt.Errorf("field %s must be %s, got %T", name, field.Type, value)
+		}
+		if coerced, ok := coerce(value, field.Type); ok {
+			result[name] = coerced
+		}
+	}
+	return result, nil
+}
+
+// coerce converts the value to the field type.
+func coerce(value any, typ string) (any, bool) {
+	if typ != FieldTypeNumeric {
+		return fmt.Sprint(value), true
+	}
+	switch v := value.(type) {
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return nil, false
+}
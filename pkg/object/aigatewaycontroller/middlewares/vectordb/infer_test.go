@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/pgvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	os.Exit(m.Run())
+}
+
+func TestInferSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	schema, err := InferSchema([]map[string]any{
+		{"id": "doc-1", "price": 12.5, "title": "a movie", "embedding": []float32{1, 2, 3}, "hot": true},
+		{"id": "doc-2", "price": 8, "title": "b", "embedding": []any{1.0, 2.0, 3.0}, "year": nil},
+	})
+	assert.NoError(err)
+	assert.Equal("embedding:vector(3), hot:tag, id:tag, price:numeric, title:text", schema.String())
+
+	redis := schema.ToSchema(&Spec{CommonSpec: vecdbtypes.CommonSpec{Type: TypeRedis}}).(*redisvector.IndexSchema)
+	assert.Equal([]redisvector.Tag{{Name: "hot"}, {Name: "id"}}, redis.Tags)
+	assert.Equal([]redisvector.Numeric{{Name: "price"}}, redis.Numerics)
+	assert.Equal([]redisvector.Text{{Name: "title"}}, redis.Texts)
+	assert.Equal([]redisvector.Vector{{Name: "embedding", Dim: 3}}, redis.Vectors)
+
+	table := schema.ToSchema(&Spec{CommonSpec: vecdbtypes.CommonSpec{Type: TypePostgres, CollectionName: "movies"}}).(*pgvector.TableSchema)
+	assert.Equal("movies", table.TableName)
+	assert.Equal("vector(3)", table.Columns[0].DataType)
+	assert.Equal("double precision", table.Columns[3].DataType)
+	assert.Equal("text", table.Columns[4].DataType)
+
+	// conflicting scalar types are widened to text.
+	schema, err = InferSchema([]map[string]any{{"year": 2020}, {"year": "unknown"}})
+	assert.NoError(err)
+	assert.Equal(FieldTypeText, schema.Field("year").Type)
+
+	_, err = InferSchema([]map[string]any{{"embedding": []float32{1, 2}}, {"embedding": []float32{1, 2, 3}}})
+	assert.ErrorContains(err, "dimensions 2 and 3")
+	_, err = InferSchema([]map[string]any{{"embedding": []float32{1, 2}}, {"embedding": "1,2"}})
+	assert.ErrorContains(err, "vector and scalar")
+	_, err = InferSchema([]map[string]any{{"id": nil}})
+	assert.Error(err)
+}
+
+func TestConform(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := &InferredSchema{Fields: []*InferredField{
+		{Name: "embedding", Type: FieldTypeVector, Dim: 2},
+		{Name: "id", Type: FieldTypeTag},
+		{Name: "price", Type: FieldTypeNumeric},
+		{Name: "title", Type: FieldTypeText},
+	}}
+
+	doc := map[string]any{"embedding": []float32{1, 2}, "id": "a", "price": 1, "title": "short"}
+	result, err := schema.Conform(doc, true)
+	assert.NoError(err)
+	assert.Equal(doc, result)
+
+	_, err = schema.Conform(map[string]any{"price": "12"}, true)
+	assert.ErrorContains(err, "price must be numeric")
+	_, err = schema.Conform(map[string]any{"extra": "x"}, true)
+	assert.ErrorContains(err, "not in the schema")
+
+	result, err = schema.Conform(map[string]any{"price": " 12 ", "id": 7, "extra": "x"}, false)
+	assert.NoError(err)
+	assert.Equal(map[string]any{"price": 12.0, "id": "7", "extra": "x"}, result)
+	// the values which cannot be coerced are dropped.
+	result, err = schema.Conform(map[string]any{"price": "cheap", "id": "a"}, false)
+	assert.NoError(err)
+	assert.Equal(map[string]any{"id": "a"}, result)
+
+	_, err = schema.Conform(map[string]any{"embedding": []float32{1, 2, 3}}, false)
+	assert.ErrorContains(err, "dimension 2")
+}
+
+// schemaDB is a vector database with a schema store in memory.
+type schemaDB struct {
+	lock     sync.Mutex
+	schemas  map[string][]byte
+	created  []vecdbtypes.Schema
+	inserted [][]map[string]any
+	fail     bool
+}
+
+func (db *schemaDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+	opts := &vecdbtypes.Options{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	db.created = append(db.created, opts.Schema)
+	return db, nil
+}
+
+func (db *schemaDB) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	db.inserted = append(db.inserted, docs)
+	ids := make([]string, len(docs))
+	return ids, nil
+}
+
+func (db *schemaDB) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	return []map[string]any{{"id": "1"}}, nil
+}
+
+func (db *schemaDB) LoadSchema(ctx context.Context, name string) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.schemas[name], nil
+}
+
+func (db *schemaDB) SaveSchema(ctx context.Context, name string, schema []byte) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.fail {
+		return nil, errors.New("save failed")
+	}
+	if _, ok := db.schemas[name]; !ok {
+		db.schemas[name] = schema
+	}
+	return db.schemas[name], nil
+}
+
+func TestInferringHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{CommonSpec: vecdbtypes.CommonSpec{Type: TypeRedis, CollectionName: "movies"}}
+	db := &schemaDB{schemas: map[string][]byte{}}
+	ctx := context.Background()
+
+	h, err := NewInferringHandler(ctx, db, spec, &InferOptions{SampleSize: 3, Strict: true})
+	assert.NoError(err)
+
+	// bootstrap mode.
+	ids, err := h.InsertDocuments(ctx, []map[string]any{{"id": "a", "year": 2020, "embedding": []float32{1, 2}}})
+	assert.NoError(err)
+	assert.Nil(ids)
+	_, err = h.SimilaritySearch(ctx)
+	assert.ErrorIs(err, ErrSimilaritySearchNotFound)
+	assert.Empty(db.created)
+
+	// the schema is inferred from all kept documents, and they are inserted.
+	ids, err = h.InsertDocuments(ctx, []map[string]any{
+		{"id": "b", "year": 2021, "embedding": []float32{3, 4}},
+		{"id": "c", "year": 2022, "embedding": []float32{5, 6}},
+	})
+	assert.NoError(err)
+	assert.Len(ids, 2)
+	assert.Len(db.created, 1)
+	assert.Len(db.inserted, 2)
+	assert.Contains(string(db.schemas["movies"]), `"name":"year","type":"numeric"`)
+	docs, err := h.SimilaritySearch(ctx)
+	assert.NoError(err)
+	assert.Len(docs, 1)
+
+	_, err = h.InsertDocuments(ctx, []map[string]any{{"id": "d", "year": "2023"}})
+	assert.ErrorContains(err, "conflicts with the schema")
+
+	// a restart uses the persisted schema, even if the samples differ.
+	db.created = nil
+	handler, err := CreateSchemaFromSamples(ctx, db, spec, []map[string]any{{"year": "unknown"}}, false)
+	assert.NoError(err)
+	assert.Len(db.created, 1)
+	assert.Equal([]redisvector.Numeric{{Name: "year"}}, db.created[0].(*redisvector.IndexSchema).Numerics)
+	_, err = handler.InsertDocuments(ctx, []map[string]any{{"id": "d", "year": "2023"}})
+	assert.NoError(err)
+	assert.Equal(2023.0, db.inserted[len(db.inserted)-1][0]["year"])
+
+	h, err = NewInferringHandler(ctx, db, spec, nil)
+	assert.NoError(err)
+	_, err = h.SimilaritySearch(ctx)
+	assert.NoError(err)
+
+	// the documents of a failed bootstrap are dropped.
+	db = &schemaDB{schemas: map[string][]byte{}, fail: true}
+	h, err = NewInferringHandler(ctx, db, spec, &InferOptions{SampleSize: 1})
+	assert.NoError(err)
+	_, err = h.InsertDocuments(ctx, []map[string]any{{"id": "a"}})
+	assert.Error(err)
+	db.fail = false
+	_, err = h.InsertDocuments(ctx, []map[string]any{{"title": "a movie"}})
+	assert.NoError(err)
+	assert.Equal("title:text", mustLoadSchema(t, db, "movies").String())
+}
+
+func mustLoadSchema(t *testing.T, db VectorDB, name string) *InferredSchema {
+	schema, err := loadSchema(context.Background(), db, name)
+	assert.NoError(t, err)
+	return schema
+}
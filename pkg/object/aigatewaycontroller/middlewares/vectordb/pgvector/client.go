@@ -19,12 +19,15 @@ package pgvector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pgvector/pgvector-go"
 	pgxvec "github.com/pgvector/pgvector-go/pgx"
 )
@@ -98,6 +101,21 @@ func (c *PostgresClient) CreateDBIfNotExists(ctx context.Context, tx pgx.Tx, sch
 		return fmt.Errorf("failed to create table %s: %w", schema.TableName, err)
 	}
 
+	// the columns added to the schema later are added to the existing
+	// table, primary keys are never changed.
+	for _, col := range schema.Columns {
+		if col.IsPrimary {
+			continue
+		}
+		sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", schema.TableName, col.Name, col.DataType)
+		if col.DefaultValue != "" {
+			sql += " DEFAULT " + col.DefaultValue
+		}
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("failed to add column %s to table %s: %w", col.Name, schema.TableName, err)
+		}
+	}
+
 	// Create indexes if specified
 	for _, index := range schema.Indexes {
 		indexSQL, err := getCreateTableIndexSQL(schema, index)
@@ -264,6 +282,103 @@ func (c *PostgresClient) insertSingleDocument(tableName string, doc map[string]a
 	return sql, args, nil
 }
 
+// ReplaceGroup deletes the documents whose column is group, and inserts
+// the documents in a transaction.
+func (c *PostgresClient) ReplaceGroup(ctx context.Context, tableName, column, group string, docs []map[string]any) ([]string, error) {
+	tx, err := c.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s = $1", tableName, column), group); err != nil {
+		return nil, fmt.Errorf("failed to delete documents: %w", err)
+	}
+	docIDs := make([]string, 0, len(docs))
+	for _, d := range docs {
+		if d[DefaultPrimaryKeyColumnName] == nil {
+			d[DefaultPrimaryKeyColumnName] = uuid.New().String()
+		}
+		docIDs = append(docIDs, fmt.Sprint(d[DefaultPrimaryKeyColumnName]))
+		sql, args, err := c.insertSingleDocument(tableName, d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert document: %w", err)
+		}
+		if _, err := tx.Exec(ctx, sql, args...); err != nil {
+			return nil, fmt.Errorf("failed to insert document: %w", err)
+		}
+	}
+	return docIDs, tx.Commit(ctx)
+}
+
+// Delete deletes the documents of the table by their primary keys.
+func (c *PostgresClient) Delete(ctx context.Context, tableName string, ids []string) (int64, error) {
+	sql := fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1)", tableName, DefaultPrimaryKeyColumnName)
+	tag, err := c.conn.Exec(ctx, sql, ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete documents: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DeleteWhere deletes the rows of the table matching the condition.
+func (c *PostgresClient) DeleteWhere(ctx context.Context, tableName, condition string) (int64, error) {
+	sql := fmt.Sprintf("DELETE FROM %s WHERE %s", tableName, condition)
+	tag, err := c.conn.Exec(ctx, sql)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete documents: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// CountByColumn counts the rows of the table by the values of the column.
+func (c *PostgresClient) CountByColumn(ctx context.Context, tableName, column string) (map[string]int64, error) {
+	sql := fmt.Sprintf("SELECT COALESCE(%s::text, ''), count(*) FROM %s GROUP BY 1", pgx.Identifier{column}.Sanitize(), tableName)
+	counts := map[string]int64{}
+	rows, err := c.conn.Query(ctx, sql)
+	if err == nil {
+		var (
+			value string
+			count int64
+		)
+		_, err = pgx.ForEachRow(rows, []any{&value, &count}, func() error {
+			counts[value] += count
+			return nil
+		})
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42703" { // undefined_column
+		var count int64
+		if err := c.conn.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s", tableName)).Scan(&count); err != nil {
+			return nil, err
+		}
+		return map[string]int64{"": count}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Count returns the number of rows of the table matching the filter, which
+// is a condition of WHERE like the filters of queries, all rows are counted
+// if it is empty.
+func (c *PostgresClient) Count(ctx context.Context, tableName, filter string) (int64, error) {
+	var count int64
+	if err := c.conn.QueryRow(ctx, getCountSQL(tableName, filter)).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func getCountSQL(tableName, filter string) string {
+	sql := fmt.Sprintf("SELECT count(*) FROM %s", tableName)
+	if filter != "" {
+		sql += fmt.Sprintf(" WHERE %s", filter)
+	}
+	return sql + ";"
+}
+
 // Query executes a vector query against the specified table and returns the results.
 func (c *PostgresClient) Query(ctx context.Context, query *PostgresVectorQuery) (int64, []map[string]any, error) {
 	if query == nil || query.tableName == "" {
@@ -318,6 +433,9 @@ func getQuerySQL(query *PostgresVectorQuery) (string, error) {
 	if query.filters != "" {
 		sql += fmt.Sprintf(" AND %s", query.filters)
 	}
+	if query.scoreThreshold > 0 {
+		sql += fmt.Sprintf(" AND (1-(%s%s$1)) >= %s", query.vectorKey, query.distanceAlgorithm, strconv.FormatFloat(float64(query.scoreThreshold), 'f', -1, 32))
+	}
 	sql += fmt.Sprintf(" ORDER BY score DESC LIMIT %d", query.limit)
 	if query.offset > 0 {
 		sql += fmt.Sprintf(" OFFSET %d", query.offset)
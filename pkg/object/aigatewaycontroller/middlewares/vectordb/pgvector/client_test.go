@@ -19,6 +19,7 @@ package pgvector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -26,6 +27,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
 )
 
 func skipDockerTest() bool {
@@ -152,6 +155,18 @@ func TestQuerySQL(t *testing.T) {
 			},
 			expected: "SELECT *, (1-(embedding<=>$1)) AS score FROM test_table WHERE vector_dims(embedding) = $2 AND name = 'test' ORDER BY score DESC LIMIT 10;",
 		},
+		{
+			name: "Query with score threshold",
+			query: &PostgresVectorQuery{
+				tableName:         "test_table",
+				vectorKey:         "embedding",
+				vectorValues:      []float32{0.1, 0.2, 0.3},
+				distanceAlgorithm: "<=>",
+				limit:             1,
+				scoreThreshold:    0.5,
+			},
+			expected: "SELECT *, (1-(embedding<=>$1)) AS score FROM test_table WHERE vector_dims(embedding) = $2 AND (1-(embedding<=>$1)) >= 0.5 ORDER BY score DESC LIMIT 1;",
+		},
 	}
 
 	for _, tt := range tests {
@@ -167,6 +182,82 @@ func TestQuerySQL(t *testing.T) {
 	}
 }
 
+func TestCombineFilters(t *testing.T) {
+	filters, err := combineFilters("score > 1", nil)
+	if err != nil || filters != "score > 1" {
+		t.Errorf("combineFilters() = %v, %v", filters, err)
+	}
+	filters, err = combineFilters("a = 1 OR b = 2", []*vecdbtypes.TagFilter{
+		{Field: "model", Tags: []string{"gpt-4", "o'neil"}},
+		{Field: "tenant", Tags: []string{"acme"}, Negate: true},
+	})
+	expected := `(a = 1 OR b = 2) AND "model" IN ('gpt-4', 'o''neil') AND ("tenant" IS NULL OR "tenant" NOT IN ('acme'))`
+	if err != nil || filters != expected {
+		t.Errorf("combineFilters() = %v, %v, want %v", filters, err, expected)
+	}
+	filters, err = combineFilters("", []*vecdbtypes.TagFilter{
+		{Field: "acl", Tags: []string{"hr", "finance"}, Array: true},
+		{Field: "acl", Tags: []string{"legal"}, Array: true, Negate: true},
+	})
+	expected = `"acl" && ARRAY['hr', 'finance']::text[] AND ("acl" IS NULL OR NOT "acl" && ARRAY['legal']::text[])`
+	if err != nil || filters != expected {
+		t.Errorf("combineFilters() = %v, %v, want %v", filters, err, expected)
+	}
+	_, err = combineFilters("", []*vecdbtypes.TagFilter{{Field: "model"}})
+	if !errors.Is(err, vecdbtypes.ErrInvalidFilter) {
+		t.Errorf("combineFilters() error = %v, want ErrInvalidFilter", err)
+	}
+}
+
+func TestCountSQL(t *testing.T) {
+	expected := "SELECT count(*) FROM docs;"
+	if sql := getCountSQL("docs", ""); sql != expected {
+		t.Errorf("getCountSQL() = %v, want %v", sql, expected)
+	}
+	expected = "SELECT count(*) FROM docs WHERE model = 'gpt-4o';"
+	if sql := getCountSQL("docs", "model = 'gpt-4o'"); sql != expected {
+		t.Errorf("getCountSQL() = %v, want %v", sql, expected)
+	}
+}
+
+func TestPayloadSQL(t *testing.T) {
+	table := getPayloadTableName("test_table")
+	if table != "test_table_payloads" {
+		t.Errorf("getPayloadTableName() = %v", table)
+	}
+	expected := "CREATE TABLE IF NOT EXISTS test_table_payloads (hash text PRIMARY KEY, content text NOT NULL, refs bigint NOT NULL DEFAULT 0);"
+	if sql := getCreatePayloadTableSQL(table); sql != expected {
+		t.Errorf("getCreatePayloadTableSQL() = %v, want %v", sql, expected)
+	}
+	expected = "INSERT INTO test_table_payloads (hash, content, refs) VALUES ($1, $2, 1) ON CONFLICT (hash) DO UPDATE SET refs = test_table_payloads.refs + 1;"
+	if sql := getPutPayloadSQL(table); sql != expected {
+		t.Errorf("getPutPayloadSQL() = %v, want %v", sql, expected)
+	}
+	expected = "UPDATE test_table_payloads SET refs = refs - 1 WHERE hash = $1;"
+	if sql := getReleasePayloadSQL(table); sql != expected {
+		t.Errorf("getReleasePayloadSQL() = %v, want %v", sql, expected)
+	}
+	expected = "DELETE FROM test_table WHERE id = ANY($1) RETURNING content::text, title::text;"
+	if sql := getDeleteReturningSQL("test_table", "id = ANY($1)", []string{"content", "title"}); sql != expected {
+		t.Errorf("getDeleteReturningSQL() = %v, want %v", sql, expected)
+	}
+}
+
+func TestScrubSQL(t *testing.T) {
+	expected := "SELECT id::text, embedding::real[], title::real[] FROM docs WHERE id::text > $1 ORDER BY id::text LIMIT 100;"
+	if sql := getScrubBatchSQL("docs", []string{"embedding", "title"}); sql != expected {
+		t.Errorf("getScrubBatchSQL() = %v, want %v", sql, expected)
+	}
+	expected = "CREATE TABLE IF NOT EXISTS docs_quarantine (LIKE docs);"
+	if sql := getCreateQuarantineTableSQL("docs"); sql != expected {
+		t.Errorf("getCreateQuarantineTableSQL() = %v, want %v", sql, expected)
+	}
+	expected = "WITH moved AS (DELETE FROM docs WHERE id::text = ANY($1) RETURNING *) INSERT INTO docs_quarantine SELECT * FROM moved;"
+	if sql := getQuarantineSQL("docs"); sql != expected {
+		t.Errorf("getQuarantineSQL() = %v, want %v", sql, expected)
+	}
+}
+
 func TestPostgresClient(t *testing.T) {
 	if skipDockerTest() {
 		return
@@ -17,6 +17,15 @@
 
 package pgvector
 
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
 type ErrCreatePostgresClient struct {
 	Message string
 	Err     error
@@ -34,6 +43,10 @@ func (e *ErrCreatePostgresClient) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrCreatePostgresClient) Unwrap() error {
+	return e.Err
+}
+
 type ErrEnableVectorExtension struct {
 	Message string
 	Err     error
@@ -51,6 +64,10 @@ func (e *ErrEnableVectorExtension) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrEnableVectorExtension) Unwrap() error {
+	return e.Err
+}
+
 type ErrBeginTransaction struct {
 	Message string
 	Err     error
@@ -68,6 +85,10 @@ func (e *ErrBeginTransaction) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrBeginTransaction) Unwrap() error {
+	return e.Err
+}
+
 type ErrUnexpectedSchemaType struct {
 	Message string
 	Err     error
@@ -85,6 +106,10 @@ func (e *ErrUnexpectedSchemaType) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrUnexpectedSchemaType) Unwrap() error {
+	return e.Err
+}
+
 type ErrCreatePostgresDB struct {
 	Message string
 	Err     error
@@ -102,6 +127,10 @@ func (e *ErrCreatePostgresDB) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrCreatePostgresDB) Unwrap() error {
+	return e.Err
+}
+
 type ErrInsertDocuments struct {
 	Message string
 	Err     error
@@ -118,3 +147,75 @@ func NewErrInsertDocuments(message string, err error) *ErrInsertDocuments {
 func (e *ErrInsertDocuments) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
+
+func (e *ErrInsertDocuments) Unwrap() error {
+	return e.Err
+}
+
+type ErrPayloadStore struct {
+	Message string
+	Err     error
+}
+
+// NewErrPayloadStore creates a new ErrPayloadStore with the given message and error.
+func NewErrPayloadStore(message string, err error) *ErrPayloadStore {
+	return &ErrPayloadStore{
+		Message: message,
+		Err:     err,
+	}
+}
+
+func (e *ErrPayloadStore) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *ErrPayloadStore) Unwrap() error {
+	return e.Err
+}
+
+// withErrorKind classifies the error of PostgreSQL by the kinds of
+// vecdbtypes, it is returned as is if its kind is unknown.
+func withErrorKind(err error) error {
+	if err == nil {
+		return nil
+	}
+	if kind := vecdbtypes.CommonErrorKind(err); kind != nil {
+		return vecdbtypes.NewError(kind, err)
+	}
+	if pgconn.Timeout(err) {
+		return vecdbtypes.NewError(vecdbtypes.ErrTimeout, err)
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return vecdbtypes.NewError(vecdbtypes.ErrUnavailable, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	var kind error
+	switch code := pgErr.Code; {
+	case code == "42P01": // undefined_table
+		kind = vecdbtypes.ErrNotFound
+	case code == "23505": // unique_violation
+		kind = vecdbtypes.ErrDocumentExists
+	case code == "57014": // query_canceled, by statement_timeout
+		kind = vecdbtypes.ErrTimeout
+	case strings.HasPrefix(code, "53"): // insufficient_resources
+		kind = vecdbtypes.ErrQuotaExceeded
+	case strings.HasPrefix(code, "08"), code == "57P01", code == "57P02", code == "57P03":
+		// connection_exception, admin_shutdown, crash_shutdown and
+		// cannot_connect_now.
+		kind = vecdbtypes.ErrUnavailable
+	case code == "22000" && strings.Contains(pgErr.Message, "dimensions"):
+		// pgvector reports "expected 3 dimensions, not 4" and "different
+		// vector dimensions 3 and 4".
+		kind = vecdbtypes.ErrDimensionMismatch
+	case code == "42601", code == "42703", code == "42883", code == "42804", code == "22P02":
+		// syntax_error, undefined_column, undefined_function,
+		// datatype_mismatch and invalid_text_representation.
+		kind = vecdbtypes.ErrInvalidFilter
+	}
+	return vecdbtypes.NewError(kind, err)
+}
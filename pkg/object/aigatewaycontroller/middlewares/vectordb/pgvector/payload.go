@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pgvector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// batchSender is a connection or a transaction sending batches.
+type batchSender interface {
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// payloadStore is the content-addressable payload store of a table, the
+// payloads are stored in a separate table keyed by their content hashes.
+type payloadStore struct {
+	client        *PostgresClient
+	connectionURL string
+	spec          *vecdbtypes.PayloadStoreSpec
+	table         string
+
+	// stop stops the sweeper when it is closed.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newPayloadStore(client *PostgresClient, connectionURL string, tableName string, spec *vecdbtypes.PayloadStoreSpec) *payloadStore {
+	return &payloadStore{
+		client:        client,
+		connectionURL: connectionURL,
+		spec:          spec,
+		table:         getPayloadTableName(tableName),
+		stop:          make(chan struct{}),
+	}
+}
+
+func getPayloadTableName(tableName string) string {
+	return tableName + "_payloads"
+}
+
+func getCreatePayloadTableSQL(table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (hash text PRIMARY KEY, content text NOT NULL, refs bigint NOT NULL DEFAULT 0);", table)
+}
+
+func getPutPayloadSQL(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (hash, content, refs) VALUES ($1, $2, 1) ON CONFLICT (hash) DO UPDATE SET refs = %s.refs + 1;", table, table)
+}
+
+func getReleasePayloadSQL(table string) string {
+	return fmt.Sprintf("UPDATE %s SET refs = refs - 1 WHERE hash = $1;", table)
+}
+
+// getDeleteReturningSQL returns the SQL deleting the rows of the table
+// matching the condition and returning their payload fields.
+func getDeleteReturningSQL(tableName, condition string, fields []string) string {
+	columns := make([]string, 0, len(fields))
+	for _, field := range fields {
+		columns = append(columns, field+"::text")
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s RETURNING %s;", tableName, condition, strings.Join(columns, ", "))
+}
+
+// createTable creates the payload table if it does not exist.
+func (s *payloadStore) createTable(ctx context.Context, tx pgx.Tx) error {
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", CreateTableLockID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, getCreatePayloadTableSQL(s.table)); err != nil {
+		return fmt.Errorf("failed to create table %s: %w", s.table, err)
+	}
+	return nil
+}
+
+// put stores the payloads and increases their reference counts.
+func (s *payloadStore) put(ctx context.Context, hashes []string, contents []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	b := &pgx.Batch{}
+	sql := getPutPayloadSQL(s.table)
+	for i, hash := range hashes {
+		b.Queue(sql, hash, contents[i])
+	}
+	return s.client.conn.SendBatch(ctx, b).Close()
+}
+
+// release decreases the reference counts of the payloads by the connection
+// or the transaction, the unreferenced payloads are removed by the sweeper.
+func (s *payloadStore) release(ctx context.Context, sender batchSender, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	b := &pgx.Batch{}
+	sql := getReleasePayloadSQL(s.table)
+	for _, hash := range hashes {
+		b.Queue(sql, hash)
+	}
+	return sender.SendBatch(ctx, b).Close()
+}
+
+// deleteRows deletes the rows of the table matching the condition, and
+// releases the payloads referenced by them in the same transaction. It
+// returns the number of the deleted rows.
+func (s *payloadStore) deleteRows(ctx context.Context, tableName, condition string, args ...any) (int64, error) {
+	tx, err := s.client.conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, getDeleteReturningSQL(tableName, condition, s.spec.Fields), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete documents: %w", err)
+	}
+	var hashes []string
+	for rows.Next() {
+		values := make([]*string, len(s.spec.Fields))
+		dest := make([]any, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to delete documents: %w", err)
+		}
+		for _, value := range values {
+			if value != nil && *value != "" {
+				hashes = append(hashes, *value)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to delete documents: %w", err)
+	}
+	deleted := rows.CommandTag().RowsAffected()
+
+	if err := s.release(ctx, tx, hashes); err != nil {
+		return 0, NewErrPayloadStore("failed to release payloads", err)
+	}
+	return deleted, tx.Commit(ctx)
+}
+
+// resolve returns the content of the payloads.
+func (s *payloadStore) resolve(ctx context.Context, hashes []string) (map[string]string, error) {
+	contents := make(map[string]string, len(hashes))
+	if len(hashes) == 0 {
+		return contents, nil
+	}
+
+	rows, err := s.client.conn.Query(ctx, fmt.Sprintf("SELECT hash, content FROM %s WHERE hash = ANY($1);", s.table), hashes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash, content string
+		if err := rows.Scan(&hash, &content); err != nil {
+			return nil, err
+		}
+		contents[hash] = content
+	}
+	return contents, rows.Err()
+}
+
+// stats returns the statistics of the payload store.
+func (s *payloadStore) stats(ctx context.Context) (*vecdbtypes.PayloadStats, error) {
+	var references, payloads int64
+	sql := fmt.Sprintf("SELECT COALESCE(SUM(refs), 0), COUNT(*) FROM %s WHERE refs > 0;", s.table)
+	if err := s.client.conn.QueryRow(ctx, sql).Scan(&references, &payloads); err != nil {
+		return nil, err
+	}
+	return vecdbtypes.NewPayloadStats(references, payloads), nil
+}
+
+// sweep removes the unreferenced payloads. It uses its own connection,
+// because the connection of the handler is not safe for concurrent use.
+func (s *payloadStore) sweep(ctx context.Context) (int64, error) {
+	client, err := NewPostgresClient(ctx, s.connectionURL)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close(ctx)
+
+	tag, err := client.conn.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE refs <= 0;", s.table))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// startSweeper starts the background sweeper of the payload store, it
+// runs until the store is closed. Every handler sweeps its own table,
+// which is safe since only the unreferenced payloads are deleted.
+func (s *payloadStore) startSweeper() {
+	interval := s.spec.GetSweepInterval()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			removed, err := s.sweep(ctx)
+			cancel()
+			if err != nil {
+				logger.Errorf("failed to sweep payloads of table %s: %v", s.table, err)
+			}
+			if removed > 0 {
+				logger.Debugf("swept %d unreferenced payloads of table %s", removed, s.table)
+			}
+		}
+	}()
+}
+
+// close stops the sweeper.
+func (s *payloadStore) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
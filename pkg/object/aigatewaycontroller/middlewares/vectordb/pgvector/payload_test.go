@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pgvector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestPayloadStore(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	assert := assert.New(t)
+	ctx := context.Background()
+	postgresContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "pgvector/pgvector:pg17",
+			ExposedPorts: []string{"5432/tcp"},
+			Env: map[string]string{
+				"POSTGRES_USER":     "postgres",
+				"POSTGRES_PASSWORD": "postgres",
+			},
+			WaitingFor: wait.ForListeningPort("5432/tcp"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start Postgres container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, postgresContainer)
+	host, err := postgresContainer.Host(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get Postgres container host: %v", err)
+	}
+	port, err := postgresContainer.MappedPort(ctx, "5432")
+	if err != nil {
+		t.Fatalf("Failed to get Postgres container port: %v", err)
+	}
+	connectionString := fmt.Sprintf("postgres://postgres:postgres@%s:%s/postgres?sslmode=disable", host, port.Port())
+	client, err := NewPostgresClient(ctx, connectionString)
+	if err != nil {
+		t.Fatalf("Failed to create Postgres client: %v", err)
+	}
+	defer client.Close(ctx)
+
+	s := newPayloadStore(client, connectionString, "docs", &vecdbtypes.PayloadStoreSpec{Fields: []string{"content"}, SweepInterval: "50ms"})
+	tx, err := client.conn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	if err := s.createTable(ctx, tx); err != nil {
+		t.Fatalf("Failed to create payload table: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+	a, b := vecdbtypes.PayloadHash("a"), vecdbtypes.PayloadHash("b")
+
+	// a payload is stored once, and referenced by every field.
+	assert.Nil(s.put(ctx, []string{a, a, b}, []string{"a", "a", "b"}))
+	stats, err := s.stats(ctx)
+	assert.Nil(err)
+	assert.Equal(&vecdbtypes.PayloadStats{References: 3, Payloads: 2, DedupRatio: 1.5}, stats)
+
+	// the referenced payloads are kept by sweeps.
+	assert.Nil(s.release(ctx, client.conn, []string{a, b}))
+	removed, err := s.sweep(ctx)
+	assert.Nil(err)
+	assert.Equal(int64(1), removed)
+	contents, err := s.resolve(ctx, []string{a, b})
+	assert.Nil(err)
+	assert.Equal(map[string]string{a: "a"}, contents)
+
+	// the sweeper removes the payloads once unreferenced.
+	handler := &PostgresVectorHandler{client: client, DBName: "docs", payloads: s}
+	s.startSweeper()
+	assert.Nil(s.release(ctx, client.conn, []string{a}))
+	assert.Eventually(func() bool {
+		contents, err := s.resolve(ctx, []string{a})
+		return err == nil && len(contents) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the unreferenced payloads are kept after the handler is closed.
+	handler.Close()
+	handler.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(s.put(ctx, []string{b}, []string{"b"}))
+	assert.Nil(s.release(ctx, client.conn, []string{b}))
+	time.Sleep(200 * time.Millisecond)
+	contents, err = s.resolve(ctx, []string{b})
+	assert.Nil(err)
+	assert.Equal(map[string]string{b: "b"}, contents)
+
+	// the payloads referenced by the deleted documents are released.
+	refs := func(hash string) int64 {
+		var n int64
+		assert.Nil(client.conn.QueryRow(ctx, "SELECT refs FROM docs_payloads WHERE hash = $1;", hash).Scan(&n))
+		return n
+	}
+	_, err = client.conn.Exec(ctx, "CREATE TABLE docs (id text PRIMARY KEY, content text);")
+	assert.Nil(err)
+	assert.Nil(s.put(ctx, []string{a, a}, []string{"a", "a"}))
+	_, err = client.conn.Exec(ctx, "INSERT INTO docs VALUES ('1', $1), ('2', $1), ('3', NULL);", a)
+	assert.Nil(err)
+	deleted, err := handler.DeleteDocuments(ctx, []string{"1", "3", "4"})
+	assert.Nil(err)
+	assert.Equal(int64(2), deleted)
+	assert.Equal(int64(1), refs(a))
+	deleted, err = handler.DeleteDocuments(ctx, []string{"1", "2"})
+	assert.Nil(err)
+	assert.Equal(int64(1), deleted)
+	assert.Equal(int64(0), refs(a))
+
+	// the payloads of the rows matched by filters are released too.
+	assert.Nil(s.put(ctx, []string{a}, []string{"a"}))
+	_, err = client.conn.Exec(ctx, "INSERT INTO docs VALUES ('5', $1);", a)
+	assert.Nil(err)
+	deleted, err = handler.DeleteByFilter(ctx, &vecdbtypes.TagFilter{Field: "id", Tags: []string{"5"}})
+	assert.Nil(err)
+	assert.Equal(int64(1), deleted)
+	assert.Equal(int64(0), refs(a))
+}
@@ -18,7 +18,11 @@
 package pgvector
 
 import (
+	"fmt"
 	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
 
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
 )
@@ -35,6 +39,7 @@ type (
 		vectorValues      []float32
 		distanceAlgorithm string
 		filters           string
+		scoreThreshold    float32
 		limit             int
 		offset            int
 	}
@@ -83,6 +88,13 @@ func WithDistanceAlgorithm(algorithm string) Option {
 	}
 }
 
+// WithScoreThreshold sets the minimum score of the results for the PostgresVectorQuery.
+func WithScoreThreshold(scoreThreshold float32) Option {
+	return func(query *PostgresVectorQuery) {
+		query.scoreThreshold = scoreThreshold
+	}
+}
+
 // WithLimit sets the limit for the PostgresVectorQuery.
 func WithLimit(limit int) Option {
 	return func(query *PostgresVectorQuery) {
@@ -109,9 +121,63 @@ func toPostgresQueryOptions(options vecdbtypes.HandlerSearchOptions) ([]Option,
 		opts = append(opts, WithDistanceAlgorithm("<=>"))
 	}
 
-	if options.PostgresFilters != "" {
-		opts = append(opts, WithFilters(options.PostgresFilters))
+	tagFilters := append(slices.Clone(options.TagFilters), options.MandatoryTagFilters...)
+	filters, err := combineFilters(options.PostgresFilters, tagFilters)
+	if err != nil {
+		return nil, err
+	}
+	if filters != "" {
+		opts = append(opts, WithFilters(filters))
+	}
+
+	if options.ScoreThreshold < 0 || options.ScoreThreshold > 1 {
+		return nil, fmt.Errorf("invalid score threshold: must be between 0 and 1")
+	}
+	// an explained search returns the documents below the threshold too.
+	if !options.Explain {
+		opts = append(opts, WithScoreThreshold(options.ScoreThreshold))
 	}
 
 	return opts, nil
 }
+
+// combineFilters combines the filters conditions with the tag filters by
+// AND, the tag filters are rendered as IN lists of their columns.
+func combineFilters(filters string, tagFilters []*vecdbtypes.TagFilter) (string, error) {
+	if err := vecdbtypes.ValidateTagFilters(tagFilters); err != nil {
+		return "", vecdbtypes.NewError(vecdbtypes.ErrInvalidFilter, err)
+	}
+	parts := make([]string, 0, len(tagFilters)+1)
+	if filters != "" {
+		if len(tagFilters) == 0 {
+			return filters, nil
+		}
+		parts = append(parts, "("+filters+")")
+	}
+	for _, filter := range tagFilters {
+		parts = append(parts, renderTagFilter(filter))
+	}
+	return strings.Join(parts, " AND "), nil
+}
+
+// renderTagFilter renders a tag filter, like "model" IN ('gpt-4', 'gpt4'),
+// or "acl" && ARRAY['hr', 'finance']::text[] of an array column, the rows without the column value match a negated filter, the same as
+// the documents without the tag field in Redis.
+func renderTagFilter(filter *vecdbtypes.TagFilter) string {
+	column := pgx.Identifier{filter.Field}.Sanitize()
+	values := make([]string, len(filter.Tags))
+	for i, tag := range filter.Tags {
+		values[i] = "'" + strings.ReplaceAll(tag, "'", "''") + "'"
+	}
+	list := strings.Join(values, ", ")
+	if filter.Array {
+		if filter.Negate {
+			return fmt.Sprintf("(%s IS NULL OR NOT %s && ARRAY[%s]::text[])", column, column, list)
+		}
+		return fmt.Sprintf("%s && ARRAY[%s]::text[]", column, list)
+	}
+	if filter.Negate {
+		return fmt.Sprintf("(%s IS NULL OR %s NOT IN (%s))", column, column, list)
+	}
+	return fmt.Sprintf("%s IN (%s)", column, list)
+}
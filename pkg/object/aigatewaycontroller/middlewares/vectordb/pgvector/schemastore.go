@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pgvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// schemaTableName is the table of the inferred schemas of all tables.
+const schemaTableName = "vecdb_schemas"
+
+var _ vecdbtypes.SchemaStore = (*PostgresVectorDB)(nil)
+
+func getCreateSchemaTableSQL() string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name text PRIMARY KEY, schema text NOT NULL);", schemaTableName)
+}
+
+func getSaveSchemaSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (name, schema) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING;", schemaTableName)
+}
+
+func getLoadSchemaSQL() string {
+	return fmt.Sprintf("SELECT schema FROM %s WHERE name = $1;", schemaTableName)
+}
+
+// withClient runs fn with a client, the schemas are accessed only when the
+// table is bootstrapped, so the client is not kept.
+func (p *PostgresVectorDB) withClient(ctx context.Context, fn func(client *PostgresClient) error) error {
+	client, err := NewPostgresClient(ctx, p.Spec.ConnectionURL)
+	if err != nil {
+		return NewErrCreatePostgresClient("failed to create Postgres client", err)
+	}
+	defer client.Close(ctx)
+	if _, err := client.conn.Exec(ctx, getCreateSchemaTableSQL()); err != nil {
+		return fmt.Errorf("failed to create table %s: %w", schemaTableName, err)
+	}
+	return fn(client)
+}
+
+// LoadSchema returns the persisted schema of the table.
+func (p *PostgresVectorDB) LoadSchema(ctx context.Context, name string) (_ []byte, err error) {
+	defer func() { err = withErrorKind(err) }()
+	var schema []byte
+	err = p.withClient(ctx, func(client *PostgresClient) error {
+		return client.loadSchema(ctx, name, &schema)
+	})
+	return schema, err
+}
+
+// SaveSchema persists the schema of the table if there is none.
+func (p *PostgresVectorDB) SaveSchema(ctx context.Context, name string, schema []byte) (_ []byte, err error) {
+	defer func() { err = withErrorKind(err) }()
+	var saved []byte
+	err = p.withClient(ctx, func(client *PostgresClient) error {
+		if _, err := client.conn.Exec(ctx, getSaveSchemaSQL(), name, string(schema)); err != nil {
+			return fmt.Errorf("failed to save schema of table %s: %w", name, err)
+		}
+		return client.loadSchema(ctx, name, &saved)
+	})
+	return saved, err
+}
+
+func (c *PostgresClient) loadSchema(ctx context.Context, name string, schema *[]byte) error {
+	var data string
+	err := c.conn.QueryRow(ctx, getLoadSchemaSQL(), name).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load schema of table %s: %w", name, err)
+	}
+	*schema = []byte(data)
+	return nil
+}
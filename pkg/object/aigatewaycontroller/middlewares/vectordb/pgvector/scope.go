@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pgvector
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var _ vecdbtypes.ScopeMigrator = (*PostgresVectorDB)(nil)
+
+func getRenameTableSQL(from, to string) string {
+	return fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", from, to)
+}
+
+func getRenameSchemaSQL() string {
+	return fmt.Sprintf("UPDATE %s SET name = $2 WHERE name = $1;", schemaTableName)
+}
+
+// MigrateToScope renames the unscoped table of the scoped name, with its
+// payload table and inferred schema, in a transaction. It fails if the
+// scoped table exists, so it should be run before the scoped table is
+// created by the first write.
+func (p *PostgresVectorDB) MigrateToScope(ctx context.Context, name string) (_ *vecdbtypes.ScopeMigrationReport, err error) {
+	defer func() { err = withErrorKind(err) }()
+	scope := ""
+	if p.CommonSpec != nil {
+		scope = p.CommonSpec.Scope
+	}
+	if scope == "" {
+		return nil, fmt.Errorf("vector database of table %s is not scoped", name)
+	}
+	if !vecdbtypes.InScope(scope, name) {
+		return nil, fmt.Errorf("table %s is not in scope %s", name, scope)
+	}
+	from := vecdbtypes.UnscopedName(scope, name)
+	report := &vecdbtypes.ScopeMigrationReport{From: from, To: name}
+
+	err = p.withClient(ctx, func(client *PostgresClient) error {
+		tx, err := client.conn.Begin(ctx)
+		if err != nil {
+			return NewErrBeginTransaction("failed to begin transaction", err)
+		}
+		defer tx.Rollback(ctx)
+
+		exists, err := tableExists(ctx, tx, from)
+		if err != nil || !exists {
+			return err
+		}
+		if exists, err := tableExists(ctx, tx, name); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("table %s exists, migrate before it is created", name)
+		}
+		if err := tx.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s;", from)).Scan(&report.Moved); err != nil {
+			return fmt.Errorf("failed to count rows of table %s: %w", from, err)
+		}
+		if _, err := tx.Exec(ctx, getRenameTableSQL(from, name)); err != nil {
+			return fmt.Errorf("failed to rename table %s: %w", from, err)
+		}
+		if exists, err := tableExists(ctx, tx, getPayloadTableName(from)); err != nil {
+			return err
+		} else if exists {
+			if _, err := tx.Exec(ctx, getRenameTableSQL(getPayloadTableName(from), getPayloadTableName(name))); err != nil {
+				return fmt.Errorf("failed to rename payload table of %s: %w", from, err)
+			}
+		}
+		if _, err := tx.Exec(ctx, getRenameSchemaSQL(), from, name); err != nil {
+			return fmt.Errorf("failed to rename schema of table %s: %w", from, err)
+		}
+		return tx.Commit(ctx)
+	})
+	if err == nil {
+		logger.Infof("moved %d rows of table %s to %s", report.Moved, from, name)
+	}
+	return report, err
+}
+
+// tableExists returns whether the table exists in the search path.
+func tableExists(ctx context.Context, tx pgx.Tx, table string) (bool, error) {
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL;", table).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check table %s: %w", table, err)
+	}
+	return exists, nil
+}
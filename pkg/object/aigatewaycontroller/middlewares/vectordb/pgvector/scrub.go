@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pgvector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const scrubBatchSize = 100
+
+var _ vecdbtypes.VectorScrubber = (*PostgresVectorDB)(nil)
+
+// getQuarantineTableName returns the table the quarantined rows of the
+// table are moved to.
+func getQuarantineTableName(table string) string {
+	return table + "_quarantine"
+}
+
+func getVectorColumnsSQL() string {
+	return "SELECT attname FROM pg_attribute WHERE attrelid = to_regclass($1) AND atttypid = 'vector'::regtype AND attnum > 0 AND NOT attisdropped ORDER BY attnum;"
+}
+
+// getScrubBatchSQL returns the SQL selecting a batch of rows after the ID,
+// the vectors are cast to arrays so they are scanned without the codec of
+// the vector type.
+func getScrubBatchSQL(table string, columns []string) string {
+	selected := make([]string, 0, len(columns)+1)
+	selected = append(selected, DefaultPrimaryKeyColumnName+"::text")
+	for _, column := range columns {
+		selected = append(selected, column+"::real[]")
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s::text > $1 ORDER BY %s::text LIMIT %d;",
+		strings.Join(selected, ", "), table, DefaultPrimaryKeyColumnName, DefaultPrimaryKeyColumnName, scrubBatchSize)
+}
+
+func getCreateQuarantineTableSQL(table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s);", getQuarantineTableName(table), table)
+}
+
+func getQuarantineSQL(table string) string {
+	return fmt.Sprintf("WITH moved AS (DELETE FROM %s WHERE %s::text = ANY($1) RETURNING *) INSERT INTO %s SELECT * FROM moved;",
+		table, DefaultPrimaryKeyColumnName, getQuarantineTableName(table))
+}
+
+// ScrubVectors scans the rows of the table, and moves the ones with
+// invalid vectors to the quarantine table, which are reported.
+func (p *PostgresVectorDB) ScrubVectors(ctx context.Context, name string, dryRun bool) (_ *vecdbtypes.ScrubReport, err error) {
+	defer func() { err = withErrorKind(err) }()
+	client, err := NewPostgresClient(ctx, p.Spec.ConnectionURL)
+	if err != nil {
+		return nil, NewErrCreatePostgresClient("failed to create Postgres client", err)
+	}
+	defer client.Close(ctx)
+	return client.scrubTable(ctx, name, p.CommonSpec.VectorValidation, dryRun)
+}
+
+func (c *PostgresClient) scrubTable(ctx context.Context, table string, spec *vecdbtypes.VectorValidationSpec, dryRun bool) (*vecdbtypes.ScrubReport, error) {
+	report := &vecdbtypes.ScrubReport{
+		Collection:  table,
+		DryRun:      dryRun,
+		Quarantined: []*vecdbtypes.QuarantinedDocument{},
+	}
+	columns, err := c.vectorColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return report, nil
+	}
+
+	lastID := ""
+	for {
+		n, next, err := c.scrubBatch(ctx, table, columns, lastID, spec, report)
+		if err != nil {
+			return report, err
+		}
+		if n == 0 {
+			break
+		}
+		lastID = next
+	}
+	if dryRun || len(report.Quarantined) == 0 {
+		return report, nil
+	}
+
+	ids := make([]string, 0, len(report.Quarantined))
+	for _, doc := range report.Quarantined {
+		ids = append(ids, doc.ID)
+	}
+	if _, err := c.conn.Exec(ctx, getCreateQuarantineTableSQL(table)); err != nil {
+		return report, fmt.Errorf("failed to create table %s: %w", getQuarantineTableName(table), err)
+	}
+	if _, err := c.conn.Exec(ctx, getQuarantineSQL(table), ids); err != nil {
+		return report, fmt.Errorf("failed to quarantine rows of table %s: %w", table, err)
+	}
+	for _, doc := range report.Quarantined {
+		doc.Location = getQuarantineTableName(table)
+	}
+	return report, nil
+}
+
+// vectorColumns returns the vector columns of the table, it is empty if
+// the table does not exist.
+func (c *PostgresClient) vectorColumns(ctx context.Context, table string) ([]string, error) {
+	rows, err := c.conn.Query(ctx, getVectorColumnsSQL(), table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vector columns of table %s: %w", table, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// scrubBatch checks a batch of rows after the ID, it returns the number of
+// rows and the last ID.
+func (c *PostgresClient) scrubBatch(ctx context.Context, table string, columns []string, after string,
+	spec *vecdbtypes.VectorValidationSpec, report *vecdbtypes.ScrubReport,
+) (int, string, error) {
+	rows, err := c.conn.Query(ctx, getScrubBatchSQL(table, columns), after)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to scan table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	n, lastID := 0, after
+	for rows.Next() {
+		var id string
+		vectors := make([][]float32, len(columns))
+		dest := make([]any, 0, len(columns)+1)
+		dest = append(dest, &id)
+		for i := range vectors {
+			dest = append(dest, &vectors[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return 0, "", fmt.Errorf("failed to scan table %s: %w", table, err)
+		}
+		n++
+		lastID = id
+		report.Scanned++
+		for i, vec := range vectors {
+			if vec == nil {
+				continue
+			}
+			if _, err := vecdbtypes.CheckVector(vec, spec); err != nil {
+				report.Quarantined = append(report.Quarantined, &vecdbtypes.QuarantinedDocument{
+					ID: id, Field: columns[i], Reason: err.Reason, Positions: err.Positions,
+				})
+				break
+			}
+		}
+	}
+	return n, lastID, rows.Err()
+}
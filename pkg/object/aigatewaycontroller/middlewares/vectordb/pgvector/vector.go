@@ -19,6 +19,7 @@ package pgvector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
@@ -36,9 +37,11 @@ type (
 	}
 
 	PostgresVectorHandler struct {
-		client *PostgresClient
-		DBName string
-		schema *TableSchema
+		client     *PostgresClient
+		DBName     string
+		schema     *TableSchema
+		payloads   *payloadStore
+		validation *vecdbtypes.VectorValidationSpec
 	}
 )
 
@@ -50,7 +53,19 @@ func New(common *vecdbtypes.CommonSpec, spec *PostgresVectorDBSpec) *PostgresVec
 	}
 }
 
-func (p *PostgresVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+// Ping checks whether the Postgres server is reachable.
+func (p *PostgresVectorDB) Ping(ctx context.Context) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	client, err := NewPostgresClient(ctx, p.Spec.ConnectionURL)
+	if err != nil {
+		return NewErrCreatePostgresClient("failed to create Postgres client", err)
+	}
+	defer client.Close(ctx)
+	return client.conn.Ping(ctx)
+}
+
+func (p *PostgresVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (_ vecdbtypes.VectorHandler, err error) {
+	defer func() { err = withErrorKind(err) }()
 	clientHandler := &PostgresVectorHandler{}
 	client, err := NewPostgresClient(ctx, p.Spec.ConnectionURL)
 	if err != nil {
@@ -74,6 +89,7 @@ func (p *PostgresVectorDB) CreateSchema(ctx context.Context, options ...vecdbtyp
 
 	clientHandler.client = client
 	clientHandler.DBName = opts.DBName
+	clientHandler.validation = p.CommonSpec.VectorValidation
 
 	if !client.CheckDBExists(ctx, opts.DBName) {
 		schema, ok := opts.Schema.(*TableSchema)
@@ -87,24 +103,148 @@ func (p *PostgresVectorDB) CreateSchema(ctx context.Context, options ...vecdbtyp
 		}
 	}
 
-	return clientHandler, tx.Commit(ctx)
+	if p.CommonSpec.PayloadStore != nil {
+		clientHandler.payloads = newPayloadStore(client, p.Spec.ConnectionURL, clientHandler.DBName, p.CommonSpec.PayloadStore)
+		if err := clientHandler.payloads.createTable(ctx, tx); err != nil {
+			_ = tx.Rollback(ctx)
+			return nil, NewErrPayloadStore("failed to create payload table", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	if clientHandler.payloads != nil {
+		clientHandler.payloads.startSweeper()
+	}
+	return clientHandler, nil
 }
 
-var _ vecdbtypes.VectorHandler = (*PostgresVectorHandler)(nil)
+var (
+	_ vecdbtypes.VectorHandler        = (*PostgresVectorHandler)(nil)
+	_ vecdbtypes.PayloadStatsReporter = (*PostgresVectorHandler)(nil)
+	_ vecdbtypes.DocumentReplacer     = (*PostgresVectorHandler)(nil)
+	_ vecdbtypes.DocumentDeleter      = (*PostgresVectorHandler)(nil)
+	_ vecdbtypes.FilterDeleter        = (*PostgresVectorHandler)(nil)
+	_ vecdbtypes.HandlerCloser        = (*PostgresVectorHandler)(nil)
+	_ vecdbtypes.FieldCounter         = (*PostgresVectorDB)(nil)
+	_ vecdbtypes.DocumentCounter      = (*PostgresVectorDB)(nil)
+)
 
-func (p *PostgresVectorHandler) InsertDocuments(ctx context.Context, doc []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+// CountByField counts the rows of the table by the values of the column,
+// all rows are counted under the empty value if the column does not exist.
+func (p *PostgresVectorDB) CountByField(ctx context.Context, name, field string) (_ map[string]int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	client, err := NewPostgresClient(ctx, p.Spec.ConnectionURL)
+	if err != nil {
+		return nil, NewErrCreatePostgresClient("failed to create Postgres client", err)
+	}
+	defer client.Close(ctx)
+	return client.CountByColumn(ctx, name, field)
+}
+
+// CountDocuments counts the rows of the table matching the filter, all
+// rows are counted if it is empty.
+func (p *PostgresVectorDB) CountDocuments(ctx context.Context, name, filter string) (_ int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	client, err := NewPostgresClient(ctx, p.Spec.ConnectionURL)
+	if err != nil {
+		return 0, NewErrCreatePostgresClient("failed to create Postgres client", err)
+	}
+	defer client.Close(ctx)
+	return client.Count(ctx, name, filter)
+}
+
+// Close stops the sweeper of the payload store of the handler.
+func (p *PostgresVectorHandler) Close() {
+	if p.payloads != nil {
+		p.payloads.close()
+	}
+}
+
+// DeleteDocuments deletes the documents by their IDs. The payloads
+// referenced by the documents are released if there is a payload store.
+func (p *PostgresVectorHandler) DeleteDocuments(ctx context.Context, ids []string) (_ int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if p.payloads != nil {
+		return p.payloads.deleteRows(ctx, p.DBName, DefaultPrimaryKeyColumnName+" = ANY($1)", ids)
+	}
+	return p.client.Delete(ctx, p.DBName, ids)
+}
+
+// DeleteByFilter deletes the rows matching all the tag filters, whose
+// fields are the columns of the table. The payloads referenced by the
+// documents are released if there is a payload store.
+func (p *PostgresVectorHandler) DeleteByFilter(ctx context.Context, filters ...*vecdbtypes.TagFilter) (_ int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if len(filters) == 0 {
+		return 0, vecdbtypes.NewError(vecdbtypes.ErrInvalidFilter, errors.New("at least one filter is required"))
+	}
+	condition, err := combineFilters("", filters)
+	if err != nil {
+		return 0, err
+	}
+	if p.payloads != nil {
+		return p.payloads.deleteRows(ctx, p.DBName, condition)
+	}
+	return p.client.DeleteWhere(ctx, p.DBName, condition)
+}
+
+func (p *PostgresVectorHandler) InsertDocuments(ctx context.Context, doc []map[string]any, options ...vecdbtypes.HandlerInsertOption) (_ []string, err error) {
+	defer func() { err = withErrorKind(err) }()
 	if doc == nil || len(doc) == 0 {
 		doc = []map[string]any{}
 	}
 
+	doc, err = vecdbtypes.ValidateDocumentVectors(doc, p.validation)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	if p.payloads != nil {
+		var contents []string
+		doc, hashes, contents = vecdbtypes.ExtractPayloads(doc, p.payloads.spec.Fields)
+		if err := p.payloads.put(ctx, hashes, contents); err != nil {
+			return nil, NewErrPayloadStore("failed to store payloads", err)
+		}
+	}
+
 	docIDs, err := p.client.InsertWithVector(ctx, p.DBName, doc)
 	if err != nil {
+		if p.payloads != nil {
+			if releaseErr := p.payloads.release(ctx, p.client.conn, hashes); releaseErr != nil {
+				err = errors.Join(err, releaseErr)
+			}
+		}
 		return nil, NewErrInsertDocuments("failed to insert documents", err)
 	}
 	return docIDs, nil
 }
 
-func (p *PostgresVectorHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+// ReplaceDocuments replaces the documents of the group in a transaction,
+// the field must be a column of the table.
+func (p *PostgresVectorHandler) ReplaceDocuments(ctx context.Context, field, group string, docs []map[string]any) (_ []string, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if p.payloads != nil {
+		return nil, NewErrInsertDocuments("failed to replace documents", fmt.Errorf("%w with payload store", vecdbtypes.ErrReplaceNotSupported))
+	}
+	docs, err = vecdbtypes.ValidateDocumentVectors(docs, p.validation)
+	if err != nil {
+		return nil, err
+	}
+	docIDs, err := p.client.ReplaceGroup(ctx, p.DBName, field, group, docs)
+	if err != nil {
+		return nil, NewErrInsertDocuments("failed to replace documents", err)
+	}
+	return docIDs, nil
+}
+
+func (p *PostgresVectorHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) (_ []map[string]any, err error) {
+	defer func() { err = withErrorKind(err) }()
 	opts := &vecdbtypes.HandlerSearchOptions{}
 	for _, opt := range options {
 		opt(opts)
@@ -115,9 +255,48 @@ func (p *PostgresVectorHandler) SimilaritySearch(ctx context.Context, options ..
 		return nil, err
 	}
 
-	query := NewPostgresVectorQuery(p.DBName, opts.PostgresFilters, opts.PostgresVectorFilterValues, searchOpts...)
+	query := NewPostgresVectorQuery(p.DBName, opts.PostgresVectorFilterKey, opts.PostgresVectorFilterValues, searchOpts...)
 	_, docs, err := p.client.Query(ctx, query)
-	return docs, err
+	if err != nil {
+		return nil, err
+	}
+
+	if p.payloads != nil {
+		fields := p.payloads.spec.Fields
+		contents, err := p.payloads.resolve(ctx, vecdbtypes.PayloadReferences(docs, fields))
+		if err != nil {
+			return nil, NewErrPayloadStore("failed to resolve payloads", err)
+		}
+		if err := vecdbtypes.ResolvePayloads(docs, fields, contents); err != nil {
+			return nil, NewErrPayloadStore("failed to resolve payloads", err)
+		}
+	}
+
+	if opts.Explain {
+		for _, doc := range docs {
+			// the score of Postgres results is 1 - distance.
+			score, err := vecdbtypes.ToFloat64(doc["score"])
+			if err != nil {
+				return nil, fmt.Errorf("failed to get score of document %v: %w", doc[DefaultPrimaryKeyColumnName], err)
+			}
+			delete(doc, "score")
+			vecdbtypes.ExplainDocument(doc, 1-score, score, opts.ScoreThreshold)
+		}
+	}
+	return docs, nil
+}
+
+// PayloadStats returns the statistics of the payload store.
+func (p *PostgresVectorHandler) PayloadStats(ctx context.Context) (_ *vecdbtypes.PayloadStats, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if p.payloads == nil {
+		return nil, NewErrPayloadStore("failed to get payload stats", fmt.Errorf("payload store of table %s is not enabled", p.DBName))
+	}
+	stats, err := p.payloads.stats(ctx)
+	if err != nil {
+		return nil, NewErrPayloadStore("failed to get payload stats", err)
+	}
+	return stats, nil
 }
 
 func ValidateSpec(spec *PostgresVectorDBSpec) error {
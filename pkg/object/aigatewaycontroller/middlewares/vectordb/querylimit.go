@@ -0,0 +1,416 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+type (
+	QueryLimitSpec = vecdbtypes.QueryLimitSpec
+
+	// wrappedHandler forwards the optional capabilities of the handler it
+	// wraps, so they are kept by the wrappers of handlers.
+	wrappedHandler struct {
+		VectorHandler
+	}
+
+	// LimitedHandler limits the similarity searches of a handler by the
+	// query limiter of its backend, writes are never limited.
+	LimitedHandler struct {
+		wrappedHandler
+		limiter  *queryLimiter
+		priority int
+	}
+
+	// queryLimiter limits the concurrent similarity searches of a backend.
+	// The handlers of all middlewares using the backend share the limiter,
+	// and the spec of the latest handler applies.
+	queryLimiter struct {
+		backend string
+
+		lock     sync.Mutex
+		spec     *QueryLimitSpec
+		inFlight [3]int
+		waiters  [3][]*queryWaiter
+		// current is the state of the smooth weighted round-robin which
+		// dispatches the freed slots to the priorities.
+		current [3]int
+	}
+
+	queryWaiter struct {
+		ready chan struct{}
+		// granted is protected by the lock of the limiter.
+		granted bool
+	}
+
+	queryLimitBypassKey struct{}
+)
+
+// ErrQueryShed means the query waited for a slot of the backend longer
+// than the max wait of the query limit, it is of the kind ErrUnavailable.
+var ErrQueryShed error = &vecdbtypes.Error{Kind: vecdbtypes.ErrUnavailable, Err: errors.New("vector database query shed")}
+
+var (
+	queryLimitersLock sync.Mutex
+	queryLimiters     = map[string]*queryLimiter{}
+
+	queryMetricsOnce sync.Once
+	queriesInFlight  *prometheus.GaugeVec
+	queryWaitSeconds *prometheus.HistogramVec
+	shedQueries      *prometheus.CounterVec
+)
+
+var queryPriorities = [3]string{
+	vecdbtypes.QueryPriorityHigh,
+	vecdbtypes.QueryPriorityMedium,
+	vecdbtypes.QueryPriorityLow,
+}
+
+var (
+	_ vecdbtypes.SchemaEnsurer    = (*LimitedHandler)(nil)
+	_ vecdbtypes.DocumentReplacer = (*LimitedHandler)(nil)
+	_ vecdbtypes.HandlerCloser    = (*LimitedHandler)(nil)
+)
+
+func initQueryMetrics() {
+	queryMetricsOnce.Do(func() {
+		queriesInFlight = metricshub.VectorDBQueriesInFlight.NewGauge()
+		queryWaitSeconds = metricshub.VectorDBQueryWaitSeconds.NewHistogram()
+		shedQueries = metricshub.VectorDBShedQueries.NewCounter()
+	})
+}
+
+// WithoutQueryLimit returns the context whose similarity searches bypass
+// the query limit, it is used by the admin probes.
+func WithoutQueryLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryLimitBypassKey{}, true)
+}
+
+func queryLimitBypassed(ctx context.Context) bool {
+	bypassed, _ := ctx.Value(queryLimitBypassKey{}).(bool)
+	return bypassed
+}
+
+// queryBackend returns the name of the backend of the spec, it contains
+// only the host of the backend so the credentials are not exposed by the
+// metrics.
+func queryBackend(spec *Spec) string {
+	raw := ""
+	switch spec.Type {
+	case TypeRedis:
+		if spec.Redis != nil {
+			raw = spec.Redis.ConnectionURL()
+			// the searches of sharded collections are limited as a whole.
+			if spec.Redis.Shards != nil && len(spec.Redis.Shards.URLs) > 0 {
+				raw = spec.Redis.Shards.URLs[0]
+			}
+		}
+	case TypePostgres:
+		if spec.Postgres != nil {
+			raw = spec.Postgres.ConnectionURL
+		}
+	}
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		return spec.Type + "://" + u.Host
+	}
+	return spec.Type
+}
+
+// NewLimitedHandler returns the handler whose similarity searches are
+// limited by the query limiter of the backend of the spec, the handler is
+// returned as is if the spec has no query limit. The priority of the spec
+// overrides the given default priority.
+func NewLimitedHandler(spec *Spec, handler VectorHandler, priority string) VectorHandler {
+	if spec.QueryLimit == nil {
+		return handler
+	}
+	initQueryMetrics()
+	if spec.QueryLimit.Priority != "" {
+		priority = spec.QueryLimit.Priority
+	}
+
+	backend := queryBackend(spec)
+	queryLimitersLock.Lock()
+	l := queryLimiters[backend]
+	if l == nil {
+		l = &queryLimiter{backend: backend}
+		queryLimiters[backend] = l
+	}
+	queryLimitersLock.Unlock()
+
+	l.setSpec(spec.QueryLimit)
+	return &LimitedHandler{wrappedHandler: wrappedHandler{handler}, limiter: l, priority: priorityIndex(priority)}
+}
+
+func priorityIndex(priority string) int {
+	for i, p := range queryPriorities {
+		if p == priority {
+			return i
+		}
+	}
+	return 1
+}
+
+// SimilaritySearch searches when a slot of the backend is available, it
+// returns ErrQueryShed if no slot is available within the max wait.
+func (h *LimitedHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	if queryLimitBypassed(ctx) {
+		return h.VectorHandler.SimilaritySearch(ctx, options...)
+	}
+	if err := h.limiter.acquire(ctx, h.priority); err != nil {
+		return nil, err
+	}
+	defer h.limiter.release(h.priority)
+	return h.VectorHandler.SimilaritySearch(ctx, options...)
+}
+
+// ReplaceDocuments replaces the documents of the group, it fails if the
+// handler does not support replacing.
+func (h *wrappedHandler) ReplaceDocuments(ctx context.Context, field, group string, docs []map[string]any) ([]string, error) {
+	replacer, ok := h.VectorHandler.(vecdbtypes.DocumentReplacer)
+	if !ok {
+		return nil, vecdbtypes.ErrReplaceNotSupported
+	}
+	return replacer.ReplaceDocuments(ctx, field, group, docs)
+}
+
+// DeleteDocuments deletes the documents, it fails if the handler does not
+// support deleting.
+func (h *wrappedHandler) DeleteDocuments(ctx context.Context, ids []string) (int64, error) {
+	deleter, ok := h.VectorHandler.(vecdbtypes.DocumentDeleter)
+	if !ok {
+		return 0, vecdbtypes.ErrDeleteNotSupported
+	}
+	return deleter.DeleteDocuments(ctx, ids)
+}
+
+// DeleteByFilter deletes the documents matching the filters, it fails if
+// the handler does not support deleting by filters.
+func (h *wrappedHandler) DeleteByFilter(ctx context.Context, filters ...*vecdbtypes.TagFilter) (int64, error) {
+	deleter, ok := h.VectorHandler.(vecdbtypes.FilterDeleter)
+	if !ok {
+		return 0, vecdbtypes.ErrDeleteNotSupported
+	}
+	return deleter.DeleteByFilter(ctx, filters...)
+}
+
+// Now returns the current time of the database, it fails if the handler
+// does not support tiering.
+func (h *wrappedHandler) Now(ctx context.Context) (time.Time, error) {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return time.Time{}, vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.Now(ctx)
+}
+
+// TouchDocuments records the documents are hit, it fails if the handler
+// does not support tiering.
+func (h *wrappedHandler) TouchDocuments(ctx context.Context, ids []string, at time.Time) error {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.TouchDocuments(ctx, ids, at)
+}
+
+// ClaimIdleDocuments claims the documents not hit since the time, it fails
+// if the handler does not support tiering.
+func (h *wrappedHandler) ClaimIdleDocuments(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return nil, vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.ClaimIdleDocuments(ctx, since, limit)
+}
+
+// GetDocumentFields returns the fields of the document, it fails if the
+// handler does not support tiering.
+func (h *wrappedHandler) GetDocumentFields(ctx context.Context, id string, fields []string) (map[string]string, error) {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return nil, vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.GetDocumentFields(ctx, id, fields)
+}
+
+// SetDocumentFields sets the fields of the document, it fails if the
+// handler does not support tiering.
+func (h *wrappedHandler) SetDocumentFields(ctx context.Context, id string, fields map[string]string) error {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.SetDocumentFields(ctx, id, fields)
+}
+
+// EnsureSchema ensures the collection of the handler exists.
+func (h *wrappedHandler) EnsureSchema(ctx context.Context) error {
+	if ensurer, ok := h.VectorHandler.(vecdbtypes.SchemaEnsurer); ok {
+		return ensurer.EnsureSchema(ctx)
+	}
+	return nil
+}
+
+// Close closes the handler, if it runs background jobs.
+func (h *wrappedHandler) Close() {
+	if closer, ok := h.VectorHandler.(vecdbtypes.HandlerCloser); ok {
+		closer.Close()
+	}
+}
+
+func (l *queryLimiter) setSpec(spec *QueryLimitSpec) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.spec = spec
+	// the new spec may allow more queries.
+	l.dispatch()
+}
+
+// setInFlight updates the in-flight metric, the lock must be held.
+func (l *queryLimiter) setInFlight(priority int) {
+	if queriesInFlight != nil {
+		queriesInFlight.With(prometheus.Labels{
+			"backend":  l.backend,
+			"priority": queryPriorities[priority],
+		}).Set(float64(l.inFlight[priority]))
+	}
+}
+
+func (l *queryLimiter) observe(priority int, wait time.Duration, shed bool) {
+	labels := prometheus.Labels{"backend": l.backend, "priority": queryPriorities[priority]}
+	if queryWaitSeconds != nil {
+		queryWaitSeconds.With(labels).Observe(wait.Seconds())
+	}
+	if shed && shedQueries != nil {
+		shedQueries.With(labels).Inc()
+	}
+}
+
+// total returns the number of in-flight queries, the lock must be held.
+func (l *queryLimiter) total() int {
+	return l.inFlight[0] + l.inFlight[1] + l.inFlight[2]
+}
+
+// waiting returns whether any query is waiting, the lock must be held.
+func (l *queryLimiter) waiting() bool {
+	return len(l.waiters[0])+len(l.waiters[1])+len(l.waiters[2]) > 0
+}
+
+// acquire waits for a slot of the backend. The query gets a slot at once
+// if the backend is not saturated and no query is waiting, otherwise it
+// waits in the queue of its priority.
+func (l *queryLimiter) acquire(ctx context.Context, priority int) error {
+	l.lock.Lock()
+	if l.total() < l.spec.MaxConcurrency && !l.waiting() {
+		l.inFlight[priority]++
+		l.setInFlight(priority)
+		l.lock.Unlock()
+		l.observe(priority, 0, false)
+		return nil
+	}
+	w := &queryWaiter{ready: make(chan struct{})}
+	l.waiters[priority] = append(l.waiters[priority], w)
+	maxWait := l.spec.GetMaxWait()
+	l.lock.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		l.observe(priority, time.Since(start), false)
+		return nil
+	case <-timer.C:
+		err = ErrQueryShed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.lock.Lock()
+	if w.granted {
+		// the slot is granted while timing out, use it.
+		l.lock.Unlock()
+		l.observe(priority, time.Since(start), false)
+		return nil
+	}
+	l.remove(priority, w)
+	l.lock.Unlock()
+	l.observe(priority, time.Since(start), err == ErrQueryShed)
+	return err
+}
+
+// remove removes the waiter from the queue, the lock must be held.
+func (l *queryLimiter) remove(priority int, w *queryWaiter) {
+	waiters := l.waiters[priority]
+	for i := range waiters {
+		if waiters[i] == w {
+			l.waiters[priority] = append(waiters[:i], waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *queryLimiter) release(priority int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inFlight[priority]--
+	l.setInFlight(priority)
+	l.dispatch()
+}
+
+// dispatch gives the free slots to the waiting queries, the priority of
+// each slot is chosen by the smooth weighted round-robin among the
+// priorities having waiting queries. The lock must be held.
+func (l *queryLimiter) dispatch() {
+	weights := l.spec.GetWeights()
+	for l.total() < l.spec.MaxConcurrency && l.waiting() {
+		chosen, sum := -1, 0
+		for i := range weights {
+			if len(l.waiters[i]) == 0 {
+				continue
+			}
+			sum += weights[i]
+			l.current[i] += weights[i]
+			if chosen < 0 || l.current[i] > l.current[chosen] {
+				chosen = i
+			}
+		}
+		l.current[chosen] -= sum
+
+		w := l.waiters[chosen][0]
+		l.waiters[chosen][0] = nil
+		l.waiters[chosen] = l.waiters[chosen][1:]
+		w.granted = true
+		l.inFlight[chosen]++
+		l.setInFlight(chosen)
+		close(w.ready)
+	}
+}
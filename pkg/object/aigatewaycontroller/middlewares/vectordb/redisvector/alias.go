@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbmetrics"
+)
+
+// aliasesKey is the hash of the aliases created by the client, from alias
+// to index. Redis does not list the aliases of an index, so it is used to
+// remove them before dropping the index.
+const aliasesKey = "aliases"
+
+type (
+	// IndexOption configures CreateIndexIfNotExists.
+	IndexOption func(*indexOptions)
+
+	indexOptions struct {
+		alias string
+	}
+)
+
+// WithIndexAlias creates the index as a concrete index behind the alias.
+// The documents of the index are the ones of the alias, so an index of a
+// new version covers the same documents and can be swapped in by SwapAlias
+// once it is built. The alias is added if it does not exist, an existing
+// alias is left pointing to its index.
+func WithIndexAlias(alias string) IndexOption {
+	return func(o *indexOptions) {
+		o.alias = alias
+	}
+}
+
+// VersionedIndexName returns the name of the concrete index of the version
+// behind the alias.
+func VersionedIndexName(alias string, version int) string {
+	return fmt.Sprintf("%s_v%d", alias, version)
+}
+
+func isAliasExistsError(err error) bool {
+	redisErr, ok := rueidis.IsRedisErr(err)
+	return ok && strings.Contains(strings.ToLower(redisErr.Error()), "alias already exists")
+}
+
+func isUnknownAliasError(err error) bool {
+	redisErr, ok := rueidis.IsRedisErr(err)
+	if !ok {
+		return false
+	}
+	msg := strings.ToLower(redisErr.Error())
+	return strings.Contains(msg, "alias does not exist") || strings.Contains(msg, "unknown index name")
+}
+
+// CreateAlias adds the alias of the index, it fails if the alias exists.
+func (c *RedisClient) CreateAlias(ctx context.Context, alias, index string) (err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationAdmin, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	defer done(&err)
+	if alias == "" || index == "" {
+		return errors.New("empty alias or index name")
+	}
+	if err := c.client.Do(ctx, c.client.B().FtAliasadd().Alias(alias).Index(index).Build()).Error(); err != nil {
+		return classifyError("failed to add alias", err)
+	}
+	return c.recordAlias(ctx, alias, index)
+}
+
+// SwapAlias points the alias to the new index atomically, the alias is
+// added if it does not exist. Queries through the alias are served by the
+// new index right after, so it should be built before swapping.
+func (c *RedisClient) SwapAlias(ctx context.Context, alias, newIndex string) (err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationAdmin, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	defer done(&err)
+	if alias == "" || newIndex == "" {
+		return errors.New("empty alias or index name")
+	}
+	if err := c.client.Do(ctx, c.client.B().FtAliasupdate().Alias(alias).Index(newIndex).Build()).Error(); err != nil {
+		return classifyError("failed to swap alias", err)
+	}
+	return c.recordAlias(ctx, alias, newIndex)
+}
+
+// ResolveAlias returns the index behind the alias, the name itself if it
+// is an index.
+func (c *RedisClient) ResolveAlias(ctx context.Context, alias string) (_ string, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationAdmin, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	defer done(&err)
+	info, err := c.client.Do(ctx, c.client.B().FtInfo().Index(alias).Build()).AsMap()
+	if err != nil {
+		return "", classifyError("failed to resolve alias", err)
+	}
+	if name, ok := info["index_name"]; ok {
+		if index, err := name.ToString(); err == nil && index != "" {
+			return index, nil
+		}
+	}
+	return alias, nil
+}
+
+func (c *RedisClient) recordAlias(ctx context.Context, alias, index string) error {
+	err := c.client.Do(ctx, c.client.B().Hset().Key(aliasesKey).FieldValue().FieldValue(alias, index).Build()).Error()
+	if err != nil {
+		return fmt.Errorf("failed to record alias %s of index %s: %w", alias, index, err)
+	}
+	return nil
+}
+
+// removeAliases deletes the aliases of the index recorded by the client,
+// the aliases pointing to other indexes by now are forgotten only.
+func (c *RedisClient) removeAliases(ctx context.Context, index string) error {
+	aliases, err := c.client.Do(ctx, c.client.B().Hgetall().Key(aliasesKey).Build()).AsStrMap()
+	if err != nil {
+		return fmt.Errorf("failed to get aliases of index %s: %w", index, err)
+	}
+	for alias, target := range aliases {
+		if target != index {
+			continue
+		}
+		// the alias may be swapped by others since it is recorded.
+		if current, err := c.ResolveAlias(ctx, alias); err == nil && current == index {
+			err := c.client.Do(ctx, c.client.B().FtAliasdel().Alias(alias).Build()).Error()
+			if err != nil && !isUnknownAliasError(err) {
+				return classifyError("failed to delete alias", err)
+			}
+		}
+		c.client.Do(ctx, c.client.B().Hdel().Key(aliasesKey).Field(alias).Build())
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAliasRedis keeps the indexes and aliases of a Redis server.
+type fakeAliasRedis struct {
+	indexes  map[string]string
+	aliases  map[string]string
+	records  map[string]string
+	commands []string
+}
+
+func (f *fakeAliasRedis) handle(args []string) string {
+	cmd := strings.ToUpper(args[0])
+	if strings.HasPrefix(cmd, "FT.") {
+		f.commands = append(f.commands, strings.Join(args, " "))
+	}
+	switch cmd {
+	case "FT.INFO":
+		index := args[1]
+		if target, ok := f.aliases[index]; ok {
+			index = target
+		}
+		if _, ok := f.indexes[index]; !ok {
+			return "-Unknown index name\r\n"
+		}
+		return respIndexInfo(index, "title", "embedding:VECTOR")
+	case "FT.CREATE":
+		if _, ok := f.indexes[args[1]]; ok {
+			return "-Index already exists\r\n"
+		}
+		f.indexes[args[1]] = strings.Join(args, " ")
+		return "+OK\r\n"
+	case "FT.DROPINDEX":
+		if _, ok := f.indexes[args[1]]; !ok {
+			return "-Unknown Index name\r\n"
+		}
+		for _, index := range f.aliases {
+			if index == args[1] {
+				return "-ERR index has aliases\r\n"
+			}
+		}
+		delete(f.indexes, args[1])
+		return "+OK\r\n"
+	case "FT.ALIASADD":
+		if _, ok := f.aliases[args[1]]; ok {
+			return "-Alias already exists\r\n"
+		}
+		f.aliases[args[1]] = args[2]
+		return "+OK\r\n"
+	case "FT.ALIASUPDATE":
+		f.aliases[args[1]] = args[2]
+		return "+OK\r\n"
+	case "FT.ALIASDEL":
+		if _, ok := f.aliases[args[1]]; !ok {
+			return "-Alias does not exist\r\n"
+		}
+		delete(f.aliases, args[1])
+		return "+OK\r\n"
+	case "HSET":
+		f.records[args[2]] = args[3]
+		return ":1\r\n"
+	case "HGETALL":
+		items := []string{}
+		for k, v := range f.records {
+			items = append(items, respBulk(k), respBulk(v))
+		}
+		return respArray(items...)
+	case "HDEL":
+		delete(f.records, args[2])
+		return ":1\r\n"
+	case "HGET":
+		return "$-1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestIndexAlias(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := &fakeAliasRedis{
+		indexes: map[string]string{},
+		aliases: map[string]string{},
+		records: map[string]string{},
+	}
+	r := newFakeRedis(t, fake.handle)
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+	schema := &IndexSchema{
+		Texts:   []Text{{Name: "title"}},
+		Vectors: []Vector{{Name: "embedding", Dim: 3}},
+	}
+
+	assert.Equal("movie_v1", VersionedIndexName("movie", 1))
+
+	// the concrete index covers the documents of the alias.
+	v1 := VersionedIndexName("movie", 1)
+	assert.NoError(client.CreateIndexIfNotExists(ctx, v1, schema, WithIndexAlias("movie")))
+	assert.Contains(fake.indexes[v1], "PREFIX 1 movie: ")
+	assert.Equal(v1, fake.aliases["movie"])
+	assert.Equal(v1, fake.records["movie"])
+	index, err := client.ResolveAlias(ctx, "movie")
+	assert.NoError(err)
+	assert.Equal(v1, index)
+
+	// a new version leaves the alias to the old one until it is swapped.
+	v2 := VersionedIndexName("movie", 2)
+	assert.NoError(client.CreateIndexIfNotExists(ctx, v2, schema, WithIndexAlias("movie")))
+	assert.Contains(fake.indexes[v2], "PREFIX 1 movie: ")
+	assert.Equal(v1, fake.aliases["movie"])
+	assert.NoError(client.SwapAlias(ctx, "movie", v2))
+	assert.Equal(v2, fake.aliases["movie"])
+	assert.Equal(v2, fake.records["movie"])
+
+	// creating an existing index is a no-op.
+	fake.commands = nil
+	assert.NoError(client.CreateIndexIfNotExists(ctx, v2, schema, WithIndexAlias("movie")))
+	assert.Equal([]string{"FT.INFO movie_v2", "FT.INFO movie_v2", "FT.INFO movie"}, fake.commands)
+
+	// the alias exists.
+	err = client.CreateAlias(ctx, "movie", v1)
+	assert.ErrorContains(err, "Alias already exists")
+
+	// dropping an index without aliases.
+	assert.NoError(client.DropIndex(ctx, v1, false))
+	assert.NotContains(fake.indexes, v1)
+	assert.Equal(v2, fake.aliases["movie"])
+
+	// dropping an aliased index removes the alias first.
+	fake.commands = nil
+	assert.NoError(client.DropIndex(ctx, v2, false))
+	assert.NotContains(fake.indexes, v2)
+	assert.Empty(fake.aliases)
+	assert.Empty(fake.records)
+	assert.Equal([]string{"FT.INFO movie", "FT.ALIASDEL movie", "FT.DROPINDEX movie_v2"}, fake.commands)
+
+	// the alias swapped by others is kept.
+	assert.NoError(client.CreateIndexIfNotExists(ctx, v1, schema, WithIndexAlias("movie")))
+	assert.NoError(client.CreateIndexIfNotExists(ctx, v2, schema))
+	fake.aliases["movie"] = v2
+	assert.NoError(client.DropIndex(ctx, v1, false))
+	assert.Equal(v2, fake.aliases["movie"])
+	assert.Empty(fake.records)
+}
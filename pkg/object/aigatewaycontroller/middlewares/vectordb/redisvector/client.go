@@ -20,33 +20,245 @@ package redisvector
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"math"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/google/uuid"
 	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbmetrics"
+)
+
+const (
+	// reservedFieldPrefix namespaces the internal fields of documents, so
+	// user fields never shadow them.
+	reservedFieldPrefix = "__eg_"
+	// idField stores the ID of a document.
+	idField = reservedFieldPrefix + "id"
+	// jsonRootPath is the path of the whole JSON document.
+	jsonRootPath = "$"
+	// deleteBatchSize is the number of documents deleted in a pipeline.
+	deleteBatchSize = 500
+	// getBatchSize is the number of documents read in a pipeline.
+	getBatchSize = 500
+	// DefaultInsertChunkSize is the default number of documents inserted
+	// in a pipeline.
+	DefaultInsertChunkSize = 500
+	// defaultDeletePageSize is the number of documents searched at a time
+	// when deleting by query.
+	defaultDeletePageSize = 1000
 )
 
+// ReservedFields are the fields synthesized in search results or used as
+// document IDs by old versions, documents cannot have them unless legacy
+// fields are enabled. Fields starting with __eg_ are reserved as well.
+var ReservedFields = []string{"score", "distance", "keys"}
+
 type (
 	RedisClient struct {
 		client rueidis.Client
+		// legacyFields writes documents the way of old versions for
+		// collections containing old-style fields, see toHmsetCommand.
+		legacyFields bool
+		// indexType is how documents are stored, hashes by default.
+		indexType IndexType
+		// ttl is the time to live of inserted documents, zero means
+		// documents never expire.
+		ttl time.Duration
+		// retry retries the operations failed by transient errors, they
+		// are never retried if it is nil.
+		retry *retryPolicy
+		// vectorTypes are the data types of the vector fields of the
+		// index, the vectors of the fields not in it are encoded by their
+		// Go types.
+		vectorTypes map[string]VectorDataType
+		// recreateOnMismatch drops and creates the index again if the
+		// existing one does not match the schema, instead of failing.
+		recreateOnMismatch bool
+		// timeouts bound the operations by their kinds.
+		timeouts operationTimeouts
+		// metrics records the operations, it is nil for the clients of
+		// internal uses, like the janitor.
+		metrics *vecdbmetrics.Metrics
+		// keys is the layout of the keys of documents.
+		keys keyLayout
+		// ids decides the IDs of the documents inserted without id.
+		ids documentIDs
+		// dialect is the query dialect of the vector searches, 0 means
+		// DefaultDialect.
+		dialect int
+	}
+
+	// WriteMode is how a document is written if its key exists.
+	WriteMode string
+
+	// InsertOption configures the insertion of documents.
+	InsertOption func(*insertOptions)
+
+	insertOptions struct {
+		ttl       time.Duration
+		mode      WriteMode
+		chunkSize int
+	}
+
+	// InsertResult is the result of inserting a document, the ID is the
+	// key of the document.
+	InsertResult struct {
+		ID  string
+		Err error
+	}
+
+	// InsertManyResult is the result of inserting documents in chunks,
+	// the IDs are the keys of the documents, in the order of the documents.
+	InsertManyResult struct {
+		SucceededIDs []string
+		FailedDocs   []FailedDoc
 	}
+
+	// FailedDoc is a document failed to be inserted and its error.
+	FailedDoc struct {
+		ID  string
+		Err error
+	}
+
+	// DeleteOption configures DeleteByIDs and DeleteByQuery.
+	DeleteOption func(*deleteOptions)
+
+	deleteOptions struct {
+		pageSize int
+		payloads *payloadStore
+	}
+
+	// GetOption configures GetByIDs.
+	GetOption func(*getOptions)
+
+	getOptions struct {
+		decodeVectors bool
+	}
+)
+
+const (
+	// WriteModeMerge writes the fields of the document into the existing
+	// one, the fields not in the document are kept. It is the default.
+	WriteModeMerge WriteMode = "merge"
+	// WriteModeOverwrite replaces the existing document.
+	WriteModeOverwrite WriteMode = "overwrite"
+	// WriteModeCreateOnly fails the document with ErrDocumentExists if
+	// its key exists.
+	WriteModeCreateOnly WriteMode = "createOnly"
 )
 
+// writeDocumentScript writes the document in the write mode, and expires
+// it after the ttl in milliseconds if it is positive. ARGV[3] is the
+// command writing the document and the rest are its arguments after the
+// key. It returns 0 if the document exists in the create only mode.
+var writeDocumentScript = rueidis.NewLuaScript(`
+local key, mode, ttl = KEYS[1], ARGV[1], tonumber(ARGV[2])
+if redis.call('EXISTS', key) == 1 then
+	if mode == 'createOnly' then
+		return 0
+	end
+	if mode == 'overwrite' then
+		redis.call('DEL', key)
+	end
+end
+redis.call(ARGV[3], key, unpack(ARGV, 4))
+if ttl > 0 then
+	redis.call('PEXPIRE', key, ttl)
+end
+return 1
+`)
+
+// WithDeletePageSize sets the number of documents searched and deleted at
+// a time by DeleteByQuery.
+func WithDeletePageSize(size int) DeleteOption {
+	return func(o *deleteOptions) {
+		o.pageSize = size
+	}
+}
+
+// withPayloadRelease releases the payloads referenced by the deleted
+// documents in the payload store.
+func withPayloadRelease(payloads *payloadStore) DeleteOption {
+	return func(o *deleteOptions) {
+		o.payloads = payloads
+	}
+}
+
+// WithInsertTTL sets the time to live of the inserted documents, overriding
+// the one of the client, zero uses the one of the client.
+func WithInsertTTL(ttl time.Duration) InsertOption {
+	return func(o *insertOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithWriteMode sets how the documents are written if their keys exist,
+// WriteModeMerge by default.
+func WithWriteMode(mode WriteMode) InsertOption {
+	return func(o *insertOptions) {
+		o.mode = mode
+	}
+}
+
+// WithInsertChunkSize sets the number of documents inserted in a pipeline
+// by InsertManyWithHash, DefaultInsertChunkSize by default.
+func WithInsertChunkSize(size int) InsertOption {
+	return func(o *insertOptions) {
+		o.chunkSize = size
+	}
+}
+
+// getInsertOptions returns the options of inserting documents, the time
+// to live is the one of the client if the options have none.
+func (c *RedisClient) getInsertOptions(options ...InsertOption) (*insertOptions, error) {
+	opts := &insertOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	if opts.ttl <= 0 {
+		opts.ttl = c.ttl
+	}
+	if opts.chunkSize <= 0 {
+		opts.chunkSize = DefaultInsertChunkSize
+	}
+	switch opts.mode {
+	case "":
+		opts.mode = WriteModeMerge
+	case WriteModeMerge, WriteModeOverwrite, WriteModeCreateOnly:
+	default:
+		return nil, fmt.Errorf("invalid write mode %s", opts.mode)
+	}
+	return opts, nil
+}
+
 // NewRedisClient creates a new Redis client with the given options.
 func NewRedisClient(opt rueidis.ClientOption) (*RedisClient, error) {
 	client, err := rueidis.NewClient(opt)
 	if err != nil {
 		return nil, err
 	}
-	return &RedisClient{client: client}, nil
+	return &RedisClient{client: client, metrics: vecdbmetrics.New(vecdbmetrics.BackendRedis, withErrorKind)}, nil
 }
 
-// DropIndex drops the index with the given name.
-func (c *RedisClient) DropIndex(ctx context.Context, index string, deleteDocuments bool) error {
+// DropIndex drops the index with the given name, the aliases of the index
+// created by the client are removed first.
+func (c *RedisClient) DropIndex(ctx context.Context, index string, deleteDocuments bool) (err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationAdmin, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	defer done(&err)
+	if err := c.removeAliases(ctx, index); err != nil {
+		return err
+	}
 	if deleteDocuments {
 		return c.client.Do(ctx, c.client.B().FtDropindex().Index(index).Dd().Build()).Error()
 	}
@@ -58,120 +270,1109 @@ func (c *RedisClient) CheckIndexExists(ctx context.Context, index string) bool {
 	if index == "" {
 		return false
 	}
-	return c.client.Do(ctx, c.client.B().FtInfo().Index(index).Build()).Error() == nil
+	start := time.Now()
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	err := c.client.Do(ctx, c.client.B().FtInfo().Index(index).Build()).Error()
+	done(&err)
+	c.metrics.Observe(vecdbmetrics.OperationAdmin, start, &err)
+	return err == nil
+}
+
+// HealthCheck pings the server, and checks the indexes exist. It tells
+// whether the client is usable, so it is never retried.
+func (c *RedisClient) HealthCheck(ctx context.Context, indexes ...string) (err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationAdmin, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	defer done(&err)
+	if err := c.client.Do(ctx, c.client.B().Ping().Build()).Error(); err != nil {
+		return fmt.Errorf("failed to ping Redis: %w", err)
+	}
+	for _, index := range indexes {
+		if err := c.client.Do(ctx, c.client.B().FtInfo().Index(index).Build()).Error(); err != nil {
+			return fmt.Errorf("failed to check index %s: %w", index, err)
+		}
+	}
+	return nil
 }
 
 // CreateIndexIfNotExists creates the index with the given name if it does not exist.
-func (c *RedisClient) CreateIndexIfNotExists(ctx context.Context, index string, schema *IndexSchema) error {
+// The index is verified to be queryable with all fields of the schema after
+// creation, and it is dropped if the creation partially failed, so a later
+// attempt starts from scratch. Cluster topology errors are returned as
+// ErrRedisCluster. With WithIndexAlias, the index covers the documents of
+// the alias, and the alias is added after the index is verified. An
+// existing index must match the schema, otherwise ErrIndexSchemaMismatch
+// is returned, or the index is created again if recreateOnMismatch is set.
+func (c *RedisClient) CreateIndexIfNotExists(ctx context.Context, index string, schema *IndexSchema, opts ...IndexOption) (err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationAdmin, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	defer done(&err)
 	if index == "" {
 		return errors.New("empty index name")
 	}
+	options := &indexOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	// owner is the name the documents are stored under.
+	owner := index
+	if options.alias != "" {
+		owner = options.alias
+	}
+	prefix := c.keys.getPrefix(owner)
 
 	if c.CheckIndexExists(ctx, index) {
-		return nil
+		err := c.matchIndexSchema(ctx, index, prefix, schema)
+		if err == nil {
+			return c.ensureAlias(ctx, options.alias, index)
+		}
+		var mismatch *ErrIndexSchemaMismatch
+		if !c.recreateOnMismatch || !errors.As(err, &mismatch) {
+			return err
+		}
+		// the documents are kept, and indexed again by the new index.
+		logger.Warnf("create index %s again: %v", index, err)
+		err = c.client.Do(ctx, c.client.B().FtDropindex().Index(index).Build()).Error()
+		if err != nil && !isUnknownIndexError(err) {
+			return classifyError("failed to drop mismatched index", err)
+		}
+	}
+	if c.isDraining(ctx, owner) {
+		return NewErrIndexDraining("failed to create index", fmt.Errorf("documents of index %s are being drained", owner))
 	}
 
 	redisIndex := &Index{
 		Name:      index,
 		Schema:    schema,
-		Prefix:    []string{getPrefix(index)},
-		IndexType: "HASH",
+		Prefix:    []string{prefix},
+		IndexType: c.getIndexType(),
 	}
 
 	command := redisIndex.ToCommand()
-	return c.client.Do(ctx, c.client.B().Arbitrary(command.Commands...).Keys(command.Keys...).Args(command.Args...).Build()).Error()
+	err = c.client.Do(ctx, c.client.B().Arbitrary(command.Commands...).Keys(command.Keys...).Args(command.Args...).Build()).Error()
+	if err != nil {
+		if isIndexExistsError(err) {
+			// created by others concurrently, it is not ours to roll back.
+			if err := c.matchIndexSchema(ctx, index, prefix, schema); err != nil {
+				return err
+			}
+			return c.ensureAlias(ctx, options.alias, index)
+		}
+		c.rollbackIndex(ctx, index)
+		return classifyError("failed to create index", err)
+	}
+
+	if err := c.verifyIndex(ctx, index, schema); err != nil {
+		c.rollbackIndex(ctx, index)
+		return err
+	}
+	if err := c.ensureAlias(ctx, options.alias, index); err != nil {
+		c.rollbackIndex(ctx, index)
+		return err
+	}
+	return nil
+}
+
+// ensureAlias adds the alias of the index if the alias does not exist, it
+// does nothing for an empty alias.
+func (c *RedisClient) ensureAlias(ctx context.Context, alias, index string) error {
+	if alias == "" || c.CheckIndexExists(ctx, alias) {
+		return nil
+	}
+	err := c.CreateAlias(ctx, alias, index)
+	if err != nil && isAliasExistsError(err) {
+		// added by others concurrently.
+		return nil
+	}
+	return err
+}
+
+func isIndexExistsError(err error) bool {
+	redisErr, ok := rueidis.IsRedisErr(err)
+	return ok && strings.Contains(strings.ToLower(redisErr.Error()), "index already exists")
+}
+
+func isUnknownIndexError(err error) bool {
+	redisErr, ok := rueidis.IsRedisErr(err)
+	return ok && strings.Contains(strings.ToLower(redisErr.Error()), "unknown index name")
+}
+
+// verifyIndex checks the index is queryable and it has all fields of the schema.
+func (c *RedisClient) verifyIndex(ctx context.Context, index string, schema *IndexSchema) error {
+	info, err := c.client.Do(ctx, c.client.B().FtInfo().Index(index).Build()).AsMap()
+	if err != nil {
+		return classifyError("failed to verify index", err)
+	}
+
+	attrs, ok := info["attributes"]
+	if !ok {
+		return fmt.Errorf("index %s has no attributes", index)
+	}
+	attributes, err := attrs.ToArray()
+	if err != nil {
+		return fmt.Errorf("failed to get attributes of index %s: %w", index, err)
+	}
+	fields := map[string]struct{}{}
+	for _, attribute := range attributes {
+		for _, key := range []string{"identifier", "attribute"} {
+			if name := indexAttributeValue(&attribute, key); name != "" {
+				fields[name] = struct{}{}
+			}
+		}
+	}
+	for _, field := range schema.GetDefaultSelectedFields() {
+		if _, ok := fields[field]; !ok && !slices.Contains(schema.Stored, field) {
+			return fmt.Errorf("index %s is created without field %s", index, field)
+		}
+	}
+	return nil
+}
+
+// matchIndexSchema checks the existing index has the fields of the schema
+// in their types, and its vector fields have the dimensions and distance
+// metrics of the schema. The data types of vectors are not compared, since
+// the vectors are encoded in the types of the existing index. The index
+// must index the keys of the prefix only, otherwise the documents written
+// after changing the key prefix are never searchable.
+func (c *RedisClient) matchIndexSchema(ctx context.Context, index, prefix string, schema *IndexSchema) error {
+	info, err := c.client.Do(ctx, c.client.B().FtInfo().Index(index).Build()).AsMap()
+	if err != nil {
+		return classifyError("failed to verify index", err)
+	}
+	attrs, ok := info["attributes"]
+	if !ok {
+		return fmt.Errorf("index %s has no attributes", index)
+	}
+	attributes, err := attrs.ToArray()
+	if err != nil {
+		return fmt.Errorf("failed to get attributes of index %s: %w", index, err)
+	}
+	differences := diffIndexSchema(attributes, schema)
+	if prefixes := indexPrefixes(info); prefixes != nil && !slices.Equal(prefixes, []string{prefix}) {
+		differences = append(differences, fmt.Sprintf("key prefixes are %s instead of %s", strings.Join(prefixes, ","), prefix))
+	}
+	if len(differences) > 0 {
+		return NewErrIndexSchemaMismatch(index, differences)
+	}
+	return nil
+}
+
+// indexPrefixes returns the key prefixes in the index definition of
+// FT.INFO, it is nil if FT.INFO has no index definition.
+func indexPrefixes(info map[string]rueidis.RedisMessage) []string {
+	definition, ok := info["index_definition"]
+	if !ok {
+		return nil
+	}
+	values, err := definition.AsMap()
+	if err != nil {
+		return nil
+	}
+	prefixes, ok := values["prefixes"]
+	if !ok {
+		return nil
+	}
+	result, err := prefixes.AsStrSlice()
+	if err != nil {
+		return nil
+	}
+	return result
+}
+
+// diffIndexSchema returns the differences of the attributes of FT.INFO
+// from the schema, the fields are matched by their names, which are the
+// identifiers or the aliases of the attributes. The attributes not in the
+// schema are ignored, and so are the values missing in the attributes,
+// which are not reported by old versions of RediSearch.
+func diffIndexSchema(attributes []rueidis.RedisMessage, schema *IndexSchema) []string {
+	byName := map[string]*rueidis.RedisMessage{}
+	for i := range attributes {
+		for _, key := range []string{"identifier", "attribute"} {
+			if name := indexAttributeValue(&attributes[i], key); name != "" {
+				byName[name] = &attributes[i]
+			}
+		}
+	}
+
+	var differences []string
+	match := func(name, fieldType string) *rueidis.RedisMessage {
+		attribute, ok := byName[name]
+		if !ok {
+			differences = append(differences, fmt.Sprintf("field %s is missing", name))
+			return nil
+		}
+		if actual := indexAttributeValue(attribute, "type"); actual != fieldType {
+			differences = append(differences, fmt.Sprintf("field %s is %s instead of %s", name, actual, fieldType))
+			return nil
+		}
+		return attribute
+	}
+	for _, tag := range schema.Tags {
+		match(tag.Name, "TAG")
+	}
+	for _, text := range schema.Texts {
+		match(text.Name, "TEXT")
+	}
+	for _, numeric := range schema.Numerics {
+		match(numeric.Name, "NUMERIC")
+	}
+	for _, vector := range schema.Vectors {
+		attribute := match(vector.Name, "VECTOR")
+		if attribute == nil {
+			continue
+		}
+		if dim := indexAttributeValue(attribute, "dim"); dim != "" && dim != strconv.Itoa(vector.Dim) {
+			differences = append(differences, fmt.Sprintf("dimension of field %s is %s instead of %d", vector.Name, dim, vector.Dim))
+		}
+		metric := indexAttributeValue(attribute, "distance_metric")
+		if want := vector.DistanceMetric.orDefault(); metric != "" && !strings.EqualFold(metric, string(want)) {
+			differences = append(differences, fmt.Sprintf("distance metric of field %s is %s instead of %s", vector.Name, metric, want))
+		}
+	}
+	return differences
+}
+
+// indexAttributeValue returns the value of the key in an attribute of
+// FT.INFO. An attribute is a map in RESP3, and a list in RESP2 like
+// [identifier, title, attribute, title, type, TEXT, SORTABLE], which may
+// have flags without values. Integer values are formatted as strings.
+func indexAttributeValue(attribute *rueidis.RedisMessage, key string) string {
+	if attribute.IsMap() {
+		values, err := attribute.AsMap()
+		if err != nil {
+			return ""
+		}
+		v, ok := values[key]
+		if !ok {
+			return ""
+		}
+		return attributeString(&v)
+	}
+	values, err := attribute.ToArray()
+	if err != nil {
+		return ""
+	}
+	for i := 0; i+1 < len(values); i++ {
+		if k, _ := values[i].ToString(); k == key {
+			return attributeString(&values[i+1])
+		}
+	}
+	return ""
+}
+
+func attributeString(value *rueidis.RedisMessage) string {
+	if s, err := value.ToString(); err == nil {
+		return s
+	}
+	if n, err := value.AsInt64(); err == nil {
+		return strconv.FormatInt(n, 10)
+	}
+	return ""
 }
 
-func getPrefix(index string) string {
-	return fmt.Sprintf("%s:", index)
+// rollbackTimeout is the timeout of rolling back a failed creation of an
+// index, the context of the creation may be done already.
+const rollbackTimeout = 5 * time.Second
+
+// rollbackIndex drops the index if it exists, the documents are kept. A
+// rolled back index has no alias, since the alias is added last.
+func (c *RedisClient) rollbackIndex(ctx context.Context, index string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+	if !c.CheckIndexExists(ctx, index) {
+		return
+	}
+	if err := c.client.Do(ctx, c.client.B().FtDropindex().Index(index).Build()).Error(); err != nil {
+		logger.Errorf("failed to roll back index %s: %v", index, err)
+	}
+}
+
+func (c *RedisClient) getIndexType() IndexType {
+	if c.indexType == "" {
+		return IndexTypeHash
+	}
+	return c.indexType
+}
+
+// toWriteCommand returns the command writing the document in the way of
+// the index type of the client.
+func (c *RedisClient) toWriteCommand(prefix string, doc map[string]any) (*RedisArbitraryCommand, string, error) {
+	if c.getIndexType() == IndexTypeJSON {
+		return toJSONSetCommand(prefix, doc, c.legacyFields)
+	}
+	return toHmsetCommand(prefix, doc, c.legacyFields, c.vectorTypes)
 }
 
 // InsertWithHash inserts a single document into the index with the given name.
-func (c *RedisClient) InsertWithHash(ctx context.Context, index string, doc map[string]any) (string, error) {
-	command := toHmsetCommand(index, doc)
-	return command.Keys[0], c.client.Do(ctx, c.client.B().Arbitrary(command.Commands...).Keys(command.Keys...).Args(command.Args...).Build()).Error()
+func (c *RedisClient) InsertWithHash(ctx context.Context, index string, doc map[string]any, options ...InsertOption) (_ string, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationInsert, time.Now(), &err)
+	c.metrics.ObserveBatch(vecdbmetrics.OperationInsert, 1)
+	ctx, done := c.startOperation(ctx, operationInsert)
+	defer done(&err)
+	doc, err = c.ids.resolve(0, doc)
+	if err != nil {
+		return "", err
+	}
+	command, _, err := toHmsetCommand(c.keys.getPrefix(index), doc, c.legacyFields, c.vectorTypes)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.insertWithRetry(ctx, []*RedisArbitraryCommand{command}, options...)
+	return command.Keys[0], err
 }
 
 // InsertManyWithHash inserts multiple documents into the index with the given name.
-func (c *RedisClient) InsertManyWithHash(ctx context.Context, index string, docs []map[string]any) ([]string, error) {
-	commands := make([]rueidis.Completed, 0, len(docs))
-	docIDs := make([]string, 0, len(docs))
-	errs := make([]error, 0, len(docs))
+// The documents failed because of cluster topology changes are inserted
+// again with the same keys, so a retry never duplicates documents. So are
+// the documents failed because of transient errors by the retry policy.
+// The results are in the order of the documents, and the error is the
+// join of the errors of the documents, see InsertManyWithHashChunked.
+func (c *RedisClient) InsertManyWithHash(ctx context.Context, index string, docs []map[string]any, options ...InsertOption) (_ []*InsertResult, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationInsert, time.Now(), &err)
+	c.metrics.ObserveBatch(vecdbmetrics.OperationInsert, len(docs))
+	ctx, done := c.startOperation(ctx, operationInsert)
+	defer done(&err)
+	hmsets, err := c.toHmsetCommands(index, docs)
+	if err != nil {
+		return nil, err
+	}
+	return c.insertChunks(ctx, hmsets, options...)
+}
+
+// InsertManyWithHashChunked inserts the documents like InsertManyWithHash,
+// and reports which of them are inserted and which are failed, instead of
+// joining the errors. The documents are inserted in pipelines of chunks
+// one by one, the chunks not started before the context is done are
+// failed by the error of the context, which is returned as well. Other
+// errors are returned only if no document is inserted, like invalid
+// documents or options.
+func (c *RedisClient) InsertManyWithHashChunked(ctx context.Context, index string, docs []map[string]any, options ...InsertOption) (_ *InsertManyResult, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationInsert, time.Now(), &err)
+	c.metrics.ObserveBatch(vecdbmetrics.OperationInsert, len(docs))
+	ctx, done := c.startOperation(ctx, operationInsert)
+	defer done(&err)
+	hmsets, err := c.toHmsetCommands(index, docs)
+	if err != nil {
+		return nil, err
+	}
+	results, err := c.insertChunks(ctx, hmsets, options...)
+	if results == nil {
+		return nil, err
+	}
+	result := &InsertManyResult{}
+	for _, r := range results {
+		if r.Err != nil {
+			result.FailedDocs = append(result.FailedDocs, FailedDoc{ID: r.ID, Err: r.Err})
+		} else {
+			result.SucceededIDs = append(result.SucceededIDs, r.ID)
+		}
+	}
+	return result, ctx.Err()
+}
+
+func (c *RedisClient) toHmsetCommands(index string, docs []map[string]any) ([]*RedisArbitraryCommand, error) {
+	docs, err := c.ids.resolveAll(docs)
+	if err != nil {
+		return nil, err
+	}
+	hmsets := make([]*RedisArbitraryCommand, 0, len(docs))
+	for _, doc := range docs {
+		command, _, err := toHmsetCommand(c.keys.getPrefix(index), doc, c.legacyFields, c.vectorTypes)
+		if err != nil {
+			return nil, err
+		}
+		hmsets = append(hmsets, command)
+	}
+	return hmsets, nil
+}
+
+// insertChunks inserts the documents by insertWithRetry in chunks of the
+// chunk size of the options one by one, so a large batch never blocks
+// the connection by a huge pipeline. The documents of the chunks not
+// started before the context is done are failed by the error of the
+// context.
+func (c *RedisClient) insertChunks(ctx context.Context, hmsets []*RedisArbitraryCommand, options ...InsertOption) ([]*InsertResult, error) {
+	opts, err := c.getInsertOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*InsertResult, 0, len(hmsets))
+	for start := 0; start < len(hmsets); start += opts.chunkSize {
+		chunk := hmsets[start:min(start+opts.chunkSize, len(hmsets))]
+		if err := ctx.Err(); err != nil {
+			for _, command := range hmsets[start:] {
+				results = append(results, &InsertResult{ID: command.Keys[0], Err: err})
+			}
+			break
+		}
+		chunkResults, err := c.insertWithRetry(ctx, chunk, options...)
+		if chunkResults == nil {
+			return nil, err
+		}
+		results = append(results, chunkResults...)
+	}
+
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// InsertWithJSON inserts a single document into the index with the given
+// name as a JSON document.
+func (c *RedisClient) InsertWithJSON(ctx context.Context, index string, doc map[string]any, options ...InsertOption) (_ string, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationInsert, time.Now(), &err)
+	c.metrics.ObserveBatch(vecdbmetrics.OperationInsert, 1)
+	ctx, done := c.startOperation(ctx, operationInsert)
+	defer done(&err)
+	doc, err = c.ids.resolve(0, doc)
+	if err != nil {
+		return "", err
+	}
+	command, _, err := toJSONSetCommand(c.keys.getPrefix(index), doc, c.legacyFields)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.insertMany(ctx, []*RedisArbitraryCommand{command}, options...)
+	return command.Keys[0], err
+}
 
+// InsertManyWithJSON inserts multiple documents into the index with the
+// given name as JSON documents, failures are retried like InsertManyWithHash.
+func (c *RedisClient) InsertManyWithJSON(ctx context.Context, index string, docs []map[string]any, options ...InsertOption) (_ []*InsertResult, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationInsert, time.Now(), &err)
+	c.metrics.ObserveBatch(vecdbmetrics.OperationInsert, len(docs))
+	ctx, done := c.startOperation(ctx, operationInsert)
+	defer done(&err)
+	docs, err = c.ids.resolveAll(docs)
+	if err != nil {
+		return nil, err
+	}
+	sets := make([]*RedisArbitraryCommand, 0, len(docs))
 	for _, doc := range docs {
-		command := toHmsetCommand(index, doc)
-		docIDs = append(docIDs, command.Keys[0])
+		command, _, err := toJSONSetCommand(c.keys.getPrefix(index), doc, c.legacyFields)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, command)
+	}
+	return c.insertMany(ctx, sets, options...)
+}
+
+// insertMany executes the commands writing documents in the write mode
+// of the options, and returns the results of the documents in order, the
+// error is the join of the errors of the documents. The documents failed
+// because of cluster topology changes are written again. If the ttl is
+// positive, every document is expired after the ttl along with its write.
+func (c *RedisClient) insertMany(ctx context.Context, hmsets []*RedisArbitraryCommand, options ...InsertOption) ([]*InsertResult, error) {
+	opts, err := c.getInsertOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*InsertResult, 0, len(hmsets))
+	pending := make([]int, 0, len(hmsets))
+	for i, command := range hmsets {
+		results = append(results, &InsertResult{ID: command.Keys[0]})
+		pending = append(pending, i)
+	}
+
+retry:
+	for attempt := 1; len(pending) > 0; attempt++ {
+		commands := make([]*RedisArbitraryCommand, 0, len(pending))
+		for _, i := range pending {
+			commands = append(commands, hmsets[i])
+		}
+
+		var retries []int
+		for j, err := range c.writeDocuments(ctx, commands, opts) {
+			i := pending[j]
+			if isClusterError(err) {
+				retries = append(retries, i)
+				err = NewErrRedisCluster("failed to insert document "+hmsets[i].Keys[0], err)
+			}
+			results[i].Err = err
+		}
+		if len(retries) == 0 || attempt == maxClusterAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break retry
+		case <-time.After(clusterBackoff(attempt)):
+		}
+		pending = retries
+	}
+
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// writeDocuments executes the commands writing documents in a pipeline,
+// and returns their errors in order. The documents are merged by the
+// commands, and expired by the PEXPIRE following them. The other write
+// modes run the commands by writeDocumentScript.
+func (c *RedisClient) writeDocuments(ctx context.Context, hmsets []*RedisArbitraryCommand, opts *insertOptions) []error {
+	errs := make([]error, len(hmsets))
+	if opts.mode != WriteModeMerge {
+		execs := make([]rueidis.LuaExec, 0, len(hmsets))
+		for _, command := range hmsets {
+			args := make([]string, 0, len(command.Args)+3)
+			args = append(args, string(opts.mode), strconv.FormatInt(opts.ttl.Milliseconds(), 10), command.Commands[0])
+			execs = append(execs, rueidis.LuaExec{Keys: command.Keys[:1], Args: append(args, command.Args...)})
+		}
+		for i, res := range writeDocumentScript.ExecMulti(ctx, c.client, execs...) {
+			written, err := res.AsInt64()
+			if err == nil && written == 0 {
+				err = NewErrDocumentExists(hmsets[i].Keys[0])
+			}
+			errs[i] = err
+		}
+		return errs
+	}
+
+	// commands are recycled after execution, so build them again in
+	// every attempt.
+	step := 1
+	if opts.ttl > 0 {
+		step = 2
+	}
+	commands := make([]rueidis.Completed, 0, step*len(hmsets))
+	for _, command := range hmsets {
 		commands = append(commands, c.client.B().Arbitrary(command.Commands...).Keys(command.Keys...).Args(command.Args...).Build())
+		if opts.ttl > 0 {
+			commands = append(commands, c.client.B().Pexpire().Key(command.Keys[0]).Milliseconds(opts.ttl.Milliseconds()).Build())
+		}
+	}
+	results := c.client.DoMulti(ctx, commands...)
+	for i := range hmsets {
+		for _, res := range results[i*step : (i+1)*step] {
+			if errs[i] = res.Error(); errs[i] != nil {
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// DeleteByIDs deletes the documents of the index by their IDs, and returns
+// the number of deleted documents, IDs not existing are skipped. The keys
+// of the documents are the IDs with the prefix of the index, IDs which
+// are already keys, like the IDs returned by inserts and the IDs of
+// documents written by old versions, are used as is. Inserts reject the
+// IDs starting with the prefix, so an ID is never taken as a key. The documents are unlinked in pipelines of batches.
+func (c *RedisClient) DeleteByIDs(ctx context.Context, index string, ids []string, options ...DeleteOption) (_ int64, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationDelete, time.Now(), &err)
+	c.metrics.ObserveBatch(vecdbmetrics.OperationDelete, len(ids))
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	defer done(&err)
+	opts := &deleteOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, c.keys.documentKey(index, id))
+	}
+	return c.unlinkKeys(ctx, keys, opts)
+}
+
+// WithDecodedVectors decodes the vector fields of the documents returned
+// by GetByIDs into []float32, instead of skipping them.
+func WithDecodedVectors() GetOption {
+	return func(o *getOptions) {
+		o.decodeVectors = true
+	}
+}
+
+// GetByIDs returns the documents of the index by their IDs, in the order
+// of the IDs, and the documents not existing are nil. The keys are built
+// like DeleteByIDs, and the documents are read in pipelines of batches,
+// which are run again by the retry policy if they fail because of
+// transient errors. The fields are converted like the search results. The
+// vector fields of the schema of the client are skipped, unless they are
+// decoded by WithDecodedVectors.
+func (c *RedisClient) GetByIDs(ctx context.Context, index string, ids []string, options ...GetOption) (_ []map[string]any, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationFind, time.Now(), &err)
+	c.metrics.ObserveBatch(vecdbmetrics.OperationFind, len(ids))
+	ctx, done := c.startOperation(ctx, operationSearch)
+	defer done(&err)
+	opts := &getOptions{}
+	for _, opt := range options {
+		opt(opts)
 	}
+	isJSON := c.getIndexType() == IndexTypeJSON
 
-	result := c.client.DoMulti(ctx, commands...)
-	for _, res := range result {
-		if res.Error() != nil {
-			errs = append(errs, res.Error())
+	result := make([]map[string]any, 0, len(ids))
+	for start := 0; start < len(ids); start += getBatchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, getBatchSize)
+		commands := make(rueidis.Commands, 0, getBatchSize)
+		for _, id := range ids[start:min(start+getBatchSize, len(ids))] {
+			key := c.keys.documentKey(index, id)
+			keys = append(keys, key)
+			if isJSON {
+				commands = append(commands, c.client.B().JsonGet().Key(key).Build())
+			} else {
+				commands = append(commands, c.client.B().Hgetall().Key(key).Build())
+			}
+		}
+
+		var resps []rueidis.RedisResult
+		err := c.withRetry(ctx, func() error {
+			resps = c.client.DoMulti(ctx, commands...)
+			for _, resp := range resps {
+				if err := resp.Error(); err != nil && !rueidis.IsRedisNil(err) {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, classifyError("failed to get documents", err)
+		}
+		for i, resp := range resps {
+			doc, err := c.toDocument(keys[i], resp, isJSON, opts)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, doc)
 		}
 	}
+	return result, nil
+}
 
-	return docIDs, errors.Join(errs...)
+// toDocument converts the reply of HGETALL or JSON.GET of the key into the
+// document, it returns nil if the key does not exist.
+func (c *RedisClient) toDocument(key string, resp rueidis.RedisResult, isJSON bool, opts *getOptions) (map[string]any, error) {
+	var fields map[string]string
+	if isJSON {
+		raw, err := resp.ToString()
+		if rueidis.IsRedisNil(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get document %s: %w", key, err)
+		}
+		fields = map[string]string{jsonRootPath: raw}
+	} else {
+		var err error
+		fields, err = resp.AsStrMap()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get document %s: %w", key, err)
+		}
+		if len(fields) == 0 {
+			return nil, nil
+		}
+	}
+	docs, err := convertFTSearchResIntoMapSchema([]rueidis.FtSearchDoc{{Key: key, Doc: fields}}, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	doc := docs[0]
+	for field, dataType := range c.vectorTypes {
+		value, ok := doc[field]
+		if !ok {
+			continue
+		}
+		if !opts.decodeVectors {
+			delete(doc, field)
+			continue
+		}
+		vector, ok := decodeVector(value, dataType)
+		if !ok {
+			return nil, fmt.Errorf("invalid vector %s of document %s", field, key)
+		}
+		doc[field] = vector
+	}
+	return doc, nil
 }
 
-// Find retrieves documents from the index based on the provided query.
-func (c *RedisClient) Find(ctx context.Context, query *RedisVectorQuery) (int64, []map[string]any, error) {
+// DeleteByQuery deletes the documents of the index matching the filter,
+// which is a query of FT.SEARCH like "@model:{gpt\-4o}", and returns the
+// number of deleted documents. The matched documents are searched and
+// deleted page by page until none is left, the first page is searched
+// again after deleting a page, since the deleted documents are removed
+// from the index. If the context is done, it stops between the pages or
+// the batches of a page, the documents are deleted one by one, so the
+// index is consistent with the documents left. The payloads referenced by
+// the matched documents are read when they are unlinked, and released
+// after every batch, see withPayloadRelease.
+func (c *RedisClient) DeleteByQuery(ctx context.Context, index, filter string, options ...DeleteOption) (_ int64, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationDelete, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationAdmin)
+	defer done(&err)
+	opts := &deleteOptions{pageSize: defaultDeletePageSize}
+	for _, opt := range options {
+		opt(opts)
+	}
+	if opts.pageSize <= 0 {
+		return 0, fmt.Errorf("invalid page size %d", opts.pageSize)
+	}
+
+	var deleted int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		cmd := c.client.B().Arbitrary("FT.SEARCH").Keys(index).Args(filter,
+			"NOCONTENT", "DIALECT", "2", "LIMIT", "0", strconv.Itoa(opts.pageSize)).Build()
+		_, docs, err := c.client.Do(ctx, cmd).AsFtSearch()
+		if err != nil {
+			return deleted, classifyError("failed to search documents to delete", err)
+		}
+		if len(docs) == 0 {
+			return deleted, nil
+		}
+		keys := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		n, err := c.unlinkKeys(ctx, keys, opts)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		// the documents are not deleted, like the ones expired but still
+		// in the index, searching again would find them forever.
+		if n == 0 || len(docs) < opts.pageSize {
+			return deleted, nil
+		}
+	}
+}
+
+// unlinkKeys deletes the keys in pipelines of batches, and returns the
+// number of deleted keys. The payloads referenced by the documents are
+// released after every batch, if they are in a payload store. It stops
+// between the batches if the context is done.
+func (c *RedisClient) unlinkKeys(ctx context.Context, keys []string, opts *deleteOptions) (int64, error) {
+	var deleted int64
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		batch := keys[start:min(start+deleteBatchSize, len(keys))]
+		if opts.payloads != nil {
+			n, err := opts.payloads.unlinkDocuments(ctx, batch, c.getIndexType() == IndexTypeJSON)
+			deleted += n
+			if err != nil {
+				return deleted, classifyError("failed to delete documents", err)
+			}
+			continue
+		}
+		commands := make(rueidis.Commands, 0, len(batch))
+		for _, key := range batch {
+			commands = append(commands, c.client.B().Unlink().Key(key).Build())
+		}
+
+		var errs []error
+		for _, resp := range c.client.DoMulti(ctx, commands...) {
+			n, err := resp.AsInt64()
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			deleted += n
+		}
+		if len(errs) > 0 {
+			return deleted, classifyError("failed to delete documents", errors.Join(errs...))
+		}
+	}
+	return deleted, nil
+}
+
+// Find retrieves a page of documents from the index based on the provided
+// query, and returns the total of the query to iterate the pages. The
+// total of a range query is the number of all matches, while the total
+// of a KNN query is capped at its k, which is the end of the page unless
+// it is set by WithKNN. The search is run again by the retry policy if it
+// fails because of transient errors.
+func (c *RedisClient) Find(ctx context.Context, query *RedisVectorQuery) (_ int64, _ []map[string]any, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationFind, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationSearch)
+	defer done(&err)
 	command := query.ToCommand()
-	total, docs, err := c.client.Do(ctx, c.client.B().Arbitrary(command.Commands...).Keys(command.Keys...).Args(command.Args...).Build()).AsFtSearch()
+	logger.Debugf("search redis vector index: %s", command.Redacted())
+	var (
+		total int64
+		docs  []rueidis.FtSearchDoc
+	)
+	err = c.withRetry(ctx, func() (err error) {
+		total, docs, err = c.client.Do(ctx, c.client.B().Arbitrary(command.Commands...).Keys(command.Keys...).Args(command.Args...).Build()).AsFtSearch()
+		return err
+	})
 	if err != nil {
 		return 0, nil, err
 	}
-	return total, convertFTSearchResIntoMapSchema(docs), nil
+	result, err := convertFTSearchResIntoMapSchema(docs, query.returnFields, query.distanceMetric)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.metrics.ObserveResults(len(result))
+	return total, result, nil
+}
+
+// Count returns the number of documents of the index matching the filter,
+// which is a query of FT.SEARCH like "@model:{gpt\-4o}", all documents are
+// counted if it is empty. Only the total of the search is read, so no
+// document is returned by Redis. The errors of Redis, like the syntax
+// errors of the filter, are returned as is.
+func (c *RedisClient) Count(ctx context.Context, index, filter string) (_ int64, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationFind, time.Now(), &err)
+	ctx, done := c.startOperation(ctx, operationSearch)
+	defer done(&err)
+	if filter == "" {
+		filter = "*"
+	}
+	var total int64
+	err = c.withRetry(ctx, func() (err error) {
+		total, _, err = c.client.Do(ctx, c.client.B().Arbitrary("FT.SEARCH").Keys(index).Args(filter,
+			"NOCONTENT", "DIALECT", "2", "LIMIT", "0", "0").Build()).AsFtSearch()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// cursorDeleteTimeout is the timeout of deleting the cursor of a scan
+// terminated early, the context of the scan may be cancelled already.
+const cursorDeleteTimeout = 5 * time.Second
+
+// ScanAll reads all documents of the index in batches of batchSize by the
+// cursor of FT.AGGREGATE, so the index is read as a whole regardless of the
+// result limit of FT.SEARCH, and only a batch is held in memory at a time.
+// fn is called with every batch, and the scan stops at the first error of
+// fn or the context, the cursor is deleted then, so it is not kept by the
+// server until it is idle for long.
+func (c *RedisClient) ScanAll(ctx context.Context, index string, batchSize int, fn func([]map[string]any) error) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("invalid batch size %d", batchSize)
+	}
+	cursor, _, docs, err := c.client.Do(ctx, c.client.B().FtAggregate().Index(index).Query("*").
+		LoadAll().Withcursor().Count(int64(batchSize)).Build()).AsFtAggregateCursor()
+	if err != nil {
+		return fmt.Errorf("failed to aggregate index %s: %w", index, err)
+	}
+	defer func() {
+		if cursor != 0 {
+			c.deleteCursor(index, cursor)
+		}
+	}()
+
+	for {
+		if len(docs) > 0 {
+			result, err := convertFTAggregateRes(docs)
+			if err != nil {
+				return err
+			}
+			if err := fn(result); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		next, _, nextDocs, err := c.client.Do(ctx, c.client.B().FtCursorRead().Index(index).
+			CursorId(cursor).Count(int64(batchSize)).Build()).AsFtAggregateCursor()
+		if err != nil {
+			return fmt.Errorf("failed to read cursor %d of index %s: %w", cursor, index, err)
+		}
+		cursor, docs = next, nextDocs
+	}
+}
+
+// deleteCursor deletes the cursor of the index, the errors are logged
+// only, since the cursor is deleted by the server when it is idle anyway.
+func (c *RedisClient) deleteCursor(index string, cursor int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), cursorDeleteTimeout)
+	defer cancel()
+	if err := c.client.Do(ctx, c.client.B().FtCursorDel().Index(index).CursorId(cursor).Build()).Error(); err != nil {
+		logger.Warnf("failed to delete cursor %d of index %s: %v", cursor, index, err)
+	}
+}
+
+// convertFTAggregateRes converts the aggregation results loading all
+// fields into maps of fields like the search results. The keys are not
+// loaded, so the documents written by old versions without id fields have
+// empty IDs.
+func convertFTAggregateRes(docs []map[string]string) ([]map[string]any, error) {
+	searchDocs := make([]rueidis.FtSearchDoc, 0, len(docs))
+	for _, doc := range docs {
+		searchDocs = append(searchDocs, rueidis.FtSearchDoc{Doc: doc})
+	}
+	return convertFTSearchResIntoMapSchema(searchDocs, nil, "")
 }
 
-func convertFTSearchResIntoMapSchema(docs []rueidis.FtSearchDoc) []map[string]any {
+// convertFTSearchResIntoMapSchema converts the search results into maps
+// of fields. JSON documents are returned as a whole in the $ field, their
+// top level fields are unwrapped into the maps, so the results are the same
+// as hashes, except the values keep their JSON types. The raw distance of a
+// search result is populated in the distance field, and the similarity
+// normalized from it by the metric in the score field. With the projection
+// fields, only them and the id, the distance and the score are populated.
+func convertFTSearchResIntoMapSchema(docs []rueidis.FtSearchDoc, projection []string, metric DistanceMetric) ([]map[string]any, error) {
+	selected := func(k string) bool {
+		return !strings.HasPrefix(k, reservedFieldPrefix) && (len(projection) == 0 || slices.Contains(projection, k))
+	}
 	result := make([]map[string]any, 0, len(docs))
 	for _, doc := range docs {
 		docMap := make(map[string]any)
+		if raw, ok := doc.Doc[jsonRootPath]; ok {
+			fields := map[string]any{}
+			if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal JSON document %s: %w", doc.Key, err)
+			}
+			for k, v := range fields {
+				if k == idField {
+					docMap["id"] = v
+				} else if selected(k) {
+					docMap[k] = v
+				}
+			}
+			// the id field of old versions is the ID even if it is
+			// not projected.
+			if id, ok := fields["id"]; ok && docMap["id"] == nil {
+				docMap["id"] = id
+			}
+		}
 		for k, field := range doc.Doc {
-			if k == "distance" {
-				score, _ := strconv.ParseFloat(field, 32)
-				docMap["score"] = float32(score)
-			} else {
+			if k == jsonRootPath {
+				continue
+			}
+			if selected(k) || k == "id" {
 				docMap[k] = field
 			}
 		}
-		if _, ok := docMap["id"]; !ok {
+		// the synthesized fields override the fields of old versions.
+		if field, ok := doc.Doc[distancePlaceHolder]; ok {
+			distance, _ := strconv.ParseFloat(field, 32)
+			docMap["distance"] = float32(distance)
+			docMap["score"] = float32(metric.Similarity(distance))
+		}
+		// documents written by old versions have no idField, their IDs
+		// are the id field if any, or the keys.
+		if id, ok := doc.Doc[idField]; ok {
+			docMap["id"] = id
+		} else if _, ok := docMap["id"]; !ok {
 			docMap["id"] = doc.Key
 		}
 		result = append(result, docMap)
 	}
-	return result
+	return result, nil
+}
+
+// validateDocument checks the document has no reserved fields.
+func validateDocument(doc map[string]any) error {
+	for key := range doc {
+		if strings.HasPrefix(key, reservedFieldPrefix) {
+			return NewErrReservedField(key)
+		}
+		for _, reserved := range ReservedFields {
+			if key == reserved {
+				return NewErrReservedField(key)
+			}
+		}
+	}
+	return nil
 }
 
-func toHmsetCommand(prefix string, doc map[string]any) *RedisArbitraryCommand {
+// toHmsetCommand returns the command writing the document and the ID of
+// the document, the id field of the document is used as the ID if any,
+// otherwise a UUID is generated. The key of the document is the ID after
+// the prefix, see keyLayout. The document is never modified. The inserts
+// require or derive the IDs by the spec before, see documentIDs.
+//
+// The ID is also stored in idField, and documents with reserved fields
+// are rejected, so are the IDs starting with the prefix, see
+// ErrPrefixedID. With legacy fields, which is for collections written by
+// old versions, the document is written as is, and the keys field is used
+// as the ID if there is no id field. The vectors are encoded in the data
+// types of their fields in vectorTypes, see vectorToString.
+func toHmsetCommand(prefix string, doc map[string]any, legacy bool, vectorTypes map[string]VectorDataType) (*RedisArbitraryCommand, string, error) {
+	if !legacy {
+		if err := validateDocument(doc); err != nil {
+			return nil, "", err
+		}
+	}
+
+	id := documentID(doc, legacy)
+	if strings.HasPrefix(id, prefix) {
+		return nil, "", NewErrPrefixedID(id, prefix)
+	}
 	command := &RedisArbitraryCommand{
 		Commands: []string{"HMSET"},
+		Keys:     []string{prefix + id},
 	}
 
-	command.Args = make([]string, 0, len(doc)*2)
+	command.Args = make([]string, 0, len(doc)*2+2)
 	for key, value := range doc {
-		switch v := value.(type) {
-		case []float64:
-			command.Args = append(command.Args, key, float64VectorToString(v))
-		case []float32:
-			command.Args = append(command.Args, key, float32VectorToString(v))
-		default:
-			command.Args = append(command.Args, key, fmt.Sprintf("%v", v))
+		if vector, ok := vectorToString(value, vectorTypes[key]); ok {
+			command.Args = append(command.Args, key, vector)
+		} else {
+			command.Args = append(command.Args, key, fmt.Sprintf("%v", value))
 		}
 	}
+	if !legacy {
+		command.Args = append(command.Args, idField, id)
+	}
+	return command, id, nil
+}
 
-	if idx, ok := doc["id"]; ok {
-		command.Keys = []string{fmt.Sprintf("%s:%s", prefix, idx)}
-	} else if keys, ok := doc["keys"]; ok {
-		doc["id"] = keys
-		command.Keys = []string{fmt.Sprintf("%s:%s", prefix, keys)}
-	} else {
-		uuidx := uuid.New().String()
-		doc["id"] = uuidx
-		command.Keys = []string{fmt.Sprintf("%s:%s", prefix, uuidx)}
+// documentID returns the id field of the document if any, or the keys
+// field with legacy fields, otherwise a new UUID.
+func documentID(doc map[string]any, legacy bool) string {
+	if v, ok := doc["id"]; ok {
+		return fmt.Sprintf("%v", v)
+	}
+	if v, ok := doc["keys"]; ok && legacy {
+		return fmt.Sprintf("%v", v)
 	}
-	return command
+	return uuid.New().String()
+}
+
+// toJSONSetCommand is like toHmsetCommand, but the document is written as
+// a JSON document, whose vectors are arrays of numbers and the other fields
+// keep their structures.
+func toJSONSetCommand(prefix string, doc map[string]any, legacy bool) (*RedisArbitraryCommand, string, error) {
+	if !legacy {
+		if err := validateDocument(doc); err != nil {
+			return nil, "", err
+		}
+	}
+
+	id := documentID(doc, legacy)
+	if strings.HasPrefix(id, prefix) {
+		return nil, "", NewErrPrefixedID(id, prefix)
+	}
+	if !legacy {
+		doc = maps.Clone(doc)
+		doc[idField] = id
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal document %s: %w", id, err)
+	}
+
+	command := &RedisArbitraryCommand{
+		Commands: []string{"JSON.SET"},
+		Keys:     []string{prefix + id},
+		Args:     []string{jsonRootPath, string(data)},
+	}
+	return command, id, nil
 }
 
 func float32VectorToString(v []float32) string {
@@ -191,3 +1392,155 @@ func float64VectorToString(v []float64) string {
 	}
 	return unsafe.String(unsafe.SliceData(b), len(b))
 }
+
+// vectorToString encodes the vector of float32 or float64 in the data type,
+// it returns false if the value is not a vector. The vectors are encoded
+// by their Go types if the data type is empty or not supported, which are
+// FLOAT32 and FLOAT64 for []float32 and []float64.
+func vectorToString(value any, dataType VectorDataType) (string, bool) {
+	var v32 []float32
+	switch v := value.(type) {
+	case []float32:
+		v32 = v
+	case []float64:
+		if dataType != VectorDataTypeFloat32 && dataType != VectorDataTypeFloat16 {
+			return float64VectorToString(v), true
+		}
+		v32 = make([]float32, len(v))
+		for i, e := range v {
+			v32[i] = float32(e)
+		}
+	default:
+		return "", false
+	}
+
+	switch dataType {
+	case VectorDataTypeFloat16:
+		return float32ToFloat16Bytes(v32), true
+	case VectorDataTypeFloat64:
+		v64 := make([]float64, len(v32))
+		for i, e := range v32 {
+			v64[i] = float64(e)
+		}
+		return float64VectorToString(v64), true
+	}
+	return float32VectorToString(v32), true
+}
+
+// float32ToFloat16Bytes encodes the vector as IEEE 754 half-precision
+// floats in little endian, the values are rounded to the nearest even.
+func float32ToFloat16Bytes(v []float32) string {
+	b := make([]byte, len(v)*2)
+	for i, e := range v {
+		i := i * 2
+		binary.LittleEndian.PutUint16(b[i:i+2], float32ToFloat16(e))
+	}
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
+
+// float32ToFloat16 converts the float to half precision, the values out
+// of its range become infinities, and the tiny ones subnormals or zeros.
+func float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+
+	switch {
+	case bits>>23&0xff == 0xff:
+		// NaN keeps a bit of its payload, so it is not an infinity.
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		// the subnormal of the implicit leading bit and the mantissa.
+		mant |= 0x800000
+		shift := uint32(14 - exp)
+		half := mant >> shift
+		rem, mid := mant&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > mid || (rem == mid && half&1 == 1) {
+			half++
+		}
+		return sign | uint16(half)
+	}
+
+	half := uint32(exp)<<10 | mant>>13
+	// a carry of the rounding goes to the exponent, up to the infinity.
+	rem := mant & 0x1fff
+	if rem > 0x1000 || (rem == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return sign | uint16(half)
+}
+
+// decodeVector decodes the vector of a hash in the data type, or the array
+// of numbers of a JSON document, into []float32. It returns false if the
+// value is malformed.
+func decodeVector(value any, dataType VectorDataType) ([]float32, bool) {
+	switch v := value.(type) {
+	case []any:
+		vector := make([]float32, len(v))
+		for i, e := range v {
+			f, ok := e.(float64)
+			if !ok {
+				return nil, false
+			}
+			vector[i] = float32(f)
+		}
+		return vector, true
+	case string:
+		switch dataType {
+		case VectorDataTypeFloat16, VectorDataTypeBFloat16:
+			if len(v)%2 != 0 {
+				return nil, false
+			}
+			vector := make([]float32, len(v)/2)
+			for i := range vector {
+				h := binary.LittleEndian.Uint16([]byte(v[i*2 : i*2+2]))
+				if dataType == VectorDataTypeBFloat16 {
+					vector[i] = math.Float32frombits(uint32(h) << 16)
+				} else {
+					vector[i] = Float16ToFloat32(h)
+				}
+			}
+			return vector, true
+		case VectorDataTypeFloat64:
+			v64, ok := stringToFloat64Vector(v)
+			if !ok {
+				return nil, false
+			}
+			vector := make([]float32, len(v64))
+			for i, e := range v64 {
+				vector[i] = float32(e)
+			}
+			return vector, true
+		}
+		return stringToFloat32Vector(v)
+	}
+	return nil, false
+}
+
+// Float16ToFloat32 converts the IEEE 754 half-precision float to float32,
+// which is exact.
+func Float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+	switch exp {
+	case 0:
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
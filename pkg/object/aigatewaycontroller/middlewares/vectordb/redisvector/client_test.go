@@ -19,14 +19,23 @@ package redisvector
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/redis/rueidis"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
 )
 
 func skipDockerTest() bool {
@@ -46,10 +55,171 @@ func TestToHmsetCommands(t *testing.T) {
 		"tag":            []int{1, 2},
 	}
 
-	result := toHmsetCommand("test-prefix", data)
-	if len(result.Args) != 6 {
-		t.Errorf("Expected 6 args, got %d", len(result.Args))
+	result, id, err := toHmsetCommand("test-prefix:", data, false, nil)
+	assert.NoError(t, err)
+	// the generated ID is stored in the internal field.
+	assert.Len(t, result.Args, 8)
+	assert.Equal(t, "test-prefix:"+id, result.Keys[0])
+	assert.Equal(t, []string{idField, id}, result.Args[6:])
+	// the document is not modified.
+	assert.Len(t, data, 3)
+	assert.NotContains(t, data, "id")
+
+	result, id, err = toHmsetCommand("test-prefix:", map[string]any{"id": 1, "content": "foo"}, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", id)
+	assert.Equal(t, "test-prefix:1", result.Keys[0])
+	// the id field is kept, so indexes may filter by it.
+	assert.Len(t, result.Args, 6)
+
+	for _, field := range []string{"score", "distance", "keys", "__eg_id"} {
+		_, _, err = toHmsetCommand("test-prefix:", map[string]any{field: "x"}, false, nil)
+		var reservedErr *ErrReservedField
+		assert.ErrorAs(t, err, &reservedErr)
+		assert.Equal(t, field, reservedErr.Field)
 	}
+
+	// the key would be the prefix twice.
+	_, _, err = toHmsetCommand("test-prefix:", map[string]any{"id": "test-prefix:1"}, false, nil)
+	var prefixedErr *ErrPrefixedID
+	assert.ErrorAs(t, err, &prefixedErr)
+	assert.Equal(t, "test-prefix:1", prefixedErr.ID)
+
+	// legacy fields, the keys field is the ID and the document is written
+	// as is.
+	doc := map[string]any{"keys": "k", "score": 1}
+	result, id, err = toHmsetCommand("test-prefix:", doc, true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "k", id)
+	assert.Equal(t, "test-prefix:k", result.Keys[0])
+	assert.Len(t, result.Args, 4)
+	assert.NotContains(t, doc, "id")
+}
+
+func TestFloat16(t *testing.T) {
+	assert := assert.New(t)
+
+	for f, h := range map[float32]uint16{
+		0:                     0x0000,
+		1:                     0x3c00,
+		-2.5:                  0xc100,
+		65504:                 0x7bff,
+		1e6:                   0x7c00, // overflow to the infinity.
+		5.960464477e-8:        0x0001, // the smallest subnormal.
+		6.103515625e-5:        0x0400, // the smallest normal.
+		1e-10:                 0x0000,
+		1.0009765625:          0x3c01,
+		1.00048828125:         0x3c00, // a tie rounds to the even.
+		1.00146484375:         0x3c02,
+		float32(math.Inf(-1)): 0xfc00,
+	} {
+		assert.Equal(h, float32ToFloat16(f), "float32ToFloat16(%v)", f)
+	}
+	assert.Equal(uint16(0x7e00), float32ToFloat16(float32(math.NaN())))
+	assert.Equal(uint16(0x8000), float32ToFloat16(float32(math.Copysign(0, -1))))
+
+	// the halves are converted back exactly.
+	for _, h := range []uint16{0x0000, 0x0001, 0x03ff, 0x0400, 0x3c00, 0xc100, 0x7bff, 0x7c00, 0xfc00} {
+		assert.Equal(h, float32ToFloat16(Float16ToFloat32(h)), "Float16ToFloat32(%#x)", h)
+	}
+	assert.True(math.IsNaN(float64(Float16ToFloat32(0x7e00))))
+	assert.Equal(float32(0.333251953125), Float16ToFloat32(float32ToFloat16(1.0/3)))
+
+	assert.Equal("\x00\x3c\x00\xc1", float32ToFloat16Bytes([]float32{1, -2.5}))
+
+	// the vectors are encoded in the types of their fields.
+	command, _, err := toHmsetCommand("p:", map[string]any{
+		"id": "1", "half": []float32{1, -2.5}, "wide": []float32{1}, "float": []float64{1}, "other": []float64{1},
+	}, false, map[string]VectorDataType{"half": VectorDataTypeFloat16, "wide": VectorDataTypeFloat64, "float": VectorDataTypeFloat32})
+	assert.NoError(err)
+	args := map[string]string{}
+	for i := 0; i < len(command.Args); i += 2 {
+		args[command.Args[i]] = command.Args[i+1]
+	}
+	assert.Equal(float32ToFloat16Bytes([]float32{1, -2.5}), args["half"])
+	assert.Equal(float64VectorToString([]float64{1}), args["wide"])
+	assert.Equal(float32VectorToString([]float32{1}), args["float"])
+	assert.Equal(float64VectorToString([]float64{1}), args["other"])
+}
+
+func TestConvertFTSearchRes(t *testing.T) {
+	assert := assert.New(t)
+
+	docs, err := convertFTSearchResIntoMapSchema([]rueidis.FtSearchDoc{
+		{Key: "idx:1", Doc: map[string]string{idField: "1", distancePlaceHolder: "0.25", "distance": "user", "title": "a"}},
+		// written by old versions.
+		{Key: "idx:2", Doc: map[string]string{"id": "2", "title": "b"}},
+		{Key: "idx:3", Doc: map[string]string{"title": "c"}},
+	}, nil, "")
+	assert.NoError(err)
+	assert.Equal(map[string]any{"id": "1", "score": float32(0.75), "distance": float32(0.25), "title": "a"}, docs[0])
+	assert.Equal("2", docs[1]["id"])
+	assert.Equal("idx:3", docs[2]["id"])
+
+	// JSON documents are unwrapped.
+	docs, err = convertFTSearchResIntoMapSchema([]rueidis.FtSearchDoc{
+		{Key: "idx:4", Doc: map[string]string{distancePlaceHolder: "0.5", "$": `{"__eg_id":"4","title":"d","meta":{"tags":["x","y"]}}`}},
+	}, nil, DistanceMetricL2)
+	assert.NoError(err)
+	assert.Equal(map[string]any{
+		"id":       "4",
+		"distance": float32(0.5),
+		"score":    float32(1 / 1.5),
+		"title":    "d",
+		"meta":     map[string]any{"tags": []any{"x", "y"}},
+	}, docs[0])
+
+	// only the projected fields, the id and the score are populated.
+	docs, err = convertFTSearchResIntoMapSchema([]rueidis.FtSearchDoc{
+		{Key: "idx:4", Doc: map[string]string{distancePlaceHolder: "0.5", "$": `{"__eg_id":"4","title":"d","meta":{"tags":["x","y"]}}`}},
+		{Key: "idx:6", Doc: map[string]string{"$": `{"id":"6","title":"e","body":"large"}`}},
+		{Key: "idx:7", Doc: map[string]string{idField: "7", distancePlaceHolder: "0.1", "title": "f", "body": "large"}},
+		{Key: "idx:8", Doc: map[string]string{"id": "8", "body": "large"}},
+	}, []string{"title"}, DistanceMetricCosine)
+	assert.NoError(err)
+	assert.Equal(map[string]any{"id": "4", "distance": float32(0.5), "score": float32(0.5), "title": "d"}, docs[0])
+	assert.Equal(map[string]any{"id": "6", "title": "e"}, docs[1])
+	assert.Equal(map[string]any{"id": "7", "distance": float32(0.1), "score": float32(0.9), "title": "f"}, docs[2])
+	assert.Equal(map[string]any{"id": "8"}, docs[3])
+
+	_, err = convertFTSearchResIntoMapSchema([]rueidis.FtSearchDoc{{Key: "idx:5", Doc: map[string]string{"$": "{"}}}, nil, "")
+	assert.Error(err)
+}
+
+func TestToJSONSetCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := map[string]any{
+		"id":             1,
+		"content_vector": []float32{0.5, 0.25},
+		"meta":           map[string]any{"tags": []string{"a", "b"}},
+	}
+	command, id, err := toJSONSetCommand("test-prefix:", doc, false)
+	assert.NoError(err)
+	assert.Equal("1", id)
+	assert.Equal([]string{"JSON.SET"}, command.Commands)
+	assert.Equal([]string{"test-prefix:1"}, command.Keys)
+	assert.Equal("$", command.Args[0])
+	assert.JSONEq(`{"id":1,"content_vector":[0.5,0.25],"meta":{"tags":["a","b"]},"__eg_id":"1"}`, command.Args[1])
+	// the document is not modified.
+	assert.NotContains(doc, idField)
+
+	_, _, err = toJSONSetCommand("test-prefix:", map[string]any{"score": 1}, false)
+	var reservedErr *ErrReservedField
+	assert.ErrorAs(err, &reservedErr)
+	_, _, err = toJSONSetCommand("test-prefix:", map[string]any{"id": "test-prefix:1"}, false)
+	var prefixedErr *ErrPrefixedID
+	assert.ErrorAs(err, &prefixedErr)
+
+	// the client writes documents the way of its index type.
+	client := &RedisClient{indexType: IndexTypeJSON}
+	command, _, err = client.toWriteCommand("test-prefix:", map[string]any{"title": "a"})
+	assert.NoError(err)
+	assert.Equal([]string{"JSON.SET"}, command.Commands)
+	client.indexType = ""
+	command, _, err = client.toWriteCommand("test-prefix:", map[string]any{"title": "a"})
+	assert.NoError(err)
+	assert.Equal([]string{"HMSET"}, command.Commands)
 }
 
 func TestRedisClientIndexOperations(t *testing.T) {
@@ -159,3 +329,793 @@ func TestRedisClientIndexOperations(t *testing.T) {
 		t.Fatalf("Failed to drop index: %v", err)
 	}
 }
+
+func TestFindRangeWithFilters(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	ctx := context.Background()
+	redisC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "redis:latest",
+			ExposedPorts: []string{"6379/tcp"},
+			WaitingFor:   wait.ForLog("Ready to accept connections"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Redis container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, redisC)
+	endpoint, err := redisC.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to get Redis container endpoint: %v", err)
+	}
+	client, err := NewRedisClient(rueidis.ClientOption{InitAddress: []string{endpoint}})
+	if err != nil {
+		t.Fatalf("Failed to create Redis client: %v", err)
+	}
+	err = client.CreateIndexIfNotExists(ctx, "movie", &IndexSchema{
+		Tags:     []Tag{{Name: "genre"}},
+		Texts:    []Text{{Name: "title"}},
+		Numerics: []Numeric{{Name: "rating"}},
+		Vectors:  []Vector{{Name: "embedding", Dim: 3}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	_, err = client.InsertManyWithHash(ctx, "movie", []map[string]any{
+		{"title": "Inception", "genre": "Sci-Fi", "rating": 9, "embedding": []float32{1, 0, 0}},
+		{"title": "Interstellar", "genre": "Sci-Fi", "rating": 8, "embedding": []float32{0.9, 0.2, 0}},
+		{"title": "Sunshine", "genre": "Sci-Fi", "rating": 5, "embedding": []float32{1, 0.1, 0}},
+		{"title": "Heat", "genre": "Action", "rating": 9, "embedding": []float32{1, 0, 0}},
+		{"title": "Solaris", "genre": "Sci-Fi", "rating": 9, "embedding": []float32{0, 1, 0}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert data: %v", err)
+	}
+
+	// the range query of the threshold only matches the documents passing
+	// the tag and numeric filters too.
+	minRating := 8.0
+	n, movies, err := client.Find(ctx, NewRedisVectorQuery("movie", "", "embedding", []float32{1, 0, 0},
+		WithScoreThreshold(0.5), WithLimit(10), WithFilters(
+			&vecdbtypes.RedisQueryFilter{Field: "genre", Tags: []string{"Sci-Fi"}},
+			&vecdbtypes.RedisQueryFilter{Field: "rating", Min: &minRating},
+		)))
+	if err != nil {
+		t.Fatalf("Failed to search data: %v", err)
+	}
+	assert.Equal(t, int64(2), n)
+	titles := []string{}
+	for _, movie := range movies {
+		titles = append(titles, movie["title"].(string))
+	}
+	assert.Equal(t, []string{"Inception", "Interstellar"}, titles)
+}
+
+func TestFindPages(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	ctx := context.Background()
+	redisC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "redis:latest",
+			ExposedPorts: []string{"6379/tcp"},
+			WaitingFor:   wait.ForLog("Ready to accept connections"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Redis container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, redisC)
+	endpoint, err := redisC.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to get Redis container endpoint: %v", err)
+	}
+	client, err := NewRedisClient(rueidis.ClientOption{InitAddress: []string{endpoint}})
+	if err != nil {
+		t.Fatalf("Failed to create Redis client: %v", err)
+	}
+	err = client.CreateIndexIfNotExists(ctx, "movie", &IndexSchema{
+		Texts:   []Text{{Name: "title"}},
+		Vectors: []Vector{{Name: "embedding", Dim: 3}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	const total = 25
+	docs := make([]map[string]any, total)
+	for i := range docs {
+		docs[i] = map[string]any{"title": fmt.Sprintf("movie %d", i), "embedding": []float32{1, float32(i) / total, 0}}
+	}
+	if _, err = client.InsertManyWithHash(ctx, "movie", docs); err != nil {
+		t.Fatalf("Failed to insert data: %v", err)
+	}
+
+	// iterates the pages by the total, every document is found once.
+	iterate := func(opts ...Option) (totals []int64, titles []string) {
+		for offset := 0; offset == 0 || int64(offset) < totals[len(totals)-1]; offset += 10 {
+			query := NewRedisVectorQuery("movie", "", "embedding", []float32{1, 0, 0},
+				append([]Option{WithOffset(offset), WithLimit(10)}, opts...)...)
+			n, page, err := client.Find(ctx, query)
+			if err != nil {
+				t.Fatalf("Failed to search data: %v", err)
+			}
+			totals = append(totals, n)
+			for _, doc := range page {
+				titles = append(titles, doc["title"].(string))
+			}
+		}
+		return totals, titles
+	}
+	want := make([]string, total)
+	for i := range want {
+		want[i] = fmt.Sprintf("movie %d", i)
+	}
+
+	// the total of KNN queries of the same k is the number of all the
+	// neighbors.
+	totals, titles := iterate(WithKNN(total))
+	assert.Equal(t, []int64{total, total, total}, totals)
+	assert.ElementsMatch(t, want, titles)
+
+	// the total of range queries is the number of all matches.
+	totals, titles = iterate(WithScoreThreshold(0.5))
+	assert.Equal(t, []int64{total, total, total}, totals)
+	assert.ElementsMatch(t, want, titles)
+
+	// the k of KNN queries is the end of the page by default, which caps
+	// the total.
+	n, _, err := client.Find(ctx, NewRedisVectorQuery("movie", "", "embedding", []float32{1, 0, 0}, WithOffset(10), WithLimit(10)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), n)
+}
+
+func TestDeleteByIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	existing := map[string]bool{}
+	var unlinks []string
+	r := newFakeRedis(t, func(args []string) string {
+		if strings.ToUpper(args[0]) != "UNLINK" {
+			return "-ERR unexpected command\r\n"
+		}
+		unlinks = append(unlinks, args[1])
+		if existing[args[1]] {
+			delete(existing, args[1])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	ids := make([]string, 0, deleteBatchSize+10)
+	for i := 0; i < deleteBatchSize+10; i++ {
+		id := strconv.Itoa(i)
+		ids = append(ids, id)
+		if i%2 == 0 {
+			existing["movie:"+id] = true
+		}
+	}
+	// the IDs of old documents are their keys.
+	existing["movie:old"] = true
+	ids = append(ids, "movie:old")
+
+	deleted, err := client.DeleteByIDs(ctx, "movie", ids)
+	assert.NoError(err)
+	// IDs not existing are skipped.
+	assert.Equal(int64((deleteBatchSize+10)/2+1), deleted)
+	assert.Len(unlinks, len(ids))
+	assert.Equal("movie:0", unlinks[0])
+	assert.Equal("movie:old", unlinks[len(unlinks)-1])
+	assert.Empty(existing)
+
+	deleted, err = client.DeleteByIDs(ctx, "movie", nil)
+	assert.NoError(err)
+	assert.Zero(deleted)
+}
+
+func TestDeleteByInsertedIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	existing := map[string]bool{}
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "HMSET":
+			existing[args[1]] = true
+			return "+OK\r\n"
+		case "UNLINK":
+			if existing[args[1]] {
+				delete(existing, args[1])
+				return ":1\r\n"
+			}
+			return ":0\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	// the documents are deleted by the IDs they are inserted with, and by
+	// the keys returned by the inserts.
+	key, err := client.InsertWithHash(ctx, "movie", map[string]any{"id": "42", "title": "a"})
+	assert.NoError(err)
+	assert.Equal("movie:42", key)
+	_, err = client.InsertWithHash(ctx, "movie", map[string]any{"id": "43", "title": "b"})
+	assert.NoError(err)
+	deleted, err := client.DeleteByIDs(ctx, "movie", []string{"42", "movie:43"})
+	assert.NoError(err)
+	assert.Equal(int64(2), deleted)
+	assert.Empty(existing)
+
+	// an ID starting with the prefix is rejected, instead of being written
+	// to a key which is never deleted by the ID.
+	_, err = client.InsertWithHash(ctx, "movie", map[string]any{"id": "movie:44", "title": "c"})
+	var prefixedErr *ErrPrefixedID
+	assert.ErrorAs(err, &prefixedErr)
+	results, err := client.InsertManyWithHash(ctx, "movie", []map[string]any{{"id": "movie:44"}})
+	assert.ErrorAs(err, &prefixedErr)
+	assert.Nil(results)
+	assert.Empty(existing)
+}
+
+func TestGetByIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := map[string][]string{
+		"movie:1":   {"title", "Up", "embedding", float32VectorToString([]float32{1, 2}), idField, "1"},
+		"movie:old": {"title", "Heat", "embedding", float32VectorToString([]float32{3, 4})},
+		"movie:f16": {"title", "Jaws", "embedding", float32ToFloat16Bytes([]float32{0.5, -2}), idField, "f16"},
+	}
+	var gets int
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "HGETALL":
+			gets++
+			fields := make([]string, 0, len(docs[args[1]]))
+			for _, field := range docs[args[1]] {
+				fields = append(fields, respBulk(field))
+			}
+			return respArray(fields...)
+		case "JSON.GET":
+			if args[1] == "movie:1" {
+				return respBulk(`{"title":"Up","embedding":[1,2],"__eg_id":"1"}`)
+			}
+			return "$-1\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	client.vectorTypes = map[string]VectorDataType{"embedding": VectorDataTypeFloat32}
+	ctx := context.Background()
+
+	// the documents are in the order of the IDs, the missing ones are nil,
+	// and the vectors are skipped.
+	result, err := client.GetByIDs(ctx, "movie", []string{"missing", "1", "movie:old"})
+	assert.NoError(err)
+	assert.Equal([]map[string]any{
+		nil,
+		{"id": "1", "title": "Up"},
+		{"id": "movie:old", "title": "Heat"},
+	}, result)
+
+	// the vectors are decoded in the data types of their fields.
+	result, err = client.GetByIDs(ctx, "movie", []string{"1"}, WithDecodedVectors())
+	assert.NoError(err)
+	assert.Equal([]float32{1, 2}, result[0]["embedding"])
+	client.vectorTypes = map[string]VectorDataType{"embedding": VectorDataTypeFloat16}
+	result, err = client.GetByIDs(ctx, "movie", []string{"f16"}, WithDecodedVectors())
+	assert.NoError(err)
+	assert.Equal([]float32{0.5, -2}, result[0]["embedding"])
+
+	// malformed vectors fail the reads.
+	docs["movie:bad"] = []string{"embedding", "abc"}
+	_, err = client.GetByIDs(ctx, "movie", []string{"bad"}, WithDecodedVectors())
+	assert.ErrorContains(err, "invalid vector embedding of document movie:bad")
+
+	// the documents are read in pipelines of batches.
+	ids := make([]string, getBatchSize+1)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	gets = 0
+	result, err = client.GetByIDs(ctx, "movie", ids)
+	assert.NoError(err)
+	assert.Len(result, getBatchSize+1)
+	assert.Equal(getBatchSize+1, gets)
+	assert.Equal("1", result[1]["id"])
+
+	// JSON documents are read as a whole.
+	client.indexType = IndexTypeJSON
+	client.vectorTypes = map[string]VectorDataType{"embedding": VectorDataTypeFloat32}
+	result, err = client.GetByIDs(ctx, "movie", []string{"1", "2"}, WithDecodedVectors())
+	assert.NoError(err)
+	assert.Equal([]map[string]any{{"id": "1", "title": "Up", "embedding": []float32{1, 2}}, nil}, result)
+}
+
+func TestDeleteByQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	existing := map[string]string{}
+	searches := 0
+	var cancel context.CancelFunc
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "FT.SEARCH":
+			searches++
+			if searches == 2 && cancel != nil {
+				cancel()
+			}
+			assert.Equal("movie", args[1])
+			assert.Contains(args, "NOCONTENT")
+			size, _ := strconv.Atoi(args[len(args)-1])
+			var keys []string
+			for key, model := range existing {
+				if "@model:{"+model+"}" == args[2] {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			items := []string{":" + strconv.Itoa(len(keys)) + "\r\n"}
+			for _, key := range keys[:min(size, len(keys))] {
+				items = append(items, respBulk(key))
+			}
+			return respArray(items...)
+		case "UNLINK":
+			if _, ok := existing[args[1]]; ok {
+				delete(existing, args[1])
+				return ":1\r\n"
+			}
+			return ":0\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+
+	reset := func() {
+		for i := 0; i < 7; i++ {
+			existing["movie:"+strconv.Itoa(i)] = "gpt4o"
+		}
+		existing["movie:a"] = "gpt4"
+		existing["movie:b"] = "gpt4"
+		searches = 0
+	}
+
+	reset()
+	deleted, err := client.DeleteByQuery(context.Background(), "movie", "@model:{gpt4o}", WithDeletePageSize(3))
+	assert.NoError(err)
+	assert.Equal(int64(7), deleted)
+	assert.Equal(3, searches)
+	assert.Len(existing, 2)
+
+	// nothing matches.
+	deleted, err = client.DeleteByQuery(context.Background(), "movie", "@model:{gpt4o}")
+	assert.NoError(err)
+	assert.Zero(deleted)
+
+	// it stops when the context is cancelled, the first page is deleted.
+	reset()
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	deleted, err = client.DeleteByQuery(ctx, "movie", "@model:{gpt4o}", WithDeletePageSize(3))
+	assert.ErrorIs(err, context.Canceled)
+	assert.Equal(int64(3), deleted)
+	assert.Len(existing, 6)
+
+	_, err = client.DeleteByQuery(context.Background(), "movie", "*", WithDeletePageSize(0))
+	assert.Error(err)
+}
+
+func TestDeleteByFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	var filter string
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "FT.SEARCH":
+			filter = args[2]
+			return respArray(":1\r\n", respBulk("movie:1"))
+		case "UNLINK":
+			return ":1\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	handler := &RedisVectorHandler{client: newFakeRedisClient(t, r), index: "movie", schema: &IndexSchema{
+		Tags: []Tag{{Name: "model"}, {Name: "tenant"}},
+	}}
+
+	deleted, err := handler.DeleteByFilter(context.Background(),
+		&vecdbtypes.TagFilter{Field: "model", Tags: []string{"gpt-4", "gpt4"}},
+		&vecdbtypes.TagFilter{Field: "tenant", Tags: []string{"acme"}, Negate: true})
+	assert.NoError(err)
+	assert.Equal(int64(1), deleted)
+	assert.Equal(`@model:{gpt\-4 | gpt4} -@tenant:{acme}`, filter)
+
+	// the filters are checked against the schema, and required.
+	_, err = handler.DeleteByFilter(context.Background(), &vecdbtypes.TagFilter{Field: "genre", Tags: []string{"drama"}})
+	assert.ErrorIs(err, vecdbtypes.ErrInvalidFilter)
+	_, err = handler.DeleteByFilter(context.Background())
+	assert.ErrorIs(err, vecdbtypes.ErrInvalidFilter)
+}
+
+func TestCreateIndexSchemaMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	// the existing index is created for another embedding model.
+	existing := respArray(
+		respArray(respBulk("identifier"), respBulk("title"), respBulk("attribute"), respBulk("title"), respBulk("type"), respBulk("TEXT")),
+		respArray(respBulk("identifier"), respBulk("embedding"), respBulk("attribute"), respBulk("embedding"), respBulk("type"), respBulk("VECTOR"),
+			respBulk("algorithm"), respBulk("FLAT"), respBulk("data_type"), respBulk("FLOAT32"), respBulk("dim"), ":3\r\n",
+			respBulk("distance_metric"), respBulk("COSINE")),
+	)
+	var (
+		attributes string
+		commands   []string
+	)
+	r := newFakeRedis(t, func(args []string) string {
+		commands = append(commands, strings.Join(args, " "))
+		switch strings.ToUpper(args[0]) {
+		case "FT.INFO":
+			if attributes == "" {
+				return "-Unknown index name\r\n"
+			}
+			return respArray(respBulk("index_name"), respBulk(args[1]), respBulk("attributes"), attributes)
+		case "FT.DROPINDEX":
+			attributes = ""
+			return "+OK\r\n"
+		case "FT.CREATE":
+			attributes = respArray(
+				respArray(respBulk("identifier"), respBulk("title"), respBulk("attribute"), respBulk("title"), respBulk("type"), respBulk("TEXT")),
+				respArray(respBulk("identifier"), respBulk("genre"), respBulk("attribute"), respBulk("genre"), respBulk("type"), respBulk("TAG")),
+				respArray(respBulk("identifier"), respBulk("embedding"), respBulk("attribute"), respBulk("embedding"), respBulk("type"), respBulk("VECTOR"),
+					respBulk("dim"), respBulk("4"), respBulk("distance_metric"), respBulk("L2")),
+			)
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	matched := &IndexSchema{
+		Texts:   []Text{{Name: "title"}},
+		Vectors: []Vector{{Name: "embedding", Dim: 3}},
+	}
+	schema := &IndexSchema{
+		Tags:    []Tag{{Name: "genre"}},
+		Texts:   []Text{{Name: "title"}},
+		Vectors: []Vector{{Name: "embedding", Dim: 4, DistanceMetric: DistanceMetricL2}},
+	}
+
+	attributes = existing
+	assert.NoError(client.CreateIndexIfNotExists(ctx, "movie", matched))
+
+	// the differences are reported, and the index is kept.
+	commands = nil
+	err := client.CreateIndexIfNotExists(ctx, "movie", schema)
+	var mismatch *ErrIndexSchemaMismatch
+	assert.True(errors.As(err, &mismatch))
+	assert.Equal([]string{
+		"field genre is missing",
+		"dimension of field embedding is 3 instead of 4",
+		"distance metric of field embedding is COSINE instead of L2",
+	}, mismatch.Differences)
+	assert.NotContains(commands, "FT.DROPINDEX movie")
+
+	// a field of another type is a mismatch as well.
+	err = client.CreateIndexIfNotExists(ctx, "movie", &IndexSchema{Tags: []Tag{{Name: "title"}}})
+	assert.ErrorContains(err, "field title is TEXT instead of TAG")
+
+	// the index is created again, and its documents are kept.
+	client.recreateOnMismatch = true
+	commands = nil
+	assert.NoError(client.CreateIndexIfNotExists(ctx, "movie", schema))
+	assert.Contains(commands, "FT.DROPINDEX movie")
+	assert.NoError(client.CreateIndexIfNotExists(ctx, "movie", schema))
+}
+
+func TestCount(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newFakeRedis(t, func(args []string) string {
+		if strings.ToUpper(args[0]) != "FT.SEARCH" {
+			return "-ERR unexpected command\r\n"
+		}
+		assert.Equal("movie", args[1])
+		assert.Equal([]string{"NOCONTENT", "DIALECT", "2", "LIMIT", "0", "0"}, args[3:])
+		switch args[2] {
+		case "*":
+			return respArray(":9\r\n")
+		case "@model:{gpt4o}":
+			return respArray(":7\r\n")
+		}
+		return "-Syntax error at offset 1 near " + args[2] + "\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+
+	count, err := client.Count(context.Background(), "movie", "")
+	assert.NoError(err)
+	assert.Equal(int64(9), count)
+
+	count, err = client.Count(context.Background(), "movie", "@model:{gpt4o}")
+	assert.NoError(err)
+	assert.Equal(int64(7), count)
+
+	_, err = client.Count(context.Background(), "movie", "@model:(")
+	assert.EqualError(err, "Syntax error at offset 1 near @model:(")
+	assert.ErrorIs(withErrorKind(err), vecdbtypes.ErrInvalidFilter)
+}
+
+func TestScanAll(t *testing.T) {
+	assert := assert.New(t)
+
+	const total = 5
+	var (
+		reads   []string
+		deletes []string
+	)
+	// the cursor is the offset of the next batch plus 1, 0 means the end.
+	batch := func(offset, size int) string {
+		items := []string{":" + strconv.Itoa(total) + "\r\n"}
+		for i := offset; i < min(offset+size, total); i++ {
+			id := strconv.Itoa(i)
+			items = append(items, respArray(respBulk(idField), respBulk(id), respBulk("title"), respBulk("movie "+id)))
+		}
+		cursor := 0
+		if offset+size < total {
+			cursor = offset + size + 1
+		}
+		return respArray(respArray(items...), ":"+strconv.Itoa(cursor)+"\r\n")
+	}
+	r := newFakeRedis(t, func(args []string) string {
+		command := strings.ToUpper(args[0])
+		if command == "FT.CURSOR" {
+			command += " " + strings.ToUpper(args[1])
+		}
+		switch command {
+		case "FT.AGGREGATE":
+			assert.Equal([]string{"FT.AGGREGATE", "movie", "*", "LOAD", "*", "WITHCURSOR", "COUNT", "2"}, args)
+			return batch(0, 2)
+		case "FT.CURSOR READ":
+			reads = append(reads, args[3])
+			cursor, _ := strconv.Atoi(args[3])
+			size, _ := strconv.Atoi(args[5])
+			return batch(cursor-1, size)
+		case "FT.CURSOR DEL":
+			deletes = append(deletes, args[3])
+			return "+OK\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+
+	var ids []any
+	err := client.ScanAll(context.Background(), "movie", 2, func(docs []map[string]any) error {
+		assert.LessOrEqual(len(docs), 2)
+		for _, doc := range docs {
+			assert.Equal("movie "+doc["id"].(string), doc["title"])
+			ids = append(ids, doc["id"])
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal([]any{"0", "1", "2", "3", "4"}, ids)
+	assert.Equal([]string{"3", "5"}, reads)
+	// the cursor is released by the server when it is exhausted.
+	assert.Empty(deletes)
+
+	// the cursor is deleted if the callback stops the scan.
+	reads = nil
+	stop := errors.New("stop")
+	batches := 0
+	err = client.ScanAll(context.Background(), "movie", 2, func(docs []map[string]any) error {
+		batches++
+		if batches == 2 {
+			return stop
+		}
+		return nil
+	})
+	assert.ErrorIs(err, stop)
+	assert.Equal([]string{"3"}, reads)
+	assert.Equal([]string{"5"}, deletes)
+
+	// the cursor is deleted if the context is cancelled.
+	deletes = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	err = client.ScanAll(ctx, "movie", 2, func(docs []map[string]any) error {
+		cancel()
+		return nil
+	})
+	assert.ErrorIs(err, context.Canceled)
+	assert.Equal([]string{"3"}, deletes)
+
+	assert.Error(client.ScanAll(context.Background(), "movie", 0, func(docs []map[string]any) error { return nil }))
+}
+
+func TestInsertTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	var commands [][]string
+	r := newFakeRedis(t, func(args []string) string {
+		commands = append(commands, args)
+		return ":1\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	// documents never expire by default.
+	_, err := client.InsertManyWithHash(ctx, "movie", []map[string]any{{"title": "a"}})
+	assert.NoError(err)
+	assert.Len(commands, 1)
+	assert.Equal("HMSET", commands[0][0])
+
+	// every document is expired in the same pipeline, including the ones
+	// with IDs given by callers.
+	client.ttl = time.Minute
+	commands = nil
+	results, err := client.InsertManyWithHash(ctx, "movie", []map[string]any{{"title": "a"}, {"id": "b", "title": "b"}})
+	assert.NoError(err)
+	assert.Len(commands, 4)
+	for i, result := range results {
+		assert.Equal([]string{"PEXPIRE", result.ID, "60000"}, commands[2*i+1])
+	}
+	assert.Equal("movie:b", results[1].ID)
+
+	// the ttl of the call overrides the one of the client.
+	commands = nil
+	id, err := client.InsertWithHash(ctx, "movie", map[string]any{"title": "a"}, WithInsertTTL(time.Second))
+	assert.NoError(err)
+	assert.Len(commands, 2)
+	assert.Equal([]string{"PEXPIRE", id, "1000"}, commands[1])
+
+	// a document is written again along with its expiry if the expiry is
+	// redirected.
+	commands = nil
+	expires := 0
+	r.lock.Lock()
+	r.handler = func(args []string) string {
+		commands = append(commands, args)
+		if args[0] == "PEXPIRE" {
+			expires++
+			if expires == 1 {
+				return "-MOVED 3999 127.0.0.1:6381\r\n"
+			}
+		}
+		return ":1\r\n"
+	}
+	r.lock.Unlock()
+	_, err = client.InsertManyWithHash(ctx, "movie", []map[string]any{{"title": "a"}})
+	assert.NoError(err)
+	assert.Len(commands, 4)
+
+	assert.NoError(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", TTL: "1h"}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", TTL: "-1h"}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", TTL: "1 hour"}))
+	assert.Equal(time.Hour, (&RedisVectorDBSpec{TTL: "1h"}).GetTTL())
+	assert.Zero((&RedisVectorDBSpec{}).GetTTL())
+}
+
+func TestInsertWriteMode(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := map[string]map[string]string{"movie:a": {"title": "a", "genre": "drama"}}
+	var commands [][]string
+	r := newFakeRedis(t, func(args []string) string {
+		commands = append(commands, args)
+		switch args[0] {
+		case "EVALSHA":
+			// EVALSHA sha numkeys key mode ttl command args...
+			key, mode, command := args[3], args[4], args[6]
+			if _, ok := docs[key]; ok {
+				if mode == string(WriteModeCreateOnly) {
+					return ":0\r\n"
+				}
+				if mode == string(WriteModeOverwrite) {
+					delete(docs, key)
+				}
+			}
+			assert.Equal("HMSET", command)
+			if docs[key] == nil {
+				docs[key] = map[string]string{}
+			}
+			for i := 7; i+1 < len(args); i += 2 {
+				docs[key][args[i]] = args[i+1]
+			}
+			return ":1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	// the documents are merged by default.
+	_, err := client.InsertWithHash(ctx, "movie", map[string]any{"id": "b", "title": "b"})
+	assert.NoError(err)
+	assert.Len(commands, 1)
+	assert.Equal("HMSET", commands[0][0])
+
+	// the existing document is replaced in the overwrite mode.
+	commands = nil
+	id, err := client.InsertWithHash(ctx, "movie", map[string]any{"id": "a", "title": "c"}, WithWriteMode(WriteModeOverwrite))
+	assert.NoError(err)
+	assert.Equal("movie:a", id)
+	assert.Equal("c", docs["movie:a"]["title"])
+	assert.NotContains(docs["movie:a"], "genre")
+	assert.Equal("EVALSHA", commands[len(commands)-1][0])
+	assert.Equal([]string{"overwrite", "0"}, commands[len(commands)-1][4:6])
+
+	// the conflicted documents are reported one by one in the create only
+	// mode, the others are written.
+	results, err := client.InsertManyWithHash(ctx, "movie", []map[string]any{
+		{"id": "a", "title": "d"},
+		{"id": "e", "title": "e"},
+	}, WithWriteMode(WriteModeCreateOnly), WithInsertTTL(time.Second))
+	assert.Error(err)
+	assert.Len(results, 2)
+	var existsErr *ErrDocumentExists
+	assert.ErrorAs(results[0].Err, &existsErr)
+	assert.Equal("movie:a", existsErr.Key)
+	assert.False(IsRetryableError(results[0].Err))
+	assert.NoError(results[1].Err)
+	assert.Equal("movie:e", results[1].ID)
+	assert.Equal("c", docs["movie:a"]["title"])
+	assert.Equal("e", docs["movie:e"]["title"])
+	assert.Equal([]string{"createOnly", "1000"}, commands[len(commands)-1][4:6])
+
+	_, err = client.InsertWithHash(ctx, "movie", map[string]any{"title": "f"}, WithWriteMode("upsert"))
+	assert.Error(err)
+}
+
+func TestInsertManyWithHashChunked(t *testing.T) {
+	assert := assert.New(t)
+
+	var hmsets []string
+	r := newFakeRedis(t, func(args []string) string {
+		if args[0] != "HMSET" {
+			return "-ERR unknown command\r\n"
+		}
+		hmsets = append(hmsets, args[1])
+		if args[1] == "movie:b" {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		return ":1\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	docs := []map[string]any{
+		{"id": "a", "title": "a"},
+		{"id": "b", "title": "b"},
+		{"id": "c", "title": "c"},
+	}
+	result, err := client.InsertManyWithHashChunked(ctx, "movie", docs, WithInsertChunkSize(2))
+	assert.NoError(err)
+	assert.Equal([]string{"movie:a", "movie:c"}, result.SucceededIDs)
+	assert.Len(result.FailedDocs, 1)
+	assert.Equal("movie:b", result.FailedDocs[0].ID)
+	assert.Error(result.FailedDocs[0].Err)
+	assert.Equal([]string{"movie:a", "movie:b", "movie:c"}, hmsets)
+
+	// the wrapper joins the errors of the documents.
+	results, err := client.InsertManyWithHash(ctx, "movie", docs, WithInsertChunkSize(1))
+	assert.Error(err)
+	assert.Len(results, 3)
+	assert.NoError(results[0].Err)
+	assert.Error(results[1].Err)
+
+	// the chunks are not started after the context is done.
+	hmsets = nil
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	result, err = client.InsertManyWithHashChunked(cancelled, "movie", docs)
+	assert.ErrorIs(err, context.Canceled)
+	assert.Empty(result.SucceededIDs)
+	assert.Len(result.FailedDocs, 3)
+	assert.ErrorIs(result.FailedDocs[2].Err, context.Canceled)
+	assert.Empty(hmsets)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"errors"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+const (
+	// maxClusterAttempts is the maximum attempts of a command failed
+	// because of cluster topology changes.
+	maxClusterAttempts  = 3
+	clusterRetryBackoff = 100 * time.Millisecond
+)
+
+// isClusterError checks whether the error is caused by cluster topology
+// changes, the command is not applied by Redis in this case.
+func isClusterError(err error) bool {
+	redisErr, ok := rueidis.IsRedisErr(err)
+	if !ok {
+		return false
+	}
+	if _, ok := redisErr.IsMoved(); ok {
+		return true
+	}
+	if _, ok := redisErr.IsAsk(); ok {
+		return true
+	}
+	return redisErr.IsTryAgain() || redisErr.IsClusterDown() || redisErr.IsLoading()
+}
+
+// classifyError wraps cluster topology errors as ErrRedisCluster, other
+// errors are returned as is.
+func classifyError(message string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if isClusterError(err) {
+		return NewErrRedisCluster(message, err)
+	}
+	return err
+}
+
+// IsRetryableError checks whether the operation failed because of cluster
+// topology changes, and it is safe to run it again.
+func IsRetryableError(err error) bool {
+	var clusterErr *ErrRedisCluster
+	return errors.As(err, &clusterErr)
+}
+
+// clusterBackoff returns the backoff before the next attempt.
+func clusterBackoff(attempt int) time.Duration {
+	return time.Duration(attempt) * clusterRetryBackoff
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/redis/rueidis"
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	m.Run()
+}
+
+// fakeRedis is a Redis server speaking RESP2, its replies are decided by
+// the handler, so cluster redirects can be simulated without a cluster.
+type fakeRedis struct {
+	ln      net.Listener
+	lock    sync.Mutex
+	handler func(args []string) string
+}
+
+func newFakeRedis(t *testing.T, handler func(args []string) string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	r := &fakeRedis{ln: ln, handler: handler}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "HELLO":
+			reply = "-ERR unknown command 'HELLO'\r\n"
+		case "CLIENT", "PING", "ASKING":
+			reply = "+OK\r\n"
+		default:
+			r.lock.Lock()
+			reply = r.handler(args)
+			r.lock.Unlock()
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respArray(items ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+}
+
+// respIndexInfo returns the FT.INFO reply of an index with the fields, a
+// field is name:TYPE, or a TEXT field by its name.
+func respIndexInfo(index string, fields ...string) string {
+	attributes := make([]string, 0, len(fields))
+	for _, field := range fields {
+		field, fieldType, ok := strings.Cut(field, ":")
+		if !ok {
+			fieldType = "TEXT"
+		}
+		attributes = append(attributes, respArray(
+			respBulk("identifier"), respBulk(field),
+			respBulk("attribute"), respBulk(field),
+			respBulk("type"), respBulk(fieldType),
+			respBulk("SORTABLE"),
+		))
+	}
+	return respArray(
+		respBulk("index_name"), respBulk(index),
+		respBulk("attributes"), respArray(attributes...),
+	)
+}
+
+func newFakeRedisClient(t *testing.T, r *fakeRedis) *RedisClient {
+	client, err := NewRedisClient(rueidis.ClientOption{
+		InitAddress:       []string{r.ln.Addr().String()},
+		DisableCache:      true,
+		AlwaysRESP2:       true,
+		ForceSingleClient: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create Redis client: %v", err)
+	}
+	t.Cleanup(client.client.Close)
+	return client
+}
+
+func TestCreateIndexClusterErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := &IndexSchema{
+		Texts:   []Text{{Name: "title"}},
+		Vectors: []Vector{{Name: "embedding", Dim: 3}},
+	}
+
+	var (
+		created  []string
+		creates  int
+		drops    int
+		createFn func() string
+	)
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "FT.INFO":
+			if created == nil {
+				return "-Unknown index name\r\n"
+			}
+			return respIndexInfo(args[1], created...)
+		case "FT.CREATE":
+			creates++
+			return createFn()
+		case "FT.DROPINDEX":
+			drops++
+			created = nil
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	handler := &RedisVectorHandler{client: client, index: "movie"}
+	ctx := context.Background()
+
+	reset := func(fn func() string) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		created, creates, drops, createFn = nil, 0, 0, fn
+	}
+
+	{
+		// redirected, the creation is classified as retryable and runs again.
+		reset(func() string {
+			if creates == 1 {
+				return "-MOVED 3999 127.0.0.1:6381\r\n"
+			}
+			created = []string{"title", "embedding:VECTOR"}
+			return "+OK\r\n"
+		})
+		err := client.CreateIndexIfNotExists(ctx, "movie", schema)
+		assert.True(IsRetryableError(err))
+		assert.Zero(drops)
+
+		reset(func() string {
+			if creates == 1 {
+				return "-TRYAGAIN Multiple keys request during rehashing of slot\r\n"
+			}
+			created = []string{"title", "embedding:VECTOR"}
+			return "+OK\r\n"
+		})
+		assert.NoError(handler.createIndex(ctx, schema))
+		assert.Equal(2, creates)
+	}
+
+	{
+		// the schema is partially applied, the index is rolled back.
+		reset(func() string {
+			created = []string{"title"}
+			return "+OK\r\n"
+		})
+		err := client.CreateIndexIfNotExists(ctx, "movie", schema)
+		assert.ErrorContains(err, "without field embedding")
+		assert.False(IsRetryableError(err))
+		assert.Equal(1, drops)
+		assert.Nil(created)
+	}
+
+	{
+		// the creation failed after the index is created, it is rolled back.
+		reset(func() string {
+			created = []string{"title"}
+			return "-ASK 3999 127.0.0.1:6381\r\n"
+		})
+		err := client.CreateIndexIfNotExists(ctx, "movie", schema)
+		assert.True(IsRetryableError(err))
+		assert.Equal(1, drops)
+
+		// the retries are limited.
+		reset(func() string {
+			return "-CLUSTERDOWN The cluster is down\r\n"
+		})
+		err = handler.createIndex(ctx, schema)
+		assert.True(IsRetryableError(err))
+		assert.Equal(maxClusterAttempts, creates)
+	}
+
+	{
+		// created by others concurrently, it is never rolled back.
+		reset(func() string {
+			created = []string{"title", "embedding:VECTOR"}
+			return "-Index already exists\r\n"
+		})
+		assert.NoError(client.CreateIndexIfNotExists(ctx, "movie", schema))
+		assert.Zero(drops)
+	}
+}
+
+func TestInsertManyClusterErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	var writes map[string]int
+	r := newFakeRedis(t, nil)
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+	setHandler := func(handler func(args []string) string) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		writes = map[string]int{}
+		r.handler = handler
+	}
+
+	docs := []map[string]any{{"title": "a"}, {"title": "b"}, {"title": "c"}}
+	// fail the second written document once.
+	setHandler(func(args []string) string {
+		key := args[1]
+		writes[key]++
+		if len(writes) == 2 && writes[key] == 1 {
+			return "-MOVED 3999 127.0.0.1:6381\r\n"
+		}
+		return ":1\r\n"
+	})
+	results, err := client.InsertManyWithHash(ctx, "movie", docs)
+	assert.NoError(err)
+	assert.Len(results, 3)
+	total := 0
+	for _, result := range results {
+		assert.NoError(result.Err)
+		total += writes[result.ID]
+	}
+	// the redirected document is written again with the same key.
+	assert.Equal(4, total)
+	assert.Len(writes, 3)
+
+	// the retries are limited, and the error is retryable.
+	setHandler(func(args []string) string {
+		writes[args[1]]++
+		return "-ASK 3999 127.0.0.1:6381\r\n"
+	})
+	_, err = client.InsertManyWithHash(ctx, "movie", docs[:1])
+	assert.True(IsRetryableError(err))
+	assert.Len(writes, 1)
+	for _, n := range writes {
+		assert.Equal(maxClusterAttempts, n)
+	}
+
+	// other errors are not retried.
+	setHandler(func(args []string) string {
+		writes[args[1]]++
+		return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	})
+	_, err = client.InsertManyWithHash(ctx, "movie", docs[:1])
+	assert.Error(err)
+	assert.False(IsRetryableError(err))
+	for _, n := range writes {
+		assert.Equal(1, n)
+	}
+}
+
+// redisClusterScript starts a Redis Cluster of three masters in the
+// container, the nodes announce the loopback address, so their ports are
+// mapped to the same ports of the host.
+const redisClusterScript = `
+for port in 7000 7001 7002; do
+  redis-server --port $port --cluster-enabled yes --cluster-config-file nodes-$port.conf \
+    --cluster-announce-ip 127.0.0.1 --daemonize yes
+done
+sleep 1
+redis-cli --cluster create 127.0.0.1:7000 127.0.0.1:7001 127.0.0.1:7002 --cluster-replicas 0 --cluster-yes
+tail -f /dev/null
+`
+
+func TestRedisClusterRedirects(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	redisC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "redis:8.0",
+			Cmd:          []string{"sh", "-c", redisClusterScript},
+			ExposedPorts: []string{"7000:7000/tcp", "7001:7001/tcp", "7002:7002/tcp"},
+			WaitingFor:   wait.ForLog("All 16384 slots covered").WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Redis Cluster container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, redisC)
+
+	client, err := NewRedisClient(rueidis.ClientOption{
+		InitAddress: []string{"127.0.0.1:7000", "127.0.0.1:7001", "127.0.0.1:7002"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Redis client: %v", err)
+	}
+	defer client.client.Close()
+
+	// the index is verified to be queryable after it is created.
+	schema := &IndexSchema{
+		Texts:   []Text{{Name: "title"}},
+		Vectors: []Vector{{Name: "embedding", Dim: 3}},
+	}
+	assert.NoError(client.CreateIndexIfNotExists(ctx, "movie", schema))
+	assert.NoError(client.verifyIndex(ctx, "movie", schema))
+
+	docs := make([]map[string]any, 0, 30)
+	for i := 0; i < 30; i++ {
+		docs = append(docs, map[string]any{
+			"title":     fmt.Sprintf("movie %d", i),
+			"embedding": []float32{float32(i), 0.2, 0.3},
+		})
+	}
+	insert := func() []string {
+		results, err := client.InsertManyWithHash(ctx, "movie", docs)
+		assert.NoError(err)
+		keys := make([]string, 0, len(results))
+		for _, result := range results {
+			assert.NoError(result.Err)
+			keys = append(keys, result.ID)
+		}
+		return keys
+	}
+	keys := insert()
+
+	// move all slots of a node to another one, the client still routes
+	// the keys of the slots to the old node, which redirects them.
+	code, output, err := redisC.Exec(ctx, []string{"sh", "-c",
+		"redis-cli --cluster reshard 127.0.0.1:7000 --cluster-from $(redis-cli -p 7000 cluster myid) " +
+			"--cluster-to $(redis-cli -p 7001 cluster myid) --cluster-slots 16384 --cluster-yes"})
+	if err != nil || code != 0 {
+		out, _ := io.ReadAll(output)
+		t.Fatalf("Failed to reshard Redis Cluster: %v, %s", err, out)
+	}
+
+	// the redirected writes are run again, and no document is lost.
+	keys = append(keys, insert()...)
+	for _, key := range keys {
+		title, err := client.client.Do(ctx, client.client.B().Hget().Key(key).Field("title").Build()).ToString()
+		assert.NoError(err, key)
+		assert.True(strings.HasPrefix(title, "movie "), key)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+const (
+	// ModeStandalone connects to a standalone Redis, a cluster is still
+	// detected if the URL is of a cluster.
+	ModeStandalone = "standalone"
+	// ModeCluster connects to a Redis cluster by the seed addresses.
+	ModeCluster = "cluster"
+	// ModeSentinel connects to the master of MasterName found by the
+	// sentinels of the addresses.
+	ModeSentinel = "sentinel"
+
+	// the query parameters of rueidis URLs, and the parameters after
+	// them which are only known by parseURL.
+	addrParam          = "addr"
+	masterSetParam     = "master_set"
+	skipVerifyParam    = "skip_verify"
+	shardsRefreshParam = "shards_refresh_interval"
+	caFileParam        = "tls_ca_file"
+	certFileParam      = "tls_cert_file"
+	keyFileParam       = "tls_key_file"
+)
+
+type (
+	// TLSSpec is the TLS of the connections to Redis.
+	TLSSpec struct {
+		// Enabled connects to Redis by TLS.
+		Enabled bool `json:"enabled,omitempty"`
+		// CAFile is the PEM file of the CA certificates verifying the
+		// server, the system CAs are used if it is empty.
+		CAFile string `json:"caFile,omitempty"`
+		// CertFile and KeyFile are the PEM files of the client
+		// certificate and its key.
+		CertFile string `json:"certFile,omitempty"`
+		KeyFile  string `json:"keyFile,omitempty"`
+		// InsecureSkipVerify does not verify the certificate of the server.
+		InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	}
+)
+
+var (
+	validModes = []string{ModeStandalone, ModeCluster, ModeSentinel}
+
+	// envReference matches the passwords referencing environment variables.
+	envReference = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+)
+
+// ConnectionURL returns the URL the clients of the spec connect by, which
+// is the URL with the addresses, the master name, the shards refresh
+// interval, the TLS and the credentials added to it. The URL is returned as
+// is if none of them is set, so the drains and integrity checks keyed by
+// it are kept.
+func (spec *RedisVectorDBSpec) ConnectionURL() string {
+	if len(spec.Addresses) == 0 && spec.MasterName == "" && spec.ShardsRefreshInterval == "" &&
+		spec.TLS == nil && spec.Username == "" && spec.Password == "" {
+		return spec.URL
+	}
+
+	addresses := spec.Addresses
+	u, err := url.Parse(spec.URL)
+	if spec.URL == "" || err != nil {
+		// the first address is the host, credentials are not supported
+		// without the URL.
+		u = &url.URL{Scheme: "redis", Host: addresses[0]}
+		addresses = addresses[1:]
+	}
+	q := u.Query()
+	for _, address := range addresses {
+		q.Add(addrParam, address)
+	}
+	if spec.Mode == ModeSentinel {
+		q.Set(masterSetParam, spec.MasterName)
+	}
+	if spec.Mode == ModeCluster && spec.ShardsRefreshInterval != "" {
+		q.Set(shardsRefreshParam, spec.ShardsRefreshInterval)
+	}
+	if spec.Username != "" || spec.Password != "" {
+		// the password referencing an environment variable is kept as
+		// is, and resolved by parseURL.
+		u.User = url.UserPassword(spec.Username, spec.Password)
+	}
+	if t := spec.TLS; t != nil && t.Enabled {
+		if u.Scheme == "redis" {
+			u.Scheme = "rediss"
+		}
+		for param, value := range map[string]string{caFileParam: t.CAFile, certFileParam: t.CertFile, keyFileParam: t.KeyFile} {
+			if value != "" {
+				q.Set(param, value)
+			}
+		}
+		if t.InsecureSkipVerify {
+			q.Set(skipVerifyParam, "true")
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// parseURL parses the URL to the client option, it is rueidis.ParseURL
+// with the shards refresh interval of clusters, the CA and the client
+// certificate of TLS, and the password referencing an environment variable.
+func parseURL(rawURL string) (rueidis.ClientOption, error) {
+	option, err := rueidis.ParseURL(rawURL)
+	if err != nil {
+		return option, err
+	}
+	u, _ := url.Parse(rawURL)
+	q := u.Query()
+	if interval := q.Get(shardsRefreshParam); interval != "" {
+		option.ClusterOption.ShardsRefreshInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			return option, fmt.Errorf("invalid shards refresh interval %q", interval)
+		}
+	}
+	if option.TLSConfig != nil {
+		if err := loadTLSFiles(option.TLSConfig, q.Get(caFileParam), q.Get(certFileParam), q.Get(keyFileParam)); err != nil {
+			return option, err
+		}
+	} else if q.Has(caFileParam) || q.Has(certFileParam) || q.Has(keyFileParam) {
+		return option, fmt.Errorf("TLS files of URL scheme %s without TLS", u.Scheme)
+	}
+	if m := envReference.FindStringSubmatch(option.Password); m != nil {
+		name, username := m[1], option.Username
+		option.Password = ""
+		option.AuthCredentialsFn = func(rueidis.AuthCredentialsContext) (rueidis.AuthCredentials, error) {
+			password := os.Getenv(name)
+			if password == "" {
+				return rueidis.AuthCredentials{}, fmt.Errorf("environment variable %s of the Redis password is not set", name)
+			}
+			return rueidis.AuthCredentials{Username: username, Password: password}, nil
+		}
+	}
+	return option, nil
+}
+
+// loadTLSFiles loads the CA certificates and the client certificate into
+// the TLS config.
+func loadTLSFiles(config *tls.Config, caFile, certFile, keyFile string) error {
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in TLS CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+// validateConnection validates how the Redis of the spec is connected,
+// there must be at least one address by the URL or the addresses.
+func validateConnection(spec *RedisVectorDBSpec) error {
+	if spec.Mode != "" && !slices.Contains(validModes, spec.Mode) {
+		return fmt.Errorf("redis vector mode %s is invalid", spec.Mode)
+	}
+	if spec.URL == "" && len(spec.Addresses) == 0 {
+		return fmt.Errorf("redis vector url and addresses are both empty")
+	}
+	for _, address := range spec.Addresses {
+		if address == "" {
+			return fmt.Errorf("redis vector address is empty")
+		}
+	}
+	if spec.Mode == ModeSentinel && spec.MasterName == "" {
+		return fmt.Errorf("redis vector masterName is required in sentinel mode")
+	}
+	if spec.Mode != ModeSentinel && spec.MasterName != "" {
+		return fmt.Errorf("redis vector masterName is only supported in sentinel mode")
+	}
+	if spec.ShardsRefreshInterval != "" {
+		if spec.Mode != ModeCluster {
+			return fmt.Errorf("redis vector shardsRefreshInterval is only supported in cluster mode")
+		}
+		interval, err := time.ParseDuration(spec.ShardsRefreshInterval)
+		if err != nil || interval < 0 {
+			return fmt.Errorf("redis vector shardsRefreshInterval %s is invalid", spec.ShardsRefreshInterval)
+		}
+	}
+	if t := spec.TLS; t != nil {
+		if !t.Enabled && (t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.InsecureSkipVerify) {
+			return fmt.Errorf("redis vector tls is configured but not enabled")
+		}
+		if (t.CertFile == "") != (t.KeyFile == "") {
+			return fmt.Errorf("redis vector tls certFile and keyFile must be set together")
+		}
+	}
+	if spec.Username != "" && spec.Password == "" {
+		return fmt.Errorf("redis vector password of username %s is empty", spec.Username)
+	}
+	// the TLS files are loaded here, so misconfigured paths fail the
+	// creation of the object instead of the first query.
+	if _, err := parseURL(spec.ConnectionURL()); err != nil {
+		return fmt.Errorf("redis vector connection is invalid: %w", err)
+	}
+	return nil
+}
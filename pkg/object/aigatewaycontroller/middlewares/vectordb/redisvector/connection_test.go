@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionURL(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &RedisVectorDBSpec{URL: "redis://:pass@localhost:6379"}
+	assert.Equal(spec.URL, spec.ConnectionURL())
+
+	spec = &RedisVectorDBSpec{Mode: ModeCluster, Addresses: []string{"a:6379", "b:6379"}, ShardsRefreshInterval: "30s"}
+	option, err := parseURL(spec.ConnectionURL())
+	assert.NoError(err)
+	assert.Equal([]string{"a:6379", "b:6379"}, option.InitAddress)
+	assert.Equal(30*time.Second, option.ClusterOption.ShardsRefreshInterval)
+	assert.Empty(option.Sentinel.MasterSet)
+
+	// the URL carries the credentials, the addresses are added to its host.
+	spec = &RedisVectorDBSpec{URL: "rediss://user:pass@s1:26379", Mode: ModeSentinel, Addresses: []string{"s2:26379"}, MasterName: "mymaster"}
+	option, err = parseURL(spec.ConnectionURL())
+	assert.NoError(err)
+	assert.Equal([]string{"s1:26379", "s2:26379"}, option.InitAddress)
+	assert.Equal("mymaster", option.Sentinel.MasterSet)
+	assert.Equal("user", option.Username)
+	assert.Equal("pass", option.Password)
+	assert.NotNil(option.TLSConfig)
+
+	_, err = parseURL("redis://localhost:6379?shards_refresh_interval=abc")
+	assert.Error(err)
+}
+
+func TestValidateConnection(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, spec := range []*RedisVectorDBSpec{
+		{URL: "redis://localhost:6379"},
+		{Mode: ModeStandalone, Addresses: []string{"localhost:6379"}},
+		{Mode: ModeCluster, Addresses: []string{"a:6379", "b:6379"}, ShardsRefreshInterval: "1m"},
+		{Mode: ModeSentinel, Addresses: []string{"s1:26379"}, MasterName: "mymaster"},
+	} {
+		assert.NoError(ValidateSpec(spec), "%+v", spec)
+	}
+
+	for _, spec := range []*RedisVectorDBSpec{
+		{},
+		{Mode: ModeCluster},
+		{Mode: "replica", URL: "redis://localhost:6379"},
+		{Mode: ModeSentinel, Addresses: []string{"s1:26379"}},
+		{Mode: ModeCluster, Addresses: []string{"a:6379"}, MasterName: "mymaster"},
+		{Mode: ModeStandalone, Addresses: []string{"a:6379"}, ShardsRefreshInterval: "1m"},
+		{Mode: ModeCluster, Addresses: []string{"a:6379"}, ShardsRefreshInterval: "-1m"},
+		{Mode: ModeCluster, Addresses: []string{""}},
+		{URL: "http://localhost:6379"},
+		{Mode: ModeCluster, Shards: &ShardingSpec{URLs: []string{"redis://a:6379"}}},
+	} {
+		assert.Error(ValidateSpec(spec), "%+v", spec)
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key to the dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestConnectionTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+	spec := &RedisVectorDBSpec{
+		URL: "redis://redis.example.com:6380",
+		TLS: &TLSSpec{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile},
+	}
+	assert.NoError(ValidateSpec(spec))
+	option, err := parseURL(spec.ConnectionURL())
+	assert.NoError(err)
+	assert.NotNil(option.TLSConfig.RootCAs)
+	assert.Len(option.TLSConfig.Certificates, 1)
+	assert.Equal("redis.example.com", option.TLSConfig.ServerName)
+	assert.False(option.TLSConfig.InsecureSkipVerify)
+
+	spec.TLS = &TLSSpec{Enabled: true, InsecureSkipVerify: true}
+	option, err = parseURL(spec.ConnectionURL())
+	assert.NoError(err)
+	assert.True(option.TLSConfig.InsecureSkipVerify)
+	assert.Nil(option.TLSConfig.RootCAs)
+
+	// the misconfigured files fail the validation.
+	for _, tlsSpec := range []*TLSSpec{
+		{Enabled: true, CAFile: filepath.Join(dir, "missing.pem")},
+		{Enabled: true, CAFile: keyFile},
+		{Enabled: true, CertFile: certFile},
+		{Enabled: true, CertFile: certFile, KeyFile: certFile},
+		{CAFile: certFile},
+	} {
+		spec.TLS = tlsSpec
+		assert.Error(ValidateSpec(spec), "%+v", tlsSpec)
+	}
+	spec.TLS = &TLSSpec{Enabled: true, CAFile: filepath.Join(dir, "missing.pem")}
+	assert.ErrorContains(ValidateSpec(spec), "failed to read TLS CA file")
+
+	// TLS is exclusive with shards, whose URLs carry it.
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{
+		TLS:    &TLSSpec{Enabled: true},
+		Shards: &ShardingSpec{URLs: []string{"rediss://a:6379"}},
+	}))
+}
+
+func TestConnectionCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	var auth []string
+	r := newFakeRedis(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "AUTH" {
+			auth = args[1:]
+		}
+		return "+OK\r\n"
+	})
+
+	spec := &RedisVectorDBSpec{
+		URL:      fmt.Sprintf("redis://%s?protocol=2&client_cache=0", r.ln.Addr()),
+		Username: "vector",
+		Password: "${EG_TEST_REDIS_PASSWORD}",
+	}
+	assert.NoError(ValidateSpec(spec))
+	// the secret never sits in the URL.
+	t.Setenv("EG_TEST_REDIS_PASSWORD", "secret")
+	assert.NotContains(spec.ConnectionURL(), "secret")
+	option, err := parseURL(spec.ConnectionURL())
+	assert.NoError(err)
+	assert.Empty(option.Password)
+	client, err := NewRedisClient(option)
+	assert.NoError(err)
+	client.client.Close()
+	r.lock.Lock()
+	assert.Equal([]string{"vector", "secret"}, auth)
+	r.lock.Unlock()
+
+	// the variable is read when connecting.
+	t.Setenv("EG_TEST_REDIS_PASSWORD", "")
+	option, err = parseURL(spec.ConnectionURL())
+	assert.NoError(err)
+	_, err = NewRedisClient(option)
+	assert.ErrorContains(err, "EG_TEST_REDIS_PASSWORD")
+
+	// plain passwords are sent as is.
+	spec.Password = "plain"
+	option, err = parseURL(spec.ConnectionURL())
+	assert.NoError(err)
+	assert.Equal("vector", option.Username)
+	assert.Equal("plain", option.Password)
+	assert.Nil(option.AuthCredentialsFn)
+
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", Username: "vector"}))
+}
+
+// keySlot returns the cluster slot of the key.
+func keySlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc % 16384
+}
+
+func TestClusterRouting(t *testing.T) {
+	assert := assert.New(t)
+
+	// two nodes of a cluster, each serves half of the slots and redirects
+	// the commands of keys of the other half.
+	const half = 8192
+	type node struct {
+		redis *fakeRedis
+		keys  []string
+	}
+	nodes := make([]*node, 2)
+	index := []string{}
+	slots := func() string {
+		items := []string{}
+		for i, n := range nodes {
+			host, port, _ := net.SplitHostPort(n.redis.ln.Addr().String())
+			items = append(items, respArray(
+				fmt.Sprintf(":%d\r\n", i*half), fmt.Sprintf(":%d\r\n", i*half+half-1),
+				respArray(respBulk(host), ":"+port+"\r\n", respBulk(fmt.Sprintf("node%d", i))),
+			))
+		}
+		return respArray(items...)
+	}
+	for i := range nodes {
+		i := i
+		nodes[i] = &node{}
+		nodes[i].redis = newFakeRedis(t, func(args []string) string {
+			command := strings.ToUpper(args[0])
+			if command == "CLUSTER" {
+				return slots()
+			}
+			key := args[1]
+			owner := int(keySlot(key)) / half
+			if owner != i {
+				return fmt.Sprintf("-MOVED %d %s\r\n", keySlot(key), nodes[owner].redis.ln.Addr())
+			}
+			nodes[i].keys = append(nodes[i].keys, command+" "+key)
+			switch command {
+			case "FT.INFO":
+				if len(index) == 0 {
+					return "-Unknown index name\r\n"
+				}
+				return respIndexInfo(key, index...)
+			case "FT.CREATE":
+				index = []string{"title"}
+				return "+OK\r\n"
+			}
+			return ":1\r\n"
+		})
+	}
+
+	spec := &RedisVectorDBSpec{
+		URL:                   fmt.Sprintf("redis://%s?protocol=2&client_cache=0", nodes[0].redis.ln.Addr()),
+		Mode:                  ModeCluster,
+		Addresses:             []string{nodes[1].redis.ln.Addr().String()},
+		ShardsRefreshInterval: "1m",
+	}
+	assert.NoError(ValidateSpec(spec))
+	option, err := parseURL(spec.ConnectionURL())
+	assert.NoError(err)
+	client, err := NewRedisClient(option)
+	assert.NoError(err)
+	defer client.client.Close()
+
+	// the index and its documents are in different slots.
+	ctx := context.Background()
+	assert.NoError(client.CreateIndexIfNotExists(ctx, "movie", &IndexSchema{Texts: []Text{{Name: "title"}}}))
+	docs := []map[string]any{}
+	for i := 0; i < 20; i++ {
+		docs = append(docs, map[string]any{"id": fmt.Sprintf("doc%d", i), "title": "a"})
+	}
+	_, err = client.InsertManyWithHash(ctx, "movie", docs)
+	assert.NoError(err)
+
+	indexNode := nodes[keySlot("movie")/half]
+	assert.Contains(indexNode.keys, "FT.CREATE movie")
+	for i, n := range nodes {
+		writes := 0
+		for _, key := range n.keys {
+			command, key, _ := strings.Cut(key, " ")
+			if strings.HasPrefix(command, "FT.") {
+				// the FT commands are only sent to the node of the index.
+				assert.Same(indexNode, n)
+				continue
+			}
+			assert.Equal(i, int(keySlot(key))/half)
+			writes++
+		}
+		// the documents are spread across both nodes.
+		assert.NotZero(writes, "node%d", i)
+	}
+}
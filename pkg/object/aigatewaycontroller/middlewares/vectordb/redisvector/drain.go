@@ -0,0 +1,529 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// DefaultDrainDeletionsPerSecond is the default cap of deleting the
+	// documents of a drained index.
+	DefaultDrainDeletionsPerSecond = 1000
+	// DefaultDrainBatchSize is the default number of keys scanned in a batch.
+	DefaultDrainBatchSize = 100
+
+	DrainStatusWaiting   = "waiting"
+	DrainStatusDraining  = "draining"
+	DrainStatusCompleted = "completed"
+
+	// drainsKey is the set of the drained indexes, it is used to resume
+	// the drains after restarts.
+	drainsKey = "drains"
+	// drainDoneCursor marks the nodes whose keys are all scanned.
+	drainDoneCursor = "done"
+	drainLockTTL    = 30 * time.Second
+	// drainRecordTTL is how long the record of a completed drain is kept.
+	drainRecordTTL = 7 * 24 * time.Hour
+)
+
+var (
+	// progressDrainScript saves the cursor of a node and counts the deleted
+	// documents, unless the drain is started again since the batch began.
+	progressDrainScript = rueidis.NewLuaScript(`
+if redis.call('HGET', KEYS[1], 'startedAt') ~= ARGV[1] then
+	return -1
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+return redis.call('HINCRBY', KEYS[1], 'deleted', ARGV[4])
+`)
+
+	// completeDrainScript marks the drain completed, unless it is started
+	// again since the scan began.
+	completeDrainScript = rueidis.NewLuaScript(`
+if redis.call('HGET', KEYS[1], 'startedAt') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', 'completed', 'finishedAt', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+	// renewDrainLockScript extends the lock if it is held by the owner.
+	renewDrainLockScript = rueidis.NewLuaScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+	// drainWaitInterval is the interval to check the lock held by others,
+	// and drainRetryInterval is the interval to retry after failures.
+	drainWaitInterval  = drainLockTTL
+	drainRetryInterval = 5 * time.Second
+
+	// drainers are the drainers started by this process, they are kept
+	// after completion to report the status.
+	drainersLock sync.Mutex
+	drainers     = map[string]*drainer{}
+)
+
+type (
+	// DrainSpec makes dropping an index gradual. The index is dropped at
+	// once, so searches miss immediately, and its documents are deleted in
+	// rate-limited background batches instead of by FT.DROPINDEX DD, which
+	// blocks Redis for seconds on large indexes.
+	DrainSpec struct {
+		DeletionsPerSecond int `json:"deletionsPerSecond,omitempty"`
+		BatchSize          int `json:"batchSize,omitempty"`
+	}
+
+	// DrainStatus is the progress of draining the documents of an index.
+	DrainStatus struct {
+		Index              string `json:"index"`
+		Status             string `json:"status"`
+		Deleted            int64  `json:"deleted"`
+		DeletionsPerSecond int    `json:"deletionsPerSecond"`
+		StartedAt          string `json:"startedAt,omitempty"`
+		FinishedAt         string `json:"finishedAt,omitempty"`
+		// Error is the last error, the drain is retried after errors.
+		Error string `json:"error,omitempty"`
+	}
+
+	// drainer deletes the documents of a dropped index. The progress is
+	// persisted in Redis, so the drain is resumed after restarts, and only
+	// the member holding the lock deletes documents.
+	drainer struct {
+		client rueidis.Client
+		index  string
+		spec   *DrainSpec
+		keys   keyLayout
+		owner  string
+
+		// running and rescan are protected by drainersLock.
+		running bool
+		rescan  bool
+
+		statusLock sync.Mutex
+		status     DrainStatus
+	}
+)
+
+// ValidateDrainSpec validates the drain spec.
+func ValidateDrainSpec(spec *DrainSpec) error {
+	if spec.DeletionsPerSecond < 0 {
+		return fmt.Errorf("deletionsPerSecond must not be negative")
+	}
+	if spec.BatchSize < 0 {
+		return fmt.Errorf("batchSize must not be negative")
+	}
+	return nil
+}
+
+// GetDeletionsPerSecond returns the cap of deletions per second.
+func (spec *DrainSpec) GetDeletionsPerSecond() int {
+	if spec.DeletionsPerSecond > 0 {
+		return spec.DeletionsPerSecond
+	}
+	return DefaultDrainDeletionsPerSecond
+}
+
+// GetBatchSize returns the number of keys scanned in a batch.
+func (spec *DrainSpec) GetBatchSize() int {
+	if spec.BatchSize > 0 {
+		return spec.BatchSize
+	}
+	return DefaultDrainBatchSize
+}
+
+func getDrainKey(index string) string {
+	return fmt.Sprintf("drain:{%s}", index)
+}
+
+func getDrainLockKey(index string) string {
+	return fmt.Sprintf("drain:{%s}:lock", index)
+}
+
+// escapeGlob escapes the special characters of SCAN MATCH patterns.
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// drainCollection drops the index at once, and deletes its documents in
+// the background. Dropping an index being drained scans its keys again,
+// since documents may be inserted meanwhile.
+func (r *RedisVectorDB) drainCollection(ctx context.Context, name string) error {
+	err := r.withClient(func(client rueidis.Client) error {
+		key := getDrainKey(name)
+		startedAt := time.Now().UTC().Format(time.RFC3339Nano)
+		for _, res := range client.DoMulti(ctx,
+			client.B().Del().Key(key).Build(),
+			client.B().Hset().Key(key).FieldValue().FieldValue("status", DrainStatusDraining).FieldValue("startedAt", startedAt).Build(),
+			client.B().Sadd().Key(drainsKey).Member(name).Build(),
+		) {
+			if err := res.Error(); err != nil {
+				return fmt.Errorf("failed to record drain of index %s: %w", name, err)
+			}
+		}
+		err := client.Do(ctx, client.B().FtDropindex().Index(name).Build()).Error()
+		if err != nil && !isUnknownIndexError(err) {
+			return fmt.Errorf("failed to drop index %s: %w", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return startDrainer(r.Spec.ConnectionURL(), name, r.Spec.Drain, r.getKeyLayout())
+}
+
+// ResumeDrains starts draining the indexes of the scope whose drains are
+// not completed, it is called when the vector database is created, so the
+// drains survive restarts.
+func (r *RedisVectorDB) ResumeDrains(ctx context.Context) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	var indexes []string
+	err = r.withClient(func(client rueidis.Client) error {
+		members, err := client.Do(ctx, client.B().Smembers().Key(drainsKey).Build()).AsStrSlice()
+		if err != nil {
+			return fmt.Errorf("failed to get drains: %w", err)
+		}
+		for _, index := range members {
+			// the drains of other scopes are resumed by their members.
+			if !vecdbtypes.InScope(r.getScope(), index) {
+				continue
+			}
+			status, err := client.Do(ctx, client.B().Hget().Key(getDrainKey(index)).Field("status").Build()).ToString()
+			switch {
+			case rueidis.IsRedisNil(err):
+				// the record of the completed drain is expired.
+				client.Do(ctx, client.B().Srem().Key(drainsKey).Member(index).Build())
+			case err != nil:
+				return fmt.Errorf("failed to get drain of index %s: %w", index, err)
+			case status == DrainStatusDraining:
+				indexes = append(indexes, index)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	spec := r.Spec.Drain
+	if spec == nil {
+		spec = &DrainSpec{}
+	}
+	for _, index := range indexes {
+		if err := startDrainer(r.Spec.ConnectionURL(), index, spec, r.getKeyLayout()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DrainStatuses returns the status of the drains of the indexes in the
+// scope started by this process.
+func DrainStatuses(scope string) []*DrainStatus {
+	drainersLock.Lock()
+	list := make([]*drainer, 0, len(drainers))
+	for index, d := range drainers {
+		if vecdbtypes.InScope(scope, index) {
+			list = append(list, d)
+		}
+	}
+	drainersLock.Unlock()
+
+	statuses := make([]*DrainStatus, 0, len(list))
+	for _, d := range list {
+		statuses = append(statuses, d.getStatus())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Index < statuses[j].Index
+	})
+	return statuses
+}
+
+// startDrainer starts draining the index, or makes the running drainer of
+// the index scan again.
+func startDrainer(url string, index string, spec *DrainSpec, keys keyLayout) error {
+	drainersLock.Lock()
+	defer drainersLock.Unlock()
+
+	key := url + "|" + index
+	if d, ok := drainers[key]; ok && d.running {
+		d.rescan = true
+		return nil
+	}
+	clientOption, err := parseURL(url)
+	if err != nil {
+		return NewErrParsingRedisURL("failed to parse Redis URL", err)
+	}
+	client, err := NewRedisClient(clientOption)
+	if err != nil {
+		return NewErrCreateRedisClient("failed to create Redis client", err)
+	}
+	d := newDrainer(client.client, index, spec)
+	d.keys = keys
+	d.running = true
+	drainers[key] = d
+	go d.run()
+	return nil
+}
+
+func newDrainer(client rueidis.Client, index string, spec *DrainSpec) *drainer {
+	return &drainer{
+		client: client,
+		index:  index,
+		spec:   spec,
+		owner:  uuid.NewString(),
+		status: DrainStatus{
+			Index:              index,
+			Status:             DrainStatusWaiting,
+			DeletionsPerSecond: spec.GetDeletionsPerSecond(),
+		},
+	}
+}
+
+func (d *drainer) run() {
+	for {
+		if err := d.drain(context.Background()); err != nil {
+			logger.Errorf("failed to drain index %s, retry in %s: %v", d.index, drainRetryInterval, err)
+			d.updateStatus(func(s *DrainStatus) { s.Error = err.Error() })
+			time.Sleep(drainRetryInterval)
+			continue
+		}
+
+		drainersLock.Lock()
+		if d.rescan {
+			d.rescan = false
+			drainersLock.Unlock()
+			continue
+		}
+		d.running = false
+		drainersLock.Unlock()
+		d.client.Close()
+		return
+	}
+}
+
+// drain deletes the documents of the index batch by batch, it returns nil
+// when the drain is completed, by this drainer or others.
+func (d *drainer) drain(ctx context.Context) error {
+	var (
+		started = time.Now()
+		deleted int64
+	)
+	for {
+		record, err := d.client.Do(ctx, d.client.B().Hgetall().Key(getDrainKey(d.index)).Build()).AsStrMap()
+		if err != nil {
+			return fmt.Errorf("failed to get drain record: %w", err)
+		}
+		if len(record) == 0 || record["status"] == DrainStatusCompleted {
+			d.updateStatus(func(s *DrainStatus) {
+				s.Status = DrainStatusCompleted
+				s.FinishedAt = record["finishedAt"]
+			})
+			return nil
+		}
+
+		owned, err := d.lock(ctx)
+		if err != nil {
+			return err
+		}
+		if !owned {
+			d.updateStatus(func(s *DrainStatus) {
+				s.Status = DrainStatusWaiting
+				s.StartedAt = record["startedAt"]
+			})
+			time.Sleep(drainWaitInterval)
+			continue
+		}
+
+		n, done, err := d.deleteBatch(ctx, record)
+		if err != nil {
+			return err
+		}
+		if done {
+			completed, err := d.complete(ctx, record["startedAt"])
+			if err != nil || completed {
+				return err
+			}
+			// the drain is started again, scan from the beginning.
+			continue
+		}
+
+		deleted += n
+		d.pace(started, deleted)
+	}
+}
+
+// lock acquires or renews the lock of the drain, it returns false if the
+// lock is held by others.
+func (d *drainer) lock(ctx context.Context) (bool, error) {
+	key := getDrainLockKey(d.index)
+	ttl := strconv.FormatInt(drainLockTTL.Milliseconds(), 10)
+	renewed, err := renewDrainLockScript.Exec(ctx, d.client, []string{key}, []string{d.owner, ttl}).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to renew drain lock: %w", err)
+	}
+	if renewed == 1 {
+		return true, nil
+	}
+	err = d.client.Do(ctx, d.client.B().Set().Key(key).Value(d.owner).Nx().Px(drainLockTTL).Build()).Error()
+	if rueidis.IsRedisNil(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire drain lock: %w", err)
+	}
+	return true, nil
+}
+
+// deleteBatch scans a batch of the keys of the index on the first node not
+// scanned through and deletes them, done is true if all nodes are scanned.
+func (d *drainer) deleteBatch(ctx context.Context, record map[string]string) (n int64, done bool, err error) {
+	nodes := d.client.Nodes()
+	addrs := make([]string, 0, len(nodes))
+	for addr := range nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		field := "cursor:" + addr
+		cursor := record[field]
+		if cursor == drainDoneCursor {
+			continue
+		}
+		if cursor == "" {
+			cursor = "0"
+		}
+		c, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid cursor %s of node %s: %w", cursor, addr, err)
+		}
+
+		node := nodes[addr]
+		entry, err := node.Do(ctx, node.B().Scan().Cursor(c).Match(escapeGlob(d.keys.getPrefix(d.index))+"*").Count(int64(d.spec.GetBatchSize())).Build()).AsScanEntry()
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to scan node %s: %w", addr, err)
+		}
+		if len(entry.Elements) > 0 {
+			commands := make(rueidis.Commands, 0, len(entry.Elements))
+			for _, key := range entry.Elements {
+				commands = append(commands, d.client.B().Unlink().Key(key).Build())
+			}
+			for _, res := range d.client.DoMulti(ctx, commands...) {
+				if err := res.Error(); err != nil {
+					return 0, false, fmt.Errorf("failed to delete documents: %w", err)
+				}
+			}
+		}
+
+		next := strconv.FormatUint(entry.Cursor, 10)
+		if entry.Cursor == 0 {
+			next = drainDoneCursor
+		}
+		total, err := progressDrainScript.Exec(ctx, d.client, []string{getDrainKey(d.index)},
+			[]string{record["startedAt"], field, next, strconv.Itoa(len(entry.Elements))}).AsInt64()
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to save drain progress: %w", err)
+		}
+		if total >= 0 {
+			d.updateStatus(func(s *DrainStatus) {
+				s.Status = DrainStatusDraining
+				s.StartedAt = record["startedAt"]
+				s.Deleted = total
+				s.Error = ""
+			})
+		}
+		return int64(len(entry.Elements)), false, nil
+	}
+	return 0, true, nil
+}
+
+// complete marks the drain completed and releases the lock, it returns
+// false if the drain is started again.
+func (d *drainer) complete(ctx context.Context, startedAt string) (bool, error) {
+	finishedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	ttl := strconv.FormatInt(drainRecordTTL.Milliseconds(), 10)
+	completed, err := completeDrainScript.Exec(ctx, d.client, []string{getDrainKey(d.index)},
+		[]string{startedAt, finishedAt, ttl}).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to complete drain: %w", err)
+	}
+	if completed == 0 {
+		return false, nil
+	}
+	d.client.Do(ctx, d.client.B().Srem().Key(drainsKey).Member(d.index).Build())
+	d.client.Do(ctx, d.client.B().Del().Key(getDrainLockKey(d.index)).Build())
+
+	status := d.updateStatus(func(s *DrainStatus) {
+		s.Status = DrainStatusCompleted
+		s.FinishedAt = finishedAt
+		s.Error = ""
+	})
+	logger.Infof("drain completed: index %s, deleted %d documents, started at %s, finished at %s",
+		d.index, status.Deleted, status.StartedAt, status.FinishedAt)
+	return true, nil
+}
+
+// pace sleeps to keep the deletions under the cap.
+func (d *drainer) pace(started time.Time, deleted int64) {
+	expected := time.Duration(float64(deleted) / float64(d.spec.GetDeletionsPerSecond()) * float64(time.Second))
+	if wait := expected - time.Since(started); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (d *drainer) updateStatus(fn func(s *DrainStatus)) *DrainStatus {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	fn(&d.status)
+	status := d.status
+	return &status
+}
+
+func (d *drainer) getStatus() *DrainStatus {
+	return d.updateStatus(func(s *DrainStatus) {})
+}
+
+// isDraining checks whether the documents of the index are being drained.
+func (c *RedisClient) isDraining(ctx context.Context, index string) bool {
+	status, err := c.client.Do(ctx, c.client.B().Hget().Key(getDrainKey(index)).Field("status").Build()).ToString()
+	return err == nil && status == DrainStatusDraining
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDrainRedis keeps the keys touched by drains, and runs the scripts
+// of drains by their effects.
+type fakeDrainRedis struct {
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	// docs are the documents, deleted ones are kept as false, so the
+	// cursors of scans are not affected by deletions like in Redis.
+	docs map[string]bool
+}
+
+func newFakeDrainRedis() *fakeDrainRedis {
+	return &fakeDrainRedis{
+		strings: map[string]string{},
+		hashes:  map[string]map[string]string{},
+		sets:    map[string]map[string]bool{},
+		docs:    map[string]bool{},
+	}
+}
+
+func (f *fakeDrainRedis) hash(key string) map[string]string {
+	if f.hashes[key] == nil {
+		f.hashes[key] = map[string]string{}
+	}
+	return f.hashes[key]
+}
+
+func (f *fakeDrainRedis) handle(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "EVALSHA":
+		return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	case "EVAL":
+		return f.eval(args[1], args[3:4], args[4:])
+	case "HGETALL":
+		items := []string{}
+		for k, v := range f.hashes[args[1]] {
+			items = append(items, respBulk(k), respBulk(v))
+		}
+		return respArray(items...)
+	case "HGET":
+		if v, ok := f.hashes[args[1]][args[2]]; ok {
+			return respBulk(v)
+		}
+		return "$-1\r\n"
+	case "HSET":
+		h := f.hash(args[1])
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		return ":1\r\n"
+	case "SET":
+		if _, ok := f.strings[args[1]]; ok {
+			return "$-1\r\n"
+		}
+		f.strings[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		delete(f.strings, args[1])
+		delete(f.hashes, args[1])
+		return ":1\r\n"
+	case "SREM":
+		delete(f.sets[args[1]], args[2])
+		return ":1\r\n"
+	case "UNLINK":
+		f.docs[args[1]] = false
+		return ":1\r\n"
+	case "SCAN":
+		return f.scan(args)
+	case "FT.INFO":
+		return "-Unknown index name\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// scan returns the documents in key order, the cursor is the offset.
+func (f *fakeDrainRedis) scan(args []string) string {
+	offset, _ := strconv.Atoi(args[1])
+	var pattern string
+	count := 10
+	for i := 2; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+		}
+	}
+	keys := make([]string, 0, len(f.docs))
+	for key := range f.docs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	next := offset + count
+	if next >= len(keys) {
+		next = 0
+	}
+	end := offset + count
+	if end > len(keys) {
+		end = len(keys)
+	}
+	items := []string{}
+	for _, key := range keys[min(offset, len(keys)):end] {
+		if f.docs[key] && strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+			items = append(items, respBulk(key))
+		}
+	}
+	return respArray(respBulk(strconv.Itoa(next)), respArray(items...))
+}
+
+func (f *fakeDrainRedis) eval(script string, keys []string, args []string) string {
+	switch {
+	case strings.Contains(script, "'deleted'"):
+		h := f.hash(keys[0])
+		if h["startedAt"] != args[0] {
+			return ":-1\r\n"
+		}
+		h[args[1]] = args[2]
+		deleted, _ := strconv.Atoi(h["deleted"])
+		n, _ := strconv.Atoi(args[3])
+		h["deleted"] = strconv.Itoa(deleted + n)
+		return ":" + h["deleted"] + "\r\n"
+	case strings.Contains(script, "'completed'"):
+		h := f.hash(keys[0])
+		if h["startedAt"] != args[0] {
+			return ":0\r\n"
+		}
+		h["status"], h["finishedAt"] = DrainStatusCompleted, args[1]
+		return ":1\r\n"
+	default:
+		if f.strings[keys[0]] == args[0] {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+}
+
+func (f *fakeDrainRedis) liveDocs() []string {
+	var keys []string
+	for key, live := range f.docs {
+		if live {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestValidateDrainSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &DrainSpec{}
+	assert.Nil(ValidateDrainSpec(spec))
+	assert.Equal(DefaultDrainDeletionsPerSecond, spec.GetDeletionsPerSecond())
+	assert.Equal(DefaultDrainBatchSize, spec.GetBatchSize())
+	spec = &DrainSpec{DeletionsPerSecond: 10, BatchSize: 5}
+	assert.Equal(10, spec.GetDeletionsPerSecond())
+	assert.Equal(5, spec.GetBatchSize())
+	assert.NotNil(ValidateDrainSpec(&DrainSpec{DeletionsPerSecond: -1}))
+	assert.NotNil(ValidateDrainSpec(&DrainSpec{BatchSize: -1}))
+
+	assert.NotNil(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", Drain: &DrainSpec{BatchSize: -1}}))
+	assert.Equal(`a\*b\?c\[d\]`, escapeGlob("a*b?c[d]"))
+}
+
+func TestDrainer(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeDrainRedis()
+	for i := 0; i < 7; i++ {
+		fake.docs["movie:"+strconv.Itoa(i)] = true
+	}
+	fake.docs["other:1"] = true
+	fake.hash(getDrainKey("movie"))["status"] = DrainStatusDraining
+	fake.hash(getDrainKey("movie"))["startedAt"] = "t1"
+	fake.sets[drainsKey] = map[string]bool{"movie": true}
+	fake.strings[getDrainLockKey("movie")] = "other-member"
+
+	r := newFakeRedis(t, fake.handle)
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+	spec := &DrainSpec{DeletionsPerSecond: 1000000, BatchSize: 3}
+
+	// the index is not created again while it is drained.
+	assert.True(client.isDraining(ctx, "movie"))
+	err := client.CreateIndexIfNotExists(ctx, "movie", &IndexSchema{})
+	var drainingErr *ErrIndexDraining
+	assert.True(errors.As(err, &drainingErr))
+
+	d := newDrainer(client.client, "movie", spec)
+	// the drain is locked by another member.
+	owned, err := d.lock(ctx)
+	assert.NoError(err)
+	assert.False(owned)
+	delete(fake.strings, getDrainLockKey("movie"))
+	owned, err = d.lock(ctx)
+	assert.NoError(err)
+	assert.True(owned)
+	owned, err = d.lock(ctx)
+	assert.NoError(err)
+	assert.True(owned)
+
+	// a batch is deleted, and the progress is persisted.
+	n, done, err := d.deleteBatch(ctx, fake.hashes[getDrainKey("movie")])
+	assert.NoError(err)
+	assert.False(done)
+	assert.Equal(int64(3), n)
+	assert.Len(fake.liveDocs(), 5)
+	assert.Equal("3", fake.hashes[getDrainKey("movie")]["deleted"])
+	assert.Equal(int64(3), d.getStatus().Deleted)
+	assert.Equal(DrainStatusDraining, d.getStatus().Status)
+
+	// the drain is resumed from the cursor by another drainer, like after
+	// a restart.
+	delete(fake.strings, getDrainLockKey("movie"))
+	d = newDrainer(client.client, "movie", spec)
+	assert.NoError(d.drain(ctx))
+	assert.Equal([]string{"other:1"}, fake.liveDocs())
+	record := fake.hashes[getDrainKey("movie")]
+	assert.Equal(DrainStatusCompleted, record["status"])
+	assert.Equal("7", record["deleted"])
+	assert.NotEmpty(record["finishedAt"])
+	assert.Empty(fake.sets[drainsKey])
+	assert.NotContains(fake.strings, getDrainLockKey("movie"))
+
+	status := d.getStatus()
+	assert.Equal(DrainStatusCompleted, status.Status)
+	assert.Equal(int64(7), status.Deleted)
+	assert.Equal(record["finishedAt"], status.FinishedAt)
+	assert.False(client.isDraining(ctx, "movie"))
+
+	// the drain started again is not completed by the previous scan.
+	completed, err := d.complete(ctx, "t0")
+	assert.NoError(err)
+	assert.False(completed)
+}
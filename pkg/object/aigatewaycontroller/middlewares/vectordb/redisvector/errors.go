@@ -17,6 +17,17 @@
 
 package redisvector
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
 type ErrParsingRedisURL struct {
 	Message string
 	Err     error
@@ -34,6 +45,10 @@ func (e *ErrParsingRedisURL) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrParsingRedisURL) Unwrap() error {
+	return e.Err
+}
+
 type ErrCreateRedisClient struct {
 	Message string
 	Err     error
@@ -51,6 +66,10 @@ func (e *ErrCreateRedisClient) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrCreateRedisClient) Unwrap() error {
+	return e.Err
+}
+
 type ErrUnexpectedIndexSchema struct {
 	Message string
 	Err     error
@@ -68,6 +87,10 @@ func (e *ErrUnexpectedIndexSchema) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrUnexpectedIndexSchema) Unwrap() error {
+	return e.Err
+}
+
 type ErrCreateRedisIndex struct {
 	Message string
 	Err     error
@@ -85,6 +108,10 @@ func (e *ErrCreateRedisIndex) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrCreateRedisIndex) Unwrap() error {
+	return e.Err
+}
+
 type ErrInsertDocument struct {
 	Message string
 	Err     error
@@ -102,6 +129,10 @@ func (e *ErrInsertDocument) Error() string {
 	return e.Message + ": " + e.Err.Error()
 }
 
+func (e *ErrInsertDocument) Unwrap() error {
+	return e.Err
+}
+
 type InvalidScoreThreshold struct{}
 
 // NewInvalidScoreThreshold creates a new InvalidScoreThreshold error.
@@ -112,3 +143,312 @@ func NewInvalidScoreThreshold() *InvalidScoreThreshold {
 func (e *InvalidScoreThreshold) Error() string {
 	return "invalid score threshold: must be between 0 and 1"
 }
+
+// ErrInvalidQueryFilter means a structured filter of a query is invalid,
+// like filtering on a field not in the index schema.
+type ErrInvalidQueryFilter struct {
+	Field  string
+	Reason string
+}
+
+// NewErrInvalidQueryFilter creates a new ErrInvalidQueryFilter.
+func NewErrInvalidQueryFilter(field string, reason string) *ErrInvalidQueryFilter {
+	return &ErrInvalidQueryFilter{
+		Field:  field,
+		Reason: reason,
+	}
+}
+
+func (e *ErrInvalidQueryFilter) Error() string {
+	return fmt.Sprintf("invalid filter on field %q: %s", e.Field, e.Reason)
+}
+
+// ErrInvalidQueryPage means the offset, the limit or the k of a query is
+// out of range.
+type ErrInvalidQueryPage struct {
+	Offset int
+	Limit  int
+	Reason string
+}
+
+// NewErrInvalidQueryPage creates a new ErrInvalidQueryPage.
+func NewErrInvalidQueryPage(offset, limit int, reason string) *ErrInvalidQueryPage {
+	return &ErrInvalidQueryPage{
+		Offset: offset,
+		Limit:  limit,
+		Reason: reason,
+	}
+}
+
+func (e *ErrInvalidQueryPage) Error() string {
+	return fmt.Sprintf("invalid page of offset %d and limit %d: %s", e.Offset, e.Limit, e.Reason)
+}
+
+// ErrDocumentIDRequired means a document of an insert has no id, while
+// the IDs of documents are required to be explicit or derived from fields.
+type ErrDocumentIDRequired struct {
+	// Index is the position of the document in the insert.
+	Index int
+	// Field is the missing field the ID is derived from, it is empty if
+	// the ID is required to be explicit.
+	Field string
+}
+
+// NewErrDocumentIDRequired creates a new ErrDocumentIDRequired.
+func NewErrDocumentIDRequired(index int, field string) *ErrDocumentIDRequired {
+	return &ErrDocumentIDRequired{
+		Index: index,
+		Field: field,
+	}
+}
+
+func (e *ErrDocumentIDRequired) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("document %d has no id or field %s to derive its id", e.Index, e.Field)
+	}
+	return fmt.Sprintf("document %d has no id", e.Index)
+}
+
+// ErrInvalidQuerySort means the sorting of a query is invalid, like
+// sorting by a field not declared sortable in the index schema.
+type ErrInvalidQuerySort struct {
+	Field  string
+	Reason string
+}
+
+// NewErrInvalidQuerySort creates a new ErrInvalidQuerySort.
+func NewErrInvalidQuerySort(field string, reason string) *ErrInvalidQuerySort {
+	return &ErrInvalidQuerySort{
+		Field:  field,
+		Reason: reason,
+	}
+}
+
+func (e *ErrInvalidQuerySort) Error() string {
+	return fmt.Sprintf("invalid sorting by field %q: %s", e.Field, e.Reason)
+}
+
+type ErrPayloadStore struct {
+	Message string
+	Err     error
+}
+
+// NewErrPayloadStore creates a new ErrPayloadStore with the given message and error.
+func NewErrPayloadStore(message string, err error) *ErrPayloadStore {
+	return &ErrPayloadStore{
+		Message: message,
+		Err:     err,
+	}
+}
+
+func (e *ErrPayloadStore) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *ErrPayloadStore) Unwrap() error {
+	return e.Err
+}
+
+// ErrRedisCluster is a cluster topology error, like MOVED, ASK, TRYAGAIN,
+// CLUSTERDOWN and LOADING. The command is not applied, so it is safe to
+// run it again, see IsRetryableError.
+type ErrRedisCluster struct {
+	Message string
+	Err     error
+}
+
+// NewErrRedisCluster creates a new ErrRedisCluster with the given message and error.
+func NewErrRedisCluster(message string, err error) *ErrRedisCluster {
+	return &ErrRedisCluster{
+		Message: message,
+		Err:     err,
+	}
+}
+
+func (e *ErrRedisCluster) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *ErrRedisCluster) Unwrap() error {
+	return e.Err
+}
+
+// ErrIndexDraining means the index is dropped and its documents are being
+// deleted in the background, it is not created again until the drain
+// completes.
+type ErrIndexDraining struct {
+	Message string
+	Err     error
+}
+
+// NewErrIndexDraining creates a new ErrIndexDraining with the given message and error.
+func NewErrIndexDraining(message string, err error) *ErrIndexDraining {
+	return &ErrIndexDraining{
+		Message: message,
+		Err:     err,
+	}
+}
+
+func (e *ErrIndexDraining) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *ErrIndexDraining) Unwrap() error {
+	return e.Err
+}
+
+// ErrIndexSchemaMismatch means an existing index does not match the
+// schema it is expected to have, like after switching embedding models.
+type ErrIndexSchemaMismatch struct {
+	Index       string
+	Differences []string
+}
+
+// NewErrIndexSchemaMismatch creates a new ErrIndexSchemaMismatch with the given index and differences.
+func NewErrIndexSchemaMismatch(index string, differences []string) *ErrIndexSchemaMismatch {
+	return &ErrIndexSchemaMismatch{Index: index, Differences: differences}
+}
+
+func (e *ErrIndexSchemaMismatch) Error() string {
+	return fmt.Sprintf("index %s does not match the schema: %s", e.Index, strings.Join(e.Differences, "; "))
+}
+
+// ErrVectorDBTimeout means an operation exceeded the timeout of its kind,
+// like searchTimeout of the spec. The caller may go on without the
+// vector database, like skipping the semantic cache.
+type ErrVectorDBTimeout struct {
+	Operation string
+	Timeout   time.Duration
+	Err       error
+}
+
+// NewErrVectorDBTimeout creates a new ErrVectorDBTimeout with the given operation, timeout and error.
+func NewErrVectorDBTimeout(operation string, timeout time.Duration, err error) *ErrVectorDBTimeout {
+	return &ErrVectorDBTimeout{Operation: operation, Timeout: timeout, Err: err}
+}
+
+func (e *ErrVectorDBTimeout) Error() string {
+	return fmt.Sprintf("redis vector %s timed out after %v: %v", e.Operation, e.Timeout, e.Err)
+}
+
+func (e *ErrVectorDBTimeout) Unwrap() error {
+	return e.Err
+}
+
+// ErrReservedField means a document has a field reserved by the vector
+// database, see ReservedFields.
+type ErrReservedField struct {
+	Field string
+}
+
+// NewErrReservedField creates a new ErrReservedField with the given field.
+func NewErrReservedField(field string) *ErrReservedField {
+	return &ErrReservedField{Field: field}
+}
+
+func (e *ErrReservedField) Error() string {
+	return fmt.Sprintf("field %s of document is reserved", e.Field)
+}
+
+// ErrPrefixedID means the ID of a document starts with the key prefix of
+// its index. The key of the document would be the prefix twice, and the
+// ID would be taken as the key by DeleteByIDs and GetByIDs.
+type ErrPrefixedID struct {
+	ID     string
+	Prefix string
+}
+
+// NewErrPrefixedID creates a new ErrPrefixedID with the given ID and prefix.
+func NewErrPrefixedID(id, prefix string) *ErrPrefixedID {
+	return &ErrPrefixedID{ID: id, Prefix: prefix}
+}
+
+func (e *ErrPrefixedID) Error() string {
+	return fmt.Sprintf("ID %s of document starts with the key prefix %s", e.ID, e.Prefix)
+}
+
+// ErrDocumentExists means a document is not inserted in the create only
+// write mode, since its key exists.
+type ErrDocumentExists struct {
+	Key string
+}
+
+// NewErrDocumentExists creates a new ErrDocumentExists with the given key.
+func NewErrDocumentExists(key string) *ErrDocumentExists {
+	return &ErrDocumentExists{Key: key}
+}
+
+func (e *ErrDocumentExists) Error() string {
+	return fmt.Sprintf("document %s exists", e.Key)
+}
+
+// withErrorKind classifies the error of Redis by the kinds of
+// vecdbtypes, it is returned as is if its kind is unknown. The messages
+// of RediSearch are matched here, so the callers never match them.
+func withErrorKind(err error) error {
+	if err == nil {
+		return nil
+	}
+	if kind := vecdbtypes.CommonErrorKind(err); kind != nil {
+		return vecdbtypes.NewError(kind, err)
+	}
+	if errors.Is(err, rueidis.ErrClosing) || IsRetryableError(err) {
+		return vecdbtypes.NewError(vecdbtypes.ErrUnavailable, err)
+	}
+	var timedOut *ErrVectorDBTimeout
+	if errors.As(err, &timedOut) {
+		return vecdbtypes.NewError(vecdbtypes.ErrTimeout, err)
+	}
+	var draining *ErrIndexDraining
+	if errors.As(err, &draining) {
+		return vecdbtypes.NewError(vecdbtypes.ErrUnavailable, err)
+	}
+	var exists *ErrDocumentExists
+	if errors.As(err, &exists) {
+		return vecdbtypes.NewError(vecdbtypes.ErrDocumentExists, err)
+	}
+	var threshold *InvalidScoreThreshold
+	if errors.As(err, &threshold) {
+		return vecdbtypes.NewError(vecdbtypes.ErrInvalidFilter, err)
+	}
+	var filter *ErrInvalidQueryFilter
+	if errors.As(err, &filter) {
+		return vecdbtypes.NewError(vecdbtypes.ErrInvalidFilter, err)
+	}
+	var page *ErrInvalidQueryPage
+	if errors.As(err, &page) {
+		return vecdbtypes.NewError(vecdbtypes.ErrInvalidPage, err)
+	}
+	var sort *ErrInvalidQuerySort
+	if errors.As(err, &sort) {
+		return vecdbtypes.NewError(vecdbtypes.ErrInvalidFilter, err)
+	}
+
+	var redisErr *rueidis.RedisError
+	if !errors.As(err, &redisErr) {
+		return err
+	}
+	if redisErr.IsLoading() || redisErr.IsTryAgain() || redisErr.IsClusterDown() {
+		return vecdbtypes.NewError(vecdbtypes.ErrUnavailable, err)
+	}
+	msg := strings.ToLower(redisErr.Error())
+	var kind error
+	switch {
+	case strings.Contains(msg, "unknown index name"), strings.Contains(msg, "no such index"):
+		kind = vecdbtypes.ErrNotFound
+	case strings.Contains(msg, "expected size"), strings.Contains(msg, "dimension"):
+		// e.g. query vector blob size (12) does not match index's
+		// expected size (16).
+		kind = vecdbtypes.ErrDimensionMismatch
+	case strings.HasPrefix(msg, "oom"), strings.Contains(msg, "max number of clients"):
+		kind = vecdbtypes.ErrQuotaExceeded
+	case strings.Contains(msg, "timeout limit"):
+		kind = vecdbtypes.ErrTimeout
+	case strings.HasPrefix(msg, "masterdown"), strings.HasPrefix(msg, "readonly"), strings.HasPrefix(msg, "busy "):
+		kind = vecdbtypes.ErrUnavailable
+	case strings.Contains(msg, "syntax error"), strings.Contains(msg, "unknown field"),
+		strings.Contains(msg, "parsing"), strings.Contains(msg, "invalid filter"):
+		kind = vecdbtypes.ErrInvalidFilter
+	}
+	return vecdbtypes.NewError(kind, err)
+}
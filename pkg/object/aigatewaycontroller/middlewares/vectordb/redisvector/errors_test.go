@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// TestErrorKinds asserts the native errors of Redis are classified by the
+// kinds of vecdbtypes in every operation.
+func TestErrorKinds(t *testing.T) {
+	assert := assert.New(t)
+
+	kinds := []error{
+		vecdbtypes.ErrNotFound, vecdbtypes.ErrTimeout, vecdbtypes.ErrUnavailable,
+		vecdbtypes.ErrDimensionMismatch, vecdbtypes.ErrQuotaExceeded, vecdbtypes.ErrInvalidFilter,
+	}
+	cases := []struct {
+		reply string
+		kind  error
+	}{
+		{"-Unknown index name\r\n", vecdbtypes.ErrNotFound},
+		{"-docs: no such index\r\n", vecdbtypes.ErrNotFound},
+		{"-Timeout limit was reached\r\n", vecdbtypes.ErrTimeout},
+		{"-LOADING Redis is loading the dataset in memory\r\n", vecdbtypes.ErrUnavailable},
+		{"-CLUSTERDOWN The cluster is down\r\n", vecdbtypes.ErrUnavailable},
+		{"-READONLY You can't write against a read only replica.\r\n", vecdbtypes.ErrUnavailable},
+		{"-Error parsing vector similarity query: query vector blob size (12) does not match index's expected size (16).\r\n", vecdbtypes.ErrDimensionMismatch},
+		{"-OOM command not allowed when used memory > 'maxmemory'.\r\n", vecdbtypes.ErrQuotaExceeded},
+		{"-ERR max number of clients reached\r\n", vecdbtypes.ErrQuotaExceeded},
+		{"-Syntax error at offset 3 near title\r\n", vecdbtypes.ErrInvalidFilter},
+		{"-Unknown field at offset 0 near color\r\n", vecdbtypes.ErrInvalidFilter},
+		{"-ERR something else\r\n", nil},
+	}
+
+	var reply string
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "FT.SEARCH", "HSET", "HMSET":
+			return reply
+		}
+		return "-ERR unknown command\r\n"
+	})
+	handler := &RedisVectorHandler{client: newFakeRedisClient(t, r), index: "docs"}
+	ctx := context.Background()
+
+	for _, c := range cases {
+		reply = c.reply
+		_, searchErr := handler.SimilaritySearch(ctx, vecdbtypes.WithRedisVectorFilterKey("embedding"), vecdbtypes.WithRedisVectorFilterValues([]float32{1, 0}))
+		_, insertErr := handler.InsertDocuments(ctx, []map[string]any{{"embedding": []float32{1, 0}, "content": "a"}})
+		for _, err := range []error{searchErr, insertErr} {
+			if !assert.Error(err, c.reply) {
+				continue
+			}
+			assert.Equal(c.kind, vecdbtypes.ErrorKind(err), c.reply)
+			for _, kind := range kinds {
+				assert.Equal(kind == c.kind, errors.Is(err, kind), c.reply)
+			}
+		}
+	}
+
+	// the typed errors of the operations are kept.
+	reply = "-OOM command not allowed\r\n"
+	_, err := handler.InsertDocuments(ctx, []map[string]any{{"embedding": []float32{1, 0}}})
+	var insertErr *ErrInsertDocument
+	assert.True(errors.As(err, &insertErr))
+	assert.ErrorIs(err, vecdbtypes.ErrQuotaExceeded)
+
+	// documents not written in the create only write mode.
+	err = withErrorKind(NewErrInsertDocument("failed to insert document", NewErrDocumentExists("doc:1")))
+	assert.ErrorIs(err, vecdbtypes.ErrDocumentExists)
+
+	// timeouts of contexts and failed connections.
+	timeout, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	_, err = handler.SimilaritySearch(timeout, vecdbtypes.WithRedisVectorFilterKey("embedding"), vecdbtypes.WithRedisVectorFilterValues([]float32{1, 0}))
+	assert.ErrorIs(err, vecdbtypes.ErrTimeout)
+
+	_, err = handler.SimilaritySearch(ctx, vecdbtypes.WithScoreThreshold(2))
+	assert.ErrorIs(err, vecdbtypes.ErrInvalidFilter)
+
+	db := New(&vecdbtypes.CommonSpec{}, &RedisVectorDBSpec{URL: "redis://127.0.0.1:1"})
+	_, err = db.CreateSchema(ctx, func(o *vecdbtypes.Options) { o.DBName = "docs" })
+	assert.ErrorIs(err, vecdbtypes.ErrUnavailable)
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// documentIDs decides the IDs of the documents inserted without id, which
+// are given UUIDs by default.
+type documentIDs struct {
+	// required rejects the documents without id.
+	required bool
+	// fields derive the IDs from the SHA-256 of their values.
+	fields []string
+}
+
+// getDocumentIDs returns how the IDs of documents are decided by the spec.
+func (spec *RedisVectorDBSpec) getDocumentIDs() documentIDs {
+	return documentIDs{required: spec.RequireExplicitID, fields: spec.IDFields}
+}
+
+// validateDocumentIDs validates requireExplicitID and idFields of the spec.
+func validateDocumentIDs(spec *RedisVectorDBSpec) error {
+	if spec.RequireExplicitID && len(spec.IDFields) != 0 {
+		return fmt.Errorf("redis vector requireExplicitID and idFields are exclusive")
+	}
+	for i, field := range spec.IDFields {
+		if field == "" || field == "id" {
+			return fmt.Errorf("redis vector idFields[%d] %q is invalid", i, field)
+		}
+		if slices.Contains(spec.IDFields[:i], field) {
+			return fmt.Errorf("redis vector idFields[%d] %s is duplicated", i, field)
+		}
+	}
+	return nil
+}
+
+// resolve returns the i-th document of an insert with its ID. A document
+// with id is returned as is, otherwise its ID is derived from the fields,
+// or it is rejected if the ID is required, or it is returned as is to be
+// given a UUID. The document is never modified, it is cloned to set the
+// derived ID.
+func (ids documentIDs) resolve(i int, doc map[string]any) (map[string]any, error) {
+	if _, ok := doc["id"]; ok {
+		return doc, nil
+	}
+	if len(ids.fields) == 0 {
+		if ids.required {
+			return nil, NewErrDocumentIDRequired(i, "")
+		}
+		return doc, nil
+	}
+
+	hash := sha256.New()
+	for _, field := range ids.fields {
+		value, ok := doc[field]
+		if !ok {
+			return nil, NewErrDocumentIDRequired(i, field)
+		}
+		// the lengths separate the fields, so the values of different
+		// fields never make the same ID by their concatenations.
+		v := fmt.Sprintf("%v", value)
+		fmt.Fprintf(hash, "%d:%s%d:%s", len(field), field, len(v), v)
+	}
+	doc = maps.Clone(doc)
+	doc["id"] = hex.EncodeToString(hash.Sum(nil))
+	return doc, nil
+}
+
+// resolveAll is resolve of every document of an insert, the documents are
+// cloned only if their IDs are derived.
+func (ids documentIDs) resolveAll(docs []map[string]any) ([]map[string]any, error) {
+	if !ids.required && len(ids.fields) == 0 {
+		return docs, nil
+	}
+	resolved := make([]map[string]any, len(docs))
+	for i, doc := range docs {
+		doc, err := ids.resolve(i, doc)
+		if err != nil {
+			return nil, err
+		}
+		resolved[i] = doc
+	}
+	return resolved, nil
+}
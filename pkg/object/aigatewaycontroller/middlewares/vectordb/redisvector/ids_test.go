@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocumentIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	url := "redis://localhost:6379"
+	assert.NoError(ValidateSpec(&RedisVectorDBSpec{URL: url, RequireExplicitID: true}))
+	assert.NoError(ValidateSpec(&RedisVectorDBSpec{URL: url, IDFields: []string{"prompt", "model"}}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, RequireExplicitID: true, IDFields: []string{"prompt"}}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, IDFields: []string{"id"}}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, IDFields: []string{"prompt", "prompt"}}))
+
+	// the documents are kept as is by default to be given UUIDs.
+	doc := map[string]any{"prompt": "hi"}
+	resolved, err := documentIDs{}.resolve(0, doc)
+	assert.NoError(err)
+	assert.NotContains(resolved, "id")
+
+	ids := documentIDs{required: true}
+	_, err = ids.resolveAll([]map[string]any{{"id": "1"}, doc})
+	var required *ErrDocumentIDRequired
+	assert.ErrorAs(err, &required)
+	assert.Equal(1, required.Index)
+	assert.Equal("document 1 has no id", err.Error())
+
+	ids = documentIDs{fields: []string{"prompt", "model"}}
+	a, err := ids.resolve(0, map[string]any{"prompt": "hi", "model": "gpt", "answer": "a"})
+	assert.NoError(err)
+	b, err := ids.resolve(0, map[string]any{"prompt": "hi", "model": "gpt", "answer": "b"})
+	assert.NoError(err)
+	assert.Len(a["id"], 64)
+	assert.Equal(a["id"], b["id"])
+	// the fields are separated by their lengths.
+	c, err := ids.resolve(0, map[string]any{"prompt": "hig", "model": "pt"})
+	assert.NoError(err)
+	assert.NotEqual(a["id"], c["id"])
+	// the explicit ID is kept.
+	d, err := ids.resolve(0, map[string]any{"id": "42", "prompt": "hi", "model": "gpt"})
+	assert.NoError(err)
+	assert.Equal("42", d["id"])
+	_, err = ids.resolve(2, doc)
+	assert.ErrorAs(err, &required)
+	assert.Equal("document 2 has no id or field model to derive its id", err.Error())
+	assert.NotContains(doc, "id")
+}
+
+func TestInsertWithDocumentIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	var keys []string
+	r := newFakeRedis(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "HMSET" {
+			keys = append(keys, args[1])
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	client.ids = documentIDs{required: true}
+	_, err := client.InsertWithHash(ctx, "movie", map[string]any{"title": "a"})
+	assert.ErrorAs(err, new(*ErrDocumentIDRequired))
+	_, err = client.InsertManyWithHash(ctx, "movie", []map[string]any{{"id": "1", "title": "a"}, {"title": "b"}})
+	assert.ErrorContains(err, "document 1 has no id")
+	assert.Empty(keys)
+
+	// identical inserts write the same key.
+	client.ids = documentIDs{fields: []string{"title"}}
+	first, err := client.InsertWithHash(ctx, "movie", map[string]any{"title": "a"})
+	assert.NoError(err)
+	results, err := client.InsertManyWithHash(ctx, "movie", []map[string]any{{"title": "a"}, {"title": "b"}})
+	assert.NoError(err)
+	assert.Equal(first, results[0].ID)
+	assert.NotEqual(first, results[1].ID)
+	assert.True(strings.HasPrefix(first, "movie:"))
+	assert.Equal([]string{first, first, results[1].ID}, keys)
+}
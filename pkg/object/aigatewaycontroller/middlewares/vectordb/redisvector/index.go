@@ -18,6 +18,7 @@
 package redisvector
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -29,13 +30,47 @@ import (
 // TODO: This file is a placeholder for the Redis Index(which is equals to the database).
 // It should be implemented with the schema operations and search operations.
 
+const (
+	// IndexTypeHash indexes documents stored as hashes.
+	IndexTypeHash IndexType = "HASH"
+	// IndexTypeJSON indexes documents stored as JSON, which keeps nested
+	// objects and arrays of documents.
+	IndexTypeJSON IndexType = "JSON"
+)
+
+// The data types of vector fields, the vectors of documents and queries are
+// encoded in the data types of their fields.
+const (
+	// VectorDataTypeFloat32 is the default data type of vector fields.
+	VectorDataTypeFloat32 VectorDataType = "FLOAT32"
+	// VectorDataTypeFloat64 doubles the memory of FLOAT32 vectors.
+	VectorDataTypeFloat64 VectorDataType = "FLOAT64"
+	// VectorDataTypeFloat16 halves the memory of FLOAT32 vectors, at the
+	// cost of the precision of the distances.
+	VectorDataTypeFloat16 VectorDataType = "FLOAT16"
+	// VectorDataTypeBFloat16 is not supported by the encoders of the
+	// client, the vectors of its fields are encoded as FLOAT32.
+	VectorDataTypeBFloat16 VectorDataType = "BFLOAT16"
+)
+
+// The distance metrics of vector fields.
+const (
+	// DistanceMetricCosine is the cosine distance, 1 - cos(a, b).
+	DistanceMetricCosine DistanceMetric = "COSINE"
+	// DistanceMetricL2 is the euclidean distance.
+	DistanceMetricL2 DistanceMetric = "L2"
+	// DistanceMetricIP is the inner product distance, 1 - a·b, which
+	// equals the cosine distance for vectors of the unit norm.
+	DistanceMetricIP DistanceMetric = "IP"
+)
+
 var (
 	validPhoneticMatcherTypes = []PhoneticMatcherType{
 		"dm:en", "dm:fr", "dm:pt", "dm:es",
 	}
 
 	validVectorDataTypes = []VectorDataType{
-		"FLOAT32", "FLOAT64", "BFLOAT16", "FLOAT16",
+		VectorDataTypeFloat32, VectorDataTypeFloat64, VectorDataTypeBFloat16, VectorDataTypeFloat16,
 	}
 
 	validVectorAlgorithms = []VectorAlgorithm{
@@ -43,11 +78,11 @@ var (
 	}
 
 	validDistanceMetrics = []DistanceMetric{
-		"L2", "COSINE", "IP",
+		DistanceMetricL2, DistanceMetricCosine, DistanceMetricIP,
 	}
 
 	validIndexTypes = []IndexType{
-		"HASH", "JSON",
+		IndexTypeHash, IndexTypeJSON,
 	}
 )
 
@@ -110,6 +145,10 @@ type (
 		Texts    []Text
 		Numerics []Numeric
 		Vectors  []Vector
+		// Stored are the fields of documents returned by searches without
+		// being indexed, so they can be added to the schemas of existing
+		// indexes.
+		Stored []string
 		// TODO: GEO and GEOSHAPE
 	}
 
@@ -117,6 +156,34 @@ type (
 		Commands []string
 		Keys     []string
 		Args     []string
+		// redacted are the indexes of the arguments elided by Redacted,
+		// like the vectors of queries.
+		redacted []int
+	}
+
+	// VectorIndexSpec describes the algorithm of the vector fields of the
+	// indexes created. FLAT searches exhaustively, which is exact and fast
+	// enough for small datasets, and HNSW searches a graph, which trades
+	// recall for latency on large datasets.
+	VectorIndexSpec struct {
+		// Algorithm is FLAT by default.
+		Algorithm string `json:"algorithm,omitempty" jsonschema:"enum=,enum=FLAT,enum=HNSW"`
+		// M is the max number of edges of a node in the HNSW graph,
+		// RediSearch defaults it to 16.
+		M int `json:"m,omitempty"`
+		// EFConstruction is the number of candidates kept while building
+		// the HNSW graph, RediSearch defaults it to 200.
+		EFConstruction int `json:"efConstruction,omitempty"`
+		// EFRuntime is the number of candidates kept by KNN queries by
+		// default, RediSearch defaults it to 10. Queries can override it.
+		EFRuntime int `json:"efRuntime,omitempty"`
+		// DistanceMetric is COSINE by default. The distances of all
+		// metrics are normalized to similarities between 0 and 1, which
+		// are compared with the threshold.
+		DistanceMetric string `json:"distanceMetric,omitempty" jsonschema:"enum=,enum=COSINE,enum=L2,enum=IP"`
+		// VectorType is the data type of the vectors, FLOAT32 by default.
+		// FLOAT16 halves the memory of vectors.
+		VectorType string `json:"vectorType,omitempty" jsonschema:"enum=,enum=FLOAT32,enum=FLOAT64,enum=FLOAT16"`
 	}
 
 	Index struct {
@@ -137,6 +204,97 @@ type (
 
 var _ vecdbtypes.Schema = (*IndexSchema)(nil)
 
+// ValidateVectorIndexSpec validates the vector index spec.
+func ValidateVectorIndexSpec(spec *VectorIndexSpec) error {
+	if spec.DistanceMetric != "" && !slices.Contains(validDistanceMetrics, DistanceMetric(spec.DistanceMetric)) {
+		return fmt.Errorf("invalid distance metric %s", spec.DistanceMetric)
+	}
+	if spec.Algorithm != "" && !slices.Contains(validVectorAlgorithms, VectorAlgorithm(spec.Algorithm)) {
+		return fmt.Errorf("invalid algorithm %s", spec.Algorithm)
+	}
+	switch VectorDataType(spec.VectorType) {
+	case "", VectorDataTypeFloat32, VectorDataTypeFloat64, VectorDataTypeFloat16:
+	default:
+		return fmt.Errorf("invalid vector type %s", spec.VectorType)
+	}
+	if spec.Algorithm != "HNSW" {
+		if spec.M != 0 || spec.EFConstruction != 0 || spec.EFRuntime != 0 {
+			return fmt.Errorf("m, efConstruction and efRuntime are only supported by HNSW")
+		}
+		return nil
+	}
+	switch {
+	case spec.M != 0 && spec.M < 2:
+		return fmt.Errorf("m %d must be at least 2", spec.M)
+	case spec.EFConstruction < 0:
+		return fmt.Errorf("efConstruction %d must not be negative", spec.EFConstruction)
+	case spec.EFConstruction != 0 && spec.EFConstruction < spec.M:
+		return fmt.Errorf("efConstruction %d must not be less than m %d", spec.EFConstruction, spec.M)
+	case spec.EFRuntime < 0:
+		return fmt.Errorf("efRuntime %d must not be negative", spec.EFRuntime)
+	}
+	return nil
+}
+
+// apply returns the schema with the vector fields of no algorithm set to
+// the algorithm of the spec, and the ones of no distance metric or vector
+// type set to the ones of the spec, the schema is not modified.
+func (spec *VectorIndexSpec) apply(schema *IndexSchema) *IndexSchema {
+	if spec == nil || (spec.Algorithm == "" && spec.DistanceMetric == "" && spec.VectorType == "") || schema == nil {
+		return schema
+	}
+	applied := *schema
+	applied.Vectors = slices.Clone(schema.Vectors)
+	for i := range applied.Vectors {
+		v := &applied.Vectors[i]
+		if v.DistanceMetric == "" {
+			v.DistanceMetric = DistanceMetric(spec.DistanceMetric)
+		}
+		if v.VectorType == "" {
+			v.VectorType = VectorDataType(spec.VectorType)
+		}
+		if v.Algorithm != "" || spec.Algorithm == "" {
+			continue
+		}
+		v.Algorithm = VectorAlgorithm(spec.Algorithm)
+		v.M = spec.M
+		v.EfConstruction = spec.EFConstruction
+		v.EfRuntime = spec.EFRuntime
+	}
+	return &applied
+}
+
+// orDefault returns the metric, or COSINE if it is not valid, which is the
+// metric of the vector fields rendered.
+func (m DistanceMetric) orDefault() DistanceMetric {
+	if slices.Contains(validDistanceMetrics, m) {
+		return m
+	}
+	return DistanceMetricCosine
+}
+
+// Similarity normalizes the distance of the metric reported by RediSearch
+// to a similarity between 0 and 1, the larger the more similar, so the
+// score thresholds behave the same regardless of the metric. The cosine
+// and inner product similarities are 1 - distance, clamped to 0 and 1,
+// and the L2 similarity is 1 / (1 + distance).
+func (m DistanceMetric) Similarity(distance float64) float64 {
+	if m.orDefault() == DistanceMetricL2 {
+		return 1 / (1 + max(distance, 0))
+	}
+	return min(max(1-distance, 0), 1)
+}
+
+// distanceThreshold returns the largest distance of the metric whose
+// similarity is at least the score threshold, which is between 0 and 1
+// exclusively.
+func (m DistanceMetric) distanceThreshold(scoreThreshold float64) float64 {
+	if m.orDefault() == DistanceMetricL2 {
+		return 1/scoreThreshold - 1
+	}
+	return 1 - scoreThreshold
+}
+
 func (t *Tag) ToCommand() []string {
 	commands := []string{t.Name}
 	if t.As != "" {
@@ -229,11 +387,7 @@ func (v *Vector) ToCommand() []string {
 	}
 
 	args := make([]string, 0)
-	if slices.Contains(validVectorDataTypes, v.VectorType) {
-		args = append(args, "TYPE", string(v.VectorType))
-	} else {
-		args = append(args, "TYPE", "FLOAT32")
-	}
+	args = append(args, "TYPE", string(v.vectorTypeOrDefault()))
 
 	if v.Dim > 0 {
 		args = append(args, "DIM", strconv.Itoa(v.Dim))
@@ -241,13 +395,15 @@ func (v *Vector) ToCommand() []string {
 		args = append(args, "DIM", "128")
 	}
 
-	if slices.Contains(validDistanceMetrics, v.DistanceMetric) {
-		args = append(args, "DISTANCE_METRIC", string(v.DistanceMetric))
-	} else {
-		args = append(args, "DISTANCE_METRIC", "COSINE")
-	}
+	args = append(args, "DISTANCE_METRIC", string(v.DistanceMetric.orDefault()))
 
 	count := 3
+	// the parameters of HNSW are rejected by FLAT.
+	if v.Algorithm != "HNSW" {
+		commands = append(commands, strconv.Itoa(count*2))
+		commands = append(commands, args...)
+		return commands
+	}
 	if v.M > 0 {
 		args = append(args, "M", strconv.Itoa(v.M))
 		count++
@@ -270,6 +426,82 @@ func (v *Vector) ToCommand() []string {
 	return commands
 }
 
+// distanceMetric returns the distance metric of the vector field, which is
+// looked up by its name or alias, COSINE if it is not found.
+func (s *IndexSchema) distanceMetric(field string) DistanceMetric {
+	if s == nil {
+		return DistanceMetricCosine
+	}
+	for _, v := range s.Vectors {
+		if v.Name == field || (v.As != "" && v.As == field) {
+			return v.DistanceMetric.orDefault()
+		}
+	}
+	return DistanceMetricCosine
+}
+
+// isSortable returns whether the field, which is named by its name or
+// alias, is a tag, text or numeric field declared sortable.
+func (s *IndexSchema) isSortable(field string) bool {
+	named := func(name, as string) bool {
+		return name == field || (as != "" && as == field)
+	}
+	return slices.ContainsFunc(s.Tags, func(t Tag) bool { return t.Sortable && named(t.Name, t.As) }) ||
+		slices.ContainsFunc(s.Texts, func(t Text) bool { return t.Sortable && named(t.Name, t.As) }) ||
+		slices.ContainsFunc(s.Numerics, func(n Numeric) bool { return n.Sortable && named(n.Name, n.As) })
+}
+
+// vectorType returns the data type of the vector field, which is named by
+// its name or alias, it is FLOAT32 if the field is not in the schema.
+func (s *IndexSchema) vectorType(field string) VectorDataType {
+	if s == nil {
+		return VectorDataTypeFloat32
+	}
+	for _, v := range s.Vectors {
+		if v.Name == field || (v.As != "" && v.As == field) {
+			return v.vectorTypeOrDefault()
+		}
+	}
+	return VectorDataTypeFloat32
+}
+
+// vectorTypes returns the data types of the vector fields by their names,
+// which are the fields of documents.
+func (s *IndexSchema) vectorTypes() map[string]VectorDataType {
+	if s == nil || len(s.Vectors) == 0 {
+		return nil
+	}
+	types := make(map[string]VectorDataType, len(s.Vectors))
+	for _, v := range s.Vectors {
+		types[v.Name] = v.vectorTypeOrDefault()
+	}
+	return types
+}
+
+// withVectorTypes returns the schema with the data types of the vector
+// fields set to the ones of the fields by their names, the schema is not
+// modified.
+func (s *IndexSchema) withVectorTypes(types map[string]string) *IndexSchema {
+	result := *s
+	result.Vectors = slices.Clone(s.Vectors)
+	for i := range result.Vectors {
+		v := &result.Vectors[i]
+		if dataType, ok := types[v.Name]; ok {
+			v.VectorType = VectorDataType(dataType)
+		}
+	}
+	return &result
+}
+
+// vectorTypeOrDefault returns the data type of the field, or FLOAT32 if it
+// is not valid, which is the data type of the vector fields rendered.
+func (v *Vector) vectorTypeOrDefault() VectorDataType {
+	if slices.Contains(validVectorDataTypes, v.VectorType) {
+		return v.VectorType
+	}
+	return VectorDataTypeFloat32
+}
+
 func (s *IndexSchema) SchemaType() string {
 	return "redis"
 }
@@ -293,7 +525,7 @@ func (s *IndexSchema) GetDefaultSelectedFields() []string {
 		fields = append(fields, vector.Name)
 	}
 
-	return fields
+	return append(fields, s.Stored...)
 }
 
 func (s *IndexSchema) ToCommand() []string {
@@ -326,6 +558,37 @@ func (s *IndexSchema) ToCommand() []string {
 	return commands
 }
 
+// jsonPaths returns a copy of the schema whose fields are the JSON paths
+// of the top level fields of documents, aliased as the field names, so
+// queries refer to the fields the same way as the fields of hashes.
+func (s *IndexSchema) jsonPaths() *IndexSchema {
+	schema := &IndexSchema{
+		Tags:     slices.Clone(s.Tags),
+		Texts:    slices.Clone(s.Texts),
+		Numerics: slices.Clone(s.Numerics),
+		Vectors:  slices.Clone(s.Vectors),
+	}
+	path := func(name, as *string) {
+		if *as == "" {
+			*as = *name
+		}
+		*name = "$." + *name
+	}
+	for i := range schema.Tags {
+		path(&schema.Tags[i].Name, &schema.Tags[i].As)
+	}
+	for i := range schema.Texts {
+		path(&schema.Texts[i].Name, &schema.Texts[i].As)
+	}
+	for i := range schema.Numerics {
+		path(&schema.Numerics[i].Name, &schema.Numerics[i].As)
+	}
+	for i := range schema.Vectors {
+		path(&schema.Vectors[i].Name, &schema.Vectors[i].As)
+	}
+	return schema
+}
+
 func (i *Index) ToCommand() *RedisArbitraryCommand {
 	command := &RedisArbitraryCommand{
 		Commands: []string{"FT.CREATE"},
@@ -345,7 +608,7 @@ func (i *Index) ToCommand() *RedisArbitraryCommand {
 		command.Args = append(command.Args, "PREFIX", strconv.Itoa(len(i.Prefix)))
 		command.Args = append(command.Args, i.Prefix...)
 	} else {
-		command.Args = append(command.Args, "PREFIX", "1", getPrefix(i.Name))
+		command.Args = append(command.Args, "PREFIX", "1", keyLayout{}.getPrefix(i.Name))
 	}
 
 	if i.Filter != "" {
@@ -383,7 +646,11 @@ func (i *Index) ToCommand() *RedisArbitraryCommand {
 
 	command.Args = append(command.Args, "SCHEMA")
 	if i.Schema != nil {
-		schemaCommands := i.Schema.ToCommand()
+		schema := i.Schema
+		if i.IndexType == IndexTypeJSON {
+			schema = schema.jsonPaths()
+		}
+		schemaCommands := schema.ToCommand()
 		command.Args = append(command.Args, schemaCommands...)
 	}
 
@@ -400,3 +667,17 @@ func (c *RedisArbitraryCommand) ToString() string {
 	}
 	return strings.Join(cmd, " ")
 }
+
+// Redacted returns the command like ToString with the binary arguments,
+// like the vectors of queries, replaced by their sizes, so it is safe to
+// log.
+func (c *RedisArbitraryCommand) Redacted() string {
+	args := slices.Clone(c.Args)
+	for _, i := range c.redacted {
+		if i < len(args) {
+			args[i] = fmt.Sprintf("<%d bytes>", len(args[i]))
+		}
+	}
+	redacted := RedisArbitraryCommand{Commands: c.Commands, Keys: c.Keys, Args: args}
+	return redacted.ToString()
+}
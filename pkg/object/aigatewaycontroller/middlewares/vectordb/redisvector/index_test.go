@@ -18,6 +18,7 @@
 package redisvector
 
 import (
+	"math"
 	"strings"
 	"testing"
 )
@@ -166,6 +167,16 @@ func TestVectorToCommand(t *testing.T) {
 			},
 			command: "movie vector AS vector VECTOR HNSW 14 TYPE BFLOAT16 DIM 256 DISTANCE_METRIC L2 M 16 EF_CONSTRUCTION 200 EF_RUNTIME 2000 EPSILON 0.1",
 		},
+		{
+			name: "flat vector ignoring HNSW options",
+			vector: Vector{
+				Name:           "movie vector",
+				Algorithm:      "FLAT",
+				M:              16,
+				EfConstruction: 200,
+			},
+			command: "movie vector VECTOR FLAT 6 TYPE FLOAT32 DIM 128 DISTANCE_METRIC COSINE",
+		},
 	}
 
 	for _, tt := range tests {
@@ -178,6 +189,116 @@ func TestVectorToCommand(t *testing.T) {
 	}
 }
 
+func TestVectorIndexSpec(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  VectorIndexSpec
+		valid bool
+	}{
+		{"default", VectorIndexSpec{}, true},
+		{"flat", VectorIndexSpec{Algorithm: "FLAT"}, true},
+		{"hnsw", VectorIndexSpec{Algorithm: "HNSW", M: 16, EFConstruction: 200, EFRuntime: 50}, true},
+		{"unknown algorithm", VectorIndexSpec{Algorithm: "IVF"}, false},
+		{"flat with HNSW options", VectorIndexSpec{Algorithm: "FLAT", M: 16}, false},
+		{"m less than 2", VectorIndexSpec{Algorithm: "HNSW", M: 1}, false},
+		{"efConstruction less than m", VectorIndexSpec{Algorithm: "HNSW", M: 32, EFConstruction: 16}, false},
+		{"negative efRuntime", VectorIndexSpec{Algorithm: "HNSW", EFRuntime: -1}, false},
+		{"distance metric", VectorIndexSpec{DistanceMetric: "IP"}, true},
+		{"unknown distance metric", VectorIndexSpec{DistanceMetric: "HAMMING"}, false},
+		{"vector type", VectorIndexSpec{VectorType: "FLOAT16"}, true},
+		{"unsupported vector type", VectorIndexSpec{VectorType: "BFLOAT16"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateVectorIndexSpec(&tt.spec)
+			if tt.valid != (err == nil) {
+				t.Errorf("ValidateVectorIndexSpec() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+
+	schema := &IndexSchema{Vectors: []Vector{{Name: "embedding", Dim: 3}, {Name: "flat", Algorithm: "FLAT"}}}
+	spec := &VectorIndexSpec{Algorithm: "HNSW", M: 8, EFConstruction: 100, EFRuntime: 20}
+	applied := spec.apply(schema)
+	if got := strings.Join(applied.Vectors[0].ToCommand(), " "); got != "embedding VECTOR HNSW 12 TYPE FLOAT32 DIM 3 DISTANCE_METRIC COSINE M 8 EF_CONSTRUCTION 100 EF_RUNTIME 20" {
+		t.Errorf("applied vector = %v", got)
+	}
+	// the vectors with their own algorithm and the schema are not changed.
+	if applied.Vectors[1].Algorithm != "FLAT" || schema.Vectors[0].Algorithm != "" {
+		t.Errorf("apply() changed the vectors with algorithm or the schema")
+	}
+	var none *VectorIndexSpec
+	if none.apply(schema) != schema {
+		t.Errorf("apply() of nil spec changed the schema")
+	}
+
+	// the distance metric is applied alone, to the vectors of no metric.
+	schema.Vectors = append(schema.Vectors, Vector{Name: "ip", DistanceMetric: DistanceMetricIP})
+	applied = (&VectorIndexSpec{DistanceMetric: "L2"}).apply(schema)
+	if got := strings.Join(applied.Vectors[0].ToCommand(), " "); got != "embedding VECTOR FLAT 6 TYPE FLOAT32 DIM 3 DISTANCE_METRIC L2" {
+		t.Errorf("applied vector = %v", got)
+	}
+	if applied.distanceMetric("ip") != DistanceMetricIP || applied.distanceMetric("embedding") != DistanceMetricL2 {
+		t.Errorf("apply() changed the vectors with distance metric")
+	}
+	if schema.distanceMetric("embedding") != DistanceMetricCosine || schema.distanceMetric("unknown") != DistanceMetricCosine {
+		t.Errorf("distance metric of vectors of no metric is not COSINE")
+	}
+
+	// the vector type is applied to the vectors of no type.
+	schema.Vectors = append(schema.Vectors, Vector{Name: "wide", As: "w", VectorType: VectorDataTypeFloat64})
+	applied = (&VectorIndexSpec{VectorType: "FLOAT16"}).apply(schema)
+	if got := strings.Join(applied.Vectors[0].ToCommand(), " "); got != "embedding VECTOR FLAT 6 TYPE FLOAT16 DIM 3 DISTANCE_METRIC COSINE" {
+		t.Errorf("applied vector = %v", got)
+	}
+	if applied.vectorType("embedding") != VectorDataTypeFloat16 || applied.vectorType("w") != VectorDataTypeFloat64 {
+		t.Errorf("apply() changed the vectors with vector type")
+	}
+	if types := applied.vectorTypes(); types["embedding"] != VectorDataTypeFloat16 || types["wide"] != VectorDataTypeFloat64 {
+		t.Errorf("vectorTypes() = %v", types)
+	}
+	if schema.vectorType("embedding") != VectorDataTypeFloat32 || schema.vectorType("unknown") != VectorDataTypeFloat32 {
+		t.Errorf("vector type of vectors of no type is not FLOAT32")
+	}
+
+	// the types of existing indexes override the ones of the spec.
+	existing := applied.withVectorTypes(map[string]string{"embedding": "FLOAT32"})
+	if existing.vectorType("embedding") != VectorDataTypeFloat32 || existing.vectorType("w") != VectorDataTypeFloat64 {
+		t.Errorf("withVectorTypes() = %v", existing.vectorTypes())
+	}
+	if applied.vectorType("embedding") != VectorDataTypeFloat16 {
+		t.Errorf("withVectorTypes() changed the schema")
+	}
+}
+
+func TestDistanceMetricSimilarity(t *testing.T) {
+	tests := []struct {
+		metric     DistanceMetric
+		distance   float64
+		similarity float64
+	}{
+		{DistanceMetricCosine, 0, 1},
+		{DistanceMetricCosine, 0.25, 0.75},
+		{DistanceMetricCosine, 1.5, 0},
+		{"", 0.25, 0.75},
+		{DistanceMetricIP, 0.4, 0.6},
+		{DistanceMetricIP, -0.5, 1},
+		{DistanceMetricL2, 0, 1},
+		{DistanceMetricL2, 3, 0.25},
+	}
+	for _, tt := range tests {
+		if got := tt.metric.Similarity(tt.distance); math.Abs(got-tt.similarity) > 1e-9 {
+			t.Errorf("%s.Similarity(%v) = %v, want %v", tt.metric, tt.distance, got, tt.similarity)
+		}
+		// the distance threshold of a similarity is the distance itself.
+		if tt.similarity > 0 && tt.similarity < 1 {
+			if got := tt.metric.distanceThreshold(tt.similarity); math.Abs(got-tt.distance) > 1e-9 {
+				t.Errorf("%s.distanceThreshold(%v) = %v, want %v", tt.metric, tt.similarity, got, tt.distance)
+			}
+		}
+	}
+}
+
 func TestIndexSchemaToCommand(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -202,6 +323,14 @@ func TestIndexSchemaToCommand(t *testing.T) {
 			},
 			command: "genre TAG SEPARATOR , title TEXT rating NUMERIC embedding VECTOR FLAT 6 TYPE FLOAT32 DIM 128 DISTANCE_METRIC COSINE",
 		},
+		{
+			name: "stored fields",
+			schema: IndexSchema{
+				Texts:  []Text{{Name: "title"}},
+				Stored: []string{"views"},
+			},
+			command: "title TEXT",
+		},
 	}
 
 	for _, tt := range tests {
@@ -212,6 +341,12 @@ func TestIndexSchemaToCommand(t *testing.T) {
 			}
 		})
 	}
+
+	// the stored fields are returned by searches, but never indexed.
+	schema := &IndexSchema{Texts: []Text{{Name: "title"}}, Stored: []string{"views"}}
+	if got := schema.GetDefaultSelectedFields(); strings.Join(got, " ") != "title views" {
+		t.Errorf("IndexSchema.GetDefaultSelectedFields() = %v, want [title views]", got)
+	}
 }
 
 func TestIndexToCommand(t *testing.T) {
@@ -242,6 +377,23 @@ func TestIndexToCommand(t *testing.T) {
 			},
 			command: "FT.CREATE movies ON HASH PREFIX 1 doc:movies SCORE 1.0 SCHEMA genre TAG SEPARATOR , title TEXT rating NUMERIC embedding VECTOR FLAT 6 TYPE FLOAT32 DIM 128 DISTANCE_METRIC COSINE",
 		},
+		{
+			name: "json index",
+			index: Index{
+				Name:      "movies",
+				Prefix:    []string{"doc:movies"},
+				IndexType: IndexTypeJSON,
+				Schema: &IndexSchema{
+					Tags: []Tag{
+						{Name: "genre"},
+					},
+					Vectors: []Vector{
+						{Name: "embedding"},
+					},
+				},
+			},
+			command: "FT.CREATE movies ON JSON PREFIX 1 doc:movies SCORE 1.0 SCHEMA $.genre AS genre TAG SEPARATOR , $.embedding AS embedding VECTOR FLAT 6 TYPE FLOAT32 DIM 128 DISTANCE_METRIC COSINE",
+		},
 		{
 			name: "index with all options",
 			index: Index{
@@ -271,7 +423,7 @@ func TestIndexToCommand(t *testing.T) {
 				NoOffset:      true,
 				NoFields:      true,
 			},
-			command: "FT.CREATE movies ON JSON PREFIX 1 doc:movies FILTER @genre:{action} @rating:[1.0 5.0] LANGUAGE english LANGUAGE_FIELD title SCORE 1.5 SCORE_FIELD rating MAXTEXTFIELDS 10 NOOFFSET NOFIELDS SCHEMA genre AS g TAG SEPARATOR | CASESENSITIVE SORTABLE NOINDEX INDEXMISSING INDEXEMPTY title AS t TEXT WEIGHT 1.5 WITHSUFFIXTRIE SORTABLE NOINDEX PHONETIC dm:en INDEXMISSING INDEXEMPTY rating AS r NUMERIC SORTABLE INDEXMISSING NOINDEX embedding AS e VECTOR HNSW 14 TYPE BFLOAT16 DIM 256 DISTANCE_METRIC L2 M 16 EF_CONSTRUCTION 200 EF_RUNTIME 2000 EPSILON 0.1",
+			command: "FT.CREATE movies ON JSON PREFIX 1 doc:movies FILTER @genre:{action} @rating:[1.0 5.0] LANGUAGE english LANGUAGE_FIELD title SCORE 1.5 SCORE_FIELD rating MAXTEXTFIELDS 10 NOOFFSET NOFIELDS SCHEMA $.genre AS g TAG SEPARATOR | CASESENSITIVE SORTABLE NOINDEX INDEXMISSING INDEXEMPTY $.title AS t TEXT WEIGHT 1.5 WITHSUFFIXTRIE SORTABLE NOINDEX PHONETIC dm:en INDEXMISSING INDEXEMPTY $.rating AS r NUMERIC SORTABLE INDEXMISSING NOINDEX $.embedding AS e VECTOR HNSW 14 TYPE BFLOAT16 DIM 256 DISTANCE_METRIC L2 M 16 EF_CONSTRUCTION 200 EF_RUNTIME 2000 EPSILON 0.1",
 		},
 	}
 
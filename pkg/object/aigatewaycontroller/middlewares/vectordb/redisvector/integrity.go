@@ -0,0 +1,636 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// DefaultIntegritySampleSize is the default number of the documents
+	// verified to be found by their own vectors.
+	DefaultIntegritySampleSize = 20
+	// DefaultIntegrityKeysPerSecond is the default cap of the keys scanned
+	// or touched per second.
+	DefaultIntegrityKeysPerSecond = 1000
+
+	IntegrityStatusRunning   = "running"
+	IntegrityStatusCompleted = "completed"
+	IntegrityStatusFailed    = "failed"
+	// IntegrityStatusNoIndex means the index of the collection does not
+	// exist, so there is nothing to check.
+	IntegrityStatusNoIndex = "noIndex"
+
+	integrityBatchSize = 100
+	// integrityNeighbors is the number of the neighbors searched for a
+	// sampled document, it is more than 1 in case of duplicated vectors.
+	integrityNeighbors = 10
+	integrityLockTTL   = 30 * time.Second
+	// integrityRecordTTL is how long the record of the last check is kept.
+	integrityRecordTTL = 7 * 24 * time.Hour
+)
+
+var (
+	// touchDocumentScript writes a field of the document with its own
+	// value, so the search module indexes the document again.
+	touchDocumentScript = rueidis.NewLuaScript(`
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if v then
+	redis.call('HSET', KEYS[1], ARGV[1], v)
+	return 1
+end
+return 0
+`)
+
+	// integrityScheduleInterval is the interval to check whether the
+	// scheduled window is open.
+	integrityScheduleInterval = time.Minute
+
+	// ErrIntegrityCheckRunning means the collection is being checked, by
+	// this process or others.
+	ErrIntegrityCheckRunning = errors.New("integrity check is running")
+
+	// integrityChecks are the checks started by this process, they are
+	// kept after completion to report the results.
+	integrityChecksLock sync.Mutex
+	integrityChecks     = map[string]*integrityCheck{}
+)
+
+type (
+	// IntegritySpec configures the checks of whether the documents under
+	// the prefixes of indexes are all indexed. Documents written while
+	// the search module is recovering, e.g. after a failover, may never be
+	// indexed, so they are never hit.
+	IntegritySpec struct {
+		// Window is the daily window of the scheduled checks in UTC, like
+		// "02:00-04:00", each index is checked once in a window by one
+		// member. The checks only run by the admin API if it is empty.
+		Window string `json:"window,omitempty"`
+		// Repair touches the documents to be indexed again when the
+		// scheduled checks find discrepancies.
+		Repair        bool `json:"repair,omitempty"`
+		SampleSize    int  `json:"sampleSize,omitempty"`
+		KeysPerSecond int  `json:"keysPerSecond,omitempty"`
+	}
+
+	// integrityWindow is the daily window of the scheduled checks, the
+	// offsets are from the midnight in UTC, end is before start if the
+	// window spans midnight.
+	integrityWindow struct {
+		start time.Duration
+		end   time.Duration
+	}
+
+	// integrityCheck checks an index, the check holds a lock in Redis, so
+	// an index is checked by one member at a time.
+	integrityCheck struct {
+		client rueidis.Client
+		index  string
+		spec   *IntegritySpec
+		keys   keyLayout
+		owner  string
+
+		lock   sync.Mutex
+		report vecdbtypes.IntegrityReport
+	}
+)
+
+var _ vecdbtypes.IntegrityChecker = (*RedisVectorDB)(nil)
+
+// ValidateIntegritySpec validates the spec of integrity checks.
+func ValidateIntegritySpec(spec *IntegritySpec) error {
+	if spec.Window != "" {
+		if _, err := parseIntegrityWindow(spec.Window); err != nil {
+			return err
+		}
+	}
+	if spec.SampleSize < 0 {
+		return fmt.Errorf("sampleSize must not be negative")
+	}
+	if spec.KeysPerSecond < 0 {
+		return fmt.Errorf("keysPerSecond must not be negative")
+	}
+	return nil
+}
+
+// GetSampleSize returns the number of the sampled documents.
+func (spec *IntegritySpec) GetSampleSize() int {
+	if spec.SampleSize > 0 {
+		return spec.SampleSize
+	}
+	return DefaultIntegritySampleSize
+}
+
+// GetKeysPerSecond returns the cap of the keys scanned per second.
+func (spec *IntegritySpec) GetKeysPerSecond() int {
+	if spec.KeysPerSecond > 0 {
+		return spec.KeysPerSecond
+	}
+	return DefaultIntegrityKeysPerSecond
+}
+
+func parseIntegrityWindow(s string) (*integrityWindow, error) {
+	parse := func(hm string) (time.Duration, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(hm))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid window %s, it should be like 02:00-04:00", s)
+	}
+	w := &integrityWindow{}
+	var err1, err2 error
+	w.start, err1 = parse(start)
+	w.end, err2 = parse(end)
+	if err1 != nil || err2 != nil || w.start == w.end {
+		return nil, fmt.Errorf("invalid window %s, it should be like 02:00-04:00", s)
+	}
+	return w, nil
+}
+
+// opened returns when the window containing now is opened, it is zero if
+// now is out of the window.
+func (w *integrityWindow) opened(now time.Time) time.Time {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	offset := now.Sub(midnight)
+	switch {
+	case w.start < w.end && offset >= w.start && offset < w.end:
+		return midnight.Add(w.start)
+	case w.start > w.end && offset >= w.start:
+		return midnight.Add(w.start)
+	case w.start > w.end && offset < w.end:
+		// the window is opened yesterday.
+		return midnight.Add(w.start - 24*time.Hour)
+	}
+	return time.Time{}
+}
+
+func getIntegrityKey(index string) string {
+	return fmt.Sprintf("integrity:{%s}", index)
+}
+
+func getIntegrityLockKey(index string) string {
+	return fmt.Sprintf("integrity:{%s}:lock", index)
+}
+
+func (r *RedisVectorDB) integritySpec() *IntegritySpec {
+	if r.Spec.Integrity != nil {
+		return r.Spec.Integrity
+	}
+	return &IntegritySpec{}
+}
+
+// StartIntegrityCheck starts checking the index in the background.
+func (r *RedisVectorDB) StartIntegrityCheck(name string, repair bool) (_ *vecdbtypes.IntegrityReport, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if r.Spec.Shards != nil {
+		return nil, fmt.Errorf("integrity checks are not supported with shards")
+	}
+	c, err := startIntegrityCheck(r.Spec.ConnectionURL(), name, r.getKeyLayout(), r.integritySpec(), repair, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.getReport(), nil
+}
+
+// IntegrityReport returns the report of the last check of the index
+// started by this process.
+func (r *RedisVectorDB) IntegrityReport(name string) *vecdbtypes.IntegrityReport {
+	integrityChecksLock.Lock()
+	c := integrityChecks[r.Spec.ConnectionURL()+"|"+name]
+	integrityChecksLock.Unlock()
+	if c == nil {
+		return nil
+	}
+	return c.getReport()
+}
+
+// ScheduleIntegrityChecks checks the indexes once in every window of the
+// spec, the returned stop is a no-op if there is no window.
+func (r *RedisVectorDB) ScheduleIntegrityChecks(names []string) func() {
+	spec := r.integritySpec()
+	window, err := parseIntegrityWindow(spec.Window)
+	if err != nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(integrityScheduleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				opened := window.opened(now)
+				if opened.IsZero() {
+					continue
+				}
+				for _, name := range names {
+					if err := r.runScheduledCheck(name, opened, spec); err != nil {
+						logger.Errorf("failed to run scheduled integrity check of index %s: %v", name, err)
+					}
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// runScheduledCheck starts checking the index unless it is checked in the
+// window opened, by this member or others.
+func (r *RedisVectorDB) runScheduledCheck(name string, opened time.Time, spec *IntegritySpec) error {
+	var lastStarted time.Time
+	err := r.withClient(func(client rueidis.Client) error {
+		v, err := client.Do(context.Background(), client.B().Hget().Key(getIntegrityKey(name)).Field("startedAt").Build()).ToString()
+		if rueidis.IsRedisNil(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lastStarted, _ = time.Parse(time.RFC3339Nano, v)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get the last integrity check: %w", err)
+	}
+	if !lastStarted.Before(opened) {
+		return nil
+	}
+	_, err = startIntegrityCheck(r.Spec.ConnectionURL(), name, r.getKeyLayout(), spec, spec.Repair, true)
+	if errors.Is(err, ErrIntegrityCheckRunning) {
+		return nil
+	}
+	return err
+}
+
+// startIntegrityCheck starts checking the index, it fails if the index is
+// being checked by this process or others.
+func startIntegrityCheck(url, index string, keys keyLayout, spec *IntegritySpec, repair, scheduled bool) (*integrityCheck, error) {
+	integrityChecksLock.Lock()
+	defer integrityChecksLock.Unlock()
+
+	key := url + "|" + index
+	if c, ok := integrityChecks[key]; ok && c.getReport().Status == IntegrityStatusRunning {
+		return nil, ErrIntegrityCheckRunning
+	}
+	clientOption, err := parseURL(url)
+	if err != nil {
+		return nil, NewErrParsingRedisURL("failed to parse Redis URL", err)
+	}
+	client, err := NewRedisClient(clientOption)
+	if err != nil {
+		return nil, NewErrCreateRedisClient("failed to create Redis client", err)
+	}
+	c := newIntegrityCheck(client.client, index, spec, repair, scheduled)
+	c.keys = keys
+	owned, err := c.acquire(context.Background())
+	if err != nil || !owned {
+		client.client.Close()
+		if err == nil {
+			err = ErrIntegrityCheckRunning
+		}
+		return nil, err
+	}
+	integrityChecks[key] = c
+	go func() {
+		defer client.client.Close()
+		c.run(context.Background())
+	}()
+	return c, nil
+}
+
+func newIntegrityCheck(client rueidis.Client, index string, spec *IntegritySpec, repair, scheduled bool) *integrityCheck {
+	return &integrityCheck{
+		client: client,
+		index:  index,
+		spec:   spec,
+		owner:  uuid.NewString(),
+		report: vecdbtypes.IntegrityReport{
+			Collection:   index,
+			Status:       IntegrityStatusRunning,
+			Scheduled:    scheduled,
+			Repair:       repair,
+			StartedAt:    time.Now().UTC().Format(time.RFC3339Nano),
+			Unsearchable: []string{},
+		},
+	}
+}
+
+func (c *integrityCheck) getReport() *vecdbtypes.IntegrityReport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	report := c.report
+	report.Unsearchable = append([]string{}, c.report.Unsearchable...)
+	return &report
+}
+
+func (c *integrityCheck) updateReport(fn func(r *vecdbtypes.IntegrityReport)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fn(&c.report)
+}
+
+// acquire acquires or renews the lock of the check, it returns false if
+// the lock is held by others.
+func (c *integrityCheck) acquire(ctx context.Context) (bool, error) {
+	key := getIntegrityLockKey(c.index)
+	ttl := strconv.FormatInt(integrityLockTTL.Milliseconds(), 10)
+	renewed, err := renewDrainLockScript.Exec(ctx, c.client, []string{key}, []string{c.owner, ttl}).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to renew integrity check lock: %w", err)
+	}
+	if renewed == 1 {
+		return true, nil
+	}
+	err = c.client.Do(ctx, c.client.B().Set().Key(key).Value(c.owner).Nx().Px(integrityLockTTL).Build()).Error()
+	if rueidis.IsRedisNil(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire integrity check lock: %w", err)
+	}
+	return true, nil
+}
+
+func (c *integrityCheck) run(ctx context.Context) {
+	err := c.check(ctx)
+	c.updateReport(func(r *vecdbtypes.IntegrityReport) {
+		r.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		if err != nil {
+			r.Status = IntegrityStatusFailed
+			r.Error = err.Error()
+		} else if r.Status == IntegrityStatusRunning {
+			r.Status = IntegrityStatusCompleted
+		}
+	})
+	report := c.getReport()
+	c.client.Do(ctx, c.client.B().Del().Key(getIntegrityLockKey(c.index)).Build())
+
+	switch {
+	case err != nil:
+		logger.Errorf("integrity check of index %s failed: %v", c.index, err)
+	case report.Missing > 0 || len(report.Unsearchable) > 0:
+		logger.Warnf("integrity check of index %s found %d keys not indexed of %d, %d of %d sampled documents unsearchable, %d documents touched",
+			c.index, report.Missing, report.ScannedKeys, len(report.Unsearchable), report.Sampled, report.Touched)
+	default:
+		logger.Infof("integrity check of index %s completed, %d keys scanned", c.index, report.ScannedKeys)
+	}
+}
+
+// check counts the keys under the prefix of the index against the
+// documents in the index, verifies that sampled documents are found by
+// their own vectors, and touches all documents if repair is enabled and
+// discrepancies are found.
+func (c *integrityCheck) check(ctx context.Context) error {
+	err := c.client.Do(ctx, c.client.B().Hset().Key(getIntegrityKey(c.index)).FieldValue().
+		FieldValue("startedAt", c.report.StartedAt).Build()).Error()
+	if err != nil {
+		return fmt.Errorf("failed to record integrity check: %w", err)
+	}
+	c.client.Do(ctx, c.client.B().Pexpire().Key(getIntegrityKey(c.index)).Milliseconds(integrityRecordTTL.Milliseconds()).Build())
+
+	field, err := c.vectorField(ctx)
+	if err != nil {
+		if isUnknownIndexError(err) {
+			c.updateReport(func(r *vecdbtypes.IntegrityReport) { r.Status = IntegrityStatusNoIndex })
+			return nil
+		}
+		return classifyError("failed to get vector field of index "+c.index, err)
+	}
+	before, err := c.numDocs(ctx)
+	if err != nil {
+		return err
+	}
+
+	sampleSize := c.spec.GetSampleSize()
+	samples := make([]string, 0, sampleSize)
+	var scanned int64
+	err = c.scan(ctx, func(keys []string) error {
+		for _, key := range keys {
+			scanned++
+			// reservoir sampling, every key has the same chance.
+			if len(samples) < sampleSize {
+				samples = append(samples, key)
+			} else if i := rand.Int63n(scanned); i < int64(sampleSize) {
+				samples[i] = key
+			}
+		}
+		c.updateReport(func(r *vecdbtypes.IntegrityReport) { r.ScannedKeys = scanned })
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	after, err := c.numDocs(ctx)
+	if err != nil {
+		return err
+	}
+	indexed := max(before, after)
+	c.updateReport(func(r *vecdbtypes.IntegrityReport) {
+		r.IndexedDocs = indexed
+		r.Missing = max(scanned-indexed, 0)
+	})
+
+	unsearchable, sampled, err := c.verifySamples(ctx, field, samples)
+	if err != nil {
+		return err
+	}
+	c.updateReport(func(r *vecdbtypes.IntegrityReport) {
+		r.Sampled = sampled
+		r.Unsearchable = unsearchable
+	})
+
+	if !c.report.Repair || (scanned <= indexed && len(unsearchable) == 0) {
+		return nil
+	}
+	var touched int64
+	err = c.scan(ctx, func(keys []string) error {
+		for _, key := range keys {
+			n, err := touchDocumentScript.Exec(ctx, c.client, []string{key}, []string{field}).AsInt64()
+			if err != nil {
+				return fmt.Errorf("failed to touch document %s: %w", key, err)
+			}
+			touched += n
+		}
+		c.updateReport(func(r *vecdbtypes.IntegrityReport) { r.Touched = touched })
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	after, err = c.numDocs(ctx)
+	if err != nil {
+		return err
+	}
+	c.updateReport(func(r *vecdbtypes.IntegrityReport) { r.IndexedAfterRepair = after })
+	return nil
+}
+
+// vectorField returns the vector field of the index, the first one in
+// name order if there are many.
+func (c *integrityCheck) vectorField(ctx context.Context) (string, error) {
+	fields, err := indexVectorFields(ctx, c.client, c.index)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) == 0 {
+		return "", fmt.Errorf("index %s has no vector field", c.index)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names[0], nil
+}
+
+// numDocs returns the number of the documents in the index.
+func (c *integrityCheck) numDocs(ctx context.Context) (int64, error) {
+	info, err := c.client.Do(ctx, c.client.B().FtInfo().Index(c.index).Build()).AsMap()
+	if err != nil {
+		return 0, classifyError("failed to get info of index "+c.index, err)
+	}
+	v, ok := info["num_docs"]
+	if !ok {
+		return 0, fmt.Errorf("index %s has no num_docs", c.index)
+	}
+	if n, err := v.AsInt64(); err == nil {
+		return n, nil
+	}
+	s, err := v.ToString()
+	if err != nil {
+		return 0, fmt.Errorf("invalid num_docs of index %s: %w", c.index, err)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid num_docs of index %s: %w", c.index, err)
+	}
+	return int64(f), nil
+}
+
+// scan calls fn with the keys under the prefix of the index batch by
+// batch on all nodes, paced by the keys per second of the spec. The lock
+// of the check is renewed after every batch.
+func (c *integrityCheck) scan(ctx context.Context, fn func(keys []string) error) error {
+	nodes := c.client.Nodes()
+	addrs := make([]string, 0, len(nodes))
+	for addr := range nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var (
+		started = time.Now()
+		total   int
+	)
+	for _, addr := range addrs {
+		node := nodes[addr]
+		var cursor uint64
+		for {
+			cmd := node.B().Scan().Cursor(cursor).Match(escapeGlob(c.keys.getPrefix(c.index)) + "*").Count(integrityBatchSize).Build()
+			entry, err := node.Do(ctx, cmd).AsScanEntry()
+			if err != nil {
+				return fmt.Errorf("failed to scan node %s: %w", addr, err)
+			}
+			if len(entry.Elements) > 0 {
+				if err := fn(entry.Elements); err != nil {
+					return err
+				}
+			}
+			if owned, err := c.acquire(ctx); err != nil || !owned {
+				if err == nil {
+					err = fmt.Errorf("integrity check lock is lost")
+				}
+				return err
+			}
+
+			total += len(entry.Elements)
+			expected := time.Duration(float64(total) / float64(c.spec.GetKeysPerSecond()) * float64(time.Second))
+			if wait := expected - time.Since(started); wait > 0 {
+				time.Sleep(wait)
+			}
+			if entry.Cursor == 0 {
+				break
+			}
+			cursor = entry.Cursor
+		}
+	}
+	return nil
+}
+
+// verifySamples searches the sampled documents by their own vectors, and
+// returns the ones not found and the number of the verified ones. The
+// documents deleted since the scan are skipped.
+func (c *integrityCheck) verifySamples(ctx context.Context, field string, samples []string) ([]string, int, error) {
+	sort.Strings(samples)
+	unsearchable := []string{}
+	sampled := 0
+	for _, key := range samples {
+		vector, err := c.client.Do(ctx, c.client.B().Hget().Key(key).Field(field).Build()).ToString()
+		if rueidis.IsRedisNil(err) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to get vector of document %s: %w", key, err)
+		}
+		query := fmt.Sprintf("*=>[KNN %d @%s $%s AS %s]", integrityNeighbors, field, vectorPlaceHolder, distancePlaceHolder)
+		cmd := c.client.B().Arbitrary("FT.SEARCH").Keys(c.index).Args(query,
+			"RETURN", "1", distancePlaceHolder, "DIALECT", "2",
+			"LIMIT", "0", strconv.Itoa(integrityNeighbors),
+			"PARAMS", "2", vectorPlaceHolder, vector).Build()
+		_, docs, err := c.client.Do(ctx, cmd).AsFtSearch()
+		if err != nil {
+			return nil, 0, classifyError("failed to search index "+c.index, err)
+		}
+		sampled++
+		found := false
+		for _, doc := range docs {
+			if doc.Key == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unsearchable = append(unsearchable, key)
+		}
+	}
+	return unsearchable, sampled, nil
+}
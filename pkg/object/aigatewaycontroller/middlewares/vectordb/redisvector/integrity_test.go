@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateIntegritySpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateIntegritySpec(&IntegritySpec{}))
+	assert.NoError(ValidateIntegritySpec(&IntegritySpec{Window: "23:00-01:30", SampleSize: 10}))
+	assert.Error(ValidateIntegritySpec(&IntegritySpec{Window: "02:00"}))
+	assert.Error(ValidateIntegritySpec(&IntegritySpec{Window: "02:00-25:00"}))
+	assert.Error(ValidateIntegritySpec(&IntegritySpec{Window: "02:00-02:00"}))
+	assert.Error(ValidateIntegritySpec(&IntegritySpec{SampleSize: -1}))
+	assert.Error(ValidateIntegritySpec(&IntegritySpec{KeysPerSecond: -1}))
+
+	// the integrity check reads vectors of hashes only.
+	assert.NoError(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", IndexType: "JSON"}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", IndexType: "XML"}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", IndexType: "JSON", Integrity: &IntegritySpec{}}))
+
+	spec := &IntegritySpec{}
+	assert.Equal(DefaultIntegritySampleSize, spec.GetSampleSize())
+	assert.Equal(DefaultIntegrityKeysPerSecond, spec.GetKeysPerSecond())
+}
+
+func TestIntegrityWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		assert.NoError(err)
+		return v
+	}
+
+	w, err := parseIntegrityWindow("02:00-04:00")
+	assert.NoError(err)
+	assert.Equal(at("2024-05-01T02:00:00Z"), w.opened(at("2024-05-01T03:59:00Z")))
+	assert.True(w.opened(at("2024-05-01T04:00:00Z")).IsZero())
+	assert.True(w.opened(at("2024-05-01T01:00:00Z")).IsZero())
+
+	// the window spans midnight.
+	w, err = parseIntegrityWindow("23:00-01:00")
+	assert.NoError(err)
+	assert.Equal(at("2024-05-01T23:00:00Z"), w.opened(at("2024-05-01T23:30:00Z")))
+	assert.Equal(at("2024-05-01T23:00:00Z"), w.opened(at("2024-05-02T00:30:00Z")))
+	assert.True(w.opened(at("2024-05-02T12:00:00Z")).IsZero())
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeDrainRedis()
+	indexed := map[string]bool{}
+	for i := 1; i <= 5; i++ {
+		key := "movie:" + strconv.Itoa(i)
+		fake.docs[key] = true
+		fake.hash(key)["embedding"] = float32VectorToString([]float32{float32(i), 1})
+		// the documents written during the failover are not indexed.
+		indexed[key] = i <= 3
+	}
+	fake.docs["other:1"] = true
+
+	numIndexed := func() int {
+		n := 0
+		for _, ok := range indexed {
+			if ok {
+				n++
+			}
+		}
+		return n
+	}
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "FT.INFO":
+			if args[1] != "movie" {
+				return "-Unknown index name\r\n"
+			}
+			return respArray(
+				respBulk("index_name"), respBulk(args[1]),
+				respBulk("num_docs"), respBulk(strconv.Itoa(numIndexed())),
+				respBulk("attributes"), respArray(
+					respArray(respBulk("identifier"), respBulk("embedding"), respBulk("attribute"), respBulk("embedding"), respBulk("type"), respBulk("VECTOR"),
+						respBulk("algorithm"), respBulk("FLAT"), respBulk("data_type"), respBulk("FLOAT32")),
+				),
+			)
+		case "FT.SEARCH":
+			// the indexed documents with the vector are found.
+			vector := args[len(args)-1]
+			var keys []string
+			for key, ok := range indexed {
+				if ok && fake.hashes[key]["embedding"] == vector {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			items := []string{":" + strconv.Itoa(len(keys)) + "\r\n"}
+			for _, key := range keys {
+				items = append(items, respBulk(key), respArray(respBulk(distancePlaceHolder), respBulk("0")))
+			}
+			return respArray(items...)
+		case "EVAL":
+			if strings.Contains(args[1], "HGET") {
+				key := args[3]
+				if _, ok := fake.hashes[key][args[4]]; !ok {
+					return ":0\r\n"
+				}
+				indexed[key] = true
+				return ":1\r\n"
+			}
+		}
+		return fake.handle(args)
+	})
+	client := newFakeRedisClient(t, r).client
+	ctx := context.Background()
+
+	// the check only reports the discrepancies.
+	c := newIntegrityCheck(client, "movie", &IntegritySpec{}, false, false)
+	owned, err := c.acquire(ctx)
+	assert.NoError(err)
+	assert.True(owned)
+	c.run(ctx)
+	report := c.getReport()
+	assert.Equal(IntegrityStatusCompleted, report.Status, report.Error)
+	assert.Equal(int64(5), report.ScannedKeys)
+	assert.Equal(int64(3), report.IndexedDocs)
+	assert.Equal(int64(2), report.Missing)
+	assert.Equal(5, report.Sampled)
+	assert.Equal([]string{"movie:4", "movie:5"}, report.Unsearchable)
+	assert.Zero(report.Touched)
+	assert.NotEmpty(report.FinishedAt)
+	assert.NotEmpty(fake.hashes[getIntegrityKey("movie")]["startedAt"])
+	_, locked := fake.strings[getIntegrityLockKey("movie")]
+	assert.False(locked)
+
+	// another member holds the lock.
+	fake.strings[getIntegrityLockKey("movie")] = "other"
+	c = newIntegrityCheck(client, "movie", &IntegritySpec{}, true, false)
+	owned, err = c.acquire(ctx)
+	assert.NoError(err)
+	assert.False(owned)
+	delete(fake.strings, getIntegrityLockKey("movie"))
+
+	// the repair touches the documents to be indexed again.
+	c = newIntegrityCheck(client, "movie", &IntegritySpec{SampleSize: 2}, true, false)
+	owned, err = c.acquire(ctx)
+	assert.NoError(err)
+	assert.True(owned)
+	c.run(ctx)
+	report = c.getReport()
+	assert.Equal(IntegrityStatusCompleted, report.Status, report.Error)
+	assert.Equal(int64(2), report.Missing)
+	assert.Equal(2, report.Sampled)
+	assert.Equal(int64(5), report.Touched)
+	assert.Equal(int64(5), report.IndexedAfterRepair)
+
+	// the index does not exist.
+	c = newIntegrityCheck(client, "unknown", &IntegritySpec{}, true, false)
+	c.run(ctx)
+	report = c.getReport()
+	assert.Equal(IntegrityStatusNoIndex, report.Status)
+	assert.Zero(report.ScannedKeys)
+}
@@ -0,0 +1,512 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// DefaultJanitorInterval is the default interval of the sweeps.
+	DefaultJanitorInterval = time.Hour
+	// DefaultJanitorKeysPerSecond is the default cap of the keys scanned
+	// per second.
+	DefaultJanitorKeysPerSecond = 1000
+
+	// JanitorPolicyRepair expires the orphaned keys without TTL, writes
+	// the missing IDs, and deletes the keys without vectors, which are
+	// never searched. It is the default.
+	JanitorPolicyRepair = "repair"
+	// JanitorPolicyExpire expires the orphaned keys without TTL, the
+	// keys missing fields are left to expire.
+	JanitorPolicyExpire = "expire"
+	// JanitorPolicyDelete deletes all orphaned keys.
+	JanitorPolicyDelete = "delete"
+
+	janitorBatchSize = 100
+	janitorLockTTL   = 30 * time.Second
+
+	janitorActionExpired  = 1
+	janitorActionRepaired = 2
+	janitorActionDeleted  = 3
+)
+
+var (
+	// sweepOrphanScript checks whether the document is orphaned, which is
+	// without TTL while ARGV[2] is positive, or missing the ID field of
+	// ARGV[3] or any vector field of ARGV[5:], and applies the policy of
+	// ARGV[1] to it. ARGV[4] is the ID written by repairs. It returns the
+	// missing TTL and fields as 0 or 1, and the action taken. The check
+	// and the action are atomic, so a document written meanwhile is never
+	// deleted by a stale check.
+	sweepOrphanScript = rueidis.NewLuaScript(`
+local key, policy, ttl, idField = KEYS[1], ARGV[1], tonumber(ARGV[2]), ARGV[3]
+if redis.call('EXISTS', key) == 0 then
+	return {0, 0, 0}
+end
+local missingTTL, missingID, missingVector = 0, 0, 0
+if ttl > 0 and redis.call('PTTL', key) == -1 then
+	missingTTL = 1
+end
+if idField ~= '' and redis.call('HEXISTS', key, idField) == 0 then
+	missingID = 1
+end
+for i = 5, #ARGV do
+	if redis.call('HEXISTS', key, ARGV[i]) == 0 then
+		missingVector = 1
+	end
+end
+local missingFields = 0
+if missingID == 1 or missingVector == 1 then
+	missingFields = 1
+end
+if missingTTL == 0 and missingFields == 0 then
+	return {0, 0, 0}
+end
+if policy == 'delete' or (policy == 'repair' and missingVector == 1) then
+	redis.call('UNLINK', key)
+	return {missingTTL, missingFields, 3}
+end
+local action = 0
+if policy == 'repair' and missingID == 1 then
+	redis.call('HSET', key, idField, ARGV[4])
+	action = 2
+end
+if missingTTL == 1 then
+	redis.call('PEXPIRE', key, ttl)
+	if action == 0 then
+		action = 1
+	end
+end
+return {missingTTL, missingFields, action}
+`)
+
+	// janitors are the running janitors of this process, every handler
+	// runs its own janitor until it is closed.
+	janitorsLock sync.Mutex
+	janitors     = map[*janitor]struct{}{}
+)
+
+type (
+	// JanitorSpec sweeps the keys orphaned by crashed inserts, which are
+	// the keys under the prefix of an index without the TTL of the spec,
+	// or missing the ID or vector fields, like the documents written but
+	// not expired before a crash. Only one member sweeps an index in an
+	// interval, by holding a lock in Redis.
+	JanitorSpec struct {
+		// Interval is the interval of the sweeps, 1h by default.
+		Interval string `json:"interval,omitempty" jsonschema:"format=duration"`
+		// Policy is how the orphaned keys are handled, repair by default.
+		Policy        string `json:"policy,omitempty" jsonschema:"enum=,enum=repair,enum=expire,enum=delete"`
+		KeysPerSecond int    `json:"keysPerSecond,omitempty"`
+	}
+
+	// JanitorStats is the statistics of the sweeps of an index by this
+	// process, the counts are accumulated across sweeps.
+	JanitorStats struct {
+		Index  string `json:"index"`
+		Policy string `json:"policy"`
+		// Leader is true if this process holds the lock of the index.
+		Leader        bool   `json:"leader"`
+		Sweeps        int64  `json:"sweeps"`
+		Scanned       int64  `json:"scanned"`
+		MissingTTL    int64  `json:"missingTTL"`
+		MissingFields int64  `json:"missingFields"`
+		Expired       int64  `json:"expired"`
+		Repaired      int64  `json:"repaired"`
+		Deleted       int64  `json:"deleted"`
+		LastSweptAt   string `json:"lastSweptAt,omitempty"`
+		// Error is the error of the last sweep.
+		Error string `json:"error,omitempty"`
+	}
+
+	// janitor sweeps the orphaned keys of an index periodically. The lock
+	// of the index is kept for the interval after a sweep, so the other
+	// members skip the index until the next interval.
+	janitor struct {
+		client rueidis.Client
+		index  string
+		spec   *JanitorSpec
+		ttl    time.Duration
+		legacy bool
+		keys   keyLayout
+		owner  string
+
+		statsLock sync.Mutex
+		stats     JanitorStats
+
+		// stop stops the janitor and aborts its running sweep when it is
+		// closed.
+		stop     chan struct{}
+		stopOnce sync.Once
+	}
+)
+
+// ValidateJanitorSpec validates the janitor spec.
+func ValidateJanitorSpec(spec *JanitorSpec) error {
+	if spec.Interval != "" {
+		interval, err := time.ParseDuration(spec.Interval)
+		if err != nil {
+			return fmt.Errorf("interval %s is invalid: %w", spec.Interval, err)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("interval %s must be positive", spec.Interval)
+		}
+	}
+	switch spec.Policy {
+	case "", JanitorPolicyRepair, JanitorPolicyExpire, JanitorPolicyDelete:
+	default:
+		return fmt.Errorf("policy %s is invalid", spec.Policy)
+	}
+	if spec.KeysPerSecond < 0 {
+		return fmt.Errorf("keysPerSecond must not be negative")
+	}
+	return nil
+}
+
+// GetInterval returns the interval of the sweeps.
+func (spec *JanitorSpec) GetInterval() time.Duration {
+	interval, err := time.ParseDuration(spec.Interval)
+	if err != nil || interval <= 0 {
+		return DefaultJanitorInterval
+	}
+	return interval
+}
+
+// GetPolicy returns how the orphaned keys are handled.
+func (spec *JanitorSpec) GetPolicy() string {
+	if spec.Policy == "" {
+		return JanitorPolicyRepair
+	}
+	return spec.Policy
+}
+
+// GetKeysPerSecond returns the cap of the keys scanned per second.
+func (spec *JanitorSpec) GetKeysPerSecond() int {
+	if spec.KeysPerSecond > 0 {
+		return spec.KeysPerSecond
+	}
+	return DefaultJanitorKeysPerSecond
+}
+
+func getJanitorLockKey(index string) string {
+	return fmt.Sprintf("janitor:{%s}:lock", index)
+}
+
+// GetJanitorStats returns the statistics of the janitors of the indexes in
+// the scope started by this process.
+func GetJanitorStats(scope string) []*JanitorStats {
+	janitorsLock.Lock()
+	list := make([]*janitor, 0, len(janitors))
+	for j := range janitors {
+		if vecdbtypes.InScope(scope, j.index) {
+			list = append(list, j)
+		}
+	}
+	janitorsLock.Unlock()
+
+	stats := make([]*JanitorStats, 0, len(list))
+	for _, j := range list {
+		stats = append(stats, j.getStats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Index < stats[j].Index
+	})
+	return stats
+}
+
+// startJanitor starts the janitor of the index for a handler, the janitor
+// shares the client of the handler and runs until it is closed. Only one
+// of the janitors of an index sweeps in an interval, by the lock in Redis.
+func (r *RedisVectorDB) startJanitor(client rueidis.Client, index string) *janitor {
+	j := newJanitor(client, index, r.Spec.Janitor, r.Spec.GetTTL(), r.Spec.LegacyFields)
+	j.keys = r.getKeyLayout()
+
+	janitorsLock.Lock()
+	janitors[j] = struct{}{}
+	janitorsLock.Unlock()
+	go j.run()
+	return j
+}
+
+func newJanitor(client rueidis.Client, index string, spec *JanitorSpec, ttl time.Duration, legacy bool) *janitor {
+	return &janitor{
+		client: client,
+		index:  index,
+		spec:   spec,
+		ttl:    ttl,
+		legacy: legacy,
+		owner:  uuid.NewString(),
+		stats: JanitorStats{
+			Index:  index,
+			Policy: spec.GetPolicy(),
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// close stops the janitor, the lock of the index expires in the interval,
+// and the janitors of other handlers take over then.
+func (j *janitor) close() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+		janitorsLock.Lock()
+		delete(janitors, j)
+		janitorsLock.Unlock()
+	})
+}
+
+func (j *janitor) run() {
+	interval := j.spec.GetInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-j.stop
+		cancel()
+	}()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+		}
+		// a sweep never outlasts the interval, in which the lock of the
+		// index is kept.
+		sweepCtx, cancelSweep := context.WithTimeout(ctx, interval)
+		err := j.sweep(sweepCtx)
+		cancelSweep()
+		if ctx.Err() != nil {
+			return
+		}
+		j.updateStats(func(s *JanitorStats) {
+			s.Error = ""
+			if err != nil {
+				s.Error = err.Error()
+			}
+		})
+		if err != nil {
+			logger.Errorf("failed to sweep orphaned keys of index %s: %v", j.index, err)
+		}
+	}
+}
+
+// sweep scans the keys of the index and applies the policy to the
+// orphaned ones, if this janitor holds the lock of the index. The lock is
+// kept for the interval after the sweep.
+func (j *janitor) sweep(ctx context.Context) error {
+	owned, err := j.lock(ctx, janitorLockTTL)
+	j.updateStats(func(s *JanitorStats) { s.Leader = owned })
+	if err != nil || !owned {
+		return err
+	}
+	// the documents of the dropped indexes are deleted by drains, and
+	// the fields are unknown without the index.
+	if (&RedisClient{client: j.client}).isDraining(ctx, j.index) {
+		return nil
+	}
+	fields, err := indexVectorFields(ctx, j.client, j.index)
+	if err != nil {
+		if isUnknownIndexError(err) {
+			return nil
+		}
+		return classifyError("failed to get vector fields of index "+j.index, err)
+	}
+	vectorFields := make([]string, 0, len(fields))
+	for name := range fields {
+		vectorFields = append(vectorFields, name)
+	}
+	sort.Strings(vectorFields)
+
+	err = j.scan(ctx, func(keys []string) error {
+		return j.sweepKeys(ctx, keys, vectorFields)
+	})
+	if err != nil {
+		return err
+	}
+	stats := j.updateStats(func(s *JanitorStats) {
+		s.Sweeps++
+		s.LastSweptAt = time.Now().UTC().Format(time.RFC3339Nano)
+	})
+	logger.Debugf("swept orphaned keys of index %s: %d keys scanned, %d expired, %d repaired, %d deleted in total",
+		j.index, stats.Scanned, stats.Expired, stats.Repaired, stats.Deleted)
+
+	_, err = j.lock(ctx, j.spec.GetInterval())
+	return err
+}
+
+// lock acquires or renews the lock of the index for the ttl, it returns
+// false if the lock is held by others.
+func (j *janitor) lock(ctx context.Context, ttl time.Duration) (bool, error) {
+	key := getJanitorLockKey(j.index)
+	renewed, err := renewDrainLockScript.Exec(ctx, j.client, []string{key},
+		[]string{j.owner, strconv.FormatInt(ttl.Milliseconds(), 10)}).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to renew janitor lock: %w", err)
+	}
+	if renewed == 1 {
+		return true, nil
+	}
+	err = j.client.Do(ctx, j.client.B().Set().Key(key).Value(j.owner).Nx().Px(ttl).Build()).Error()
+	if rueidis.IsRedisNil(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire janitor lock: %w", err)
+	}
+	return true, nil
+}
+
+// scan calls fn with the keys under the prefix of the index batch by
+// batch on all nodes, paced by the keys per second of the spec. The lock
+// is renewed after every batch.
+func (j *janitor) scan(ctx context.Context, fn func(keys []string) error) error {
+	nodes := j.client.Nodes()
+	addrs := make([]string, 0, len(nodes))
+	for addr := range nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var (
+		started = time.Now()
+		total   int
+	)
+	for _, addr := range addrs {
+		node := nodes[addr]
+		var cursor uint64
+		for {
+			cmd := node.B().Scan().Cursor(cursor).Match(escapeGlob(j.keys.getPrefix(j.index)) + "*").Count(janitorBatchSize).Build()
+			entry, err := node.Do(ctx, cmd).AsScanEntry()
+			if err != nil {
+				return fmt.Errorf("failed to scan node %s: %w", addr, err)
+			}
+			if len(entry.Elements) > 0 {
+				if err := fn(entry.Elements); err != nil {
+					return err
+				}
+			}
+			if owned, err := j.lock(ctx, janitorLockTTL); err != nil || !owned {
+				if err == nil {
+					err = fmt.Errorf("janitor lock is lost")
+				}
+				return err
+			}
+
+			total += len(entry.Elements)
+			expected := time.Duration(float64(total) / float64(j.spec.GetKeysPerSecond()) * float64(time.Second))
+			if wait := expected - time.Since(started); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+			if entry.Cursor == 0 {
+				break
+			}
+			cursor = entry.Cursor
+		}
+	}
+	return nil
+}
+
+// sweepKeys checks the keys and applies the policy to the orphaned ones
+// in a pipeline. The keys of other types, like the ones of JSON documents,
+// are skipped by the errors of HEXISTS.
+func (j *janitor) sweepKeys(ctx context.Context, keys []string, vectorFields []string) error {
+	// the documents with legacy fields have no ID field.
+	id := idField
+	if j.legacy {
+		id = ""
+	}
+	policy := j.spec.GetPolicy()
+	ttl := strconv.FormatInt(j.ttl.Milliseconds(), 10)
+	execs := make([]rueidis.LuaExec, 0, len(keys))
+	for _, key := range keys {
+		args := make([]string, 0, len(vectorFields)+4)
+		args = append(args, policy, ttl, id, strings.TrimPrefix(key, j.keys.getPrefix(j.index)))
+		execs = append(execs, rueidis.LuaExec{Keys: []string{key}, Args: append(args, vectorFields...)})
+	}
+
+	var delta JanitorStats
+	for i, res := range sweepOrphanScript.ExecMulti(ctx, j.client, execs...) {
+		values, err := res.AsIntSlice()
+		if err != nil {
+			if isWrongTypeError(err) {
+				continue
+			}
+			return fmt.Errorf("failed to sweep key %s: %w", keys[i], err)
+		}
+		if len(values) != 3 {
+			return fmt.Errorf("unexpected reply of sweeping key %s: %v", keys[i], values)
+		}
+		delta.Scanned++
+		delta.MissingTTL += values[0]
+		delta.MissingFields += values[1]
+		switch values[2] {
+		case janitorActionExpired:
+			delta.Expired++
+		case janitorActionRepaired:
+			delta.Repaired++
+		case janitorActionDeleted:
+			delta.Deleted++
+		}
+	}
+	j.updateStats(func(s *JanitorStats) {
+		s.Scanned += delta.Scanned
+		s.MissingTTL += delta.MissingTTL
+		s.MissingFields += delta.MissingFields
+		s.Expired += delta.Expired
+		s.Repaired += delta.Repaired
+		s.Deleted += delta.Deleted
+	})
+	return nil
+}
+
+// isWrongTypeError checks whether the key is not of the type of the
+// command, the error of a script carries the one of the command.
+func isWrongTypeError(err error) bool {
+	redisErr, ok := rueidis.IsRedisErr(err)
+	return ok && strings.Contains(redisErr.Error(), "WRONGTYPE")
+}
+
+func (j *janitor) updateStats(fn func(s *JanitorStats)) *JanitorStats {
+	j.statsLock.Lock()
+	defer j.statsLock.Unlock()
+	fn(&j.stats)
+	stats := j.stats
+	return &stats
+}
+
+func (j *janitor) getStats() *JanitorStats {
+	return j.updateStats(func(s *JanitorStats) {})
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// fakeJanitorRedis keeps the documents and the locks of janitors, and
+// runs the scripts of janitors by their effects.
+type fakeJanitorRedis struct {
+	scripts map[string]string
+	locks   map[string]string
+	// lockTTLs are the ttls in milliseconds of the locks.
+	lockTTLs map[string]string
+	docs     map[string]map[string]string
+	// ttls are the ttls in milliseconds of the documents with expiries.
+	ttls map[string]string
+}
+
+func newFakeJanitorRedis() *fakeJanitorRedis {
+	return &fakeJanitorRedis{
+		scripts:  map[string]string{},
+		locks:    map[string]string{},
+		lockTTLs: map[string]string{},
+		docs:     map[string]map[string]string{},
+		ttls:     map[string]string{},
+	}
+}
+
+func (f *fakeJanitorRedis) handle(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "SCRIPT":
+		sum := sha1.Sum([]byte(args[2]))
+		sha := hex.EncodeToString(sum[:])
+		f.scripts[sha] = args[2]
+		return respBulk(sha)
+	case "EVALSHA":
+		script, ok := f.scripts[args[1]]
+		if !ok {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return f.eval(script, args[3], args[4:])
+	case "EVAL":
+		return f.eval(args[1], args[3], args[4:])
+	case "SET":
+		if _, ok := f.locks[args[1]]; ok {
+			return "$-1\r\n"
+		}
+		f.locks[args[1]] = args[2]
+		f.lockTTLs[args[1]] = args[5]
+		return "+OK\r\n"
+	case "HGET":
+		return "$-1\r\n"
+	case "FT.INFO":
+		if args[1] == "movie" {
+			return respIndexInfo("movie", "title", "embedding:VECTOR")
+		}
+		return "-Unknown index name\r\n"
+	case "SCAN":
+		var keys []string
+		for key := range f.docs {
+			if strings.HasPrefix(key, "movie:") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		items := []string{}
+		for _, key := range keys {
+			items = append(items, respBulk(key))
+		}
+		return respArray(respBulk("0"), respArray(items...))
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (f *fakeJanitorRedis) eval(script string, key string, args []string) string {
+	if !strings.Contains(script, "PTTL") {
+		// renewDrainLockScript
+		if f.locks[key] == args[0] {
+			f.lockTTLs[key] = args[1]
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+
+	doc, ok := f.docs[key]
+	if !ok {
+		return respArray(":0\r\n", ":0\r\n", ":0\r\n")
+	}
+	policy, ttl, id := args[0], args[1], args[2]
+	missingTTL, missingID, missingVector := 0, 0, 0
+	if _, ok := f.ttls[key]; !ok && ttl != "0" {
+		missingTTL = 1
+	}
+	if _, ok := doc[id]; id != "" && !ok {
+		missingID = 1
+	}
+	for _, field := range args[4:] {
+		if _, ok := doc[field]; !ok {
+			missingVector = 1
+		}
+	}
+	missingFields := max(missingID, missingVector)
+	reply := func(action int) string {
+		return respArray(":"+strconv.Itoa(missingTTL)+"\r\n", ":"+strconv.Itoa(missingFields)+"\r\n", ":"+strconv.Itoa(action)+"\r\n")
+	}
+	if missingTTL == 0 && missingFields == 0 {
+		return reply(0)
+	}
+	if policy == JanitorPolicyDelete || (policy == JanitorPolicyRepair && missingVector == 1) {
+		delete(f.docs, key)
+		return reply(janitorActionDeleted)
+	}
+	action := 0
+	if policy == JanitorPolicyRepair && missingID == 1 {
+		doc[id] = args[3]
+		action = janitorActionRepaired
+	}
+	if missingTTL == 1 {
+		f.ttls[key] = ttl
+		if action == 0 {
+			action = janitorActionExpired
+		}
+	}
+	return reply(action)
+}
+
+// fabricate adds a healthy document and the ones orphaned in every way.
+func (f *fakeJanitorRedis) fabricate() {
+	f.docs = map[string]map[string]string{
+		"movie:ok":    {idField: "ok", "embedding": "v"},
+		"movie:nottl": {idField: "nottl", "embedding": "v"},
+		"movie:noid":  {"embedding": "v"},
+		"movie:novec": {idField: "novec"},
+		"other:1":     {"title": "other"},
+	}
+	f.ttls = map[string]string{"movie:ok": "60000", "movie:noid": "60000"}
+}
+
+func TestValidateJanitorSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &JanitorSpec{}
+	assert.NoError(ValidateJanitorSpec(spec))
+	assert.Equal(DefaultJanitorInterval, spec.GetInterval())
+	assert.Equal(JanitorPolicyRepair, spec.GetPolicy())
+	assert.Equal(DefaultJanitorKeysPerSecond, spec.GetKeysPerSecond())
+	assert.NoError(ValidateJanitorSpec(&JanitorSpec{Interval: "10m", Policy: JanitorPolicyDelete, KeysPerSecond: 10}))
+	assert.Error(ValidateJanitorSpec(&JanitorSpec{Interval: "10 minutes"}))
+	assert.Error(ValidateJanitorSpec(&JanitorSpec{Interval: "-1m"}))
+	assert.Error(ValidateJanitorSpec(&JanitorSpec{Policy: "unknown"}))
+	assert.Error(ValidateJanitorSpec(&JanitorSpec{KeysPerSecond: -1}))
+
+	url := "redis://localhost:6379"
+	assert.NoError(ValidateSpec(&RedisVectorDBSpec{URL: url, Janitor: &JanitorSpec{}}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, Janitor: &JanitorSpec{Policy: JanitorPolicyExpire}}))
+	assert.NoError(ValidateSpec(&RedisVectorDBSpec{URL: url, TTL: "1h", Janitor: &JanitorSpec{Policy: JanitorPolicyExpire}}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, IndexType: string(IndexTypeJSON), Janitor: &JanitorSpec{}}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{Shards: &ShardingSpec{URLs: []string{url}}, Janitor: &JanitorSpec{}}))
+}
+
+func TestJanitorSweep(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeJanitorRedis()
+	r := newFakeRedis(t, fake.handle)
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	// the orphans are repaired, and the ones without vectors are deleted.
+	fake.fabricate()
+	j := newJanitor(client.client, "movie", &JanitorSpec{Interval: "10m"}, time.Minute, false)
+	assert.NoError(j.sweep(ctx))
+	assert.Len(fake.docs, 4)
+	assert.NotContains(fake.docs, "movie:novec")
+	assert.Equal("60000", fake.ttls["movie:nottl"])
+	assert.Equal("noid", fake.docs["movie:noid"][idField])
+	assert.NotContains(fake.ttls, "other:1")
+
+	stats := j.getStats()
+	assert.True(stats.Leader)
+	assert.Equal(int64(1), stats.Sweeps)
+	assert.Equal(int64(4), stats.Scanned)
+	assert.Equal(int64(2), stats.MissingTTL)
+	assert.Equal(int64(2), stats.MissingFields)
+	assert.Equal(int64(1), stats.Expired)
+	assert.Equal(int64(1), stats.Repaired)
+	assert.Equal(int64(1), stats.Deleted)
+	assert.NotEmpty(stats.LastSweptAt)
+	// the lock is kept until the next interval.
+	assert.Equal(j.owner, fake.locks[getJanitorLockKey("movie")])
+	assert.Equal("600000", fake.lockTTLs[getJanitorLockKey("movie")])
+
+	// the swept documents are not orphaned any more.
+	assert.NoError(j.sweep(ctx))
+	stats = j.getStats()
+	assert.Equal(int64(2), stats.Sweeps)
+	assert.Equal(int64(7), stats.Scanned)
+	assert.Equal(int64(1), stats.Deleted)
+
+	// another member skips the index while the lock is held.
+	fake.fabricate()
+	other := newJanitor(client.client, "movie", &JanitorSpec{Policy: JanitorPolicyDelete}, time.Minute, false)
+	assert.NoError(other.sweep(ctx))
+	assert.False(other.getStats().Leader)
+	assert.Len(fake.docs, 5)
+
+	// all orphans are deleted by the delete policy, and the missing IDs
+	// are not checked with legacy fields.
+	delete(fake.locks, getJanitorLockKey("movie"))
+	other = newJanitor(client.client, "movie", &JanitorSpec{Policy: JanitorPolicyDelete}, time.Minute, true)
+	assert.NoError(other.sweep(ctx))
+	assert.Equal([]string{"movie:noid", "movie:ok", "other:1"}, sortedKeys(fake.docs))
+	assert.Equal(int64(2), other.getStats().Deleted)
+
+	// the missing TTLs are not checked without the ttl of the spec, and
+	// the keys missing fields are left to expire by the expire policy.
+	delete(fake.locks, getJanitorLockKey("movie"))
+	fake.fabricate()
+	other = newJanitor(client.client, "movie", &JanitorSpec{Policy: JanitorPolicyExpire}, 0, false)
+	assert.NoError(other.sweep(ctx))
+	assert.Len(fake.docs, 5)
+	stats = other.getStats()
+	assert.Zero(stats.MissingTTL)
+	assert.Equal(int64(2), stats.MissingFields)
+	assert.Zero(stats.Expired + stats.Repaired + stats.Deleted)
+
+	// the keys of the indexes not existing are not touched.
+	delete(fake.locks, getJanitorLockKey("movie"))
+	other = newJanitor(client.client, "missing", &JanitorSpec{}, time.Minute, false)
+	assert.NoError(other.sweep(ctx))
+	assert.Zero(other.getStats().Scanned)
+}
+
+func sortedKeys(m map[string]map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestJanitorClose(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeJanitorRedis()
+	commands := 0
+	r := newFakeRedis(t, func(args []string) string {
+		commands++
+		return fake.handle(args)
+	})
+	client := newFakeRedisClient(t, r)
+	getCommands := func() int {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return commands
+	}
+	janitorStats := func() *JanitorStats {
+		for _, stats := range GetJanitorStats("") {
+			if stats.Index == "movie" {
+				return stats
+			}
+		}
+		return nil
+	}
+
+	db := New(&vecdbtypes.CommonSpec{}, &RedisVectorDBSpec{Janitor: &JanitorSpec{Interval: "10ms"}})
+	handler := &RedisVectorHandler{client: client, index: "movie"}
+	handler.janitor = db.startJanitor(client.client, "movie")
+	assert.Eventually(func() bool {
+		stats := janitorStats()
+		return stats != nil && stats.Sweeps >= 2
+	}, time.Second, 5*time.Millisecond)
+
+	// the janitor stops with the handler, and its running sweep, which
+	// is paced by the keys per second, is aborted.
+	handler.Close()
+	handler.Close()
+	assert.Nil(janitorStats())
+	time.Sleep(30 * time.Millisecond)
+	n := getCommands()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(n, getCommands())
+
+	r.lock.Lock()
+	delete(fake.locks, getJanitorLockKey("movie"))
+	fake.fabricate()
+	r.lock.Unlock()
+	db = New(&vecdbtypes.CommonSpec{}, &RedisVectorDBSpec{Janitor: &JanitorSpec{Interval: "10ms", KeysPerSecond: 1}})
+	j := db.startJanitor(client.client, "movie")
+	assert.Eventually(func() bool {
+		return janitorStats() != nil && janitorStats().Scanned > 0
+	}, time.Second, 5*time.Millisecond)
+	j.close()
+	time.Sleep(30 * time.Millisecond)
+	n = getCommands()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(n, getCommands())
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// keyPrefixIndex is the placeholder of the index name in keyPrefix.
+	keyPrefixIndex = "{index}"
+	// DefaultKeySeparator is the default separator of the key prefix and
+	// the IDs of documents.
+	DefaultKeySeparator = ":"
+)
+
+// keyLayout is the layout of the keys of documents, the key of a document
+// is the prefix of its index, the separator and its ID, like movie:42.
+// The zero value is the layout of old versions.
+type keyLayout struct {
+	prefix    string
+	separator string
+	// scope is the scope of the indexes, which is composed into the prefix
+	// not having the index name, the index names are scoped already.
+	scope string
+}
+
+// getKeyLayout returns the key layout of the spec, which is validated.
+func (spec *RedisVectorDBSpec) getKeyLayout() keyLayout {
+	return keyLayout{prefix: spec.KeyPrefix, separator: spec.KeySeparator}
+}
+
+// getScope returns the scope of the indexes of the vector database.
+func (r *RedisVectorDB) getScope() string {
+	if r.CommonSpec == nil {
+		return ""
+	}
+	return r.CommonSpec.Scope
+}
+
+// getKeyLayout returns the key layout of the vector database in its scope.
+func (r *RedisVectorDB) getKeyLayout() keyLayout {
+	keys := r.Spec.getKeyLayout()
+	keys.scope = r.getScope()
+	return keys
+}
+
+// validateKeyLayout validates the key prefix and separator of the spec.
+func validateKeyLayout(spec *RedisVectorDBSpec) error {
+	rest := strings.ReplaceAll(spec.KeyPrefix, keyPrefixIndex, "")
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("redis vector keyPrefix %s has placeholders other than %s", spec.KeyPrefix, keyPrefixIndex)
+	}
+	if strings.ContainsAny(spec.KeyPrefix+spec.KeySeparator, " \t\r\n") {
+		return fmt.Errorf("redis vector keyPrefix and keySeparator cannot contain whitespaces")
+	}
+	return nil
+}
+
+// getPrefix returns the prefix of the keys of the documents of the index,
+// which is the prefix of FT.CREATE as well.
+func (l keyLayout) getPrefix(index string) string {
+	prefix := index
+	switch {
+	case strings.Contains(l.prefix, keyPrefixIndex):
+		prefix = strings.ReplaceAll(l.prefix, keyPrefixIndex, index)
+	case l.prefix != "":
+		prefix = vecdbtypes.ScopedName(l.scope, l.prefix)
+	}
+	separator := l.separator
+	if separator == "" {
+		separator = DefaultKeySeparator
+	}
+	return prefix + separator
+}
+
+// documentKey returns the key of the document of the index, the ID may be
+// the key already, like the IDs of documents written by old versions.
+func (l keyLayout) documentKey(index, id string) string {
+	prefix := l.getPrefix(index)
+	if strings.HasPrefix(id, prefix) {
+		return id
+	}
+	return prefix + id
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	// the zero value is the layout of old versions.
+	keys := keyLayout{}
+	assert.Equal("movie:", keys.getPrefix("movie"))
+	assert.Equal("movie:42", keys.documentKey("movie", "42"))
+	assert.Equal("movie:42", keys.documentKey("movie", "movie:42"))
+
+	url := "redis://localhost:6379"
+	spec := &RedisVectorDBSpec{URL: url, KeyPrefix: "app:{index}", KeySeparator: "/"}
+	assert.NoError(ValidateSpec(spec))
+	keys = spec.getKeyLayout()
+	assert.Equal("app:movie/", keys.getPrefix("movie"))
+	assert.Equal("app:movie/42", keys.documentKey("movie", "42"))
+	assert.Equal("app:movie/42", keys.documentKey("movie", "app:movie/42"))
+	assert.Equal("idx/", keyLayout{prefix: "idx", separator: "/"}.getPrefix("movie"))
+
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, KeyPrefix: "app:{name}"}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, KeyPrefix: "app {index}"}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, KeySeparator: " "}))
+}
+
+func TestKeyPrefixMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	indexes := map[string]string{}
+	var keys []string
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "FT.INFO":
+			prefix, ok := indexes[args[1]]
+			if !ok {
+				return "-Unknown index name\r\n"
+			}
+			return respArray(
+				respBulk("index_name"), respBulk(args[1]),
+				respBulk("index_definition"), respArray(
+					respBulk("key_type"), respBulk("HASH"),
+					respBulk("prefixes"), respArray(respBulk(prefix)),
+					respBulk("default_score"), respBulk("1"),
+				),
+				respBulk("attributes"), respArray(respArray(
+					respBulk("identifier"), respBulk("title"),
+					respBulk("attribute"), respBulk("title"),
+					respBulk("type"), respBulk("TEXT"),
+				)),
+			)
+		case "FT.CREATE":
+			for i, arg := range args {
+				if arg == "PREFIX" {
+					indexes[args[1]] = args[i+2]
+				}
+			}
+			return "+OK\r\n"
+		case "HMSET":
+			keys = append(keys, args[1])
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+	schema := &IndexSchema{Texts: []Text{{Name: "title"}}}
+
+	client.keys = keyLayout{prefix: "app:{index}", separator: "/"}
+	assert.NoError(client.CreateIndexIfNotExists(ctx, "movie", schema))
+	assert.Equal("app:movie/", indexes["movie"])
+	key, err := client.InsertWithHash(ctx, "movie", map[string]any{"id": "42", "title": "a"})
+	assert.NoError(err)
+	assert.Equal("app:movie/42", key)
+	assert.Equal([]string{"app:movie/42"}, keys)
+
+	// the existing index matches the same layout.
+	assert.NoError(client.CreateIndexIfNotExists(ctx, "movie", schema))
+
+	// the documents written after changing the prefix would never be
+	// searchable by the existing index.
+	client.keys = keyLayout{}
+	err = client.CreateIndexIfNotExists(ctx, "movie", schema)
+	var mismatch *ErrIndexSchemaMismatch
+	assert.ErrorAs(err, &mismatch)
+	assert.ErrorContains(err, "key prefixes are app:movie/ instead of movie:")
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var (
+	// putPayloadScript stores the payload if it does not exist and increases
+	// its reference count atomically, so the sweeper never removes a payload
+	// between the two steps.
+	putPayloadScript = rueidis.NewLuaScript(`
+redis.call('SET', KEYS[2], ARGV[2], 'NX')
+return redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+`)
+
+	// unlinkHashScript unlinks the hash document and returns the values of
+	// its fields of ARGV, or nil if it does not exist. The fields are read
+	// with the unlink atomically, so the payloads referenced by a document
+	// deleted concurrently are released once.
+	unlinkHashScript = rueidis.NewLuaScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local values = redis.call('HMGET', KEYS[1], unpack(ARGV))
+redis.call('UNLINK', KEYS[1])
+return values
+`)
+
+	// unlinkJSONScript unlinks the JSON document and returns it, or nil if
+	// it does not exist.
+	unlinkJSONScript = rueidis.NewLuaScript(`
+local doc = redis.call('JSON.GET', KEYS[1])
+if not doc then
+	return false
+end
+redis.call('UNLINK', KEYS[1])
+return doc
+`)
+
+	// sweepPayloadScript removes the payload if it is not referenced.
+	sweepPayloadScript = rueidis.NewLuaScript(`
+local refs = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if refs <= 0 then
+	redis.call('DEL', KEYS[2])
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+)
+
+// payloadStore is the content-addressable payload store of an index. The
+// payloads are stored as strings keyed by their content hashes, and the
+// reference counts are stored in a hash. All keys share the hash tag of the
+// index, so they are in the same slot of a Redis cluster.
+type payloadStore struct {
+	client rueidis.Client
+	spec   *vecdbtypes.PayloadStoreSpec
+	prefix string
+
+	// stop stops the sweeper when it is closed.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newPayloadStore(client rueidis.Client, index string, spec *vecdbtypes.PayloadStoreSpec) *payloadStore {
+	return &payloadStore{
+		client: client,
+		spec:   spec,
+		prefix: getPayloadPrefix(index),
+		stop:   make(chan struct{}),
+	}
+}
+
+// getPayloadPrefix returns the prefix of the keys of the payload store of
+// the index.
+func getPayloadPrefix(index string) string {
+	return fmt.Sprintf("payload:{%s}:", index)
+}
+
+func (s *payloadStore) refsKey() string {
+	return s.prefix + "refs"
+}
+
+func (s *payloadStore) payloadKey(hash string) string {
+	return s.prefix + hash
+}
+
+// put stores the payloads and increases their reference counts.
+func (s *payloadStore) put(ctx context.Context, hashes []string, contents []string) error {
+	execs := make([]rueidis.LuaExec, 0, len(hashes))
+	for i, hash := range hashes {
+		execs = append(execs, rueidis.LuaExec{
+			Keys: []string{s.refsKey(), s.payloadKey(hash)},
+			Args: []string{hash, contents[i]},
+		})
+	}
+	var errs []error
+	for _, res := range putPayloadScript.ExecMulti(ctx, s.client, execs...) {
+		if err := res.Error(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// release decreases the reference counts of the payloads, the unreferenced
+// payloads are removed by the sweeper.
+func (s *payloadStore) release(ctx context.Context, hashes []string) error {
+	commands := make(rueidis.Commands, 0, len(hashes))
+	for _, hash := range hashes {
+		commands = append(commands, s.client.B().Hincrby().Key(s.refsKey()).Field(hash).Increment(-1).Build())
+	}
+	var errs []error
+	for _, res := range s.client.DoMulti(ctx, commands...) {
+		if err := res.Error(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolve returns the content of the payloads.
+func (s *payloadStore) resolve(ctx context.Context, hashes []string) (map[string]string, error) {
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+	contents := make(map[string]string, len(hashes))
+	if len(hashes) == 0 {
+		return contents, nil
+	}
+
+	keys := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		keys = append(keys, s.payloadKey(hash))
+	}
+	values, err := s.client.Do(ctx, s.client.B().Mget().Key(keys...).Build()).ToArray()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		content, err := value.ToString()
+		if rueidis.IsRedisNil(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		contents[hashes[i]] = content
+	}
+	return contents, nil
+}
+
+func (s *payloadStore) refs(ctx context.Context) (map[string]int64, error) {
+	return s.client.Do(ctx, s.client.B().Hgetall().Key(s.refsKey()).Build()).AsIntMap()
+}
+
+// sweep removes the unreferenced payloads.
+func (s *payloadStore) sweep(ctx context.Context) (int, error) {
+	refs, err := s.refs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	execs := []rueidis.LuaExec{}
+	for hash, n := range refs {
+		if n <= 0 {
+			execs = append(execs, rueidis.LuaExec{
+				Keys: []string{s.refsKey(), s.payloadKey(hash)},
+				Args: []string{hash},
+			})
+		}
+	}
+	if len(execs) == 0 {
+		return 0, nil
+	}
+
+	removed := 0
+	var errs []error
+	for _, res := range sweepPayloadScript.ExecMulti(ctx, s.client, execs...) {
+		n, err := res.AsInt64()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed += int(n)
+	}
+	return removed, errors.Join(errs...)
+}
+
+// stats returns the statistics of the payload store.
+func (s *payloadStore) stats(ctx context.Context) (*vecdbtypes.PayloadStats, error) {
+	refs, err := s.refs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	references, payloads := int64(0), int64(0)
+	for _, n := range refs {
+		if n > 0 {
+			references += n
+			payloads++
+		}
+	}
+	return vecdbtypes.NewPayloadStats(references, payloads), nil
+}
+
+// startSweeper starts the background sweeper of the payload store, it
+// runs until the store is closed. Every handler sweeps its own store, which
+// is safe since a payload is only removed if it is unreferenced when the
+// script runs.
+func (s *payloadStore) startSweeper() {
+	interval := s.spec.GetSweepInterval()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			removed, err := s.sweep(ctx)
+			cancel()
+			if err != nil {
+				logger.Errorf("failed to sweep payloads %s: %v", s.prefix, err)
+			}
+			if removed > 0 {
+				logger.Debugf("swept %d unreferenced payloads of %s", removed, s.prefix)
+			}
+		}
+	}()
+}
+
+// close stops the sweeper.
+func (s *payloadStore) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// unlinkDocuments unlinks the documents of the keys, and releases the
+// payloads referenced by the ones unlinked. It returns the number of the
+// documents unlinked.
+func (s *payloadStore) unlinkDocuments(ctx context.Context, keys []string, isJSON bool) (int64, error) {
+	script, fields := unlinkHashScript, s.spec.Fields
+	if isJSON {
+		script = unlinkJSONScript
+	}
+	execs := make([]rueidis.LuaExec, 0, len(keys))
+	for _, key := range keys {
+		exec := rueidis.LuaExec{Keys: []string{key}}
+		if !isJSON {
+			exec.Args = fields
+		}
+		execs = append(execs, exec)
+	}
+
+	var (
+		deleted int64
+		docs    []map[string]any
+		errs    []error
+	)
+	for _, res := range script.ExecMulti(ctx, s.client, execs...) {
+		doc, err := unlinkedDocument(res, fields, isJSON)
+		if rueidis.IsRedisNil(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		deleted++
+		docs = append(docs, doc)
+	}
+	if hashes := vecdbtypes.PayloadReferences(docs, fields); len(hashes) > 0 {
+		if err := s.release(ctx, hashes); err != nil {
+			errs = append(errs, NewErrPayloadStore("failed to release payloads", err))
+		}
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// unlinkedDocument returns the payload fields of the document returned by
+// the unlink scripts.
+func unlinkedDocument(res rueidis.RedisResult, fields []string, isJSON bool) (map[string]any, error) {
+	if isJSON {
+		raw, err := res.ToString()
+		if err != nil {
+			return nil, err
+		}
+		doc := map[string]any{}
+		if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+			return nil, fmt.Errorf("invalid JSON document: %w", err)
+		}
+		return doc, nil
+	}
+	values, err := res.ToArray()
+	if err != nil {
+		return nil, err
+	}
+	doc := make(map[string]any, len(fields))
+	for i, value := range values {
+		if v, err := value.ToString(); err == nil && i < len(fields) {
+			doc[fields[i]] = v
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/rueidis"
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestPayloadSweeperClose(t *testing.T) {
+	assert := assert.New(t)
+
+	sweeps := atomic.Int32{}
+	r := newFakeRedis(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "HGETALL" {
+			sweeps.Add(1)
+		}
+		return "*0\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+
+	handler := &RedisVectorHandler{
+		client:   client,
+		payloads: newPayloadStore(client.client, "docs", &vecdbtypes.PayloadStoreSpec{Fields: []string{"content"}, SweepInterval: "10ms"}),
+	}
+	handler.payloads.startSweeper()
+	assert.Eventually(func() bool { return sweeps.Load() >= 2 }, time.Second, 5*time.Millisecond)
+
+	// the sweeper stops once the handler is closed, closing it again is
+	// harmless.
+	handler.Close()
+	handler.Close()
+	time.Sleep(30 * time.Millisecond)
+	n := sweeps.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(n, sweeps.Load())
+}
+
+// fakePayloadRedis keeps the hash documents and the reference counts of
+// payloads, and runs the unlink script by its effects.
+type fakePayloadRedis struct {
+	scripts map[string]string
+	docs    map[string]map[string]string
+	refs    map[string]int
+}
+
+func (f *fakePayloadRedis) handle(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "SCRIPT":
+		sum := sha1.Sum([]byte(args[2]))
+		sha := hex.EncodeToString(sum[:])
+		f.scripts[sha] = args[2]
+		return respBulk(sha)
+	case "EVALSHA":
+		if !strings.Contains(f.scripts[args[1]], "HMGET") {
+			return "-ERR unexpected script\r\n"
+		}
+		doc, ok := f.docs[args[3]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		delete(f.docs, args[3])
+		items := []string{}
+		for _, field := range args[4:] {
+			if value, ok := doc[field]; ok {
+				items = append(items, respBulk(value))
+			} else {
+				items = append(items, "$-1\r\n")
+			}
+		}
+		return respArray(items...)
+	case "FT.SEARCH":
+		keys := make([]string, 0, len(f.docs))
+		for key := range f.docs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := []string{":" + strconv.Itoa(len(keys)) + "\r\n"}
+		for _, key := range keys {
+			items = append(items, respBulk(key))
+		}
+		return respArray(items...)
+	case "HINCRBY":
+		n, _ := strconv.Atoi(args[3])
+		f.refs[args[2]] += n
+		return ":" + strconv.Itoa(f.refs[args[2]]) + "\r\n"
+	}
+	return "-ERR unexpected command\r\n"
+}
+
+func TestDeleteWithPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b := vecdbtypes.PayloadHash("a"), vecdbtypes.PayloadHash("b")
+	fake := &fakePayloadRedis{
+		scripts: map[string]string{},
+		docs: map[string]map[string]string{
+			"movie:1": {"content": a, "title": b},
+			"movie:2": {"content": a},
+			"movie:3": {"title": "plain"},
+		},
+		refs: map[string]int{a: 2, b: 1},
+	}
+	r := newFakeRedis(t, fake.handle)
+	client := newFakeRedisClient(t, r)
+	handler := &RedisVectorHandler{
+		client:   client,
+		index:    "movie",
+		payloads: newPayloadStore(client.client, "movie", &vecdbtypes.PayloadStoreSpec{Fields: []string{"content"}}),
+	}
+	ctx := context.Background()
+
+	// only the payloads of the payload fields of the deleted documents are
+	// released, the documents not existing are skipped.
+	deleted, err := handler.DeleteDocuments(ctx, []string{"1", "3", "4"})
+	assert.NoError(err)
+	assert.Equal(int64(2), deleted)
+	assert.Equal(map[string]int{a: 1, b: 1}, fake.refs)
+
+	// a document deleted again releases nothing.
+	deleted, err = handler.DeleteDocuments(ctx, []string{"1", "2"})
+	assert.NoError(err)
+	assert.Equal(int64(1), deleted)
+	assert.Equal(map[string]int{a: 0, b: 1}, fake.refs)
+	assert.Empty(fake.docs)
+
+	// the payloads of the documents matched by filters are released too.
+	fake.docs = map[string]map[string]string{
+		"movie:1": {"content": a},
+		"movie:2": {"content": b},
+	}
+	fake.refs = map[string]int{a: 1, b: 1}
+	deleted, err = handler.DeleteByFilter(ctx, &vecdbtypes.TagFilter{Field: "model", Tags: []string{"gpt4o"}})
+	assert.NoError(err)
+	assert.Equal(int64(2), deleted)
+	assert.Equal(map[string]int{a: 0, b: 0}, fake.refs)
+	assert.Empty(fake.docs)
+}
+
+func TestPayloadStore(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	assert := assert.New(t)
+	ctx := context.Background()
+	redisC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "redis:latest",
+			ExposedPorts: []string{"6379/tcp"},
+			WaitingFor:   wait.ForLog("Ready to accept connections"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Redis container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, redisC)
+	endpoint, err := redisC.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to get Redis container endpoint: %v", err)
+	}
+	client, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{endpoint}})
+	if err != nil {
+		t.Fatalf("Failed to create Redis client: %v", err)
+	}
+	defer client.Close()
+
+	s := newPayloadStore(client, "docs", &vecdbtypes.PayloadStoreSpec{Fields: []string{"content"}, SweepInterval: "50ms"})
+	a, b := vecdbtypes.PayloadHash("a"), vecdbtypes.PayloadHash("b")
+
+	// a payload is stored once, and referenced by every field.
+	assert.Nil(s.put(ctx, []string{a, a, b}, []string{"a", "a", "b"}))
+	refs, err := s.refs(ctx)
+	assert.Nil(err)
+	assert.Equal(map[string]int64{a: 2, b: 1}, refs)
+	stats, err := s.stats(ctx)
+	assert.Nil(err)
+	assert.Equal(&vecdbtypes.PayloadStats{References: 3, Payloads: 2, DedupRatio: 1.5}, stats)
+
+	// the referenced payloads are kept by sweeps.
+	assert.Nil(s.release(ctx, []string{a, b}))
+	removed, err := s.sweep(ctx)
+	assert.Nil(err)
+	assert.Equal(1, removed)
+	contents, err := s.resolve(ctx, []string{a, b})
+	assert.Nil(err)
+	assert.Equal(map[string]string{a: "a"}, contents)
+
+	// the sweeper removes the payloads once unreferenced.
+	s.startSweeper()
+	assert.Nil(s.release(ctx, []string{a}))
+	assert.Eventually(func() bool {
+		contents, err := s.resolve(ctx, []string{a})
+		return err == nil && len(contents) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	refs, err = s.refs(ctx)
+	assert.Nil(err)
+	assert.Empty(refs)
+
+	// the unreferenced payloads are kept after the sweeper is closed.
+	s.close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(s.put(ctx, []string{b}, []string{"b"}))
+	assert.Nil(s.release(ctx, []string{b}))
+	time.Sleep(200 * time.Millisecond)
+	contents, err = s.resolve(ctx, []string{b})
+	assert.Nil(err)
+	assert.Equal(map[string]string{b: "b"}, contents)
+}
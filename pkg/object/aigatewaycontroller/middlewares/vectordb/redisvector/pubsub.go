@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/rueidis"
+)
+
+// PubSub broadcasts messages through the Redis of a vector database, so
+// the members sharing the database can notify each other. The messages
+// are numbered by a counter in Redis, subscribers can tell whether they
+// missed messages by the numbers.
+type PubSub struct {
+	client  rueidis.Client
+	channel string
+	seqKey  string
+}
+
+// NewPubSub creates a PubSub on the channel.
+func NewPubSub(spec *RedisVectorDBSpec, channel string) (*PubSub, error) {
+	clientOption, err := parseURL(spec.ConnectionURL())
+	if err != nil {
+		return nil, NewErrParsingRedisURL("failed to parse Redis URL", err)
+	}
+	client, err := NewRedisClient(clientOption)
+	if err != nil {
+		return nil, NewErrCreateRedisClient("failed to create Redis client", err)
+	}
+	return &PubSub{
+		client:  client.client,
+		channel: channel,
+		seqKey:  fmt.Sprintf("pubsub:{%s}:seq", channel),
+	}, nil
+}
+
+// Publish numbers the message and publishes it, it returns the number.
+// Numbering and publishing are not atomic, so messages may be received
+// out of order.
+func (p *PubSub) Publish(ctx context.Context, message string) (int64, error) {
+	seq, err := p.client.Do(ctx, p.client.B().Incr().Key(p.seqKey).Build()).AsInt64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to number message: %w", err)
+	}
+	data := strconv.FormatInt(seq, 10) + " " + message
+	if err := p.client.Do(ctx, p.client.B().Publish().Channel(p.channel).Message(data).Build()).Error(); err != nil {
+		return 0, fmt.Errorf("failed to publish message: %w", err)
+	}
+	return seq, nil
+}
+
+// Sequence returns the number of the last published message.
+func (p *PubSub) Sequence(ctx context.Context) (int64, error) {
+	seq, err := p.client.Do(ctx, p.client.B().Get().Key(p.seqKey).Build()).AsInt64()
+	if rueidis.IsRedisNil(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sequence of channel %s: %w", p.channel, err)
+	}
+	return seq, nil
+}
+
+// Subscribe calls fn with the messages of the channel until ctx is done
+// or the subscription is broken, malformed messages are dropped.
+func (p *PubSub) Subscribe(ctx context.Context, fn func(seq int64, message string)) error {
+	return p.client.Receive(ctx, p.client.B().Subscribe().Channel(p.channel).Build(), func(msg rueidis.PubSubMessage) {
+		seq, message, ok := parsePubSubMessage(msg.Message)
+		if ok {
+			fn(seq, message)
+		}
+	})
+}
+
+// Close closes the client of the PubSub.
+func (p *PubSub) Close() {
+	p.client.Close()
+}
+
+func parsePubSubMessage(data string) (int64, string, bool) {
+	seqText, message, ok := strings.Cut(data, " ")
+	if !ok {
+		return 0, "", false
+	}
+	seq, err := strconv.ParseInt(seqText, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return seq, message, true
+}
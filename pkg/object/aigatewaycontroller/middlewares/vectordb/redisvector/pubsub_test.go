@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPubSub(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		values    = map[string]int64{}
+		published []string
+	)
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			if v, ok := values[args[1]]; ok {
+				return respBulk(strconv.FormatInt(v, 10))
+			}
+			return "$-1\r\n"
+		case "INCR":
+			values[args[1]]++
+			return ":" + strconv.FormatInt(values[args[1]], 10) + "\r\n"
+		case "PUBLISH":
+			published = append(published, args[2])
+			return ":1\r\n"
+		case "SUBSCRIBE":
+			// the subscription receives a malformed message and a
+			// published one right after subscribing.
+			return respArray(respBulk("subscribe"), respBulk(args[1]), ":1\r\n") +
+				respArray(respBulk("message"), respBulk(args[1]), respBulk("malformed")) +
+				respArray(respBulk("message"), respBulk(args[1]), respBulk("7 hello"))
+		case "UNSUBSCRIBE":
+			return respArray(respBulk("unsubscribe"), respBulk(args[1]), ":0\r\n")
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	pubsub := &PubSub{client: client.client, channel: "cache", seqKey: "pubsub:{cache}:seq"}
+	ctx := context.Background()
+
+	seq, err := pubsub.Sequence(ctx)
+	assert.NoError(err)
+	assert.Zero(seq)
+
+	seq, err = pubsub.Publish(ctx, `{"kind":"purge"}`)
+	assert.NoError(err)
+	assert.Equal(int64(1), seq)
+	seq, err = pubsub.Publish(ctx, `{"kind":"purge"}`)
+	assert.NoError(err)
+	assert.Equal(int64(2), seq)
+	assert.Equal([]string{`1 {"kind":"purge"}`, `2 {"kind":"purge"}`}, published)
+
+	seq, err = pubsub.Sequence(ctx)
+	assert.NoError(err)
+	assert.Equal(int64(2), seq)
+
+	received := make(chan string, 1)
+	subCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- pubsub.Subscribe(subCtx, func(seq int64, message string) {
+			received <- strconv.FormatInt(seq, 10) + ":" + message
+		})
+	}()
+	select {
+	case msg := <-received:
+		assert.Equal("7:hello", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription is not stopped")
+	}
+}
+
+func TestParsePubSubMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	seq, message, ok := parsePubSubMessage("12 a b")
+	assert.True(ok)
+	assert.Equal(int64(12), seq)
+	assert.Equal("a b", message)
+
+	_, _, ok = parsePubSubMessage("message")
+	assert.False(ok)
+	_, _, ok = parsePubSubMessage("x message")
+	assert.False(ok)
+}
+
+func TestIsUnknownIndexError(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newFakeRedis(t, func(args []string) string {
+		if args[1] == "movie" {
+			return "-Unknown Index name\r\n"
+		}
+		return "-ERR other error\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	err := client.client.Do(ctx, client.client.B().FtDropindex().Index("movie").Dd().Build()).Error()
+	assert.True(isUnknownIndexError(err))
+	err = client.client.Do(ctx, client.client.B().FtDropindex().Index("book").Dd().Build()).Error()
+	assert.False(isUnknownIndexError(err))
+}
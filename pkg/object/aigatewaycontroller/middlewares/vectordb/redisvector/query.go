@@ -19,18 +19,38 @@ package redisvector
 
 import (
 	"fmt"
+	"slices"
 	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
 )
 
 const (
-	vectorPlaceHolder   = "vector"
-	distancePlaceHolder = "distance"
+	vectorPlaceHolder   = "vec"
+	distancePlaceHolder = reservedFieldPrefix + "distance"
+
+	// DefaultDialect is the query dialect of vector queries. MinDialect
+	// is kept for the Redis Stack versions pinned to DIALECT 1, the vector
+	// is still passed by PARAMS, which they accept for KNN queries, while
+	// the range queries of VECTOR_RANGE need RangeDialect at least.
+	// MaxDialect is the latest dialect of RediSearch.
+	DefaultDialect = 2
+	MinDialect     = 1
+	RangeDialect   = 2
+	MaxDialect     = 4
+
+	// MaxQueryResults is the maximum of the offset plus the limit of a
+	// query, and the k of its KNN clause, RediSearch rejects the queries
+	// beyond MAXSEARCHRESULTS, which is 10000 by default.
+	MaxQueryResults = 10000
 )
 
 type (
 	RedisVectorQuery struct {
 		index              string
 		filters            string
+		queryFilters       []*vecdbtypes.RedisQueryFilter
 		vectorFilterValues []float32
 		vectorFilterKey    string
 		noContent          bool
@@ -39,12 +59,20 @@ type (
 		withSortKeys       bool
 		inKeys             []string
 		inFields           []string
-		returns            []string
+		returnFields       []string
 		limit              int
+		knn                int
+		efRuntime          int
 		timeout            int
 		scoreThreshold     float32
+		distanceMetric     DistanceMetric
+		vectorType         VectorDataType
 		offset             int
 		sortBy             []string
+		dialect            int
+		// json means the documents are JSON, which are returned as a
+		// whole, and the returned fields are selected by the client.
+		json bool
 	}
 
 	Option func(*RedisVectorQuery)
@@ -101,18 +129,50 @@ func WithInFields(inFields []string) Option {
 	}
 }
 
-func WithReturns(returns []string) Option {
+// WithReturnFields projects the results to the fields, the ID and the
+// score are always returned. All fields are returned if it is empty.
+func WithReturnFields(fields []string) Option {
+	return func(f *RedisVectorQuery) {
+		f.returnFields = fields
+	}
+}
+
+// WithJSON queries an index of JSON documents.
+func WithJSON() Option {
 	return func(f *RedisVectorQuery) {
-		f.returns = returns
+		f.json = true
 	}
 }
 
+// WithLimit sets the number of results of a page, default 1.
 func WithLimit(limit int) Option {
 	return func(f *RedisVectorQuery) {
 		f.limit = limit
 	}
 }
 
+// WithKNN sets the k of the KNN clause, which is the number of nearest
+// neighbors the pages are taken from, and caps the total of the query.
+// It is the offset plus the limit by default, so every page is full, but
+// the total is capped at the end of the page then. To iterate the pages
+// by the total, set the same k for all pages, it is set by
+// vecdbtypes.WithRedisKNN for similarity searches. A page beyond k is cut
+// short, or empty.
+func WithKNN(k int) Option {
+	return func(f *RedisVectorQuery) {
+		f.knn = k
+	}
+}
+
+// WithEFRuntime sets the number of candidates kept by the KNN search of
+// an HNSW index, which overrides the EF_RUNTIME of the index. It must not
+// be less than k, and it is ignored by FLAT indexes and range queries.
+func WithEFRuntime(efRuntime int) Option {
+	return func(f *RedisVectorQuery) {
+		f.efRuntime = efRuntime
+	}
+}
+
 func WithTimeout(timeout int) Option {
 	return func(f *RedisVectorQuery) {
 		f.timeout = timeout
@@ -125,51 +185,329 @@ func WithScoreThreshold(scoreThreshold float32) Option {
 	}
 }
 
+// WithDistanceMetric sets the distance metric of the vector field, which
+// converts the score threshold to the distance of range queries, and
+// normalizes the distances of the results to their scores. It is COSINE
+// by default.
+func WithDistanceMetric(metric DistanceMetric) Option {
+	return func(f *RedisVectorQuery) {
+		f.distanceMetric = metric
+	}
+}
+
+// WithVectorType sets the data type of the vector field, the query vector
+// is encoded in it, otherwise RediSearch rejects the query. It is FLOAT32
+// by default.
+func WithVectorType(vectorType VectorDataType) Option {
+	return func(f *RedisVectorQuery) {
+		f.vectorType = vectorType
+	}
+}
+
+// WithOffset sets the number of results skipped before the page.
 func WithOffset(offset int) Option {
 	return func(f *RedisVectorQuery) {
 		f.offset = offset
 	}
 }
 
+// WithSortBy sorts the results by a field and an optional direction, ASC
+// or DESC, like [created_at DESC]. The field must be declared sortable in
+// the index schema, see Validate. The results are sorted by the distance
+// ascending by default.
 func WithSortBy(sortBy []string) Option {
 	return func(f *RedisVectorQuery) {
 		f.sortBy = sortBy
 	}
 }
 
+// WithDialect sets the query dialect, for the Redis Stack versions not
+// supporting the later dialects, or relying on their syntax. It is
+// DefaultDialect if it is 0.
+func WithDialect(dialect int) Option {
+	return func(f *RedisVectorQuery) {
+		f.dialect = dialect
+	}
+}
+
+// getDialect returns the query dialect.
+func (f *RedisVectorQuery) getDialect() int {
+	if f.dialect == 0 {
+		return DefaultDialect
+	}
+	return f.dialect
+}
+
+// WithFilters adds the structured pre-filters, which are rendered after
+// the filters string of the query.
+func WithFilters(filters ...*vecdbtypes.RedisQueryFilter) Option {
+	return func(f *RedisVectorQuery) {
+		f.queryFilters = append(f.queryFilters, filters...)
+	}
+}
+
+// Validate checks the page and the sorting of the query, and the sorted
+// field and the structured filters against the schema of the index if it
+// is not nil, RediSearch reports the filters on unknown fields obscurely.
+func (f *RedisVectorQuery) Validate(schema *IndexSchema) error {
+	switch {
+	case f.offset < 0:
+		return NewErrInvalidQueryPage(f.offset, f.limit, "offset cannot be negative")
+	case f.limit < 0:
+		return NewErrInvalidQueryPage(f.offset, f.limit, "limit cannot be negative")
+	case f.offset+f.limit > MaxQueryResults:
+		return NewErrInvalidQueryPage(f.offset, f.limit, fmt.Sprintf("offset plus limit exceeds %d", MaxQueryResults))
+	case f.knn < 0 || f.knn > MaxQueryResults:
+		return NewErrInvalidQueryPage(f.offset, f.limit, fmt.Sprintf("k of KNN must be between 0 and %d", MaxQueryResults))
+	case f.efRuntime < 0:
+		return NewErrInvalidQueryPage(f.offset, f.limit, "EF_RUNTIME cannot be negative")
+	case f.efRuntime > 0 && !f.isRange() && f.efRuntime < f.k():
+		return NewErrInvalidQueryPage(f.offset, f.limit, fmt.Sprintf("EF_RUNTIME %d is less than k %d", f.efRuntime, f.k()))
+	}
+	if err := validateDialect(f.dialect); err != nil {
+		return err
+	}
+	if f.isRange() {
+		if err := ValidateRangeDialect(f.dialect); err != nil {
+			return err
+		}
+	}
+	if err := validateSortBy(f.sortBy); err != nil {
+		return err
+	}
+	if schema == nil {
+		return nil
+	}
+	if len(f.sortBy) > 0 && f.sortBy[0] != distancePlaceHolder && !schema.isSortable(f.sortBy[0]) {
+		return NewErrInvalidQuerySort(f.sortBy[0], "field is not declared sortable in the index schema")
+	}
+	return validateQueryFilters(schema, f.queryFilters)
+}
+
+// validateDialect checks the query dialect, 0 means DefaultDialect.
+func validateDialect(dialect int) error {
+	if dialect != 0 && (dialect < MinDialect || dialect > MaxDialect) {
+		return fmt.Errorf("dialect %d must be between %d and %d", dialect, MinDialect, MaxDialect)
+	}
+	return nil
+}
+
+// ValidateRangeDialect checks the query dialect of the range queries of a
+// score threshold, 0 means DefaultDialect.
+func ValidateRangeDialect(dialect int) error {
+	if dialect != 0 && dialect < RangeDialect {
+		return fmt.Errorf("dialect %d does not support VECTOR_RANGE of score thresholds, it must be %d at least", dialect, RangeDialect)
+	}
+	return nil
+}
+
+// validateSortBy checks the form of the sorting, which is a field and an
+// optional direction.
+func validateSortBy(sortBy []string) error {
+	switch {
+	case len(sortBy) == 0:
+		return nil
+	case len(sortBy) > 2:
+		return NewErrInvalidQuerySort(sortBy[0], "only a field and a direction are allowed")
+	case sortBy[0] == "":
+		return NewErrInvalidQuerySort("", "field is required")
+	case len(sortBy) == 2 && !strings.EqualFold(sortBy[1], "ASC") && !strings.EqualFold(sortBy[1], "DESC"):
+		return NewErrInvalidQuerySort(sortBy[0], fmt.Sprintf("direction %s is not ASC or DESC", sortBy[1]))
+	}
+	return nil
+}
+
+// validateQueryFilters checks the structured filters against the schema
+// of the index.
+func validateQueryFilters(schema *IndexSchema, filters []*vecdbtypes.RedisQueryFilter) error {
+	fieldName := func(name, as string) string {
+		if as != "" {
+			return as
+		}
+		return name
+	}
+	isTag := func(field string) bool {
+		return slices.ContainsFunc(schema.Tags, func(t Tag) bool { return fieldName(t.Name, t.As) == field })
+	}
+	isNumeric := func(field string) bool {
+		return slices.ContainsFunc(schema.Numerics, func(n Numeric) bool { return fieldName(n.Name, n.As) == field })
+	}
+
+	for _, filter := range filters {
+		field := filter.Field
+		isRange := filter.Min != nil || filter.Max != nil
+		switch {
+		case field == "":
+			return NewErrInvalidQueryFilter(field, "field is required")
+		case len(filter.Tags) > 0 && isRange:
+			return NewErrInvalidQueryFilter(field, "tags and range cannot be both set")
+		case len(filter.Tags) == 0 && !isRange:
+			return NewErrInvalidQueryFilter(field, "tags or range is required")
+		}
+
+		if len(filter.Tags) > 0 {
+			if !isTag(field) {
+				if isNumeric(field) {
+					return NewErrInvalidQueryFilter(field, "tags are given for a numeric field")
+				}
+				return NewErrInvalidQueryFilter(field, "field is not a tag field of the index schema")
+			}
+			if slices.Contains(filter.Tags, "") {
+				return NewErrInvalidQueryFilter(field, "tags cannot be empty")
+			}
+			continue
+		}
+		if !isNumeric(field) {
+			if isTag(field) {
+				return NewErrInvalidQueryFilter(field, "range is given for a tag field")
+			}
+			return NewErrInvalidQueryFilter(field, "field is not a numeric field of the index schema")
+		}
+		if filter.Min != nil && filter.Max != nil && *filter.Min > *filter.Max {
+			return NewErrInvalidQueryFilter(field, "min is greater than max")
+		}
+	}
+	return nil
+}
+
+// preFilter returns the pre-filter expression of the KNN clause, which is
+// the filters string and the structured filters. The filters string is
+// put in parentheses, so its unions never widen the structured filters.
+func (f *RedisVectorQuery) preFilter() string {
+	parts := make([]string, 0, len(f.queryFilters)+1)
+	if f.filters != "" {
+		if len(f.queryFilters) == 0 {
+			return f.filters
+		}
+		parts = append(parts, "("+f.filters+")")
+	}
+	for _, filter := range f.queryFilters {
+		parts = append(parts, renderQueryFilter(filter))
+	}
+	return strings.Join(parts, " ")
+}
+
+// toRedisQueryFilters converts the tag filters to the structured filters.
+func toRedisQueryFilters(filters []*vecdbtypes.TagFilter) []*vecdbtypes.RedisQueryFilter {
+	result := make([]*vecdbtypes.RedisQueryFilter, 0, len(filters))
+	for _, filter := range filters {
+		result = append(result, &vecdbtypes.RedisQueryFilter{Field: filter.Field, Tags: filter.Tags, Negate: filter.Negate})
+	}
+	return result
+}
+
+// renderQueryFilter renders a structured filter, like @tenant:{acme | beta}
+// or -@created_at:[1717000000 +inf].
+func renderQueryFilter(filter *vecdbtypes.RedisQueryFilter) string {
+	var expr string
+	if len(filter.Tags) > 0 {
+		tags := make([]string, len(filter.Tags))
+		for i, tag := range filter.Tags {
+			tags[i] = escapeTag(tag)
+		}
+		expr = fmt.Sprintf("@%s:{%s}", filter.Field, strings.Join(tags, " | "))
+	} else {
+		bound := func(v *float64, unbounded string) string {
+			if v == nil {
+				return unbounded
+			}
+			return strconv.FormatFloat(*v, 'f', -1, 64)
+		}
+		expr = fmt.Sprintf("@%s:[%s %s]", filter.Field, bound(filter.Min, "-inf"), bound(filter.Max, "+inf"))
+	}
+	if filter.Negate {
+		return "-" + expr
+	}
+	return expr
+}
+
+// escapeTag escapes the punctuation and spaces of a tag, which separate
+// the tags in queries otherwise.
+func escapeTag(tag string) string {
+	var sb strings.Builder
+	for _, r := range tag {
+		if strings.ContainsRune(",.<>{}[]\"':;!@#$%^&*()-+=~|/\\ ", r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// isRange returns whether the query is a range query of the score
+// threshold rather than a KNN query.
+func (f *RedisVectorQuery) isRange() bool {
+	return f.scoreThreshold > 0 && f.scoreThreshold < 1
+}
+
+// k returns the k of the KNN clause, the total of a KNN query is the
+// number of the nearest neighbors found, which is at most k, while the
+// total of a range query is the number of all matches.
+func (f *RedisVectorQuery) k() int {
+	if f.knn > 0 {
+		return f.knn
+	}
+	return max(f.offset, 0) + f.limit
+}
+
+// returns returns the fields of the RETURN clause, which are the return
+// fields with the ID fields and the distance, so the results keep their
+// IDs and scores. JSON documents are returned as a whole and projected by
+// the client, as RETURN of JSON needs JSONPath.
+func (f *RedisVectorQuery) returns() []string {
+	if len(f.returnFields) == 0 || f.json {
+		return nil
+	}
+	returns := make([]string, 0, len(f.returnFields)+3)
+	for _, field := range f.returnFields {
+		if !slices.Contains(returns, field) {
+			returns = append(returns, field)
+		}
+	}
+	// the id field is the ID of documents written by old versions.
+	for _, field := range []string{idField, "id", distancePlaceHolder} {
+		if !slices.Contains(returns, field) {
+			returns = append(returns, field)
+		}
+	}
+	return returns
+}
+
 func (f *RedisVectorQuery) ToCommand() *RedisArbitraryCommand {
 	command := &RedisArbitraryCommand{
 		Commands: []string{"FT.SEARCH"},
 		Keys:     []string{f.index},
 	}
-	if f.returns == nil {
-		f.returns = []string{}
-	}
-
 	if f.limit == 0 {
 		f.limit = 1
 	}
 
-	params := []string{vectorPlaceHolder, float32VectorToString(f.vectorFilterValues)}
-	if f.scoreThreshold > 0 && f.scoreThreshold < 1 {
+	preFilter := f.preFilter()
+	vector, _ := vectorToString(f.vectorFilterValues, f.vectorType)
+	params := []string{vectorPlaceHolder, vector}
+	if f.isRange() {
 		filter := fmt.Sprintf("@%s:[VECTOR_RANGE $distance_threshold $%s]=>{$YIELD_DISTANCE_AS: %s}", f.vectorFilterKey, vectorPlaceHolder, distancePlaceHolder)
-		if f.filters != "" {
-			filter = fmt.Sprintf("\"%s %s\"", f.filters, filter)
-			command.Args = append(command.Args, filter)
-			params = append(params, "distance_threshold", strconv.FormatFloat(float64(1.0-f.scoreThreshold), 'f', -1, 32))
+		if preFilter != "" {
+			filter = fmt.Sprintf("(%s) %s", preFilter, filter)
 		}
+		command.Args = append(command.Args, filter)
+		threshold := f.distanceMetric.distanceThreshold(float64(f.scoreThreshold))
+		params = append(params, "distance_threshold", strconv.FormatFloat(threshold, 'f', -1, 32))
 	} else {
 		filter := "*"
-		if f.filters != "" {
-			filter = f.filters
+		if preFilter != "" {
+			filter = preFilter
+		}
+		knn := fmt.Sprintf("(%s)=>[KNN %d @%s $%s AS %s]", filter, f.k(), f.vectorFilterKey, vectorPlaceHolder, distancePlaceHolder)
+		if f.efRuntime > 0 {
+			knn += fmt.Sprintf("=>{$EF_RUNTIME: %d}", f.efRuntime)
 		}
-		command.Args = append(command.Args, fmt.Sprintf("(%s)=>[KNN %d @%s $%s AS %s]", filter, f.limit, f.vectorFilterKey, vectorPlaceHolder, distancePlaceHolder))
+		command.Args = append(command.Args, knn)
 	}
 
-	if l := len(f.returns); l > 0 {
-		f.returns = append(f.returns, distancePlaceHolder)
-		command.Args = append(command.Args, "RETURN", strconv.Itoa(len(f.returns)))
-		command.Args = append(command.Args, f.returns...)
+	if returns := f.returns(); len(returns) > 0 {
+		command.Args = append(command.Args, "RETURN", strconv.Itoa(len(returns)))
+		command.Args = append(command.Args, returns...)
 	}
 
 	command.Args = append(command.Args, "SORTBY")
@@ -178,14 +516,14 @@ func (f *RedisVectorQuery) ToCommand() *RedisArbitraryCommand {
 	}
 	command.Args = append(command.Args, f.sortBy...)
 
-	command.Args = append(command.Args, "DIALECT", "2")
-	if f.offset < 0 {
-		f.offset = 0
-	}
-	command.Args = append(command.Args, "LIMIT", strconv.Itoa(f.offset), strconv.Itoa(f.limit))
+	command.Args = append(command.Args, "LIMIT", strconv.Itoa(max(f.offset, 0)), strconv.Itoa(f.limit))
 
+	// the vector is passed by PARAMS rather than in the query, so it is
+	// never parsed as the query syntax, and it is elided by Redacted.
 	command.Args = append(command.Args, "PARAMS", strconv.Itoa(len(params)))
+	command.redacted = append(command.redacted, len(command.Args)+1)
 	command.Args = append(command.Args, params...)
+	command.Args = append(command.Args, "DIALECT", strconv.Itoa(f.getDialect()))
 	if f.noContent {
 		command.Args = append(command.Args, "NO_CONTENT")
 	}
@@ -17,11 +17,18 @@
 
 package redisvector
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
 
 func TestQueryToCommand(t *testing.T) {
 	vector := []float32{0.1, 0.2, 0.3}
 	vectorValue := float32VectorToString(vector)
+	min := 1717000000.0
 	tests := []struct {
 		name    string
 		query   *RedisVectorQuery
@@ -30,12 +37,83 @@ func TestQueryToCommand(t *testing.T) {
 		{
 			name:    "simple query",
 			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector),
-			command: "FT.SEARCH books-idx (*)=>[KNN 1 @title_embedding $vector AS distance] SORTBY distance ASC DIALECT 2 LIMIT 0 1 PARAMS 2 vector " + vectorValue,
+			command: "FT.SEARCH books-idx (*)=>[KNN 1 @title_embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 2 vec " + vectorValue + " DIALECT 2",
+		},
+		{
+			name:    "query of FLOAT16 vectors",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithVectorType(VectorDataTypeFloat16)),
+			command: "FT.SEARCH books-idx (*)=>[KNN 1 @title_embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 2 vec " + float32ToFloat16Bytes(vector) + " DIALECT 2",
+		},
+		{
+			name:    "query with score threshold",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithScoreThreshold(0.5)),
+			command: "FT.SEARCH books-idx @title_embedding:[VECTOR_RANGE $distance_threshold $vec]=>{$YIELD_DISTANCE_AS: __eg_distance} SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 4 vec " + vectorValue + " distance_threshold 0.5 DIALECT 2",
+		},
+		{
+			name:    "query with score threshold of L2",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithScoreThreshold(0.25), WithDistanceMetric(DistanceMetricL2)),
+			command: "FT.SEARCH books-idx @title_embedding:[VECTOR_RANGE $distance_threshold $vec]=>{$YIELD_DISTANCE_AS: __eg_distance} SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 4 vec " + vectorValue + " distance_threshold 3 DIALECT 2",
 		},
 		{
 			name:    "query with filters",
-			query:   NewRedisVectorQuery("books-idx", "@genre{fiction}", "title_embedding", vector, WithNoContent(), WithVerbatim(), WithScores(), WithSortBy([]string{"title", "DESC"}), WithSortKeys(), WithInKeys([]string{"book_id"}), WithInFields([]string{"title", "author"}), WithReturns([]string{"title", "author"}), WithOffset(5), WithLimit(10), WithScoreThreshold(0.7)),
-			command: "FT.SEARCH books-idx \"@genre{fiction} @title_embedding:[VECTOR_RANGE $distance_threshold $vector]=>{$YIELD_DISTANCE_AS: distance}\" RETURN 3 title author distance SORTBY title DESC DIALECT 2 LIMIT 5 10 PARAMS 4 vector " + vectorValue + " distance_threshold 0.3 NO_CONTENT VERBATIM WITHSCORES WITHSORTKEYS INKEYS 1 book_id INFIELDS 2 title author",
+			query:   NewRedisVectorQuery("books-idx", "@genre{fiction}", "title_embedding", vector, WithNoContent(), WithVerbatim(), WithScores(), WithSortBy([]string{"title", "DESC"}), WithSortKeys(), WithInKeys([]string{"book_id"}), WithInFields([]string{"title", "author"}), WithReturnFields([]string{"title", "author"}), WithOffset(5), WithLimit(10), WithScoreThreshold(0.7)),
+			command: "FT.SEARCH books-idx (@genre{fiction}) @title_embedding:[VECTOR_RANGE $distance_threshold $vec]=>{$YIELD_DISTANCE_AS: __eg_distance} RETURN 5 title author __eg_id id __eg_distance SORTBY title DESC LIMIT 5 10 PARAMS 4 vec " + vectorValue + " distance_threshold 0.3 DIALECT 2 NO_CONTENT VERBATIM WITHSCORES WITHSORTKEYS INKEYS 1 book_id INFIELDS 2 title author",
+		},
+		{
+			name: "query with structured filters",
+			query: NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithFilters(
+				&vecdbtypes.RedisQueryFilter{Field: "tenant", Tags: []string{"acme"}},
+				&vecdbtypes.RedisQueryFilter{Field: "created_at", Min: &min},
+			)),
+			command: "FT.SEARCH books-idx (@tenant:{acme} @created_at:[1717000000 +inf])=>[KNN 1 @title_embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 2 vec " + vectorValue + " DIALECT 2",
+		},
+		{
+			name: "query with filters string, negated and multi-value filters",
+			query: NewRedisVectorQuery("books-idx", "@genre:{fiction}", "title_embedding", vector, WithScoreThreshold(0.5), WithFilters(
+				&vecdbtypes.RedisQueryFilter{Field: "tenant", Tags: []string{"acme-corp", "beta inc"}},
+				&vecdbtypes.RedisQueryFilter{Field: "created_at", Max: &min, Negate: true},
+			)),
+			command: "FT.SEARCH books-idx ((@genre:{fiction}) @tenant:{acme\\-corp | beta\\ inc} -@created_at:[-inf 1717000000]) @title_embedding:[VECTOR_RANGE $distance_threshold $vec]=>{$YIELD_DISTANCE_AS: __eg_distance} SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 4 vec " + vectorValue + " distance_threshold 0.5 DIALECT 2",
+		},
+		{
+			name:    "knn query of the second page",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithOffset(20), WithLimit(10)),
+			command: "FT.SEARCH books-idx (*)=>[KNN 30 @title_embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 20 10 PARAMS 2 vec " + vectorValue + " DIALECT 2",
+		},
+		{
+			name:    "knn query with limit exceeding k",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithKNN(5), WithLimit(10)),
+			command: "FT.SEARCH books-idx (*)=>[KNN 5 @title_embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 0 10 PARAMS 2 vec " + vectorValue + " DIALECT 2",
+		},
+		{
+			name:    "knn query with EF_RUNTIME",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithLimit(10), WithEFRuntime(100)),
+			command: "FT.SEARCH books-idx (*)=>[KNN 10 @title_embedding $vec AS __eg_distance]=>{$EF_RUNTIME: 100} SORTBY __eg_distance ASC LIMIT 0 10 PARAMS 2 vec " + vectorValue + " DIALECT 2",
+		},
+		{
+			name:    "range query ignoring EF_RUNTIME",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithScoreThreshold(0.5), WithEFRuntime(100)),
+			command: "FT.SEARCH books-idx @title_embedding:[VECTOR_RANGE $distance_threshold $vec]=>{$YIELD_DISTANCE_AS: __eg_distance} SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 4 vec " + vectorValue + " distance_threshold 0.5 DIALECT 2",
+		},
+		{
+			name:    "query with projection",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithReturnFields([]string{"title", "title", "id"})),
+			command: "FT.SEARCH books-idx (*)=>[KNN 1 @title_embedding $vec AS __eg_distance] RETURN 4 title id __eg_id __eg_distance SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 2 vec " + vectorValue + " DIALECT 2",
+		},
+		{
+			name:    "query of json documents",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithJSON(), WithReturnFields([]string{"title"})),
+			command: "FT.SEARCH books-idx (*)=>[KNN 1 @title_embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 2 vec " + vectorValue + " DIALECT 2",
+		},
+		{
+			name:    "query of dialect 3",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithDialect(3)),
+			command: "FT.SEARCH books-idx (*)=>[KNN 1 @title_embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 2 vec " + vectorValue + " DIALECT 3",
+		},
+		{
+			name:    "query of dialect 1",
+			query:   NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithDialect(1)),
+			command: "FT.SEARCH books-idx (*)=>[KNN 1 @title_embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 2 vec " + vectorValue + " DIALECT 1",
 		},
 	}
 
@@ -45,6 +123,207 @@ func TestQueryToCommand(t *testing.T) {
 			if got != tt.command {
 				t.Errorf("RedisVectorQuery.ToCommand() = %v, want %v", got, tt.command)
 			}
+			// the query is not changed by rendering it.
+			if again := tt.query.ToCommand().ToString(); again != got {
+				t.Errorf("RedisVectorQuery.ToCommand() again = %v, want %v", again, got)
+			}
+		})
+	}
+}
+
+func TestQueryCommandRedacted(t *testing.T) {
+	vector := []float32{0.1, 0.2, 0.3}
+	command := NewRedisVectorQuery("books-idx", "", "title_embedding", vector, WithScoreThreshold(0.5)).ToCommand()
+	want := "FT.SEARCH books-idx @title_embedding:[VECTOR_RANGE $distance_threshold $vec]=>{$YIELD_DISTANCE_AS: __eg_distance} SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 4 vec <12 bytes> distance_threshold 0.5 DIALECT 2"
+	if got := command.Redacted(); got != want {
+		t.Errorf("Redacted() = %v, want %v", got, want)
+	}
+	// the command is not changed.
+	if !strings.Contains(command.ToString(), float32VectorToString(vector)) {
+		t.Errorf("ToString() = %v, want the vector", command.ToString())
+	}
+
+	for dialect, valid := range map[int]bool{0: true, 1: true, 2: true, 4: true, -1: false, 5: false} {
+		err := NewRedisVectorQuery("idx", "", "embedding", nil, WithDialect(dialect)).Validate(nil)
+		if valid != (err == nil) {
+			t.Errorf("Validate() of dialect %d = %v", dialect, err)
+		}
+	}
+	// the range queries of score thresholds need dialect 2 at least.
+	for dialect, valid := range map[int]bool{0: true, 1: false, 2: true, 4: true} {
+		err := NewRedisVectorQuery("idx", "", "embedding", nil, WithDialect(dialect), WithScoreThreshold(0.8)).Validate(nil)
+		if valid != (err == nil) {
+			t.Errorf("Validate() of range query of dialect %d = %v", dialect, err)
+		}
+	}
+}
+
+func TestQueryValidate(t *testing.T) {
+	schema := &IndexSchema{
+		Tags:     []Tag{{Name: "tenant"}, {Name: "lang", As: "language"}},
+		Numerics: []Numeric{{Name: "created_at"}},
+	}
+	low, high := 10.0, 5.0
+	tests := []struct {
+		name   string
+		filter *vecdbtypes.RedisQueryFilter
+		valid  bool
+	}{
+		{"tag filter", &vecdbtypes.RedisQueryFilter{Field: "tenant", Tags: []string{"acme", "beta"}}, true},
+		{"tag filter of alias", &vecdbtypes.RedisQueryFilter{Field: "language", Tags: []string{"en"}, Negate: true}, true},
+		{"range filter", &vecdbtypes.RedisQueryFilter{Field: "created_at", Min: &high, Max: &low}, true},
+		{"unknown field", &vecdbtypes.RedisQueryFilter{Field: "owner", Tags: []string{"bob"}}, false},
+		{"tags of numeric field", &vecdbtypes.RedisQueryFilter{Field: "created_at", Tags: []string{"1"}}, false},
+		{"range of tag field", &vecdbtypes.RedisQueryFilter{Field: "tenant", Min: &low}, false},
+		{"empty tag", &vecdbtypes.RedisQueryFilter{Field: "tenant", Tags: []string{""}}, false},
+		{"inverted range", &vecdbtypes.RedisQueryFilter{Field: "created_at", Min: &low, Max: &high}, false},
+		{"tags and range", &vecdbtypes.RedisQueryFilter{Field: "created_at", Tags: []string{"a"}, Min: &low}, false},
+		{"no condition", &vecdbtypes.RedisQueryFilter{Field: "tenant"}, false},
+		{"no field", &vecdbtypes.RedisQueryFilter{Tags: []string{"a"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewRedisVectorQuery("idx", "", "embedding", nil, WithFilters(tt.filter)).Validate(schema)
+			if tt.valid && err != nil {
+				t.Errorf("Validate() = %v, want nil", err)
+			}
+			if !tt.valid {
+				var filterErr *ErrInvalidQueryFilter
+				if !errors.As(err, &filterErr) {
+					t.Errorf("Validate() = %v, want ErrInvalidQueryFilter", err)
+				} else if !errors.Is(withErrorKind(err), vecdbtypes.ErrInvalidFilter) {
+					t.Errorf("withErrorKind(%v) is not ErrInvalidFilter", err)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryValidatePage(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		valid bool
+	}{
+		{"default", nil, true},
+		{"page", []Option{WithOffset(100), WithLimit(50)}, true},
+		{"limit exceeding k", []Option{WithKNN(5), WithLimit(10)}, true},
+		{"last page", []Option{WithOffset(MaxQueryResults - 10), WithLimit(10)}, true},
+		{"beyond max results", []Option{WithOffset(MaxQueryResults - 10), WithLimit(11)}, false},
+		{"negative offset", []Option{WithOffset(-1)}, false},
+		{"negative limit", []Option{WithLimit(-1)}, false},
+		{"k beyond max results", []Option{WithKNN(MaxQueryResults + 1)}, false},
+		{"EF_RUNTIME", []Option{WithLimit(10), WithEFRuntime(10)}, true},
+		{"EF_RUNTIME less than k", []Option{WithOffset(10), WithLimit(10), WithEFRuntime(15)}, false},
+		{"EF_RUNTIME of range query", []Option{WithLimit(10), WithScoreThreshold(0.5), WithEFRuntime(5)}, true},
+		{"negative EF_RUNTIME", []Option{WithEFRuntime(-1)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewRedisVectorQuery("idx", "", "embedding", nil, tt.opts...).Validate(nil)
+			if tt.valid && err != nil {
+				t.Errorf("Validate() = %v, want nil", err)
+			}
+			if !tt.valid {
+				var pageErr *ErrInvalidQueryPage
+				if !errors.As(err, &pageErr) {
+					t.Errorf("Validate() = %v, want ErrInvalidQueryPage", err)
+				} else if !errors.Is(withErrorKind(err), vecdbtypes.ErrInvalidPage) {
+					t.Errorf("withErrorKind(%v) is not ErrInvalidPage", err)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryValidateSortBy(t *testing.T) {
+	schema := &IndexSchema{
+		Tags:     []Tag{{Name: "tenant"}},
+		Texts:    []Text{{Name: "title", As: "t", Sortable: true, Weight: 2}},
+		Numerics: []Numeric{{Name: "created_at", Sortable: true}, {Name: "rating"}},
+	}
+	tests := []struct {
+		name   string
+		sortBy []string
+		valid  bool
+	}{
+		{"default", nil, true},
+		{"numeric descending", []string{"created_at", "DESC"}, true},
+		{"text alias ascending", []string{"t", "asc"}, true},
+		{"without direction", []string{"created_at"}, true},
+		{"distance", []string{distancePlaceHolder, "ASC"}, true},
+		{"not sortable", []string{"rating", "DESC"}, false},
+		{"tag not sortable", []string{"tenant"}, false},
+		{"unknown field", []string{"owner"}, false},
+		{"invalid direction", []string{"created_at", "UP"}, false},
+		{"too many arguments", []string{"created_at", "DESC", "title"}, false},
+		{"no field", []string{""}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewRedisVectorQuery("idx", "", "embedding", nil, WithSortBy(tt.sortBy)).Validate(schema)
+			if tt.valid && err != nil {
+				t.Errorf("Validate() = %v, want nil", err)
+			}
+			if !tt.valid {
+				var sortErr *ErrInvalidQuerySort
+				if !errors.As(err, &sortErr) {
+					t.Errorf("Validate() = %v, want ErrInvalidQuerySort", err)
+				} else if !errors.Is(withErrorKind(err), vecdbtypes.ErrInvalidFilter) {
+					t.Errorf("withErrorKind(%v) is not ErrInvalidFilter", err)
+				}
+			}
 		})
 	}
+
+	// the direction is checked without the schema.
+	query := NewRedisVectorQuery("idx", "", "embedding", nil, WithSortBy([]string{"rating", "DESC"}))
+	if err := query.Validate(nil); err != nil {
+		t.Errorf("Validate(nil) = %v, want nil", err)
+	}
+	command := query.ToCommand()
+	if !strings.Contains(strings.Join(command.Args, " "), "SORTBY rating DESC") {
+		t.Errorf("ToCommand() = %v, want SORTBY rating DESC", command.Args)
+	}
+}
+
+func TestQueryMandatoryTagFilters(t *testing.T) {
+	vector := []float32{0.1, 0.2, 0.3}
+	options := getHandlerSearchOptions(
+		vecdbtypes.WithMandatoryTagFilters(&vecdbtypes.TagFilter{Field: "acl", Tags: []string{"hr", "__public__"}, Array: true}),
+		vecdbtypes.WithRedisFilters("@acl:{finance} | *"),
+		vecdbtypes.WithTagFilters(&vecdbtypes.TagFilter{Field: "source", Tags: []string{"x} | @acl:{finance"}}),
+		vecdbtypes.WithLimit(1),
+	)
+	opts, err := toRedisQueryOptions(*options)
+	if err != nil {
+		t.Fatalf("toRedisQueryOptions() error = %v", err)
+	}
+	// the unions of the filters string and the tags can't escape their
+	// clauses, so the ACL clause always applies.
+	got := NewRedisVectorQuery("idx", options.RedisFilters, "embedding", vector, opts...).ToCommand().ToString()
+	want := "FT.SEARCH idx ((@acl:{finance} | *) @source:{x\\}\\ \\|\\ \\@acl\\:\\{finance} @acl:{hr | __public__})=>[KNN 1 @embedding $vec AS __eg_distance] SORTBY __eg_distance ASC LIMIT 0 1 PARAMS 2 vec " + float32VectorToString(vector) + " DIALECT 2"
+	if got != want {
+		t.Errorf("RedisVectorQuery.ToCommand() = %v, want %v", got, want)
+	}
+
+	options = getHandlerSearchOptions(vecdbtypes.WithMandatoryTagFilters(&vecdbtypes.TagFilter{Field: "acl"}))
+	if _, err := toRedisQueryOptions(*options); !errors.Is(err, vecdbtypes.ErrInvalidFilter) {
+		t.Errorf("toRedisQueryOptions() error = %v, want ErrInvalidFilter", err)
+	}
+}
+
+func TestSearchOptionsKNN(t *testing.T) {
+	// the k of similarity searches is set by the vecdbtypes options, so
+	// the pages of a search share the same k and total.
+	for _, offset := range []int{0, 10, 20} {
+		opts, err := toRedisQueryOptions(vecdbtypes.HandlerSearchOptions{Offset: offset, Limit: 10, RedisKNN: 25})
+		if err != nil {
+			t.Fatalf("toRedisQueryOptions() = %v", err)
+		}
+		command := NewRedisVectorQuery("idx", "", "embedding", []float32{1}, opts...).ToCommand().ToString()
+		if !strings.Contains(command, "=>[KNN 25 @embedding $vec AS __eg_distance]") {
+			t.Errorf("ToCommand() of offset %d = %v, want KNN 25", offset, command)
+		}
+	}
 }
@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	RebalanceStatusRunning   = "running"
+	RebalanceStatusCompleted = "completed"
+	RebalanceStatusFailed    = "failed"
+
+	rebalanceBatchSize = 100
+)
+
+var (
+	// ErrRebalanceRunning means the collection is being rebalanced by this
+	// process.
+	ErrRebalanceRunning = errors.New("rebalance is running")
+
+	// rebalances are the rebalances started by this process, they are
+	// kept after completion to report the results.
+	rebalancesLock sync.Mutex
+	rebalances     = map[string]*rebalance{}
+)
+
+// rebalance moves the documents of an index to the shards owning them, a
+// document is moved by DUMP and RESTORE, so its type and expiry are kept.
+// Moving a document is idempotent, so it is safe to run it again or by
+// other members at the same time.
+type rebalance struct {
+	spec  *ShardingSpec
+	ring  *hashRing
+	index string
+	keys  keyLayout
+
+	lock   sync.Mutex
+	report vecdbtypes.RebalanceReport
+}
+
+var _ vecdbtypes.Rebalancer = (*RedisVectorDB)(nil)
+
+func getRebalanceKey(spec *ShardingSpec, index string) string {
+	return strings.Join(spec.URLs, ",") + "|" + index
+}
+
+// StartRebalance starts moving the documents of the index to the shards
+// owning them in the background, the retired shards are emptied.
+func (r *RedisVectorDB) StartRebalance(name string) (_ *vecdbtypes.RebalanceReport, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if r.Spec.Shards == nil {
+		return nil, fmt.Errorf("rebalancing is not supported without shards")
+	}
+
+	rebalancesLock.Lock()
+	defer rebalancesLock.Unlock()
+	key := getRebalanceKey(r.Spec.Shards, name)
+	if b, ok := rebalances[key]; ok && b.getReport().Status == RebalanceStatusRunning {
+		return nil, ErrRebalanceRunning
+	}
+	b := newRebalance(r.Spec.Shards, name)
+	b.keys = r.getKeyLayout()
+	rebalances[key] = b
+	go b.run(context.Background())
+	return b.getReport(), nil
+}
+
+// RebalanceReport returns the report of the last rebalance of the index
+// started by this process.
+func (r *RedisVectorDB) RebalanceReport(name string) *vecdbtypes.RebalanceReport {
+	if r.Spec.Shards == nil {
+		return nil
+	}
+	rebalancesLock.Lock()
+	b := rebalances[getRebalanceKey(r.Spec.Shards, name)]
+	rebalancesLock.Unlock()
+	if b == nil {
+		return nil
+	}
+	return b.getReport()
+}
+
+func newRebalance(spec *ShardingSpec, index string) *rebalance {
+	return &rebalance{
+		spec:  spec,
+		ring:  newHashRing(spec.URLs, spec.GetVirtualNodes()),
+		index: index,
+		report: vecdbtypes.RebalanceReport{
+			Collection: index,
+			Status:     RebalanceStatusRunning,
+			StartedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}
+}
+
+func (b *rebalance) getReport() *vecdbtypes.RebalanceReport {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	report := b.report
+	return &report
+}
+
+func (b *rebalance) updateReport(fn func(r *vecdbtypes.RebalanceReport)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	fn(&b.report)
+}
+
+func (b *rebalance) run(ctx context.Context) {
+	err := b.rebalance(ctx)
+	b.updateReport(func(r *vecdbtypes.RebalanceReport) {
+		r.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		if err != nil {
+			r.Status = RebalanceStatusFailed
+			r.Error = err.Error()
+		} else {
+			r.Status = RebalanceStatusCompleted
+		}
+	})
+	report := b.getReport()
+	if err != nil {
+		logger.Errorf("rebalance of index %s failed: %v", b.index, err)
+		return
+	}
+	logger.Infof("rebalance of index %s completed, %d keys scanned, %d documents moved, %d conflicts",
+		b.index, report.ScannedKeys, report.Moved, report.Conflicts)
+}
+
+// rebalance scans the keys of the index in every shard, and moves the
+// ones owned by other shards.
+func (b *rebalance) rebalance(ctx context.Context) error {
+	urls := append(append([]string{}, b.spec.URLs...), b.spec.Retired...)
+	clients := make(map[string]rueidis.Client, len(urls))
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	for _, url := range urls {
+		option, err := parseURL(url)
+		if err != nil {
+			return NewErrParsingRedisURL("failed to parse Redis URL", err)
+		}
+		client, err := NewRedisClient(option)
+		if err != nil {
+			return NewErrCreateRedisClient("failed to create Redis client of shard "+shardAddress(url), err)
+		}
+		clients[url] = client.client
+	}
+
+	for _, url := range urls {
+		source := clients[url]
+		var cursor uint64
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			entry, err := source.Do(ctx, source.B().Scan().Cursor(cursor).Match(escapeGlob(b.keys.getPrefix(b.index))+"*").
+				Count(rebalanceBatchSize).Build()).AsScanEntry()
+			if err != nil {
+				return fmt.Errorf("failed to scan shard %s: %w", shardAddress(url), err)
+			}
+
+			moves := map[string][]string{}
+			for _, key := range entry.Elements {
+				if owner := b.ring.owner(key); owner != url {
+					moves[owner] = append(moves[owner], key)
+				}
+			}
+			b.updateReport(func(r *vecdbtypes.RebalanceReport) { r.ScannedKeys += int64(len(entry.Elements)) })
+			for owner, keys := range moves {
+				if err := b.moveKeys(ctx, source, clients[owner], keys); err != nil {
+					return fmt.Errorf("failed to move documents from shard %s to %s: %w", shardAddress(url), shardAddress(owner), err)
+				}
+			}
+
+			if entry.Cursor == 0 {
+				break
+			}
+			cursor = entry.Cursor
+		}
+	}
+	return nil
+}
+
+// moveKeys moves the keys from the source to the target, the keys deleted
+// since the scan are skipped. A key existing in the target is newer, since
+// documents are written to their owners, so it is kept and the key of the
+// source is deleted.
+func (b *rebalance) moveKeys(ctx context.Context, source, target rueidis.Client, keys []string) error {
+	moved, conflicts, err := moveKeys(ctx, source, target, keys, nil)
+	if err != nil {
+		return err
+	}
+	b.updateReport(func(r *vecdbtypes.RebalanceReport) {
+		r.Moved += moved
+		r.Conflicts += conflicts
+	})
+	return nil
+}
+
+// moveKeys moves the keys from the source to the target by DUMP and
+// RESTORE with their TTLs, the keys are renamed by rename if it is not
+// nil. The keys deleted since the scan are skipped, and the keys existing
+// in the target are kept and counted as conflicts. The keys of the source
+// are deleted once they are restored or conflicted.
+func moveKeys(ctx context.Context, source, target rueidis.Client, keys []string, rename func(string) string) (moved, conflicts int64, err error) {
+	if len(keys) == 0 {
+		return 0, 0, nil
+	}
+	if rename == nil {
+		rename = func(key string) string { return key }
+	}
+	commands := make(rueidis.Commands, 0, 2*len(keys))
+	for _, key := range keys {
+		commands = append(commands, source.B().Dump().Key(key).Build(), source.B().Pttl().Key(key).Build())
+	}
+	results := source.DoMulti(ctx, commands...)
+
+	restores := make(rueidis.Commands, 0, len(keys))
+	restored := make([]string, 0, len(keys))
+	for i, key := range keys {
+		data, err := results[2*i].ToString()
+		if rueidis.IsRedisNil(err) {
+			continue
+		}
+		if err != nil {
+			return moved, conflicts, fmt.Errorf("failed to dump %s: %w", key, err)
+		}
+		ttl, err := results[2*i+1].AsInt64()
+		if err != nil {
+			return moved, conflicts, fmt.Errorf("failed to get ttl of %s: %w", key, err)
+		}
+		switch {
+		case ttl == -2:
+			// the key is expired after the dump.
+			continue
+		case ttl < 0:
+			ttl = 0
+		}
+		restores = append(restores, target.B().Restore().Key(rename(key)).Ttl(ttl).SerializedValue(data).Build())
+		restored = append(restored, key)
+	}
+	if len(restores) == 0 {
+		return moved, conflicts, nil
+	}
+
+	deletes := make(rueidis.Commands, 0, len(restored))
+	for i, res := range target.DoMulti(ctx, restores...) {
+		err := res.Error()
+		if redisErr, ok := rueidis.IsRedisErr(err); ok && strings.HasPrefix(redisErr.Error(), "BUSYKEY") {
+			conflicts++
+		} else if err != nil {
+			return moved, conflicts, fmt.Errorf("failed to restore %s: %w", rename(restored[i]), err)
+		} else {
+			moved++
+		}
+		deletes = append(deletes, source.B().Del().Key(restored[i]).Build())
+	}
+	for i, res := range source.DoMulti(ctx, deletes...) {
+		if err := res.Error(); err != nil {
+			return moved, conflicts, fmt.Errorf("failed to delete %s: %w", restored[i], err)
+		}
+	}
+	return moved, conflicts, nil
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbmetrics"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// errGroupChanged means the documents of a group are changed by others
+// during the replacement.
+var errGroupChanged = errors.New("documents of the group are changed concurrently")
+
+var _ vecdbtypes.DocumentReplacer = (*RedisVectorHandler)(nil)
+
+// getGroupKey returns the key of the set of the keys of the documents of
+// a group. The keys of the documents and the set have the group as their
+// hash tag, so they are in the same slot and replaced in a transaction.
+func getGroupKey(index, field, group string) string {
+	return fmt.Sprintf("group:{%s}:%s:%s", group, index, field)
+}
+
+// ReplaceDocuments replaces the documents of the group in a transaction.
+// The documents are stored with the group as the hash tag of their keys,
+// and the keys of a group are kept in a set, which is watched, so the
+// replacement fails if the group is changed concurrently.
+func (r *RedisVectorHandler) ReplaceDocuments(ctx context.Context, field, group string, docs []map[string]any) (_ []string, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if r.payloads != nil {
+		return nil, NewErrInsertDocument("failed to replace documents", fmt.Errorf("%w with payload store", vecdbtypes.ErrReplaceNotSupported))
+	}
+	if group == "" || strings.ContainsAny(group, "{}") {
+		return nil, NewErrInsertDocument("failed to replace documents", fmt.Errorf("invalid group %q", group))
+	}
+	docs, err = vecdbtypes.ValidateDocumentVectors(docs, r.validation)
+	if err != nil {
+		return nil, err
+	}
+	docs, err = r.client.ids.resolveAll(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	tagged := make([]map[string]any, 0, len(docs))
+	for _, doc := range docs {
+		doc = maps.Clone(doc)
+		id, ok := doc["id"]
+		if !ok {
+			id = uuid.NewString()
+		}
+		doc["id"] = fmt.Sprintf("{%s}:%v", group, id)
+		tagged = append(tagged, doc)
+	}
+	keys, err := r.client.ReplaceGroupWithHash(ctx, r.index, getGroupKey(r.index, field, group), tagged)
+	if err != nil {
+		return nil, NewErrInsertDocument("failed to replace documents", err)
+	}
+	return keys, nil
+}
+
+// ReplaceGroupWithHash deletes the documents whose keys are in the set of
+// the group, and inserts the documents in a transaction.
+func (c *RedisClient) ReplaceGroupWithHash(ctx context.Context, index, groupKey string, docs []map[string]any) (_ []string, err error) {
+	defer c.metrics.Observe(vecdbmetrics.OperationInsert, time.Now(), &err)
+	c.metrics.ObserveBatch(vecdbmetrics.OperationInsert, len(docs))
+	ctx, done := c.startOperation(ctx, operationInsert)
+	defer done(&err)
+	hmsets := make([]*RedisArbitraryCommand, 0, len(docs))
+	keys := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		command, _, err := c.toWriteCommand(c.keys.getPrefix(index), doc)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, command.Keys[0])
+		hmsets = append(hmsets, command)
+	}
+
+	err = c.client.Dedicated(func(dc rueidis.DedicatedClient) error {
+		if err := dc.Do(ctx, dc.B().Watch().Key(groupKey).Build()).Error(); err != nil {
+			return err
+		}
+		oldKeys, err := dc.Do(ctx, dc.B().Smembers().Key(groupKey).Build()).AsStrSlice()
+		if err != nil {
+			dc.Do(ctx, dc.B().Unwatch().Build())
+			return err
+		}
+
+		commands := make(rueidis.Commands, 0, len(oldKeys)+len(hmsets)+4)
+		commands = append(commands, dc.B().Multi().Build())
+		for _, key := range oldKeys {
+			commands = append(commands, dc.B().Del().Key(key).Build())
+		}
+		for _, command := range hmsets {
+			commands = append(commands, dc.B().Arbitrary(command.Commands...).Keys(command.Keys...).Args(command.Args...).Build())
+		}
+		commands = append(commands, dc.B().Del().Key(groupKey).Build())
+		if len(keys) > 0 {
+			commands = append(commands, dc.B().Sadd().Key(groupKey).Member(keys...).Build())
+		}
+		commands = append(commands, dc.B().Exec().Build())
+
+		resps := dc.DoMulti(ctx, commands...)
+		results, err := resps[len(resps)-1].ToArray()
+		if rueidis.IsRedisNil(err) {
+			return errGroupChanged
+		}
+		if err != nil {
+			// the errors of queuing the commands are more helpful.
+			for _, resp := range resps[:len(resps)-1] {
+				if err := resp.Error(); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+		for _, result := range results {
+			if err := result.Error(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTxRedis is a fake Redis server of hashes and sets, supporting
+// transactions.
+type fakeTxRedis struct {
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	sets     map[string]map[string]bool
+	queued   [][]string
+	inMulti  bool
+	conflict bool
+}
+
+func (f *fakeTxRedis) handle(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "WATCH", "UNWATCH":
+		return "+OK\r\n"
+	case "MULTI":
+		f.inMulti, f.queued = true, nil
+		return "+OK\r\n"
+	case "EXEC":
+		f.inMulti = false
+		if f.conflict {
+			return "*-1\r\n"
+		}
+		replies := []string{}
+		for _, q := range f.queued {
+			replies = append(replies, f.exec(q))
+		}
+		return respArray(replies...)
+	}
+	if f.inMulti {
+		f.queued = append(f.queued, args)
+		return "+QUEUED\r\n"
+	}
+	return f.exec(args)
+}
+
+func (f *fakeTxRedis) exec(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "SMEMBERS":
+		items := []string{}
+		for m := range f.sets[args[1]] {
+			items = append(items, respBulk(m))
+		}
+		return respArray(items...)
+	case "HMSET":
+		h := map[string]string{}
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		f.hashes[args[1]] = h
+		return "+OK\r\n"
+	case "DEL":
+		delete(f.hashes, args[1])
+		delete(f.sets, args[1])
+		return ":1\r\n"
+	case "SADD":
+		s := map[string]bool{}
+		for _, m := range args[2:] {
+			s[m] = true
+		}
+		f.sets[args[1]] = s
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestReplaceDocuments(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeTxRedis{hashes: map[string]map[string]string{}, sets: map[string]map[string]bool{}}
+	r := newFakeRedis(t, f.handle)
+	handler := &RedisVectorHandler{client: newFakeRedisClient(t, r), index: "docs"}
+
+	docs := func(ids ...string) []map[string]any {
+		result := []map[string]any{}
+		for _, id := range ids {
+			result = append(result, map[string]any{"id": id, "content": "chunk " + id, "embedding": []float32{1, 0}})
+		}
+		return result
+	}
+
+	keys, err := handler.ReplaceDocuments(context.Background(), "parent_hash", "abc", docs("0", "1", "2"))
+	assert.NoError(err)
+	assert.Equal([]string{"docs:{abc}:0", "docs:{abc}:1", "docs:{abc}:2"}, keys)
+	assert.Len(f.hashes, 3)
+	assert.Equal("chunk 1", f.hashes["docs:{abc}:1"]["content"])
+	assert.Len(f.sets[getGroupKey("docs", "parent_hash", "abc")], 3)
+
+	// the chunks of the group are replaced, the others are kept.
+	_, err = handler.ReplaceDocuments(context.Background(), "parent_hash", "def", docs("0"))
+	assert.NoError(err)
+	keys, err = handler.ReplaceDocuments(context.Background(), "parent_hash", "abc", docs("0"))
+	assert.NoError(err)
+	assert.Equal([]string{"docs:{abc}:0"}, keys)
+	assert.Len(f.hashes, 2)
+	assert.Contains(f.hashes, "docs:{abc}:0")
+	assert.Contains(f.hashes, "docs:{def}:0")
+	assert.Equal(map[string]bool{"docs:{abc}:0": true}, f.sets[getGroupKey("docs", "parent_hash", "abc")])
+
+	// the transaction is aborted if the group is changed concurrently.
+	f.conflict = true
+	_, err = handler.ReplaceDocuments(context.Background(), "parent_hash", "abc", docs("1"))
+	assert.True(errors.Is(err, errGroupChanged), err)
+	assert.Contains(f.hashes, "docs:{abc}:0")
+	f.conflict = false
+
+	_, err = handler.ReplaceDocuments(context.Background(), "parent_hash", "a{b}", docs("0"))
+	assert.Error(err)
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+const (
+	// DefaultRetryAttempts is the default maximum attempts of an operation.
+	DefaultRetryAttempts = 3
+	// DefaultRetryInitialBackoff is the default backoff before the second
+	// attempt.
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	// DefaultRetryMaxBackoff is the default cap of the backoff.
+	DefaultRetryMaxBackoff = 2 * time.Second
+)
+
+type (
+	// RetrySpec retries the searches and inserts failed by transient
+	// errors, which are network failures and Redis loading the dataset.
+	// Other errors, like syntax errors, are never retried.
+	RetrySpec struct {
+		// Attempts is the maximum attempts of an operation, including the
+		// first one, 3 by default.
+		Attempts int `json:"attempts,omitempty"`
+		// InitialBackoff is the backoff before the second attempt, it is
+		// doubled for every attempt after. 100ms by default.
+		InitialBackoff string `json:"initialBackoff,omitempty" jsonschema:"format=duration"`
+		// MaxBackoff caps the backoff, 2s by default.
+		MaxBackoff string `json:"maxBackoff,omitempty" jsonschema:"format=duration"`
+	}
+
+	// retryPolicy is the parsed RetrySpec.
+	retryPolicy struct {
+		attempts       int
+		initialBackoff time.Duration
+		maxBackoff     time.Duration
+	}
+)
+
+// ValidateRetrySpec validates the retry spec.
+func ValidateRetrySpec(spec *RetrySpec) error {
+	if spec.Attempts < 0 {
+		return fmt.Errorf("attempts must not be negative")
+	}
+	var initial, maxBackoff time.Duration
+	for _, d := range []struct {
+		name  string
+		value string
+		out   *time.Duration
+	}{
+		{"initialBackoff", spec.InitialBackoff, &initial},
+		{"maxBackoff", spec.MaxBackoff, &maxBackoff},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("%s %s is invalid: %w", d.name, d.value, err)
+		}
+		if v <= 0 {
+			return fmt.Errorf("%s %s must be positive", d.name, d.value)
+		}
+		*d.out = v
+	}
+	if initial > 0 && maxBackoff > 0 && initial > maxBackoff {
+		return fmt.Errorf("initialBackoff %s must not be greater than maxBackoff %s", spec.InitialBackoff, spec.MaxBackoff)
+	}
+	return nil
+}
+
+// newRetryPolicy returns the policy of the spec, it is nil if the spec is
+// nil, which means operations are never retried.
+func newRetryPolicy(spec *RetrySpec) *retryPolicy {
+	if spec == nil {
+		return nil
+	}
+	p := &retryPolicy{
+		attempts:       DefaultRetryAttempts,
+		initialBackoff: DefaultRetryInitialBackoff,
+		maxBackoff:     DefaultRetryMaxBackoff,
+	}
+	if spec.Attempts > 0 {
+		p.attempts = spec.Attempts
+	}
+	if d, err := time.ParseDuration(spec.InitialBackoff); err == nil && d > 0 {
+		p.initialBackoff = d
+	}
+	if d, err := time.ParseDuration(spec.MaxBackoff); err == nil && d > 0 {
+		p.maxBackoff = d
+	}
+	p.maxBackoff = max(p.maxBackoff, p.initialBackoff)
+	return p
+}
+
+// backoff returns the backoff after the attempt, it grows exponentially
+// up to the max backoff, and a random half of it is jittered, so the
+// clients failed together do not retry together.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	d := p.initialBackoff
+	for i := 1; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+// wait sleeps for the backoff after the attempt, it returns false if the
+// context is done first.
+func (p *retryPolicy) wait(ctx context.Context, attempt int) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(p.backoff(attempt)):
+		return true
+	}
+}
+
+// isTransientError checks whether the operation failed because of network
+// failures or Redis loading the dataset, the operation may succeed if it
+// is run again. The errors of the context are not transient.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, rueidis.ErrClosing) {
+		return false
+	}
+	var redisErr *rueidis.RedisError
+	if errors.As(err, &redisErr) {
+		return redisErr.IsLoading()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// withRetry runs fn, and runs it again by the retry policy of the client
+// if it fails because of transient errors. fn runs once if the client has
+// no retry policy.
+func (c *RedisClient) withRetry(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if c.retry == nil || attempt >= c.retry.attempts || !isTransientError(err) {
+			return err
+		}
+		if !c.retry.wait(ctx, attempt) {
+			return err
+		}
+	}
+}
+
+// insertWithRetry inserts the documents, and inserts the documents failed
+// because of transient errors again by the retry policy of the client.
+// The documents are written with the same keys, so a retry never
+// duplicates documents.
+func (c *RedisClient) insertWithRetry(ctx context.Context, hmsets []*RedisArbitraryCommand, options ...InsertOption) ([]*InsertResult, error) {
+	results, err := c.insertMany(ctx, hmsets, options...)
+	if err == nil || results == nil || c.retry == nil {
+		return results, err
+	}
+	for attempt := 1; attempt < c.retry.attempts; attempt++ {
+		var pending []int
+		for i, result := range results {
+			if isTransientError(result.Err) {
+				pending = append(pending, i)
+			}
+		}
+		if len(pending) == 0 || !c.retry.wait(ctx, attempt) {
+			break
+		}
+		commands := make([]*RedisArbitraryCommand, 0, len(pending))
+		for _, i := range pending {
+			commands = append(commands, hmsets[i])
+		}
+		retried, _ := c.insertMany(ctx, commands, options...)
+		for j, i := range pending {
+			results[i] = retried[j]
+		}
+	}
+
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	return results, errors.Join(errs...)
+}
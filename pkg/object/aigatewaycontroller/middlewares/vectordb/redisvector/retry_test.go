@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/redis/rueidis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestValidateRetrySpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateRetrySpec(&RetrySpec{}))
+	assert.NoError(ValidateRetrySpec(&RetrySpec{Attempts: 5, InitialBackoff: "50ms", MaxBackoff: "1s"}))
+	assert.Error(ValidateRetrySpec(&RetrySpec{Attempts: -1}))
+	assert.Error(ValidateRetrySpec(&RetrySpec{InitialBackoff: "soon"}))
+	assert.Error(ValidateRetrySpec(&RetrySpec{MaxBackoff: "-1s"}))
+	assert.Error(ValidateRetrySpec(&RetrySpec{InitialBackoff: "2s", MaxBackoff: "1s"}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: "redis://localhost:6379", Retry: &RetrySpec{Attempts: -1}}))
+
+	assert.Nil(newRetryPolicy(nil))
+	p := newRetryPolicy(&RetrySpec{})
+	assert.Equal(&retryPolicy{attempts: DefaultRetryAttempts, initialBackoff: DefaultRetryInitialBackoff, maxBackoff: DefaultRetryMaxBackoff}, p)
+	// the max backoff is never less than the initial backoff.
+	p = newRetryPolicy(&RetrySpec{Attempts: 5, InitialBackoff: "5s"})
+	assert.Equal(&retryPolicy{attempts: 5, initialBackoff: 5 * time.Second, maxBackoff: 5 * time.Second}, p)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newRetryPolicy(&RetrySpec{InitialBackoff: "100ms", MaxBackoff: "1s"})
+	for attempt, expected := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		3:  400 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		10: time.Second,
+	} {
+		// the backoff is jittered in its upper half.
+		for i := 0; i < 20; i++ {
+			backoff := p.backoff(attempt)
+			assert.GreaterOrEqual(backoff, expected/2, attempt)
+			assert.LessOrEqual(backoff, expected, attempt)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(p.wait(ctx, 10))
+}
+
+func TestIsTransientError(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, err := range []error{
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		syscall.ECONNRESET,
+		&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+		NewErrInsertDocument("failed to insert document", syscall.EPIPE),
+	} {
+		assert.True(isTransientError(err), err.Error())
+	}
+	for _, err := range []error{
+		nil,
+		context.Canceled,
+		context.DeadlineExceeded,
+		rueidis.ErrClosing,
+		errors.New("failed"),
+	} {
+		assert.False(isTransientError(err))
+	}
+}
+
+// newRetryFakeRedis returns a client of a fake Redis failing the commands
+// with the reply until the failures run out, and the count of the commands.
+func newRetryFakeRedis(t *testing.T, retry *RetrySpec, reply string, failures int) (*RedisClient, func() int) {
+	var commands int
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "HSET", "HMSET", "FT.SEARCH":
+			commands++
+			if commands <= failures {
+				return reply
+			}
+			if args[0] == "FT.SEARCH" {
+				return "*1\r\n:0\r\n"
+			}
+			return ":1\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	client.retry = newRetryPolicy(retry)
+	return client, func() int {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return commands
+	}
+}
+
+func TestRetryFind(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	loading := "-LOADING Redis is loading the dataset in memory\r\n"
+	query := NewRedisVectorQuery("docs", "", "embedding", []float32{1, 0})
+
+	// the searches are never retried by default.
+	client, commands := newRetryFakeRedis(t, nil, loading, 1)
+	_, _, err := client.Find(ctx, query)
+	assert.Error(err)
+	assert.Equal(1, commands())
+
+	// the transient errors are retried by the policy.
+	retry := &RetrySpec{Attempts: 3, InitialBackoff: "1ms", MaxBackoff: "2ms"}
+	client, commands = newRetryFakeRedis(t, retry, loading, 2)
+	total, _, err := client.Find(ctx, query)
+	assert.NoError(err)
+	assert.Equal(int64(0), total)
+	assert.Equal(3, commands())
+
+	// the attempts are limited.
+	client, commands = newRetryFakeRedis(t, retry, loading, 10)
+	_, _, err = client.Find(ctx, query)
+	assert.ErrorIs(withErrorKind(err), vecdbtypes.ErrUnavailable)
+	assert.Equal(3, commands())
+
+	// syntax errors are never retried.
+	client, commands = newRetryFakeRedis(t, retry, "-Syntax error at offset 3 near title\r\n", 10)
+	_, _, err = client.Find(ctx, query)
+	assert.ErrorIs(withErrorKind(err), vecdbtypes.ErrInvalidFilter)
+	assert.Equal(1, commands())
+}
+
+func TestRetryInsert(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	loading := "-LOADING Redis is loading the dataset in memory\r\n"
+	docs := []map[string]any{{"title": "a"}}
+
+	// the loading errors are only retried as cluster errors by default.
+	client, commands := newRetryFakeRedis(t, nil, loading, maxClusterAttempts+1)
+	_, err := client.InsertManyWithHash(ctx, "docs", docs)
+	assert.Error(err)
+	assert.Equal(maxClusterAttempts, commands())
+
+	// the policy retries them again.
+	retry := &RetrySpec{Attempts: 2, InitialBackoff: "1ms"}
+	client, commands = newRetryFakeRedis(t, retry, loading, maxClusterAttempts+1)
+	results, err := client.InsertManyWithHash(ctx, "docs", docs)
+	assert.NoError(err)
+	assert.Len(results, 1)
+	assert.Equal(maxClusterAttempts+2, commands())
+
+	client, commands = newRetryFakeRedis(t, retry, loading, maxClusterAttempts+1)
+	_, err = client.InsertWithHash(ctx, "docs", docs[0])
+	assert.NoError(err)
+	assert.Equal(maxClusterAttempts+2, commands())
+
+	// other errors are never retried.
+	client, commands = newRetryFakeRedis(t, retry, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", 10)
+	_, err = client.InsertManyWithHash(ctx, "docs", docs)
+	assert.Error(err)
+	assert.Equal(1, commands())
+}
+
+func TestHealthCheck(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	r := newFakeRedis(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "FT.INFO" && args[1] == "docs" {
+			return respIndexInfo("docs", "title")
+		}
+		return "-Unknown index name\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	assert.NoError(client.HealthCheck(ctx))
+	assert.NoError(client.HealthCheck(ctx, "docs"))
+	assert.Error(client.HealthCheck(ctx, "docs", "missing"))
+
+	handler := &RedisVectorHandler{client: client, index: "missing"}
+	assert.ErrorIs(handler.HealthCheck(ctx), vecdbtypes.ErrNotFound)
+
+	// the server is unreachable.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err = NewRedisClient(rueidis.ClientOption{InitAddress: []string{addr}, DisableCache: true, ForceSingleClient: true})
+	assert.Error(err)
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var _ vecdbtypes.DocumentScanner = (*RedisVectorDB)(nil)
+
+// ScanDocuments scans the keys of the index node by node, and calls fn
+// with the fields of the documents of every batch of keys. The cursor is
+// the address of the node being scanned and its SCAN cursor, so a scan
+// can be resumed by another client. Only hashes without payload store
+// are supported, whose fields are the stored values.
+func (r *RedisVectorDB) ScanDocuments(ctx context.Context, name, cursor string, count int, fields []string,
+	fn func(docs []map[string]any, next string) error,
+) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	if IndexType(r.Spec.IndexType) == IndexTypeJSON {
+		return fmt.Errorf("%w with JSON index type", vecdbtypes.ErrScanNotSupported)
+	}
+	if r.CommonSpec != nil && r.CommonSpec.PayloadStore != nil {
+		return fmt.Errorf("%w with payload store", vecdbtypes.ErrScanNotSupported)
+	}
+	if r.Spec.Shards != nil {
+		return fmt.Errorf("%w with shards", vecdbtypes.ErrScanNotSupported)
+	}
+	if count <= 0 {
+		return fmt.Errorf("invalid count %d", count)
+	}
+	return r.withClient(func(client rueidis.Client) error {
+		return scanDocuments(ctx, client, name, r.getKeyLayout(), cursor, count, fields, fn)
+	})
+}
+
+// parseScanCursor parses the cursor of ScanDocuments into the address of
+// the node and its SCAN cursor.
+func parseScanCursor(cursor string) (string, uint64, error) {
+	i := strings.LastIndex(cursor, "/")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid cursor %s", cursor)
+	}
+	c, err := strconv.ParseUint(cursor[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid cursor %s: %w", cursor, err)
+	}
+	return cursor[:i], c, nil
+}
+
+func scanDocuments(ctx context.Context, client rueidis.Client, index string, keys keyLayout, cursor string, count int, fields []string,
+	fn func(docs []map[string]any, next string) error,
+) error {
+	nodes := client.Nodes()
+	addrs := make([]string, 0, len(nodes))
+	for addr := range nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	start, c := 0, uint64(0)
+	if cursor != "" {
+		addr, scanCursor, err := parseScanCursor(cursor)
+		if err != nil {
+			return err
+		}
+		start = sort.SearchStrings(addrs, addr)
+		if start == len(addrs) || addrs[start] != addr {
+			return fmt.Errorf("node %s of cursor %s not found", addr, cursor)
+		}
+		c = scanCursor
+	}
+
+	for i := start; i < len(addrs); i++ {
+		node := nodes[addrs[i]]
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			entry, err := node.Do(ctx, node.B().Scan().Cursor(c).Match(escapeGlob(keys.getPrefix(index))+"*").Count(int64(count)).Build()).AsScanEntry()
+			if err != nil {
+				return fmt.Errorf("failed to scan node %s: %w", addrs[i], err)
+			}
+			docs, err := getDocuments(ctx, client, keys.getPrefix(index), entry.Elements, fields)
+			if err != nil {
+				return err
+			}
+
+			next := ""
+			switch {
+			case entry.Cursor != 0:
+				next = fmt.Sprintf("%s/%d", addrs[i], entry.Cursor)
+			case i+1 < len(addrs):
+				next = addrs[i+1] + "/0"
+			}
+			if err := fn(docs, next); err != nil {
+				return err
+			}
+			if entry.Cursor == 0 {
+				break
+			}
+			c = entry.Cursor
+		}
+		c = 0
+	}
+	return nil
+}
+
+// getDocuments returns the fields of the documents of the keys, the
+// documents deleted since the scan are skipped.
+func getDocuments(ctx context.Context, client rueidis.Client, prefix string, keys, fields []string) ([]map[string]any, error) {
+	docs := make([]map[string]any, 0, len(keys))
+	if len(keys) == 0 {
+		return docs, nil
+	}
+	commands := make(rueidis.Commands, 0, 2*len(keys))
+	for _, key := range keys {
+		commands = append(commands, client.B().Exists().Key(key).Build())
+		commands = append(commands, client.B().Hmget().Key(key).Field(append([]string{idField}, fields...)...).Build())
+	}
+	results := client.DoMulti(ctx, commands...)
+	for i, key := range keys {
+		exists, err := results[2*i].AsInt64()
+		if err != nil {
+			return nil, classifyError("failed to get document "+key, err)
+		}
+		if exists == 0 {
+			continue
+		}
+		values, err := results[2*i+1].ToArray()
+		if err != nil {
+			return nil, classifyError("failed to get document "+key, err)
+		}
+		// documents written by old versions have no idField, their keys
+		// are the prefix of the index and their IDs.
+		doc := map[string]any{"id": strings.TrimPrefix(key, prefix)}
+		for j, value := range values {
+			s, err := value.ToString()
+			if rueidis.IsRedisNil(err) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to get document %s: %w", key, err)
+			}
+			if j == 0 {
+				doc["id"] = s
+			} else {
+				doc[fields[j-1]] = s
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
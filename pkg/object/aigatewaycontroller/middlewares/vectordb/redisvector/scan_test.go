@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestScanDocuments(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "SCAN":
+			if args[1] == "0" {
+				return respArray(respBulk("5"), respArray(respBulk("movie:a"), respBulk("movie:b")))
+			}
+			return respArray(respBulk("0"), respArray(respBulk("movie:c")))
+		case "EXISTS":
+			// movie:b is deleted after the scan.
+			if args[1] == "movie:b" {
+				return ":0\r\n"
+			}
+			return ":1\r\n"
+		case "HMGET":
+			if args[1] == "movie:a" {
+				return respArray(respBulk("a"), respBulk("title a"), "$-1\r\n")
+			}
+			// written by old versions without the ID field.
+			return respArray("$-1\r\n", respBulk("title c"), respBulk("v2"))
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	client := newFakeRedisClient(t, r).client
+	ctx := context.Background()
+	fields := []string{"title", vecdbtypes.EmbeddingVersionField}
+
+	var pages [][]map[string]any
+	var cursors []string
+	err := scanDocuments(ctx, client, "movie", keyLayout{}, "", 2, fields, func(docs []map[string]any, next string) error {
+		pages = append(pages, docs)
+		cursors = append(cursors, next)
+		return nil
+	})
+	assert.NoError(err)
+	assert.Len(pages, 2)
+	assert.Equal([]map[string]any{{"id": "a", "title": "title a"}}, pages[0])
+	assert.Equal([]map[string]any{{"id": "c", "title": "title c", vecdbtypes.EmbeddingVersionField: "v2"}}, pages[1])
+	assert.True(strings.HasSuffix(cursors[0], "/5"))
+	assert.Equal("", cursors[1])
+
+	// the scan is resumed from the cursor.
+	pages = nil
+	err = scanDocuments(ctx, client, "movie", keyLayout{}, cursors[0], 2, fields, func(docs []map[string]any, next string) error {
+		pages = append(pages, docs)
+		return nil
+	})
+	assert.NoError(err)
+	assert.Len(pages, 1)
+	assert.Equal("c", pages[0][0]["id"])
+
+	// the error of fn stops the scan.
+	errStop := errors.New("stop")
+	pages = nil
+	err = scanDocuments(ctx, client, "movie", keyLayout{}, "", 2, fields, func(docs []map[string]any, next string) error {
+		pages = append(pages, docs)
+		return errStop
+	})
+	assert.ErrorIs(err, errStop)
+	assert.Len(pages, 1)
+
+	assert.Error(scanDocuments(ctx, client, "movie", keyLayout{}, "unknown/0", 2, fields, nil))
+	assert.Error(scanDocuments(ctx, client, "movie", keyLayout{}, "invalid", 2, fields, nil))
+
+	db := New(&vecdbtypes.CommonSpec{}, &RedisVectorDBSpec{URL: "redis://" + r.ln.Addr().String(), IndexType: "JSON"})
+	assert.ErrorIs(db.ScanDocuments(ctx, "movie", "", 2, fields, nil), vecdbtypes.ErrScanNotSupported)
+}
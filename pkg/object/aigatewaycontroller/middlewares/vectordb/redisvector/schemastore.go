@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var _ vecdbtypes.SchemaStore = (*RedisVectorDB)(nil)
+
+// getSchemaKey returns the key of the inferred schema of an index, it
+// shares the hash tag of the index like the payload store.
+func getSchemaKey(index string) string {
+	return fmt.Sprintf("schema:{%s}", index)
+}
+
+// withClient runs fn with a client, the schemas are accessed only when the
+// collection is bootstrapped, so the client is not kept. The metadata of
+// sharded collections is kept in the first shard.
+func (r *RedisVectorDB) withClient(fn func(client rueidis.Client) error) error {
+	return withURLClient(r.shardURLs()[0], fn)
+}
+
+// withURLClient runs fn with a client of the Redis of the URL, the client
+// is closed after fn returns.
+func withURLClient(url string, fn func(client rueidis.Client) error) error {
+	clientOption, err := parseURL(url)
+	if err != nil {
+		return NewErrParsingRedisURL("failed to parse Redis URL", err)
+	}
+	client, err := NewRedisClient(clientOption)
+	if err != nil {
+		return NewErrCreateRedisClient("failed to create Redis client", err)
+	}
+	defer client.client.Close()
+	return fn(client.client)
+}
+
+// LoadSchema returns the persisted schema of the index.
+func (r *RedisVectorDB) LoadSchema(ctx context.Context, name string) (_ []byte, err error) {
+	defer func() { err = withErrorKind(err) }()
+	var schema []byte
+	err = r.withClient(func(client rueidis.Client) error {
+		return loadSchema(ctx, client, name, &schema)
+	})
+	return schema, err
+}
+
+// SaveSchema persists the schema of the index if there is none.
+func (r *RedisVectorDB) SaveSchema(ctx context.Context, name string, schema []byte) (_ []byte, err error) {
+	defer func() { err = withErrorKind(err) }()
+	var saved []byte
+	err = r.withClient(func(client rueidis.Client) error {
+		return saveSchema(ctx, client, name, schema, &saved)
+	})
+	return saved, err
+}
+
+func loadSchema(ctx context.Context, client rueidis.Client, name string, schema *[]byte) error {
+	data, err := client.Do(ctx, client.B().Get().Key(getSchemaKey(name)).Build()).AsBytes()
+	if rueidis.IsRedisNil(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load schema of index %s: %w", name, err)
+	}
+	*schema = data
+	return nil
+}
+
+func saveSchema(ctx context.Context, client rueidis.Client, name string, schema []byte, saved *[]byte) error {
+	cmd := client.B().Set().Key(getSchemaKey(name)).Value(rueidis.BinaryString(schema)).Nx().Build()
+	if err := client.Do(ctx, cmd).Error(); err != nil && !rueidis.IsRedisNil(err) {
+		return fmt.Errorf("failed to save schema of index %s: %w", name, err)
+	}
+	return loadSchema(ctx, client, name, saved)
+}
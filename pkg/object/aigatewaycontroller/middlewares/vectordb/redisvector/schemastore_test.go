@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaStore(t *testing.T) {
+	assert := assert.New(t)
+
+	values := map[string]string{}
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			if v, ok := values[args[1]]; ok {
+				return respBulk(v)
+			}
+			return "$-1\r\n"
+		case "SET":
+			if _, ok := values[args[1]]; ok {
+				return "$-1\r\n"
+			}
+			values[args[1]] = args[2]
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	var schema []byte
+	assert.NoError(loadSchema(ctx, client.client, "movie", &schema))
+	assert.Nil(schema)
+
+	var saved []byte
+	assert.NoError(saveSchema(ctx, client.client, "movie", []byte(`{"fields":[]}`), &saved))
+	assert.Equal(`{"fields":[]}`, string(saved))
+	assert.Contains(values, "schema:{movie}")
+
+	// the schema saved first wins.
+	assert.NoError(saveSchema(ctx, client.client, "movie", []byte(`{"fields":null}`), &saved))
+	assert.Equal(`{"fields":[]}`, string(saved))
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// scopeMigrationBatchSize is the number of keys moved at once.
+const scopeMigrationBatchSize = 100
+
+var _ vecdbtypes.ScopeMigrator = (*RedisVectorDB)(nil)
+
+// MigrateToScope moves the documents, the payloads and the inferred schema
+// of the unscoped index to the keys of the scoped index of the name, on
+// every shard, and drops the unscoped index without its documents. The
+// keys are moved by DUMP and RESTORE with their TTLs, so they may be in
+// other slots of a Redis cluster, and the keys existing in the scope are
+// kept. The scoped index covers the moved documents once it is created.
+// The hits of tiering and the groups of replaced documents are not moved.
+func (r *RedisVectorDB) MigrateToScope(ctx context.Context, name string) (_ *vecdbtypes.ScopeMigrationReport, err error) {
+	defer func() { err = withErrorKind(err) }()
+	scope := r.getScope()
+	if scope == "" {
+		return nil, fmt.Errorf("vector database of index %s is not scoped", name)
+	}
+	if !vecdbtypes.InScope(scope, name) {
+		return nil, fmt.Errorf("index %s is not in scope %s", name, scope)
+	}
+	from := vecdbtypes.UnscopedName(scope, name)
+	report := &vecdbtypes.ScopeMigrationReport{From: from, To: name}
+
+	keys := r.getKeyLayout()
+	unscoped := keys
+	unscoped.scope = ""
+	prefixes := [][2]string{
+		{unscoped.getPrefix(from), keys.getPrefix(name)},
+		{getPayloadPrefix(from), getPayloadPrefix(name)},
+	}
+	err = r.withShardClients(func(client rueidis.Client) error {
+		for _, prefix := range prefixes {
+			if err := movePrefixKeys(ctx, client, prefix[0], prefix[1], report); err != nil {
+				return err
+			}
+		}
+		rename := func(string) string { return getSchemaKey(name) }
+		if err := moveScopeKeys(ctx, client, []string{getSchemaKey(from)}, rename, report); err != nil {
+			return err
+		}
+		err := client.Do(ctx, client.B().FtDropindex().Index(from).Build()).Error()
+		if err != nil && !isUnknownIndexError(err) {
+			return fmt.Errorf("failed to drop index %s: %w", from, err)
+		}
+		return nil
+	})
+	logger.Infof("moved %d keys of index %s to %s, skipped %d existing ones", report.Moved, from, name, report.Skipped)
+	return report, err
+}
+
+// movePrefixKeys moves the keys of the prefix node by node to the keys of
+// the new prefix.
+func movePrefixKeys(ctx context.Context, client rueidis.Client, from, to string, report *vecdbtypes.ScopeMigrationReport) error {
+	rename := func(key string) string {
+		return to + strings.TrimPrefix(key, from)
+	}
+	for addr, node := range client.Nodes() {
+		cursor := uint64(0)
+		for {
+			entry, err := node.Do(ctx, node.B().Scan().Cursor(cursor).Match(escapeGlob(from)+"*").Count(scopeMigrationBatchSize).Build()).AsScanEntry()
+			if err != nil {
+				return fmt.Errorf("failed to scan node %s: %w", addr, err)
+			}
+			if err := moveScopeKeys(ctx, client, entry.Elements, rename, report); err != nil {
+				return err
+			}
+			if entry.Cursor == 0 {
+				break
+			}
+			cursor = entry.Cursor
+		}
+	}
+	return nil
+}
+
+// moveScopeKeys moves the keys in the same Redis to the renamed keys.
+func moveScopeKeys(ctx context.Context, client rueidis.Client, keys []string, rename func(string) string, report *vecdbtypes.ScopeMigrationReport) error {
+	moved, skipped, err := moveKeys(ctx, client, client, keys, rename)
+	report.Moved += moved
+	report.Skipped += skipped
+	return err
+}
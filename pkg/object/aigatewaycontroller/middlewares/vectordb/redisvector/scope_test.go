@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestScopeKeyLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	// the index names are scoped already.
+	keys := keyLayout{scope: "dev"}
+	assert.Equal("dev_movie:", keys.getPrefix("dev_movie"))
+	keys = keyLayout{prefix: "app:{index}", separator: "/", scope: "dev"}
+	assert.Equal("app:dev_movie/", keys.getPrefix("dev_movie"))
+
+	// the fixed prefix is shared by the indexes, so it is scoped.
+	keys = keyLayout{prefix: "idx", scope: "dev"}
+	assert.Equal("dev_idx:", keys.getPrefix("dev_movie"))
+
+	r := New(&vecdbtypes.CommonSpec{Scope: "dev"}, &RedisVectorDBSpec{KeyPrefix: "idx"})
+	assert.Equal("dev", r.getScope())
+	assert.Equal("dev_idx:", r.getKeyLayout().getPrefix("dev_movie"))
+	r = New(nil, &RedisVectorDBSpec{KeyPrefix: "idx"})
+	assert.Equal("", r.getScope())
+	assert.Equal("idx:", r.getKeyLayout().getPrefix("movie"))
+}
+
+func TestMigrateToScope(t *testing.T) {
+	assert := assert.New(t)
+
+	store := map[string]string{
+		"movie:1":             "a",
+		"movie:2":             "b",
+		"movie:3":             "c",
+		"payload:{movie}:1":   "p",
+		getSchemaKey("movie"): "schema",
+		"dev_movie:3":         "newer",
+		"other:1":             "other",
+		"moviegoer:1":         "goer",
+		getSchemaKey("other"): "other schema",
+		"payload:{other}:1":   "other payload",
+	}
+	dropped := []string{}
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "CLUSTER":
+			return "-ERR This instance has cluster support disabled\r\n"
+		case "SCAN":
+			pattern := ""
+			for i, arg := range args {
+				if strings.ToUpper(arg) == "MATCH" {
+					pattern = args[i+1]
+				}
+			}
+			prefix := strings.NewReplacer(`\{`, "{", `\}`, "}").Replace(strings.TrimSuffix(pattern, "*"))
+			keys := []string{}
+			for key := range store {
+				if strings.HasPrefix(key, prefix) {
+					keys = append(keys, respBulk(key))
+				}
+			}
+			return respArray(respBulk("0"), respArray(keys...))
+		case "DUMP":
+			if v, ok := store[args[1]]; ok {
+				return respBulk(v)
+			}
+			return "$-1\r\n"
+		case "PTTL":
+			return ":-1\r\n"
+		case "RESTORE":
+			if _, ok := store[args[1]]; ok {
+				return "-BUSYKEY Target key name already exists.\r\n"
+			}
+			store[args[1]] = args[3]
+			return "+OK\r\n"
+		case "DEL":
+			delete(store, args[1])
+			return ":1\r\n"
+		case "FT.DROPINDEX":
+			dropped = append(dropped, args[1])
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	url := "redis://" + r.ln.Addr().String() + "?protocol=2&client_cache=0"
+	ctx := context.Background()
+
+	db := New(nil, &RedisVectorDBSpec{URL: url})
+	_, err := db.MigrateToScope(ctx, "dev_movie")
+	assert.ErrorContains(err, "not scoped")
+
+	db = New(&vecdbtypes.CommonSpec{Scope: "dev"}, &RedisVectorDBSpec{URL: url})
+	_, err = db.MigrateToScope(ctx, "movie")
+	assert.ErrorContains(err, "not in scope dev")
+
+	report, err := db.MigrateToScope(ctx, "dev_movie")
+	assert.NoError(err)
+	assert.Equal("movie", report.From)
+	assert.Equal("dev_movie", report.To)
+	assert.Equal(int64(4), report.Moved)
+	assert.Equal(int64(1), report.Skipped)
+	assert.Equal([]string{"movie"}, dropped)
+
+	assert.Equal("a", store["dev_movie:1"])
+	assert.Equal("b", store["dev_movie:2"])
+	// the document existing in the scope is kept.
+	assert.Equal("newer", store["dev_movie:3"])
+	assert.Equal("p", store["payload:{dev_movie}:1"])
+	assert.Equal("schema", store[getSchemaKey("dev_movie")])
+	for _, key := range []string{"movie:1", "movie:2", "movie:3", "payload:{movie}:1", getSchemaKey("movie")} {
+		assert.NotContains(store, key)
+	}
+	// the keys of other indexes are not moved.
+	assert.Equal("other", store["other:1"])
+	assert.Equal("goer", store["moviegoer:1"])
+	assert.Equal("other payload", store["payload:{other}:1"])
+
+	// migrating again moves nothing.
+	report, err = db.MigrateToScope(ctx, "dev_movie")
+	assert.NoError(err)
+	assert.Equal(int64(0), report.Moved)
+}
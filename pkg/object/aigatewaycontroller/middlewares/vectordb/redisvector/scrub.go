@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// quarantinePrefix prefixes the keys of quarantined documents, they
+	// are out of the prefix of the index, so they are not searched.
+	quarantinePrefix = "quarantine:"
+	scrubBatchSize   = 100
+)
+
+var _ vecdbtypes.VectorScrubber = (*RedisVectorDB)(nil)
+
+func getQuarantineKey(key string) string {
+	return quarantinePrefix + key
+}
+
+// ScrubVectors scans the documents of the index, and moves the ones with
+// invalid vectors to quarantine keys, which are reported.
+func (r *RedisVectorDB) ScrubVectors(ctx context.Context, name string, dryRun bool) (_ *vecdbtypes.ScrubReport, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if IndexType(r.Spec.IndexType) == IndexTypeJSON {
+		return nil, fmt.Errorf("scrubbing vectors is not supported with JSON index type")
+	}
+	if r.Spec.Shards != nil {
+		return nil, fmt.Errorf("scrubbing vectors is not supported with shards")
+	}
+	var report *vecdbtypes.ScrubReport
+	err = r.withClient(func(client rueidis.Client) error {
+		var err error
+		report, err = scrubIndex(ctx, client, name, r.getKeyLayout(), r.CommonSpec.VectorValidation, dryRun)
+		return err
+	})
+	return report, err
+}
+
+func scrubIndex(ctx context.Context, client rueidis.Client, index string, keys keyLayout, spec *vecdbtypes.VectorValidationSpec, dryRun bool) (*vecdbtypes.ScrubReport, error) {
+	report := &vecdbtypes.ScrubReport{
+		Collection:  index,
+		DryRun:      dryRun,
+		Quarantined: []*vecdbtypes.QuarantinedDocument{},
+	}
+	fields, err := indexVectorFields(ctx, client, index)
+	if err != nil {
+		if isUnknownIndexError(err) {
+			return report, nil
+		}
+		return nil, classifyError("failed to get vector fields of index "+index, err)
+	}
+	// vectors of 16-bit floats are not checked.
+	for name, dataType := range fields {
+		if dataType != string(VectorDataTypeFloat32) && dataType != string(VectorDataTypeFloat64) {
+			delete(fields, name)
+		}
+	}
+	if len(fields) == 0 {
+		return report, nil
+	}
+
+	nodes := client.Nodes()
+	addrs := make([]string, 0, len(nodes))
+	for addr := range nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		node := nodes[addr]
+		var cursor uint64
+		for {
+			entry, err := node.Do(ctx, node.B().Scan().Cursor(cursor).Match(escapeGlob(keys.getPrefix(index))+"*").Count(scrubBatchSize).Build()).AsScanEntry()
+			if err != nil {
+				return report, fmt.Errorf("failed to scan node %s: %w", addr, err)
+			}
+			if err := scrubKeys(ctx, client, entry.Elements, fields, spec, dryRun, report); err != nil {
+				return report, err
+			}
+			if entry.Cursor == 0 {
+				break
+			}
+			cursor = entry.Cursor
+		}
+	}
+	return report, nil
+}
+
+// indexVectorFields returns the vector fields of the index and their data
+// types.
+func indexVectorFields(ctx context.Context, client rueidis.Client, index string) (map[string]string, error) {
+	info, err := client.Do(ctx, client.B().FtInfo().Index(index).Build()).AsMap()
+	if err != nil {
+		return nil, err
+	}
+	attrs, ok := info["attributes"]
+	if !ok {
+		return nil, fmt.Errorf("index %s has no attributes", index)
+	}
+	attributes, err := attrs.ToArray()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attributes of index %s: %w", index, err)
+	}
+	fields := map[string]string{}
+	for _, attribute := range attributes {
+		if indexAttributeValue(&attribute, "type") != "VECTOR" {
+			continue
+		}
+		dataType := indexAttributeValue(&attribute, "data_type")
+		if dataType == "" {
+			dataType = string(VectorDataTypeFloat32)
+		}
+		fields[indexAttributeValue(&attribute, "identifier")] = dataType
+	}
+	return fields, nil
+}
+
+func scrubKeys(ctx context.Context, client rueidis.Client, keys []string, fields map[string]string,
+	spec *vecdbtypes.VectorValidationSpec, dryRun bool, report *vecdbtypes.ScrubReport,
+) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	commands := make(rueidis.Commands, 0, len(keys))
+	for _, key := range keys {
+		commands = append(commands, client.B().Hgetall().Key(key).Build())
+	}
+	for i, res := range client.DoMulti(ctx, commands...) {
+		values, err := res.AsStrMap()
+		if err != nil {
+			return fmt.Errorf("failed to get document %s: %w", keys[i], err)
+		}
+		// the document is deleted after the scan.
+		if len(values) == 0 {
+			continue
+		}
+		report.Scanned++
+		doc := checkDocumentVectors(keys[i], values, fields, spec)
+		if doc == nil {
+			continue
+		}
+		if !dryRun {
+			if err := quarantineDocument(ctx, client, keys[i], values); err != nil {
+				return err
+			}
+			doc.Location = getQuarantineKey(keys[i])
+		}
+		report.Quarantined = append(report.Quarantined, doc)
+	}
+	return nil
+}
+
+// checkDocumentVectors returns the quarantined document if any vector of
+// the document is invalid, or nil.
+func checkDocumentVectors(key string, values map[string]string, fields map[string]string, spec *vecdbtypes.VectorValidationSpec) *vecdbtypes.QuarantinedDocument {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		raw, ok := values[name]
+		if !ok {
+			continue
+		}
+		var err *vecdbtypes.InvalidVectorError
+		if fields[name] == "FLOAT64" {
+			if vec, ok := stringToFloat64Vector(raw); ok {
+				_, err = vecdbtypes.CheckVector(vec, spec)
+			} else {
+				err = &vecdbtypes.InvalidVectorError{Reason: vecdbtypes.InvalidVectorMalformed}
+			}
+		} else {
+			if vec, ok := stringToFloat32Vector(raw); ok {
+				_, err = vecdbtypes.CheckVector(vec, spec)
+			} else {
+				err = &vecdbtypes.InvalidVectorError{Reason: vecdbtypes.InvalidVectorMalformed}
+			}
+		}
+		if err != nil {
+			return &vecdbtypes.QuarantinedDocument{ID: key, Field: name, Reason: err.Reason, Positions: err.Positions}
+		}
+	}
+	return nil
+}
+
+// quarantineDocument copies the document to its quarantine key, and
+// deletes it from the index. The keys may be in different slots, so they
+// are not renamed.
+func quarantineDocument(ctx context.Context, client rueidis.Client, key string, values map[string]string) error {
+	hset := client.B().Hset().Key(getQuarantineKey(key)).FieldValue()
+	for field, value := range values {
+		hset = hset.FieldValue(field, value)
+	}
+	if err := client.Do(ctx, hset.Build()).Error(); err != nil {
+		return fmt.Errorf("failed to quarantine document %s: %w", key, err)
+	}
+	if err := client.Do(ctx, client.B().Unlink().Key(key).Build()).Error(); err != nil {
+		return fmt.Errorf("failed to delete quarantined document %s: %w", key, err)
+	}
+	return nil
+}
+
+func stringToFloat32Vector(s string) ([]float32, bool) {
+	if len(s)%4 != 0 {
+		return nil, false
+	}
+	v := make([]float32, len(s)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32([]byte(s[i*4 : i*4+4])))
+	}
+	return v, true
+}
+
+func stringToFloat64Vector(s string) ([]float64, bool) {
+	if len(s)%8 != 0 {
+		return nil, false
+	}
+	v := make([]float64, len(s)/8)
+	for i := range v {
+		v[i] = math.Float64frombits(binary.LittleEndian.Uint64([]byte(s[i*8 : i*8+8])))
+	}
+	return v, true
+}
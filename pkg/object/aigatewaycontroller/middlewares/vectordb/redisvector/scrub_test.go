@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestScrubIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeDrainRedis()
+	docs := map[string][]float32{
+		"movie:1": {1, 2},
+		"movie:2": {1, float32(math.NaN())},
+		"movie:3": {0, 0},
+		"movie:4": {float32(math.Inf(1)), 1},
+	}
+	for key, vec := range docs {
+		fake.docs[key] = true
+		fake.hash(key)["embedding"] = float32VectorToString(vec)
+		fake.hash(key)["data"] = "content of " + key
+	}
+	fake.docs["movie:5"] = true
+	fake.hash("movie:5")["embedding"] = "bad"
+	fake.docs["other:1"] = true
+	fake.hash("other:1")["embedding"] = float32VectorToString([]float32{float32(math.NaN())})
+
+	indexes := map[string]bool{"movie": true}
+	r := newFakeRedis(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "FT.INFO" {
+			if !indexes[args[1]] {
+				return "-Unknown index name\r\n"
+			}
+			return respArray(
+				respBulk("index_name"), respBulk(args[1]),
+				respBulk("attributes"), respArray(
+					respArray(respBulk("identifier"), respBulk("data"), respBulk("attribute"), respBulk("data"), respBulk("type"), respBulk("TEXT")),
+					respArray(respBulk("identifier"), respBulk("embedding"), respBulk("attribute"), respBulk("embedding"), respBulk("type"), respBulk("VECTOR"),
+						respBulk("algorithm"), respBulk("FLAT"), respBulk("data_type"), respBulk("FLOAT32")),
+				),
+			)
+		}
+		return fake.handle(args)
+	})
+	client := newFakeRedisClient(t, r).client
+	ctx := context.Background()
+
+	// the dry run only reports the documents.
+	report, err := scrubIndex(ctx, client, "movie", keyLayout{}, nil, true)
+	assert.NoError(err)
+	assert.True(report.DryRun)
+	assert.Equal(5, report.Scanned)
+	assert.Len(report.Quarantined, 3)
+	assert.Equal(&vecdbtypes.QuarantinedDocument{ID: "movie:2", Field: "embedding", Reason: vecdbtypes.InvalidVectorNaN, Positions: []int{1}}, report.Quarantined[0])
+	assert.Equal(vecdbtypes.InvalidVectorInf, report.Quarantined[1].Reason)
+	assert.Equal(vecdbtypes.InvalidVectorMalformed, report.Quarantined[2].Reason)
+	assert.Len(fake.liveDocs(), 6)
+
+	// zero norm vectors are rejected by the spec.
+	report, err = scrubIndex(ctx, client, "movie", keyLayout{}, &vecdbtypes.VectorValidationSpec{ZeroNorm: vecdbtypes.ZeroNormReject}, false)
+	assert.NoError(err)
+	assert.Len(report.Quarantined, 4)
+	assert.Equal([]string{"movie:1", "other:1"}, fake.liveDocs())
+	for _, doc := range report.Quarantined {
+		assert.Equal(getQuarantineKey(doc.ID), doc.Location)
+		assert.Equal(fake.hashes[doc.ID], fake.hashes[doc.Location])
+	}
+
+	// the index does not exist.
+	report, err = scrubIndex(ctx, client, "unknown", keyLayout{}, nil, false)
+	assert.NoError(err)
+	assert.Equal(0, report.Scanned)
+	assert.Empty(report.Quarantined)
+}
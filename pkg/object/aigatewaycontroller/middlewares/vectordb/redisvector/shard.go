@@ -0,0 +1,544 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/rueidis"
+	"github.com/spaolacci/murmur3"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// DefaultShardVirtualNodes is the default number of the points of a
+	// shard on the hash ring.
+	DefaultShardVirtualNodes = 160
+	// DefaultShardRetryInterval is the default interval to try a down
+	// shard again.
+	DefaultShardRetryInterval = 10 * time.Second
+)
+
+// ErrShardUnavailable means the shard owning the documents is down, the
+// other shards are not affected.
+var ErrShardUnavailable = errors.New("redis shard is unavailable")
+
+type (
+	// ShardingSpec distributes the documents across standalone Redis
+	// instances by the consistent hash of their keys, for deployments
+	// without Redis Cluster. Searches are sent to all shards and their
+	// results are merged, a down shard is skipped, so its documents are
+	// missed instead of failing the searches.
+	ShardingSpec struct {
+		// URLs are the URLs of the shards, a shard is identified by its
+		// URL, so adding or removing a shard only moves the documents
+		// owned by it. The metadata of collections, like the schemas, is
+		// kept in the first shard.
+		URLs []string `json:"urls" jsonschema:"required"`
+		// Retired are the URLs of the removed shards whose documents are
+		// not moved yet, they own no documents but are still searched,
+		// until the documents are moved by rebalancing.
+		Retired []string `json:"retired,omitempty"`
+		// VirtualNodes is the number of the points of a shard on the hash
+		// ring, more points distribute the documents more evenly.
+		VirtualNodes int `json:"virtualNodes,omitempty"`
+		// RetryInterval is how long a down shard is skipped before it is
+		// tried again.
+		RetryInterval string `json:"retryInterval,omitempty" jsonschema:"format=duration"`
+	}
+
+	// hashRing maps keys to shards by consistent hashing, the points are
+	// sorted by their hashes.
+	hashRing struct {
+		hashes []uint64
+		urls   []string
+	}
+
+	// redisShard is a shard of a sharded handler, it is marked down if it
+	// is unreachable, and skipped until the retry interval passes.
+	redisShard struct {
+		url           string
+		addr          string
+		retryInterval time.Duration
+		// create creates the handler of the shard, it is called again if
+		// the shard was down when the collection was created.
+		create func(ctx context.Context) (*RedisVectorHandler, error)
+
+		lock      sync.Mutex
+		handler   *RedisVectorHandler
+		downSince time.Time
+		downErr   error
+	}
+
+	// RedisShardedHandler is the vector handler of a collection sharded
+	// across standalone Redis instances.
+	RedisShardedHandler struct {
+		index string
+		ring  *hashRing
+		// keys is the layout of the keys the documents are routed by.
+		keys keyLayout
+		// ids decides the IDs of the documents inserted without id, the
+		// IDs are decided before routing.
+		ids documentIDs
+		// shards are the shards owning documents followed by the retired
+		// ones.
+		shards []*redisShard
+	}
+)
+
+var (
+	_ vecdbtypes.VectorHandler   = (*RedisShardedHandler)(nil)
+	_ vecdbtypes.SchemaEnsurer   = (*RedisShardedHandler)(nil)
+	_ vecdbtypes.DocumentDeleter = (*RedisShardedHandler)(nil)
+	_ vecdbtypes.FilterDeleter   = (*RedisShardedHandler)(nil)
+	_ vecdbtypes.HandlerCloser   = (*RedisShardedHandler)(nil)
+)
+
+// ValidateShardingSpec validates the spec of sharding.
+func ValidateShardingSpec(spec *ShardingSpec) error {
+	if len(spec.URLs) == 0 {
+		return fmt.Errorf("urls are empty")
+	}
+	seen := map[string]bool{}
+	for _, url := range append(slices.Clone(spec.URLs), spec.Retired...) {
+		if seen[url] {
+			return fmt.Errorf("url %s is duplicated", url)
+		}
+		seen[url] = true
+		if _, err := parseURL(url); err != nil {
+			return fmt.Errorf("url %s is invalid: %w", url, err)
+		}
+	}
+	if spec.VirtualNodes < 0 {
+		return fmt.Errorf("virtualNodes must not be negative")
+	}
+	if spec.RetryInterval != "" {
+		interval, err := time.ParseDuration(spec.RetryInterval)
+		if err != nil {
+			return fmt.Errorf("retryInterval %s is invalid: %w", spec.RetryInterval, err)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("retryInterval %s must be positive", spec.RetryInterval)
+		}
+	}
+	return nil
+}
+
+// GetVirtualNodes returns the number of the points of a shard.
+func (spec *ShardingSpec) GetVirtualNodes() int {
+	if spec.VirtualNodes > 0 {
+		return spec.VirtualNodes
+	}
+	return DefaultShardVirtualNodes
+}
+
+// GetRetryInterval returns the interval to try a down shard again.
+func (spec *ShardingSpec) GetRetryInterval() time.Duration {
+	interval, err := time.ParseDuration(spec.RetryInterval)
+	if err != nil || interval <= 0 {
+		return DefaultShardRetryInterval
+	}
+	return interval
+}
+
+// newHashRing creates the hash ring of the shards, the points of a shard
+// only depend on its URL, so the order of the URLs does not matter.
+func newHashRing(urls []string, virtualNodes int) *hashRing {
+	type point struct {
+		hash uint64
+		url  string
+	}
+	points := make([]point, 0, len(urls)*virtualNodes)
+	for _, url := range urls {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{hash: murmur3.Sum64([]byte(url + "#" + strconv.Itoa(i))), url: url})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].url < points[j].url
+	})
+	ring := &hashRing{
+		hashes: make([]uint64, 0, len(points)),
+		urls:   make([]string, 0, len(points)),
+	}
+	for _, p := range points {
+		ring.hashes = append(ring.hashes, p.hash)
+		ring.urls = append(ring.urls, p.url)
+	}
+	return ring
+}
+
+// owner returns the URL of the shard owning the key, which is the first
+// point clockwise from the hash of the key.
+func (r *hashRing) owner(key string) string {
+	hash := murmur3.Sum64([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.urls[i]
+}
+
+// isConnectionError checks whether the error means the Redis instance is
+// unreachable, errors replied by Redis and context errors are not.
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if _, ok := rueidis.IsRedisErr(err); ok {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, rueidis.ErrClosing)
+}
+
+// get returns the handler of the shard, it fails with ErrShardUnavailable
+// if the shard is down and the retry interval has not passed.
+func (s *redisShard) get(ctx context.Context) (*RedisVectorHandler, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.downSince.IsZero() && time.Since(s.downSince) < s.retryInterval {
+		return nil, fmt.Errorf("%w: %s: %v", ErrShardUnavailable, s.addr, s.downErr)
+	}
+	if s.handler == nil {
+		handler, err := s.create(ctx)
+		if err != nil {
+			s.markDown(err)
+			return nil, err
+		}
+		s.handler = handler
+	}
+	return s.handler, nil
+}
+
+// markDown marks the shard down, the lock must be held.
+func (s *redisShard) markDown(err error) {
+	if s.downSince.IsZero() {
+		logger.Warnf("redis shard %s is down: %v", s.addr, err)
+	}
+	s.downSince = time.Now()
+	s.downErr = err
+}
+
+// report records the result of an operation on the shard, the shard is
+// marked down if it is unreachable, and up if the operation succeeds.
+func (s *redisShard) report(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case isConnectionError(err):
+		s.markDown(err)
+	case err == nil && !s.downSince.IsZero():
+		logger.Infof("redis shard %s is up", s.addr)
+		s.downSince = time.Time{}
+		s.downErr = nil
+	}
+}
+
+// do runs fn with the handler of the shard, and records its result.
+func (s *redisShard) do(ctx context.Context, fn func(handler *RedisVectorHandler) error) error {
+	handler, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(handler)
+	s.report(err)
+	return err
+}
+
+// createShardedHandler creates the handlers of the shards, the shards
+// unreachable are marked down, and their handlers are created when they
+// are tried again.
+func (r *RedisVectorDB) createShardedHandler(ctx context.Context, opts *vecdbtypes.Options) (*RedisShardedHandler, error) {
+	spec := r.Spec.Shards
+	if r.CommonSpec.PayloadStore != nil {
+		return nil, fmt.Errorf("payload store is not supported with shards")
+	}
+	h := &RedisShardedHandler{
+		index: opts.DBName,
+		ring:  newHashRing(spec.URLs, spec.GetVirtualNodes()),
+		keys:  r.getKeyLayout(),
+		ids:   r.Spec.getDocumentIDs(),
+	}
+	for _, url := range append(slices.Clone(spec.URLs), spec.Retired...) {
+		s := &redisShard{
+			url:           url,
+			addr:          shardAddress(url),
+			retryInterval: spec.GetRetryInterval(),
+			create: func(ctx context.Context) (*RedisVectorHandler, error) {
+				return r.createHandler(ctx, url, opts)
+			},
+		}
+		if _, err := s.get(ctx); err != nil {
+			if !isConnectionError(err) {
+				return nil, err
+			}
+		}
+		h.shards = append(h.shards, s)
+	}
+	return h, nil
+}
+
+// shard returns the shard of the URL.
+func (h *RedisShardedHandler) shard(url string) *redisShard {
+	for _, s := range h.shards {
+		if s.url == url {
+			return s
+		}
+	}
+	return nil
+}
+
+// forEachShard runs fn with the handlers of the shards concurrently, and
+// returns their errors in the order of the shards.
+func (h *RedisShardedHandler) forEachShard(ctx context.Context, fn func(i int, handler *RedisVectorHandler) error) []error {
+	errs := make([]error, len(h.shards))
+	wg := sync.WaitGroup{}
+	for i, s := range h.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.do(ctx, func(handler *RedisVectorHandler) error {
+				return fn(i, handler)
+			})
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// SimilaritySearch searches all shards, including the retired ones, and
+// merges their results by distance. The shards down are skipped, so their
+// documents are missed, it fails only if all shards fail.
+func (h *RedisShardedHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) (_ []map[string]any, err error) {
+	defer func() { err = withErrorKind(err) }()
+	opts := getHandlerSearchOptions(options...)
+	if len(opts.SortBy) > 0 {
+		return nil, fmt.Errorf("sorting by fields is not supported with shards")
+	}
+	limit := max(opts.Limit, 1)
+	offset := max(opts.Offset, 0)
+	// every shard returns the results up to the offset, the merged results
+	// are skipped then.
+	options = append(slices.Clone(options), vecdbtypes.WithOffset(0), vecdbtypes.WithLimit(offset+limit))
+	distanceField := "distance"
+	if opts.Explain {
+		distanceField = vecdbtypes.ExplainDistanceField
+	}
+
+	results := make([][]map[string]any, len(h.shards))
+	errs := h.forEachShard(ctx, func(i int, handler *RedisVectorHandler) error {
+		docs, err := handler.SimilaritySearch(ctx, options...)
+		results[i] = docs
+		return err
+	})
+
+	type result struct {
+		doc      map[string]any
+		distance float64
+	}
+	merged := []result{}
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			logger.Warnf("failed to search shard %s of index %s: %v", h.shards[i].addr, h.index, err)
+			continue
+		}
+		for _, doc := range results[i] {
+			distance, err := vecdbtypes.ToFloat64(doc[distanceField])
+			if err != nil {
+				return nil, fmt.Errorf("failed to get distance of document %v: %w", doc["id"], err)
+			}
+			merged = append(merged, result{doc: doc, distance: distance})
+		}
+	}
+	if failed == len(h.shards) {
+		return nil, errors.Join(errs...)
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].distance < merged[j].distance
+	})
+	docs := []map[string]any{}
+	for i := offset; i < len(merged) && i < offset+limit; i++ {
+		docs = append(docs, merged[i].doc)
+	}
+	return docs, nil
+}
+
+// InsertDocuments inserts every document to the shard owning its key, the
+// documents without IDs are given UUIDs to be routed, unless the IDs are
+// required or derived, see documentIDs. The documents of the
+// other shards are still inserted if a shard fails.
+func (h *RedisShardedHandler) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) (_ []string, err error) {
+	defer func() { err = withErrorKind(err) }()
+	opts := getHandlerInsertOptions(options...)
+
+	groups := map[string][]int{}
+	routed := make([]map[string]any, len(docs))
+	for i, doc := range docs {
+		doc, err := h.ids.resolve(i, doc)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := doc["id"]; !ok {
+			doc = maps.Clone(doc)
+			doc["id"] = uuid.NewString()
+		}
+		routed[i] = doc
+		url := h.ring.owner(h.keys.documentKey(opts.RedisPrefix, fmt.Sprintf("%v", doc["id"])))
+		groups[url] = append(groups[url], i)
+	}
+
+	ids := make([]string, len(docs))
+	errs := make([]error, 0, len(groups))
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for url, indexes := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shardDocs := make([]map[string]any, 0, len(indexes))
+			for _, i := range indexes {
+				shardDocs = append(shardDocs, routed[i])
+			}
+			var shardIDs []string
+			err := h.shard(url).do(ctx, func(handler *RedisVectorHandler) error {
+				var err error
+				shardIDs, err = handler.InsertDocuments(ctx, shardDocs, options...)
+				return err
+			})
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to insert %d documents to shard %s: %w", len(indexes), shardAddress(url), err))
+				return
+			}
+			for j, i := range indexes {
+				ids[i] = shardIDs[j]
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return ids, nil
+}
+
+// DeleteDocuments deletes the documents from all shards, since documents
+// may be in shards not owning them until they are moved by rebalancing.
+func (h *RedisShardedHandler) DeleteDocuments(ctx context.Context, ids []string) (_ int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	deleted := make([]int64, len(h.shards))
+	errs := h.forEachShard(ctx, func(i int, handler *RedisVectorHandler) error {
+		var err error
+		deleted[i], err = handler.DeleteDocuments(ctx, ids)
+		return err
+	})
+	var total int64
+	for _, n := range deleted {
+		total += n
+	}
+	return total, errors.Join(errs...)
+}
+
+// DeleteByFilter deletes the documents matching the filters from all
+// shards.
+func (h *RedisShardedHandler) DeleteByFilter(ctx context.Context, filters ...*vecdbtypes.TagFilter) (_ int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	deleted := make([]int64, len(h.shards))
+	errs := h.forEachShard(ctx, func(i int, handler *RedisVectorHandler) error {
+		var err error
+		deleted[i], err = handler.DeleteByFilter(ctx, filters...)
+		return err
+	})
+	var total int64
+	for _, n := range deleted {
+		total += n
+	}
+	return total, errors.Join(errs...)
+}
+
+// Close closes the handlers of the shards created.
+func (h *RedisShardedHandler) Close() {
+	for _, s := range h.shards {
+		s.lock.Lock()
+		if s.handler != nil {
+			s.handler.Close()
+		}
+		s.lock.Unlock()
+	}
+}
+
+// EnsureSchema creates the index of every shard again if it is dropped by
+// others.
+func (h *RedisShardedHandler) EnsureSchema(ctx context.Context) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	return errors.Join(h.forEachShard(ctx, func(_ int, handler *RedisVectorHandler) error {
+		return handler.EnsureSchema(ctx)
+	})...)
+}
+
+// shardURLs returns the URLs of the Redis instances, which are the shards
+// including the retired ones if sharded, or the URL of the spec.
+func (r *RedisVectorDB) shardURLs() []string {
+	if r.Spec.Shards == nil {
+		return []string{r.Spec.ConnectionURL()}
+	}
+	return append(slices.Clone(r.Spec.Shards.URLs), r.Spec.Shards.Retired...)
+}
+
+// withShardClients runs fn with a client of every Redis instance in
+// order, it stops at the first error.
+func (r *RedisVectorDB) withShardClients(fn func(client rueidis.Client) error) error {
+	for _, url := range r.shardURLs() {
+		if err := withURLClient(url, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardAddress returns the address of the shard of the URL for logs and
+// errors, since the URL may contain the password.
+func shardAddress(url string) string {
+	option, err := parseURL(url)
+	if err != nil || len(option.InitAddress) == 0 {
+		return "<invalid url>"
+	}
+	return option.InitAddress[0]
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestHashRing(t *testing.T) {
+	assert := assert.New(t)
+
+	urls := []string{"redis://a:6379", "redis://b:6379", "redis://c:6379"}
+	ring := newHashRing(urls, DefaultShardVirtualNodes)
+	added := newHashRing(append([]string{"redis://d:6379"}, urls...), DefaultShardVirtualNodes)
+	removed := newHashRing(urls[1:], DefaultShardVirtualNodes)
+
+	counts := map[string]int{}
+	movedByAdding, movedByRemoving := 0, 0
+	const n = 10000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("movie:%d", i)
+		owner := ring.owner(key)
+		counts[owner]++
+
+		// only the keys owned by the added shard are moved.
+		if newOwner := added.owner(key); newOwner != owner {
+			assert.Equal("redis://d:6379", newOwner)
+			movedByAdding++
+		}
+		// only the keys of the removed shard are moved.
+		if newOwner := removed.owner(key); newOwner != owner {
+			assert.Equal("redis://a:6379", owner)
+			movedByRemoving++
+		}
+	}
+	for _, url := range urls {
+		assert.InDelta(n/3, counts[url], n/10, url)
+	}
+	assert.InDelta(n/4, movedByAdding, n/10)
+	assert.Equal(counts["redis://a:6379"], movedByRemoving)
+
+	assert.NoError(ValidateShardingSpec(&ShardingSpec{URLs: urls}))
+	assert.Error(ValidateShardingSpec(&ShardingSpec{}))
+	assert.Error(ValidateShardingSpec(&ShardingSpec{URLs: urls, Retired: urls[:1]}))
+	assert.Error(ValidateShardingSpec(&ShardingSpec{URLs: urls, RetryInterval: "0s"}))
+	assert.NoError(ValidateSpec(&RedisVectorDBSpec{Shards: &ShardingSpec{URLs: urls}}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: urls[0], Shards: &ShardingSpec{URLs: urls}}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{Shards: &ShardingSpec{URLs: urls}, Drain: &DrainSpec{}}))
+}
+
+// fakeShard is a fake Redis instance of a shard, which searches and
+// writes the documents of its own.
+type fakeShard struct {
+	redis     *fakeRedis
+	url       string
+	distances map[string]string
+	written   []string
+	searches  [][]string
+}
+
+func newFakeShard(t *testing.T, distances map[string]string) *fakeShard {
+	s := &fakeShard{distances: distances}
+	s.redis = newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "FT.SEARCH":
+			s.searches = append(s.searches, args)
+			reply := []string{fmt.Sprintf(":%d\r\n", len(s.distances))}
+			for id, distance := range s.distances {
+				reply = append(reply, respBulk("movie:"+id),
+					respArray(respBulk(idField), respBulk(id), respBulk(distancePlaceHolder), respBulk(distance)))
+			}
+			return respArray(reply...)
+		case "HMSET":
+			s.written = append(s.written, args[1])
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	s.url = "redis://" + s.redis.ln.Addr().String()
+	return s
+}
+
+func newTestShardedHandler(t *testing.T, shards ...*fakeShard) *RedisShardedHandler {
+	urls := []string{}
+	h := &RedisShardedHandler{index: "movie"}
+	for _, s := range shards {
+		urls = append(urls, s.url)
+		h.shards = append(h.shards, &redisShard{
+			url:           s.url,
+			addr:          shardAddress(s.url),
+			retryInterval: DefaultShardRetryInterval,
+			create: func(ctx context.Context) (*RedisVectorHandler, error) {
+				return &RedisVectorHandler{client: newFakeRedisClient(t, s.redis), index: "movie"}, nil
+			},
+		})
+	}
+	h.ring = newHashRing(urls, DefaultShardVirtualNodes)
+	return h
+}
+
+func TestShardedHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newFakeShard(t, map[string]string{"a1": "0.1", "a2": "0.4"})
+	b := newFakeShard(t, map[string]string{"b1": "0.2", "b2": "0.3"})
+	h := newTestShardedHandler(t, a, b)
+	ctx := context.Background()
+
+	// the results of the shards are merged by distance, and every shard
+	// returns the results up to the offset.
+	docs, err := h.SimilaritySearch(ctx, vecdbtypes.WithLimit(2), vecdbtypes.WithOffset(1), vecdbtypes.WithRedisVectorFilterKey("embedding"))
+	assert.NoError(err)
+	assert.Len(docs, 2)
+	assert.Equal("b1", docs[0]["id"])
+	assert.Equal("b2", docs[1]["id"])
+	assert.Equal(float32(0.2), docs[0]["distance"])
+	assert.Equal(float32(0.8), docs[0]["score"])
+	for _, s := range []*fakeShard{a, b} {
+		args := strings.Join(s.searches[0], " ")
+		assert.Contains(args, "LIMIT 0 3")
+	}
+	_, err = h.SimilaritySearch(ctx, vecdbtypes.WithSortBy([]string{"title", "ASC"}))
+	assert.Error(err)
+
+	// every document is written to the shard owning its key.
+	inserted := []map[string]any{}
+	for i := 0; i < 20; i++ {
+		inserted = append(inserted, map[string]any{"id": fmt.Sprint(i), "title": "t"})
+	}
+	ids, err := h.InsertDocuments(ctx, inserted, vecdbtypes.WithRedisPrefix("movie"))
+	assert.NoError(err)
+	assert.Len(ids, 20)
+	assert.Equal(20, len(a.written)+len(b.written))
+	assert.NotEmpty(a.written)
+	assert.NotEmpty(b.written)
+	for i, id := range ids {
+		assert.Equal(fmt.Sprintf("movie:%d", i), id)
+	}
+	for _, s := range []*fakeShard{a, b} {
+		for _, key := range s.written {
+			assert.Equal(s.url, h.ring.owner(key))
+		}
+	}
+
+	// documents without IDs are given ones to be routed.
+	ids, err = h.InsertDocuments(ctx, []map[string]any{{"title": "t"}}, vecdbtypes.WithRedisPrefix("movie"))
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(ids[0], "movie:"))
+}
+
+func TestShardedHandlerShardDown(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newFakeShard(t, map[string]string{"a1": "0.1"})
+	b := newFakeShard(t, map[string]string{"b1": "0.2"})
+	h := newTestShardedHandler(t, a, b)
+	ctx := context.Background()
+
+	down := true
+	create := h.shards[1].create
+	h.shards[1].create = func(ctx context.Context) (*RedisVectorHandler, error) {
+		if down {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		return create(ctx)
+	}
+
+	// the documents of the down shard are missed.
+	docs, err := h.SimilaritySearch(ctx, vecdbtypes.WithLimit(10))
+	assert.NoError(err)
+	assert.Len(docs, 1)
+	assert.Equal("a1", docs[0]["id"])
+
+	// the shard is skipped until the retry interval passes.
+	var key string
+	for i := 0; ; i++ {
+		if key = fmt.Sprintf("movie:%d", i); h.ring.owner(key) == b.url {
+			break
+		}
+	}
+	h.shards[1].create = create
+	_, err = h.InsertDocuments(ctx, []map[string]any{{"id": strings.TrimPrefix(key, "movie:")}}, vecdbtypes.WithRedisPrefix("movie"))
+	assert.ErrorIs(err, ErrShardUnavailable)
+	assert.Empty(b.written)
+
+	h.shards[1].retryInterval = 0
+	_, err = h.InsertDocuments(ctx, []map[string]any{{"id": strings.TrimPrefix(key, "movie:")}}, vecdbtypes.WithRedisPrefix("movie"))
+	assert.NoError(err)
+	assert.Equal([]string{key}, b.written)
+	docs, err = h.SimilaritySearch(ctx, vecdbtypes.WithLimit(10))
+	assert.NoError(err)
+	assert.Len(docs, 2)
+}
+
+func TestRebalance(t *testing.T) {
+	assert := assert.New(t)
+
+	newStore := func(keys ...string) (*fakeRedis, map[string]string) {
+		store := map[string]string{}
+		for _, key := range keys {
+			store[key] = "value of " + key
+		}
+		r := newFakeRedis(t, func(args []string) string {
+			switch strings.ToUpper(args[0]) {
+			case "CLUSTER":
+				return "-ERR This instance has cluster support disabled\r\n"
+			case "SCAN":
+				keys := []string{}
+				for key := range store {
+					if strings.HasPrefix(key, "movie:") {
+						keys = append(keys, respBulk(key))
+					}
+				}
+				return respArray(respBulk("0"), respArray(keys...))
+			case "DUMP":
+				if v, ok := store[args[1]]; ok {
+					return respBulk(v)
+				}
+				return "$-1\r\n"
+			case "PTTL":
+				return ":-1\r\n"
+			case "RESTORE":
+				if _, ok := store[args[1]]; ok {
+					return "-BUSYKEY Target key name already exists.\r\n"
+				}
+				store[args[1]] = args[3]
+				return "+OK\r\n"
+			case "DEL":
+				delete(store, args[1])
+				return ":1\r\n"
+			}
+			return "-ERR unknown command\r\n"
+		})
+		return r, store
+	}
+
+	keys := []string{}
+	for i := 0; i < 30; i++ {
+		keys = append(keys, fmt.Sprintf("movie:%d", i))
+	}
+	ra, a := newStore(keys[:20]...)
+	rb, b := newStore(keys[20:]...)
+	rc, c := newStore()
+	// the fake Redis supports RESP2 only.
+	url := func(r *fakeRedis) string {
+		return "redis://" + r.ln.Addr().String() + "?protocol=2&client_cache=0"
+	}
+	spec := &ShardingSpec{
+		URLs:    []string{url(ra), url(rc)},
+		Retired: []string{url(rb)},
+	}
+	ring := newHashRing(spec.URLs, spec.GetVirtualNodes())
+
+	// the newer document in the owner is kept.
+	var conflicted string
+	for _, key := range keys[:20] {
+		if ring.owner(key) == spec.URLs[1] {
+			conflicted = key
+			c[key] = "newer"
+			break
+		}
+	}
+	assert.NotEmpty(conflicted)
+
+	b0 := newRebalance(spec, "movie")
+	assert.NoError(b0.rebalance(context.Background()))
+	report := b0.getReport()
+	// the keys moved to the shards scanned later are scanned again.
+	assert.GreaterOrEqual(report.ScannedKeys, int64(30))
+	assert.Equal(int64(1), report.Conflicts)
+	assert.Empty(b)
+	assert.Equal(30, len(a)+len(c))
+	kept := 0
+	for _, key := range keys[:20] {
+		if ring.owner(key) == spec.URLs[0] {
+			kept++
+		}
+	}
+	assert.Equal(int64(30-kept-1), report.Moved)
+	for key := range a {
+		assert.Equal(spec.URLs[0], ring.owner(key))
+	}
+	for key, v := range c {
+		assert.Equal(spec.URLs[1], ring.owner(key))
+		if key != conflicted {
+			assert.Equal("value of "+key, v)
+		}
+	}
+	assert.Equal("newer", c[conflicted])
+}
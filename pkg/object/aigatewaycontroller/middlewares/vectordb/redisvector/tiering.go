@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var (
+	// claimIdleScript returns the documents not hit since the time and
+	// removes them from the hits, so concurrent callers never claim the
+	// same documents.
+	claimIdleScript = rueidis.NewLuaScript(`
+local ids = redis.call('ZRANGE', KEYS[1], '-inf', '(' .. ARGV[1], 'BYSCORE', 'LIMIT', 0, tonumber(ARGV[2]))
+if #ids > 0 then
+	redis.call('ZREM', KEYS[1], unpack(ids))
+end
+return ids
+`)
+
+	// touchNowScript records the documents are hit at the time of Redis,
+	// so the hits recorded by members with skewed clocks are comparable.
+	touchNowScript = rueidis.NewLuaScript(`
+local now = redis.call('TIME')
+local score = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+for i = 1, #ARGV do
+	redis.call('ZADD', KEYS[1], score, ARGV[i])
+end
+return score
+`)
+
+	// setFieldsScript sets the fields of the document if it exists.
+	setFieldsScript = rueidis.NewLuaScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], unpack(ARGV))
+return 1
+`)
+)
+
+var _ vecdbtypes.DocumentTierer = (*RedisVectorHandler)(nil)
+
+// getHitsKey returns the key of the sorted set of the last hits of the
+// documents of the index, the members are the keys of the documents.
+func getHitsKey(index string) string {
+	return fmt.Sprintf("hits:{%s}", index)
+}
+
+// checkTiering checks the documents of the handler can be tiered, they
+// must be hashes whose fields are stored in place.
+func (r *RedisVectorHandler) checkTiering() error {
+	if r.payloads != nil {
+		return fmt.Errorf("%w with payload store", vecdbtypes.ErrTieringNotSupported)
+	}
+	if r.client.getIndexType() != IndexTypeHash {
+		return fmt.Errorf("%w with %s index type", vecdbtypes.ErrTieringNotSupported, r.client.getIndexType())
+	}
+	return nil
+}
+
+// Now returns the current time of Redis.
+func (r *RedisVectorHandler) Now(ctx context.Context) (_ time.Time, err error) {
+	defer func() { err = withErrorKind(err) }()
+	client := r.client.client
+	now, err := client.Do(ctx, client.B().Time().Build()).AsIntSlice()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(now) != 2 {
+		return time.Time{}, fmt.Errorf("invalid time %v", now)
+	}
+	return time.Unix(now[0], now[1]*int64(time.Microsecond)), nil
+}
+
+// TouchDocuments records the documents are hit at the time, or at the time
+// of Redis if the time is zero.
+func (r *RedisVectorHandler) TouchDocuments(ctx context.Context, ids []string, at time.Time) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	if err := r.checkTiering(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	client := r.client.client
+	if at.IsZero() {
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = r.client.keys.documentKey(r.index, id)
+		}
+		return touchNowScript.Exec(ctx, client, []string{getHitsKey(r.index)}, keys).Error()
+	}
+	zadd := client.B().Zadd().Key(getHitsKey(r.index)).ScoreMember()
+	score := float64(at.UnixMilli())
+	for _, id := range ids {
+		zadd = zadd.ScoreMember(score, r.client.keys.documentKey(r.index, id))
+	}
+	return client.Do(ctx, zadd.Build()).Error()
+}
+
+// ClaimIdleDocuments returns the keys of at most limit documents not hit
+// since the time, and stops tracking them.
+func (r *RedisVectorHandler) ClaimIdleDocuments(ctx context.Context, since time.Time, limit int) (_ []string, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if err := r.checkTiering(); err != nil {
+		return nil, err
+	}
+	client := r.client.client
+	args := []string{strconv.FormatInt(since.UnixMilli(), 10), strconv.Itoa(limit)}
+	return claimIdleScript.Exec(ctx, client, []string{getHitsKey(r.index)}, args).AsStrSlice()
+}
+
+// GetDocumentFields returns the fields of the document.
+func (r *RedisVectorHandler) GetDocumentFields(ctx context.Context, id string, fields []string) (_ map[string]string, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if err := r.checkTiering(); err != nil {
+		return nil, err
+	}
+	client := r.client.client
+	key := r.client.keys.documentKey(r.index, id)
+	resps := client.DoMulti(ctx,
+		client.B().Exists().Key(key).Build(),
+		client.B().Hmget().Key(key).Field(fields...).Build(),
+	)
+	exists, err := resps[0].AsInt64()
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, vecdbtypes.NewError(vecdbtypes.ErrNotFound, fmt.Errorf("document %s not found", id))
+	}
+	values, err := resps[1].ToArray()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(fields))
+	for i, field := range fields {
+		value, err := values[i].ToString()
+		if err != nil && !rueidis.IsRedisNil(err) {
+			return nil, err
+		}
+		result[field] = value
+	}
+	return result, nil
+}
+
+// SetDocumentFields sets the fields of the document if it exists.
+func (r *RedisVectorHandler) SetDocumentFields(ctx context.Context, id string, fields map[string]string) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	if err := r.checkTiering(); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	args := make([]string, 0, len(fields)*2)
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+	set, err := setFieldsScript.Exec(ctx, r.client.client, []string{r.client.keys.documentKey(r.index, id)}, args).AsInt64()
+	if err != nil {
+		return err
+	}
+	if set == 0 {
+		return vecdbtypes.NewError(vecdbtypes.ErrNotFound, fmt.Errorf("document %s not found", id))
+	}
+	return nil
+}
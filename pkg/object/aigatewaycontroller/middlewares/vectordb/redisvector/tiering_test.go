@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestTiering(t *testing.T) {
+	assert := assert.New(t)
+
+	hashes := map[string]map[string]string{
+		"movie:1": {"data": "a", "header": "{}"},
+		"movie:2": {"data": "b", "header": "{}"},
+	}
+	hits := map[string]int64{}
+	// the clock of Redis is skewed from the local clock.
+	serverNow := time.UnixMicro(1600000000123456)
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "ZADD":
+			for i := 2; i+1 < len(args); i += 2 {
+				score, _ := strconv.ParseFloat(args[i], 64)
+				hits[args[i+1]] = int64(score)
+			}
+			return ":1\r\n"
+		case "TIME":
+			return respArray(respBulk(strconv.FormatInt(serverNow.Unix(), 10)), respBulk(strconv.Itoa(serverNow.Nanosecond()/1000)))
+		case "EVALSHA":
+			return "-NOSCRIPT No matching script\r\n"
+		case "EVAL":
+			// EVAL script numkeys key args...
+			script, key, argv := args[1], args[3], args[4:]
+			if strings.Contains(script, "TIME") {
+				for _, member := range argv {
+					hits[member] = serverNow.UnixMilli()
+				}
+				return ":" + strconv.FormatInt(serverNow.UnixMilli(), 10) + "\r\n"
+			}
+			if strings.Contains(script, "ZRANGE") {
+				since, _ := strconv.ParseInt(argv[0], 10, 64)
+				limit, _ := strconv.Atoi(argv[1])
+				var members []string
+				for member, score := range hits {
+					if score < since {
+						members = append(members, member)
+					}
+				}
+				sort.Strings(members)
+				if len(members) > limit {
+					members = members[:limit]
+				}
+				items := []string{}
+				for _, member := range members {
+					delete(hits, member)
+					items = append(items, respBulk(member))
+				}
+				return respArray(items...)
+			}
+			hash, ok := hashes[key]
+			if !ok {
+				return ":0\r\n"
+			}
+			for i := 0; i+1 < len(argv); i += 2 {
+				hash[argv[i]] = argv[i+1]
+			}
+			return ":1\r\n"
+		case "EXISTS":
+			if _, ok := hashes[args[1]]; ok {
+				return ":1\r\n"
+			}
+			return ":0\r\n"
+		case "HMGET":
+			items := []string{}
+			for _, field := range args[2:] {
+				if v, ok := hashes[args[1]][field]; ok {
+					items = append(items, respBulk(v))
+				} else {
+					items = append(items, "$-1\r\n")
+				}
+			}
+			return respArray(items...)
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	handler := &RedisVectorHandler{client: newFakeRedisClient(t, r), index: "movie"}
+	ctx := context.Background()
+	now := time.UnixMilli(1700000000000)
+
+	assert.NoError(handler.TouchDocuments(ctx, []string{"1", "movie:2"}, now.Add(-time.Hour)))
+	assert.Equal(map[string]int64{"movie:1": now.Add(-time.Hour).UnixMilli(), "movie:2": now.Add(-time.Hour).UnixMilli()}, hits)
+	assert.NoError(handler.TouchDocuments(ctx, []string{"2"}, now))
+
+	// only the documents not hit since the time are claimed, and they are
+	// claimed once.
+	ids, err := handler.ClaimIdleDocuments(ctx, now.Add(-time.Minute), 10)
+	assert.NoError(err)
+	assert.Equal([]string{"movie:1"}, ids)
+	ids, err = handler.ClaimIdleDocuments(ctx, now.Add(-time.Minute), 10)
+	assert.NoError(err)
+	assert.Empty(ids)
+
+	// the hits are recorded at the time of Redis if the time is zero.
+	dbNow, err := handler.Now(ctx)
+	assert.NoError(err)
+	assert.True(serverNow.Equal(dbNow))
+	assert.NoError(handler.TouchDocuments(ctx, []string{"1"}, time.Time{}))
+	assert.Equal(serverNow.UnixMilli(), hits["movie:1"])
+	ids, err = handler.ClaimIdleDocuments(ctx, dbNow.Add(-time.Minute), 10)
+	assert.NoError(err)
+	assert.Empty(ids)
+	ids, err = handler.ClaimIdleDocuments(ctx, dbNow.Add(time.Millisecond), 10)
+	assert.NoError(err)
+	assert.Equal([]string{"movie:1"}, ids)
+
+	fields, err := handler.GetDocumentFields(ctx, "movie:1", []string{"data", "cold_key"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"data": "a", "cold_key": ""}, fields)
+	_, err = handler.GetDocumentFields(ctx, "3", []string{"data"})
+	assert.True(errors.Is(err, vecdbtypes.ErrNotFound))
+
+	assert.NoError(handler.SetDocumentFields(ctx, "1", map[string]string{"data": "", "cold_key": "movie:1"}))
+	assert.Equal(map[string]string{"data": "", "header": "{}", "cold_key": "movie:1"}, hashes["movie:1"])
+	err = handler.SetDocumentFields(ctx, "3", map[string]string{"data": ""})
+	assert.True(errors.Is(err, vecdbtypes.ErrNotFound))
+
+	// documents of JSON indexes can not be tiered.
+	handler.client.indexType = IndexTypeJSON
+	err = handler.TouchDocuments(ctx, []string{"1"}, now)
+	assert.True(errors.Is(err, vecdbtypes.ErrTieringNotSupported))
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	operationSearch = "search"
+	operationInsert = "insert"
+	operationAdmin  = "admin"
+)
+
+// errOperationTimeout is the cause of the contexts of operations timed
+// out, it tells them from the ones done by the callers.
+var errOperationTimeout = errors.New("redis vector operation timeout")
+
+// operationTimeouts are the timeouts of the kinds of operations, an
+// operation is bounded by the context of the caller only if its timeout
+// is zero.
+type operationTimeouts struct {
+	search time.Duration
+	insert time.Duration
+	admin  time.Duration
+}
+
+// getOperationTimeouts returns the timeouts of the spec, which is
+// validated.
+func (spec *RedisVectorDBSpec) getOperationTimeouts() operationTimeouts {
+	parse := func(value string) time.Duration {
+		d, _ := time.ParseDuration(value)
+		return max(d, 0)
+	}
+	return operationTimeouts{
+		search: parse(spec.SearchTimeout),
+		insert: parse(spec.InsertTimeout),
+		admin:  parse(spec.AdminTimeout),
+	}
+}
+
+// validateOperationTimeouts validates the timeouts of the spec.
+func validateOperationTimeouts(spec *RedisVectorDBSpec) error {
+	timeouts := []struct{ name, value string }{
+		{"searchTimeout", spec.SearchTimeout},
+		{"insertTimeout", spec.InsertTimeout},
+		{"adminTimeout", spec.AdminTimeout},
+	}
+	for _, t := range timeouts {
+		name, value := t.name, t.value
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("redis vector %s %s is invalid: %w", name, value, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("redis vector %s %s is negative", name, value)
+		}
+	}
+	return nil
+}
+
+func (t operationTimeouts) get(operation string) time.Duration {
+	switch operation {
+	case operationSearch:
+		return t.search
+	case operationInsert:
+		return t.insert
+	}
+	return t.admin
+}
+
+// startOperation bounds the context by the timeout of the operation, and
+// returns the function to call when the operation completes, which
+// releases the context and turns the error of the operation into
+// ErrVectorDBTimeout if the operation timed out.
+func (c *RedisClient) startOperation(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	timeout := c.timeouts.get(operation)
+	if timeout <= 0 {
+		return ctx, func(*error) {}
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, errOperationTimeout)
+	return ctx, func(err *error) {
+		defer cancel()
+		if *err == nil || !errors.Is(context.Cause(ctx), errOperationTimeout) {
+			return
+		}
+		// the error of a nested operation is wrapped by it already.
+		var timedOut *ErrVectorDBTimeout
+		if errors.As(*err, &timedOut) {
+			return
+		}
+		*err = NewErrVectorDBTimeout(operation, timeout, *err)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisvector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestValidateOperationTimeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	url := "redis://localhost:6379"
+	spec := &RedisVectorDBSpec{URL: url, SearchTimeout: "100ms", InsertTimeout: "1s"}
+	assert.NoError(ValidateSpec(spec))
+	assert.Equal(operationTimeouts{search: 100 * time.Millisecond, insert: time.Second}, spec.getOperationTimeouts())
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, SearchTimeout: "1 second"}))
+	assert.Error(ValidateSpec(&RedisVectorDBSpec{URL: url, AdminTimeout: "-1s"}))
+}
+
+func TestOperationTimeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newFakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "FT.SEARCH":
+			time.Sleep(200 * time.Millisecond)
+			return respArray(":3\r\n")
+		case "PING":
+			return "+PONG\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := newFakeRedisClient(t, r)
+	ctx := context.Background()
+
+	// the operations are bounded by the contexts of the callers only
+	// without timeouts.
+	count, err := client.Count(ctx, "movie", "")
+	assert.NoError(err)
+	assert.Equal(int64(3), count)
+
+	var timedOut *ErrVectorDBTimeout
+	callerCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Count(callerCtx, "movie", "")
+	assert.Error(err)
+	assert.False(errors.As(err, &timedOut))
+
+	client.timeouts = operationTimeouts{search: 50 * time.Millisecond}
+	_, err = client.Count(ctx, "movie", "")
+	assert.True(errors.As(err, &timedOut))
+	assert.Equal(operationSearch, timedOut.Operation)
+	assert.Equal(50*time.Millisecond, timedOut.Timeout)
+	assert.ErrorIs(withErrorKind(err), vecdbtypes.ErrTimeout)
+
+	// the other kinds of operations are not bounded by the search timeout.
+	assert.NoError(client.HealthCheck(ctx))
+}
@@ -19,17 +19,111 @@ package redisvector
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/rueidis"
 
+	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
 )
 
 type (
 	// RedisVectorDBSpec defines the specification for a vector database middleware.
 	RedisVectorDBSpec struct {
-		URL string `json:"url" jsonschema:"required"`
+		// URL is the URL of the Redis instance or cluster, it is empty if
+		// the documents are sharded across instances by Shards.
+		URL string `json:"url,omitempty"`
+		// Mode is how Redis is connected, standalone (default), cluster
+		// or sentinel.
+		Mode string `json:"mode,omitempty" jsonschema:"enum=,enum=standalone,enum=cluster,enum=sentinel"`
+		// Addresses are the addresses of Redis, they are the seed nodes in
+		// cluster mode and the sentinels in sentinel mode. They are added
+		// to the host of URL, which carries the credentials and TLS.
+		Addresses []string `json:"addresses,omitempty"`
+		// MasterName is the name of the master monitored by the sentinels,
+		// it is required in sentinel mode.
+		MasterName string `json:"masterName,omitempty"`
+		// ShardsRefreshInterval is the interval of refreshing the cluster
+		// topology in cluster mode, the topology is only refreshed on
+		// redirects if it is empty.
+		ShardsRefreshInterval string `json:"shardsRefreshInterval,omitempty" jsonschema:"format=duration"`
+		// TLS connects to Redis by TLS, see TLSSpec.
+		TLS *TLSSpec `json:"tls,omitempty"`
+		// Username is the ACL username, the default user is used if it
+		// is empty.
+		Username string `json:"username,omitempty"`
+		// Password is the password of the user, it can be a reference
+		// like ${REDIS_PASSWORD} to an environment variable, which is
+		// read whenever a connection is authenticated.
+		Password string `json:"password,omitempty"`
+		// Shards distributes the documents across standalone Redis
+		// instances, see ShardingSpec.
+		Shards *ShardingSpec `json:"shards,omitempty"`
+		// Drain makes dropping an index gradual, see DrainSpec.
+		Drain *DrainSpec `json:"drain,omitempty"`
+		// LegacyFields writes documents without validating reserved fields
+		// and namespacing the ID, for indexes containing documents written
+		// by old versions which rely on the id or keys fields.
+		LegacyFields bool `json:"legacyFields,omitempty"`
+		// IndexType is how documents are stored, HASH by default. JSON
+		// keeps nested objects and arrays of documents.
+		IndexType string `json:"indexType,omitempty" jsonschema:"enum=,enum=HASH,enum=JSON"`
+		// Integrity checks whether the documents of the indexes are all
+		// indexed, see IntegritySpec.
+		Integrity *IntegritySpec `json:"integrity,omitempty"`
+		// TTL expires inserted documents after the duration, documents
+		// never expire if it is empty or zero.
+		TTL string `json:"ttl,omitempty" jsonschema:"format=duration"`
+		// VectorIndex is the algorithm of the vector fields of the indexes
+		// created, see VectorIndexSpec. Existing indexes are not changed.
+		VectorIndex *VectorIndexSpec `json:"vectorIndex,omitempty"`
+		// RecreateOnMismatch drops and creates an existing index again if
+		// its fields, vector dimensions or distance metrics do not match
+		// the schema, instead of failing. The documents are kept.
+		RecreateOnMismatch bool `json:"recreateOnMismatch,omitempty"`
+		// Retry retries the searches and inserts failed by transient
+		// errors, see RetrySpec. They are never retried if it is nil.
+		Retry *RetrySpec `json:"retry,omitempty"`
+		// Janitor sweeps the keys orphaned by crashed inserts, see
+		// JanitorSpec.
+		Janitor *JanitorSpec `json:"janitor,omitempty"`
+		// SearchTimeout, InsertTimeout and AdminTimeout bound the
+		// searches, the inserts and the other operations like creating
+		// indexes, including their retries. The operations time out with
+		// ErrVectorDBTimeout, and they are only bounded by the contexts of
+		// the callers if the timeouts are empty.
+		SearchTimeout string `json:"searchTimeout,omitempty" jsonschema:"format=duration"`
+		InsertTimeout string `json:"insertTimeout,omitempty" jsonschema:"format=duration"`
+		AdminTimeout  string `json:"adminTimeout,omitempty" jsonschema:"format=duration"`
+		// KeyPrefix is the prefix of the keys of documents, which is the
+		// prefix of the index as well, {index} in it is replaced by the
+		// name of the index, like app:{index}. It is the name of the index
+		// by default. KeySeparator separates the prefix and the IDs of
+		// documents, : by default. Changing them fails to create the
+		// existing indexes by the mismatch of their prefixes.
+		KeyPrefix    string `json:"keyPrefix,omitempty"`
+		KeySeparator string `json:"keySeparator,omitempty"`
+		// RequireExplicitID rejects the documents inserted without id by
+		// ErrDocumentIDRequired, instead of giving them UUIDs, so the
+		// callers forgetting the IDs never write duplicated documents.
+		RequireExplicitID bool `json:"requireExplicitID,omitempty"`
+		// IDFields derives the IDs of the documents inserted without id
+		// from the SHA-256 of the values of the fields, like the prompt,
+		// so inserting an identical document overwrites the existing one.
+		// The documents missing any of the fields are rejected. It is
+		// exclusive with RequireExplicitID.
+		IDFields []string `json:"idFields,omitempty"`
+		// Dialect is the query dialect of the vector searches, between 1
+		// and 4, it is 2 by default. The vectors are passed by PARAMS in
+		// every dialect, dialect 1 is for the Redis Stack versions
+		// pinned to it, and only supports thresholds of 1, as the
+		// searches of lower thresholds are range queries.
+		Dialect int `json:"dialect,omitempty"`
 		// opt rueidis.ClientOption
 	}
 
@@ -39,9 +133,12 @@ type (
 	}
 
 	RedisVectorHandler struct {
-		client *RedisClient
-		index  string
-		schema *IndexSchema
+		client     *RedisClient
+		index      string
+		schema     *IndexSchema
+		payloads   *payloadStore
+		janitor    *janitor
+		validation *vecdbtypes.VectorValidationSpec
 	}
 )
 
@@ -53,9 +150,31 @@ func New(common *vecdbtypes.CommonSpec, spec *RedisVectorDBSpec) *RedisVectorDB
 	}
 }
 
-func (r *RedisVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (vecdbtypes.VectorHandler, error) {
+func (r *RedisVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.Option) (_ vecdbtypes.VectorHandler, err error) {
+	defer func() { err = withErrorKind(err) }()
+	opts := &vecdbtypes.Options{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	if r.Spec.Shards != nil {
+		handler, err := r.createShardedHandler(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return handler, nil
+	}
+	handler, err := r.createHandler(ctx, r.Spec.ConnectionURL(), opts)
+	if err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+// createHandler creates the handler of the collection in the Redis of the
+// URL, the index is created if it does not exist.
+func (r *RedisVectorDB) createHandler(ctx context.Context, url string, opts *vecdbtypes.Options) (*RedisVectorHandler, error) {
 	clientHandler := &RedisVectorHandler{}
-	clientOption, err := rueidis.ParseURL(r.Spec.URL)
+	clientOption, err := parseURL(url)
 	if err != nil {
 		return nil, NewErrParsingRedisURL("failed to parse Redis URL", err)
 	}
@@ -65,70 +184,437 @@ func (r *RedisVectorDB) CreateSchema(ctx context.Context, options ...vecdbtypes.
 		return nil, NewErrCreateRedisClient("failed to create Redis client", err)
 	}
 
-	opts := &vecdbtypes.Options{}
-	for _, opt := range options {
-		opt(opts)
-	}
-
+	client.legacyFields = r.Spec.LegacyFields
+	client.indexType = IndexType(r.Spec.IndexType)
+	client.ttl = r.Spec.GetTTL()
+	client.retry = newRetryPolicy(r.Spec.Retry)
+	client.recreateOnMismatch = r.Spec.RecreateOnMismatch
+	client.timeouts = r.Spec.getOperationTimeouts()
+	client.keys = r.getKeyLayout()
+	client.ids = r.Spec.getDocumentIDs()
+	client.dialect = r.Spec.Dialect
 	clientHandler.client = client
 	clientHandler.index = opts.DBName
+	clientHandler.validation = r.CommonSpec.VectorValidation
 
-	if !clientHandler.client.CheckIndexExists(ctx, clientHandler.index) {
-		schema, ok := opts.Schema.(*IndexSchema)
-		if !ok {
-			return nil, NewErrUnexpectedIndexSchema("unexpected index schema type", fmt.Errorf("expected IndexSchema, got %T", opts.Schema))
+	// the schema is also used to select the fields of search results and
+	// encode vectors, so keep it even if the index exists.
+	if schema, ok := opts.Schema.(*IndexSchema); ok {
+		clientHandler.schema = r.Spec.VectorIndex.apply(schema)
+	}
+	exists := clientHandler.client.CheckIndexExists(ctx, clientHandler.index)
+	if exists && clientHandler.schema != nil {
+		// the vector type of the spec only applies to the indexes created,
+		// the vectors must be encoded in the types of the existing index.
+		fields, err := indexVectorFields(ctx, client.client, clientHandler.index)
+		if err != nil {
+			logger.Warnf("failed to get vector types of index %s, use the ones of the spec: %v", clientHandler.index, err)
+		} else {
+			clientHandler.schema = clientHandler.schema.withVectorTypes(fields)
 		}
-		clientHandler.schema = schema
-		if err := clientHandler.client.CreateIndexIfNotExists(ctx, clientHandler.index, schema); err != nil {
-			return nil, NewErrCreateRedisIndex("failed to create index", err)
+	}
+	if clientHandler.schema == nil {
+		if !exists {
+			return nil, NewErrUnexpectedIndexSchema("unexpected index schema type", fmt.Errorf("expected IndexSchema, got %T", opts.Schema))
 		}
+	} else if err := clientHandler.createIndex(ctx, clientHandler.schema); err != nil {
+		// the existing index is checked against the schema as well.
+		return nil, NewErrCreateRedisIndex("failed to create index", err)
+	}
+	client.vectorTypes = clientHandler.schema.vectorTypes()
+
+	if r.CommonSpec.PayloadStore != nil {
+		clientHandler.payloads = newPayloadStore(client.client, clientHandler.index, r.CommonSpec.PayloadStore)
+		clientHandler.payloads.startSweeper()
+	}
+	if r.Spec.Janitor != nil {
+		clientHandler.janitor = r.startJanitor(client.client, clientHandler.index)
 	}
 
 	return clientHandler, nil
 }
 
+// DropCollection drops the index and its documents, it succeeds if the
+// index does not exist. The documents are deleted in the background if
+// drain is configured. The index of every shard is dropped if sharded.
+func (r *RedisVectorDB) DropCollection(ctx context.Context, name string) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	if r.Spec.Drain != nil {
+		return r.drainCollection(ctx, name)
+	}
+	return r.withShardClients(func(client rueidis.Client) error {
+		err := client.Do(ctx, client.B().FtDropindex().Index(name).Dd().Build()).Error()
+		if err != nil && !isUnknownIndexError(err) {
+			return fmt.Errorf("failed to drop index %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// Ping checks whether the Redis server is reachable, it succeeds if any
+// shard is reachable if sharded, since the others only miss documents.
+func (r *RedisVectorDB) Ping(ctx context.Context) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	var errs []error
+	for _, url := range r.shardURLs() {
+		err := withURLClient(url, func(client rueidis.Client) error {
+			return client.Do(ctx, client.B().Ping().Build()).Error()
+		})
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// CountByField counts the documents of the index by the values of the
+// field, the field does not need to be indexed. The counts of all shards
+// are summed if sharded.
+func (r *RedisVectorDB) CountByField(ctx context.Context, name, field string) (_ map[string]int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	counts := map[string]int64{}
+	err = r.withShardClients(func(client rueidis.Client) error {
+		_, groups, err := client.Do(ctx, client.B().Arbitrary("FT.AGGREGATE").Keys(name).Args(
+			"*", "LOAD", "1", "@"+field, "GROUPBY", "1", "@"+field, "REDUCE", "COUNT", "0", "AS", "count",
+		).Build()).AsFtAggregate()
+		if err != nil {
+			return fmt.Errorf("failed to count documents of index %s: %w", name, err)
+		}
+		for _, group := range groups {
+			count, err := strconv.ParseInt(group["count"], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid count of index %s: %w", name, err)
+			}
+			counts[group[field]] += count
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// CountDocuments counts the documents of the index matching the filter,
+// all documents are counted if it is empty. The counts of all shards are
+// summed if sharded.
+func (r *RedisVectorDB) CountDocuments(ctx context.Context, name, filter string) (_ int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	var total int64
+	err = r.withShardClients(func(client rueidis.Client) error {
+		count, err := (&RedisClient{client: client}).Count(ctx, name, filter)
+		total += count
+		return err
+	})
+	return total, err
+}
+
+// DeleteDocuments deletes the documents by their IDs, the IDs of documents
+// written by old versions are their keys. The payloads referenced by the
+// documents are released if there is a payload store.
+func (r *RedisVectorHandler) DeleteDocuments(ctx context.Context, ids []string) (_ int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	var options []DeleteOption
+	if r.payloads != nil {
+		options = append(options, withPayloadRelease(r.payloads))
+	}
+	return r.client.DeleteByIDs(ctx, r.index, ids, options...)
+}
+
+// DeleteByFilter deletes the documents matching all the tag filters, the
+// filters are checked against the schema of the index first, so a filter
+// on an unknown field never deletes anything. The payloads referenced by
+// the documents are released if there is a payload store.
+func (r *RedisVectorHandler) DeleteByFilter(ctx context.Context, filters ...*vecdbtypes.TagFilter) (_ int64, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if len(filters) == 0 {
+		return 0, NewErrInvalidQueryFilter("", "at least one filter is required")
+	}
+	queryFilters := toRedisQueryFilters(filters)
+	if r.schema != nil {
+		if err := validateQueryFilters(r.schema, queryFilters); err != nil {
+			return 0, err
+		}
+	}
+	parts := make([]string, 0, len(queryFilters))
+	for _, filter := range queryFilters {
+		parts = append(parts, renderQueryFilter(filter))
+	}
+	var options []DeleteOption
+	if r.payloads != nil {
+		options = append(options, withPayloadRelease(r.payloads))
+	}
+	return r.client.DeleteByQuery(ctx, r.index, strings.Join(parts, " "), options...)
+}
+
+// HealthCheck checks whether Redis is reachable and the index exists.
+func (r *RedisVectorHandler) HealthCheck(ctx context.Context) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	return r.client.HealthCheck(ctx, r.index)
+}
+
+// Close stops the sweeper of the payload store and the janitor of the
+// handler.
+func (r *RedisVectorHandler) Close() {
+	if r.payloads != nil {
+		r.payloads.close()
+	}
+	if r.janitor != nil {
+		r.janitor.close()
+	}
+}
+
+// EnsureSchema creates the index again if it is dropped by others.
+func (r *RedisVectorHandler) EnsureSchema(ctx context.Context) (err error) {
+	defer func() { err = withErrorKind(err) }()
+	if r.client.CheckIndexExists(ctx, r.index) {
+		return nil
+	}
+	if r.schema == nil {
+		return NewErrUnexpectedIndexSchema("unexpected index schema type", fmt.Errorf("index %s has no schema", r.index))
+	}
+	if err := r.createIndex(ctx, r.schema); err != nil {
+		return NewErrCreateRedisIndex("failed to create index", err)
+	}
+	return nil
+}
+
+// createIndex creates the index, it runs the creation again if it failed
+// because of cluster topology changes, since a failed creation is rolled back.
+func (r *RedisVectorHandler) createIndex(ctx context.Context, schema *IndexSchema) error {
+	for attempt := 1; ; attempt++ {
+		err := r.client.CreateIndexIfNotExists(ctx, r.index, schema)
+		if err == nil || !IsRetryableError(err) || attempt == maxClusterAttempts {
+			return err
+		}
+		logger.Warnf("failed to create index %s, retry: %v", r.index, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(clusterBackoff(attempt)):
+		}
+	}
+}
+
+// GetTTL returns the time to live of inserted documents, zero means
+// documents never expire.
+func (spec *RedisVectorDBSpec) GetTTL() time.Duration {
+	ttl, err := time.ParseDuration(spec.TTL)
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
 func ValidateSpec(spec *RedisVectorDBSpec) error {
 	if spec == nil {
 		return fmt.Errorf("redis vector spec is nil")
 	}
-	if spec.URL == "" {
-		return fmt.Errorf("redis vector url is empty")
+	if spec.Shards != nil {
+		if spec.URL != "" || len(spec.Addresses) != 0 || spec.Mode != "" || spec.TLS != nil || spec.Username != "" || spec.Password != "" {
+			return fmt.Errorf("redis vector url, addresses, mode, tls and credentials are exclusive with shards, set them in the URLs of shards")
+		}
+		if err := ValidateShardingSpec(spec.Shards); err != nil {
+			return fmt.Errorf("redis vector shards: %w", err)
+		}
+		// the drains, integrity checks, janitors and legacy documents are
+		// of a single instance or cluster.
+		if spec.Drain != nil || spec.Integrity != nil || spec.Janitor != nil || spec.LegacyFields {
+			return fmt.Errorf("redis vector drain, integrity, janitor and legacyFields are not supported with shards")
+		}
+	} else if err := validateConnection(spec); err != nil {
+		return err
+	}
+	if spec.Drain != nil {
+		if err := ValidateDrainSpec(spec.Drain); err != nil {
+			return fmt.Errorf("redis vector drain: %w", err)
+		}
+	}
+	if spec.TTL != "" {
+		ttl, err := time.ParseDuration(spec.TTL)
+		if err != nil {
+			return fmt.Errorf("redis vector ttl %s is invalid: %w", spec.TTL, err)
+		}
+		if ttl < 0 {
+			return fmt.Errorf("redis vector ttl %s is negative", spec.TTL)
+		}
+	}
+	if spec.IndexType != "" && !slices.Contains(validIndexTypes, IndexType(spec.IndexType)) {
+		return fmt.Errorf("redis vector index type %s is invalid", spec.IndexType)
+	}
+	if spec.VectorIndex != nil {
+		if err := ValidateVectorIndexSpec(spec.VectorIndex); err != nil {
+			return fmt.Errorf("redis vector vectorIndex: %w", err)
+		}
+	}
+	if err := validateOperationTimeouts(spec); err != nil {
+		return err
+	}
+	if err := validateKeyLayout(spec); err != nil {
+		return err
+	}
+	if err := validateDocumentIDs(spec); err != nil {
+		return err
+	}
+	if err := validateDialect(spec.Dialect); err != nil {
+		return fmt.Errorf("redis vector %w", err)
+	}
+	if spec.Retry != nil {
+		if err := ValidateRetrySpec(spec.Retry); err != nil {
+			return fmt.Errorf("redis vector retry: %w", err)
+		}
+	}
+	if spec.Integrity != nil {
+		if err := ValidateIntegritySpec(spec.Integrity); err != nil {
+			return fmt.Errorf("redis vector integrity: %w", err)
+		}
+		// the integrity check reads the vectors of hashes.
+		if IndexType(spec.IndexType) == IndexTypeJSON {
+			return fmt.Errorf("redis vector integrity is not supported with JSON index type")
+		}
+	}
+	if spec.Janitor != nil {
+		if err := ValidateJanitorSpec(spec.Janitor); err != nil {
+			return fmt.Errorf("redis vector janitor: %w", err)
+		}
+		// the janitor checks the fields of hashes.
+		if IndexType(spec.IndexType) == IndexTypeJSON {
+			return fmt.Errorf("redis vector janitor is not supported with JSON index type")
+		}
+		if spec.Janitor.GetPolicy() == JanitorPolicyExpire && spec.GetTTL() == 0 {
+			return fmt.Errorf("redis vector janitor policy %s requires ttl", JanitorPolicyExpire)
+		}
 	}
 	return nil
 }
 
-var _ vecdbtypes.VectorHandler = (*RedisVectorHandler)(nil)
+var (
+	_ vecdbtypes.VectorHandler        = (*RedisVectorHandler)(nil)
+	_ vecdbtypes.PayloadStatsReporter = (*RedisVectorHandler)(nil)
+	_ vecdbtypes.SchemaEnsurer        = (*RedisVectorHandler)(nil)
+	_ vecdbtypes.DocumentDeleter      = (*RedisVectorHandler)(nil)
+	_ vecdbtypes.FilterDeleter        = (*RedisVectorHandler)(nil)
+	_ vecdbtypes.HandlerCloser        = (*RedisVectorHandler)(nil)
+	_ vecdbtypes.FieldCounter         = (*RedisVectorDB)(nil)
+	_ vecdbtypes.DocumentCounter      = (*RedisVectorDB)(nil)
+	_ vecdbtypes.CollectionDropper    = (*RedisVectorDB)(nil)
+	_ vecdbtypes.DrainResumer         = (*RedisVectorDB)(nil)
+)
 
-func (r *RedisVectorHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+func (r *RedisVectorHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) (_ []map[string]any, err error) {
+	defer func() { err = withErrorKind(err) }()
 	opts := getHandlerSearchOptions(options...)
-	if opts.SelectedFields == nil {
+	if opts.SelectedFields == nil && r.schema != nil {
 		fields := r.schema.GetDefaultSelectedFields()
 		opts.SelectedFields = fields
 	}
+	scoreThreshold := opts.ScoreThreshold
+	if opts.Explain {
+		opts.ScoreThreshold = 0
+	}
 	searchOpts, err := toRedisQueryOptions(*opts)
 	if err != nil {
 		return nil, err
 	}
 
+	if r.client.getIndexType() == IndexTypeJSON {
+		searchOpts = append(searchOpts, WithJSON())
+	}
+	searchOpts = append(searchOpts, WithDistanceMetric(r.schema.distanceMetric(opts.RedisVectorFilterKey)),
+		WithVectorType(r.schema.vectorType(opts.RedisVectorFilterKey)), WithDialect(r.client.dialect))
 	query := NewRedisVectorQuery(r.index, opts.RedisFilters, opts.RedisVectorFilterKey, opts.RedisVectorFilterValues, searchOpts...)
+	if err := query.Validate(r.schema); err != nil {
+		return nil, err
+	}
 	_, docs, err := r.client.Find(ctx, query)
-	return docs, err
+	if err != nil {
+		return nil, err
+	}
+
+	if r.payloads != nil {
+		fields := r.payloads.spec.Fields
+		contents, err := r.payloads.resolve(ctx, vecdbtypes.PayloadReferences(docs, fields))
+		if err != nil {
+			return nil, NewErrPayloadStore("failed to resolve payloads", err)
+		}
+		if err := vecdbtypes.ResolvePayloads(docs, fields, contents); err != nil {
+			return nil, NewErrPayloadStore("failed to resolve payloads", err)
+		}
+	}
+
+	if opts.Explain {
+		for _, doc := range docs {
+			distance, err := vecdbtypes.ToFloat64(doc["distance"])
+			if err != nil {
+				return nil, fmt.Errorf("failed to get distance of document %v: %w", doc["id"], err)
+			}
+			score, err := vecdbtypes.ToFloat64(doc["score"])
+			if err != nil {
+				return nil, fmt.Errorf("failed to get score of document %v: %w", doc["id"], err)
+			}
+			delete(doc, "distance")
+			delete(doc, "score")
+			vecdbtypes.ExplainDocument(doc, distance, score, scoreThreshold)
+		}
+	}
+	return docs, nil
 }
 
-func (r *RedisVectorHandler) InsertDocuments(ctx context.Context, doc []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+func (r *RedisVectorHandler) InsertDocuments(ctx context.Context, doc []map[string]any, options ...vecdbtypes.HandlerInsertOption) (_ []string, err error) {
+	defer func() { err = withErrorKind(err) }()
 	if doc == nil {
 		doc = []map[string]any{}
 	}
 
+	doc, err = vecdbtypes.ValidateDocumentVectors(doc, r.validation)
+	if err != nil {
+		return nil, err
+	}
+
 	opts := getHandlerInsertOptions(options...)
 
-	docIDs, err := r.client.InsertManyWithHash(ctx, opts.RedisPrefix, doc)
+	var hashes []string
+	if r.payloads != nil {
+		var contents []string
+		doc, hashes, contents = vecdbtypes.ExtractPayloads(doc, r.payloads.spec.Fields)
+		if err := r.payloads.put(ctx, hashes, contents); err != nil {
+			return nil, NewErrPayloadStore("failed to store payloads", err)
+		}
+	}
+
+	var results []*InsertResult
+	insertOpts := []InsertOption{WithInsertTTL(opts.TTL), WithWriteMode(WriteMode(opts.RedisWriteMode))}
+	if r.client.getIndexType() == IndexTypeJSON {
+		results, err = r.client.InsertManyWithJSON(ctx, opts.RedisPrefix, doc, insertOpts...)
+	} else {
+		results, err = r.client.InsertManyWithHash(ctx, opts.RedisPrefix, doc, insertOpts...)
+	}
 	if err != nil {
+		if r.payloads != nil {
+			if releaseErr := r.payloads.release(ctx, hashes); releaseErr != nil {
+				err = errors.Join(err, releaseErr)
+			}
+		}
 		return nil, NewErrInsertDocument("failed to insert document", err)
 	}
+	docIDs := make([]string, 0, len(results))
+	for _, result := range results {
+		docIDs = append(docIDs, result.ID)
+	}
 	return docIDs, nil
 }
 
+// PayloadStats returns the statistics of the payload store.
+func (r *RedisVectorHandler) PayloadStats(ctx context.Context) (_ *vecdbtypes.PayloadStats, err error) {
+	defer func() { err = withErrorKind(err) }()
+	if r.payloads == nil {
+		return nil, NewErrPayloadStore("failed to get payload stats", fmt.Errorf("payload store of index %s is not enabled", r.index))
+	}
+	stats, err := r.payloads.stats(ctx)
+	if err != nil {
+		return nil, NewErrPayloadStore("failed to get payload stats", err)
+	}
+	return stats, nil
+}
+
 func getHandlerInsertOptions(options ...vecdbtypes.HandlerInsertOption) *vecdbtypes.HandlerInsertOptions {
 	opts := &vecdbtypes.HandlerInsertOptions{}
 	for _, opt := range options {
@@ -184,7 +670,30 @@ func toRedisQueryOptions(options vecdbtypes.HandlerSearchOptions) ([]Option, err
 	}
 
 	if options.SelectedFields != nil {
-		opts = append(opts, WithReturns(options.SelectedFields))
+		opts = append(opts, WithReturnFields(options.SelectedFields))
+	}
+
+	if len(options.RedisQueryFilters) > 0 {
+		opts = append(opts, WithFilters(options.RedisQueryFilters...))
+	}
+
+	if len(options.TagFilters) > 0 {
+		opts = append(opts, WithFilters(toRedisQueryFilters(options.TagFilters)...))
+	}
+
+	if len(options.MandatoryTagFilters) > 0 {
+		if err := vecdbtypes.ValidateTagFilters(options.MandatoryTagFilters); err != nil {
+			return nil, vecdbtypes.NewError(vecdbtypes.ErrInvalidFilter, err)
+		}
+		opts = append(opts, WithFilters(toRedisQueryFilters(options.MandatoryTagFilters)...))
+	}
+
+	if options.RedisKNN != 0 {
+		opts = append(opts, WithKNN(options.RedisKNN))
+	}
+
+	if options.RedisEFRuntime != 0 {
+		opts = append(opts, WithEFRuntime(options.RedisEFRuntime))
 	}
 
 	return opts, nil
@@ -0,0 +1,358 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	defaultRescoringVectorField      = "embedding"
+	defaultRescoringCandidatesFactor = 4
+	// rescoringCostLimit bounds the runtime cost of the expression of a
+	// candidate.
+	rescoringCostLimit = 10000
+)
+
+type (
+	RescoringSpec = vecdbtypes.RescoringSpec
+
+	// RescoredHandler re-scores the candidates of the similarity searches
+	// of a handler. It searches more nearest neighbors than requested
+	// regardless of the score threshold, re-scores them by the function of
+	// the spec, and returns the page of the requested offset and limit of
+	// the candidates passing the threshold, ordered by their new scores.
+	RescoredHandler struct {
+		wrappedHandler
+		spec        *RescoringSpec
+		vectorField string
+		program     cel.Program
+	}
+
+	// rescoredDocument is a candidate with its new score.
+	rescoredDocument struct {
+		doc   map[string]any
+		score float64
+	}
+)
+
+var (
+	rescoringMetricsOnce sync.Once
+	rescoringSeconds     *prometheus.HistogramVec
+	rescoringFailures    *prometheus.CounterVec
+)
+
+func initRescoringMetrics() {
+	rescoringMetricsOnce.Do(func() {
+		rescoringSeconds = metricshub.VectorDBRescoringSeconds.NewHistogram()
+		rescoringFailures = metricshub.VectorDBRescoringFailures.NewCounter()
+	})
+}
+
+// newRescoringEnv returns the environment of the rescoring expressions,
+// the variables are:
+//
+//   - score: the similarity score calibrated by the backend.
+//   - doc: the fields of the document, except the vector field.
+func newRescoringEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("score", cel.DoubleType),
+		cel.Variable("doc", cel.MapType(cel.StringType, cel.DynType)),
+	)
+}
+
+// compileRescoringExpression compiles the expression, which must return a
+// number.
+func compileRescoringExpression(expression string) (cel.Program, error) {
+	env, err := newRescoringEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	outputType := ast.OutputType()
+	if !outputType.IsExactType(cel.DoubleType) && !outputType.IsExactType(cel.IntType) && !outputType.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("expression returns %s, not a number", outputType)
+	}
+	return env.Program(ast, cel.CostLimit(rescoringCostLimit))
+}
+
+func validateRescoringSpec(spec *RescoringSpec) error {
+	if spec == nil {
+		return nil
+	}
+	switch spec.Function {
+	case vecdbtypes.RescoringCosine, vecdbtypes.RescoringDotProduct, vecdbtypes.RescoringEuclidean:
+		if spec.Expression != "" {
+			return fmt.Errorf("expression of rescoring is only used by the %s function", vecdbtypes.RescoringExpression)
+		}
+	case vecdbtypes.RescoringExpression:
+		if spec.Expression == "" {
+			return fmt.Errorf("expression of rescoring is required by the %s function", vecdbtypes.RescoringExpression)
+		}
+		if _, err := compileRescoringExpression(spec.Expression); err != nil {
+			return fmt.Errorf("invalid expression of rescoring: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid function %s of rescoring", spec.Function)
+	}
+	if spec.Candidates < 0 || spec.Candidates > redisvector.MaxQueryResults {
+		return fmt.Errorf("candidates of rescoring must be between 0 and %d", redisvector.MaxQueryResults)
+	}
+	return nil
+}
+
+// NewRescoredHandler returns the handler re-scoring the candidates of its
+// similarity searches by the rescoring of the spec, the handler is
+// returned as is if the spec has no rescoring.
+func NewRescoredHandler(spec *Spec, handler VectorHandler) VectorHandler {
+	if spec.Rescoring == nil {
+		return handler
+	}
+	initRescoringMetrics()
+	h := &RescoredHandler{
+		wrappedHandler: wrappedHandler{handler},
+		spec:           spec.Rescoring,
+		vectorField:    spec.Rescoring.VectorField,
+	}
+	if h.vectorField == "" {
+		h.vectorField = defaultRescoringVectorField
+	}
+	if spec.Rescoring.Function == vecdbtypes.RescoringExpression {
+		program, err := compileRescoringExpression(spec.Rescoring.Expression)
+		if err != nil {
+			// should not reach here, the spec is validated.
+			logger.Errorf("rescoring of %s is disabled, invalid expression: %v", spec.CollectionName, err)
+			return handler
+		}
+		h.program = program
+	}
+	return h
+}
+
+// needsVectors returns whether the function reads the vectors.
+func (h *RescoredHandler) needsVectors() bool {
+	return h.spec.Function != vecdbtypes.RescoringExpression
+}
+
+// SimilaritySearch searches the candidates and re-scores them, the
+// candidates failed to re-score are dropped. The results are explained by
+// the new scores if the search is explained.
+func (h *RescoredHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	opts := &vecdbtypes.HandlerSearchOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	offset, limit := max(opts.Offset, 0), max(opts.Limit, 1)
+	candidates := h.spec.Candidates
+	if candidates == 0 {
+		candidates = min(defaultRescoringCandidatesFactor*(offset+limit), redisvector.MaxQueryResults)
+	}
+	candidates = max(candidates, offset+limit)
+
+	// the explained search returns the candidates below the threshold too,
+	// and the vectors are only requested if they are read.
+	searchOptions := append(slices.Clone(options), vecdbtypes.WithOffset(0), vecdbtypes.WithLimit(candidates), vecdbtypes.WithExplain())
+	stripVectors := false
+	if h.needsVectors() && len(opts.SelectedFields) > 0 && !slices.Contains(opts.SelectedFields, h.vectorField) {
+		fields := append(slices.Clone(opts.SelectedFields), h.vectorField)
+		searchOptions = append(searchOptions, vecdbtypes.WithSelectedFields(fields))
+		stripVectors = true
+	}
+	docs, err := h.VectorHandler.SimilaritySearch(ctx, searchOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	query := opts.RedisVectorFilterValues
+	if len(query) == 0 {
+		query = opts.PostgresVectorFilterValues
+	}
+	rescored := make([]*rescoredDocument, 0, len(docs))
+	for _, doc := range docs {
+		score, err := h.rescore(doc, query)
+		if err != nil {
+			rescoringFailures.WithLabelValues(h.spec.Function).Inc()
+			logger.Debugf("failed to re-score document %v: %v", doc["id"], err)
+			continue
+		}
+		if stripVectors {
+			delete(doc, h.vectorField)
+		}
+		if opts.Explain {
+			// the distance of the backend is kept as is.
+			distance, _ := vecdbtypes.ToFloat64(doc[vecdbtypes.ExplainDistanceField])
+			vecdbtypes.ExplainDocument(doc, distance, score, opts.ScoreThreshold)
+		} else {
+			if score < float64(opts.ScoreThreshold) {
+				continue
+			}
+			delete(doc, vecdbtypes.ExplainDistanceField)
+			delete(doc, vecdbtypes.ExplainScoreField)
+			delete(doc, vecdbtypes.ExplainPassedField)
+		}
+		rescored = append(rescored, &rescoredDocument{doc: doc, score: score})
+	}
+	slices.SortStableFunc(rescored, func(a, b *rescoredDocument) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		}
+		return 0
+	})
+	rescoringSeconds.WithLabelValues(h.spec.Function).Observe(time.Since(start).Seconds())
+
+	results := make([]map[string]any, 0, limit)
+	for i := offset; i < len(rescored) && i < offset+limit; i++ {
+		results = append(results, rescored[i].doc)
+	}
+	return results, nil
+}
+
+// rescore returns the new score of the explained candidate.
+func (h *RescoredHandler) rescore(doc map[string]any, query []float32) (float64, error) {
+	if h.program != nil {
+		return h.evaluate(doc)
+	}
+	vector, err := decodeVector(doc[h.vectorField], len(query))
+	if err != nil {
+		return 0, fmt.Errorf("invalid vector field %s: %w", h.vectorField, err)
+	}
+	if len(vector) != len(query) {
+		return 0, fmt.Errorf("dimension %d of vector differs from %d of query", len(vector), len(query))
+	}
+	var dot, docNorm, queryNorm, squared float64
+	for i := range vector {
+		a, b := float64(vector[i]), float64(query[i])
+		dot += a * b
+		docNorm += a * a
+		queryNorm += b * b
+		squared += (a - b) * (a - b)
+	}
+	switch h.spec.Function {
+	case vecdbtypes.RescoringDotProduct:
+		return dot, nil
+	case vecdbtypes.RescoringEuclidean:
+		return 1 / (1 + math.Sqrt(squared)), nil
+	default:
+		if docNorm == 0 || queryNorm == 0 {
+			return 0, fmt.Errorf("cosine of zero vector")
+		}
+		return dot / math.Sqrt(docNorm*queryNorm), nil
+	}
+}
+
+// evaluate evaluates the expression against the score of the backend and
+// the fields of the candidate.
+func (h *RescoredHandler) evaluate(doc map[string]any) (float64, error) {
+	score, err := vecdbtypes.ToFloat64(doc[vecdbtypes.ExplainScoreField])
+	if err != nil {
+		return 0, fmt.Errorf("invalid score: %w", err)
+	}
+	fields := make(map[string]any, len(doc))
+	for k, v := range doc {
+		switch k {
+		case h.vectorField, vecdbtypes.ExplainDistanceField, vecdbtypes.ExplainScoreField, vecdbtypes.ExplainPassedField:
+		default:
+			fields[k] = v
+		}
+	}
+	out, _, err := h.program.Eval(map[string]any{"score": score, "doc": fields})
+	if err != nil {
+		return 0, err
+	}
+	switch v := out.Value().(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	default:
+		return 0, fmt.Errorf("expression returns %T, not a number", v)
+	}
+}
+
+// decodeVector decodes the vector of a search result, which is a slice of
+// numbers, or the little endian bytes of FLOAT32 or FLOAT64 components of
+// a Redis hash, told apart by the dimension of the query.
+func decodeVector(value any, dim int) ([]float32, error) {
+	switch v := value.(type) {
+	case []float32:
+		return v, nil
+	case []float64:
+		vector := make([]float32, len(v))
+		for i, x := range v {
+			vector[i] = float32(x)
+		}
+		return vector, nil
+	case []any:
+		vector := make([]float32, len(v))
+		for i, x := range v {
+			f, err := vecdbtypes.ToFloat64(x)
+			if err != nil {
+				return nil, err
+			}
+			vector[i] = float32(f)
+		}
+		return vector, nil
+	case string:
+		switch len(v) {
+		case 4 * dim:
+			vector := make([]float32, dim)
+			for i := range vector {
+				vector[i] = math.Float32frombits(binary.LittleEndian.Uint32([]byte(v[i*4 : i*4+4])))
+			}
+			return vector, nil
+		case 8 * dim:
+			vector := make([]float32, dim)
+			for i := range vector {
+				vector[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64([]byte(v[i*8 : i*8+8]))))
+			}
+			return vector, nil
+		case 2 * dim:
+			vector := make([]float32, dim)
+			for i := range vector {
+				vector[i] = redisvector.Float16ToFloat32(binary.LittleEndian.Uint16([]byte(v[i*2 : i*2+2])))
+			}
+			return vector, nil
+		}
+		return nil, fmt.Errorf("%d bytes of vector mismatch dimension %d", len(v), dim)
+	case nil:
+		return nil, fmt.Errorf("vector not found")
+	default:
+		return nil, fmt.Errorf("unexpected vector type %T", value)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// candidateHandler returns its candidates to the similarity searches, and
+// records the options of the last search.
+type candidateHandler struct {
+	countingHandler
+	candidates []map[string]any
+	options    *vecdbtypes.HandlerSearchOptions
+}
+
+func (h *candidateHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	h.options = &vecdbtypes.HandlerSearchOptions{}
+	for _, opt := range options {
+		opt(h.options)
+	}
+	docs := make([]map[string]any, 0, len(h.candidates))
+	for _, c := range h.candidates {
+		doc := make(map[string]any, len(c))
+		for k, v := range c {
+			doc[k] = v
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+func rescoringTestSpec(rescoring *RescoringSpec) *Spec {
+	spec := &Spec{}
+	spec.Type = TypeRedis
+	spec.Rescoring = rescoring
+	return spec
+}
+
+func docIDs(docs []map[string]any) []any {
+	ids := make([]any, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc["id"])
+	}
+	return ids
+}
+
+func TestValidateRescoringSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateRescoringSpec(nil))
+	assert.NoError(validateRescoringSpec(&RescoringSpec{Function: vecdbtypes.RescoringCosine}))
+	assert.NoError(validateRescoringSpec(&RescoringSpec{Function: vecdbtypes.RescoringExpression, Expression: `score + (doc.tier == "gold" ? 0.1 : 0.0)`}))
+	assert.NoError(validateRescoringSpec(&RescoringSpec{Function: vecdbtypes.RescoringExpression, Expression: `1`}))
+
+	assert.Error(validateRescoringSpec(&RescoringSpec{Function: "manhattan"}))
+	assert.Error(validateRescoringSpec(&RescoringSpec{Function: vecdbtypes.RescoringCosine, Expression: "score"}))
+	assert.Error(validateRescoringSpec(&RescoringSpec{Function: vecdbtypes.RescoringExpression}))
+	assert.Error(validateRescoringSpec(&RescoringSpec{Function: vecdbtypes.RescoringExpression, Expression: "score +"}))
+	assert.Error(validateRescoringSpec(&RescoringSpec{Function: vecdbtypes.RescoringExpression, Expression: `"high"`}))
+	assert.Error(validateRescoringSpec(&RescoringSpec{Function: vecdbtypes.RescoringDotProduct, Candidates: -1}))
+}
+
+func TestDecodeVector(t *testing.T) {
+	assert := assert.New(t)
+
+	want := []float32{1, -2.5}
+	v, err := decodeVector([]float64{1, -2.5}, 2)
+	assert.NoError(err)
+	assert.Equal(want, v)
+	v, err = decodeVector([]any{1, "-2.5"}, 2)
+	assert.NoError(err)
+	assert.Equal(want, v)
+
+	buf32 := make([]byte, 8)
+	buf64 := make([]byte, 16)
+	for i, x := range want {
+		binary.LittleEndian.PutUint32(buf32[i*4:], math.Float32bits(x))
+		binary.LittleEndian.PutUint64(buf64[i*8:], math.Float64bits(float64(x)))
+	}
+	v, err = decodeVector(string(buf32), 2)
+	assert.NoError(err)
+	assert.Equal(want, v)
+	v, err = decodeVector(string(buf64), 2)
+	assert.NoError(err)
+	assert.Equal(want, v)
+	// the vectors of FLOAT16 fields.
+	v, err = decodeVector(string([]byte{0x00, 0x3c, 0x00, 0xc1}), 2)
+	assert.NoError(err)
+	assert.Equal(want, v)
+
+	_, err = decodeVector(string(buf32), 3)
+	assert.Error(err)
+	_, err = decodeVector(nil, 2)
+	assert.Error(err)
+	_, err = decodeVector(42, 2)
+	assert.Error(err)
+}
+
+func TestRescoredHandlerPassthrough(t *testing.T) {
+	handler := &candidateHandler{}
+	assert.Same(t, handler, NewRescoredHandler(rescoringTestSpec(nil), handler))
+}
+
+func TestRescoredHandlerFunctions(t *testing.T) {
+	assert := assert.New(t)
+
+	query := []float32{1, 0}
+	candidates := []map[string]any{
+		// the backend ranks a before b before c.
+		{"id": "a", "embedding": []float32{1, 1}, vecdbtypes.ExplainScoreField: 0.9},
+		{"id": "b", "embedding": []float32{3, 0}, vecdbtypes.ExplainScoreField: 0.8},
+		{"id": "c", "embedding": []float32{0.5, 0}, vecdbtypes.ExplainScoreField: 0.7},
+		{"id": "broken", "embedding": []float32{1}, vecdbtypes.ExplainScoreField: 0.6},
+	}
+	cases := []struct {
+		function string
+		ids      []any
+	}{
+		{vecdbtypes.RescoringCosine, []any{"b", "c", "a"}},
+		{vecdbtypes.RescoringDotProduct, []any{"b", "a", "c"}},
+		{vecdbtypes.RescoringEuclidean, []any{"c", "a", "b"}},
+	}
+	for _, c := range cases {
+		inner := &candidateHandler{candidates: candidates}
+		handler := NewRescoredHandler(rescoringTestSpec(&RescoringSpec{Function: c.function}), inner)
+		docs, err := handler.SimilaritySearch(context.Background(),
+			vecdbtypes.WithRedisVectorFilterValues(query), vecdbtypes.WithLimit(5))
+		assert.NoError(err, c.function)
+		assert.Equal(c.ids, docIDs(docs), c.function)
+		for _, doc := range docs {
+			assert.NotContains(doc, vecdbtypes.ExplainScoreField)
+		}
+
+		// the candidates are searched from the first one with explaining.
+		assert.True(inner.options.Explain)
+		assert.Equal(0, inner.options.Offset)
+		assert.Equal(20, inner.options.Limit)
+	}
+}
+
+func TestRescoredHandlerExpression(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &candidateHandler{candidates: []map[string]any{
+		{"id": "a", "tier": "free", "embedding": "ignored", vecdbtypes.ExplainScoreField: 0.9},
+		{"id": "b", "tier": "gold", "embedding": "ignored", vecdbtypes.ExplainScoreField: 0.85},
+		{"id": "c", "tier": "free", "embedding": "ignored", vecdbtypes.ExplainScoreField: 0.5},
+	}}
+	spec := rescoringTestSpec(&RescoringSpec{
+		Function:   vecdbtypes.RescoringExpression,
+		Expression: `score + (doc.tier == "gold" ? 0.1 : 0.0)`,
+		Candidates: 10,
+	})
+	handler := NewRescoredHandler(spec, inner)
+
+	// the vectors are not requested for expressions.
+	docs, err := handler.SimilaritySearch(context.Background(),
+		vecdbtypes.WithSelectedFields([]string{"id", "tier"}), vecdbtypes.WithScoreThreshold(0.6))
+	assert.NoError(err)
+	assert.Equal([]string{"id", "tier"}, inner.options.SelectedFields)
+	assert.Equal(10, inner.options.Limit)
+	assert.Equal([]any{"b"}, docIDs(docs))
+
+	docs, err = handler.SimilaritySearch(context.Background(),
+		vecdbtypes.WithLimit(5), vecdbtypes.WithScoreThreshold(0.6))
+	assert.NoError(err)
+	assert.Equal([]any{"b", "a"}, docIDs(docs))
+
+	// the explained search returns the candidates below the threshold
+	// with their new scores.
+	docs, err = handler.SimilaritySearch(context.Background(),
+		vecdbtypes.WithLimit(5), vecdbtypes.WithScoreThreshold(0.6), vecdbtypes.WithExplain())
+	assert.NoError(err)
+	assert.Equal([]any{"b", "a", "c"}, docIDs(docs))
+	assert.InDelta(0.95, docs[0][vecdbtypes.ExplainScoreField], 1e-9)
+	assert.Equal(false, docs[2][vecdbtypes.ExplainPassedField])
+}
+
+func TestRescoredHandlerPaging(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &candidateHandler{}
+	for i, x := range []float32{1, 2, 3, 4, 5} {
+		inner.candidates = append(inner.candidates, map[string]any{
+			"id":                         i,
+			"embedding":                  []float32{x},
+			vecdbtypes.ExplainScoreField: 1.0,
+		})
+	}
+	handler := NewRescoredHandler(rescoringTestSpec(&RescoringSpec{Function: vecdbtypes.RescoringDotProduct}), inner)
+	docs, err := handler.SimilaritySearch(context.Background(),
+		vecdbtypes.WithRedisVectorFilterValues([]float32{1}), vecdbtypes.WithSelectedFields([]string{"id"}),
+		vecdbtypes.WithOffset(1), vecdbtypes.WithLimit(2))
+	assert.NoError(err)
+	assert.Equal(12, inner.options.Limit)
+	assert.Equal([]string{"id", "embedding"}, inner.options.SelectedFields)
+	assert.Equal([]any{3, 2}, docIDs(docs))
+
+	// the vectors are stripped if they are not selected.
+	for _, doc := range docs {
+		assert.NotContains(doc, "embedding")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package vecdbmetrics records the operations of the vector database
+// clients, the clients of all backends share the metrics, told apart by
+// the backend label.
+package vecdbmetrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The backends of the clients.
+const (
+	BackendRedis    = "redis"
+	BackendPostgres = "postgres"
+)
+
+// Operation is the type of an operation of a client.
+type Operation int
+
+// The types of the operations.
+const (
+	OperationFind Operation = iota
+	OperationInsert
+	OperationDelete
+	OperationAdmin
+	operationCount
+)
+
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeNotFound
+	outcomeTimeout
+	outcomeUnavailable
+	outcomeError
+	outcomeCount
+)
+
+var (
+	operationNames = [operationCount]string{"find", "insert", "delete", "admin"}
+	outcomeNames   = [outcomeCount]string{"success", "notFound", "timeout", "unavailable", "error"}
+
+	metricsOnce sync.Once
+	operations  *prometheus.CounterVec
+	durations   *prometheus.HistogramVec
+	batchSizes  *prometheus.HistogramVec
+	results     *prometheus.HistogramVec
+)
+
+// Metrics records the operations of a client. The children of the
+// metrics are resolved when it is created, so recording an operation
+// allocates nothing. A nil Metrics records nothing.
+type Metrics struct {
+	classify   func(error) error
+	operations [operationCount][outcomeCount]prometheus.Counter
+	durations  [operationCount]prometheus.Observer
+	batchSizes [operationCount]prometheus.Observer
+	results    prometheus.Observer
+}
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		operations = metricshub.VectorDBOperations.NewCounter()
+		durations = metricshub.VectorDBOperationSeconds.NewHistogram()
+		batchSizes = metricshub.VectorDBBatchSize.NewHistogram()
+		results = metricshub.VectorDBResults.NewHistogram()
+	})
+}
+
+// New returns the metrics of a client of the backend, classify turns the
+// errors of the client into the error kinds of vecdbtypes, which are the
+// outcomes of the operations.
+func New(backend string, classify func(error) error) *Metrics {
+	initMetrics()
+	m := &Metrics{classify: classify, results: results.WithLabelValues(backend)}
+	for op, name := range operationNames {
+		for oc, outcome := range outcomeNames {
+			m.operations[op][oc] = operations.WithLabelValues(backend, name, outcome)
+		}
+		m.durations[op] = durations.WithLabelValues(backend, name)
+		m.batchSizes[op] = batchSizes.WithLabelValues(backend, name)
+	}
+	return m
+}
+
+// Observe records an operation started at start, it is deferred by the
+// operation with its error, like:
+//
+//	defer c.metrics.Observe(vecdbmetrics.OperationFind, time.Now(), &err)
+func (m *Metrics) Observe(op Operation, start time.Time, err *error) {
+	if m == nil {
+		return
+	}
+	m.durations[op].Observe(time.Since(start).Seconds())
+	m.operations[op][m.outcome(*err)].Inc()
+}
+
+// ObserveBatch records the number of documents of a write or deletion.
+func (m *Metrics) ObserveBatch(op Operation, size int) {
+	if m == nil {
+		return
+	}
+	m.batchSizes[op].Observe(float64(size))
+}
+
+// ObserveResults records the number of documents returned by a search.
+func (m *Metrics) ObserveResults(n int) {
+	if m == nil {
+		return
+	}
+	m.results.Observe(float64(n))
+}
+
+func (m *Metrics) outcome(err error) outcome {
+	if err == nil {
+		return outcomeSuccess
+	}
+	if m.classify != nil {
+		err = m.classify(err)
+	}
+	switch {
+	case errors.Is(err, vecdbtypes.ErrNotFound):
+		return outcomeNotFound
+	case errors.Is(err, vecdbtypes.ErrTimeout):
+		return outcomeTimeout
+	case errors.Is(err, vecdbtypes.ErrUnavailable):
+		return outcomeUnavailable
+	}
+	return outcomeError
+}
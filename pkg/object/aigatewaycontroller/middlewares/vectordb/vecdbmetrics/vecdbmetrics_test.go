@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	os.Exit(m.Run())
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	errSlow := errors.New("slow")
+	m := New("test", func(err error) error {
+		if errors.Is(err, errSlow) {
+			return vecdbtypes.NewError(vecdbtypes.ErrTimeout, err)
+		}
+		return err
+	})
+	count := func(op, outcome string) float64 {
+		return testutil.ToFloat64(operations.WithLabelValues("test", op, outcome))
+	}
+
+	for _, err := range []error{
+		nil,
+		nil,
+		fmt.Errorf("find: %w", errSlow),
+		vecdbtypes.NewError(vecdbtypes.ErrNotFound, errors.New("no index")),
+		vecdbtypes.NewError(vecdbtypes.ErrUnavailable, errors.New("loading")),
+		context.Canceled,
+	} {
+		m.Observe(OperationFind, time.Now(), &err)
+	}
+	assert.Equal(2.0, count("find", "success"))
+	assert.Equal(1.0, count("find", "timeout"))
+	assert.Equal(1.0, count("find", "notFound"))
+	assert.Equal(1.0, count("find", "unavailable"))
+	assert.Equal(1.0, count("find", "error"))
+	assert.Zero(count("insert", "success"))
+	// the series of all operations are created with the metrics.
+	assert.Equal(4, testutil.CollectAndCount(durations, "ai_gateway_vectordb_operation_seconds"))
+
+	// a nil Metrics records nothing.
+	var nilMetrics *Metrics
+	var err error
+	nilMetrics.Observe(OperationInsert, time.Now(), &err)
+	nilMetrics.ObserveBatch(OperationInsert, 10)
+	nilMetrics.ObserveResults(10)
+}
+
+func TestMetricsAllocations(t *testing.T) {
+	m := New("test", nil)
+	var err error
+	allocs := testing.AllocsPerRun(100, func() {
+		m.ObserveBatch(OperationInsert, 10)
+		m.Observe(OperationInsert, time.Now(), &err)
+		m.ObserveResults(3)
+	})
+	assert.Zero(t, allocs)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// The kinds of the errors of vector databases, the backends classify their
+// native errors by them, so middlewares decide whether to degrade, retry
+// or fail by errors.Is instead of the messages of the backends.
+var (
+	// ErrNotFound means the collection or the result does not exist.
+	ErrNotFound = errors.New("vector database: not found")
+	// ErrTimeout means the operation timed out, it may be applied.
+	ErrTimeout = errors.New("vector database: timeout")
+	// ErrUnavailable means the backend can not serve the operation now,
+	// like connection failures, failovers and overload.
+	ErrUnavailable = errors.New("vector database: unavailable")
+	// ErrDimensionMismatch means the dimension of a vector differs from
+	// the one of the collection.
+	ErrDimensionMismatch = errors.New("vector database: dimension mismatch")
+	// ErrQuotaExceeded means the backend is out of memory, storage or
+	// connections.
+	ErrQuotaExceeded = errors.New("vector database: quota exceeded")
+	// ErrInvalidFilter means the query or its filters are rejected by the
+	// backend.
+	ErrInvalidFilter = errors.New("vector database: invalid filter")
+	// ErrInvalidPage means the offset, the limit or the k of a query is
+	// out of the bounds of the backend.
+	ErrInvalidPage = errors.New("vector database: invalid page")
+	// ErrDocumentExists means a document is not inserted since its ID
+	// exists, in the write modes which never overwrite.
+	ErrDocumentExists = errors.New("vector database: document exists")
+)
+
+// Error is an error of a vector database with its kind. It wraps both the
+// kind and the error of the backend, so errors.Is works with the kind and
+// errors.As works with the error types of the backend.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// NewError creates an Error of the kind wrapping err, err is returned as
+// is if it is nil or already has a kind.
+func NewError(kind, err error) error {
+	if err == nil || kind == nil {
+		return err
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// ErrorKind returns the kind of err, or nil if it has no kind.
+func ErrorKind(err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return nil
+}
+
+// CommonErrorKind returns the kind of the errors common to all backends,
+// like timeouts of contexts and network failures, or nil if err is not
+// one of them.
+func CommonErrorKind(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		return ErrUnavailable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return ErrUnavailable
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// The fields added to the results of an explained search.
+const (
+	// ExplainDistanceField is the raw distance between the query vector and the document.
+	ExplainDistanceField = "_distance"
+	// ExplainScoreField is the similarity score between 0 and 1 normalized
+	// from the distance by its metric, it is compared with the score
+	// threshold.
+	ExplainScoreField = "_score"
+	// ExplainPassedField tells whether the document passes the score threshold.
+	ExplainPassedField = "_passed"
+	// ExplainFilterExpansionsField is the expansions of the tag filters by
+	// the filter aliases, it is only added if any filter is expanded.
+	ExplainFilterExpansionsField = "_filter_expansions"
+)
+
+// WithExplain returns a HandlerSearchOption for explaining the search. An
+// explained search ignores the score threshold, so the documents below the
+// threshold are returned too, and each document is annotated with the
+// ExplainDistanceField, ExplainScoreField and ExplainPassedField.
+func WithExplain() HandlerSearchOption {
+	return func(opts *HandlerSearchOptions) {
+		opts.Explain = true
+	}
+}
+
+// ExplainDocument annotates a document of an explained search with its
+// distance, score, and whether it passes the score threshold.
+func ExplainDocument(doc map[string]any, distance, score float64, scoreThreshold float32) {
+	doc[ExplainDistanceField] = distance
+	doc[ExplainScoreField] = score
+	doc[ExplainPassedField] = score >= float64(scoreThreshold)
+}
+
+// ToFloat64 converts a numeric value returned by vector databases to float64.
+func ToFloat64(value any) (float64, error) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("unexpected numeric type %T", value)
+	}
+}
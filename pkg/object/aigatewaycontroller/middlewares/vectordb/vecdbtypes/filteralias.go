@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"fmt"
+	"slices"
+)
+
+// DefaultMaxFilterExpansion is the default maximum number of tags a tag
+// filter is expanded to by the filter aliases.
+const DefaultMaxFilterExpansion = 32
+
+type (
+	// TagFilter matches the documents whose tag field has any of the tags,
+	// it is rendered as the TAG clause of Redis or the IN list of SQL.
+	TagFilter struct {
+		Field string
+		Tags  []string
+		// Negate matches the documents not matching the filter, including
+		// the ones without the field.
+		Negate bool
+		// Array means the field has multiple tags, the documents match if
+		// any of their tags is in the filter. It is a text[] column of
+		// PostgreSQL, the tag fields of Redis are always like this.
+		Array bool
+	}
+
+	// FilterAliasSpec defines the tags of fields which mean the same, like
+	// the spellings of a model family, the tag filters of queries and
+	// deletions on a field match the aliases of their tags too.
+	FilterAliasSpec struct {
+		// Aliases are the groups of equivalent tags of each field.
+		Aliases map[string][][]string `json:"aliases" jsonschema:"required"`
+		// MaxExpansion is the maximum number of tags a filter is expanded
+		// to, DefaultMaxFilterExpansion if it is 0.
+		MaxExpansion int `json:"maxExpansion,omitempty"`
+	}
+
+	// FilterAliases expands the tag filters by the aliases of a spec.
+	FilterAliases struct {
+		// groups maps the tags of every field to their groups.
+		groups       map[string]map[string][]string
+		maxExpansion int
+	}
+
+	// FilterExpansion is the expansion of a tag filter by the aliases, it
+	// is in the ExplainFilterExpansionsField of explained searches.
+	FilterExpansion struct {
+		Field    string   `json:"field"`
+		Tags     []string `json:"tags"`
+		Expanded []string `json:"expanded"`
+		// Capped means some aliases are dropped by the max expansion.
+		Capped bool `json:"capped,omitempty"`
+	}
+)
+
+// WithTagFilters returns a HandlerSearchOption for setting the tag filters,
+// they are combined with the filters of the vector database.
+func WithTagFilters(filters ...*TagFilter) HandlerSearchOption {
+	return func(opts *HandlerSearchOptions) {
+		opts.TagFilters = filters
+	}
+}
+
+// WithMandatoryTagFilters returns a HandlerSearchOption for adding tag
+// filters which no other option can override, widen or drop, like access
+// control. They are appended to the ones of the previous options, and
+// never expanded by the filter aliases.
+func WithMandatoryTagFilters(filters ...*TagFilter) HandlerSearchOption {
+	return func(opts *HandlerSearchOptions) {
+		opts.MandatoryTagFilters = append(opts.MandatoryTagFilters, filters...)
+	}
+}
+
+// ValidateTagFilters validates the tag filters independent of schemas.
+func ValidateTagFilters(filters []*TagFilter) error {
+	for _, filter := range filters {
+		switch {
+		case filter.Field == "":
+			return fmt.Errorf("field of tag filter is required")
+		case len(filter.Tags) == 0:
+			return fmt.Errorf("tags of tag filter on %s are required", filter.Field)
+		case slices.Contains(filter.Tags, ""):
+			return fmt.Errorf("tags of tag filter on %s cannot be empty", filter.Field)
+		}
+	}
+	return nil
+}
+
+// ValidateFilterAliasSpec validates the filter alias spec.
+func ValidateFilterAliasSpec(spec *FilterAliasSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.MaxExpansion < 0 {
+		return fmt.Errorf("invalid filter alias maxExpansion %d", spec.MaxExpansion)
+	}
+	for field, groups := range spec.Aliases {
+		seen := map[string]bool{}
+		for _, group := range groups {
+			if len(group) < 2 {
+				return fmt.Errorf("filter aliases of field %s must have at least two tags in a group", field)
+			}
+			for _, tag := range group {
+				if tag == "" {
+					return fmt.Errorf("filter aliases of field %s cannot be empty", field)
+				}
+				if seen[tag] {
+					return fmt.Errorf("filter alias %s of field %s is in more than one group", tag, field)
+				}
+				seen[tag] = true
+			}
+		}
+	}
+	return nil
+}
+
+// NewFilterAliases compiles the filter aliases of the spec, it is nil if
+// the spec is nil.
+func NewFilterAliases(spec *FilterAliasSpec) *FilterAliases {
+	if spec == nil {
+		return nil
+	}
+	a := &FilterAliases{groups: map[string]map[string][]string{}, maxExpansion: spec.MaxExpansion}
+	if a.maxExpansion == 0 {
+		a.maxExpansion = DefaultMaxFilterExpansion
+	}
+	for field, groups := range spec.Aliases {
+		tags := map[string][]string{}
+		for _, group := range groups {
+			for _, tag := range group {
+				tags[tag] = group
+			}
+		}
+		a.groups[field] = tags
+	}
+	return a
+}
+
+// Expand returns the tags with their aliases on the field, the tags are
+// kept first in their order, followed by the aliases in the order of
+// their groups. The expansion stops at the max expansion, the tags given
+// are never dropped though, and capped is true if any alias is dropped.
+func (a *FilterAliases) Expand(field string, tags []string) (expanded []string, capped bool) {
+	groups := a.groups[field]
+	if len(groups) == 0 {
+		return tags, false
+	}
+	expanded = slices.Clone(tags)
+	for _, tag := range tags {
+		for _, alias := range groups[tag] {
+			if slices.Contains(expanded, alias) {
+				continue
+			}
+			if len(expanded) >= a.maxExpansion {
+				return expanded, true
+			}
+			expanded = append(expanded, alias)
+		}
+	}
+	return expanded, false
+}
+
+// ExpandTagFilters returns the tag filters with their tags expanded, the
+// filters are not modified, and the expansions of the filters having
+// aliases.
+func (a *FilterAliases) ExpandTagFilters(filters []*TagFilter) ([]*TagFilter, []*FilterExpansion) {
+	var expansions []*FilterExpansion
+	result := make([]*TagFilter, len(filters))
+	for i, filter := range filters {
+		result[i] = filter
+		expanded, capped := a.Expand(filter.Field, filter.Tags)
+		if len(expanded) == len(filter.Tags) {
+			continue
+		}
+		result[i] = &TagFilter{Field: filter.Field, Tags: expanded, Negate: filter.Negate, Array: filter.Array}
+		expansions = append(expansions, &FilterExpansion{Field: filter.Field, Tags: filter.Tags, Expanded: expanded, Capped: capped})
+	}
+	return result, expansions
+}
+
+// ExpandRedisQueryFilters is ExpandTagFilters of the structured filters
+// of Redis, the range filters are kept as is.
+func (a *FilterAliases) ExpandRedisQueryFilters(filters []*RedisQueryFilter) ([]*RedisQueryFilter, []*FilterExpansion) {
+	var expansions []*FilterExpansion
+	result := make([]*RedisQueryFilter, len(filters))
+	for i, filter := range filters {
+		result[i] = filter
+		expanded, capped := a.Expand(filter.Field, filter.Tags)
+		if len(expanded) == len(filter.Tags) {
+			continue
+		}
+		f := *filter
+		f.Tags = expanded
+		result[i] = &f
+		expansions = append(expansions, &FilterExpansion{Field: filter.Field, Tags: filter.Tags, Expanded: expanded, Capped: capped})
+	}
+	return result, expansions
+}
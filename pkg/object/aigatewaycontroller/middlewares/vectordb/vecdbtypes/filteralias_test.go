@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFilterAliasSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateFilterAliasSpec(nil))
+	assert.NoError(ValidateFilterAliasSpec(&FilterAliasSpec{Aliases: map[string][][]string{
+		"model": {{"gpt4", "gpt-4", "gpt-4-0613"}, {"gpt4o", "gpt-4o"}},
+	}}))
+	assert.Error(ValidateFilterAliasSpec(&FilterAliasSpec{MaxExpansion: -1}))
+	assert.Error(ValidateFilterAliasSpec(&FilterAliasSpec{Aliases: map[string][][]string{"model": {{"gpt4"}}}}))
+	assert.Error(ValidateFilterAliasSpec(&FilterAliasSpec{Aliases: map[string][][]string{"model": {{"gpt4", ""}}}}))
+	assert.Error(ValidateFilterAliasSpec(&FilterAliasSpec{Aliases: map[string][][]string{
+		"model": {{"gpt4", "gpt-4"}, {"gpt-4", "gpt-4-0613"}},
+	}}))
+
+	assert.NoError(ValidateTagFilters([]*TagFilter{{Field: "model", Tags: []string{"gpt4"}}}))
+	assert.Error(ValidateTagFilters([]*TagFilter{{Tags: []string{"gpt4"}}}))
+	assert.Error(ValidateTagFilters([]*TagFilter{{Field: "model"}}))
+	assert.Error(ValidateTagFilters([]*TagFilter{{Field: "model", Tags: []string{""}}}))
+}
+
+func TestFilterAliasesExpand(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(NewFilterAliases(nil))
+	aliases := NewFilterAliases(&FilterAliasSpec{Aliases: map[string][][]string{
+		"model": {{"gpt4", "gpt-4", "gpt-4-0613"}, {"gpt4o", "gpt-4o"}},
+	}})
+
+	expanded, capped := aliases.Expand("model", []string{"gpt-4"})
+	assert.Equal([]string{"gpt-4", "gpt4", "gpt-4-0613"}, expanded)
+	assert.False(capped)
+
+	expanded, capped = aliases.Expand("model", []string{"gpt-4o", "claude", "gpt4"})
+	assert.Equal([]string{"gpt-4o", "claude", "gpt4", "gpt4o", "gpt-4", "gpt-4-0613"}, expanded)
+	assert.False(capped)
+
+	// other fields and tags without aliases are kept as is.
+	expanded, _ = aliases.Expand("tenant", []string{"gpt4"})
+	assert.Equal([]string{"gpt4"}, expanded)
+	expanded, _ = aliases.Expand("model", []string{"claude"})
+	assert.Equal([]string{"claude"}, expanded)
+
+	// the expansion is capped, the tags given are never dropped.
+	aliases = NewFilterAliases(&FilterAliasSpec{MaxExpansion: 2, Aliases: map[string][][]string{
+		"model": {{"gpt4", "gpt-4", "gpt-4-0613"}},
+	}})
+	expanded, capped = aliases.Expand("model", []string{"gpt4"})
+	assert.Equal([]string{"gpt4", "gpt-4"}, expanded)
+	assert.True(capped)
+	expanded, capped = aliases.Expand("model", []string{"a", "b", "gpt4"})
+	assert.Equal([]string{"a", "b", "gpt4"}, expanded)
+	assert.True(capped)
+
+	filters := []*TagFilter{{Field: "model", Tags: []string{"gpt4"}, Negate: true}, {Field: "tenant", Tags: []string{"acme"}}}
+	result, expansions := aliases.ExpandTagFilters(filters)
+	assert.Equal(&TagFilter{Field: "model", Tags: []string{"gpt4", "gpt-4"}, Negate: true}, result[0])
+	assert.Same(filters[1], result[1])
+	assert.Equal([]string{"gpt4"}, filters[0].Tags)
+	assert.Equal([]*FilterExpansion{{Field: "model", Tags: []string{"gpt4"}, Expanded: []string{"gpt4", "gpt-4"}, Capped: true}}, expansions)
+
+	since := 1.0
+	queryFilters := []*RedisQueryFilter{{Field: "model", Tags: []string{"gpt-4"}}, {Field: "created_at", Min: &since}}
+	redisResult, expansions := aliases.ExpandRedisQueryFilters(queryFilters)
+	assert.Equal([]string{"gpt-4", "gpt4"}, redisResult[0].Tags)
+	assert.Same(queryFilters[1], redisResult[1])
+	assert.Len(expansions, 1)
+}
+
+func TestWithMandatoryTagFilters(t *testing.T) {
+	assert := assert.New(t)
+
+	acl := &TagFilter{Field: "acl", Tags: []string{"hr"}, Array: true}
+	opts := &HandlerSearchOptions{}
+	// the tag filters set after the mandatory ones never override them.
+	for _, opt := range []HandlerSearchOption{
+		WithMandatoryTagFilters(acl),
+		WithTagFilters(&TagFilter{Field: "acl", Tags: []string{"finance"}}),
+		WithTagFilters(),
+		WithMandatoryTagFilters(&TagFilter{Field: "model", Tags: []string{"gpt4"}}),
+	} {
+		opt(opts)
+	}
+	assert.Empty(opts.TagFilters)
+	assert.Equal([]*TagFilter{acl, {Field: "model", Tags: []string{"gpt4"}}}, opts.MandatoryTagFilters)
+}
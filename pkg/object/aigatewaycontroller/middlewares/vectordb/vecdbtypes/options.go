@@ -17,6 +17,8 @@
 
 package vecdbtypes
 
+import "time"
+
 type Option func(*Options)
 
 type Schema interface {
@@ -36,6 +38,12 @@ type HandlerInsertOption func(*HandlerInsertOptions)
 type HandlerInsertOptions struct {
 	// RedisPrefix is the prefix for Redis vector database.
 	RedisPrefix string
+	// TTL is the time to live of the inserted documents, overriding the
+	// one of the vector database if positive.
+	TTL time.Duration
+	// RedisWriteMode is how the documents are written to Redis if their
+	// keys exist, one of merge, overwrite and createOnly.
+	RedisWriteMode string
 }
 
 // WithRedisPrefix returns a HandlerInsertOption for setting the Redis prefix.
@@ -45,8 +53,38 @@ func WithRedisPrefix(prefix string) HandlerInsertOption {
 	}
 }
 
+// WithTTL returns a HandlerInsertOption for setting the time to live of the
+// inserted documents.
+func WithTTL(ttl time.Duration) HandlerInsertOption {
+	return func(opts *HandlerInsertOptions) {
+		opts.TTL = ttl
+	}
+}
+
+// WithRedisWriteMode returns a HandlerInsertOption for setting the Redis
+// write mode.
+func WithRedisWriteMode(mode string) HandlerInsertOption {
+	return func(opts *HandlerInsertOptions) {
+		opts.RedisWriteMode = mode
+	}
+}
+
 type HandlerSearchOption func(*HandlerSearchOptions)
 
+// RedisQueryFilter is a pre-filter of the Redis vector search on a tag or
+// a numeric field of the index. Only one of Tags and the range is set.
+type RedisQueryFilter struct {
+	Field string
+	// Tags matches the documents whose tag field has any of the tags.
+	Tags []string
+	// Min and Max are the inclusive range of the numeric field, nil means
+	// unbounded.
+	Min *float64
+	Max *float64
+	// Negate matches the documents not matching the filter.
+	Negate bool
+}
+
 type HandlerSearchOptions struct {
 	// Limit is the maximum number of results to return.
 	Limit int
@@ -58,11 +96,24 @@ type HandlerSearchOptions struct {
 	Timeout int
 	// ScoreThreshold is the minimum score for a result to be included.
 	ScoreThreshold float32
-	// SelectedFields is the fields to return in the results.
+	// SelectedFields is the fields to return in the results, the id and
+	// the score are always returned. An empty list returns all fields.
 	SelectedFields []string
+	// Explain is a flag to indicate whether to explain the search, see WithExplain.
+	Explain bool
+
+	// TagFilters are the tag filters of both vector databases, they are
+	// combined with the filters of the vector database.
+	TagFilters []*TagFilter
+	// MandatoryTagFilters are combined with all the other filters by AND,
+	// see WithMandatoryTagFilters.
+	MandatoryTagFilters []*TagFilter
 
 	// RedisFilters is the filters conditions for Redis vector database.
 	RedisFilters string
+	// RedisQueryFilters are the structured pre-filters for Redis vector
+	// database, they are combined with RedisFilters.
+	RedisQueryFilters []*RedisQueryFilter
 	// RedisVectorFilterKey is the key for the vector filter in Redis.
 	RedisVectorFilterKey string
 	// RedisVectorFilterValues is the value for the vector filter in Redis.
@@ -79,6 +130,12 @@ type HandlerSearchOptions struct {
 	RedisInKeys []string
 	// RedisInFields limits the result to a given set of fields specified in the list.
 	RedisInFields []string
+	// RedisEFRuntime is the number of candidates kept by the KNN search
+	// of HNSW indexes, the EF_RUNTIME of the index is used if it is 0.
+	RedisEFRuntime int
+	// RedisKNN is the k of the KNN search, which caps the total of the
+	// search, it is the offset plus the limit if it is 0.
+	RedisKNN int
 
 	// PostgresVectorFilterKey is the key for the vector filter in Postgres.
 	PostgresVectorFilterKey string
@@ -139,6 +196,14 @@ func WithRedisFilters(redisFilters string) HandlerSearchOption {
 	}
 }
 
+// WithRedisQueryFilters returns a HandlerSearchOption for setting the
+// structured Redis pre-filters.
+func WithRedisQueryFilters(filters ...*RedisQueryFilter) HandlerSearchOption {
+	return func(opts *HandlerSearchOptions) {
+		opts.RedisQueryFilters = filters
+	}
+}
+
 // WithRedisVectorFilterKey returns a HandlerSearchOption for setting the Redis vector filter key.
 func WithRedisVectorFilterKey(redisVectorFilterKey string) HandlerSearchOption {
 	return func(opts *HandlerSearchOptions) {
@@ -195,6 +260,21 @@ func WithRedisInFields(redisInFields []string) HandlerSearchOption {
 	}
 }
 
+// WithRedisKNN returns a HandlerSearchOption for setting the k of the KNN search in Redis,
+// the pages of a search are taken from the k nearest neighbors.
+func WithRedisKNN(k int) HandlerSearchOption {
+	return func(opts *HandlerSearchOptions) {
+		opts.RedisKNN = k
+	}
+}
+
+// WithRedisEFRuntime returns a HandlerSearchOption for setting the EF_RUNTIME of the KNN search in Redis.
+func WithRedisEFRuntime(efRuntime int) HandlerSearchOption {
+	return func(opts *HandlerSearchOptions) {
+		opts.RedisEFRuntime = efRuntime
+	}
+}
+
 func WithPostgresVectorFilterKey(postgresVectorFilterKey string) HandlerSearchOption {
 	return func(opts *HandlerSearchOptions) {
 		opts.PostgresVectorFilterKey = postgresVectorFilterKey
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// DefaultPayloadSweepInterval is the default interval to garbage-collect
+// unreferenced payloads.
+const DefaultPayloadSweepInterval = 10 * time.Minute
+
+type (
+	// PayloadStoreSpec defines the content-addressable payload store. The
+	// documents keep only the content hash of the fields, and the content is
+	// stored once in a separate keyspace or table with reference counting.
+	PayloadStoreSpec struct {
+		Fields        []string `json:"fields" jsonschema:"required"`
+		SweepInterval string   `json:"sweepInterval,omitempty" jsonschema:"format=duration"`
+	}
+
+	// PayloadStats is the statistics of a payload store.
+	PayloadStats struct {
+		// References is the number of document fields referencing payloads.
+		References int64 `json:"references"`
+		// Payloads is the number of stored payloads.
+		Payloads int64 `json:"payloads"`
+		// DedupRatio is References / Payloads, 1 means no deduplication.
+		DedupRatio float64 `json:"dedupRatio"`
+	}
+
+	// PayloadStatsReporter is implemented by vector handlers with a payload store.
+	PayloadStatsReporter interface {
+		PayloadStats(ctx context.Context) (*PayloadStats, error)
+	}
+)
+
+// ValidatePayloadStoreSpec validates the payload store spec.
+func ValidatePayloadStoreSpec(spec *PayloadStoreSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if len(spec.Fields) == 0 {
+		return fmt.Errorf("payload store must have at least one field")
+	}
+	if spec.SweepInterval != "" {
+		if d, err := time.ParseDuration(spec.SweepInterval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid payload store sweepInterval %s", spec.SweepInterval)
+		}
+	}
+	return nil
+}
+
+// GetSweepInterval returns the interval to garbage-collect unreferenced payloads.
+func (spec *PayloadStoreSpec) GetSweepInterval() time.Duration {
+	if d, err := time.ParseDuration(spec.SweepInterval); err == nil && d > 0 {
+		return d
+	}
+	return DefaultPayloadSweepInterval
+}
+
+// NewPayloadStats creates the payload statistics.
+func NewPayloadStats(references, payloads int64) *PayloadStats {
+	stats := &PayloadStats{References: references, Payloads: payloads}
+	if payloads > 0 {
+		stats.DedupRatio = float64(references) / float64(payloads)
+	}
+	return stats
+}
+
+// PayloadHash returns the content hash of a payload.
+func PayloadHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// ExtractPayloads returns copies of the documents whose payload fields are
+// replaced with their content hashes, and the hashes and content in the
+// order of the references, so a hash appears once for each referencing field.
+func ExtractPayloads(docs []map[string]any, fields []string) (result []map[string]any, hashes []string, contents []string) {
+	result = make([]map[string]any, 0, len(docs))
+	for _, doc := range docs {
+		d := make(map[string]any, len(doc))
+		for k, v := range doc {
+			d[k] = v
+		}
+		for _, field := range fields {
+			value, ok := d[field]
+			if !ok || value == nil {
+				continue
+			}
+			content := fmt.Sprintf("%v", value)
+			hash := PayloadHash(content)
+			d[field] = hash
+			hashes = append(hashes, hash)
+			contents = append(contents, content)
+		}
+		result = append(result, d)
+	}
+	return result, hashes, contents
+}
+
+// PayloadReferences returns the content hashes referenced by the documents.
+func PayloadReferences(docs []map[string]any, fields []string) []string {
+	var hashes []string
+	for _, doc := range docs {
+		for _, field := range fields {
+			if hash, ok := doc[field].(string); ok && hash != "" {
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	return hashes
+}
+
+// ResolvePayloads replaces the content hashes in the payload fields of the
+// documents with the content.
+func ResolvePayloads(docs []map[string]any, fields []string, contents map[string]string) error {
+	for _, doc := range docs {
+		for _, field := range fields {
+			hash, ok := doc[field].(string)
+			if !ok || hash == "" {
+				continue
+			}
+			content, ok := contents[hash]
+			if !ok {
+				return fmt.Errorf("payload %s of field %s not found", hash, field)
+			}
+			doc[field] = content
+		}
+	}
+	return nil
+}
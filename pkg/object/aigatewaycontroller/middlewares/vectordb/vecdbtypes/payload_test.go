@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	fields := []string{"data"}
+	docs := []map[string]any{
+		{"data": "large document", "status": 200},
+		{"data": "large document", "status": 201},
+		{"data": "another document"},
+		{"status": 204},
+	}
+	result, hashes, contents := ExtractPayloads(docs, fields)
+	assert.Len(result, 4)
+	assert.Equal([]string{"large document", "large document", "another document"}, contents)
+	assert.Equal(hashes[0], hashes[1])
+	assert.NotEqual(hashes[0], hashes[2])
+	assert.Equal(hashes[0], result[0]["data"])
+	assert.Equal(200, result[0]["status"])
+	// the documents of the caller are not changed.
+	assert.Equal("large document", docs[0]["data"])
+
+	assert.Equal(hashes, PayloadReferences(result, fields))
+	assert.Nil(ResolvePayloads(result, fields, map[string]string{
+		hashes[0]: "large document",
+		hashes[2]: "another document",
+	}))
+	assert.Equal("large document", result[1]["data"])
+	assert.Equal("another document", result[2]["data"])
+
+	_, hashes, _ = ExtractPayloads(docs[:1], fields)
+	assert.NotNil(ResolvePayloads([]map[string]any{{"data": hashes[0]}}, fields, map[string]string{}))
+
+	stats := NewPayloadStats(3, 2)
+	assert.Equal(1.5, stats.DedupRatio)
+	assert.Equal(0.0, NewPayloadStats(0, 0).DedupRatio)
+}
+
+func TestValidatePayloadStoreSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(ValidatePayloadStoreSpec(nil))
+	assert.NotNil(ValidatePayloadStoreSpec(&PayloadStoreSpec{}))
+	spec := &PayloadStoreSpec{Fields: []string{"data"}}
+	assert.Nil(ValidatePayloadStoreSpec(spec))
+	assert.Equal(DefaultPayloadSweepInterval, spec.GetSweepInterval())
+	spec.SweepInterval = "1m"
+	assert.Nil(ValidatePayloadStoreSpec(spec))
+	assert.Equal(time.Minute, spec.GetSweepInterval())
+	spec.SweepInterval = "-1m"
+	assert.NotNil(ValidatePayloadStoreSpec(spec))
+}
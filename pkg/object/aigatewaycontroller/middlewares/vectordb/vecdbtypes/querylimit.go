@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"fmt"
+	"time"
+)
+
+// Priorities of the queries limited by the query limit.
+const (
+	QueryPriorityHigh   = "high"
+	QueryPriorityMedium = "medium"
+	QueryPriorityLow    = "low"
+)
+
+const (
+	// DefaultQueryMaxWait is the default longest time a query waits for a
+	// slot of the backend.
+	DefaultQueryMaxWait = 100 * time.Millisecond
+
+	defaultHighWeight   = 4
+	defaultMediumWeight = 2
+	defaultLowWeight    = 1
+)
+
+type (
+	// QueryLimitSpec limits the concurrent similarity searches of a vector
+	// database backend, the middlewares using the same backend share the
+	// limit. When all slots are in use, the queries wait in the queues of
+	// their priorities, the freed slots are given to the queues in
+	// proportion to their weights, and the queries waiting longer than
+	// MaxWait are shed.
+	QueryLimitSpec struct {
+		MaxConcurrency int `json:"maxConcurrency" jsonschema:"required"`
+		// MaxWait is the longest time a query waits for a slot.
+		MaxWait string `json:"maxWait,omitempty" jsonschema:"format=duration"`
+		// Priority is the priority of the queries of the middleware, the
+		// default depends on the middleware, it is high for semantic
+		// caches and medium for retrievals.
+		Priority string            `json:"priority,omitempty" jsonschema:"enum=,enum=high,enum=medium,enum=low"`
+		Weights  *QueryWeightsSpec `json:"weights,omitempty"`
+	}
+
+	// QueryWeightsSpec is the share of the freed slots of each priority.
+	QueryWeightsSpec struct {
+		High   int `json:"high,omitempty"`
+		Medium int `json:"medium,omitempty"`
+		Low    int `json:"low,omitempty"`
+	}
+)
+
+// ValidateQueryLimitSpec validates the spec of the query limit.
+func ValidateQueryLimitSpec(spec *QueryLimitSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.MaxConcurrency <= 0 {
+		return fmt.Errorf("maxConcurrency of query limit must be positive")
+	}
+	if spec.MaxWait != "" {
+		d, err := time.ParseDuration(spec.MaxWait)
+		if err != nil {
+			return fmt.Errorf("invalid maxWait of query limit: %w", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("maxWait of query limit cannot be negative")
+		}
+	}
+	switch spec.Priority {
+	case "", QueryPriorityHigh, QueryPriorityMedium, QueryPriorityLow:
+	default:
+		return fmt.Errorf("invalid priority %s of query limit", spec.Priority)
+	}
+	if w := spec.Weights; w != nil && (w.High < 0 || w.Medium < 0 || w.Low < 0) {
+		return fmt.Errorf("weights of query limit cannot be negative")
+	}
+	return nil
+}
+
+// GetMaxWait returns the max wait of the query limit.
+func (spec *QueryLimitSpec) GetMaxWait() time.Duration {
+	if d, err := time.ParseDuration(spec.MaxWait); err == nil {
+		return d
+	}
+	return DefaultQueryMaxWait
+}
+
+// GetWeights returns the weights of the high, medium and low priorities.
+func (spec *QueryLimitSpec) GetWeights() [3]int {
+	weights := [3]int{defaultHighWeight, defaultMediumWeight, defaultLowWeight}
+	if w := spec.Weights; w != nil {
+		for i, v := range []int{w.High, w.Medium, w.Low} {
+			if v > 0 {
+				weights[i] = v
+			}
+		}
+	}
+	return weights
+}
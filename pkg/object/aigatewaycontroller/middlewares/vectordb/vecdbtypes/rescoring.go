@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+// The functions of re-scoring.
+const (
+	// RescoringCosine is the cosine similarity of the vectors.
+	RescoringCosine = "cosine"
+	// RescoringDotProduct is the dot product of the vectors, which is not
+	// normalized by their norms.
+	RescoringDotProduct = "dotProduct"
+	// RescoringEuclidean is 1 / (1 + d), where d is the euclidean distance
+	// of the vectors.
+	RescoringEuclidean = "euclidean"
+	// RescoringExpression is the result of a CEL expression over the score
+	// of the backend and the fields of the document.
+	RescoringExpression = "expression"
+)
+
+// RescoringSpec defines re-scoring the nearest neighbors found by the
+// backend on the client with another similarity function, without
+// changing the index. The candidates are compared with the score threshold
+// and ordered by their new scores.
+type RescoringSpec struct {
+	Function string `json:"function" jsonschema:"required,enum=cosine,enum=dotProduct,enum=euclidean,enum=expression"`
+	// Expression is the CEL expression of the new score, which is used by
+	// the expression function.
+	Expression string `json:"expression,omitempty"`
+	// VectorField is the field of the vectors of documents, which is read
+	// by the functions of vectors, default embedding.
+	VectorField string `json:"vectorField,omitempty"`
+	// Candidates is the number of the nearest neighbors re-scored, default
+	// 4 times the offset plus the limit of the search.
+	Candidates int `json:"candidates,omitempty"`
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ScopeSeparator separates the scope and the name of a scoped collection,
+// like staging_cache. Scopes cannot contain it, so the collections of a
+// scope are never mistaken for the ones of another scope.
+const ScopeSeparator = "_"
+
+// maxScopeLength keeps the scoped names in the 63 bytes of the identifiers
+// of Postgres.
+const maxScopeLength = 16
+
+var scopeRegexp = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+type (
+	// ScopeMigrator is implemented by vector databases which can move the
+	// documents of a collection created without the scope under the
+	// scope.
+	ScopeMigrator interface {
+		// MigrateToScope moves the documents of the unscoped collection of
+		// the scoped name to the collection of the name.
+		MigrateToScope(ctx context.Context, name string) (*ScopeMigrationReport, error)
+	}
+
+	// ScopeMigrationReport is the result of moving a collection under the
+	// scope.
+	ScopeMigrationReport struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		// Moved is the number of the moved keys or rows, and Skipped is the
+		// number of the ones existing in the scope already, which are kept
+		// and the unscoped ones are deleted.
+		Moved   int64 `json:"moved"`
+		Skipped int64 `json:"skipped"`
+	}
+)
+
+// ValidateScope validates the scope of collections, the empty scope means
+// the collections are not scoped.
+func ValidateScope(scope string) error {
+	if scope == "" {
+		return nil
+	}
+	if len(scope) > maxScopeLength || !scopeRegexp.MatchString(scope) {
+		return fmt.Errorf("invalid scope %s, it must be at most %d lower case letters and digits starting with a letter", scope, maxScopeLength)
+	}
+	return nil
+}
+
+// ScopedName returns the name of the collection in the scope.
+func ScopedName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + ScopeSeparator + name
+}
+
+// UnscopedName returns the name of the scoped collection without the scope.
+func UnscopedName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, scope+ScopeSeparator)
+}
+
+// InScope returns whether the collection of the name is in the scope, all
+// collections are in the empty scope.
+func InScope(scope, name string) bool {
+	return scope == "" || strings.HasPrefix(name, scope+ScopeSeparator)
+}
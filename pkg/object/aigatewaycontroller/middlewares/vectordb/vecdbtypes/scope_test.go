@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScope(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateScope(""))
+	assert.NoError(ValidateScope("staging2"))
+	assert.Error(ValidateScope("prod_eu"))
+	assert.Error(ValidateScope("Prod"))
+	assert.Error(ValidateScope("2prod"))
+	assert.Error(ValidateScope("averyveryverylongscope"))
+
+	assert.Equal("cache", ScopedName("", "cache"))
+	assert.Equal("staging_cache", ScopedName("staging", "cache"))
+	assert.Equal("cache", UnscopedName("staging", "staging_cache"))
+	assert.Equal("staging_cache", UnscopedName("", "staging_cache"))
+
+	assert.True(InScope("", "cache"))
+	assert.True(InScope("staging", "staging_cache"))
+	assert.False(InScope("staging", "cache"))
+	assert.False(InScope("prod", "prodeu_cache"))
+}
@@ -20,9 +20,30 @@ package vecdbtypes
 import (
 	"context"
 	"errors"
+	"time"
 )
 
-var ErrSimilaritySearchNotFound = errors.New("not found a result that matches the query in vector database")
+// ErrSimilaritySearchNotFound means no result matches the query, it is of
+// the kind ErrNotFound.
+var ErrSimilaritySearchNotFound error = &Error{Kind: ErrNotFound, Err: errors.New("not found a result that matches the query in vector database")}
+
+// ErrReplaceNotSupported means the vector handler can not replace the
+// documents of a group atomically.
+var ErrReplaceNotSupported = errors.New("replacing documents is not supported")
+
+// ErrDeleteNotSupported means the vector handler can not delete documents.
+var ErrDeleteNotSupported = errors.New("deleting documents is not supported")
+
+// ErrTieringNotSupported means the vector handler can not track the hits
+// of documents or update their fields in place.
+var ErrTieringNotSupported = errors.New("tiering documents is not supported")
+
+// ErrScanNotSupported means the vector database can not iterate over the
+// documents of a collection.
+var ErrScanNotSupported = errors.New("scanning documents is not supported")
+
+// EmbeddingVersionField is the metadata field that records the embedding version of a document.
+const EmbeddingVersionField = "embedding_version"
 
 type (
 	// VectorDB is the interface for vector database middleware.
@@ -35,10 +56,187 @@ type (
 		InsertDocuments(ctx context.Context, doc []map[string]any, options ...HandlerInsertOption) ([]string, error)
 	}
 
+	// SchemaStore is implemented by vector databases persisting the
+	// inferred schemas of collections, so restarts and other members use
+	// the same schema.
+	SchemaStore interface {
+		// LoadSchema returns the persisted schema of the collection, or nil
+		// if there is none.
+		LoadSchema(ctx context.Context, name string) ([]byte, error)
+		// SaveSchema persists the schema of the collection if there is none,
+		// and returns the persisted one, which may be saved by others.
+		SaveSchema(ctx context.Context, name string, schema []byte) ([]byte, error)
+	}
+
+	// Pinger is implemented by vector databases which can check whether
+	// they are reachable without touching any collection.
+	Pinger interface {
+		Ping(ctx context.Context) error
+	}
+
+	// CollectionDropper is implemented by vector databases which can drop
+	// a collection with its documents.
+	CollectionDropper interface {
+		DropCollection(ctx context.Context, name string) error
+	}
+
+	// DrainResumer is implemented by vector databases which delete the
+	// documents of dropped collections in the background, the deletions
+	// are resumed after restarts.
+	DrainResumer interface {
+		ResumeDrains(ctx context.Context) error
+	}
+
+	// IntegrityChecker is implemented by vector databases which can check
+	// whether the stored documents of collections are all indexed.
+	IntegrityChecker interface {
+		// StartIntegrityCheck starts checking the collection in the
+		// background, the documents are touched to be indexed again if
+		// repair is true and discrepancies are found.
+		StartIntegrityCheck(name string, repair bool) (*IntegrityReport, error)
+		// IntegrityReport returns the progress of the running check of the
+		// collection, or the report of the last one, it is nil if the
+		// collection is never checked by this process.
+		IntegrityReport(name string) *IntegrityReport
+		// ScheduleIntegrityChecks checks the collections in the scheduled
+		// windows until stop is called.
+		ScheduleIntegrityChecks(names []string) (stop func())
+	}
+
+	// Rebalancer is implemented by vector databases distributing the
+	// documents of collections across shards, which can move documents to
+	// the shards owning them after shards are added or removed.
+	Rebalancer interface {
+		// StartRebalance starts moving the documents of the collection in
+		// the background.
+		StartRebalance(name string) (*RebalanceReport, error)
+		// RebalanceReport returns the progress of the running rebalance of
+		// the collection, or the report of the last one, it is nil if the
+		// collection is never rebalanced by this process.
+		RebalanceReport(name string) *RebalanceReport
+	}
+
+	// DocumentReplacer is implemented by vector handlers which can replace
+	// a group of documents atomically, so searches never see a mix of the
+	// old and the new documents of the group.
+	DocumentReplacer interface {
+		// ReplaceDocuments deletes the documents whose field is group, and
+		// inserts the documents, which should have the field set to group.
+		ReplaceDocuments(ctx context.Context, field, group string, docs []map[string]any) ([]string, error)
+	}
+
+	// DocumentDeleter is implemented by vector handlers which can delete
+	// documents by the IDs returned by searches, the number of deleted
+	// documents is returned, and IDs not existing are skipped.
+	DocumentDeleter interface {
+		DeleteDocuments(ctx context.Context, ids []string) (int64, error)
+	}
+
+	// DocumentTierer is implemented by vector handlers which can track the
+	// last hits of documents and update their fields in place, so the
+	// fields of documents not hit for long can be moved to cold storage.
+	// The IDs are the ones returned by searches or inserts. The hits are
+	// recorded by the clock of the database, so the members with skewed
+	// clocks agree on which documents are idle.
+	DocumentTierer interface {
+		// Now returns the current time of the database.
+		Now(ctx context.Context) (time.Time, error)
+		// TouchDocuments records the documents are hit at the time, the
+		// current time of the database if the time is zero.
+		TouchDocuments(ctx context.Context, ids []string, at time.Time) error
+		// ClaimIdleDocuments returns at most limit documents not hit since
+		// the time of the database, and stops tracking them, so a document
+		// is claimed by one caller only. Touch them again to give them up.
+		ClaimIdleDocuments(ctx context.Context, since time.Time, limit int) ([]string, error)
+		// GetDocumentFields returns the fields of the document, missing
+		// fields are empty, it returns ErrNotFound if the document does
+		// not exist.
+		GetDocumentFields(ctx context.Context, id string, fields []string) (map[string]string, error)
+		// SetDocumentFields sets the fields of the document, it returns
+		// ErrNotFound if the document does not exist.
+		SetDocumentFields(ctx context.Context, id string, fields map[string]string) error
+	}
+
+	// DocumentScanner is implemented by vector databases which can iterate
+	// over the documents of a collection page by page.
+	DocumentScanner interface {
+		// ScanDocuments calls fn with the fields of the documents of the
+		// collection page by page, starting from the cursor, which is
+		// empty for the first page. The ID of a document is in the id
+		// field, and next is the cursor of the page after, it is empty
+		// after the last page. The scan stops if fn returns an error,
+		// which is returned. A document written during the scan may be
+		// returned more than once.
+		ScanDocuments(ctx context.Context, name, cursor string, count int, fields []string,
+			fn func(docs []map[string]any, next string) error) error
+	}
+
+	// FieldCounter is implemented by vector databases which can count the
+	// documents of a collection by the values of a field, the documents
+	// without the field are counted under the empty value.
+	FieldCounter interface {
+		CountByField(ctx context.Context, name, field string) (map[string]int64, error)
+	}
+
+	// FilterDeleter is implemented by vector handlers which can delete the
+	// documents matching all the tag filters, the number of deleted
+	// documents is returned. At least one filter is required.
+	FilterDeleter interface {
+		DeleteByFilter(ctx context.Context, filters ...*TagFilter) (int64, error)
+	}
+
+	// DocumentCounter is implemented by vector databases which can count
+	// the documents of a collection matching a filter in the query syntax
+	// of the database, all documents are counted if the filter is empty.
+	DocumentCounter interface {
+		CountDocuments(ctx context.Context, name, filter string) (int64, error)
+	}
+
+	// SchemaEnsurer is implemented by vector handlers which can create
+	// their collection again if it is dropped by others.
+	SchemaEnsurer interface {
+		EnsureSchema(ctx context.Context) error
+	}
+
+	// HandlerCloser is implemented by vector handlers running background
+	// jobs, like sweeping payloads, which are stopped when the handlers
+	// are closed. The handlers are closed when their middlewares are
+	// replaced by spec changes, so the jobs restart with the new spec.
+	HandlerCloser interface {
+		Close()
+	}
+
 	// CommonSpec defines the specification for a vector database middleware.
 	CommonSpec struct {
 		Type           string  `json:"type"`
 		Threshold      float64 `json:"threshold" jsonschema:"required"`
 		CollectionName string  `json:"collectionName" jsonschema:"required"`
+		// EmbeddingVersion is stored with every document in EmbeddingVersionField,
+		// so documents embedded by different models can be told apart.
+		EmbeddingVersion string `json:"embeddingVersion,omitempty"`
+		// PayloadStore stores large document fields once by content hash.
+		PayloadStore *PayloadStoreSpec `json:"payloadStore,omitempty"`
+		// WriteLimit limits the document writes of each collection, the
+		// writes are queued and written asynchronously if it is set.
+		WriteLimit *WriteLimitSpec `json:"writeLimit,omitempty"`
+		// VectorValidation validates the vectors of documents before they
+		// are stored, vectors with NaN or Inf components are always rejected.
+		VectorValidation *VectorValidationSpec `json:"vectorValidation,omitempty"`
+		// QueryLimit limits the concurrent similarity searches of the
+		// backend, they are not limited if it is nil.
+		QueryLimit *QueryLimitSpec `json:"queryLimit,omitempty"`
+		// Rescoring re-scores the candidates of similarity searches on the
+		// client, it is disabled if it is nil.
+		Rescoring *RescoringSpec `json:"rescoring,omitempty"`
+		// FilterAliases expands the tag filters of searches and deletions
+		// by the aliases of tags, the latest spec of a collection applies.
+		FilterAliases *FilterAliasSpec `json:"filterAliases,omitempty"`
+		// Region is the data residency region of the collection, it is
+		// neither read nor written for consumers pinned to other regions.
+		Region string `json:"region,omitempty"`
+		// Scope is the scope of the controller, it is composed into
+		// CollectionName and the names of the collections not derived from
+		// it by ScopedName. It is set by the controller, not configured.
+		Scope string `json:"-"`
 	}
 )
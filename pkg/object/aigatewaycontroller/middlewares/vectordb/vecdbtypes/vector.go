@@ -0,0 +1,277 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+)
+
+// Policies of vectors with a zero norm.
+const (
+	ZeroNormAllow  = "allow"
+	ZeroNormReject = "reject"
+)
+
+// Reasons of invalid vectors.
+const (
+	InvalidVectorNaN       = "nan"
+	InvalidVectorInf       = "inf"
+	InvalidVectorZeroNorm  = "zeroNorm"
+	InvalidVectorNorm      = "normOutOfBounds"
+	InvalidVectorMalformed = "malformed"
+)
+
+type (
+	// VectorValidationSpec defines how the vectors of documents are
+	// validated before storage. Vectors containing NaN or Inf components
+	// are always rejected.
+	VectorValidationSpec struct {
+		// ZeroNorm is how vectors with a zero norm are handled, they are
+		// allowed by default, and always rejected if Normalize is set.
+		ZeroNorm string `json:"zeroNorm,omitempty" jsonschema:"enum=,enum=allow,enum=reject"`
+		// Normalize scales vectors to the unit norm before storage.
+		Normalize bool `json:"normalize,omitempty"`
+		// MinNorm and MaxNorm are the bounds of the norm of vectors before
+		// normalization, 0 means no bound.
+		MinNorm float64 `json:"minNorm,omitempty"`
+		MaxNorm float64 `json:"maxNorm,omitempty"`
+	}
+
+	// InvalidVectorError is returned when a document has an invalid vector.
+	InvalidVectorError struct {
+		// Document is the index of the document in the inserted ones.
+		Document int
+		Field    string
+		Reason   string
+		// Positions are the indexes of the NaN or Inf components.
+		Positions []int
+		Norm      float64
+	}
+
+	// VectorScrubber is implemented by vector databases which can scan a
+	// collection for invalid vectors and quarantine them.
+	VectorScrubber interface {
+		// ScrubVectors moves the documents with invalid vectors out of the
+		// collection, they are only reported if dryRun is true.
+		ScrubVectors(ctx context.Context, name string, dryRun bool) (*ScrubReport, error)
+	}
+
+	// ScrubReport is the result of scrubbing a collection.
+	ScrubReport struct {
+		Collection string `json:"collection"`
+		DryRun     bool   `json:"dryRun,omitempty"`
+		// Scanned is the number of scanned documents.
+		Scanned     int                    `json:"scanned"`
+		Quarantined []*QuarantinedDocument `json:"quarantined"`
+	}
+
+	// IntegrityReport is the progress or the result of checking whether
+	// the documents of a collection are all indexed.
+	IntegrityReport struct {
+		Collection string `json:"collection"`
+		Status     string `json:"status"`
+		Scheduled  bool   `json:"scheduled,omitempty"`
+		Repair     bool   `json:"repair,omitempty"`
+		StartedAt  string `json:"startedAt,omitempty"`
+		FinishedAt string `json:"finishedAt,omitempty"`
+		// ScannedKeys is the number of the keys of the collection scanned,
+		// and IndexedDocs is the number of the documents in the index.
+		ScannedKeys int64 `json:"scannedKeys"`
+		IndexedDocs int64 `json:"indexedDocs"`
+		// Missing is the number of scanned keys not indexed, it is an
+		// estimate as documents may be written during the check.
+		Missing int64 `json:"missing"`
+		// Sampled is the number of the documents verified to be found by
+		// their own vectors, and Unsearchable lists the ones not found.
+		Sampled      int      `json:"sampled"`
+		Unsearchable []string `json:"unsearchable"`
+		// Touched is the number of the documents touched to be indexed
+		// again by the repair.
+		Touched int64 `json:"touched,omitempty"`
+		// IndexedAfterRepair is the number of the documents in the index
+		// after the repair.
+		IndexedAfterRepair int64  `json:"indexedAfterRepair,omitempty"`
+		Error              string `json:"error,omitempty"`
+	}
+
+	// RebalanceReport is the progress or the result of moving the
+	// documents of a collection to the shards owning them.
+	RebalanceReport struct {
+		Collection string `json:"collection"`
+		Status     string `json:"status"`
+		StartedAt  string `json:"startedAt,omitempty"`
+		FinishedAt string `json:"finishedAt,omitempty"`
+		// ScannedKeys is the number of the keys of the collection scanned
+		// in all shards, Moved is the number of the documents moved to
+		// their owners.
+		ScannedKeys int64 `json:"scannedKeys"`
+		Moved       int64 `json:"moved"`
+		// Conflicts is the number of the documents not moved since their
+		// owners have newer ones, they are deleted from the old shards.
+		Conflicts int64  `json:"conflicts"`
+		Error     string `json:"error,omitempty"`
+	}
+
+	// QuarantinedDocument is a document with an invalid vector.
+	QuarantinedDocument struct {
+		ID        string `json:"id"`
+		Field     string `json:"field"`
+		Reason    string `json:"reason"`
+		Positions []int  `json:"positions,omitempty"`
+		// Location is where the document is moved to, it is empty in dry
+		// runs.
+		Location string `json:"location,omitempty"`
+	}
+)
+
+func (e *InvalidVectorError) Error() string {
+	switch e.Reason {
+	case InvalidVectorNaN, InvalidVectorInf:
+		return fmt.Sprintf("invalid vector %s of document %d: %s at positions %v", e.Field, e.Document, e.Reason, e.Positions)
+	case InvalidVectorMalformed:
+		return fmt.Sprintf("invalid vector %s of document %d: malformed", e.Field, e.Document)
+	default:
+		return fmt.Sprintf("invalid vector %s of document %d: %s, norm is %g", e.Field, e.Document, e.Reason, e.Norm)
+	}
+}
+
+// ValidateVectorValidationSpec validates the vector validation spec.
+func ValidateVectorValidationSpec(spec *VectorValidationSpec) error {
+	if spec == nil {
+		return nil
+	}
+	switch spec.ZeroNorm {
+	case "", ZeroNormAllow, ZeroNormReject:
+	default:
+		return fmt.Errorf("invalid zeroNorm %s of vector validation", spec.ZeroNorm)
+	}
+	if spec.MinNorm < 0 || spec.MaxNorm < 0 {
+		return fmt.Errorf("minNorm and maxNorm of vector validation cannot be negative")
+	}
+	if spec.MaxNorm > 0 && spec.MinNorm > spec.MaxNorm {
+		return fmt.Errorf("minNorm of vector validation cannot be greater than maxNorm")
+	}
+	return nil
+}
+
+// CheckVector checks a vector against the spec, the spec can be nil. It
+// returns the norm of the vector, and an error without the document and
+// field if the vector is invalid.
+func CheckVector[T float32 | float64](vec []T, spec *VectorValidationSpec) (float64, *InvalidVectorError) {
+	var nan, inf []int
+	var sum float64
+	for i, v := range vec {
+		f := float64(v)
+		switch {
+		case math.IsNaN(f):
+			nan = append(nan, i)
+		case math.IsInf(f, 0):
+			inf = append(inf, i)
+		default:
+			sum += f * f
+		}
+	}
+	if len(nan) > 0 {
+		return 0, &InvalidVectorError{Reason: InvalidVectorNaN, Positions: nan}
+	}
+	if len(inf) > 0 {
+		return 0, &InvalidVectorError{Reason: InvalidVectorInf, Positions: inf}
+	}
+
+	// the sum of squares of finite float64 components may overflow.
+	norm := math.Sqrt(sum)
+	if math.IsInf(norm, 0) {
+		return norm, &InvalidVectorError{Reason: InvalidVectorNorm, Norm: norm}
+	}
+	if spec == nil {
+		return norm, nil
+	}
+	if norm == 0 && (spec.ZeroNorm == ZeroNormReject || spec.Normalize) {
+		return norm, &InvalidVectorError{Reason: InvalidVectorZeroNorm}
+	}
+	if norm < spec.MinNorm || (spec.MaxNorm > 0 && norm > spec.MaxNorm) {
+		return norm, &InvalidVectorError{Reason: InvalidVectorNorm, Norm: norm}
+	}
+	return norm, nil
+}
+
+// ValidateDocumentVectors validates the vectors of the documents, which
+// are the fields of type []float32 or []float64. It returns the documents
+// whose vectors are normalized if the spec requires, the documents passed
+// in are not modified.
+func ValidateDocumentVectors(docs []map[string]any, spec *VectorValidationSpec) ([]map[string]any, error) {
+	normalize := spec != nil && spec.Normalize
+	result, copied := docs, false
+	for i, doc := range docs {
+		var normalized map[string]any
+		for field, value := range doc {
+			var norm float64
+			var err *InvalidVectorError
+			switch vec := value.(type) {
+			case []float32:
+				norm, err = CheckVector(vec, spec)
+			case []float64:
+				norm, err = CheckVector(vec, spec)
+			default:
+				continue
+			}
+			if err != nil {
+				err.Document, err.Field = i, field
+				return nil, err
+			}
+			if !normalize || norm == 1 {
+				continue
+			}
+			if normalized == nil {
+				normalized = maps.Clone(doc)
+			}
+			normalized[field] = normalizeVector(value, norm)
+		}
+		if normalized == nil {
+			continue
+		}
+		if !copied {
+			result = slices.Clone(docs)
+			copied = true
+		}
+		result[i] = normalized
+	}
+	return result, nil
+}
+
+func normalizeVector(value any, norm float64) any {
+	switch vec := value.(type) {
+	case []float32:
+		result := make([]float32, len(vec))
+		for i, v := range vec {
+			result[i] = float32(float64(v) / norm)
+		}
+		return result
+	case []float64:
+		result := make([]float64, len(vec))
+		for i, v := range vec {
+			result[i] = v / norm
+		}
+		return result
+	}
+	return value
+}
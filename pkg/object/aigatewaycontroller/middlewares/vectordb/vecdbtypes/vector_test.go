@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateVectorValidationSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(ValidateVectorValidationSpec(nil))
+	assert.Nil(ValidateVectorValidationSpec(&VectorValidationSpec{ZeroNorm: ZeroNormReject, MinNorm: 0.5, MaxNorm: 2}))
+	assert.NotNil(ValidateVectorValidationSpec(&VectorValidationSpec{ZeroNorm: "drop"}))
+	assert.NotNil(ValidateVectorValidationSpec(&VectorValidationSpec{MinNorm: -1}))
+	assert.NotNil(ValidateVectorValidationSpec(&VectorValidationSpec{MinNorm: 2, MaxNorm: 1}))
+}
+
+func TestCheckVector(t *testing.T) {
+	assert := assert.New(t)
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(1))
+
+	norm, err := CheckVector([]float32{3, 4}, nil)
+	assert.Nil(err)
+	assert.Equal(5.0, norm)
+
+	_, err = CheckVector([]float32{1, nan, 2, nan, inf}, nil)
+	assert.Equal(InvalidVectorNaN, err.Reason)
+	assert.Equal([]int{1, 3}, err.Positions)
+
+	_, err = CheckVector([]float64{1, math.Inf(-1)}, nil)
+	assert.Equal(InvalidVectorInf, err.Reason)
+	assert.Equal([]int{1}, err.Positions)
+
+	// the squares of finite components overflow.
+	_, err = CheckVector([]float64{math.MaxFloat64, math.MaxFloat64}, nil)
+	assert.Equal(InvalidVectorNorm, err.Reason)
+
+	_, err = CheckVector([]float32{0, 0}, nil)
+	assert.Nil(err)
+	_, err = CheckVector([]float32{0, 0}, &VectorValidationSpec{ZeroNorm: ZeroNormReject})
+	assert.Equal(InvalidVectorZeroNorm, err.Reason)
+	_, err = CheckVector([]float32{0, 0}, &VectorValidationSpec{Normalize: true})
+	assert.Equal(InvalidVectorZeroNorm, err.Reason)
+
+	spec := &VectorValidationSpec{MinNorm: 1, MaxNorm: 10}
+	_, err = CheckVector([]float32{0.1, 0.1}, spec)
+	assert.Equal(InvalidVectorNorm, err.Reason)
+	_, err = CheckVector([]float32{30, 40}, spec)
+	assert.Equal(InvalidVectorNorm, err.Reason)
+	assert.Equal(50.0, err.Norm)
+	_, err = CheckVector([]float32{3, 4}, spec)
+	assert.Nil(err)
+}
+
+func TestValidateDocumentVectors(t *testing.T) {
+	assert := assert.New(t)
+
+	docs := []map[string]any{
+		{"data": "a", "embedding": []float32{3, 4}},
+		{"data": "b", "embedding": []float64{0, 2}},
+	}
+	result, err := ValidateDocumentVectors(docs, nil)
+	assert.Nil(err)
+	assert.Equal(docs, result)
+
+	// the vectors are normalized in copies of the documents.
+	result, err = ValidateDocumentVectors(docs, &VectorValidationSpec{Normalize: true})
+	assert.Nil(err)
+	assert.Equal([]float32{0.6, 0.8}, result[0]["embedding"])
+	assert.Equal([]float64{0, 1}, result[1]["embedding"])
+	assert.Equal("a", result[0]["data"])
+	assert.Equal([]float32{3, 4}, docs[0]["embedding"])
+	assert.Equal([]float64{0, 2}, docs[1]["embedding"])
+
+	docs = append(docs, map[string]any{"embedding": []float32{1, float32(math.NaN())}})
+	_, err = ValidateDocumentVectors(docs, nil)
+	var vectorErr *InvalidVectorError
+	assert.True(errors.As(err, &vectorErr))
+	assert.Equal(2, vectorErr.Document)
+	assert.Equal("embedding", vectorErr.Field)
+	assert.Equal([]int{1}, vectorErr.Positions)
+	assert.Equal("invalid vector embedding of document 2: nan at positions [1]", err.Error())
+}
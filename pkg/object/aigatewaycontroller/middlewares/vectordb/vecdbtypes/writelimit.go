@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vecdbtypes
+
+import (
+	"fmt"
+	"math"
+)
+
+// Overflow policies of the write limit.
+const (
+	WriteOverflowDelay = "delay"
+	WriteOverflowDrop  = "drop"
+)
+
+// DefaultWriteQueueSize is the default maximum number of pending writes of
+// a collection.
+const DefaultWriteQueueSize = 1000
+
+// WriteLimitSpec is the token bucket limiting the document writes of a
+// collection.
+type WriteLimitSpec struct {
+	// Rate is the sustained number of documents written per second.
+	Rate float64 `json:"rate" jsonschema:"required"`
+	// Burst is the maximum number of documents written at once, default
+	// is the rate rounded up.
+	Burst int `json:"burst,omitempty"`
+	// QueueSize is the maximum number of pending writes of a collection,
+	// the writes exceeding it are dropped.
+	QueueSize int `json:"queueSize,omitempty"`
+	// Overflow is how the writes exceeding the rate are handled, delay
+	// keeps them in the queue until there are tokens, drop drops them.
+	Overflow string `json:"overflow,omitempty" jsonschema:"enum=,enum=delay,enum=drop"`
+}
+
+// ValidateWriteLimitSpec validates the spec of the write limit.
+func ValidateWriteLimitSpec(spec *WriteLimitSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.Rate <= 0 {
+		return fmt.Errorf("rate of write limit must be positive")
+	}
+	if spec.Burst < 0 {
+		return fmt.Errorf("burst of write limit cannot be negative")
+	}
+	if spec.QueueSize < 0 {
+		return fmt.Errorf("queueSize of write limit cannot be negative")
+	}
+	switch spec.Overflow {
+	case "", WriteOverflowDelay, WriteOverflowDrop:
+	default:
+		return fmt.Errorf("invalid overflow %s of write limit", spec.Overflow)
+	}
+	return nil
+}
+
+// GetBurst returns the burst of the write limit.
+func (spec *WriteLimitSpec) GetBurst() int {
+	if spec.Burst > 0 {
+		return spec.Burst
+	}
+	return DefaultWriteBurst(spec.Rate)
+}
+
+// DefaultWriteBurst returns the default burst of the rate.
+func DefaultWriteBurst(rate float64) int {
+	return max(1, int(math.Ceil(rate)))
+}
+
+// GetQueueSize returns the maximum number of pending writes.
+func (spec *WriteLimitSpec) GetQueueSize() int {
+	if spec.QueueSize > 0 {
+		return spec.QueueSize
+	}
+	return DefaultWriteQueueSize
+}
+
+// GetOverflow returns the overflow policy of the write limit.
+func (spec *WriteLimitSpec) GetOverflow() string {
+	if spec.Overflow != "" {
+		return spec.Overflow
+	}
+	return WriteOverflowDelay
+}
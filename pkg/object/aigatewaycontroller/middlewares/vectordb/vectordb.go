@@ -25,9 +25,29 @@ import (
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
 )
 
+var ErrReplaceNotSupported = vecdbtypes.ErrReplaceNotSupported
+
+var ErrDeleteNotSupported = vecdbtypes.ErrDeleteNotSupported
+
+var ErrTieringNotSupported = vecdbtypes.ErrTieringNotSupported
+
+var ErrScanNotSupported = vecdbtypes.ErrScanNotSupported
+
 var ErrSimilaritySearchNotFound = vecdbtypes.ErrSimilaritySearchNotFound
 
+// EmbeddingVersionField is the metadata field that records the embedding version of a document.
+const EmbeddingVersionField = vecdbtypes.EmbeddingVersionField
+
 type (
+	PayloadStoreSpec = vecdbtypes.PayloadStoreSpec
+	PayloadStats     = vecdbtypes.PayloadStats
+
+	InvalidVectorError   = vecdbtypes.InvalidVectorError
+	ScrubReport          = vecdbtypes.ScrubReport
+	IntegrityReport      = vecdbtypes.IntegrityReport
+	RebalanceReport      = vecdbtypes.RebalanceReport
+	ScopeMigrationReport = vecdbtypes.ScopeMigrationReport
+
 	Spec struct {
 		vecdbtypes.CommonSpec
 		Redis    *redisvector.RedisVectorDBSpec `json:"redis,omitempty"`
@@ -56,12 +76,46 @@ func New(spec *Spec) vecdbtypes.VectorDB {
 	}
 }
 
+// ScopeSpec composes the scope into the collection of the spec, the spec
+// is modified, so it should be a copy of the configured one.
+func ScopeSpec(spec *Spec, scope string) {
+	spec.Scope = scope
+	spec.CollectionName = vecdbtypes.ScopedName(scope, spec.CollectionName)
+}
+
 func ValidateSpec(spec *Spec) error {
 	if spec.Threshold <= 0 || spec.Threshold > 1.0 {
 		return fmt.Errorf("invalid threshold")
 	}
+	if err := vecdbtypes.ValidatePayloadStoreSpec(spec.PayloadStore); err != nil {
+		return err
+	}
+	if err := vecdbtypes.ValidateWriteLimitSpec(spec.WriteLimit); err != nil {
+		return err
+	}
+	if err := vecdbtypes.ValidateVectorValidationSpec(spec.VectorValidation); err != nil {
+		return err
+	}
+	if err := vecdbtypes.ValidateQueryLimitSpec(spec.QueryLimit); err != nil {
+		return err
+	}
+	if err := validateRescoringSpec(spec.Rescoring); err != nil {
+		return err
+	}
+	if err := vecdbtypes.ValidateFilterAliasSpec(spec.FilterAliases); err != nil {
+		return err
+	}
 	switch spec.Type {
 	case TypeRedis:
+		if spec.PayloadStore != nil && spec.Redis != nil && spec.Redis.Shards != nil {
+			return fmt.Errorf("payload store is not supported with redis shards")
+		}
+		// the searches of a threshold below 1 are range queries.
+		if spec.Threshold < 1 && spec.Redis != nil {
+			if err := redisvector.ValidateRangeDialect(spec.Redis.Dialect); err != nil {
+				return fmt.Errorf("redis vector %w", err)
+			}
+		}
 		return redisvector.ValidateSpec(spec.Redis)
 	case TypePostgres:
 		return pgvector.ValidateSpec(spec.Postgres)
@@ -0,0 +1,519 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+const (
+	// writeTimeout is the timeout of a queued write.
+	writeTimeout = 30 * time.Second
+	// maxWriteWait is the longest the drain loop sleeps before checking the
+	// limit again, so the rate adjusted by the admin API applies quickly.
+	maxWriteWait = 100 * time.Millisecond
+
+	// results of the queued writes.
+	writeResultWritten     = "written"
+	writeResultFailed      = "failed"
+	writeResultQueueFull   = "queueFull"
+	writeResultRateLimited = "rateLimited"
+	writeResultClosed      = "closed"
+)
+
+type (
+	WriteLimitSpec = vecdbtypes.WriteLimitSpec
+
+	// WriteQueueStatus is the status of the write queue of a collection.
+	WriteQueueStatus struct {
+		Collection string  `json:"collection"`
+		Rate       float64 `json:"rate"`
+		Burst      int     `json:"burst"`
+		Overflow   string  `json:"overflow"`
+		// OverrideUntil is when the rate adjusted by the admin API
+		// expires, it is empty if the rate is the one in the spec.
+		OverrideUntil string `json:"overrideUntil,omitempty"`
+		Depth         int    `json:"depth"`
+		QueueSize     int    `json:"queueSize"`
+		Written       int64  `json:"written"`
+		Failed        int64  `json:"failed"`
+		Dropped       int64  `json:"dropped"`
+	}
+
+	// QueuedHandler writes the documents of a collection through the write
+	// queue of the collection, searches are never queued or limited.
+	QueuedHandler struct {
+		VectorHandler
+		queue     *writeQueue
+		closeOnce sync.Once
+	}
+
+	// writeQueue writes the documents of a collection asynchronously, its
+	// drain loop limits the writes by a token bucket. The handlers of all
+	// generations of the same collection share the queue.
+	writeQueue struct {
+		collection string
+		notify     chan struct{}
+		done       chan struct{}
+		// refs is protected by writeQueuesLock.
+		refs int
+
+		lock     sync.Mutex
+		spec     *WriteLimitSpec
+		handler  VectorHandler
+		pending  []*writeTask
+		override *writeRateOverride
+		tokens   float64
+		last     time.Time
+
+		written atomic.Int64
+		failed  atomic.Int64
+		dropped atomic.Int64
+	}
+
+	// writeRateOverride is the rate adjusted temporarily by the admin API.
+	writeRateOverride struct {
+		rate  float64
+		burst int
+		until time.Time
+	}
+
+	writeTask struct {
+		docs    []map[string]any
+		options []vecdbtypes.HandlerInsertOption
+	}
+)
+
+// ErrWriteQueueNotFound means no write queue matches the collection.
+var ErrWriteQueueNotFound = errors.New("write queue not found")
+
+var (
+	writeQueuesLock sync.Mutex
+	writeQueues     = map[string]*writeQueue{}
+
+	writeMetricsOnce sync.Once
+	writeQueueDepth  *prometheus.GaugeVec
+	queuedWrites     *prometheus.CounterVec
+)
+
+var _ vecdbtypes.SchemaEnsurer = (*QueuedHandler)(nil)
+
+func initWriteMetrics() {
+	writeMetricsOnce.Do(func() {
+		writeQueueDepth = metricshub.VectorDBWriteQueueDepth.NewGauge()
+		queuedWrites = metricshub.VectorDBQueuedWrites.NewCounter()
+	})
+}
+
+// NewQueuedHandler returns the handler writing the documents of the
+// collection through the write queue of the collection, the queue is
+// created if it does not exist, otherwise its spec and handler are
+// replaced. The handler must be closed to release the queue.
+func NewQueuedHandler(collection string, handler VectorHandler, spec *WriteLimitSpec) *QueuedHandler {
+	initWriteMetrics()
+
+	writeQueuesLock.Lock()
+	defer writeQueuesLock.Unlock()
+
+	q := writeQueues[collection]
+	if q == nil {
+		q = &writeQueue{
+			collection: collection,
+			notify:     make(chan struct{}, 1),
+			done:       make(chan struct{}),
+			tokens:     float64(spec.GetBurst()),
+			last:       time.Now(),
+		}
+		writeQueues[collection] = q
+		go q.run()
+	}
+	q.refs++
+
+	q.lock.Lock()
+	q.spec = spec
+	q.handler = handler
+	q.lock.Unlock()
+	return &QueuedHandler{VectorHandler: handler, queue: q}
+}
+
+// InsertDocuments queues the documents, they are written asynchronously.
+// The documents are dropped if the queue is full, and the drops are
+// counted by metrics.
+func (h *QueuedHandler) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	h.queue.enqueue(&writeTask{docs: docs, options: options})
+	return nil, nil
+}
+
+// DeleteDocuments deletes the documents without queuing, it fails if the
+// handler does not support deleting.
+func (h *QueuedHandler) DeleteDocuments(ctx context.Context, ids []string) (int64, error) {
+	deleter, ok := h.VectorHandler.(vecdbtypes.DocumentDeleter)
+	if !ok {
+		return 0, vecdbtypes.ErrDeleteNotSupported
+	}
+	return deleter.DeleteDocuments(ctx, ids)
+}
+
+// DeleteByFilter deletes the documents matching the filters without
+// queuing, it fails if the handler does not support deleting by filters.
+func (h *QueuedHandler) DeleteByFilter(ctx context.Context, filters ...*vecdbtypes.TagFilter) (int64, error) {
+	deleter, ok := h.VectorHandler.(vecdbtypes.FilterDeleter)
+	if !ok {
+		return 0, vecdbtypes.ErrDeleteNotSupported
+	}
+	return deleter.DeleteByFilter(ctx, filters...)
+}
+
+// Now returns the current time of the database, it fails if the handler
+// does not support tiering.
+func (h *QueuedHandler) Now(ctx context.Context) (time.Time, error) {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return time.Time{}, vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.Now(ctx)
+}
+
+// TouchDocuments records the documents are hit, it fails if the handler
+// does not support tiering.
+func (h *QueuedHandler) TouchDocuments(ctx context.Context, ids []string, at time.Time) error {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.TouchDocuments(ctx, ids, at)
+}
+
+// ClaimIdleDocuments claims the documents not hit since the time, it fails
+// if the handler does not support tiering.
+func (h *QueuedHandler) ClaimIdleDocuments(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return nil, vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.ClaimIdleDocuments(ctx, since, limit)
+}
+
+// GetDocumentFields returns the fields of the document, it fails if the
+// handler does not support tiering.
+func (h *QueuedHandler) GetDocumentFields(ctx context.Context, id string, fields []string) (map[string]string, error) {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return nil, vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.GetDocumentFields(ctx, id, fields)
+}
+
+// SetDocumentFields sets the fields of the document, it fails if the
+// handler does not support tiering.
+func (h *QueuedHandler) SetDocumentFields(ctx context.Context, id string, fields map[string]string) error {
+	tierer, ok := h.VectorHandler.(vecdbtypes.DocumentTierer)
+	if !ok {
+		return vecdbtypes.ErrTieringNotSupported
+	}
+	return tierer.SetDocumentFields(ctx, id, fields)
+}
+
+// EnsureSchema ensures the collection of the handler exists.
+func (h *QueuedHandler) EnsureSchema(ctx context.Context) error {
+	if ensurer, ok := h.VectorHandler.(vecdbtypes.SchemaEnsurer); ok {
+		return ensurer.EnsureSchema(ctx)
+	}
+	return nil
+}
+
+// Close releases the write queue and closes the handler, the queue is
+// stopped when all of its handlers are closed, and the pending writes are
+// dropped.
+func (h *QueuedHandler) Close() {
+	h.closeOnce.Do(func() {
+		writeQueuesLock.Lock()
+		q := h.queue
+		q.refs--
+		if q.refs == 0 {
+			delete(writeQueues, q.collection)
+			close(q.done)
+		}
+		writeQueuesLock.Unlock()
+
+		if closer, ok := h.VectorHandler.(vecdbtypes.HandlerCloser); ok {
+			closer.Close()
+		}
+	})
+}
+
+func (q *writeQueue) count(result string, n int) {
+	if queuedWrites != nil {
+		queuedWrites.With(prometheus.Labels{"collection": q.collection, "result": result}).Add(float64(n))
+	}
+}
+
+// setDepth updates the depth metric, the lock must be held.
+func (q *writeQueue) setDepth() {
+	if writeQueueDepth != nil {
+		writeQueueDepth.With(prometheus.Labels{"collection": q.collection}).Set(float64(len(q.pending)))
+	}
+}
+
+func (q *writeQueue) enqueue(task *writeTask) {
+	q.lock.Lock()
+	if len(q.pending) >= q.spec.GetQueueSize() {
+		q.lock.Unlock()
+		q.dropped.Add(int64(len(task.docs)))
+		q.count(writeResultQueueFull, len(task.docs))
+		return
+	}
+	q.pending = append(q.pending, task)
+	q.setDepth()
+	q.lock.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next pending task, it returns nil if the queue is
+// stopped.
+func (q *writeQueue) next() *writeTask {
+	for {
+		q.lock.Lock()
+		if len(q.pending) > 0 {
+			task := q.pending[0]
+			q.pending[0] = nil
+			q.pending = q.pending[1:]
+			q.setDepth()
+			q.lock.Unlock()
+			return task
+		}
+		q.lock.Unlock()
+
+		select {
+		case <-q.done:
+			return nil
+		case <-q.notify:
+		}
+	}
+}
+
+// limits returns the rate and the burst in effect.
+func (q *writeQueue) limits(now time.Time) (float64, int) {
+	if o := q.override; o != nil {
+		if now.Before(o.until) {
+			return o.rate, o.burst
+		}
+		q.override = nil
+		logger.Infof("write rate override of collection %s expires", q.collection)
+	}
+	return q.spec.Rate, q.spec.GetBurst()
+}
+
+// acquire takes n tokens from the bucket. It waits for the tokens if the
+// overflow policy is delay, and returns false if the tokens are not
+// available with the drop policy, or the queue is stopped.
+func (q *writeQueue) acquire(n int) bool {
+	for {
+		q.lock.Lock()
+		now := time.Now()
+		rate, burst := q.limits(now)
+		q.tokens = min(float64(burst), q.tokens+now.Sub(q.last).Seconds()*rate)
+		q.last = now
+		// a write larger than the burst waits for a full bucket.
+		need := float64(min(n, burst))
+		if q.tokens >= need {
+			q.tokens -= need
+			q.lock.Unlock()
+			return true
+		}
+		if q.spec.GetOverflow() == vecdbtypes.WriteOverflowDrop {
+			q.lock.Unlock()
+			return false
+		}
+		wait := maxWriteWait
+		if rate > 0 {
+			wait = min(wait, time.Duration((need-q.tokens)/rate*float64(time.Second)))
+		}
+		q.lock.Unlock()
+
+		select {
+		case <-q.done:
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (q *writeQueue) run() {
+	for {
+		task := q.next()
+		if task == nil {
+			q.dropPending()
+			return
+		}
+		n := len(task.docs)
+		if !q.acquire(n) {
+			q.dropped.Add(int64(n))
+			select {
+			case <-q.done:
+				q.count(writeResultClosed, n)
+			default:
+				q.count(writeResultRateLimited, n)
+			}
+			continue
+		}
+
+		q.lock.Lock()
+		handler := q.handler
+		q.lock.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		_, err := handler.InsertDocuments(ctx, task.docs, task.options...)
+		cancel()
+		if err != nil {
+			logger.Errorf("failed to write %d documents to collection %s: %v", n, q.collection, err)
+			q.failed.Add(int64(n))
+			q.count(writeResultFailed, n)
+			continue
+		}
+		q.written.Add(int64(n))
+		q.count(writeResultWritten, n)
+	}
+}
+
+// dropPending drops the pending writes of the stopped queue.
+func (q *writeQueue) dropPending() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := 0
+	for _, task := range q.pending {
+		n += len(task.docs)
+	}
+	q.pending = nil
+	q.setDepth()
+	if n > 0 {
+		q.dropped.Add(int64(n))
+		q.count(writeResultClosed, n)
+		logger.Warnf("drop %d pending writes of collection %s as its write queue is stopped", n, q.collection)
+	}
+}
+
+func (q *writeQueue) status() *WriteQueueStatus {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	rate, burst := q.limits(time.Now())
+	s := &WriteQueueStatus{
+		Collection: q.collection,
+		Rate:       rate,
+		Burst:      burst,
+		Overflow:   q.spec.GetOverflow(),
+		Depth:      len(q.pending),
+		QueueSize:  q.spec.GetQueueSize(),
+		Written:    q.written.Load(),
+		Failed:     q.failed.Load(),
+		Dropped:    q.dropped.Load(),
+	}
+	if q.override != nil {
+		s.OverrideUntil = q.override.until.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// WriteQueueStatuses returns the statuses of the write queues of the
+// collections in the scope of this member, sorted by collection.
+func WriteQueueStatuses(scope string) []*WriteQueueStatus {
+	writeQueuesLock.Lock()
+	queues := make([]*writeQueue, 0, len(writeQueues))
+	for _, q := range writeQueues {
+		if vecdbtypes.InScope(scope, q.collection) {
+			queues = append(queues, q)
+		}
+	}
+	writeQueuesLock.Unlock()
+
+	statuses := make([]*WriteQueueStatus, 0, len(queues))
+	for _, q := range queues {
+		statuses = append(statuses, q.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Collection < statuses[j].Collection
+	})
+	return statuses
+}
+
+// SetWriteRate adjusts the rate of the write queue of the collection, or
+// of all write queues in the scope if collection is empty, for the
+// duration. The collections out of the scope are never adjusted. A rate
+// of 0 pauses the writes, and burst defaults to the rate rounded up. It
+// returns the statuses of the adjusted queues.
+func SetWriteRate(scope, collection string, rate float64, burst int, duration time.Duration) ([]*WriteQueueStatus, error) {
+	if rate < 0 {
+		return nil, fmt.Errorf("rate cannot be negative")
+	}
+	if burst < 0 {
+		return nil, fmt.Errorf("burst cannot be negative")
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("duration must be positive")
+	}
+	if burst == 0 {
+		burst = vecdbtypes.DefaultWriteBurst(rate)
+	}
+
+	writeQueuesLock.Lock()
+	var queues []*writeQueue
+	for _, q := range writeQueues {
+		if vecdbtypes.InScope(scope, q.collection) && (collection == "" || q.collection == collection) {
+			queues = append(queues, q)
+		}
+	}
+	writeQueuesLock.Unlock()
+	if len(queues) == 0 {
+		if collection == "" {
+			return nil, ErrWriteQueueNotFound
+		}
+		return nil, fmt.Errorf("%w: collection %s", ErrWriteQueueNotFound, collection)
+	}
+
+	until := time.Now().Add(duration)
+	statuses := make([]*WriteQueueStatus, 0, len(queues))
+	for _, q := range queues {
+		q.lock.Lock()
+		q.override = &writeRateOverride{rate: rate, burst: burst, until: until}
+		q.tokens = min(q.tokens, float64(burst))
+		q.lock.Unlock()
+		logger.Infof("write rate of collection %s is set to %g/s with burst %d until %s", q.collection, rate, burst, until.Format(time.RFC3339))
+		statuses = append(statuses, q.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Collection < statuses[j].Collection
+	})
+	return statuses, nil
+}
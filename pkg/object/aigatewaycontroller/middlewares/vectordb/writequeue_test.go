@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vectordb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// countingHandler counts the written documents, the searches and the
+// closes.
+type countingHandler struct {
+	lock     sync.Mutex
+	written  int
+	searches int
+	closed   int
+}
+
+func (h *countingHandler) InsertDocuments(ctx context.Context, docs []map[string]any, options ...vecdbtypes.HandlerInsertOption) ([]string, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.written += len(docs)
+	return nil, nil
+}
+
+func (h *countingHandler) SimilaritySearch(ctx context.Context, options ...vecdbtypes.HandlerSearchOption) ([]map[string]any, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.searches++
+	return nil, nil
+}
+
+func (h *countingHandler) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed++
+}
+
+func (h *countingHandler) getWritten() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.written
+}
+
+func writeQueueStatus(collection string) *WriteQueueStatus {
+	for _, s := range WriteQueueStatuses("") {
+		if s.Collection == collection {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestWriteQueueDrop(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &countingHandler{}
+	h := NewQueuedHandler("drop", inner, &WriteLimitSpec{Rate: 1, Burst: 2, Overflow: vecdbtypes.WriteOverflowDrop})
+	defer h.Close()
+
+	for i := 0; i < 5; i++ {
+		ids, err := h.InsertDocuments(context.Background(), []map[string]any{{"i": i}})
+		assert.NoError(err)
+		assert.Nil(ids)
+	}
+	assert.Eventually(func() bool {
+		s := writeQueueStatus("drop")
+		return s.Written+s.Dropped == 5
+	}, time.Second, 10*time.Millisecond)
+
+	s := writeQueueStatus("drop")
+	assert.EqualValues(2, s.Written)
+	assert.EqualValues(3, s.Dropped)
+	assert.Equal(2, inner.getWritten())
+}
+
+func TestWriteQueueDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &countingHandler{}
+	h := NewQueuedHandler("delay", inner, &WriteLimitSpec{Rate: 20, Burst: 1})
+	defer h.Close()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		h.InsertDocuments(context.Background(), []map[string]any{{"i": i}})
+	}
+	assert.Eventually(func() bool {
+		return inner.getWritten() == 5
+	}, 2*time.Second, 5*time.Millisecond)
+	// the first write takes the burst, the others wait 50ms each.
+	assert.GreaterOrEqual(time.Since(start), 150*time.Millisecond)
+	assert.EqualValues(0, writeQueueStatus("delay").Dropped)
+}
+
+func TestWriteQueueOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &countingHandler{}
+	spec := &WriteLimitSpec{Rate: 1000, QueueSize: 2}
+	h := NewQueuedHandler("override", inner, spec)
+	// the handlers of the same collection share the queue.
+	h2 := NewQueuedHandler("override", inner, spec)
+	defer h2.Close()
+
+	_, err := SetWriteRate("", "unknown", 0, 0, time.Second)
+	assert.ErrorIs(err, ErrWriteQueueNotFound)
+	_, err = SetWriteRate("", "override", -1, 0, time.Second)
+	assert.Error(err)
+
+	// pause the writes.
+	statuses, err := SetWriteRate("", "override", 0, 0, 200*time.Millisecond)
+	assert.NoError(err)
+	assert.Len(statuses, 1)
+	assert.Equal(0.0, statuses[0].Rate)
+	assert.Equal(1, statuses[0].Burst)
+	assert.NotEmpty(statuses[0].OverrideUntil)
+
+	// drain the tokens left by the spec.
+	h.InsertDocuments(context.Background(), []map[string]any{{"i": 0}})
+	assert.Eventually(func() bool {
+		return inner.getWritten() == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// one write waits for the token, two are pending, and the last one
+	// is dropped as the queue is full.
+	for i := 0; i < 4; i++ {
+		h.InsertDocuments(context.Background(), []map[string]any{{"i": i}})
+		time.Sleep(10 * time.Millisecond)
+	}
+	s := writeQueueStatus("override")
+	assert.Equal(2, s.Depth)
+	assert.EqualValues(1, s.Dropped)
+	assert.Equal(1, inner.getWritten())
+
+	// searches are never limited.
+	_, err = h.SimilaritySearch(context.Background())
+	assert.NoError(err)
+	assert.Equal(1, inner.searches)
+
+	// the writes are resumed once the override expires.
+	assert.Eventually(func() bool {
+		return inner.getWritten() == 4
+	}, 2*time.Second, 10*time.Millisecond)
+	s = writeQueueStatus("override")
+	assert.Empty(s.OverrideUntil)
+	assert.Equal(1000.0, s.Rate)
+
+	// the queue is kept until all of its handlers are closed.
+	h.Close()
+	h.Close()
+	assert.NotNil(writeQueueStatus("override"))
+}
+
+func TestWriteQueueClose(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &countingHandler{}
+	limited := NewLimitedHandler(queryLimitTestSpec("redis://write-queue-close:6379", &QueryLimitSpec{MaxConcurrency: 1}), inner, vecdbtypes.QueryPriorityHigh)
+	h := NewQueuedHandler("close", limited, &WriteLimitSpec{Rate: 1})
+	_, err := SetWriteRate("", "close", 0, 0, time.Minute)
+	assert.NoError(err)
+	// the first write takes the token of the spec, the other ones wait.
+	for i := 0; i < 3; i++ {
+		h.InsertDocuments(context.Background(), []map[string]any{{"i": i}})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	h.Close()
+	h.Close()
+	assert.Nil(writeQueueStatus("close"))
+	// the handler is closed once, through the wrappers.
+	assert.Equal(1, inner.closed)
+	_, err = SetWriteRate("", "close", 1, 0, time.Minute)
+	assert.ErrorIs(err, ErrWriteQueueNotFound)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(1, inner.getWritten())
+}
+
+func TestWriteQueueScope(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &countingHandler{}
+	staging := NewQueuedHandler("staging_scoped", inner, &WriteLimitSpec{Rate: 1000})
+	defer staging.Close()
+	prod := NewQueuedHandler("prod_scoped", inner, &WriteLimitSpec{Rate: 1000})
+	defer prod.Close()
+
+	collections := func(scope string) []string {
+		var names []string
+		for _, s := range WriteQueueStatuses(scope) {
+			names = append(names, s.Collection)
+		}
+		return names
+	}
+	assert.Equal([]string{"staging_scoped"}, collections("staging"))
+	assert.Subset(collections(""), []string{"prod_scoped", "staging_scoped"})
+
+	// the queues of other scopes are never adjusted.
+	_, err := SetWriteRate("staging", "prod_scoped", 0, 0, time.Minute)
+	assert.ErrorIs(err, ErrWriteQueueNotFound)
+	statuses, err := SetWriteRate("staging", "", 0, 0, time.Minute)
+	assert.NoError(err)
+	assert.Len(statuses, 1)
+	assert.Equal("staging_scoped", statuses[0].Collection)
+	assert.Empty(writeQueueStatus("prod_scoped").OverrideUntil)
+}
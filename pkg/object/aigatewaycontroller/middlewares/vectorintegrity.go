@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var (
+	_ IntegrityChecker = (*semanticCacheMiddleware)(nil)
+	_ IntegrityChecker = (*retrievalMiddleware)(nil)
+	_ Closer           = (*retrievalMiddleware)(nil)
+)
+
+// integrityCollection is a collection to check and its vector database.
+type integrityCollection struct {
+	db     vectordb.VectorDB
+	dbSpec *vectordb.Spec
+	names  []string
+}
+
+// startIntegrityChecks starts checking the collections in the background.
+func startIntegrityChecks(collections []*integrityCollection, repair bool) (*IntegrityResult, error) {
+	result := &IntegrityResult{Reports: []*vectordb.IntegrityReport{}}
+	for _, c := range collections {
+		checker, ok := c.db.(vecdbtypes.IntegrityChecker)
+		if !ok {
+			return nil, fmt.Errorf("vectorDB %s does not support integrity checks", c.dbSpec.Type)
+		}
+		for _, name := range c.names {
+			report, err := checker.StartIntegrityCheck(name, repair)
+			if err != nil {
+				return result, fmt.Errorf("failed to start integrity check of collection %s: %w", name, err)
+			}
+			result.Reports = append(result.Reports, report)
+		}
+	}
+	return result, nil
+}
+
+// integrityReports returns the reports of the last checks of the
+// collections.
+func integrityReports(collections []*integrityCollection) *IntegrityResult {
+	result := &IntegrityResult{Reports: []*vectordb.IntegrityReport{}}
+	for _, c := range collections {
+		checker, ok := c.db.(vecdbtypes.IntegrityChecker)
+		if !ok {
+			continue
+		}
+		for _, name := range c.names {
+			if report := checker.IntegrityReport(name); report != nil {
+				result.Reports = append(result.Reports, report)
+			}
+		}
+	}
+	return result
+}
+
+// scheduleIntegrityChecks schedules the checks of the collections, the
+// returned stops should be called on close.
+func scheduleIntegrityChecks(collections []*integrityCollection) []func() {
+	stops := []func(){}
+	for _, c := range collections {
+		if checker, ok := c.db.(vecdbtypes.IntegrityChecker); ok {
+			stops = append(stops, checker.ScheduleIntegrityChecks(c.names))
+		}
+	}
+	return stops
+}
+
+func (m *semanticCacheMiddleware) integrityCollections() []*integrityCollection {
+	handlers := []*semanticCacheVectorHandler{m.vectorHandler}
+	if m.fallbackVectorHandler != nil {
+		handlers = append(handlers, m.fallbackVectorHandler)
+	}
+	collections := []*integrityCollection{}
+	for _, h := range handlers {
+		if h.dbSpec.Type != vectordb.TypeRedis {
+			continue
+		}
+		collections = append(collections, &integrityCollection{
+			db:     h.vectorDB,
+			dbSpec: h.dbSpec,
+			names:  getRedisDBNames(h.dbSpec.CollectionName),
+		})
+	}
+	return collections
+}
+
+// StartIntegrityCheck starts checking the collections of the cache,
+// including the fallback.
+func (m *semanticCacheMiddleware) StartIntegrityCheck(repair bool) (*IntegrityResult, error) {
+	return startIntegrityChecks(m.integrityCollections(), repair)
+}
+
+// IntegrityReports returns the reports of the last checks of the cache.
+func (m *semanticCacheMiddleware) IntegrityReports() *IntegrityResult {
+	return integrityReports(m.integrityCollections())
+}
+
+func (m *retrievalMiddleware) integrityCollections() []*integrityCollection {
+	dbSpec := m.spec.Retrieval.VectorDB
+	if dbSpec.Type != vectordb.TypeRedis {
+		return nil
+	}
+	return []*integrityCollection{{
+		db:     m.vectorDB,
+		dbSpec: dbSpec,
+		names:  []string{dbSpec.CollectionName},
+	}}
+}
+
+// StartIntegrityCheck starts checking the collection of the retrieved
+// documents.
+func (m *retrievalMiddleware) StartIntegrityCheck(repair bool) (*IntegrityResult, error) {
+	collections := m.integrityCollections()
+	if len(collections) == 0 {
+		return nil, fmt.Errorf("vectorDB %s does not support integrity checks", m.spec.Retrieval.VectorDB.Type)
+	}
+	return startIntegrityChecks(collections, repair)
+}
+
+// IntegrityReports returns the reports of the last checks of the
+// collection.
+func (m *retrievalMiddleware) IntegrityReports() *IntegrityResult {
+	return integrityReports(m.integrityCollections())
+}
+
+// Close stops the scheduled integrity checks, the running re-embedding
+// and the background jobs of the handler.
+func (m *retrievalMiddleware) Close() {
+	for _, stop := range m.stopIntegrityChecks {
+		stop()
+	}
+	if _, err := m.AbortReembed(); err == nil {
+		logger.Infof("re-embedding of middleware %s aborted on close", m.spec.Name)
+	}
+	m.handlerLock.Lock()
+	defer m.handlerLock.Unlock()
+	if closer, ok := m.handler.(vecdbtypes.HandlerCloser); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var (
+	_ Rebalancer = (*semanticCacheMiddleware)(nil)
+	_ Rebalancer = (*retrievalMiddleware)(nil)
+)
+
+// startRebalances starts rebalancing the Redis collections in the
+// background, it fails if none of them is sharded.
+func startRebalances(collections []*integrityCollection) (*RebalanceResult, error) {
+	result := &RebalanceResult{Reports: []*vectordb.RebalanceReport{}}
+	for _, c := range collections {
+		if c.dbSpec.Redis == nil || c.dbSpec.Redis.Shards == nil {
+			continue
+		}
+		rebalancer, ok := c.db.(vecdbtypes.Rebalancer)
+		if !ok {
+			return nil, fmt.Errorf("vectorDB %s does not support rebalancing", c.dbSpec.Type)
+		}
+		for _, name := range c.names {
+			report, err := rebalancer.StartRebalance(name)
+			if err != nil {
+				return result, fmt.Errorf("failed to start rebalance of collection %s: %w", name, err)
+			}
+			result.Reports = append(result.Reports, report)
+		}
+	}
+	if len(result.Reports) == 0 {
+		return nil, fmt.Errorf("no collection is sharded")
+	}
+	return result, nil
+}
+
+// rebalanceReports returns the reports of the last rebalances of the
+// collections.
+func rebalanceReports(collections []*integrityCollection) *RebalanceResult {
+	result := &RebalanceResult{Reports: []*vectordb.RebalanceReport{}}
+	for _, c := range collections {
+		rebalancer, ok := c.db.(vecdbtypes.Rebalancer)
+		if !ok {
+			continue
+		}
+		for _, name := range c.names {
+			if report := rebalancer.RebalanceReport(name); report != nil {
+				result.Reports = append(result.Reports, report)
+			}
+		}
+	}
+	return result
+}
+
+// StartRebalance starts moving the documents of the sharded collections
+// of the cache, including the fallback, to the shards owning them.
+func (m *semanticCacheMiddleware) StartRebalance() (*RebalanceResult, error) {
+	return startRebalances(m.integrityCollections())
+}
+
+// RebalanceReports returns the reports of the last rebalances of the
+// cache.
+func (m *semanticCacheMiddleware) RebalanceReports() *RebalanceResult {
+	return rebalanceReports(m.integrityCollections())
+}
+
+// StartRebalance starts moving the documents of the collection of the
+// retrieved documents to the shards owning them.
+func (m *retrievalMiddleware) StartRebalance() (*RebalanceResult, error) {
+	return startRebalances(m.integrityCollections())
+}
+
+// RebalanceReports returns the reports of the last rebalances of the
+// collection.
+func (m *retrievalMiddleware) RebalanceReports() *RebalanceResult {
+	return rebalanceReports(m.integrityCollections())
+}
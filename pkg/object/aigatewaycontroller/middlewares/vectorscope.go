@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var (
+	_ ScopeMigrator = (*semanticCacheMiddleware)(nil)
+	_ ScopeMigrator = (*retrievalMiddleware)(nil)
+)
+
+// migrateCollections moves the unscoped collections of the names under the
+// scope of the vector database.
+func migrateCollections(ctx context.Context, db vectordb.VectorDB, dbSpec *vectordb.Spec, names []string, result *ScopeMigrationResult) error {
+	if dbSpec.Scope == "" {
+		return fmt.Errorf("collection %s is not scoped", dbSpec.CollectionName)
+	}
+	migrator, ok := db.(vecdbtypes.ScopeMigrator)
+	if !ok {
+		return fmt.Errorf("vectorDB %s does not support scope migration", dbSpec.Type)
+	}
+	for _, name := range names {
+		report, err := migrator.MigrateToScope(ctx, name)
+		if report != nil {
+			result.Reports = append(result.Reports, report)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to migrate collection %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateToScope moves the collections of the cache, including the
+// fallback, under the scope. The handlers are invalidated, so they verify
+// the moved collections again.
+func (m *semanticCacheMiddleware) MigrateToScope(ctx context.Context) (*ScopeMigrationResult, error) {
+	result := &ScopeMigrationResult{Reports: []*vectordb.ScopeMigrationReport{}}
+	handlers := []*semanticCacheVectorHandler{m.vectorHandler}
+	if m.fallbackVectorHandler != nil {
+		handlers = append(handlers, m.fallbackVectorHandler)
+	}
+	for _, h := range handlers {
+		names := getPostgresTableNames(h.dbSpec.Scope)
+		if h.dbSpec.Type == vectordb.TypeRedis {
+			names = getRedisDBNames(h.dbSpec.CollectionName)
+		}
+		if err := migrateCollections(ctx, h.vectorDB, h.dbSpec, names, result); err != nil {
+			return result, err
+		}
+		h.invalidate()
+	}
+	return result, nil
+}
+
+// MigrateToScope moves the collection of the retrieved documents under the
+// scope.
+func (m *retrievalMiddleware) MigrateToScope(ctx context.Context) (*ScopeMigrationResult, error) {
+	result := &ScopeMigrationResult{Reports: []*vectordb.ScopeMigrationReport{}}
+	dbSpec := m.spec.Retrieval.VectorDB
+	err := migrateCollections(ctx, m.vectorDB, dbSpec, []string{dbSpec.CollectionName}, result)
+	return result, err
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func TestScopeSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	newDBSpec := func(name string) *vectordb.Spec {
+		return &vectordb.Spec{CommonSpec: vecdbtypes.CommonSpec{Type: vectordb.TypeRedis, CollectionName: name}}
+	}
+	spec := &MiddlewareSpec{
+		Name: "cache",
+		Kind: "SemanticCache",
+		SemanticCache: &SemanticCacheSpec{
+			VectorDB: newDBSpec("cache"),
+			Fallback: &SemanticCacheFallbackSpec{VectorDB: newDBSpec("cache_v1")},
+		},
+	}
+	assert.Same(spec, ScopeSpec(spec, ""))
+
+	scoped := ScopeSpec(spec, "dev")
+	assert.Equal("dev_cache", scoped.SemanticCache.VectorDB.CollectionName)
+	assert.Equal("dev", scoped.SemanticCache.VectorDB.Scope)
+	assert.Equal("dev_cache_v1", scoped.SemanticCache.Fallback.VectorDB.CollectionName)
+	// the configured spec is not modified.
+	assert.Equal("cache", spec.SemanticCache.VectorDB.CollectionName)
+	assert.Equal("", spec.SemanticCache.VectorDB.Scope)
+
+	spec = &MiddlewareSpec{Name: "rag", Kind: "Retrieval", Retrieval: &RetrievalSpec{VectorDB: newDBSpec("docs")}}
+	scoped = ScopeSpec(spec, "prod")
+	assert.Equal("prod_docs", scoped.Retrieval.VectorDB.CollectionName)
+
+	// the tables of the semantic cache are named by the scope.
+	assert.Equal("semantic_cache_chat_non_stream", getPostgresTableName("", aicontext.ResponseTypeChatCompletions, false))
+	assert.Equal("dev_semantic_cache_chat_non_stream", getPostgresTableName("dev", aicontext.ResponseTypeChatCompletions, false))
+	for _, name := range getPostgresTableNames("dev") {
+		assert.True(vecdbtypes.InScope("dev", name))
+	}
+}
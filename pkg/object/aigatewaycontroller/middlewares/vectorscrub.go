@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package middlewares
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+var (
+	_ VectorScrubber = (*semanticCacheMiddleware)(nil)
+	_ VectorScrubber = (*retrievalMiddleware)(nil)
+)
+
+// scrubCollections scrubs the invalid vectors of the collections.
+func scrubCollections(ctx context.Context, db vectordb.VectorDB, dbSpec *vectordb.Spec, names []string, dryRun bool, result *ScrubResult) error {
+	scrubber, ok := db.(vecdbtypes.VectorScrubber)
+	if !ok {
+		return fmt.Errorf("vectorDB %s does not support scrubbing", dbSpec.Type)
+	}
+	for _, name := range names {
+		report, err := scrubber.ScrubVectors(ctx, name, dryRun)
+		if report != nil {
+			result.Reports = append(result.Reports, report)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to scrub collection %s: %w", name, err)
+		}
+		if len(report.Quarantined) > 0 {
+			logger.Warnf("found %d documents with invalid vectors in collection %s, dry run: %v", len(report.Quarantined), name, dryRun)
+		}
+	}
+	return nil
+}
+
+// ScrubVectors scrubs the collections of the cache, including the fallback.
+func (m *semanticCacheMiddleware) ScrubVectors(ctx context.Context, dryRun bool) (*ScrubResult, error) {
+	result := &ScrubResult{}
+	handlers := []*semanticCacheVectorHandler{m.vectorHandler}
+	if m.fallbackVectorHandler != nil {
+		handlers = append(handlers, m.fallbackVectorHandler)
+	}
+	for _, h := range handlers {
+		names := getPostgresTableNames(h.dbSpec.Scope)
+		if h.dbSpec.Type == vectordb.TypeRedis {
+			names = getRedisDBNames(h.dbSpec.CollectionName)
+		}
+		if err := scrubCollections(ctx, h.vectorDB, h.dbSpec, names, dryRun, result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// ScrubVectors scrubs the collection of the retrieved documents.
+func (m *retrievalMiddleware) ScrubVectors(ctx context.Context, dryRun bool) (*ScrubResult, error) {
+	result := &ScrubResult{}
+	dbSpec := m.spec.Retrieval.VectorDB
+	err := scrubCollections(ctx, m.vectorDB, dbSpec, []string{dbSpec.CollectionName}, dryRun, result)
+	return result, err
+}
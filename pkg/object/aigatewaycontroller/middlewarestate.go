@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+type (
+	// MiddlewareState is the runtime state of a middleware.
+	MiddlewareState struct {
+		Name    string `json:"name"`
+		Kind    string `json:"kind"`
+		Enabled bool   `json:"enabled"`
+		// UpdatedBy and UpdatedAt record the last runtime toggle, they are
+		// empty if the state comes from the spec.
+		UpdatedBy string `json:"updatedBy,omitempty"`
+		UpdatedAt string `json:"updatedAt,omitempty"`
+	}
+
+	// middlewareStates maps middleware names to their states. It is never
+	// modified after creation, toggles replace it as a whole, so a request
+	// sees the same states from start to end.
+	middlewareStates map[string]*MiddlewareState
+)
+
+// initMiddlewareStates initializes the middleware states from the spec. The
+// runtime toggles of the previous generation are kept, so re-applying the
+// spec does not silently re-enable a middleware disabled for an incident.
+func (agc *AIGatewayController) initMiddlewareStates(prev *AIGatewayController) {
+	var prevStates middlewareStates
+	if prev != nil {
+		prevStates = prev.getMiddlewareStates()
+	}
+
+	states := middlewareStates{}
+	for _, m := range agc.spec.Middlewares {
+		state := &MiddlewareState{
+			Name:    m.Name,
+			Kind:    m.Kind,
+			Enabled: !m.Disabled,
+		}
+		if prevState, ok := prevStates[m.Name]; ok && prevState.Kind == m.Kind && prevState.UpdatedBy != "" {
+			state = prevState
+		}
+		states[m.Name] = state
+	}
+	agc.middlewareStates.Store(&states)
+}
+
+func (agc *AIGatewayController) getMiddlewareStates() middlewareStates {
+	states := agc.middlewareStates.Load()
+	if states == nil {
+		return nil
+	}
+	return *states
+}
+
+// setMiddlewareEnabled enables or disables a middleware at runtime.
+func (agc *AIGatewayController) setMiddlewareEnabled(name string, enabled bool, operator string) (*MiddlewareState, error) {
+	agc.middlewareStatesLock.Lock()
+	defer agc.middlewareStatesLock.Unlock()
+
+	states := maps.Clone(agc.getMiddlewareStates())
+	state, ok := states[name]
+	if !ok {
+		return nil, fmt.Errorf("middleware %s not found", name)
+	}
+
+	state = &MiddlewareState{
+		Name:      state.Name,
+		Kind:      state.Kind,
+		Enabled:   enabled,
+		UpdatedBy: operator,
+		UpdatedAt: time.Now().Format(time.RFC3339),
+	}
+	states[name] = state
+	agc.middlewareStates.Store(&states)
+
+	action := "disabled"
+	if enabled {
+		action = "enabled"
+	}
+	logger.Infof("middleware %s of AIGatewayController is %s by %s at %s", name, action, operator, state.UpdatedAt)
+	return state, nil
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// checkCapability checks the provider serves the endpoint of the request,
+// otherwise it sets an OpenAI format error response and returns false.
+// The moderations endpoint is always served if the moderation backend is
+// configured. The completions requests translated to chat completions are
+// checked here, so the requests which cannot be translated are rejected
+// before the middlewares.
+func (agc *AIGatewayController) checkCapability(ctx *context.Context, aiCtx *aicontext.Context) bool {
+	code, message := agc.capabilityError(aiCtx)
+	if code == "" {
+		return true
+	}
+	setEndpointErrResponse(ctx, http.StatusBadRequest, code, message)
+	return false
+}
+
+// capabilityError returns the error code and the message if the provider
+// does not serve the request, and empty strings otherwise.
+func (agc *AIGatewayController) capabilityError(aiCtx *aicontext.Context) (string, string) {
+	if aiCtx.RespType == aicontext.ResponseTypeModerations && agc.moderator != nil {
+		return "", ""
+	}
+	if !providers.SupportsEndpoint(aiCtx.Provider.ProviderType, aiCtx.RespType) {
+		return errCodeUnsupportedEndpoint, fmt.Sprintf("Unsupported endpoint: provider %s does not support %s.", aiCtx.Provider.Name, aiCtx.RespType)
+	}
+	if aiCtx.RespType == aicontext.ResponseTypeCompletions && providers.TranslatesCompletions(aiCtx.Provider) {
+		if err := providers.ValidateCompletionsRequest(aiCtx.ReqBody); err != nil {
+			return errCodeUnsupportedParameter, fmt.Sprintf("Unsupported parameter: provider %s serves completions by chat models, %v.", aiCtx.Provider.Name, err)
+		}
+	}
+	return "", ""
+}
+
+// moderationInputs returns the texts of the input of a moderation request,
+// the input is a string, an array of strings, or an array of text objects.
+func moderationInputs(input any) ([]string, error) {
+	switch input := input.(type) {
+	case string:
+		return []string{input}, nil
+	case []any:
+		inputs := make([]string, 0, len(input))
+		for _, item := range input {
+			switch item := item.(type) {
+			case string:
+				inputs = append(inputs, item)
+			case map[string]any:
+				if item["type"] != "text" {
+					return nil, fmt.Errorf("input of type %v is not supported", item["type"])
+				}
+				text, _ := item["text"].(string)
+				inputs = append(inputs, text)
+			default:
+				return nil, fmt.Errorf("input must be a string or an array of strings")
+			}
+		}
+		if len(inputs) == 0 {
+			return nil, fmt.Errorf("input cannot be empty")
+		}
+		return inputs, nil
+	default:
+		return nil, fmt.Errorf("input must be a string or an array of strings")
+	}
+}
+
+// moderate serves the moderation request with the moderation backend.
+func (agc *AIGatewayController) moderate(aiCtx *aicontext.Context) {
+	inputs, err := moderationInputs(aiCtx.OpenAIReq["input"])
+	if err != nil {
+		setModerationResponse(aiCtx, http.StatusBadRequest, protocol.NewError(http.StatusBadRequest, err.Error()))
+		aiCtx.Stop(aicontext.ResultClientError)
+		return
+	}
+
+	results, err := agc.moderator.Moderate(aiCtx.Req.Context(), inputs)
+	if err != nil {
+		logger.Errorf("failed to moderate inputs: %v", err)
+		setModerationResponse(aiCtx, http.StatusBadGateway, protocol.NewError(http.StatusBadGateway, fmt.Sprintf("moderation failed: %v", err)))
+		aiCtx.Stop(aicontext.ResultServerError)
+		return
+	}
+	setModerationResponse(aiCtx, http.StatusOK, &protocol.ModerationResponse{
+		ID:      "modr-" + uuid.NewString(),
+		Model:   agc.moderator.Model(),
+		Results: results,
+	})
+}
+
+func setModerationResponse(aiCtx *aicontext.Context, statusCode int, body any) {
+	data, _ := codectool.MarshalJSON(body)
+	aiCtx.SetResponse(&aicontext.Response{
+		StatusCode:    statusCode,
+		ContentLength: int64(len(data)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		BodyBytes:     data,
+	})
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func TestModerationInputs(t *testing.T) {
+	assert := assert.New(t)
+
+	inputs, err := moderationInputs("hello")
+	assert.Nil(err)
+	assert.Equal([]string{"hello"}, inputs)
+	inputs, err = moderationInputs([]any{"a", map[string]any{"type": "text", "text": "b"}})
+	assert.Nil(err)
+	assert.Equal([]string{"a", "b"}, inputs)
+
+	_, err = moderationInputs(nil)
+	assert.Error(err)
+	_, err = moderationInputs([]any{})
+	assert.Error(err)
+	_, err = moderationInputs([]any{map[string]any{"type": "image_url"}})
+	assert.Error(err)
+	_, err = moderationInputs([]any{1})
+	assert.Error(err)
+}
+
+func TestModerations(t *testing.T) {
+	assert := assert.New(t)
+
+	classifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[[{"label": "toxic", "score": 0.9}], [{"label": "toxic", "score": 0.1}]]`))
+	}))
+	defer classifier.Close()
+
+	newController := func(moderation string) *AIGatewayController {
+		controllerConfig := `
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: http://localhost:19876
+  apiKey: mock
+- name: anthropic
+  providerType: anthropic
+  baseURL: http://localhost:19876
+  apiKey: mock
+` + moderation
+		super := supervisor.NewMock(option.New(), nil, nil,
+			nil, false, nil, nil)
+		spec, err := super.NewSpec(controllerConfig)
+		assert.Nil(err)
+		controller := &AIGatewayController{}
+		controller.Init(spec)
+		return controller
+	}
+	moderate := func(controller *AIGatewayController, provider string, body string) (string, *httpprot.Response) {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/moderations", bytes.NewReader([]byte(body)))
+		assert.Nil(err)
+		setRequest(t, ctx, "moderations", req)
+		result := controller.Handle(ctx, provider, nil)
+		return result, ctx.GetResponse("moderations").(*httpprot.Response)
+	}
+
+	{
+		// without the moderation backend, providers not supporting
+		// moderations are rejected.
+		controller := newController("")
+		result, resp := moderate(controller, "anthropic", `{"input": "hello"}`)
+		assert.Equal("clientError", result)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode())
+		errResp := &protocol.ErrorResponse{}
+		assert.Nil(json.Unmarshal(resp.RawPayload(), errResp))
+		assert.Equal(errCodeUnsupportedEndpoint, *errResp.Error.Code)
+		controller.Close()
+	}
+
+	controller := newController(fmt.Sprintf(`
+moderation:
+  type: classifier
+  baseURL: %s
+  labels:
+    toxic: harassment
+middlewares:
+- name: moderation-guard
+  kind: ModerationGuard
+  moderationGuard: {}
+`, classifier.URL))
+	defer controller.Close()
+
+	// the moderation backend serves all providers.
+	result, resp := moderate(controller, "anthropic", `{"input": ["you idiot", "hello"]}`)
+	assert.Equal("", result)
+	assert.Equal(http.StatusOK, resp.StatusCode())
+	moderationResp := &protocol.ModerationResponse{}
+	assert.Nil(json.Unmarshal(resp.RawPayload(), moderationResp))
+	assert.Equal("classifier", moderationResp.Model)
+	assert.Len(moderationResp.Results, 2)
+	assert.True(moderationResp.Results[0].Flagged)
+	assert.False(moderationResp.Results[1].Flagged)
+	assert.Nil(moderationResp.Results[0].Categories["hate"])
+	assert.Contains(string(resp.RawPayload()), `"hate":null`)
+
+	result, resp = moderate(controller, "openai", `{"input": 1}`)
+	assert.Equal("clientError", result)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode())
+
+	// the guard middleware shares the moderation backend, the prompt is
+	// moderated already, so the result is served from the cache.
+	guard := controller.middlewares["moderation-guard"]
+	assert.NotNil(guard)
+	ctx := context.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions",
+		bytes.NewReader([]byte(`{"model": "gpt", "messages": [{"role": "user", "content": "you idiot"}]}`)))
+	assert.Nil(err)
+	setRequest(t, ctx, "guard", req)
+	result = controller.Handle(ctx, "openai", []string{"moderation-guard"})
+	assert.Equal("middlewareError", result)
+	assert.Equal(http.StatusBadRequest, ctx.GetResponse("guard").(*httpprot.Response).StatusCode())
+
+	// the guard middleware requires the moderation backend.
+	spec := &Spec{Middlewares: controller.spec.Middlewares}
+	assert.ErrorContains(spec.Validate(), "requires the moderation backend")
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ErrEmbeddingResponseTooLarge is returned when an embedding response is
+// larger than the memory cap of decoding it.
+var ErrEmbeddingResponseTooLarge = errors.New("embedding response exceeds the memory cap")
+
+// cappedReader fails the reads after more than max bytes are read, zero
+// means no cap.
+type cappedReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func (r *cappedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.max > 0 && r.read > r.max {
+		return 0, ErrEmbeddingResponseTooLarge
+	}
+	return n, err
+}
+
+// DecodeEmbeddingResponse decodes an embedding response incrementally. The
+// embeddings of data are passed to fn one by one in the order of the
+// response instead of being kept in the returned response, so a response
+// of a large batch is never held in memory as a whole. The embeddings are
+// skipped without being allocated if fn is nil. The decoding is aborted
+// with ErrEmbeddingResponseTooLarge once more than maxBytes are read, zero
+// means no cap.
+func DecodeEmbeddingResponse(r io.Reader, maxBytes int64, fn func(*Embedding) error) (*EmbeddingResponse, error) {
+	resp := &EmbeddingResponse{}
+	dec := json.NewDecoder(&cappedReader{r: r, max: maxBytes})
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		key, _ := tok.(string)
+		switch key {
+		case "data":
+			err = decodeEmbeddings(dec, fn)
+		case "object":
+			err = dec.Decode(&resp.Object)
+		case "model":
+			err = dec.Decode(&resp.Model)
+		case "usage":
+			err = dec.Decode(&resp.Usage)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return nil, decodeError(err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// decodeEmbeddings decodes the elements of the data array, it may be null.
+func decodeEmbeddings(dec *json.Decoder, fn func(*Embedding) error) error {
+	tok, err := dec.Token()
+	if err != nil || tok == nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("data is not an array")
+	}
+	var buf []float32
+	for dec.More() {
+		if fn == nil {
+			// the fields are skipped by the decoder.
+			var skip struct{}
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		// the vector is decoded into the reused buffer and then copied, so
+		// the slices grown while decoding are not left as garbage.
+		scratch := Embedding{Embedding: buf[:0]}
+		if err := dec.Decode(&scratch); err != nil {
+			return err
+		}
+		buf = scratch.Embedding
+		embedding := &Embedding{
+			Object:    scratch.Object,
+			Index:     scratch.Index,
+			Embedding: slices.Clone(scratch.Embedding),
+		}
+		if err := fn(embedding); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return decodeError(err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("failed to decode embedding response: unexpected %v", tok)
+	}
+	return nil
+}
+
+func decodeError(err error) error {
+	if errors.Is(err, ErrEmbeddingResponseTooLarge) {
+		return err
+	}
+	return fmt.Errorf("failed to decode embedding response: %w", err)
+}
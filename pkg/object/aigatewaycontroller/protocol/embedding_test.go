@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeEmbeddingResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"object":"list","data":[
+		{"object":"embedding","index":0,"embedding":[0.1,0.2]},
+		{"object":"embedding","index":1,"embedding":[0.3,0.4],"extra":{"a":[1]}}
+	],"model":"m","usage":{"prompt_tokens":3,"total_tokens":5},"id":"x"}`
+
+	var embeddings []*Embedding
+	resp, err := DecodeEmbeddingResponse(strings.NewReader(body), 0, func(e *Embedding) error {
+		embeddings = append(embeddings, e)
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(&EmbeddingResponse{Object: "list", Model: "m", Usage: EmbeddingUsage{PromptTokens: 3, TotalTokens: 5}}, resp)
+	assert.Equal([]*Embedding{
+		{Object: "embedding", Index: 0, Embedding: []float32{0.1, 0.2}},
+		{Object: "embedding", Index: 1, Embedding: []float32{0.3, 0.4}},
+	}, embeddings)
+
+	// the embeddings are skipped.
+	resp, err = DecodeEmbeddingResponse(strings.NewReader(body), 0, nil)
+	assert.NoError(err)
+	assert.Equal(5, resp.Usage.TotalTokens)
+
+	// the memory cap is exceeded.
+	_, err = DecodeEmbeddingResponse(strings.NewReader(body), 64, nil)
+	assert.ErrorIs(err, ErrEmbeddingResponseTooLarge)
+	_, err = DecodeEmbeddingResponse(strings.NewReader(body), int64(len(body)), nil)
+	assert.NoError(err)
+
+	// the callback aborts the decoding.
+	abort := fmt.Errorf("abort")
+	calls := 0
+	_, err = DecodeEmbeddingResponse(strings.NewReader(body), 0, func(e *Embedding) error {
+		calls++
+		return abort
+	})
+	assert.ErrorIs(err, abort)
+	assert.Equal(1, calls)
+
+	// null data.
+	resp, err = DecodeEmbeddingResponse(strings.NewReader(`{"data":null,"model":"m"}`), 0, nil)
+	assert.NoError(err)
+	assert.Equal("m", resp.Model)
+
+	for _, body := range []string{`[]`, `{"data":{}}`, `{"data":[{"index":0}`, `{"model":"m"`} {
+		_, err = DecodeEmbeddingResponse(strings.NewReader(body), 0, nil)
+		assert.Error(err, body)
+	}
+}
+
+// syntheticEmbeddingResponse generates an embedding response of the inputs
+// and dimensions lazily, so the response is never held in memory.
+type syntheticEmbeddingResponse struct {
+	inputs, dims int
+	next         int
+	buf          bytes.Buffer
+}
+
+func (r *syntheticEmbeddingResponse) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		switch {
+		case r.next == 0:
+			r.buf.WriteString(`{"object":"list","data":[`)
+		case r.next <= r.inputs:
+			if r.next > 1 {
+				r.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&r.buf, `{"object":"embedding","index":%d,"embedding":[`, r.next-1)
+			for i := 0; i < r.dims; i++ {
+				if i > 0 {
+					r.buf.WriteByte(',')
+				}
+				fmt.Fprintf(&r.buf, "-0.0%09d", (r.next*r.dims+i)%1000000000)
+			}
+			r.buf.WriteString(`]}`)
+		case r.next == r.inputs+1:
+			r.buf.WriteString(`],"model":"m","usage":{"prompt_tokens":1,"total_tokens":1}}`)
+		default:
+			return 0, io.EOF
+		}
+		r.next++
+	}
+	return r.buf.Read(p)
+}
+
+// The response of 2048 inputs of 3500 dimensions is about 100MB.
+const (
+	benchmarkInputs = 2048
+	benchmarkDims   = 3500
+)
+
+// samplePeakHeap samples the heap until the returned function is called,
+// which returns the peak above the heap at the start. The heap is what
+// drives the RSS of the process.
+func samplePeakHeap() func() uint64 {
+	runtime.GC()
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(samples)
+	base := samples[0].Value.Uint64()
+
+	var peak uint64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			metrics.Read(samples)
+			if v := samples[0].Value.Uint64(); v > peak {
+				peak = v
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		<-stopped
+		return peak - min(peak, base)
+	}
+}
+
+// reportPeakHeap reports the peak heap of the benchmark as peak-heap-MB.
+func reportPeakHeap(b *testing.B) func() {
+	stop := samplePeakHeap()
+	return func() {
+		b.ReportMetric(float64(stop())/(1<<20), "peak-heap-MB")
+	}
+}
+
+// unmarshalEmbeddingResponse decodes the synthetic response in one shot,
+// like the embeddings were decoded before DecodeEmbeddingResponse.
+func unmarshalEmbeddingResponse(r io.Reader) (*EmbeddingResponse, int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp := &EmbeddingResponse{}
+	return resp, len(data), json.Unmarshal(data, resp)
+}
+
+// decodeEmbeddingResults decodes the synthetic response into the result
+// slices of the inputs.
+func decodeEmbeddingResults(r io.Reader, inputs int) ([][]float32, error) {
+	results := make([][]float32, inputs)
+	_, err := DecodeEmbeddingResponse(r, 0, func(e *Embedding) error {
+		results[e.Index] = e.Embedding
+		return nil
+	})
+	return results, err
+}
+
+func TestEmbeddingResponsePeakHeap(t *testing.T) {
+	assert := assert.New(t)
+
+	stop := samplePeakHeap()
+	resp, _, err := unmarshalEmbeddingResponse(&syntheticEmbeddingResponse{inputs: benchmarkInputs, dims: benchmarkDims})
+	unmarshalPeak := stop()
+	assert.Nil(err)
+	assert.Len(resp.Data, benchmarkInputs)
+	resp = nil
+
+	stop = samplePeakHeap()
+	results, err := decodeEmbeddingResults(&syntheticEmbeddingResponse{inputs: benchmarkInputs, dims: benchmarkDims}, benchmarkInputs)
+	decodePeak := stop()
+	assert.Nil(err)
+	assert.Len(results[benchmarkInputs-1], benchmarkDims)
+
+	// the incremental decoding keeps the results only, the peak heap of
+	// a 100MB response is reduced by 5x at least.
+	t.Logf("peak heap of unmarshal: %dMB, decode: %dMB", unmarshalPeak>>20, decodePeak>>20)
+	assert.GreaterOrEqual(unmarshalPeak, 5*decodePeak)
+}
+
+func BenchmarkEmbeddingResponseUnmarshal(b *testing.B) {
+	defer reportPeakHeap(b)()
+	for i := 0; i < b.N; i++ {
+		_, size, err := unmarshalEmbeddingResponse(&syntheticEmbeddingResponse{inputs: benchmarkInputs, dims: benchmarkDims})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(size))
+	}
+}
+
+func BenchmarkEmbeddingResponseDecode(b *testing.B) {
+	defer reportPeakHeap(b)()
+	for i := 0; i < b.N; i++ {
+		_, err := decodeEmbeddingResults(&syntheticEmbeddingResponse{inputs: benchmarkInputs, dims: benchmarkDims}, benchmarkInputs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -47,6 +47,18 @@ func NewError(code int, message string) ErrorResponse {
 	return ErrorResponse{Error{Type: etype, Message: message}}
 }
 
+// NewInvalidRequestError returns an invalid_request_error with the code.
+func NewInvalidRequestError(code string, message string) ErrorResponse {
+	return ErrorResponse{Error{Type: "invalid_request_error", Code: &code, Message: message}}
+}
+
+// NewRateLimitError returns a rate limit error, the type is requests or
+// tokens, the limit exceeded.
+func NewRateLimitError(limitType string, message string) ErrorResponse {
+	code := "rate_limit_exceeded"
+	return ErrorResponse{Error{Type: limitType, Code: &code, Message: message}}
+}
+
 type GeneralRequest struct {
 	Model         string        `json:"model"`
 	Stream        bool          `json:"stream"`
@@ -152,3 +164,27 @@ type ImageResponse struct {
 	Size         string        `json:"size,omitempty"`
 	Usage        ImageUsage    `json:"usage,omitempty"`
 }
+
+// ================================== Moderation Structure ==================================
+
+// ModerationRequest represents the request structure for OpenAI moderations,
+// Input is a string or an array of strings.
+type ModerationRequest struct {
+	Input any    `json:"input"`
+	Model string `json:"model,omitempty"`
+}
+
+// ModerationResult is the moderation result of an input. The categories
+// not supported by the moderation backend are null.
+// see more details from https://platform.openai.com/docs/api-reference/moderations/object
+type ModerationResult struct {
+	Flagged        bool                `json:"flagged"`
+	Categories     map[string]*bool    `json:"categories"`
+	CategoryScores map[string]*float64 `json:"category_scores"`
+}
+
+type ModerationResponse struct {
+	ID      string              `json:"id"`
+	Model   string              `json:"model"`
+	Results []*ModerationResult `json:"results"`
+}
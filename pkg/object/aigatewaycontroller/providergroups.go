@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/megaease/easegress/v2/pkg/common"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+type (
+	// ProviderGroupSpec balances the requests among providers by weight,
+	// the name of a group is used in place of a provider name. The weights
+	// of providers violating their latency SLOs are reduced, see
+	// LatencySLOSpec.
+	ProviderGroupSpec struct {
+		Name    string                     `json:"name" jsonschema:"required"`
+		Members []*ProviderGroupMemberSpec `json:"members" jsonschema:"required"`
+		// Hedge sends a slow request to a second member of the group, see
+		// ProviderGroupHedgeSpec.
+		Hedge *ProviderGroupHedgeSpec `json:"hedge,omitempty"`
+	}
+
+	// ProviderGroupMemberSpec is a provider of a group.
+	ProviderGroupMemberSpec struct {
+		Provider string `json:"provider" jsonschema:"required"`
+		// Weight is the share of requests of the provider, default 1.
+		Weight int `json:"weight,omitempty"`
+	}
+)
+
+// getWeight returns the weight of the member.
+func (m *ProviderGroupMemberSpec) getWeight() int {
+	if m.Weight == 0 {
+		return 1
+	}
+	return m.Weight
+}
+
+func validateProviderGroups(groups []*ProviderGroupSpec, providers []*aicontext.ProviderSpec) error {
+	names := map[string]struct{}{}
+	for _, p := range providers {
+		names[p.Name] = struct{}{}
+	}
+	groupNames := map[string]struct{}{}
+	for _, g := range groups {
+		if common.ValidateName(g.Name) != nil {
+			return fmt.Errorf("invalid provider group name: %s", g.Name)
+		}
+		if _, ok := names[g.Name]; ok {
+			return fmt.Errorf("provider group %s has the same name as a provider", g.Name)
+		}
+		if _, ok := groupNames[g.Name]; ok {
+			return fmt.Errorf("duplicate provider group name: %s", g.Name)
+		}
+		groupNames[g.Name] = struct{}{}
+		if len(g.Members) == 0 {
+			return fmt.Errorf("provider group %s has no members", g.Name)
+		}
+		for _, m := range g.Members {
+			if _, ok := names[m.Provider]; !ok {
+				return fmt.Errorf("provider %s of provider group %s not found", m.Provider, g.Name)
+			}
+			if m.Weight < 0 {
+				return fmt.Errorf("weight of provider %s of provider group %s cannot be negative", m.Provider, g.Name)
+			}
+		}
+		if g.Hedge != nil {
+			if err := validateHedge(g); err != nil {
+				return fmt.Errorf("provider group %s: %w", g.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveProviderName returns the provider serving a request to the name,
+// it picks a member in the region by the effective weights if the name is
+// a group, and returns the name as is otherwise. It returns an empty name
+// if the group has no member in the region, see residentProvider.
+func (agc *AIGatewayController) resolveProviderName(set *providerSet, name, region string) string {
+	for _, g := range agc.spec.ProviderGroups {
+		if g.Name == name {
+			return agc.pickGroupMember(g, func(provider string) bool {
+				return aicontext.Resident(region, set.region(provider))
+			})
+		}
+	}
+	return name
+}
+
+// groupWeights returns the weights of the members of the group adjusted by
+// the latency SLO, their total, and the index of the member with the
+// largest weight in the spec. The members not eligible have no weight,
+// and the index is -1 if no member is eligible, all members are eligible
+// if eligible is nil.
+func (agc *AIGatewayController) groupWeights(g *ProviderGroupSpec, eligible func(provider string) bool) ([]float64, float64, int) {
+	weights := make([]float64, len(g.Members))
+	total := 0.0
+	best := -1
+	for i, m := range g.Members {
+		if eligible != nil && !eligible(m.Provider) {
+			continue
+		}
+		weights[i] = float64(m.getWeight()) * agc.latencySLO.weightFactor(m.Provider)
+		total += weights[i]
+		if best < 0 || m.getWeight() > g.Members[best].getWeight() {
+			best = i
+		}
+	}
+	return weights, total, best
+}
+
+// pickGroupMember picks an eligible member of the group randomly in
+// proportion to the weights adjusted by the latency SLO. The eligible
+// member with the largest weight is picked if all adjusted weights are
+// zero, and it returns an empty name if no member is eligible.
+func (agc *AIGatewayController) pickGroupMember(g *ProviderGroupSpec, eligible func(provider string) bool) string {
+	weights, total, best := agc.groupWeights(g, eligible)
+	if best < 0 {
+		return ""
+	}
+	if total <= 0 {
+		return g.Members[best].Provider
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return g.Members[i].Provider
+		}
+		r -= w
+	}
+	// rounding errors, the members not eligible have no weight.
+	return g.Members[best].Provider
+}
@@ -18,10 +18,11 @@
 package providers
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"net/url"
 	"reflect"
 	"strings"
 
@@ -52,6 +53,13 @@ const (
 // Almost all providers compatible with OpenAI API, so we abstract the common logic.
 type BaseProvider struct {
 	providerSpec *aicontext.ProviderSpec
+	endpoints    *endpointManager
+	// signer signs the requests to the provider, it is nil if requests
+	// are authenticated by the APIKey as a bearer token.
+	signer RequestSigner
+	// credentials are the API keys rotated at runtime, it is nil if the
+	// signing does not use the APIKey.
+	credentials *credentialPool
 }
 
 var _ Provider = (*BaseProvider)(nil)
@@ -70,6 +78,10 @@ func (bp *BaseProvider) Spec() *aicontext.ProviderSpec {
 
 func (bp *BaseProvider) init(spec *aicontext.ProviderSpec) {
 	bp.providerSpec = spec
+	// the spec is validated, so the signer is always created.
+	bp.signer, _ = newRequestSigner(spec)
+	bp.credentials = newCredentialPool(spec, bp.signer)
+	bp.endpoints = newEndpointManager(spec, bp.signer, bp.credentials)
 }
 
 func (bp *BaseProvider) validate(spec *aicontext.ProviderSpec) error {
@@ -79,45 +91,66 @@ func (bp *BaseProvider) validate(spec *aicontext.ProviderSpec) error {
 	if spec.BaseURL == "" {
 		return fmt.Errorf("BaseURL cannot be empty for provider: %s", spec.Name)
 	}
-	if spec.APIKey == "" {
+	if spec.APIKey == "" && spec.Signing == nil {
 		return fmt.Errorf("APIKey cannot be empty for provider: %s", spec.Name)
 	}
+	if _, err := newRequestSigner(spec); err != nil {
+		return fmt.Errorf("invalid signing for provider %s: %w", spec.Name, err)
+	}
+	if err := validateEndpoints(spec); err != nil {
+		return fmt.Errorf("invalid endpoints for provider %s: %w", spec.Name, err)
+	}
+	if err := validateHTTPClientSpec(spec.HTTPClient); err != nil {
+		return fmt.Errorf("invalid httpClient for provider %s: %w", spec.Name, err)
+	}
+	if err := validateMaxResponseBytesSpec(spec.MaxResponseBytes); err != nil {
+		return fmt.Errorf("invalid maxResponseBytes for provider %s: %w", spec.Name, err)
+	}
+	switch spec.Completions {
+	case "", CompletionsNative, CompletionsChat:
+	default:
+		return fmt.Errorf("invalid completions for provider %s: %s", spec.Name, spec.Completions)
+	}
+	if err := validateSynthesizeStreamingSpec(spec.SynthesizeStreaming); err != nil {
+		return fmt.Errorf("invalid synthesizeStreaming for provider %s: %w", spec.Name, err)
+	}
 	return nil
 }
 
 func (bp *BaseProvider) HealthCheck() error {
-	checkURL, err := url.JoinPath(bp.providerSpec.BaseURL, string(aicontext.ResponseTypeModels))
-	if err != nil {
-		return fmt.Errorf("failed to join health check URL: %w", err)
-	}
-
-	req, err := http.NewRequest(http.MethodGet, checkURL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create health check request: %w", err)
-	}
+	return bp.endpoints.checkHealth()
+}
 
-	req.Header.Set("Authorization", "Bearer "+bp.providerSpec.APIKey)
+func (bp *BaseProvider) EndpointHealth() []*EndpointHealth {
+	return bp.endpoints.health()
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("health check request failed: %w", err)
-	}
+func (bp *BaseProvider) FlushConnections() {
+	bp.endpoints.flush()
+}
 
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("health check failed, status code: %d", resp.StatusCode)
+func (bp *BaseProvider) Close() {
+	bp.endpoints.close()
+	if bp.credentials != nil {
+		bp.credentials.close()
 	}
-	return nil
 }
 
 func (bp *BaseProvider) Handle(ctx *aicontext.Context) {
-	request, err := prepareRequest(ctx, bp.RequestMapper)
+	mapper, shim, synthesizer, err := bp.requestMapper(ctx)
 	if err != nil {
-		logger.Errorf("failed to prepare request for provider %s: %v", bp.providerSpec.Name, err)
-		setErrResponse(ctx, http.StatusInternalServerError, err)
+		setErrResponse(ctx, http.StatusBadRequest, err)
+		ctx.Stop(aicontext.ResultClientError)
 		return
 	}
 
+	trace := &connTrace{}
+	ep, client := bp.proxyRequest(ctx, trace, mapper)
+	if ep == nil {
+		return
+	}
+
+	limit := newResponseLimit(bp.providerSpec, ctx.ReqInfo.Stream && synthesizer == nil)
 	ctx.ParseMetricFn = func(fc *aicontext.FinishContext) *metricshub.Metric {
 		if ctx.RespType == aicontext.ResponseTypeModels {
 			return nil
@@ -127,9 +160,15 @@ func (bp *BaseProvider) Handle(ctx *aicontext.Context) {
 			Provider:     ctx.Provider.Name,
 			ProviderType: ctx.Provider.ProviderType,
 			Model:        ctx.ReqInfo.Model,
-			BaseURL:      ctx.Provider.BaseURL,
+			BaseURL:      ep.baseURL,
 			ResponseType: string(ctx.RespType),
 		}
+		trace.fill(metric, client)
+		if limit.exceeded.Load() {
+			metric.Success = false
+			metric.Error = metricshub.MetricResponseTooLargeError
+			return metric
+		}
 		if fc.StatusCode != http.StatusOK {
 			metric.Success = false
 			metric.Error = metricshub.MetricInternalError
@@ -141,32 +180,130 @@ func (bp *BaseProvider) Handle(ctx *aicontext.Context) {
 		metric.InputTokens, metric.OutputTokens, metric.Error = int64(inputToken), int64(outputToken), err
 		return metric
 	}
-
-	bp.ProxyRequest(ctx, request)
+	limit.apply(ctx)
+	if synthesizer != nil {
+		synthesizer.synthesize(ctx)
+	}
+	if shim != nil {
+		shim.translateResponse(ctx)
+	}
 }
 
 func (bp *BaseProvider) RequestMapper(pc *aicontext.Context) (string, []byte, error) {
 	return string(pc.RespType), pc.ReqBody, nil
 }
 
-func (bp *BaseProvider) ProxyRequest(ctx *aicontext.Context, req *http.Request) {
-	resp, err := http.DefaultClient.Do(req)
+// requestMapper returns the mapper of the request to the provider, and
+// the shim and the synthesizer translating its response, which are nil
+// if the response is not translated.
+func (bp *BaseProvider) requestMapper(ctx *aicontext.Context) (RequestMapper, *completionsShim, *streamSynthesizer, error) {
+	mapper := bp.RequestMapper
+	var shim *completionsShim
+	if ctx.RespType == aicontext.ResponseTypeCompletions && TranslatesCompletions(bp.providerSpec) {
+		var err error
+		shim, err = newCompletionsShim(ctx.ReqBody)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		mapper = shim.requestMapper
+	}
+	// the synthetic stream is of chat completion chunks if the completions
+	// are translated, so they are translated by the shim as well.
+	var synthesizer *streamSynthesizer
+	if synthesizesStreaming(bp.providerSpec, ctx) {
+		chat := ctx.RespType == aicontext.ResponseTypeChatCompletions || shim != nil
+		synthesizer = newStreamSynthesizer(bp.providerSpec.SynthesizeStreaming, mapper, chat)
+		mapper = synthesizer.requestMapper
+	}
+	return mapper, shim, synthesizer, nil
+}
+
+// PrepareRequest prepares the request of the context to the provider
+// like Handle, but does not send it. The request is signed by the
+// primary API key, and addressed to the endpoint Handle would pick.
+func (bp *BaseProvider) PrepareRequest(ctx *aicontext.Context) (*http.Request, []byte, error) {
+	mapper, _, _, err := bp.requestMapper(ctx)
 	if err != nil {
-		setErrResponse(ctx, http.StatusInternalServerError, err)
-		return
+		return nil, nil, err
+	}
+	signer := bp.signer
+	if bp.credentials != nil {
+		signer = bp.credentials.primary().signer
+	}
+	req, err := prepareRequest(ctx, bp.endpoints.pick(nil).baseURL, mapper, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, nil, err
 	}
-	ctx.AddCallBack(func(*aicontext.FinishContext) {
-		resp.Body.Close()
-	})
+	return req, body, nil
+}
 
-	ctx.SetResponse(&aicontext.Response{
-		StatusCode:    resp.StatusCode,
-		ContentLength: resp.ContentLength,
-		Header:        resp.Header,
-		BodyReader:    resp.Body,
-	})
-	if resp.StatusCode != http.StatusOK {
-		ctx.Stop(aicontext.ResultProviderError)
+// proxyRequest sends the request to the endpoints of the provider in turn
+// until one of them responds. It returns the endpoint and the client used
+// by the request, or nil if the request cannot be prepared.
+func (bp *BaseProvider) proxyRequest(ctx *aicontext.Context, trace *connTrace, mapper RequestMapper) (*endpoint, *providerClient) {
+	signer := bp.signer
+	var cred *credential
+	if bp.credentials != nil {
+		cred = bp.credentials.pick()
+		signer = cred.signer
+	}
+	record := func(statusCode int) {
+		if cred != nil {
+			bp.credentials.record(cred, statusCode)
+		}
+	}
+
+	var tried []*endpoint
+	ep := bp.endpoints.pick(nil)
+	for {
+		req, err := prepareRequest(ctx, ep.baseURL, mapper, signer)
+		if err != nil {
+			logger.Errorf("failed to prepare request for provider %s: %v", bp.providerSpec.Name, err)
+			setErrResponse(ctx, http.StatusInternalServerError, err)
+			return nil, nil
+		}
+
+		client := ep.client.Load()
+		resp, err := client.Do(trace.withTrace(req))
+		if err == nil {
+			record(resp.StatusCode)
+			if ctx.Detached {
+				ctx.UpstreamBody = resp.Body
+			} else {
+				ctx.AddCallBack(func(*aicontext.FinishContext) {
+					resp.Body.Close()
+				})
+			}
+			ctx.SetResponse(&aicontext.Response{
+				StatusCode:    resp.StatusCode,
+				ContentLength: resp.ContentLength,
+				Header:        resp.Header,
+				BodyReader:    resp.Body,
+			})
+			if resp.StatusCode != http.StatusOK {
+				ctx.Stop(aicontext.ResultProviderError)
+			}
+			return ep, client
+		}
+
+		// the request is canceled by the client, not the fault of the endpoint.
+		if req.Context().Err() != nil {
+			setErrResponse(ctx, http.StatusInternalServerError, err)
+			return ep, client
+		}
+		bp.endpoints.failover(ep, err)
+		tried = append(tried, ep)
+		next := bp.endpoints.pick(tried)
+		if next == nil {
+			record(0)
+			setErrResponse(ctx, http.StatusInternalServerError, err)
+			return ep, client
+		}
+		ep = next
 	}
 }
 
@@ -191,7 +328,7 @@ func (bp *BaseProvider) ParseTokens(ctx *aicontext.Context, fc *aicontext.Finish
 		return parseEmbeddings(fc.RespBody)
 	case aicontext.ResponseTypeImageGenerations:
 		return parseImageGenerations(fc.RespBody)
-	case aicontext.ResponseTypeModels:
+	case aicontext.ResponseTypeModels, aicontext.ResponseTypeModerations:
 		return 0, 0, metricshub.MetricNoError
 	default:
 		logger.Errorf("unsupported resp type %s", ctx.RespType)
@@ -251,9 +388,10 @@ func parseChatCompletions(openaiReq *protocol.GeneralRequest, respBody []byte) (
 	return resp.Usage.PromptTokens, resp.Usage.CompletionTokens, ""
 }
 
+// parseEmbeddings decodes the usage only, the embeddings of a large batch
+// are skipped without being allocated.
 func parseEmbeddings(respBody []byte) (inputToken int, outputToken int, e metricshub.MetricError) {
-	resp := &protocol.EmbeddingResponse{}
-	err := json.Unmarshal(respBody, &resp)
+	resp, err := protocol.DecodeEmbeddingResponse(bytes.NewReader(respBody), 0, nil)
 	if err != nil {
 		logger.Errorf("failed to unmarshal resp %s, %v", string(respBody), err)
 		return 0, 0, metricshub.MetricMarshalError
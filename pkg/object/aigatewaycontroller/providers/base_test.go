@@ -159,6 +159,88 @@ func TestBaseProvider(t *testing.T) {
 	}
 }
 
+func TestBaseProviderMaxResponseBytes(t *testing.T) {
+	assert := assert.New(t)
+	mockServer := httptest.NewServer(http.HandlerFunc(chatCompletionsHandler))
+	defer mockServer.Close()
+
+	providerSpec := &aicontext.ProviderSpec{
+		Name:         "openai",
+		ProviderType: "openai",
+		BaseURL:      mockServer.URL,
+		APIKey:       "test-api-key",
+		MaxResponseBytes: &aicontext.MaxResponseBytesSpec{
+			Body:   100,
+			Stream: 300,
+		},
+	}
+	provider := &BaseProvider{}
+	assert.Nil(provider.validate(providerSpec))
+	provider.init(providerSpec)
+
+	handle := func(stream bool, content string) (*aicontext.Context, []byte, *metricshub.Metric) {
+		ctx := context.New(nil)
+		req, err := createChatCompletionRequest("gpt-5", stream, content)
+		assert.Nil(err)
+		setRequest(t, ctx, "chat.completions", req)
+		aiCtx, err := aicontext.New(ctx, providerSpec)
+		assert.Nil(err)
+		provider.Handle(aiCtx)
+
+		resp := aiCtx.GetResponse()
+		data := resp.BodyBytes
+		if resp.BodyReader != nil {
+			data, err = io.ReadAll(resp.BodyReader)
+			assert.Nil(err)
+		}
+		fc := &aicontext.FinishContext{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			RespBody:   data,
+			Duration:   100,
+		}
+		metric := aiCtx.ParseMetricFn(fc)
+		for _, cb := range aiCtx.Callbacks() {
+			cb(fc)
+		}
+		return aiCtx, data, metric
+	}
+
+	{
+		// non-stream, exceeds the limit
+		aiCtx, data, metric := handle(false, "hello")
+		assert.Equal(http.StatusBadGateway, aiCtx.GetResponse().StatusCode)
+		assert.Equal(aicontext.ResultProviderError, aiCtx.Result())
+		assert.Contains(string(data), "exceeds the limit of 100 bytes")
+		assert.False(metric.Success)
+		assert.Equal(metricshub.MetricResponseTooLargeError, metric.Error)
+	}
+
+	{
+		// stream, exceeds the limit
+		aiCtx, data, metric := handle(true, "Hello, how are you?")
+		assert.Equal(http.StatusOK, aiCtx.GetResponse().StatusCode)
+		body := string(data)
+		assert.NotContains(body, "data: [DONE]")
+		assert.True(strings.HasSuffix(body, "\n\n"))
+		chunks := strings.Split(strings.TrimSpace(body), "\n\n")
+		assert.Contains(chunks[len(chunks)-1], "exceeds the limit of 300 bytes")
+		assert.False(metric.Success)
+		assert.Equal(metricshub.MetricResponseTooLargeError, metric.Error)
+	}
+
+	{
+		// within the limit
+		providerSpec.MaxResponseBytes.Body = 1 << 20
+		aiCtx, _, metric := handle(false, "hello")
+		assert.Equal(http.StatusOK, aiCtx.GetResponse().StatusCode)
+		assert.True(metric.Success)
+	}
+
+	providerSpec.MaxResponseBytes.Body = -1
+	assert.NotNil(provider.validate(providerSpec))
+}
+
 func setRequest(t *testing.T, ctx *context.Context, ns string, req *http.Request) {
 	httpreq, err := httpprot.NewRequest(req)
 	httpreq.FetchPayload(0)
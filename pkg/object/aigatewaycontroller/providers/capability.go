@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"slices"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+)
+
+// optionalEndpoints are the endpoints not served by all providers, the
+// value is the provider types serving the endpoint in the OpenAI format.
+var optionalEndpoints = map[aicontext.ResponseType][]string{
+	aicontext.ResponseTypeModerations: {OpenAIProviderType},
+}
+
+// nativeCompletionsProviders are the provider types still serving the
+// legacy completions endpoint, the completions requests to other provider
+// types are translated to chat completions.
+var nativeCompletionsProviders = []string{OpenAIProviderType, AzureProviderType, OllamaProviderType}
+
+// Values of the completions field of the provider spec.
+const (
+	CompletionsNative = "native"
+	CompletionsChat   = "chat"
+)
+
+// SupportsEndpoint returns whether the provider type serves the endpoint.
+func SupportsEndpoint(providerType string, respType aicontext.ResponseType) bool {
+	providerTypes, ok := optionalEndpoints[respType]
+	if !ok {
+		return true
+	}
+	return slices.Contains(providerTypes, providerType)
+}
+
+// TranslatesCompletions returns whether the completions requests to the
+// provider are translated to chat completions.
+func TranslatesCompletions(spec *aicontext.ProviderSpec) bool {
+	switch spec.Completions {
+	case CompletionsNative:
+		return false
+	case CompletionsChat:
+		return true
+	}
+	return !slices.Contains(nativeCompletionsProviders, spec.ProviderType)
+}
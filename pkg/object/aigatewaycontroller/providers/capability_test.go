@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupportsEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(SupportsEndpoint(OpenAIProviderType, aicontext.ResponseTypeChatCompletions))
+	assert.True(SupportsEndpoint(AnthropicProviderType, aicontext.ResponseTypeModels))
+	assert.True(SupportsEndpoint(OpenAIProviderType, aicontext.ResponseTypeModerations))
+	assert.False(SupportsEndpoint(AnthropicProviderType, aicontext.ResponseTypeModerations))
+}
+
+func TestTranslatesCompletions(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(TranslatesCompletions(&aicontext.ProviderSpec{ProviderType: OpenAIProviderType}))
+	assert.False(TranslatesCompletions(&aicontext.ProviderSpec{ProviderType: OllamaProviderType}))
+	assert.True(TranslatesCompletions(&aicontext.ProviderSpec{ProviderType: AnthropicProviderType}))
+	assert.True(TranslatesCompletions(&aicontext.ProviderSpec{ProviderType: OpenAIProviderType, Completions: CompletionsChat}))
+	assert.False(TranslatesCompletions(&aicontext.ProviderSpec{ProviderType: DeepSeekProviderType, Completions: CompletionsNative}))
+}
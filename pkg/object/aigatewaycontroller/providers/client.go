@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+// Default connection pool options of the provider HTTP client. Go's default
+// MaxIdleConnsPerHost is 2, which makes almost every concurrent request to
+// a provider open a new connection and do a new TLS handshake.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+
+	httpProtocol1 = "http1"
+	httpProtocol2 = "http2"
+)
+
+type (
+	// providerClient is the HTTP client of a provider, it counts
+	// the connections opened to the provider.
+	providerClient struct {
+		*http.Client
+		openConns atomic.Int64
+	}
+
+	// countedConn decreases the open connection count of the client when closed.
+	countedConn struct {
+		net.Conn
+		once   sync.Once
+		client *providerClient
+	}
+
+	// connTrace records the connection information of a single request.
+	connTrace struct {
+		lock     sync.Mutex
+		reused   bool
+		dnsStart time.Time
+		tlsStart time.Time
+		dns      time.Duration
+		tls      time.Duration
+	}
+)
+
+func validateHTTPClientSpec(spec *aicontext.HTTPClientSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.MaxIdleConns < 0 || spec.MaxIdleConnsPerHost < 0 || spec.MaxConnsPerHost < 0 {
+		return fmt.Errorf("maxIdleConns, maxIdleConnsPerHost and maxConnsPerHost must be greater than or equal to 0")
+	}
+	if spec.IdleConnTimeout != "" {
+		if _, err := time.ParseDuration(spec.IdleConnTimeout); err != nil {
+			return fmt.Errorf("invalid idleConnTimeout: %w", err)
+		}
+	}
+	if spec.DNSRefreshInterval != "" {
+		if _, err := time.ParseDuration(spec.DNSRefreshInterval); err != nil {
+			return fmt.Errorf("invalid dnsRefreshInterval: %w", err)
+		}
+	}
+	switch spec.Protocol {
+	case "", httpProtocol1, httpProtocol2:
+	default:
+		return fmt.Errorf("invalid protocol %s, must be %s or %s", spec.Protocol, httpProtocol1, httpProtocol2)
+	}
+	return nil
+}
+
+func newProviderClient(spec *aicontext.HTTPClientSpec) *providerClient {
+	if spec == nil {
+		spec = &aicontext.HTTPClientSpec{}
+	}
+	client := &providerClient{}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			client.openConns.Add(1)
+			return &countedConn{Conn: conn, client: client}, nil
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          defaultMaxIdleConns,
+		MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if spec.MaxIdleConns > 0 {
+		transport.MaxIdleConns = spec.MaxIdleConns
+	}
+	if spec.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = spec.MaxIdleConnsPerHost
+	}
+	if spec.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = spec.MaxConnsPerHost
+	}
+	if spec.IdleConnTimeout != "" {
+		transport.IdleConnTimeout, _ = time.ParseDuration(spec.IdleConnTimeout)
+	}
+	switch spec.Protocol {
+	case httpProtocol1:
+		// A non-nil empty TLSNextProto disables HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case httpProtocol2:
+		transport.TLSClientConfig = &tls.Config{NextProtos: []string{"h2"}}
+	}
+
+	client.Client = &http.Client{Transport: transport}
+	return client
+}
+
+// OpenConnections returns the number of connections currently opened to the provider.
+func (c *providerClient) OpenConnections() int64 {
+	return c.openConns.Load()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.client.openConns.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// withTrace returns a request that records its connection information into the trace.
+func (t *connTrace) withTrace(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.lock.Lock()
+			t.reused = info.Reused
+			t.lock.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.lock.Lock()
+			t.dnsStart = time.Now()
+			t.lock.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.lock.Lock()
+			t.dns = time.Since(t.dnsStart)
+			t.lock.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.lock.Lock()
+			t.tlsStart = time.Now()
+			t.lock.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.lock.Lock()
+			t.tls = time.Since(t.tlsStart)
+			t.lock.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// fill fills the connection information into the metric.
+func (t *connTrace) fill(metric *metricshub.Metric, client *providerClient) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	metric.ConnectionTraced = true
+	metric.ConnectionReused = t.reused
+	metric.DNSDuration = t.dns.Milliseconds()
+	metric.TLSHandshakeDuration = t.tls.Milliseconds()
+	metric.OpenConnections = client.OpenConnections()
+}
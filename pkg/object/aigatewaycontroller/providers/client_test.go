@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateHTTPClientSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(validateHTTPClientSpec(nil))
+	assert.Nil(validateHTTPClientSpec(&aicontext.HTTPClientSpec{
+		MaxConnsPerHost: 10,
+		IdleConnTimeout: "30s",
+		Protocol:        "http1",
+	}))
+	assert.NotNil(validateHTTPClientSpec(&aicontext.HTTPClientSpec{MaxConnsPerHost: -1}))
+	assert.NotNil(validateHTTPClientSpec(&aicontext.HTTPClientSpec{IdleConnTimeout: "30"}))
+	assert.NotNil(validateHTTPClientSpec(&aicontext.HTTPClientSpec{Protocol: "http3"}))
+}
+
+func TestProviderClientConnectionReuse(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"object": "list", "data": []}`))
+	}))
+	defer server.Close()
+
+	client := newProviderClient(nil)
+
+	const (
+		workers  = 8
+		requests = 50
+	)
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		metrics []*metricshub.Metric
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+				assert.Nil(err)
+				trace := &connTrace{}
+				resp, err := client.Do(trace.withTrace(req))
+				if !assert.Nil(err) {
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+
+				metric := &metricshub.Metric{}
+				trace.fill(metric, client)
+				lock.Lock()
+				metrics = append(metrics, metric)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	reused := 0
+	for _, m := range metrics {
+		assert.True(m.ConnectionTraced)
+		if m.ConnectionReused {
+			reused++
+		}
+	}
+	assert.Len(metrics, workers*requests)
+	ratio := float64(reused) / float64(len(metrics))
+	assert.GreaterOrEqual(ratio, 0.95, "connection reuse ratio %f", ratio)
+	assert.LessOrEqual(client.OpenConnections(), int64(workers))
+
+	client.CloseIdleConnections()
+}
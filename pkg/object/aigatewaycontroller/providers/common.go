@@ -19,6 +19,7 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"maps"
 	"net/http"
@@ -32,8 +33,11 @@ import (
 
 type RequestMapper func(pc *aicontext.Context) (path string, newBody []byte, err error)
 
-func prepareRequest(pc *aicontext.Context, mapper RequestMapper) (request *http.Request, err error) {
-	u, err := url.Parse(pc.Provider.BaseURL)
+// prepareRequest creates the request to the provider. The request is
+// signed by the signer after all its headers and body are final, requests
+// are authenticated by the APIKey as a bearer token if signer is nil.
+func prepareRequest(pc *aicontext.Context, baseURL string, mapper RequestMapper, signer RequestSigner) (request *http.Request, err error) {
+	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, err
 	}
@@ -50,22 +54,35 @@ func prepareRequest(pc *aicontext.Context, mapper RequestMapper) (request *http.
 		u.RawQuery = query.Encode()
 	}
 	u.RawQuery = pc.Req.URL().RawQuery
-	req, err := http.NewRequestWithContext(pc.Req.Context(), pc.Req.Method(), u.String(), bytes.NewReader(newBody))
+	reqCtx := pc.RequestContext()
+	if pc.Detached {
+		reqCtx = context.WithoutCancel(reqCtx)
+	}
+	req, err := http.NewRequestWithContext(reqCtx, pc.Req.Method(), u.String(), bytes.NewReader(newBody))
 	if err != nil {
 		return nil, err
 	}
 
-	headers := pc.Req.HTTPHeader()
+	// the headers are copied, since the request may be sent to several
+	// providers at the same time.
+	headers := pc.Req.HTTPHeader().Clone()
 	httphelper.RemoveHopByHopHeaders(headers)
 	maps.Copy(req.Header, headers)
 
-	if pc.Provider.APIKey != "" {
+	if signer == nil && pc.Provider.APIKey != "" {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", pc.Provider.APIKey))
 	}
 	for k, v := range pc.Provider.Headers {
 		req.Header.Set(k, v)
 	}
-	return req, err
+	if signer != nil {
+		// the body of streaming requests is buffered as well, so it is
+		// always signed as a whole.
+		if err := signRequest(signer, req, newBody); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+	}
+	return req, nil
 }
 
 func setErrResponse(ctx *aicontext.Context, code int, err error) {
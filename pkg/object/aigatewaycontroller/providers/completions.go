@@ -0,0 +1,367 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+type (
+	// completionsShim serves a legacy completions request by a chat
+	// completions request, the prompt is sent as a user message, and the
+	// response is translated back to the completions format.
+	completionsShim struct {
+		body     []byte
+		prompt   string
+		echo     bool
+		logprobs bool
+	}
+
+	chatLogprobs struct {
+		Content []struct {
+			Token       string  `json:"token"`
+			Logprob     float64 `json:"logprob"`
+			TopLogprobs []struct {
+				Token   string  `json:"token"`
+				Logprob float64 `json:"logprob"`
+			} `json:"top_logprobs"`
+		} `json:"content"`
+	}
+
+	// chatCompletionResponse is a chat completion or a chunk of it.
+	chatCompletionResponse struct {
+		ID                string `json:"id"`
+		Created           int64  `json:"created"`
+		Model             string `json:"model"`
+		SystemFingerprint string `json:"system_fingerprint,omitempty"`
+		Choices           []struct {
+			Index   int `json:"index"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+			Logprobs     *chatLogprobs `json:"logprobs"`
+			FinishReason *string       `json:"finish_reason"`
+		} `json:"choices"`
+		Usage json.RawMessage `json:"usage,omitempty"`
+	}
+
+	textCompletion struct {
+		ID                string          `json:"id"`
+		Object            string          `json:"object"`
+		Created           int64           `json:"created"`
+		Model             string          `json:"model"`
+		SystemFingerprint string          `json:"system_fingerprint,omitempty"`
+		Choices           []*textChoice   `json:"choices"`
+		Usage             json.RawMessage `json:"usage,omitempty"`
+	}
+
+	textChoice struct {
+		Text         string        `json:"text"`
+		Index        int           `json:"index"`
+		Logprobs     *textLogprobs `json:"logprobs"`
+		FinishReason *string       `json:"finish_reason"`
+	}
+
+	textLogprobs struct {
+		Tokens        []string             `json:"tokens"`
+		TokenLogprobs []float64            `json:"token_logprobs"`
+		TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+		TextOffset    []int                `json:"text_offset"`
+	}
+
+	// completionsStreamReader translates the chat completion chunks of a
+	// streaming response to completion chunks.
+	completionsStreamReader struct {
+		body   io.Reader
+		reader *bufio.Reader
+		shim   *completionsShim
+		// echoed records the choices whose prompt is echoed.
+		echoed map[int]bool
+		out    bytes.Buffer
+		done   bool
+	}
+)
+
+// completionsFields are the fields of a completions request handled by the
+// shim, other fields are the same in chat completions and copied as is.
+var completionsFields = []string{"prompt", "suffix", "echo", "best_of", "logprobs"}
+
+// ValidateCompletionsRequest checks whether the completions request can be
+// translated to a chat completions request.
+func ValidateCompletionsRequest(body []byte) error {
+	_, err := newCompletionsShim(body)
+	return err
+}
+
+func newCompletionsShim(body []byte) (*completionsShim, error) {
+	req := map[string]any{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("invalid completions request: %w", err)
+	}
+
+	shim := &completionsShim{}
+	switch prompt := req["prompt"].(type) {
+	case string:
+		shim.prompt = prompt
+	case []any:
+		if len(prompt) != 1 {
+			return nil, fmt.Errorf("prompt with %d items is not supported by chat models, send one prompt per request", len(prompt))
+		}
+		text, ok := prompt[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("prompt of token IDs is not supported by chat models, send the prompt as text")
+		}
+		shim.prompt = text
+	case nil:
+		return nil, fmt.Errorf("prompt is required")
+	default:
+		return nil, fmt.Errorf("prompt must be a string or an array of strings")
+	}
+
+	if suffix, _ := req["suffix"].(string); suffix != "" {
+		return nil, fmt.Errorf("suffix is not supported by chat models")
+	}
+	if bestOf, _ := req["best_of"].(float64); bestOf > 1 {
+		return nil, fmt.Errorf("best_of is not supported by chat models")
+	}
+	shim.echo, _ = req["echo"].(bool)
+
+	chatReq := map[string]any{}
+	for k, v := range req {
+		chatReq[k] = v
+	}
+	for _, k := range completionsFields {
+		delete(chatReq, k)
+	}
+	chatReq["messages"] = []map[string]any{{"role": "user", "content": shim.prompt}}
+
+	if logprobs, ok := req["logprobs"].(float64); ok {
+		if shim.echo {
+			return nil, fmt.Errorf("echo with logprobs is not supported by chat models")
+		}
+		shim.logprobs = true
+		chatReq["logprobs"] = true
+		chatReq["top_logprobs"] = int(logprobs)
+	}
+
+	// the usage of streaming responses is included by default, so the
+	// tokens of translated requests are accounted as well.
+	if stream, _ := req["stream"].(bool); stream {
+		options, _ := chatReq["stream_options"].(map[string]any)
+		if options == nil {
+			options = map[string]any{}
+		}
+		if _, ok := options["include_usage"]; !ok {
+			options["include_usage"] = true
+		}
+		chatReq["stream_options"] = options
+	}
+
+	data, err := codectool.MarshalJSON(chatReq)
+	if err != nil {
+		return nil, err
+	}
+	shim.body = data
+	return shim, nil
+}
+
+func (s *completionsShim) requestMapper(*aicontext.Context) (string, []byte, error) {
+	return string(aicontext.ResponseTypeChatCompletions), s.body, nil
+}
+
+// translateResponse translates the chat completions response of the
+// context to the completions format, error responses are kept as is.
+func (s *completionsShim) translateResponse(ctx *aicontext.Context) {
+	resp := ctx.GetResponse()
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	if ctx.ReqInfo.Stream {
+		if resp.BodyReader != nil {
+			resp.BodyReader = s.newStreamReader(resp.BodyReader)
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+		return
+	}
+
+	body := resp.BodyBytes
+	if resp.BodyReader != nil {
+		var err error
+		body, err = io.ReadAll(resp.BodyReader)
+		closeBody(resp.BodyReader)
+		resp.BodyReader = nil
+		if err != nil {
+			setErrResponse(ctx, http.StatusBadGateway, fmt.Errorf("failed to read response of provider %s: %w", ctx.Provider.Name, err))
+			ctx.Stop(aicontext.ResultProviderError)
+			return
+		}
+	}
+	data, err := s.translateCompletion(body)
+	if err != nil {
+		logger.Errorf("failed to translate chat completion to completion: %v", err)
+		setErrResponse(ctx, http.StatusBadGateway, fmt.Errorf("invalid chat completion of provider %s: %w", ctx.Provider.Name, err))
+		ctx.Stop(aicontext.ResultProviderError)
+		return
+	}
+	resp.BodyBytes = data
+	resp.ContentLength = int64(len(data))
+	resp.Header.Del("Content-Length")
+}
+
+func (s *completionsShim) translateCompletion(body []byte) ([]byte, error) {
+	chat := &chatCompletionResponse{}
+	if err := json.Unmarshal(body, chat); err != nil {
+		return nil, err
+	}
+	completion := s.newTextCompletion(chat)
+	for _, c := range chat.Choices {
+		text := c.Message.Content
+		if s.echo {
+			text = s.prompt + text
+		}
+		completion.Choices = append(completion.Choices, &textChoice{
+			Text:         text,
+			Index:        c.Index,
+			Logprobs:     s.translateLogprobs(c.Logprobs),
+			FinishReason: c.FinishReason,
+		})
+	}
+	return codectool.MarshalJSON(completion)
+}
+
+func (s *completionsShim) newTextCompletion(chat *chatCompletionResponse) *textCompletion {
+	return &textCompletion{
+		ID:                chat.ID,
+		Object:            "text_completion",
+		Created:           chat.Created,
+		Model:             chat.Model,
+		SystemFingerprint: chat.SystemFingerprint,
+		Choices:           []*textChoice{},
+		Usage:             chat.Usage,
+	}
+}
+
+// translateLogprobs translates the logprobs of a chat choice to the legacy
+// format, the text offsets are counted from the start of the output.
+func (s *completionsShim) translateLogprobs(logprobs *chatLogprobs) *textLogprobs {
+	if !s.logprobs || logprobs == nil {
+		return nil
+	}
+	result := &textLogprobs{
+		Tokens:        []string{},
+		TokenLogprobs: []float64{},
+		TopLogprobs:   []map[string]float64{},
+		TextOffset:    []int{},
+	}
+	offset := 0
+	for _, c := range logprobs.Content {
+		top := map[string]float64{}
+		for _, t := range c.TopLogprobs {
+			top[t.Token] = t.Logprob
+		}
+		result.Tokens = append(result.Tokens, c.Token)
+		result.TokenLogprobs = append(result.TokenLogprobs, c.Logprob)
+		result.TopLogprobs = append(result.TopLogprobs, top)
+		result.TextOffset = append(result.TextOffset, offset)
+		offset += len(c.Token)
+	}
+	return result
+}
+
+func (s *completionsShim) newStreamReader(body io.Reader) *completionsStreamReader {
+	return &completionsStreamReader{
+		body:   body,
+		reader: bufio.NewReader(body),
+		shim:   s,
+		echoed: map[int]bool{},
+	}
+}
+
+// translateChunk translates a chat completion chunk, the data which is not
+// a chunk, like the error event, is returned as is.
+func (r *completionsStreamReader) translateChunk(data []byte) []byte {
+	chunk := &chatCompletionResponse{}
+	if err := json.Unmarshal(data, chunk); err != nil || chunk.Choices == nil {
+		return data
+	}
+	completion := r.shim.newTextCompletion(chunk)
+	for _, c := range chunk.Choices {
+		text := c.Delta.Content
+		if r.shim.echo && !r.echoed[c.Index] {
+			r.echoed[c.Index] = true
+			text = r.shim.prompt + text
+		}
+		completion.Choices = append(completion.Choices, &textChoice{
+			Text:         text,
+			Index:        c.Index,
+			Logprobs:     r.shim.translateLogprobs(c.Logprobs),
+			FinishReason: c.FinishReason,
+		})
+	}
+	result, err := codectool.MarshalJSON(completion)
+	if err != nil {
+		return data
+	}
+	return result
+}
+
+func (r *completionsStreamReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && !r.done {
+		line, err := r.reader.ReadBytes('\n')
+		if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = bytes.TrimSpace(data)
+			if !bytes.Equal(data, []byte("[DONE]")) {
+				data = r.translateChunk(data)
+			}
+			r.out.WriteString("data: ")
+			r.out.Write(data)
+			r.out.WriteString("\n")
+		} else {
+			r.out.Write(line)
+		}
+		if err != nil {
+			r.done = true
+		}
+	}
+	if r.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.out.Read(p)
+}
+
+// Close closes the upstream body.
+func (r *completionsStreamReader) Close() error {
+	if closer, ok := r.body.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCompletionsShim(t *testing.T) {
+	assert := assert.New(t)
+	cases := []struct {
+		name string
+		req  string
+		chat string
+		err  string
+	}{
+		{
+			name: "prompt",
+			req:  `{"model":"m","prompt":"Say hi","max_tokens":16,"temperature":0.5,"stop":["\n"],"user":"u"}`,
+			chat: `{"model":"m","messages":[{"role":"user","content":"Say hi"}],"max_tokens":16,"temperature":0.5,"stop":["\n"],"user":"u"}`,
+		},
+		{
+			name: "single prompt array",
+			req:  `{"model":"m","prompt":["Say hi"],"echo":true,"best_of":1,"suffix":""}`,
+			chat: `{"model":"m","messages":[{"role":"user","content":"Say hi"}]}`,
+		},
+		{
+			name: "logprobs",
+			req:  `{"model":"m","prompt":"Say hi","logprobs":3}`,
+			chat: `{"model":"m","messages":[{"role":"user","content":"Say hi"}],"logprobs":true,"top_logprobs":3}`,
+		},
+		{
+			name: "stream includes usage",
+			req:  `{"model":"m","prompt":"Say hi","stream":true}`,
+			chat: `{"model":"m","messages":[{"role":"user","content":"Say hi"}],"stream":true,"stream_options":{"include_usage":true}}`,
+		},
+		{
+			name: "stream keeps usage option",
+			req:  `{"model":"m","prompt":"Say hi","stream":true,"stream_options":{"include_usage":false}}`,
+			chat: `{"model":"m","messages":[{"role":"user","content":"Say hi"}],"stream":true,"stream_options":{"include_usage":false}}`,
+		},
+		{name: "no prompt", req: `{"model":"m"}`, err: "prompt is required"},
+		{name: "multiple prompts", req: `{"model":"m","prompt":["a","b"]}`, err: "prompt with 2 items"},
+		{name: "token prompt", req: `{"model":"m","prompt":[[1,2,3]]}`, err: "token IDs"},
+		{name: "suffix", req: `{"model":"m","prompt":"a","suffix":"b"}`, err: "suffix"},
+		{name: "best_of", req: `{"model":"m","prompt":"a","best_of":2}`, err: "best_of"},
+		{name: "echo with logprobs", req: `{"model":"m","prompt":"a","echo":true,"logprobs":1}`, err: "echo with logprobs"},
+	}
+
+	for _, c := range cases {
+		shim, err := newCompletionsShim([]byte(c.req))
+		if c.err != "" {
+			assert.ErrorContains(err, c.err, c.name)
+			continue
+		}
+		assert.Nil(err, c.name)
+		assert.JSONEq(c.chat, string(shim.body), c.name)
+	}
+}
+
+func TestCompletionsShimTranslateCompletion(t *testing.T) {
+	assert := assert.New(t)
+	chat := `{"id":"chatcmpl-1","object":"chat.completion","created":1700000000,"model":"m",
+		"choices":[{"index":0,"message":{"role":"assistant","content":"Hi there"},
+		"logprobs":{"content":[{"token":"Hi","logprob":-0.1,"top_logprobs":[{"token":"Hi","logprob":-0.1},{"token":"Hello","logprob":-2.5}]},
+		{"token":" there","logprob":-0.3,"top_logprobs":[{"token":" there","logprob":-0.3}]}]},"finish_reason":"stop"}],
+		"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`
+
+	cases := []struct {
+		name       string
+		req        string
+		completion string
+	}{
+		{
+			name: "plain",
+			req:  `{"model":"m","prompt":"Say hi"}`,
+			completion: `{"id":"chatcmpl-1","object":"text_completion","created":1700000000,"model":"m",
+				"choices":[{"text":"Hi there","index":0,"logprobs":null,"finish_reason":"stop"}],
+				"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		},
+		{
+			name: "echo",
+			req:  `{"model":"m","prompt":"Say hi","echo":true}`,
+			completion: `{"id":"chatcmpl-1","object":"text_completion","created":1700000000,"model":"m",
+				"choices":[{"text":"Say hiHi there","index":0,"logprobs":null,"finish_reason":"stop"}],
+				"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		},
+		{
+			name: "logprobs",
+			req:  `{"model":"m","prompt":"Say hi","logprobs":2}`,
+			completion: `{"id":"chatcmpl-1","object":"text_completion","created":1700000000,"model":"m",
+				"choices":[{"text":"Hi there","index":0,"finish_reason":"stop","logprobs":{
+				"tokens":["Hi"," there"],"token_logprobs":[-0.1,-0.3],
+				"top_logprobs":[{"Hi":-0.1,"Hello":-2.5},{" there":-0.3}],"text_offset":[0,2]}}],
+				"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		},
+	}
+
+	for _, c := range cases {
+		shim, err := newCompletionsShim([]byte(c.req))
+		assert.Nil(err, c.name)
+		data, err := shim.translateCompletion([]byte(chat))
+		assert.Nil(err, c.name)
+		assert.JSONEq(c.completion, string(data), c.name)
+	}
+
+	shim, err := newCompletionsShim([]byte(`{"model":"m","prompt":"a"}`))
+	assert.Nil(err)
+	_, err = shim.translateCompletion([]byte("not json"))
+	assert.NotNil(err)
+}
+
+func TestCompletionsStreamReader(t *testing.T) {
+	assert := assert.New(t)
+	stream := `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"Hi"}}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}
+
+data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[],"usage":{"prompt_tokens":2,"completion_tokens":1,"total_tokens":3}}
+
+data: {"error":{"message":"boom","type":"api_error","param":null,"code":null}}
+
+data: [DONE]
+
+`
+	expected := []string{
+		`{"id":"c1","object":"text_completion","created":1,"model":"m","choices":[{"text":"Say hi","index":0,"logprobs":null,"finish_reason":null}]}`,
+		`{"id":"c1","object":"text_completion","created":1,"model":"m","choices":[{"text":"Hi","index":0,"logprobs":null,"finish_reason":null}]}`,
+		`{"id":"c1","object":"text_completion","created":1,"model":"m","choices":[{"text":"","index":0,"logprobs":null,"finish_reason":"stop"}]}`,
+		`{"id":"c1","object":"text_completion","created":1,"model":"m","choices":[],"usage":{"prompt_tokens":2,"completion_tokens":1,"total_tokens":3}}`,
+		`{"error":{"message":"boom","type":"api_error","param":null,"code":null}}`,
+	}
+
+	shim, err := newCompletionsShim([]byte(`{"model":"m","prompt":"Say hi","echo":true,"stream":true}`))
+	assert.Nil(err)
+	reader := shim.newStreamReader(io.NopCloser(strings.NewReader(stream)))
+	data, err := io.ReadAll(reader)
+	assert.Nil(err)
+	assert.Nil(reader.Close())
+
+	events := strings.Split(strings.TrimSpace(string(data)), "\n\n")
+	assert.Equal(len(expected)+1, len(events))
+	for i, e := range expected {
+		assert.JSONEq(e, strings.TrimPrefix(events[i], "data: "), i)
+	}
+	assert.Equal("data: [DONE]", events[len(events)-1])
+}
+
+func TestBaseProviderCompletions(t *testing.T) {
+	assert := assert.New(t)
+	var paths []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		chatCompletionsHandler(w, r)
+	}))
+	defer mockServer.Close()
+
+	providerSpec := &aicontext.ProviderSpec{
+		Name:         "gemini",
+		ProviderType: GeminiProviderType,
+		BaseURL:      mockServer.URL,
+		APIKey:       "test-api-key",
+	}
+	provider := &BaseProvider{}
+	provider.init(providerSpec)
+
+	handle := func(body string) (*aicontext.Context, []byte) {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/v1/completions", bytes.NewReader([]byte(body)))
+		assert.Nil(err)
+		setRequest(t, ctx, "completions", req)
+		aiCtx, err := aicontext.New(ctx, providerSpec)
+		assert.Nil(err)
+		provider.Handle(aiCtx)
+		resp := aiCtx.GetResponse()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		data := resp.BodyBytes
+		if resp.BodyReader != nil {
+			data, err = io.ReadAll(resp.BodyReader)
+			assert.Nil(err)
+		}
+		return aiCtx, data
+	}
+
+	{
+		// non-stream
+		aiCtx, data := handle(`{"model":"gemini-2.5","prompt":"Hello world"}`)
+		completion := map[string]any{}
+		assert.Nil(json.Unmarshal(data, &completion))
+		assert.Equal("text_completion", completion["object"])
+		choice := completion["choices"].([]any)[0].(map[string]any)
+		assert.Equal("Hello world", choice["text"])
+
+		metric := aiCtx.ParseMetricFn(&aicontext.FinishContext{StatusCode: http.StatusOK, RespBody: data})
+		assert.True(metric.Success)
+		assert.Equal("/v1/completions", metric.ResponseType)
+		assert.Equal(int64(2), metric.InputTokens)
+		assert.Equal(int64(2), metric.OutputTokens)
+	}
+
+	{
+		// stream
+		aiCtx, data := handle(`{"model":"gemini-2.5","prompt":"Hello world","stream":true}`)
+		assert.Contains(string(data), `"object":"text_completion"`)
+		assert.Contains(string(data), `"text":"world"`)
+		assert.NotContains(string(data), "chat.completion")
+
+		metric := aiCtx.ParseMetricFn(&aicontext.FinishContext{StatusCode: http.StatusOK, RespBody: data})
+		assert.True(metric.Success)
+		assert.Equal(int64(2), metric.InputTokens)
+		assert.Equal(int64(2), metric.OutputTokens)
+	}
+
+	{
+		// rejected before proxied to the provider
+		aiCtx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/v1/completions", strings.NewReader(`{"model":"m","prompt":"a","suffix":"b"}`))
+		assert.Nil(err)
+		setRequest(t, aiCtx, "completions", req)
+		c, err := aicontext.New(aiCtx, providerSpec)
+		assert.Nil(err)
+		provider.Handle(c)
+		assert.Equal(http.StatusBadRequest, c.GetResponse().StatusCode)
+		assert.Equal(string(aicontext.ResultClientError), string(c.Result()))
+	}
+
+	assert.Equal([]string{"/v1/chat/completions", "/v1/chat/completions"}, paths)
+}
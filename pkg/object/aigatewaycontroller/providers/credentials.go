@@ -0,0 +1,447 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+// The modes of credential rotations.
+const (
+	// CredentialModeReplace replaces the API keys in use by the new one.
+	CredentialModeReplace = "replace"
+	// CredentialModeJoin adds the new API key to the ones in use, requests
+	// are balanced among them in round-robin.
+	CredentialModeJoin = "join"
+	// CredentialModeStaged sends a percentage of requests with the new API
+	// key during the soak, then it replaces the API keys in use.
+	CredentialModeStaged = "staged"
+)
+
+// The states of the API keys of a provider.
+const (
+	CredentialStateActive = "active"
+	CredentialStateStaged = "staged"
+)
+
+// The results of the requests counted by API key.
+const (
+	credentialResultSuccess      = "success"
+	credentialResultUnauthorized = "unauthorized"
+	credentialResultRateLimited  = "rateLimited"
+	credentialResultError        = "error"
+)
+
+const (
+	defaultCredentialSoak = 10 * time.Minute
+	// credentialVerifyTimeout bounds the verification request of a new
+	// API key.
+	credentialVerifyTimeout = 10 * time.Second
+	// credentialErrorBodyLimit bounds the body of the upstream error
+	// attached to a failed verification.
+	credentialErrorBodyLimit = 1024
+)
+
+var (
+	// ErrCredentialRotationUnsupported is returned by the providers whose
+	// signing does not use the API key.
+	ErrCredentialRotationUnsupported = errors.New("credential rotation is only supported by providers authenticated by API keys")
+	// ErrCredentialRotationInProgress is returned if a staged rotation is
+	// soaking.
+	ErrCredentialRotationInProgress = errors.New("a staged credential rotation is in progress")
+	// ErrNoCredentialRotation is returned when aborting without a staged
+	// rotation.
+	ErrNoCredentialRotation = errors.New("no staged credential rotation is in progress")
+	// ErrCredentialInUse is returned if the new API key is already in use.
+	ErrCredentialInUse = errors.New("the API key is already in use")
+)
+
+type (
+	// CredentialRotator is implemented by the providers which can rotate
+	// their API keys at runtime. The rotations are kept in the memory of
+	// the provider, so they are lost when the providers are reloaded.
+	CredentialRotator interface {
+		// RotateCredential verifies the new API key by a request listing
+		// the models, and rotates to it only if the request succeeds.
+		RotateCredential(ctx context.Context, rotation *CredentialRotation) (*CredentialStatus, error)
+		// AbortCredentialRotation removes the new API key of the staged
+		// rotation, the API keys in use are kept.
+		AbortCredentialRotation() (*CredentialStatus, error)
+		// CredentialStatus returns the API keys of the provider.
+		CredentialStatus() *CredentialStatus
+	}
+
+	// CredentialRotation is a request to rotate the API key of a provider.
+	CredentialRotation struct {
+		APIKey string `json:"apiKey"`
+		// Mode is replace by default.
+		Mode string `json:"mode,omitempty"`
+		// Percentage is the percentage of requests sent with the new API
+		// key during the soak of a staged rotation.
+		Percentage int `json:"percentage,omitempty"`
+		// Soak is how long a staged rotation lasts before the API keys in
+		// use are retired, default 10m.
+		Soak string `json:"soak,omitempty"`
+	}
+
+	// CredentialStatus is the API keys of a provider.
+	CredentialStatus struct {
+		Provider    string                 `json:"provider"`
+		Credentials []*CredentialKeyStatus `json:"credentials"`
+	}
+
+	// CredentialKeyStatus is an API key of a provider and its requests.
+	CredentialKeyStatus struct {
+		// Fingerprint identifies the API key without revealing it.
+		Fingerprint string `json:"fingerprint"`
+		State       string `json:"state"`
+		// Percentage and SoakEndsAt are set for the staged API key.
+		Percentage int    `json:"percentage,omitempty"`
+		SoakEndsAt string `json:"soakEndsAt,omitempty"`
+		AddedAt    string `json:"addedAt"`
+		Requests   int64  `json:"requests"`
+		Errors     int64  `json:"errors"`
+	}
+
+	// CredentialVerificationError is returned if the new API key fails
+	// the verification request, with the upstream error attached.
+	CredentialVerificationError struct {
+		StatusCode int
+		Body       string
+		Err        error
+	}
+
+	// credential is an API key of a provider.
+	credential struct {
+		fingerprint string
+		// signer signs the requests with the API key, it is nil for the
+		// API key of the spec if the provider has no signing.
+		signer     RequestSigner
+		addedAt    time.Time
+		percentage int
+		soakEndsAt time.Time
+		requests   atomic.Int64
+		errors     atomic.Int64
+	}
+
+	// credentialPool is the API keys of a provider, it starts with the API
+	// key of the spec.
+	credentialPool struct {
+		spec     *aicontext.ProviderSpec
+		requests *prometheus.CounterVec
+		next     atomic.Uint64
+
+		lock      sync.RWMutex
+		active    []*credential
+		staged    *credential
+		soakTimer *time.Timer
+	}
+)
+
+func (e *CredentialVerificationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("verification request failed: %v", e.Err)
+	}
+	return fmt.Sprintf("verification request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *CredentialVerificationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateCredentialRotation validates the rotation request.
+func ValidateCredentialRotation(rotation *CredentialRotation) error {
+	if rotation.APIKey == "" {
+		return fmt.Errorf("apiKey is required")
+	}
+	switch rotation.Mode {
+	case "", CredentialModeReplace, CredentialModeJoin:
+		if rotation.Percentage != 0 || rotation.Soak != "" {
+			return fmt.Errorf("percentage and soak are only used by the %s mode", CredentialModeStaged)
+		}
+	case CredentialModeStaged:
+		if rotation.Percentage < 1 || rotation.Percentage > 99 {
+			return fmt.Errorf("percentage must be between 1 and 99")
+		}
+		if rotation.Soak != "" {
+			soak, err := time.ParseDuration(rotation.Soak)
+			if err != nil {
+				return fmt.Errorf("invalid soak: %w", err)
+			}
+			if soak <= 0 {
+				return fmt.Errorf("soak must be positive")
+			}
+		}
+	default:
+		return fmt.Errorf("invalid mode %s", rotation.Mode)
+	}
+	return nil
+}
+
+// credentialFingerprint returns the first 12 hex digits of the SHA-256 of
+// the API key.
+func credentialFingerprint(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// newCredentialPool returns the API keys of the provider, it returns nil
+// if the signing of the provider does not use the API key.
+func newCredentialPool(spec *aicontext.ProviderSpec, signer RequestSigner) *credentialPool {
+	if spec.Signing != nil && spec.Signing.Type != SigningTypeBearer && spec.Signing.Type != SigningTypeAPIKey {
+		return nil
+	}
+	return &credentialPool{
+		spec:     spec,
+		requests: metricshub.ProviderCredentialRequests.NewCounter(),
+		active: []*credential{{
+			fingerprint: credentialFingerprint(spec.APIKey),
+			signer:      signer,
+			addedAt:     time.Now(),
+		}},
+	}
+}
+
+// newCredential returns the API key signing the requests like the API key
+// of the spec.
+func (p *credentialPool) newCredential(apiKey string) (*credential, error) {
+	spec := *p.spec
+	spec.APIKey = apiKey
+	signer, err := newRequestSigner(&spec)
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		signer = &bearerSigner{apiKey: apiKey}
+	}
+	return &credential{fingerprint: credentialFingerprint(apiKey), signer: signer, addedAt: time.Now()}, nil
+}
+
+// pick returns the API key of a request, the staged API key is picked by
+// its percentage, and the active ones in round-robin.
+func (p *credentialPool) pick() *credential {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.staged != nil && rand.IntN(100) < p.staged.percentage {
+		return p.staged
+	}
+	return p.active[(p.next.Add(1)-1)%uint64(len(p.active))]
+}
+
+// primary returns the first active API key, which signs the health checks.
+func (p *credentialPool) primary() *credential {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.active[0]
+}
+
+// record counts the result of a request by the status code of its
+// response, 0 means the request failed without a response.
+func (p *credentialPool) record(c *credential, statusCode int) {
+	result := credentialResultSuccess
+	switch {
+	case statusCode == http.StatusOK:
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		result = credentialResultUnauthorized
+	case statusCode == http.StatusTooManyRequests:
+		result = credentialResultRateLimited
+	default:
+		result = credentialResultError
+	}
+	c.requests.Add(1)
+	if result != credentialResultSuccess {
+		c.errors.Add(1)
+	}
+	p.requests.With(prometheus.Labels{"provider": p.spec.Name, "credential": c.fingerprint, "result": result}).Inc()
+}
+
+// check checks whether the pool can rotate to the API key, the caller must
+// hold the lock.
+func (p *credentialPool) check(c *credential) error {
+	if p.staged != nil {
+		return ErrCredentialRotationInProgress
+	}
+	if slices.ContainsFunc(p.active, func(a *credential) bool { return a.fingerprint == c.fingerprint }) {
+		return ErrCredentialInUse
+	}
+	return nil
+}
+
+// precheck checks whether the pool can rotate to the API key before it is
+// verified.
+func (p *credentialPool) precheck(c *credential) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.check(c)
+}
+
+// rotate rotates to the verified API key by the mode of the rotation.
+func (p *credentialPool) rotate(c *credential, rotation *CredentialRotation) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.check(c); err != nil {
+		return err
+	}
+
+	switch rotation.Mode {
+	case CredentialModeJoin:
+		p.active = append(slices.Clone(p.active), c)
+		logger.Infof("API key %s joined provider %s", c.fingerprint, p.spec.Name)
+	case CredentialModeStaged:
+		soak := defaultCredentialSoak
+		if rotation.Soak != "" {
+			soak, _ = time.ParseDuration(rotation.Soak)
+		}
+		c.percentage = rotation.Percentage
+		c.soakEndsAt = time.Now().Add(soak)
+		p.staged = c
+		p.soakTimer = time.AfterFunc(soak, func() { p.promote(c) })
+		logger.Infof("API key %s of provider %s is staged with %d%% of requests for %s", c.fingerprint, p.spec.Name, c.percentage, soak)
+	default:
+		p.active = []*credential{c}
+		logger.Infof("API key %s replaced the API keys of provider %s", c.fingerprint, p.spec.Name)
+	}
+	return nil
+}
+
+// promote replaces the active API keys by the staged one after its soak,
+// unless the rotation is aborted.
+func (p *credentialPool) promote(c *credential) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.staged != c {
+		return
+	}
+	c.percentage, c.soakEndsAt = 0, time.Time{}
+	p.active, p.staged, p.soakTimer = []*credential{c}, nil, nil
+	logger.Infof("staged API key %s replaced the API keys of provider %s after the soak", c.fingerprint, p.spec.Name)
+}
+
+// abort removes the staged API key.
+func (p *credentialPool) abort() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.staged == nil {
+		return ErrNoCredentialRotation
+	}
+	p.soakTimer.Stop()
+	logger.Infof("staged API key %s of provider %s is removed", p.staged.fingerprint, p.spec.Name)
+	p.staged, p.soakTimer = nil, nil
+	return nil
+}
+
+func (p *credentialPool) status() *CredentialStatus {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	status := &CredentialStatus{Provider: p.spec.Name}
+	keyStatus := func(c *credential, state string) *CredentialKeyStatus {
+		s := &CredentialKeyStatus{
+			Fingerprint: c.fingerprint,
+			State:       state,
+			Percentage:  c.percentage,
+			AddedAt:     c.addedAt.Format(time.RFC3339),
+			Requests:    c.requests.Load(),
+			Errors:      c.errors.Load(),
+		}
+		if !c.soakEndsAt.IsZero() {
+			s.SoakEndsAt = c.soakEndsAt.Format(time.RFC3339)
+		}
+		return s
+	}
+	for _, c := range p.active {
+		status.Credentials = append(status.Credentials, keyStatus(c, CredentialStateActive))
+	}
+	if p.staged != nil {
+		status.Credentials = append(status.Credentials, keyStatus(p.staged, CredentialStateStaged))
+	}
+	return status
+}
+
+// close stops the soak of the staged rotation, the staged API key is
+// never promoted then.
+func (p *credentialPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.soakTimer != nil {
+		p.soakTimer.Stop()
+	}
+}
+
+// RotateCredential verifies the new API key by a request listing the
+// models, and rotates to it if the request succeeds.
+func (bp *BaseProvider) RotateCredential(ctx context.Context, rotation *CredentialRotation) (*CredentialStatus, error) {
+	if bp.credentials == nil {
+		return nil, ErrCredentialRotationUnsupported
+	}
+	if err := ValidateCredentialRotation(rotation); err != nil {
+		return nil, err
+	}
+	c, err := bp.credentials.newCredential(rotation.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := bp.credentials.precheck(c); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, credentialVerifyTimeout)
+	defer cancel()
+	if err := bp.endpoints.verify(ctx, c.signer); err != nil {
+		logger.Warnf("API key %s of provider %s failed the verification: %v", c.fingerprint, bp.providerSpec.Name, err)
+		return nil, err
+	}
+	if err := bp.credentials.rotate(c, rotation); err != nil {
+		return nil, err
+	}
+	return bp.credentials.status(), nil
+}
+
+// AbortCredentialRotation removes the new API key of the staged rotation.
+func (bp *BaseProvider) AbortCredentialRotation() (*CredentialStatus, error) {
+	if bp.credentials == nil {
+		return nil, ErrNoCredentialRotation
+	}
+	if err := bp.credentials.abort(); err != nil {
+		return nil, err
+	}
+	return bp.credentials.status(), nil
+}
+
+// CredentialStatus returns the API keys of the provider, it is nil if the
+// provider is not authenticated by API keys.
+func (bp *BaseProvider) CredentialStatus() *CredentialStatus {
+	if bp.credentials == nil {
+		return nil
+	}
+	return bp.credentials.status()
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	stdcontext "context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+// keyServer accepts the requests carrying the valid API keys, and records
+// the API keys of the chat completions.
+type keyServer struct {
+	*httptest.Server
+	header string
+	lock   sync.Mutex
+	valid  map[string]bool
+	used   []string
+}
+
+func newKeyServer(header string, valid ...string) *keyServer {
+	s := &keyServer{header: header, valid: map[string]bool{}}
+	for _, key := range valid {
+		s.valid[key] = true
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get(s.header), "Bearer ")
+		s.lock.Lock()
+		valid := s.valid[key]
+		if r.URL.Path != string(aicontext.ResponseTypeModels) {
+			s.used = append(s.used, key)
+		}
+		s.lock.Unlock()
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"message": "invalid api key", "type": "invalid_request_error"}}`))
+			return
+		}
+		if r.URL.Path == string(aicontext.ResponseTypeModels) {
+			w.Write([]byte(`{"object": "list", "data": []}`))
+			return
+		}
+		chatCompletionsHandler(w, r)
+	}))
+	return s
+}
+
+func (s *keyServer) setValid(key string, valid bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.valid[key] = valid
+}
+
+func (s *keyServer) usedKeys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	used := s.used
+	s.used = nil
+	return used
+}
+
+func sendChatCompletion(t *testing.T, provider Provider) int {
+	ctx := context.New(nil)
+	req, err := createChatCompletionRequest("gpt-5", false, "hello")
+	assert.Nil(t, err)
+	setRequest(t, ctx, "chat.completions", req)
+	aiCtx, err := aicontext.New(ctx, provider.Spec())
+	assert.Nil(t, err)
+	provider.Handle(aiCtx)
+	for _, cb := range aiCtx.Callbacks() {
+		cb(&aicontext.FinishContext{})
+	}
+	return aiCtx.GetResponse().StatusCode
+}
+
+func fingerprints(status *CredentialStatus) []string {
+	var result []string
+	for _, c := range status.Credentials {
+		result = append(result, c.Fingerprint+":"+c.State)
+	}
+	return result
+}
+
+func TestValidateCredentialRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateCredentialRotation(&CredentialRotation{APIKey: "k"}))
+	assert.NoError(ValidateCredentialRotation(&CredentialRotation{APIKey: "k", Mode: CredentialModeJoin}))
+	assert.NoError(ValidateCredentialRotation(&CredentialRotation{APIKey: "k", Mode: CredentialModeStaged, Percentage: 10, Soak: "30m"}))
+
+	assert.Error(ValidateCredentialRotation(&CredentialRotation{}))
+	assert.Error(ValidateCredentialRotation(&CredentialRotation{APIKey: "k", Mode: "swap"}))
+	assert.Error(ValidateCredentialRotation(&CredentialRotation{APIKey: "k", Percentage: 10}))
+	assert.Error(ValidateCredentialRotation(&CredentialRotation{APIKey: "k", Mode: CredentialModeStaged}))
+	assert.Error(ValidateCredentialRotation(&CredentialRotation{APIKey: "k", Mode: CredentialModeStaged, Percentage: 100}))
+	assert.Error(ValidateCredentialRotation(&CredentialRotation{APIKey: "k", Mode: CredentialModeStaged, Percentage: 10, Soak: "-1m"}))
+}
+
+func TestRotateCredential(t *testing.T) {
+	assert := assert.New(t)
+	ctx := stdcontext.Background()
+
+	server := newKeyServer("Authorization", "old-key", "new-key", "join-key", "staged-key")
+	defer server.Close()
+	spec := &aicontext.ProviderSpec{Name: "openai", ProviderType: "openai", BaseURL: server.URL, APIKey: "old-key"}
+	provider := &BaseProvider{}
+	provider.init(spec)
+	defer provider.Close()
+
+	old, newKey := credentialFingerprint("old-key"), credentialFingerprint("new-key")
+	assert.Equal([]string{old + ":active"}, fingerprints(provider.CredentialStatus()))
+	assert.Equal(http.StatusOK, sendChatCompletion(t, provider))
+	assert.Equal([]string{"old-key"}, server.usedKeys())
+
+	// a bad API key is rejected with the upstream error.
+	_, err := provider.RotateCredential(ctx, &CredentialRotation{APIKey: "bad-key"})
+	var verifyErr *CredentialVerificationError
+	assert.True(errors.As(err, &verifyErr))
+	assert.Equal(http.StatusUnauthorized, verifyErr.StatusCode)
+	assert.Contains(err.Error(), "invalid api key")
+	assert.Equal([]string{old + ":active"}, fingerprints(provider.CredentialStatus()))
+
+	// the new API key replaces the old one, which can be revoked then.
+	status, err := provider.RotateCredential(ctx, &CredentialRotation{APIKey: "new-key"})
+	assert.NoError(err)
+	assert.Equal([]string{newKey + ":active"}, fingerprints(status))
+	server.setValid("old-key", false)
+	assert.Equal(http.StatusOK, sendChatCompletion(t, provider))
+	assert.Equal([]string{"new-key"}, server.usedKeys())
+	assert.NoError(provider.HealthCheck())
+	_, err = provider.RotateCredential(ctx, &CredentialRotation{APIKey: "new-key"})
+	assert.ErrorIs(err, ErrCredentialInUse)
+
+	// the joined API key shares the requests.
+	status, err = provider.RotateCredential(ctx, &CredentialRotation{APIKey: "join-key", Mode: CredentialModeJoin})
+	assert.NoError(err)
+	assert.Len(status.Credentials, 2)
+	for i := 0; i < 4; i++ {
+		assert.Equal(http.StatusOK, sendChatCompletion(t, provider))
+	}
+	assert.ElementsMatch([]string{"new-key", "join-key", "new-key", "join-key"}, server.usedKeys())
+
+	// the requests and errors are counted by API key.
+	server.setValid("join-key", false)
+	for i := 0; i < 4; i++ {
+		sendChatCompletion(t, provider)
+	}
+	server.usedKeys()
+	for _, c := range provider.CredentialStatus().Credentials {
+		switch c.Fingerprint {
+		case newKey:
+			assert.Equal(int64(5), c.Requests)
+			assert.Equal(int64(0), c.Errors)
+		default:
+			assert.Equal(int64(4), c.Requests)
+			assert.Equal(int64(2), c.Errors)
+		}
+	}
+}
+
+func TestStagedCredentialRotation(t *testing.T) {
+	assert := assert.New(t)
+	ctx := stdcontext.Background()
+
+	server := newKeyServer("X-Key", "old-key", "staged-key")
+	defer server.Close()
+	spec := &aicontext.ProviderSpec{
+		Name:         "openai",
+		ProviderType: "openai",
+		BaseURL:      server.URL,
+		APIKey:       "old-key",
+		Signing:      &aicontext.SigningSpec{Type: SigningTypeAPIKey, Header: "X-Key"},
+	}
+	provider := &BaseProvider{}
+	provider.init(spec)
+	defer provider.Close()
+
+	old, staged := credentialFingerprint("old-key"), credentialFingerprint("staged-key")
+	status, err := provider.RotateCredential(ctx, &CredentialRotation{APIKey: "staged-key", Mode: CredentialModeStaged, Percentage: 50, Soak: "1h"})
+	assert.NoError(err)
+	assert.Equal([]string{old + ":active", staged + ":staged"}, fingerprints(status))
+	assert.Equal(50, status.Credentials[1].Percentage)
+	assert.NotEmpty(status.Credentials[1].SoakEndsAt)
+	for i := 0; i < 50; i++ {
+		assert.Equal(http.StatusOK, sendChatCompletion(t, provider))
+	}
+	// the staged API key is signed like the API key of the spec.
+	assert.Contains(server.usedKeys(), "staged-key")
+
+	_, err = provider.RotateCredential(ctx, &CredentialRotation{APIKey: "another-key"})
+	assert.ErrorIs(err, ErrCredentialRotationInProgress)
+
+	// the aborted rotation keeps the old API key.
+	status, err = provider.AbortCredentialRotation()
+	assert.NoError(err)
+	assert.Equal([]string{old + ":active"}, fingerprints(status))
+	_, err = provider.AbortCredentialRotation()
+	assert.ErrorIs(err, ErrNoCredentialRotation)
+
+	// the staged API key replaces the old one after the soak.
+	_, err = provider.RotateCredential(ctx, &CredentialRotation{APIKey: "staged-key", Mode: CredentialModeStaged, Percentage: 10, Soak: "10ms"})
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		status := provider.CredentialStatus()
+		return len(status.Credentials) == 1 && status.Credentials[0].Fingerprint == staged
+	}, time.Second, 5*time.Millisecond)
+	sendChatCompletion(t, provider)
+	assert.Equal([]string{"staged-key"}, server.usedKeys())
+}
+
+func TestRotateCredentialUnsupported(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &aicontext.ProviderSpec{
+		Name:         "bedrock",
+		ProviderType: "bedrock",
+		BaseURL:      "http://localhost:1",
+		Signing: &aicontext.SigningSpec{
+			Type:            SigningTypeSigV4,
+			Region:          "us-east-1",
+			Service:         "bedrock",
+			AccessKeyID:     "id",
+			SecretAccessKey: "secret",
+		},
+	}
+	provider := &BaseProvider{}
+	provider.init(spec)
+	defer provider.Close()
+
+	assert.Nil(provider.CredentialStatus())
+	_, err := provider.RotateCredential(stdcontext.Background(), &CredentialRotation{APIKey: "k"})
+	assert.ErrorIs(err, ErrCredentialRotationUnsupported)
+	_, err = provider.AbortCredentialRotation()
+	assert.ErrorIs(err, ErrNoCredentialRotation)
+}
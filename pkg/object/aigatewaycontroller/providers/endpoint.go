@@ -0,0 +1,335 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultHealthCheckInterval is the health check interval of endpoints
+// when a provider has more than one base URL.
+const defaultHealthCheckInterval = 10 * time.Second
+
+type (
+	// endpoint is a base URL of a provider, each endpoint has its own
+	// connection pool, so it can be flushed independently.
+	endpoint struct {
+		baseURL string
+		host    string
+		client  atomic.Pointer[providerClient]
+		healthy atomic.Bool
+
+		// addrs is the last resolved addresses of host, it is accessed
+		// by the refresh goroutine only.
+		addrs []string
+	}
+
+	// EndpointHealth is the last known health of a base URL of a provider.
+	EndpointHealth struct {
+		BaseURL string `json:"baseURL"`
+		Healthy bool   `json:"healthy"`
+	}
+
+	// endpointManager balances requests among the endpoints of a provider in
+	// round-robin, and fails over to other endpoints if one is unreachable.
+	endpointManager struct {
+		spec   *aicontext.ProviderSpec
+		signer RequestSigner
+		// credentials are the API keys of the provider, the health checks
+		// are signed by the first active one.
+		credentials *credentialPool
+		endpoints   []*endpoint
+		next        atomic.Uint64
+		failovers   *prometheus.CounterVec
+
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+)
+
+func validateEndpoints(spec *aicontext.ProviderSpec) error {
+	for _, baseURL := range spec.BaseURLs {
+		u, err := url.Parse(baseURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid baseURL %s", baseURL)
+		}
+	}
+	if spec.HealthCheckInterval != "" {
+		if _, err := time.ParseDuration(spec.HealthCheckInterval); err != nil {
+			return fmt.Errorf("invalid healthCheckInterval: %w", err)
+		}
+	}
+	return nil
+}
+
+func newEndpointManager(spec *aicontext.ProviderSpec, signer RequestSigner, credentials *credentialPool) *endpointManager {
+	m := &endpointManager{
+		spec:        spec,
+		signer:      signer,
+		credentials: credentials,
+		failovers:   metricshub.ProviderFailovers.NewCounter(),
+		done:        make(chan struct{}),
+	}
+	for _, baseURL := range append([]string{spec.BaseURL}, spec.BaseURLs...) {
+		ep := &endpoint{baseURL: baseURL}
+		if u, err := url.Parse(baseURL); err == nil {
+			ep.host = u.Hostname()
+		}
+		ep.client.Store(newProviderClient(spec.HTTPClient))
+		ep.healthy.Store(true)
+		m.endpoints = append(m.endpoints, ep)
+	}
+
+	healthCheckInterval := time.Duration(0)
+	if len(m.endpoints) > 1 {
+		healthCheckInterval = defaultHealthCheckInterval
+		if spec.HealthCheckInterval != "" {
+			healthCheckInterval, _ = time.ParseDuration(spec.HealthCheckInterval)
+		}
+	}
+	dnsRefreshInterval := time.Duration(0)
+	if spec.HTTPClient != nil && spec.HTTPClient.DNSRefreshInterval != "" {
+		dnsRefreshInterval, _ = time.ParseDuration(spec.HTTPClient.DNSRefreshInterval)
+	}
+	if healthCheckInterval > 0 {
+		go m.run(healthCheckInterval, func() { m.checkHealth() })
+	}
+	if dnsRefreshInterval > 0 {
+		go m.run(dnsRefreshInterval, m.refreshDNS)
+	}
+	return m
+}
+
+func (m *endpointManager) run(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// pick returns the next healthy endpoint in round-robin, the endpoints in
+// excluded are skipped. If all endpoints are unhealthy, it picks from all
+// of them. It returns nil if all endpoints are excluded.
+func (m *endpointManager) pick(excluded []*endpoint) *endpoint {
+	var candidates []*endpoint
+	for _, ep := range m.endpoints {
+		if !slices.Contains(excluded, ep) && ep.healthy.Load() {
+			candidates = append(candidates, ep)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, ep := range m.endpoints {
+			if !slices.Contains(excluded, ep) {
+				candidates = append(candidates, ep)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[(m.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+// health returns the last known health of the endpoints, set by the
+// failovers and the health checks.
+func (m *endpointManager) health() []*EndpointHealth {
+	health := make([]*EndpointHealth, 0, len(m.endpoints))
+	for _, ep := range m.endpoints {
+		health = append(health, &EndpointHealth{BaseURL: ep.baseURL, Healthy: ep.healthy.Load()})
+	}
+	return health
+}
+
+// failover marks the endpoint unhealthy because of err.
+func (m *endpointManager) failover(ep *endpoint, err error) {
+	// nothing to fail over to.
+	if len(m.endpoints) == 1 {
+		return
+	}
+	if !ep.healthy.CompareAndSwap(true, false) {
+		return
+	}
+	logger.Warnf("endpoint %s of provider %s is unhealthy, fail over to other endpoints: %v", ep.baseURL, m.spec.Name, err)
+	if m.failovers != nil {
+		m.failovers.With(prometheus.Labels{"provider": m.spec.Name, "baseUrl": ep.baseURL}).Inc()
+	}
+}
+
+func (m *endpointManager) recover(ep *endpoint) {
+	if ep.healthy.CompareAndSwap(false, true) {
+		logger.Infof("endpoint %s of provider %s is healthy again", ep.baseURL, m.spec.Name)
+	}
+}
+
+// newModelsRequest creates the request listing the models of the
+// endpoint signed by the signer, or authenticated by the APIKey as a
+// bearer token if signer is nil.
+func (m *endpointManager) newModelsRequest(ctx context.Context, ep *endpoint, signer RequestSigner) (*http.Request, error) {
+	checkURL, err := url.JoinPath(ep.baseURL, string(aicontext.ResponseTypeModels))
+	if err != nil {
+		return nil, fmt.Errorf("failed to join URL: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if signer == nil {
+		req.Header.Set("Authorization", "Bearer "+m.spec.APIKey)
+	} else if err := signRequest(signer, req, nil); err != nil {
+		return nil, fmt.Errorf("failed to sign request: %w", err)
+	}
+	return req, nil
+}
+
+// verify sends the request listing the models signed by the signer to an
+// endpoint, the health of the endpoint is not changed by it.
+func (m *endpointManager) verify(ctx context.Context, signer RequestSigner) error {
+	ep := m.pick(nil)
+	req, err := m.newModelsRequest(ctx, ep, signer)
+	if err != nil {
+		return err
+	}
+	resp, err := ep.client.Load().Do(req)
+	if err != nil {
+		return &CredentialVerificationError{Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, credentialErrorBodyLimit))
+		return &CredentialVerificationError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// healthCheck checks the endpoint and updates its health state.
+func (m *endpointManager) healthCheck(ep *endpoint) error {
+	signer := m.signer
+	if m.credentials != nil {
+		signer = m.credentials.primary().signer
+	}
+	req, err := m.newModelsRequest(context.Background(), ep, signer)
+	if err != nil {
+		return fmt.Errorf("failed to create health check request: %w", err)
+	}
+
+	resp, err := ep.client.Load().Do(req)
+	if err != nil {
+		err = fmt.Errorf("health check request failed: %w", err)
+		m.failover(ep, err)
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("health check failed, status code: %d", resp.StatusCode)
+		m.failover(ep, err)
+		return err
+	}
+	m.recover(ep)
+	return nil
+}
+
+// checkHealth checks all endpoints, it returns error if none of them is healthy.
+func (m *endpointManager) checkHealth() error {
+	if len(m.endpoints) == 1 {
+		return m.healthCheck(m.endpoints[0])
+	}
+
+	var errs []string
+	for _, ep := range m.endpoints {
+		if err := m.healthCheck(ep); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", ep.baseURL, err))
+		}
+	}
+	if len(errs) == len(m.endpoints) {
+		return fmt.Errorf("all endpoints are unhealthy, %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// refreshDNS resolves the hosts of endpoints, and flushes the connection
+// pool of an endpoint if its addresses change.
+func (m *endpointManager) refreshDNS() {
+	for _, ep := range m.endpoints {
+		if ep.host == "" || net.ParseIP(ep.host) != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, ep.host)
+		cancel()
+		if err != nil {
+			logger.Errorf("failed to resolve host %s of provider %s: %v", ep.host, m.spec.Name, err)
+			continue
+		}
+		slices.Sort(addrs)
+		if ep.addrs != nil && !slices.Equal(ep.addrs, addrs) {
+			logger.Infof("addresses of host %s of provider %s change from %v to %v, flush connections",
+				ep.host, m.spec.Name, ep.addrs, addrs)
+			m.flushEndpoint(ep)
+		}
+		ep.addrs = addrs
+	}
+}
+
+// flushEndpoint replaces the connection pool of the endpoint. In-flight
+// requests complete on their connections, and the idle connections of the
+// old pool are closed.
+func (m *endpointManager) flushEndpoint(ep *endpoint) {
+	old := ep.client.Swap(newProviderClient(m.spec.HTTPClient))
+	old.CloseIdleConnections()
+}
+
+// flush replaces the connection pools of all endpoints.
+func (m *endpointManager) flush() {
+	for _, ep := range m.endpoints {
+		m.flushEndpoint(ep)
+	}
+	logger.Infof("connections of provider %s are flushed", m.spec.Name)
+}
+
+func (m *endpointManager) close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, ep := range m.endpoints {
+			ep.client.Load().CloseIdleConnections()
+		}
+	})
+}
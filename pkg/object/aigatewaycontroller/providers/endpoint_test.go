@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointManagerPick(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &aicontext.ProviderSpec{
+		Name:                "openai",
+		ProviderType:        "openai",
+		BaseURL:             "http://127.0.0.1:1",
+		BaseURLs:            []string{"http://127.0.0.1:2", "http://127.0.0.1:3"},
+		APIKey:              "test-api-key",
+		HealthCheckInterval: "1h",
+	}
+	assert.Nil(validateEndpoints(spec))
+	m := newEndpointManager(spec, nil, nil)
+	defer m.close()
+
+	// round-robin
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		counts[m.pick(nil).baseURL]++
+	}
+	assert.Equal(map[string]int{"http://127.0.0.1:1": 10, "http://127.0.0.1:2": 10, "http://127.0.0.1:3": 10}, counts)
+
+	// skip unhealthy endpoints
+	m.failover(m.endpoints[0], io.EOF)
+	for i := 0; i < 10; i++ {
+		assert.NotEqual("http://127.0.0.1:1", m.pick(nil).baseURL)
+	}
+	assert.Equal("http://127.0.0.1:3", m.pick([]*endpoint{m.endpoints[1]}).baseURL)
+
+	// pick unhealthy endpoints if all are unhealthy
+	m.failover(m.endpoints[1], io.EOF)
+	m.failover(m.endpoints[2], io.EOF)
+	assert.NotNil(m.pick(nil))
+	assert.Nil(m.pick(m.endpoints))
+
+	m.recover(m.endpoints[0])
+	assert.Equal("http://127.0.0.1:1", m.pick(nil).baseURL)
+
+	// flush replaces the connection pools
+	client := m.endpoints[0].client.Load()
+	m.flush()
+	assert.NotSame(client, m.endpoints[0].client.Load())
+
+	spec.BaseURLs = []string{"127.0.0.1:2"}
+	assert.NotNil(validateEndpoints(spec))
+	spec.BaseURLs = nil
+	spec.HealthCheckInterval = "10"
+	assert.NotNil(validateEndpoints(spec))
+}
+
+func TestBaseProviderFailover(t *testing.T) {
+	assert := assert.New(t)
+
+	var served atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == string(aicontext.ResponseTypeModels) {
+			w.Write([]byte(`{"object": "list", "data": []}`))
+			return
+		}
+		served.Add(1)
+		chatCompletionsHandler(w, r)
+	}))
+	defer server.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	providerSpec := &aicontext.ProviderSpec{
+		Name:                "openai",
+		ProviderType:        "openai",
+		BaseURL:             dead.URL,
+		BaseURLs:            []string{server.URL},
+		APIKey:              "test-api-key",
+		HealthCheckInterval: "1h",
+	}
+	provider := &BaseProvider{}
+	assert.Nil(provider.validate(providerSpec))
+	provider.init(providerSpec)
+	defer provider.Close()
+
+	for i := 0; i < 4; i++ {
+		ctx := context.New(nil)
+		req, err := createChatCompletionRequest("gpt-5", false, "hello")
+		assert.Nil(err)
+		setRequest(t, ctx, "chat.completions", req)
+		aiCtx, err := aicontext.New(ctx, providerSpec)
+		assert.Nil(err)
+		provider.Handle(aiCtx)
+
+		resp := aiCtx.GetResponse()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		data, err := io.ReadAll(resp.BodyReader)
+		assert.Nil(err)
+		metric := aiCtx.ParseMetricFn(&aicontext.FinishContext{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			RespBody:   data,
+		})
+		assert.True(metric.Success)
+		assert.Equal(server.URL, metric.BaseURL)
+		for _, cb := range aiCtx.Callbacks() {
+			cb(&aicontext.FinishContext{})
+		}
+	}
+	assert.Equal(int32(4), served.Load())
+	assert.False(provider.endpoints.endpoints[0].healthy.Load())
+
+	// the health check keeps the dead endpoint out.
+	assert.Nil(provider.HealthCheck())
+	assert.False(provider.endpoints.endpoints[0].healthy.Load())
+	assert.True(provider.endpoints.endpoints[1].healthy.Load())
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+type (
+	// responseLimit enforces the maximum response size of a single request.
+	responseLimit struct {
+		provider string
+		maxBytes int64
+		stream   bool
+		exceeded atomic.Bool
+	}
+
+	// limitedStreamReader reads a streaming response until the limit is
+	// reached, then it aborts the upstream connection and ends the stream
+	// with an error event.
+	limitedStreamReader struct {
+		body     io.Reader
+		limit    *responseLimit
+		read     int64
+		errEvent []byte
+	}
+)
+
+func validateMaxResponseBytesSpec(spec *aicontext.MaxResponseBytesSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.Body < 0 || spec.Stream < 0 {
+		return fmt.Errorf("body and stream must be greater than or equal to 0")
+	}
+	return nil
+}
+
+func newResponseLimit(spec *aicontext.ProviderSpec, stream bool) *responseLimit {
+	limit := &responseLimit{provider: spec.Name, stream: stream}
+	if spec.MaxResponseBytes == nil {
+		return limit
+	}
+	if stream {
+		limit.maxBytes = spec.MaxResponseBytes.Stream
+	} else {
+		limit.maxBytes = spec.MaxResponseBytes.Body
+	}
+	return limit
+}
+
+func (l *responseLimit) err() error {
+	return fmt.Errorf("response of provider %s exceeds the limit of %d bytes", l.provider, l.maxBytes)
+}
+
+// apply enforces the limit on the response of the context.
+func (l *responseLimit) apply(ctx *aicontext.Context) {
+	resp := ctx.GetResponse()
+	if l.maxBytes <= 0 || resp == nil || resp.BodyReader == nil {
+		return
+	}
+
+	if l.stream {
+		resp.BodyReader = &limitedStreamReader{body: resp.BodyReader, limit: l}
+		resp.ContentLength = -1
+		return
+	}
+
+	if resp.ContentLength > l.maxBytes {
+		l.abort(ctx, resp.BodyReader)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.BodyReader, l.maxBytes+1))
+	if err != nil {
+		closeBody(resp.BodyReader)
+		setErrResponse(ctx, http.StatusBadGateway, fmt.Errorf("failed to read response of provider %s: %w", l.provider, err))
+		ctx.Stop(aicontext.ResultProviderError)
+		return
+	}
+	if int64(len(body)) > l.maxBytes {
+		l.abort(ctx, resp.BodyReader)
+		return
+	}
+	resp.BodyReader = nil
+	resp.BodyBytes = body
+}
+
+// abort closes the upstream body without draining it, so the connection
+// is dropped instead of reading the rest of the response.
+func (l *responseLimit) abort(ctx *aicontext.Context, body io.Reader) {
+	l.exceeded.Store(true)
+	closeBody(body)
+	logger.Errorf("%v, abort the response", l.err())
+	setErrResponse(ctx, http.StatusBadGateway, l.err())
+	ctx.Stop(aicontext.ResultProviderError)
+}
+
+func (r *limitedStreamReader) Read(p []byte) (int, error) {
+	if r.errEvent != nil {
+		n := copy(p, r.errEvent)
+		r.errEvent = r.errEvent[n:]
+		if len(r.errEvent) == 0 {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if r.limit.exceeded.Load() {
+		return 0, io.EOF
+	}
+
+	remaining := r.limit.maxBytes - r.read
+	if int64(len(p)) > remaining+1 {
+		p = p[:remaining+1]
+	}
+	n, err := r.body.Read(p)
+	if r.read+int64(n) <= r.limit.maxBytes {
+		r.read += int64(n)
+		return n, err
+	}
+
+	// Forward the bytes within the limit, and the error event in
+	// following reads.
+	n = int(remaining)
+	r.read += int64(n)
+	r.limit.exceeded.Store(true)
+	closeBody(r.body)
+	logger.Errorf("%v, abort the stream", r.limit.err())
+
+	data, _ := codectool.MarshalJSON(protocol.NewError(http.StatusBadGateway, r.limit.err().Error()))
+	// The leading blank line terminates the event truncated by the limit.
+	r.errEvent = []byte("\n\ndata: " + string(data) + "\n\n")
+	return n, nil
+}
+
+func closeBody(body io.Reader) {
+	if closer, ok := body.(io.Closer); ok {
+		closer.Close()
+	}
+}
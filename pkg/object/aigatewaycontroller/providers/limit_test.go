@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package providers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+// trackedBody is an upstream body recording how much is read from it and
+// whether it is closed.
+type trackedBody struct {
+	r      io.Reader
+	read   int
+	closed bool
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += n
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func newLimitContext(body *trackedBody, contentLength int64) *aicontext.Context {
+	ctx := &aicontext.Context{}
+	ctx.SetResponse(&aicontext.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: contentLength,
+		BodyReader:    body,
+	})
+	return ctx
+}
+
+func TestResponseLimitBody(t *testing.T) {
+	assert := assert.New(t)
+	spec := &aicontext.ProviderSpec{
+		Name:             "openai",
+		MaxResponseBytes: &aicontext.MaxResponseBytesSpec{Body: 100},
+	}
+
+	{
+		// the content length exceeds the limit, the body is rejected
+		// without reading it.
+		body := &trackedBody{r: strings.NewReader(strings.Repeat("a", 1000))}
+		ctx := newLimitContext(body, 1000)
+		limit := newResponseLimit(spec, false)
+		limit.apply(ctx)
+		assert.True(limit.exceeded.Load())
+		assert.Equal(0, body.read)
+		assert.True(body.closed)
+		assert.Equal(http.StatusBadGateway, ctx.GetResponse().StatusCode)
+		assert.Contains(string(ctx.GetResponse().BodyBytes), "exceeds the limit of 100 bytes")
+		assert.Equal(aicontext.ResultProviderError, ctx.Result())
+	}
+
+	{
+		// the content length is unknown, the body is rejected once more
+		// than the limit is read, the rest is not read.
+		body := &trackedBody{r: strings.NewReader(strings.Repeat("a", 1000))}
+		ctx := newLimitContext(body, -1)
+		limit := newResponseLimit(spec, false)
+		limit.apply(ctx)
+		assert.True(limit.exceeded.Load())
+		assert.Equal(101, body.read)
+		assert.True(body.closed)
+		assert.Equal(http.StatusBadGateway, ctx.GetResponse().StatusCode)
+		assert.Equal(aicontext.ResultProviderError, ctx.Result())
+	}
+
+	{
+		// the body within the limit is buffered.
+		body := &trackedBody{r: strings.NewReader(strings.Repeat("a", 100))}
+		ctx := newLimitContext(body, -1)
+		limit := newResponseLimit(spec, false)
+		limit.apply(ctx)
+		assert.False(limit.exceeded.Load())
+		resp := ctx.GetResponse()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Nil(resp.BodyReader)
+		assert.Equal(strings.Repeat("a", 100), string(resp.BodyBytes))
+	}
+}
+
+func TestResponseLimitStream(t *testing.T) {
+	assert := assert.New(t)
+	spec := &aicontext.ProviderSpec{
+		Name:             "openai",
+		MaxResponseBytes: &aicontext.MaxResponseBytesSpec{Stream: 50},
+	}
+	event := "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"
+	stream := strings.Repeat(event, 10)
+
+	{
+		// the stream is cut at the limit and ended with an error event.
+		body := &trackedBody{r: strings.NewReader(stream)}
+		ctx := newLimitContext(body, int64(len(stream)))
+		limit := newResponseLimit(spec, true)
+		limit.apply(ctx)
+		resp := ctx.GetResponse()
+		assert.Equal(int64(-1), resp.ContentLength)
+
+		data, err := io.ReadAll(resp.BodyReader)
+		assert.Nil(err)
+		assert.True(limit.exceeded.Load())
+		assert.True(body.closed)
+		assert.LessOrEqual(body.read, 51)
+		out := string(data)
+		assert.True(strings.HasPrefix(out, stream[:50]+"\n\ndata: "))
+		assert.True(strings.HasSuffix(out, "\n\n"))
+		assert.Contains(out[50:], "exceeds the limit of 50 bytes")
+		assert.NotContains(out, "[DONE]")
+
+		// the stream stays ended after the error event.
+		n, err := resp.BodyReader.Read(make([]byte, 10))
+		assert.Equal(0, n)
+		assert.Equal(io.EOF, err)
+	}
+
+	{
+		// the stream within the limit is passed through.
+		spec.MaxResponseBytes.Stream = int64(len(stream))
+		body := &trackedBody{r: strings.NewReader(stream)}
+		ctx := newLimitContext(body, -1)
+		limit := newResponseLimit(spec, true)
+		limit.apply(ctx)
+		data, err := io.ReadAll(ctx.GetResponse().BodyReader)
+		assert.Nil(err)
+		assert.False(limit.exceeded.Load())
+		assert.False(body.closed)
+		assert.Equal(stream, string(data))
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/util/signer"
+)
+
+const (
+	SigningTypeBearer = "bearer"
+	SigningTypeAPIKey = "apiKey"
+	SigningTypeHMAC   = "hmac"
+	SigningTypeSigV4  = "sigv4"
+
+	defaultAPIKeyHeader      = "X-API-Key"
+	defaultSignatureHeader   = "X-Signature"
+	defaultTimestampHeader   = "X-Timestamp"
+	defaultStringToSign      = "{{.Method}}\n{{.Path}}\n{{.Timestamp}}\n{{.BodyHash}}"
+	defaultSigV4Service      = "bedrock"
+	sigV4ContentSHA256Header = "X-Amz-Content-Sha256"
+	sigV4SecurityTokenHeader = "X-Amz-Security-Token"
+	authorizationHeader      = "Authorization"
+)
+
+type (
+	// RequestSigner authenticates the requests to a provider. Sign is
+	// called after the request is final, so the signature covers the
+	// headers and the body sent to the provider. bodyHash is the hex
+	// encoded SHA-256 of the request body.
+	RequestSigner interface {
+		Sign(ctx context.Context, req *http.Request, bodyHash string) error
+	}
+
+	// SignerFactory creates the RequestSigner of a provider, it returns an
+	// error if the signing spec of the provider is invalid.
+	SignerFactory func(spec *aicontext.ProviderSpec) (RequestSigner, error)
+
+	bearerSigner struct {
+		apiKey string
+	}
+
+	apiKeySigner struct {
+		header string
+		apiKey string
+	}
+
+	// hmacSigner signs the string rendered from the template with
+	// HMAC-SHA256, the signature is sent in hex.
+	hmacSigner struct {
+		secret          []byte
+		header          string
+		timestampHeader string
+		stringToSign    *template.Template
+		now             func() time.Time
+	}
+
+	// stringToSign is the data to render the string to sign of hmacSigner.
+	stringToSign struct {
+		Method    string
+		Host      string
+		Path      string
+		Query     string
+		Timestamp string
+		BodyHash  string
+		Header    http.Header
+	}
+
+	// sigV4Signer signs requests with AWS Signature Version 4.
+	sigV4Signer struct {
+		signer       *signer.Signer
+		region       string
+		service      string
+		sessionToken string
+		now          func() time.Time
+	}
+)
+
+// SignerTypeRegistry contains the factories of request signers by the
+// signing type, bespoke signing schemes are added by registering here.
+var SignerTypeRegistry = map[string]SignerFactory{}
+
+var sigV4Literal = &signer.Literal{
+	ScopeSuffix:      "aws4_request",
+	AlgorithmName:    "X-Amz-Algorithm",
+	AlgorithmValue:   "AWS4-HMAC-SHA256",
+	SignedHeaders:    "X-Amz-SignedHeaders",
+	Signature:        "X-Amz-Signature",
+	Date:             "X-Amz-Date",
+	Expires:          "X-Amz-Expires",
+	Credential:       "X-Amz-Credential",
+	ContentSHA256:    sigV4ContentSHA256Header,
+	SigningKeyPrefix: "AWS4",
+}
+
+func init() {
+	SignerTypeRegistry[SigningTypeBearer] = newBearerSigner
+	SignerTypeRegistry[SigningTypeAPIKey] = newAPIKeySigner
+	SignerTypeRegistry[SigningTypeHMAC] = newHMACSigner
+	SignerTypeRegistry[SigningTypeSigV4] = newSigV4Signer
+}
+
+// newRequestSigner creates the signer of the provider, it returns nil if
+// the provider uses the default bearer authentication.
+func newRequestSigner(spec *aicontext.ProviderSpec) (RequestSigner, error) {
+	if spec.Signing == nil {
+		return nil, nil
+	}
+	factory, ok := SignerTypeRegistry[spec.Signing.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing type: %s", spec.Signing.Type)
+	}
+	return factory(spec)
+}
+
+// signRequest signs the final request with the buffered body, the
+// credential of the client is never forwarded to the provider.
+func signRequest(s RequestSigner, req *http.Request, body []byte) error {
+	req.Header.Del(authorizationHeader)
+	sum := sha256.Sum256(body)
+	return s.Sign(req.Context(), req, hex.EncodeToString(sum[:]))
+}
+
+func newBearerSigner(spec *aicontext.ProviderSpec) (RequestSigner, error) {
+	if spec.APIKey == "" {
+		return nil, fmt.Errorf("apiKey is required by bearer signing")
+	}
+	return &bearerSigner{apiKey: spec.APIKey}, nil
+}
+
+func (s *bearerSigner) Sign(ctx context.Context, req *http.Request, bodyHash string) error {
+	req.Header.Set(authorizationHeader, "Bearer "+s.apiKey)
+	return nil
+}
+
+func newAPIKeySigner(spec *aicontext.ProviderSpec) (RequestSigner, error) {
+	if spec.APIKey == "" {
+		return nil, fmt.Errorf("apiKey is required by apiKey signing")
+	}
+	s := &apiKeySigner{header: spec.Signing.Header, apiKey: spec.APIKey}
+	if s.header == "" {
+		s.header = defaultAPIKeyHeader
+	}
+	return s, nil
+}
+
+func (s *apiKeySigner) Sign(ctx context.Context, req *http.Request, bodyHash string) error {
+	req.Header.Set(s.header, s.apiKey)
+	return nil
+}
+
+func newHMACSigner(spec *aicontext.ProviderSpec) (RequestSigner, error) {
+	signing := spec.Signing
+	if signing.Secret == "" {
+		return nil, fmt.Errorf("secret is required by hmac signing")
+	}
+	text := signing.StringToSign
+	if text == "" {
+		text = defaultStringToSign
+	}
+	tmpl, err := template.New("stringToSign").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stringToSign: %w", err)
+	}
+	s := &hmacSigner{
+		secret:          []byte(signing.Secret),
+		header:          signing.Header,
+		timestampHeader: signing.TimestampHeader,
+		stringToSign:    tmpl,
+		now:             time.Now,
+	}
+	if s.header == "" {
+		s.header = defaultSignatureHeader
+	}
+	if s.timestampHeader == "" {
+		s.timestampHeader = defaultTimestampHeader
+	}
+	return s, nil
+}
+
+func (s *hmacSigner) Sign(ctx context.Context, req *http.Request, bodyHash string) error {
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	req.Header.Set(s.timestampHeader, timestamp)
+
+	data := &stringToSign{
+		Method:    req.Method,
+		Host:      req.URL.Host,
+		Path:      req.URL.EscapedPath(),
+		Query:     req.URL.RawQuery,
+		Timestamp: timestamp,
+		BodyHash:  bodyHash,
+		Header:    req.Header,
+	}
+	var buf bytes.Buffer
+	if err := s.stringToSign.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to render the string to sign: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(buf.Bytes())
+	req.Header.Set(s.header, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+func newSigV4Signer(spec *aicontext.ProviderSpec) (RequestSigner, error) {
+	signing := spec.Signing
+	if signing.Region == "" {
+		return nil, fmt.Errorf("region is required by sigv4 signing")
+	}
+	if signing.AccessKeyID == "" || signing.SecretAccessKey == "" {
+		return nil, fmt.Errorf("accessKeyID and secretAccessKey are required by sigv4 signing")
+	}
+	s := &sigV4Signer{
+		signer:       signer.New().SetLiteral(sigV4Literal).SetCredential(signing.AccessKeyID, signing.SecretAccessKey),
+		region:       signing.Region,
+		service:      signing.Service,
+		sessionToken: signing.SessionToken,
+		now:          time.Now,
+	}
+	if s.service == "" {
+		s.service = defaultSigV4Service
+	}
+	return s, nil
+}
+
+func (s *sigV4Signer) Sign(ctx context.Context, req *http.Request, bodyHash string) error {
+	// the body hash is passed in the header, so the signer never reads
+	// the body again.
+	req.Header.Set(sigV4ContentSHA256Header, bodyHash)
+	if s.sessionToken != "" {
+		req.Header.Set(sigV4SecurityTokenHeader, s.sessionToken)
+	}
+	return s.signer.NewSigningContext(s.now(), s.region, s.service).Sign(req, nil)
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	egcontext "github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestValidateSigning(t *testing.T) {
+	assert := assert.New(t)
+
+	newSpec := func(apiKey string, signing *aicontext.SigningSpec) *aicontext.ProviderSpec {
+		return &aicontext.ProviderSpec{
+			Name:         "signed",
+			ProviderType: "openai",
+			BaseURL:      "http://localhost:8080",
+			APIKey:       apiKey,
+			Signing:      signing,
+		}
+	}
+
+	assert.NoError(ValidateSpec(newSpec("key", nil)))
+	assert.Error(ValidateSpec(newSpec("", nil)))
+	assert.NoError(ValidateSpec(newSpec("key", &aicontext.SigningSpec{Type: SigningTypeBearer})))
+	assert.Error(ValidateSpec(newSpec("", &aicontext.SigningSpec{Type: SigningTypeAPIKey})))
+	assert.Error(ValidateSpec(newSpec("key", &aicontext.SigningSpec{Type: "unknown"})))
+
+	// hmac and sigv4 do not need an APIKey.
+	assert.NoError(ValidateSpec(newSpec("", &aicontext.SigningSpec{Type: SigningTypeHMAC, Secret: "secret"})))
+	assert.Error(ValidateSpec(newSpec("", &aicontext.SigningSpec{Type: SigningTypeHMAC})))
+	assert.Error(ValidateSpec(newSpec("", &aicontext.SigningSpec{Type: SigningTypeHMAC, Secret: "secret", StringToSign: "{{.Method"})))
+	assert.NoError(ValidateSpec(newSpec("", &aicontext.SigningSpec{
+		Type: SigningTypeSigV4, Region: "us-east-1", AccessKeyID: "id", SecretAccessKey: "secret",
+	})))
+	assert.Error(ValidateSpec(newSpec("", &aicontext.SigningSpec{Type: SigningTypeSigV4, AccessKeyID: "id", SecretAccessKey: "secret"})))
+	assert.Error(ValidateSpec(newSpec("", &aicontext.SigningSpec{Type: SigningTypeSigV4, Region: "us-east-1", AccessKeyID: "id"})))
+}
+
+func TestKeySigners(t *testing.T) {
+	assert := assert.New(t)
+
+	req, _ := http.NewRequest(http.MethodPost, "https://api.example.com/v1/chat/completions", nil)
+	s, err := newRequestSigner(&aicontext.ProviderSpec{APIKey: "key", Signing: &aicontext.SigningSpec{Type: SigningTypeBearer}})
+	assert.NoError(err)
+	assert.NoError(s.Sign(context.Background(), req, ""))
+	assert.Equal("Bearer key", req.Header.Get("Authorization"))
+
+	req, _ = http.NewRequest(http.MethodPost, "https://api.example.com/v1/chat/completions", nil)
+	s, err = newRequestSigner(&aicontext.ProviderSpec{APIKey: "key", Signing: &aicontext.SigningSpec{Type: SigningTypeAPIKey}})
+	assert.NoError(err)
+	assert.NoError(s.Sign(context.Background(), req, ""))
+	assert.Equal("key", req.Header.Get("X-API-Key"))
+	assert.Empty(req.Header.Get("Authorization"))
+
+	req, _ = http.NewRequest(http.MethodPost, "https://api.example.com/v1/chat/completions", nil)
+	s, err = newRequestSigner(&aicontext.ProviderSpec{APIKey: "key", Signing: &aicontext.SigningSpec{Type: SigningTypeAPIKey, Header: "api-key"}})
+	assert.NoError(err)
+	assert.NoError(s.Sign(context.Background(), req, ""))
+	assert.Equal("key", req.Header.Get("Api-Key"))
+}
+
+func TestHMACSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	body := []byte(`{"model":"gpt","stream":true}`)
+	newSigner := func(signing *aicontext.SigningSpec) *hmacSigner {
+		s, err := newRequestSigner(&aicontext.ProviderSpec{Signing: signing})
+		assert.NoError(err)
+		hs := s.(*hmacSigner)
+		hs.now = func() time.Time { return time.Unix(1700000000, 0) }
+		return hs
+	}
+
+	// the expected signatures are computed independently:
+	// hex(HMAC-SHA256("secret", stringToSign)).
+	req, _ := http.NewRequest(http.MethodPost, "https://api.example.com/v1/chat/completions", bytes.NewReader(body))
+	s := newSigner(&aicontext.SigningSpec{Type: SigningTypeHMAC, Secret: "secret"})
+	assert.NoError(s.Sign(context.Background(), req, bodyHash(body)))
+	assert.Equal("1700000000", req.Header.Get("X-Timestamp"))
+	assert.Equal("73cb906908ed2e7c24a500f76369607d39343c16f88a16b9a63d52c2b59cb352", req.Header.Get("X-Signature"))
+
+	req, _ = http.NewRequest(http.MethodPost, "https://api.example.com/v1/chat/completions", bytes.NewReader(body))
+	req.Header.Set("X-Project", "project-1")
+	s = newSigner(&aicontext.SigningSpec{
+		Type:            SigningTypeHMAC,
+		Secret:          "secret",
+		Header:          "X-Custom-Signature",
+		TimestampHeader: "X-Custom-Time",
+		StringToSign:    "{{.Method}}\n{{.Host}}\n{{.Path}}\n{{.Timestamp}}\n{{.BodyHash}}\n{{.Header.Get \"X-Project\"}}",
+	})
+	assert.NoError(s.Sign(context.Background(), req, bodyHash(body)))
+	assert.Equal("1700000000", req.Header.Get("X-Custom-Time"))
+	assert.Equal("669f75cc0dc759f5c89ad307f6920b2bff594c9ad91bfe5d5bb3df0d54dc67bf", req.Header.Get("X-Custom-Signature"))
+	assert.Empty(req.Header.Get("X-Signature"))
+}
+
+func TestSigV4Signer(t *testing.T) {
+	assert := assert.New(t)
+
+	body := []byte(`{"prompt":"hello"}`)
+	s, err := newRequestSigner(&aicontext.ProviderSpec{Signing: &aicontext.SigningSpec{
+		Type:            SigningTypeSigV4,
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}})
+	assert.NoError(err)
+	signer := s.(*sigV4Signer)
+	signer.now = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+
+	// the expected signature is computed by an independent implementation
+	// of AWS Signature Version 4, which is verified by the example in the
+	// AWS documentation.
+	req, _ := http.NewRequest(http.MethodPost, "https://bedrock-runtime.us-east-1.amazonaws.com/model/anthropic.claude-v2/invoke", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	assert.NoError(signer.Sign(context.Background(), req, bodyHash(body)))
+	assert.Equal("20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(bodyHash(body), req.Header.Get("X-Amz-Content-Sha256"))
+	assert.Equal("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/bedrock/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date, "+
+		"Signature=181a601c47e9c372a373b9cc599b5f0e8676987128109e2a7b171aa192706c0d", req.Header.Get("Authorization"))
+
+	// the session token is signed as well.
+	signer.sessionToken = "SESSION"
+	req, _ = http.NewRequest(http.MethodPost, "https://bedrock-runtime.us-east-1.amazonaws.com/model/anthropic.claude-v2/invoke", bytes.NewReader(body))
+	assert.NoError(signer.Sign(context.Background(), req, bodyHash(body)))
+	assert.Equal("SESSION", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token,")
+}
+
+func TestSignedProviderRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		signature string
+		auth      string
+		project   string
+	)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Signature")
+		auth = r.Header.Get("Authorization")
+		project = r.Header.Get("X-Project")
+		chatCompletionsHandler(w, r)
+	}))
+	defer mockServer.Close()
+
+	providerSpec := &aicontext.ProviderSpec{
+		Name:         "signed",
+		ProviderType: "openai",
+		BaseURL:      mockServer.URL,
+		Headers:      map[string]string{"X-Project": "project-1"},
+		Signing:      &aicontext.SigningSpec{Type: SigningTypeHMAC, Secret: "secret"},
+	}
+	assert.NoError(ValidateSpec(providerSpec))
+	provider := &BaseProvider{}
+	provider.init(providerSpec)
+	defer provider.Close()
+	provider.signer.(*hmacSigner).now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	// the streaming request is signed with its buffered body, and the
+	// credential of the client is not forwarded.
+	body := []byte(`{"model":"gpt","stream":true,"messages":[{"role":"user","content":"hello"}]}`)
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/v1/chat/completions", bytes.NewReader(body))
+	assert.Nil(err)
+	req.Header.Set("Authorization", "Bearer client-key")
+	ctx := egcontext.New(nil)
+	setRequest(t, ctx, "signed", req)
+	aiCtx, err := aicontext.New(ctx, providerSpec)
+	assert.Nil(err)
+	assert.True(aiCtx.ReqInfo.Stream)
+
+	provider.Handle(aiCtx)
+	assert.Equal(http.StatusOK, aiCtx.GetResponse().StatusCode)
+	assert.Equal("8c4a76c81354e482cf72cb12ed94359c19006031cedaf0f30c2ecb7daf0fee17", signature)
+	assert.Empty(auth)
+	assert.Equal("project-1", project)
+}
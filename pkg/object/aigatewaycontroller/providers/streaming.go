@@ -0,0 +1,342 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// SyntheticStreamHeader marks the streaming responses synthesized from the
+// non-streaming responses of providers.
+const SyntheticStreamHeader = "X-Synthetic-Stream"
+
+// Values of the chunking of synthetic streams.
+const (
+	ChunkingWord     = "word"
+	ChunkingSentence = "sentence"
+)
+
+// The terminators of the sentences of synthetic streams, the sentences end
+// at the whitespaces after the terminators, or right after the full-width
+// terminators, which are not followed by whitespaces.
+const (
+	sentenceTerminators          = ".!?"
+	fullWidthSentenceTerminators = "。！？"
+)
+
+type (
+	// streamSynthesizer serves a streaming request by a non-streaming
+	// request, the content of the response is chunked into a synthetic
+	// stream of chat completion or completion chunks.
+	streamSynthesizer struct {
+		mapper   RequestMapper
+		chunking string
+		interval time.Duration
+		// chat is whether the provider responds chat completions, it is
+		// false for native completions.
+		chat bool
+	}
+
+	// synthesizedResponse is a non-streaming chat completion or completion.
+	synthesizedResponse struct {
+		ID                string `json:"id"`
+		Created           int64  `json:"created"`
+		Model             string `json:"model"`
+		SystemFingerprint string `json:"system_fingerprint,omitempty"`
+		Choices           []struct {
+			Index   int `json:"index"`
+			Message struct {
+				Role      string           `json:"role"`
+				Content   string           `json:"content"`
+				ToolCalls []map[string]any `json:"tool_calls"`
+			} `json:"message"`
+			Text         string  `json:"text"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage json.RawMessage `json:"usage,omitempty"`
+	}
+
+	// synthesizedChunk is a chunk of a synthetic stream, the choices are
+	// chatChunkChoice or textChoice.
+	synthesizedChunk struct {
+		ID                string          `json:"id"`
+		Object            string          `json:"object"`
+		Created           int64           `json:"created"`
+		Model             string          `json:"model"`
+		SystemFingerprint string          `json:"system_fingerprint,omitempty"`
+		Choices           []any           `json:"choices"`
+		Usage             json.RawMessage `json:"usage,omitempty"`
+	}
+
+	chatChunkChoice struct {
+		Index        int            `json:"index"`
+		Delta        chatChunkDelta `json:"delta"`
+		FinishReason *string        `json:"finish_reason"`
+	}
+
+	chatChunkDelta struct {
+		Role      string           `json:"role,omitempty"`
+		Content   *string          `json:"content,omitempty"`
+		ToolCalls []map[string]any `json:"tool_calls,omitempty"`
+	}
+
+	// syntheticStreamReader sends the events of a synthetic stream, paced
+	// by the interval.
+	syntheticStreamReader struct {
+		ctx      context.Context
+		events   [][]byte
+		interval time.Duration
+		current  []byte
+		started  bool
+	}
+)
+
+func validateSynthesizeStreamingSpec(spec *aicontext.SynthesizeStreamingSpec) error {
+	if spec == nil {
+		return nil
+	}
+	switch spec.Chunking {
+	case "", ChunkingWord, ChunkingSentence:
+	default:
+		return fmt.Errorf("invalid chunking %s, must be %s or %s", spec.Chunking, ChunkingWord, ChunkingSentence)
+	}
+	if spec.Interval != "" {
+		if d, err := time.ParseDuration(spec.Interval); err != nil || d < 0 {
+			return fmt.Errorf("invalid interval %s", spec.Interval)
+		}
+	}
+	return nil
+}
+
+// synthesizesStreaming returns whether the streaming request of the
+// context is served by a synthetic stream.
+func synthesizesStreaming(spec *aicontext.ProviderSpec, ctx *aicontext.Context) bool {
+	if spec.SynthesizeStreaming == nil || !ctx.ReqInfo.Stream {
+		return false
+	}
+	return ctx.RespType == aicontext.ResponseTypeChatCompletions || ctx.RespType == aicontext.ResponseTypeCompletions
+}
+
+func newStreamSynthesizer(spec *aicontext.SynthesizeStreamingSpec, mapper RequestMapper, chat bool) *streamSynthesizer {
+	s := &streamSynthesizer{mapper: mapper, chunking: spec.Chunking, chat: chat}
+	// the spec is validated.
+	s.interval, _ = time.ParseDuration(spec.Interval)
+	return s
+}
+
+// requestMapper maps the request by the mapper of the synthesizer, and
+// turns it into a non-streaming request.
+func (s *streamSynthesizer) requestMapper(ctx *aicontext.Context) (string, []byte, error) {
+	path, body, err := s.mapper(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	req := map[string]any{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", nil, fmt.Errorf("invalid request: %w", err)
+	}
+	delete(req, "stream")
+	delete(req, "stream_options")
+	data, err := codectool.MarshalJSON(req)
+	if err != nil {
+		return "", nil, err
+	}
+	return path, data, nil
+}
+
+// synthesize replaces the non-streaming response of the context with the
+// synthetic stream, error responses are kept as is.
+func (s *streamSynthesizer) synthesize(ctx *aicontext.Context) {
+	resp := ctx.GetResponse()
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	body := resp.BodyBytes
+	if resp.BodyReader != nil {
+		var err error
+		body, err = io.ReadAll(resp.BodyReader)
+		closeBody(resp.BodyReader)
+		resp.BodyReader = nil
+		if err != nil {
+			setErrResponse(ctx, http.StatusBadGateway, fmt.Errorf("failed to read response of provider %s: %w", ctx.Provider.Name, err))
+			ctx.Stop(aicontext.ResultProviderError)
+			return
+		}
+	}
+	events, err := s.events(body)
+	if err != nil {
+		logger.Errorf("failed to synthesize stream of provider %s: %v", ctx.Provider.Name, err)
+		setErrResponse(ctx, http.StatusBadGateway, fmt.Errorf("invalid response of provider %s: %w", ctx.Provider.Name, err))
+		ctx.Stop(aicontext.ResultProviderError)
+		return
+	}
+
+	// the pacing stops with the request, unless the stream is detached
+	// from it to be resumed.
+	paceCtx := ctx.RequestContext()
+	if ctx.Detached {
+		paceCtx = context.Background()
+	}
+	resp.BodyBytes = nil
+	resp.BodyReader = &syntheticStreamReader{ctx: paceCtx, events: events, interval: s.interval}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Type", "text/event-stream")
+	resp.Header.Set(SyntheticStreamHeader, "true")
+}
+
+// events returns the server-sent events of the response. The content of
+// every choice is sent in chunks, followed by a chunk of its finish
+// reason, and the usage is sent in the last chunk without choices, like
+// the streams including the usage.
+func (s *streamSynthesizer) events(body []byte) ([][]byte, error) {
+	resp := &synthesizedResponse{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, err
+	}
+	object := "text_completion"
+	if s.chat {
+		object = "chat.completion.chunk"
+	}
+	var events [][]byte
+	add := func(choices []any, usage json.RawMessage) error {
+		data, err := codectool.MarshalJSON(&synthesizedChunk{
+			ID:                resp.ID,
+			Object:            object,
+			Created:           resp.Created,
+			Model:             resp.Model,
+			SystemFingerprint: resp.SystemFingerprint,
+			Choices:           choices,
+			Usage:             usage,
+		})
+		if err != nil {
+			return err
+		}
+		events = append(events, []byte("data: "+string(data)+"\n\n"))
+		return nil
+	}
+
+	for _, c := range resp.Choices {
+		if !s.chat {
+			for _, text := range splitContent(c.Text, s.chunking) {
+				if err := add([]any{&textChoice{Text: text, Index: c.Index}}, nil); err != nil {
+					return nil, err
+				}
+			}
+			if err := add([]any{&textChoice{Index: c.Index, FinishReason: c.FinishReason}}, nil); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		role := c.Message.Role
+		if role == "" {
+			role = "assistant"
+		}
+		empty := ""
+		if err := add([]any{&chatChunkChoice{Index: c.Index, Delta: chatChunkDelta{Role: role, Content: &empty}}}, nil); err != nil {
+			return nil, err
+		}
+		for _, content := range splitContent(c.Message.Content, s.chunking) {
+			if err := add([]any{&chatChunkChoice{Index: c.Index, Delta: chatChunkDelta{Content: &content}}}, nil); err != nil {
+				return nil, err
+			}
+		}
+		if len(c.Message.ToolCalls) > 0 {
+			// the tool calls of chunks are identified by their indexes.
+			for i, call := range c.Message.ToolCalls {
+				call["index"] = i
+			}
+			if err := add([]any{&chatChunkChoice{Index: c.Index, Delta: chatChunkDelta{ToolCalls: c.Message.ToolCalls}}}, nil); err != nil {
+				return nil, err
+			}
+		}
+		if err := add([]any{&chatChunkChoice{Index: c.Index, FinishReason: c.FinishReason}}, nil); err != nil {
+			return nil, err
+		}
+	}
+	if len(resp.Usage) > 0 && !bytes.Equal(resp.Usage, []byte("null")) {
+		if err := add([]any{}, resp.Usage); err != nil {
+			return nil, err
+		}
+	}
+	return append(events, []byte("data: [DONE]\n\n")), nil
+}
+
+// splitContent splits the content into chunks by word or by sentence, the
+// whitespaces after a word or a sentence are kept in its chunk, so the
+// chunks are joined into the content. Line breaks end sentences as well.
+func splitContent(content, chunking string) []string {
+	sentence := chunking == ChunkingSentence
+	var chunks []string
+	start, ended, terminated, hasContent := 0, false, false, false
+	for i, r := range content {
+		if unicode.IsSpace(r) {
+			if hasContent && (!sentence || terminated || r == '\n') {
+				ended = true
+			}
+			continue
+		}
+		if ended {
+			chunks = append(chunks, content[start:i])
+			start, ended = i, false
+		}
+		hasContent = true
+		terminated = sentence && strings.ContainsRune(sentenceTerminators, r)
+		ended = sentence && strings.ContainsRune(fullWidthSentenceTerminators, r)
+	}
+	if start < len(content) {
+		chunks = append(chunks, content[start:])
+	}
+	return chunks
+}
+
+func (r *syntheticStreamReader) Read(p []byte) (int, error) {
+	if len(r.current) == 0 {
+		if len(r.events) == 0 {
+			return 0, io.EOF
+		}
+		if r.started && r.interval > 0 {
+			timer := time.NewTimer(r.interval)
+			select {
+			case <-timer.C:
+			case <-r.ctx.Done():
+				timer.Stop()
+				return 0, r.ctx.Err()
+			}
+		}
+		r.started = true
+		r.current, r.events = r.events[0], r.events[1:]
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package providers
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitContent(t *testing.T) {
+	assert := assert.New(t)
+	cases := []struct {
+		content  string
+		chunking string
+		chunks   []string
+	}{
+		{content: "", chunking: ChunkingWord, chunks: nil},
+		{content: "Hello", chunking: ChunkingWord, chunks: []string{"Hello"}},
+		{content: " Hello  big\nworld ", chunking: ChunkingWord, chunks: []string{" Hello  ", "big\n", "world "}},
+		{content: "Pi is 3.14. Really? Yes!", chunking: ChunkingSentence, chunks: []string{"Pi is 3.14. ", "Really? ", "Yes!"}},
+		{content: "First line\nSecond line", chunking: ChunkingSentence, chunks: []string{"First line\n", "Second line"}},
+		{content: "你好。今天好吗？好！", chunking: ChunkingSentence, chunks: []string{"你好。", "今天好吗？", "好！"}},
+		{content: "No terminator", chunking: ChunkingSentence, chunks: []string{"No terminator"}},
+	}
+
+	for _, c := range cases {
+		chunks := splitContent(c.content, c.chunking)
+		assert.Equal(c.chunks, chunks, c.content)
+		assert.Equal(c.content, strings.Join(chunks, ""), c.content)
+	}
+}
+
+func TestValidateSynthesizeStreamingSpec(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(validateSynthesizeStreamingSpec(nil))
+	assert.Nil(validateSynthesizeStreamingSpec(&aicontext.SynthesizeStreamingSpec{}))
+	assert.Nil(validateSynthesizeStreamingSpec(&aicontext.SynthesizeStreamingSpec{Chunking: ChunkingSentence, Interval: "20ms"}))
+	assert.NotNil(validateSynthesizeStreamingSpec(&aicontext.SynthesizeStreamingSpec{Chunking: "token"}))
+	assert.NotNil(validateSynthesizeStreamingSpec(&aicontext.SynthesizeStreamingSpec{Interval: "fast"}))
+	assert.NotNil(validateSynthesizeStreamingSpec(&aicontext.SynthesizeStreamingSpec{Interval: "-1s"}))
+}
+
+func TestStreamSynthesizerEvents(t *testing.T) {
+	assert := assert.New(t)
+	cases := []struct {
+		name   string
+		chat   bool
+		body   string
+		events []string
+	}{
+		{
+			name: "chat",
+			chat: true,
+			body: `{"id":"c1","object":"chat.completion","created":1,"model":"m",
+				"choices":[{"index":0,"message":{"role":"assistant","content":"Hi there"},"finish_reason":"stop"}],
+				"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+			events: []string{
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"Hi "},"finish_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"there"},"finish_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+			},
+		},
+		{
+			name: "tool calls",
+			chat: true,
+			body: `{"id":"c2","created":1,"model":"m",
+				"choices":[{"index":0,"message":{"role":"assistant","content":null,
+				"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+			events: []string{
+				`{"id":"c2","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`,
+				`{"id":"c2","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]},"finish_reason":null}]}`,
+				`{"id":"c2","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			},
+		},
+		{
+			name: "completion",
+			body: `{"id":"c3","object":"text_completion","created":1,"model":"m",
+				"choices":[{"index":0,"text":"Hi there","finish_reason":"length"}],"usage":null}`,
+			events: []string{
+				`{"id":"c3","object":"text_completion","created":1,"model":"m","choices":[{"text":"Hi ","index":0,"logprobs":null,"finish_reason":null}]}`,
+				`{"id":"c3","object":"text_completion","created":1,"model":"m","choices":[{"text":"there","index":0,"logprobs":null,"finish_reason":null}]}`,
+				`{"id":"c3","object":"text_completion","created":1,"model":"m","choices":[{"text":"","index":0,"logprobs":null,"finish_reason":"length"}]}`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		s := newStreamSynthesizer(&aicontext.SynthesizeStreamingSpec{}, nil, c.chat)
+		events, err := s.events([]byte(c.body))
+		assert.Nil(err, c.name)
+		assert.Equal(len(c.events)+1, len(events), c.name)
+		for i, e := range c.events {
+			assert.JSONEq(e, strings.TrimSuffix(strings.TrimPrefix(string(events[i]), "data: "), "\n\n"), c.name)
+		}
+		assert.Equal("data: [DONE]\n\n", string(events[len(events)-1]), c.name)
+	}
+
+	s := newStreamSynthesizer(&aicontext.SynthesizeStreamingSpec{}, nil, true)
+	_, err := s.events([]byte("not json"))
+	assert.NotNil(err)
+}
+
+func TestSyntheticStreamReader(t *testing.T) {
+	assert := assert.New(t)
+	events := [][]byte{[]byte("data: a\n\n"), []byte("data: b\n\n"), []byte("data: [DONE]\n\n")}
+
+	reader := &syntheticStreamReader{ctx: stdcontext.Background(), events: events, interval: 20 * time.Millisecond}
+	start := time.Now()
+	data, err := io.ReadAll(reader)
+	assert.Nil(err)
+	assert.Equal("data: a\n\ndata: b\n\ndata: [DONE]\n\n", string(data))
+	assert.GreaterOrEqual(time.Since(start), 40*time.Millisecond)
+
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	reader = &syntheticStreamReader{ctx: ctx, events: events, interval: time.Hour}
+	buf := make([]byte, 64)
+	n, err := reader.Read(buf)
+	assert.Nil(err)
+	assert.Equal("data: a\n\n", string(buf[:n]))
+	cancel()
+	_, err = reader.Read(buf)
+	assert.ErrorIs(err, stdcontext.Canceled)
+}
+
+func TestBaseProviderSynthesizeStreaming(t *testing.T) {
+	assert := assert.New(t)
+	var streams []bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := map[string]any{}
+		json.Unmarshal(body, &req)
+		_, ok := req["stream"]
+		streams = append(streams, ok)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		chatCompletionsHandler(w, r)
+	}))
+	defer mockServer.Close()
+
+	providerSpec := &aicontext.ProviderSpec{
+		Name:                "openai",
+		ProviderType:        OpenAIProviderType,
+		BaseURL:             mockServer.URL,
+		APIKey:              "test-api-key",
+		SynthesizeStreaming: &aicontext.SynthesizeStreamingSpec{Chunking: ChunkingWord},
+	}
+	provider := &BaseProvider{}
+	provider.init(providerSpec)
+
+	ctx := context.New(nil)
+	req, err := createChatCompletionRequest("gpt-4o", true, "Hello big world")
+	assert.Nil(err)
+	setRequest(t, ctx, "chat", req)
+	aiCtx, err := aicontext.New(ctx, providerSpec)
+	assert.Nil(err)
+	provider.Handle(aiCtx)
+
+	resp := aiCtx.GetResponse()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("true", resp.Header.Get(SyntheticStreamHeader))
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal([]bool{false}, streams)
+
+	data, err := io.ReadAll(resp.BodyReader)
+	assert.Nil(err)
+	assert.Contains(string(data), `"delta":{"content":"big "}`)
+	assert.Contains(string(data), `"finish_reason":"stop"`)
+	assert.True(strings.HasSuffix(string(data), "data: [DONE]\n\n"))
+
+	metric := aiCtx.ParseMetricFn(&aicontext.FinishContext{StatusCode: http.StatusOK, RespBody: data})
+	assert.True(metric.Success)
+	assert.Equal(int64(3), metric.InputTokens)
+	assert.Equal(int64(3), metric.OutputTokens)
+}
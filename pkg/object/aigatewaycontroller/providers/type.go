@@ -18,6 +18,8 @@
 package providers
 
 import (
+	"net/http"
+
 	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
 )
 
@@ -26,11 +28,22 @@ type (
 		Name() string
 		Type() string
 		Handle(ctx *aicontext.Context)
+		// PrepareRequest returns the request of the context to the
+		// provider and its body without sending it.
+		PrepareRequest(ctx *aicontext.Context) (*http.Request, []byte, error)
 		Spec() *aicontext.ProviderSpec
 
 		// HealthCheck checks the health of the provider.
 		// It should return nil if the provider is healthy, otherwise it returns an error.
 		HealthCheck() error
+		// EndpointHealth returns the last known health of the base URLs
+		// of the provider, it does not check them.
+		EndpointHealth() []*EndpointHealth
+		// FlushConnections closes the idle connections to the provider,
+		// in-flight requests are not affected.
+		FlushConnections()
+		// Close releases the resources of the provider.
+		Close()
 
 		init(spec *aicontext.ProviderSpec)
 		validate(spec *aicontext.ProviderSpec) error
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+)
+
+// providerSet is the complete set of providers built from a spec, it is
+// never modified after creation. A reload builds a new set aside and swaps
+// it in, and the replaced set closes its providers after the requests
+// acquired it finish.
+type providerSet struct {
+	// specs are the effective specs of the providers.
+	specs     []*aicontext.ProviderSpec
+	providers map[string]providers.Provider
+	// scrubbers are the output scrubbers of the providers by name.
+	scrubbers map[string]*middlewares.OutputScrubber
+	inflight  atomic.Int64
+	retired   atomic.Bool
+	closeOnce sync.Once
+}
+
+// newProviderSet creates and initializes all providers of the specs, the
+// providers created are closed if any of them fails.
+func newProviderSet(specs []*aicontext.ProviderSpec) (*providerSet, error) {
+	set := &providerSet{
+		specs:     specs,
+		providers: make(map[string]providers.Provider, len(specs)),
+		scrubbers: make(map[string]*middlewares.OutputScrubber),
+	}
+	for _, s := range specs {
+		if err := providers.ValidateSpec(s); err != nil {
+			set.close()
+			return nil, err
+		}
+		provider := providers.NewProvider(s)
+		if provider == nil {
+			set.close()
+			return nil, fmt.Errorf("failed to create provider %s of type %s", s.Name, s.ProviderType)
+		}
+		set.providers[s.Name] = provider
+		if len(s.OutputScrub) > 0 {
+			scrubber, err := middlewares.NewOutputScrubber(s.Name, s.OutputScrub)
+			if err != nil {
+				set.close()
+				return nil, fmt.Errorf("provider %s has invalid output scrub: %w", s.Name, err)
+			}
+			set.scrubbers[s.Name] = scrubber
+		}
+	}
+	return set, nil
+}
+
+// region returns the region of the provider, it is empty if the provider
+// is not found.
+func (s *providerSet) region(name string) string {
+	if p, ok := s.providers[name]; ok {
+		return p.Spec().Region
+	}
+	return ""
+}
+
+// acquire counts a request using the set, it fails if the set is retired,
+// and the caller should load the set in use again.
+func (s *providerSet) acquire() bool {
+	s.inflight.Add(1)
+	if s.retired.Load() {
+		s.release()
+		return false
+	}
+	return true
+}
+
+// release is called when a request acquired the set finishes.
+func (s *providerSet) release() {
+	if s.inflight.Add(-1) == 0 && s.retired.Load() {
+		s.close()
+	}
+}
+
+// retire is called after the set is replaced, it closes the providers
+// when there is no in-flight request.
+func (s *providerSet) retire() {
+	s.retired.Store(true)
+	if s.inflight.Load() == 0 {
+		s.close()
+	}
+}
+
+func (s *providerSet) close() {
+	s.closeOnce.Do(func() {
+		for _, provider := range s.providers {
+			provider.Close()
+		}
+	})
+}
+
+// reloadProviders builds the providers of the spec and swaps them in. The
+// pointer to the set in use is shared by all generations, so requests
+// handled by a replaced generation also see the latest providers. The
+// templates and the environment variables are resolved again, so changed
+// environment variables take effect on reloads.
+func (agc *AIGatewayController) reloadProviders(prev *AIGatewayController) string {
+	if prev != nil {
+		agc.providerSets = prev.providerSets
+	} else {
+		agc.providerSets = &atomic.Pointer[providerSet]{}
+	}
+
+	specs, err := resolveProviders(agc.spec)
+	var set *providerSet
+	if err == nil {
+		set, err = newProviderSet(specs)
+	}
+	if err != nil {
+		if agc.providerSets.Load() != nil {
+			logger.Errorf("failed to create providers, keep the previous ones: %v", err)
+			return componentFailed
+		}
+		logger.Errorf("failed to create providers: %v", err)
+		set = &providerSet{providers: map[string]providers.Provider{}}
+	}
+	if old := agc.providerSets.Swap(set); old != nil {
+		old.retire()
+		return componentRecreated
+	}
+	return componentCreated
+}
+
+// acquireProviders returns the providers in use, the caller must release
+// them. It returns nil if the controller is closed.
+func (agc *AIGatewayController) acquireProviders() *providerSet {
+	for {
+		set := agc.providerSets.Load()
+		if set == nil || set.acquire() {
+			return set
+		}
+	}
+}
+
+// closeProviders retires the providers in use when the controller is
+// closed.
+func (agc *AIGatewayController) closeProviders() {
+	if set := agc.providerSets.Swap(nil); set != nil {
+		set.retire()
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+type closeCountingProvider struct {
+	providers.Provider
+	closed atomic.Int32
+}
+
+func (p *closeCountingProvider) Close() {
+	p.closed.Add(1)
+}
+
+func TestProviderSetRetire(t *testing.T) {
+	assert := assert.New(t)
+
+	provider := &closeCountingProvider{}
+	set := &providerSet{providers: map[string]providers.Provider{"openai": provider}}
+
+	assert.True(set.acquire())
+	assert.True(set.acquire())
+	set.retire()
+	assert.Zero(provider.closed.Load())
+	assert.False(set.acquire())
+
+	set.release()
+	assert.Zero(provider.closed.Load())
+	set.release()
+	assert.Equal(int32(1), provider.closed.Load())
+
+	// closed only once.
+	set.retire()
+	assert.Equal(int32(1), provider.closed.Load())
+
+	_, err := newProviderSet([]*aicontext.ProviderSpec{{Name: "unknown", ProviderType: "unknown"}})
+	assert.Error(err)
+}
+
+func TestProviderReloadRace(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(chatCompletionsHandler))
+	defer server.Close()
+
+	config := `
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock-%d
+`
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	newSpec := func(generation int) *supervisor.Spec {
+		spec, err := super.NewSpec(fmt.Sprintf(config, server.URL, generation))
+		assert.Nil(err)
+		return spec
+	}
+
+	controller := &AIGatewayController{}
+	controller.Init(newSpec(0))
+
+	var (
+		wg       sync.WaitGroup
+		stop     atomic.Bool
+		requests atomic.Int64
+		failures atomic.Int64
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				handler, err := GetGlobalAIGatewayHandler()
+				if err != nil {
+					continue
+				}
+				ctx := context.New(nil)
+				req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions",
+					bytes.NewReader([]byte(`{"model": "gpt", "stream": false}`)))
+				stdReq, _ := httpprot.NewRequest(req)
+				stdReq.FetchPayload(0)
+				ctx.SetRequest("race", stdReq)
+				ctx.UseNamespace("race")
+
+				if result := handler.Handle(ctx, "openai", nil); result != "" {
+					failures.Add(1)
+				}
+				resp := ctx.GetResponse("race").(*httpprot.Response)
+				if resp.StatusCode() != http.StatusOK {
+					failures.Add(1)
+				}
+				ctx.Finish()
+				requests.Add(1)
+			}
+		}()
+	}
+
+	sets := []*providerSet{}
+	// keep reloading until enough requests are handled during reloads.
+	for generation := 1; generation <= 50 || (requests.Load() < 200 && generation <= 100000); generation++ {
+		sets = append(sets, controller.providerSets.Load())
+		next := &AIGatewayController{}
+		next.Inherit(newSpec(generation), controller)
+		controller = next
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	assert.Greater(requests.Load(), int64(0))
+	assert.Zero(failures.Load())
+	// all replaced sets are drained and retired.
+	for _, set := range sets {
+		assert.True(set.retired.Load())
+		assert.Zero(set.inflight.Load())
+	}
+
+	controller.Close()
+	_, err := GetGlobalAIGatewayHandler()
+	assert.Error(err)
+}
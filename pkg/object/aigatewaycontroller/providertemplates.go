@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// envPattern matches ${NAME} and ${NAME:-default} in the string fields of
+// providers.
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ProviderTemplateSpec is a base provider definition extended by providers.
+type ProviderTemplateSpec struct {
+	Name string `json:"name" jsonschema:"required"`
+	// Extends is the template this template is based on.
+	Extends string `json:"extends,omitempty"`
+	// Fields are the fields of the provider spec defined by the template,
+	// they are deep-merged into the fields of the template it extends.
+	Fields map[string]any `json:"fields" jsonschema:"required"`
+}
+
+// resolveProviders returns the effective specs of the providers, the
+// templates are merged and the environment variables are interpolated.
+func resolveProviders(spec *Spec) ([]*aicontext.ProviderSpec, error) {
+	templates := make(map[string]*ProviderTemplateSpec, len(spec.ProviderTemplates))
+	for _, t := range spec.ProviderTemplates {
+		if t.Name == "" {
+			return nil, fmt.Errorf("provider template name cannot be empty")
+		}
+		if _, exists := templates[t.Name]; exists {
+			return nil, fmt.Errorf("duplicate provider template name: %s", t.Name)
+		}
+		templates[t.Name] = t
+	}
+
+	result := make([]*aicontext.ProviderSpec, 0, len(spec.Providers))
+	for _, p := range spec.Providers {
+		effective, err := resolveProvider(p, templates)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", p.Name, err)
+		}
+		result = append(result, effective)
+	}
+	return result, nil
+}
+
+func resolveProvider(p *aicontext.ProviderSpec, templates map[string]*ProviderTemplateSpec) (*aicontext.ProviderSpec, error) {
+	var fields map[string]any
+	if p.Extends == "" {
+		if len(p.Overrides) > 0 {
+			return nil, fmt.Errorf("overrides require extends")
+		}
+		fields = map[string]any{}
+		if err := codectool.UnmarshalJSON(codectool.MustMarshalJSON(p), &fields); err != nil {
+			return nil, err
+		}
+	} else {
+		rest := *p
+		rest.Name, rest.Extends, rest.Overrides = "", "", nil
+		if !reflect.DeepEqual(rest, aicontext.ProviderSpec{}) {
+			return nil, fmt.Errorf("fields of a provider extending a template must be set in overrides")
+		}
+		base, err := templateFields(p.Extends, templates, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		fields = mergeFields(base, copyValue(p.Overrides).(map[string]any))
+		fields["name"] = p.Name
+	}
+
+	interpolated, err := interpolateEnv(fields)
+	if err != nil {
+		return nil, err
+	}
+	effective := &aicontext.ProviderSpec{}
+	if err := codectool.UnmarshalJSON(codectool.MustMarshalJSON(interpolated), effective); err != nil {
+		return nil, fmt.Errorf("invalid fields: %w", err)
+	}
+	effective.Extends = p.Extends
+	return effective, nil
+}
+
+// templateFields returns a copy of the merged fields of the template and
+// the templates it extends.
+func templateFields(name string, templates map[string]*ProviderTemplateSpec, visiting map[string]bool) (map[string]any, error) {
+	t, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("provider template %s not found", name)
+	}
+	if visiting[name] {
+		return nil, fmt.Errorf("provider template %s extends itself", name)
+	}
+	visiting[name] = true
+
+	fields := copyValue(t.Fields).(map[string]any)
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	if t.Extends == "" {
+		return fields, nil
+	}
+	base, err := templateFields(t.Extends, templates, visiting)
+	if err != nil {
+		return nil, err
+	}
+	return mergeFields(base, fields), nil
+}
+
+// mergeFields deep-merges src into dst and returns dst. Objects are merged
+// recursively, a null in src deletes the field, and other values including
+// lists replace the ones in dst.
+func mergeFields(dst, src map[string]any) map[string]any {
+	if dst == nil {
+		dst = map[string]any{}
+	}
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		if sm, ok := v.(map[string]any); ok {
+			if dm, ok := dst[k].(map[string]any); ok {
+				dst[k] = mergeFields(dm, sm)
+				continue
+			}
+			// the nulls of a new object delete nothing.
+			dst[k] = mergeFields(nil, sm)
+			continue
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+func copyValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		if v == nil {
+			return map[string]any(nil)
+		}
+		m := make(map[string]any, len(v))
+		for k, child := range v {
+			m[k] = copyValue(child)
+		}
+		return m
+	case []any:
+		l := make([]any, len(v))
+		for i, child := range v {
+			l[i] = copyValue(child)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+// interpolateEnv replaces ${NAME} in the string values with the environment
+// variable, and ${NAME:-default} with the default if it is not set.
+func interpolateEnv(value any) (any, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, child := range v {
+			interpolated, err := interpolateEnv(child)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = interpolated
+		}
+		return v, nil
+	case []any:
+		for i, child := range v {
+			interpolated, err := interpolateEnv(child)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = interpolated
+		}
+		return v, nil
+	case string:
+		var err error
+		s := envPattern.ReplaceAllStringFunc(v, func(match string) string {
+			groups := envPattern.FindStringSubmatch(match)
+			if value, ok := os.LookupEnv(groups[1]); ok {
+				return value
+			}
+			if groups[2] != "" {
+				return groups[3]
+			}
+			if err == nil {
+				err = fmt.Errorf("environment variable %s is not set", groups[1])
+			}
+			return match
+		})
+		return s, err
+	default:
+		return v, nil
+	}
+}
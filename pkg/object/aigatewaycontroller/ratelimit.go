@@ -0,0 +1,457 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	// rateLimitHeadersPassthrough keeps the rate limit headers of providers.
+	rateLimitHeadersPassthrough = "passthrough"
+	// rateLimitHeadersSynthesized replaces the rate limit headers of
+	// providers with the ones computed from the rate limit of the gateway.
+	rateLimitHeadersSynthesized = "synthesized"
+	// rateLimitHeadersOff removes all rate limit headers.
+	rateLimitHeadersOff = "off"
+
+	// rateLimitHeaderPrefix is the canonical prefix of the OpenAI style
+	// x-ratelimit-* headers.
+	rateLimitHeaderPrefix = "X-Ratelimit-"
+
+	rateLimitTypeRequests = "requests"
+	rateLimitTypeTokens   = "tokens"
+
+	// rateLimitWindowFixed resets the minute limits at minute boundaries.
+	rateLimitWindowFixed = "fixed"
+	// rateLimitWindowTokenBucket refills the minute limits continuously.
+	rateLimitWindowTokenBucket = "tokenBucket"
+
+	rateLimitDay = 24 * time.Hour
+)
+
+type (
+	// RateLimitSpec limits the requests and tokens of each consumer across
+	// all providers, the limits are kept in the memory of each member.
+	RateLimitSpec struct {
+		// RequestsPerMinute and TokensPerMinute are the limits of each
+		// consumer, all requests share the same limits if there is no
+		// consumer ID.
+		RequestsPerMinute int64 `json:"requestsPerMinute,omitempty"`
+		TokensPerMinute   int64 `json:"tokensPerMinute,omitempty"`
+		// TokensPerDay is the daily token quota, days are in UTC.
+		TokensPerDay int64 `json:"tokensPerDay,omitempty"`
+		// WindowType is how the minute limits are replenished, fixed
+		// resets them at minute boundaries, tokenBucket refills them
+		// continuously, so the rejected clients don't retry at the same
+		// second. The default is fixed.
+		WindowType string `json:"windowType,omitempty" jsonschema:"enum=,enum=fixed,enum=tokenBucket"`
+		// RetryAfterJitter is the maximum random duration added to the
+		// Retry-After of the rejected requests.
+		RetryAfterJitter string `json:"retryAfterJitter,omitempty" jsonschema:"format=duration"`
+	}
+
+	// rateLimiter tracks the budgets of consumers. The tokens of a request
+	// are unknown until it finishes, so a request is admitted as long as
+	// there are tokens left, and its tokens are recorded after it.
+	rateLimiter struct {
+		lock      sync.Mutex
+		spec      *RateLimitSpec
+		jitter    time.Duration
+		consumers map[string]*consumerBudget
+		lastSweep time.Time
+		rejected  *prometheus.CounterVec
+	}
+
+	// consumerBudget is the usage of a consumer in the current windows,
+	// and the buckets of the minute limits of tokenBucket.
+	consumerBudget struct {
+		minute    time.Time
+		requests  int64
+		tokens    int64
+		day       time.Time
+		dayTokens int64
+
+		refilled       time.Time
+		bucketRequests float64
+		bucketTokens   float64
+	}
+
+	// rateLimitState is the remaining budget of a consumer, the limits are
+	// zero if they are not configured. The resets are the durations until
+	// the budgets are full again, and the waits are the durations until a
+	// rejected request can be admitted.
+	rateLimitState struct {
+		limitRequests     int64
+		remainingRequests int64
+		resetRequests     time.Duration
+		waitRequests      time.Duration
+		limitTokens       int64
+		remainingTokens   int64
+		resetTokens       time.Duration
+		waitTokens        time.Duration
+	}
+)
+
+func validateRateLimitSpec(spec *RateLimitSpec, headers string) error {
+	switch headers {
+	case "", rateLimitHeadersPassthrough, rateLimitHeadersOff:
+	case rateLimitHeadersSynthesized:
+		if spec == nil {
+			return fmt.Errorf("rateLimitHeaders %s requires rateLimit", headers)
+		}
+	default:
+		return fmt.Errorf("invalid rateLimitHeaders %s", headers)
+	}
+	if spec == nil {
+		return nil
+	}
+	if spec.RequestsPerMinute < 0 || spec.TokensPerMinute < 0 || spec.TokensPerDay < 0 {
+		return fmt.Errorf("rate limits must be greater than or equal to 0")
+	}
+	if spec.RequestsPerMinute == 0 && spec.TokensPerMinute == 0 && spec.TokensPerDay == 0 {
+		return fmt.Errorf("rateLimit must have at least one limit")
+	}
+	switch spec.WindowType {
+	case "", rateLimitWindowFixed, rateLimitWindowTokenBucket:
+	default:
+		return fmt.Errorf("invalid rateLimit windowType %s", spec.WindowType)
+	}
+	if spec.RetryAfterJitter != "" {
+		jitter, err := time.ParseDuration(spec.RetryAfterJitter)
+		if err != nil {
+			return fmt.Errorf("invalid rateLimit retryAfterJitter: %v", err)
+		}
+		if jitter < 0 {
+			return fmt.Errorf("rateLimit retryAfterJitter must not be negative")
+		}
+	}
+	return nil
+}
+
+// retryAfterJitter returns the maximum jitter of Retry-After, the spec is
+// validated.
+func (spec *RateLimitSpec) retryAfterJitter() time.Duration {
+	jitter, _ := time.ParseDuration(spec.RetryAfterJitter)
+	return jitter
+}
+
+func newRateLimiter(spec *RateLimitSpec) *rateLimiter {
+	return &rateLimiter{
+		spec:      spec,
+		jitter:    spec.retryAfterJitter(),
+		consumers: map[string]*consumerBudget{},
+		rejected:  metricshub.RateLimitedRequests.NewCounter(),
+	}
+}
+
+// setSpec updates the limits, the usage in the current windows is kept.
+func (rl *rateLimiter) setSpec(spec *RateLimitSpec) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.spec = spec
+	rl.jitter = spec.retryAfterJitter()
+}
+
+// retryJitter returns a random duration added to Retry-After, so the
+// rejected clients don't retry at the same time.
+func (rl *rateLimiter) retryJitter() time.Duration {
+	rl.lock.Lock()
+	jitter := rl.jitter
+	rl.lock.Unlock()
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// budget returns the budget of the consumer with the windows rolled to
+// now, the caller must hold the lock.
+func (rl *rateLimiter) budget(consumer string, now time.Time) *consumerBudget {
+	if now.Sub(rl.lastSweep) >= time.Minute {
+		rl.lastSweep = now
+		today := now.Truncate(rateLimitDay)
+		for k, b := range rl.consumers {
+			if b.day.Before(today) {
+				delete(rl.consumers, k)
+			}
+		}
+	}
+
+	b, ok := rl.consumers[consumer]
+	if !ok {
+		b = &consumerBudget{}
+		rl.consumers[consumer] = b
+	}
+	rl.roll(b, now)
+	return b
+}
+
+// roll rolls the windows of the budget to now, the caller must hold the
+// lock.
+func (rl *rateLimiter) roll(b *consumerBudget, now time.Time) {
+	if minute := now.Truncate(time.Minute); !b.minute.Equal(minute) {
+		b.minute, b.requests, b.tokens = minute, 0, 0
+	}
+	if today := now.Truncate(rateLimitDay); !b.day.Equal(today) {
+		b.day, b.dayTokens = today, 0
+	}
+	if rl.spec.WindowType == rateLimitWindowTokenBucket {
+		rl.refill(b, now)
+	}
+}
+
+// refill refills the buckets of the minute limits by the time elapsed
+// since the last refill, up to the limits. The buckets are full at first.
+func (rl *rateLimiter) refill(b *consumerBudget, now time.Time) {
+	requests, tokens := float64(rl.spec.RequestsPerMinute), float64(rl.spec.TokensPerMinute)
+	if b.refilled.IsZero() {
+		b.bucketRequests, b.bucketTokens, b.refilled = requests, tokens, now
+		return
+	}
+	if !now.After(b.refilled) {
+		return
+	}
+	minutes := now.Sub(b.refilled).Minutes()
+	b.bucketRequests = min(requests, b.bucketRequests+requests*minutes)
+	b.bucketTokens = min(tokens, b.bucketTokens+tokens*minutes)
+	b.refilled = now
+}
+
+// admit counts the request if the consumer has budget left, otherwise it
+// returns the type of the limit exceeded.
+func (rl *rateLimiter) admit(consumer string, now time.Time) (*rateLimitState, string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	b := rl.budget(consumer, now)
+	limitType := rl.stateOf(b, now).exceeded()
+	if limitType == "" {
+		b.requests++
+		b.bucketRequests--
+	}
+	if limitType != "" && rl.rejected != nil {
+		rl.rejected.WithLabelValues(limitType).Inc()
+	}
+	return rl.stateOf(b, now), limitType
+}
+
+// record adds the tokens used by a finished request of the consumer.
+func (rl *rateLimiter) record(consumer string, tokens int64, now time.Time) {
+	if tokens <= 0 {
+		return
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	b := rl.budget(consumer, now)
+	b.tokens += tokens
+	b.dayTokens += tokens
+	// the bucket may go below zero, the debt is refilled before other
+	// requests are admitted.
+	b.bucketTokens -= float64(tokens)
+}
+
+// state returns the remaining budget of the consumer.
+func (rl *rateLimiter) state(consumer string, now time.Time) *rateLimitState {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.stateOf(rl.budget(consumer, now), now)
+}
+
+// peek returns the remaining budget of the consumer without counting a
+// request or keeping the budget of a new consumer.
+func (rl *rateLimiter) peek(consumer string, now time.Time) *rateLimitState {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	b := &consumerBudget{}
+	if current, ok := rl.consumers[consumer]; ok {
+		*b = *current
+	}
+	rl.roll(b, now)
+	return rl.stateOf(b, now)
+}
+
+// stateOf returns the remaining budget, the token budget is the tighter
+// one of the minute limit and the daily quota.
+func (rl *rateLimiter) stateOf(b *consumerBudget, now time.Time) *rateLimitState {
+	s := &rateLimitState{}
+	bucket := rl.spec.WindowType == rateLimitWindowTokenBucket
+	if limit := rl.spec.RequestsPerMinute; limit > 0 {
+		s.limitRequests = limit
+		if bucket {
+			s.remainingRequests, s.resetRequests, s.waitRequests = bucketState(b.bucketRequests, limit)
+		} else {
+			s.remainingRequests = max(0, limit-b.requests)
+			s.resetRequests = b.minute.Add(time.Minute).Sub(now)
+			s.waitRequests = s.resetRequests
+		}
+	}
+	if limit := rl.spec.TokensPerMinute; limit > 0 {
+		s.limitTokens = limit
+		if bucket {
+			s.remainingTokens, s.resetTokens, s.waitTokens = bucketState(b.bucketTokens, limit)
+		} else {
+			s.remainingTokens = max(0, limit-b.tokens)
+			s.resetTokens = b.minute.Add(time.Minute).Sub(now)
+			s.waitTokens = s.resetTokens
+		}
+	}
+	if limit := rl.spec.TokensPerDay; limit > 0 {
+		// an exhausted quota is reported even if the minute limit is
+		// exhausted too, as it is reset later.
+		remaining := max(0, limit-b.dayTokens)
+		if s.limitTokens == 0 || remaining < s.remainingTokens || remaining == 0 {
+			s.limitTokens = limit
+			s.remainingTokens = remaining
+			s.resetTokens = b.day.Add(rateLimitDay).Sub(now)
+			s.waitTokens = s.resetTokens
+		}
+	}
+	return s
+}
+
+// bucketState returns the remaining of a bucket refilled by limit per
+// minute, the time until it is full, and the time until there is one
+// left.
+func bucketState(level float64, limit int64) (int64, time.Duration, time.Duration) {
+	perSecond := float64(limit) / time.Minute.Seconds()
+	remaining := max(0, int64(math.Floor(level)))
+	reset := time.Duration((float64(limit) - level) / perSecond * float64(time.Second))
+	var wait time.Duration
+	if level < 1 {
+		wait = time.Duration((1 - level) / perSecond * float64(time.Second))
+	}
+	return remaining, max(0, reset), wait
+}
+
+// exceeded returns the type of the limit exhausted, or empty if a request
+// can be admitted.
+func (s *rateLimitState) exceeded() string {
+	switch {
+	case s.limitRequests > 0 && s.remainingRequests == 0:
+		return rateLimitTypeRequests
+	case s.limitTokens > 0 && s.remainingTokens == 0:
+		return rateLimitTypeTokens
+	}
+	return ""
+}
+
+// retryAfter returns the time until a request can be admitted by the
+// exceeded limit.
+func (s *rateLimitState) retryAfter(limitType string) time.Duration {
+	if limitType == rateLimitTypeRequests {
+		return s.waitRequests
+	}
+	return s.waitTokens
+}
+
+// setHeaders sets the OpenAI style rate limit headers.
+func (s *rateLimitState) setHeaders(h http.Header) {
+	if s.limitRequests > 0 {
+		h.Set("X-Ratelimit-Limit-Requests", strconv.FormatInt(s.limitRequests, 10))
+		h.Set("X-Ratelimit-Remaining-Requests", strconv.FormatInt(s.remainingRequests, 10))
+		h.Set("X-Ratelimit-Reset-Requests", formatReset(s.resetRequests))
+	}
+	if s.limitTokens > 0 {
+		h.Set("X-Ratelimit-Limit-Tokens", strconv.FormatInt(s.limitTokens, 10))
+		h.Set("X-Ratelimit-Remaining-Tokens", strconv.FormatInt(s.remainingTokens, 10))
+		h.Set("X-Ratelimit-Reset-Tokens", formatReset(s.resetTokens))
+	}
+}
+
+// formatReset formats the duration like the reset headers of OpenAI,
+// e.g. 1s, 6m0s, rounded up to seconds.
+func formatReset(d time.Duration) string {
+	return (d + time.Second - 1).Truncate(time.Second).String()
+}
+
+// removeRateLimitHeaders removes the rate limit headers of providers.
+func removeRateLimitHeaders(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), rateLimitHeaderPrefix) {
+			delete(h, k)
+		}
+	}
+}
+
+// checkRateLimit admits the request by the rate limit, otherwise it sets
+// an OpenAI format 429 response and returns false.
+func (agc *AIGatewayController) checkRateLimit(ctx *context.Context) bool {
+	if agc.rateLimiter == nil {
+		return true
+	}
+	consumer := agc.consumerID(ctx)
+	state, limitType := agc.rateLimiter.admit(consumer, time.Now())
+	if limitType == "" {
+		return true
+	}
+
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil {
+		resp, _ = httpprot.NewResponse(nil)
+	}
+	resp.SetStatusCode(http.StatusTooManyRequests)
+	resp.HTTPHeader().Set("Content-Type", "application/json")
+	retryAfter := state.retryAfter(limitType) + agc.rateLimiter.retryJitter()
+	resp.HTTPHeader().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	if agc.spec.RateLimitHeaders != rateLimitHeadersOff {
+		state.setHeaders(resp.HTTPHeader())
+	}
+	message := fmt.Sprintf("Rate limit reached for %s of consumer %q, please try again in %s.", limitType, consumer, formatReset(retryAfter))
+	data, _ := codectool.MarshalJSON(protocol.NewRateLimitError(limitType, message))
+	resp.SetPayload(data)
+	ctx.SetOutputResponse(resp)
+	return false
+}
+
+// applyRateLimitHeaders applies the rate limit headers policy to the
+// headers of the response, it is called before the response is written,
+// so the headers of streaming responses are covered too.
+func (agc *AIGatewayController) applyRateLimitHeaders(ctx *context.Context, h http.Header) {
+	switch agc.spec.RateLimitHeaders {
+	case rateLimitHeadersOff:
+		removeRateLimitHeaders(h)
+	case rateLimitHeadersSynthesized:
+		removeRateLimitHeaders(h)
+		agc.rateLimiter.state(agc.consumerID(ctx), time.Now()).setHeaders(h)
+	}
+}
+
+// recordRateLimit records the tokens used by the request.
+func (agc *AIGatewayController) recordRateLimit(ctx *context.Context, metric *metricshub.Metric) {
+	if agc.rateLimiter == nil || metric == nil {
+		return
+	}
+	agc.rateLimiter.record(agc.consumerID(ctx), metric.InputTokens+metric.OutputTokens, time.Now())
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func TestValidateRateLimitSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateRateLimitSpec(nil, ""))
+	assert.NoError(validateRateLimitSpec(nil, rateLimitHeadersOff))
+	assert.NoError(validateRateLimitSpec(&RateLimitSpec{TokensPerDay: 100}, rateLimitHeadersSynthesized))
+	assert.Error(validateRateLimitSpec(nil, rateLimitHeadersSynthesized))
+	assert.Error(validateRateLimitSpec(nil, "raw"))
+	assert.Error(validateRateLimitSpec(&RateLimitSpec{}, ""))
+	assert.Error(validateRateLimitSpec(&RateLimitSpec{RequestsPerMinute: -1, TokensPerDay: 100}, ""))
+	assert.NoError(validateRateLimitSpec(&RateLimitSpec{TokensPerMinute: 100, WindowType: rateLimitWindowTokenBucket, RetryAfterJitter: "5s"}, ""))
+	assert.Error(validateRateLimitSpec(&RateLimitSpec{TokensPerMinute: 100, WindowType: "sliding"}, ""))
+	assert.Error(validateRateLimitSpec(&RateLimitSpec{TokensPerMinute: 100, RetryAfterJitter: "5"}, ""))
+	assert.Error(validateRateLimitSpec(&RateLimitSpec{TokensPerMinute: 100, RetryAfterJitter: "-1s"}, ""))
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	rl := newRateLimiter(&RateLimitSpec{RequestsPerMinute: 2, TokensPerMinute: 100, TokensPerDay: 150})
+	now := time.Date(2025, 1, 1, 10, 0, 30, 0, time.UTC)
+
+	state, limitType := rl.admit("alice", now)
+	assert.Empty(limitType)
+	assert.Equal(int64(1), state.remainingRequests)
+	assert.Equal(30*time.Second, state.resetRequests)
+	assert.Equal(int64(100), state.remainingTokens)
+	assert.Equal(int64(100), state.limitTokens)
+
+	rl.record("alice", 60, now)
+	state = rl.state("alice", now)
+	assert.Equal(int64(40), state.remainingTokens)
+
+	_, limitType = rl.admit("alice", now)
+	assert.Empty(limitType)
+	state, limitType = rl.admit("alice", now)
+	assert.Equal(rateLimitTypeRequests, limitType)
+	assert.Equal(int64(0), state.remainingRequests)
+	assert.Equal(30*time.Second, state.retryAfter(limitType))
+
+	// other consumers have their own budgets.
+	_, limitType = rl.admit("bob", now)
+	assert.Empty(limitType)
+
+	// the minute limit is exceeded.
+	rl.record("alice", 60, now)
+	now = now.Add(time.Minute)
+	state, limitType = rl.admit("alice", now)
+	assert.Empty(limitType)
+	// the daily quota is tighter than the minute limit.
+	assert.Equal(int64(150), state.limitTokens)
+	assert.Equal(int64(30), state.remainingTokens)
+	assert.Equal(14*time.Hour-90*time.Second, state.resetTokens)
+
+	rl.record("alice", 30, now)
+	state, limitType = rl.admit("alice", now)
+	assert.Equal(rateLimitTypeTokens, limitType)
+	assert.Equal(int64(0), state.remainingTokens)
+	assert.Equal(int64(150), state.limitTokens)
+
+	// the quota is reset the next day, and expired budgets are removed.
+	now = now.Add(14 * time.Hour)
+	_, limitType = rl.admit("alice", now)
+	assert.Empty(limitType)
+	assert.Len(rl.consumers, 1)
+
+	// the usage is kept when the limits are changed.
+	rl.record("alice", 100, now)
+	rl.setSpec(&RateLimitSpec{TokensPerMinute: 200})
+	state = rl.state("alice", now)
+	assert.Equal(int64(100), state.remainingTokens)
+	assert.Zero(state.limitRequests)
+
+	assert.Equal("1s", formatReset(100*time.Millisecond))
+	assert.Equal("6m0s", formatReset(6*time.Minute))
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	rl := newRateLimiter(&RateLimitSpec{RequestsPerMinute: 2, TokensPerMinute: 600, WindowType: rateLimitWindowTokenBucket})
+	now := time.Date(2025, 1, 1, 10, 0, 59, 0, time.UTC)
+
+	// the buckets are full at first.
+	state, limitType := rl.admit("alice", now)
+	assert.Empty(limitType)
+	assert.Equal(int64(1), state.remainingRequests)
+	assert.Equal(30*time.Second, state.resetRequests)
+	assert.Equal(int64(600), state.remainingTokens)
+
+	_, limitType = rl.admit("alice", now)
+	assert.Empty(limitType)
+	state, limitType = rl.admit("alice", now)
+	assert.Equal(rateLimitTypeRequests, limitType)
+	// one request is refilled in 30 seconds, not at the minute boundary.
+	assert.Equal(30*time.Second, state.retryAfter(limitType))
+	_, limitType = rl.admit("alice", now.Add(time.Second))
+	assert.Equal(rateLimitTypeRequests, limitType)
+	_, limitType = rl.admit("alice", now.Add(30*time.Second))
+	assert.Empty(limitType)
+
+	// the tokens used beyond the bucket are a debt.
+	now = now.Add(time.Minute)
+	rl.record("alice", 900, now)
+	state, limitType = rl.admit("alice", now)
+	assert.Equal(rateLimitTypeTokens, limitType)
+	assert.Equal(int64(0), state.remainingTokens)
+	assert.Equal(30100*time.Millisecond, state.retryAfter(limitType))
+	assert.Equal(time.Minute+30*time.Second, state.resetTokens)
+
+	state = rl.state("alice", now.Add(40*time.Second))
+	assert.Equal(int64(100), state.remainingTokens)
+	// the buckets are not refilled beyond the limits.
+	state = rl.state("alice", now.Add(time.Hour))
+	assert.Equal(int64(600), state.remainingTokens)
+	assert.Equal(int64(2), state.remainingRequests)
+
+	rl.setSpec(&RateLimitSpec{TokensPerMinute: 600, WindowType: rateLimitWindowTokenBucket, RetryAfterJitter: "3s"})
+	for i := 0; i < 10; i++ {
+		jitter := rl.retryJitter()
+		assert.GreaterOrEqual(jitter, time.Duration(0))
+		assert.Less(jitter, 3*time.Second)
+	}
+}
+
+// TestRateLimiterBoundaryBurst simulates clients retrying after the
+// Retry-After of the rejected requests. With fixed windows the requests
+// admitted to providers burst at the minute boundaries, and with token
+// buckets they are spread evenly.
+func TestRateLimiterBoundaryBurst(t *testing.T) {
+	assert := assert.New(t)
+
+	simulate := func(windowType string) map[int]int {
+		rl := newRateLimiter(&RateLimitSpec{TokensPerMinute: 6000, WindowType: windowType})
+		start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+		// the clients send their first requests evenly in the first
+		// minute, every request uses 100 tokens.
+		const clients = 200
+		next := make([]time.Time, clients)
+		for i := range next {
+			next[i] = start.Add(time.Duration(i) * time.Minute / clients)
+		}
+
+		admitted := map[int]int{}
+		for tick := time.Duration(0); tick < 4*time.Minute; tick += 100 * time.Millisecond {
+			now := start.Add(tick)
+			for i := range next {
+				if now.Before(next[i]) {
+					continue
+				}
+				state, limitType := rl.admit("", now)
+				if limitType == "" {
+					rl.record("", 100, now)
+					admitted[int(tick/time.Second)]++
+					next[i] = now.Add(10 * time.Second)
+					continue
+				}
+				// the clients retry after the Retry-After in seconds.
+				retryAfter := time.Duration(math.Ceil(state.retryAfter(limitType).Seconds())) * time.Second
+				next[i] = now.Add(retryAfter)
+			}
+		}
+		return admitted
+	}
+	burst := func(admitted map[int]int) int {
+		// the first minute is skipped, the budgets are full at first.
+		result := 0
+		for second, n := range admitted {
+			if second >= 60 {
+				result = max(result, n)
+			}
+		}
+		return result
+	}
+
+	fixed := simulate(rateLimitWindowFixed)
+	assert.Equal(60, fixed[60])
+	assert.Equal(60, fixed[120])
+	assert.Equal(60, burst(fixed))
+
+	bucket := simulate(rateLimitWindowTokenBucket)
+	assert.LessOrEqual(burst(bucket), 2)
+	total := 0
+	for second, n := range bucket {
+		if second >= 60 {
+			total += n
+		}
+	}
+	// the throughput is the same, a request per second.
+	assert.InDelta(180, total, 3)
+}
+
+func rateLimitedHandler(w http.ResponseWriter, r *http.Request) {
+	req := &protocol.GeneralRequest{}
+	json.NewDecoder(r.Body).Decode(req)
+	w.Header().Set("X-Ratelimit-Remaining-Tokens", "999")
+	w.Header().Set("X-Ratelimit-Limit-Tokens", "1000")
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(getNonStreamBody(req.Model))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	chunk := `{"id":"1","object":"chat.completion.chunk","choices":[],"usage":{"prompt_tokens":19,"completion_tokens":10,"total_tokens":29}}`
+	fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", chunk)
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(rateLimitedHandler))
+	defer mockServer.Close()
+
+	newController := func(extra string) *AIGatewayController {
+		config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+%s`, mockServer.URL, extra)
+		super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+		spec, err := super.NewSpec(config)
+		assert.Nil(err)
+		controller := &AIGatewayController{}
+		controller.Init(spec)
+		return controller
+	}
+	send := func(controller *AIGatewayController, consumer string, stream bool) (*httpprot.Response, []byte) {
+		ctx := context.New(nil)
+		data := fmt.Sprintf(`{"model": "gpt", "stream": %v}`, stream)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(data)))
+		assert.Nil(err)
+		req.Header.Set("X-Consumer", consumer)
+		setRequest(t, ctx, "ratelimit", req)
+		controller.Handle(ctx, "openai", nil)
+		resp := ctx.GetResponse("ratelimit").(*httpprot.Response)
+		// the response is read as it is written to the client, so the
+		// tokens are recorded.
+		body, err := io.ReadAll(resp.GetPayload())
+		assert.Nil(err)
+		ctx.Finish()
+		return resp, body
+	}
+
+	{
+		controller := newController("")
+		resp, _ := send(controller, "alice", false)
+		assert.Equal(http.StatusOK, resp.StatusCode())
+		assert.Equal("999", resp.HTTPHeader().Get("X-Ratelimit-Remaining-Tokens"))
+		controller.Close()
+	}
+
+	{
+		controller := newController("rateLimitHeaders: off\n")
+		for _, stream := range []bool{false, true} {
+			resp, _ := send(controller, "alice", stream)
+			assert.Equal(http.StatusOK, resp.StatusCode())
+			assert.Empty(resp.HTTPHeader().Get("X-Ratelimit-Remaining-Tokens"))
+			assert.Empty(resp.HTTPHeader().Get("X-Ratelimit-Limit-Tokens"))
+		}
+		controller.Close()
+	}
+
+	{
+		controller := newController(`consumerIDHeader: X-Consumer
+rateLimit:
+  tokensPerDay: 50
+rateLimitHeaders: synthesized
+`)
+		defer controller.Close()
+
+		resp, _ := send(controller, "alice", false)
+		assert.Equal(http.StatusOK, resp.StatusCode())
+		assert.Equal("50", resp.HTTPHeader().Get("X-Ratelimit-Limit-Tokens"))
+		assert.Equal("50", resp.HTTPHeader().Get("X-Ratelimit-Remaining-Tokens"))
+		assert.NotEmpty(resp.HTTPHeader().Get("X-Ratelimit-Reset-Tokens"))
+		assert.Empty(resp.HTTPHeader().Get("X-Ratelimit-Limit-Requests"))
+
+		// the tokens of the first request are counted.
+		resp, _ = send(controller, "alice", true)
+		assert.Equal(http.StatusOK, resp.StatusCode())
+		assert.Equal("21", resp.HTTPHeader().Get("X-Ratelimit-Remaining-Tokens"))
+
+		resp, body := send(controller, "alice", true)
+		assert.Equal(http.StatusTooManyRequests, resp.StatusCode())
+		assert.Equal("0", resp.HTTPHeader().Get("X-Ratelimit-Remaining-Tokens"))
+		assert.NotEmpty(resp.HTTPHeader().Get("Retry-After"))
+		errResp := &protocol.ErrorResponse{}
+		assert.Nil(json.Unmarshal(body, errResp))
+		assert.Equal(rateLimitTypeTokens, errResp.Error.Type)
+		assert.Equal("rate_limit_exceeded", *errResp.Error.Code)
+
+		// the budget is per consumer, across providers.
+		resp, _ = send(controller, "bob", false)
+		assert.Equal(http.StatusOK, resp.StatusCode())
+		assert.Equal("50", resp.HTTPHeader().Get("X-Ratelimit-Remaining-Tokens"))
+	}
+}
@@ -0,0 +1,478 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	stdcontext "context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/protocol"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	// readinessPolicyServeDegraded serves the traffic when the grace
+	// period expires, the dependencies are still probed in background.
+	readinessPolicyServeDegraded = "serveDegraded"
+	// readinessPolicyKeepRetrying keeps rejecting the traffic until the
+	// dependencies pass.
+	readinessPolicyKeepRetrying = "keepRetrying"
+
+	readinessNotReady = "NotReady"
+	readinessReady    = "Ready"
+	readinessDegraded = "Degraded"
+
+	defaultReadinessGracePeriod    = time.Minute
+	defaultReadinessInitialBackoff = 500 * time.Millisecond
+	defaultReadinessMaxBackoff     = 10 * time.Second
+	readinessProbeTimeout          = 5 * time.Second
+
+	// maxReadinessTransitions bounds the transitions kept for the status.
+	maxReadinessTransitions = 10
+)
+
+type (
+	// ReadinessSpec gates the AI traffic at startup until the dependencies
+	// are reachable. The dependencies are the vector databases of the
+	// middlewares and the providers marked required, they are probed with
+	// exponential backoff, and the AI requests are rejected with 503 until
+	// all of them pass or the grace period expires. The controller stays
+	// ready after reloads once it is ready.
+	ReadinessSpec struct {
+		// GracePeriod is how long to wait for the dependencies, default 1m.
+		GracePeriod string `json:"gracePeriod,omitempty" jsonschema:"format=duration"`
+		// InitialBackoff is the interval before the second probe, it is
+		// doubled after each probe up to MaxBackoff, default 500ms.
+		InitialBackoff string `json:"initialBackoff,omitempty" jsonschema:"format=duration"`
+		// MaxBackoff is the maximum interval between probes, default 10s.
+		MaxBackoff string `json:"maxBackoff,omitempty" jsonschema:"format=duration"`
+		// Policy is what to do when the grace period expires, serveDegraded
+		// serves the traffic without the failing dependencies, and
+		// keepRetrying keeps rejecting the traffic, default serveDegraded.
+		Policy string `json:"policy,omitempty" jsonschema:"enum=,enum=serveDegraded,enum=keepRetrying"`
+	}
+
+	// ReadinessStatus is the readiness of the controller in its status.
+	ReadinessStatus struct {
+		State            string                 `json:"state"`
+		Since            time.Time              `json:"since"`
+		Policy           string                 `json:"policy"`
+		GracePeriodEndAt time.Time              `json:"gracePeriodEndAt"`
+		Dependencies     []*DependencyStatus    `json:"dependencies,omitempty"`
+		Transitions      []*ReadinessTransition `json:"transitions,omitempty"`
+	}
+
+	// DependencyStatus is the probe result of a dependency.
+	DependencyStatus struct {
+		Name      string    `json:"name"`
+		Ready     bool      `json:"ready"`
+		Attempts  int       `json:"attempts"`
+		LastProbe time.Time `json:"lastProbe,omitempty"`
+		Error     string    `json:"error,omitempty"`
+	}
+
+	// ReadinessTransition is a change of the readiness state.
+	ReadinessTransition struct {
+		From   string    `json:"from"`
+		To     string    `json:"to"`
+		At     time.Time `json:"at"`
+		Reason string    `json:"reason"`
+	}
+
+	// readiness probes the dependencies of the controller in background
+	// until all of them pass.
+	readiness struct {
+		name           string
+		policy         string
+		gracePeriodEnd time.Time
+		initialBackoff time.Duration
+		maxBackoff     time.Duration
+		deps           []*readinessDependency
+
+		lock        sync.Mutex
+		state       string
+		since       time.Time
+		expired     bool
+		nextProbe   time.Time
+		transitions []*ReadinessTransition
+
+		// ctx is canceled to stop probing.
+		ctx    stdcontext.Context
+		cancel stdcontext.CancelFunc
+		done   chan struct{}
+	}
+
+	// readinessDependency is a dependency probed by check, ready is called
+	// once the check passes.
+	readinessDependency struct {
+		status DependencyStatus
+		check  func(ctx stdcontext.Context) error
+		ready  func()
+	}
+)
+
+func validateReadinessSpec(spec *ReadinessSpec) error {
+	if spec == nil {
+		return nil
+	}
+	for _, d := range []string{spec.GracePeriod, spec.InitialBackoff, spec.MaxBackoff} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+			return fmt.Errorf("invalid duration %s", d)
+		}
+	}
+	if spec.initialBackoff() > spec.maxBackoff() {
+		return fmt.Errorf("initialBackoff %s is greater than maxBackoff %s", spec.initialBackoff(), spec.maxBackoff())
+	}
+	switch spec.Policy {
+	case "", readinessPolicyServeDegraded, readinessPolicyKeepRetrying:
+	default:
+		return fmt.Errorf("invalid policy %s", spec.Policy)
+	}
+	return nil
+}
+
+func (spec *ReadinessSpec) gracePeriod() time.Duration {
+	return parseDurationOr(spec.GracePeriod, defaultReadinessGracePeriod)
+}
+
+func (spec *ReadinessSpec) initialBackoff() time.Duration {
+	return parseDurationOr(spec.InitialBackoff, defaultReadinessInitialBackoff)
+}
+
+func (spec *ReadinessSpec) maxBackoff() time.Duration {
+	return parseDurationOr(spec.MaxBackoff, defaultReadinessMaxBackoff)
+}
+
+func (spec *ReadinessSpec) policy() string {
+	if spec.Policy == "" {
+		return readinessPolicyServeDegraded
+	}
+	return spec.Policy
+}
+
+// newReadiness creates the readiness of the dependencies, it starts in
+// the state of prev, and keeps the grace period of prev, so reloads do
+// not restart the readiness phase.
+func newReadiness(name string, spec *ReadinessSpec, deps []*readinessDependency, prev *readiness) *readiness {
+	now := time.Now()
+	r := &readiness{
+		name:           name,
+		policy:         spec.policy(),
+		gracePeriodEnd: now.Add(spec.gracePeriod()),
+		initialBackoff: spec.initialBackoff(),
+		maxBackoff:     spec.maxBackoff(),
+		deps:           deps,
+		state:          readinessNotReady,
+		since:          now,
+		done:           make(chan struct{}),
+	}
+	r.ctx, r.cancel = stdcontext.WithCancel(stdcontext.Background())
+	if prev != nil {
+		prev.lock.Lock()
+		r.gracePeriodEnd = prev.gracePeriodEnd
+		r.state, r.since, r.expired = prev.state, prev.since, prev.expired
+		r.transitions = prev.transitions
+		prev.lock.Unlock()
+	}
+	if r.state == readinessReady {
+		close(r.done)
+		return r
+	}
+	go r.run()
+	return r
+}
+
+// run probes the dependencies with exponential backoff until all of them
+// pass or the readiness is closed.
+func (r *readiness) run() {
+	defer close(r.done)
+	backoff := r.initialBackoff
+	for {
+		ready := r.probe()
+		if r.ctx.Err() != nil {
+			return
+		}
+		if ready {
+			r.transit(readinessReady, "all dependencies are ready")
+			return
+		}
+		now := time.Now()
+		wait := backoff
+		if !r.isExpired() && r.gracePeriodEnd.Sub(now) < wait {
+			wait = max(r.gracePeriodEnd.Sub(now), 0)
+		} else {
+			backoff = min(backoff*2, r.maxBackoff)
+		}
+		r.lock.Lock()
+		r.nextProbe = now.Add(wait)
+		r.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !r.isExpired() && !time.Now().Before(r.gracePeriodEnd) {
+			r.expire()
+		}
+	}
+}
+
+// probe checks the dependencies not ready yet concurrently, and returns
+// whether all dependencies are ready.
+func (r *readiness) probe() bool {
+	var wg sync.WaitGroup
+	for _, dep := range r.deps {
+		r.lock.Lock()
+		ready := dep.status.Ready
+		r.lock.Unlock()
+		if ready {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := stdcontext.WithTimeout(r.ctx, readinessProbeTimeout)
+			err := dep.check(ctx)
+			cancel()
+			if r.ctx.Err() != nil {
+				return
+			}
+
+			r.lock.Lock()
+			dep.status.Attempts++
+			dep.status.LastProbe = time.Now()
+			dep.status.Ready = err == nil
+			dep.status.Error = ""
+			if err != nil {
+				dep.status.Error = err.Error()
+			}
+			attempts := dep.status.Attempts
+			r.lock.Unlock()
+
+			if err != nil {
+				logger.Warnf("AIGatewayController %s dependency %s is not ready (attempt %d): %v", r.name, dep.status.Name, attempts, err)
+				return
+			}
+			logger.Infof("AIGatewayController %s dependency %s is ready after %d attempts", r.name, dep.status.Name, attempts)
+			if dep.ready != nil {
+				dep.ready()
+			}
+		}()
+	}
+	wg.Wait()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, dep := range r.deps {
+		if !dep.status.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *readiness) isExpired() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.expired || r.state == readinessDegraded
+}
+
+// expire applies the policy when the grace period expires.
+func (r *readiness) expire() {
+	r.lock.Lock()
+	r.expired = true
+	r.lock.Unlock()
+	if r.policy == readinessPolicyServeDegraded {
+		r.transit(readinessDegraded, "grace period expired, serving without the failing dependencies")
+		return
+	}
+	logger.Warnf("AIGatewayController %s readiness grace period expired, keep retrying the failing dependencies", r.name)
+}
+
+func (r *readiness) transit(state, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state == state {
+		return
+	}
+	now := time.Now()
+	r.transitions = append(r.transitions, &ReadinessTransition{From: r.state, To: state, At: now, Reason: reason})
+	if len(r.transitions) > maxReadinessTransitions {
+		r.transitions = r.transitions[len(r.transitions)-maxReadinessTransitions:]
+	}
+	logger.Infof("AIGatewayController %s readiness: %s -> %s, %s", r.name, r.state, state, reason)
+	r.state, r.since = state, now
+}
+
+// serving returns whether the AI traffic is served, it is true if
+// readiness is not configured.
+func (r *readiness) serving() bool {
+	if r == nil {
+		return true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state != readinessNotReady
+}
+
+// retryAfter returns the duration until the next probe.
+func (r *readiness) retryAfter() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return max(time.Until(r.nextProbe), time.Second)
+}
+
+func (r *readiness) status() *ReadinessStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	status := &ReadinessStatus{
+		State:            r.state,
+		Since:            r.since,
+		Policy:           r.policy,
+		GracePeriodEndAt: r.gracePeriodEnd,
+		Transitions:      append([]*ReadinessTransition(nil), r.transitions...),
+	}
+	for _, dep := range r.deps {
+		s := dep.status
+		status.Dependencies = append(status.Dependencies, &s)
+	}
+	return status
+}
+
+// close stops probing the dependencies.
+func (r *readiness) close() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
+
+// readinessDependencies returns the dependencies of the controller, the
+// vector databases of the middlewares are probed before the providers.
+func (agc *AIGatewayController) readinessDependencies() []*readinessDependency {
+	deps := []*readinessDependency{}
+	names := make([]string, 0, len(agc.middlewares))
+	for name := range agc.middlewares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checker, ok := agc.middlewares[name].(middlewares.DependencyChecker)
+		if !ok {
+			continue
+		}
+		deps = append(deps, &readinessDependency{
+			status: DependencyStatus{Name: "middleware/" + name},
+			check:  checker.CheckDependencies,
+			ready:  checker.DependenciesReady,
+		})
+	}
+	set := agc.acquireProviders()
+	if set == nil {
+		return deps
+	}
+	defer set.release()
+	names = names[:0]
+	for name, p := range set.providers {
+		if p.Spec().Required {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		deps = append(deps, &readinessDependency{
+			status: DependencyStatus{Name: "provider/" + name},
+			check: func(stdcontext.Context) error {
+				return agc.checkProviderHealth(name)
+			},
+		})
+	}
+	return deps
+}
+
+func (agc *AIGatewayController) checkProviderHealth(name string) error {
+	set := agc.acquireProviders()
+	if set == nil {
+		return fmt.Errorf("AIGatewayController is closed")
+	}
+	defer set.release()
+	provider, ok := set.providers[name]
+	if !ok {
+		return fmt.Errorf("provider %s not found", name)
+	}
+	return provider.HealthCheck()
+}
+
+// reloadReadiness starts the readiness of the new generation from the one
+// of the previous generation.
+func (agc *AIGatewayController) reloadReadiness(prev *AIGatewayController) string {
+	var prevReadiness *readiness
+	if prev != nil {
+		prevReadiness = prev.readiness
+		prevReadiness.close()
+	}
+	if agc.spec.Readiness == nil {
+		if prevReadiness != nil {
+			return componentClosed
+		}
+		return ""
+	}
+	agc.readiness = newReadiness(agc.superSpec.Name(), agc.spec.Readiness, agc.readinessDependencies(), prevReadiness)
+	if prevReadiness != nil {
+		return componentKept
+	}
+	return componentCreated
+}
+
+// checkReadiness admits the request if the controller is serving,
+// otherwise it sets an OpenAI format 503 response and returns false.
+func (agc *AIGatewayController) checkReadiness(ctx *context.Context) bool {
+	if agc.readiness.serving() {
+		return true
+	}
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil {
+		resp, _ = httpprot.NewResponse(nil)
+	}
+	resp.SetStatusCode(http.StatusServiceUnavailable)
+	resp.HTTPHeader().Set("Content-Type", "application/json")
+	retryAfter := agc.readiness.retryAfter()
+	resp.HTTPHeader().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	errMsg := protocol.NewError(http.StatusServiceUnavailable, "AI gateway is not ready, waiting for its dependencies")
+	data, _ := codectool.MarshalJSON(errMsg)
+	resp.SetPayload(data)
+	ctx.SetOutputResponse(resp)
+	return false
+}
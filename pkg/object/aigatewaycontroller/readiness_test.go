@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func TestValidateReadinessSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(validateReadinessSpec(nil))
+	assert.Nil(validateReadinessSpec(&ReadinessSpec{}))
+	assert.Nil(validateReadinessSpec(&ReadinessSpec{GracePeriod: "30s", InitialBackoff: "1s", MaxBackoff: "5s", Policy: readinessPolicyKeepRetrying}))
+	assert.NotNil(validateReadinessSpec(&ReadinessSpec{GracePeriod: "0s"}))
+	assert.NotNil(validateReadinessSpec(&ReadinessSpec{InitialBackoff: "bad"}))
+	assert.NotNil(validateReadinessSpec(&ReadinessSpec{InitialBackoff: "20s"}))
+	assert.NotNil(validateReadinessSpec(&ReadinessSpec{Policy: "wait"}))
+}
+
+func newTestDependency(name string, healthy *atomic.Bool, readyCalls *atomic.Int32) *readinessDependency {
+	return &readinessDependency{
+		status: DependencyStatus{Name: name},
+		check: func(stdcontext.Context) error {
+			if healthy.Load() {
+				return nil
+			}
+			return fmt.Errorf("connection refused")
+		},
+		ready: func() { readyCalls.Add(1) },
+	}
+}
+
+func TestReadinessPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &ReadinessSpec{GracePeriod: "50ms", InitialBackoff: "10ms", MaxBackoff: "20ms"}
+	state := func(r *readiness) string { return r.status().State }
+
+	{
+		healthy, readyCalls := &atomic.Bool{}, &atomic.Int32{}
+		r := newReadiness("agc", spec, []*readinessDependency{newTestDependency("middleware/cache", healthy, readyCalls)}, nil)
+		assert.False(r.serving())
+		assert.Eventually(func() bool { return state(r) == readinessDegraded }, time.Second, 5*time.Millisecond)
+		assert.True(r.serving())
+
+		healthy.Store(true)
+		assert.Eventually(func() bool { return state(r) == readinessReady }, time.Second, 5*time.Millisecond)
+		assert.Equal(int32(1), readyCalls.Load())
+		status := r.status()
+		assert.Len(status.Transitions, 2)
+		assert.Equal(readinessNotReady, status.Transitions[0].From)
+		assert.Equal(readinessDegraded, status.Transitions[0].To)
+		assert.Equal(readinessReady, status.Transitions[1].To)
+		assert.True(status.Dependencies[0].Ready)
+		assert.Greater(status.Dependencies[0].Attempts, 1)
+		r.close()
+	}
+
+	{
+		keepRetrying := *spec
+		keepRetrying.Policy = readinessPolicyKeepRetrying
+		healthy, readyCalls := &atomic.Bool{}, &atomic.Int32{}
+		r := newReadiness("agc", &keepRetrying, []*readinessDependency{newTestDependency("provider/openai", healthy, readyCalls)}, nil)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(readinessNotReady, state(r))
+		assert.False(r.serving())
+		assert.Equal("connection refused", r.status().Dependencies[0].Error)
+
+		healthy.Store(true)
+		assert.Eventually(r.serving, time.Second, 5*time.Millisecond)
+		assert.Equal(readinessReady, state(r))
+		r.close()
+	}
+
+	{
+		// no dependencies, ready at once.
+		r := newReadiness("agc", spec, nil, nil)
+		assert.Eventually(r.serving, time.Second, 5*time.Millisecond)
+
+		// the next generation inherits the ready state without probing.
+		healthy, readyCalls := &atomic.Bool{}, &atomic.Int32{}
+		next := newReadiness("agc", spec, []*readinessDependency{newTestDependency("middleware/cache", healthy, readyCalls)}, r)
+		assert.True(next.serving())
+		assert.Equal(0, next.status().Dependencies[0].Attempts)
+		next.close()
+	}
+
+	{
+		// closing stops probing.
+		healthy, readyCalls := &atomic.Bool{}, &atomic.Int32{}
+		r := newReadiness("agc", spec, []*readinessDependency{newTestDependency("middleware/cache", healthy, readyCalls)}, nil)
+		r.close()
+		healthy.Store(true)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(readinessNotReady, state(r))
+	}
+}
+
+func TestReadinessGate(t *testing.T) {
+	assert := assert.New(t)
+
+	var healthy atomic.Bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/models" {
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(getNonStreamBody("gpt"))
+	}))
+	defer mockServer.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+  required: true
+readiness:
+  initialBackoff: 10ms
+  maxBackoff: 20ms
+  policy: keepRetrying
+`, mockServer.URL)
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	send := func() *httpprot.Response {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt"}`)))
+		assert.Nil(err)
+		setRequest(t, ctx, "readiness", req)
+		controller.Handle(ctx, "openai", nil)
+		defer ctx.Finish()
+		return ctx.GetResponse("readiness").(*httpprot.Response)
+	}
+
+	resp := send()
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode())
+	assert.NotEmpty(resp.HTTPHeader().Get("Retry-After"))
+	status := controller.Status().ObjectStatus.(map[string]interface{})["readiness"].(*ReadinessStatus)
+	assert.Equal(readinessNotReady, status.State)
+	assert.Equal("provider/openai", status.Dependencies[0].Name)
+
+	healthy.Store(true)
+	assert.Eventually(controller.readiness.serving, time.Second, 5*time.Millisecond)
+	resp = send()
+	assert.Equal(http.StatusOK, resp.StatusCode())
+	status = controller.Status().ObjectStatus.(map[string]interface{})["readiness"].(*ReadinessStatus)
+	assert.Equal(readinessReady, status.State)
+	assert.Len(status.Transitions, 1)
+}
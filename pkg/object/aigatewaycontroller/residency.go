@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+)
+
+const (
+	// ResidencyActionReject rejects the requests addressing providers out
+	// of the region of their consumers, it is the default.
+	ResidencyActionReject = "reject"
+	// ResidencyActionReroute sends the requests addressing providers out
+	// of the region of their consumers to the alternatives in the region.
+	ResidencyActionReroute = "reroute"
+
+	errCodeResidencyViolation = "data_residency_violation"
+
+	// stages of the residency enforcement, they are the values of the
+	// stage label of the metric.
+	residencyStageRouting   = "routing"
+	residencyStageFallback  = "fallback"
+	residencyStageUsageSink = "usageSink"
+	residencyStageCorpus    = "corpus"
+)
+
+// errNotResident means no provider in the region of the consumer serves
+// the request.
+var errNotResident = errors.New("no provider in the region of the consumer")
+
+type (
+	// ResidencySpec decides how the requests of the consumers pinned to a
+	// region are handled if they address providers out of the region. The
+	// members of provider groups out of the region are never picked, and
+	// the requests and usage events never leave the region whatever the
+	// action is.
+	ResidencySpec struct {
+		Action string `json:"action,omitempty" jsonschema:"enum=,enum=reject,enum=reroute"`
+		// Reroutes are the alternatives of the providers for the reroute
+		// action, the requests to providers without alternatives in the
+		// region are rejected.
+		Reroutes []*ResidencyRerouteSpec `json:"reroutes,omitempty"`
+	}
+
+	// ResidencyRerouteSpec is the alternatives of a provider.
+	ResidencyRerouteSpec struct {
+		Provider string `json:"provider" jsonschema:"required"`
+		// Alternatives are providers or provider groups, the first one
+		// with a provider in the region of the consumer serves the request.
+		Alternatives []string `json:"alternatives" jsonschema:"required"`
+	}
+
+	// residency enforces the regions of consumers.
+	residency struct {
+		spec         *ResidencySpec
+		enforcements *prometheus.CounterVec
+	}
+)
+
+func validateResidencySpec(spec *ResidencySpec, effective []*aicontext.ProviderSpec, groups []*ProviderGroupSpec) error {
+	if spec == nil {
+		return nil
+	}
+	switch spec.Action {
+	case "", ResidencyActionReject, ResidencyActionReroute:
+	default:
+		return fmt.Errorf("invalid action %s", spec.Action)
+	}
+	names := map[string]struct{}{}
+	for _, p := range effective {
+		names[p.Name] = struct{}{}
+	}
+	for _, g := range groups {
+		names[g.Name] = struct{}{}
+	}
+	for i, r := range spec.Reroutes {
+		if !slices.ContainsFunc(effective, func(p *aicontext.ProviderSpec) bool { return p.Name == r.Provider }) {
+			return fmt.Errorf("reroutes[%d]: provider %s not found", i, r.Provider)
+		}
+		if len(r.Alternatives) == 0 {
+			return fmt.Errorf("reroutes[%d]: no alternatives", i)
+		}
+		for _, alt := range r.Alternatives {
+			if _, ok := names[alt]; !ok {
+				return fmt.Errorf("reroutes[%d]: alternative %s not found", i, alt)
+			}
+		}
+	}
+	return nil
+}
+
+func newResidency(spec *ResidencySpec) *residency {
+	return &residency{
+		spec:         spec,
+		enforcements: metricshub.ResidencyEnforcements.NewCounter(),
+	}
+}
+
+// alternatives returns the alternatives of the provider for the reroute
+// action, nil if the action is reject.
+func (r *residency) alternatives(provider string) []string {
+	if r == nil || r.spec == nil || r.spec.Action != ResidencyActionReroute {
+		return nil
+	}
+	for _, reroute := range r.spec.Reroutes {
+		if reroute.Provider == provider {
+			return reroute.Alternatives
+		}
+	}
+	return nil
+}
+
+func (r *residency) record(region, stage, action string) {
+	if r == nil {
+		return
+	}
+	r.enforcements.WithLabelValues(region, stage, action).Inc()
+}
+
+// residentProvider returns the provider serving a request to the name of
+// a provider or a provider group for a consumer in the region. It is the
+// only way providers are selected for requests, and it never returns a
+// provider out of the region, so routing and fallbacks are kept in the
+// region by construction. Any provider is allowed if the region is empty.
+func (agc *AIGatewayController) residentProvider(set *providerSet, name, region, stage string) (providers.Provider, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty provider name")
+	}
+	resolved := agc.resolveProviderName(set, name, region)
+	if resolved == "" {
+		agc.residency.record(region, stage, "rejected")
+		return nil, fmt.Errorf("%w: provider group %s has no member in region %s", errNotResident, name, region)
+	}
+	provider, ok := set.providers[resolved]
+	if !ok {
+		return nil, fmt.Errorf("provider %s not found", resolved)
+	}
+	if aicontext.Resident(region, provider.Spec().Region) {
+		return provider, nil
+	}
+
+	for _, alt := range agc.residency.alternatives(resolved) {
+		// the alternatives are not rerouted again.
+		p, ok := set.providers[agc.resolveProviderName(set, alt, region)]
+		if ok && aicontext.Resident(region, p.Spec().Region) {
+			agc.residency.record(region, stage, "rerouted")
+			return p, nil
+		}
+	}
+	agc.residency.record(region, stage, "rejected")
+	return nil, fmt.Errorf("%w: provider %s is not in region %s", errNotResident, resolved, region)
+}
+
+// consumerRegion returns the region of the consumer of the request, which
+// is set by authenticateConsumer.
+func (agc *AIGatewayController) consumerRegion(ctx *context.Context) string {
+	if consumer := aicontext.ConsumerOf(ctx); consumer != nil {
+		return consumer.Region
+	}
+	return ""
+}
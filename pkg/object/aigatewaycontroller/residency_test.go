@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/consumers"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+)
+
+func TestValidateResidencySpec(t *testing.T) {
+	assert := assert.New(t)
+
+	providers := []*aicontext.ProviderSpec{{Name: "us"}, {Name: "eu"}}
+	groups := []*ProviderGroupSpec{{Name: "chat"}}
+	assert.NoError(validateResidencySpec(nil, providers, groups))
+	assert.NoError(validateResidencySpec(&ResidencySpec{
+		Action:   ResidencyActionReroute,
+		Reroutes: []*ResidencyRerouteSpec{{Provider: "us", Alternatives: []string{"eu", "chat"}}},
+	}, providers, groups))
+	assert.Error(validateResidencySpec(&ResidencySpec{Action: "drop"}, providers, groups))
+	assert.Error(validateResidencySpec(&ResidencySpec{Reroutes: []*ResidencyRerouteSpec{{Provider: "chat", Alternatives: []string{"eu"}}}}, providers, groups))
+	assert.Error(validateResidencySpec(&ResidencySpec{Reroutes: []*ResidencyRerouteSpec{{Provider: "us"}}}, providers, groups))
+	assert.Error(validateResidencySpec(&ResidencySpec{Reroutes: []*ResidencyRerouteSpec{{Provider: "us", Alternatives: []string{"apac"}}}}, providers, groups))
+
+	assert.True(aicontext.Resident("", "us"))
+	assert.True(aicontext.Resident("eu", "eu"))
+	assert.False(aicontext.Resident("eu", "us"))
+	// a consumer pinned to a region never goes to unlabeled targets.
+	assert.False(aicontext.Resident("eu", ""))
+}
+
+func TestResidency(t *testing.T) {
+	assert := assert.New(t)
+
+	// eu2 responds empty content, which fails the response validator.
+	hits := map[string]*atomic.Int32{}
+	servers := map[string]*httptest.Server{}
+	for _, name := range []string{"us", "eu1", "eu2"} {
+		counter := &atomic.Int32{}
+		hits[name] = counter
+		content := "Hello from " + name
+		if name == "eu2" {
+			content = ""
+		}
+		servers[name] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counter.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"choices": []any{map[string]any{
+					"index":   0,
+					"message": map[string]any{"role": "assistant", "content": content},
+				}},
+				"usage": map[string]any{"prompt_tokens": 5, "completion_tokens": 3, "total_tokens": 8},
+			})
+		}))
+		defer servers[name].Close()
+	}
+
+	newController := func(action string) *AIGatewayController {
+		config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: us
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+  region: us
+- name: eu1
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+  region: eu
+- name: eu2
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+  region: eu
+providerGroups:
+- name: chat
+  members:
+  - provider: us
+    weight: 100
+  - provider: eu1
+- name: usonly
+  members:
+  - provider: us
+responseValidators:
+- models: ["gpt-*"]
+  fallback: chat
+  checks:
+  - type: nonEmpty
+    action: fallback
+consumers:
+  required: true
+residency:
+  action: %s
+  reroutes:
+  - provider: us
+    alternatives: [usonly, eu1]
+`, servers["us"].URL, servers["eu1"].URL, servers["eu2"].URL, action)
+		super := supervisor.NewMock(option.New(), newMapCluster(), nil, nil, false, nil, nil)
+		spec, err := super.NewSpec(config)
+		assert.Nil(err)
+		controller := &AIGatewayController{}
+		controller.Init(spec)
+		return controller
+	}
+	createKey := func(controller *AIGatewayController, name, region string) string {
+		resp, err := controller.consumers.Create(&consumers.CreateRequest{Name: name, Region: region}, "admin", time.Now())
+		assert.Nil(err)
+		return resp.Key
+	}
+	send := func(controller *AIGatewayController, key, provider string) (*httpprot.Response, string) {
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`)))
+		assert.Nil(err)
+		req.Header.Set("Authorization", "Bearer "+key)
+		// the region sent by clients is never trusted.
+		req.Header.Set("X-Consumer-Region", "us")
+		setRequest(t, ctx, "residency", req)
+		controller.Handle(ctx, provider, nil)
+		resp := ctx.GetResponse("residency").(*httpprot.Response)
+		data, err := io.ReadAll(resp.GetPayload())
+		assert.Nil(err)
+		ctx.Finish()
+		return resp, string(data)
+	}
+	reset := func() {
+		for _, h := range hits {
+			h.Store(0)
+		}
+	}
+
+	{
+		controller := newController(ResidencyActionReject)
+		eu := createKey(controller, "anna", "eu")
+		free := createKey(controller, "bob", "")
+
+		// the members of a group out of the region are never picked.
+		reset()
+		for i := 0; i < 20; i++ {
+			resp, body := send(controller, eu, "chat")
+			assert.Equal(http.StatusOK, resp.StatusCode())
+			assert.Contains(body, "Hello from eu1")
+		}
+		assert.Zero(hits["us"].Load())
+
+		// no member of the group is in the region.
+		reset()
+		resp, body := send(controller, eu, "usonly")
+		assert.Equal(http.StatusForbidden, resp.StatusCode())
+		assert.Contains(body, errCodeResidencyViolation)
+		assert.Zero(hits["us"].Load())
+
+		// the provider out of the region is rejected.
+		resp, _ = send(controller, eu, "us")
+		assert.Equal(http.StatusForbidden, resp.StatusCode())
+		assert.Zero(hits["us"].Load())
+
+		// the fallback is kept in the region, the group member out of the
+		// region is never picked, and the response passes with the warning.
+		reset()
+		resp, _ = send(controller, eu, "eu2")
+		assert.Equal(http.StatusOK, resp.StatusCode())
+		assert.Equal(int32(1), hits["eu2"].Load())
+		assert.Equal(int32(1), hits["eu1"].Load())
+		assert.Zero(hits["us"].Load())
+
+		// the consumers not pinned to a region are served by any provider.
+		reset()
+		resp, body = send(controller, free, "us")
+		assert.Equal(http.StatusOK, resp.StatusCode())
+		assert.Contains(body, "Hello from us")
+		controller.Close()
+	}
+
+	{
+		controller := newController(ResidencyActionReroute)
+		eu := createKey(controller, "anna", "eu")
+
+		// usonly has no member in the region, the request is rerouted to
+		// eu1 then.
+		reset()
+		resp, body := send(controller, eu, "us")
+		assert.Equal(http.StatusOK, resp.StatusCode())
+		assert.Contains(body, "Hello from eu1")
+		assert.Zero(hits["us"].Load())
+		controller.Close()
+	}
+}
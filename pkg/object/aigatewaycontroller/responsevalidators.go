@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+)
+
+func validateResponseValidators(specs []*middlewares.ResponseValidatorSpec, effective []*aicontext.ProviderSpec, groups []*ProviderGroupSpec) error {
+	if err := middlewares.ValidateResponseValidatorSpecs(specs); err != nil {
+		return err
+	}
+	for i, spec := range specs {
+		if spec.Fallback == "" {
+			continue
+		}
+		isProvider := slices.ContainsFunc(effective, func(p *aicontext.ProviderSpec) bool { return p.Name == spec.Fallback })
+		isGroup := slices.ContainsFunc(groups, func(g *ProviderGroupSpec) bool { return g.Name == spec.Fallback })
+		if !isProvider && !isGroup {
+			return fmt.Errorf("responseValidators[%d]: fallback %s not found", i, spec.Fallback)
+		}
+	}
+	return nil
+}
+
+func (agc *AIGatewayController) reloadResponseValidator(prev *AIGatewayController) string {
+	if len(agc.spec.ResponseValidators) > 0 {
+		agc.responseValidator = middlewares.NewResponseValidator(agc.spec.ResponseValidators)
+	}
+	return componentAction(prev != nil && prev.responseValidator != nil, agc.responseValidator != nil)
+}
+
+// validateResponse checks the response of the provider with the validator
+// of the model, and takes the action of the first failed check. The
+// response passed to the user with failed checks carries the warning
+// header, and it is not cached.
+func (agc *AIGatewayController) validateResponse(aiCtx *aicontext.Context, set *providerSet, provider providers.Provider) {
+	v := agc.responseValidator
+	if v == nil || aiCtx.IsStopped() {
+		return
+	}
+	spec := v.Validator(aiCtx.ReqInfo.Model)
+	if spec == nil {
+		return
+	}
+	if aiCtx.ReqInfo.Stream {
+		v.WatchStream(aiCtx, spec)
+		return
+	}
+
+	retries, fellBack := 0, false
+	for {
+		failures := v.Check(aiCtx, spec)
+		if len(failures) == 0 {
+			return
+		}
+
+		action := failures[0].Action
+		switch {
+		case action == middlewares.ResponseActionRetry && retries < spec.GetMaxRetries():
+			retries++
+		case action == middlewares.ResponseActionFallback && !fellBack:
+			// the fallback is kept in the region of the consumer.
+			fallback, err := agc.residentProvider(set, spec.Fallback, aiCtx.ConsumerRegion, residencyStageFallback)
+			if err != nil {
+				action = middlewares.ResponseActionWarn
+				break
+			}
+			fellBack = true
+			provider = fallback
+			aiCtx.Provider = fallback.Spec()
+		default:
+			action = middlewares.ResponseActionWarn
+		}
+		for _, f := range failures {
+			f.Action = action
+		}
+		v.Trigger(aiCtx.ReqInfo.Model, failures)
+
+		if action == middlewares.ResponseActionWarn {
+			checks := make([]string, len(failures))
+			for i, f := range failures {
+				checks[i] = f.Check
+			}
+			aiCtx.SetResponseCheckFailures(failures)
+			resp := aiCtx.GetResponse()
+			if resp.Header == nil {
+				resp.Header = http.Header{}
+			}
+			resp.Header.Set(middlewares.ResponseCheckWarningHeader, strings.Join(checks, ","))
+			return
+		}
+
+		aiCtx.Ctx.AddTag(fmt.Sprintf("responseValidator: %s to provider %s after failed %s check", action, aiCtx.Provider.Name, failures[0].Check))
+		provider.Handle(aiCtx)
+		if aiCtx.IsStopped() {
+			return
+		}
+	}
+}
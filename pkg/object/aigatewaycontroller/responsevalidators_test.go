@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseValidators(t *testing.T) {
+	assert := assert.New(t)
+
+	// the flaky provider responds empty content until it is called
+	// emptyTimes times, the stable provider always responds the content.
+	var flakyCalls, stableCalls atomic.Int32
+	emptyTimes := int32(0)
+	respond := func(w http.ResponseWriter, content string) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []any{map[string]any{
+				"index":   0,
+				"message": map[string]any{"role": "assistant", "content": content},
+			}},
+			"usage": map[string]any{"prompt_tokens": 5, "completion_tokens": 3, "total_tokens": 8},
+		})
+	}
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flakyCalls.Add(1) <= emptyTimes {
+			respond(w, "")
+			return
+		}
+		respond(w, "Hello from flaky")
+	}))
+	defer flaky.Close()
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stableCalls.Add(1)
+		respond(w, "Hello from stable")
+	}))
+	defer stable.Close()
+
+	newController := func(action string) *AIGatewayController {
+		config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: flaky
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+- name: stable
+  providerType: openai
+  baseURL: %s
+  apiKey: mock
+responseValidators:
+- models: ["gpt-*"]
+  maxRetries: 2
+  fallback: stable
+  checks:
+  - type: nonEmpty
+    action: %s
+`, flaky.URL, stable.URL, action)
+		super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+		spec, err := super.NewSpec(config)
+		assert.Nil(err)
+		controller := &AIGatewayController{}
+		controller.Init(spec)
+		return controller
+	}
+	handle := func(controller *AIGatewayController, model string) (*httpprot.Response, string) {
+		ctx := context.New(nil)
+		body := fmt.Sprintf(`{"model": %q, "messages": [{"role": "user", "content": "hi"}]}`, model)
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080/v1/chat/completions", bytes.NewReader([]byte(body)))
+		assert.Nil(err)
+		setRequest(t, ctx, "validator", req)
+		assert.Equal("", controller.Handle(ctx, "flaky", nil))
+		resp := ctx.GetResponse("validator").(*httpprot.Response)
+		data, err := io.ReadAll(resp.GetPayload())
+		assert.Nil(err)
+		ctx.Finish()
+		return resp, string(data)
+	}
+	reset := func(n int32) {
+		emptyTimes = n
+		flakyCalls.Store(0)
+		stableCalls.Store(0)
+	}
+
+	{
+		controller := newController("retry")
+
+		// the retry succeeds.
+		reset(1)
+		resp, body := handle(controller, "gpt-4o")
+		assert.Contains(body, "Hello from flaky")
+		assert.Empty(resp.HTTPHeader().Get("X-Response-Check-Warning"))
+		assert.Equal(int32(2), flakyCalls.Load())
+
+		// the retries are exhausted, the response passes with the warning.
+		reset(10)
+		resp, _ = handle(controller, "gpt-4o")
+		assert.Equal("nonEmpty", resp.HTTPHeader().Get("X-Response-Check-Warning"))
+		assert.Equal(int32(3), flakyCalls.Load())
+
+		// no validator matches the model.
+		reset(10)
+		resp, _ = handle(controller, "llama3")
+		assert.Empty(resp.HTTPHeader().Get("X-Response-Check-Warning"))
+		assert.Equal(int32(1), flakyCalls.Load())
+		controller.Close()
+	}
+
+	{
+		controller := newController("fallback")
+		reset(10)
+		resp, body := handle(controller, "gpt-4o")
+		assert.Contains(body, "Hello from stable")
+		assert.Empty(resp.HTTPHeader().Get("X-Response-Check-Warning"))
+		assert.Equal(int32(1), flakyCalls.Load())
+		assert.Equal(int32(1), stableCalls.Load())
+		controller.Close()
+	}
+
+	{
+		controller := newController("warn")
+		reset(10)
+		resp, body := handle(controller, "gpt-4o")
+		assert.True(strings.Contains(body, `"content":""`))
+		assert.Equal("nonEmpty", resp.HTTPHeader().Get("X-Response-Check-Warning"))
+		assert.Equal(int32(1), flakyCalls.Load())
+		controller.Close()
+	}
+}
+
+func TestValidateResponseValidators(t *testing.T) {
+	assert := assert.New(t)
+
+	config := `
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: openai
+  providerType: openai
+  baseURL: http://localhost:19876
+  apiKey: mock
+responseValidators:
+- fallback: %s
+  checks:
+  - type: nonEmpty
+    action: fallback
+`
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	_, err := super.NewSpec(fmt.Sprintf(config, "openai"))
+	assert.Nil(err)
+	_, err = super.NewSpec(fmt.Sprintf(config, "unknown"))
+	assert.ErrorContains(err, "fallback unknown not found")
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+// validateScope validates the scope of the vector databases, it cannot be
+// empty if the backend is shared, otherwise the controllers of different
+// environments would write into the same collections.
+func validateScope(scope string, sharedBackend bool) error {
+	if sharedBackend && scope == "" {
+		return fmt.Errorf("scope is required if the backend is shared")
+	}
+	return vecdbtypes.ValidateScope(scope)
+}
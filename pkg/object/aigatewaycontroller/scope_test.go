@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateScope(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateScope("", false))
+	assert.NoError(validateScope("dev", false))
+	assert.NoError(validateScope("staging2", true))
+	assert.Error(validateScope("", true))
+	assert.Error(validateScope("Dev", false))
+	assert.Error(validateScope("dev_1", false))
+	assert.Error(validateScope("averyveryverylongscope", false))
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	stdcontext "context"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/sessionstate"
+)
+
+const (
+	// sessionTokensField is the field of the session state counting the
+	// tokens spent by the session.
+	sessionTokensField = "tokens"
+
+	sessionUpdateTimeout = 2 * time.Second
+)
+
+// reloadSessions reuses the session store of the previous generation if
+// the Redis is not changed.
+func (agc *AIGatewayController) reloadSessions(prev *AIGatewayController) string {
+	var store *sessionstate.Store
+	if prev != nil {
+		store = prev.sessions
+	}
+	spec := agc.spec.SessionState
+	if store != nil && (spec == nil || spec.URL != prev.spec.SessionState.URL) {
+		store.Close()
+		store = nil
+		if spec == nil {
+			return componentClosed
+		}
+	}
+	if spec == nil {
+		return ""
+	}
+	if store != nil {
+		store.SetSpec(spec)
+		agc.sessions = store
+		return componentKept
+	}
+	store, err := sessionstate.New(spec)
+	if err != nil {
+		logger.Errorf("failed to create session store: %v", err)
+		return componentFailed
+	}
+	agc.sessions = store
+	if prev != nil && prev.sessions != nil {
+		return componentRecreated
+	}
+	return componentCreated
+}
+
+// attachSession sets the session of the request from its session header.
+func (agc *AIGatewayController) attachSession(aiCtx *aicontext.Context) {
+	if agc.sessions == nil {
+		return
+	}
+	aiCtx.Session = agc.sessions.Session(aiCtx.Req.HTTPHeader().Get(agc.sessions.SessionHeader()))
+}
+
+// recordSessionUsage adds the tokens of the request to the session.
+func (agc *AIGatewayController) recordSessionUsage(aiCtx *aicontext.Context, metric *metricshub.Metric) {
+	if aiCtx.Session == nil || metric == nil {
+		return
+	}
+	tokens := metric.InputTokens + metric.OutputTokens
+	if tokens == 0 {
+		return
+	}
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), sessionUpdateTimeout)
+	defer cancel()
+	if _, err := aiCtx.Session.Incr(ctx, sessionTokensField, tokens); err != nil {
+		logger.Warnf("failed to record the usage of session %s: %v", aiCtx.Session.ID(), err)
+	}
+}
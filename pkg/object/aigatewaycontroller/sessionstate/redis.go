@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sessionstate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+// redisBackend stores the fields of a session in a hash, the updates
+// watch the hash, so they fail if it is changed by others.
+type redisBackend struct {
+	client rueidis.Client
+}
+
+func newRedisBackend(url string) (*redisBackend, error) {
+	option, err := rueidis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+	}
+	client, err := rueidis.NewClient(option)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Redis client: %w", err)
+	}
+	return &redisBackend{client: client}, nil
+}
+
+func sessionKey(id string) string {
+	return "aisession:{" + id + "}"
+}
+
+func (b *redisBackend) Load(ctx context.Context, id string) (map[string]string, error) {
+	return b.client.Do(ctx, b.client.B().Hgetall().Key(sessionKey(id)).Build()).AsStrMap()
+}
+
+func (b *redisBackend) Update(ctx context.Context, id string, ttl time.Duration, fn func(fields map[string]string) (map[string]*string, error)) error {
+	key := sessionKey(id)
+	return b.client.Dedicated(func(dc rueidis.DedicatedClient) error {
+		if err := dc.Do(ctx, dc.B().Watch().Key(key).Build()).Error(); err != nil {
+			return err
+		}
+		fields, err := dc.Do(ctx, dc.B().Hgetall().Key(key).Build()).AsStrMap()
+		if err != nil {
+			dc.Do(ctx, dc.B().Unwatch().Build())
+			return err
+		}
+		changes, err := fn(fields)
+		if err != nil || len(changes) == 0 {
+			dc.Do(ctx, dc.B().Unwatch().Build())
+			return err
+		}
+
+		set := dc.B().Hset().Key(key).FieldValue()
+		deleted := []string{}
+		for field, value := range changes {
+			if value == nil {
+				deleted = append(deleted, field)
+			} else {
+				set = set.FieldValue(field, *value)
+			}
+		}
+		commands := rueidis.Commands{dc.B().Multi().Build()}
+		if len(deleted) < len(changes) {
+			commands = append(commands, set.Build())
+		}
+		if len(deleted) > 0 {
+			commands = append(commands, dc.B().Hdel().Key(key).Field(deleted...).Build())
+		}
+		commands = append(commands,
+			dc.B().Pexpire().Key(key).Milliseconds(ttl.Milliseconds()).Build(),
+			dc.B().Exec().Build(),
+		)
+
+		resps := dc.DoMulti(ctx, commands...)
+		results, err := resps[len(resps)-1].ToArray()
+		if rueidis.IsRedisNil(err) {
+			return errVersionConflict
+		}
+		if err != nil {
+			// the errors of queuing the commands are more helpful.
+			for _, resp := range resps[:len(resps)-1] {
+				if err := resp.Error(); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+		for _, result := range results {
+			if err := result.Error(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *redisBackend) Close() {
+	b.client.Close()
+}
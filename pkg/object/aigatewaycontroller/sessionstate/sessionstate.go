@@ -0,0 +1,400 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sessionstate stores small states of conversations in Redis, so
+// the middlewares share them across the requests of a conversation and
+// across gateway members.
+package sessionstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTTL           = 24 * time.Hour
+	defaultSessionHeader = "X-Session-Id"
+	defaultMaxFields     = 64
+	defaultMaxBytes      = 16 << 10
+	minTTL               = time.Minute
+	maxTTL               = 30 * 24 * time.Hour
+	// maxSessionIDLength bounds the session IDs, requests with longer IDs
+	// have no session.
+	maxSessionIDLength = 256
+	// maxUpdateAttempts bounds the attempts of an update conflicting with
+	// the updates of others.
+	maxUpdateAttempts = 8
+	updateBackoff     = 5 * time.Millisecond
+)
+
+var (
+	// ErrTooLarge is returned if an update makes the session exceed its
+	// size caps, the update is discarded.
+	ErrTooLarge = errors.New("session state is too large")
+	// ErrConflict is returned if an update keeps conflicting with the
+	// updates of others.
+	ErrConflict = errors.New("session state is updated concurrently")
+
+	// errVersionConflict is returned by backends if the session is
+	// changed by others during an update.
+	errVersionConflict = errors.New("session state is changed")
+)
+
+type (
+	// Spec describes the store of session states.
+	Spec struct {
+		// URL is the URL of the Redis storing the session states.
+		URL string `json:"url" jsonschema:"required"`
+		// SessionHeader is the request header carrying the session ID.
+		SessionHeader string `json:"sessionHeader,omitempty"`
+		// TTL is how long a session is kept after its last update.
+		TTL string `json:"ttl,omitempty" jsonschema:"format=duration"`
+		// MaxFields and MaxBytes cap the number of fields and the total
+		// size of the fields and their values of a session.
+		MaxFields int `json:"maxFields,omitempty"`
+		MaxBytes  int `json:"maxBytes,omitempty"`
+	}
+
+	// Backend stores the fields of the sessions.
+	Backend interface {
+		// Load returns the fields of the session.
+		Load(ctx context.Context, id string) (map[string]string, error)
+		// Update calls fn with the fields of the session, and applies the
+		// changes fn returns, where deleted fields have nil values. The
+		// changes are discarded and errVersionConflict is returned if the
+		// session is changed by others in between. The session expires
+		// ttl after the update.
+		Update(ctx context.Context, id string, ttl time.Duration, fn func(fields map[string]string) (map[string]*string, error)) error
+		Close()
+	}
+
+	// Store stores the session states.
+	Store struct {
+		backend  Backend
+		settings atomic.Pointer[settings]
+	}
+
+	settings struct {
+		ttl           time.Duration
+		sessionHeader string
+		maxFields     int
+		maxBytes      int
+	}
+
+	// Session is the state of a session. Reads are served from a snapshot
+	// loaded at the first read, and updated by the writes of the session,
+	// so a request sees a consistent state. Writes are applied to the
+	// latest state with optimistic concurrency.
+	Session struct {
+		store    *Store
+		id       string
+		lock     sync.Mutex
+		snapshot map[string]string
+	}
+)
+
+// ValidateSpec validates the spec of the session store.
+func ValidateSpec(spec *Spec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if spec.TTL != "" {
+		ttl, err := time.ParseDuration(spec.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid ttl: %w", err)
+		}
+		if ttl < minTTL || ttl > maxTTL {
+			return fmt.Errorf("ttl must be between %s and %s", minTTL, maxTTL)
+		}
+	}
+	if spec.MaxFields < 0 || spec.MaxBytes < 0 {
+		return fmt.Errorf("maxFields and maxBytes cannot be negative")
+	}
+	return nil
+}
+
+// New creates a Store storing the session states in the Redis of the spec.
+func New(spec *Spec) (*Store, error) {
+	backend, err := newRedisBackend(spec.URL)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithBackend(spec, backend), nil
+}
+
+// NewWithBackend creates a Store storing the session states in the
+// backend.
+func NewWithBackend(spec *Spec, backend Backend) *Store {
+	s := &Store{backend: backend}
+	s.SetSpec(spec)
+	return s
+}
+
+// SetSpec updates the settings of the store, the URL is not changed.
+func (s *Store) SetSpec(spec *Spec) {
+	st := &settings{
+		ttl:           defaultTTL,
+		sessionHeader: spec.SessionHeader,
+		maxFields:     spec.MaxFields,
+		maxBytes:      spec.MaxBytes,
+	}
+	if spec.TTL != "" {
+		st.ttl, _ = time.ParseDuration(spec.TTL)
+	}
+	if st.sessionHeader == "" {
+		st.sessionHeader = defaultSessionHeader
+	}
+	if st.maxFields == 0 {
+		st.maxFields = defaultMaxFields
+	}
+	if st.maxBytes == 0 {
+		st.maxBytes = defaultMaxBytes
+	}
+	s.settings.Store(st)
+}
+
+// SessionHeader returns the request header carrying the session ID.
+func (s *Store) SessionHeader() string {
+	return s.settings.Load().sessionHeader
+}
+
+// Close closes the backend.
+func (s *Store) Close() {
+	s.backend.Close()
+}
+
+// Session returns the session of the ID, it is nil if the store is nil or
+// the ID is invalid.
+func (s *Store) Session(id string) *Session {
+	if s == nil || id == "" || len(id) > maxSessionIDLength {
+		return nil
+	}
+	return &Session{store: s, id: id}
+}
+
+// update applies fn to a copy of the fields of the session, and writes
+// the changes. It is retried if the session is changed by others, so fn
+// may be called more than once.
+func (s *Store) update(ctx context.Context, id string, fn func(fields map[string]string) error) (map[string]string, error) {
+	st := s.settings.Load()
+	var result map[string]string
+	apply := func(fields map[string]string) (map[string]*string, error) {
+		updated := maps.Clone(fields)
+		if updated == nil {
+			updated = map[string]string{}
+		}
+		if err := fn(updated); err != nil {
+			return nil, err
+		}
+		if err := st.checkSize(updated); err != nil {
+			return nil, err
+		}
+		changes := map[string]*string{}
+		for field, value := range updated {
+			if old, ok := fields[field]; !ok || old != value {
+				changes[field] = &value
+			}
+		}
+		for field := range fields {
+			if _, ok := updated[field]; !ok {
+				changes[field] = nil
+			}
+		}
+		result = updated
+		return changes, nil
+	}
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		err := s.backend.Update(ctx, id, st.ttl, apply)
+		if !errors.Is(err, errVersionConflict) {
+			return result, err
+		}
+		backoff := updateBackoff << attempt
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff)))):
+		}
+	}
+	return nil, ErrConflict
+}
+
+func (st *settings) checkSize(fields map[string]string) error {
+	if len(fields) > st.maxFields {
+		return fmt.Errorf("%w: %d fields, the limit is %d", ErrTooLarge, len(fields), st.maxFields)
+	}
+	size := 0
+	for field, value := range fields {
+		size += len(field) + len(value)
+	}
+	if size > st.maxBytes {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, size, st.maxBytes)
+	}
+	return nil
+}
+
+// ID returns the ID of the session.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// load returns the snapshot of the session, it is loaded at the first call.
+func (s *Session) load(ctx context.Context) (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.snapshot != nil {
+		return s.snapshot, nil
+	}
+	fields, err := s.store.backend.Load(ctx, s.id)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	s.snapshot = fields
+	return fields, nil
+}
+
+// Get returns the value of the field.
+func (s *Session) Get(ctx context.Context, field string) (string, bool, error) {
+	fields, err := s.load(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := fields[field]
+	return value, ok, nil
+}
+
+// GetInt returns the integer value of the field.
+func (s *Session) GetInt(ctx context.Context, field string) (int64, bool, error) {
+	value, ok, err := s.Get(ctx, field)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("field %s is not an integer: %w", field, err)
+	}
+	return n, true, nil
+}
+
+// GetJSON unmarshals the JSON value of the field into v.
+func (s *Session) GetJSON(ctx context.Context, field string, v any) (bool, error) {
+	value, ok, err := s.Get(ctx, field)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return false, fmt.Errorf("field %s is not valid JSON: %w", field, err)
+	}
+	return true, nil
+}
+
+// Update applies fn to the fields of the session with optimistic
+// concurrency, fn is called again with the latest fields if the session
+// is changed by others, so it should not have side effects. The changes
+// are discarded if fn returns an error or they exceed the size caps.
+func (s *Session) Update(ctx context.Context, fn func(fields map[string]string) error) error {
+	fields, err := s.store.update(ctx, s.id, fn)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.snapshot = fields
+	s.lock.Unlock()
+	return nil
+}
+
+// Set sets the value of the field.
+func (s *Session) Set(ctx context.Context, field, value string) error {
+	return s.Update(ctx, func(fields map[string]string) error {
+		fields[field] = value
+		return nil
+	})
+}
+
+// SetInt sets the integer value of the field.
+func (s *Session) SetInt(ctx context.Context, field string, value int64) error {
+	return s.Set(ctx, field, strconv.FormatInt(value, 10))
+}
+
+// SetJSON sets the value of the field to the JSON of v.
+func (s *Session) SetJSON(ctx context.Context, field string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Set(ctx, field, string(data))
+}
+
+// SetIfAbsent sets the value of the field if it is not set, and returns
+// the value of the field, so concurrent requests of a session agree on
+// the value set first, like the provider pinned or the variant assigned.
+func (s *Session) SetIfAbsent(ctx context.Context, field, value string) (string, error) {
+	result := value
+	err := s.Update(ctx, func(fields map[string]string) error {
+		if old, ok := fields[field]; ok {
+			result = old
+			return nil
+		}
+		result = value
+		fields[field] = value
+		return nil
+	})
+	return result, err
+}
+
+// Incr adds delta to the integer value of the field, and returns the new
+// value. A missing field is 0.
+func (s *Session) Incr(ctx context.Context, field string, delta int64) (int64, error) {
+	var result int64
+	err := s.Update(ctx, func(fields map[string]string) error {
+		var n int64
+		if value, ok := fields[field]; ok {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("field %s is not an integer: %w", field, err)
+			}
+		}
+		result = n + delta
+		fields[field] = strconv.FormatInt(result, 10)
+		return nil
+	})
+	return result, err
+}
+
+// Delete deletes the fields.
+func (s *Session) Delete(ctx context.Context, fields ...string) error {
+	return s.Update(ctx, func(current map[string]string) error {
+		for _, field := range fields {
+			delete(current, field)
+		}
+		return nil
+	})
+}
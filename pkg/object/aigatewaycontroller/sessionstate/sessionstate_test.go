@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sessionstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryBackend works like the Redis backend, the session is read and
+// written without holding the lock, and the write fails if the session
+// is changed in between.
+type memoryBackend struct {
+	lock      sync.Mutex
+	sessions  map[string]map[string]string
+	versions  map[string]int
+	ttls      map[string]time.Duration
+	conflicts int
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		sessions: map[string]map[string]string{},
+		versions: map[string]int{},
+		ttls:     map[string]time.Duration{},
+	}
+}
+
+func (b *memoryBackend) Load(ctx context.Context, id string) (map[string]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return maps.Clone(b.sessions[id]), nil
+}
+
+func (b *memoryBackend) Update(ctx context.Context, id string, ttl time.Duration, fn func(fields map[string]string) (map[string]*string, error)) error {
+	b.lock.Lock()
+	fields, version := maps.Clone(b.sessions[id]), b.versions[id]
+	b.lock.Unlock()
+
+	changes, err := fn(fields)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	// yield, so the concurrent updates interleave.
+	time.Sleep(time.Millisecond)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.versions[id] != version {
+		b.conflicts++
+		return errVersionConflict
+	}
+	if b.sessions[id] == nil {
+		b.sessions[id] = map[string]string{}
+	}
+	for field, value := range changes {
+		if value == nil {
+			delete(b.sessions[id], field)
+		} else {
+			b.sessions[id][field] = *value
+		}
+	}
+	b.versions[id]++
+	b.ttls[id] = ttl
+	return nil
+}
+
+func (b *memoryBackend) Close() {}
+
+func TestValidateSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateSpec(nil))
+	assert.NoError(ValidateSpec(&Spec{URL: "redis://localhost:6379", TTL: "1h"}))
+	assert.Error(ValidateSpec(&Spec{}))
+	assert.Error(ValidateSpec(&Spec{URL: "redis://localhost:6379", TTL: "1s"}))
+	assert.Error(ValidateSpec(&Spec{URL: "redis://localhost:6379", TTL: "1000h"}))
+	assert.Error(ValidateSpec(&Spec{URL: "redis://localhost:6379", TTL: "x"}))
+	assert.Error(ValidateSpec(&Spec{URL: "redis://localhost:6379", MaxFields: -1}))
+}
+
+func TestSession(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	backend := newMemoryBackend()
+	store := NewWithBackend(&Spec{TTL: "1h"}, backend)
+	assert.Equal(defaultSessionHeader, store.SessionHeader())
+	assert.Nil(store.Session(""))
+	assert.Nil(store.Session(strings.Repeat("a", maxSessionIDLength+1)))
+	assert.Nil((*Store)(nil).Session("s1"))
+
+	session := store.Session("s1")
+	_, ok, err := session.Get(ctx, "provider")
+	assert.NoError(err)
+	assert.False(ok)
+
+	assert.NoError(session.Set(ctx, "provider", "openai"))
+	assert.NoError(session.SetInt(ctx, "turns", 3))
+	assert.NoError(session.SetJSON(ctx, "variant", map[string]string{"name": "b"}))
+	assert.Equal(time.Hour, backend.ttls["s1"])
+
+	// a new request of the session sees the fields.
+	session = store.Session("s1")
+	value, ok, err := session.Get(ctx, "provider")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal("openai", value)
+	turns, ok, err := session.GetInt(ctx, "turns")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(int64(3), turns)
+	variant := map[string]string{}
+	ok, err = session.GetJSON(ctx, "variant", &variant)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal("b", variant["name"])
+	_, _, err = session.GetInt(ctx, "provider")
+	assert.Error(err)
+
+	n, err := session.Incr(ctx, "turns", 2)
+	assert.NoError(err)
+	assert.Equal(int64(5), n)
+	_, err = session.Incr(ctx, "provider", 1)
+	assert.Error(err)
+
+	// the first value set wins.
+	winner, err := session.SetIfAbsent(ctx, "pinned", "anthropic")
+	assert.NoError(err)
+	assert.Equal("anthropic", winner)
+	winner, err = store.Session("s1").SetIfAbsent(ctx, "pinned", "openai")
+	assert.NoError(err)
+	assert.Equal("anthropic", winner)
+
+	assert.NoError(session.Delete(ctx, "pinned", "variant"))
+	_, ok, _ = store.Session("s1").Get(ctx, "pinned")
+	assert.False(ok)
+	_, ok, _ = store.Session("s2").Get(ctx, "provider")
+	assert.False(ok)
+}
+
+func TestSessionSizeCaps(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	backend := newMemoryBackend()
+	store := NewWithBackend(&Spec{MaxFields: 2, MaxBytes: 32}, backend)
+	session := store.Session("s1")
+
+	assert.NoError(session.Set(ctx, "a", "1"))
+	assert.NoError(session.Set(ctx, "b", "2"))
+	err := session.Set(ctx, "c", "3")
+	assert.True(errors.Is(err, ErrTooLarge))
+	err = session.Set(ctx, "a", strings.Repeat("x", 32))
+	assert.True(errors.Is(err, ErrTooLarge))
+
+	// the rejected updates are not written.
+	assert.Equal(map[string]string{"a": "1", "b": "2"}, backend.sessions["s1"])
+
+	// replacing a field stays in the caps.
+	assert.NoError(session.Set(ctx, "b", "22"))
+	store.SetSpec(&Spec{MaxFields: 1})
+	assert.True(errors.Is(session.Set(ctx, "b", "3"), ErrTooLarge))
+	assert.NoError(session.Delete(ctx, "b"))
+}
+
+func TestSessionConcurrentIncr(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// the stores are the controllers of different members sharing the
+	// Redis.
+	backend := newMemoryBackend()
+	stores := []*Store{
+		NewWithBackend(&Spec{}, backend),
+		NewWithBackend(&Spec{}, backend),
+	}
+
+	const requests = 20
+	wg := sync.WaitGroup{}
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session := stores[i%len(stores)].Session("s1")
+			_, err := session.Incr(ctx, "tokens", 10)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			assert.True(errors.Is(err, ErrConflict), fmt.Sprint(err))
+			failed++
+		}
+	}
+	assert.Greater(backend.conflicts, 0)
+	tokens, _, err := stores[0].Session("s1").GetInt(ctx, "tokens")
+	assert.NoError(err)
+	// no increment is lost, the failed ones are reported.
+	assert.Equal(int64(10*(requests-failed)), tokens)
+}
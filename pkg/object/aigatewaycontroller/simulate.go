@@ -0,0 +1,547 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/consumers"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/providers"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	// SimulationProxied means the simulated request reaches the provider.
+	SimulationProxied = "proxied"
+	// SimulationRejected means the simulated request is rejected by the
+	// gateway.
+	SimulationRejected = "rejected"
+
+	// simulatedCharsPerToken is the characters of the simulated prompt
+	// per token, it is the usual ratio of English text.
+	simulatedCharsPerToken = 4
+	// maxSimulatedPromptTokens limits the size of the simulated prompt.
+	maxSimulatedPromptTokens = 1 << 20
+)
+
+type (
+	// SimulateRequest describes a hypothetical request to trace through
+	// the routing and the policies of the controller.
+	SimulateRequest struct {
+		// Provider is the provider or the provider group of the
+		// AIGatewayProxy filter, and Middlewares are its middlewares.
+		Provider    string   `json:"provider"`
+		Middlewares []string `json:"middlewares,omitempty"`
+		// Path is the endpoint of the request, default
+		// /v1/chat/completions.
+		Path string `json:"path,omitempty"`
+		// Consumer is the name of the consumer sending the request, it is
+		// looked up in the consumer keys instead of authenticating a key.
+		Consumer string            `json:"consumer,omitempty"`
+		Model    string            `json:"model,omitempty"`
+		Stream   bool              `json:"stream,omitempty"`
+		Headers  map[string]string `json:"headers,omitempty"`
+		// PromptTokens is the approximate size of the prompt.
+		PromptTokens int `json:"promptTokens,omitempty"`
+	}
+
+	// SimulateResponse is the decision trace of a simulated request.
+	SimulateResponse struct {
+		// Outcome is proxied or rejected.
+		Outcome string `json:"outcome"`
+		// Provider is the provider the request is sent to.
+		Provider string                        `json:"provider,omitempty"`
+		Steps    []*middlewares.SimulationStep `json:"steps"`
+	}
+
+	// simulation is a simulated request, it stops at the first step
+	// rejecting the request.
+	simulation struct {
+		resp *SimulateResponse
+		ctx  *context.Context
+		req  *httpprot.Request
+	}
+)
+
+// validateSimulateRequest validates the request and sets the defaults.
+func validateSimulateRequest(req *SimulateRequest) error {
+	if req.Provider == "" {
+		return fmt.Errorf("provider is required")
+	}
+	if req.Path == "" {
+		req.Path = string(aicontext.ResponseTypeChatCompletions)
+	}
+	if req.PromptTokens < 0 || req.PromptTokens > maxSimulatedPromptTokens {
+		return fmt.Errorf("promptTokens must be between 0 and %d", maxSimulatedPromptTokens)
+	}
+	return nil
+}
+
+// newSimulation creates the synthetic request of the simulation, its
+// prompt is a single user message of the approximate size.
+func newSimulation(req *SimulateRequest) (*simulation, error) {
+	method, respType, body := http.MethodPost, aicontext.ResponseType(""), []byte(nil)
+	if ep := findSupportedEndpoint(req.Path); ep != nil {
+		method, respType = ep.method, ep.respType
+	}
+	if method == http.MethodPost {
+		prompt := strings.Repeat("x", req.PromptTokens*simulatedCharsPerToken)
+		content := map[string]any{"model": req.Model}
+		switch respType {
+		case aicontext.ResponseTypeCompletions:
+			content["prompt"], content["stream"] = prompt, req.Stream
+		case aicontext.ResponseTypeModerations:
+			content["input"] = prompt
+		default:
+			content["stream"] = req.Stream
+			content["messages"] = []map[string]any{{"role": "user", "content": prompt}}
+		}
+		var err error
+		if body, err = codectool.MarshalJSON(content); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, egReq, err := newSyntheticRequest(method, req.Path, req.Headers, body)
+	if err != nil {
+		return nil, err
+	}
+	return &simulation{
+		resp: &SimulateResponse{Outcome: SimulationProxied, Steps: []*middlewares.SimulationStep{}},
+		ctx:  ctx,
+		req:  egReq,
+	}, nil
+}
+
+// newSyntheticRequest creates the context of a request made up by the
+// admin API.
+func newSyntheticRequest(method, path string, headers map[string]string, body []byte) (*context.Context, *httpprot.Request, error) {
+	stdReq, err := http.NewRequest(method, "http://localhost"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	stdReq.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		stdReq.Header.Set(k, v)
+	}
+	egReq, err := httpprot.NewRequest(stdReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := egReq.FetchPayload(0); err != nil {
+		return nil, nil, err
+	}
+	ctx := context.New(nil)
+	ctx.SetRequest(context.DefaultNamespace, egReq)
+	ctx.UseNamespace(context.DefaultNamespace)
+	return ctx, egReq, nil
+}
+
+// add adds the step to the trace, and returns false if the step rejects
+// the request.
+func (s *simulation) add(name string, step *middlewares.SimulationStep) bool {
+	step.Step = name
+	s.resp.Steps = append(s.resp.Steps, step)
+	if step.Decision == middlewares.SimulationReject {
+		s.resp.Outcome = SimulationRejected
+		return false
+	}
+	return true
+}
+
+// simulate traces the request through the steps of Handle in read-only
+// mode. Nothing is counted by the rate limit or the metrics, and no
+// provider or vector database is called, the steps depending on them
+// are reported as unknown.
+func (agc *AIGatewayController) simulate(req *SimulateRequest, now time.Time) (*SimulateResponse, error) {
+	if err := validateSimulateRequest(req); err != nil {
+		return nil, err
+	}
+	if err := agc.ValidateMiddlewares(req.Middlewares); err != nil {
+		return nil, err
+	}
+	s, err := newSimulation(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create simulated request: %w", err)
+	}
+
+	if !s.add("readiness", agc.simulateReadiness()) ||
+		!s.add("endpoint", agc.simulateEndpoint(req.Path)) ||
+		!s.add("authentication", agc.simulateAuthentication(s.ctx, req.Consumer, now)) ||
+		!s.add("rateLimit", agc.simulateRateLimit(s.ctx, req.PromptTokens, now)) {
+		return s.resp, nil
+	}
+
+	set := agc.acquireProviders()
+	if set == nil {
+		return nil, fmt.Errorf("AIGatewayController is closed")
+	}
+	defer set.release()
+
+	providerName, step := agc.simulateRouting(req.Provider)
+	provider, ok := set.providers[providerName]
+	if !ok || providerName == "" {
+		step.Decision = middlewares.SimulationReject
+		step.Detail = fmt.Sprintf("provider %s not found", providerName)
+	}
+	if !s.add("routing", step) {
+		return s.resp, nil
+	}
+	s.resp.Provider = providerName
+	s.add("providerHealth", simulateProviderHealth(provider))
+
+	aiCtx, err := aicontext.New(s.ctx, provider.Spec())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AI context: %w", err)
+	}
+	if !s.add("capability", agc.simulateCapability(aiCtx)) {
+		return s.resp, nil
+	}
+	s.add("featureFlags", agc.simulateFeatureFlags(aiCtx))
+
+	states := agc.getMiddlewareStates()
+	for _, name := range req.Middlewares {
+		if !s.add("middleware/"+name, agc.simulateMiddleware(aiCtx, name, states[name])) {
+			return s.resp, nil
+		}
+	}
+
+	if aiCtx.RespType == aicontext.ResponseTypeModerations && agc.moderator != nil {
+		s.add("moderation", &middlewares.SimulationStep{
+			Decision: middlewares.SimulationUnknown,
+			Rules:    []string{"moderation"},
+			Detail:   "the request is served by the moderation backend, which is not called by simulations",
+		})
+		s.resp.Provider = ""
+		return s.resp, nil
+	}
+	s.add("responseValidator", agc.simulateResponseValidator(aiCtx))
+	return s.resp, nil
+}
+
+func (agc *AIGatewayController) simulateReadiness() *middlewares.SimulationStep {
+	if agc.readiness == nil {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationSkip, Detail: "readiness is not configured"}
+	}
+	step := &middlewares.SimulationStep{
+		Decision:     middlewares.SimulationPass,
+		Rules:        []string{"readiness"},
+		RuntimeState: map[string]string{"readiness.state": agc.readiness.status().State},
+	}
+	if !agc.readiness.serving() {
+		step.Decision = middlewares.SimulationReject
+		step.Detail = "AI gateway is not ready, waiting for its dependencies"
+	}
+	return step
+}
+
+func (agc *AIGatewayController) simulateEndpoint(path string) *middlewares.SimulationStep {
+	ep := findSupportedEndpoint(path)
+	if ep == nil {
+		return &middlewares.SimulationStep{
+			Decision: middlewares.SimulationReject,
+			Detail:   fmt.Sprintf("endpoint %s is not supported by the AI gateway", path),
+		}
+	}
+	step := &middlewares.SimulationStep{Decision: middlewares.SimulationPass}
+	if spec := agc.spec.Endpoints; spec != nil {
+		if slices.Contains(spec.Expose, string(ep.respType)) {
+			step.Rules = append(step.Rules, fmt.Sprintf("endpoints.expose[%s]", ep.respType))
+		}
+		if slices.Contains(spec.Reject, string(ep.respType)) {
+			step.Rules = append(step.Rules, fmt.Sprintf("endpoints.reject[%s]", ep.respType))
+		}
+	}
+	if !agc.endpoints.exposed[ep.respType] {
+		step.Decision = middlewares.SimulationReject
+		step.Detail = fmt.Sprintf("endpoint %s is not exposed", ep.respType)
+	}
+	return step
+}
+
+// simulateAuthentication sets the consumer like authenticateConsumer, the
+// consumer is looked up by name as the simulation has no key.
+func (agc *AIGatewayController) simulateAuthentication(ctx *context.Context, name string, now time.Time) *middlewares.SimulationStep {
+	registry := agc.consumers
+	if registry == nil {
+		return &middlewares.SimulationStep{
+			Decision: middlewares.SimulationSkip,
+			Detail:   "consumer keys are not configured, the headers of the request are used as is",
+		}
+	}
+	header := ctx.GetInputRequest().(*httpprot.Request).HTTPHeader()
+	header.Del(agc.spec.consumerIDHeader())
+	header.Del(registry.GroupHeader())
+	header.Del(registry.RegionHeader())
+	aicontext.SetConsumer(ctx, &aicontext.Consumer{})
+
+	reject := func(detail string) *middlewares.SimulationStep {
+		step := &middlewares.SimulationStep{Decision: middlewares.SimulationPass, Rules: []string{"consumers"}}
+		if registry.Required() {
+			step.Decision = middlewares.SimulationReject
+			step.Rules = []string{"consumers.required"}
+			step.Detail = detail
+		} else {
+			step.Detail = detail + ", the request is served without a consumer"
+		}
+		return step
+	}
+	if name == "" {
+		return reject("no consumer")
+	}
+	consumer, err := registry.Get(name)
+	if errors.Is(err, consumers.ErrConsumerNotFound) {
+		return reject(fmt.Sprintf("consumer %q not found", name))
+	}
+	if err != nil {
+		return &middlewares.SimulationStep{
+			Decision: middlewares.SimulationUnknown,
+			Detail:   fmt.Sprintf("failed to load consumer %q: %v", name, err),
+		}
+	}
+	if consumer.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, consumer.ExpiresAt)
+		if err != nil || !now.Before(expiresAt) {
+			return reject(fmt.Sprintf("the key of consumer %q is expired", name))
+		}
+	}
+
+	agc.setConsumer(ctx, registry, consumer)
+	step := &middlewares.SimulationStep{
+		Decision:     middlewares.SimulationPass,
+		Rules:        []string{"consumers"},
+		Detail:       fmt.Sprintf("consumer %q", consumer.Name),
+		RuntimeState: map[string]string{"consumer.group": consumer.Group},
+	}
+	if consumer.ExpiresAt != "" {
+		step.RuntimeState["consumer.expiresAt"] = consumer.ExpiresAt
+	}
+	return step
+}
+
+// simulateRateLimit checks the budget of the consumer without counting
+// the request.
+func (agc *AIGatewayController) simulateRateLimit(ctx *context.Context, promptTokens int, now time.Time) *middlewares.SimulationStep {
+	if agc.rateLimiter == nil {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationSkip, Detail: "rate limit is not configured"}
+	}
+	consumer := agc.consumerID(ctx)
+	state := agc.rateLimiter.peek(consumer, now)
+	step := &middlewares.SimulationStep{
+		Decision:     middlewares.SimulationPass,
+		Rules:        []string{"rateLimit"},
+		Detail:       fmt.Sprintf("consumer %q", consumer),
+		RuntimeState: map[string]string{},
+	}
+	if state.limitRequests > 0 {
+		step.RuntimeState["remainingRequests"] = strconv.FormatInt(state.remainingRequests, 10)
+		step.RuntimeState["resetRequests"] = formatReset(state.resetRequests)
+	}
+	if state.limitTokens > 0 {
+		step.RuntimeState["remainingTokens"] = strconv.FormatInt(state.remainingTokens, 10)
+		step.RuntimeState["resetTokens"] = formatReset(state.resetTokens)
+		// the tokens are counted after the request, so a request larger
+		// than the budget left is still admitted.
+		if int64(promptTokens) > state.remainingTokens && state.remainingTokens > 0 {
+			step.Detail += fmt.Sprintf(", the prompt exhausts the %d tokens left", state.remainingTokens)
+		}
+	}
+	if limitType := state.exceeded(); limitType != "" {
+		step.Decision = middlewares.SimulationReject
+		step.Detail = fmt.Sprintf("rate limit reached for %s of consumer %q, please try again in %s",
+			limitType, consumer, formatReset(state.retryAfter(limitType)))
+	}
+	return step
+}
+
+// simulateRouting resolves the provider like resolveProviderName, the
+// member of a group with the largest effective weight is selected, as
+// the member of a real request is picked randomly by the weights.
+func (agc *AIGatewayController) simulateRouting(name string) (string, *middlewares.SimulationStep) {
+	for _, g := range agc.spec.ProviderGroups {
+		if g.Name != name {
+			continue
+		}
+		weights, total, best := agc.groupWeights(g, nil)
+		if total > 0 {
+			for i, w := range weights {
+				if w > weights[best] {
+					best = i
+				}
+			}
+		}
+		step := &middlewares.SimulationStep{
+			Decision:     middlewares.SimulationSelect,
+			Rules:        []string{fmt.Sprintf("providerGroups[%s].members[%s]", g.Name, g.Members[best].Provider)},
+			RuntimeState: map[string]string{},
+		}
+		for i, m := range g.Members {
+			step.RuntimeState[fmt.Sprintf("latencySLO.weightFactor[%s]", m.Provider)] = strconv.FormatFloat(agc.latencySLO.weightFactor(m.Provider), 'f', -1, 64)
+			if total > 0 {
+				step.RuntimeState[fmt.Sprintf("share[%s]", m.Provider)] = fmt.Sprintf("%.1f%%", weights[i]/total*100)
+			}
+		}
+		if total > 0 {
+			step.Detail = fmt.Sprintf("provider %s of group %s has the largest share of requests", g.Members[best].Provider, g.Name)
+		} else {
+			step.Detail = fmt.Sprintf("all members of group %s are demoted, provider %s with the largest weight serves the requests", g.Name, g.Members[best].Provider)
+		}
+		return g.Members[best].Provider, step
+	}
+	return name, &middlewares.SimulationStep{
+		Decision: middlewares.SimulationSelect,
+		Rules:    []string{fmt.Sprintf("providers[%s]", name)},
+	}
+}
+
+// simulateProviderHealth reports the health of the endpoints of the
+// provider, the unhealthy endpoints are skipped unless all of them are.
+func simulateProviderHealth(provider providers.Provider) *middlewares.SimulationStep {
+	step := &middlewares.SimulationStep{
+		Decision:     middlewares.SimulationPass,
+		RuntimeState: map[string]string{},
+	}
+	healthy := 0
+	for _, h := range provider.EndpointHealth() {
+		step.RuntimeState[fmt.Sprintf("healthy[%s]", h.BaseURL)] = strconv.FormatBool(h.Healthy)
+		if h.Healthy {
+			healthy++
+		}
+	}
+	if healthy == 0 && len(step.RuntimeState) > 0 {
+		step.Detail = "all endpoints are unhealthy, the request is sent to any of them"
+	}
+	return step
+}
+
+func (agc *AIGatewayController) simulateCapability(aiCtx *aicontext.Context) *middlewares.SimulationStep {
+	if _, message := agc.capabilityError(aiCtx); message != "" {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationReject, Detail: message}
+	}
+	return &middlewares.SimulationStep{Decision: middlewares.SimulationPass}
+}
+
+// simulateFeatureFlags resolves the flags like resolve, but they are not
+// recorded in the metrics.
+func (agc *AIGatewayController) simulateFeatureFlags(aiCtx *aicontext.Context) *middlewares.SimulationStep {
+	ff := agc.flags
+	if ff == nil || len(ff.spec.Flags) == 0 {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationSkip, Detail: "feature flags are not configured"}
+	}
+	header := aiCtx.Req.HTTPHeader()
+	var overrides map[string]bool
+	if ff.spec.OverrideHeader != "" {
+		overrides = parseFeatureFlagOverrides(header.Get(ff.spec.OverrideHeader))
+	}
+	step := &middlewares.SimulationStep{Decision: middlewares.SimulationPass}
+	aiCtx.Flags = map[string]bool{}
+	items := []string{}
+	for _, evaluation := range ff.evaluate(aiCtx.ConsumerID(agc.spec.consumerIDHeader()), overrides) {
+		aiCtx.Flags[evaluation.Name] = evaluation.Enabled
+		if evaluation.Reason != featureFlagReasonDefault && evaluation.Reason != featureFlagReasonOverride {
+			step.Rules = append(step.Rules, fmt.Sprintf("featureFlags.flags[%s]", evaluation.Name))
+		}
+		value := "off"
+		if evaluation.Enabled {
+			value = "on"
+		}
+		items = append(items, fmt.Sprintf("%s=%s (%s)", evaluation.Name, value, evaluation.Reason))
+	}
+	sort.Strings(items)
+	step.Detail = strings.Join(items, ", ")
+	return step
+}
+
+func (agc *AIGatewayController) simulateMiddleware(aiCtx *aicontext.Context, name string, state *MiddlewareState) *middlewares.SimulationStep {
+	middleware, ok := agc.middlewares[name]
+	if !ok {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationSkip, Detail: fmt.Sprintf("middleware %s not found", name)}
+	}
+	var runtimeState map[string]string
+	// the state differs from the spec only if it is toggled at runtime.
+	if state != nil && state.UpdatedBy != "" {
+		runtimeState = map[string]string{"enabled": strconv.FormatBool(state.Enabled)}
+	}
+	if state != nil && !state.Enabled {
+		return &middlewares.SimulationStep{
+			Decision:     middlewares.SimulationSkip,
+			Rules:        []string{fmt.Sprintf("middlewares[%s]", name)},
+			Detail:       "middleware is disabled",
+			RuntimeState: runtimeState,
+		}
+	}
+	if aiCtx.Consumer.Skips(name) {
+		return &middlewares.SimulationStep{
+			Decision:     middlewares.SimulationSkip,
+			Rules:        []string{"consumers.skippableMiddlewares"},
+			Detail:       fmt.Sprintf("middleware is skipped by consumer %q", aiCtx.Consumer.ID),
+			RuntimeState: runtimeState,
+		}
+	}
+	simulator, ok := middleware.(middlewares.Simulator)
+	if !ok {
+		return &middlewares.SimulationStep{
+			Decision:     middlewares.SimulationUnknown,
+			Rules:        []string{fmt.Sprintf("middlewares[%s]", name)},
+			Detail:       fmt.Sprintf("the decision of %s depends on calls to providers or vector databases, which are not made by simulations", middleware.Kind()),
+			RuntimeState: runtimeState,
+		}
+	}
+	step := simulator.Simulate(aiCtx)
+	if len(runtimeState) > 0 {
+		if step.RuntimeState == nil {
+			step.RuntimeState = map[string]string{}
+		}
+		for k, v := range runtimeState {
+			step.RuntimeState[k] = v
+		}
+	}
+	return step
+}
+
+func (agc *AIGatewayController) simulateResponseValidator(aiCtx *aicontext.Context) *middlewares.SimulationStep {
+	if agc.responseValidator == nil {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationSkip, Detail: "response validators are not configured"}
+	}
+	spec := agc.responseValidator.Validator(aiCtx.ReqInfo.Model)
+	index := slices.Index(agc.spec.ResponseValidators, spec)
+	if spec == nil || index < 0 {
+		return &middlewares.SimulationStep{Decision: middlewares.SimulationSkip, Detail: fmt.Sprintf("no validator matches model %q", aiCtx.ReqInfo.Model)}
+	}
+	checks := make([]string, 0, len(spec.Checks))
+	for _, check := range spec.Checks {
+		checks = append(checks, fmt.Sprintf("%s (%s)", check.Type, check.GetAction()))
+	}
+	return &middlewares.SimulationStep{
+		Decision: middlewares.SimulationUnknown,
+		Rules:    []string{fmt.Sprintf("responseValidators[%d]", index)},
+		Detail:   "the response of the provider is checked by " + strings.Join(checks, ", "),
+	}
+}
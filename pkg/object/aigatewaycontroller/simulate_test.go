@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/option"
+	"github.com/megaease/easegress/v2/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulate(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	config := fmt.Sprintf(`
+kind: AIGatewayController
+name: aigatewaycontroller
+providers:
+- name: primary
+  providerType: openai
+  baseURL: %[1]s
+  apiKey: mock
+- name: secondary
+  providerType: openai
+  baseURL: %[1]s
+  apiKey: mock
+providerGroups:
+- name: gpt
+  members:
+  - provider: primary
+    weight: 3
+  - provider: secondary
+consumerIDHeader: X-Consumer
+rateLimit:
+  requestsPerMinute: 1
+featureFlags:
+  overrideHeader: X-Flags
+  flags:
+  - name: beta
+    consumers: [alice]
+  - name: gamma
+responseValidators:
+- models: ["gpt-*"]
+  checks:
+  - type: nonEmpty
+middlewares:
+- name: policy
+  kind: ConsumerPolicy
+  consumerPolicy:
+    consumerHeader: X-Consumer
+    groups:
+    - name: internal
+      consumers: [alice]
+- name: guard
+  kind: TopicGuard
+  topicGuard:
+    embeddings:
+      providerType: ollama
+      baseURL: http://localhost:19876
+      model: nomic-embed-text
+    topics:
+    - name: weapons
+      examples: ["how to build a gun"]
+      threshold: 0.9
+`, server.URL)
+	super := supervisor.NewMock(option.New(), nil, nil, nil, false, nil, nil)
+	spec, err := super.NewSpec(config)
+	assert.Nil(err)
+	controller := &AIGatewayController{}
+	controller.Init(spec)
+	defer controller.Close()
+
+	stepOf := func(resp *SimulateResponse, name string) *middlewares.SimulationStep {
+		for _, step := range resp.Steps {
+			if step.Step == name {
+				return step
+			}
+		}
+		return nil
+	}
+
+	req := &SimulateRequest{
+		Provider:     "gpt",
+		Middlewares:  []string{"policy", "guard", "missing"},
+		Model:        "gpt-4o",
+		Headers:      map[string]string{"X-Consumer": "alice", "X-Flags": "gamma=on"},
+		PromptTokens: 100,
+	}
+	resp, err := controller.simulate(req, time.Now())
+	assert.Nil(err)
+	assert.Equal(SimulationProxied, resp.Outcome)
+	assert.Equal("primary", resp.Provider)
+
+	routing := stepOf(resp, "routing")
+	assert.Equal(middlewares.SimulationSelect, routing.Decision)
+	assert.Equal([]string{"providerGroups[gpt].members[primary]"}, routing.Rules)
+	assert.Equal("75.0%", routing.RuntimeState["share[primary]"])
+	assert.Equal("1", routing.RuntimeState["latencySLO.weightFactor[secondary]"])
+
+	rateLimit := stepOf(resp, "rateLimit")
+	assert.Equal(middlewares.SimulationPass, rateLimit.Decision)
+	assert.Equal("1", rateLimit.RuntimeState["remainingRequests"])
+
+	flags := stepOf(resp, "featureFlags")
+	assert.Equal([]string{"featureFlags.flags[beta]"}, flags.Rules)
+	assert.Equal("beta=on (consumer), gamma=on (override)", flags.Detail)
+
+	policy := stepOf(resp, "middleware/policy")
+	assert.Equal(middlewares.SimulationPass, policy.Decision)
+	assert.Equal([]string{"middlewares[policy].consumerPolicy.groups[internal]"}, policy.Rules)
+	assert.Equal(middlewares.SimulationUnknown, stepOf(resp, "middleware/guard").Decision)
+	assert.Equal(middlewares.SimulationSkip, stepOf(resp, "middleware/missing").Decision)
+	assert.Equal([]string{"responseValidators[0]"}, stepOf(resp, "responseValidator").Rules)
+	assert.Equal("true", stepOf(resp, "providerHealth").RuntimeState[fmt.Sprintf("healthy[%s]", server.URL)])
+
+	// the simulation counts nothing, and the real request exhausts the
+	// rate limit.
+	resp, err = controller.simulate(req, time.Now())
+	assert.Nil(err)
+	assert.Equal(SimulationProxied, resp.Outcome)
+	_, limitType := controller.rateLimiter.admit("alice", time.Now())
+	assert.Equal("", limitType)
+	resp, err = controller.simulate(req, time.Now())
+	assert.Nil(err)
+	assert.Equal(SimulationRejected, resp.Outcome)
+	assert.Equal("rateLimit", resp.Steps[len(resp.Steps)-1].Step)
+	assert.Equal("0", resp.Steps[len(resp.Steps)-1].RuntimeState["remainingRequests"])
+	assert.Empty(resp.Provider)
+
+	// a middleware disabled at runtime is skipped with its state.
+	_, err = controller.setMiddlewareEnabled("policy", false, "test")
+	assert.Nil(err)
+	resp, err = controller.simulate(&SimulateRequest{Provider: "secondary", Middlewares: []string{"policy"}, Model: "gpt-4o"}, time.Now())
+	assert.Nil(err)
+	assert.Equal("secondary", resp.Provider)
+	assert.Equal([]string{"providers[secondary]"}, stepOf(resp, "routing").Rules)
+	policy = stepOf(resp, "middleware/policy")
+	assert.Equal(middlewares.SimulationSkip, policy.Decision)
+	assert.Equal("false", policy.RuntimeState["enabled"])
+
+	// unknown providers and endpoints are rejected.
+	resp, err = controller.simulate(&SimulateRequest{Provider: "unknown"}, time.Now())
+	assert.Nil(err)
+	assert.Equal(SimulationRejected, resp.Outcome)
+	assert.Equal("routing", resp.Steps[len(resp.Steps)-1].Step)
+	resp, err = controller.simulate(&SimulateRequest{Provider: "gpt", Path: "/v1/assistants"}, time.Now())
+	assert.Nil(err)
+	assert.Equal(SimulationRejected, resp.Outcome)
+	assert.Equal("endpoint", resp.Steps[len(resp.Steps)-1].Step)
+
+	_, err = controller.simulate(&SimulateRequest{}, time.Now())
+	assert.NotNil(err)
+
+	// no provider is called.
+	assert.Equal(int32(0), calls.Load())
+}
@@ -0,0 +1,449 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// maxSpecDiffs is the number of the latest spec diffs kept.
+const maxSpecDiffs = 20
+
+// Types of spec changes.
+const (
+	specChangeAdded    = "added"
+	specChangeRemoved  = "removed"
+	specChangeModified = "modified"
+)
+
+// Actions on the runtime components in a reload.
+const (
+	componentCreated   = "created"
+	componentRecreated = "recreated"
+	componentKept      = "kept"
+	componentClosed    = "closed"
+	componentFailed    = "failed"
+)
+
+// secretFields are the spec fields diffed by their hashes, the values
+// under headers are secret as well.
+var secretFields = []string{"apiKey", "password", "secret", "accessKeyID", "secretAccessKey", "sessionToken", "connectionURL", "token"}
+
+type (
+	// SpecDiff is the difference between the specs of two generations of
+	// the controller, and what the reload did to the runtime components.
+	SpecDiff struct {
+		Time    time.Time     `json:"time"`
+		Changes []*SpecChange `json:"changes"`
+		// Providers and Middlewares are the names of the changed ones.
+		Providers   *NamesDiff `json:"providers,omitempty"`
+		Middlewares *NamesDiff `json:"middlewares,omitempty"`
+		// MiddlewareOrder is set if the middlewares kept are reordered.
+		MiddlewareOrder *OrderDiff `json:"middlewareOrder,omitempty"`
+		// Collections are the vector collections added or removed.
+		Collections *NamesDiff         `json:"collections,omitempty"`
+		Components  []*ComponentChange `json:"components"`
+	}
+
+	// SpecChange is the change of a spec field, the path is like
+	// providers[openai].headers.X-Team, the values of secret fields are
+	// their hashes.
+	SpecChange struct {
+		Path string `json:"path"`
+		Type string `json:"type"`
+		Old  any    `json:"old,omitempty"`
+		New  any    `json:"new,omitempty"`
+	}
+
+	// NamesDiff is the names added, removed or modified.
+	NamesDiff struct {
+		Added    []string `json:"added,omitempty"`
+		Removed  []string `json:"removed,omitempty"`
+		Modified []string `json:"modified,omitempty"`
+	}
+
+	// OrderDiff is the order of names before and after a change.
+	OrderDiff struct {
+		Old []string `json:"old"`
+		New []string `json:"new"`
+	}
+
+	// ComponentChange is what a reload did to a runtime component.
+	ComponentChange struct {
+		Name   string `json:"name"`
+		Action string `json:"action"`
+	}
+
+	// specDiffHistory keeps the latest spec diffs, it is shared by all
+	// generations of the controller.
+	specDiffHistory struct {
+		lock  sync.Mutex
+		diffs []*SpecDiff
+	}
+)
+
+// add adds the diff, the oldest one is dropped if there are too many.
+func (h *specDiffHistory) add(diff *SpecDiff) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.diffs = append(h.diffs, diff)
+	if len(h.diffs) > maxSpecDiffs {
+		h.diffs = h.diffs[len(h.diffs)-maxSpecDiffs:]
+	}
+}
+
+// list returns the diffs, the latest first.
+func (h *specDiffHistory) list() []*SpecDiff {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	diffs := slices.Clone(h.diffs)
+	slices.Reverse(diffs)
+	return diffs
+}
+
+// diffSpecs computes the difference between the specs.
+func diffSpecs(old, new *Spec) *SpecDiff {
+	oldValue, newValue := specValue(old), specValue(new)
+	diff := &SpecDiff{Time: time.Now(), Changes: []*SpecChange{}, Components: []*ComponentChange{}}
+	diffValues("", oldValue, newValue, &diff.Changes)
+
+	diff.Providers = namedChanges(diff.Changes, "providers")
+	diff.Middlewares = namedChanges(diff.Changes, "middlewares")
+	oldOrder, newOrder := specNames(oldValue["middlewares"]), specNames(newValue["middlewares"])
+	if order := commonOrder(oldOrder, newOrder); !slices.Equal(order, commonOrder(newOrder, oldOrder)) {
+		diff.MiddlewareOrder = &OrderDiff{Old: oldOrder, New: newOrder}
+	}
+
+	var oldCollections, newCollections []string
+	collectValues(oldValue["middlewares"], "collectionName", &oldCollections)
+	collectValues(newValue["middlewares"], "collectionName", &newCollections)
+	collections := &NamesDiff{}
+	for _, c := range newCollections {
+		if !slices.Contains(oldCollections, c) && !slices.Contains(collections.Added, c) {
+			collections.Added = append(collections.Added, c)
+		}
+	}
+	for _, c := range oldCollections {
+		if !slices.Contains(newCollections, c) && !slices.Contains(collections.Removed, c) {
+			collections.Removed = append(collections.Removed, c)
+		}
+	}
+	sort.Strings(collections.Added)
+	sort.Strings(collections.Removed)
+	if len(collections.Added) > 0 || len(collections.Removed) > 0 {
+		diff.Collections = collections
+	}
+	return diff
+}
+
+// component records the action on a component, nothing is recorded if the
+// action is empty.
+func (d *SpecDiff) component(name string, action string) {
+	if d == nil || action == "" {
+		return
+	}
+	d.Components = append(d.Components, &ComponentChange{Name: name, Action: action})
+}
+
+// componentAction returns the action on a component which is rebuilt in
+// every reload if it is configured.
+func componentAction(existed bool, exists bool) string {
+	switch {
+	case existed && exists:
+		return componentRecreated
+	case exists:
+		return componentCreated
+	case existed:
+		return componentClosed
+	}
+	return ""
+}
+
+// String returns the summary of the diff for logging.
+func (d *SpecDiff) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d changes", len(d.Changes))
+	for _, c := range d.Changes {
+		fmt.Fprintf(&sb, "; %s %s", c.Path, c.Type)
+	}
+	if d.MiddlewareOrder != nil {
+		fmt.Fprintf(&sb, "; middlewares reordered %v -> %v", d.MiddlewareOrder.Old, d.MiddlewareOrder.New)
+	}
+	var components []string
+	for _, c := range d.Components {
+		components = append(components, c.Name+" "+c.Action)
+	}
+	fmt.Fprintf(&sb, "; components: %s", strings.Join(components, ", "))
+	return sb.String()
+}
+
+// specValue returns the spec as a generic JSON value, with the secrets
+// replaced by their hashes.
+func specValue(spec *Spec) map[string]any {
+	value := map[string]any{}
+	if spec == nil {
+		return value
+	}
+	data, err := codectool.MarshalJSON(spec)
+	if err != nil {
+		logger.Errorf("failed to marshal spec for diff: %v", err)
+		return value
+	}
+	if err := json.Unmarshal(data, &value); err != nil {
+		logger.Errorf("failed to unmarshal spec for diff: %v", err)
+		return map[string]any{}
+	}
+	return redactSecrets(value, "").(map[string]any)
+}
+
+func hashSecret(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// redactSecrets replaces the secrets in the value of the key with their
+// hashes, and the passwords in URLs.
+func redactSecrets(value any, key string) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if key == "headers" {
+				if s, ok := child.(string); ok {
+					v[k] = hashSecret(s)
+				}
+				continue
+			}
+			v[k] = redactSecrets(child, k)
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = redactSecrets(child, key)
+		}
+		return v
+	case string:
+		if slices.Contains(secretFields, key) {
+			return hashSecret(v)
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), hashSecret(password))
+				return u.String()
+			}
+		}
+		return v
+	}
+	return value
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// diffValues appends the changes from old to new at the path. Lists of
+// objects with names are matched by names, other lists by indexes.
+func diffValues(path string, old, new any, changes *[]*SpecChange) {
+	switch {
+	case old == nil && new == nil:
+		return
+	case old == nil:
+		*changes = append(*changes, &SpecChange{Path: path, Type: specChangeAdded, New: new})
+		return
+	case new == nil:
+		*changes = append(*changes, &SpecChange{Path: path, Type: specChangeRemoved, Old: old})
+		return
+	}
+
+	oldMap, ok1 := old.(map[string]any)
+	newMap, ok2 := new.(map[string]any)
+	if ok1 && ok2 {
+		keys := make([]string, 0, len(oldMap)+len(newMap))
+		for k := range oldMap {
+			keys = append(keys, k)
+		}
+		for k := range newMap {
+			if _, ok := oldMap[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffValues(joinPath(path, k), oldMap[k], newMap[k], changes)
+		}
+		return
+	}
+
+	oldList, ok1 := old.([]any)
+	newList, ok2 := new.([]any)
+	if ok1 && ok2 {
+		if isNamedList(oldList) && isNamedList(newList) {
+			diffNamedLists(path, oldList, newList, changes)
+			return
+		}
+		for i := 0; i < max(len(oldList), len(newList)); i++ {
+			var o, n any
+			if i < len(oldList) {
+				o = oldList[i]
+			}
+			if i < len(newList) {
+				n = newList[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), o, n, changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, &SpecChange{Path: path, Type: specChangeModified, Old: old, New: new})
+	}
+}
+
+func diffNamedLists(path string, old, new []any, changes *[]*SpecChange) {
+	oldItems := map[string]any{}
+	for _, item := range old {
+		oldItems[itemName(item)] = item
+	}
+	newItems := map[string]any{}
+	for _, item := range new {
+		newItems[itemName(item)] = item
+	}
+	names := specNames(old)
+	for _, name := range specNames(new) {
+		if _, ok := oldItems[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		diffValues(fmt.Sprintf("%s[%s]", path, name), oldItems[name], newItems[name], changes)
+	}
+}
+
+// isNamedList checks whether the list consists of objects with unique
+// names.
+func isNamedList(list []any) bool {
+	if len(list) == 0 {
+		return true
+	}
+	names := map[string]struct{}{}
+	for _, item := range list {
+		name := itemName(item)
+		if name == "" {
+			return false
+		}
+		if _, ok := names[name]; ok {
+			return false
+		}
+		names[name] = struct{}{}
+	}
+	return true
+}
+
+func itemName(item any) string {
+	m, ok := item.(map[string]any)
+	if !ok {
+		return ""
+	}
+	name, _ := m["name"].(string)
+	return name
+}
+
+// specNames returns the names of the items of a named list in order.
+func specNames(value any) []string {
+	list, _ := value.([]any)
+	names := make([]string, 0, len(list))
+	for _, item := range list {
+		if name := itemName(item); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// commonOrder returns the names also in others, in the order of names.
+func commonOrder(names []string, others []string) []string {
+	var result []string
+	for _, name := range names {
+		if slices.Contains(others, name) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// namedChanges summarizes the changes of the items of a top level named
+// list, it returns nil if there is no change.
+func namedChanges(changes []*SpecChange, list string) *NamesDiff {
+	result := &NamesDiff{}
+	prefix := list + "["
+	for _, c := range changes {
+		rest, ok := strings.CutPrefix(c.Path, prefix)
+		if !ok {
+			continue
+		}
+		name, field, ok := strings.Cut(rest, "]")
+		if !ok {
+			continue
+		}
+		switch {
+		case field == "" && c.Type == specChangeAdded:
+			result.Added = append(result.Added, name)
+		case field == "" && c.Type == specChangeRemoved:
+			result.Removed = append(result.Removed, name)
+		case !slices.Contains(result.Modified, name):
+			result.Modified = append(result.Modified, name)
+		}
+	}
+	if len(result.Added) == 0 && len(result.Removed) == 0 && len(result.Modified) == 0 {
+		return nil
+	}
+	return result
+}
+
+// collectValues collects the string values of the key in the value.
+func collectValues(value any, key string, values *[]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if s, ok := child.(string); ok && k == key && s != "" {
+				*values = append(*values, s)
+				continue
+			}
+			collectValues(child, key, values)
+		}
+	case []any:
+		for _, child := range v {
+			collectValues(child, key, values)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/redisvector"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/middlewares/vectordb/vecdbtypes"
+)
+
+func diffTestSpec() *Spec {
+	retrieval := func(name, collection, redisURL string) *middlewares.MiddlewareSpec {
+		return &middlewares.MiddlewareSpec{
+			Name: name,
+			Kind: "Retrieval",
+			Retrieval: &middlewares.RetrievalSpec{
+				VectorDB: &vectordb.Spec{
+					CommonSpec: vecdbtypes.CommonSpec{
+						Type:           vectordb.TypeRedis,
+						Threshold:      0.5,
+						CollectionName: collection,
+					},
+					Redis: &redisvector.RedisVectorDBSpec{URL: redisURL},
+				},
+				TopK: 3,
+			},
+		}
+	}
+	return &Spec{
+		Providers: []*aicontext.ProviderSpec{
+			{
+				Name:         "openai",
+				ProviderType: "openai",
+				BaseURL:      "https://api.openai.com",
+				APIKey:       "sk-old",
+				Headers:      map[string]string{"X-Team": "a"},
+				Signing:      &aicontext.SigningSpec{Type: "hmac", Header: "X-Sig", Secret: "s1"},
+			},
+			{Name: "deepseek", ProviderType: "deepseek", BaseURL: "https://api.deepseek.com", APIKey: "sk-ds"},
+		},
+		Middlewares: []*middlewares.MiddlewareSpec{
+			retrieval("docs", "docs", "redis://:pass1@redis:6379"),
+			retrieval("faq", "faq", "redis://redis:6379"),
+			{Name: "validator", Kind: "ConversationValidator"},
+		},
+	}
+}
+
+func findChange(changes []*SpecChange, path string) *SpecChange {
+	for _, c := range changes {
+		if c.Path == path {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestDiffSpecsNested(t *testing.T) {
+	assert := assert.New(t)
+
+	old, new := diffTestSpec(), diffTestSpec()
+	diff := diffSpecs(old, new)
+	assert.Empty(diff.Changes)
+	assert.Nil(diff.Providers)
+	assert.Nil(diff.Middlewares)
+	assert.Nil(diff.MiddlewareOrder)
+	assert.Nil(diff.Collections)
+
+	new.Providers = []*aicontext.ProviderSpec{
+		new.Providers[1],
+		{Name: "ollama", ProviderType: "ollama", BaseURL: "http://ollama:11434"},
+		new.Providers[0],
+	}
+	diff = diffSpecs(old, new)
+
+	// providers are matched by names, so the reorder is not a change.
+	assert.Len(diff.Changes, 1)
+	assert.Equal(&NamesDiff{Added: []string{"ollama"}}, diff.Providers)
+	c := findChange(diff.Changes, "providers[ollama]")
+	assert.NotNil(c)
+	assert.Equal(specChangeAdded, c.Type)
+
+	new = diffTestSpec()
+	new.Providers[0].BaseURL = "https://proxy.example.com"
+	new.Providers[0].Headers["X-Env"] = "prod"
+	new.Providers[0].Signing.Header = "X-Signature"
+	new.Providers = new.Providers[:1]
+	new.Middlewares[1].Retrieval.TopK = 5
+	new.Middlewares[1].Retrieval.VectorDB.CollectionName = "faq2"
+	diff = diffSpecs(old, new)
+
+	c = findChange(diff.Changes, "providers[openai].baseURL")
+	assert.Equal(&SpecChange{Path: "providers[openai].baseURL", Type: specChangeModified,
+		Old: "https://api.openai.com", New: "https://proxy.example.com"}, c)
+	c = findChange(diff.Changes, "providers[openai].signing.header")
+	assert.Equal(&SpecChange{Path: "providers[openai].signing.header", Type: specChangeModified,
+		Old: "X-Sig", New: "X-Signature"}, c)
+	c = findChange(diff.Changes, "providers[openai].headers.X-Env")
+	assert.Equal(specChangeAdded, c.Type)
+	c = findChange(diff.Changes, "providers[deepseek]")
+	assert.Equal(specChangeRemoved, c.Type)
+	c = findChange(diff.Changes, "middlewares[faq].retrieval.topK")
+	assert.Equal(&SpecChange{Path: "middlewares[faq].retrieval.topK", Type: specChangeModified,
+		Old: float64(3), New: float64(5)}, c)
+	assert.NotNil(findChange(diff.Changes, "middlewares[faq].retrieval.vectorDB.collectionName"))
+	assert.Len(diff.Changes, 6)
+
+	assert.Equal(&NamesDiff{Removed: []string{"deepseek"}, Modified: []string{"openai"}}, diff.Providers)
+	assert.Equal(&NamesDiff{Modified: []string{"faq"}}, diff.Middlewares)
+	assert.Equal(&NamesDiff{Added: []string{"faq2"}, Removed: []string{"faq"}}, diff.Collections)
+	assert.Nil(diff.MiddlewareOrder)
+}
+
+func TestDiffSpecsSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	old, new := diffTestSpec(), diffTestSpec()
+	new.Providers[0].APIKey = "sk-new"
+	new.Providers[0].Headers["X-Team"] = "b"
+	new.Providers[0].Signing.Secret = "s2"
+	new.Middlewares[0].Retrieval.VectorDB.Redis.URL = "redis://:pass2@redis:6379"
+	diff := diffSpecs(old, new)
+	assert.Len(diff.Changes, 4)
+
+	c := findChange(diff.Changes, "providers[openai].apiKey")
+	assert.Equal(hashSecret("sk-old"), c.Old)
+	assert.Equal(hashSecret("sk-new"), c.New)
+	c = findChange(diff.Changes, "providers[openai].headers.X-Team")
+	assert.Equal(hashSecret("a"), c.Old)
+	c = findChange(diff.Changes, "providers[openai].signing.secret")
+	assert.Equal(hashSecret("s2"), c.New)
+	c = findChange(diff.Changes, "middlewares[docs].retrieval.vectorDB.redis.url")
+	assert.NotNil(c)
+
+	for _, c := range diff.Changes {
+		for _, secret := range []string{"sk-old", "sk-new", "s1", "s2", "pass1", "pass2"} {
+			assert.NotEqual(secret, c.Old)
+			assert.NotEqual(secret, c.New)
+			assert.NotContains(c.Old.(string), secret+"@")
+			assert.NotContains(c.New.(string), secret+"@")
+		}
+	}
+	assert.True(strings.HasPrefix(hashSecret("x"), "sha256:"))
+
+	// the specs are not changed by the diff.
+	assert.Equal("sk-new", new.Providers[0].APIKey)
+	assert.Equal("redis://:pass2@redis:6379", new.Middlewares[0].Retrieval.VectorDB.Redis.URL)
+}
+
+func TestDiffSpecsMiddlewareOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	old, new := diffTestSpec(), diffTestSpec()
+	new.Middlewares[0], new.Middlewares[2] = new.Middlewares[2], new.Middlewares[0]
+	diff := diffSpecs(old, new)
+	assert.Empty(diff.Changes)
+	assert.Equal(&OrderDiff{
+		Old: []string{"docs", "faq", "validator"},
+		New: []string{"validator", "faq", "docs"},
+	}, diff.MiddlewareOrder)
+
+	// adding or removing a middleware is not a reorder.
+	new = diffTestSpec()
+	new.Middlewares = new.Middlewares[1:]
+	diff = diffSpecs(old, new)
+	assert.Nil(diff.MiddlewareOrder)
+	assert.Equal(&NamesDiff{Removed: []string{"docs"}}, diff.Middlewares)
+	assert.Equal(&NamesDiff{Removed: []string{"docs"}}, diff.Collections)
+}
+
+func TestSpecDiffHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &specDiffHistory{}
+	for i := 0; i < maxSpecDiffs+5; i++ {
+		d := &SpecDiff{}
+		d.component("providers", componentAction(i > 0, true))
+		h.add(d)
+	}
+	diffs := h.list()
+	assert.Len(diffs, maxSpecDiffs)
+	assert.Equal(componentRecreated, diffs[0].Components[0].Action)
+
+	var d *SpecDiff
+	d.component("providers", componentCreated)
+	assert.Equal("", componentAction(false, false))
+	assert.Equal(componentClosed, componentAction(true, false))
+}
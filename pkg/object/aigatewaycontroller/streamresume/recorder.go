@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package streamresume
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+// writeTimeout is the timeout of writing a batch of events.
+const writeTimeout = 5 * time.Second
+
+type (
+	// recorder numbers the events of a stream sent to the client and
+	// buffers them. If the client goes away before the stream completes,
+	// the rest of the stream is read from the upstream and buffered in
+	// background, so it can be resumed by the client.
+	recorder struct {
+		backend  Backend
+		settings *settings
+		id       string
+		owner    string
+
+		live     io.Reader
+		upstream io.Reader
+		closer   io.Closer
+
+		buf       []byte
+		in        []byte
+		out       bytes.Buffer
+		seq       int64
+		size      int64
+		err       error
+		closeOnce sync.Once
+
+		queue chan *bufferWrite
+		// abandoned is set if an event is not buffered, the buffer is
+		// marked incomplete then and no more events are written.
+		abandoned atomic.Bool
+		stopped   chan struct{}
+	}
+
+	bufferWrite struct {
+		events []string
+		state  string
+	}
+)
+
+// Record buffers the stream of the request id. The client reads live,
+// which is a view of upstream, and upstream is read directly once the
+// client goes away. closer closes the upstream, it may be nil.
+func (s *Store) Record(id string, owner string, live io.Reader, upstream io.Reader, closer io.Closer) io.ReadCloser {
+	r := &recorder{
+		backend:  s.backend,
+		settings: s.settings.Load(),
+		id:       id,
+		owner:    ownerHash(owner),
+		live:     live,
+		upstream: upstream,
+		closer:   closer,
+		buf:      make([]byte, 4096),
+		queue:    make(chan *bufferWrite, writeQueueSize),
+		stopped:  make(chan struct{}),
+	}
+	r.queue <- &bufferWrite{state: StateStreaming}
+	go r.write()
+	return r
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && r.err == nil {
+		n, err := r.live.Read(r.buf)
+		r.consume(r.buf[:n], &r.out)
+		if err != nil {
+			r.end(&r.out)
+			r.err = err
+		}
+	}
+	if r.out.Len() == 0 {
+		return 0, r.err
+	}
+	return r.out.Read(p)
+}
+
+// consume splits the data into events, numbers and buffers them.
+func (r *recorder) consume(data []byte, out *bytes.Buffer) {
+	r.in = append(r.in, data...)
+	for {
+		i := bytes.Index(r.in, []byte("\n\n"))
+		if i < 0 {
+			return
+		}
+		r.emit(r.in[:i+2], out)
+		r.in = r.in[i+2:]
+	}
+}
+
+// end emits the incomplete event at the end of the stream, and marks the
+// stream done.
+func (r *recorder) end(out *bytes.Buffer) {
+	if len(r.in) > 0 {
+		r.emit(r.in, out)
+		r.in = nil
+	}
+	r.queue <- &bufferWrite{state: StateDone}
+	close(r.queue)
+}
+
+func (r *recorder) emit(event []byte, out *bytes.Buffer) {
+	r.seq++
+	out.Write(formatEvent(r.seq, string(event)))
+
+	r.size += int64(len(event))
+	if r.size > r.settings.maxBytes {
+		r.abandoned.Store(true)
+	}
+	if r.abandoned.Load() {
+		return
+	}
+	select {
+	case r.queue <- &bufferWrite{events: []string{string(event)}, state: StateStreaming}:
+	default:
+		r.abandoned.Store(true)
+	}
+}
+
+// Close closes the stream if it completes, or reads the rest of it in
+// background.
+func (r *recorder) Close() error {
+	r.closeOnce.Do(func() {
+		if r.err != nil {
+			r.closeUpstream()
+			return
+		}
+		go r.drain()
+	})
+	return nil
+}
+
+// drain reads the rest of the stream from the upstream, it stops early if
+// the stream cannot be buffered completely.
+func (r *recorder) drain() {
+	defer r.closeUpstream()
+	var discard bytes.Buffer
+	for !r.abandoned.Load() {
+		n, err := r.upstream.Read(r.buf)
+		r.consume(r.buf[:n], &discard)
+		discard.Reset()
+		if err != nil {
+			break
+		}
+	}
+	r.end(&discard)
+}
+
+func (r *recorder) closeUpstream() {
+	if r.closer != nil {
+		r.closer.Close()
+	}
+}
+
+// write writes the events to the backend in batches.
+func (r *recorder) write() {
+	defer close(r.stopped)
+	for w := range r.queue {
+		batch := &bufferWrite{events: w.events, state: w.state}
+	collect:
+		for {
+			select {
+			case next, ok := <-r.queue:
+				if !ok {
+					break collect
+				}
+				batch.events = append(batch.events, next.events...)
+				batch.state = next.state
+			default:
+				break collect
+			}
+		}
+
+		if r.abandoned.Load() {
+			batch.events, batch.state = nil, StateIncomplete
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		err := r.backend.Append(ctx, r.id, batch.events, batch.state, r.owner, r.settings.ttl)
+		cancel()
+		if err != nil {
+			logger.Errorf("failed to buffer stream %s: %v", r.id, err)
+			r.abandoned.Store(true)
+			ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+			r.backend.Append(ctx, r.id, nil, StateIncomplete, r.owner, r.settings.ttl)
+			cancel()
+		}
+		if batch.state == StateIncomplete || r.abandoned.Load() {
+			// the rest is dropped, the queue is drained so the stream is
+			// not blocked.
+			for range r.queue {
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package streamresume
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/rueidis"
+)
+
+// redisBackend buffers the events of a stream in a list, and its state
+// and owner in a hash. The keys share a hash tag, so they are in the same
+// slot of a Redis cluster.
+type redisBackend struct {
+	client rueidis.Client
+}
+
+func newRedisBackend(url string) (*redisBackend, error) {
+	option, err := rueidis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+	}
+	client, err := rueidis.NewClient(option)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Redis client: %w", err)
+	}
+	return &redisBackend{client: client}, nil
+}
+
+func eventsKey(id string) string {
+	return "aistream:{" + id + "}:events"
+}
+
+func metaKey(id string) string {
+	return "aistream:{" + id + "}:meta"
+}
+
+func (b *redisBackend) Append(ctx context.Context, id string, events []string, state string, owner string, ttl time.Duration) error {
+	cmds := rueidis.Commands{
+		b.client.B().Multi().Build(),
+		b.client.B().Hset().Key(metaKey(id)).FieldValue().FieldValue("state", state).FieldValue("owner", owner).Build(),
+		b.client.B().Pexpire().Key(metaKey(id)).Milliseconds(ttl.Milliseconds()).Build(),
+	}
+	if len(events) > 0 {
+		cmds = append(cmds, b.client.B().Rpush().Key(eventsKey(id)).Element(events...).Build())
+	}
+	cmds = append(cmds,
+		b.client.B().Pexpire().Key(eventsKey(id)).Milliseconds(ttl.Milliseconds()).Build(),
+		b.client.B().Exec().Build(),
+	)
+	for _, resp := range b.client.DoMulti(ctx, cmds...) {
+		if err := resp.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *redisBackend) State(ctx context.Context, id string) (string, string, error) {
+	values, err := b.client.Do(ctx, b.client.B().Hmget().Key(metaKey(id)).Field("state", "owner").Build()).ToArray()
+	if err != nil {
+		return "", "", err
+	}
+	var result [2]string
+	for i := 0; i < len(values) && i < 2; i++ {
+		if s, err := values[i].ToString(); err == nil {
+			result[i] = s
+		}
+	}
+	return result[0], result[1], nil
+}
+
+func (b *redisBackend) Events(ctx context.Context, id string, start int64) ([]string, error) {
+	return b.client.Do(ctx, b.client.B().Lrange().Key(eventsKey(id)).Start(start).Stop(-1).Build()).AsStrSlice()
+}
+
+func (b *redisBackend) Close() {
+	b.client.Close()
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package streamresume buffers the events of streaming responses in Redis,
+// so clients losing the stream can reconnect and resume it from the last
+// event received instead of requesting the whole completion again.
+package streamresume
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+const (
+	defaultTTL         = 5 * time.Minute
+	defaultMaxBytes    = 1 << 20
+	defaultOwnerHeader = "Authorization"
+	minTTL             = 10 * time.Second
+	maxTTL             = time.Hour
+	pollInterval       = 100 * time.Millisecond
+	// writeQueueSize is the number of the events of a stream waiting to
+	// be written, the buffer is abandoned if Redis cannot keep up.
+	writeQueueSize = 256
+)
+
+// States of the buffer of a stream.
+const (
+	StateStreaming = "streaming"
+	StateDone      = "done"
+	// StateIncomplete is set if some events are not buffered, because
+	// the stream is too large or Redis cannot keep up.
+	StateIncomplete = "incomplete"
+)
+
+var (
+	// ErrNotFound is returned if the stream is not buffered, it is
+	// expired, or it is owned by another client.
+	ErrNotFound = errors.New("stream not found")
+	// ErrIncomplete is returned if some events of the stream are not
+	// buffered, so it cannot be resumed.
+	ErrIncomplete = errors.New("stream is not buffered completely")
+)
+
+type (
+	// Spec describes the resumption of streaming responses.
+	Spec struct {
+		// URL is the URL of the Redis buffering the streams.
+		URL string `json:"url" jsonschema:"required"`
+		// TTL is how long the buffer of a stream is kept after the last
+		// event, so it is purged TTL after the stream completes.
+		TTL string `json:"ttl,omitempty" jsonschema:"format=duration"`
+		// MaxBytes is the max size of the events buffered for a stream,
+		// streams exceeding it cannot be resumed.
+		MaxBytes int64 `json:"maxBytes,omitempty"`
+		// OwnerHeader is the request header identifying the client, a
+		// stream can only be resumed by requests with the same value.
+		OwnerHeader string `json:"ownerHeader,omitempty"`
+	}
+
+	// Backend stores the buffers of the streams.
+	Backend interface {
+		// Append appends the events to the buffer of the stream, and
+		// sets the state and the owner, the buffer expires after ttl.
+		Append(ctx context.Context, id string, events []string, state string, owner string, ttl time.Duration) error
+		// State returns the state and the owner of the stream, the state
+		// is empty if the stream is not buffered.
+		State(ctx context.Context, id string) (state string, owner string, err error)
+		// Events returns the events of the stream from the index.
+		Events(ctx context.Context, id string, start int64) ([]string, error)
+		Close()
+	}
+
+	// Store buffers the streams.
+	Store struct {
+		backend  Backend
+		settings atomic.Pointer[settings]
+	}
+
+	settings struct {
+		ttl         time.Duration
+		maxBytes    int64
+		ownerHeader string
+	}
+)
+
+// ValidateSpec validates the spec of stream resumption.
+func ValidateSpec(spec *Spec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if spec.TTL != "" {
+		ttl, err := time.ParseDuration(spec.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid ttl: %w", err)
+		}
+		if ttl < minTTL || ttl > maxTTL {
+			return fmt.Errorf("ttl must be between %s and %s", minTTL, maxTTL)
+		}
+	}
+	if spec.MaxBytes < 0 {
+		return fmt.Errorf("maxBytes cannot be negative")
+	}
+	return nil
+}
+
+// New creates a Store buffering the streams in the Redis of the spec.
+func New(spec *Spec) (*Store, error) {
+	backend, err := newRedisBackend(spec.URL)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithBackend(spec, backend), nil
+}
+
+// NewWithBackend creates a Store buffering the streams in the backend.
+func NewWithBackend(spec *Spec, backend Backend) *Store {
+	s := &Store{backend: backend}
+	s.SetSpec(spec)
+	return s
+}
+
+// SetSpec updates the settings of the store, the URL is not changed. The
+// streams being buffered keep their settings.
+func (s *Store) SetSpec(spec *Spec) {
+	st := &settings{
+		ttl:         defaultTTL,
+		maxBytes:    spec.MaxBytes,
+		ownerHeader: spec.OwnerHeader,
+	}
+	if spec.TTL != "" {
+		st.ttl, _ = time.ParseDuration(spec.TTL)
+	}
+	if st.maxBytes == 0 {
+		st.maxBytes = defaultMaxBytes
+	}
+	if st.ownerHeader == "" {
+		st.ownerHeader = defaultOwnerHeader
+	}
+	s.settings.Store(st)
+}
+
+// OwnerHeader returns the request header identifying the client.
+func (s *Store) OwnerHeader() string {
+	return s.settings.Load().ownerHeader
+}
+
+// Close closes the backend.
+func (s *Store) Close() {
+	s.backend.Close()
+}
+
+// ownerHash hashes the owner, so the credentials are not stored.
+func ownerHash(owner string) string {
+	sum := sha256.Sum256([]byte(owner))
+	return hex.EncodeToString(sum[:])
+}
+
+// Resume returns the events of the stream after the event lastEventID,
+// followed by the ones buffered later until the stream completes.
+func (s *Store) Resume(ctx context.Context, id string, owner string, lastEventID int64) (io.ReadCloser, error) {
+	state, storedOwner, err := s.backend.State(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if state == "" || storedOwner != ownerHash(owner) {
+		return nil, ErrNotFound
+	}
+	if state == StateIncomplete {
+		return nil, ErrIncomplete
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timeout := s.settings.Load().ttl
+	return &resumeReader{ctx: ctx, cancel: cancel, backend: s.backend, id: id, next: lastEventID, timeout: timeout}, nil
+}
+
+// resumeReader reads the buffered events of a stream, and polls the new
+// ones until the stream completes.
+type resumeReader struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	backend Backend
+	id      string
+	// next is the index of the next event, which is also the ID of the
+	// last event read as IDs start from 1.
+	next    int64
+	timeout time.Duration
+	out     []byte
+	done    bool
+	idle    time.Time
+}
+
+func (r *resumeReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.poll(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// poll reads the new events, it waits if there is none.
+func (r *resumeReader) poll() error {
+	// the state is read before the events, so no event is missed if the
+	// stream completes in between.
+	state, _, err := r.backend.State(r.ctx, r.id)
+	if err != nil {
+		return err
+	}
+	events, err := r.backend.Events(r.ctx, r.id, r.next)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		r.next++
+		r.out = append(r.out, formatEvent(r.next, event)...)
+	}
+	if len(events) > 0 {
+		r.idle = time.Time{}
+		return nil
+	}
+
+	switch state {
+	case StateStreaming:
+	case "", StateDone:
+		r.done = true
+		return nil
+	default:
+		logger.Warnf("stream %s is not buffered completely, resumption ends at event %d", r.id, r.next)
+		r.done = true
+		return nil
+	}
+	if r.idle.IsZero() {
+		r.idle = time.Now()
+	} else if time.Since(r.idle) > r.timeout {
+		r.done = true
+		return nil
+	}
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-time.After(pollInterval):
+		return nil
+	}
+}
+
+func (r *resumeReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// formatEvent prepends the ID to the event.
+func formatEvent(id int64, event string) []byte {
+	out := make([]byte, 0, len(event)+16)
+	out = append(out, "id: "...)
+	out = strconv.AppendInt(out, id, 10)
+	out = append(out, '\n')
+	return append(out, event...)
+}
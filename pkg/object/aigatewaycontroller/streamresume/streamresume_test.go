@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package streamresume
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryBackend struct {
+	lock   sync.Mutex
+	states map[string]string
+	owners map[string]string
+	events map[string][]string
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{states: map[string]string{}, owners: map[string]string{}, events: map[string][]string{}}
+}
+
+func (b *memoryBackend) Append(ctx context.Context, id string, events []string, state string, owner string, ttl time.Duration) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.events[id] = append(b.events[id], events...)
+	b.states[id] = state
+	b.owners[id] = owner
+	return nil
+}
+
+func (b *memoryBackend) State(ctx context.Context, id string) (string, string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.states[id], b.owners[id], nil
+}
+
+func (b *memoryBackend) Events(ctx context.Context, id string, start int64) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	events := b.events[id]
+	if start >= int64(len(events)) {
+		return nil, nil
+	}
+	return append([]string(nil), events[start:]...), nil
+}
+
+func (b *memoryBackend) Close() {}
+
+// closeRecorder closes the recorder and waits for its writes.
+func closeRecorder(body io.ReadCloser) {
+	body.Close()
+	<-body.(*recorder).stopped
+}
+
+func TestValidateSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateSpec(nil))
+	assert.NoError(ValidateSpec(&Spec{URL: "redis://localhost:6379", TTL: "1m"}))
+	assert.Error(ValidateSpec(&Spec{}))
+	assert.Error(ValidateSpec(&Spec{URL: "redis://localhost:6379", TTL: "1s"}))
+	assert.Error(ValidateSpec(&Spec{URL: "redis://localhost:6379", TTL: "abc"}))
+	assert.Error(ValidateSpec(&Spec{URL: "redis://localhost:6379", MaxBytes: -1}))
+}
+
+func TestRecordAndResume(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newMemoryBackend()
+	store := NewWithBackend(&Spec{}, backend)
+	stream := "data: a\n\ndata: b\n\ndata: [DONE]\n\n"
+	body := store.Record("req-1", "Bearer key", strings.NewReader(stream), nil, nil)
+	data, err := io.ReadAll(body)
+	assert.NoError(err)
+	assert.Equal("id: 1\ndata: a\n\nid: 2\ndata: b\n\nid: 3\ndata: [DONE]\n\n", string(data))
+	closeRecorder(body)
+
+	assert.Equal(StateDone, backend.states["req-1"])
+	assert.Equal([]string{"data: a\n\n", "data: b\n\n", "data: [DONE]\n\n"}, backend.events["req-1"])
+	assert.NotContains(backend.owners["req-1"], "key")
+
+	resumed, err := store.Resume(context.Background(), "req-1", "Bearer key", 1)
+	assert.NoError(err)
+	data, err = io.ReadAll(resumed)
+	assert.NoError(err)
+	assert.Equal("id: 2\ndata: b\n\nid: 3\ndata: [DONE]\n\n", string(data))
+	resumed.Close()
+
+	// the stream is resumed by the owner only.
+	_, err = store.Resume(context.Background(), "req-1", "Bearer other", 1)
+	assert.ErrorIs(err, ErrNotFound)
+	_, err = store.Resume(context.Background(), "req-2", "Bearer key", 0)
+	assert.ErrorIs(err, ErrNotFound)
+}
+
+func TestResumeLiveTail(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newMemoryBackend()
+	store := NewWithBackend(&Spec{}, backend)
+	pr, pw := io.Pipe()
+	body := store.Record("req-1", "", pr, pr, pr)
+
+	go func() {
+		pw.Write([]byte("data: a\n\n"))
+		pw.Write([]byte("data: b\n\n"))
+	}()
+	buf := make([]byte, 64)
+	n, err := body.Read(buf)
+	assert.NoError(err)
+	assert.Equal("id: 1\ndata: a\n\n", string(buf[:n]))
+
+	// the client goes away, the rest is buffered in background.
+	body.Close()
+
+	assert.Eventually(func() bool {
+		events, _ := backend.Events(context.Background(), "req-1", 0)
+		return len(events) >= 1
+	}, time.Second, 10*time.Millisecond)
+	resumed, err := store.Resume(context.Background(), "req-1", "", 1)
+	assert.NoError(err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pw.Write([]byte("data: c\n\ndata: [DONE]\n\n"))
+		pw.Close()
+	}()
+	data, err := io.ReadAll(resumed)
+	assert.NoError(err)
+	assert.Equal("id: 2\ndata: b\n\nid: 3\ndata: c\n\nid: 4\ndata: [DONE]\n\n", string(data))
+	<-body.(*recorder).stopped
+	assert.Equal(StateDone, backend.states["req-1"])
+}
+
+func TestRecordIncomplete(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newMemoryBackend()
+	store := NewWithBackend(&Spec{MaxBytes: 16}, backend)
+	stream := "data: aaaa\n\ndata: bbbb\n\ndata: [DONE]\n\n"
+	body := store.Record("req-1", "", strings.NewReader(stream), nil, nil)
+	data, err := io.ReadAll(body)
+	assert.NoError(err)
+	// the client gets the whole stream anyway.
+	assert.Equal("id: 1\ndata: aaaa\n\nid: 2\ndata: bbbb\n\nid: 3\ndata: [DONE]\n\n", string(data))
+	closeRecorder(body)
+
+	assert.Equal(StateIncomplete, backend.states["req-1"])
+	_, err = store.Resume(context.Background(), "req-1", "", 0)
+	assert.ErrorIs(err, ErrIncomplete)
+}
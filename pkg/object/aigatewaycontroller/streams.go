@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aigatewaycontroller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+
+	"github.com/megaease/easegress/v2/pkg/context"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/aicontext"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/streamresume"
+	"github.com/megaease/easegress/v2/pkg/protocols/httpprot"
+)
+
+const (
+	// requestIDHeader identifies a stream to resume, it is generated and
+	// returned in the response if the request does not have one.
+	requestIDHeader   = "X-Request-Id"
+	lastEventIDHeader = "Last-Event-ID"
+
+	errCodeInvalidResumption = "invalid_resumption"
+	errCodeStreamNotFound    = "stream_not_found"
+	errCodeStreamIncomplete  = "stream_incomplete"
+)
+
+// reloadStreams reuses the stream store of the previous generation if the
+// Redis is not changed, so the streams being buffered are not broken.
+func (agc *AIGatewayController) reloadStreams(prev *AIGatewayController) string {
+	var store *streamresume.Store
+	if prev != nil {
+		store = prev.streams
+	}
+	spec := agc.spec.StreamResumption
+	if store != nil && (spec == nil || spec.URL != prev.spec.StreamResumption.URL) {
+		store.Close()
+		store = nil
+		if spec == nil {
+			return componentClosed
+		}
+	}
+	if spec == nil {
+		return ""
+	}
+	if store != nil {
+		store.SetSpec(spec)
+		agc.streams = store
+		return componentKept
+	}
+	store, err := streamresume.New(spec)
+	if err != nil {
+		logger.Errorf("failed to create stream store: %v", err)
+		return componentFailed
+	}
+	agc.streams = store
+	if prev != nil && prev.streams != nil {
+		return componentRecreated
+	}
+	return componentCreated
+}
+
+// detachStream makes a streaming request resumable, the request gets an ID
+// if it does not have one.
+func (agc *AIGatewayController) detachStream(aiCtx *aicontext.Context) {
+	if agc.streams == nil || !aiCtx.ReqInfo.Stream {
+		return
+	}
+	if aiCtx.Req.HTTPHeader().Get(requestIDHeader) == "" {
+		aiCtx.Req.HTTPHeader().Set(requestIDHeader, uuid.NewString())
+	}
+	aiCtx.Detached = true
+}
+
+// recordStream buffers the successful streaming response of a detached
+// request, live is the body sent to the client.
+func (agc *AIGatewayController) recordStream(aiCtx *aicontext.Context, egResp *httpprot.Response, live io.Reader) io.Reader {
+	aiResp := aiCtx.GetResponse()
+	if !aiCtx.Detached || aiResp.StatusCode != http.StatusOK {
+		return live
+	}
+	header := aiCtx.Req.HTTPHeader()
+	requestID := header.Get(requestIDHeader)
+	egResp.HTTPHeader().Set(requestIDHeader, requestID)
+	body := agc.streams.Record(requestID, header.Get(agc.streams.OwnerHeader()), live, aiResp.BodyReader, aiCtx.UpstreamBody)
+	// the upstream is closed by the buffer.
+	aiCtx.UpstreamBody = nil
+	return body
+}
+
+// resumeStream serves the request resuming a stream, which has the
+// Last-Event-ID header. It returns false if the request is not one.
+func (agc *AIGatewayController) resumeStream(ctx *context.Context) (string, bool) {
+	if agc.streams == nil {
+		return "", false
+	}
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	header := req.HTTPHeader()
+	lastEventID := header.Get(lastEventIDHeader)
+	if lastEventID == "" {
+		return "", false
+	}
+
+	requestID := header.Get(requestIDHeader)
+	id, err := strconv.ParseInt(lastEventID, 10, 64)
+	if requestID == "" || err != nil || id < 0 {
+		message := fmt.Sprintf("Invalid resumption: the %s header and a non-negative %s header are required.", requestIDHeader, lastEventIDHeader)
+		setEndpointErrResponse(ctx, http.StatusBadRequest, errCodeInvalidResumption, message)
+		return string(aicontext.ResultClientError), true
+	}
+
+	body, err := agc.streams.Resume(req.Context(), requestID, header.Get(agc.streams.OwnerHeader()), id)
+	switch {
+	case errors.Is(err, streamresume.ErrNotFound):
+		message := fmt.Sprintf("Stream %s is not found, it may be expired.", requestID)
+		setEndpointErrResponse(ctx, http.StatusNotFound, errCodeStreamNotFound, message)
+		return string(aicontext.ResultClientError), true
+	case errors.Is(err, streamresume.ErrIncomplete):
+		message := fmt.Sprintf("Stream %s cannot be resumed, it is not buffered completely.", requestID)
+		setEndpointErrResponse(ctx, http.StatusGone, errCodeStreamIncomplete, message)
+		return string(aicontext.ResultClientError), true
+	case err != nil:
+		agc.setErrResponse(ctx, fmt.Errorf("failed to resume stream %s: %w", requestID, err))
+		return string(aicontext.ResultInternalError), true
+	}
+
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil {
+		resp, _ = httpprot.NewResponse(nil)
+	}
+	resp.SetStatusCode(http.StatusOK)
+	resp.HTTPHeader().Set("Content-Type", "text/event-stream")
+	resp.HTTPHeader().Set("Cache-Control", "no-cache")
+	resp.HTTPHeader().Set(requestIDHeader, requestID)
+	resp.SetPayload(body)
+	ctx.SetOutputResponse(resp)
+	return string(aicontext.ResultOk), true
+}
@@ -0,0 +1,390 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package usagesink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	defaultKafkaBufferSize    = 10000
+	defaultKafkaBatchSize     = 100
+	defaultKafkaFlushInterval = 500 * time.Millisecond
+	kafkaRetryBackoff         = time.Second
+
+	// kafkaRequestIDHeader is the record header carrying the request ID.
+	kafkaRequestIDHeader = "requestID"
+
+	eventResultSent    = "sent"
+	eventResultDropped = "dropped"
+	eventResultRetried = "retried"
+)
+
+type (
+	// KafkaSpec describes the Kafka usage sink.
+	KafkaSpec struct {
+		Brokers []string `json:"brokers" jsonschema:"required"`
+		Topic   string   `json:"topic" jsonschema:"required"`
+		// Compression is the compression codec of messages.
+		Compression string         `json:"compression,omitempty" jsonschema:"enum=,enum=none,enum=gzip,enum=snappy,enum=lz4,enum=zstd"`
+		TLS         *KafkaTLSSpec  `json:"tls,omitempty"`
+		SASL        *KafkaSASLSpec `json:"sasl,omitempty"`
+		// BufferSize is the maximum number of events not acknowledged by
+		// Kafka, events are dropped when the buffer is full.
+		BufferSize    int    `json:"bufferSize,omitempty"`
+		BatchSize     int    `json:"batchSize,omitempty"`
+		FlushInterval string `json:"flushInterval,omitempty" jsonschema:"format=duration"`
+	}
+
+	// KafkaTLSSpec describes the TLS config to connect to Kafka.
+	KafkaTLSSpec struct {
+		CaCertBase64       string `json:"caCertBase64,omitempty" jsonschema:"format=base64"`
+		CertBase64         string `json:"certBase64,omitempty" jsonschema:"format=base64"`
+		KeyBase64          string `json:"keyBase64,omitempty" jsonschema:"format=base64"`
+		InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+	}
+
+	// KafkaSASLSpec describes the SASL authentication of Kafka.
+	KafkaSASLSpec struct {
+		Mechanism string `json:"mechanism,omitempty" jsonschema:"enum=,enum=PLAIN"`
+		Username  string `json:"username" jsonschema:"required"`
+		Password  string `json:"password" jsonschema:"required"`
+	}
+
+	// kafkaSink produces usage events to Kafka asynchronously. The events
+	// are buffered in memory until Kafka acknowledges them, and failed
+	// events are retried, so events are only dropped when the buffer is full.
+	kafkaSink struct {
+		name        string
+		spec        *KafkaSpec
+		newProducer func() (sarama.AsyncProducer, error)
+
+		// slots limits the number of events not acknowledged by Kafka.
+		slots chan struct{}
+		queue chan *sarama.ProducerMessage
+
+		events  *prometheus.CounterVec
+		sent    atomic.Int64
+		dropped atomic.Int64
+
+		closed    atomic.Bool
+		done      chan struct{}
+		closeOnce sync.Once
+		wg        sync.WaitGroup
+	}
+)
+
+var kafkaCompressions = map[string]sarama.CompressionCodec{
+	"":       sarama.CompressionNone,
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+func validateKafkaSpec(spec *KafkaSpec) error {
+	if len(spec.Brokers) == 0 {
+		return fmt.Errorf("kafka usage sink must have at least one broker")
+	}
+	if spec.Topic == "" {
+		return fmt.Errorf("kafka usage sink must have a topic")
+	}
+	if _, ok := kafkaCompressions[spec.Compression]; !ok {
+		return fmt.Errorf("invalid kafka compression %s", spec.Compression)
+	}
+	if spec.BufferSize < 0 || spec.BatchSize < 0 {
+		return fmt.Errorf("bufferSize and batchSize of kafka usage sink must not be negative")
+	}
+	if spec.FlushInterval != "" {
+		if _, err := time.ParseDuration(spec.FlushInterval); err != nil {
+			return fmt.Errorf("invalid flushInterval of kafka usage sink: %w", err)
+		}
+	}
+	if spec.SASL != nil && spec.SASL.Mechanism != "" && spec.SASL.Mechanism != sarama.SASLTypePlaintext {
+		return fmt.Errorf("unsupported SASL mechanism %s", spec.SASL.Mechanism)
+	}
+	if spec.TLS != nil {
+		if _, err := newKafkaTLSConfig(spec.TLS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newKafkaTLSConfig(spec *KafkaTLSSpec) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: spec.InsecureSkipVerify}
+	if spec.CaCertBase64 != "" {
+		caCert, err := base64.StdEncoding.DecodeString(spec.CaCertBase64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode caCertBase64: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("invalid CA certificate")
+		}
+		config.RootCAs = pool
+	}
+	if spec.CertBase64 != "" || spec.KeyBase64 != "" {
+		cert, err := base64.StdEncoding.DecodeString(spec.CertBase64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode certBase64: %w", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(spec.KeyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode keyBase64: %w", err)
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// newKafkaConfig creates the config of an idempotent async producer.
+func newKafkaConfig(name string, spec *KafkaSpec) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = name
+	config.Version = sarama.V2_1_0_0
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Idempotent = true
+	config.Net.MaxOpenRequests = 1
+	config.Producer.Compression = kafkaCompressions[spec.Compression]
+
+	config.Producer.Flush.Messages = defaultKafkaBatchSize
+	if spec.BatchSize > 0 {
+		config.Producer.Flush.Messages = spec.BatchSize
+	}
+	config.Producer.Flush.Frequency = defaultKafkaFlushInterval
+	if spec.FlushInterval != "" {
+		config.Producer.Flush.Frequency, _ = time.ParseDuration(spec.FlushInterval)
+	}
+
+	if spec.TLS != nil {
+		tlsConfig, err := newKafkaTLSConfig(spec.TLS)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	if spec.SASL != nil {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		config.Net.SASL.User = spec.SASL.Username
+		config.Net.SASL.Password = spec.SASL.Password
+	}
+	return config, config.Validate()
+}
+
+func newKafkaSink(name string, spec *KafkaSpec) (*kafkaSink, error) {
+	config, err := newKafkaConfig(name, spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kafka config: %w", err)
+	}
+	s := newKafkaSinkWithProducer(name, spec, func() (sarama.AsyncProducer, error) {
+		return sarama.NewAsyncProducer(spec.Brokers, config)
+	})
+	return s, nil
+}
+
+func newKafkaSinkWithProducer(name string, spec *KafkaSpec, newProducer func() (sarama.AsyncProducer, error)) *kafkaSink {
+	bufferSize := defaultKafkaBufferSize
+	if spec.BufferSize > 0 {
+		bufferSize = spec.BufferSize
+	}
+	s := &kafkaSink{
+		name:        name,
+		spec:        spec,
+		newProducer: newProducer,
+		slots:       make(chan struct{}, bufferSize),
+		queue:       make(chan *sarama.ProducerMessage, bufferSize),
+		events:      metricshub.UsageSinkEvents.NewCounter(),
+		done:        make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *kafkaSink) count(result string) {
+	switch result {
+	case eventResultSent:
+		s.sent.Add(1)
+	case eventResultDropped:
+		s.dropped.Add(1)
+	}
+	if s.events != nil {
+		s.events.With(prometheus.Labels{"sink": s.name, "result": result}).Inc()
+	}
+}
+
+// Send buffers the event, it drops the event if the buffer is full.
+func (s *kafkaSink) Send(event *Event) {
+	if s.closed.Load() {
+		s.count(eventResultDropped)
+		return
+	}
+	data, err := codectool.MarshalJSON(event)
+	if err != nil {
+		logger.Errorf("failed to marshal usage event: %v", err)
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.count(eventResultDropped)
+		return
+	}
+
+	// the partition key is the consumer ID, so the events of a consumer
+	// are ordered, the request ID is used if there is no consumer ID.
+	key := event.ConsumerID
+	if key == "" {
+		key = event.RequestID
+	}
+	// the queue has the same capacity as the slots, so it never blocks.
+	s.queue <- &sarama.ProducerMessage{
+		Topic: s.spec.Topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(data),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(kafkaRequestIDHeader), Value: []byte(event.RequestID)},
+		},
+	}
+}
+
+// run connects to Kafka and produces the buffered events. Events are kept
+// in the buffer while Kafka is unreachable.
+func (s *kafkaSink) run() {
+	defer s.wg.Done()
+
+	var producer sarama.AsyncProducer
+	for producer == nil {
+		p, err := s.newProducer()
+		if err == nil {
+			producer = p
+			break
+		}
+		logger.Errorf("failed to create kafka producer of usage sink %s: %v", s.name, err)
+		select {
+		case <-s.done:
+			return
+		case <-time.After(kafkaRetryBackoff):
+		}
+	}
+
+	s.wg.Add(1)
+	go s.handleResults(producer)
+
+	defer producer.AsyncClose()
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.queue:
+			select {
+			case producer.Input() <- msg:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// handleResults releases the buffer of acknowledged events, and retries
+// the failed ones.
+func (s *kafkaSink) handleResults(producer sarama.AsyncProducer) {
+	defer s.wg.Done()
+
+	successes, errors := producer.Successes(), producer.Errors()
+	for successes != nil || errors != nil {
+		select {
+		case _, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			<-s.slots
+			s.count(eventResultSent)
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			s.retry(err)
+		}
+	}
+}
+
+func (s *kafkaSink) retry(err *sarama.ProducerError) {
+	if s.closed.Load() {
+		<-s.slots
+		s.count(eventResultDropped)
+		return
+	}
+	logger.Warnf("failed to produce usage event to kafka, retry later: %v", err.Err)
+	s.count(eventResultRetried)
+
+	msg := &sarama.ProducerMessage{
+		Topic:   err.Msg.Topic,
+		Key:     err.Msg.Key,
+		Value:   err.Msg.Value,
+		Headers: err.Msg.Headers,
+	}
+	go func() {
+		select {
+		case <-time.After(kafkaRetryBackoff):
+			// the event keeps its slot, so the queue never blocks.
+			s.queue <- msg
+		case <-s.done:
+			<-s.slots
+			s.count(eventResultDropped)
+		}
+	}()
+}
+
+// Close stops the sink, the events not sent yet are dropped.
+func (s *kafkaSink) Close() {
+	s.closeOnce.Do(func() {
+		s.closed.Store(true)
+		close(s.done)
+		s.wg.Wait()
+		if n := len(s.slots); n > 0 {
+			logger.Warnf("usage sink %s is closed with %d events not sent", s.name, n)
+		}
+	})
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package usagesink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func skipDockerTest() bool {
+	// For windows and mac, the github action runner does not support docker for now.
+	skipDocker := os.Getenv("EASEGRESS_TEST_SKIP_DOCKER")
+	return skipDocker == "true"
+}
+
+func newMockConfig() *sarama.Config {
+	config := mocks.NewTestConfig()
+	config.Producer.Return.Successes = true
+	return config
+}
+
+func newTestEvent(i int) *Event {
+	return &Event{
+		RequestID:  fmt.Sprintf("request-%d", i),
+		ConsumerID: "consumer",
+		Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
+		Metric: metricshub.Metric{
+			Success:      true,
+			Provider:     "openai",
+			Model:        "gpt-4o",
+			InputTokens:  10,
+			OutputTokens: 20,
+		},
+	}
+}
+
+func TestValidateKafkaSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error(ValidateSpec(&Spec{}))
+	assert.Error(ValidateSpec(&Spec{Kafka: &KafkaSpec{Topic: "usage"}}))
+	assert.Error(ValidateSpec(&Spec{Kafka: &KafkaSpec{Brokers: []string{"localhost:9092"}}}))
+
+	spec := &KafkaSpec{Brokers: []string{"localhost:9092"}, Topic: "usage"}
+	assert.NoError(ValidateSpec(&Spec{Kafka: spec}))
+
+	spec.Compression = "brotli"
+	assert.Error(validateKafkaSpec(spec))
+	spec.Compression = "zstd"
+	assert.NoError(validateKafkaSpec(spec))
+
+	spec.FlushInterval = "1x"
+	assert.Error(validateKafkaSpec(spec))
+	spec.FlushInterval = "100ms"
+	assert.NoError(validateKafkaSpec(spec))
+
+	spec.SASL = &KafkaSASLSpec{Mechanism: "SCRAM-SHA-512", Username: "u", Password: "p"}
+	assert.Error(validateKafkaSpec(spec))
+	spec.SASL.Mechanism = "PLAIN"
+	assert.NoError(validateKafkaSpec(spec))
+
+	spec.TLS = &KafkaTLSSpec{CaCertBase64: "not base64"}
+	assert.Error(validateKafkaSpec(spec))
+	spec.TLS = &KafkaTLSSpec{InsecureSkipVerify: true}
+	assert.NoError(validateKafkaSpec(spec))
+
+	config, err := newKafkaConfig("test", spec)
+	assert.NoError(err)
+	assert.True(config.Producer.Idempotent)
+	assert.Equal(sarama.CompressionZSTD, config.Producer.Compression)
+	assert.Equal(100*time.Millisecond, config.Producer.Flush.Frequency)
+	assert.True(config.Net.TLS.Enable)
+	assert.True(config.Net.SASL.Enable)
+}
+
+func TestKafkaSinkDelivery(t *testing.T) {
+	assert := assert.New(t)
+
+	producer := mocks.NewAsyncProducer(t, newMockConfig())
+	messages := make(chan *sarama.ProducerMessage, 10)
+	for i := 0; i < 10; i++ {
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			messages <- msg
+			return nil
+		})
+	}
+
+	spec := &KafkaSpec{Brokers: []string{"localhost:9092"}, Topic: "usage"}
+	sink := newKafkaSinkWithProducer("test", spec, func() (sarama.AsyncProducer, error) {
+		return producer, nil
+	})
+	for i := 0; i < 10; i++ {
+		sink.Send(newTestEvent(i))
+	}
+	assert.Eventually(func() bool { return sink.sent.Load() == 10 }, 5*time.Second, 10*time.Millisecond)
+	sink.Close()
+	assert.Zero(sink.dropped.Load())
+
+	msg := <-messages
+	key, _ := msg.Key.Encode()
+	assert.Equal("consumer", string(key))
+	assert.Equal(kafkaRequestIDHeader, string(msg.Headers[0].Key))
+	assert.Equal("request-0", string(msg.Headers[0].Value))
+
+	value, _ := msg.Value.Encode()
+	event := &Event{}
+	assert.NoError(codectool.UnmarshalJSON(value, event))
+	assert.Equal("request-0", event.RequestID)
+	assert.Equal(int64(20), event.OutputTokens)
+
+	// events sent after close are dropped.
+	sink.Send(newTestEvent(10))
+	assert.Equal(int64(1), sink.dropped.Load())
+}
+
+func TestKafkaSinkRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	producer := mocks.NewAsyncProducer(t, newMockConfig())
+	producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	producer.ExpectInputAndSucceed()
+
+	spec := &KafkaSpec{Brokers: []string{"localhost:9092"}, Topic: "usage"}
+	sink := newKafkaSinkWithProducer("test", spec, func() (sarama.AsyncProducer, error) {
+		return producer, nil
+	})
+	sink.Send(newTestEvent(0))
+	assert.Eventually(func() bool { return sink.sent.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	sink.Close()
+	assert.Zero(sink.dropped.Load())
+}
+
+func TestKafkaSinkOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	// the broker is unreachable, events are kept in the buffer until it
+	// overflows.
+	spec := &KafkaSpec{Brokers: []string{"localhost:9092"}, Topic: "usage", BufferSize: 5}
+	sink := newKafkaSinkWithProducer("test", spec, func() (sarama.AsyncProducer, error) {
+		return nil, sarama.ErrOutOfBrokers
+	})
+	defer sink.Close()
+
+	for i := 0; i < 5; i++ {
+		sink.Send(newTestEvent(i))
+	}
+	assert.Zero(sink.dropped.Load())
+	for i := 5; i < 8; i++ {
+		sink.Send(newTestEvent(i))
+	}
+	assert.Equal(int64(3), sink.dropped.Load())
+	assert.Zero(sink.sent.Load())
+}
+
+func TestKafkaSinkEndToEnd(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	req := testcontainers.ContainerRequest{
+		Image: "apache/kafka:3.9.0",
+		// kafka advertises the listener address to clients, so the host
+		// port must be fixed.
+		ExposedPorts: []string{"19092:19092/tcp"},
+		Env: map[string]string{
+			"KAFKA_NODE_ID":                                  "1",
+			"KAFKA_PROCESS_ROLES":                            "broker,controller",
+			"KAFKA_LISTENERS":                                "PLAINTEXT://:19092,CONTROLLER://:9093",
+			"KAFKA_ADVERTISED_LISTENERS":                     "PLAINTEXT://localhost:19092",
+			"KAFKA_CONTROLLER_LISTENER_NAMES":                "CONTROLLER",
+			"KAFKA_LISTENER_SECURITY_PROTOCOL_MAP":           "CONTROLLER:PLAINTEXT,PLAINTEXT:PLAINTEXT",
+			"KAFKA_CONTROLLER_QUORUM_VOTERS":                 "1@localhost:9093",
+			"KAFKA_OFFSETS_TOPIC_REPLICATION_FACTOR":         "1",
+			"KAFKA_TRANSACTION_STATE_LOG_REPLICATION_FACTOR": "1",
+			"KAFKA_TRANSACTION_STATE_LOG_MIN_ISR":            "1",
+			"KAFKA_AUTO_CREATE_TOPICS_ENABLE":                "true",
+		},
+		WaitingFor: wait.ForLog("Kafka Server started").WithStartupTimeout(2 * time.Minute),
+	}
+	kafkaC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Kafka container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, kafkaC)
+
+	brokers := []string{"localhost:19092"}
+	spec := &KafkaSpec{Brokers: brokers, Topic: "usage", Compression: "zstd", FlushInterval: "10ms"}
+	sink, err := newKafkaSink("test", spec)
+	assert.NoError(err)
+	for i := 0; i < 10; i++ {
+		sink.Send(newTestEvent(i))
+	}
+	assert.Eventually(func() bool { return sink.sent.Load() == 10 }, time.Minute, 100*time.Millisecond)
+	sink.Close()
+
+	consumer, err := sarama.NewConsumer(brokers, sarama.NewConfig())
+	if err != nil {
+		t.Fatalf("Failed to create Kafka consumer: %v", err)
+	}
+	defer consumer.Close()
+	pc, err := consumer.ConsumePartition("usage", 0, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatalf("Failed to consume partition: %v", err)
+	}
+	defer pc.Close()
+
+	requestIDs := map[string]struct{}{}
+	timeout := time.After(30 * time.Second)
+	for len(requestIDs) < 10 {
+		select {
+		case msg := <-pc.Messages():
+			event := &Event{}
+			assert.NoError(codectool.UnmarshalJSON(msg.Value, event))
+			requestIDs[event.RequestID] = struct{}{}
+		case <-timeout:
+			t.Fatalf("only %d events received", len(requestIDs))
+		}
+	}
+}
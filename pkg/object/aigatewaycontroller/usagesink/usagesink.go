@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package usagesink sends the usage events of AI requests to external systems.
+package usagesink
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+type (
+	// Spec describes the usage sink of AIGatewayController.
+	Spec struct {
+		Kafka *KafkaSpec `json:"kafka,omitempty"`
+		// Region is the data residency region of the sink, the events of
+		// consumers pinned to other regions are not sent.
+		Region string `json:"region,omitempty"`
+	}
+
+	// Event is the usage record of a request.
+	Event struct {
+		// RequestID identifies the request, downstream systems dedup events
+		// by it after retries.
+		RequestID  string `json:"requestID"`
+		ConsumerID string `json:"consumerID,omitempty"`
+		Timestamp  string `json:"timestamp"`
+		// Flags is the feature flags resolved for the request.
+		Flags map[string]bool `json:"flags,omitempty"`
+		metricshub.Metric
+	}
+
+	// Sink sends usage events. Send must not block, and it is safe to
+	// call Send after Close, the events are dropped then.
+	Sink interface {
+		Send(event *Event)
+		Close()
+	}
+)
+
+// ValidateSpec validates the usage sink spec.
+func ValidateSpec(spec *Spec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.Kafka == nil {
+		return fmt.Errorf("usage sink must have a kafka spec")
+	}
+	return validateKafkaSpec(spec.Kafka)
+}
+
+// New creates the usage sink of the spec.
+func New(name string, spec *Spec) (Sink, error) {
+	return newKafkaSink(name, spec.Kafka)
+}
@@ -0,0 +1,431 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package usagestore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+const (
+	// FSyncAlways syncs the journal before every append returns.
+	FSyncAlways = "always"
+	// FSyncInterval syncs the journal periodically.
+	FSyncInterval = "interval"
+	// FSyncNever leaves the sync to the operating system.
+	FSyncNever = "never"
+
+	defaultSegmentSize       = 16 << 20
+	defaultFSyncInterval     = time.Second
+	defaultIdempotencyWindow = 5 * time.Minute
+
+	journalIDFile     = "id"
+	journalAckFile    = "ack"
+	journalSegmentExt = ".wal"
+)
+
+type (
+	// JournalSpec describes the write-ahead journal of the usage store.
+	// The usage of every request is appended to the journal on local
+	// disk before it is aggregated, and the records not saved to the
+	// cluster yet are replayed after a crash.
+	JournalSpec struct {
+		// Dir is the directory of the journal, it must not be shared by
+		// other members.
+		Dir string `json:"dir" jsonschema:"required"`
+		// SegmentSize is the size in bytes of a journal segment before
+		// rotating to a new one.
+		SegmentSize int64 `json:"segmentSize,omitempty"`
+		// FSync is the sync policy of the journal.
+		FSync         string `json:"fsync,omitempty" jsonschema:"enum=,enum=always,enum=interval,enum=never"`
+		FSyncInterval string `json:"fsyncInterval,omitempty" jsonschema:"format=duration"`
+		// IdempotencyWindow is how long the request IDs are remembered,
+		// the usage of a request ID is counted once in the window.
+		IdempotencyWindow string `json:"idempotencyWindow,omitempty" jsonschema:"format=duration"`
+	}
+
+	// journalRecord is the usage of a request, it keeps the bucket the
+	// usage was aggregated to, so replays are not affected by changes of
+	// the bucket width.
+	journalRecord struct {
+		Seq          int64  `json:"seq"`
+		RequestID    string `json:"requestID,omitempty"`
+		Start        int64  `json:"start"`
+		Width        int64  `json:"width"`
+		Consumer     string `json:"consumer,omitempty"`
+		Provider     string `json:"provider"`
+		Model        string `json:"model"`
+		Success      bool   `json:"success"`
+		InputTokens  int64  `json:"inputTokens,omitempty"`
+		OutputTokens int64  `json:"outputTokens,omitempty"`
+	}
+
+	// journal is an append only log split into segments named by the
+	// sequence of their first records. The sequence of the last record
+	// saved to the cluster is kept in the ack file, and the segments
+	// whose records are all acknowledged are deleted.
+	journal struct {
+		dir         string
+		id          string
+		segmentSize int64
+		fsync       string
+
+		lock     sync.Mutex
+		file     *os.File
+		size     int64
+		dirty    bool
+		seq      int64
+		acked    int64
+		segments []int64
+
+		done chan struct{}
+		wg   sync.WaitGroup
+	}
+)
+
+func validateJournalSpec(spec *JournalSpec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.Dir == "" {
+		return fmt.Errorf("dir of journal cannot be empty")
+	}
+	if spec.SegmentSize < 0 {
+		return fmt.Errorf("segment size of journal cannot be negative")
+	}
+	switch spec.FSync {
+	case "", FSyncAlways, FSyncInterval, FSyncNever:
+	default:
+		return fmt.Errorf("invalid fsync policy of journal: %s", spec.FSync)
+	}
+	if spec.FSyncInterval != "" {
+		d, err := time.ParseDuration(spec.FSyncInterval)
+		if err != nil {
+			return fmt.Errorf("invalid fsync interval of journal: %w", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("fsync interval of journal must be positive")
+		}
+	}
+	if spec.IdempotencyWindow != "" {
+		d, err := time.ParseDuration(spec.IdempotencyWindow)
+		if err != nil {
+			return fmt.Errorf("invalid idempotency window of journal: %w", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("idempotency window of journal cannot be negative")
+		}
+	}
+	return nil
+}
+
+// openJournal opens the journal in the directory of the spec, it returns
+// the records not acknowledged yet in the order of their sequences.
+func openJournal(spec *JournalSpec) (*journal, []*journalRecord, error) {
+	if err := os.MkdirAll(spec.Dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	j := &journal{
+		dir:         spec.Dir,
+		segmentSize: spec.SegmentSize,
+		fsync:       spec.FSync,
+		done:        make(chan struct{}),
+	}
+	if j.segmentSize == 0 {
+		j.segmentSize = defaultSegmentSize
+	}
+	if j.fsync == "" {
+		j.fsync = FSyncInterval
+	}
+
+	id, err := j.loadID()
+	if err != nil {
+		return nil, nil, err
+	}
+	j.id = id
+	if data, err := os.ReadFile(filepath.Join(j.dir, journalAckFile)); err == nil {
+		j.acked, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	j.seq = j.acked
+
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), journalSegmentExt)
+		if name == e.Name() {
+			continue
+		}
+		if first, err := strconv.ParseInt(name, 10, 64); err == nil {
+			j.segments = append(j.segments, first)
+		}
+	}
+	sort.Slice(j.segments, func(a, b int) bool { return j.segments[a] < j.segments[b] })
+
+	pending := []*journalRecord{}
+	for _, first := range j.segments {
+		records, err := j.readSegment(first)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range records {
+			if r.Seq > j.seq {
+				j.seq = r.Seq
+			}
+			if r.Seq > j.acked {
+				pending = append(pending, r)
+			}
+		}
+	}
+
+	if j.fsync == FSyncInterval {
+		interval := defaultFSyncInterval
+		if d, err := time.ParseDuration(spec.FSyncInterval); err == nil {
+			interval = d
+		}
+		j.wg.Add(1)
+		go j.run(interval)
+	}
+	return j, pending, nil
+}
+
+// loadID loads the ID of the journal, the buckets remember the journal
+// their records come from, so a recreated journal is never mistaken for
+// the old one.
+func (j *journal) loadID() (string, error) {
+	p := filepath.Join(j.dir, journalIDFile)
+	data, err := os.ReadFile(p)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	id := uuid.NewString()
+	if err := writeFileSync(p, []byte(id)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (j *journal) segmentPath(first int64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d%s", first, journalSegmentExt))
+}
+
+// readSegment reads the records of a segment, it stops at the first
+// incomplete record, which is written partially by a crash.
+func (j *journal) readSegment(first int64) ([]*journalRecord, error) {
+	f, err := os.Open(j.segmentPath(first))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []*journalRecord{}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if len(line) > 0 {
+				logger.Warnf("ignore the incomplete record at the end of AI gateway usage journal %s", f.Name())
+			}
+			return records, nil
+		}
+		r := &journalRecord{}
+		if err := json.Unmarshal(line, r); err != nil {
+			logger.Warnf("ignore the corrupted records of AI gateway usage journal %s: %v", f.Name(), err)
+			return records, nil
+		}
+		records = append(records, r)
+	}
+}
+
+func (j *journal) run(interval time.Duration) {
+	defer j.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			j.lock.Lock()
+			if err := j.sync(); err != nil {
+				logger.Errorf("failed to sync AI gateway usage journal: %v", err)
+			}
+			j.lock.Unlock()
+		case <-j.done:
+			return
+		}
+	}
+}
+
+func (j *journal) sync() error {
+	if !j.dirty || j.file == nil {
+		return nil
+	}
+	j.dirty = false
+	return j.file.Sync()
+}
+
+// append assigns the next sequence to the record and appends it.
+func (j *journal) append(r *journalRecord) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.file == nil || j.size >= j.segmentSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	j.seq++
+	r.Seq = j.seq
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	n, err := j.file.Write(data)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if j.fsync == FSyncAlways {
+		return j.file.Sync()
+	}
+	j.dirty = true
+	return nil
+}
+
+// rotate closes the current segment and creates a new one starting from
+// the next sequence.
+func (j *journal) rotate() error {
+	if j.file != nil {
+		if err := j.sync(); err != nil {
+			return err
+		}
+		j.file.Close()
+		j.file = nil
+	}
+	first := j.seq + 1
+	f, err := os.OpenFile(j.segmentPath(first), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(j.dir); err != nil {
+		f.Close()
+		return err
+	}
+	j.file, j.size = f, 0
+	j.segments = append(j.segments, first)
+	return nil
+}
+
+// lastSeq returns the sequence of the last appended record.
+func (j *journal) lastSeq() int64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.seq
+}
+
+// ack acknowledges the records up to seq are saved, and deletes the
+// segments whose records are all acknowledged.
+func (j *journal) ack(seq int64) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if seq <= j.acked {
+		return nil
+	}
+	err := writeFileSync(filepath.Join(j.dir, journalAckFile), []byte(strconv.FormatInt(seq, 10)))
+	if err != nil {
+		return err
+	}
+	j.acked = seq
+
+	// the last segment is kept for appending.
+	for len(j.segments) > 1 && j.segments[1]-1 <= seq {
+		if err := os.Remove(j.segmentPath(j.segments[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		j.segments = j.segments[1:]
+	}
+	return nil
+}
+
+func (j *journal) close() {
+	close(j.done)
+	j.wg.Wait()
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return
+	}
+	if err := j.sync(); err != nil {
+		logger.Errorf("failed to sync AI gateway usage journal: %v", err)
+	}
+	j.file.Close()
+	j.file = nil
+}
+
+// writeFileSync replaces the file atomically and syncs it to disk.
+func writeFileSync(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
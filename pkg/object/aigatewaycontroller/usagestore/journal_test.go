@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package usagestore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crash stops the store like a crashed member, the buckets changed after
+// the last save are not saved and the journal is not acknowledged.
+func crash(s *Store) {
+	close(s.done)
+	s.wg.Wait()
+	s.journal.close()
+}
+
+func totalRequests(s *Store) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	total := int64(0)
+	for _, mb := range s.buckets {
+		for _, c := range mb.labels {
+			total += c.Requests
+		}
+	}
+	return total
+}
+
+func segmentFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+journalSegmentExt))
+	return files
+}
+
+func TestValidateJournalSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateSpec(&Spec{Journal: &JournalSpec{Dir: "/tmp/journal", FSync: FSyncAlways}}))
+	assert.NoError(ValidateSpec(&Spec{Journal: &JournalSpec{Dir: "/tmp/journal", FSyncInterval: "100ms", IdempotencyWindow: "0s"}}))
+	assert.Error(ValidateSpec(&Spec{Journal: &JournalSpec{}}))
+	assert.Error(ValidateSpec(&Spec{Journal: &JournalSpec{Dir: "/tmp/journal", SegmentSize: -1}}))
+	assert.Error(ValidateSpec(&Spec{Journal: &JournalSpec{Dir: "/tmp/journal", FSync: "sometimes"}}))
+	assert.Error(ValidateSpec(&Spec{Journal: &JournalSpec{Dir: "/tmp/journal", FSyncInterval: "0s"}}))
+	assert.Error(ValidateSpec(&Spec{Journal: &JournalSpec{Dir: "/tmp/journal", IdempotencyWindow: "-1m"}}))
+}
+
+func TestJournalReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	backend := newMemBackend()
+	spec := &Spec{Journal: &JournalSpec{Dir: dir, FSync: FSyncAlways}}
+	now := time.Now()
+
+	store := newTestStore(spec, backend, "eg-1")
+	store.Update("req-1", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.Update("req-2", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.save(now)
+
+	// the member crashes after saving the buckets but before the journal
+	// is acknowledged.
+	assert.NoError(os.Remove(filepath.Join(dir, journalAckFile)))
+	store.Update("req-3", "alice", metric("gpt-4o", true, 100, 10), now)
+	crash(store)
+
+	// the saved records are skipped, and the one not saved is replayed.
+	store = newTestStore(spec, backend, "eg-1")
+	assert.Equal(int64(3), totalRequests(store))
+
+	// the replayed request is counted once.
+	store.Update("req-3", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now)
+	assert.Equal(int64(5), totalRequests(store))
+	store.Close()
+
+	// everything is acknowledged after close.
+	store = newTestStore(spec, backend, "eg-1")
+	defer store.Close()
+	assert.Equal(int64(5), totalRequests(store))
+	data, _ := os.ReadFile(filepath.Join(dir, journalAckFile))
+	assert.Equal("5", string(data))
+}
+
+func TestJournalEmptyRequestID(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	backend := newMemBackend()
+	spec := &Spec{Journal: &JournalSpec{Dir: dir, FSync: FSyncAlways}}
+	now := time.Now()
+
+	// the requests without IDs are never deduplicated, neither when they
+	// are updated nor when they are replayed.
+	store := newTestStore(spec, backend, "eg-1")
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now)
+	assert.Equal(int64(2), totalRequests(store))
+	crash(store)
+
+	store = newTestStore(spec, backend, "eg-1")
+	defer store.Close()
+	assert.Equal(int64(2), totalRequests(store))
+}
+
+func TestJournalNewDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newMemBackend()
+	now := time.Now()
+
+	store := newTestStore(&Spec{Journal: &JournalSpec{Dir: t.TempDir()}}, backend, "eg-1")
+	for i := 0; i < 3; i++ {
+		store.Update(fmt.Sprint("old-", i), "alice", metric("gpt-4o", true, 100, 10), now)
+	}
+	store.Close()
+
+	// the records of a new journal have smaller sequences than the saved
+	// buckets, but they are still replayed.
+	spec := &Spec{Journal: &JournalSpec{Dir: t.TempDir(), FSync: FSyncNever}}
+	store = newTestStore(spec, backend, "eg-1")
+	store.Update("new-1", "alice", metric("gpt-4o", true, 100, 10), now)
+	crash(store)
+
+	store = newTestStore(spec, backend, "eg-1")
+	defer store.Close()
+	assert.Equal(int64(4), totalRequests(store))
+}
+
+func TestJournalRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	backend := newMemBackend()
+	spec := &Spec{Journal: &JournalSpec{Dir: dir, SegmentSize: 512, IdempotencyWindow: "0s"}}
+	now := time.Now()
+
+	store := newTestStore(spec, backend, "eg-1")
+	for i := 0; i < 20; i++ {
+		store.Update("same", "alice", metric("gpt-4o", true, 100, 10), now)
+	}
+	assert.Greater(len(segmentFiles(dir)), 2)
+
+	// the acknowledged segments are deleted except the last one.
+	store.save(now)
+	assert.Len(segmentFiles(dir), 1)
+
+	// the records are not acknowledged if the save fails.
+	backend.setFail(true)
+	for i := 0; i < 20; i++ {
+		store.Update("same", "alice", metric("gpt-4o", true, 100, 10), now)
+	}
+	store.save(now)
+	assert.Greater(len(segmentFiles(dir)), 2)
+	backend.setFail(false)
+	crash(store)
+
+	store = newTestStore(spec, backend, "eg-1")
+	defer store.Close()
+	assert.Equal(int64(40), totalRequests(store))
+}
+
+func TestJournalIncompleteRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	backend := newMemBackend()
+	spec := &Spec{Journal: &JournalSpec{Dir: dir}}
+	now := time.Now()
+
+	store := newTestStore(spec, backend, "eg-1")
+	store.Update("req-1", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.Update("req-2", "alice", metric("gpt-4o", true, 100, 10), now)
+	crash(store)
+
+	// a record written partially by a crash.
+	files := segmentFiles(dir)
+	assert.Len(files, 1)
+	f, err := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0o644)
+	assert.NoError(err)
+	f.WriteString(`{"seq":3,"requestID":"req-3","sta`)
+	f.Close()
+
+	store = newTestStore(spec, backend, "eg-1")
+	assert.Equal(int64(2), totalRequests(store))
+
+	// the new records are appended to a new segment.
+	store.Update("req-3", "alice", metric("gpt-4o", true, 100, 10), now)
+	crash(store)
+	store = newTestStore(spec, backend, "eg-1")
+	defer store.Close()
+	assert.Equal(int64(3), totalRequests(store))
+}
+
+const crashHelperEnv = "USAGE_JOURNAL_CRASH_DIR"
+
+// TestJournalCrashHelper is run in a subprocess by TestJournalKill, it
+// updates the usage and reports every returned update, until killed.
+func TestJournalCrashHelper(t *testing.T) {
+	dir := os.Getenv(crashHelperEnv)
+	if dir == "" {
+		t.Skip("run by TestJournalKill")
+	}
+	spec := &Spec{Journal: &JournalSpec{Dir: dir, FSync: FSyncAlways, SegmentSize: 4096}}
+	store := newTestStore(spec, newMemBackend(), "eg-1")
+	for i := 1; ; i++ {
+		store.Update(fmt.Sprint("req-", i), "alice", metric("gpt-4o", true, 100, 10), time.Now())
+		fmt.Printf("updated %d\n", i)
+	}
+}
+
+func TestJournalKill(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestJournalCrashHelper$")
+	cmd.Env = append(os.Environ(), crashHelperEnv+"="+dir)
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(err)
+	assert.NoError(cmd.Start())
+
+	updated := 0
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() && updated < 300 {
+		if n, ok := strings.CutPrefix(scanner.Text(), "updated "); ok {
+			updated, _ = strconv.Atoi(n)
+		}
+	}
+	assert.NoError(cmd.Process.Kill())
+	cmd.Wait()
+	assert.Equal(300, updated)
+
+	// the usage of the killed member is not saved to the cluster at all,
+	// every update returned before the kill is replayed from the journal.
+	store := newTestStore(&Spec{Journal: &JournalSpec{Dir: dir}}, newMemBackend(), "eg-1")
+	defer store.Close()
+	assert.GreaterOrEqual(totalRequests(store), int64(updated))
+	assert.Greater(len(segmentFiles(dir)), 1)
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package usagestore
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultQueryLimit = 7
+	maxQueryLimit     = 1000
+)
+
+// Group-by dimensions of the usage query.
+const (
+	GroupByConsumer = "consumer"
+	GroupByProvider = "provider"
+	GroupByModel    = "model"
+)
+
+type (
+	// Query queries the usage in [StartTime, EndTime) in unix seconds,
+	// aggregated into buckets of BucketWidth.
+	Query struct {
+		StartTime   int64
+		EndTime     int64
+		BucketWidth time.Duration
+		GroupBy     []string
+		Consumers   []string
+		Providers   []string
+		Models      []string
+		// Limit is the maximum number of buckets of a page.
+		Limit int
+	}
+
+	// Page is a page of the usage, its layout follows the OpenAI usage API.
+	Page struct {
+		Object   string    `json:"object"`
+		Data     []*Bucket `json:"data"`
+		HasMore  bool      `json:"has_more"`
+		NextPage string    `json:"next_page,omitempty"`
+	}
+
+	// Bucket is the usage in [StartTime, EndTime) in unix seconds.
+	Bucket struct {
+		Object    string    `json:"object"`
+		StartTime int64     `json:"start_time"`
+		EndTime   int64     `json:"end_time"`
+		Results   []*Result `json:"results"`
+	}
+
+	// Result is the usage of a group in a bucket, the fields not in the
+	// group-by dimensions are empty.
+	Result struct {
+		Object            string  `json:"object"`
+		InputTokens       int64   `json:"input_tokens"`
+		OutputTokens      int64   `json:"output_tokens"`
+		NumModelRequests  int64   `json:"num_model_requests"`
+		NumFailedRequests int64   `json:"num_failed_requests"`
+		Cost              float64 `json:"cost"`
+		Consumer          string  `json:"consumer,omitempty"`
+		Provider          string  `json:"provider,omitempty"`
+		Model             string  `json:"model,omitempty"`
+	}
+)
+
+// parseBucketWidth parses the bucket width, the OpenAI style "1d" is
+// supported besides Go durations.
+func parseBucketWidth(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n != 1 {
+			return 0, fmt.Errorf("invalid bucket width %s", s)
+		}
+		return 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// queryList returns the values of a query parameter, it may be repeated
+// or comma separated.
+func queryList(values url.Values, name string) []string {
+	var result []string
+	for _, v := range values[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+func parseUnixTime(values url.Values, name string) (int64, error) {
+	v := values.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	t, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || t < 0 {
+		return 0, fmt.Errorf("invalid %s %s, it must be unix seconds", name, v)
+	}
+	return t, nil
+}
+
+// ParseQuery parses the query parameters of the usage API. The page
+// parameter is the cursor returned as next_page by the previous page.
+func ParseQuery(values url.Values, now time.Time) (*Query, error) {
+	q := &Query{
+		BucketWidth: 24 * time.Hour,
+		GroupBy:     queryList(values, "group_by"),
+		Consumers:   queryList(values, "consumers"),
+		Providers:   queryList(values, "providers"),
+		Models:      queryList(values, "models"),
+		Limit:       defaultQueryLimit,
+	}
+
+	var err error
+	if values.Get("start_time") == "" {
+		return nil, fmt.Errorf("start_time is required")
+	}
+	if q.StartTime, err = parseUnixTime(values, "start_time"); err != nil {
+		return nil, err
+	}
+	if q.EndTime, err = parseUnixTime(values, "end_time"); err != nil {
+		return nil, err
+	}
+	if q.EndTime == 0 {
+		q.EndTime = now.Unix()
+	}
+	if q.EndTime <= q.StartTime {
+		return nil, fmt.Errorf("end_time must be after start_time")
+	}
+
+	if v := values.Get("bucket_width"); v != "" {
+		if q.BucketWidth, err = parseBucketWidth(v); err != nil {
+			return nil, fmt.Errorf("invalid bucket_width: %w", err)
+		}
+		if err := validateWidth(q.BucketWidth); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range q.GroupBy {
+		if g != GroupByConsumer && g != GroupByProvider && g != GroupByModel {
+			return nil, fmt.Errorf("invalid group_by %s, must be one of consumer, provider and model", g)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxQueryLimit {
+			return nil, fmt.Errorf("invalid limit %s, it must be in [1, %d]", v, maxQueryLimit)
+		}
+	}
+	if v := values.Get("page"); v != "" {
+		page, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || page < q.StartTime || page >= q.EndTime {
+			return nil, fmt.Errorf("invalid page %s", v)
+		}
+		q.StartTime = page
+	}
+	return q, nil
+}
+
+// match reports whether the label passes the filters of the query.
+func (q *Query) match(label Label) bool {
+	if len(q.Consumers) > 0 && !slices.Contains(q.Consumers, label.Consumer) {
+		return false
+	}
+	if len(q.Providers) > 0 && !slices.Contains(q.Providers, label.Provider) {
+		return false
+	}
+	if len(q.Models) > 0 && !slices.Contains(q.Models, label.Model) {
+		return false
+	}
+	return true
+}
+
+// group returns the label with the dimensions not grouped by cleared.
+func (q *Query) group(label Label) Label {
+	result := Label{}
+	for _, g := range q.GroupBy {
+		switch g {
+		case GroupByConsumer:
+			result.Consumer = label.Consumer
+		case GroupByProvider:
+			result.Provider = label.Provider
+		case GroupByModel:
+			result.Model = label.Model
+		}
+	}
+	return result
+}
+
+// Query saves the usage of own member and returns the usage of all
+// members. The stored buckets are assigned to the query buckets by their
+// start time, so query buckets narrower than the stored buckets are
+// approximate.
+func (s *Store) Query(q *Query) (*Page, error) {
+	now := time.Now()
+	s.save(now)
+	stored, err := s.loadAll(now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load usage: %w", err)
+	}
+
+	width := int64(q.BucketWidth / time.Second)
+	first := q.StartTime / width * width
+	page := &Page{Object: "page", Data: []*Bucket{}}
+	end := first
+	for i := 0; i < q.Limit && end < q.EndTime; i++ {
+		end += width
+	}
+	if end < q.EndTime {
+		page.HasMore = true
+		page.NextPage = strconv.FormatInt(end, 10)
+	}
+
+	aggregated := map[int64]map[Label]*Counters{}
+	for _, b := range stored {
+		if b.Start < first || b.Start >= end || b.Start >= q.EndTime {
+			continue
+		}
+		start := b.Start / width * width
+		groups := aggregated[start]
+		if groups == nil {
+			groups = map[Label]*Counters{}
+			aggregated[start] = groups
+		}
+		for _, r := range b.Records {
+			if !q.match(r.Label) {
+				continue
+			}
+			label := q.group(r.Label)
+			counters := groups[label]
+			if counters == nil {
+				counters = &Counters{}
+				groups[label] = counters
+			}
+			counters.Requests += r.Requests
+			counters.FailedRequests += r.FailedRequests
+			counters.InputTokens += r.InputTokens
+			counters.OutputTokens += r.OutputTokens
+			counters.Cost += r.Cost
+		}
+	}
+
+	for start := first; start < end; start += width {
+		bucket := &Bucket{Object: "bucket", StartTime: start, EndTime: start + width, Results: []*Result{}}
+		for label, counters := range aggregated[start] {
+			bucket.Results = append(bucket.Results, &Result{
+				Object:            "usage.result",
+				InputTokens:       counters.InputTokens,
+				OutputTokens:      counters.OutputTokens,
+				NumModelRequests:  counters.Requests,
+				NumFailedRequests: counters.FailedRequests,
+				Cost:              counters.Cost,
+				Consumer:          label.Consumer,
+				Provider:          label.Provider,
+				Model:             label.Model,
+			})
+		}
+		sort.Slice(bucket.Results, func(i, j int) bool {
+			a, b := bucket.Results[i], bucket.Results[j]
+			if a.Consumer != b.Consumer {
+				return a.Consumer < b.Consumer
+			}
+			if a.Provider != b.Provider {
+				return a.Provider < b.Provider
+			}
+			return a.Model < b.Model
+		})
+		page.Data = append(page.Data, bucket)
+	}
+	return page, nil
+}
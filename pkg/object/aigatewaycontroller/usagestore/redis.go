@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package usagestore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/redis/rueidis"
+)
+
+const redisScanCount = 1000
+
+// redisBackend saves every bucket to a string key of Redis, the keys are
+// the same as the ones in the cluster store.
+type redisBackend struct {
+	client rueidis.Client
+}
+
+func newRedisBackend(url string) (*redisBackend, error) {
+	option, err := rueidis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+	}
+	client, err := rueidis.NewClient(option)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Redis client: %w", err)
+	}
+	return &redisBackend{client: client}, nil
+}
+
+func (b *redisBackend) Put(key, value string) error {
+	return b.client.Do(context.Background(), b.client.B().Set().Key(key).Value(value).Build()).Error()
+}
+
+func (b *redisBackend) Delete(key string) error {
+	return b.client.Do(context.Background(), b.client.B().Del().Key(key).Build()).Error()
+}
+
+// GetPrefix scans the keys of the prefix on every node, as the keys of a
+// Redis Cluster are spread over its nodes.
+func (b *redisBackend) GetPrefix(prefix string) (map[string]string, error) {
+	ctx := context.Background()
+	pattern := escapeGlob(prefix) + "*"
+	keys := []string{}
+	for _, node := range b.client.Nodes() {
+		cursor := uint64(0)
+		for {
+			entry, err := node.Do(ctx, node.B().Scan().Cursor(cursor).Match(pattern).Count(redisScanCount).Build()).AsScanEntry()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, entry.Elements...)
+			cursor = entry.Cursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	commands := make(rueidis.Commands, 0, len(keys))
+	for _, key := range keys {
+		commands = append(commands, b.client.B().Get().Key(key).Build())
+	}
+	result := make(map[string]string, len(keys))
+	for i, resp := range b.client.DoMulti(ctx, commands...) {
+		value, err := resp.ToString()
+		if rueidis.IsRedisNil(err) {
+			// deleted after the scan.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[keys[i]] = value
+	}
+	return result, nil
+}
+
+func (b *redisBackend) Close() {
+	b.client.Close()
+}
+
+// escapeGlob escapes the special characters of the glob patterns of SCAN.
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
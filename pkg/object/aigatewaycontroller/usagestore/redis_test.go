@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package usagestore
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func skipDockerTest() bool {
+	// For windows and mac, the github action runner does not support docker for now.
+	skipDocker := os.Getenv("EASEGRESS_TEST_SKIP_DOCKER")
+	return skipDocker == "true"
+}
+
+func TestEscapeGlob(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("/usage/eg-1/", escapeGlob("/usage/eg-1/"))
+	assert.Equal(`/usage/\[eg\*1\]\?\\/`, escapeGlob(`/usage/[eg*1]?\/`))
+}
+
+func TestRedisBackend(t *testing.T) {
+	if skipDockerTest() {
+		return
+	}
+	assert := assert.New(t)
+
+	ctx := context.Background()
+	redisC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "redis:latest",
+			ExposedPorts: []string{"6379/tcp"},
+			WaitingFor:   wait.ForLog("Ready to accept connections"),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create Redis container: %v", err)
+	}
+	defer testcontainers.CleanupContainer(t, redisC)
+	endpoint, err := redisC.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to get Redis container endpoint: %v", err)
+	}
+	url := "redis://" + endpoint
+
+	// the keys of other prefixes are not returned, even if the prefix has
+	// special characters of patterns.
+	backend, err := newRedisBackend(url)
+	assert.NoError(err)
+	assert.NoError(backend.Put("/usage/eg-1/1", "a"))
+	assert.NoError(backend.Put("/usage/eg-1/2", "b"))
+	assert.NoError(backend.Put("/usage/eg-2/1", "c"))
+	assert.NoError(backend.Put("/usage/eg?1/1", "d"))
+	data, err := backend.GetPrefix("/usage/eg-1/")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"/usage/eg-1/1": "a", "/usage/eg-1/2": "b"}, data)
+	data, err = backend.GetPrefix("/usage/eg?1/")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"/usage/eg?1/1": "d"}, data)
+	assert.NoError(backend.Delete("/usage/eg-1/1"))
+	data, err = backend.GetPrefix("/usage/")
+	assert.NoError(err)
+	assert.Len(data, 3)
+	backend.Close()
+
+	// the buckets saved to Redis are loaded after restart, the backend
+	// of the cluster is not used.
+	spec := &Spec{BucketWidth: "1h", Redis: &RedisSpec{URL: url}}
+	now := time.Now()
+	cluster := newMemBackend()
+	store := newTestStore(spec, cluster, "eg-3")
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.Close()
+	assert.Empty(cluster.data)
+
+	store = newTestStore(spec, cluster, "eg-3")
+	defer store.Close()
+	page, err := store.Query(&Query{
+		StartTime:   now.Add(-time.Hour).Unix(),
+		EndTime:     now.Add(time.Hour).Unix(),
+		BucketWidth: 24 * time.Hour,
+		GroupBy:     []string{GroupByConsumer},
+		Consumers:   []string{"alice"},
+		Limit:       7,
+	})
+	assert.NoError(err)
+	total := int64(0)
+	for _, bucket := range page.Data {
+		for _, result := range bucket.Results {
+			total += result.InputTokens
+		}
+	}
+	assert.Equal(int64(100), total)
+}
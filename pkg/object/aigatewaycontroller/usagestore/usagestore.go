@@ -0,0 +1,566 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package usagestore aggregates the usage of AI requests into time buckets
+// and persists them to the cluster or Redis, so usage reports survive
+// restarts.
+package usagestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/rueidis"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+const (
+	defaultBucketWidth = time.Hour
+	defaultRetention   = 30 * 24 * time.Hour
+	minBucketWidth     = time.Minute
+	saveInterval       = 5 * time.Second
+)
+
+type (
+	// Spec describes the usage store of AIGatewayController.
+	Spec struct {
+		// BucketWidth is the granularity of the aggregation, it must
+		// divide a day. Changes apply to new buckets only.
+		BucketWidth string `json:"bucketWidth,omitempty" jsonschema:"format=duration"`
+		// Retention is how long the buckets are kept.
+		Retention string        `json:"retention,omitempty" jsonschema:"format=duration"`
+		Pricing   []*ModelPrice `json:"pricing,omitempty"`
+		// Journal makes the usage crash consistent, the usage is lost
+		// if the member crashes before saving it without the journal.
+		Journal *JournalSpec `json:"journal,omitempty"`
+		// Redis saves the buckets to Redis instead of the cluster.
+		Redis *RedisSpec `json:"redis,omitempty"`
+	}
+
+	// RedisSpec describes the Redis the buckets are saved to.
+	RedisSpec struct {
+		URL string `json:"url" jsonschema:"required"`
+	}
+
+	// ModelPrice is the price of a model in USD per million tokens. The
+	// first price matching the provider and model of a request is used.
+	ModelPrice struct {
+		// Provider is the provider name, empty matches all providers.
+		Provider string `json:"provider,omitempty"`
+		// Model is a glob pattern of the model name.
+		Model            string  `json:"model" jsonschema:"required"`
+		InputPerMillion  float64 `json:"inputPerMillion,omitempty"`
+		OutputPerMillion float64 `json:"outputPerMillion,omitempty"`
+	}
+
+	// Backend persists the buckets, it is implemented by the cluster and
+	// Redis.
+	Backend interface {
+		Put(key, value string) error
+		GetPrefix(prefix string) (map[string]string, error)
+		Delete(key string) error
+	}
+
+	// Label identifies the usage of a consumer on a model in a bucket.
+	Label struct {
+		Consumer string `json:"consumer,omitempty"`
+		Provider string `json:"provider"`
+		Model    string `json:"model"`
+	}
+
+	// Counters is the aggregated usage. Like the Prometheus counters of
+	// AIGatewayController, tokens are only counted for successful requests.
+	Counters struct {
+		Requests       int64 `json:"requests"`
+		FailedRequests int64 `json:"failedRequests"`
+		InputTokens    int64 `json:"inputTokens"`
+		OutputTokens   int64 `json:"outputTokens"`
+		// Cost is in USD.
+		Cost float64 `json:"cost"`
+	}
+
+	// Record is the usage of a label in a bucket.
+	Record struct {
+		Label    `json:",inline"`
+		Counters `json:",inline"`
+	}
+
+	// bucket is the usage in [Start, Start+Width), in unix seconds.
+	// JournalSeq is the sequence of the last journal record aggregated
+	// into the bucket, the records up to it are skipped in replays.
+	bucket struct {
+		Start      int64     `json:"start"`
+		Width      int64     `json:"width"`
+		Records    []*Record `json:"records"`
+		JournalID  string    `json:"journalID,omitempty"`
+		JournalSeq int64     `json:"journalSeq,omitempty"`
+	}
+
+	// Store aggregates the usage of own member in memory and saves the
+	// changed buckets to the backend periodically. Queries merge the
+	// buckets of all members in the backend.
+	Store struct {
+		backend      Backend
+		redis        *redisBackend
+		prefix       string
+		memberPrefix string
+
+		lock      sync.Mutex
+		width     time.Duration
+		retention time.Duration
+		prices    []*ModelPrice
+		buckets   map[int64]*memBucket
+		dirty     map[int64]struct{}
+
+		journal *journal
+		// requests maps the request IDs in the idempotency window to
+		// their expiration time.
+		requests          map[string]time.Time
+		idempotencyWindow time.Duration
+
+		cost *prometheus.CounterVec
+
+		done      chan struct{}
+		closeOnce sync.Once
+		wg        sync.WaitGroup
+	}
+
+	memBucket struct {
+		width      int64
+		labels     map[Label]*Counters
+		journalID  string
+		journalSeq int64
+	}
+)
+
+// ValidateSpec validates the usage store spec.
+func ValidateSpec(spec *Spec) error {
+	if spec == nil {
+		return nil
+	}
+	if spec.BucketWidth != "" {
+		width, err := time.ParseDuration(spec.BucketWidth)
+		if err != nil {
+			return fmt.Errorf("invalid bucket width: %w", err)
+		}
+		if err := validateWidth(width); err != nil {
+			return err
+		}
+	}
+	if spec.Retention != "" {
+		retention, err := time.ParseDuration(spec.Retention)
+		if err != nil {
+			return fmt.Errorf("invalid retention: %w", err)
+		}
+		if retention <= 0 {
+			return fmt.Errorf("retention must be positive")
+		}
+	}
+	for _, price := range spec.Pricing {
+		if price.Model == "" {
+			return fmt.Errorf("model of pricing cannot be empty")
+		}
+		if _, err := path.Match(price.Model, ""); err != nil {
+			return fmt.Errorf("invalid model pattern %s: %w", price.Model, err)
+		}
+		if price.InputPerMillion < 0 || price.OutputPerMillion < 0 {
+			return fmt.Errorf("price of model %s cannot be negative", price.Model)
+		}
+	}
+	if spec.Redis != nil {
+		if _, err := rueidis.ParseURL(spec.Redis.URL); err != nil {
+			return fmt.Errorf("invalid Redis URL: %w", err)
+		}
+	}
+	return validateJournalSpec(spec.Journal)
+}
+
+// validateWidth checks the width is whole seconds and divides a day, so
+// buckets are aligned with days in UTC.
+func validateWidth(width time.Duration) error {
+	if width < minBucketWidth {
+		return fmt.Errorf("bucket width must be at least %s", minBucketWidth)
+	}
+	if width%time.Second != 0 || (24*time.Hour)%width != 0 {
+		return fmt.Errorf("bucket width %s must divide a day", width)
+	}
+	return nil
+}
+
+// New creates a usage store, it loads the buckets of own member saved
+// under memberPrefix, prefix is the prefix of the buckets of all members.
+// The buckets are saved to the backend, or to the Redis of the spec if
+// it is set. The journal of the spec is opened here and its records not
+// saved yet are replayed, changes of the journal or Redis spec require a
+// new store.
+func New(spec *Spec, backend Backend, prefix, memberPrefix string) (*Store, error) {
+	var redis *redisBackend
+	if spec.Redis != nil {
+		var err error
+		redis, err = newRedisBackend(spec.Redis.URL)
+		if err != nil {
+			return nil, err
+		}
+		backend = redis
+	}
+	s := &Store{
+		redis:        redis,
+		backend:      backend,
+		prefix:       prefix,
+		memberPrefix: memberPrefix,
+		buckets:      make(map[int64]*memBucket),
+		dirty:        make(map[int64]struct{}),
+		cost:         metricshub.UsageCost.NewCounter(),
+		requests:     make(map[string]time.Time),
+		done:         make(chan struct{}),
+	}
+	s.SetSpec(spec)
+	s.load()
+	if spec.Journal != nil {
+		s.openJournal(spec.Journal)
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// SetSpec updates the spec of the store, the aggregated usage is kept.
+func (s *Store) SetSpec(spec *Spec) {
+	width, retention := defaultBucketWidth, defaultRetention
+	if d, err := time.ParseDuration(spec.BucketWidth); err == nil {
+		width = d
+	}
+	if d, err := time.ParseDuration(spec.Retention); err == nil {
+		retention = d
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.width = width
+	s.retention = retention
+	s.prices = spec.Pricing
+}
+
+func (s *Store) load() {
+	data, err := s.backend.GetPrefix(s.memberPrefix)
+	if err != nil {
+		logger.Errorf("failed to load AI gateway usage from store: %v", err)
+		return
+	}
+	for key, value := range data {
+		b := &bucket{}
+		if err := json.Unmarshal([]byte(value), b); err != nil {
+			logger.Errorf("failed to unmarshal AI gateway usage %s: %v", key, err)
+			continue
+		}
+		mb := &memBucket{
+			width:      b.Width,
+			labels:     make(map[Label]*Counters, len(b.Records)),
+			journalID:  b.JournalID,
+			journalSeq: b.JournalSeq,
+		}
+		for _, r := range b.Records {
+			counters := r.Counters
+			mb.labels[r.Label] = &counters
+		}
+		s.buckets[b.Start] = mb
+	}
+}
+
+// openJournal opens the journal and replays the records not saved yet.
+// The records already aggregated into the saved buckets are skipped, as
+// the member may crash after saving the buckets but before acknowledging
+// the journal.
+func (s *Store) openJournal(spec *JournalSpec) {
+	j, pending, err := openJournal(spec)
+	if err != nil {
+		logger.Errorf("failed to open AI gateway usage journal, usage is not journaled: %v", err)
+		return
+	}
+	s.journal = j
+	s.idempotencyWindow = defaultIdempotencyWindow
+	if d, err := time.ParseDuration(spec.IdempotencyWindow); err == nil {
+		s.idempotencyWindow = d
+	}
+
+	now := time.Now()
+	replayed := 0
+	for _, r := range pending {
+		if s.duplicated(r.RequestID, now) {
+			continue
+		}
+		mb := s.buckets[r.Start]
+		if mb != nil && mb.journalID == j.id && r.Seq <= mb.journalSeq {
+			continue
+		}
+		s.apply(r)
+		replayed++
+	}
+	if replayed > 0 {
+		logger.Infof("replayed %d records of AI gateway usage journal", replayed)
+	}
+}
+
+func (s *Store) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.save(time.Now())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops the store and saves the changed buckets.
+func (s *Store) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+		s.save(time.Now())
+		if s.journal != nil {
+			s.journal.close()
+		}
+		if s.redis != nil {
+			s.redis.Close()
+		}
+	})
+}
+
+// Price returns the first price matching the provider and the model, or
+// nil if there is none. An empty provider only matches the prices for
+// all providers.
+func (s *Store) Price(provider, model string) *ModelPrice {
+	for _, p := range s.prices {
+		if p.Provider != "" && p.Provider != provider {
+			continue
+		}
+		if ok, _ := path.Match(p.Model, model); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// Update aggregates the usage of a request finished at now. With the
+// journal, the usage is appended to the journal first, and the usage of
+// a request ID already counted in the idempotency window is ignored. An
+// empty request ID is never deduplicated, as requests without IDs can't
+// be told apart.
+func (s *Store) Update(requestID, consumer string, metric *metricshub.Metric, now time.Time) {
+	if metric == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.journal != nil && s.duplicated(requestID, now) {
+		return
+	}
+	width := int64(s.width / time.Second)
+	r := &journalRecord{
+		RequestID:    requestID,
+		Start:        now.Unix() / width * width,
+		Width:        width,
+		Consumer:     consumer,
+		Provider:     metric.Provider,
+		Model:        metric.Model,
+		Success:      metric.Success,
+		InputTokens:  metric.InputTokens,
+		OutputTokens: metric.OutputTokens,
+	}
+	if s.journal != nil {
+		if err := s.journal.append(r); err != nil {
+			logger.Errorf("failed to append AI gateway usage journal: %v", err)
+		}
+	}
+	s.apply(r)
+}
+
+// duplicated reports whether the request ID is in the idempotency window,
+// and adds it to the window if not. It must be called with the lock held.
+func (s *Store) duplicated(requestID string, now time.Time) bool {
+	if requestID == "" || s.idempotencyWindow == 0 {
+		return false
+	}
+	if expireAt, ok := s.requests[requestID]; ok && now.Before(expireAt) {
+		return true
+	}
+	s.requests[requestID] = now.Add(s.idempotencyWindow)
+	return false
+}
+
+// apply aggregates the record, it must be called with the lock held.
+func (s *Store) apply(r *journalRecord) {
+	label := Label{Consumer: r.Consumer, Provider: r.Provider, Model: r.Model}
+	mb := s.buckets[r.Start]
+	if mb == nil {
+		mb = &memBucket{width: r.Width, labels: make(map[Label]*Counters)}
+		s.buckets[r.Start] = mb
+	}
+	if s.journal != nil && r.Seq > 0 {
+		if mb.journalID != s.journal.id || r.Seq > mb.journalSeq {
+			mb.journalID, mb.journalSeq = s.journal.id, r.Seq
+		}
+	}
+	counters := mb.labels[label]
+	if counters == nil {
+		counters = &Counters{}
+		mb.labels[label] = counters
+	}
+	s.dirty[r.Start] = struct{}{}
+
+	counters.Requests++
+	if !r.Success {
+		counters.FailedRequests++
+		return
+	}
+	counters.InputTokens += r.InputTokens
+	counters.OutputTokens += r.OutputTokens
+	if p := s.Price(r.Provider, r.Model); p != nil {
+		cost := (float64(r.InputTokens)*p.InputPerMillion + float64(r.OutputTokens)*p.OutputPerMillion) / 1e6
+		counters.Cost += cost
+		if s.cost != nil {
+			s.cost.WithLabelValues(r.Provider, r.Model).Add(cost)
+		}
+	}
+}
+
+func (s *Store) bucketKey(start int64) string {
+	return s.memberPrefix + strconv.FormatInt(start, 10)
+}
+
+// save saves the changed buckets and deletes the expired ones. The
+// journal is acknowledged up to the last record aggregated before the
+// save if all the buckets are saved.
+func (s *Store) save(now time.Time) {
+	values := map[int64]string{}
+	expired := []int64{}
+	seq := int64(0)
+
+	s.lock.Lock()
+	if s.journal != nil {
+		seq = s.journal.lastSeq()
+		for id, expireAt := range s.requests {
+			if !now.Before(expireAt) {
+				delete(s.requests, id)
+			}
+		}
+	}
+	deadline := now.Add(-s.retention).Unix()
+	for start, mb := range s.buckets {
+		if start+mb.width <= deadline {
+			expired = append(expired, start)
+			delete(s.buckets, start)
+			delete(s.dirty, start)
+		}
+	}
+	for start := range s.dirty {
+		mb := s.buckets[start]
+		b := &bucket{
+			Start:      start,
+			Width:      mb.width,
+			Records:    make([]*Record, 0, len(mb.labels)),
+			JournalID:  mb.journalID,
+			JournalSeq: mb.journalSeq,
+		}
+		for label, counters := range mb.labels {
+			b.Records = append(b.Records, &Record{Label: label, Counters: *counters})
+		}
+		data, err := json.Marshal(b)
+		if err != nil {
+			logger.Errorf("failed to marshal AI gateway usage: %v", err)
+			continue
+		}
+		values[start] = string(data)
+	}
+	s.dirty = make(map[int64]struct{})
+	s.lock.Unlock()
+
+	for _, start := range expired {
+		if err := s.backend.Delete(s.bucketKey(start)); err != nil {
+			logger.Errorf("failed to delete expired AI gateway usage: %v", err)
+		}
+	}
+	failed := []int64{}
+	for start, value := range values {
+		if err := s.backend.Put(s.bucketKey(start), value); err != nil {
+			logger.Errorf("failed to save AI gateway usage to store: %v", err)
+			failed = append(failed, start)
+		}
+	}
+	if len(failed) == 0 {
+		if s.journal != nil {
+			if err := s.journal.ack(seq); err != nil {
+				logger.Errorf("failed to acknowledge AI gateway usage journal: %v", err)
+			}
+		}
+		return
+	}
+	// saved again at the next round.
+	s.lock.Lock()
+	for _, start := range failed {
+		if _, ok := s.buckets[start]; ok {
+			s.dirty[start] = struct{}{}
+		}
+	}
+	s.lock.Unlock()
+}
+
+// loadAll loads the buckets of all members not expired at now.
+func (s *Store) loadAll(now time.Time) ([]*bucket, error) {
+	data, err := s.backend.GetPrefix(s.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	deadline := now.Add(-s.retention).Unix()
+	s.lock.Unlock()
+
+	buckets := make([]*bucket, 0, len(data))
+	for key, value := range data {
+		b := &bucket{}
+		if err := json.Unmarshal([]byte(value), b); err != nil {
+			logger.Errorf("failed to unmarshal AI gateway usage %s: %v", key, err)
+			continue
+		}
+		if b.Start+b.Width <= deadline {
+			// the buckets of members left the cluster are never deleted
+			// by themselves.
+			if !strings.HasPrefix(key, s.memberPrefix) {
+				s.backend.Delete(key)
+			}
+			continue
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package usagestore
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/aigatewaycontroller/metricshub"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	m.Run()
+}
+
+type memBackend struct {
+	lock sync.Mutex
+	data map[string]string
+	fail bool
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{data: map[string]string{}}
+}
+
+func (b *memBackend) Put(key, value string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.fail {
+		return fmt.Errorf("backend is down")
+	}
+	b.data[key] = value
+	return nil
+}
+
+func (b *memBackend) setFail(fail bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.fail = fail
+}
+
+func (b *memBackend) GetPrefix(prefix string) (map[string]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	result := map[string]string{}
+	for k, v := range b.data {
+		if strings.HasPrefix(k, prefix) {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+func (b *memBackend) Delete(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.data, key)
+	return nil
+}
+
+func newTestStore(spec *Spec, backend Backend, member string) *Store {
+	s, err := New(spec, backend, "/usage/", "/usage/"+member+"/")
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func metric(model string, success bool, input, output int64) *metricshub.Metric {
+	return &metricshub.Metric{
+		Success:      success,
+		Provider:     "openai",
+		Model:        model,
+		InputTokens:  input,
+		OutputTokens: output,
+	}
+}
+
+func TestValidateSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateSpec(nil))
+	assert.NoError(ValidateSpec(&Spec{BucketWidth: "15m", Retention: "2160h"}))
+	assert.Error(ValidateSpec(&Spec{BucketWidth: "30s"}))
+	assert.Error(ValidateSpec(&Spec{BucketWidth: "7h"}))
+	assert.Error(ValidateSpec(&Spec{BucketWidth: "1x"}))
+	assert.Error(ValidateSpec(&Spec{Retention: "-1h"}))
+	assert.Error(ValidateSpec(&Spec{Pricing: []*ModelPrice{{Model: ""}}}))
+	assert.Error(ValidateSpec(&Spec{Pricing: []*ModelPrice{{Model: "gpt-["}}}))
+	assert.Error(ValidateSpec(&Spec{Pricing: []*ModelPrice{{Model: "gpt-4o", InputPerMillion: -1}}}))
+	assert.NoError(ValidateSpec(&Spec{Redis: &RedisSpec{URL: "redis://localhost:6379"}}))
+	assert.Error(ValidateSpec(&Spec{Redis: &RedisSpec{URL: "http://localhost:6379"}}))
+}
+
+func TestParseQuery(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1760000000, 0)
+
+	q, err := ParseQuery(url.Values{"start_time": {"1759000000"}}, now)
+	assert.NoError(err)
+	assert.Equal(int64(1760000000), q.EndTime)
+	assert.Equal(24*time.Hour, q.BucketWidth)
+	assert.Equal(defaultQueryLimit, q.Limit)
+
+	q, err = ParseQuery(url.Values{
+		"start_time":   {"1759000000"},
+		"end_time":     {"1759900000"},
+		"bucket_width": {"1h"},
+		"group_by":     {"consumer,model"},
+		"models":       {"gpt-4o", "gpt-4o-mini"},
+		"limit":        {"24"},
+		"page":         {"1759003600"},
+	}, now)
+	assert.NoError(err)
+	assert.Equal(time.Hour, q.BucketWidth)
+	assert.Equal([]string{"consumer", "model"}, q.GroupBy)
+	assert.Equal([]string{"gpt-4o", "gpt-4o-mini"}, q.Models)
+	assert.Equal(24, q.Limit)
+	assert.Equal(int64(1759003600), q.StartTime)
+
+	for _, values := range []url.Values{
+		{},
+		{"start_time": {"abc"}},
+		{"start_time": {"1760000000"}, "end_time": {"1759000000"}},
+		{"start_time": {"1759000000"}, "bucket_width": {"2d"}},
+		{"start_time": {"1759000000"}, "bucket_width": {"1s"}},
+		{"start_time": {"1759000000"}, "group_by": {"project"}},
+		{"start_time": {"1759000000"}, "limit": {"0"}},
+		{"start_time": {"1759000000"}, "page": {"1"}},
+	} {
+		_, err := ParseQuery(values, now)
+		assert.Error(err, values)
+	}
+}
+
+func TestStoreQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{
+		BucketWidth: "1h",
+		Pricing: []*ModelPrice{
+			{Provider: "azure", Model: "gpt-4o", InputPerMillion: 100},
+			{Model: "gpt-4o*", InputPerMillion: 2.5, OutputPerMillion: 10},
+		},
+	}
+	backend := newMemBackend()
+	store := newTestStore(spec, backend, "eg-1")
+	defer store.Close()
+
+	day := time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	store.Update("", "alice", metric("gpt-4o", true, 1000, 100), day.Add(time.Minute))
+	store.Update("", "alice", metric("gpt-4o", true, 2000, 200), day.Add(2*time.Hour))
+	store.Update("", "alice", metric("gpt-4o", false, 0, 0), day.Add(2*time.Hour))
+	store.Update("", "bob", metric("gpt-4o-mini", true, 500, 50), day.Add(3*time.Hour))
+	store.Update("", "bob", metric("llama3", true, 500, 50), day.Add(25*time.Hour))
+
+	// another member of the cluster.
+	other := newTestStore(spec, backend, "eg-2")
+	other.Update("", "alice", metric("gpt-4o", true, 4000, 400), day.Add(time.Hour))
+	other.Close()
+
+	page, err := store.Query(&Query{
+		StartTime:   day.Unix(),
+		EndTime:     day.Add(48 * time.Hour).Unix(),
+		BucketWidth: 24 * time.Hour,
+		GroupBy:     []string{GroupByConsumer},
+		Limit:       7,
+	})
+	assert.NoError(err)
+	assert.False(page.HasMore)
+	assert.Len(page.Data, 2)
+
+	first := page.Data[0]
+	assert.Equal(day.Unix(), first.StartTime)
+	assert.Len(first.Results, 2)
+	alice, bob := first.Results[0], first.Results[1]
+	assert.Equal("alice", alice.Consumer)
+	assert.Empty(alice.Model)
+	assert.Equal(int64(4), alice.NumModelRequests)
+	assert.Equal(int64(1), alice.NumFailedRequests)
+	assert.Equal(int64(7000), alice.InputTokens)
+	assert.Equal(int64(700), alice.OutputTokens)
+	assert.InDelta(7000*2.5/1e6+700*10/1e6, alice.Cost, 1e-9)
+	assert.Equal("bob", bob.Consumer)
+	assert.Equal(int64(500), bob.InputTokens)
+
+	second := page.Data[1]
+	assert.Len(second.Results, 1)
+	assert.Zero(second.Results[0].Cost)
+
+	// filters, hourly buckets and pagination.
+	page, err = store.Query(&Query{
+		StartTime:   day.Unix(),
+		EndTime:     day.Add(24 * time.Hour).Unix(),
+		BucketWidth: time.Hour,
+		GroupBy:     []string{GroupByModel, GroupByProvider},
+		Models:      []string{"gpt-4o"},
+		Limit:       2,
+	})
+	assert.NoError(err)
+	assert.True(page.HasMore)
+	assert.Equal(fmt.Sprint(day.Add(2*time.Hour).Unix()), page.NextPage)
+	assert.Len(page.Data, 2)
+	assert.Equal(int64(1000), page.Data[0].Results[0].InputTokens)
+	assert.Equal("openai", page.Data[0].Results[0].Provider)
+	assert.Equal(int64(4000), page.Data[1].Results[0].InputTokens)
+
+	page, err = store.Query(&Query{
+		StartTime:   day.Add(22 * time.Hour).Unix(),
+		EndTime:     day.Add(24 * time.Hour).Unix(),
+		BucketWidth: time.Hour,
+		Limit:       2,
+	})
+	assert.NoError(err)
+	assert.False(page.HasMore)
+	assert.Len(page.Data, 2)
+	assert.Empty(page.Data[0].Results)
+}
+
+func TestStoreRestartAndRetention(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newMemBackend()
+	spec := &Spec{BucketWidth: "1h", Retention: "48h"}
+	now := time.Now()
+
+	store := newTestStore(spec, backend, "eg-1")
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now.Add(-72*time.Hour))
+	store.Close()
+
+	// the buckets are loaded after restart, and new usage adds to them.
+	store = newTestStore(spec, backend, "eg-1")
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.save(now)
+	store.Close()
+
+	data, _ := backend.GetPrefix("/usage/eg-1/")
+	assert.Len(data, 1)
+
+	// the buckets of a member left the cluster are deleted when expired.
+	backend.Put("/usage/eg-9/0", `{"start":0,"width":3600,"records":[]}`)
+
+	store = newTestStore(spec, backend, "eg-1")
+	defer store.Close()
+	page, err := store.Query(&Query{
+		StartTime:   now.Add(-96 * time.Hour).Unix(),
+		EndTime:     now.Add(time.Hour).Unix(),
+		BucketWidth: 24 * time.Hour,
+		Limit:       7,
+	})
+	assert.NoError(err)
+	total := int64(0)
+	for _, b := range page.Data {
+		for _, r := range b.Results {
+			total += r.InputTokens
+		}
+	}
+	assert.Equal(int64(200), total)
+	data, _ = backend.GetPrefix("/usage/eg-9/")
+	assert.Empty(data)
+}
+
+func TestStoreSaveFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newMemBackend()
+	store := newTestStore(&Spec{}, backend, "eg-1")
+	defer store.Close()
+
+	backend.setFail(true)
+	now := time.Now()
+	store.Update("", "alice", metric("gpt-4o", true, 100, 10), now)
+	store.save(now)
+	data, _ := backend.GetPrefix("/usage/")
+	assert.Empty(data)
+
+	// saved at the next round.
+	backend.setFail(false)
+	store.save(now)
+	data, _ = backend.GetPrefix("/usage/")
+	assert.Len(data, 1)
+}